@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"berty.tech/berty/v2/go/internal/attachment"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// attachmentPinning returns the pinning service of the published
+// attachments, nil if none is set.
+func attachmentPinning() (*attachment.PinningService, error) {
+	if opts.attachmentPinning == "" {
+		return nil, nil
+	}
+
+	pinning := &attachment.PinningService{Endpoint: opts.attachmentPinning}
+	if opts.attachPinningToken != "" {
+		data, err := ioutil.ReadFile(opts.attachPinningToken)
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+		pinning.Token = strings.TrimSpace(string(data))
+	}
+
+	return pinning, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"berty.tech/berty/v2/go/internal/grpcutil"
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/legacyimport"
+	"berty.tech/berty/v2/go/internal/storage"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/go-orbit-db/cache/cacheleveldown"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/hkdf"
+)
+
+// datastoreSecretInfo is the HKDF info of the datastore secret derived from
+// the device key
+const datastoreSecretInfo = "berty datastore secret"
+
+// datastoreFile returns the path of a file of the datastore directory, empty
+// with an in memory datastore.
+func datastoreFile(name string) string {
+	if opts.datastorePath == "" || opts.datastorePath == cacheleveldown.InMemoryDirectory {
+		return ""
+	}
+
+	return filepath.Join(opts.datastorePath, name)
+}
+
+// apiRootToken returns the root admin token of the client API, read from its
+// file or generated and written to it on the first run. Without a file, with
+// an in memory datastore, the token is generated for this run only.
+func apiRootToken() (string, error) {
+	path := opts.apiTokenFile
+	if path == "" {
+		path = datastoreFile("api.token")
+	}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			if token := strings.TrimSpace(string(data)); token != "" {
+				return token, nil
+			}
+		} else if !os.IsNotExist(err) {
+			return "", errcode.TODO.Wrap(err)
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err := crand.Read(raw); err != nil {
+		return "", errcode.TODO.Wrap(err)
+	}
+
+	token := hex.EncodeToString(raw)
+	if path == "" {
+		opts.logger.Warn("root API token generated for this run only", zap.String("token", token))
+		return token, nil
+	}
+
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", errcode.TODO.Wrap(err)
+	}
+
+	opts.logger.Info("root API token written", zap.String("path", path))
+
+	return token, nil
+}
+
+// newAPITokenStore returns the store of the API tokens issued by the daemon,
+// they are kept next to the datastore.
+func newAPITokenStore() (*grpcutil.TokenStore, error) {
+	root, err := apiRootToken()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := grpcutil.NewTokenStore(datastoreFile("api-tokens.json"), root)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return tokens, nil
+}
+
+// datastoreSecret returns the secret encrypting the datastore at rest, nil
+// leaves it in the clear. The datastore is encrypted in place with
+// -store-encrypt, and read with the same secret from then on by every
+// command.
+//
+// The secret is derived from the device key, the keystore holding it is then
+// left in the clear, derived reports it. A -store-key file keeps the secret
+// apart from the datastore instead, e.g. on a removable drive or a secret
+// mount, it can't be in the datastore directory.
+func datastoreSecret(ds storage.Datastore) (secret []byte, derived bool, err error) {
+	if opts.storeKeyFile != "" {
+		secret, err := datastoreKeyFile(opts.storeKeyFile)
+		return secret, false, err
+	}
+
+	encrypted, err := storage.IsEncrypted(ds)
+	if err != nil {
+		return nil, false, errcode.TODO.Wrap(err)
+	}
+
+	if !encrypted && !opts.storeEncrypt {
+		return nil, false, nil
+	}
+
+	// the keys of a legacy install are imported first, its device key would
+	// be replaced otherwise
+	if !encrypted {
+		if _, err := legacyimport.Import(ds, legacyimport.Opts{Logger: opts.logger}); err != nil {
+			return nil, false, err
+		}
+	}
+
+	ks := ipfsutil.NewDatastoreKeystore(ipfsutil.NewNamespacedDatastore(ds, legacyimport.KeystoreNamespace))
+	sk, err := bertyprotocol.NewDeviceKeystore(ks).DevicePrivKey()
+	if err != nil {
+		return nil, false, errcode.TODO.Wrap(err)
+	}
+
+	raw, err := sk.Raw()
+	if err != nil {
+		return nil, false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	secret = make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, raw, nil, []byte(datastoreSecretInfo)), secret); err != nil {
+		return nil, false, errcode.TODO.Wrap(err)
+	}
+
+	return secret, true, nil
+}
+
+// datastoreKeyFile reads the secret of the datastore from path, generated
+// with -store-encrypt if missing.
+func datastoreKeyFile(path string) ([]byte, error) {
+	if dir := datastoreFile(""); dir != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		if rel, err := filepath.Rel(absDir, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the datastore key file %q can't be in the datastore directory", path))
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		return secret, nil
+
+	case !os.IsNotExist(err):
+		return nil, errcode.TODO.Wrap(err)
+
+	case !opts.storeEncrypt:
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing datastore key file %q, see -store-encrypt", path))
+	}
+
+	secret := make([]byte, 32)
+	if _, err := crand.Read(secret); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(secret)+"\n"), 0600); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	opts.logger.Info("datastore key written, keep it safe, the datastore can't be read without it", zap.String("path", path))
+
+	return secret, nil
+}
+
+// remoteToken returns the API token sent to the remote daemon, the root
+// token of the datastore directory if none is given, so the commands run
+// next to the daemon are authenticated.
+func remoteToken() string {
+	if opts.remoteDaemonToken != "" {
+		return opts.remoteDaemonToken
+	}
+
+	path := opts.apiTokenFile
+	if path == "" {
+		path = datastoreFile("api.token")
+	}
+
+	if path == "" {
+		return ""
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// localListener reports whether a client listener is only reachable from the
+// host: on the loopback, or without any IP nor DNS name, e.g. a unix socket.
+func localListener(maddr ma.Multiaddr) bool {
+	if manet.IsIPLoopback(maddr) {
+		return true
+	}
+
+	for _, p := range maddr.Protocols() {
+		switch p.Code {
+		case ma.P_IP4, ma.P_IP6, ma.P_DNS4, ma.P_DNS6, ma.P_DNSADDR:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/backup"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+type backupFlags struct {
+	target         backup.TargetConfig
+	passphraseFile string
+	keep           int
+}
+
+func backupCommand() *ffcli.Command {
+	bf := &backupFlags{target: backup.TargetConfig{Type: backup.TargetFile}}
+
+	return &ffcli.Command{
+		Name:       "backup",
+		ShortUsage: "berty backup <subcommand> [flags] [args...]",
+		ShortHelp:  "back up the datastore encrypted to a directory, a WebDAV server or an S3-compatible endpoint, and restore it; the daemon must be stopped",
+		FlagSet:    flag.NewFlagSet("backup", flag.ExitOnError),
+		Exec:       func(context.Context, []string) error { return flag.ErrHelp },
+		Subcommands: []*ffcli.Command{
+			{
+				Name:       "run",
+				ShortUsage: "berty backup run [flags]",
+				ShortHelp:  "upload a snapshot of the datastore, only the entries changed since the last one are uploaded",
+				FlagSet:    bf.flagSet("run", true),
+				Exec: func(ctx context.Context, args []string) error {
+					return bf.withRepository(ctx, func(repository *backup.Repository) error {
+						return withBackupDatastore(func(rootDS datastore.Batching) error {
+							report, err := repository.Backup(ctx, rootDS, bertyprotocol.BackupExcluded)
+							if err != nil {
+								return errcode.TODO.Wrap(err)
+							}
+
+							fmt.Printf("snapshot %s: %d entries, %d changed, %d bytes uploaded\n",
+								report.Snapshot.ID, report.Snapshot.Entries, report.Changed, report.Uploaded)
+
+							if bf.keep > 0 {
+								pruned, err := repository.Prune(ctx, bf.keep)
+								if err != nil {
+									return errcode.TODO.Wrap(err)
+								}
+
+								fmt.Printf("pruned %d snapshots, %d packs\n", pruned.Snapshots, pruned.Packs)
+							}
+
+							return nil
+						})
+					})
+				},
+			},
+			{
+				Name:       "list",
+				ShortUsage: "berty backup list [flags]",
+				ShortHelp:  "list the snapshots of the target",
+				FlagSet:    bf.flagSet("list", false),
+				Exec: func(ctx context.Context, args []string) error {
+					return bf.withRepository(ctx, func(repository *backup.Repository) error {
+						snapshots, err := repository.Snapshots(ctx)
+						if err != nil {
+							return errcode.TODO.Wrap(err)
+						}
+
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "ID\tCREATED\tENTRIES\tSIZE")
+						for _, s := range snapshots {
+							fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", s.ID, s.CreatedAt.Local().Format(time.RFC3339), s.Entries, s.Size)
+						}
+
+						return w.Flush()
+					})
+				},
+			},
+			{
+				Name:       "restore",
+				ShortUsage: "berty backup restore [flags] [snapshot id]",
+				ShortHelp:  "replace the content of the datastore with a snapshot, the latest one by default",
+				FlagSet:    bf.flagSet("restore", false),
+				Exec: func(ctx context.Context, args []string) error {
+					if len(args) > 1 {
+						return flag.ErrHelp
+					}
+
+					id := ""
+					if len(args) == 1 {
+						id = args[0]
+					}
+
+					return bf.withRepository(ctx, func(repository *backup.Repository) error {
+						return withBackupDatastore(func(rootDS datastore.Batching) error {
+							report, err := repository.Restore(ctx, id, rootDS, bertyprotocol.BackupExcluded)
+							if err != nil {
+								return errcode.TODO.Wrap(err)
+							}
+
+							fmt.Printf("restored snapshot %s of %s: %d entries, %d deleted\n",
+								report.Snapshot.ID, report.Snapshot.CreatedAt.Local().Format(time.RFC3339), report.Snapshot.Entries, report.Deleted)
+
+							return nil
+						})
+					})
+				},
+			},
+		},
+	}
+}
+
+func (bf *backupFlags) flagSet(name string, run bool) *flag.FlagSet {
+	fs := flag.NewFlagSet("backup "+name, flag.ExitOnError)
+	fs.StringVar(&opts.datastorePath, "d", opts.datastorePath, "datastore base directory")
+	fs.StringVar(&opts.storeKeyFile, "store-key", opts.storeKeyFile, "key file of the datastore encryption, if it was encrypted with one, see the daemon")
+	fs.StringVar(&bf.passphraseFile, "passphrase-file", bf.passphraseFile, "file holding the passphrase of the backups, required")
+	fs.StringVar(&bf.target.Type, "target", bf.target.Type, "type of the target: file, webdav or s3")
+	fs.StringVar(&bf.target.Path, "path", bf.target.Path, "directory of a file target")
+	fs.StringVar(&bf.target.URL, "url", bf.target.URL, "collection URL of a WebDAV target, or endpoint of an S3 target")
+	fs.StringVar(&bf.target.Username, "username", bf.target.Username, "username of a WebDAV target")
+	fs.StringVar(&bf.target.Password, "password", bf.target.Password, "password of a WebDAV target")
+	fs.StringVar(&bf.target.Bucket, "bucket", bf.target.Bucket, "bucket of an S3 target")
+	fs.StringVar(&bf.target.Region, "region", bf.target.Region, "region of an S3 target")
+	fs.StringVar(&bf.target.AccessKey, "access-key", bf.target.AccessKey, "access key of an S3 target")
+	fs.StringVar(&bf.target.SecretKey, "secret-key", bf.target.SecretKey, "secret key of an S3 target")
+	fs.StringVar(&bf.target.Prefix, "prefix", bf.target.Prefix, "prefix of the objects on an S3 target")
+	if run {
+		fs.IntVar(&bf.keep, "keep", bf.keep, "prune the snapshots but the latest ones, none if 0")
+	}
+
+	return fs
+}
+
+// withRepository opens the repository of the target, or creates it.
+func (bf *backupFlags) withRepository(ctx context.Context, f func(repository *backup.Repository) error) error {
+	cleanup := globalPreRun()
+	defer cleanup()
+
+	if bf.passphraseFile == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing -passphrase-file"))
+	}
+
+	passphrase, err := ioutil.ReadFile(bf.passphraseFile)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	target, err := backup.NewTarget(&bf.target, nil)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	repository, err := backup.Open(ctx, target, strings.TrimSpace(string(passphrase)))
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	return f(repository)
+}
+
+func withBackupDatastore(f func(rootDS datastore.Batching) error) error {
+	rootDS, dsLock, err := getRootDatastore(opts.datastorePath)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+	if dsLock != nil {
+		defer func() { _ = dsLock.Unlock() }()
+	}
+	defer rootDS.Close()
+
+	return f(rootDS)
+}
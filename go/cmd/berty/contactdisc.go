@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	"berty.tech/berty/v2/go/internal/contactdisc"
+	"berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/internal/storage"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p"
+	libp2p_peer "github.com/libp2p/go-libp2p-core/peer"
+	libp2p_quic "github.com/libp2p/go-libp2p-quic-transport"
+	"github.com/oklog/run"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"go.uber.org/zap"
+)
+
+func contactDiscoveryCommand() *ffcli.Command {
+	var (
+		listeners          = "/ip4/0.0.0.0/tcp/4245,/ip4/0.0.0.0/udp/4245/quic"
+		keyFile            = "contact-discovery.key"
+		dbPath             = "contact-discovery.db"
+		maxTokenAccounts   = contactdisc.DefaultMaxTokenAccounts
+		maxPeerEvaluations = contactdisc.DefaultMaxPeerEvaluations
+		metricsListener    string
+	)
+
+	fs := flag.NewFlagSet("contact-discovery", flag.ExitOnError)
+	fs.StringVar(&listeners, "l", listeners, "listeners, comma separated")
+	fs.StringVar(&keyFile, "pk", keyFile, "private key file of the service, generated on the first run, the tokens of the identifiers change with it")
+	fs.StringVar(&dbPath, "db", dbPath, "directory of the datastore of the records, in memory if "+storage.InMemoryPath)
+	fs.IntVar(&maxTokenAccounts, "max-token-accounts", maxTokenAccounts, "maximum number of accounts registered for an identifier")
+	fs.IntVar(&maxPeerEvaluations, "max-peer-evaluations", maxPeerEvaluations, "maximum number of identifiers evaluated for a peer per day")
+	fs.StringVar(&metricsListener, "metrics", metricsListener, "listener of the Prometheus /metrics endpoint, e.g. /ip4/127.0.0.1/tcp/9093, disabled if empty")
+
+	return &ffcli.Command{
+		Name:       "contact-discovery",
+		ShortUsage: "berty contact-discovery [flags]",
+		ShortHelp:  "start a contact discovery service, the devices find the accounts of their address book without uploading it",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			cleanup := globalPreRun()
+			defer cleanup()
+
+			logger := opts.logger.Named("contact-discovery")
+
+			priv, err := serviceKey(logger, keyFile)
+			if err != nil {
+				return err
+			}
+
+			ds, err := storage.Open(storage.Opts{Path: dbPath})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+			defer ds.Close()
+
+			host, err := libp2p.New(ctx,
+				libp2p.DefaultTransports,
+				libp2p.Transport(libp2p_quic.NewTransport),
+				libp2p.ListenAddrStrings(strings.Split(listeners, ",")...),
+				libp2p.Identity(priv),
+			)
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+			defer host.Close()
+
+			// nil unless the metrics endpoint is enabled
+			var reg *metrics.Registry
+			if metricsListener != "" {
+				reg = metrics.New()
+				reg.RegisterHost(host)
+			}
+
+			_, err = contactdisc.NewService(host, priv, contactdisc.ServiceOpts{
+				Logger:             logger,
+				Datastore:          ds,
+				MaxTokenAccounts:   maxTokenAccounts,
+				MaxPeerEvaluations: maxPeerEvaluations,
+			})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			// the devices use one of these addrs, see -contact-discovery
+			maddrs, err := libp2p_peer.AddrInfoToP2pAddrs(&libp2p_peer.AddrInfo{ID: host.ID(), Addrs: host.Addrs()})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			for _, maddr := range maddrs {
+				logger.Info("listening", zap.Stringer("maddr", maddr))
+			}
+
+			var workers run.Group
+			if err := serveMetrics(&workers, metricsListener, reg); err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			workers.Add(func() error {
+				<-ctx.Done()
+				return nil
+			}, func(error) {
+				cancel()
+			})
+
+			return workers.Run()
+		},
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ff "github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffyaml"
+	"go.uber.org/zap"
+)
+
+// setLogLevel changes the levels of the log subsystems, e.g.
+// "info,ble-tpt=error", they are kept if level is empty.
+func setLogLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+
+	return opts.logs.SetLevels(level)
+}
+
+// syncBootstrapPeers replaces the bootstrap peers of the node by the given
+// list, in its order.
+func syncBootstrapPeers(ctx context.Context, protocol bertyprotocol.Service, addrs []string) {
+	current, err := protocol.BootstrapPeerList(ctx)
+	if err != nil {
+		opts.logger.Warn("unable to list the bootstrap peers", zap.Error(err))
+		return
+	}
+
+	wanted := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		wanted[addr] = true
+	}
+
+	known := map[string]bool{}
+	for _, p := range current {
+		if wanted[p.Addr] {
+			known[p.Addr] = true
+		} else if err := protocol.BootstrapPeerRemove(ctx, p.Addr); err != nil {
+			opts.logger.Warn("unable to remove bootstrap peer", zap.String("addr", p.Addr), zap.Error(err))
+		}
+	}
+
+	for i, addr := range addrs {
+		if known[addr] {
+			err = protocol.BootstrapPeerSetPriority(ctx, addr, i)
+		} else {
+			err = protocol.BootstrapPeerAdd(ctx, addr, i)
+		}
+
+		if err != nil {
+			opts.logger.Warn("unable to set bootstrap peer", zap.String("addr", addr), zap.Error(err))
+		}
+	}
+}
+
+// reloadDaemonConfig reads the config file again and applies its tunables:
+// the log level, the bootstrap peers, the transport priority and the announce
+// filter. The other flags are only read once, the daemon has to be restarted
+// to change them.
+func reloadDaemonConfig(ctx context.Context, protocol bertyprotocol.Service, policy *ipfsutil.TransportPolicy, announce *ipfsutil.AnnounceFilter) error {
+	reloaded := opts
+	reloaded.bootstrapPeers = stringList{values: opts.bootstrapPeers.values}
+
+	fs := newDaemonFlagSet(&reloaded)
+	fs.Init(fs.Name(), flag.ContinueOnError)
+	if err := ff.Parse(fs, []string{}, ff.WithConfigFile(opts.daemonConfig), ff.WithConfigFileParser(ffyaml.Parser)); err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	priority, err := ipfsutil.ParseTransportPriority(reloaded.transportPriority)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	announceConfig, err := ipfsutil.ParseAnnounceFilterConfig(reloaded.announceFilter)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if err := setLogLevel(reloaded.daemonLogLevel); err != nil {
+		return err
+	}
+
+	policy.SetPriority(priority)
+
+	if reloaded.announceFilter != opts.announceFilter {
+		if err := announce.SetConfig(announceConfig); err != nil {
+			return err
+		}
+	}
+
+	if reloaded.bootstrapPeers.set {
+		syncBootstrapPeers(ctx, protocol, reloaded.bootstrapPeers.values)
+	}
+
+	opts.daemonLogLevel = reloaded.daemonLogLevel
+	opts.transportPriority = reloaded.transportPriority
+	opts.announceFilter = reloaded.announceFilter
+	opts.bootstrapPeers = reloaded.bootstrapPeers
+
+	opts.logger.Info("config reloaded", zap.String("path", opts.daemonConfig))
+
+	return nil
+}
+
+// reloadConfigOnHangup reloads the config file of the daemon on each SIGHUP.
+func reloadConfigOnHangup(ctx context.Context, protocol bertyprotocol.Service, policy *ipfsutil.TransportPolicy, announce *ipfsutil.AnnounceFilter) (func() error, func(error)) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return func() error {
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, syscall.SIGHUP)
+			defer signal.Stop(sigc)
+
+			for {
+				select {
+				case <-sigc:
+					if err := reloadDaemonConfig(ctx, protocol, policy, announce); err != nil {
+						opts.logger.Error("unable to reload the config", zap.Error(err))
+					}
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}, func(error) {
+			cancel()
+		}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"berty.tech/berty/v2/go/internal/simulation"
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/oklog/run"
+	"go.uber.org/zap"
+)
+
+// runDaemonSimulation serves the client API backed by the synthetic peers of
+// a fixture, see the simulation package for the fixture format.
+func runDaemonSimulation(ctx context.Context) error {
+	f, err := os.Open(opts.daemonSimulation)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	fixture, err := simulation.ParseFixture(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	sim, err := simulation.New(ctx, simulation.Opts{
+		Logger:  opts.logger.Named("simulation"),
+		Fixture: fixture,
+	})
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+	defer sim.Close()
+
+	var workers run.Group
+	grpcServer, grpcServeMux, err := newDaemonServer(&workers)
+	if err != nil {
+		return err
+	}
+
+	// protocol
+	protocol := sim.Protocol()
+	bertyprotocol.RegisterProtocolServiceServer(grpcServer, protocol)
+	bertyprotocol.RegisterEventServiceServer(grpcServer, protocol)
+	bertyprotocol.RegisterPeerServiceServer(grpcServer, protocol)
+	bertyprotocol.RegisterWebhookServiceServer(grpcServer, protocol)
+	if err := bertyprotocol.RegisterProtocolServiceHandlerServer(ctx, grpcServeMux, protocol); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	// messenger
+	protocolClient, err := bertyprotocol.NewClient(protocol)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+	defer protocolClient.Close()
+
+	messenger := bertymessenger.New(protocolClient, &bertymessenger.Opts{
+		Logger:          opts.logger.Named("messenger"),
+		ProtocolService: protocol,
+	})
+	bertymessenger.RegisterMessengerServiceServer(grpcServer, messenger)
+	if err := bertymessenger.RegisterMessengerServiceHandlerServer(ctx, grpcServeMux, messenger); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	// timeline
+	ctx, cancel := context.WithCancel(ctx)
+	workers.Add(func() error {
+		if err := sim.Run(ctx); err != nil && err != context.Canceled {
+			return err
+		}
+
+		opts.logger.Info("simulation timeline replayed")
+		<-ctx.Done()
+		return nil
+	}, func(error) {
+		cancel()
+	})
+
+	opts.logger.Info("simulation initialized", zap.String("fixture", opts.daemonSimulation))
+	return workers.Run()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"berty.tech/berty/v2/go/internal/grpcutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	grpcgw "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"github.com/oklog/run"
+	"go.uber.org/zap"
+)
+
+// serveGateway serves the HTTP/JSON gateway of the client API on the gateway
+// listener, if any.
+func serveGateway(workers *run.Group, mux *grpcgw.ServeMux, tokens *grpcutil.TokenStore) error {
+	if opts.gatewayListener == "" {
+		return nil
+	}
+
+	maddr, err := parseAddr(opts.gatewayListener)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	l, err := manet.Listen(maddr)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	server := http.Server{
+		Handler: grpcutil.NewGatewayHandler(mux, grpcutil.GatewayOpts{
+			Logger:     opts.logger.Named("gateway"),
+			Tokens:     tokens,
+			OpenAPIDir: opts.gatewayOpenAPIDir,
+		}),
+	}
+
+	workers.Add(func() error {
+		opts.logger.Info("serving gateway", zap.String("maddr", maddr.String()))
+		return server.Serve(manet.NetListener(l))
+	}, func(error) {
+		l.Close()
+	})
+
+	return nil
+}
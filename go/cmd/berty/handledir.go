@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/handledir"
+	"berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/internal/storage"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p"
+	libp2p_peer "github.com/libp2p/go-libp2p-core/peer"
+	libp2p_quic "github.com/libp2p/go-libp2p-quic-transport"
+	"github.com/oklog/run"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"go.uber.org/zap"
+)
+
+func handleDirectoryCommand() *ffcli.Command {
+	var (
+		listeners       = "/ip4/0.0.0.0/tcp/4243,/ip4/0.0.0.0/udp/4243/quic"
+		keyFile         = "handle-directory.key"
+		dbPath          = "handle-directory.db"
+		maxChainLength  = handledir.DefaultMaxChainLength
+		maxPeerRequests = handledir.DefaultMaxPeerRequests
+		metricsListener string
+	)
+
+	fs := flag.NewFlagSet("handle-directory", flag.ExitOnError)
+	fs.StringVar(&listeners, "l", listeners, "listeners, comma separated")
+	fs.StringVar(&keyFile, "pk", keyFile, "private key file of the directory, generated on the first run, it signs the receipts of the lookups")
+	fs.StringVar(&dbPath, "db", dbPath, "directory of the datastore of the handles, in memory if "+storage.InMemoryPath)
+	fs.IntVar(&maxChainLength, "max-chain-length", maxChainLength, "maximum number of records of a handle")
+	fs.IntVar(&maxPeerRequests, "max-peer-requests", maxPeerRequests, "maximum number of requests of a peer per minute")
+	fs.StringVar(&metricsListener, "metrics", metricsListener, "listener of the Prometheus /metrics endpoint, e.g. /ip4/127.0.0.1/tcp/9093, disabled if empty")
+
+	return &ffcli.Command{
+		Name:       "handle-directory",
+		ShortUsage: "berty handle-directory [flags]",
+		ShortHelp:  "start a directory of the handles registered by the accounts, the records are signed by them and can't be forged",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			cleanup := globalPreRun()
+			defer cleanup()
+
+			logger := opts.logger.Named("handle-directory")
+
+			priv, err := serviceKey(logger, keyFile)
+			if err != nil {
+				return err
+			}
+
+			ds, err := storage.Open(storage.Opts{Path: dbPath})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+			defer ds.Close()
+
+			host, err := libp2p.New(ctx,
+				libp2p.DefaultTransports,
+				libp2p.Transport(libp2p_quic.NewTransport),
+				libp2p.ListenAddrStrings(strings.Split(listeners, ",")...),
+				libp2p.Identity(priv),
+			)
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+			defer host.Close()
+
+			// nil unless the metrics endpoint is enabled
+			var reg *metrics.Registry
+			if metricsListener != "" {
+				reg = metrics.New()
+				reg.RegisterHost(host)
+			}
+
+			_, err = handledir.NewDirectory(host, priv, handledir.DirectoryOpts{
+				Logger:            logger,
+				Datastore:         ds,
+				MaxChainLength:    maxChainLength,
+				MaxPeerRequests:   maxPeerRequests,
+				PeerRequestWindow: time.Minute,
+			})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			// the devices use one of these addrs, see -handle-directory
+			maddrs, err := libp2p_peer.AddrInfoToP2pAddrs(&libp2p_peer.AddrInfo{ID: host.ID(), Addrs: host.Addrs()})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			for _, maddr := range maddrs {
+				logger.Info("listening", zap.Stringer("maddr", maddr))
+			}
+
+			var workers run.Group
+			if err := serveMetrics(&workers, metricsListener, reg); err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			workers.Add(func() error {
+				<-ctx.Done()
+				return nil
+			}, func(error) {
+				cancel()
+			})
+
+			return workers.Run()
+		},
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/linkpreview"
+	"berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/internal/storage"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p"
+	libp2p_host "github.com/libp2p/go-libp2p-core/host"
+	libp2p_peer "github.com/libp2p/go-libp2p-core/peer"
+	libp2p_quic "github.com/libp2p/go-libp2p-quic-transport"
+	"github.com/oklog/run"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"go.uber.org/zap"
+)
+
+func linkPreviewRelayCommand() *ffcli.Command {
+	var (
+		listeners       = "/ip4/0.0.0.0/tcp/4244,/ip4/0.0.0.0/udp/4244/quic"
+		keyFile         = "link-preview-relay.key"
+		dbPath          = storage.InMemoryPath
+		maxPeerRequests = linkpreview.DefaultMaxPeerRequests
+		metricsListener string
+	)
+
+	fs := flag.NewFlagSet("link-preview-relay", flag.ExitOnError)
+	fs.StringVar(&listeners, "l", listeners, "listeners, comma separated")
+	fs.StringVar(&keyFile, "pk", keyFile, "private key file of the relay, generated on the first run")
+	fs.StringVar(&dbPath, "db", dbPath, "directory of the cache of the previews, in memory if "+storage.InMemoryPath)
+	fs.IntVar(&maxPeerRequests, "max-peer-requests", maxPeerRequests, "maximum number of previews a peer can ask per minute")
+	fs.StringVar(&metricsListener, "metrics", metricsListener, "listener of the Prometheus /metrics endpoint, e.g. /ip4/127.0.0.1/tcp/9094, disabled if empty")
+
+	return &ffcli.Command{
+		Name:       "link-preview-relay",
+		ShortUsage: "berty link-preview-relay [flags]",
+		ShortHelp:  "start a relay fetching the link previews for the devices, the linked servers only see its IP",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			cleanup := globalPreRun()
+			defer cleanup()
+
+			logger := opts.logger.Named("link-preview-relay")
+
+			priv, err := serviceKey(logger, keyFile)
+			if err != nil {
+				return err
+			}
+
+			ds, err := storage.Open(storage.Opts{Path: dbPath})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+			defer ds.Close()
+
+			host, err := libp2p.New(ctx,
+				libp2p.DefaultTransports,
+				libp2p.Transport(libp2p_quic.NewTransport),
+				libp2p.ListenAddrStrings(strings.Split(listeners, ",")...),
+				libp2p.Identity(priv),
+			)
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+			defer host.Close()
+
+			// nil unless the metrics endpoint is enabled
+			var reg *metrics.Registry
+			if metricsListener != "" {
+				reg = metrics.New()
+				reg.RegisterHost(host)
+			}
+
+			_, err = linkpreview.NewRelay(host, linkpreview.RelayOpts{
+				Logger:            logger,
+				Datastore:         ds,
+				MaxPeerRequests:   maxPeerRequests,
+				PeerRequestWindow: time.Minute,
+			})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			// the devices use one of these addrs, see -link-preview-relay
+			maddrs, err := libp2p_peer.AddrInfoToP2pAddrs(&libp2p_peer.AddrInfo{ID: host.ID(), Addrs: host.Addrs()})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			for _, maddr := range maddrs {
+				logger.Info("listening", zap.Stringer("maddr", maddr))
+			}
+
+			var workers run.Group
+			if err := serveMetrics(&workers, metricsListener, reg); err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			workers.Add(func() error {
+				<-ctx.Done()
+				return nil
+			}, func(error) {
+				cancel()
+			})
+
+			return workers.Run()
+		},
+	}
+}
+
+// newLinkPreviewFetcher returns the fetcher of the -link-previews route, nil
+// if disabled.
+func newLinkPreviewFetcher(ctx context.Context, logger *zap.Logger, host libp2p_host.Host, proxyOpts ipfsutil.ProxyOpts) (*linkpreview.Fetcher, error) {
+	if opts.linkPreviews == "" {
+		return nil, nil
+	}
+
+	route, err := linkpreview.ParseRoute(opts.linkPreviews)
+	if err != nil {
+		return nil, err
+	}
+
+	fopts := linkpreview.Opts{
+		Logger: logger,
+		Route:  route,
+		Host:   host,
+	}
+
+	switch route {
+	case linkpreview.RouteProxy:
+		fopts.Proxy, err = proxyOpts.Dialer()
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		if fopts.Proxy == nil {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("-link-previews=proxy needs -proxy"))
+		}
+	case linkpreview.RouteRelay:
+		fopts.Relay, err = ipfsutil.ParseAndResolveIpfsAddr(ctx, opts.linkPreviewRelay)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+	}
+
+	return linkpreview.NewFetcher(fopts)
+}
@@ -24,6 +24,7 @@ func main() {
 	globalFlags.StringVar(&opts.logToFile, "logfile", opts.logToFile, "if specified, will log everything in JSON into a file and nothing on stderr")
 	globalFlags.StringVar(&opts.logFormat, "logformat", opts.logFormat, "if specified, will override default log format")
 	globalFlags.StringVar(&opts.tracer, "tracer", opts.tracer, `specify "stdout" to output tracing on stdout or <hostname:port> to trace on jaeger`)
+	globalFlags.Float64Var(&opts.tracerRatio, "tracer-ratio", opts.tracerRatio, "fraction of the traces exported, e.g. 0.1 on the busy nodes")
 	globalFlags.BoolVar(&opts.localDiscovery, "localdiscovery", opts.localDiscovery, "local discovery")
 
 	root := &ffcli.Command{
@@ -39,6 +40,14 @@ func main() {
 			systemInfoCommand(),
 			groupinitCommand(),
 			shareInviteCommand(),
+			stateDiffCommand(),
+			migrateCommand(),
+			backupCommand(),
+			peersCommand(),
+			pushRelayCommand(),
+			handleDirectoryCommand(),
+			linkPreviewRelayCommand(),
+			contactDiscoveryCommand(),
 		},
 	}
 
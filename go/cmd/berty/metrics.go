@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"github.com/oklog/run"
+	"go.uber.org/zap"
+)
+
+// serveMetrics serves the Prometheus metrics of the node on /metrics of the
+// listener, if any. The endpoint isn't authenticated, it should only be
+// reachable by the monitoring.
+func serveMetrics(workers *run.Group, listener string, reg *metrics.Registry) error {
+	if listener == "" {
+		return nil
+	}
+
+	maddr, err := parseAddr(listener)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	l, err := manet.Listen(maddr)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg.Handler())
+	server := http.Server{Handler: mux}
+
+	workers.Add(func() error {
+		opts.logger.Info("serving metrics", zap.String("maddr", maddr.String()))
+		return server.Serve(manet.NetListener(l))
+	}, func(error) {
+		l.Close()
+	})
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"berty.tech/berty/v2/go/internal/storage"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func migrateCommand() *ffcli.Command {
+	var (
+		target int
+		dryRun bool
+	)
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.StringVar(&opts.datastorePath, "d", opts.datastorePath, "datastore base directory")
+	fs.StringVar(&opts.storeKeyFile, "store-key", opts.storeKeyFile, "key file of the datastore encryption, if it was encrypted with one, see the daemon")
+	fs.IntVar(&target, "to", 0, "schema version to migrate to, an older one rolls back the migrations, the latest version if 0")
+	fs.BoolVar(&dryRun, "dry-run", false, "report the changes of the migrations without writing them")
+
+	return &ffcli.Command{
+		Name:      "migrate",
+		ShortHelp: "migrate the datastore schema, e.g. to roll it back before a downgrade, the daemon migrates it to the latest version on startup",
+		FlagSet:   fs,
+		Exec: func(ctx context.Context, args []string) error {
+			cleanup := globalPreRun()
+			defer cleanup()
+
+			rootDS, dsLock, err := getRootDatastore(opts.datastorePath)
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+			if dsLock != nil {
+				defer func() { _ = dsLock.Unlock() }()
+			}
+			defer rootDS.Close()
+
+			report, err := storage.Migrate(rootDS, bertyprotocol.DatastoreMigrations(), storage.MigrateOpts{Target: target, DryRun: dryRun})
+			if report != nil {
+				for _, step := range report.Steps {
+					action := "migrated to"
+					if step.Rollback {
+						action = "rolled back"
+					}
+
+					fmt.Printf("%s %d %q: %d puts, %d deletes\n", action, step.Version, step.Name, step.Puts, step.Deletes)
+				}
+			}
+
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			if dryRun {
+				fmt.Printf("dry run, the datastore is still at version %d\n", report.From)
+			} else {
+				fmt.Printf("datastore at version %d\n", report.To)
+			}
+
+			return nil
+		},
+	}
+}
@@ -20,6 +20,7 @@ func miniCommand() *ffcli.Command {
 	miniFlags.StringVar(&opts.datastorePath, "d", opts.datastorePath, "datastore base directory")
 	miniFlags.UintVar(&opts.miniPort, "p", opts.miniPort, "default IPFS listen port")
 	miniFlags.StringVar(&opts.remoteDaemonAddr, "r", opts.remoteDaemonAddr, "remote berty daemon")
+	miniFlags.StringVar(&opts.remoteDaemonToken, "r-token", opts.remoteDaemonToken, "API token of the remote berty daemon")
 	miniFlags.StringVar(&opts.rdvpMaddr, "rdvp", opts.rdvpMaddr, "rendezvous point maddr")
 	miniFlags.BoolVar(&opts.miniInMemory, "inmem", opts.miniInMemory, "disable persistence")
 
@@ -66,6 +67,7 @@ func miniCommand() *ffcli.Command {
 
 			err = mini.Main(ctx, &mini.Opts{
 				RemoteAddr:      opts.remoteDaemonAddr,
+				RemoteToken:     remoteToken(),
 				GroupInvitation: opts.miniGroup,
 				Port:            opts.miniPort,
 				RootDS:          rootDS,
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"berty.tech/berty/v2/go/internal/grpcutil"
 	"berty.tech/berty/v2/go/internal/ipfsutil"
 	"berty.tech/berty/v2/go/internal/tinder"
 	"berty.tech/berty/v2/go/internal/tracer"
@@ -38,6 +39,7 @@ type Opts struct {
 	RendezVousPeer *peer.AddrInfo
 
 	RemoteAddr      string
+	RemoteToken     string
 	GroupInvitation string
 	Port            uint
 	RootDS          datastore.Batching
@@ -91,6 +93,7 @@ func newService(ctx context.Context, logger *zap.Logger, opts *Opts) (bertyproto
 	var ps *pubsub.PubSub
 	api, node, err := ipfsutil.NewCoreAPIFromDatastore(ctx, ipfsDS, &ipfsutil.CoreAPIConfig{
 		DisableCorePubSub: true,
+		DisableMDNS:       !opts.LocalDiscovery,
 		BootstrapAddrs:    opts.Bootstrap,
 		SwarmAddrs:        swarmAddresses,
 		HostConfig: func(h host.Host, _ routing.Routing) error {
@@ -201,9 +204,19 @@ func Main(ctx context.Context, opts *Opts) error {
 
 		client = protocolClient
 	} else {
-		cc, err := grpc.Dial(opts.RemoteAddr, append([]grpc.DialOption{grpc.WithInsecure()},
-			clientOpts...,
-		)...)
+		// the remote daemon may be older or newer than this client
+		versionOpts := grpcutil.VersionOpts{Logger: opts.Logger}
+		dialOpts := []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithChainUnaryInterceptor(grpcutil.VersionUnaryClientInterceptor(versionOpts)),
+			grpc.WithChainStreamInterceptor(grpcutil.VersionStreamClientInterceptor(versionOpts)),
+		}
+
+		if opts.RemoteToken != "" {
+			dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(grpcutil.TokenCredentials(opts.RemoteToken)))
+		}
+
+		cc, err := grpc.Dial(opts.RemoteAddr, append(dialOpts, clientOpts...)...)
 		if err != nil {
 			return errcode.TODO.Wrap(err)
 		}
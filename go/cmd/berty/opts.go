@@ -16,12 +16,14 @@ import (
 
 	"berty.tech/berty/v2/go/internal/config"
 	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/legacyimport"
+	"berty.tech/berty/v2/go/internal/logutil"
+	"berty.tech/berty/v2/go/internal/storage"
 	"berty.tech/berty/v2/go/internal/tracer"
 	"berty.tech/berty/v2/go/pkg/errcode"
 	"berty.tech/go-orbit-db/cache/cacheleveldown"
 	datastore "github.com/ipfs/go-datastore"
 	sync_ds "github.com/ipfs/go-datastore/sync"
-	badger "github.com/ipfs/go-ds-badger"
 	ipfs_log "github.com/ipfs/go-log/v2"
 	"github.com/juju/fslock"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -39,10 +41,15 @@ type mainOpts struct {
 	logFormat      string
 	logToFile      string
 	logger         *zap.Logger
+	logs           *logutil.Manager
 	orbitDebug     bool
 	poiDebug       bool
 	tracer         string
+	tracerRatio    float64
 	datastorePath  string
+	storeBackend   string
+	storeEncrypt   bool
+	storeKeyFile   string
 
 	// more specific
 	bannerLight           bool
@@ -50,9 +57,72 @@ type mainOpts struct {
 	displayName           string
 	infoRefreshEvery      time.Duration
 	rdvpForce             bool
+	legacyImportDryRun    bool
+	quicDisable           bool
+	quicPort              uint
 	rdvpMaddr             string
+	rdvpServe             bool
+	rdvpServeDB           string
+	dhtDisable            bool
+	announceAddrs         string
+	announceFilter        string
+	relayDisable          bool
+	relayService          bool
+	interopStats          bool
+	interopStatsCollect   bool
+	storeForward          bool
+	hybridKEM             bool
+	envelopeCompression   bool
+	pushRelay             string
+	handleDirectory       string
+	contactDiscovery      string
+	contactRequestPoW     int
+	requestQuarantine     int
+	linkPreviews          string
+	linkPreviewRelay      string
+	xmppServer            string
+	xmppDomain            string
+	xmppSecretFile        string
+	xmppOwner             string
+	attachmentQuota       int64
+	attachmentPublish     int64
+	attachmentPinning     string
+	attachPinningToken    string
+	transportPriority     string
+	multipathPolicy       string
+	devChaos              string
+	swarmKeyPath          string
+	connLowWater          int
+	connHighWater         int
+	connGracePeriod       time.Duration
+	maxPendingDials       int
+	maxPendingHandshakes  int
+	wsPort                uint
+	wssPort               uint
+	wssCert               string
+	wssKey                string
+	torEnable             bool
+	torSocksAddr          string
+	torControlAddr        string
+	torStrict             bool
+	proxyAddr             string
+	proxyOverrides        string
+	proxyFallbackDirect   bool
 	remoteDaemonAddr      string
+	remoteDaemonToken     string
+	peersRemoteAddr       string
 	daemonListeners       string
+	daemonConfig          string
+	daemonHeadless        bool
+	daemonLogLevel        string
+	bootstrapPeers        stringList
+	gatewayListener       string
+	metricsListener       string
+	apiTokenFile          string
+	apiAuth               bool
+	gatewayOpenAPIDir     string
+	daemonSimulation      string
+	daemonStateSnapshot   string
 	miniPort              uint
 	miniGroup             string
 	miniInMemory          bool
@@ -73,6 +143,7 @@ func newMainOpts() mainOpts {
 		orbitDebug:     false,
 		poiDebug:       false,
 		tracer:         "",
+		tracerRatio:    1,
 		datastorePath:  cacheleveldown.InMemoryDirectory,
 
 		miniPort:              0,
@@ -83,9 +154,15 @@ func newMainOpts() mainOpts {
 		displayName:           safeDefaultDisplayName(),
 		infoRefreshEvery:      time.Duration(0),
 		rdvpForce:             false,
+		legacyImportDryRun:    false,
 		rdvpMaddr:             config.BertyDev.RendezVousPeer,
+		torSocksAddr:          ipfsutil.DefaultTorSocksAddr,
+		relayService:          true,
 		remoteDaemonAddr:      "",
+		peersRemoteAddr:       "127.0.0.1:9091",
 		daemonListeners:       "/ip4/127.0.0.1/tcp/9091/grpc",
+		apiAuth:               true,
+		bootstrapPeers:        stringList{values: config.BertyDev.Bootstrap},
 		shareInviteOnDev:      false,
 		shareInviteReset:      false,
 		shareInviteNoTerminal: false,
@@ -116,17 +193,71 @@ func getRootDatastore(optPath string) (datastore.Batching, *fslock.Lock, error)
 			return nil, nil, err
 		}
 
-		baseDS, err = badger.NewDatastore(basePath, nil)
+		backend, err := storage.ParseBackend(opts.storeBackend)
 		if err != nil {
+			return nil, nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		// the backend of an existing datastore is detected, badger by default
+		rawDS, err := storage.Open(storage.Opts{Backend: backend, Path: basePath})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		secret, derived, err := datastoreSecret(rawDS)
+		if err != nil {
+			rawDS.Close()
 			return nil, nil, err
 		}
 
+		baseDS = rawDS
+		if secret != nil {
+			var clear []datastore.Key
+			if derived {
+				clear = []datastore.Key{legacyimport.KeystoreNamespace}
+			}
+
+			if baseDS, err = storage.NewEncrypted(rawDS, secret, clear...); err != nil {
+				rawDS.Close()
+				return nil, nil, err
+			}
+		}
+
 		baseDS = sync_ds.MutexWrap(baseDS)
 	}
 
 	return baseDS, lock, nil
 }
 
+// stringList is a flag of comma-separated values, it can be repeated, e.g. by
+// the lists of a config file. Its defaults are replaced by the first value.
+type stringList struct {
+	values []string
+	set    bool
+}
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(l.values, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	if !l.set {
+		l.values, l.set = nil, true
+	}
+
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l.values = append(l.values, v)
+		}
+	}
+
+	return nil
+}
+
 func parseAddr(addr string) (maddr ma.Multiaddr, err error) {
 	maddr, err = ma.NewMultiaddr(addr)
 	if err != nil {
@@ -188,7 +319,7 @@ func safeDefaultDisplayName() string {
 func globalPreRun() func() {
 	mrand.Seed(srand.Secure())
 	isDebugEnabled := opts.debug || opts.orbitDebug || opts.libp2pDebug || opts.poiDebug
-	flush := tracer.InitTracer(opts.tracer, "berty")
+	flush := tracer.InitTracer(opts.tracer, "berty", opts.tracerRatio)
 
 	// setup zap config
 	var config zap.Config
@@ -219,17 +350,22 @@ func globalPreRun() func() {
 		}
 	}
 
+	level := zap.InfoLevel
 	if isDebugEnabled {
-		config.Level.SetLevel(zap.DebugLevel)
-	} else {
-		config.Level.SetLevel(zap.InfoLevel)
+		level = zap.DebugLevel
 	}
 
-	var err error
-	if opts.logger, err = config.Build(); err != nil {
+	// the levels are changed at runtime by subsystem, e.g. by the daemon
+	config.Level.SetLevel(zap.DebugLevel)
+
+	logger, err := config.Build()
+	if err != nil {
 		log.Fatalf("unable to build log config: %s", err)
 	}
 
+	opts.logs = logutil.New(logger, logutil.Opts{Level: level})
+	opts.logger = opts.logs.Logger()
+
 	ipfs_log.SetupLogging(ipfs_log.Config{
 		Stderr: false,
 		Stdout: false,
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/grpcutil"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"google.golang.org/grpc"
+)
+
+func peersCommand() *ffcli.Command {
+	var listBanned bool
+
+	listFlags := newPeersFlagSet("list")
+	listFlags.BoolVar(&listBanned, "banned", listBanned, "list the banned peers instead of the connected ones")
+
+	return &ffcli.Command{
+		Name:       "peers",
+		ShortUsage: "berty peers <subcommand> [flags] [args...]",
+		ShortHelp:  "inspect and manage the peers of a running daemon",
+		FlagSet:    flag.NewFlagSet("peers", flag.ExitOnError),
+		Exec:       func(context.Context, []string) error { return flag.ErrHelp },
+		Subcommands: []*ffcli.Command{
+			{
+				Name:       "list",
+				ShortUsage: "berty peers list [flags]",
+				ShortHelp:  "list the connected peers with their transports, latency and bandwidth",
+				FlagSet:    listFlags,
+				Exec: func(ctx context.Context, args []string) error {
+					return withPeerService(ctx, func(client bertyprotocol.PeerServiceClient) error {
+						ret, err := client.PeerList(ctx, &bertyprotocol.PeerList_Request{Banned: listBanned})
+						if err != nil {
+							return errcode.TODO.Wrap(err)
+						}
+
+						printPeers(ret.Peers)
+						return nil
+					})
+				},
+			},
+			{
+				Name:       "info",
+				ShortUsage: "berty peers info [flags] <peer id>",
+				ShortHelp:  "describe a peer: transports, addresses, latency, bandwidth and protocols",
+				FlagSet:    newPeersFlagSet("info"),
+				Exec: peerExec(func(ctx context.Context, client bertyprotocol.PeerServiceClient, arg string) error {
+					ret, err := client.PeerInfo(ctx, &bertyprotocol.PeerInfo_Request{PeerID: arg})
+					if err != nil {
+						return errcode.TODO.Wrap(err)
+					}
+
+					printPeerInfo(ret.Peer)
+					return nil
+				}),
+			},
+			{
+				Name:       "connect",
+				ShortUsage: "berty peers connect [flags] <maddr>",
+				ShortHelp:  "dial a peer, e.g. /ip4/1.2.3.4/tcp/4040/p2p/<peer id>",
+				FlagSet:    newPeersFlagSet("connect"),
+				Exec: peerExec(func(ctx context.Context, client bertyprotocol.PeerServiceClient, arg string) error {
+					ret, err := client.PeerConnect(ctx, &bertyprotocol.PeerConnect_Request{Addr: arg})
+					if err != nil {
+						return errcode.TODO.Wrap(err)
+					}
+
+					printPeerInfo(ret.Peer)
+					return nil
+				}),
+			},
+			{
+				Name:       "disconnect",
+				ShortUsage: "berty peers disconnect [flags] <peer id>",
+				ShortHelp:  "close the connections of a peer, it may reconnect",
+				FlagSet:    newPeersFlagSet("disconnect"),
+				Exec: peerExec(func(ctx context.Context, client bertyprotocol.PeerServiceClient, arg string) error {
+					if _, err := client.PeerDisconnect(ctx, &bertyprotocol.PeerDisconnect_Request{PeerID: arg}); err != nil {
+						return errcode.TODO.Wrap(err)
+					}
+
+					return nil
+				}),
+			},
+			{
+				Name:       "ban",
+				ShortUsage: "berty peers ban [flags] <peer id>",
+				ShortHelp:  "refuse the connections of a peer until the daemon is restarted",
+				FlagSet:    newPeersFlagSet("ban"),
+				Exec: peerExec(func(ctx context.Context, client bertyprotocol.PeerServiceClient, arg string) error {
+					if _, err := client.PeerBan(ctx, &bertyprotocol.PeerBan_Request{PeerID: arg}); err != nil {
+						return errcode.TODO.Wrap(err)
+					}
+
+					return nil
+				}),
+			},
+			{
+				Name:       "unban",
+				ShortUsage: "berty peers unban [flags] <peer id>",
+				ShortHelp:  "accept the connections of a banned peer again",
+				FlagSet:    newPeersFlagSet("unban"),
+				Exec: peerExec(func(ctx context.Context, client bertyprotocol.PeerServiceClient, arg string) error {
+					if _, err := client.PeerUnban(ctx, &bertyprotocol.PeerUnban_Request{PeerID: arg}); err != nil {
+						return errcode.TODO.Wrap(err)
+					}
+
+					return nil
+				}),
+			},
+		},
+	}
+}
+
+func newPeersFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("peers "+name, flag.ExitOnError)
+	fs.StringVar(&opts.peersRemoteAddr, "r", opts.peersRemoteAddr, "remote berty daemon")
+	fs.StringVar(&opts.remoteDaemonToken, "r-token", opts.remoteDaemonToken, "API token of the remote berty daemon, with the admin scope")
+	return fs
+}
+
+// peerExec returns the exec of a subcommand taking a single argument.
+func peerExec(f func(ctx context.Context, client bertyprotocol.PeerServiceClient, arg string) error) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return flag.ErrHelp
+		}
+
+		return withPeerService(ctx, func(client bertyprotocol.PeerServiceClient) error {
+			return f(ctx, client, args[0])
+		})
+	}
+}
+
+// withPeerService calls f with a client of the peer service of the remote
+// daemon.
+func withPeerService(ctx context.Context, f func(client bertyprotocol.PeerServiceClient) error) error {
+	cleanup := globalPreRun()
+	defer cleanup()
+
+	// the remote daemon may be older or newer than this client
+	versionOpts := grpcutil.VersionOpts{Logger: opts.logger}
+	dialOpts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(grpcutil.VersionUnaryClientInterceptor(versionOpts)),
+	}
+
+	if token := remoteToken(); token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(grpcutil.TokenCredentials(token)))
+	}
+
+	cc, err := grpc.DialContext(ctx, opts.peersRemoteAddr, dialOpts...)
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+	defer cc.Close()
+
+	return f(bertyprotocol.NewPeerServiceClient(cc))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatLatency(latency int64) string {
+	if latency == 0 {
+		return "-"
+	}
+
+	return time.Duration(latency).Round(100 * time.Microsecond).String()
+}
+
+func printPeers(peers []*bertyprotocol.PeerInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tTRANSPORTS\tADDR\tLATENCY\tIN\tOUT\tRATE IN/OUT")
+
+	for _, p := range peers {
+		addr := "-"
+		if len(p.Addrs) > 0 {
+			addr = p.Addrs[0]
+		}
+
+		transports := "-"
+		if len(p.Transports) > 0 {
+			transports = strings.Join(p.Transports, ",")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s/s / %s/s\n", p.ID, transports, addr, formatLatency(p.Latency),
+			formatBytes(p.TotalIn), formatBytes(p.TotalOut), formatBytes(int64(p.RateIn)), formatBytes(int64(p.RateOut)))
+	}
+
+	w.Flush()
+}
+
+func printPeerInfo(p *bertyprotocol.PeerInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "peer\t%s\n", p.ID)
+	fmt.Fprintf(w, "connected\t%t\n", p.Connected)
+	fmt.Fprintf(w, "banned\t%t\n", p.Banned)
+	fmt.Fprintf(w, "latency\t%s\n", formatLatency(p.Latency))
+	fmt.Fprintf(w, "traffic\t%s in, %s out\n", formatBytes(p.TotalIn), formatBytes(p.TotalOut))
+	fmt.Fprintf(w, "rate\t%s/s in, %s/s out\n", formatBytes(int64(p.RateIn)), formatBytes(int64(p.RateOut)))
+
+	for i, addr := range p.Addrs {
+		transport := "unknown"
+		if i < len(p.Transports) {
+			transport = p.Transports[i]
+		}
+
+		fmt.Fprintf(w, "connection\t%s (%s)\n", addr, transport)
+	}
+
+	for _, addr := range p.KnownAddrs {
+		fmt.Fprintf(w, "known addr\t%s\n", addr)
+	}
+
+	for _, proto := range p.Protocols {
+		fmt.Fprintf(w, "protocol\t%s\n", proto)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/internal/pushrelay"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p"
+	libp2p_ci "github.com/libp2p/go-libp2p-core/crypto"
+	libp2p_peer "github.com/libp2p/go-libp2p-core/peer"
+	libp2p_quic "github.com/libp2p/go-libp2p-quic-transport"
+	"github.com/oklog/run"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"go.uber.org/zap"
+)
+
+func pushRelayCommand() *ffcli.Command {
+	var (
+		listeners       = "/ip4/0.0.0.0/tcp/4242,/ip4/0.0.0.0/udp/4242/quic"
+		keyFile         = "push-relay.key"
+		apnsKeyFile     string
+		apnsTeam        string
+		apnsKeyID       string
+		fcmKey          string
+		webPushKeyFile  string
+		webPushSubject  string
+		minPushInterval = pushrelay.DefaultMinPushInterval
+		maxPeerRequests = pushrelay.DefaultMaxPeerRequests
+		metricsListener string
+	)
+
+	fs := flag.NewFlagSet("push-relay", flag.ExitOnError)
+	fs.StringVar(&listeners, "l", listeners, "listeners, comma separated")
+	fs.StringVar(&keyFile, "pk", keyFile, "private key file of the relay, generated on the first run, the sealed push tokens stay valid as long as it is kept")
+	fs.StringVar(&apnsKeyFile, "push-apns-key", apnsKeyFile, "path of the .p8 APNs signing key, relays the pushes to the iOS devices if set")
+	fs.StringVar(&apnsTeam, "push-apns-team", apnsTeam, "team ID of the APNs signing key")
+	fs.StringVar(&apnsKeyID, "push-apns-key-id", apnsKeyID, "key ID of the APNs signing key")
+	fs.StringVar(&fcmKey, "push-fcm-key", fcmKey, "FCM server key, relays the pushes to the Android devices if set")
+	fs.StringVar(&webPushKeyFile, "push-webpush-key", webPushKeyFile, "path of the PEM VAPID key, generated on the first run, relays the pushes to the Web Push endpoints if set")
+	fs.StringVar(&webPushSubject, "push-webpush-subject", webPushSubject, "contact of the operator sent to the Web Push services, e.g. mailto:ops@example.com")
+	fs.DurationVar(&minPushInterval, "min-push-interval", minPushInterval, "minimum delay between two pushes to the same device")
+	fs.IntVar(&maxPeerRequests, "max-peer-requests", maxPeerRequests, "maximum number of requests of a peer per minute")
+	fs.StringVar(&metricsListener, "metrics", metricsListener, "listener of the Prometheus /metrics endpoint, e.g. /ip4/127.0.0.1/tcp/9092, disabled if empty")
+
+	return &ffcli.Command{
+		Name:       "push-relay",
+		ShortUsage: "berty push-relay [flags]",
+		ShortHelp:  "start a push relay waking the devices through APNs, FCM or Web Push, it never sees the content of the messages",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			cleanup := globalPreRun()
+			defer cleanup()
+
+			logger := opts.logger.Named("push-relay")
+
+			priv, err := serviceKey(logger, keyFile)
+			if err != nil {
+				return err
+			}
+
+			dispatchers := map[string]pushrelay.Dispatcher{}
+			if apnsKeyFile != "" {
+				data, err := ioutil.ReadFile(apnsKeyFile)
+				if err != nil {
+					return errcode.TODO.Wrap(err)
+				}
+
+				key, err := pushrelay.ParseAPNsKey(data)
+				if err != nil {
+					return errcode.TODO.Wrap(err)
+				}
+
+				dispatchers[pushrelay.PlatformAPNs] = pushrelay.NewAPNsDispatcher(pushrelay.APNsOpts{
+					TeamID: apnsTeam,
+					KeyID:  apnsKeyID,
+					Key:    key,
+				})
+			}
+
+			if fcmKey != "" {
+				dispatchers[pushrelay.PlatformFCM] = pushrelay.NewFCMDispatcher(pushrelay.FCMOpts{ServerKey: fcmKey})
+			}
+
+			if webPushKeyFile != "" {
+				key, err := vapidKey(logger, webPushKeyFile)
+				if err != nil {
+					return err
+				}
+
+				dispatchers[pushrelay.PlatformWebPush] = pushrelay.NewWebPushDispatcher(pushrelay.WebPushOpts{
+					Key:     key,
+					Subject: webPushSubject,
+				})
+
+				// the browsers subscribe with it
+				logger.Info("web push enabled", zap.String("application server key", pushrelay.VAPIDPublicKey(key)))
+			}
+
+			if len(dispatchers) == 0 {
+				return errcode.ErrMissingInput.Wrap(flag.ErrHelp)
+			}
+
+			host, err := libp2p.New(ctx,
+				libp2p.DefaultTransports,
+				libp2p.Transport(libp2p_quic.NewTransport),
+				libp2p.ListenAddrStrings(strings.Split(listeners, ",")...),
+				libp2p.Identity(priv),
+			)
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+			defer host.Close()
+
+			// nil unless the metrics endpoint is enabled
+			var reg *metrics.Registry
+			if metricsListener != "" {
+				reg = metrics.New()
+				reg.RegisterHost(host)
+			}
+
+			_, err = pushrelay.NewRelay(host, priv, pushrelay.RelayOpts{
+				Logger:            logger,
+				Dispatchers:       dispatchers,
+				MinPushInterval:   minPushInterval,
+				MaxPeerRequests:   maxPeerRequests,
+				PeerRequestWindow: time.Minute,
+				Metrics:           reg,
+			})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			// the devices register with one of these addrs, see -push-relay
+			maddrs, err := libp2p_peer.AddrInfoToP2pAddrs(&libp2p_peer.AddrInfo{ID: host.ID(), Addrs: host.Addrs()})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			for _, maddr := range maddrs {
+				logger.Info("listening", zap.Stringer("maddr", maddr))
+			}
+
+			var workers run.Group
+			if err := serveMetrics(&workers, metricsListener, reg); err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			workers.Add(func() error {
+				<-ctx.Done()
+				return nil
+			}, func(error) {
+				cancel()
+			})
+
+			return workers.Run()
+		},
+	}
+}
+
+// serviceKey returns the private key of a self-hosted service, the push
+// relay or the handle directory, read from its file or generated and written
+// to it on the first run.
+func serviceKey(logger *zap.Logger, path string) (libp2p_ci.PrivKey, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		priv, err := libp2p_ci.UnmarshalPrivateKey(raw)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		return priv, nil
+
+	case !os.IsNotExist(err):
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	priv, _, err := libp2p_ci.GenerateEd25519Key(crand.Reader)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	raw, err := libp2p_ci.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(raw)+"\n"), 0600); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	logger.Info("private key written, keep it safe, the sealed tokens and the receipts are tied to it", zap.String("path", path))
+
+	return priv, nil
+}
+
+// vapidKey returns the VAPID key of the relay, read from its file or
+// generated and written to it on the first run. The browsers have to
+// subscribe again if it changes.
+func vapidKey(logger *zap.Logger, path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		return pushrelay.ParseVAPIDKey(data)
+
+	case !os.IsNotExist(err):
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	logger.Info("VAPID key written", zap.String("path", path))
+
+	return key, nil
+}
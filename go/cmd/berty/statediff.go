@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"go.uber.org/zap"
+)
+
+func stateDiffCommand() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "state-diff",
+		ShortUsage: "berty state-diff <snapshot a> <snapshot b>",
+		ShortHelp:  "compare the state snapshots of two devices, see daemon -state-snapshot",
+		FlagSet:    flag.NewFlagSet("state-diff", flag.ExitOnError),
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 2 {
+				return flag.ErrHelp
+			}
+
+			snapshots := make([]*bertyprotocol.StateSnapshot, len(args))
+			for i, path := range args {
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return errcode.TODO.Wrap(err)
+				}
+
+				if snapshots[i], err = bertyprotocol.ParseStateSnapshot(data); err != nil {
+					return fmt.Errorf("unable to parse %s: %w", path, err)
+				}
+			}
+
+			a, b := snapshots[0], snapshots[1]
+			diff := bertyprotocol.DiffStateSnapshots(a, b)
+			if diff.Empty() {
+				fmt.Printf("in sync, root %s\n", a.Root)
+				return nil
+			}
+
+			fmt.Printf("a: %s (root %s)\nb: %s (root %s)\n", args[0], a.Root, args[1], b.Root)
+
+			for _, pk := range diff.OnlyInA {
+				fmt.Printf("group %s: only in a\n", encodeGroupPK(pk))
+			}
+
+			for _, pk := range diff.OnlyInB {
+				fmt.Printf("group %s: only in b\n", encodeGroupPK(pk))
+			}
+
+			for _, g := range diff.Groups {
+				switch {
+				case g.OpenedOnlyInA:
+					fmt.Printf("group %s: only opened in a\n", encodeGroupPK(g.GroupPK))
+				case g.OpenedOnlyInB:
+					fmt.Printf("group %s: only opened in b\n", encodeGroupPK(g.GroupPK))
+				default:
+					printLogDiff(g.GroupPK, "metadata", g.Metadata)
+					printLogDiff(g.GroupPK, "messages", g.Messages)
+				}
+			}
+
+			return fmt.Errorf("snapshots diverged")
+		},
+	}
+}
+
+func encodeGroupPK(pk []byte) string {
+	return base64.RawURLEncoding.EncodeToString(pk)
+}
+
+func printLogDiff(groupPK []byte, name string, diff *bertyprotocol.LogSnapshotDiff) {
+	if diff == nil {
+		return
+	}
+
+	for _, e := range diff.OnlyInA {
+		fmt.Printf("group %s: %s entry %s only in a\n", encodeGroupPK(groupPK), name, e)
+	}
+
+	for _, e := range diff.OnlyInB {
+		fmt.Printf("group %s: %s entry %s only in b\n", encodeGroupPK(groupPK), name, e)
+	}
+}
+
+// writeStateSnapshotOnInterrupt waits for an interrupt, then writes the state
+// snapshot of the protocol to the given path before stopping the daemon.
+func writeStateSnapshotOnInterrupt(ctx context.Context, protocol bertyprotocol.Service, path string) (func() error, func(error)) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return func() error {
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, os.Interrupt)
+			defer signal.Stop(sigc)
+
+			select {
+			case <-sigc:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			snapshot, err := protocol.StateSnapshot(ctx)
+			if err != nil {
+				return err
+			}
+
+			data, err := snapshot.Marshal()
+			if err != nil {
+				return err
+			}
+
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			opts.logger.Info("state snapshot written", zap.String("path", path), zap.String("root", snapshot.Root))
+
+			return fmt.Errorf("interrupted")
+		}, func(error) {
+			cancel()
+		}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+
+	"berty.tech/berty/v2/go/internal/xmppgw"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/oklog/run"
+)
+
+// serveXMPP exposes the contacts of the account to the owner through an XMPP
+// server, if any, see xmppgw.
+func serveXMPP(ctx context.Context, workers *run.Group, protocol bertyprotocol.Service) error {
+	if opts.xmppServer == "" {
+		return nil
+	}
+
+	var secret string
+	if opts.xmppSecretFile != "" {
+		data, err := ioutil.ReadFile(opts.xmppSecretFile)
+		if err != nil {
+			return errcode.TODO.Wrap(err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+
+	gw, err := xmppgw.New(protocol, xmppgw.Opts{
+		Logger: opts.logger,
+		Server: opts.xmppServer,
+		Domain: opts.xmppDomain,
+		Secret: secret,
+		Owner:  opts.xmppOwner,
+	})
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	workers.Add(func() error {
+		return gw.Run(ctx)
+	}, func(error) {
+		cancel()
+	})
+
+	return nil
+}
@@ -6,12 +6,16 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	mrand "math/rand"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 
+	"berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/internal/pushrelay"
 	"berty.tech/berty/v2/go/pkg/errcode"
 	ipfs_log "github.com/ipfs/go-log"
 	libp2p "github.com/libp2p/go-libp2p"
@@ -48,6 +52,11 @@ func main() {
 		serveFlagsURN       = serveFlags.String("db", ":memory:", "rdvp sqlite URN")
 		serveFlagsListeners = serveFlags.String("l", "/ip4/0.0.0.0/tcp/4040,/ip4/0.0.0.0/udp/4141/quic", "lists of listeners of (m)addrs separate by a comma")
 		serveFlagsPK        = serveFlags.String("pk", "", "private key (generated by `rdvp genkey`)")
+		serveFlagsAPNsKey   = serveFlags.String("push-apns-key", "", "path of the .p8 APNs signing key, relays the pushes to the iOS devices if set")
+		serveFlagsAPNsTeam  = serveFlags.String("push-apns-team", "", "team ID of the APNs signing key")
+		serveFlagsAPNsKeyID = serveFlags.String("push-apns-key-id", "", "key ID of the APNs signing key")
+		serveFlagsFCMKey    = serveFlags.String("push-fcm-key", "", "FCM server key, relays the pushes to the Android devices if set")
+		serveFlagsMetrics   = serveFlags.String("metrics", "", "listener of the Prometheus /metrics endpoint, e.g. 127.0.0.1:9093, disabled if empty")
 	)
 
 	globalPreRun := func() error {
@@ -147,6 +156,29 @@ func main() {
 			defer host.Close()
 			logHostInfo(logger, host)
 
+			// nil unless the metrics endpoint is enabled
+			var reg *metrics.Registry
+			if *serveFlagsMetrics != "" {
+				reg = metrics.New()
+				reg.RegisterHost(host)
+				if *serveFlagsURN != ":memory:" {
+					reg.RegisterDirectory("rendezvous", *serveFlagsURN)
+				}
+
+				l, err := net.Listen("tcp", *serveFlagsMetrics)
+				if err != nil {
+					return errcode.TODO.Wrap(err)
+				}
+				defer l.Close()
+
+				mux := http.NewServeMux()
+				mux.Handle("/metrics", reg.Handler())
+				go func() {
+					logger.Info("serving metrics", zap.String("addr", l.Addr().String()))
+					_ = http.Serve(l, mux)
+				}()
+			}
+
 			db, err := libp2p_rpdb.OpenDB(ctx, *serveFlagsURN)
 			if err != nil {
 				return errcode.TODO.Wrap(err)
@@ -157,6 +189,37 @@ func main() {
 			// start service
 			_ = libp2p_rp.NewRendezvousService(host, db)
 
+			// the sealed push tokens stay valid as long as the private key
+			// is kept, see -pk
+			dispatchers := map[string]pushrelay.Dispatcher{}
+			if *serveFlagsAPNsKey != "" {
+				data, err := ioutil.ReadFile(*serveFlagsAPNsKey)
+				if err != nil {
+					return errcode.TODO.Wrap(err)
+				}
+
+				key, err := pushrelay.ParseAPNsKey(data)
+				if err != nil {
+					return errcode.TODO.Wrap(err)
+				}
+
+				dispatchers[pushrelay.PlatformAPNs] = pushrelay.NewAPNsDispatcher(pushrelay.APNsOpts{
+					TeamID: *serveFlagsAPNsTeam,
+					KeyID:  *serveFlagsAPNsKeyID,
+					Key:    key,
+				})
+			}
+
+			if *serveFlagsFCMKey != "" {
+				dispatchers[pushrelay.PlatformFCM] = pushrelay.NewFCMDispatcher(pushrelay.FCMOpts{ServerKey: *serveFlagsFCMKey})
+			}
+
+			if len(dispatchers) > 0 {
+				if _, err := pushrelay.NewRelay(host, priv, pushrelay.RelayOpts{Logger: logger, Dispatchers: dispatchers, Metrics: reg}); err != nil {
+					return errcode.TODO.Wrap(err)
+				}
+			}
+
 			<-ctx.Done()
 			if err = ctx.Err(); err != nil {
 				return errcode.TODO.Wrap(err)
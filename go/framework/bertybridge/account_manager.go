@@ -0,0 +1,425 @@
+package bertybridge
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.uber.org/zap"
+)
+
+// DefaultAccountID is the account of an install predating the account
+// manager, its files are kept at the root of the directory.
+const DefaultAccountID = "default"
+
+const accountsFile = "accounts.json"
+
+// AccountInfo describes an account of the device.
+type AccountInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Running and Current are only set by AccountList
+	Running bool `json:"running,omitempty"`
+	Current bool `json:"current,omitempty"`
+}
+
+// AccountManager runs several isolated accounts within the process, e.g. a
+// work and a personal one. Each account has its own directory under the root
+// directory of the config, so its own keys, datastores and network host.
+//
+// The resources bound to the process, the native drivers, the gRPC and
+// swarm listeners of the config and the fixed QUIC port, are owned by the
+// first account opened until it is closed, the other ones only get their
+// own random ports and are reached through their in-process gRPC client.
+type AccountManager struct {
+	logger *zap.Logger
+	config *ProtocolConfig
+
+	// newProtocol starts the node of an account, overridden by the tests
+	newProtocol func(logger *zap.Logger, config *ProtocolConfig) (*Protocol, error)
+
+	mu       sync.Mutex
+	accounts []*AccountInfo
+	running  map[string]*Protocol
+	primary  string
+	current  string
+}
+
+// NewAccountManager returns the manager of the accounts stored in the root
+// directory of the config, with an in memory root the accounts are lost
+// once the process exits.
+func NewAccountManager(config *ProtocolConfig) (*AccountManager, error) {
+	if config.quicPort < 0 || config.quicPort > math.MaxUint16 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid QUIC port %d", config.quicPort))
+	}
+
+	logger, err := newConfigLogger(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAccountManager(logger, config)
+}
+
+func newAccountManager(logger *zap.Logger, config *ProtocolConfig) (*AccountManager, error) {
+	m := &AccountManager{
+		logger:      logger,
+		config:      config,
+		newProtocol: newProtocolBridge,
+		running:     make(map[string]*Protocol),
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *AccountManager) inMemory() bool {
+	return m.config.rootDirectory == "" || m.config.rootDirectory == ":memory:"
+}
+
+func (m *AccountManager) accountDirectory(id string) string {
+	if m.inMemory() {
+		return m.config.rootDirectory
+	}
+
+	if id == DefaultAccountID {
+		return m.config.rootDirectory
+	}
+
+	return filepath.Join(m.config.rootDirectory, "accounts", id)
+}
+
+// load reads the accounts of the root directory, the account of an install
+// predating the manager is registered as the default one.
+func (m *AccountManager) load() error {
+	if m.inMemory() {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(m.config.rootDirectory, accountsFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &m.accounts); err != nil {
+			return errcode.ErrDeserialization.Wrap(err)
+		}
+
+		return nil
+	} else if !os.IsNotExist(err) {
+		return errcode.TODO.Wrap(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(m.config.rootDirectory, "store")); err == nil {
+		m.accounts = []*AccountInfo{{ID: DefaultAccountID, Name: DefaultAccountID, CreatedAt: time.Now()}}
+		return m.saveLocked()
+	}
+
+	return nil
+}
+
+func (m *AccountManager) saveLocked() error {
+	if m.inMemory() {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.accounts, "", "  ")
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := os.MkdirAll(m.config.rootDirectory, 0700); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	// written aside then renamed, a crash can't lose the accounts
+	path := filepath.Join(m.config.rootDirectory, accountsFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	return nil
+}
+
+func (m *AccountManager) getLocked(id string) (*AccountInfo, error) {
+	for _, a := range m.accounts {
+		if a.ID == id {
+			return a, nil
+		}
+	}
+
+	return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown account %q", id))
+}
+
+// AccountCreate registers a new account and returns its ID, it is created
+// once opened.
+func (m *AccountManager) AccountCreate(name string) (string, error) {
+	raw := make([]byte, 8)
+	if _, err := crand.Read(raw); err != nil {
+		return "", errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// an in memory root only holds a single account, they would share it
+	if m.inMemory() && len(m.accounts) > 0 {
+		return "", errcode.ErrNotImplemented.Wrap(fmt.Errorf("an in memory root holds a single account"))
+	}
+
+	a := &AccountInfo{ID: hex.EncodeToString(raw), Name: name, CreatedAt: time.Now()}
+	m.accounts = append(m.accounts, a)
+
+	if err := m.saveLocked(); err != nil {
+		m.accounts = m.accounts[:len(m.accounts)-1]
+		return "", err
+	}
+
+	return a.ID, nil
+}
+
+// AccountList returns the accounts of the device as JSON.
+func (m *AccountManager) AccountList() (string, error) {
+	m.mu.Lock()
+	accounts := make([]*AccountInfo, len(m.accounts))
+	for i, a := range m.accounts {
+		info := *a
+		_, info.Running = m.running[a.ID]
+		info.Current = a.ID == m.current
+		accounts[i] = &info
+	}
+	m.mu.Unlock()
+
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return accounts[i].CreatedAt.Before(accounts[j].CreatedAt)
+	})
+
+	data, err := json.Marshal(accounts)
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return string(data), nil
+}
+
+// AccountRename changes the name of an account.
+func (m *AccountManager) AccountRename(id, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, err := m.getLocked(id)
+	if err != nil {
+		return err
+	}
+
+	prev := a.Name
+	a.Name = name
+
+	if err := m.saveLocked(); err != nil {
+		a.Name = prev
+		return err
+	}
+
+	return nil
+}
+
+// AccountOpen starts the node of an account, if not running yet, and
+// returns it. The other running accounts keep running.
+func (m *AccountManager) AccountOpen(id string) (*Protocol, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.openLocked(id)
+}
+
+func (m *AccountManager) openLocked(id string) (*Protocol, error) {
+	if _, err := m.getLocked(id); err != nil {
+		return nil, err
+	}
+
+	if p, ok := m.running[id]; ok {
+		return p, nil
+	}
+
+	config := *m.config
+	config.rootDirectory = m.accountDirectory(id)
+
+	// the first account opened owns the resources bound to the process
+	if m.primary != "" {
+		config.secondary = true
+		config.Config = NewConfig()
+		config.swarmListeners = nil
+		config.quicPort = 0
+	}
+
+	p, err := m.newProtocol(m.logger.With(zap.String("account", id)), &config)
+	if err != nil {
+		return nil, err
+	}
+
+	m.running[id] = p
+	if m.primary == "" {
+		m.primary = id
+	}
+
+	if m.current == "" {
+		m.current = id
+	}
+
+	m.logger.Info("account opened", zap.String("account", id), zap.Bool("primary", m.primary == id))
+
+	return p, nil
+}
+
+// AccountSwitch makes an account the current one: the other running
+// accounts are closed, then the account is opened.
+func (m *AccountManager) AccountSwitch(id string) (*Protocol, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.getLocked(id); err != nil {
+		return nil, err
+	}
+
+	for other := range m.running {
+		if other == id {
+			continue
+		}
+
+		if err := m.closeLocked(other); err != nil {
+			m.logger.Warn("unable to close account", zap.String("account", other), zap.Error(err))
+		}
+	}
+
+	p, err := m.openLocked(id)
+	if err != nil {
+		return nil, err
+	}
+
+	m.current = id
+
+	return p, nil
+}
+
+// CurrentAccount returns the ID of the current account, empty if none is
+// running.
+func (m *AccountManager) CurrentAccount() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.current
+}
+
+// AccountClose stops the node of an account.
+func (m *AccountManager) AccountClose(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.running[id]; !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("account %q isn't running", id))
+	}
+
+	return m.closeLocked(id)
+}
+
+func (m *AccountManager) closeLocked(id string) error {
+	p := m.running[id]
+	delete(m.running, id)
+
+	if m.primary == id {
+		m.primary = ""
+	}
+
+	if m.current == id {
+		m.current = ""
+	}
+
+	// the resources bound to the process are released once the primary
+	// account is closed, the next account opened owns them
+	err := p.Close()
+
+	m.logger.Info("account closed", zap.String("account", id))
+
+	return err
+}
+
+// AccountDelete closes an account and removes its files, its keys are lost
+// unless it was exported.
+func (m *AccountManager) AccountDelete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.getLocked(id); err != nil {
+		return err
+	}
+
+	if _, ok := m.running[id]; ok {
+		if err := m.closeLocked(id); err != nil {
+			m.logger.Warn("unable to close account", zap.String("account", id), zap.Error(err))
+		}
+	}
+
+	accounts := m.accounts[:0]
+	for _, a := range m.accounts {
+		if a.ID != id {
+			accounts = append(accounts, a)
+		}
+	}
+	m.accounts = accounts
+
+	if err := m.saveLocked(); err != nil {
+		return err
+	}
+
+	if m.inMemory() {
+		return nil
+	}
+
+	dir := m.accountDirectory(id)
+	if id == DefaultAccountID {
+		// the other accounts live within the root directory
+		for _, name := range []string{"ipfs", "store", "orbitdb"} {
+			if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+		}
+
+		return nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	return nil
+}
+
+// Close stops the nodes of the running accounts.
+func (m *AccountManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	for id := range m.running {
+		if cerr := m.closeLocked(id); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,153 @@
+package bertybridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/testutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+func testAccountManager(t *testing.T, rootdir string) *AccountManager {
+	t.Helper()
+
+	config := NewProtocolConfig()
+	config.RootDirectory(rootdir)
+	config.AddGRPCListener("/ip4/127.0.0.1/tcp/0/grpc")
+
+	m, err := newAccountManager(testutil.Logger(t), config)
+	require.NoError(t, err)
+
+	// each account runs its own mocked node
+	m.newProtocol = func(logger *zap.Logger, config *ProtocolConfig) (*Protocol, error) {
+		mc, cleanup := ipfsutil.TestingCoreAPI(context.Background(), t)
+		t.Cleanup(cleanup)
+
+		config.ipfsCoreAPI(mc.API())
+		return newProtocolBridge(logger, config)
+	}
+
+	return m
+}
+
+func accountPK(t *testing.T, p *Protocol) []byte {
+	t.Helper()
+
+	client, err := newServiceClient(p)
+	require.NoError(t, err)
+
+	res, err := client.InstanceGetConfiguration(context.Background(), &bertytypes.InstanceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	return res.AccountPK
+}
+
+func listAccounts(t *testing.T, m *AccountManager) []*AccountInfo {
+	t.Helper()
+
+	data, err := m.AccountList()
+	require.NoError(t, err)
+
+	accounts := []*AccountInfo{}
+	require.NoError(t, json.Unmarshal([]byte(data), &accounts))
+
+	return accounts
+}
+
+func TestAccountManager(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "accounts")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootdir)
+
+	m := testAccountManager(t, rootdir)
+	assert.Empty(t, listAccounts(t, m))
+
+	work, err := m.AccountCreate("work")
+	require.NoError(t, err)
+	personal, err := m.AccountCreate("personal")
+	require.NoError(t, err)
+
+	_, err = m.AccountOpen("unknown")
+	assert.Error(t, err)
+
+	// both accounts run side by side, isolated
+	workNode, err := m.AccountOpen(work)
+	require.NoError(t, err)
+	personalNode, err := m.AccountOpen(personal)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, accountPK(t, workNode), accountPK(t, personalNode))
+	assert.NotEmpty(t, workNode.GRPCListenerAddr())
+	assert.Empty(t, personalNode.GRPCListenerAddr(), "the listeners of the config are owned by the first account")
+	assert.Equal(t, work, m.CurrentAccount())
+
+	again, err := m.AccountOpen(work)
+	require.NoError(t, err)
+	assert.Equal(t, workNode, again)
+
+	workPK := accountPK(t, workNode)
+
+	// switching closes the other accounts
+	_, err = m.AccountSwitch(personal)
+	require.NoError(t, err)
+	assert.Equal(t, personal, m.CurrentAccount())
+
+	accounts := listAccounts(t, m)
+	require.Len(t, accounts, 2)
+	assert.Equal(t, "work", accounts[0].Name)
+	assert.False(t, accounts[0].Running)
+	assert.True(t, accounts[1].Running)
+	assert.True(t, accounts[1].Current)
+
+	require.NoError(t, m.AccountRename(personal, "home"))
+	require.NoError(t, m.Close())
+
+	// the accounts and their keys survive a restart
+	m = testAccountManager(t, rootdir)
+	accounts = listAccounts(t, m)
+	require.Len(t, accounts, 2)
+	assert.Equal(t, "home", accounts[1].Name)
+
+	workNode, err = m.AccountOpen(work)
+	require.NoError(t, err)
+	assert.Equal(t, workPK, accountPK(t, workNode))
+
+	require.NoError(t, m.AccountDelete(work))
+	assert.Len(t, listAccounts(t, m), 1)
+	assert.Empty(t, m.CurrentAccount())
+
+	_, err = os.Stat(filepath.Join(rootdir, "accounts", work))
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, m.Close())
+}
+
+func TestAccountManagerDefaultAccount(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "accounts")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootdir)
+
+	// an install predating the manager
+	require.NoError(t, os.MkdirAll(filepath.Join(rootdir, "store"), 0700))
+
+	m := testAccountManager(t, rootdir)
+	accounts := listAccounts(t, m)
+	require.Len(t, accounts, 1)
+	assert.Equal(t, DefaultAccountID, accounts[0].ID)
+	assert.Equal(t, rootdir, m.accountDirectory(DefaultAccountID))
+
+	// an in memory root holds a single account
+	m = testAccountManager(t, "")
+	_, err = m.AccountCreate("first")
+	require.NoError(t, err)
+	_, err = m.AccountCreate("second")
+	assert.Error(t, err)
+}
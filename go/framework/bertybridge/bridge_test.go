@@ -1,6 +1,7 @@
 package bertybridge
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -80,6 +81,35 @@ func TestProtocolBridge(t *testing.T) {
 	_, err = cc.InstanceGetConfiguration(ctx, msg)
 	require.NoError(t, err)
 
+	// the DHT is managed by the given core API
+	diagnostics, err := protocol.Diagnostics()
+	require.NoError(t, err)
+	assert.Contains(t, diagnostics, `"dht_mode":"disabled"`)
+	assert.Contains(t, diagnostics, `"dial_errors":[]`)
+
+	// the DHT mode controller is left to the given core API
+	require.NoError(t, protocol.ResourceHints(10, false, bertyprotocol.NetworkTypeCellular, false))
+	assert.Error(t, protocol.ResourceHints(10, false, "5g", false))
+
+	// the transports of the given core API are already started
+	<-protocol.startupDone
+	progress, err := protocol.StartupProgress()
+	require.NoError(t, err)
+
+	stages := []*bertyprotocol.StartupEvent{}
+	require.NoError(t, json.Unmarshal([]byte(progress), &stages))
+	require.Len(t, stages, 5)
+	for i, stage := range []string{
+		bertyprotocol.StartupStageStorage,
+		bertyprotocol.StartupStageIdentity,
+		bertyprotocol.StartupStageAPIReady,
+		bertyprotocol.StartupStageTransports,
+		bertyprotocol.StartupStageDiscovery,
+	} {
+		assert.Equal(t, stage, stages[i].Stage)
+		assert.Empty(t, stages[i].Error)
+	}
+
 	//results, err = makeGrpcRequest(
 	//	protocol.GRPCWebListenerAddr(),
 	//	"/berty.protocol.v1.ProtocolService/ContactGet",
@@ -95,6 +125,39 @@ func TestProtocolBridge(t *testing.T) {
 	//}
 }
 
+type testingEventHandler chan string
+
+func (h testingEventHandler) HandleEvent(eventType string, event string) {
+	h <- event
+}
+
+func TestProtocolEventHandler(t *testing.T) {
+	ctx := context.Background()
+	mc, cleanup := ipfsutil.TestingCoreAPI(ctx, t)
+	defer cleanup()
+
+	events := make(testingEventHandler, 10)
+	config := NewProtocolConfig()
+	config.ipfsCoreAPI(mc.API())
+	config.EventHandler(events, " "+bertyprotocol.NodeEventStartup+" ")
+
+	protocol, err := newProtocolBridge(testutil.Logger(t), config)
+	require.NoError(t, err)
+
+	// the stages done in the background are pushed to the handler
+	for _, stage := range []string{bertyprotocol.StartupStageTransports, bertyprotocol.StartupStageDiscovery} {
+		e := struct {
+			Type    string                      `json:"type"`
+			Payload *bertyprotocol.StartupEvent `json:"payload"`
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(<-events), &e))
+		assert.Equal(t, bertyprotocol.NodeEventStartup, e.Type)
+		assert.Equal(t, stage, e.Payload.Stage)
+	}
+
+	require.NoError(t, protocol.Close())
+}
+
 func TestPersistenceProtocol(t *testing.T) {
 	var err error //results      [][]byte
 
@@ -175,3 +238,25 @@ func TestPersistenceProtocol(t *testing.T) {
 	assert.Equal(t, node_id_1, node_id_2, "IPFS node should have the same ID after reboot")
 	assert.Equal(t, device_pk_1, device_pk_2, "Device should have the same PK after reboot")
 }
+
+func TestProtocolLogLevels(t *testing.T) {
+	_, _, err := newLoggers("chatty", nil)
+	assert.Error(t, err)
+
+	logger, logs, err := newLoggers("info", nil)
+	require.NoError(t, err)
+
+	p := &Protocol{logs: logs}
+	require.NoError(t, p.LogSetLevel("ble-tpt", "error"))
+	assert.Error(t, p.LogSetLevel("bluetooth", "error"))
+
+	logger.Named("ble-tpt").Warn("ble warn")
+	logger.Named("bertyprotocol").Info("protocol info")
+	assert.NotContains(t, p.LogCapture(), "ble warn")
+	assert.Contains(t, p.LogCapture(), "protocol info")
+
+	list, err := p.LogSubsystemList()
+	require.NoError(t, err)
+	assert.Contains(t, list, `{"name":"ble-tpt","level":"error"}`)
+	assert.Contains(t, list, `{"name":"node","level":"info"}`)
+}
@@ -0,0 +1,54 @@
+package bertybridge
+
+import (
+	mc "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport"
+)
+
+// NativeBLEDriver is implemented by the native BLE driver (Android), see
+// mc.NativeDriver. Once started, the driver reports the devices found and
+// the payloads they send to the handler given to Start.
+type NativeBLEDriver interface {
+	Start(localPID string, advertisement string, handler *BLEHandler)
+	Stop()
+	DialPeer(remotePID string) bool
+	SendToPeer(remotePID string, payload []byte) bool
+	CloseConnWithPeer(remotePID string)
+	Started() bool
+	Advertising() bool
+	Browsing() bool
+
+	// SetDutyCycle sets the share of the time the driver scans and
+	// advertises, in percent, see Protocol.ResourceHints
+	SetDutyCycle(percent int)
+}
+
+// BLEHandler is called by the native BLE driver, it is only valid until the
+// driver is stopped.
+type BLEHandler struct {
+	handler mc.NativeHandler
+}
+
+// HandleAdvertisement must be called when a device is found, before
+// connecting to it, the device must be skipped if it returns false
+func (h *BLEHandler) HandleAdvertisement(advertisement string) bool {
+	return h.handler.HandleAdvertisement(advertisement)
+}
+
+// HandleFoundPeer must be called once connected to a peer
+func (h *BLEHandler) HandleFoundPeer(remotePID string) bool {
+	return h.handler.HandleFoundPeer(remotePID)
+}
+
+// ReceiveFromPeer must be called when a payload is received from a peer
+func (h *BLEHandler) ReceiveFromPeer(remotePID string, payload []byte) {
+	h.handler.ReceiveFromPeer(remotePID, payload)
+}
+
+// bleDriver adapts a NativeBLEDriver to the mc transport.
+type bleDriver struct {
+	NativeBLEDriver
+}
+
+func (d bleDriver) Start(localPID string, advertisement string, handler mc.NativeHandler) {
+	d.NativeBLEDriver.Start(localPID, advertisement, &BLEHandler{handler: handler})
+}
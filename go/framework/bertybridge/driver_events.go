@@ -0,0 +1,58 @@
+package bertybridge
+
+import (
+	"context"
+	"encoding/json"
+
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"go.uber.org/zap"
+)
+
+// NativeEventHandler is implemented by the native app to receive the events
+// of the node as they happen, instead of polling them. The events are the
+// JSON NodeEvents of the EventService, with their payload inlined, and
+// eventType is one of the bertyprotocol.NodeEvent* types. HandleEvent is
+// called from a single goroutine, in order, it must not block.
+type NativeEventHandler interface {
+	HandleEvent(eventType string, event string)
+}
+
+// nativeEvent is a NodeEvent given to a NativeEventHandler.
+type nativeEvent struct {
+	Cursor  string          `json:"cursor"`
+	Type    string          `json:"type"`
+	At      int64           `json:"at"`
+	GroupPK []byte          `json:"group_pk,omitempty"`
+	PeerID  string          `json:"peer_id,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// pushEvents hands the events of the service to the handler until ctx is
+// done.
+func pushEvents(ctx context.Context, logger *zap.Logger, service bertyprotocol.Service, handler NativeEventHandler, types []string) error {
+	events, err := service.SubscribeNodeEvents(ctx, &bertyprotocol.EventStreamRequest{Types: types})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for e := range events {
+			data, err := json.Marshal(&nativeEvent{
+				Cursor:  e.Cursor,
+				Type:    e.Type,
+				At:      e.At,
+				GroupPK: e.GroupPK,
+				PeerID:  e.PeerID,
+				Payload: e.Payload,
+			})
+			if err != nil {
+				logger.Warn("unable to serialize node event", zap.String("type", e.Type), zap.Error(err))
+				continue
+			}
+
+			handler.HandleEvent(e.Type, string(data))
+		}
+	}()
+
+	return nil
+}
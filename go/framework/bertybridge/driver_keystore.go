@@ -0,0 +1,10 @@
+package bertybridge
+
+// NativeKeystoreDriver is implemented by the native keystore, it wraps the
+// device keys with a key held by the Secure Enclave (iOS) or the Android
+// Keystore, see ipfsutil.KeyWrapper
+type NativeKeystoreDriver interface {
+	Wrap(data []byte) ([]byte, error)
+	Unwrap(data []byte) ([]byte, error)
+	Hardware() bool
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"berty.tech/berty/v2/go/internal/logutil"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -41,28 +42,55 @@ func (mc *nativeLogger) Write(entry zapcore.Entry, fields []zapcore.Field) error
 	return mc.l.Log(entry.Level.CapitalString(), entry.LoggerName, buff.String())
 }
 
-func newLogger(loglevel string) (logger *zap.Logger, err error) {
-	config := zap.NewDevelopmentConfig()
-	config.DisableStacktrace = true
-	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
-
+func parseLogLevel(loglevel string) (zapcore.Level, error) {
 	switch loglevel {
 	case "", "warn":
-		config.Level.SetLevel(zap.WarnLevel)
+		return zap.WarnLevel, nil
 	case "info":
-		config.Level.SetLevel(zap.InfoLevel)
+		return zap.InfoLevel, nil
 	case "debug":
-		config.Level.SetLevel(zap.DebugLevel)
+		return zap.DebugLevel, nil
 	default:
-		err = fmt.Errorf("unsupported log level: %q", loglevel)
-		return
+		return zap.WarnLevel, fmt.Errorf("unsupported log level: %q", loglevel)
 	}
+}
+
+// newLoggers returns the logger of the config, filtered by subsystem by the
+// returned manager.
+func newLoggers(loglevel string, mlogger NativeLoggerDriver) (*zap.Logger, *logutil.Manager, error) {
+	level, err := parseLogLevel(loglevel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var base *zap.Logger
+	if mlogger != nil {
+		base = newNativeLogger(mlogger)
+	} else if base, err = newLogger(); err != nil {
+		return nil, nil, err
+	}
+
+	logs := logutil.New(base, logutil.Opts{Level: level})
+	logger := logs.Logger()
+
+	logger.Info("logger initialized", zap.String("level", level.String()))
+	return logger, logs, nil
+}
+
+// newLogger lets all the entries through, they are filtered by subsystem.
+func newLogger() (logger *zap.Logger, err error) {
+	config := zap.NewDevelopmentConfig()
+	config.DisableStacktrace = true
+	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+	config.Level.SetLevel(zap.DebugLevel)
 
 	logger, err = config.Build()
 	return
 }
 
-func newNativeLogger(loglevel string, mlogger NativeLoggerDriver) (*zap.Logger, error) {
+// newNativeLogger lets the entries enabled by the native driver through, they
+// are filtered by subsystem.
+func newNativeLogger(mlogger NativeLoggerDriver) *zap.Logger {
 	// native logger
 	nativeEncoderConfig := zap.NewDevelopmentEncoderConfig()
 	nativeEncoderConfig.LevelKey = ""
@@ -73,34 +101,17 @@ func newNativeLogger(loglevel string, mlogger NativeLoggerDriver) (*zap.Logger,
 	nativeEncoder := zapcore.NewConsoleEncoder(nativeEncoderConfig)
 	nativeOutput := zapcore.Lock(os.Stderr)
 
-	var zapLogLevel zapcore.Level
-	switch loglevel {
-	case "", "warn":
-		zapLogLevel = zap.WarnLevel
-	case "info":
-		zapLogLevel = zap.InfoLevel
-	case "debug":
-		zapLogLevel = zap.DebugLevel
-	default:
-		return nil, fmt.Errorf("unsupported log level: %q", loglevel)
-	}
-
-	nativeLevel := zap.LevelEnablerFunc(func(lvl zapcore.Level) bool { return lvl >= zapLogLevel })
 	nativeCore := &nativeLogger{
-		Core: zapcore.NewCore(nativeEncoder, nativeOutput, nativeLevel),
+		Core: zapcore.NewCore(nativeEncoder, nativeOutput, zap.DebugLevel),
 		enc:  nativeEncoder,
 		l:    mlogger,
 	}
 
-	// create logger
-	logger := zap.New(nativeCore)
-
 	// bind ipfs logger with zap
 	// @FIXME(gfanton): find a way to bind libp2p logger
 	// if err := ipfsutil.ConfigureLogger("*", logger, loglevel); err != nil {
 	// 	return nil, err
 	// }
 
-	logger.Info("logger initialized", zap.String("level", loglevel))
-	return logger, nil
+	return zap.New(nativeCore)
 }
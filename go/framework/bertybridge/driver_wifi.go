@@ -0,0 +1,27 @@
+package bertybridge
+
+import (
+	wifi "berty.tech/berty/v2/go/internal/wifi-transport"
+)
+
+// NativeWifiDriver is implemented by the native Wi-Fi Direct (Android) or
+// Wi-Fi Aware driver, see wifi.NativeDriver
+type NativeWifiDriver interface {
+	Start(localPID string) bool
+	Stop()
+	DialPeer(remotePID string) bool
+	SendToPeer(remotePID string, payload []byte) bool
+	CloseConnWithPeer(remotePID string)
+}
+
+// WifiHandleFoundPeer must be called by the native Wi-Fi driver when a
+// datapath with a peer is ready
+func WifiHandleFoundPeer(remotePID string) bool {
+	return wifi.HandleFoundPeer(remotePID)
+}
+
+// WifiReceiveFromPeer must be called by the native Wi-Fi driver when a
+// payload is received from a peer
+func WifiReceiveFromPeer(remotePID string, payload []byte) {
+	wifi.ReceiveFromPeer(remotePID, payload)
+}
@@ -0,0 +1,132 @@
+package accountbackup
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Version is the version of the file format produced by this package.
+const Version = 1
+
+const kdfScrypt = "scrypt"
+
+const (
+	defaultN = 1 << 15
+	defaultR = 8
+	defaultP = 1
+
+	saltSize = 16
+
+	// maxN bounds the cost read from a file, a forged file could otherwise
+	// make the import allocate gigabytes
+	maxN = 1 << 20
+)
+
+// ErrDecrypt is returned when a file can't be opened, the passphrase is
+// wrong or the file was altered.
+var ErrDecrypt = fmt.Errorf("wrong passphrase or corrupted account backup")
+
+// file is the serialized backup:
+//
+//	{
+//	  "version": 1,
+//	  "kdf": "scrypt", "n": 32768, "r": 8, "p": 1,
+//	  "salt": "<base64>", "nonce": "<base64>",
+//	  "sealed": "<base64>"
+//	}
+type file struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Sealed  []byte `json:"sealed"`
+}
+
+func (f *file) key(passphrase string) (*[32]byte, error) {
+	raw, err := scrypt.Key([]byte(passphrase), f.Salt, f.N, f.R, f.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &[32]byte{}
+	copy(key[:], raw)
+
+	return key, nil
+}
+
+// Seal encrypts a payload with a key derived from the passphrase.
+func Seal(passphrase string, payload []byte) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+
+	f := &file{
+		Version: Version,
+		KDF:     kdfScrypt,
+		N:       defaultN,
+		R:       defaultR,
+		P:       defaultP,
+		Salt:    make([]byte, saltSize),
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(f.Salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	key, err := f.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Nonce = nonce[:]
+	f.Sealed = secretbox.Seal(nil, payload, &nonce, key)
+
+	return json.Marshal(f)
+}
+
+// Open decrypts a file sealed with the passphrase.
+func Open(passphrase string, data []byte) ([]byte, error) {
+	f := &file{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("invalid account backup: %w", err)
+	}
+
+	if f.Version != Version {
+		return nil, fmt.Errorf("unsupported account backup version %d", f.Version)
+	}
+
+	if f.KDF != kdfScrypt || f.N <= 1 || f.N > maxN || f.R <= 0 || f.P <= 0 || len(f.Salt) == 0 {
+		return nil, fmt.Errorf("invalid account backup key derivation")
+	}
+
+	var nonce [24]byte
+	if len(f.Nonce) != len(nonce) {
+		return nil, fmt.Errorf("invalid account backup nonce")
+	}
+
+	copy(nonce[:], f.Nonce)
+
+	key, err := f.key(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account backup key derivation: %w", err)
+	}
+
+	payload, ok := secretbox.Open(nil, f.Sealed, &nonce, key)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+
+	return payload, nil
+}
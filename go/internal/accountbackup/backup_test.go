@@ -0,0 +1,68 @@
+package accountbackup
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealOpen(t *testing.T) {
+	payload := []byte(`{"account": "payload"}`)
+
+	data, err := Seal("correct horse battery staple", payload)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "account")
+
+	opened, err := Open("correct horse battery staple", data)
+	require.NoError(t, err)
+	assert.Equal(t, payload, opened)
+
+	_, err = Open("wrong passphrase", data)
+	assert.Equal(t, ErrDecrypt, err)
+
+	// the salt and the nonce are random
+	other, err := Seal("correct horse battery staple", payload)
+	require.NoError(t, err)
+	assert.NotEqual(t, data, other)
+
+	_, err = Seal("", payload)
+	assert.Error(t, err)
+}
+
+func TestOpenInvalid(t *testing.T) {
+	data, err := Seal("passphrase", []byte("payload"))
+	require.NoError(t, err)
+
+	alter := func(f func(f *file)) []byte {
+		decoded := &file{}
+		require.NoError(t, json.Unmarshal(data, decoded))
+		f(decoded)
+
+		altered, err := json.Marshal(decoded)
+		require.NoError(t, err)
+
+		return altered
+	}
+
+	_, err = Open("passphrase", alter(func(f *file) { f.Sealed[0] ^= 1 }))
+	assert.Equal(t, ErrDecrypt, err)
+
+	_, err = Open("passphrase", alter(func(f *file) { f.Salt[0] ^= 1 }))
+	assert.Equal(t, ErrDecrypt, err)
+
+	for name, f := range map[string]func(f *file){
+		"version": func(f *file) { f.Version = 2 },
+		"kdf":     func(f *file) { f.KDF = "argon2" },
+		"cost":    func(f *file) { f.N = 1 << 30 },
+		"nonce":   func(f *file) { f.Nonce = f.Nonce[:8] },
+	} {
+		_, err = Open("passphrase", alter(f))
+		assert.Error(t, err, name)
+		assert.NotEqual(t, ErrDecrypt, err, name)
+	}
+
+	_, err = Open("passphrase", []byte("not json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,8 @@
+// Package accountbackup implements the passphrase encrypted file an account
+// is exported to, to move it to a new device without linking both devices.
+//
+// The key is derived from the passphrase with scrypt and the payload is
+// sealed with secretbox. The cost of the derivation and its salt are stored
+// in the clear header of the file, so the cost can be raised without
+// breaking the files already exported.
+package accountbackup
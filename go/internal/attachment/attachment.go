@@ -0,0 +1,627 @@
+package attachment
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const ProtocolID = protocol.ID("/berty/attachment/1.0.0")
+
+const (
+	DefaultChunkSize       = 256 << 10
+	DefaultStreamChunkSize = 16 << 10
+	MaxChunkSize           = 1 << 20
+
+	// maxChunksPerRequest caps the chunks requested at once to a peer
+	maxChunksPerRequest = 16
+
+	requestTimeout = 2 * time.Minute
+
+	keySize = 32
+)
+
+var (
+	// ErrIncomplete is returned while chunks of an attachment are missing
+	ErrIncomplete = fmt.Errorf("attachment incomplete")
+
+	// ErrInvalidChunk is returned for the chunks not matching their hash
+	ErrInvalidChunk = fmt.Errorf("invalid chunk")
+)
+
+// Descriptor identifies an attachment, it carries its key and has to be sent
+// encrypted.
+type Descriptor struct {
+	// ID is derived from the size and the chunks of the attachment
+	ID        []byte   `json:"id"`
+	Size      int64    `json:"size"`
+	ChunkSize int      `json:"chunk_size"`
+	Chunks    [][]byte `json:"chunks,omitempty"`
+	Key       []byte   `json:"key"`
+
+	// Root is the CID of the index of the chunks of an attachment published
+	// on IPFS, the chunks are then omitted, see Service.Publish
+	Root []byte `json:"root,omitempty"`
+}
+
+func descriptorID(size int64, chunkSize int, chunks [][]byte) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(size))
+	binary.BigEndian.PutUint64(buf[8:], uint64(chunkSize))
+
+	h := sha256.New()
+	_, _ = h.Write([]byte("berty attachment"))
+	_, _ = h.Write(buf)
+	for _, hash := range chunks {
+		_, _ = h.Write(hash)
+	}
+
+	return h.Sum(nil)
+}
+
+func (d *Descriptor) validate() error {
+	if d == nil || len(d.Key) != keySize || d.Size < 0 || d.ChunkSize <= 0 || d.ChunkSize > MaxChunkSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid attachment descriptor"))
+	}
+
+	if int64(len(d.Chunks)) != (d.Size+int64(d.ChunkSize)-1)/int64(d.ChunkSize) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("%d chunks for %d bytes", len(d.Chunks), d.Size))
+	}
+
+	if !hmac.Equal(d.ID, descriptorID(d.Size, d.ChunkSize, d.Chunks)) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid attachment ID"))
+	}
+
+	return nil
+}
+
+// Progress is the state of the transfer of an attachment.
+type Progress struct {
+	ID       []byte `json:"id"`
+	Chunks   int    `json:"chunks"`
+	Received int    `json:"received"`
+	Done     bool   `json:"done"`
+}
+
+// Opts configures an attachment service.
+type Opts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the chunks and the pending transfers
+	Datastore ipfs_ds.Datastore
+
+	ChunkSize int
+
+	// StreamChunkSize is the size of the chunks of the streams when they
+	// aren't flushed before, it bounds the latency of a live stream
+	StreamChunkSize int
+
+	// Lanes schedules the chunks behind the messages to the same peers
+	Lanes *ipfsutil.OutboundLanes
+
+	// Allow reports whether the chunks are served to a peer, all the peers
+	// are allowed by default
+	Allow func(peer.ID) bool
+
+	// Quota is the space in bytes of the attachments and streams fetched
+	// from the peers, the least recently used are collected beyond it once
+	// a transfer completes. There is no quota if zero.
+	Quota int64
+
+	// AutoResume reports whether a pending transfer is resumed in the
+	// background, given the size of its attachment, or 0 for a stream. All
+	// of them are resumed by default, the fetches asked explicitly always
+	// run.
+	AutoResume func(size int64) bool
+
+	// IPFS is the node the attachments are published on, see Publish, the
+	// chunks of the published ones are fetched over bitswap before asking
+	// the peers. There is no publication if nil.
+	IPFS ipfs_interface.CoreAPI
+
+	// Pinning is the remote node pinning the published attachments, if any
+	Pinning *PinningService
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		opts.Datastore = ipfs_ds.NewMapDatastore()
+	}
+
+	if opts.ChunkSize <= 0 || opts.ChunkSize > MaxChunkSize {
+		opts.ChunkSize = DefaultChunkSize
+	}
+
+	if opts.StreamChunkSize <= 0 || opts.StreamChunkSize > MaxChunkSize {
+		opts.StreamChunkSize = DefaultStreamChunkSize
+	}
+
+	if opts.Allow == nil {
+		opts.Allow = func(peer.ID) bool { return true }
+	}
+
+	if opts.AutoResume == nil {
+		opts.AutoResume = func(int64) bool { return true }
+	}
+}
+
+// request asks a peer for chunks, it answers a response by chunk, in order.
+type request struct {
+	Chunks [][]byte `json:"chunks"`
+}
+
+// response carries a chunk, its data is empty if the peer doesn't have it.
+type response struct {
+	Data []byte `json:"data,omitempty"`
+}
+
+// Service stores the attachments and fetches them from the peers.
+type Service struct {
+	logger *zap.Logger
+	host   host.Host
+	store  *chunkStore
+	opts   Opts
+
+	muFetching sync.Mutex
+	fetching   map[string]struct{}
+
+	muUsages sync.Mutex
+
+	muLive sync.Mutex
+	live   map[string]int
+
+	muSubs sync.Mutex
+	subs   map[chan *Progress]struct{}
+}
+
+// New registers the attachment protocol on the host.
+func New(h host.Host, opts Opts) (*Service, error) {
+	opts.applyDefaults()
+
+	store, err := newChunkStore(opts.Datastore)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		logger:   opts.Logger,
+		host:     h,
+		store:    store,
+		opts:     opts,
+		fetching: make(map[string]struct{}),
+		live:     make(map[string]int),
+		subs:     make(map[chan *Progress]struct{}),
+	}
+
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	h.SetStreamHandler(StreamProtocolID, s.handleStreamRequest)
+
+	return s, nil
+}
+
+// Start resumes the pending transfers, then each time one of their peers is
+// connected, until the context is done.
+func (s *Service) Start(ctx context.Context) {
+	s.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			for _, t := range s.store.pending(c.RemotePeer()) {
+				go s.resume(ctx, t)
+			}
+		},
+	})
+
+	for _, t := range s.store.pending("") {
+		go s.resume(ctx, t)
+	}
+}
+
+func (s *Service) resume(ctx context.Context, t *transfer) {
+	size := int64(0)
+	if t.Descriptor != nil {
+		size = t.Descriptor.Size
+	}
+
+	if !s.opts.AutoResume(size) {
+		return
+	}
+
+	if err := s.fetch(ctx, t); err != nil && err != ErrIncomplete {
+		s.logger.Debug("unable to resume transfer", zap.String("id", fmt.Sprintf("%.12s", hex.EncodeToString(t.id()))), zap.Error(err))
+	}
+}
+
+// Add splits and seals a file, its chunks are kept to be served to the peers.
+func (s *Service) Add(r io.Reader) (*Descriptor, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(crand.Reader, key); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	d := &Descriptor{ChunkSize: s.opts.ChunkSize, Chunks: [][]byte{}, Key: key}
+	buf := make([]byte, s.opts.ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sealed := sealChunk(key, len(d.Chunks), buf[:n])
+			hash := sha256.Sum256(sealed)
+
+			if err := s.store.putChunk(hash[:], sealed); err != nil {
+				return nil, err
+			}
+
+			d.Chunks = append(d.Chunks, hash[:])
+			d.Size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	d.ID = descriptorID(d.Size, d.ChunkSize, d.Chunks)
+	s.track(&usage{ID: d.ID, Chunks: d.Chunks, Own: true})
+
+	return d, nil
+}
+
+// Fetch gets the missing chunks of an attachment from the peers, until all
+// of them are received. If some are not found, the transfer resumes once one
+// of the peers is connected again. The scope, e.g. the conversation, groups
+// the attachments for their retention.
+func (s *Service) Fetch(ctx context.Context, scope []byte, d *Descriptor, sources []peer.ID) error {
+	d, err := s.resolve(ctx, d)
+	if err != nil {
+		return err
+	}
+
+	s.track(&usage{ID: d.ID, Scope: scope, Chunks: d.Chunks})
+
+	t := &transfer{Descriptor: d, Sources: sources}
+	if prev := s.store.getTransfer(d.ID); prev != nil {
+		t.Sources = mergeSources(prev.Sources, sources)
+	}
+
+	if len(s.store.missing(d)) > 0 {
+		if err := s.store.putTransfer(t); err != nil {
+			return err
+		}
+	}
+
+	return s.fetch(ctx, t)
+}
+
+func mergeSources(a, b []peer.ID) []peer.ID {
+	seen := make(map[peer.ID]struct{}, len(a)+len(b))
+	merged := []peer.ID{}
+	for _, p := range append(append([]peer.ID{}, a...), b...) {
+		if _, ok := seen[p]; !ok {
+			seen[p] = struct{}{}
+			merged = append(merged, p)
+		}
+	}
+
+	return merged
+}
+
+// fetch runs a transfer, at most once at a time.
+func (s *Service) fetch(ctx context.Context, t *transfer) error {
+	id := hex.EncodeToString(t.id())
+
+	s.muFetching.Lock()
+	if _, ok := s.fetching[id]; ok {
+		s.muFetching.Unlock()
+		return ErrIncomplete
+	}
+	s.fetching[id] = struct{}{}
+	s.muFetching.Unlock()
+
+	defer func() {
+		s.muFetching.Lock()
+		delete(s.fetching, id)
+		s.muFetching.Unlock()
+	}()
+
+	if t.Stream != nil {
+		return s.fetchStream(ctx, t)
+	}
+
+	d := t.Descriptor
+	missing := s.store.missing(d)
+	received := len(d.Chunks) - len(missing)
+	onChunk := func() {
+		received++
+		s.emit(&Progress{ID: d.ID, Chunks: len(d.Chunks), Received: received})
+	}
+
+	if len(d.Root) > 0 && len(missing) > 0 && s.opts.IPFS != nil {
+		missing = s.fetchFromIPFS(ctx, d, missing, onChunk)
+	}
+
+	for _, p := range s.sortSources(t.Sources) {
+		if len(missing) == 0 {
+			break
+		}
+
+		if p == s.host.ID() {
+			continue
+		}
+
+		still, err := s.fetchFrom(ctx, p, d, missing, onChunk)
+		if err != nil {
+			s.logger.Debug("unable to fetch chunks", zap.Stringer("peer", p), zap.Error(err))
+		}
+
+		missing = still
+	}
+
+	if len(missing) > 0 {
+		return ErrIncomplete
+	}
+
+	if err := s.store.delTransfer(d.ID); err != nil {
+		return err
+	}
+
+	s.completed(&usage{ID: d.ID, Chunks: d.Chunks})
+	s.emit(&Progress{ID: d.ID, Chunks: len(d.Chunks), Received: len(d.Chunks), Done: true})
+
+	return nil
+}
+
+// sortSources puts the connected peers first.
+func (s *Service) sortSources(peers []peer.ID) []peer.ID {
+	sources := []peer.ID{}
+	for _, p := range peers {
+		if s.host.Network().Connectedness(p) == network.Connected {
+			sources = append(sources, p)
+		}
+	}
+
+	for _, p := range peers {
+		if s.host.Network().Connectedness(p) != network.Connected {
+			sources = append(sources, p)
+		}
+	}
+
+	return sources
+}
+
+// fetchFrom requests the missing chunks to a peer, it returns the chunks
+// still missing.
+func (s *Service) fetchFrom(ctx context.Context, p peer.ID, d *Descriptor, missing []int, onChunk func()) ([]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return missing, err
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(requestTimeout))
+
+	enc := json.NewEncoder(stream)
+
+	// the chunks are base64 encoded
+	dec := json.NewDecoder(io.LimitReader(stream, int64(len(missing))*int64(2*d.ChunkSize+secretbox.Overhead+64)))
+
+	still := []int{}
+	for start := 0; start < len(missing); start += maxChunksPerRequest {
+		batch := missing[start:]
+		if len(batch) > maxChunksPerRequest {
+			batch = batch[:maxChunksPerRequest]
+		}
+
+		req := &request{Chunks: make([][]byte, len(batch))}
+		for i, index := range batch {
+			req.Chunks[i] = d.Chunks[index]
+		}
+
+		if err := enc.Encode(req); err != nil {
+			_ = stream.Reset()
+			return append(still, missing[start:]...), errcode.ErrSerialization.Wrap(err)
+		}
+
+		for i, index := range batch {
+			res := &response{}
+			if err := dec.Decode(res); err != nil {
+				_ = stream.Reset()
+				return append(still, missing[start+i:]...), errcode.ErrDeserialization.Wrap(err)
+			}
+
+			if len(res.Data) == 0 {
+				still = append(still, index)
+				continue
+			}
+
+			if err := s.store.putChunk(d.Chunks[index], res.Data); err != nil {
+				_ = stream.Reset()
+				return append(still, missing[start+i:]...), err
+			}
+
+			onChunk()
+		}
+	}
+
+	return still, nil
+}
+
+func (s *Service) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	if !s.opts.Allow(stream.Conn().RemotePeer()) {
+		_ = stream.Reset()
+		return
+	}
+
+	_ = stream.SetDeadline(time.Now().Add(requestTimeout))
+
+	dec := json.NewDecoder(stream)
+	enc := json.NewEncoder(s.opts.Lanes.Stream(stream, ipfsutil.PriorityMedia))
+	for {
+		req := &request{}
+		if err := dec.Decode(req); err != nil {
+			if err != io.EOF {
+				_ = stream.Reset()
+			}
+			return
+		}
+
+		if len(req.Chunks) > maxChunksPerRequest {
+			_ = stream.Reset()
+			return
+		}
+
+		for _, hash := range req.Chunks {
+			res := &response{}
+			if data, err := s.store.getChunk(hash); err == nil {
+				res.Data = data
+			}
+
+			if err := enc.Encode(res); err != nil {
+				_ = stream.Reset()
+				return
+			}
+		}
+	}
+}
+
+// Read writes the content of an attachment once all its chunks are
+// received.
+func (s *Service) Read(d *Descriptor, w io.Writer) error {
+	d, err := s.resolveLocal(d)
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	for i, hash := range d.Chunks {
+		sealed, err := s.store.getChunk(hash)
+		if err != nil {
+			return err
+		}
+
+		chunk, err := openChunk(d.Key, i, sealed)
+		if err != nil {
+			return err
+		}
+
+		if size += int64(len(chunk)); size > d.Size || (i < len(d.Chunks)-1 && len(chunk) != d.ChunkSize) {
+			return ErrInvalidChunk
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	if size != d.Size {
+		return ErrInvalidChunk
+	}
+
+	s.touch(d.ID)
+
+	return nil
+}
+
+// Progress returns the state of the transfer of an attachment.
+func (s *Service) Progress(d *Descriptor) (*Progress, error) {
+	resolved, err := s.resolveLocal(d)
+	if err == ErrIncomplete {
+		// the chunks of a published attachment aren't known before its fetch
+		chunks := int((d.Size + int64(d.ChunkSize) - 1) / int64(d.ChunkSize))
+		return &Progress{ID: d.ID, Chunks: chunks}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	d = resolved
+
+	missing := s.store.missing(d)
+
+	return &Progress{ID: d.ID, Chunks: len(d.Chunks), Received: len(d.Chunks) - len(missing), Done: len(missing) == 0}, nil
+}
+
+// Subscribe returns the progress of the transfers until the context is done,
+// the updates are dropped for a slow reader.
+func (s *Service) Subscribe(ctx context.Context) <-chan *Progress {
+	ch := make(chan *Progress, 32)
+
+	s.muSubs.Lock()
+	s.subs[ch] = struct{}{}
+	s.muSubs.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.muSubs.Lock()
+		delete(s.subs, ch)
+		s.muSubs.Unlock()
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (s *Service) emit(p *Progress) {
+	s.muSubs.Lock()
+	defer s.muSubs.Unlock()
+
+	for ch := range s.subs {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+func chunkNonce(index int) *[24]byte {
+	var nonce [24]byte
+	binary.BigEndian.PutUint64(nonce[16:], uint64(index))
+
+	return &nonce
+}
+
+func sealChunk(key []byte, index int, chunk []byte) []byte {
+	var k [keySize]byte
+	copy(k[:], key)
+
+	return secretbox.Seal(nil, chunk, chunkNonce(index), &k)
+}
+
+func openChunk(key []byte, index int, sealed []byte) ([]byte, error) {
+	var k [keySize]byte
+	copy(k[:], key)
+
+	chunk, ok := secretbox.Open(nil, sealed, chunkNonce(index), &k)
+	if !ok {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(ErrInvalidChunk)
+	}
+
+	return chunk, nil
+}
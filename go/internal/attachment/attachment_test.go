@@ -0,0 +1,156 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	s, err := New(h, Opts{Logger: testutil.Logger(t), ChunkSize: 1000})
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 999, 1000, 2500} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		d, err := s.Add(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Len(t, d.Chunks, (size+999)/1000)
+
+		out := &bytes.Buffer{}
+		require.NoError(t, s.Read(d, out))
+		assert.Equal(t, data, out.Bytes())
+	}
+
+	d, err := s.Add(bytes.NewReader([]byte("attachment")))
+	require.NoError(t, err)
+
+	// the descriptor can't be altered
+	d.Size++
+	assert.Error(t, s.Read(d, &bytes.Buffer{}))
+}
+
+func TestFetchResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	ha, err := mn.GenPeer()
+	require.NoError(t, err)
+	hb, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	sa, err := New(ha, Opts{Logger: testutil.Logger(t), ChunkSize: 100})
+	require.NoError(t, err)
+
+	dsB := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	sb, err := New(hb, Opts{Logger: testutil.Logger(t), Datastore: dsB, ChunkSize: 100})
+	require.NoError(t, err)
+
+	require.NoError(t, ha.Connect(ctx, peer.AddrInfo{ID: hb.ID(), Addrs: hb.Addrs()}))
+
+	data := make([]byte, 5000)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	d, err := sa.Add(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	// the sender only has a part of the chunks
+	removed := map[int][]byte{}
+	for i := 10; i < 20; i++ {
+		removed[i], err = sa.store.getChunk(d.Chunks[i])
+		require.NoError(t, err)
+		require.NoError(t, sa.opts.Datastore.Delete(chunkKey(d.Chunks[i])))
+	}
+
+	progress := sb.Subscribe(ctx)
+
+	assert.Equal(t, ErrIncomplete, sb.Fetch(ctx, nil, d, []peer.ID{ha.ID()}))
+	assert.Equal(t, ErrIncomplete, sb.Read(d, &bytes.Buffer{}))
+
+	p, err := sb.Progress(d)
+	require.NoError(t, err)
+	assert.Equal(t, 40, p.Received)
+	assert.False(t, p.Done)
+
+	first := <-progress
+	assert.Equal(t, 1, first.Received)
+	assert.Equal(t, 50, first.Chunks)
+
+	// the transfer is kept across restarts
+	sb, err = New(hb, Opts{Logger: testutil.Logger(t), Datastore: dsB, ChunkSize: 100})
+	require.NoError(t, err)
+	require.Len(t, sb.store.pending(ha.ID()), 1)
+
+	for i, chunk := range removed {
+		require.NoError(t, sa.store.putChunk(d.Chunks[i], chunk))
+	}
+
+	require.NoError(t, sb.fetch(ctx, sb.store.pending(ha.ID())[0]))
+	assert.Empty(t, sb.store.pending(""))
+
+	out := &bytes.Buffer{}
+	require.NoError(t, sb.Read(d, out))
+	assert.Equal(t, data, out.Bytes())
+
+	// a chunk not matching its hash is refused
+	assert.Equal(t, ErrInvalidChunk, sb.store.putChunk(d.Chunks[0], []byte("forged")))
+}
+
+func TestAutoResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	ha, err := mn.GenPeer()
+	require.NoError(t, err)
+	hb, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	sa, err := New(ha, Opts{Logger: testutil.Logger(t), ChunkSize: 100})
+	require.NoError(t, err)
+
+	sizes := []int64{}
+	sb, err := New(hb, Opts{Logger: testutil.Logger(t), ChunkSize: 100, AutoResume: func(size int64) bool {
+		sizes = append(sizes, size)
+		return false
+	}})
+	require.NoError(t, err)
+
+	d, err := sa.Add(bytes.NewReader(make([]byte, 500)))
+	require.NoError(t, err)
+
+	// the sender isn't connected yet
+	assert.Equal(t, ErrIncomplete, sb.Fetch(ctx, nil, d, []peer.ID{ha.ID()}))
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, ha.Connect(ctx, peer.AddrInfo{ID: hb.ID(), Addrs: hb.Addrs()}))
+
+	// the transfer isn't resumed in the background
+	sb.resume(ctx, sb.store.pending(ha.ID())[0])
+	assert.Equal(t, []int64{500}, sizes)
+	assert.Len(t, sb.store.pending(""), 1)
+
+	// the fetches asked explicitly still run
+	require.NoError(t, sb.Fetch(ctx, nil, d, []peer.ID{ha.ID()}))
+	assert.Empty(t, sb.store.pending(""))
+}
@@ -0,0 +1,29 @@
+// Package attachment transfers the files attached to the messages: a file is
+// split in chunks, each chunk is sealed with the key of the attachment and
+// addressed by the hash of its sealed bytes.
+//
+// The descriptor of an attachment lists its chunks and carries its key, it
+// is sent within a message, so only the members of the conversation can open
+// the chunks. The chunks are fetched from any peer holding them, e.g. any
+// device of the sender, the fetched chunks are kept so an interrupted
+// transfer resumes where it stopped once one of its peers is connected
+// again.
+//
+// A large attachment can be published on IPFS instead: its sealed chunks are
+// stored as raw blocks, linked by a dag-cbor index pinned by the node and by
+// a pinning service if any, and its descriptor only carries the CID of the
+// index and the key. The members fetch the chunks over bitswap from any node
+// holding them, so the sender doesn't send the file to each of them, and
+// fall back to the peers for the ones not found.
+//
+// A stream, e.g. a voice message, is sent while it is recorded: its
+// descriptor only carries its key and its chunks are addressed by index, the
+// last one being flagged within its sealed bytes. The peers following a live
+// stream wait for its next chunks, so it can be played before its end, and an
+// interrupted stream is resumed the same way as an attachment.
+//
+// The attachments and streams fetched from the peers are a cache: the least
+// recently used are deleted beyond the quota of the service, or by the
+// retention of their scope, and can be fetched again. The ones added by the
+// node are never deleted, it is their source.
+package attachment
@@ -0,0 +1,352 @@
+package attachment
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+)
+
+var usagesKey = ipfs_ds.NewKey("usages")
+
+// touchInterval throttles the updates of the last use of an attachment
+const touchInterval = time.Minute
+
+// usage records an attachment or a stream held by the node, to report the
+// space it takes and collect it.
+type usage struct {
+	ID     []byte   `json:"id"`
+	Scope  []byte   `json:"scope,omitempty"`
+	Chunks [][]byte `json:"chunks,omitempty"`
+	Stream bool     `json:"stream,omitempty"`
+
+	// Own is set on the attachments added by the node, it is their source
+	// so they are never collected
+	Own bool `json:"own,omitempty"`
+
+	// Size is the count of sealed bytes held
+	Size int64 `json:"size"`
+
+	AddedAt int64 `json:"added_at"`
+	UsedAt  int64 `json:"used_at"`
+}
+
+// Usage is the space taken by the attachments and the streams, in sealed
+// bytes.
+type Usage struct {
+	// Own is the space of the attachments and streams added by the node
+	Own int64 `json:"own"`
+
+	// Cached is the space of the ones fetched from the peers, they are
+	// collected beyond the quota
+	Cached int64 `json:"cached"`
+
+	Attachments int `json:"attachments"`
+	Streams     int `json:"streams"`
+
+	// Scopes is the space of the fetched ones by scope, i.e. by
+	// conversation, hex encoded
+	Scopes map[string]int64 `json:"scopes"`
+}
+
+// CollectReport reports the attachments collected.
+type CollectReport struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+func usageKey(id []byte) ipfs_ds.Key {
+	return usagesKey.ChildString(hex.EncodeToString(id))
+}
+
+func (s *chunkStore) getUsage(id []byte) (*usage, error) {
+	data, err := s.ds.Get(usageKey(id))
+	if err == ipfs_ds.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	u := &usage{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return u, nil
+}
+
+func (s *chunkStore) putUsage(u *usage) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := s.ds.Put(usageKey(u.ID), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (s *chunkStore) usages() ([]*usage, error) {
+	res, err := s.ds.Query(query.Query{Prefix: usagesKey.String()})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	usages := make([]*usage, 0, len(entries))
+	for _, entry := range entries {
+		u := &usage{}
+		if err := json.Unmarshal(entry.Value, u); err != nil {
+			continue
+		}
+
+		usages = append(usages, u)
+	}
+
+	return usages, nil
+}
+
+// size returns the count of sealed bytes of an attachment or a stream held.
+func (s *chunkStore) size(u *usage) int64 {
+	size := int64(0)
+
+	if u.Stream {
+		for i := 0; ; i++ {
+			n, err := s.ds.GetSize(streamChunkKey(u.ID, i))
+			if err != nil {
+				break
+			}
+			size += int64(n)
+		}
+
+		return size
+	}
+
+	for _, hash := range u.Chunks {
+		if n, err := s.ds.GetSize(chunkKey(hash)); err == nil {
+			size += int64(n)
+		}
+	}
+
+	return size
+}
+
+// remove deletes the chunks of an attachment or a stream and its record.
+func (s *chunkStore) remove(u *usage) error {
+	if u.Stream {
+		res, err := s.ds.Query(query.Query{Prefix: streamsKey.ChildString(hex.EncodeToString(u.ID)).String(), KeysOnly: true})
+		if err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		entries, err := res.Rest()
+		if err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		for _, entry := range entries {
+			if err := s.ds.Delete(ipfs_ds.RawKey(entry.Key)); err != nil && err != ipfs_ds.ErrNotFound {
+				return errcode.ErrInternal.Wrap(err)
+			}
+		}
+	}
+
+	for _, hash := range u.Chunks {
+		if err := s.ds.Delete(chunkKey(hash)); err != nil && err != ipfs_ds.ErrNotFound {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	if err := s.ds.Delete(usageKey(u.ID)); err != nil && err != ipfs_ds.ErrNotFound {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// track records an attachment or a stream held by the node with its current
+// size, the scope is kept once known.
+func (s *Service) track(u *usage) {
+	s.muUsages.Lock()
+	defer s.muUsages.Unlock()
+
+	now := time.Now().UnixNano()
+	u.AddedAt, u.UsedAt = now, now
+
+	if prev, err := s.store.getUsage(u.ID); err == nil && prev != nil {
+		u.AddedAt, u.Own = prev.AddedAt, u.Own || prev.Own
+		if u.Scope == nil {
+			u.Scope = prev.Scope
+		}
+	}
+
+	u.Size = s.store.size(u)
+
+	if err := s.store.putUsage(u); err != nil {
+		s.logger.Warn("unable to record attachment usage", zap.Error(err))
+	}
+}
+
+// completed records the size of a transfer once complete, then collects the
+// least recently used beyond the quota.
+func (s *Service) completed(u *usage) {
+	s.track(u)
+
+	if s.opts.Quota <= 0 {
+		return
+	}
+
+	if report, err := s.collect(nil, s.opts.Quota, time.Time{}, u.ID); err != nil {
+		s.logger.Warn("unable to collect attachments", zap.Error(err))
+	} else if report.Removed > 0 {
+		s.logger.Debug("attachments collected", zap.Int("removed", report.Removed), zap.Int64("freed", report.Freed))
+	}
+}
+
+// touch records the use of an attachment or a stream, for the collection of
+// the least recently used.
+func (s *Service) touch(id []byte) {
+	s.muUsages.Lock()
+	defer s.muUsages.Unlock()
+
+	u, err := s.store.getUsage(id)
+	if err != nil || u == nil || time.Since(time.Unix(0, u.UsedAt)) < touchInterval {
+		return
+	}
+
+	u.UsedAt = time.Now().UnixNano()
+	if err := s.store.putUsage(u); err != nil {
+		s.logger.Warn("unable to record attachment usage", zap.Error(err))
+	}
+}
+
+// Usage returns the space taken by the attachments and the streams.
+func (s *Service) Usage() (*Usage, error) {
+	usages, err := s.store.usages()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Usage{Scopes: map[string]int64{}}
+	for _, u := range usages {
+		if u.Stream {
+			report.Streams++
+		} else {
+			report.Attachments++
+		}
+
+		if u.Own {
+			report.Own += u.Size
+			continue
+		}
+
+		report.Cached += u.Size
+		if u.Scope != nil {
+			report.Scopes[hex.EncodeToString(u.Scope)] += u.Size
+		}
+	}
+
+	return report, nil
+}
+
+// collectable reports whether an attachment or a stream can be collected:
+// fetched from the peers and not being transferred.
+func (s *Service) collectable(u *usage) bool {
+	if u.Own || s.isLive(u.ID) || s.store.getTransfer(u.ID) != nil {
+		return false
+	}
+
+	s.muFetching.Lock()
+	_, fetching := s.fetching[hex.EncodeToString(u.ID)]
+	s.muFetching.Unlock()
+
+	return !fetching
+}
+
+// Collect deletes the least recently used attachments and streams fetched
+// from the peers until their space is within quota bytes, they can be
+// fetched again from the peers of their conversation.
+func (s *Service) Collect(quota int64) (*CollectReport, error) {
+	return s.collect(nil, quota, time.Time{}, nil)
+}
+
+// Prune applies the retention of a scope: it deletes the attachments and
+// streams of the scope fetched before a date, if not zero, then the least
+// recently used beyond maxBytes, if not zero.
+func (s *Service) Prune(scope []byte, before time.Time, maxBytes int64) (*CollectReport, error) {
+	return s.collect(scope, maxBytes, before, nil)
+}
+
+func (s *Service) collect(scope []byte, quota int64, before time.Time, keep []byte) (*CollectReport, error) {
+	s.muUsages.Lock()
+	defer s.muUsages.Unlock()
+
+	usages, err := s.store.usages()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []*usage{}
+	total := int64(0)
+	for _, u := range usages {
+		if u.Own || (scope != nil && string(u.Scope) != string(scope)) {
+			continue
+		}
+
+		total += u.Size
+		if s.collectable(u) && string(u.ID) != string(keep) {
+			candidates = append(candidates, u)
+		}
+	}
+
+	// the least recently used first
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].UsedAt < candidates[j].UsedAt })
+
+	report := &CollectReport{}
+	for _, u := range candidates {
+		expired := !before.IsZero() && u.AddedAt < before.UnixNano()
+		if !expired && (quota <= 0 || total <= quota) {
+			continue
+		}
+
+		if err := s.store.remove(u); err != nil {
+			return report, err
+		}
+
+		total -= u.Size
+		report.Removed++
+		report.Freed += u.Size
+	}
+
+	return report, nil
+}
+
+// Forget deletes an attachment or a stream fetched from the peers.
+func (s *Service) Forget(id []byte) error {
+	s.muUsages.Lock()
+	defer s.muUsages.Unlock()
+
+	u, err := s.store.getUsage(id)
+	if err != nil {
+		return err
+	} else if u == nil {
+		return errcode.ErrInvalidInput
+	}
+
+	if !s.collectable(u) {
+		return errcode.ErrInvalidInput
+	}
+
+	return s.store.remove(u)
+}
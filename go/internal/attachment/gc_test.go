@@ -0,0 +1,100 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	ha, err := mn.GenPeer()
+	require.NoError(t, err)
+	hb, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	// each attachment is a chunk of 1016 sealed bytes
+	sa, err := New(ha, Opts{Logger: testutil.Logger(t), ChunkSize: 1000})
+	require.NoError(t, err)
+	sb, err := New(hb, Opts{Logger: testutil.Logger(t), ChunkSize: 1000, Quota: 2500})
+	require.NoError(t, err)
+
+	require.NoError(t, ha.Connect(ctx, peer.AddrInfo{ID: hb.ID(), Addrs: hb.Addrs()}))
+
+	scopeA, scopeB := []byte("scope a"), []byte("scope b")
+
+	descriptors := []*Descriptor{}
+	for i := 0; i < 4; i++ {
+		data := make([]byte, 1000)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		d, err := sa.Add(bytes.NewReader(data))
+		require.NoError(t, err)
+		descriptors = append(descriptors, d)
+	}
+
+	scopes := [][]byte{scopeA, scopeA, scopeB}
+	for i, scope := range scopes {
+		require.NoError(t, sb.Fetch(ctx, scope, descriptors[i], []peer.ID{ha.ID()}))
+		time.Sleep(time.Millisecond)
+	}
+
+	// the least recently used is collected beyond the quota
+	p, err := sb.Progress(descriptors[0])
+	require.NoError(t, err)
+	assert.False(t, p.Done)
+
+	for _, d := range descriptors[1:3] {
+		require.NoError(t, sb.Read(d, &bytes.Buffer{}))
+	}
+
+	usage, err := sb.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Own)
+	assert.Equal(t, int64(2032), usage.Cached)
+	assert.Equal(t, 2, usage.Attachments)
+	assert.Equal(t, map[string]int64{hex.EncodeToString(scopeA): 1016, hex.EncodeToString(scopeB): 1016}, usage.Scopes)
+
+	// the attachments added are never collected
+	report, err := sa.Collect(1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Removed)
+
+	usage, err = sa.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4064), usage.Own)
+	assert.Equal(t, int64(0), usage.Cached)
+
+	// the retention of a scope
+	report, err = sb.Prune(scopeA, time.Now(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Removed: 1, Freed: 1016}, report)
+	assert.Error(t, sb.Read(descriptors[1], &bytes.Buffer{}))
+	require.NoError(t, sb.Read(descriptors[2], &bytes.Buffer{}))
+
+	// fetched again from the peers
+	require.NoError(t, sb.Fetch(ctx, scopeA, descriptors[1], []peer.ID{ha.ID()}))
+	require.NoError(t, sb.Read(descriptors[1], &bytes.Buffer{}))
+
+	require.NoError(t, sb.Forget(descriptors[2].ID))
+	assert.Error(t, sb.Forget(descriptors[2].ID))
+	assert.Error(t, sa.Forget(descriptors[3].ID))
+
+	usage, err = sb.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{hex.EncodeToString(scopeA): 1016}, usage.Scopes)
+}
@@ -0,0 +1,401 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	mh "github.com/multiformats/go-multihash"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// maxIndexSize caps the index block of a published attachment, bitswap
+	// doesn't transfer the blocks over 1 MiB
+	maxIndexSize = 1 << 20
+
+	// ipfsFetchers is the number of chunks fetched at once over bitswap
+	ipfsFetchers = 8
+
+	ipfsFetchTimeout = 30 * time.Second
+
+	// cborTagCID is the CBOR tag of the links of the dag-cbor blocks
+	cborTagCID = 42
+)
+
+// chunkCID returns the CID of the raw block of a sealed chunk, its multihash
+// is the hash the chunk is addressed by.
+func chunkCID(hash []byte) (cid.Cid, error) {
+	mhash, err := mh.Encode(hash, mh.SHA2_256)
+	if err != nil {
+		return cid.Undef, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	return cid.NewCidV1(cid.Raw, mhash), nil
+}
+
+// chunkHash returns the hash of the chunk of a raw block.
+func chunkHash(c cid.Cid) ([]byte, error) {
+	decoded, err := mh.Decode(c.Hash())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if c.Type() != cid.Raw || decoded.Code != mh.SHA2_256 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unexpected chunk block %s", c))
+	}
+
+	return decoded.Digest, nil
+}
+
+// encodeIndex returns the dag-cbor block linking the chunks of a published
+// attachment, a recursive pin of the block pins all of them.
+func encodeIndex(links []cid.Cid) []byte {
+	buf := cborHeader(4, uint64(len(links)))
+	for _, link := range links {
+		buf = append(buf, cborHeader(6, cborTagCID)...)
+
+		// the links are prefixed by the multibase identity
+		raw := append([]byte{0}, link.Bytes()...)
+		buf = append(buf, cborHeader(2, uint64(len(raw)))...)
+		buf = append(buf, raw...)
+	}
+
+	return buf
+}
+
+func decodeIndex(data []byte) ([]cid.Cid, error) {
+	major, count, data, err := readCBORHeader(data)
+	if err != nil {
+		return nil, err
+	} else if major != 4 || count > uint64(len(data)) {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("invalid attachment index"))
+	}
+
+	links := make([]cid.Cid, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var tag, size uint64
+
+		major, tag, data, err = readCBORHeader(data)
+		if err != nil {
+			return nil, err
+		} else if major != 6 || tag != cborTagCID {
+			return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("invalid attachment index link"))
+		}
+
+		major, size, data, err = readCBORHeader(data)
+		if err != nil {
+			return nil, err
+		} else if major != 2 || size < 2 || size > uint64(len(data)) || data[0] != 0 {
+			return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("invalid attachment index link"))
+		}
+
+		link, err := cid.Cast(data[1:size])
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		links, data = append(links, link), data[size:]
+	}
+
+	if len(data) != 0 {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("trailing bytes after the attachment index"))
+	}
+
+	return links, nil
+}
+
+func cborHeader(major byte, n uint64) []byte {
+	major <<= 5
+
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= 0xff:
+		return []byte{major | 24, byte(n)}
+	case n <= 0xffff:
+		buf := []byte{major | 25, 0, 0}
+		binary.BigEndian.PutUint16(buf[1:], uint16(n))
+		return buf
+	case n <= 0xffffffff:
+		buf := []byte{major | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		return buf
+	}
+
+	buf := []byte{major | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(buf[1:], n)
+
+	return buf
+}
+
+func readCBORHeader(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errcode.ErrDeserialization.Wrap(io.ErrUnexpectedEOF)
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("unsupported CBOR length"))
+	}
+
+	if len(data) < size {
+		return 0, 0, nil, errcode.ErrDeserialization.Wrap(io.ErrUnexpectedEOF)
+	}
+
+	n := uint64(0)
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+
+	return major, n, data[size:], nil
+}
+
+// Publish stores the chunks of an attachment added by the node on IPFS,
+// pinned by the node and by the pinning service if any, so its peers fetch
+// them over bitswap from any node holding them. The returned descriptor only
+// carries the CID of the index of the chunks, besides the key.
+func (s *Service) Publish(ctx context.Context, d *Descriptor) (*Descriptor, error) {
+	if s.opts.IPFS == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	d, err := s.resolve(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]cid.Cid, len(d.Chunks))
+	for i, hash := range d.Chunks {
+		sealed, err := s.store.getChunk(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		stat, err := s.opts.IPFS.Block().Put(ctx, bytes.NewReader(sealed), options.Block.Format("raw"))
+		if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		links[i] = stat.Path().Cid()
+	}
+
+	index := encodeIndex(links)
+	if len(index) > maxIndexSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("%d chunks can't be published", len(links)))
+	}
+
+	stat, err := s.opts.IPFS.Block().Put(ctx, bytes.NewReader(index), options.Block.Format("cbor"))
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := s.opts.IPFS.Pin().Add(ctx, stat.Path()); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	root := stat.Path().Cid()
+	if s.opts.Pinning != nil {
+		if err := s.opts.Pinning.Pin(ctx, root, hex.EncodeToString(d.ID), s.origins()); err != nil {
+			s.logger.Warn("unable to pin attachment remotely", zap.Stringer("cid", root), zap.Error(err))
+		}
+	}
+
+	return &Descriptor{ID: d.ID, Size: d.Size, ChunkSize: d.ChunkSize, Key: d.Key, Root: root.Bytes()}, nil
+}
+
+// Pin fetches a published attachment and pins it on the node, e.g. on the
+// other devices of its sender, so it is still served while the device which
+// published it is offline.
+func (s *Service) Pin(ctx context.Context, d *Descriptor) error {
+	if s.opts.IPFS == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	root, err := cid.Cast(d.Root)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if _, err := s.resolve(ctx, d); err != nil {
+		return err
+	}
+
+	if err := s.opts.IPFS.Pin().Add(ctx, path.IpfsPath(root)); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (s *Service) origins() []string {
+	origins := []string{}
+	for _, addr := range s.host.Addrs() {
+		origins = append(origins, fmt.Sprintf("%s/p2p/%s", addr, s.host.ID().Pretty()))
+	}
+
+	return origins
+}
+
+// resolveLocal returns the descriptor of an attachment with its chunks, the
+// ones of a published attachment are known once it was fetched or added.
+func (s *Service) resolveLocal(d *Descriptor) (*Descriptor, error) {
+	if d == nil || d.Size == 0 || len(d.Chunks) > 0 || len(d.Root) == 0 {
+		return d, d.validate()
+	}
+
+	if len(d.Key) != keySize || d.Size < 0 || d.ChunkSize <= 0 || d.ChunkSize > MaxChunkSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid attachment descriptor"))
+	}
+
+	u, err := s.store.getUsage(d.ID)
+	if err != nil {
+		return nil, err
+	} else if u == nil || len(u.Chunks) == 0 {
+		return nil, ErrIncomplete
+	}
+
+	resolved := *d
+	resolved.Chunks = u.Chunks
+
+	return &resolved, resolved.validate()
+}
+
+// resolve is resolveLocal fetching the index of the chunks of a published
+// attachment over bitswap when they aren't known yet.
+func (s *Service) resolve(ctx context.Context, d *Descriptor) (*Descriptor, error) {
+	resolved, err := s.resolveLocal(d)
+	if err != ErrIncomplete || s.opts.IPFS == nil {
+		return resolved, err
+	}
+
+	root, err := cid.Cast(d.Root)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ipfsFetchTimeout)
+	defer cancel()
+
+	r, err := s.opts.IPFS.Block().Get(ctx, path.IpfsPath(root))
+	if err != nil {
+		return nil, ErrIncomplete
+	}
+
+	index, err := ioutil.ReadAll(io.LimitReader(r, maxIndexSize+1))
+	if err != nil {
+		return nil, ErrIncomplete
+	}
+
+	links, err := decodeIndex(index)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved = &Descriptor{ID: d.ID, Size: d.Size, ChunkSize: d.ChunkSize, Key: d.Key, Root: d.Root}
+	resolved.Chunks = make([][]byte, len(links))
+	for i, link := range links {
+		if resolved.Chunks[i], err = chunkHash(link); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolved, resolved.validate()
+}
+
+// fetchFromIPFS gets the missing chunks of a published attachment over
+// bitswap, it returns the chunks still missing. It gives up on the first
+// chunk not found, the peers are asked for the rest.
+func (s *Service) fetchFromIPFS(ctx context.Context, d *Descriptor, missing []int, onChunk func()) []int {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		still []int
+	)
+
+	indexes := make(chan int)
+	for i := 0; i < ipfsFetchers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for index := range indexes {
+				err := s.fetchChunkFromIPFS(ctx, d, index)
+
+				mu.Lock()
+				if err != nil {
+					still = append(still, index)
+					cancel()
+				} else {
+					onChunk()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, index := range missing {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	sort.Ints(still)
+
+	return still
+}
+
+func (s *Service) fetchChunkFromIPFS(ctx context.Context, d *Descriptor, index int) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	c, err := chunkCID(d.Chunks[index])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ipfsFetchTimeout)
+	defer cancel()
+
+	r, err := s.opts.IPFS.Block().Get(ctx, path.IpfsPath(c))
+	if err != nil {
+		return err
+	}
+
+	sealed, err := ioutil.ReadAll(io.LimitReader(r, int64(d.ChunkSize+secretbox.Overhead)))
+	if err != nil {
+		return err
+	}
+
+	return s.store.putChunk(d.Chunks[index], sealed)
+}
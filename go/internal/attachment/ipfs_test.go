@@ -0,0 +1,139 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/testutil"
+	cid "github.com/ipfs/go-cid"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	for _, count := range []int{0, 1, 23, 24, 300} {
+		links := make([]cid.Cid, count)
+		for i := range links {
+			hash := make([]byte, 32)
+			_, err := rand.Read(hash)
+			require.NoError(t, err)
+
+			links[i], err = chunkCID(hash)
+			require.NoError(t, err)
+		}
+
+		decoded, err := decodeIndex(encodeIndex(links))
+		require.NoError(t, err)
+		assert.Equal(t, links, decoded)
+	}
+
+	index := encodeIndex([]cid.Cid{})
+	_, err := decodeIndex(append(index, 0))
+	assert.Error(t, err)
+
+	_, err = decodeIndex([]byte{0x81, 0x01})
+	assert.Error(t, err)
+}
+
+func TestPublishFetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	apiA, cleanA := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{Mocknet: mn})
+	defer cleanA()
+	apiB, cleanB := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{Mocknet: mn})
+	defer cleanB()
+
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	sa, err := New(apiA.MockNode().PeerHost, Opts{Logger: testutil.Logger(t), ChunkSize: 100, IPFS: apiA.API()})
+	require.NoError(t, err)
+	sb, err := New(apiB.MockNode().PeerHost, Opts{Logger: testutil.Logger(t), ChunkSize: 100, IPFS: apiB.API()})
+	require.NoError(t, err)
+
+	data := make([]byte, 2500)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	added, err := sa.Add(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	d, err := sa.Publish(ctx, added)
+	require.NoError(t, err)
+	assert.Equal(t, added.ID, d.ID)
+	assert.Empty(t, d.Chunks)
+	assert.NotEmpty(t, d.Root)
+
+	// only the CID of the index is sent with the key
+	raw, err := json.Marshal(d)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), `"chunks"`)
+
+	// the publisher reads it from its own chunks
+	out := &bytes.Buffer{}
+	require.NoError(t, sa.Read(d, out))
+	assert.Equal(t, data, out.Bytes())
+
+	p, err := sb.Progress(d)
+	require.NoError(t, err)
+	assert.Equal(t, 25, p.Chunks)
+	assert.Equal(t, ErrIncomplete, sb.Read(d, &bytes.Buffer{}))
+
+	// the chunks are fetched over bitswap, without any source
+	require.NoError(t, sb.Fetch(ctx, nil, d, nil))
+
+	out.Reset()
+	require.NoError(t, sb.Read(d, out))
+	assert.Equal(t, data, out.Bytes())
+
+	p, err = sb.Progress(d)
+	require.NoError(t, err)
+	assert.True(t, p.Done)
+
+	require.NoError(t, sb.Pin(ctx, d))
+
+	// an altered index doesn't match the ID of the attachment
+	altered := *d
+	altered.ID = append([]byte{}, d.ID...)
+	altered.ID[0] ^= 0xff
+	assert.Error(t, sb.Fetch(ctx, nil, &altered, nil))
+}
+
+func TestPinningService(t *testing.T) {
+	c, err := chunkCID(make([]byte, 32))
+	require.NoError(t, err)
+
+	pinned := make(chan *pinRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/pins" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		req := &pinRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(req))
+		pinned <- req
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	p := &PinningService{Endpoint: server.URL + "/api/v1/", Token: "token"}
+	require.NoError(t, p.Pin(context.Background(), c, "attachment", []string{"/ip4/127.0.0.1/tcp/4242"}))
+
+	req := <-pinned
+	assert.Equal(t, c.String(), req.CID)
+	assert.Equal(t, "attachment", req.Name)
+
+	p.Token = "invalid"
+	assert.Error(t, p.Pin(context.Background(), c, "attachment", nil))
+}
@@ -0,0 +1,77 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	cid "github.com/ipfs/go-cid"
+)
+
+const pinningTimeout = 30 * time.Second
+
+// PinningService is a remote node implementing the IPFS Pinning Service API,
+// e.g. a node of the user kept online, it fetches the pinned attachments from
+// the node which published them and serves them meanwhile.
+type PinningService struct {
+	// Endpoint is the URL of the API, e.g. https://pinning.example.com/api/v1
+	Endpoint string
+
+	// Token is the bearer token of the account on the service
+	Token string
+
+	Client *http.Client
+}
+
+type pinRequest struct {
+	CID     string   `json:"cid"`
+	Name    string   `json:"name,omitempty"`
+	Origins []string `json:"origins,omitempty"`
+}
+
+// Pin asks the service to pin a DAG, origins are the multiaddrs of the nodes
+// holding it.
+func (p *PinningService) Pin(ctx context.Context, c cid.Cid, name string, origins []string) error {
+	body, err := json.Marshal(&pinRequest{CID: c.String(), Name: name, Origins: origins})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pinningTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.Endpoint, "/")+"/pins", bytes.NewReader(body))
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		reason, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return errcode.ErrInternal.Wrap(fmt.Errorf("pinning service: %s: %s", res.Status, strings.TrimSpace(string(reason))))
+	}
+
+	return nil
+}
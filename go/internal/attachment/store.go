@@ -0,0 +1,282 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	chunksKey    = ipfs_ds.NewKey("chunks")
+	transfersKey = ipfs_ds.NewKey("transfers")
+	streamsKey   = ipfs_ds.NewKey("streams")
+)
+
+// transfer is an attachment or a stream being fetched, it is persisted until
+// all its chunks are received.
+type transfer struct {
+	Descriptor *Descriptor       `json:"descriptor,omitempty"`
+	Stream     *StreamDescriptor `json:"stream,omitempty"`
+	Sources    []peer.ID         `json:"sources"`
+}
+
+func (t *transfer) id() []byte {
+	if t.Stream != nil {
+		return t.Stream.ID
+	}
+
+	return t.Descriptor.ID
+}
+
+func (t *transfer) validate() error {
+	if t.Stream != nil {
+		return t.Stream.validate()
+	}
+
+	return t.Descriptor.validate()
+}
+
+// chunkStore keeps the sealed chunks, by hash for the attachments and by
+// index for the streams, and the pending transfers.
+type chunkStore struct {
+	ds ipfs_ds.Datastore
+
+	muTransfers sync.Mutex
+	transfers   map[string]*transfer
+
+	muWaiters sync.Mutex
+	waiters   map[string]chan struct{}
+}
+
+func newChunkStore(ds ipfs_ds.Datastore) (*chunkStore, error) {
+	s := &chunkStore{
+		ds:        ds,
+		transfers: make(map[string]*transfer),
+		waiters:   make(map[string]chan struct{}),
+	}
+
+	results, err := ds.Query(query.Query{Prefix: transfersKey.String()})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, errcode.ErrInternal.Wrap(result.Error)
+		}
+
+		t := &transfer{}
+		if err := json.Unmarshal(result.Value, t); err != nil || (t.Descriptor == nil && t.Stream == nil) || t.validate() != nil {
+			_ = ds.Delete(ipfs_ds.NewKey(result.Key))
+			continue
+		}
+
+		s.transfers[hex.EncodeToString(t.id())] = t
+	}
+
+	return s, nil
+}
+
+func chunkKey(hash []byte) ipfs_ds.Key {
+	return chunksKey.ChildString(hex.EncodeToString(hash))
+}
+
+func (s *chunkStore) hasChunk(hash []byte) bool {
+	ok, err := s.ds.Has(chunkKey(hash))
+	return err == nil && ok
+}
+
+func (s *chunkStore) getChunk(hash []byte) ([]byte, error) {
+	data, err := s.ds.Get(chunkKey(hash))
+	if err == ipfs_ds.ErrNotFound {
+		return nil, ErrIncomplete
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return data, nil
+}
+
+// putChunk keeps a chunk if it matches its hash.
+func (s *chunkStore) putChunk(hash []byte, data []byte) error {
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], hash) {
+		return ErrInvalidChunk
+	}
+
+	if err := s.ds.Put(chunkKey(hash), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// missing returns the indexes of the chunks of an attachment not received
+// yet.
+func (s *chunkStore) missing(d *Descriptor) []int {
+	missing := []int{}
+	for i, hash := range d.Chunks {
+		if !s.hasChunk(hash) {
+			missing = append(missing, i)
+		}
+	}
+
+	return missing
+}
+
+func (s *chunkStore) putTransfer(t *transfer) error {
+	s.muTransfers.Lock()
+	defer s.muTransfers.Unlock()
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	id := hex.EncodeToString(t.id())
+	if err := s.ds.Put(transfersKey.ChildString(id), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	s.transfers[id] = t
+
+	return nil
+}
+
+func (s *chunkStore) delTransfer(id []byte) error {
+	s.muTransfers.Lock()
+	defer s.muTransfers.Unlock()
+
+	key := hex.EncodeToString(id)
+	if err := s.ds.Delete(transfersKey.ChildString(key)); err != nil && err != ipfs_ds.ErrNotFound {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	delete(s.transfers, key)
+
+	return nil
+}
+
+func (s *chunkStore) getTransfer(id []byte) *transfer {
+	s.muTransfers.Lock()
+	defer s.muTransfers.Unlock()
+
+	return s.transfers[hex.EncodeToString(id)]
+}
+
+// pending returns the transfers with the peer among their sources, or all
+// of them if the peer is empty.
+func (s *chunkStore) pending(p peer.ID) []*transfer {
+	s.muTransfers.Lock()
+	defer s.muTransfers.Unlock()
+
+	transfers := []*transfer{}
+	for _, t := range s.transfers {
+		if p == "" {
+			transfers = append(transfers, t)
+			continue
+		}
+
+		for _, source := range t.Sources {
+			if source == p {
+				transfers = append(transfers, t)
+				break
+			}
+		}
+	}
+
+	return transfers
+}
+
+func streamChunkKey(id []byte, index int) ipfs_ds.Key {
+	return streamsKey.ChildString(hex.EncodeToString(id)).ChildString(strconv.Itoa(index))
+}
+
+func streamEndKey(id []byte) ipfs_ds.Key {
+	return streamsKey.ChildString(hex.EncodeToString(id)).ChildString("end")
+}
+
+func (s *chunkStore) getStreamChunk(id []byte, index int) ([]byte, error) {
+	data, err := s.ds.Get(streamChunkKey(id, index))
+	if err == ipfs_ds.ErrNotFound {
+		return nil, ErrIncomplete
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return data, nil
+}
+
+// putStreamChunk keeps a chunk of a stream, the caller has opened it, and
+// wakes up the readers of the stream.
+func (s *chunkStore) putStreamChunk(id []byte, index int, data []byte, final bool) error {
+	if err := s.ds.Put(streamChunkKey(id, index), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if final {
+		if err := s.ds.Put(streamEndKey(id), []byte(strconv.Itoa(index))); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	s.muWaiters.Lock()
+	if ch, ok := s.waiters[hex.EncodeToString(id)]; ok {
+		close(ch)
+		delete(s.waiters, hex.EncodeToString(id))
+	}
+	s.muWaiters.Unlock()
+
+	return nil
+}
+
+// streamEnd returns the index of the last chunk of a stream, if it is known.
+func (s *chunkStore) streamEnd(id []byte) (int, bool) {
+	data, err := s.ds.Get(streamEndKey(id))
+	if err != nil {
+		return 0, false
+	}
+
+	end, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, false
+	}
+
+	return end, true
+}
+
+// streamReceived returns the count of the chunks of a stream received
+// without a gap.
+func (s *chunkStore) streamReceived(id []byte) int {
+	count := 0
+	for {
+		if ok, err := s.ds.Has(streamChunkKey(id, count)); err != nil || !ok {
+			return count
+		}
+		count++
+	}
+}
+
+// streamWait returns a channel closed once a chunk of the stream is put, it
+// has to be called before looking for the chunk to not miss it.
+func (s *chunkStore) streamWait(id []byte) <-chan struct{} {
+	s.muWaiters.Lock()
+	defer s.muWaiters.Unlock()
+
+	key := hex.EncodeToString(id)
+	ch, ok := s.waiters[key]
+	if !ok {
+		ch = make(chan struct{})
+		s.waiters[key] = ch
+	}
+
+	return ch
+}
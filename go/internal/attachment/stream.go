@@ -0,0 +1,493 @@
+package attachment
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const StreamProtocolID = protocol.ID("/berty/attachment-stream/1.0.0")
+
+const (
+	streamIDSize = 32
+
+	// streamIdleTimeout is how long a peer waits for the next chunk of a live
+	// stream before closing the request
+	streamIdleTimeout = 30 * time.Second
+)
+
+const (
+	chunkFlagMore  = byte(0)
+	chunkFlagFinal = byte(1)
+)
+
+// ErrStreamClosed is returned when writing to a closed stream
+var ErrStreamClosed = fmt.Errorf("stream closed")
+
+// StreamDescriptor identifies a stream, e.g. a voice message, it is sent
+// before the stream is complete so the chunks can be fetched and played while
+// they are recorded. Like the descriptor of an attachment, it carries its key
+// and has to be sent encrypted.
+type StreamDescriptor struct {
+	ID        []byte `json:"id"`
+	ChunkSize int    `json:"chunk_size"`
+	Key       []byte `json:"key"`
+}
+
+func (d *StreamDescriptor) validate() error {
+	if d == nil || len(d.ID) != streamIDSize || len(d.Key) != keySize || d.ChunkSize <= 0 || d.ChunkSize > MaxChunkSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid stream descriptor"))
+	}
+
+	return nil
+}
+
+// streamRequest asks a peer for the chunks of a stream starting at an index,
+// it answers them in order as they are available.
+type streamRequest struct {
+	ID   []byte `json:"id"`
+	From int    `json:"from"`
+}
+
+type streamResponse struct {
+	Index int    `json:"index"`
+	Data  []byte `json:"data"`
+}
+
+// StreamWriter seals the data written to a stream in chunks, each chunk is
+// served to the peers as soon as it is sealed.
+type StreamWriter struct {
+	s *Service
+	d *StreamDescriptor
+
+	mu     sync.Mutex
+	buf    []byte
+	index  int
+	closed bool
+}
+
+// NewStream opens a stream, its descriptor can be sent right away.
+func (s *Service) NewStream() (*StreamWriter, error) {
+	d := &StreamDescriptor{
+		ID:        make([]byte, streamIDSize),
+		ChunkSize: s.opts.StreamChunkSize,
+		Key:       make([]byte, keySize),
+	}
+
+	if _, err := io.ReadFull(crand.Reader, d.ID); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	if _, err := io.ReadFull(crand.Reader, d.Key); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	s.setLive(d.ID, true)
+	s.track(&usage{ID: d.ID, Stream: true, Own: true})
+
+	return &StreamWriter{s: s, d: d}, nil
+}
+
+// Descriptor returns the descriptor of the stream.
+func (w *StreamWriter) Descriptor() *StreamDescriptor {
+	return w.d
+}
+
+// Write seals the data in chunks once a chunk is full.
+func (w *StreamWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+
+	w.buf = append(w.buf, data...)
+	for len(w.buf) >= w.d.ChunkSize {
+		if err := w.put(w.buf[:w.d.ChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[w.d.ChunkSize:]
+	}
+
+	return len(data), nil
+}
+
+// Flush seals the data written so far in a chunk, even if it is not full.
+func (w *StreamWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrStreamClosed
+	}
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	if err := w.put(w.buf, false); err != nil {
+		return err
+	}
+	w.buf = nil
+
+	return nil
+}
+
+// Close seals the last chunk of the stream.
+func (w *StreamWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+
+	if err := w.put(w.buf, true); err != nil {
+		return err
+	}
+
+	w.buf = nil
+	w.closed = true
+	w.s.setLive(w.d.ID, false)
+	w.s.track(&usage{ID: w.d.ID, Stream: true, Own: true})
+
+	return nil
+}
+
+func (w *StreamWriter) put(data []byte, final bool) error {
+	flag := chunkFlagMore
+	if final {
+		flag = chunkFlagFinal
+	}
+
+	sealed := sealChunk(w.d.Key, w.index, append([]byte{flag}, data...))
+	if err := w.s.store.putStreamChunk(w.d.ID, w.index, sealed, final); err != nil {
+		return err
+	}
+
+	w.index++
+
+	return nil
+}
+
+func openStreamChunk(d *StreamDescriptor, index int, sealed []byte) ([]byte, bool, error) {
+	chunk, err := openChunk(d.Key, index, sealed)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(chunk) == 0 || len(chunk)-1 > d.ChunkSize || (chunk[0] != chunkFlagMore && chunk[0] != chunkFlagFinal) {
+		return nil, false, ErrInvalidChunk
+	}
+
+	return chunk[1:], chunk[0] == chunkFlagFinal, nil
+}
+
+// setLive marks the streams written or fetched by the service, their peers
+// wait for the next chunks instead of closing the requests.
+func (s *Service) setLive(id []byte, live bool) {
+	s.muLive.Lock()
+	defer s.muLive.Unlock()
+
+	key := hex.EncodeToString(id)
+	if live {
+		s.live[key]++
+		return
+	}
+
+	if s.live[key]--; s.live[key] <= 0 {
+		delete(s.live, key)
+	}
+}
+
+func (s *Service) isLive(id []byte) bool {
+	s.muLive.Lock()
+	defer s.muLive.Unlock()
+
+	return s.live[hex.EncodeToString(id)] > 0
+}
+
+// FetchStream follows a stream from the peers, until its last chunk is
+// received. If the peers are gone before, the transfer resumes once one of
+// them is connected again. The scope is the one of Fetch.
+func (s *Service) FetchStream(ctx context.Context, scope []byte, d *StreamDescriptor, sources []peer.ID) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+
+	t := &transfer{Stream: d, Sources: sources}
+	if prev := s.store.getTransfer(d.ID); prev != nil {
+		if prev.Stream == nil || !hmac.Equal(prev.Stream.Key, d.Key) {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("stream descriptor mismatch"))
+		}
+		t.Sources = mergeSources(prev.Sources, sources)
+	}
+
+	s.track(&usage{ID: d.ID, Scope: scope, Stream: true})
+
+	if p, _ := s.StreamProgress(d); !p.Done {
+		if err := s.store.putTransfer(t); err != nil {
+			return err
+		}
+	}
+
+	return s.fetch(ctx, t)
+}
+
+func (s *Service) fetchStream(ctx context.Context, t *transfer) error {
+	d := t.Stream
+
+	s.setLive(d.ID, true)
+	defer s.setLive(d.ID, false)
+
+	from := s.store.streamReceived(d.ID)
+	end, done := s.store.streamEnd(d.ID)
+	done = done && from > end
+
+	for _, p := range s.sortSources(t.Sources) {
+		if done {
+			break
+		}
+
+		if p == s.host.ID() {
+			continue
+		}
+
+		var err error
+		if from, done, err = s.fetchStreamFrom(ctx, p, d, from); err != nil {
+			s.logger.Debug("unable to fetch stream", zap.Stringer("peer", p), zap.Error(err))
+		}
+	}
+
+	if !done {
+		return ErrIncomplete
+	}
+
+	if err := s.store.delTransfer(d.ID); err != nil {
+		return err
+	}
+
+	s.completed(&usage{ID: d.ID, Stream: true})
+	s.emit(&Progress{ID: d.ID, Chunks: from, Received: from, Done: true})
+
+	return nil
+}
+
+// fetchStreamFrom follows a stream from a peer, it returns the index of the
+// next chunk and whether the last one is received.
+func (s *Service) fetchStreamFrom(ctx context.Context, p peer.ID, d *StreamDescriptor, from int) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	// the stream outlives the timeout of the dial, its deadlines are
+	// extended for each chunk
+	stream, err := s.host.NewStream(ctx, p, StreamProtocolID)
+	if err != nil {
+		return from, false, err
+	}
+	defer stream.Close()
+
+	_ = stream.SetWriteDeadline(time.Now().Add(requestTimeout))
+	if err := json.NewEncoder(stream).Encode(&streamRequest{ID: d.ID, From: from}); err != nil {
+		_ = stream.Reset()
+		return from, false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	// the limit is granted again for each chunk, the chunks are base64
+	// encoded
+	limit := int64(2*(d.ChunkSize+1) + secretbox.Overhead + 64)
+	lr := &io.LimitedReader{R: stream}
+	dec := json.NewDecoder(lr)
+
+	for {
+		lr.N = limit
+		_ = stream.SetReadDeadline(time.Now().Add(streamIdleTimeout + requestTimeout))
+
+		res := &streamResponse{}
+		if err := dec.Decode(res); err == io.EOF {
+			return from, false, nil
+		} else if err != nil {
+			_ = stream.Reset()
+			return from, false, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if res.Index != from {
+			_ = stream.Reset()
+			return from, false, ErrInvalidChunk
+		}
+
+		_, final, err := openStreamChunk(d, from, res.Data)
+		if err != nil {
+			_ = stream.Reset()
+			return from, false, err
+		}
+
+		if err := s.store.putStreamChunk(d.ID, from, res.Data, final); err != nil {
+			_ = stream.Reset()
+			return from, false, err
+		}
+
+		from++
+
+		if final {
+			return from, true, nil
+		}
+
+		s.emit(&Progress{ID: d.ID, Received: from})
+	}
+}
+
+func (s *Service) handleStreamRequest(stream network.Stream) {
+	defer stream.Close()
+
+	if !s.opts.Allow(stream.Conn().RemotePeer()) {
+		_ = stream.Reset()
+		return
+	}
+
+	_ = stream.SetReadDeadline(time.Now().Add(requestTimeout))
+
+	req := &streamRequest{}
+	if err := json.NewDecoder(stream).Decode(req); err != nil || len(req.ID) != streamIDSize || req.From < 0 {
+		_ = stream.Reset()
+		return
+	}
+
+	enc := json.NewEncoder(s.opts.Lanes.Stream(stream, ipfsutil.PriorityMedia))
+	for index := req.From; ; index++ {
+		if end, ok := s.store.streamEnd(req.ID); ok && index > end {
+			return
+		}
+
+		data, err := s.waitStreamChunk(req.ID, index)
+		if err == ErrIncomplete {
+			return
+		} else if err != nil {
+			_ = stream.Reset()
+			return
+		}
+
+		_ = stream.SetWriteDeadline(time.Now().Add(requestTimeout))
+		if err := enc.Encode(&streamResponse{Index: index, Data: data}); err != nil {
+			_ = stream.Reset()
+			return
+		}
+	}
+}
+
+// waitStreamChunk returns a chunk of a stream, it waits for it while the
+// stream is live.
+func (s *Service) waitStreamChunk(id []byte, index int) ([]byte, error) {
+	for {
+		wait := s.store.streamWait(id)
+
+		data, err := s.store.getStreamChunk(id, index)
+		if err != ErrIncomplete || !s.isLive(id) {
+			return data, err
+		}
+
+		select {
+		case <-wait:
+		case <-time.After(streamIdleTimeout):
+			return nil, ErrIncomplete
+		}
+	}
+}
+
+// StreamChunk returns a chunk of a stream and whether it is the last one,
+// ErrIncomplete is returned while it is not received.
+func (s *Service) StreamChunk(d *StreamDescriptor, index int) ([]byte, bool, error) {
+	if err := d.validate(); err != nil {
+		return nil, false, err
+	}
+
+	sealed, err := s.store.getStreamChunk(d.ID, index)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.touch(d.ID)
+
+	return openStreamChunk(d, index, sealed)
+}
+
+// StreamReader returns the content of a stream as its chunks are received,
+// the reads block until the next chunk or the end of the context.
+func (s *Service) StreamReader(ctx context.Context, d *StreamDescriptor) (io.Reader, error) {
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+
+	return &streamReader{ctx: ctx, s: s, d: d}, nil
+}
+
+type streamReader struct {
+	ctx context.Context
+	s   *Service
+	d   *StreamDescriptor
+
+	index int
+	buf   []byte
+	eof   bool
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		wait := r.s.store.streamWait(r.d.ID)
+
+		data, final, err := r.s.StreamChunk(r.d, r.index)
+		if err == ErrIncomplete {
+			select {
+			case <-wait:
+				continue
+			case <-r.ctx.Done():
+				return 0, r.ctx.Err()
+			}
+		} else if err != nil {
+			return 0, err
+		}
+
+		r.buf, r.eof = data, final
+		r.index++
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// StreamProgress returns the state of the transfer of a stream, its count of
+// chunks is known once its last chunk is received.
+func (s *Service) StreamProgress(d *StreamDescriptor) (*Progress, error) {
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+
+	p := &Progress{ID: d.ID, Received: s.store.streamReceived(d.ID)}
+	if end, ok := s.store.streamEnd(d.ID); ok {
+		p.Chunks = end + 1
+		p.Done = p.Received == p.Chunks
+	}
+
+	return p, nil
+}
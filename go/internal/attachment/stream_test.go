@@ -0,0 +1,93 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamLive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	ha, err := mn.GenPeer()
+	require.NoError(t, err)
+	hb, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	sa, err := New(ha, Opts{Logger: testutil.Logger(t), StreamChunkSize: 100})
+	require.NoError(t, err)
+	sb, err := New(hb, Opts{Logger: testutil.Logger(t), StreamChunkSize: 100})
+	require.NoError(t, err)
+
+	require.NoError(t, ha.Connect(ctx, peer.AddrInfo{ID: hb.ID(), Addrs: hb.Addrs()}))
+
+	w, err := sa.NewStream()
+	require.NoError(t, err)
+	d := w.Descriptor()
+
+	data := make([]byte, 1050)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	_, err = w.Write(data[:250])
+	require.NoError(t, err)
+
+	fetched := make(chan error, 1)
+	go func() { fetched <- sb.FetchStream(ctx, nil, d, []peer.ID{ha.ID()}) }()
+
+	// the beginning is played before the end is recorded
+	r, err := sb.StreamReader(ctx, d)
+	require.NoError(t, err)
+
+	head := make([]byte, 200)
+	_, err = io.ReadFull(r, head)
+	require.NoError(t, err)
+	assert.Equal(t, data[:200], head)
+
+	p, err := sb.StreamProgress(d)
+	require.NoError(t, err)
+	assert.False(t, p.Done)
+
+	_, err = w.Write(data[250:])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	_, err = w.Write(data)
+	assert.Equal(t, ErrStreamClosed, err)
+
+	select {
+	case err := <-fetched:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream not fetched")
+	}
+
+	tail, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, append(head, tail...))
+
+	p, err = sb.StreamProgress(d)
+	require.NoError(t, err)
+	assert.True(t, p.Done)
+	assert.Equal(t, 11, p.Chunks)
+	assert.Empty(t, sb.store.pending(""))
+
+	// the chunks can't be opened with another key
+	forged := *d
+	forged.Key = bytes.Repeat([]byte{1}, keySize)
+	_, _, err = sb.StreamChunk(&forged, 0)
+	assert.Error(t, err)
+}
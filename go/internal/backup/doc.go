@@ -0,0 +1,15 @@
+// Package backup uploads encrypted snapshots of a datastore to a target
+// chosen by the user: a local directory, a WebDAV server or an
+// S3-compatible endpoint.
+//
+// The target only sees sealed objects. The key is derived from a passphrase
+// with scrypt, its parameters are the only plaintext object of the
+// repository, so the passphrase and the repository are enough to restore a
+// node on a new device.
+//
+// The entries of the datastore are uploaded in packs, a snapshot lists
+// every entry with the pack holding it. The entries unchanged since the
+// previous snapshot refer to its packs, so a backup only uploads what
+// changed. Pruning deletes the oldest snapshots then the packs no longer
+// referenced.
+package backup
@@ -0,0 +1,662 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Version is the version of the repository format produced by this package.
+const Version = 1
+
+const (
+	headerName      = "backup.json"
+	snapshotsPrefix = "snapshots/"
+	packsPrefix     = "packs/"
+
+	// packSize is the size above which a pack is closed, the entries are
+	// uploaded in packs to not send an object per entry
+	packSize = 4 << 20
+
+	kdfScrypt = "scrypt"
+	defaultN  = 1 << 15
+	defaultR  = 8
+	defaultP  = 1
+	saltSize  = 16
+
+	// maxN bounds the cost read from a header, a forged one could otherwise
+	// make the node allocate gigabytes
+	maxN = 1 << 20
+)
+
+var repositoryCheck = []byte("berty backup")
+
+var (
+	// ErrWrongKey is returned when a repository is opened with another
+	// passphrase or key than the one it was created with
+	ErrWrongKey = fmt.Errorf("wrong backup passphrase or key")
+
+	// ErrNoSnapshot is returned when restoring an empty repository
+	ErrNoSnapshot = fmt.Errorf("no backup snapshot")
+)
+
+// header is the only plaintext object of a repository, it holds the
+// parameters of the key derivation and a check value sealed with the key.
+type header struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Check   []byte `json:"check"`
+}
+
+// entryRef locates the value of an entry in a pack.
+type entryRef struct {
+	Pack string `json:"pack"`
+	Hash []byte `json:"hash"`
+	Size int    `json:"size"`
+}
+
+// manifest is a snapshot of a datastore, its entries refer to the packs of
+// the snapshots before when they didn't change.
+type manifest struct {
+	ID        string               `json:"id"`
+	CreatedAt time.Time            `json:"created_at"`
+	Parent    string               `json:"parent,omitempty"`
+	Entries   map[string]*entryRef `json:"entries"`
+}
+
+type packEntry struct {
+	Key   string `json:"k"`
+	Value []byte `json:"v"`
+}
+
+type pack struct {
+	Entries []*packEntry `json:"entries"`
+}
+
+// Snapshot describes a backup of a datastore.
+type Snapshot struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Entries   int       `json:"entries"`
+
+	// Size is the size of the values of the snapshot, before encryption
+	Size int64 `json:"size"`
+}
+
+// Report summarizes a backup.
+type Report struct {
+	Snapshot *Snapshot `json:"snapshot"`
+
+	// Changed is the count of the entries uploaded, the others are in the
+	// packs of the previous snapshots
+	Changed  int   `json:"changed"`
+	Packs    int   `json:"packs"`
+	Uploaded int64 `json:"uploaded"`
+}
+
+// RestoreReport summarizes a restore.
+type RestoreReport struct {
+	Snapshot *Snapshot `json:"snapshot"`
+	Deleted  int       `json:"deleted"`
+}
+
+// PruneReport summarizes a prune.
+type PruneReport struct {
+	Snapshots int `json:"snapshots"`
+	Packs     int `json:"packs"`
+}
+
+// Repository is a set of encrypted snapshots of a datastore on a target.
+// Everything but the header is sealed with XChaCha20-Poly1305 under a key
+// derived from a passphrase, the object name being the associated data.
+type Repository struct {
+	target Target
+	key    []byte
+	aead   cipher.AEAD
+}
+
+func newRepository(target Target, key []byte) (*Repository, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Repository{target: target, key: key, aead: aead}, nil
+}
+
+func (h *header) derive(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), h.Salt, h.N, h.R, h.P, chacha20poly1305.KeySize)
+}
+
+func getHeader(ctx context.Context, target Target) (*header, error) {
+	data, err := target.Get(ctx, headerName)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &header{}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, fmt.Errorf("invalid backup header: %w", err)
+	}
+
+	if h.Version != Version {
+		return nil, fmt.Errorf("unsupported backup version %d", h.Version)
+	}
+
+	if h.KDF != kdfScrypt || h.N <= 1 || h.N > maxN || h.R <= 0 || h.P <= 0 || len(h.Salt) == 0 {
+		return nil, fmt.Errorf("invalid backup key derivation")
+	}
+
+	return h, nil
+}
+
+// Open opens the repository of a target with a passphrase, it is created if
+// the target has none.
+func Open(ctx context.Context, target Target, passphrase string) (*Repository, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty backup passphrase")
+	}
+
+	h, err := getHeader(ctx, target)
+	if err == ErrNotFound {
+		return create(ctx, target, passphrase)
+	} else if err != nil {
+		return nil, err
+	}
+
+	key, err := h.derive(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup key derivation: %w", err)
+	}
+
+	return openKey(target, h, key)
+}
+
+// OpenWithKey opens an existing repository with the key of a repository
+// opened before, e.g. by the scheduled backups which don't keep the
+// passphrase.
+func OpenWithKey(ctx context.Context, target Target, key []byte) (*Repository, error) {
+	h, err := getHeader(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return openKey(target, h, key)
+}
+
+func openKey(target Target, h *header, key []byte) (*Repository, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, ErrWrongKey
+	}
+
+	r, err := newRepository(target, key)
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := r.open(headerName, h.Check)
+	if err != nil || subtle.ConstantTimeCompare(check, repositoryCheck) != 1 {
+		return nil, ErrWrongKey
+	}
+
+	return r, nil
+}
+
+func create(ctx context.Context, target Target, passphrase string) (*Repository, error) {
+	h := &header{
+		Version: Version,
+		KDF:     kdfScrypt,
+		N:       defaultN,
+		R:       defaultR,
+		P:       defaultP,
+		Salt:    make([]byte, saltSize),
+	}
+
+	if _, err := rand.Read(h.Salt); err != nil {
+		return nil, err
+	}
+
+	key, err := h.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newRepository(target, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Check, err = r.seal(headerName, repositoryCheck); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := target.Put(ctx, headerName, data); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Key returns the key of the repository, it has to be kept as secret as the
+// passphrase.
+func (r *Repository) Key() []byte {
+	return append([]byte{}, r.key...)
+}
+
+func (r *Repository) seal(name string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, r.aead.NonceSize(), r.aead.NonceSize()+len(plaintext)+r.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return r.aead.Seal(nonce, nonce, plaintext, []byte(name)), nil
+}
+
+func (r *Repository) open(name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < r.aead.NonceSize()+r.aead.Overhead() {
+		return nil, fmt.Errorf("invalid backup object %s", name)
+	}
+
+	n := r.aead.NonceSize()
+	plaintext, err := r.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt backup object %s", name)
+	}
+
+	return plaintext, nil
+}
+
+func (r *Repository) putObject(ctx context.Context, name string, v interface{}) (int, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+
+	sealed, err := r.seal(name, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(sealed), r.target.Put(ctx, name, sealed)
+}
+
+func (r *Repository) getObject(ctx context.Context, name string, v interface{}) error {
+	sealed, err := r.target.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	data, err := r.open(name, sealed)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func randomID(t time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	// the IDs sort by date
+	return fmt.Sprintf("%016x-%s", t.UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+func (r *Repository) snapshotIDs(ctx context.Context) ([]string, error) {
+	names, err := r.target.List(ctx, snapshotsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		if id := strings.TrimPrefix(name, snapshotsPrefix); id != "" && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (r *Repository) manifest(ctx context.Context, id string) (*manifest, error) {
+	if id == "" {
+		ids, err := r.snapshotIDs(ctx)
+		if err != nil {
+			return nil, err
+		} else if len(ids) == 0 {
+			return nil, ErrNoSnapshot
+		}
+
+		id = ids[len(ids)-1]
+	}
+
+	m := &manifest{}
+	if err := r.getObject(ctx, snapshotsPrefix+id, m); err != nil {
+		return nil, err
+	}
+
+	if m.ID != id {
+		return nil, fmt.Errorf("invalid backup snapshot %s", id)
+	}
+
+	return m, nil
+}
+
+func (m *manifest) snapshot() *Snapshot {
+	s := &Snapshot{ID: m.ID, CreatedAt: m.CreatedAt, Entries: len(m.Entries)}
+	for _, ref := range m.Entries {
+		s.Size += int64(ref.Size)
+	}
+
+	return s
+}
+
+// Snapshots returns the snapshots of the repository, the oldest first.
+func (r *Repository) Snapshots(ctx context.Context) ([]*Snapshot, error) {
+	ids, err := r.snapshotIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*Snapshot, 0, len(ids))
+	for _, id := range ids {
+		m, err := r.manifest(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, m.snapshot())
+	}
+
+	return snapshots, nil
+}
+
+func excluded(key datastore.Key, exclude []datastore.Key) bool {
+	for _, prefix := range exclude {
+		if key.Equal(prefix) || key.IsDescendantOf(prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Backup uploads a snapshot of a datastore, but the entries under the
+// excluded prefixes. Only the entries changed since the last snapshot are
+// uploaded.
+func (r *Repository) Backup(ctx context.Context, ds datastore.Read, exclude []datastore.Key) (*Report, error) {
+	parent, err := r.manifest(ctx, "")
+	if err == ErrNoSnapshot {
+		parent = &manifest{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	id, err := randomID(now)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{ID: id, CreatedAt: now, Parent: parent.ID, Entries: map[string]*entryRef{}}
+	report := &Report{}
+
+	current, currentSize := &pack{}, 0
+	pending := []*entryRef{}
+	flush := func() error {
+		if len(current.Entries) == 0 {
+			return nil
+		}
+
+		packID, err := randomID(now)
+		if err != nil {
+			return err
+		}
+
+		n, err := r.putObject(ctx, packsPrefix+packID, current)
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range pending {
+			ref.Pack = packID
+		}
+
+		report.Packs++
+		report.Uploaded += int64(n)
+		current, currentSize, pending = &pack{}, 0, nil
+
+		return nil
+	}
+
+	res, err := ds.Query(query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	for result := range res.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		if excluded(datastore.RawKey(result.Key), exclude) {
+			continue
+		}
+
+		hash := sha256.Sum256(result.Value)
+		if prev, ok := parent.Entries[result.Key]; ok && bytes.Equal(prev.Hash, hash[:]) {
+			m.Entries[result.Key] = prev
+			continue
+		}
+
+		ref := &entryRef{Hash: hash[:], Size: len(result.Value)}
+		m.Entries[result.Key] = ref
+		pending = append(pending, ref)
+		current.Entries = append(current.Entries, &packEntry{Key: result.Key, Value: result.Value})
+		currentSize += len(result.Key) + len(result.Value)
+		report.Changed++
+
+		if currentSize >= packSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	// the snapshot is written last, an interrupted backup leaves unreferenced
+	// packs removed by the next prune
+	n, err := r.putObject(ctx, snapshotsPrefix+id, m)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Uploaded += int64(n)
+	report.Snapshot = m.snapshot()
+
+	return report, nil
+}
+
+// Restore replaces the content of a datastore with a snapshot, the latest if
+// id is empty. The entries under the excluded prefixes are left untouched.
+func (r *Repository) Restore(ctx context.Context, id string, ds datastore.Batching, exclude []datastore.Key) (*RestoreReport, error) {
+	m, err := r.manifest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	byPack := map[string]map[string]*entryRef{}
+	for key, ref := range m.Entries {
+		if excluded(datastore.RawKey(key), exclude) {
+			continue
+		}
+
+		if byPack[ref.Pack] == nil {
+			byPack[ref.Pack] = map[string]*entryRef{}
+		}
+		byPack[ref.Pack][key] = ref
+	}
+
+	// all the packs are read before writing, a missing or altered one
+	// leaves the datastore as it was
+	packs := make(map[string]*pack, len(byPack))
+	for packID, refs := range byPack {
+		p := &pack{}
+		if err := r.getObject(ctx, packsPrefix+packID, p); err != nil {
+			return nil, fmt.Errorf("unable to read backup pack %s: %w", packID, err)
+		}
+
+		found := 0
+		for _, e := range p.Entries {
+			if ref, ok := refs[e.Key]; ok {
+				if hash := sha256.Sum256(e.Value); !bytes.Equal(hash[:], ref.Hash) {
+					continue
+				}
+				found++
+			}
+		}
+
+		if found < len(refs) {
+			return nil, fmt.Errorf("backup pack %s misses entries", packID)
+		}
+
+		packs[packID] = p
+	}
+
+	batch, err := ds.Batch()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RestoreReport{Snapshot: m.snapshot()}
+
+	res, err := ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range keys {
+		if _, ok := m.Entries[entry.Key]; ok || excluded(datastore.RawKey(entry.Key), exclude) {
+			continue
+		}
+
+		if err := batch.Delete(datastore.RawKey(entry.Key)); err != nil {
+			return nil, err
+		}
+		report.Deleted++
+	}
+
+	for packID, p := range packs {
+		refs := byPack[packID]
+		for _, e := range p.Entries {
+			ref, ok := refs[e.Key]
+			if !ok {
+				continue
+			}
+
+			if hash := sha256.Sum256(e.Value); !bytes.Equal(hash[:], ref.Hash) {
+				continue
+			}
+
+			if err := batch.Put(datastore.RawKey(e.Key), e.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Prune deletes the snapshots but the keep latest ones, then the packs no
+// longer referenced.
+func (r *Repository) Prune(ctx context.Context, keep int) (*PruneReport, error) {
+	if keep < 1 {
+		return nil, fmt.Errorf("at least a backup snapshot has to be kept")
+	}
+
+	ids, err := r.snapshotIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PruneReport{}
+	if len(ids) > keep {
+		for _, id := range ids[:len(ids)-keep] {
+			if err := r.target.Delete(ctx, snapshotsPrefix+id); err != nil {
+				return report, err
+			}
+			report.Snapshots++
+		}
+		ids = ids[len(ids)-keep:]
+	}
+
+	referenced := map[string]bool{}
+	for _, id := range ids {
+		m, err := r.manifest(ctx, id)
+		if err != nil {
+			return report, err
+		}
+
+		for _, ref := range m.Entries {
+			referenced[ref.Pack] = true
+		}
+	}
+
+	names, err := r.target.List(ctx, packsPrefix)
+	if err != nil {
+		return report, err
+	}
+
+	for _, name := range names {
+		if referenced[strings.TrimPrefix(name, packsPrefix)] {
+			continue
+		}
+
+		if err := r.target.Delete(ctx, name); err != nil {
+			return report, err
+		}
+		report.Packs++
+	}
+
+	return report, nil
+}
@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTarget(t *testing.T) (Target, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "backup")
+	require.NoError(t, err)
+
+	return NewFileTarget(dir), func() { _ = os.RemoveAll(dir) }
+}
+
+func dump(t *testing.T, ds datastore.Read) map[string]string {
+	t.Helper()
+
+	res, err := ds.Query(query.Query{})
+	require.NoError(t, err)
+
+	entries, err := res.Rest()
+	require.NoError(t, err)
+
+	m := map[string]string{}
+	for _, e := range entries {
+		m[e.Key] = string(e.Value)
+	}
+
+	return m
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	target, clean := testTarget(t)
+	defer clean()
+
+	_, err := Open(ctx, target, "")
+	require.Error(t, err)
+
+	r, err := Open(ctx, target, "passphrase")
+	require.NoError(t, err)
+
+	// the header is created once
+	r2, err := Open(ctx, target, "passphrase")
+	require.NoError(t, err)
+	assert.Equal(t, r.Key(), r2.Key())
+
+	_, err = Open(ctx, target, "another passphrase")
+	assert.Equal(t, ErrWrongKey, err)
+
+	_, err = OpenWithKey(ctx, target, r.Key())
+	require.NoError(t, err)
+
+	_, err = OpenWithKey(ctx, target, make([]byte, len(r.Key())))
+	assert.Equal(t, ErrWrongKey, err)
+
+	_, err = r.Snapshots(ctx)
+	require.NoError(t, err)
+	_, err = r.Restore(ctx, "", ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	assert.Equal(t, ErrNoSnapshot, err)
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	target, clean := testTarget(t)
+	defer clean()
+
+	r, err := Open(ctx, target, "passphrase")
+	require.NoError(t, err)
+
+	ds := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/data/%d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	require.NoError(t, ds.Put(datastore.NewKey("/secret/key"), []byte("not backed up")))
+
+	exclude := []datastore.Key{datastore.NewKey("/secret")}
+
+	report, err := r.Backup(ctx, ds, exclude)
+	require.NoError(t, err)
+	assert.Equal(t, 10, report.Changed)
+	assert.Equal(t, 10, report.Snapshot.Entries)
+	assert.Equal(t, 1, report.Packs)
+	first := dump(t, ds)
+
+	// only the changed entries are uploaded
+	require.NoError(t, ds.Put(datastore.NewKey("/data/0"), []byte("changed")))
+	require.NoError(t, ds.Delete(datastore.NewKey("/data/1")))
+	require.NoError(t, ds.Put(datastore.NewKey("/data/new"), []byte("new")))
+
+	report, err = r.Backup(ctx, ds, exclude)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Changed)
+	assert.Equal(t, 10, report.Snapshot.Entries)
+	second := dump(t, ds)
+
+	snapshots, err := r.Snapshots(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.True(t, snapshots[0].ID < snapshots[1].ID)
+
+	// a restore replaces the datastore but the excluded entries
+	restored := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	require.NoError(t, restored.Put(datastore.NewKey("/data/stale"), []byte("stale")))
+	require.NoError(t, restored.Put(datastore.NewKey("/secret/key"), []byte("kept")))
+
+	rr, err := r.Restore(ctx, snapshots[0].ID, restored, exclude)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rr.Deleted)
+
+	expected := first
+	expected["/secret/key"] = "kept"
+	assert.Equal(t, expected, dump(t, restored))
+
+	_, err = r.Restore(ctx, "", restored, exclude)
+	require.NoError(t, err)
+
+	expected = second
+	expected["/secret/key"] = "kept"
+	assert.Equal(t, expected, dump(t, restored))
+
+	// the packs of the first snapshot are still referenced by the second
+	pr, err := r.Prune(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pr.Snapshots)
+	assert.Equal(t, 0, pr.Packs)
+
+	restored = ds_sync.MutexWrap(datastore.NewMapDatastore())
+	_, err = r.Restore(ctx, "", restored, nil)
+	require.NoError(t, err)
+	delete(second, "/secret/key")
+	assert.Equal(t, second, dump(t, restored))
+
+	_, err = r.Prune(ctx, 0)
+	require.Error(t, err)
+}
+
+func TestRestoreAltered(t *testing.T) {
+	ctx := context.Background()
+	target, clean := testTarget(t)
+	defer clean()
+
+	r, err := Open(ctx, target, "passphrase")
+	require.NoError(t, err)
+
+	ds := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	require.NoError(t, ds.Put(datastore.NewKey("/data"), []byte("value")))
+
+	_, err = r.Backup(ctx, ds, nil)
+	require.NoError(t, err)
+
+	packs, err := target.List(ctx, packsPrefix)
+	require.NoError(t, err)
+	require.Len(t, packs, 1)
+
+	data, err := target.Get(ctx, packs[0])
+	require.NoError(t, err)
+	data[len(data)-1] ^= 1
+	require.NoError(t, target.Put(ctx, packs[0], data))
+
+	// nothing is written from an altered pack
+	restored := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	require.NoError(t, restored.Put(datastore.NewKey("/other"), []byte("value")))
+
+	_, err = r.Restore(ctx, "", restored, nil)
+	require.Error(t, err)
+	assert.Equal(t, map[string]string{"/other": "value"}, dump(t, restored))
+}
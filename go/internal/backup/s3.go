@@ -0,0 +1,264 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Opts configures a target on an S3-compatible endpoint, e.g. a MinIO
+// server run by the user, the requests are signed with AWS signature v4.
+type S3Opts struct {
+	// Endpoint is the base URL of the service, the bucket is in the path
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// Prefix is prepended to the object names
+	Prefix string
+
+	Client *http.Client
+}
+
+type s3Target struct {
+	opts     S3Opts
+	endpoint *url.URL
+}
+
+// NewS3Target returns a target storing the objects in a bucket of an
+// S3-compatible endpoint.
+func NewS3Target(opts *S3Opts) (Target, error) {
+	if opts.Endpoint == "" || opts.Bucket == "" || opts.AccessKey == "" || opts.SecretKey == "" {
+		return nil, fmt.Errorf("missing S3 endpoint, bucket or credentials")
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", opts.Endpoint)
+	}
+
+	o := *opts
+	if o.Region == "" {
+		o.Region = "us-east-1"
+	}
+
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+
+	return &s3Target{opts: o, endpoint: endpoint}, nil
+}
+
+// s3Escape escapes a path or a query part as required by the signature.
+func s3Escape(s string, path bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		case b == '/' && path:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// request builds a signed request on an object, or on the bucket if the key
+// is empty.
+func (t *s3Target) request(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	path := t.endpoint.Path + "/" + t.opts.Bucket + "/"
+	if key != "" {
+		path += t.opts.Prefix + key
+	}
+
+	escapedPath := s3Escape(path, true)
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, s3Escape(k, false)+"="+s3Escape(query.Get(k), false))
+	}
+	rawQuery := strings.Join(parts, "&")
+
+	u := *t.endpoint
+	u.Path, u.RawPath, u.RawQuery = path, escapedPath, rawQuery
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	now := time.Now().UTC()
+	date, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		method,
+		escapedPath,
+		rawQuery,
+		"host:" + u.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + date + "\n",
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + t.opts.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	k := hmacSHA256([]byte("AWS4"+t.opts.SecretKey), day)
+	k = hmacSHA256(k, t.opts.Region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.opts.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(k, toSign))))
+
+	return req, nil
+}
+
+func (t *s3Target) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	if key != "" && !validName(key) {
+		return nil, fmt.Errorf("invalid backup object name %q", key)
+	}
+
+	req, err := t.request(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.opts.Client.Do(req)
+}
+
+func s3Error(method, key string, res *http.Response) error {
+	return fmt.Errorf("s3 %s %s: %s", method, key, res.Status)
+}
+
+func (t *s3Target) Put(ctx context.Context, name string, data []byte) error {
+	res, err := t.do(ctx, http.MethodPut, name, nil, data)
+	if err != nil {
+		return err
+	}
+	defer drain(res)
+
+	if res.StatusCode/100 != 2 {
+		return s3Error(http.MethodPut, name, res)
+	}
+
+	return nil
+}
+
+func (t *s3Target) Get(ctx context.Context, name string) ([]byte, error) {
+	res, err := t.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	} else if res.StatusCode/100 != 2 {
+		return nil, s3Error(http.MethodGet, name, res)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(res.Body, maxObjectSize))
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (t *s3Target) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": []string{"2"}, "prefix": []string{t.opts.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := t.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode/100 != 2 {
+			drain(res)
+			return nil, s3Error(http.MethodGet, "?list-type=2", res)
+		}
+
+		result := &listBucketResult{}
+		err = xml.NewDecoder(io.LimitReader(res.Body, maxObjectSize)).Decode(result)
+		drain(res)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 listing: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, t.opts.Prefix))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (t *s3Target) Delete(ctx context.Context, name string) error {
+	res, err := t.do(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer drain(res)
+
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusNotFound {
+		return s3Error(http.MethodDelete, name, res)
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrNotFound is returned by a target for a missing object
+var ErrNotFound = fmt.Errorf("backup object not found")
+
+// Target stores the sealed objects of a backup repository, by name, e.g.
+// "snapshots/<id>". The objects are encrypted before they reach it.
+type Target interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+
+	// List returns the names of the objects starting with a prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	Delete(ctx context.Context, name string) error
+}
+
+// Target types.
+const (
+	TargetFile   = "file"
+	TargetWebDAV = "webdav"
+	TargetS3     = "s3"
+)
+
+// TargetConfig selects and configures a target.
+type TargetConfig struct {
+	Type string `json:"type"`
+
+	// Path is the directory of a file target
+	Path string `json:"path,omitempty"`
+
+	// URL is the collection of a WebDAV target or the endpoint of an S3
+	// target, e.g. https://s3.example.com
+	URL string `json:"url,omitempty"`
+
+	// Username and Password authenticate to a WebDAV target
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Bucket, Region, AccessKey and SecretKey configure an S3 target
+	Bucket    string `json:"bucket,omitempty"`
+	Region    string `json:"region,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+
+	// Prefix is prepended to the object names on an S3 target, to share a
+	// bucket
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// NewTarget returns the target of a config, the HTTP client of the remote
+// ones defaults to http.DefaultClient.
+func NewTarget(cfg *TargetConfig, client *http.Client) (Target, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("missing backup target")
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	switch cfg.Type {
+	case TargetFile:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("missing backup directory")
+		}
+
+		return NewFileTarget(cfg.Path), nil
+
+	case TargetWebDAV:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("missing WebDAV URL")
+		}
+
+		return NewWebDAVTarget(cfg.URL, cfg.Username, cfg.Password, client), nil
+
+	case TargetS3:
+		return NewS3Target(&S3Opts{
+			Endpoint:  cfg.URL,
+			Bucket:    cfg.Bucket,
+			Region:    cfg.Region,
+			AccessKey: cfg.AccessKey,
+			SecretKey: cfg.SecretKey,
+			Prefix:    cfg.Prefix,
+			Client:    client,
+		})
+	}
+
+	return nil, fmt.Errorf("unknown backup target %q", cfg.Type)
+}
+
+// validName rejects the names escaping the repository, they're built by the
+// package but the listings come from the target.
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "/") && !strings.Contains(name, "..") && !strings.Contains(name, "\\")
+}
+
+// fileTarget stores the objects as files of a directory, e.g. on a removable
+// drive or a folder synced by another app.
+type fileTarget struct {
+	dir string
+}
+
+// NewFileTarget returns a target storing the objects in a directory, it is
+// created on the first write.
+func NewFileTarget(dir string) Target {
+	return &fileTarget{dir: dir}
+}
+
+func (t *fileTarget) path(name string) (string, error) {
+	if !validName(name) {
+		return "", fmt.Errorf("invalid backup object name %q", name)
+	}
+
+	return filepath.Join(t.dir, filepath.FromSlash(name)), nil
+}
+
+func (t *fileTarget) Put(_ context.Context, name string, data []byte) error {
+	path, err := t.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// written aside then renamed, an interrupted backup leaves no partial
+	// object
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (t *fileTarget) Get(_ context.Context, name string) ([]byte, error) {
+	path, err := t.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return data, err
+}
+
+func (t *fileTarget) List(_ context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	err := filepath.Walk(t.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(t.dir, path)
+		if err != nil {
+			return err
+		}
+
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (t *fileTarget) Delete(_ context.Context, name string) error {
+	path, err := t.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func testTargetObjects(t *testing.T, target Target) {
+	t.Helper()
+	ctx := context.Background()
+
+	_, err := target.Get(ctx, "backup.json")
+	assert.Equal(t, ErrNotFound, err)
+
+	names, err := target.List(ctx, "snapshots/")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	require.NoError(t, target.Put(ctx, "backup.json", []byte("header")))
+	require.NoError(t, target.Put(ctx, "snapshots/2", []byte("2")))
+	require.NoError(t, target.Put(ctx, "snapshots/1", []byte("1")))
+	require.NoError(t, target.Put(ctx, "packs/a", []byte("a")))
+
+	data, err := target.Get(ctx, "snapshots/1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), data)
+
+	names, err = target.List(ctx, "snapshots/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"snapshots/1", "snapshots/2"}, names)
+
+	names, err = target.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backup.json", "packs/a", "snapshots/1", "snapshots/2"}, names)
+
+	require.NoError(t, target.Delete(ctx, "snapshots/1"))
+	require.NoError(t, target.Delete(ctx, "snapshots/1"))
+
+	names, err = target.List(ctx, "snapshots/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"snapshots/2"}, names)
+
+	require.Error(t, target.Put(ctx, "../escape", []byte("x")))
+}
+
+func TestFileTarget(t *testing.T) {
+	target, clean := testTarget(t)
+	defer clean()
+
+	testTargetObjects(t, target)
+}
+
+func TestWebDAVTarget(t *testing.T) {
+	srv := httptest.NewServer(&webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer srv.Close()
+
+	testTargetObjects(t, NewWebDAVTarget(srv.URL+"/dav", "", "", srv.Client()))
+}
+
+func TestNewTarget(t *testing.T) {
+	_, err := NewTarget(nil, nil)
+	require.Error(t, err)
+
+	_, err = NewTarget(&TargetConfig{Type: "ftp"}, nil)
+	require.Error(t, err)
+
+	_, err = NewTarget(&TargetConfig{Type: TargetS3, URL: "https://s3.example.com"}, nil)
+	require.Error(t, err)
+
+	target, err := NewTarget(&TargetConfig{Type: TargetS3, URL: "https://s3.example.com", Bucket: "b", AccessKey: "a", SecretKey: "s"}, nil)
+	require.NoError(t, err)
+	assert.NotNil(t, target)
+}
@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxObjectSize bounds the objects read from a remote target
+const maxObjectSize = 64 << 20
+
+// webdavTarget stores the objects on a WebDAV server, e.g. a Nextcloud
+// instance, under a collection.
+type webdavTarget struct {
+	base     *url.URL
+	username string
+	password string
+	client   *http.Client
+}
+
+// NewWebDAVTarget returns a target storing the objects under the collection
+// of a WebDAV URL, with basic auth if a username is given.
+func NewWebDAVTarget(rawURL, username, password string, client *http.Client) Target {
+	base, err := url.Parse(strings.TrimSuffix(rawURL, "/") + "/")
+	if err != nil {
+		base = &url.URL{Path: "/"}
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &webdavTarget{base: base, username: username, password: password, client: client}
+}
+
+func (t *webdavTarget) url(name string) string {
+	u := *t.base
+	u.Path = t.base.Path + name
+
+	return u.String()
+}
+
+func (t *webdavTarget) do(ctx context.Context, method, name string, body []byte, header http.Header) (*http.Response, error) {
+	if !validName(strings.TrimSuffix(name, "/")) && name != "" {
+		return nil, fmt.Errorf("invalid backup object name %q", name)
+	}
+
+	req, err := http.NewRequest(method, t.url(name), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+
+	return t.client.Do(req)
+}
+
+func drain(res *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	_ = res.Body.Close()
+}
+
+func statusError(method, name string, res *http.Response) error {
+	return fmt.Errorf("webdav %s %s: %s", method, name, res.Status)
+}
+
+func (t *webdavTarget) Put(ctx context.Context, name string, data []byte) error {
+	res, err := t.do(ctx, http.MethodPut, name, data, nil)
+	if err != nil {
+		return err
+	}
+	drain(res)
+
+	// the parent collection is created on the first object
+	if res.StatusCode == http.StatusConflict || res.StatusCode == http.StatusNotFound {
+		if err := t.mkcol(ctx, name); err != nil {
+			return err
+		}
+
+		if res, err = t.do(ctx, http.MethodPut, name, data, nil); err != nil {
+			return err
+		}
+		drain(res)
+	}
+
+	if res.StatusCode/100 != 2 {
+		return statusError(http.MethodPut, name, res)
+	}
+
+	return nil
+}
+
+// mkcol creates the collections of the parents of an object.
+func (t *webdavTarget) mkcol(ctx context.Context, name string) error {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/") + "/"
+
+		res, err := t.do(ctx, "MKCOL", dir, nil, nil)
+		if err != nil {
+			return err
+		}
+		drain(res)
+
+		// already there
+		if res.StatusCode/100 != 2 && res.StatusCode != http.StatusMethodNotAllowed {
+			return statusError("MKCOL", dir, res)
+		}
+	}
+
+	return nil
+}
+
+func (t *webdavTarget) Get(ctx context.Context, name string) ([]byte, error) {
+	res, err := t.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	} else if res.StatusCode/100 != 2 {
+		return nil, statusError(http.MethodGet, name, res)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(res.Body, maxObjectSize))
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href  string `xml:"href"`
+		Props []struct {
+			Collection *struct{} `xml:"prop>resourcetype>collection"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+
+// List walks the collections under the prefix, the objects of the
+// repository are at most one collection deep.
+func (t *webdavTarget) List(ctx context.Context, prefix string) ([]string, error) {
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i+1]
+	}
+
+	names := []string{}
+	if err := t.list(ctx, dir, prefix, &names, 2); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (t *webdavTarget) list(ctx context.Context, dir, prefix string, names *[]string, depth int) error {
+	res, err := t.do(ctx, "PROPFIND", dir, []byte(propfindBody), http.Header{
+		"Depth":        []string{"1"},
+		"Content-Type": []string{"application/xml"},
+	})
+	if err != nil {
+		return err
+	}
+	defer drain(res)
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil
+	} else if res.StatusCode != http.StatusMultiStatus {
+		return statusError("PROPFIND", dir, res)
+	}
+
+	ms := &multistatus{}
+	if err := xml.NewDecoder(io.LimitReader(res.Body, maxObjectSize)).Decode(ms); err != nil {
+		return fmt.Errorf("invalid webdav listing: %w", err)
+	}
+
+	for _, r := range ms.Responses {
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+
+		if u, err := url.Parse(href); err == nil && u.IsAbs() {
+			href = u.Path
+		}
+
+		rel := strings.TrimPrefix(path.Clean("/"+href), path.Clean("/"+t.base.Path))
+		rel = strings.TrimPrefix(rel, "/")
+
+		// the collection itself
+		if rel == "" || rel+"/" == dir {
+			continue
+		}
+
+		collection := false
+		for _, p := range r.Props {
+			collection = collection || p.Collection != nil
+		}
+
+		switch {
+		case collection && depth > 1 && (strings.HasPrefix(rel+"/", prefix) || strings.HasPrefix(prefix, rel+"/")):
+			if err := t.list(ctx, rel+"/", prefix, names, depth-1); err != nil {
+				return err
+			}
+		case !collection && strings.HasPrefix(rel, prefix):
+			*names = append(*names, rel)
+		}
+	}
+
+	return nil
+}
+
+func (t *webdavTarget) Delete(ctx context.Context, name string) error {
+	res, err := t.do(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	drain(res)
+
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusNotFound {
+		return statusError(http.MethodDelete, name, res)
+	}
+
+	return nil
+}
@@ -0,0 +1,320 @@
+package contactdisc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+const ProtocolID = protocol.ID("/berty/contact-discovery/1.0.0")
+
+const (
+	// MaxMetadataSize is the maximum size of the app metadata of a record
+	MaxMetadataSize = 1 << 10
+
+	// MaxClockSkew is how far in the future the timestamp of a record can be
+	MaxClockSkew = time.Hour
+
+	// BucketPrefixSize is the size of the prefixes of the tokens sent in the
+	// lookups, the records of the tokens sharing it are all returned
+	BucketPrefixSize = 2
+
+	// MaxIdentifiers is the number of identifiers evaluated or looked up by
+	// a request
+	MaxIdentifiers = 256
+
+	defaultStreamTimeout = 30 * time.Second
+	maxRequestSize       = 64 << 10
+	maxResponseSize      = 4 << 20
+
+	recordSigningContext = "berty contact discovery record"
+)
+
+var (
+	phoneRegexp = regexp.MustCompile(`^\+[1-9][0-9]{5,14}$`)
+	emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+)
+
+// NormalizeIdentifier returns the canonical form of a phone number in the
+// international format or of an email, the one hashed by every device.
+func NormalizeIdentifier(identifier string) (string, error) {
+	identifier = strings.TrimSpace(identifier)
+
+	if strings.Contains(identifier, "@") {
+		email := strings.ToLower(identifier)
+		if !emailRegexp.MatchString(email) {
+			return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid email %q", identifier))
+		}
+
+		return email, nil
+	}
+
+	phone := strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(identifier)
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	}
+
+	if !phoneRegexp.MatchString(phone) {
+		return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid phone number %q, expected the international format", identifier))
+	}
+
+	return phone, nil
+}
+
+// Record maps the token of an identifier to the shareable contact of an
+// account, it is signed by the account.
+type Record struct {
+	Token []byte `json:"token"`
+
+	AccountPK            []byte `json:"accountPk"`
+	PublicRendezvousSeed []byte `json:"publicRendezvousSeed,omitempty"`
+	Metadata             []byte `json:"metadata,omitempty"`
+
+	// Remove unregisters the account from the token
+	Remove bool `json:"remove,omitempty"`
+
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// NewRecord returns a record of the token signed by the account, removing
+// the account from the token if rdvSeed is nil.
+func NewRecord(accountSK crypto.PrivKey, token []byte, rdvSeed, metadata []byte) (*Record, error) {
+	accountPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	rec := &Record{
+		Token:                token,
+		AccountPK:            accountPK,
+		PublicRendezvousSeed: rdvSeed,
+		Metadata:             metadata,
+		Remove:               rdvSeed == nil,
+		Timestamp:            time.Now().UnixNano(),
+	}
+
+	if rec.Remove {
+		rec.Metadata = nil
+	}
+
+	data, err := rec.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.Signature, err = accountSK.Sign(data); err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	return rec, nil
+}
+
+func (r *Record) signedBytes() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return append([]byte(recordSigningContext), data...), nil
+}
+
+// Verify checks the signature of the record by its account.
+func (r *Record) Verify() error {
+	if len(r.Token) != tokenSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid token"))
+	}
+
+	if len(r.Metadata) > MaxMetadataSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("metadata too large: %d bytes", len(r.Metadata)))
+	}
+
+	if !r.Remove && len(r.PublicRendezvousSeed) == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no rendezvous seed"))
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(r.AccountPK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+
+	if ok, err := pk.Verify(data, r.Signature); err != nil || !ok {
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid signature of the record"))
+	}
+
+	return nil
+}
+
+type request struct {
+	// Evaluate are blinded points to evaluate, Register a record to
+	// register and Lookup prefixes of tokens to look up
+	Evaluate [][]byte `json:"evaluate,omitempty"`
+	Register *Record  `json:"register,omitempty"`
+	Lookup   [][]byte `json:"lookup,omitempty"`
+}
+
+type response struct {
+	Evaluated [][]byte  `json:"evaluated,omitempty"`
+	Records   []*Record `json:"records,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Tokens returns the tokens of the identifiers, evaluated by the service
+// without it learning them.
+func Tokens(ctx context.Context, h host.Host, service peer.AddrInfo, identifiers []string) (map[string][]byte, error) {
+	if len(identifiers) == 0 {
+		return map[string][]byte{}, nil
+	}
+
+	if len(identifiers) > MaxIdentifiers {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many identifiers: %d, at most %d", len(identifiers), MaxIdentifiers))
+	}
+
+	req := &request{}
+	blindeds := make([]*blinded, len(identifiers))
+	for i, identifier := range identifiers {
+		normalized, err := NormalizeIdentifier(identifier)
+		if err != nil {
+			return nil, err
+		}
+
+		if blindeds[i], err = blind(normalized); err != nil {
+			return nil, err
+		}
+
+		req.Evaluate = append(req.Evaluate, blindeds[i].point)
+	}
+
+	res, err := roundTrip(ctx, h, service, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Evaluated) != len(blindeds) {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("%d points evaluated, %d expected", len(res.Evaluated), len(blindeds)))
+	}
+
+	tokens := make(map[string][]byte, len(identifiers))
+	for i, b := range blindeds {
+		t, err := b.unblind(res.Evaluated[i])
+		if err != nil {
+			return nil, err
+		}
+
+		tokens[identifiers[i]] = t
+	}
+
+	return tokens, nil
+}
+
+// Register publishes a record on the service, or removes the account from
+// its token.
+func Register(ctx context.Context, h host.Host, service peer.AddrInfo, rec *Record) error {
+	if rec == nil {
+		return errcode.ErrMissingInput
+	}
+
+	_, err := roundTrip(ctx, h, service, &request{Register: rec})
+
+	return err
+}
+
+// Lookup returns the verified records of the tokens, by identifier. Only
+// the prefixes of the tokens are sent, the records are matched locally.
+func Lookup(ctx context.Context, h host.Host, service peer.AddrInfo, tokens map[string][]byte) (map[string][]*Record, error) {
+	if len(tokens) > MaxIdentifiers {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many tokens: %d, at most %d", len(tokens), MaxIdentifiers))
+	}
+
+	found := make(map[string][]*Record)
+	if len(tokens) == 0 {
+		return found, nil
+	}
+
+	req := &request{}
+	prefixes := make(map[string]bool)
+	for _, t := range tokens {
+		if len(t) != tokenSize {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid token"))
+		}
+
+		if prefix := t[:BucketPrefixSize]; !prefixes[string(prefix)] {
+			prefixes[string(prefix)] = true
+			req.Lookup = append(req.Lookup, prefix)
+		}
+	}
+
+	res, err := roundTrip(ctx, h, service, req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range res.Records {
+		if rec == nil || rec.Remove || rec.Verify() != nil {
+			continue
+		}
+
+		for identifier, t := range tokens {
+			if bytes.Equal(rec.Token, t) {
+				found[identifier] = append(found[identifier], rec)
+			}
+		}
+	}
+
+	return found, nil
+}
+
+func roundTrip(ctx context.Context, h host.Host, service peer.AddrInfo, req *request) (*response, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultStreamTimeout)
+	defer cancel()
+
+	if err := h.Connect(ctx, service); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	stream, err := h.NewStream(ctx, service.ID, ProtocolID)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(stream).Encode(req); err != nil {
+		_ = stream.Reset()
+		return nil, errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	res := &response{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxResponseSize)).Decode(res); err != nil {
+		_ = stream.Reset()
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	if res.Error != "" {
+		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("contact discovery: %s", res.Error))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,192 @@
+package contactdisc
+
+import (
+	"context"
+	crand "crypto/rand"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+
+	sk, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	return sk
+}
+
+func TestNormalizeIdentifier(t *testing.T) {
+	for identifier, expected := range map[string]string{
+		"+33 6 12-34.56 78":  "+33612345678",
+		"0033612345678":      "+33612345678",
+		"+1 (555) 010-9999":  "+15550109999",
+		" Alice@Berty.Tech ": "alice@berty.tech",
+		"0612345678":         "",
+		"+0612345678":        "",
+		"+12345":             "",
+		"alice@berty":        "",
+		"alice@@berty.tech":  "",
+	} {
+		normalized, err := NormalizeIdentifier(identifier)
+		if expected == "" {
+			assert.Error(t, err, identifier)
+			continue
+		}
+
+		require.NoError(t, err, identifier)
+		assert.Equal(t, expected, normalized)
+	}
+}
+
+func TestOPRF(t *testing.T) {
+	tokenOf := func(k *big.Int, identifier string) (point, tok []byte) {
+		b, err := blind(identifier)
+		require.NoError(t, err)
+
+		evaluated, err := evaluate(k, b.point)
+		require.NoError(t, err)
+
+		tok, err = b.unblind(evaluated)
+		require.NoError(t, err)
+
+		return b.point, tok
+	}
+
+	k, err := serviceKey(newTestKey(t))
+	require.NoError(t, err)
+
+	other, err := serviceKey(newTestKey(t))
+	require.NoError(t, err)
+
+	// the blinding changes every time, the token stays the same
+	point1, token1 := tokenOf(k, "+33612345678")
+	point2, token2 := tokenOf(k, "+33612345678")
+	assert.NotEqual(t, point1, point2)
+	assert.Equal(t, token1, token2)
+	assert.Len(t, token1, tokenSize)
+
+	_, token3 := tokenOf(k, "+33612345679")
+	assert.NotEqual(t, token1, token3)
+
+	// the tokens depend on the key of the service
+	_, token4 := tokenOf(other, "+33612345678")
+	assert.NotEqual(t, token1, token4)
+
+	_, err = evaluate(k, []byte("not a point"))
+	assert.Error(t, err)
+}
+
+func TestRecord(t *testing.T) {
+	alice := newTestKey(t)
+	tok := make([]byte, tokenSize)
+
+	rec, err := NewRecord(alice, tok, []byte("seed"), []byte("metadata"))
+	require.NoError(t, err)
+	require.NoError(t, rec.Verify())
+	assert.False(t, rec.Remove)
+
+	forged := *rec
+	forged.PublicRendezvousSeed = []byte("forged seed")
+	assert.Error(t, forged.Verify())
+
+	removal, err := NewRecord(alice, tok, nil, []byte("metadata"))
+	require.NoError(t, err)
+	require.NoError(t, removal.Verify())
+	assert.True(t, removal.Remove)
+	assert.Nil(t, removal.Metadata)
+
+	short, err := NewRecord(alice, tok[:4], []byte("seed"), nil)
+	require.NoError(t, err)
+	assert.Error(t, short.Verify())
+}
+
+func TestService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+
+	serviceSK := newTestKey(t)
+	serviceHost, err := mn.AddPeer(serviceSK, ma.StringCast("/ip4/127.0.0.1/tcp/4245"))
+	require.NoError(t, err)
+
+	client, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	s, err := NewService(serviceHost, serviceSK, ServiceOpts{MaxTokenAccounts: 2, MaxPeerEvaluations: 5})
+	require.NoError(t, err)
+
+	service := peer.AddrInfo{ID: serviceHost.ID(), Addrs: serviceHost.Addrs()}
+	alice, bob, carol := newTestKey(t), newTestKey(t), newTestKey(t)
+
+	tokens, err := Tokens(ctx, client, service, []string{"+33 6 12 34 56 78", "alice@berty.tech", "+15550109999"})
+	require.NoError(t, err)
+	require.Len(t, tokens, 3)
+
+	// the identifiers are normalized before being hashed
+	same, err := Tokens(ctx, client, service, []string{"+33612345678"})
+	require.NoError(t, err)
+	assert.Equal(t, tokens["+33 6 12 34 56 78"], same["+33612345678"])
+
+	// the evaluations of a peer are rate limited
+	_, err = Tokens(ctx, client, service, []string{"+33612345670", "+33612345671"})
+	assert.Error(t, err)
+
+	_, err = Tokens(ctx, client, service, []string{"not an identifier"})
+	assert.Error(t, err)
+
+	phone, email := tokens["+33 6 12 34 56 78"], tokens["alice@berty.tech"]
+
+	found, err := Lookup(ctx, client, service, tokens)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+
+	for _, sk := range []crypto.PrivKey{alice, bob} {
+		rec, err := NewRecord(sk, phone, []byte("seed"), nil)
+		require.NoError(t, err)
+		require.NoError(t, Register(ctx, client, service, rec))
+	}
+
+	rec, err := NewRecord(alice, email, []byte("seed 2"), []byte("metadata"))
+	require.NoError(t, err)
+	require.NoError(t, Register(ctx, client, service, rec))
+
+	// the token has its accounts
+	full, err := NewRecord(carol, phone, []byte("seed"), nil)
+	require.NoError(t, err)
+	assert.Error(t, Register(ctx, client, service, full))
+
+	found, err = Lookup(ctx, client, service, tokens)
+	require.NoError(t, err)
+	assert.Len(t, found["+33 6 12 34 56 78"], 2)
+	require.Len(t, found["alice@berty.tech"], 1)
+	assert.Equal(t, []byte("seed 2"), found["alice@berty.tech"][0].PublicRendezvousSeed)
+	assert.Empty(t, found["+15550109999"])
+
+	// the removals can't be undone by replaying the former record
+	removal, err := NewRecord(alice, email, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, Register(ctx, client, service, removal))
+	require.NoError(t, Register(ctx, client, service, rec))
+
+	found, err = Lookup(ctx, client, service, tokens)
+	require.NoError(t, err)
+	assert.Empty(t, found["alice@berty.tech"])
+
+	future, err := NewRecord(carol, email, []byte("seed"), nil)
+	require.NoError(t, err)
+	assert.Error(t, s.register(future, time.Now().Add(-2*MaxClockSkew)))
+
+	_, err = s.lookup([][]byte{[]byte("prefix too long")})
+	assert.Error(t, err)
+}
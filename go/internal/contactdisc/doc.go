@@ -0,0 +1,22 @@
+// Package contactdisc is an opt-in service finding which identifiers of an
+// address book, phone numbers or emails, are the ones of Berty accounts,
+// without uploading them.
+//
+// A device never sends an identifier: it hashes it onto P-256, blinds the
+// point with a random scalar and asks the service to multiply it by its
+// secret key, then removes the blinding and derives a token from the result
+// (an OPRF, 2HashDH). The service learns neither the identifier nor the
+// token, and the tokens can't be computed without it, the evaluations of a
+// peer are rate limited so the identifiers can't be enumerated through it.
+//
+// The accounts opting in register the token of their identifier with their
+// shareable contact, in a record signed by the account. A lookup only sends
+// short prefixes of the tokens, the service returns every record of these
+// buckets and the device matches the full tokens: the service doesn't learn
+// which identifiers were looked up. It can still evaluate its key on
+// guessed identifiers to find the ones registered, and it doesn't verify the
+// ownership of an identifier: the contacts found have to be verified like
+// any other one.
+//
+// The service can be self-hosted with `berty contact-discovery`.
+package contactdisc
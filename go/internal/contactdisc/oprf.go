@@ -0,0 +1,170 @@
+package contactdisc
+
+import (
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+const (
+	hashToCurveContext = "berty contact discovery"
+	tokenContext       = "berty contact discovery token"
+	keyContext         = "berty contact discovery key"
+
+	tokenSize = sha256.Size
+
+	// maxHashToCurveTries bounds the try-and-increment, half the x are on
+	// the curve
+	maxHashToCurveTries = 256
+)
+
+var curve = elliptic.P256()
+
+// hashToCurve maps an identifier onto a point of P-256 by try-and-increment,
+// nobody knows its discrete logarithm.
+func hashToCurve(identifier string) (x, y *big.Int, err error) {
+	params := curve.Params()
+	three := big.NewInt(3)
+
+	for ctr := 0; ctr < maxHashToCurveTries; ctr++ {
+		var c [4]byte
+		binary.BigEndian.PutUint32(c[:], uint32(ctr))
+
+		h := sha256.New()
+		_, _ = h.Write([]byte(hashToCurveContext))
+		_, _ = h.Write(c[:])
+		_, _ = h.Write([]byte(identifier))
+		sum := h.Sum(nil)
+
+		x = new(big.Int).SetBytes(sum)
+		if x.Cmp(params.P) >= 0 {
+			continue
+		}
+
+		// y² = x³ - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(x, three))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+
+		if y = new(big.Int).ModSqrt(y2, params.P); y == nil {
+			continue
+		}
+
+		// the parity of y comes from the hash, both roots are valid
+		if y.Bit(0) != uint(sum[len(sum)-1]&1) {
+			y.Sub(params.P, y)
+		}
+
+		return x, y, nil
+	}
+
+	return nil, nil, errcode.ErrCryptoKeyGeneration.Wrap(fmt.Errorf("no point found for the identifier"))
+}
+
+// blinded is an identifier hashed onto the curve and multiplied by a random
+// scalar, the service can't tell which identifier it is.
+type blinded struct {
+	identifier string
+	r          *big.Int
+	point      []byte
+}
+
+func blind(identifier string) (*blinded, error) {
+	x, y, err := hashToCurve(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+
+	bx, by := curve.ScalarMult(x, y, r.Bytes())
+
+	return &blinded{identifier: identifier, r: r, point: elliptic.Marshal(curve, bx, by)}, nil
+}
+
+// unblind removes the blinding from the point evaluated by the service and
+// returns the token of the identifier.
+func (b *blinded) unblind(evaluated []byte) ([]byte, error) {
+	ex, ey, err := unmarshalPoint(evaluated)
+	if err != nil {
+		return nil, err
+	}
+
+	rInv := new(big.Int).ModInverse(b.r, curve.Params().N)
+	x, y := curve.ScalarMult(ex, ey, rInv.Bytes())
+
+	return token(b.identifier, elliptic.Marshal(curve, x, y)), nil
+}
+
+func token(identifier string, point []byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write([]byte(tokenContext))
+	_, _ = h.Write([]byte(identifier))
+	_, _ = h.Write(point)
+
+	return h.Sum(nil)
+}
+
+// evaluate multiplies a blinded point by the key of the service.
+func evaluate(k *big.Int, point []byte) ([]byte, error) {
+	x, y, err := unmarshalPoint(point)
+	if err != nil {
+		return nil, err
+	}
+
+	ex, ey := curve.ScalarMult(x, y, k.Bytes())
+
+	return elliptic.Marshal(curve, ex, ey), nil
+}
+
+// serviceKey derives the key of the OPRF from the private key of the
+// service, the tokens stay the same as long as it is kept.
+func serviceKey(priv crypto.PrivKey) (*big.Int, error) {
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sum := sha256.Sum256(append([]byte(keyContext), raw...))
+	k := new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), curve.Params().N)
+	if k.Sign() == 0 {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(fmt.Errorf("invalid key"))
+	}
+
+	return k, nil
+}
+
+func randomScalar() (*big.Int, error) {
+	n := curve.Params().N
+	for {
+		r, err := crand.Int(crand.Reader, n)
+		if err != nil {
+			return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+		}
+
+		if r.Sign() != 0 {
+			return r, nil
+		}
+	}
+}
+
+// unmarshalPoint rejects the points outside of the curve, and the point at
+// infinity.
+func unmarshalPoint(data []byte) (x, y *big.Int, err error) {
+	x, y = elliptic.Unmarshal(curve, data)
+	if x == nil {
+		return nil, nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("invalid point"))
+	}
+
+	return x, y, nil
+}
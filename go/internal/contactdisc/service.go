@@ -0,0 +1,331 @@
+package contactdisc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMaxTokenAccounts is the number of accounts registered on a
+	// token, an identifier shared by a few devices or accounts
+	DefaultMaxTokenAccounts = 4
+
+	// DefaultMaxPeerEvaluations is the number of identifiers a peer can
+	// evaluate in a DefaultPeerEvaluationWindow, an address book a day
+	DefaultMaxPeerEvaluations   = 1000
+	DefaultPeerEvaluationWindow = 24 * time.Hour
+
+	// maxLookupRecords caps the records of a lookup to stay under the size
+	// of a response
+	maxLookupRecords = 4096
+)
+
+var recordsKey = ipfs_ds.NewKey("records")
+
+// ServiceOpts configures a contact discovery service.
+type ServiceOpts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the records, in memory if nil
+	Datastore ipfs_ds.Datastore
+
+	MaxTokenAccounts int
+
+	// MaxPeerEvaluations caps the identifiers a peer evaluates in a
+	// PeerEvaluationWindow, the others are refused
+	MaxPeerEvaluations   int
+	PeerEvaluationWindow time.Duration
+}
+
+func (opts *ServiceOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		opts.Datastore = ipfs_ds.NewMapDatastore()
+	}
+
+	if opts.MaxTokenAccounts <= 0 {
+		opts.MaxTokenAccounts = DefaultMaxTokenAccounts
+	}
+
+	if opts.MaxPeerEvaluations <= 0 {
+		opts.MaxPeerEvaluations = DefaultMaxPeerEvaluations
+	}
+
+	if opts.PeerEvaluationWindow <= 0 {
+		opts.PeerEvaluationWindow = DefaultPeerEvaluationWindow
+	}
+}
+
+// Service evaluates the blinded identifiers and serves the records of the
+// accounts registered on their tokens.
+type Service struct {
+	logger *zap.Logger
+	opts   ServiceOpts
+	k      *big.Int
+
+	muRecords sync.Mutex
+
+	muPeers sync.Mutex
+	peers   map[peer.ID]*peerWindow
+}
+
+type peerWindow struct {
+	start       time.Time
+	evaluations int
+}
+
+// NewService registers the contact discovery protocol on the host, the key
+// of the OPRF is derived from the given private key, the one of the host.
+func NewService(h host.Host, priv crypto.PrivKey, opts ServiceOpts) (*Service, error) {
+	opts.applyDefaults()
+
+	if priv == nil {
+		return nil, errcode.ErrMissingInput
+	}
+
+	k, err := serviceKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		logger: opts.Logger.Named("contactdisc"),
+		opts:   opts,
+		k:      k,
+		peers:  make(map[peer.ID]*peerWindow),
+	}
+
+	if h != nil {
+		h.SetStreamHandler(ProtocolID, s.handleStream)
+	}
+
+	return s, nil
+}
+
+func (s *Service) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	pid := stream.Conn().RemotePeer()
+	_ = stream.SetDeadline(time.Now().Add(defaultStreamTimeout))
+
+	req := &request{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxRequestSize)).Decode(req); err != nil {
+		s.logger.Debug("invalid request", zap.Stringer("peer", pid), zap.Error(err))
+		_ = stream.Reset()
+		return
+	}
+
+	res := &response{}
+	var err error
+	switch {
+	case len(req.Evaluate) > 0:
+		if !s.allowPeer(pid, len(req.Evaluate), time.Now()) {
+			err = errcode.ErrInvalidInput.Wrap(fmt.Errorf("rate limited"))
+			break
+		}
+
+		res.Evaluated, err = s.evaluate(req.Evaluate)
+	case req.Register != nil:
+		err = s.register(req.Register, time.Now())
+	default:
+		res.Records, err = s.lookup(req.Lookup)
+	}
+
+	if err != nil {
+		s.logger.Debug("request refused", zap.Stringer("peer", pid), zap.Error(err))
+		res = &response{Error: err.Error()}
+	}
+
+	if err := json.NewEncoder(stream).Encode(res); err != nil {
+		_ = stream.Reset()
+	}
+}
+
+func (s *Service) evaluate(points [][]byte) ([][]byte, error) {
+	if len(points) > MaxIdentifiers {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many points: %d", len(points)))
+	}
+
+	evaluated := make([][]byte, len(points))
+	for i, point := range points {
+		var err error
+		if evaluated[i], err = evaluate(s.k, point); err != nil {
+			return nil, err
+		}
+	}
+
+	return evaluated, nil
+}
+
+// register stores the record of an account on its token, or removes it.
+func (s *Service) register(rec *Record, now time.Time) error {
+	if err := rec.Verify(); err != nil {
+		return err
+	}
+
+	if rec.Timestamp > now.Add(MaxClockSkew).UnixNano() {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("record from the future"))
+	}
+
+	s.muRecords.Lock()
+	defer s.muRecords.Unlock()
+
+	tokenKey := recordsKey.ChildString(hex.EncodeToString(rec.Token[:BucketPrefixSize])).ChildString(hex.EncodeToString(rec.Token))
+	key := tokenKey.ChildString(hex.EncodeToString(rec.AccountPK))
+
+	prev, err := s.record(key)
+	if err != nil {
+		return err
+	}
+
+	// the records replayed or reordered are ignored, the removals are kept
+	// so the former records can't be registered again
+	if prev != nil && prev.Timestamp >= rec.Timestamp {
+		return nil
+	}
+
+	if !rec.Remove && (prev == nil || prev.Remove) {
+		accounts, err := s.records(tokenKey.String(), s.opts.MaxTokenAccounts)
+		if err != nil {
+			return err
+		}
+
+		if len(accounts) >= s.opts.MaxTokenAccounts {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many accounts on the token"))
+		}
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := s.opts.Datastore.Put(key, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	s.logger.Debug("record registered", zap.Bool("remove", rec.Remove))
+
+	return nil
+}
+
+// lookup returns the records of every token starting with the prefixes.
+func (s *Service) lookup(prefixes [][]byte) ([]*Record, error) {
+	if len(prefixes) > MaxIdentifiers {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many prefixes: %d", len(prefixes)))
+	}
+
+	s.muRecords.Lock()
+	defer s.muRecords.Unlock()
+
+	records := []*Record(nil)
+	for _, prefix := range prefixes {
+		if len(prefix) != BucketPrefixSize {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid prefix"))
+		}
+
+		bucket, err := s.records(recordsKey.ChildString(hex.EncodeToString(prefix)).String(), maxLookupRecords-len(records))
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, bucket...)
+		if len(records) >= maxLookupRecords {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+func (s *Service) record(key ipfs_ds.Key) (*Record, error) {
+	data, err := s.opts.Datastore.Get(key)
+	if err == ipfs_ds.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	rec := &Record{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return rec, nil
+}
+
+// records returns up to limit records of the accounts registered under the
+// prefix, without the removed ones.
+func (s *Service) records(prefix string, limit int) ([]*Record, error) {
+	res, err := s.opts.Datastore.Query(query.Query{Prefix: prefix})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+	defer res.Close()
+
+	records := []*Record(nil)
+	for entry := range res.Next() {
+		if entry.Error != nil {
+			return nil, errcode.ErrInternal.Wrap(entry.Error)
+		}
+
+		rec := &Record{}
+		if err := json.Unmarshal(entry.Value, rec); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if rec.Remove {
+			continue
+		}
+
+		if records = append(records, rec); len(records) >= limit {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+// allowPeer counts the evaluations of the peer, the identifiers it can
+// guess are bounded by its window.
+func (s *Service) allowPeer(pid peer.ID, evaluations int, now time.Time) bool {
+	s.muPeers.Lock()
+	defer s.muPeers.Unlock()
+
+	for p, w := range s.peers {
+		if now.Sub(w.start) >= s.opts.PeerEvaluationWindow {
+			delete(s.peers, p)
+		}
+	}
+
+	w, ok := s.peers[pid]
+	if !ok {
+		w = &peerWindow{start: now}
+		s.peers[pid] = w
+	}
+
+	if w.evaluations+evaluations > s.opts.MaxPeerEvaluations {
+		return false
+	}
+
+	w.evaluations += evaluations
+
+	return true
+}
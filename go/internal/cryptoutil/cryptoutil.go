@@ -134,11 +134,15 @@ func EdwardsToMontgomeryPriv(privKey crypto.PrivKey) (*[KeySize]byte, error) {
 	privKeyBytes, err := privKey.Raw()
 	if err != nil {
 		return nil, errcode.ErrSerialization.Wrap(err)
-	} else if len(privKeyBytes) != 64 {
+	}
+	defer Wipe(privKeyBytes)
+
+	if len(privKeyBytes) != 64 {
 		return nil, errcode.ErrInvalidInput
 	}
 
 	copy(edPriv[:], privKeyBytes)
+	defer Wipe(edPriv[:])
 
 	cconv.PrivateKeyToCurve25519(&mongPriv, &edPriv)
 
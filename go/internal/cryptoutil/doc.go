@@ -1,2 +1,3 @@
-// Package cryptoutil contains generic & stateless crypto helpers.
+// Package cryptoutil contains generic crypto helpers, and the secure buffers
+// holding key material.
 package cryptoutil
@@ -0,0 +1,114 @@
+package cryptoutil
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// Wipe overwrites b with zeros, it has to be called as soon as the key
+// material it holds isn't needed anymore.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+
+	// prevents the compiler from dropping the writes of a buffer which isn't
+	// read afterwards
+	runtime.KeepAlive(b)
+}
+
+// WipeKey overwrites a box/secretbox key with zeros.
+func WipeKey(k *[KeySize]byte) {
+	if k != nil {
+		Wipe(k[:])
+	}
+}
+
+// SecureBuffer holds key material out of the Go heap when the platform
+// allows it: its pages are locked in memory so they are never swapped,
+// excluded from the core dumps, and surrounded by inaccessible guard pages so
+// an overflow crashes instead of leaking the neighboring memory. Elsewhere
+// the buffer is allocated on the heap, it is only wiped once destroyed.
+//
+// A SecureBuffer isn't safe for concurrent use, it has to be destroyed once
+// the key isn't needed anymore.
+type SecureBuffer struct {
+	data    []byte
+	mem     []byte
+	guarded bool
+	locked  bool
+}
+
+// NewSecureBuffer allocates a zeroed buffer of the given size.
+func NewSecureBuffer(size int) (*SecureBuffer, error) {
+	if size <= 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid secure buffer size %d", size))
+	}
+
+	b, err := allocSecureBuffer(size)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return b, nil
+}
+
+// NewSecureBufferFrom moves src into a new secure buffer, src is wiped.
+func NewSecureBufferFrom(src []byte) (*SecureBuffer, error) {
+	b, err := NewSecureBuffer(len(src))
+	if err != nil {
+		return nil, err
+	}
+
+	copy(b.data, src)
+	Wipe(src)
+
+	return b, nil
+}
+
+// Bytes returns the content of the buffer, the slice must not be used once
+// the buffer is destroyed.
+func (b *SecureBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+
+	return b.data
+}
+
+// Key returns the buffer as a box/secretbox key, it returns nil if the size
+// of the buffer isn't KeySize.
+func (b *SecureBuffer) Key() *[KeySize]byte {
+	if b == nil || len(b.data) != KeySize {
+		return nil
+	}
+
+	return (*[KeySize]byte)(unsafe.Pointer(&b.data[0]))
+}
+
+// Locked reports whether the pages of the buffer are locked in memory, the
+// lock fails once the RLIMIT_MEMLOCK of the process is reached.
+func (b *SecureBuffer) Locked() bool {
+	return b != nil && b.locked
+}
+
+// Guarded reports whether the buffer is allocated out of the Go heap,
+// between guard pages.
+func (b *SecureBuffer) Guarded() bool {
+	return b != nil && b.guarded
+}
+
+// Destroy wipes the buffer and releases its memory.
+func (b *SecureBuffer) Destroy() {
+	if b == nil || b.data == nil {
+		return
+	}
+
+	Wipe(b.data)
+	freeSecureBuffer(b)
+
+	b.data, b.mem = nil, nil
+}
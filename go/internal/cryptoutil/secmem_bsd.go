@@ -0,0 +1,7 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package cryptoutil
+
+// excludeFromDumps is a no-op, the pages are only excluded from the core
+// dumps on linux.
+func excludeFromDumps([]byte) {}
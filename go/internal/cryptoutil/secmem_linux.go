@@ -0,0 +1,7 @@
+package cryptoutil
+
+import "golang.org/x/sys/unix"
+
+func excludeFromDumps(pages []byte) {
+	_ = unix.Madvise(pages, unix.MADV_DONTDUMP)
+}
@@ -0,0 +1,9 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package cryptoutil
+
+func allocSecureBuffer(size int) (*SecureBuffer, error) {
+	return &SecureBuffer{data: make([]byte, size)}, nil
+}
+
+func freeSecureBuffer(*SecureBuffer) {}
@@ -0,0 +1,93 @@
+package cryptoutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var heapSink []byte
+
+// inHeapDump reports whether the heap contains secret, the dump is wiped
+// before returning so it doesn't pollute the next dumps.
+func inHeapDump(t *testing.T, secret []byte) bool {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "heapdump")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	debug.WriteHeapDump(f.Fd())
+
+	dump, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	defer Wipe(dump)
+
+	return bytes.Contains(dump, secret)
+}
+
+func fillPattern(b []byte) {
+	for i := range b {
+		b[i] = byte(i*7 + 13)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	b := []byte("secret key material")
+	Wipe(b)
+	assert.Equal(t, make([]byte, len(b)), b)
+
+	k := &[KeySize]byte{1, 2, 3}
+	WipeKey(k)
+	assert.Equal(t, [KeySize]byte{}, *k)
+
+	WipeKey(nil)
+}
+
+func TestSecureBuffer(t *testing.T) {
+	_, err := NewSecureBuffer(0)
+	require.Error(t, err)
+
+	src := []byte("0123456789abcdef0123456789abcdef")
+	b, err := NewSecureBufferFrom(src)
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("0123456789abcdef0123456789abcdef"), b.Bytes())
+	assert.Equal(t, make([]byte, KeySize), src)
+	require.NotNil(t, b.Key())
+	assert.Equal(t, b.Bytes(), b.Key()[:])
+
+	b.Destroy()
+	assert.Nil(t, b.Bytes())
+	assert.Nil(t, b.Key())
+
+	// destroying twice is a no-op
+	b.Destroy()
+}
+
+func TestSecureBufferNotInHeapDump(t *testing.T) {
+	b, err := NewSecureBuffer(KeySize)
+	require.NoError(t, err)
+	defer b.Destroy()
+
+	if !b.Guarded() {
+		t.Skipf("secure buffers are allocated on the heap on %s", runtime.GOOS)
+	}
+
+	fillPattern(b.Bytes())
+	assert.False(t, inHeapDump(t, b.Bytes()), "secure buffer found in the heap")
+
+	// a key copied on the heap is dumped until it is wiped
+	heapSink = append([]byte{}, b.Bytes()...)
+	require.True(t, inHeapDump(t, b.Bytes()), "heap copy not found, the dump can't be trusted")
+
+	Wipe(heapSink)
+	assert.False(t, inHeapDump(t, b.Bytes()), "wiped key found in the heap")
+}
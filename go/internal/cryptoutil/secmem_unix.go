@@ -0,0 +1,55 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package cryptoutil
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocSecureBuffer maps the data pages between two guard pages, the data is
+// aligned on the end of the pages so an overflow hits the rear guard.
+func allocSecureBuffer(size int) (*SecureBuffer, error) {
+	pageSize := os.Getpagesize()
+	dataPages := (size + pageSize - 1) / pageSize * pageSize
+
+	mem, err := unix.Mmap(-1, 0, dataPages+2*pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Mprotect(mem[:pageSize], unix.PROT_NONE); err != nil {
+		_ = unix.Munmap(mem)
+		return nil, err
+	}
+
+	if err := unix.Mprotect(mem[pageSize+dataPages:], unix.PROT_NONE); err != nil {
+		_ = unix.Munmap(mem)
+		return nil, err
+	}
+
+	pages := mem[pageSize : pageSize+dataPages]
+	excludeFromDumps(pages)
+
+	b := &SecureBuffer{
+		data:    pages[dataPages-size:],
+		mem:     mem,
+		guarded: true,
+		// best effort, the buffer is still usable if it can't be locked
+		locked: unix.Mlock(pages) == nil,
+	}
+
+	return b, nil
+}
+
+func freeSecureBuffer(b *SecureBuffer) {
+	pageSize := os.Getpagesize()
+	pages := b.mem[pageSize : len(b.mem)-pageSize]
+
+	if b.locked {
+		_ = unix.Munlock(pages)
+	}
+
+	_ = unix.Munmap(b.mem)
+}
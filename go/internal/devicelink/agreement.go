@@ -0,0 +1,106 @@
+package devicelink
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	keyInfo  = "berty device link key"
+	codeInfo = "berty device link code"
+)
+
+// ErrDecrypt is returned when a sealed payload can't be opened with the
+// agreed key.
+var ErrDecrypt = fmt.Errorf("unable to open the device link payload")
+
+// Key is the key agreed by both devices.
+type Key [32]byte
+
+// Answer returns the ephemeral key of the existing device, sent to the new
+// device, and the key agreed with the offer.
+func Answer(o *Offer) ([]byte, *Key, error) {
+	priv, pub, err := generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k, err := agree(priv, o.PublicKey, o.PublicKey, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pub, k, nil
+}
+
+// Agree returns the key agreed with an answer, priv is the ephemeral key of
+// the offer.
+func Agree(o *Offer, priv []byte, answer []byte) (*Key, error) {
+	if len(answer) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid answer key")
+	}
+
+	return agree(priv, answer, o.PublicKey, answer)
+}
+
+func agree(priv, remote, offerPK, answerPK []byte) (*Key, error) {
+	dh, err := curve25519.X25519(priv, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	// both ephemeral keys are bound to the key
+	salt := append(append([]byte{}, offerPK...), answerPK...)
+
+	k := &Key{}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dh, salt, []byte(keyInfo)), k[:]); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// VerificationCode returns the 6 digits code both devices display.
+func (k *Key) VerificationCode() string {
+	code := make([]byte, 4)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, k[:], nil, []byte(codeInfo)), code)
+
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(code)%1000000)
+}
+
+// Seal encrypts a payload with the key, a random nonce is prepended.
+func (k *Key) Seal(payload []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	key := [32]byte(*k)
+
+	return secretbox.Seal(nonce[:], payload, &nonce, &key), nil
+}
+
+// Open decrypts a payload sealed with the key.
+func (k *Key) Open(sealed []byte) ([]byte, error) {
+	var nonce [24]byte
+	if len(sealed) < len(nonce)+secretbox.Overhead {
+		return nil, ErrDecrypt
+	}
+
+	copy(nonce[:], sealed)
+	key := [32]byte(*k)
+
+	payload, ok := secretbox.Open(nil, sealed[len(nonce):], &nonce, &key)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+
+	return payload, nil
+}
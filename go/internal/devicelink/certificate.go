@@ -0,0 +1,124 @@
+package devicelink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ErrInvalidCertificate is returned when a certificate isn't signed by the
+// key of its account.
+var ErrInvalidCertificate = fmt.Errorf("invalid device certificate")
+
+// Certificate attests a device belongs to an account.
+type Certificate struct {
+	AccountPK []byte  `json:"account_pk"`
+	DevicePK  []byte  `json:"device_pk"`
+	PeerID    peer.ID `json:"peer_id"`
+
+	// IssuerPK is the device key of the device which linked the device
+	IssuerPK []byte `json:"issuer_pk"`
+	IssuedAt int64  `json:"issued_at"`
+}
+
+type signedCertificate struct {
+	Certificate []byte `json:"certificate"`
+	Signature   []byte `json:"signature"`
+}
+
+// SignCertificate signs a certificate with the account key, its account and
+// issue date are set from it.
+func SignCertificate(accountSK crypto.PrivKey, c *Certificate, now time.Time) ([]byte, error) {
+	accountPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	c.AccountPK = accountPK
+	c.IssuedAt = now.Unix()
+
+	cert, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := accountSK.Sign(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&signedCertificate{Certificate: cert, Signature: sig})
+}
+
+// OpenCertificate verifies a signed certificate, it must be signed by the
+// key of its account.
+func OpenCertificate(data []byte) (*Certificate, error) {
+	signed := &signedCertificate{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, err
+	}
+
+	c := &Certificate{}
+	if err := json.Unmarshal(signed.Certificate, c); err != nil {
+		return nil, err
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(c.AccountPK)
+	if err != nil {
+		return nil, ErrInvalidCertificate
+	}
+
+	if ok, err := pk.Verify(signed.Certificate, signed.Signature); err != nil || !ok {
+		return nil, ErrInvalidCertificate
+	}
+
+	return c, nil
+}
+
+// Bundle is the payload the new device receives, sealed with the agreed
+// key.
+type Bundle struct {
+	// AccountSK and AccountProofSK are the marshaled account keys
+	AccountSK      []byte `json:"account_sk"`
+	AccountProofSK []byte `json:"account_proof_sk"`
+
+	Certificate []byte `json:"certificate"`
+
+	// Snapshot is the state snapshot of the existing device, the new device
+	// is in sync once it has the same
+	Snapshot []byte `json:"snapshot,omitempty"`
+}
+
+// Check verifies the bundle is for a device: its certificate is signed by
+// its account key and issued for the device.
+func (b *Bundle) Check(devicePK []byte, pid peer.ID) (*Certificate, crypto.PrivKey, crypto.PrivKey, error) {
+	accountSK, err := crypto.UnmarshalPrivateKey(b.AccountSK)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	proofSK, err := crypto.UnmarshalPrivateKey(b.AccountProofSK)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	c, err := OpenCertificate(b.Certificate)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	accountPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !bytes.Equal(c.AccountPK, accountPK) || !bytes.Equal(c.DevicePK, devicePK) || c.PeerID != pid {
+		return nil, nil, nil, ErrInvalidCertificate
+	}
+
+	return c, accountSK, proofSK, nil
+}
@@ -0,0 +1,120 @@
+package devicelink
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	return sk
+}
+
+func testOffer(t *testing.T, now time.Time) (*Offer, []byte, crypto.PrivKey) {
+	t.Helper()
+
+	deviceSK := testKey(t)
+	devicePK, err := deviceSK.GetPublic().Raw()
+	require.NoError(t, err)
+
+	pid, err := peer.IDFromPrivateKey(testKey(t))
+	require.NoError(t, err)
+
+	o, priv, err := NewOffer(pid, []string{"/ip4/192.168.1.2/tcp/4242", "invalid"}, devicePK, now)
+	require.NoError(t, err)
+
+	return o, priv, deviceSK
+}
+
+func TestOffer(t *testing.T) {
+	now := time.Now()
+	o, _, _ := testOffer(t, now)
+
+	s, err := o.Encode()
+	require.NoError(t, err)
+
+	decoded, err := DecodeOffer(s, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, o.PeerID, decoded.PeerID)
+	assert.Equal(t, o.PublicKey, decoded.PublicKey)
+	assert.Len(t, decoded.Multiaddrs(), 1)
+
+	_, err = DecodeOffer(s, now.Add(MaxOfferAge+time.Second))
+	assert.Equal(t, ErrExpired, err)
+
+	_, err = DecodeOffer("berty://other#"+s[len(OfferPrefix):], now)
+	assert.Equal(t, ErrInvalidOffer, err)
+}
+
+func TestAgreement(t *testing.T) {
+	o, priv, _ := testOffer(t, time.Now())
+
+	answer, existing, err := Answer(o)
+	require.NoError(t, err)
+
+	linked, err := Agree(o, priv, answer)
+	require.NoError(t, err)
+	assert.Equal(t, existing, linked)
+	assert.Len(t, linked.VerificationCode(), 6)
+	assert.Equal(t, existing.VerificationCode(), linked.VerificationCode())
+
+	sealed, err := existing.Seal([]byte("bundle"))
+	require.NoError(t, err)
+
+	payload, err := linked.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bundle"), payload)
+
+	// somebody else answering the offer agrees another key
+	other, _, err := Answer(o)
+	require.NoError(t, err)
+
+	forged, err := Agree(o, priv, other)
+	require.NoError(t, err)
+	assert.NotEqual(t, existing.VerificationCode(), forged.VerificationCode())
+
+	_, err = forged.Open(sealed)
+	assert.Equal(t, ErrDecrypt, err)
+}
+
+func TestBundle(t *testing.T) {
+	o, _, _ := testOffer(t, time.Now())
+	accountSK, proofSK, issuerSK := testKey(t), testKey(t), testKey(t)
+
+	issuerPK, err := issuerSK.GetPublic().Raw()
+	require.NoError(t, err)
+
+	cert, err := SignCertificate(accountSK, &Certificate{DevicePK: o.DevicePK, PeerID: o.PeerID, IssuerPK: issuerPK}, time.Now())
+	require.NoError(t, err)
+
+	b := &Bundle{Certificate: cert}
+	b.AccountSK, err = crypto.MarshalPrivateKey(accountSK)
+	require.NoError(t, err)
+	b.AccountProofSK, err = crypto.MarshalPrivateKey(proofSK)
+	require.NoError(t, err)
+
+	c, sk, _, err := b.Check(o.DevicePK, o.PeerID)
+	require.NoError(t, err)
+	assert.True(t, sk.Equals(accountSK))
+	assert.Equal(t, issuerPK, c.IssuerPK)
+
+	// the certificate is issued for another device
+	_, _, _, err = b.Check(issuerPK, o.PeerID)
+	assert.Equal(t, ErrInvalidCertificate, err)
+
+	// the certificate isn't signed by the account sent
+	b.Certificate, err = SignCertificate(testKey(t), &Certificate{DevicePK: o.DevicePK, PeerID: o.PeerID}, time.Now())
+	require.NoError(t, err)
+	_, _, _, err = b.Check(o.DevicePK, o.PeerID)
+	assert.Equal(t, ErrInvalidCertificate, err)
+}
@@ -0,0 +1,10 @@
+// Package devicelink implements the linking of a new device to an account:
+// the new device shows an offer with an ephemeral key as a QR code, the
+// existing device scans it and runs a key agreement with it, then sends it
+// the keys of the account, a device certificate signed by the account and a
+// snapshot of the state to catch up with.
+//
+// The QR code is the authenticated channel: the existing device only talks
+// to the key it scanned. Both devices display a verification code derived
+// from the agreed key, for the user to check nobody else answered the offer.
+package devicelink
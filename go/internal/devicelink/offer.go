@@ -0,0 +1,129 @@
+package devicelink
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/crypto/curve25519"
+)
+
+// OfferPrefix starts the offers encoded in the QR codes.
+const OfferPrefix = "berty://link-device#"
+
+// MaxOfferAge is how long an offer can be scanned, the QR code is shown on
+// the new device only while linking.
+const MaxOfferAge = 10 * time.Minute
+
+// maxClockSkew tolerates the offers of a device with a clock ahead.
+const maxClockSkew = time.Minute
+
+var (
+	// ErrInvalidOffer is returned for the strings which aren't offers
+	ErrInvalidOffer = fmt.Errorf("invalid device link offer")
+
+	// ErrExpired is returned for the offers made too long ago
+	ErrExpired = fmt.Errorf("device link offer expired")
+)
+
+// Offer is shown by the new device as a QR code.
+type Offer struct {
+	PeerID peer.ID  `json:"peer_id"`
+	Addrs  []string `json:"addrs,omitempty"`
+
+	// DevicePK is the device key of the new device, the certificate is
+	// issued for it
+	DevicePK []byte `json:"device_pk"`
+
+	// PublicKey is the ephemeral X25519 key of the key agreement
+	PublicKey []byte `json:"public_key"`
+
+	Timestamp int64 `json:"timestamp"`
+}
+
+// NewOffer returns an offer for a device and the private key of its
+// ephemeral key.
+func NewOffer(pid peer.ID, addrs []string, devicePK []byte, now time.Time) (*Offer, []byte, error) {
+	priv, pub, err := generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &Offer{
+		PeerID:    pid,
+		Addrs:     addrs,
+		DevicePK:  devicePK,
+		PublicKey: pub,
+		Timestamp: now.Unix(),
+	}, priv, nil
+}
+
+func generateKey() ([]byte, []byte, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return priv, pub, nil
+}
+
+// Multiaddrs returns the valid addrs of the offer.
+func (o *Offer) Multiaddrs() []ma.Multiaddr {
+	addrs := []ma.Multiaddr{}
+	for _, s := range o.Addrs {
+		if addr, err := ma.NewMultiaddr(s); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// Encode returns the content of the QR code of the offer.
+func (o *Offer) Encode() (string, error) {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+
+	return OfferPrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeOffer decodes the content of a QR code, the offer must have been
+// made less than MaxOfferAge ago.
+func DecodeOffer(s string, now time.Time) (*Offer, error) {
+	if !strings.HasPrefix(s, OfferPrefix) {
+		return nil, ErrInvalidOffer
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, OfferPrefix))
+	if err != nil {
+		return nil, ErrInvalidOffer
+	}
+
+	o := &Offer{}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, ErrInvalidOffer
+	}
+
+	if len(o.PublicKey) != curve25519.PointSize || len(o.DevicePK) == 0 || o.PeerID.Validate() != nil {
+		return nil, ErrInvalidOffer
+	}
+
+	madeAt := time.Unix(o.Timestamp, 0)
+	if now.Sub(madeAt) > MaxOfferAge || madeAt.Sub(now) > maxClockSkew {
+		return nil, ErrExpired
+	}
+
+	return o, nil
+}
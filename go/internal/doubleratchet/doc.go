@@ -0,0 +1,18 @@
+// Package doubleratchet implements the Double Ratchet algorithm, as
+// specified by https://signal.org/docs/specifications/doubleratchet/
+//
+// - X25519 is used for the Diffie-Hellman ratchet.
+// - HKDF-SHA256 derives the root and the chain keys, HMAC-SHA256 derives the
+//   message keys from the chain keys.
+// - ChaCha20-Poly1305 seals the messages, the header is authenticated along
+//   with the associated data.
+//
+// Unlike the specification, both parties can send first: they agree on the
+// role of each one, the initiator starts sending with the public key of the
+// responder, while the responder immediately performs a DH ratchet step
+// using the public key of the initiator. Both public keys have to be known
+// beforehand.
+//
+// A session is not safe for concurrent use, it can be serialized with
+// Marshal and restored with Unmarshal.
+package doubleratchet
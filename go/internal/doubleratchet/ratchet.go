@@ -0,0 +1,378 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// KeySize is the size of the keys of the DH ratchet
+	KeySize = 32
+
+	// MaxSkip is the maximum count of message keys skipped in a single
+	// chain, a message further ahead is refused.
+	MaxSkip = 1000
+
+	// MaxSkipped is the maximum count of skipped message keys kept by a
+	// session.
+	MaxSkipped = 2000
+
+	headerSize = KeySize + 8
+)
+
+var (
+	ErrTooManySkipped = fmt.Errorf("too many skipped messages")
+	ErrNoSendingChain = fmt.Errorf("no sending chain")
+
+	rootInfo    = []byte("berty double ratchet root")
+	messageInfo = []byte("berty double ratchet message")
+)
+
+// KeyPair is a X25519 key pair.
+type KeyPair struct {
+	Private []byte
+	Public  []byte
+}
+
+// GenerateKeyPair generates a new X25519 key pair.
+func GenerateKeyPair() (*KeyPair, error) {
+	priv := make([]byte, KeySize)
+	if _, err := io.ReadFull(crand.Reader, priv); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return &KeyPair{Private: priv, Public: pub}, nil
+}
+
+// Header is sent in clear along with each message.
+type Header struct {
+	// DH is the current ratchet public key of the sender
+	DH []byte
+
+	// PN is the count of messages in the previous sending chain
+	PN uint32
+
+	// N is the number of the message in the current sending chain
+	N uint32
+}
+
+func (h *Header) Marshal() []byte {
+	buf := make([]byte, headerSize)
+	copy(buf, h.DH)
+	binary.BigEndian.PutUint32(buf[KeySize:], h.PN)
+	binary.BigEndian.PutUint32(buf[KeySize+4:], h.N)
+
+	return buf
+}
+
+func UnmarshalHeader(data []byte) (*Header, error) {
+	if len(data) != headerSize {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("invalid header size %d", len(data)))
+	}
+
+	return &Header{
+		DH: append([]byte(nil), data[:KeySize]...),
+		PN: binary.BigEndian.Uint32(data[KeySize:]),
+		N:  binary.BigEndian.Uint32(data[KeySize+4:]),
+	}, nil
+}
+
+type state struct {
+	DHs     *KeyPair          `json:"dhs"`
+	DHr     []byte            `json:"dhr"`
+	RK      []byte            `json:"rk"`
+	CKs     []byte            `json:"cks"`
+	CKr     []byte            `json:"ckr"`
+	Ns      uint32            `json:"ns"`
+	Nr      uint32            `json:"nr"`
+	PN      uint32            `json:"pn"`
+	Skipped map[string][]byte `json:"skipped"`
+}
+
+func (s *state) clone() *state {
+	c := *s
+	c.Skipped = make(map[string][]byte, len(s.Skipped))
+	for k, v := range s.Skipped {
+		c.Skipped[k] = v
+	}
+
+	return &c
+}
+
+// Session is one side of a Double Ratchet session.
+type Session struct {
+	state *state
+}
+
+// NewSession starts a session from a secret shared by both parties and their
+// ratchet key pair and public key, the initiator must be the opposite on
+// both sides.
+func NewSession(sharedSecret []byte, own *KeyPair, remotePub []byte, initiator bool) (*Session, error) {
+	if len(sharedSecret) == 0 || own == nil || len(remotePub) != KeySize {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	dh, err := curve25519.X25519(own.Private, remotePub)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	rk, ck, err := kdfRootKey(sharedSecret, dh)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &state{
+		DHs:     own,
+		DHr:     append([]byte(nil), remotePub...),
+		RK:      rk,
+		Skipped: map[string][]byte{},
+	}
+
+	if initiator {
+		s.CKs = ck
+		return &Session{state: s}, nil
+	}
+
+	// the responder receives on the chain of the initiator, it starts its
+	// own sending chain right away
+	s.CKr = ck
+	if s.DHs, err = GenerateKeyPair(); err != nil {
+		return nil, err
+	}
+
+	if dh, err = curve25519.X25519(s.DHs.Private, s.DHr); err != nil {
+		return nil, errcode.ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	if s.RK, s.CKs, err = kdfRootKey(s.RK, dh); err != nil {
+		return nil, err
+	}
+
+	return &Session{state: s}, nil
+}
+
+// Encrypt seals a message, the associated data is authenticated but not sent.
+func (s *Session) Encrypt(plaintext []byte, ad []byte) (*Header, []byte, error) {
+	if s.state.CKs == nil {
+		return nil, nil, errcode.ErrCryptoEncrypt.Wrap(ErrNoSendingChain)
+	}
+
+	ck, mk := kdfChainKey(s.state.CKs)
+	header := &Header{DH: s.state.DHs.Public, PN: s.state.PN, N: s.state.Ns}
+
+	ciphertext, err := seal(mk, plaintext, append(append([]byte(nil), ad...), header.Marshal()...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.state.CKs = ck
+	s.state.Ns++
+
+	return header, ciphertext, nil
+}
+
+// Decrypt opens a message, the session is left unchanged if it fails.
+func (s *Session) Decrypt(header *Header, ciphertext []byte, ad []byte) ([]byte, error) {
+	ad = append(append([]byte(nil), ad...), header.Marshal()...)
+
+	if mk, ok := s.state.Skipped[skippedKey(header.DH, header.N)]; ok {
+		plaintext, err := open(mk, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+
+		delete(s.state.Skipped, skippedKey(header.DH, header.N))
+
+		return plaintext, nil
+	}
+
+	st := s.state.clone()
+
+	if !bytes.Equal(header.DH, st.DHr) {
+		if err := st.skip(header.PN); err != nil {
+			return nil, err
+		}
+
+		if err := st.dhRatchet(header); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := st.skip(header.N); err != nil {
+		return nil, err
+	}
+
+	ck, mk := kdfChainKey(st.CKr)
+	plaintext, err := open(mk, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	st.CKr = ck
+	st.Nr++
+	s.state = st
+
+	return plaintext, nil
+}
+
+func (s *state) skip(until uint32) error {
+	if s.CKr == nil {
+		return nil
+	}
+
+	if until < s.Nr {
+		return nil
+	}
+
+	if until-s.Nr > MaxSkip || len(s.Skipped)+int(until-s.Nr) > MaxSkipped {
+		return errcode.ErrCryptoDecrypt.Wrap(ErrTooManySkipped)
+	}
+
+	for s.Nr < until {
+		ck, mk := kdfChainKey(s.CKr)
+		s.Skipped[skippedKey(s.DHr, s.Nr)] = mk
+		s.CKr = ck
+		s.Nr++
+	}
+
+	return nil
+}
+
+func (s *state) dhRatchet(header *Header) error {
+	s.PN = s.Ns
+	s.Ns, s.Nr = 0, 0
+	s.DHr = append([]byte(nil), header.DH...)
+
+	dh, err := curve25519.X25519(s.DHs.Private, s.DHr)
+	if err != nil {
+		return errcode.ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	if s.RK, s.CKr, err = kdfRootKey(s.RK, dh); err != nil {
+		return err
+	}
+
+	if s.DHs, err = GenerateKeyPair(); err != nil {
+		return err
+	}
+
+	if dh, err = curve25519.X25519(s.DHs.Private, s.DHr); err != nil {
+		return errcode.ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	s.RK, s.CKs, err = kdfRootKey(s.RK, dh)
+
+	return err
+}
+
+// Marshal serializes the state of the session, it contains its secrets.
+func (s *Session) Marshal() ([]byte, error) {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return data, nil
+}
+
+// Unmarshal restores a session serialized by Marshal.
+func Unmarshal(data []byte) (*Session, error) {
+	st := &state{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if st.DHs == nil || len(st.RK) == 0 {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("invalid session state"))
+	}
+
+	if st.Skipped == nil {
+		st.Skipped = map[string][]byte{}
+	}
+
+	return &Session{state: st}, nil
+}
+
+func skippedKey(dh []byte, n uint32) string {
+	return fmt.Sprintf("%s/%d", hex.EncodeToString(dh), n)
+}
+
+func kdfRootKey(rk, dh []byte) ([]byte, []byte, error) {
+	out := make([]byte, 2*KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dh, rk, rootInfo), out); err != nil {
+		return nil, nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return out[:KeySize], out[KeySize:], nil
+}
+
+func kdfChainKey(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+	mk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+
+	return mac.Sum(nil), mk
+}
+
+func messageCipher(mk []byte) ([]byte, []byte, error) {
+	out := make([]byte, chacha20poly1305.KeySize+chacha20poly1305.NonceSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, mk, nil, messageInfo), out); err != nil {
+		return nil, nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return out[:chacha20poly1305.KeySize], out[chacha20poly1305.KeySize:], nil
+}
+
+func seal(mk, plaintext, ad []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(mk)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
+	}
+
+	return aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func open(mk, ciphertext, ad []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(mk)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,132 @@
+package doubleratchet
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSessions(t *testing.T) (*Session, *Session) {
+	t.Helper()
+
+	secret := []byte("shared secret")
+
+	kpA, err := GenerateKeyPair()
+	require.NoError(t, err)
+
+	kpB, err := GenerateKeyPair()
+	require.NoError(t, err)
+
+	alice, err := NewSession(secret, kpA, kpB.Public, true)
+	require.NoError(t, err)
+
+	bob, err := NewSession(secret, kpB, kpA.Public, false)
+	require.NoError(t, err)
+
+	return alice, bob
+}
+
+type testMessage struct {
+	header     *Header
+	ciphertext []byte
+	plaintext  []byte
+}
+
+func encrypt(t *testing.T, s *Session, plaintext string) *testMessage {
+	t.Helper()
+
+	header, ciphertext, err := s.Encrypt([]byte(plaintext), []byte("ad"))
+	require.NoError(t, err)
+
+	return &testMessage{header: header, ciphertext: ciphertext, plaintext: []byte(plaintext)}
+}
+
+func decrypt(t *testing.T, s *Session, m *testMessage) {
+	t.Helper()
+
+	plaintext, err := s.Decrypt(m.header, m.ciphertext, []byte("ad"))
+	require.NoError(t, err)
+	assert.Equal(t, m.plaintext, plaintext)
+}
+
+func TestSession(t *testing.T) {
+	alice, bob := newTestSessions(t)
+
+	// both parties can send first
+	decrypt(t, alice, encrypt(t, bob, "bob 1"))
+	decrypt(t, bob, encrypt(t, alice, "alice 1"))
+
+	for i := 0; i < 10; i++ {
+		decrypt(t, bob, encrypt(t, alice, fmt.Sprintf("alice %d", i)))
+		decrypt(t, alice, encrypt(t, bob, fmt.Sprintf("bob %d", i)))
+	}
+
+	// a replayed message is refused
+	m := encrypt(t, alice, "replayed")
+	decrypt(t, bob, m)
+	_, err := bob.Decrypt(m.header, m.ciphertext, []byte("ad"))
+	assert.Error(t, err)
+}
+
+func TestSessionOutOfOrder(t *testing.T) {
+	alice, bob := newTestSessions(t)
+
+	first := []*testMessage{encrypt(t, alice, "a1"), encrypt(t, alice, "a2"), encrypt(t, alice, "a3")}
+	decrypt(t, bob, first[2])
+
+	reply := encrypt(t, bob, "b1")
+	decrypt(t, alice, reply)
+
+	// a message of the next chain arrives before the end of the previous one
+	second := encrypt(t, alice, "a4")
+	decrypt(t, bob, second)
+	decrypt(t, bob, first[0])
+	decrypt(t, bob, first[1])
+}
+
+func TestSessionTampered(t *testing.T) {
+	alice, bob := newTestSessions(t)
+
+	m := encrypt(t, alice, "message")
+	m.ciphertext[0] ^= 0xff
+
+	_, err := bob.Decrypt(m.header, m.ciphertext, []byte("ad"))
+	assert.Error(t, err)
+
+	// the session is unchanged by the failure
+	decrypt(t, bob, encrypt(t, alice, "next"))
+}
+
+func TestSessionMarshal(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	decrypt(t, bob, encrypt(t, alice, "before"))
+
+	data, err := bob.Marshal()
+	require.NoError(t, err)
+
+	restored, err := Unmarshal(data)
+	require.NoError(t, err)
+
+	decrypt(t, restored, encrypt(t, alice, "after"))
+	decrypt(t, alice, encrypt(t, restored, "reply"))
+
+	header, err := UnmarshalHeader((&Header{DH: make([]byte, KeySize), PN: 1, N: 2}).Marshal())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), header.PN)
+	assert.Equal(t, uint32(2), header.N)
+}
+
+func TestSessionTooManySkipped(t *testing.T) {
+	alice, bob := newTestSessions(t)
+
+	for i := 0; i < MaxSkip+1; i++ {
+		_, _, err := alice.Encrypt([]byte("skipped"), nil)
+		require.NoError(t, err)
+	}
+
+	m := encrypt(t, alice, "too far")
+	_, err := bob.Decrypt(m.header, m.ciphertext, []byte("ad"))
+	assert.Error(t, err)
+}
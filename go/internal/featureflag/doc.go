@@ -0,0 +1,3 @@
+// Package featureflag gates new protocol behaviors on both peers of a session
+// advertising them, with deterministic staged rollout and a local kill-switch.
+package featureflag
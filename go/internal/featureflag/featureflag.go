@@ -0,0 +1,271 @@
+package featureflag
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+// Flag is the name of a protocol behavior that can be toggled network-wide
+type Flag string
+
+// ProtocolID returns the protocol ID used to advertise the flag through
+// libp2p identify.
+func (f Flag) ProtocolID() protocol.ID {
+	return protocol.ID(fmt.Sprintf("/berty/feature/%s/1.0.0", string(f)))
+}
+
+// Override is a local decision taking precedence over the rollout
+type Override int
+
+const (
+	OverrideNone Override = iota
+	OverrideEnabled
+	OverrideDisabled
+)
+
+// Status describes the local state of a registered flag
+type Status struct {
+	Flag     Flag
+	Rollout  uint32
+	Override Override
+	Enabled  bool
+}
+
+type flagState struct {
+	rollout  uint32
+	override Override
+	enabled  bool
+}
+
+// Manager keeps track of the local flags and advertises the enabled ones
+type Manager struct {
+	logger *zap.Logger
+	host   host.Host
+	ds     datastore.Datastore
+
+	mu    sync.RWMutex
+	flags map[Flag]*flagState
+}
+
+// New returns a flags manager advertising enabled flags on the given host.
+// Local overrides are persisted in ds when not nil.
+func New(logger *zap.Logger, h host.Host, ds datastore.Datastore) *Manager {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Manager{
+		logger: logger.Named("featureflag"),
+		host:   h,
+		ds:     ds,
+		flags:  make(map[Flag]*flagState),
+	}
+}
+
+// Register declares a flag enabled for the given rollout percentage (0-100)
+// of the peers. The selection is deterministic for a peer ID, so a node
+// doesn't flip between restarts.
+func (m *Manager) Register(f Flag, rollout uint32) error {
+	if f == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("empty flag name"))
+	}
+
+	if rollout > 100 {
+		rollout = 100
+	}
+
+	override, err := m.loadOverride(f)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := &flagState{rollout: rollout, override: override}
+	m.flags[f] = state
+	m.apply(f, state)
+
+	return nil
+}
+
+// Enable forces a flag on, regardless of its rollout.
+func (m *Manager) Enable(f Flag) error {
+	return m.setOverride(f, OverrideEnabled)
+}
+
+// Disable is the local kill-switch, it stops using and advertising a flag.
+func (m *Manager) Disable(f Flag) error {
+	return m.setOverride(f, OverrideDisabled)
+}
+
+// Reset removes the local override of a flag, falling back to its rollout.
+func (m *Manager) Reset(f Flag) error {
+	return m.setOverride(f, OverrideNone)
+}
+
+// IsEnabled returns true if the flag is enabled locally.
+func (m *Manager) IsEnabled(f Flag) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.flags[f]
+	return ok && state.enabled
+}
+
+// IsSupportedBy returns true if the flag is enabled locally and advertised by
+// the given peer, which is the condition for using the gated behavior within
+// a session.
+func (m *Manager) IsSupportedBy(p peer.ID, f Flag) bool {
+	if !m.IsEnabled(f) || m.host == nil {
+		return false
+	}
+
+	supported, err := m.host.Peerstore().SupportsProtocols(p, string(f.ProtocolID()))
+	if err != nil {
+		m.logger.Warn("unable to get peer protocols", zap.String("peer", p.Pretty()), zap.Error(err))
+		return false
+	}
+
+	return len(supported) > 0
+}
+
+// List returns the status of every registered flag, sorted by name.
+func (m *Manager) List() []Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	statuses := make([]Status, 0, len(m.flags))
+	for f, state := range m.flags {
+		statuses = append(statuses, Status{
+			Flag:     f,
+			Rollout:  state.rollout,
+			Override: state.override,
+			Enabled:  state.enabled,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Flag < statuses[j].Flag })
+
+	return statuses
+}
+
+func (m *Manager) setOverride(f Flag, override Override) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.flags[f]
+	if !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown flag %s", f))
+	}
+
+	if err := m.storeOverride(f, override); err != nil {
+		return err
+	}
+
+	state.override = override
+	m.apply(f, state)
+
+	return nil
+}
+
+// apply computes the flag state and updates the advertised protocols, identify
+// pushes the change to the connected peers.
+func (m *Manager) apply(f Flag, state *flagState) {
+	switch state.override {
+	case OverrideEnabled:
+		state.enabled = true
+	case OverrideDisabled:
+		state.enabled = false
+	default:
+		state.enabled = m.inRollout(f, state.rollout)
+	}
+
+	if m.host == nil {
+		return
+	}
+
+	if state.enabled {
+		m.host.SetStreamHandler(f.ProtocolID(), handleFlagStream)
+	} else {
+		m.host.RemoveStreamHandler(f.ProtocolID())
+	}
+
+	m.logger.Debug("feature flag updated", zap.String("flag", string(f)), zap.Bool("enabled", state.enabled))
+}
+
+func (m *Manager) inRollout(f Flag, rollout uint32) bool {
+	switch {
+	case rollout == 0:
+		return false
+	case rollout >= 100:
+		return true
+	case m.host == nil:
+		return false
+	}
+
+	return bucket(m.host.ID(), f) < rollout
+}
+
+// bucket deterministically maps a peer and a flag to [0, 100)
+func bucket(p peer.ID, f Flag) uint32 {
+	sum := sha256.Sum256([]byte(string(p) + "/" + string(f)))
+	return binary.BigEndian.Uint32(sum[:4]) % 100
+}
+
+func overrideKey(f Flag) datastore.Key {
+	return datastore.NewKey(string(f))
+}
+
+func (m *Manager) loadOverride(f Flag) (Override, error) {
+	if m.ds == nil {
+		return OverrideNone, nil
+	}
+
+	value, err := m.ds.Get(overrideKey(f))
+	switch {
+	case err == datastore.ErrNotFound:
+		return OverrideNone, nil
+	case err != nil:
+		return OverrideNone, errcode.TODO.Wrap(err)
+	case len(value) != 1:
+		return OverrideNone, errcode.ErrDeserialization.Wrap(fmt.Errorf("invalid override for flag %s", f))
+	}
+
+	return Override(value[0]), nil
+}
+
+func (m *Manager) storeOverride(f Flag, override Override) error {
+	if m.ds == nil {
+		return nil
+	}
+
+	if override == OverrideNone {
+		if err := m.ds.Delete(overrideKey(f)); err != nil && err != datastore.ErrNotFound {
+			return errcode.TODO.Wrap(err)
+		}
+		return nil
+	}
+
+	if err := m.ds.Put(overrideKey(f), []byte{byte(override)}); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	return nil
+}
+
+// handleFlagStream is a noop, flags are only advertised through identify
+func handleFlagStream(s network.Stream) {
+	_ = s.Reset()
+}
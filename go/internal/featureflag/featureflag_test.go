@@ -0,0 +1,102 @@
+package featureflag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFlag = Flag("test-flag")
+
+func TestManager_Rollout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	m := New(testutil.Logger(t), h, nil)
+
+	require.NoError(t, m.Register(testFlag, 0))
+	assert.False(t, m.IsEnabled(testFlag))
+	assert.NotContains(t, h.Mux().Protocols(), string(testFlag.ProtocolID()))
+
+	require.NoError(t, m.Register(testFlag, 100))
+	assert.True(t, m.IsEnabled(testFlag))
+	assert.Contains(t, h.Mux().Protocols(), string(testFlag.ProtocolID()))
+
+	expected := bucket(h.ID(), testFlag) < 42
+	require.NoError(t, m.Register(testFlag, 42))
+	assert.Equal(t, expected, m.IsEnabled(testFlag))
+	assert.Equal(t, bucket(h.ID(), testFlag), bucket(h.ID(), testFlag))
+
+	assert.Error(t, m.Disable(Flag("unknown")))
+}
+
+func TestManager_KillSwitchPersistence(t *testing.T) {
+	ds := ds_sync.MutexWrap(datastore.NewMapDatastore())
+
+	m := New(testutil.Logger(t), nil, ds)
+	require.NoError(t, m.Register(testFlag, 100))
+	assert.True(t, m.IsEnabled(testFlag))
+
+	require.NoError(t, m.Disable(testFlag))
+	assert.False(t, m.IsEnabled(testFlag))
+
+	// overrides survive a restart
+	m = New(testutil.Logger(t), nil, ds)
+	require.NoError(t, m.Register(testFlag, 100))
+	assert.False(t, m.IsEnabled(testFlag))
+
+	statuses := m.List()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, OverrideDisabled, statuses[0].Override)
+
+	require.NoError(t, m.Reset(testFlag))
+	assert.True(t, m.IsEnabled(testFlag))
+
+	require.NoError(t, m.Enable(testFlag))
+	require.NoError(t, m.Register(testFlag, 0))
+	assert.True(t, m.IsEnabled(testFlag))
+}
+
+func TestManager_IsSupportedBy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	ha, err := mn.GenPeer()
+	require.NoError(t, err)
+	hb, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	require.NoError(t, mn.LinkAll())
+
+	ma := New(testutil.Logger(t), ha, nil)
+	mb := New(testutil.Logger(t), hb, nil)
+
+	require.NoError(t, ma.Register(testFlag, 100))
+	require.NoError(t, mb.Register(testFlag, 100))
+
+	require.NoError(t, ha.Connect(ctx, peer.AddrInfo{ID: hb.ID(), Addrs: hb.Addrs()}))
+
+	require.Eventually(t, func() bool {
+		return ma.IsSupportedBy(hb.ID(), testFlag) && mb.IsSupportedBy(ha.ID(), testFlag)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the kill-switch on one side disables the flag for the session
+	require.NoError(t, mb.Disable(testFlag))
+	assert.False(t, mb.IsSupportedBy(ha.ID(), testFlag))
+	require.Eventually(t, func() bool {
+		return !ma.IsSupportedBy(hb.ID(), testFlag)
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,404 @@
+package grpcutil
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Scope is a permission given to an API token.
+type Scope string
+
+const (
+	ScopeReadMessages   Scope = "read-messages"
+	ScopeSend           Scope = "send"
+	ScopeManageContacts Scope = "manage-contacts"
+
+	// ScopeAdmin allows every method, the other scopes included
+	ScopeAdmin Scope = "admin"
+)
+
+// AuthorizationKey is the metadata key of the bearer tokens.
+const AuthorizationKey = "authorization"
+
+// RootTokenID is the ID of the root token of a TokenStore.
+const RootTokenID = "root"
+
+// ParseScopes validates the names of scopes.
+func ParseScopes(names []string) ([]Scope, error) {
+	scopes := make([]Scope, 0, len(names))
+	for _, name := range names {
+		switch s := Scope(strings.TrimSpace(name)); s {
+		case ScopeReadMessages, ScopeSend, ScopeManageContacts, ScopeAdmin:
+			scopes = append(scopes, s)
+		default:
+			return nil, fmt.Errorf("unknown scope %q", name)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no scope")
+	}
+
+	return scopes, nil
+}
+
+// DefaultMethodScope returns the scope required by a method, from its name:
+// the methods not reading or sending messages nor managing the contacts
+// require the admin scope.
+func DefaultMethodScope(fullMethod string) Scope {
+	name := path.Base(fullMethod)
+
+	switch {
+	case name == "AppMessageSend", name == "AppMetadataSend", name == "SendMessage", name == "SendAck":
+		return ScopeSend
+	case strings.HasPrefix(name, "Contact"), name == "SendContactRequest",
+		name == "InstanceShareableBertyID", name == "ParseDeepLink":
+		return ScopeManageContacts
+	case strings.HasPrefix(name, "GroupMessage"), strings.HasPrefix(name, "GroupMetadata"),
+		name == "GroupInfo", name == "EventStream":
+		return ScopeReadMessages
+	}
+
+	return ScopeAdmin
+}
+
+// APIToken describes a token issued by a TokenStore, its secret is only
+// known when issued.
+type APIToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []Scope   `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Allows returns whether the token has a scope, or the admin one.
+func (t *APIToken) Allows(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+type tokenRecord struct {
+	APIToken
+
+	// Hash is the hex SHA-256 of the secret
+	Hash string `json:"hash"`
+}
+
+// TokenStore issues the API tokens and authenticates the calls, the tokens
+// are persisted in a JSON file, in memory if its path is empty. The root
+// token is the bootstrap admin token of the daemon, it can't be revoked.
+type TokenStore struct {
+	path string
+	root string
+
+	lock   sync.RWMutex
+	tokens map[string]*tokenRecord
+}
+
+// NewTokenStore loads the tokens of a file.
+func NewTokenStore(path string, rootToken string) (*TokenStore, error) {
+	ts := &TokenStore{
+		path:   path,
+		root:   rootToken,
+		tokens: make(map[string]*tokenRecord),
+	}
+
+	if path == "" {
+		return ts, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ts, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	records := []*tokenRecord{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("invalid token file %s: %w", path, err)
+	}
+
+	for _, rec := range records {
+		ts.tokens[rec.ID] = rec
+	}
+
+	return ts, nil
+}
+
+func randomHex(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := crand.Read(raw); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(raw), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// saveLocked writes the tokens to a temporary file first, so the file is
+// never left half written.
+func (ts *TokenStore) saveLocked() error {
+	if ts.path == "" {
+		return nil
+	}
+
+	records := make([]*tokenRecord, 0, len(ts.tokens))
+	for _, rec := range ts.tokens {
+		records = append(records, rec)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := ts.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ts.path)
+}
+
+// Issue creates a token, the returned secret is the bearer token to send.
+func (ts *TokenStore) Issue(name string, scopes []Scope) (string, *APIToken, error) {
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("no scope")
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := id + "." + secret
+	rec := &tokenRecord{
+		APIToken: APIToken{
+			ID:        id,
+			Name:      name,
+			Scopes:    scopes,
+			CreatedAt: time.Now(),
+		},
+		Hash: hashSecret(token),
+	}
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.tokens[id] = rec
+	if err := ts.saveLocked(); err != nil {
+		delete(ts.tokens, id)
+		return "", nil, err
+	}
+
+	t := rec.APIToken
+	return token, &t, nil
+}
+
+// Revoke deletes a token, the calls made with it are refused from now on.
+func (ts *TokenStore) Revoke(id string) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	rec, ok := ts.tokens[id]
+	if !ok {
+		return fmt.Errorf("unknown token %q", id)
+	}
+
+	delete(ts.tokens, id)
+	if err := ts.saveLocked(); err != nil {
+		ts.tokens[id] = rec
+		return err
+	}
+
+	return nil
+}
+
+// List returns the issued tokens, by creation date.
+func (ts *TokenStore) List() []*APIToken {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+
+	tokens := make([]*APIToken, 0, len(ts.tokens))
+	for _, rec := range ts.tokens {
+		t := rec.APIToken
+		tokens = append(tokens, &t)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+
+	return tokens
+}
+
+// Authenticate returns the token of a bearer token, nil if unknown.
+func (ts *TokenStore) Authenticate(token string) *APIToken {
+	if token == "" {
+		return nil
+	}
+
+	if ts.root != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ts.root)) == 1 {
+		return &APIToken{ID: RootTokenID, Name: RootTokenID, Scopes: []Scope{ScopeAdmin}}
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	ts.lock.RLock()
+	rec, ok := ts.tokens[parts[0]]
+	ts.lock.RUnlock()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(hashSecret(token)), []byte(rec.Hash)) != 1 {
+		return nil
+	}
+
+	t := rec.APIToken
+	return &t
+}
+
+// bearerToken returns the token of an authorization value.
+func bearerToken(auth string) string {
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+type tokenCtxKey struct{}
+
+// TokenFromContext returns the token authenticating a call, set by the auth
+// interceptors.
+func TokenFromContext(ctx context.Context) (*APIToken, bool) {
+	t, ok := ctx.Value(tokenCtxKey{}).(*APIToken)
+	return t, ok
+}
+
+// AuthOpts configures the auth interceptors.
+type AuthOpts struct {
+	Logger *zap.Logger
+	Tokens *TokenStore
+
+	// MethodScope returns the scope required by a method, defaults to
+	// DefaultMethodScope
+	MethodScope func(fullMethod string) Scope
+}
+
+func (opts *AuthOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.MethodScope == nil {
+		opts.MethodScope = DefaultMethodScope
+	}
+}
+
+// authorize returns the token of a call allowed to call a method.
+func (opts *AuthOpts) authorize(ctx context.Context, method string) (*APIToken, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var token *APIToken
+	if values := md.Get(AuthorizationKey); len(values) > 0 {
+		token = opts.Tokens.Authenticate(bearerToken(values[0]))
+	}
+
+	if token == nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid or missing API token")
+	}
+
+	if scope := opts.MethodScope(method); !token.Allows(scope) {
+		opts.Logger.Debug("call refused", zap.String("method", method), zap.String("token", token.ID), zap.String("scope", string(scope)))
+		return nil, status.Errorf(codes.PermissionDenied, "the API token lacks the %s scope", scope)
+	}
+
+	return token, nil
+}
+
+// AuthUnaryServerInterceptor refuses the calls without a token having the
+// scope of their method.
+func AuthUnaryServerInterceptor(opts AuthOpts) grpc.UnaryServerInterceptor {
+	opts.applyDefaults()
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		token, err := opts.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(context.WithValue(ctx, tokenCtxKey{}, token), req)
+	}
+}
+
+type authServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authServerStream) Context() context.Context { return s.ctx }
+
+// AuthStreamServerInterceptor is the stream counterpart of
+// AuthUnaryServerInterceptor.
+func AuthStreamServerInterceptor(opts AuthOpts) grpc.StreamServerInterceptor {
+	opts.applyDefaults()
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		token, err := opts.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authServerStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), tokenCtxKey{}, token)})
+	}
+}
+
+type tokenCredentials string
+
+// TokenCredentials sends a bearer token with each call of a client, the
+// daemon listeners are local so no transport security is required.
+func TokenCredentials(token string) credentials.PerRPCCredentials {
+	return tokenCredentials(token)
+}
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{AuthorizationKey: "Bearer " + string(t)}, nil
+}
+
+func (tokenCredentials) RequireTransportSecurity() bool { return false }
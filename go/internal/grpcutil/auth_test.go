@@ -0,0 +1,181 @@
+package grpcutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(AuthorizationKey, "Bearer "+token))
+}
+
+func TestDefaultMethodScope(t *testing.T) {
+	for method, scope := range map[string]Scope{
+		"/berty.protocol.v1.ProtocolService/AppMessageSend":       ScopeSend,
+		"/berty.messenger.v1.MessengerService/SendMessage":        ScopeSend,
+		"/berty.protocol.v1.ProtocolService/ContactRequestSend":   ScopeManageContacts,
+		"/berty.messenger.v1.MessengerService/ParseDeepLink":      ScopeManageContacts,
+		"/berty.protocol.v1.ProtocolService/GroupMessageList":     ScopeReadMessages,
+		"/berty.messenger.v1.MessengerService/EventStream":        ScopeReadMessages,
+		"/berty.protocol.v1.ProtocolService/InstanceExportData":   ScopeAdmin,
+		"/berty.auth.v1.TokenService/TokenIssue":                  ScopeAdmin,
+		"/berty.protocol.v1.ProtocolService/DeviceRevoke":         ScopeAdmin,
+		"/berty.protocol.v1.ProtocolService/GroupMetadataList":    ScopeReadMessages,
+		"/berty.messenger.v1.MessengerService/SendContactRequest": ScopeManageContacts,
+	} {
+		assert.Equal(t, scope, DefaultMethodScope(method), method)
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpcutil-tokens")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.json")
+	ts, err := NewTokenStore(path, "root secret")
+	require.NoError(t, err)
+
+	// the root token is an admin token
+	root := ts.Authenticate("root secret")
+	require.NotNil(t, root)
+	assert.Equal(t, RootTokenID, root.ID)
+	assert.True(t, root.Allows(ScopeSend))
+
+	_, _, err = ts.Issue("bot", nil)
+	assert.Error(t, err)
+
+	secret, token, err := ts.Issue("bot", []Scope{ScopeSend})
+	require.NoError(t, err)
+
+	authenticated := ts.Authenticate(secret)
+	require.NotNil(t, authenticated)
+	assert.Equal(t, token.ID, authenticated.ID)
+	assert.True(t, authenticated.Allows(ScopeSend))
+	assert.False(t, authenticated.Allows(ScopeAdmin))
+
+	// a wrong secret for a known ID
+	assert.Nil(t, ts.Authenticate(token.ID+".wrong"))
+	assert.Nil(t, ts.Authenticate(""))
+	assert.Nil(t, ts.Authenticate("garbage"))
+
+	// the tokens are kept, their secrets aren't
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), secret)
+
+	ts, err = NewTokenStore(path, "root secret")
+	require.NoError(t, err)
+	require.NotNil(t, ts.Authenticate(secret))
+	require.Len(t, ts.List(), 1)
+
+	require.NoError(t, ts.Revoke(token.ID))
+	assert.Nil(t, ts.Authenticate(secret))
+	assert.Error(t, ts.Revoke(token.ID))
+
+	ts, err = NewTokenStore(path, "root secret")
+	require.NoError(t, err)
+	assert.Nil(t, ts.Authenticate(secret))
+	assert.Empty(t, ts.List())
+}
+
+func TestAuthInterceptors(t *testing.T) {
+	ts, err := NewTokenStore("", "root secret")
+	require.NoError(t, err)
+
+	send, _, err := ts.Issue("sender", []Scope{ScopeSend})
+	require.NoError(t, err)
+
+	opts := AuthOpts{Tokens: ts}
+	unary := AuthUnaryServerInterceptor(opts)
+	stream := AuthStreamServerInterceptor(opts)
+
+	handler := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		token, ok := TokenFromContext(ctx)
+		require.True(t, ok)
+		return token.ID, nil
+	}
+
+	sendInfo := &grpc.UnaryServerInfo{FullMethod: "/berty.protocol.v1.ProtocolService/AppMessageSend"}
+	adminInfo := &grpc.UnaryServerInfo{FullMethod: "/berty.protocol.v1.ProtocolService/InstanceExportData"}
+
+	// no token
+	_, err = unary(context.Background(), nil, sendInfo, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = unary(withToken("unknown"), nil, sendInfo, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// a token without the scope of the method
+	_, err = unary(withToken(send), nil, adminInfo, handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	id, err := unary(withToken(send), nil, sendInfo, handler)
+	require.NoError(t, err)
+	assert.NotEqual(t, RootTokenID, id)
+
+	id, err = unary(withToken("root secret"), nil, adminInfo, handler)
+	require.NoError(t, err)
+	assert.Equal(t, RootTokenID, id)
+
+	streamHandler := func(_ interface{}, ss grpc.ServerStream) error {
+		_, ok := TokenFromContext(ss.Context())
+		assert.True(t, ok)
+		return nil
+	}
+
+	streamInfo := &grpc.StreamServerInfo{FullMethod: "/berty.messenger.v1.MessengerService/EventStream"}
+
+	err = stream(nil, &testServerStream{ctx: withToken(send)}, streamInfo, streamHandler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	err = stream(nil, &testServerStream{ctx: context.Background()}, streamInfo, streamHandler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	assert.NoError(t, stream(nil, &testServerStream{ctx: withToken("root secret")}, streamInfo, streamHandler))
+}
+
+func TestTokenService(t *testing.T) {
+	ts, err := NewTokenStore("", "root secret")
+	require.NoError(t, err)
+
+	send, _, err := ts.Issue("sender", []Scope{ScopeSend})
+	require.NoError(t, err)
+
+	svc := NewTokenService(AuthOpts{Tokens: ts})
+
+	// the service requires the admin scope even without the interceptors
+	_, err = svc.TokenIssue(context.Background(), &TokenIssue_Request{Name: "bot", Scopes: []string{"admin"}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = svc.TokenIssue(withToken(send), &TokenIssue_Request{Name: "bot", Scopes: []string{"admin"}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	reply, err := svc.TokenIssue(withToken("root secret"), &TokenIssue_Request{Name: "bot", Scopes: []string{"read-messages"}})
+	require.NoError(t, err)
+	require.NotNil(t, ts.Authenticate(reply.Token))
+
+	_, err = svc.TokenRevoke(withToken("root secret"), &TokenRevoke_Request{ID: RootTokenID})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = svc.TokenRevoke(withToken("root secret"), &TokenRevoke_Request{ID: reply.Info.ID})
+	require.NoError(t, err)
+	assert.Nil(t, ts.Authenticate(reply.Token))
+}
+
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testServerStream) Context() context.Context { return s.ctx }
@@ -1,2 +1,4 @@
-// Package grpcutil contains gRPC lazy codecs, messages and a buf-based listener.
+// Package grpcutil contains gRPC lazy codecs, messages, a buf-based listener,
+// the API version negotiation and API token interceptors, and the HTTP/JSON
+// gateway handler.
 package grpcutil
@@ -0,0 +1,292 @@
+package grpcutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	grpcgw "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"go.uber.org/zap"
+)
+
+const (
+	// GatewayOpenAPIPath is the path the OpenAPI descriptions are served on,
+	// e.g. /openapi/bertyprotocol.swagger.json
+	GatewayOpenAPIPath = "/openapi/"
+
+	// DefaultGatewayPageSize is the size of the pages when only an offset
+	// is given
+	DefaultGatewayPageSize = 50
+
+	// MaxGatewayPageSize bounds the limit of the pages
+	MaxGatewayPageSize = 1000
+)
+
+// GatewayOpts configures the HTTP/JSON gateway.
+type GatewayOpts struct {
+	Logger *zap.Logger
+
+	// Tokens authenticates the requests, by the bearer token of their
+	// Authorization header
+	Tokens *TokenStore
+
+	// MethodScope returns the scope required by a method, defaults to
+	// DefaultMethodScope
+	MethodScope func(fullMethod string) Scope
+
+	// OpenAPIDir is the directory of the OpenAPI descriptions, they are
+	// served without authentication, disabled if empty
+	OpenAPIDir string
+}
+
+func (opts *GatewayOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.MethodScope == nil {
+		opts.MethodScope = DefaultMethodScope
+	}
+}
+
+// NewGatewayHandler returns the handler of the HTTP/JSON gateway of the client
+// API. The calls require a token having the scope of their method, the results
+// of the streaming methods are paginated with the limit and offset query
+// parameters: a page is returned as {"results": [...], "next_offset": n},
+// next_offset being set if the stream has more results.
+func NewGatewayHandler(mux *grpcgw.ServeMux, opts GatewayOpts) http.Handler {
+	opts.applyDefaults()
+
+	gw := &gateway{mux: mux, opts: opts}
+
+	h := http.NewServeMux()
+	h.HandleFunc("/", gw.serveAPI)
+	if opts.OpenAPIDir != "" {
+		h.HandleFunc(GatewayOpenAPIPath, gw.serveOpenAPI)
+	}
+
+	return h
+}
+
+type gateway struct {
+	mux  *grpcgw.ServeMux
+	opts GatewayOpts
+}
+
+func (gw *gateway) serveAPI(w http.ResponseWriter, r *http.Request) {
+	token := gw.opts.Tokens.Authenticate(bearerToken(r.Header.Get("Authorization")))
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="berty"`)
+		writeGatewayError(w, http.StatusUnauthorized, "invalid or missing API token")
+		return
+	}
+
+	// the paths of the gateway are the full names of the methods
+	if scope := gw.opts.MethodScope(r.URL.Path); !token.Allows(scope) {
+		writeGatewayError(w, http.StatusForbidden, "the API token lacks the "+string(scope)+" scope")
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("limit") == "" && q.Get("offset") == "" {
+		gw.mux.ServeHTTP(w, r)
+		return
+	}
+
+	limit, offset, err := parsePage(q.Get("limit"), q.Get("offset"))
+	if err != nil {
+		writeGatewayError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the stream is ended once the page is full
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	pw := &pageWriter{header: http.Header{}, limit: limit, offset: offset, cancel: cancel}
+	gw.mux.ServeHTTP(pw, r.WithContext(ctx))
+	pw.flushTo(w)
+}
+
+func (gw *gateway) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(strings.TrimPrefix(r.URL.Path, GatewayOpenAPIPath))
+	if !strings.HasSuffix(name, ".json") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(gw.opts.OpenAPIDir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, name, st.ModTime(), f)
+}
+
+func parsePage(rawLimit, rawOffset string) (int, int, error) {
+	limit, offset := DefaultGatewayPageSize, 0
+
+	if rawLimit != "" {
+		l, err := strconv.Atoi(rawLimit)
+		if err != nil || l <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit")
+		}
+
+		limit = l
+		if limit > MaxGatewayPageSize {
+			limit = MaxGatewayPageSize
+		}
+	}
+
+	if rawOffset != "" {
+		o, err := strconv.Atoi(rawOffset)
+		if err != nil || o < 0 {
+			return 0, 0, fmt.Errorf("invalid offset")
+		}
+
+		offset = o
+	}
+
+	return limit, offset, nil
+}
+
+type gatewayPage struct {
+	Results    []json.RawMessage `json:"results"`
+	NextOffset *int              `json:"next_offset,omitempty"`
+	Error      json.RawMessage   `json:"error,omitempty"`
+}
+
+// pageWriter collects a page of the newline delimited results written by the
+// gateway for the streaming methods, the other responses are passed as is.
+type pageWriter struct {
+	header http.Header
+	status int
+	limit  int
+	offset int
+	cancel func()
+
+	pending []byte
+	lines   int
+	page    gatewayPage
+	full    bool
+}
+
+func (pw *pageWriter) Header() http.Header { return pw.header }
+
+func (pw *pageWriter) WriteHeader(status int) {
+	if pw.status == 0 {
+		pw.status = status
+	}
+}
+
+func (pw *pageWriter) Flush() {}
+
+func (pw *pageWriter) Write(b []byte) (int, error) {
+	if pw.full {
+		return len(b), nil
+	}
+
+	pw.pending = append(pw.pending, b...)
+	for {
+		i := bytes.IndexByte(pw.pending, '\n')
+		if i < 0 {
+			break
+		}
+
+		pw.line(pw.pending[:i])
+		pw.pending = pw.pending[i+1:]
+		if pw.full {
+			pw.cancel()
+			break
+		}
+	}
+
+	return len(b), nil
+}
+
+func (pw *pageWriter) line(line []byte) {
+	var msg struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+
+	if msg.Error != nil {
+		pw.page.Error = msg.Error
+		pw.full = true
+		return
+	}
+
+	pw.lines++
+	switch {
+	case pw.lines <= pw.offset:
+	case len(pw.page.Results) < pw.limit:
+		pw.page.Results = append(pw.page.Results, msg.Result)
+	default:
+		// a result after the page, the stream has more
+		next := pw.offset + pw.limit
+		pw.page.NextOffset = &next
+		pw.full = true
+	}
+}
+
+func (pw *pageWriter) flushTo(w http.ResponseWriter) {
+	status := pw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	// not a stream, e.g. a unary method or an error
+	if pw.lines == 0 && pw.page.Error == nil && len(bytes.TrimSpace(pw.pending)) > 0 {
+		for k, v := range pw.header {
+			w.Header()[k] = v
+		}
+
+		w.WriteHeader(status)
+		_, _ = w.Write(pw.pending)
+		return
+	}
+
+	if pw.page.Results == nil {
+		pw.page.Results = []json.RawMessage{}
+	}
+
+	data, err := json.Marshal(&pw.page)
+	if err != nil {
+		writeGatewayError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, message string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"code":    status,
+		"message": message,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,301 @@
+package grpcutil
+
+import (
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The token service issues and revokes the API tokens of the daemon, its
+// messages are plain protobuf messages:
+//
+//   service TokenService {
+//     rpc TokenIssue (TokenIssue.Request) returns (TokenIssue.Reply);
+//     rpc TokenRevoke (TokenRevoke.Request) returns (TokenRevoke.Reply);
+//     rpc TokenList (TokenList.Request) returns (TokenList.Reply);
+//   }
+//
+//   message TokenInfo {
+//     string id = 1;
+//     string name = 2;
+//     repeated string scopes = 3;
+//     int64 created_at = 4;
+//   }
+//
+// Its methods require the admin scope, whether the daemon enforces the
+// tokens or not.
+
+type TokenInfo struct {
+	ID        string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name      string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Scopes    []string `protobuf:"bytes,3,rep,name=scopes,proto3" json:"scopes,omitempty"`
+	CreatedAt int64    `protobuf:"varint,4,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+}
+
+func (m *TokenInfo) Reset()         { *m = TokenInfo{} }
+func (m *TokenInfo) String() string { return proto.CompactTextString(m) }
+func (*TokenInfo) ProtoMessage()    {}
+
+type TokenIssue_Request struct {
+	Name   string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Scopes []string `protobuf:"bytes,2,rep,name=scopes,proto3" json:"scopes,omitempty"`
+}
+
+func (m *TokenIssue_Request) Reset()         { *m = TokenIssue_Request{} }
+func (m *TokenIssue_Request) String() string { return proto.CompactTextString(m) }
+func (*TokenIssue_Request) ProtoMessage()    {}
+
+type TokenIssue_Reply struct {
+	// Token is the bearer token, it can't be retrieved later
+	Token string     `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	Info  *TokenInfo `protobuf:"bytes,2,opt,name=info,proto3" json:"info,omitempty"`
+}
+
+func (m *TokenIssue_Reply) Reset()         { *m = TokenIssue_Reply{} }
+func (m *TokenIssue_Reply) String() string { return proto.CompactTextString(m) }
+func (*TokenIssue_Reply) ProtoMessage()    {}
+
+type TokenRevoke_Request struct {
+	ID string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (m *TokenRevoke_Request) Reset()         { *m = TokenRevoke_Request{} }
+func (m *TokenRevoke_Request) String() string { return proto.CompactTextString(m) }
+func (*TokenRevoke_Request) ProtoMessage()    {}
+
+type TokenRevoke_Reply struct{}
+
+func (m *TokenRevoke_Reply) Reset()         { *m = TokenRevoke_Reply{} }
+func (m *TokenRevoke_Reply) String() string { return proto.CompactTextString(m) }
+func (*TokenRevoke_Reply) ProtoMessage()    {}
+
+type TokenList_Request struct{}
+
+func (m *TokenList_Request) Reset()         { *m = TokenList_Request{} }
+func (m *TokenList_Request) String() string { return proto.CompactTextString(m) }
+func (*TokenList_Request) ProtoMessage()    {}
+
+type TokenList_Reply struct {
+	Tokens []*TokenInfo `protobuf:"bytes,1,rep,name=tokens,proto3" json:"tokens,omitempty"`
+}
+
+func (m *TokenList_Reply) Reset()         { *m = TokenList_Reply{} }
+func (m *TokenList_Reply) String() string { return proto.CompactTextString(m) }
+func (*TokenList_Reply) ProtoMessage()    {}
+
+func newTokenInfo(t *APIToken) *TokenInfo {
+	scopes := make([]string, len(t.Scopes))
+	for i, s := range t.Scopes {
+		scopes[i] = string(s)
+	}
+
+	return &TokenInfo{ID: t.ID, Name: t.Name, Scopes: scopes, CreatedAt: t.CreatedAt.UnixNano()}
+}
+
+// TokenServiceClient is the client API for TokenService service.
+type TokenServiceClient interface {
+	TokenIssue(ctx context.Context, in *TokenIssue_Request, opts ...grpc.CallOption) (*TokenIssue_Reply, error)
+	TokenRevoke(ctx context.Context, in *TokenRevoke_Request, opts ...grpc.CallOption) (*TokenRevoke_Reply, error)
+	TokenList(ctx context.Context, in *TokenList_Request, opts ...grpc.CallOption) (*TokenList_Reply, error)
+}
+
+type tokenServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewTokenServiceClient(cc *grpc.ClientConn) TokenServiceClient {
+	return &tokenServiceClient{cc}
+}
+
+func (c *tokenServiceClient) TokenIssue(ctx context.Context, in *TokenIssue_Request, opts ...grpc.CallOption) (*TokenIssue_Reply, error) {
+	out := new(TokenIssue_Reply)
+	err := c.cc.Invoke(ctx, "/berty.auth.v1.TokenService/TokenIssue", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tokenServiceClient) TokenRevoke(ctx context.Context, in *TokenRevoke_Request, opts ...grpc.CallOption) (*TokenRevoke_Reply, error) {
+	out := new(TokenRevoke_Reply)
+	err := c.cc.Invoke(ctx, "/berty.auth.v1.TokenService/TokenRevoke", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tokenServiceClient) TokenList(ctx context.Context, in *TokenList_Request, opts ...grpc.CallOption) (*TokenList_Reply, error) {
+	out := new(TokenList_Reply)
+	err := c.cc.Invoke(ctx, "/berty.auth.v1.TokenService/TokenList", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TokenServiceServer is the server API for TokenService service.
+type TokenServiceServer interface {
+	TokenIssue(context.Context, *TokenIssue_Request) (*TokenIssue_Reply, error)
+	TokenRevoke(context.Context, *TokenRevoke_Request) (*TokenRevoke_Reply, error)
+	TokenList(context.Context, *TokenList_Request) (*TokenList_Reply, error)
+}
+
+func RegisterTokenServiceServer(s *grpc.Server, srv TokenServiceServer) {
+	s.RegisterService(&_TokenService_serviceDesc, srv)
+}
+
+func _TokenService_TokenIssue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenIssue_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenServiceServer).TokenIssue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.auth.v1.TokenService/TokenIssue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenServiceServer).TokenIssue(ctx, req.(*TokenIssue_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TokenService_TokenRevoke_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenRevoke_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenServiceServer).TokenRevoke(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.auth.v1.TokenService/TokenRevoke",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenServiceServer).TokenRevoke(ctx, req.(*TokenRevoke_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TokenService_TokenList_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenList_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenServiceServer).TokenList(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.auth.v1.TokenService/TokenList",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenServiceServer).TokenList(ctx, req.(*TokenList_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _TokenService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "berty.auth.v1.TokenService",
+	HandlerType: (*TokenServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "TokenIssue",
+			Handler:    _TokenService_TokenIssue_Handler,
+		},
+		{
+			MethodName: "TokenRevoke",
+			Handler:    _TokenService_TokenRevoke_Handler,
+		},
+		{
+			MethodName: "TokenList",
+			Handler:    _TokenService_TokenList_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+type tokenService struct {
+	auth AuthOpts
+}
+
+// NewTokenService returns the token service of a store.
+func NewTokenService(opts AuthOpts) TokenServiceServer {
+	opts.applyDefaults()
+	return &tokenService{auth: opts}
+}
+
+func (svc *tokenService) checkAdmin(ctx context.Context, method string) error {
+	if t, ok := TokenFromContext(ctx); ok {
+		if !t.Allows(ScopeAdmin) {
+			return status.Error(codes.PermissionDenied, "the API token lacks the admin scope")
+		}
+
+		return nil
+	}
+
+	// the daemon doesn't enforce the tokens
+	_, err := svc.auth.authorize(ctx, method)
+	return err
+}
+
+func (svc *tokenService) TokenIssue(ctx context.Context, req *TokenIssue_Request) (*TokenIssue_Reply, error) {
+	if err := svc.checkAdmin(ctx, "/berty.auth.v1.TokenService/TokenIssue"); err != nil {
+		return nil, err
+	}
+
+	scopes, err := ParseScopes(req.Scopes)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	token, t, err := svc.auth.Tokens.Issue(req.Name, scopes)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	svc.auth.Logger.Info("API token issued", zap.String("id", t.ID), zap.String("name", t.Name))
+
+	return &TokenIssue_Reply{Token: token, Info: newTokenInfo(t)}, nil
+}
+
+func (svc *tokenService) TokenRevoke(ctx context.Context, req *TokenRevoke_Request) (*TokenRevoke_Reply, error) {
+	if err := svc.checkAdmin(ctx, "/berty.auth.v1.TokenService/TokenRevoke"); err != nil {
+		return nil, err
+	}
+
+	if req.ID == RootTokenID {
+		return nil, status.Error(codes.InvalidArgument, "the root token can't be revoked")
+	}
+
+	if err := svc.auth.Tokens.Revoke(req.ID); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	svc.auth.Logger.Info("API token revoked", zap.String("id", req.ID))
+
+	return &TokenRevoke_Reply{}, nil
+}
+
+func (svc *tokenService) TokenList(ctx context.Context, _ *TokenList_Request) (*TokenList_Reply, error) {
+	if err := svc.checkAdmin(ctx, "/berty.auth.v1.TokenService/TokenList"); err != nil {
+		return nil, err
+	}
+
+	tokens := svc.auth.Tokens.List()
+
+	reply := &TokenList_Reply{Tokens: make([]*TokenInfo, len(tokens))}
+	for i, t := range tokens {
+		reply.Tokens[i] = newTokenInfo(t)
+	}
+
+	return reply, nil
+}
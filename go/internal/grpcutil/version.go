@@ -0,0 +1,265 @@
+package grpcutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// APIVersion is the version of the client API, it is increased on each
+	// change the older clients or daemons can't handle
+	APIVersion = 1
+
+	// MinAPIVersion is the oldest version of the client API still supported
+	MinAPIVersion = 1
+)
+
+// The versions are exchanged in the gRPC metadata: the client sends its
+// version with each call, the daemon replies with its version, the oldest
+// version it supports and a deprecation notice if the method is deprecated.
+const (
+	APIVersionKey     = "berty-api-version"
+	APIMinVersionKey  = "berty-api-min-version"
+	APIDeprecationKey = "berty-api-deprecation"
+)
+
+// DeprecatedMethod describes a method the clients should stop calling.
+type DeprecatedMethod struct {
+	// Since is the API version the method got deprecated in
+	Since int
+
+	// Replacement is the full name of the method to call instead, if any
+	Replacement string
+}
+
+func (d DeprecatedMethod) notice(method string) string {
+	notice := fmt.Sprintf("%s is deprecated since API version %d", method, d.Since)
+	if d.Replacement != "" {
+		notice += ", use " + d.Replacement
+	}
+
+	return notice
+}
+
+// VersionOpts configures the version interceptors.
+type VersionOpts struct {
+	Logger *zap.Logger
+
+	// Version and MinVersion default to APIVersion and MinAPIVersion
+	Version    int
+	MinVersion int
+
+	// Deprecated is indexed by the full name of the methods, e.g.
+	// "/berty.protocol.v1.ProtocolService/InstanceExportData", only used by
+	// the server interceptors
+	Deprecated map[string]DeprecatedMethod
+}
+
+func (opts *VersionOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Version == 0 {
+		opts.Version = APIVersion
+	}
+
+	if opts.MinVersion == 0 {
+		opts.MinVersion = MinAPIVersion
+	}
+}
+
+type versionChecker struct {
+	opts VersionOpts
+
+	// the deprecation warnings are logged once by method
+	warned sync.Map
+}
+
+func newVersionChecker(opts VersionOpts) *versionChecker {
+	opts.applyDefaults()
+	return &versionChecker{opts: opts}
+}
+
+func (vc *versionChecker) warnOnce(key, msg string, fields ...zap.Field) {
+	if _, loaded := vc.warned.LoadOrStore(key, struct{}{}); !loaded {
+		vc.opts.Logger.Warn(msg, fields...)
+	}
+}
+
+func mdVersion(md metadata.MD, key string) (int, bool, error) {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return 0, false, nil
+	}
+
+	v, err := strconv.Atoi(values[0])
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s %q", key, values[0])
+	}
+
+	return v, true, nil
+}
+
+// checkClient returns the header of the reply, or an error if the client is
+// too old. The clients without version, e.g. the ones predating the
+// negotiation, are served but warned about.
+func (vc *versionChecker) checkClient(ctx context.Context, method string) (metadata.MD, error) {
+	header := metadata.Pairs(
+		APIVersionKey, strconv.Itoa(vc.opts.Version),
+		APIMinVersionKey, strconv.Itoa(vc.opts.MinVersion),
+	)
+
+	if d, ok := vc.opts.Deprecated[method]; ok {
+		notice := d.notice(method)
+		header.Set(APIDeprecationKey, notice)
+		vc.warnOnce(method, "deprecated method called", zap.String("notice", notice))
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	version, ok, err := mdVersion(md, APIVersionKey)
+	switch {
+	case err != nil:
+		return header, status.Error(codes.InvalidArgument, err.Error())
+	case !ok:
+		vc.warnOnce("", "client without API version, it may not be supported", zap.String("method", method))
+	case version < vc.opts.MinVersion:
+		return header, status.Errorf(codes.FailedPrecondition,
+			"client API version %d is no longer supported, the daemon requires version %d or newer", version, vc.opts.MinVersion)
+	}
+
+	return header, nil
+}
+
+// checkServer returns an error if the daemon is too old or doesn't support
+// the client anymore, according to the header of its reply.
+func (vc *versionChecker) checkServer(method string, header metadata.MD) error {
+	if notices := header.Get(APIDeprecationKey); len(notices) > 0 {
+		vc.warnOnce(method, "deprecated method called", zap.String("notice", notices[0]))
+	}
+
+	version, ok, err := mdVersion(header, APIVersionKey)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// the daemons predating the negotiation can't be checked
+	if !ok {
+		vc.warnOnce("", "daemon without API version, it may not be supported", zap.String("method", method))
+		return nil
+	}
+
+	if version < vc.opts.MinVersion {
+		return status.Errorf(codes.FailedPrecondition,
+			"daemon API version %d is no longer supported, the client requires version %d or newer", version, vc.opts.MinVersion)
+	}
+
+	if min, ok, _ := mdVersion(header, APIMinVersionKey); ok && vc.opts.Version < min {
+		return status.Errorf(codes.FailedPrecondition,
+			"client API version %d is no longer supported, the daemon requires version %d or newer", vc.opts.Version, min)
+	}
+
+	return nil
+}
+
+// VersionUnaryServerInterceptor rejects the calls of the clients older than
+// the minimum version, and signals the deprecated methods.
+func VersionUnaryServerInterceptor(opts VersionOpts) grpc.UnaryServerInterceptor {
+	vc := newVersionChecker(opts)
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		header, err := vc.checkClient(ctx, info.FullMethod)
+		_ = grpc.SetHeader(ctx, header)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// VersionStreamServerInterceptor is the stream counterpart of
+// VersionUnaryServerInterceptor.
+func VersionStreamServerInterceptor(opts VersionOpts) grpc.StreamServerInterceptor {
+	vc := newVersionChecker(opts)
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		header, err := vc.checkClient(ss.Context(), info.FullMethod)
+		_ = ss.SetHeader(header)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+func (vc *versionChecker) outgoingContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, APIVersionKey, strconv.Itoa(vc.opts.Version))
+}
+
+// VersionUnaryClientInterceptor sends the version of the client, and fails
+// the calls to the daemons older than the minimum version.
+func VersionUnaryClientInterceptor(opts VersionOpts) grpc.UnaryClientInterceptor {
+	vc := newVersionChecker(opts)
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		header := metadata.MD{}
+		err := invoker(vc.outgoingContext(ctx), method, req, reply, cc, append(callOpts, grpc.Header(&header))...)
+
+		// a version mismatch explains the other errors
+		if verr := vc.checkServer(method, header); verr != nil && (err == nil || header.Len() > 0) {
+			return verr
+		}
+
+		return err
+	}
+}
+
+// VersionStreamClientInterceptor is the stream counterpart of
+// VersionUnaryClientInterceptor, the version is checked on the first
+// received message.
+func VersionStreamClientInterceptor(opts VersionOpts) grpc.StreamClientInterceptor {
+	vc := newVersionChecker(opts)
+
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(vc.outgoingContext(ctx), desc, cc, method, callOpts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &versionClientStream{ClientStream: cs, checker: vc, method: method}, nil
+	}
+}
+
+type versionClientStream struct {
+	grpc.ClientStream
+
+	checker *versionChecker
+	method  string
+	once    sync.Once
+	err     error
+}
+
+func (s *versionClientStream) RecvMsg(m interface{}) error {
+	s.once.Do(func() {
+		header, err := s.ClientStream.Header()
+		if err == nil {
+			s.err = s.checker.checkServer(s.method, header)
+		}
+	})
+
+	if s.err != nil {
+		return s.err
+	}
+
+	return s.ClientStream.RecvMsg(m)
+}
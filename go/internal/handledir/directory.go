@@ -0,0 +1,263 @@
+package handledir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMaxChainLength is the number of records a handle can have, its
+	// account has to register another handle once it is reached
+	DefaultMaxChainLength = 128
+
+	// DefaultMaxPeerRequests is the number of requests a peer can send in a
+	// DefaultPeerRequestWindow
+	DefaultMaxPeerRequests   = 60
+	DefaultPeerRequestWindow = time.Minute
+)
+
+var handlesKey = ipfs_ds.NewKey("handles")
+
+// DirectoryOpts configures a handle directory.
+type DirectoryOpts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the chains of the handles, in memory if nil
+	Datastore ipfs_ds.Datastore
+
+	MaxChainLength int
+
+	// MaxPeerRequests caps the requests of a peer in a PeerRequestWindow, the
+	// others are refused
+	MaxPeerRequests   int
+	PeerRequestWindow time.Duration
+}
+
+func (opts *DirectoryOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		opts.Datastore = ipfs_ds.NewMapDatastore()
+	}
+
+	if opts.MaxChainLength <= 0 {
+		opts.MaxChainLength = DefaultMaxChainLength
+	}
+
+	if opts.MaxPeerRequests <= 0 {
+		opts.MaxPeerRequests = DefaultMaxPeerRequests
+	}
+
+	if opts.PeerRequestWindow <= 0 {
+		opts.PeerRequestWindow = DefaultPeerRequestWindow
+	}
+}
+
+// Directory serves the chains of the handles registered by the accounts.
+type Directory struct {
+	logger *zap.Logger
+	opts   DirectoryOpts
+	priv   crypto.PrivKey
+
+	muHandles sync.Mutex
+
+	muPeers sync.Mutex
+	peers   map[peer.ID]*peerWindow
+}
+
+type peerWindow struct {
+	start    time.Time
+	requests int
+}
+
+// NewDirectory registers the handle directory protocol on the host, the
+// receipts are signed with the given private key, the one of the host.
+func NewDirectory(h host.Host, priv crypto.PrivKey, opts DirectoryOpts) (*Directory, error) {
+	opts.applyDefaults()
+
+	if priv == nil {
+		return nil, errcode.ErrMissingInput
+	}
+
+	d := &Directory{
+		logger: opts.Logger.Named("handledir"),
+		opts:   opts,
+		priv:   priv,
+		peers:  make(map[peer.ID]*peerWindow),
+	}
+
+	if h != nil {
+		h.SetStreamHandler(ProtocolID, d.handleStream)
+	}
+
+	return d, nil
+}
+
+func (d *Directory) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	pid := stream.Conn().RemotePeer()
+	_ = stream.SetDeadline(time.Now().Add(defaultStreamTimeout))
+
+	req := &request{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxRequestSize)).Decode(req); err != nil {
+		d.logger.Debug("invalid request", zap.Stringer("peer", pid), zap.Error(err))
+		_ = stream.Reset()
+		return
+	}
+
+	res := &response{}
+	var err error
+	switch {
+	case !d.allowPeer(pid, time.Now()):
+		err = errcode.ErrInvalidInput.Wrap(fmt.Errorf("rate limited"))
+	case req.Register != nil:
+		res.Entry, err = d.register(req.Register, time.Now())
+	default:
+		res.Entry, err = d.lookup(req.Lookup)
+	}
+
+	switch {
+	case err == ErrNotFound:
+		res.NotFound = true
+	case err != nil:
+		d.logger.Debug("request refused", zap.Stringer("peer", pid), zap.Error(err))
+		res.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(stream).Encode(res); err != nil {
+		_ = stream.Reset()
+	}
+}
+
+// register appends the record to the chain of its handle, it only returns
+// the receipt of the new head.
+func (d *Directory) register(rec *Record, now time.Time) (*Entry, error) {
+	if normalized, err := NormalizeHandle(rec.Handle); err != nil || normalized != rec.Handle {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid handle %q", rec.Handle))
+	}
+
+	if rec.Timestamp > now.Add(MaxClockSkew).UnixNano() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("record of %q from the future", rec.Handle))
+	}
+
+	d.muHandles.Lock()
+	defer d.muHandles.Unlock()
+
+	chain, err := d.chain(rec.Handle)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	var prev *Record
+	if len(chain) > 0 {
+		prev = chain[len(chain)-1]
+	}
+
+	if err := rec.follows(prev); err != nil {
+		return nil, err
+	}
+
+	if len(chain) >= d.opts.MaxChainLength {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many records for %q", rec.Handle))
+	}
+
+	chain = append(chain, rec)
+
+	data, err := json.Marshal(chain)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := d.opts.Datastore.Put(handlesKey.ChildString(rec.Handle), data); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	receipt, err := newReceipt(d.priv, rec)
+	if err != nil {
+		return nil, err
+	}
+
+	d.logger.Debug("handle registered", zap.String("handle", rec.Handle), zap.Uint64("seq", rec.Seq))
+
+	return &Entry{Receipt: receipt}, nil
+}
+
+func (d *Directory) lookup(handle string) (*Entry, error) {
+	handle, err := NormalizeHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	d.muHandles.Lock()
+	chain, err := d.chain(handle)
+	d.muHandles.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	receipt, err := newReceipt(d.priv, chain[len(chain)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Entry{Chain: chain, Receipt: receipt}, nil
+}
+
+func (d *Directory) chain(handle string) ([]*Record, error) {
+	data, err := d.opts.Datastore.Get(handlesKey.ChildString(handle))
+	if err == ipfs_ds.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	var chain []*Record
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if len(chain) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return chain, nil
+}
+
+func (d *Directory) allowPeer(pid peer.ID, now time.Time) bool {
+	d.muPeers.Lock()
+	defer d.muPeers.Unlock()
+
+	for p, w := range d.peers {
+		if now.Sub(w.start) >= d.opts.PeerRequestWindow {
+			delete(d.peers, p)
+		}
+	}
+
+	w, ok := d.peers[pid]
+	if !ok {
+		w = &peerWindow{start: now}
+		d.peers[pid] = w
+	}
+
+	if w.requests >= d.opts.MaxPeerRequests {
+		return false
+	}
+
+	w.requests++
+
+	return true
+}
@@ -0,0 +1,15 @@
+// Package handledir is an opt-in directory of handles, where the users
+// publish a short name others can look up to send them a contact request
+// instead of scanning a link.
+//
+// A handle maps to the shareable contact of an account, its public key and
+// rendezvous seed, in a record signed by the account. The records of a handle
+// are chained, each one references the hash of the previous one and has to
+// be signed by the same account: the first account to register a handle owns
+// it and the directory can't forge entries, only withhold them. The
+// directory signs a receipt of the head of the chain it serves, two
+// conflicting receipts are the proof it equivocated, and the clients pin the
+// first record of the handles they looked up to notice a swapped chain.
+//
+// The directory can be self-hosted with `berty handle-directory`.
+package handledir
@@ -0,0 +1,431 @@
+package handledir
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+const ProtocolID = protocol.ID("/berty/handle-directory/1.0.0")
+
+const (
+	// MaxMetadataSize is the maximum size of the app metadata of a record
+	MaxMetadataSize = 1 << 10
+
+	// MaxClockSkew is how far in the future the timestamp of a record can be
+	MaxClockSkew = time.Hour
+
+	defaultStreamTimeout = 30 * time.Second
+	maxRequestSize       = 16 << 10
+	maxResponseSize      = 1 << 20
+
+	recordSigningContext  = "berty handle record"
+	receiptSigningContext = "berty handle receipt"
+)
+
+// ErrNotFound is returned when no account registered a handle.
+var ErrNotFound = fmt.Errorf("handle not found")
+
+var handleRegexp = regexp.MustCompile(`^[a-z0-9_.-]{3,32}$`)
+
+// NormalizeHandle returns the canonical form of a handle, lowercase and
+// without its leading @.
+func NormalizeHandle(handle string) (string, error) {
+	normalized := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+	if !handleRegexp.MatchString(normalized) {
+		return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid handle %q, expected 3 to 32 letters, digits, '_', '.' or '-'", handle))
+	}
+
+	return normalized, nil
+}
+
+// Record maps a handle to the shareable contact of an account, it is signed
+// by the account.
+type Record struct {
+	Handle string `json:"handle"`
+
+	// Seq is the position of the record in the chain of the handle, Prev the
+	// hash of the previous record, empty for the first one
+	Seq  uint64 `json:"seq"`
+	Prev []byte `json:"prev,omitempty"`
+
+	AccountPK            []byte `json:"accountPk"`
+	PublicRendezvousSeed []byte `json:"publicRendezvousSeed"`
+	Metadata             []byte `json:"metadata,omitempty"`
+	Timestamp            int64  `json:"timestamp"`
+	Signature            []byte `json:"signature,omitempty"`
+}
+
+// NewRecord returns a record of the handle signed by the account, following
+// prev if the handle is already registered.
+func NewRecord(accountSK crypto.PrivKey, handle string, prev *Record, rdvSeed, metadata []byte) (*Record, error) {
+	handle, err := NormalizeHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	accountPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	rec := &Record{
+		Handle:               handle,
+		AccountPK:            accountPK,
+		PublicRendezvousSeed: rdvSeed,
+		Metadata:             metadata,
+		Timestamp:            time.Now().UnixNano(),
+	}
+
+	if prev != nil {
+		if prev.Handle != handle || !bytes.Equal(prev.AccountPK, accountPK) {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("handle %q owned by another account", handle))
+		}
+
+		if rec.Prev, err = prev.Hash(); err != nil {
+			return nil, err
+		}
+
+		rec.Seq = prev.Seq + 1
+		if rec.Timestamp < prev.Timestamp {
+			rec.Timestamp = prev.Timestamp
+		}
+	}
+
+	data, err := rec.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.Signature, err = accountSK.Sign(data); err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	return rec, nil
+}
+
+func (r *Record) signedBytes() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return append([]byte(recordSigningContext), data...), nil
+}
+
+// Hash identifies the record in the chain of its handle.
+func (r *Record) Hash() ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sum := sha256.Sum256(data)
+
+	return sum[:], nil
+}
+
+// Verify checks the signature of the record by its account.
+func (r *Record) Verify() error {
+	if len(r.Metadata) > MaxMetadataSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("metadata too large: %d bytes", len(r.Metadata)))
+	}
+
+	if len(r.PublicRendezvousSeed) == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no rendezvous seed"))
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(r.AccountPK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+
+	if ok, err := pk.Verify(data, r.Signature); err != nil || !ok {
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid signature of the record %d of %q", r.Seq, r.Handle))
+	}
+
+	return nil
+}
+
+// follows checks that the record can be appended after prev, nil for the
+// first record of a handle.
+func (r *Record) follows(prev *Record) error {
+	if err := r.Verify(); err != nil {
+		return err
+	}
+
+	if prev == nil {
+		if r.Seq != 0 || len(r.Prev) != 0 {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("first record of %q expected", r.Handle))
+		}
+
+		return nil
+	}
+
+	prevHash, err := prev.Hash()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case r.Handle != prev.Handle:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("record of %q in the chain of %q", r.Handle, prev.Handle))
+	case !bytes.Equal(r.AccountPK, prev.AccountPK):
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("handle %q owned by another account", r.Handle))
+	case r.Seq != prev.Seq+1 || !bytes.Equal(r.Prev, prevHash):
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("record %d of %q doesn't follow the record %d", r.Seq, r.Handle, prev.Seq))
+	case r.Timestamp < prev.Timestamp:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("record %d of %q older than the previous one", r.Seq, r.Handle))
+	}
+
+	return nil
+}
+
+// VerifyChain checks that the records are the chain of the handle, from its
+// first record.
+func VerifyChain(handle string, chain []*Record) error {
+	if len(chain) == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("empty chain"))
+	}
+
+	var prev *Record
+	for _, rec := range chain {
+		if rec == nil || rec.Handle != handle {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("record of another handle in the chain of %q", handle))
+		}
+
+		if err := rec.follows(prev); err != nil {
+			return err
+		}
+
+		prev = rec
+	}
+
+	return nil
+}
+
+// Receipt is the head of the chain of a handle served by a directory, signed
+// by it.
+type Receipt struct {
+	Handle    string `json:"handle"`
+	Seq       uint64 `json:"seq"`
+	Head      []byte `json:"head"`
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+func newReceipt(priv crypto.PrivKey, head *Record) (*Receipt, error) {
+	hash, err := head.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &Receipt{
+		Handle:    head.Handle,
+		Seq:       head.Seq,
+		Head:      hash,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	data, err := receipt.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if receipt.Signature, err = priv.Sign(data); err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	return receipt, nil
+}
+
+func (r *Receipt) signedBytes() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return append([]byte(receiptSigningContext), data...), nil
+}
+
+// Verify checks that the receipt was signed by the key of the directory and
+// is the one of the head of the chain.
+func (r *Receipt) Verify(directoryPK crypto.PubKey, head *Record) error {
+	if directoryPK == nil {
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("unknown key of the directory"))
+	}
+
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+
+	if ok, err := directoryPK.Verify(data, r.Signature); err != nil || !ok {
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("receipt of %q not signed by the directory", r.Handle))
+	}
+
+	hash, err := head.Hash()
+	if err != nil {
+		return err
+	}
+
+	if r.Handle != head.Handle || r.Seq != head.Seq || !bytes.Equal(r.Head, hash) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("receipt of %q doesn't match the head of its chain", r.Handle))
+	}
+
+	return nil
+}
+
+// Conflicting reports whether two receipts of a directory are for different
+// records at the same position of a handle, the proof the directory served
+// diverging chains.
+func Conflicting(a, b *Receipt) bool {
+	return a.Handle == b.Handle && a.Seq == b.Seq && !bytes.Equal(a.Head, b.Head)
+}
+
+// Entry is the chain of a handle with the receipt of its head.
+type Entry struct {
+	Chain   []*Record `json:"chain"`
+	Receipt *Receipt  `json:"receipt"`
+}
+
+// Head returns the latest record of the handle.
+func (e *Entry) Head() *Record {
+	return e.Chain[len(e.Chain)-1]
+}
+
+type request struct {
+	// Register is set to register a record, the others look up a handle
+	Register *Record `json:"register,omitempty"`
+	Lookup   string  `json:"lookup,omitempty"`
+}
+
+type response struct {
+	Entry    *Entry `json:"entry,omitempty"`
+	Error    string `json:"error,omitempty"`
+	NotFound bool   `json:"notFound,omitempty"`
+}
+
+// Register publishes a record on a directory, it returns the receipt of the
+// directory once it is the head of its handle.
+func Register(ctx context.Context, h host.Host, directory peer.AddrInfo, rec *Record) (*Receipt, error) {
+	if rec == nil {
+		return nil, errcode.ErrMissingInput
+	}
+
+	res, err := roundTrip(ctx, h, directory, &request{Register: rec})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Entry == nil || res.Entry.Receipt == nil {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("no receipt"))
+	}
+
+	if err := res.Entry.Receipt.Verify(directoryKey(h, directory.ID), rec); err != nil {
+		return nil, err
+	}
+
+	return res.Entry.Receipt, nil
+}
+
+// Lookup returns the chain of a handle from a directory, verified up to the
+// receipt of its head. It returns ErrNotFound if the handle isn't
+// registered.
+func Lookup(ctx context.Context, h host.Host, directory peer.AddrInfo, handle string) (*Entry, error) {
+	handle, err := NormalizeHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := roundTrip(ctx, h, directory, &request{Lookup: handle})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Entry == nil || res.Entry.Receipt == nil {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("no entry"))
+	}
+
+	if err := VerifyChain(handle, res.Entry.Chain); err != nil {
+		return nil, err
+	}
+
+	if err := res.Entry.Receipt.Verify(directoryKey(h, directory.ID), res.Entry.Head()); err != nil {
+		return nil, err
+	}
+
+	return res.Entry, nil
+}
+
+// directoryKey returns the key of the directory, embedded in its peer ID or
+// learned by the host during the handshake.
+func directoryKey(h host.Host, directory peer.ID) crypto.PubKey {
+	if pk, err := directory.ExtractPublicKey(); err == nil {
+		return pk
+	}
+
+	return h.Peerstore().PubKey(directory)
+}
+
+func roundTrip(ctx context.Context, h host.Host, directory peer.AddrInfo, req *request) (*response, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultStreamTimeout)
+	defer cancel()
+
+	if err := h.Connect(ctx, directory); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	stream, err := h.NewStream(ctx, directory.ID, ProtocolID)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(stream).Encode(req); err != nil {
+		_ = stream.Reset()
+		return nil, errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	res := &response{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxResponseSize)).Decode(res); err != nil {
+		_ = stream.Reset()
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	switch {
+	case res.NotFound:
+		return nil, ErrNotFound
+	case res.Error != "":
+		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("handle directory: %s", res.Error))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,164 @@
+package handledir
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+
+	sk, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	return sk
+}
+
+func TestNormalizeHandle(t *testing.T) {
+	for handle, expected := range map[string]string{
+		"alice":       "alice",
+		"@Alice":      "alice",
+		" bob.smith ": "bob.smith",
+		"a_b-c":       "a_b-c",
+		"ab":          "",
+		"al ice":      "",
+		"émile":       "",
+		"@":           "",
+	} {
+		normalized, err := NormalizeHandle(handle)
+		if expected == "" {
+			assert.Error(t, err, handle)
+			continue
+		}
+
+		require.NoError(t, err, handle)
+		assert.Equal(t, expected, normalized)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	alice, mallory := newTestKey(t), newTestKey(t)
+
+	first, err := NewRecord(alice, "@Alice", nil, []byte("seed 1"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", first.Handle)
+
+	second, err := NewRecord(alice, "alice", first, []byte("seed 2"), []byte("metadata"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), second.Seq)
+
+	require.NoError(t, VerifyChain("alice", []*Record{first}))
+	require.NoError(t, VerifyChain("alice", []*Record{first, second}))
+	assert.Error(t, VerifyChain("alice", nil))
+	assert.Error(t, VerifyChain("bob", []*Record{first}))
+	assert.Error(t, VerifyChain("alice", []*Record{second}))
+	assert.Error(t, VerifyChain("alice", []*Record{second, first}))
+
+	// another account can't extend the chain
+	_, err = NewRecord(mallory, "alice", second, []byte("seed"), nil)
+	assert.Error(t, err)
+
+	forged := *second
+	forged.AccountPK = first.AccountPK
+	forged.PublicRendezvousSeed = []byte("forged seed")
+	assert.Error(t, VerifyChain("alice", []*Record{first, &forged}))
+
+	hijacked, err := NewRecord(mallory, "alice", nil, []byte("seed"), nil)
+	require.NoError(t, err)
+	hijacked.Seq, hijacked.Prev = second.Seq, second.Prev
+	assert.Error(t, VerifyChain("alice", []*Record{first, hijacked}))
+}
+
+func TestReceipt(t *testing.T) {
+	dirSK, alice := newTestKey(t), newTestKey(t)
+	dirPK := dirSK.GetPublic()
+
+	rec, err := NewRecord(alice, "alice", nil, []byte("seed"), nil)
+	require.NoError(t, err)
+
+	receipt, err := newReceipt(dirSK, rec)
+	require.NoError(t, err)
+	require.NoError(t, receipt.Verify(dirPK, rec))
+	assert.Error(t, receipt.Verify(alice.GetPublic(), rec))
+
+	other, err := NewRecord(alice, "alice", nil, []byte("other seed"), nil)
+	require.NoError(t, err)
+	assert.Error(t, receipt.Verify(dirPK, other))
+
+	// two heads at the same position prove the directory forked the chain
+	otherReceipt, err := newReceipt(dirSK, other)
+	require.NoError(t, err)
+	assert.True(t, Conflicting(receipt, otherReceipt))
+	assert.False(t, Conflicting(receipt, receipt))
+}
+
+func TestDirectory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+
+	dirSK := newTestKey(t)
+
+	// the receipts are verified with the key embedded in the ed25519 peer IDs
+	dirHost, err := mn.AddPeer(dirSK, ma.StringCast("/ip4/127.0.0.1/tcp/4242"))
+	require.NoError(t, err)
+
+	client, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	d, err := NewDirectory(dirHost, dirSK, DirectoryOpts{MaxChainLength: 2})
+	require.NoError(t, err)
+
+	dir := peer.AddrInfo{ID: dirHost.ID(), Addrs: dirHost.Addrs()}
+	alice, bob := newTestKey(t), newTestKey(t)
+
+	_, err = Lookup(ctx, client, dir, "alice")
+	assert.Equal(t, ErrNotFound, err)
+
+	first, err := NewRecord(alice, "alice", nil, []byte("seed 1"), nil)
+	require.NoError(t, err)
+
+	receipt, err := Register(ctx, client, dir, first)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), receipt.Seq)
+
+	// the handle is taken
+	taken, err := NewRecord(bob, "alice", nil, []byte("seed"), nil)
+	require.NoError(t, err)
+	_, err = Register(ctx, client, dir, taken)
+	assert.Error(t, err)
+
+	second, err := NewRecord(alice, "alice", first, []byte("seed 2"), nil)
+	require.NoError(t, err)
+	_, err = Register(ctx, client, dir, second)
+	require.NoError(t, err)
+
+	entry, err := Lookup(ctx, client, dir, "@ALICE")
+	require.NoError(t, err)
+	require.Len(t, entry.Chain, 2)
+	assert.Equal(t, []byte("seed 2"), entry.Head().PublicRendezvousSeed)
+
+	third, err := NewRecord(alice, "alice", second, []byte("seed 3"), nil)
+	require.NoError(t, err)
+	_, err = Register(ctx, client, dir, third)
+	assert.Error(t, err)
+
+	_, err = d.register(&Record{Handle: "Alice"}, time.Now())
+	assert.Error(t, err)
+
+	future, err := NewRecord(bob, "bob", nil, []byte("seed"), nil)
+	require.NoError(t, err)
+	_, err = d.register(future, time.Now().Add(-2*MaxClockSkew))
+	assert.Error(t, err)
+}
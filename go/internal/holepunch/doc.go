@@ -0,0 +1,5 @@
+// Package holepunch upgrades the relayed connections to direct ones: the
+// peers exchange their observed addrs through the relay, then dial each other
+// at the same time to open their NATs. The relayed connection is kept if the
+// hole punching fails.
+package holepunch
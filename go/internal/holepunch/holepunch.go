@@ -0,0 +1,354 @@
+package holepunch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"go.uber.org/zap"
+)
+
+const ProtocolID = protocol.ID("/berty/holepunch/1.0.0")
+
+const (
+	// DefaultPunchTimeout is the timeout of the simultaneous dials
+	DefaultPunchTimeout = 5 * time.Second
+
+	// DefaultRetryDelay is the minimum delay between two upgrade attempts
+	// with the same peer
+	DefaultRetryDelay = 10 * time.Minute
+
+	defaultNegotiationTimeout = 30 * time.Second
+)
+
+const (
+	msgConnect = "connect"
+	msgSync    = "sync"
+)
+
+// message is exchanged through the relay, the connect messages carry the
+// direct addrs of the peers.
+type message struct {
+	Type  string   `json:"type"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// Opts contains the configuration of the hole punching service.
+type Opts struct {
+	Logger       *zap.Logger
+	PunchTimeout time.Duration
+	RetryDelay   time.Duration
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.PunchTimeout <= 0 {
+		opts.PunchTimeout = DefaultPunchTimeout
+	}
+
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = DefaultRetryDelay
+	}
+}
+
+// Service upgrades the relayed connections dialed by the local peer, and
+// answers the upgrade requests of the remote peers.
+type Service struct {
+	host   host.Host
+	logger *zap.Logger
+	opts   Opts
+
+	muAttempts sync.Mutex
+	attempts   map[peer.ID]time.Time
+}
+
+// New registers the hole punching protocol on the host.
+func New(h host.Host, opts Opts) *Service {
+	opts.applyDefaults()
+
+	s := &Service{
+		host:     h,
+		logger:   opts.Logger.Named("holepunch"),
+		opts:     opts,
+		attempts: make(map[peer.ID]time.Time),
+	}
+
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			// only the dialer of the relayed connection starts the upgrade
+			if isRelayedAddr(c.RemoteMultiaddr()) && c.Stat().Direction == network.DirOutbound {
+				go s.upgrade(c.RemotePeer())
+			}
+		},
+	})
+
+	return s
+}
+
+func isRelayedAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// directAddrs filters the public addrs that aren't relayed, they include the
+// addrs observed by the other peers.
+func directAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	direct := []ma.Multiaddr{}
+	for _, addr := range addrs {
+		if !isRelayedAddr(addr) && manet.IsPublicAddr(addr) {
+			direct = append(direct, addr)
+		}
+	}
+
+	return direct
+}
+
+func (s *Service) hasDirectConn(pid peer.ID) bool {
+	for _, c := range s.host.Network().ConnsToPeer(pid) {
+		if !isRelayedAddr(c.RemoteMultiaddr()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Service) shouldAttempt(pid peer.ID) bool {
+	s.muAttempts.Lock()
+	defer s.muAttempts.Unlock()
+
+	if last, ok := s.attempts[pid]; ok && time.Since(last) < s.opts.RetryDelay {
+		return false
+	}
+
+	s.attempts[pid] = time.Now()
+
+	return true
+}
+
+func (s *Service) upgrade(pid peer.ID) {
+	if s.hasDirectConn(pid) || !s.shouldAttempt(pid) {
+		return
+	}
+
+	logger := s.logger.With(zap.Stringer("peer", pid))
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultNegotiationTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(network.WithNoDial(ctx, "holepunch"), pid, ProtocolID)
+	if err != nil {
+		logger.Debug("unable to open stream", zap.Error(err))
+		return
+	}
+	defer stream.Close()
+
+	remoteAddrs, rtt, err := initiate(stream, directAddrs(s.host.Addrs()))
+	if err != nil {
+		logger.Debug("negotiation failed", zap.Error(err))
+		_ = stream.Reset()
+		return
+	}
+
+	if len(remoteAddrs) == 0 {
+		logger.Debug("no direct addrs to punch")
+		return
+	}
+
+	// the remote peer dials as soon as it receives the sync message
+	time.Sleep(rtt / 2)
+
+	if !s.punch(ctx, pid, remoteAddrs) {
+		logger.Debug("hole punching failed, staying on the relay")
+		return
+	}
+
+	// the host reuses the relayed connection as long as it's open, the
+	// direct one is dialed while the NATs are open
+	for _, c := range s.host.Network().ConnsToPeer(pid) {
+		if isRelayedAddr(c.RemoteMultiaddr()) {
+			_ = c.Close()
+		}
+	}
+
+	if err := s.host.Connect(ctx, peer.AddrInfo{ID: pid, Addrs: remoteAddrs}); err != nil {
+		logger.Debug("direct connection failed, falling back to the relay", zap.Error(err))
+
+		if err := s.host.Connect(ctx, peer.AddrInfo{ID: pid}); err != nil {
+			logger.Warn("unable to reconnect through the relay", zap.Error(err))
+		}
+
+		return
+	}
+
+	logger.Info("relayed connection upgraded", zap.Duration("rtt", rtt))
+}
+
+func (s *Service) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	pid := stream.Conn().RemotePeer()
+	if !isRelayedAddr(stream.Conn().RemoteMultiaddr()) {
+		_ = stream.Reset()
+		return
+	}
+
+	_ = stream.SetDeadline(time.Now().Add(defaultNegotiationTimeout))
+
+	remoteAddrs, err := respond(stream, directAddrs(s.host.Addrs()))
+	if err != nil {
+		s.logger.Debug("negotiation failed", zap.Stringer("peer", pid), zap.Error(err))
+		_ = stream.Reset()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultNegotiationTimeout)
+	defer cancel()
+
+	s.punch(ctx, pid, remoteAddrs)
+}
+
+// punch dials the addrs at the same time, each dial opens the local NAT
+// for the dials of the remote peer. It returns true if a dial succeeded, the
+// connections are closed since they aren't managed by the host.
+func (s *Service) punch(ctx context.Context, pid peer.ID, addrs []ma.Multiaddr) bool {
+	dialer, ok := s.host.Network().(interface {
+		TransportForDialing(ma.Multiaddr) tpt.Transport
+	})
+	if !ok {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.PunchTimeout)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		muPunch sync.Mutex
+		punched bool
+	)
+
+	for _, addr := range addrs {
+		t := dialer.TransportForDialing(addr)
+		if t == nil || !t.CanDial(addr) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(t tpt.Transport, addr ma.Multiaddr) {
+			defer wg.Done()
+
+			c, err := t.Dial(ctx, addr, pid)
+			if err != nil {
+				return
+			}
+
+			_ = c.Close()
+
+			muPunch.Lock()
+			punched = true
+			muPunch.Unlock()
+		}(t, addr)
+	}
+
+	wg.Wait()
+
+	return punched
+}
+
+// initiate sends the local addrs and reads the remote ones, then sends the
+// sync message. It returns the remote addrs and the round trip time.
+func initiate(rw io.ReadWriter, local []ma.Multiaddr) ([]ma.Multiaddr, time.Duration, error) {
+	enc, dec := json.NewEncoder(rw), json.NewDecoder(rw)
+
+	start := time.Now()
+	if err := enc.Encode(&message{Type: msgConnect, Addrs: addrsToStrings(local)}); err != nil {
+		return nil, 0, errcode.ErrSerialization.Wrap(err)
+	}
+
+	reply := message{}
+	if err := dec.Decode(&reply); err != nil {
+		return nil, 0, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	rtt := time.Since(start)
+
+	if reply.Type != msgConnect {
+		return nil, 0, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unexpected message %q", reply.Type))
+	}
+
+	if err := enc.Encode(&message{Type: msgSync}); err != nil {
+		return nil, 0, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return stringsToAddrs(reply.Addrs), rtt, nil
+}
+
+// respond reads the remote addrs and replies with the local ones, it returns
+// once the sync message is received.
+func respond(rw io.ReadWriter, local []ma.Multiaddr) ([]ma.Multiaddr, error) {
+	enc, dec := json.NewEncoder(rw), json.NewDecoder(rw)
+
+	req := message{}
+	if err := dec.Decode(&req); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if req.Type != msgConnect {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unexpected message %q", req.Type))
+	}
+
+	if err := enc.Encode(&message{Type: msgConnect, Addrs: addrsToStrings(local)}); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	next := message{}
+	if err := dec.Decode(&next); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if next.Type != msgSync {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unexpected message %q", next.Type))
+	}
+
+	return stringsToAddrs(req.Addrs), nil
+}
+
+func addrsToStrings(addrs []ma.Multiaddr) []string {
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+
+	return strs
+}
+
+// stringsToAddrs skips the invalid and the relayed addrs.
+func stringsToAddrs(strs []string) []ma.Multiaddr {
+	addrs := []ma.Multiaddr{}
+	for _, str := range strs {
+		addr, err := ma.NewMultiaddr(str)
+		if err != nil || isRelayedAddr(addr) {
+			continue
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
@@ -0,0 +1,52 @@
+package holepunch
+
+import (
+	"net"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiation(t *testing.T) {
+	initiatorAddrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/udp/4242/quic")}
+	responderAddrs := []ma.Multiaddr{
+		ma.StringCast("/ip4/5.6.7.8/tcp/4242"),
+		// relayed addrs are never punched
+		ma.StringCast("/ip4/9.9.9.9/tcp/4001/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC/p2p-circuit"),
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	done := make(chan []ma.Multiaddr)
+	go func() {
+		addrs, err := respond(c2, responderAddrs)
+		assert.NoError(t, err)
+		done <- addrs
+	}()
+
+	addrs, rtt, err := initiate(c1, initiatorAddrs)
+	require.NoError(t, err)
+	assert.True(t, rtt > 0)
+	require.Len(t, addrs, 1)
+	assert.True(t, addrs[0].Equal(responderAddrs[0]))
+
+	addrs = <-done
+	require.Len(t, addrs, 1)
+	assert.True(t, addrs[0].Equal(initiatorAddrs[0]))
+}
+
+func TestDirectAddrs(t *testing.T) {
+	addrs := directAddrs([]ma.Multiaddr{
+		ma.StringCast("/ip4/127.0.0.1/tcp/4242"),
+		ma.StringCast("/ip4/192.168.1.2/tcp/4242"),
+		ma.StringCast("/ip4/5.6.7.8/tcp/4242"),
+		ma.StringCast("/ip4/9.9.9.9/tcp/4001/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC/p2p-circuit"),
+	})
+
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "/ip4/5.6.7.8/tcp/4242", addrs[0].String())
+}
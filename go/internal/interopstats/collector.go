@@ -0,0 +1,221 @@
+package interopstats
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const (
+	// DefaultEpsilon is the privacy budget of a report
+	DefaultEpsilon = 1.0
+
+	// DefaultMaxDials caps the dials of a transport counted in a report, it
+	// bounds the contribution of a device
+	DefaultMaxDials = 100
+
+	// DefaultMaxLatency caps the delivery latencies counted in a report
+	DefaultMaxLatency = time.Minute
+
+	// maxLatencySamples caps the latencies kept between two reports
+	maxLatencySamples = 1000
+)
+
+// DefaultTransports are the transports dialed through the dial scheduler of
+// ipfsutil, the others aren't observed.
+var DefaultTransports = []string{"MC", "Wi-Fi", "Tor"}
+
+// TransportStats are the noised dial counts of a transport.
+type TransportStats struct {
+	Attempts  float64 `json:"attempts"`
+	Successes float64 `json:"successes"`
+}
+
+// Report is the noised stats of a device over a period, nothing in it
+// identifies the device.
+type Report struct {
+	Transports map[string]TransportStats `json:"transports"`
+
+	// MedianLatency is the noised median delivery latency in ms, it is
+	// negative if no message was delivered
+	MedianLatency float64 `json:"medianLatency"`
+}
+
+// CollectorOpts configures a stats collector.
+type CollectorOpts struct {
+	// Transports are the transports reported, the set is fixed so the
+	// reports don't reveal the transports used by the device
+	Transports []string
+
+	// Epsilon is the privacy budget of a report, it's split between the
+	// released values
+	Epsilon float64
+
+	MaxDials   int
+	MaxLatency time.Duration
+}
+
+func (opts *CollectorOpts) applyDefaults() {
+	if len(opts.Transports) == 0 {
+		opts.Transports = DefaultTransports
+	}
+
+	if opts.Epsilon <= 0 {
+		opts.Epsilon = DefaultEpsilon
+	}
+
+	if opts.MaxDials <= 0 {
+		opts.MaxDials = DefaultMaxDials
+	}
+
+	if opts.MaxLatency <= 0 {
+		opts.MaxLatency = DefaultMaxLatency
+	}
+}
+
+type dialCounts struct {
+	attempts  int
+	successes int
+}
+
+// Collector records the dials and the deliveries of the device until the next
+// report.
+type Collector struct {
+	opts CollectorOpts
+
+	muStats   sync.Mutex
+	dials     map[string]*dialCounts
+	latencies []time.Duration
+}
+
+func NewCollector(opts CollectorOpts) *Collector {
+	opts.applyDefaults()
+
+	return &Collector{
+		opts:  opts,
+		dials: newDialCounts(opts.Transports),
+	}
+}
+
+func newDialCounts(transports []string) map[string]*dialCounts {
+	dials := make(map[string]*dialCounts, len(transports))
+	for _, transport := range transports {
+		dials[transport] = &dialCounts{}
+	}
+
+	return dials
+}
+
+// RecordDial records the outcome of a dial of the given transport, the
+// transports which aren't reported are ignored.
+func (c *Collector) RecordDial(transport string, err error) {
+	c.muStats.Lock()
+	defer c.muStats.Unlock()
+
+	counts, ok := c.dials[transport]
+	if !ok || counts.attempts >= c.opts.MaxDials {
+		return
+	}
+
+	counts.attempts++
+	if err == nil {
+		counts.successes++
+	}
+}
+
+// RecordDelivery records the latency of a delivered message.
+func (c *Collector) RecordDelivery(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+
+	if latency > c.opts.MaxLatency {
+		latency = c.opts.MaxLatency
+	}
+
+	c.muStats.Lock()
+	defer c.muStats.Unlock()
+
+	if len(c.latencies) < maxLatencySamples {
+		c.latencies = append(c.latencies, latency)
+	}
+}
+
+// Report returns the noised stats recorded since the previous report, and
+// resets them.
+func (c *Collector) Report() (*Report, error) {
+	c.muStats.Lock()
+	dials, latencies := c.dials, c.latencies
+	c.dials, c.latencies = newDialCounts(c.opts.Transports), nil
+	c.muStats.Unlock()
+
+	// two counts by transport and the median
+	epsilon := c.opts.Epsilon / float64(2*len(dials)+1)
+	dialScale := float64(c.opts.MaxDials) / epsilon
+
+	report := &Report{
+		Transports:    make(map[string]TransportStats, len(dials)),
+		MedianLatency: -1,
+	}
+
+	for transport, counts := range dials {
+		attemptsNoise, err := laplace(dialScale)
+		if err != nil {
+			return nil, err
+		}
+
+		successesNoise, err := laplace(dialScale)
+		if err != nil {
+			return nil, err
+		}
+
+		report.Transports[transport] = TransportStats{
+			Attempts:  float64(counts.attempts) + attemptsNoise,
+			Successes: float64(counts.successes) + successesNoise,
+		}
+	}
+
+	if len(latencies) > 0 {
+		maxLatency := float64(c.opts.MaxLatency.Milliseconds())
+
+		noise, err := laplace(maxLatency / epsilon)
+		if err != nil {
+			return nil, err
+		}
+
+		noised := float64(median(latencies).Milliseconds()) + noise
+		report.MedianLatency = math.Max(0, math.Min(noised, maxLatency))
+	}
+
+	return report, nil
+}
+
+func median(durations []time.Duration) time.Duration {
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[len(sorted)/2]
+}
+
+// laplace draws from a centered Laplace distribution, the noise is drawn from
+// crypto/rand so it can't be predicted and removed.
+func laplace(scale float64) (float64, error) {
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		return 0, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	// uniform in (-0.5, 0.5)
+	u := (float64(binary.BigEndian.Uint64(buf[:])>>11)+0.5)/(1<<53) - 0.5
+
+	if u < 0 {
+		return scale * math.Log(1+2*u), nil
+	}
+
+	return -scale * math.Log(1-2*u), nil
+}
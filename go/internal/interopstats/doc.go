@@ -0,0 +1,8 @@
+// Package interopstats reports the interoperability of the network to the
+// operators of the community relays: the success rate of the dials of each
+// transport and the median delivery latency of the messages.
+//
+// The reports are opt-in, and noised on the device with the Laplace mechanism
+// before being sent: a report is differentially private on its own, the
+// operators only learn something from the aggregate of many reports.
+package interopstats
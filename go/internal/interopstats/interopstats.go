@@ -0,0 +1,293 @@
+package interopstats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const ProtocolID = protocol.ID("/berty/interopstats/1.0.0")
+
+const (
+	// DefaultReportInterval is the delay between two reports of a device
+	DefaultReportInterval = time.Hour
+
+	// DefaultMinReportInterval is the minimum delay between two reports of
+	// the same peer accepted by an aggregator
+	DefaultMinReportInterval = 10 * time.Minute
+
+	defaultStreamTimeout = 30 * time.Second
+	maxReportSize        = 64 << 10
+	maxReportTransports  = 16
+)
+
+// PublisherOpts configures a stats publisher.
+type PublisherOpts struct {
+	Logger *zap.Logger
+
+	// Interval is the delay between two reports
+	Interval time.Duration
+}
+
+func (opts *PublisherOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultReportInterval
+	}
+}
+
+// Publisher sends the reports of a collector to the connected peers serving
+// the stats protocol, e.g. the community relays. The report of a period is
+// discarded if no such peer is connected.
+type Publisher struct {
+	host      host.Host
+	collector *Collector
+	logger    *zap.Logger
+	opts      PublisherOpts
+}
+
+func NewPublisher(h host.Host, collector *Collector, opts PublisherOpts) *Publisher {
+	opts.applyDefaults()
+
+	return &Publisher{
+		host:      h,
+		collector: collector,
+		logger:    opts.Logger.Named("interopstats"),
+		opts:      opts,
+	}
+}
+
+// Start sends a report every interval until the context is done.
+func (p *Publisher) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.publish(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (p *Publisher) aggregators() []peer.ID {
+	aggregators := []peer.ID{}
+	for _, pid := range p.host.Network().Peers() {
+		if protos, err := p.host.Peerstore().SupportsProtocols(pid, string(ProtocolID)); err == nil && len(protos) > 0 {
+			aggregators = append(aggregators, pid)
+		}
+	}
+
+	return aggregators
+}
+
+func (p *Publisher) publish(ctx context.Context) {
+	report, err := p.collector.Report()
+	if err != nil {
+		p.logger.Error("unable to noise report", zap.Error(err))
+		return
+	}
+
+	// the same report is sent to every aggregator, it doesn't spend more of
+	// the privacy budget
+	for _, pid := range p.aggregators() {
+		if err := p.send(ctx, pid, report); err != nil {
+			p.logger.Debug("unable to send report", zap.Stringer("peer", pid), zap.Error(err))
+		}
+	}
+}
+
+func (p *Publisher) send(ctx context.Context, pid peer.ID, report *Report) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultStreamTimeout)
+	defer cancel()
+
+	stream, err := p.host.NewStream(network.WithNoDial(ctx, "interopstats"), pid, ProtocolID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := json.NewEncoder(stream).Encode(report); err != nil {
+		_ = stream.Reset()
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return nil
+}
+
+// AggregatorOpts configures a stats aggregator.
+type AggregatorOpts struct {
+	Logger *zap.Logger
+
+	// MinReportInterval is the minimum delay between two reports of the same
+	// peer, the others are dropped
+	MinReportInterval time.Duration
+}
+
+func (opts *AggregatorOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.MinReportInterval <= 0 {
+		opts.MinReportInterval = DefaultMinReportInterval
+	}
+}
+
+// TransportSummary are the aggregated dial counts of a transport.
+type TransportSummary struct {
+	Attempts    float64 `json:"attempts"`
+	Successes   float64 `json:"successes"`
+	SuccessRate float64 `json:"successRate"`
+}
+
+// Summary is the aggregate of the received reports.
+type Summary struct {
+	Reports    int                         `json:"reports"`
+	Transports map[string]TransportSummary `json:"transports"`
+
+	// MedianLatency is the median of the reported median latencies in ms, it
+	// is negative if none was reported
+	MedianLatency float64 `json:"medianLatency"`
+}
+
+// Aggregator collects the reports of the peers, e.g. on a community relay.
+type Aggregator struct {
+	logger *zap.Logger
+	opts   AggregatorOpts
+
+	muReports   sync.Mutex
+	reports     int
+	transports  map[string]*TransportSummary
+	latencies   []float64
+	lastReports map[peer.ID]time.Time
+}
+
+// NewAggregator registers the stats protocol on the host.
+func NewAggregator(h host.Host, opts AggregatorOpts) *Aggregator {
+	opts.applyDefaults()
+
+	a := &Aggregator{
+		logger:      opts.Logger.Named("interopstats"),
+		opts:        opts,
+		transports:  make(map[string]*TransportSummary),
+		lastReports: make(map[peer.ID]time.Time),
+	}
+
+	h.SetStreamHandler(ProtocolID, a.handleStream)
+
+	return a
+}
+
+func (a *Aggregator) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	pid := stream.Conn().RemotePeer()
+	_ = stream.SetDeadline(time.Now().Add(defaultStreamTimeout))
+
+	report := &Report{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxReportSize)).Decode(report); err != nil {
+		a.logger.Debug("invalid report", zap.Stringer("peer", pid), zap.Error(err))
+		_ = stream.Reset()
+		return
+	}
+
+	if err := a.add(pid, report); err != nil {
+		a.logger.Debug("report dropped", zap.Stringer("peer", pid), zap.Error(err))
+	}
+}
+
+func (a *Aggregator) add(pid peer.ID, report *Report) error {
+	a.muReports.Lock()
+	defer a.muReports.Unlock()
+
+	if len(report.Transports) > maxReportTransports {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many transports: %d", len(report.Transports)))
+	}
+
+	now := time.Now()
+	if last, ok := a.lastReports[pid]; ok && now.Sub(last) < a.opts.MinReportInterval {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("reported %s ago", now.Sub(last).Round(time.Second)))
+	}
+
+	// the peers are only kept to rate limit their reports
+	for p, last := range a.lastReports {
+		if now.Sub(last) >= a.opts.MinReportInterval {
+			delete(a.lastReports, p)
+		}
+	}
+
+	a.lastReports[pid] = now
+	a.reports++
+
+	for transport, stats := range report.Transports {
+		summary, ok := a.transports[transport]
+		if !ok {
+			summary = &TransportSummary{}
+			a.transports[transport] = summary
+		}
+
+		summary.Attempts += stats.Attempts
+		summary.Successes += stats.Successes
+	}
+
+	if report.MedianLatency >= 0 && len(a.latencies) < maxLatencySamples {
+		a.latencies = append(a.latencies, report.MedianLatency)
+	}
+
+	return nil
+}
+
+// Summary returns the aggregate of the reports received so far. The noise of
+// each report cancels out as reports add up, the aggregate of a few reports is
+// meaningless.
+func (a *Aggregator) Summary() *Summary {
+	a.muReports.Lock()
+	defer a.muReports.Unlock()
+
+	summary := &Summary{
+		Reports:       a.reports,
+		Transports:    make(map[string]TransportSummary, len(a.transports)),
+		MedianLatency: -1,
+	}
+
+	for transport, stats := range a.transports {
+		s := *stats
+		if s.Attempts > 0 {
+			s.SuccessRate = s.Successes / s.Attempts
+			if s.SuccessRate < 0 {
+				s.SuccessRate = 0
+			} else if s.SuccessRate > 1 {
+				s.SuccessRate = 1
+			}
+		}
+
+		summary.Transports[transport] = s
+	}
+
+	if len(a.latencies) > 0 {
+		sorted := append([]float64{}, a.latencies...)
+		sort.Float64s(sorted)
+		summary.MedianLatency = sorted[len(sorted)/2]
+	}
+
+	return summary
+}
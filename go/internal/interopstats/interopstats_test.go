@@ -0,0 +1,97 @@
+package interopstats
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportTransports(t *testing.T) {
+	c := NewCollector(CollectorOpts{})
+	c.RecordDial("MC", nil)
+	c.RecordDial("unknown", nil)
+
+	report, err := c.Report()
+	require.NoError(t, err)
+
+	// every reported transport is part of the report, used or not
+	require.Len(t, report.Transports, len(DefaultTransports))
+	for _, transport := range DefaultTransports {
+		assert.Contains(t, report.Transports, transport)
+	}
+
+	assert.Equal(t, float64(-1), report.MedianLatency)
+}
+
+func TestAggregatedReports(t *testing.T) {
+	const (
+		devices  = 2000
+		attempts = 10
+	)
+
+	a := &Aggregator{
+		opts:        AggregatorOpts{MinReportInterval: time.Hour},
+		transports:  make(map[string]*TransportSummary),
+		lastReports: make(map[peer.ID]time.Time),
+	}
+
+	for i := 0; i < devices; i++ {
+		c := NewCollector(CollectorOpts{Transports: []string{"MC"}, Epsilon: 10, MaxDials: attempts, MaxLatency: time.Second})
+		for j := 0; j < attempts; j++ {
+			var err error
+			if j%2 == 0 {
+				err = fmt.Errorf("dial failed")
+			}
+
+			c.RecordDial("MC", err)
+		}
+
+		c.RecordDelivery(500 * time.Millisecond)
+
+		report, err := c.Report()
+		require.NoError(t, err)
+		require.NoError(t, a.add(peer.ID(fmt.Sprint(i)), report))
+	}
+
+	summary := a.Summary()
+	assert.Equal(t, devices, summary.Reports)
+	assert.InDelta(t, 0.5, summary.Transports["MC"].SuccessRate, 0.1)
+
+	// the noise of the latencies is clamped, the median is still close
+	assert.True(t, summary.MedianLatency >= 0 && summary.MedianLatency <= 1000)
+	assert.InDelta(t, 500, summary.MedianLatency, 150)
+}
+
+func TestAggregatorRateLimit(t *testing.T) {
+	a := &Aggregator{
+		opts:        AggregatorOpts{MinReportInterval: time.Hour},
+		transports:  make(map[string]*TransportSummary),
+		lastReports: make(map[peer.ID]time.Time),
+	}
+
+	require.NoError(t, a.add(peer.ID("peer"), &Report{MedianLatency: -1}))
+	assert.Error(t, a.add(peer.ID("peer"), &Report{MedianLatency: -1}))
+	assert.Equal(t, 1, a.Summary().Reports)
+}
+
+func TestLaplace(t *testing.T) {
+	const samples = 100000
+
+	var sum, abs float64
+	for i := 0; i < samples; i++ {
+		noise, err := laplace(2)
+		require.NoError(t, err)
+
+		sum += noise
+		abs += math.Abs(noise)
+	}
+
+	// the mean absolute deviation of Laplace(b) is b
+	assert.InDelta(t, 0, sum/samples, 0.05)
+	assert.InDelta(t, 2, abs/samples, 0.05)
+}
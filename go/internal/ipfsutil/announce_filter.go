@@ -0,0 +1,486 @@
+package ipfsutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	ipfs_core "github.com/ipfs/go-ipfs/core"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	p2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	p2p_config "github.com/libp2p/go-libp2p/config"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"go.uber.org/zap"
+)
+
+const contactAddrsProtocolID = protocol.ID("/berty/contact-addrs/1.0.0")
+
+const (
+	// interfacesRefreshInterval is the lifetime of the addrs of the
+	// interfaces, the addrs factory is called on each announcement
+	interfacesRefreshInterval = 10 * time.Second
+
+	contactAddrsTimeout = 10 * time.Second
+	maxContactAddrs     = 32
+)
+
+var announceFilterKey = datastore.NewKey("config")
+
+// AnnounceFilterConfig selects the addrs announced to the other peers, e.g.
+// through the DHT and identify. The zero value announces every addr.
+type AnnounceFilterConfig struct {
+	// NoPrivate drops the private, loopback and link-local addrs, e.g. the
+	// LAN and the Docker bridges ones
+	NoPrivate bool `json:"noPrivate,omitempty"`
+
+	// AllowInterfaces, if set, only announces the addrs of these interfaces,
+	// DenyInterfaces never announces those of these ones. The names are glob
+	// patterns, e.g. "docker*". The addrs which aren't the ones of an
+	// interface, e.g. the observed or relayed ones, are kept.
+	AllowInterfaces []string `json:"allowInterfaces,omitempty"`
+	DenyInterfaces  []string `json:"denyInterfaces,omitempty"`
+
+	// AllowTransports, if set, only announces the addrs of these transports,
+	// DenyTransports never announces those of these ones. The names are the
+	// ones of TransportName, case insensitive, e.g. "quic" or "websocket".
+	AllowTransports []string `json:"allowTransports,omitempty"`
+	DenyTransports  []string `json:"denyTransports,omitempty"`
+
+	// ProximityContactsOnly keeps the BLE and Wi-Fi direct addrs out of the
+	// announcements, they are only sent to the contacts
+	ProximityContactsOnly bool `json:"proximityContactsOnly,omitempty"`
+}
+
+func (c AnnounceFilterConfig) validate() error {
+	for _, patterns := range [][]string{c.AllowInterfaces, c.DenyInterfaces} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid interface pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseAnnounceFilterConfig parses a comma separated list of filters, e.g.
+// "no-private,deny-interfaces=docker*|br-*,deny-transports=quic,proximity=contacts".
+// The filters are no-private, interfaces, deny-interfaces, transports,
+// deny-transports and proximity, whose only value is contacts. The values of
+// a filter are separated by '|'.
+func ParseAnnounceFilterConfig(s string) (AnnounceFilterConfig, error) {
+	c := AnnounceFilterConfig{}
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		name, value := strings.TrimSpace(kv[0]), ""
+		if len(kv) == 2 {
+			value = strings.TrimSpace(kv[1])
+		}
+
+		values := []string{}
+		for _, v := range strings.Split(value, "|") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+
+		switch {
+		case name == "no-private" && len(kv) == 1:
+			c.NoPrivate = true
+		case name == "proximity" && value == "contacts":
+			c.ProximityContactsOnly = true
+		case name == "interfaces" && len(values) > 0:
+			c.AllowInterfaces = append(c.AllowInterfaces, values...)
+		case name == "deny-interfaces" && len(values) > 0:
+			c.DenyInterfaces = append(c.DenyInterfaces, values...)
+		case name == "transports" && len(values) > 0:
+			c.AllowTransports = append(c.AllowTransports, values...)
+		case name == "deny-transports" && len(values) > 0:
+			c.DenyTransports = append(c.DenyTransports, values...)
+		default:
+			return AnnounceFilterConfig{}, fmt.Errorf("invalid announce filter %q", field)
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return AnnounceFilterConfig{}, err
+	}
+
+	return c, nil
+}
+
+// AnnounceFilterOpts configures an announce filter.
+type AnnounceFilterOpts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the config set at runtime, it takes precedence
+	// over Config on the next runs
+	Datastore datastore.Datastore
+
+	Config AnnounceFilterConfig
+
+	// Contacts reports whether a peer is a contact, the proximity addrs are
+	// sent to them with ProximityContactsOnly
+	Contacts func(peer.ID) bool
+}
+
+// AnnounceFilter drops addrs from the ones announced by the host, its config
+// can be changed at runtime: the addrs are announced again at once to the
+// connected peers, the DHT serves the new ones.
+type AnnounceFilter struct {
+	logger   *zap.Logger
+	store    datastore.Datastore
+	contacts func(peer.ID) bool
+
+	mu     sync.RWMutex
+	config AnnounceFilterConfig
+	host   host.Host
+
+	// proximity addrs kept out of the last announcement
+	withheld []ma.Multiaddr
+
+	// names of the interfaces by IP
+	muIfaces   sync.Mutex
+	ifaces     map[string]string
+	ifacesRead time.Time
+}
+
+func NewAnnounceFilter(opts AnnounceFilterOpts) (*AnnounceFilter, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		opts.Datastore = datastore.NewMapDatastore()
+	}
+
+	if opts.Contacts == nil {
+		opts.Contacts = func(peer.ID) bool { return false }
+	}
+
+	data, err := opts.Datastore.Get(announceFilterKey)
+	switch err {
+	case nil:
+		opts.Config = AnnounceFilterConfig{}
+		if err := json.Unmarshal(data, &opts.Config); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+	case datastore.ErrNotFound:
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := opts.Config.validate(); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	return &AnnounceFilter{
+		logger:   opts.Logger,
+		store:    opts.Datastore,
+		contacts: opts.Contacts,
+		config:   opts.Config,
+	}, nil
+}
+
+// Config returns the current config of the filter.
+func (f *AnnounceFilter) Config() AnnounceFilterConfig {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.config
+}
+
+// SetConfig replaces the config of the filter and announces the addrs again.
+func (f *AnnounceFilter) SetConfig(c AnnounceFilterConfig) error {
+	if err := c.validate(); err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := f.store.Put(announceFilterKey, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	f.mu.Lock()
+	f.config = c
+	h := f.host
+	f.mu.Unlock()
+
+	f.logger.Info("announce filter changed", zap.Any("config", c))
+
+	if h != nil {
+		f.reannounce(h)
+	}
+
+	return nil
+}
+
+// AddrsFactoryOption returns a libp2p option filtering the addrs announced
+// by the host. It wraps the addrs factory already configured, e.g. the one
+// of the announce addrs of the repo and the observed addrs, so it has to
+// come after them.
+func (f *AnnounceFilter) AddrsFactoryOption() p2p.Option {
+	return func(cfg *p2p_config.Config) error {
+		next := cfg.AddrsFactory
+		cfg.AddrsFactory = func(addrs []ma.Multiaddr) []ma.Multiaddr {
+			if next != nil {
+				addrs = next(addrs)
+			}
+
+			announced, withheld := f.Filter(addrs)
+
+			f.mu.Lock()
+			f.withheld = withheld
+			f.mu.Unlock()
+
+			return announced
+		}
+
+		return nil
+	}
+}
+
+// Filter returns the addrs announced and the proximity ones only sent to the
+// contacts.
+func (f *AnnounceFilter) Filter(addrs []ma.Multiaddr) (announced []ma.Multiaddr, withheld []ma.Multiaddr) {
+	c := f.Config()
+
+	var ifaces map[string]string
+	if len(c.AllowInterfaces) > 0 || len(c.DenyInterfaces) > 0 {
+		ifaces = f.interfaces(time.Now())
+	}
+
+	announced = make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if !c.allowed(addr, ifaces) {
+			continue
+		}
+
+		if c.ProximityContactsOnly && PathKindOf(addr) == PathProximity {
+			withheld = append(withheld, addr)
+			continue
+		}
+
+		announced = append(announced, addr)
+	}
+
+	return announced, withheld
+}
+
+func (c AnnounceFilterConfig) allowed(addr ma.Multiaddr, ifaces map[string]string) bool {
+	transport := strings.ToLower(TransportName(addr))
+	if len(c.AllowTransports) > 0 && !containsFold(c.AllowTransports, transport) {
+		return false
+	}
+
+	if containsFold(c.DenyTransports, transport) {
+		return false
+	}
+
+	// the IP of a relayed addr is the one of the relay
+	if ClassifyAddr(addr) == ClassRelay {
+		return true
+	}
+
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return true
+	}
+
+	if c.NoPrivate && (manet.IsPrivateAddr(addr) || manet.IsIPLoopback(addr) || ip.IsLinkLocalUnicast()) {
+		return false
+	}
+
+	iface, ok := ifaces[ip.String()]
+	if !ok {
+		return true
+	}
+
+	if len(c.AllowInterfaces) > 0 && !matchAny(c.AllowInterfaces, iface) {
+		return false
+	}
+
+	return !matchAny(c.DenyInterfaces, iface)
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// interfaces returns the names of the interfaces by IP, they are read again
+// once stale.
+func (f *AnnounceFilter) interfaces(now time.Time) map[string]string {
+	f.muIfaces.Lock()
+	defer f.muIfaces.Unlock()
+
+	if f.ifaces != nil && now.Sub(f.ifacesRead) < interfacesRefreshInterval {
+		return f.ifaces
+	}
+
+	ifaces := make(map[string]string)
+	if list, err := net.Interfaces(); err == nil {
+		for _, iface := range list {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok {
+					ifaces[ipnet.IP.String()] = iface.Name
+				}
+			}
+		}
+	}
+
+	f.ifaces, f.ifacesRead = ifaces, now
+
+	return ifaces
+}
+
+// reannounce pushes the addrs of the host to the connected peers, and the
+// proximity ones to the connected contacts.
+func (f *AnnounceFilter) reannounce(h host.Host) {
+	f.muIfaces.Lock()
+	f.ifaces = nil
+	f.muIfaces.Unlock()
+
+	if signaler, ok := h.(interface{ SignalAddressChange() }); ok {
+		signaler.SignalAddressChange()
+	}
+
+	// refreshes the withheld addrs
+	_ = h.Addrs()
+
+	for _, p := range h.Network().Peers() {
+		if f.contacts(p) {
+			go f.sendContactAddrs(h, p)
+		}
+	}
+}
+
+// sendContactAddrs sends the withheld proximity addrs to a contact.
+func (f *AnnounceFilter) sendContactAddrs(h host.Host, p peer.ID) {
+	f.mu.RLock()
+	addrs := make([]string, 0, len(f.withheld))
+	for _, addr := range f.withheld {
+		addrs = append(addrs, addr.String())
+	}
+	f.mu.RUnlock()
+
+	if len(addrs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), contactAddrsTimeout)
+	defer cancel()
+
+	stream, err := h.NewStream(network.WithNoDial(ctx, "contact addrs"), p, contactAddrsProtocolID)
+	if err != nil {
+		f.logger.Debug("unable to send addrs to contact", zap.Stringer("peer", p), zap.Error(err))
+		return
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(contactAddrsTimeout))
+
+	if err := json.NewEncoder(stream).Encode(addrs); err != nil {
+		_ = stream.Reset()
+	}
+}
+
+// handleContactAddrs adds the proximity addrs of a contact to the peerstore,
+// the ones of the other peers are ignored.
+func (f *AnnounceFilter) handleContactAddrs(h host.Host) network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+
+		p := stream.Conn().RemotePeer()
+		if !f.contacts(p) {
+			_ = stream.Reset()
+			return
+		}
+
+		_ = stream.SetDeadline(time.Now().Add(contactAddrsTimeout))
+
+		addrs := []string{}
+		if err := json.NewDecoder(io.LimitReader(stream, 64<<10)).Decode(&addrs); err != nil || len(addrs) > maxContactAddrs {
+			_ = stream.Reset()
+			return
+		}
+
+		maddrs := make([]ma.Multiaddr, 0, len(addrs))
+		for _, addr := range addrs {
+			if maddr, err := ma.NewMultiaddr(addr); err == nil && PathKindOf(maddr) == PathProximity {
+				maddrs = append(maddrs, maddr)
+			}
+		}
+
+		h.Peerstore().AddAddrs(p, maddrs, peerstore.RecentlyConnectedAddrTTL)
+	}
+}
+
+func (f *AnnounceFilter) attachHost(h host.Host) {
+	f.mu.Lock()
+	f.host = h
+	f.mu.Unlock()
+
+	h.SetStreamHandler(contactAddrsProtocolID, f.handleContactAddrs(h))
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			if len(n.ConnsToPeer(c.RemotePeer())) == 1 && f.Config().ProximityContactsOnly && f.contacts(c.RemotePeer()) {
+				go f.sendContactAddrs(h, c.RemotePeer())
+			}
+		},
+	})
+}
+
+// OptionAnnounceFilter returns a CoreAPIOption sending the withheld addrs
+// to the contacts of the node host, and announcing the addrs again on each
+// change of the config.
+func OptionAnnounceFilter(f *AnnounceFilter) CoreAPIOption {
+	return func(_ context.Context, node *ipfs_core.IpfsNode, _ ipfs_interface.CoreAPI) error {
+		f.attachHost(node.PeerHost)
+		return nil
+	}
+}
@@ -15,17 +15,21 @@ import (
 	ipfs_libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
 	ipfs_repo "github.com/ipfs/go-ipfs/repo"
 	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/pkg/errors"
 
 	p2p "github.com/libp2p/go-libp2p" // nolint:staticcheck
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	host "github.com/libp2p/go-libp2p-core/host"
 	p2p_host "github.com/libp2p/go-libp2p-core/host"
 	p2p_peer "github.com/libp2p/go-libp2p-core/peer" // nolint:staticcheck
 	p2p_ps "github.com/libp2p/go-libp2p-core/peerstore"
 	p2p_routing "github.com/libp2p/go-libp2p-core/routing"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
 	p2p_dht "github.com/libp2p/go-libp2p-kad-dht"
 	p2p_dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
 	p2p_record "github.com/libp2p/go-libp2p-record"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
 	// nolint:staticcheck
 )
 
@@ -45,6 +49,71 @@ type CoreAPIConfig struct {
 	Routing ipfs_libp2p.RoutingOption
 	Host    ipfs_libp2p.HostOption
 
+	// AnnounceAddrs, if set, replaces the addrs announced to the other peers
+	AnnounceAddrs []string
+
+	// AnnounceFilter, if set, drops addrs from the announced ones, e.g. the
+	// private ones, its config can be changed at runtime
+	AnnounceFilter *AnnounceFilter
+
+	QUIC      QUICOpts
+	WebSocket WebSocketOpts
+	Relay     RelayOpts
+
+	// DisableMDNS disables the LAN discovery, e.g. on hostile networks
+	DisableMDNS bool
+	MDNS        MDNSOpts
+
+	// Tor routes the dials through a Tor proxy, see TorOpts
+	Tor TorOpts
+
+	// Proxy routes the IP dials through a SOCKS5 proxy, see ProxyOpts. It
+	// can't be combined with Tor.
+	Proxy ProxyOpts
+
+	// SwarmKey, if set, restricts the node to the peers sharing this
+	// pre-shared key, see ParseSwarmKey for its format. QUIC doesn't support
+	// private networks and is disabled.
+	SwarmKey []byte
+
+	// ConnMgr overrides the watermarks of the connection manager
+	ConnMgr ConnMgrOpts
+
+	// DialScheduler, if set, caps the dials of the transports added by
+	// ipfsutil, e.g. the Tor one
+	DialScheduler *DialScheduler
+
+	// DisableDHT keeps the node off the public DHT, the peers are only found
+	// through the tinder drivers, e.g. a rendezvous node
+	DisableDHT bool
+
+	// DHTMode, if set, is the routing of the node, its mode can be switched
+	// at runtime. DisableDHT takes precedence.
+	DHTMode *DHTModeController
+
+	// Multipath, if set, keeps its peers connected over both a proximity
+	// path and an IP one, see Multipath
+	Multipath *Multipath
+
+	// Blocklist, if set, gates the connections of the node, the blocked
+	// peers are refused on every transport
+	Blocklist *Blocklist
+
+	// ConnLimiter, if set, caps the pending dials and handshakes of the node
+	// on every transport
+	ConnLimiter *ConnLimiter
+
+	// RendezvousServer, if set, makes the node serve the rendezvous protocol
+	RendezvousServer *RendezvousServerOpts
+
+	// Chaos, if set, injects network conditions in the streams of the node,
+	// e.g. latency and disconnections, for the developers
+	Chaos *Chaos
+
+	// DeferredStart, if set, builds the node without listening on its swarm
+	// addrs nor starting the mDNS discovery, both are started by it
+	DeferredStart *DeferredStart
+
 	Options []CoreAPIOption
 }
 
@@ -63,17 +132,144 @@ func NewCoreAPIFromDatastore(ctx context.Context, ds ipfs_ds.Batching, cfg *Core
 }
 
 func NewCoreAPIFromRepo(ctx context.Context, repo ipfs_repo.Repo, cfg *CoreAPIConfig) (ExtendedCoreAPI, *ipfs_core.IpfsNode, error) {
+	if cfg.Options == nil {
+		cfg.Options = []CoreAPIOption{}
+	}
+
+	if len(cfg.SwarmKey) != 0 {
+		var err error
+		if repo, err = withSwarmKey(repo, cfg.SwarmKey); err != nil {
+			return nil, nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		// the QUIC listeners would fail without the transport
+		cfg.QUIC.Disable = true
+	}
+
+	if cfg.Proxy.Enabled() {
+		if cfg.Tor.Enable {
+			return nil, nil, errcode.ErrInvalidInput.Wrap(errors.New("a proxy can't be used with Tor"))
+		}
+
+		if err := cfg.Proxy.validate(); err != nil {
+			return nil, nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		proxyCtor := newProxyTransportConstructor(cfg.Proxy)
+		proxied := p2p.Transport(proxyCtor)
+		if cfg.DialScheduler != nil {
+			proxied = cfg.DialScheduler.TransportOption(func(_ host.Host, u *tptu.Upgrader) (tpt.Transport, error) {
+				return proxyCtor(u)
+			})
+		}
+		if cfg.ExtraLibp2pOption != nil {
+			proxied = p2p.ChainOptions(cfg.ExtraLibp2pOption, proxied)
+		}
+
+		cfg.ExtraLibp2pOption = proxied
+
+		// QUIC can't go through a SOCKS5 proxy, the peers are dialed on
+		// their TCP addrs
+		cfg.QUIC.Disable = true
+	}
+
+	var onion *onionService
+	if cfg.Tor.Enable {
+		if cfg.Tor.ControlAddr != "" {
+			var err error
+			if onion, err = newOnionService(cfg.Tor); err != nil {
+				return nil, nil, errcode.TODO.Wrap(err)
+			}
+		}
+
+		torCtor := newTorTransportConstructor(cfg.Tor, onion)
+		tor := p2p.Transport(torCtor)
+		if cfg.DialScheduler != nil {
+			tor = cfg.DialScheduler.TransportOption(func(_ host.Host, u *tptu.Upgrader) (tpt.Transport, error) {
+				return torCtor(u)
+			})
+		}
+		if cfg.ExtraLibp2pOption != nil {
+			tor = p2p.ChainOptions(cfg.ExtraLibp2pOption, tor)
+		}
+
+		cfg.ExtraLibp2pOption = tor
+
+		// QUIC can't go through Tor, and the LAN discovery would reveal
+		// the node
+		cfg.QUIC.Disable = true
+		cfg.DisableMDNS = cfg.DisableMDNS || cfg.Tor.Strict
+	}
+
+	api, node, err := newCoreAPIFromRepo(ctx, repo, cfg, onion)
+	if err != nil {
+		if onion != nil {
+			onion.Close()
+		}
+
+		return nil, nil, err
+	}
+
+	return api, node, nil
+}
+
+func newCoreAPIFromRepo(ctx context.Context, repo ipfs_repo.Repo, cfg *CoreAPIConfig, onion *onionService) (ExtendedCoreAPI, *ipfs_core.IpfsNode, error) {
 	bcfg, err := CreateBuildConfig(repo, cfg)
 	if err != nil {
 		return nil, nil, errcode.TODO.Wrap(err)
 	}
 
-	if err := updateRepoConfig(repo, cfg); err != nil {
+	var onionAddr ma.Multiaddr
+	if onion != nil {
+		onionAddr = onion.addr
+		cfg.Options = append(cfg.Options, func(ctx context.Context, _ *ipfs_core.IpfsNode, _ ipfs_interface.CoreAPI) error {
+			go func() {
+				<-ctx.Done()
+				_ = onion.Close()
+			}()
+
+			return nil
+		})
+	}
+
+	if err := updateRepoConfig(repo, cfg, onionAddr); err != nil {
 		return nil, nil, errcode.TODO.Wrap(err)
 	}
 
-	if cfg.Options == nil {
-		cfg.Options = []CoreAPIOption{}
+	if cfg.DeferredStart != nil {
+		if bcfg.Repo, err = cfg.DeferredStart.deferListen(repo); err != nil {
+			return nil, nil, errcode.TODO.Wrap(err)
+		}
+
+		cfg.Options = append(cfg.Options, cfg.DeferredStart.option())
+	}
+
+	if !cfg.DisableMDNS {
+		if cfg.DeferredStart != nil {
+			cfg.DeferredStart.deferDiscovery(OptionMDNSDiscovery(cfg.MDNS))
+		} else {
+			cfg.Options = append(cfg.Options, OptionMDNSDiscovery(cfg.MDNS))
+		}
+	}
+
+	if cfg.Relay.Service && !cfg.Relay.Disable {
+		cfg.Options = append(cfg.Options, OptionRelayService(cfg.Relay))
+	}
+
+	if cfg.WebSocket.TLSPort != 0 && !cfg.Tor.Strict {
+		cfg.Options = append(cfg.Options, OptionWebSocketTLS(cfg.WebSocket))
+	}
+
+	if cfg.RendezvousServer != nil {
+		cfg.Options = append(cfg.Options, OptionRendezvousServer(*cfg.RendezvousServer))
+	}
+
+	if cfg.Blocklist != nil {
+		cfg.Options = append(cfg.Options, OptionBlocklist(cfg.Blocklist))
+	}
+
+	if cfg.AnnounceFilter != nil {
+		cfg.Options = append(cfg.Options, OptionAnnounceFilter(cfg.AnnounceFilter))
 	}
 
 	return NewConfigurableCoreAPI(ctx, bcfg, cfg.Options...)
@@ -111,6 +307,14 @@ func CreateBuildConfig(repo ipfs_repo.Repo, opts *CoreAPIConfig) (*ipfs_node.Bui
 	routingOpt := configureRouting(
 		p2p_dht.ModeClient,
 		p2p_dht.Concurrency(2))
+	if opts.DHTMode != nil {
+		routingOpt = opts.DHTMode.RoutingOption(p2p_dht.Concurrency(2))
+	}
+
+	if opts.DisableDHT {
+		routingOpt = nilRouting
+	}
+
 	if opts.Routing != nil {
 		routingOpt = opts.Routing
 	}
@@ -120,10 +324,38 @@ func CreateBuildConfig(repo ipfs_repo.Repo, opts *CoreAPIConfig) (*ipfs_node.Bui
 		hostOpt = opts.Host
 	}
 
+	// the options of the inner wraps come last, the announced addrs are
+	// filtered after the other addrs factories, e.g. the observed addrs one
+	if opts.AnnounceFilter != nil {
+		hostOpt = wrapP2POptionsToHost(hostOpt, opts.AnnounceFilter.AddrsFactoryOption())
+	}
+
 	if opts.ExtraLibp2pOption != nil {
 		hostOpt = wrapP2POptionsToHost(hostOpt, opts.ExtraLibp2pOption)
 	}
 
+	if opts.Multipath != nil {
+		hostOpt = opts.Multipath.HostOption(hostOpt)
+	}
+
+	if opts.Chaos != nil {
+		hostOpt = opts.Chaos.HostOption(hostOpt)
+	}
+
+	// the blocked peers don't take the slots of the limiter
+	gaters := []connmgr.ConnectionGater{}
+	if opts.Blocklist != nil {
+		gaters = append(gaters, opts.Blocklist)
+	}
+
+	if opts.ConnLimiter != nil {
+		gaters = append(gaters, opts.ConnLimiter)
+	}
+
+	if len(gaters) > 0 {
+		hostOpt = wrapP2POptionsToHost(hostOpt, p2p.ConnectionGater(ChainGaters(gaters...)))
+	}
+
 	if opts.HostConfig != nil {
 		routingOpt = wrapHostConfig(routingOpt, opts.HostConfig)
 	}
@@ -142,7 +374,7 @@ func CreateBuildConfig(repo ipfs_repo.Repo, opts *CoreAPIConfig) (*ipfs_node.Bui
 	}, nil
 }
 
-func updateRepoConfig(repo ipfs_repo.Repo, cfg *CoreAPIConfig) error {
+func updateRepoConfig(repo ipfs_repo.Repo, cfg *CoreAPIConfig, onion ma.Multiaddr) error {
 	rcfg, err := repo.Config()
 	if err != nil {
 		return err
@@ -164,6 +396,32 @@ func updateRepoConfig(repo ipfs_repo.Repo, cfg *CoreAPIConfig) error {
 		rcfg.API = cfg.APIConfig
 	}
 
+	if len(cfg.AnnounceAddrs) != 0 {
+		rcfg.Addresses.Announce = cfg.AnnounceAddrs
+	}
+
+	if err := applyQUICConfig(rcfg, cfg.QUIC); err != nil {
+		return err
+	}
+
+	if err := applyWebSocketConfig(rcfg, cfg.WebSocket); err != nil {
+		return err
+	}
+
+	applyRelayConfig(rcfg, cfg.Relay)
+
+	if err := applyConnMgrConfig(rcfg, cfg.ConnMgr); err != nil {
+		return err
+	}
+
+	if cfg.Tor.Enable {
+		applyTorConfig(rcfg, cfg.Tor, onion)
+	}
+
+	// the mDNS service of go-ipfs dials every peer found, ours is started
+	// with OptionMDNSDiscovery instead
+	rcfg.Discovery.MDNS.Enabled = false
+
 	return repo.SetConfig(rcfg)
 }
 
@@ -0,0 +1,376 @@
+package ipfsutil
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	mcma "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/multiaddr"
+	wifi "berty.tech/berty/v2/go/internal/wifi-transport"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultBandwidthSampleInterval is the interval between two samples of
+	// the traffic of the peers, it is accounted to their transport
+	DefaultBandwidthSampleInterval = 10 * time.Second
+
+	// DefaultBandwidthPersistInterval is the interval between two writes of
+	// the totals
+	DefaultBandwidthPersistInterval = time.Minute
+
+	// DefaultBandwidthSeriesWindow is the duration of the traffic kept by
+	// minute, see BandwidthMeter.Series
+	DefaultBandwidthSeriesWindow = time.Hour
+
+	// maxPersistedBandwidthPeers caps the peers persisted, the ones with the
+	// least traffic are dropped
+	maxPersistedBandwidthPeers = 1000
+)
+
+var bandwidthTotalsKey = ipfs_ds.NewKey("totals")
+
+// BandwidthTotals are the bytes exchanged since the first run of the node,
+// and the current rates in bytes per second.
+type BandwidthTotals struct {
+	TotalIn  int64   `json:"totalIn"`
+	TotalOut int64   `json:"totalOut"`
+	RateIn   float64 `json:"rateIn,omitempty"`
+	RateOut  float64 `json:"rateOut,omitempty"`
+}
+
+func (t BandwidthTotals) add(o BandwidthTotals) BandwidthTotals {
+	return BandwidthTotals{
+		TotalIn:  t.TotalIn + o.TotalIn,
+		TotalOut: t.TotalOut + o.TotalOut,
+		RateIn:   t.RateIn + o.RateIn,
+		RateOut:  t.RateOut + o.RateOut,
+	}
+}
+
+// withoutRates returns the totals without the rates, which aren't persisted.
+func (t BandwidthTotals) withoutRates() BandwidthTotals {
+	return BandwidthTotals{TotalIn: t.TotalIn, TotalOut: t.TotalOut}
+}
+
+func totalsFromStats(s metrics.Stats) BandwidthTotals {
+	return BandwidthTotals{
+		TotalIn:  s.TotalIn,
+		TotalOut: s.TotalOut,
+		RateIn:   s.RateIn,
+		RateOut:  s.RateOut,
+	}
+}
+
+// BandwidthStats is the traffic of the node by transport, peer and protocol.
+type BandwidthStats struct {
+	Totals     BandwidthTotals            `json:"totals"`
+	Transports map[string]BandwidthTotals `json:"transports"`
+	Peers      map[string]BandwidthTotals `json:"peers"`
+	Protocols  map[string]BandwidthTotals `json:"protocols"`
+}
+
+func newBandwidthStats() *BandwidthStats {
+	return &BandwidthStats{
+		Transports: make(map[string]BandwidthTotals),
+		Peers:      make(map[string]BandwidthTotals),
+		Protocols:  make(map[string]BandwidthTotals),
+	}
+}
+
+// BandwidthMeterOpts configures a bandwidth meter.
+type BandwidthMeterOpts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the totals across restarts
+	Datastore ipfs_ds.Datastore
+
+	SampleInterval  time.Duration
+	PersistInterval time.Duration
+
+	// SeriesWindow is the duration of the traffic kept by minute
+	SeriesWindow time.Duration
+}
+
+func (opts *BandwidthMeterOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		opts.Datastore = ipfs_ds.NewMapDatastore()
+	}
+
+	if opts.SampleInterval <= 0 {
+		opts.SampleInterval = DefaultBandwidthSampleInterval
+	}
+
+	if opts.PersistInterval <= 0 {
+		opts.PersistInterval = DefaultBandwidthPersistInterval
+	}
+
+	if opts.SeriesWindow <= 0 {
+		opts.SeriesWindow = DefaultBandwidthSeriesWindow
+	}
+}
+
+// BandwidthMeter reports the traffic of the node by transport, peer and
+// protocol, e.g. for the users on metered plans.
+//
+// The swarm meters the streams of every transport, including the proximity
+// ones, by peer and protocol. The traffic of a peer is accounted to the
+// transport of its connection at each sample: a peer connected through
+// several transports is accounted to the first one.
+type BandwidthMeter struct {
+	logger   *zap.Logger
+	store    ipfs_ds.Datastore
+	host     host.Host
+	reporter metrics.Reporter
+	opts     BandwidthMeterOpts
+
+	muStats sync.Mutex
+	// persisted totals of the previous runs
+	base *BandwidthStats
+	// traffic of this run by transport, with the rates of the last sample
+	transports map[string]BandwidthTotals
+	lastByPeer map[peer.ID]metrics.Stats
+
+	// traffic of this run by minute
+	series *bandwidthSeries
+}
+
+func NewBandwidthMeter(h host.Host, reporter metrics.Reporter, opts BandwidthMeterOpts) (*BandwidthMeter, error) {
+	opts.applyDefaults()
+
+	m := &BandwidthMeter{
+		logger:     opts.Logger,
+		store:      opts.Datastore,
+		host:       h,
+		reporter:   reporter,
+		opts:       opts,
+		base:       newBandwidthStats(),
+		transports: make(map[string]BandwidthTotals),
+		lastByPeer: make(map[peer.ID]metrics.Stats),
+		series:     newBandwidthSeries(opts.SeriesWindow),
+	}
+
+	data, err := m.store.Get(bandwidthTotalsKey)
+	switch err {
+	case nil:
+		if err := json.Unmarshal(data, m.base); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+	case ipfs_ds.ErrNotFound:
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return m, nil
+}
+
+// Start samples the traffic until the context is done, the totals are
+// persisted periodically and once done.
+func (m *BandwidthMeter) Start(ctx context.Context) {
+	go func() {
+		sample := time.NewTicker(m.opts.SampleInterval)
+		defer sample.Stop()
+
+		persist := time.NewTicker(m.opts.PersistInterval)
+		defer persist.Stop()
+
+		for {
+			select {
+			case <-sample.C:
+				m.sample()
+			case <-persist.C:
+				if err := m.persist(); err != nil {
+					m.logger.Warn("unable to persist bandwidth totals", zap.Error(err))
+				}
+			case <-ctx.Done():
+				m.sample()
+				if err := m.persist(); err != nil {
+					m.logger.Warn("unable to persist bandwidth totals", zap.Error(err))
+				}
+
+				return
+			}
+		}
+	}()
+}
+
+// transportNames are the names of the transports by multiaddr protocol, the
+// transports running over another one, e.g. WebSocket over TCP, come first.
+var transportNames = []struct {
+	code int
+	name string
+}{
+	{ma.P_CIRCUIT, "Relay"},
+	{mcma.P_MC, "MC"},
+	{wifi.P_WIFI, "Wi-Fi"},
+	{ma.P_ONION3, "Tor"},
+	{ma.P_ONION, "Tor"},
+	{ma.P_WS, "WebSocket"},
+	{ma.P_WSS, "WebSocket"},
+	{ma.P_QUIC, "QUIC"},
+	{ma.P_TCP, "TCP"},
+}
+
+// TransportName returns the name of the transport of a multiaddr, e.g. for
+// the remote addr of a connection.
+func TransportName(addr ma.Multiaddr) string {
+	for _, t := range transportNames {
+		if _, err := addr.ValueForProtocol(t.code); err == nil {
+			return t.name
+		}
+	}
+
+	return "unknown"
+}
+
+func (m *BandwidthMeter) transportOf(p peer.ID) string {
+	for _, c := range m.host.Network().ConnsToPeer(p) {
+		return TransportName(c.RemoteMultiaddr())
+	}
+
+	return "unknown"
+}
+
+// sample accounts the traffic of the peers since the previous sample to their
+// transport.
+func (m *BandwidthMeter) sample() {
+	byPeer := m.reporter.GetBandwidthByPeer()
+	seconds := m.opts.SampleInterval.Seconds()
+	now := time.Now()
+
+	m.muStats.Lock()
+	defer m.muStats.Unlock()
+
+	deltas := make(map[string]BandwidthTotals)
+	for p, stats := range byPeer {
+		last := m.lastByPeer[p]
+
+		// the meters of the idle peers can be trimmed
+		if stats.TotalIn < last.TotalIn || stats.TotalOut < last.TotalOut {
+			last = metrics.Stats{}
+		}
+
+		delta := BandwidthTotals{
+			TotalIn:  stats.TotalIn - last.TotalIn,
+			TotalOut: stats.TotalOut - last.TotalOut,
+		}
+
+		if delta.TotalIn != 0 || delta.TotalOut != 0 {
+			transport := m.transportOf(p)
+			deltas[transport] = deltas[transport].add(delta)
+			m.series.add(now, p.Pretty(), transport, delta)
+		}
+	}
+
+	m.series.flush(now)
+
+	m.lastByPeer = byPeer
+
+	for transport, totals := range m.transports {
+		m.transports[transport] = totals.withoutRates()
+	}
+
+	for transport, delta := range deltas {
+		totals := m.transports[transport].add(delta)
+		totals.RateIn = float64(delta.TotalIn) / seconds
+		totals.RateOut = float64(delta.TotalOut) / seconds
+		m.transports[transport] = totals
+	}
+}
+
+// PeerStats returns the traffic of a peer during this run.
+func (m *BandwidthMeter) PeerStats(p peer.ID) metrics.Stats {
+	return m.reporter.GetBandwidthForPeer(p)
+}
+
+// Stats returns the traffic of the node since its first run.
+func (m *BandwidthMeter) Stats() *BandwidthStats {
+	totals := m.reporter.GetBandwidthTotals()
+	byPeer := m.reporter.GetBandwidthByPeer()
+	byProtocol := m.reporter.GetBandwidthByProtocol()
+
+	m.muStats.Lock()
+	defer m.muStats.Unlock()
+
+	stats := newBandwidthStats()
+	stats.Totals = m.base.Totals.add(totalsFromStats(totals))
+
+	for transport, t := range m.base.Transports {
+		stats.Transports[transport] = t
+	}
+	for transport, t := range m.transports {
+		stats.Transports[transport] = stats.Transports[transport].add(t)
+	}
+
+	for p, t := range m.base.Peers {
+		stats.Peers[p] = t
+	}
+	for p, s := range byPeer {
+		stats.Peers[p.Pretty()] = stats.Peers[p.Pretty()].add(totalsFromStats(s))
+	}
+
+	for proto, t := range m.base.Protocols {
+		stats.Protocols[proto] = t
+	}
+	for proto, s := range byProtocol {
+		stats.Protocols[string(proto)] = stats.Protocols[string(proto)].add(totalsFromStats(s))
+	}
+
+	return stats
+}
+
+func (m *BandwidthMeter) persist() error {
+	stats := m.Stats()
+
+	persisted := newBandwidthStats()
+	persisted.Totals = stats.Totals.withoutRates()
+
+	for transport, t := range stats.Transports {
+		persisted.Transports[transport] = t.withoutRates()
+	}
+
+	for proto, t := range stats.Protocols {
+		persisted.Protocols[proto] = t.withoutRates()
+	}
+
+	peers := make([]string, 0, len(stats.Peers))
+	for p := range stats.Peers {
+		peers = append(peers, p)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		ti, tj := stats.Peers[peers[i]], stats.Peers[peers[j]]
+		return ti.TotalIn+ti.TotalOut > tj.TotalIn+tj.TotalOut
+	})
+
+	if len(peers) > maxPersistedBandwidthPeers {
+		peers = peers[:maxPersistedBandwidthPeers]
+	}
+
+	for _, p := range peers {
+		persisted.Peers[p] = stats.Peers[p].withoutRates()
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := m.store.Put(bandwidthTotalsKey, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
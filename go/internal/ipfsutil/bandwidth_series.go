@@ -0,0 +1,158 @@
+package ipfsutil
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BandwidthSeriesResolution is the duration of a point of the series.
+const BandwidthSeriesResolution = time.Minute
+
+// BandwidthPoint is the traffic of the node during a minute, by transport
+// and peer. The rates aren't set, the point of the current minute is updated
+// at each sample.
+type BandwidthPoint struct {
+	Start      time.Time                  `json:"start"`
+	Totals     BandwidthTotals            `json:"totals"`
+	Transports map[string]BandwidthTotals `json:"transports"`
+	Peers      map[string]BandwidthTotals `json:"peers"`
+}
+
+func newBandwidthPoint(start time.Time) *BandwidthPoint {
+	return &BandwidthPoint{
+		Start:      start,
+		Transports: make(map[string]BandwidthTotals),
+		Peers:      make(map[string]BandwidthTotals),
+	}
+}
+
+func (p *BandwidthPoint) clone() *BandwidthPoint {
+	c := newBandwidthPoint(p.Start)
+	c.Totals = p.Totals
+
+	for transport, t := range p.Transports {
+		c.Transports[transport] = t
+	}
+
+	for peer, t := range p.Peers {
+		c.Peers[peer] = t
+	}
+
+	return c
+}
+
+// bandwidthSeries keeps the traffic by minute over a sliding window.
+type bandwidthSeries struct {
+	window time.Duration
+
+	muPoints sync.Mutex
+	// oldest first, the last one is the current minute
+	points []*BandwidthPoint
+
+	muSubs sync.Mutex
+	subs   map[chan *BandwidthPoint]struct{}
+}
+
+func newBandwidthSeries(window time.Duration) *bandwidthSeries {
+	return &bandwidthSeries{
+		window: window,
+		subs:   make(map[chan *BandwidthPoint]struct{}),
+	}
+}
+
+// current returns the point of the minute, the points out of the window are
+// dropped. It is called with muPoints held.
+func (s *bandwidthSeries) current(now time.Time) *BandwidthPoint {
+	start := now.Truncate(BandwidthSeriesResolution)
+	if n := len(s.points); n > 0 && s.points[n-1].Start.Equal(start) {
+		return s.points[n-1]
+	}
+
+	p := newBandwidthPoint(start)
+	s.points = append(s.points, p)
+
+	oldest := start.Add(-s.window)
+	for len(s.points) > 0 && !s.points[0].Start.After(oldest) {
+		s.points = s.points[1:]
+	}
+
+	return p
+}
+
+func (s *bandwidthSeries) add(now time.Time, peer string, transport string, delta BandwidthTotals) {
+	s.muPoints.Lock()
+	defer s.muPoints.Unlock()
+
+	p := s.current(now)
+	p.Totals = p.Totals.add(delta)
+	p.Transports[transport] = p.Transports[transport].add(delta)
+	p.Peers[peer] = p.Peers[peer].add(delta)
+}
+
+// flush sends the point of the minute to the subscribers, after each sample.
+func (s *bandwidthSeries) flush(now time.Time) {
+	s.muPoints.Lock()
+	p := s.current(now).clone()
+	s.muPoints.Unlock()
+
+	s.muSubs.Lock()
+	defer s.muSubs.Unlock()
+
+	for ch := range s.subs {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+func (s *bandwidthSeries) list(since time.Time) []*BandwidthPoint {
+	s.muPoints.Lock()
+	defer s.muPoints.Unlock()
+
+	since = since.Truncate(BandwidthSeriesResolution)
+
+	points := []*BandwidthPoint{}
+	for _, p := range s.points {
+		if !p.Start.Before(since) {
+			points = append(points, p.clone())
+		}
+	}
+
+	return points
+}
+
+func (s *bandwidthSeries) subscribe(ctx context.Context) <-chan *BandwidthPoint {
+	ch := make(chan *BandwidthPoint, 8)
+
+	s.muSubs.Lock()
+	s.subs[ch] = struct{}{}
+	s.muSubs.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.muSubs.Lock()
+		delete(s.subs, ch)
+		s.muSubs.Unlock()
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+// Series returns the traffic of this run by minute since a date, within the
+// window of the series, the oldest first. The last point is the current
+// minute.
+func (m *BandwidthMeter) Series(since time.Time) []*BandwidthPoint {
+	return m.series.list(since)
+}
+
+// SubscribeSeries returns the point of the current minute after each sample
+// until the context is done, a point replaces the previous one with the same
+// start. The updates are dropped for a slow reader.
+func (m *BandwidthMeter) SubscribeSeries(ctx context.Context) <-chan *BandwidthPoint {
+	return m.series.subscribe(ctx)
+}
@@ -0,0 +1,195 @@
+package ipfsutil
+
+import (
+	"context"
+	"sync"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipfs_core "github.com/ipfs/go-ipfs/core"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+// Blocklist is a connection gater refusing the connections of the blocked
+// peers, whatever their transport: the dials to them fail, their inbound
+// connections are dropped once their peerID is known, and the streams they
+// open on an already established connection are reset. The discovery
+// mechanisms should also skip them, see IsBlocked.
+//
+// The blocked peers are persisted in the datastore.
+type Blocklist struct {
+	logger *zap.Logger
+	store  datastore.Datastore
+
+	mu      sync.RWMutex
+	blocked map[peer.ID]struct{}
+	host    host.Host
+}
+
+var _ connmgr.ConnectionGater = (*Blocklist)(nil)
+
+// NewBlocklist returns a blocklist loading the blocked peers from the
+// datastore.
+func NewBlocklist(logger *zap.Logger, store datastore.Datastore) (*Blocklist, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	bl := &Blocklist{
+		logger:  logger,
+		store:   store,
+		blocked: make(map[peer.ID]struct{}),
+	}
+
+	res, err := store.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for _, e := range entries {
+		pid, err := peer.Decode(datastore.RawKey(e.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		bl.blocked[pid] = struct{}{}
+	}
+
+	return bl, nil
+}
+
+func blocklistKey(pid peer.ID) datastore.Key {
+	return datastore.NewKey(pid.Pretty())
+}
+
+// Block refuses the connections of a peer, the current ones are closed.
+func (bl *Blocklist) Block(pid peer.ID) error {
+	if err := bl.store.Put(blocklistKey(pid), []byte{}); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	bl.mu.Lock()
+	bl.blocked[pid] = struct{}{}
+	h := bl.host
+	bl.mu.Unlock()
+
+	if h != nil {
+		if err := h.Network().ClosePeer(pid); err != nil {
+			bl.logger.Debug("unable to close blocked peer", zap.Stringer("peer", pid), zap.Error(err))
+		}
+	}
+
+	bl.logger.Info("peer blocked", zap.Stringer("peer", pid))
+
+	return nil
+}
+
+// Unblock accepts the connections of a peer again.
+func (bl *Blocklist) Unblock(pid peer.ID) error {
+	if err := bl.store.Delete(blocklistKey(pid)); err != nil && err != datastore.ErrNotFound {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	bl.mu.Lock()
+	delete(bl.blocked, pid)
+	bl.mu.Unlock()
+
+	bl.logger.Info("peer unblocked", zap.Stringer("peer", pid))
+
+	return nil
+}
+
+// IsBlocked returns true if the peer is blocked, it is safe to call on a nil
+// blocklist.
+func (bl *Blocklist) IsBlocked(pid peer.ID) bool {
+	if bl == nil {
+		return false
+	}
+
+	bl.mu.RLock()
+	_, ok := bl.blocked[pid]
+	bl.mu.RUnlock()
+
+	return ok
+}
+
+// List returns the blocked peers.
+func (bl *Blocklist) List() []peer.ID {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	pids := make([]peer.ID, 0, len(bl.blocked))
+	for pid := range bl.blocked {
+		pids = append(pids, pid)
+	}
+
+	return pids
+}
+
+// InterceptPeerDial refuses to dial a blocked peer.
+func (bl *Blocklist) InterceptPeerDial(pid peer.ID) bool {
+	return !bl.IsBlocked(pid)
+}
+
+// InterceptAddrDial refuses to dial a blocked peer.
+func (bl *Blocklist) InterceptAddrDial(pid peer.ID, _ ma.Multiaddr) bool {
+	return !bl.IsBlocked(pid)
+}
+
+// InterceptAccept accepts every inbound connection, the peerID isn't known
+// until the connection is secured.
+func (bl *Blocklist) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+// InterceptSecured drops the connections of a blocked peer.
+func (bl *Blocklist) InterceptSecured(_ network.Direction, pid peer.ID, _ network.ConnMultiaddrs) bool {
+	return !bl.IsBlocked(pid)
+}
+
+// InterceptUpgraded drops the connections of a blocked peer, the transports
+// not using the upgrader are checked here.
+func (bl *Blocklist) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	return !bl.IsBlocked(c.RemotePeer()), 0
+}
+
+func (bl *Blocklist) attachHost(h host.Host) {
+	bl.mu.Lock()
+	bl.host = h
+	bl.mu.Unlock()
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if bl.IsBlocked(c.RemotePeer()) {
+				_ = c.Close()
+			}
+		},
+		OpenedStreamF: func(_ network.Network, s network.Stream) {
+			if bl.IsBlocked(s.Conn().RemotePeer()) {
+				_ = s.Reset()
+			}
+		},
+	})
+}
+
+// OptionBlocklist returns a CoreAPIOption closing the connections and
+// resetting the streams of the peers blocked on the node host.
+func OptionBlocklist(bl *Blocklist) CoreAPIOption {
+	return func(_ context.Context, node *ipfs_core.IpfsNode, _ ipfs_interface.CoreAPI) error {
+		bl.attachHost(node.PeerHost)
+		return nil
+	}
+}
@@ -0,0 +1,365 @@
+package ipfsutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultBootstrapMinConnected is the number of bootstrap peers the node
+	// tries to stay connected to
+	DefaultBootstrapMinConnected = 4
+
+	// DefaultBootstrapInterval is the interval between two checks of the
+	// bootstrap connections
+	DefaultBootstrapInterval = 30 * time.Second
+
+	bootstrapDialTimeout = 15 * time.Second
+)
+
+var bootstrapPeersKey = ipfs_ds.NewKey("peers")
+
+// BootstrapStatus is the connection status of a bootstrap peer.
+type BootstrapStatus string
+
+const (
+	BootstrapStatusUnknown    BootstrapStatus = "unknown"
+	BootstrapStatusConnecting BootstrapStatus = "connecting"
+	BootstrapStatusConnected  BootstrapStatus = "connected"
+	BootstrapStatusFailed     BootstrapStatus = "failed"
+)
+
+// BootstrapPeer is an entry of the bootstrap list, the peers are dialed by
+// increasing priority.
+type BootstrapPeer struct {
+	Addr          string
+	Priority      int
+	Status        BootstrapStatus
+	LastError     string
+	LastConnected time.Time
+}
+
+type bootstrapState struct {
+	status        BootstrapStatus
+	lastError     error
+	lastConnected time.Time
+}
+
+// BootstrapOpts configures a bootstrap manager.
+type BootstrapOpts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the list, it is only written once modified
+	Datastore ipfs_ds.Datastore
+
+	// Defaults is the list used until it is modified
+	Defaults []string
+
+	MinConnected int
+	Interval     time.Duration
+}
+
+// BootstrapManager keeps the node connected to the bootstrap peers of a list
+// editable at runtime, e.g. by the operators running their own bootstrap
+// nodes. It replaces the bootstrap of go-ipfs, whose list is fixed once the
+// node is built.
+type BootstrapManager struct {
+	logger       *zap.Logger
+	store        ipfs_ds.Datastore
+	host         host.Host
+	minConnected int
+	interval     time.Duration
+	notify       chan struct{}
+
+	muPeers sync.Mutex
+	addrs   []string
+	states  map[string]*bootstrapState
+}
+
+func NewBootstrapManager(h host.Host, opts BootstrapOpts) (*BootstrapManager, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("no bootstrap datastore"))
+	}
+
+	if opts.MinConnected <= 0 {
+		opts.MinConnected = DefaultBootstrapMinConnected
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultBootstrapInterval
+	}
+
+	m := &BootstrapManager{
+		logger:       opts.Logger,
+		store:        opts.Datastore,
+		host:         h,
+		minConnected: opts.MinConnected,
+		interval:     opts.Interval,
+		notify:       make(chan struct{}, 1),
+		addrs:        append([]string{}, opts.Defaults...),
+		states:       make(map[string]*bootstrapState),
+	}
+
+	data, err := m.store.Get(bootstrapPeersKey)
+	switch err {
+	case nil:
+		if err := json.Unmarshal(data, &m.addrs); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+	case ipfs_ds.ErrNotFound:
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return m, nil
+}
+
+func parseBootstrapAddr(addr string) (*peer.AddrInfo, error) {
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	pi, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("bootstrap addr %q has no peer id: %w", addr, err))
+	}
+
+	return pi, nil
+}
+
+// save has to be called with the lock held.
+func (m *BootstrapManager) save() error {
+	data, err := json.Marshal(m.addrs)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := m.store.Put(bootstrapPeersKey, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (m *BootstrapManager) index(addr string) int {
+	for i, a := range m.addrs {
+		if a == addr {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// insert has to be called with the lock held, the priority is clamped to
+// the bounds of the list.
+func (m *BootstrapManager) insert(addr string, priority int) {
+	if priority < 0 || priority > len(m.addrs) {
+		priority = len(m.addrs)
+	}
+
+	m.addrs = append(m.addrs, "")
+	copy(m.addrs[priority+1:], m.addrs[priority:])
+	m.addrs[priority] = addr
+}
+
+func (m *BootstrapManager) wakeup() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// List returns the bootstrap peers by priority, with their connection status.
+func (m *BootstrapManager) List() []*BootstrapPeer {
+	m.muPeers.Lock()
+	defer m.muPeers.Unlock()
+
+	peers := make([]*BootstrapPeer, len(m.addrs))
+	for i, addr := range m.addrs {
+		bp := &BootstrapPeer{Addr: addr, Priority: i, Status: BootstrapStatusUnknown}
+		if state, ok := m.states[addr]; ok {
+			bp.Status = state.status
+			bp.LastConnected = state.lastConnected
+			if state.lastError != nil {
+				bp.LastError = state.lastError.Error()
+			}
+		}
+
+		// the connection may have been closed since the last check
+		if pi, err := parseBootstrapAddr(addr); err == nil && m.host != nil {
+			if m.host.Network().Connectedness(pi.ID) == network.Connected {
+				bp.Status = BootstrapStatusConnected
+			} else if bp.Status == BootstrapStatusConnected {
+				bp.Status = BootstrapStatusUnknown
+			}
+		}
+
+		peers[i] = bp
+	}
+
+	return peers
+}
+
+// Add inserts a bootstrap peer at the given priority, 0 being the highest, the
+// peer is appended if the priority is negative or out of bounds.
+func (m *BootstrapManager) Add(addr string, priority int) error {
+	if _, err := parseBootstrapAddr(addr); err != nil {
+		return err
+	}
+
+	m.muPeers.Lock()
+	defer m.muPeers.Unlock()
+
+	if m.index(addr) >= 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("bootstrap peer %q already listed", addr))
+	}
+
+	m.insert(addr, priority)
+	if err := m.save(); err != nil {
+		return err
+	}
+
+	m.wakeup()
+
+	return nil
+}
+
+// Remove removes a bootstrap peer, the node stays connected to it until the
+// connection manager prunes it.
+func (m *BootstrapManager) Remove(addr string) error {
+	m.muPeers.Lock()
+	defer m.muPeers.Unlock()
+
+	i := m.index(addr)
+	if i < 0 {
+		return errcode.ErrMissingMapKey.Wrap(fmt.Errorf("unknown bootstrap peer %q", addr))
+	}
+
+	m.addrs = append(m.addrs[:i], m.addrs[i+1:]...)
+	delete(m.states, addr)
+
+	return m.save()
+}
+
+// SetPriority moves a bootstrap peer to the given priority.
+func (m *BootstrapManager) SetPriority(addr string, priority int) error {
+	m.muPeers.Lock()
+	defer m.muPeers.Unlock()
+
+	i := m.index(addr)
+	if i < 0 {
+		return errcode.ErrMissingMapKey.Wrap(fmt.Errorf("unknown bootstrap peer %q", addr))
+	}
+
+	m.addrs = append(m.addrs[:i], m.addrs[i+1:]...)
+	m.insert(addr, priority)
+
+	return m.save()
+}
+
+func (m *BootstrapManager) setState(addr string, status BootstrapStatus, err error) {
+	m.muPeers.Lock()
+	defer m.muPeers.Unlock()
+
+	// the peer may have been removed during the dial
+	if m.index(addr) < 0 {
+		return
+	}
+
+	state, ok := m.states[addr]
+	if !ok {
+		state = &bootstrapState{}
+		m.states[addr] = state
+	}
+
+	state.status = status
+	state.lastError = err
+	if status == BootstrapStatusConnected {
+		state.lastConnected = time.Now()
+	}
+}
+
+// bootstrap dials the peers by priority until enough of them are connected.
+func (m *BootstrapManager) bootstrap(ctx context.Context) {
+	m.muPeers.Lock()
+	addrs := append([]string{}, m.addrs...)
+	m.muPeers.Unlock()
+
+	connected := 0
+	pending := []*peer.AddrInfo{}
+	pendingAddrs := []string{}
+	for _, addr := range addrs {
+		pi, err := parseBootstrapAddr(addr)
+		if err != nil {
+			m.setState(addr, BootstrapStatusFailed, err)
+			continue
+		}
+
+		if m.host.Network().Connectedness(pi.ID) == network.Connected {
+			m.setState(addr, BootstrapStatusConnected, nil)
+			connected++
+			continue
+		}
+
+		pending = append(pending, pi)
+		pendingAddrs = append(pendingAddrs, addr)
+	}
+
+	for i := 0; i < len(pending) && connected < m.minConnected; i++ {
+		m.setState(pendingAddrs[i], BootstrapStatusConnecting, nil)
+
+		dctx, cancel := context.WithTimeout(ctx, bootstrapDialTimeout)
+		err := m.host.Connect(dctx, *pending[i])
+		cancel()
+
+		if err != nil {
+			m.logger.Debug("unable to connect to bootstrap peer", zap.String("addr", pendingAddrs[i]), zap.Error(err))
+			m.setState(pendingAddrs[i], BootstrapStatusFailed, err)
+			continue
+		}
+
+		m.setState(pendingAddrs[i], BootstrapStatusConnected, nil)
+		connected++
+	}
+
+	if connected < m.minConnected && len(addrs) > 0 {
+		m.logger.Debug("not enough bootstrap peers connected", zap.Int("connected", connected), zap.Int("min", m.minConnected))
+	}
+}
+
+// Start bootstraps the node now, then each time the list changes or the
+// interval elapses, until ctx is done.
+func (m *BootstrapManager) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			m.bootstrap(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-m.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,282 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ipfs_libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
+	p2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	p2p_ps "github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultChaosRetransmitDelay is the delay of a lost write before it is
+	// delivered
+	DefaultChaosRetransmitDelay = 200 * time.Millisecond
+
+	// DefaultChaosReorderDelay is the delay of a held back write
+	DefaultChaosReorderDelay = 100 * time.Millisecond
+)
+
+// ErrChaosDisconnect is returned by the streams whose connection is dropped
+// by a Chaos.
+var ErrChaosDisconnect = fmt.Errorf("connection dropped by the network conditions")
+
+// ChaosOpts are the network conditions injected by a Chaos. The
+// probabilities are by read or write of a stream.
+type ChaosOpts struct {
+	Logger *zap.Logger
+
+	// Latency delays every read and write, by up to Jitter more or less
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Loss is the probability a write is lost. The streams are reliable, a
+	// lost write is delivered after RetransmitDelay.
+	Loss            float64
+	RetransmitDelay time.Duration
+
+	// Reorder is the probability a write is held back for ReorderDelay, the
+	// writes of the other streams overtake it.
+	Reorder      float64
+	ReorderDelay time.Duration
+
+	// Disconnect is the probability a read or a write drops the connection
+	// of its stream
+	Disconnect float64
+
+	// Seed makes the conditions reproducible, random if zero
+	Seed int64
+}
+
+func (opts *ChaosOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.RetransmitDelay <= 0 {
+		opts.RetransmitDelay = DefaultChaosRetransmitDelay
+	}
+
+	if opts.ReorderDelay <= 0 {
+		opts.ReorderDelay = DefaultChaosReorderDelay
+	}
+
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+}
+
+// ParseChaosOpts parses a comma separated list of conditions, e.g.
+// "latency=200ms,jitter=50ms,loss=0.05,reorder=0.1,disconnect=0.001,seed=42".
+// The conditions are latency, jitter, loss, retransmit, reorder,
+// reorder-delay, disconnect and seed.
+func ParseChaosOpts(s string) (ChaosOpts, error) {
+	opts := ChaosOpts{}
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return ChaosOpts{}, fmt.Errorf("invalid network condition %q, expected name=value", field)
+		}
+
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		var err error
+		switch name {
+		case "latency":
+			opts.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			opts.Jitter, err = time.ParseDuration(value)
+		case "retransmit":
+			opts.RetransmitDelay, err = time.ParseDuration(value)
+		case "reorder-delay":
+			opts.ReorderDelay, err = time.ParseDuration(value)
+		case "loss":
+			opts.Loss, err = parseProbability(value)
+		case "reorder":
+			opts.Reorder, err = parseProbability(value)
+		case "disconnect":
+			opts.Disconnect, err = parseProbability(value)
+		case "seed":
+			opts.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return ChaosOpts{}, fmt.Errorf("unknown network condition %q", name)
+		}
+
+		if err != nil {
+			return ChaosOpts{}, fmt.Errorf("invalid network condition %q: %w", name, err)
+		}
+	}
+
+	return opts, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("%v isn't within [0, 1]", p)
+	}
+
+	return p, nil
+}
+
+// Chaos injects network conditions in the streams of a host, e.g. to test
+// the messaging on a lossy network. It wraps the host, so the conditions
+// apply to every transport, for the streams opened by the node and the ones
+// it accepts.
+type Chaos struct {
+	logger *zap.Logger
+	opts   ChaosOpts
+
+	muRand sync.Mutex
+	rand   *rand.Rand
+}
+
+func NewChaos(opts ChaosOpts) *Chaos {
+	opts.applyDefaults()
+
+	return &Chaos{
+		logger: opts.Logger,
+		opts:   opts,
+		rand:   rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+// HostOption returns a host option whose hosts inject the network
+// conditions.
+func (c *Chaos) HostOption(hf ipfs_libp2p.HostOption) ipfs_libp2p.HostOption {
+	return func(ctx context.Context, id peer.ID, ps p2p_ps.Peerstore, options ...p2p.Option) (host.Host, error) {
+		h, err := hf(ctx, id, ps, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.WrapHost(h), nil
+	}
+}
+
+// WrapHost returns a host injecting the network conditions, e.g. for the
+// hosts of a mocknet.
+func (c *Chaos) WrapHost(h host.Host) host.Host {
+	return &chaosHost{Host: h, chaos: c}
+}
+
+// WrapStream returns a stream injecting the network conditions.
+func (c *Chaos) WrapStream(s network.Stream) network.Stream {
+	return &chaosStream{Stream: s, chaos: c}
+}
+
+// condition returns the delay of a read or a write and whether it drops the
+// connection.
+func (c *Chaos) condition(write bool) (time.Duration, bool) {
+	c.muRand.Lock()
+	defer c.muRand.Unlock()
+
+	delay := c.opts.Latency
+	if c.opts.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(2*c.opts.Jitter))) - c.opts.Jitter
+	}
+
+	if write && c.rand.Float64() < c.opts.Loss {
+		delay += c.opts.RetransmitDelay
+	}
+
+	if write && c.rand.Float64() < c.opts.Reorder {
+		delay += c.opts.ReorderDelay
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+
+	return delay, c.rand.Float64() < c.opts.Disconnect
+}
+
+// inject delays a read or a write of a stream, or drops its connection.
+func (c *Chaos) inject(s network.Stream, write bool) error {
+	delay, disconnect := c.condition(write)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if !disconnect {
+		return nil
+	}
+
+	c.logger.Debug("dropping connection", zap.Stringer("peer", s.Conn().RemotePeer()), zap.String("protocol", string(s.Protocol())))
+	_ = s.Conn().Close()
+
+	return ErrChaosDisconnect
+}
+
+type chaosHost struct {
+	host.Host
+	chaos *Chaos
+}
+
+func (h *chaosHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.chaos.WrapStream(s), nil
+}
+
+func (h *chaosHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, h.wrapHandler(handler))
+}
+
+func (h *chaosHost) SetStreamHandlerMatch(pid protocol.ID, match func(string) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, match, h.wrapHandler(handler))
+}
+
+func (h *chaosHost) wrapHandler(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		handler(h.chaos.WrapStream(s))
+	}
+}
+
+type chaosStream struct {
+	network.Stream
+	chaos *Chaos
+}
+
+func (s *chaosStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		if ierr := s.chaos.inject(s.Stream, false); ierr != nil {
+			return n, ierr
+		}
+	}
+
+	return n, err
+}
+
+func (s *chaosStream) Write(b []byte) (int, error) {
+	if err := s.chaos.inject(s.Stream, true); err != nil {
+		return 0, err
+	}
+
+	return s.Stream.Write(b)
+}
@@ -0,0 +1,297 @@
+package ipfsutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMaxPendingDials caps the peers dialed and not secured yet, all
+	// transports included.
+	DefaultMaxPendingDials = 32
+
+	// DefaultMaxPendingHandshakes caps the inbound connections not secured
+	// yet, all transports included.
+	DefaultMaxPendingHandshakes = 32
+
+	// DefaultConnLimiterTimeout is the time after which a pending dial or
+	// handshake is assumed to have failed and frees its slot.
+	DefaultConnLimiterTimeout = 30 * time.Second
+)
+
+// ConnLimiterOpts configures a ConnLimiter.
+type ConnLimiterOpts struct {
+	Logger *zap.Logger
+
+	// MaxPendingDials caps the peers dialed and MaxPendingHandshakes the
+	// inbound connections, until they are secured. Set them to a negative
+	// value to disable the cap.
+	MaxPendingDials      int
+	MaxPendingHandshakes int
+
+	// Timeout is the time after which a pending connection frees its slot,
+	// the gater isn't told about the failed ones
+	Timeout time.Duration
+}
+
+func (opts *ConnLimiterOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.MaxPendingDials == 0 {
+		opts.MaxPendingDials = DefaultMaxPendingDials
+	}
+
+	if opts.MaxPendingHandshakes == 0 {
+		opts.MaxPendingHandshakes = DefaultMaxPendingHandshakes
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultConnLimiterTimeout
+	}
+}
+
+// ConnLimiterStats are the pending connections of a ConnLimiter and the ones
+// it refused since it was created.
+type ConnLimiterStats struct {
+	PendingDials      int    `json:"pending_dials"`
+	PendingHandshakes int    `json:"pending_handshakes"`
+	RefusedDials      uint64 `json:"refused_dials"`
+	RefusedHandshakes uint64 `json:"refused_handshakes"`
+}
+
+// ConnLimiter is a connection gater capping the connections the node is
+// dialing or accepting, so a crowded or hostile place can't make it spawn
+// unbounded dial and handshake goroutines. The caps apply to every
+// transport, the proximity ones gate their inbound connections themselves as
+// they don't use the listeners of the upgrader.
+//
+// A connection is pending from its dial or its accept until it is secured,
+// or until the timeout as the failures aren't reported to the gaters.
+type ConnLimiter struct {
+	logger *zap.Logger
+
+	mu         sync.Mutex
+	dials      *pendingConns
+	handshakes *pendingConns
+	stats      ConnLimiterStats
+	now        func() time.Time
+}
+
+var _ connmgr.ConnectionGater = (*ConnLimiter)(nil)
+
+func NewConnLimiter(opts ConnLimiterOpts) *ConnLimiter {
+	opts.applyDefaults()
+
+	return &ConnLimiter{
+		logger:     opts.Logger,
+		dials:      newPendingConns(opts.MaxPendingDials, opts.Timeout),
+		handshakes: newPendingConns(opts.MaxPendingHandshakes, opts.Timeout),
+		now:        time.Now,
+	}
+}
+
+// Stats returns the pending connections and the refused ones.
+func (l *ConnLimiter) Stats() ConnLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	stats := l.stats
+	stats.PendingDials = l.dials.len(now)
+	stats.PendingHandshakes = l.handshakes.len(now)
+
+	return stats
+}
+
+// InterceptPeerDial accepts the dials, they are capped once their addrs are
+// known.
+func (l *ConnLimiter) InterceptPeerDial(peer.ID) bool {
+	return true
+}
+
+// InterceptAddrDial refuses the dials beyond the cap of pending dials, the
+// addrs of a peer dialed in parallel hold a single slot.
+func (l *ConnLimiter) InterceptAddrDial(pid peer.ID, _ ma.Multiaddr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.dials.add(string(pid), l.now()) {
+		return true
+	}
+
+	l.stats.RefusedDials++
+	l.logger.Debug("dial refused, too many pending dials", zap.Stringer("peer", pid))
+
+	return false
+}
+
+// InterceptAccept refuses the inbound connections beyond the cap of pending
+// handshakes.
+func (l *ConnLimiter) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.handshakes.add(addrs.RemoteMultiaddr().String(), l.now()) {
+		return true
+	}
+
+	l.stats.RefusedHandshakes++
+	l.logger.Debug("inbound connection refused, too many pending handshakes")
+
+	return false
+}
+
+// InterceptSecured frees the slot of the secured connection.
+func (l *ConnLimiter) InterceptSecured(dir network.Direction, pid peer.ID, addrs network.ConnMultiaddrs) bool {
+	l.release(dir, pid, addrs.RemoteMultiaddr())
+	return true
+}
+
+// InterceptUpgraded frees the slot of the connection, the transports not
+// using the upgrader aren't checked when secured.
+func (l *ConnLimiter) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	l.release(c.Stat().Direction, c.RemotePeer(), c.RemoteMultiaddr())
+	return true, 0
+}
+
+func (l *ConnLimiter) release(dir network.Direction, pid peer.ID, addr ma.Multiaddr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if dir == network.DirInbound {
+		l.handshakes.remove(addr.String())
+	} else {
+		l.dials.remove(string(pid))
+	}
+}
+
+// pendingConns are the connections holding a slot, with the time their slot
+// expires.
+type pendingConns struct {
+	max     int
+	timeout time.Duration
+	expires map[string]time.Time
+}
+
+func newPendingConns(max int, timeout time.Duration) *pendingConns {
+	return &pendingConns{
+		max:     max,
+		timeout: timeout,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// add takes a slot for the connection, a connection retried keeps its slot.
+// The expired slots are only freed once the cap is reached.
+func (pc *pendingConns) add(key string, now time.Time) bool {
+	if pc.max < 0 {
+		return true
+	}
+
+	if _, ok := pc.expires[key]; !ok && len(pc.expires) >= pc.max {
+		pc.expire(now)
+		if len(pc.expires) >= pc.max {
+			return false
+		}
+	}
+
+	pc.expires[key] = now.Add(pc.timeout)
+
+	return true
+}
+
+func (pc *pendingConns) remove(key string) {
+	delete(pc.expires, key)
+}
+
+func (pc *pendingConns) len(now time.Time) int {
+	pc.expire(now)
+	return len(pc.expires)
+}
+
+func (pc *pendingConns) expire(now time.Time) {
+	for key, expires := range pc.expires {
+		if !now.Before(expires) {
+			delete(pc.expires, key)
+		}
+	}
+}
+
+// ChainGaters returns a connection gater accepting the connections accepted
+// by all the gaters. The dials and the accepts are asked in order until a
+// gater refuses, so a gater reserving resources, e.g. a ConnLimiter, comes
+// last. Every gater is told about the secured and upgraded connections, so
+// it can free its resources. The nil gaters are skipped.
+func ChainGaters(gaters ...connmgr.ConnectionGater) connmgr.ConnectionGater {
+	chain := gaterChain{}
+	for _, g := range gaters {
+		if g != nil {
+			chain = append(chain, g)
+		}
+	}
+
+	return chain
+}
+
+type gaterChain []connmgr.ConnectionGater
+
+func (c gaterChain) InterceptPeerDial(pid peer.ID) bool {
+	for _, g := range c {
+		if !g.InterceptPeerDial(pid) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c gaterChain) InterceptAddrDial(pid peer.ID, addr ma.Multiaddr) bool {
+	for _, g := range c {
+		if !g.InterceptAddrDial(pid, addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c gaterChain) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	for _, g := range c {
+		if !g.InterceptAccept(addrs) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c gaterChain) InterceptSecured(dir network.Direction, pid peer.ID, addrs network.ConnMultiaddrs) bool {
+	allow := true
+	for _, g := range c {
+		if !g.InterceptSecured(dir, pid, addrs) {
+			allow = false
+		}
+	}
+
+	return allow
+}
+
+func (c gaterChain) InterceptUpgraded(conn network.Conn) (bool, control.DisconnectReason) {
+	allow, reason := true, control.DisconnectReason(0)
+	for _, g := range c {
+		if ok, r := g.InterceptUpgraded(conn); !ok && allow {
+			allow, reason = false, r
+		}
+	}
+
+	return allow, reason
+}
@@ -0,0 +1,47 @@
+package ipfsutil
+
+import (
+	"fmt"
+	"time"
+
+	ipfs_cfg "github.com/ipfs/go-ipfs-config"
+)
+
+// ConnMgrOpts configures the connection manager of the node. Once the node
+// has more than HighWater connections, the least valuable ones are closed
+// until LowWater remain. The connections younger than GracePeriod and the
+// protected ones, e.g. the contacts, are never closed. The zero values keep
+// the defaults of the repo.
+type ConnMgrOpts struct {
+	LowWater    int
+	HighWater   int
+	GracePeriod time.Duration
+}
+
+// applyConnMgrConfig updates the connection manager of the repo config.
+func applyConnMgrConfig(rcfg *ipfs_cfg.Config, opts ConnMgrOpts) error {
+	if opts.LowWater < 0 || opts.HighWater < 0 || opts.GracePeriod < 0 {
+		return fmt.Errorf("invalid connection manager config: negative value")
+	}
+
+	if opts.LowWater != 0 {
+		rcfg.Swarm.ConnMgr.LowWater = opts.LowWater
+	}
+
+	if opts.HighWater != 0 {
+		rcfg.Swarm.ConnMgr.HighWater = opts.HighWater
+	}
+
+	if opts.GracePeriod != 0 {
+		rcfg.Swarm.ConnMgr.GracePeriod = opts.GracePeriod.String()
+	}
+
+	if rcfg.Swarm.ConnMgr.LowWater > rcfg.Swarm.ConnMgr.HighWater {
+		return fmt.Errorf("invalid connection manager config: low water %d above high water %d",
+			rcfg.Swarm.ConnMgr.LowWater, rcfg.Swarm.ConnMgr.HighWater)
+	}
+
+	rcfg.Swarm.ConnMgr.Type = "basic"
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	config "github.com/ipfs/go-ipfs-config"
+	ipfs_core "github.com/ipfs/go-ipfs/core"
+	ipfs_repo "github.com/ipfs/go-ipfs/repo"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DeferredStart delays the listeners and the LAN discovery of a node, so a
+// mobile app gets its API before the transports warm up, e.g. the native
+// drivers of the proximity ones. The node is built without listening on its
+// swarm addrs, Listen and then StartDiscovery are called in the background
+// once the node is built, see CoreAPIConfig.DeferredStart.
+type DeferredStart struct {
+	mu        sync.Mutex
+	ctx       context.Context
+	node      *ipfs_core.IpfsNode
+	api       ipfs_interface.CoreAPI
+	addrs     []string
+	discovery []CoreAPIOption
+
+	listened   bool
+	discovered bool
+}
+
+func NewDeferredStart() *DeferredStart {
+	return &DeferredStart{}
+}
+
+// deferListen is called once the repo is configured, the node built on the
+// returned repo doesn't listen on the swarm addrs.
+func (d *DeferredStart) deferListen(repo ipfs_repo.Repo) (ipfs_repo.Repo, error) {
+	rcfg, err := repo.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.addrs = append([]string{}, rcfg.Addresses.Swarm...)
+	d.mu.Unlock()
+
+	return &deferredListenRepo{Repo: repo}, nil
+}
+
+// deferDiscovery keeps the discovery options until StartDiscovery.
+func (d *DeferredStart) deferDiscovery(opts ...CoreAPIOption) {
+	d.mu.Lock()
+	d.discovery = append(d.discovery, opts...)
+	d.mu.Unlock()
+}
+
+// option records the node once built.
+func (d *DeferredStart) option() CoreAPIOption {
+	return func(ctx context.Context, node *ipfs_core.IpfsNode, api ipfs_interface.CoreAPI) error {
+		d.mu.Lock()
+		d.ctx, d.node, d.api = ctx, node, api
+		d.mu.Unlock()
+
+		return nil
+	}
+}
+
+// Listen listens on the swarm addrs of the node, only the first call does.
+// It fails if none of the addrs can be listened on, like go-ipfs.
+func (d *DeferredStart) Listen() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.node == nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the node isn't built yet"))
+	}
+
+	if d.listened {
+		return nil
+	}
+	d.listened = true
+
+	maddrs := make([]ma.Multiaddr, len(d.addrs))
+	for i, addr := range d.addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		maddrs[i] = maddr
+	}
+
+	if err := d.node.PeerHost.Network().Listen(maddrs...); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	return nil
+}
+
+// StartDiscovery starts the LAN discovery of the node, only the first call
+// does. The discovery is stopped with the context the node was built with.
+func (d *DeferredStart) StartDiscovery() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.node == nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the node isn't built yet"))
+	}
+
+	if d.discovered {
+		return nil
+	}
+	d.discovered = true
+
+	for _, opt := range d.discovery {
+		if err := opt(d.ctx, d.node, d.api); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deferredListenRepo hides the swarm addrs from the node built on it, they
+// are listened by DeferredStart.Listen.
+type deferredListenRepo struct {
+	ipfs_repo.Repo
+}
+
+func (r *deferredListenRepo) Config() (*config.Config, error) {
+	rcfg, err := r.Repo.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := *rcfg
+	cfg.Addresses.Swarm = []string{}
+
+	return &cfg, nil
+}
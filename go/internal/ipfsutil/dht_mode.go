@@ -0,0 +1,293 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	ipfs_libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
+	p2p_host "github.com/libp2p/go-libp2p-core/host"
+	p2p_peer "github.com/libp2p/go-libp2p-core/peer"
+	p2p_routing "github.com/libp2p/go-libp2p-core/routing"
+	p2p_dht "github.com/libp2p/go-libp2p-kad-dht"
+	p2p_dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
+	p2p_record "github.com/libp2p/go-libp2p-record"
+	p2p_routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"go.uber.org/zap"
+)
+
+// DHTMode is the mode the node runs the DHT in.
+type DHTMode int
+
+const (
+	// DHTModeClient only queries the DHT, the node doesn't answer the
+	// queries of the other peers
+	DHTModeClient DHTMode = iota
+
+	// DHTModeServer makes the node a full DHT peer
+	DHTModeServer
+
+	// DHTModeDisabled keeps the node off the DHT
+	DHTModeDisabled
+)
+
+func (m DHTMode) String() string {
+	switch m {
+	case DHTModeClient:
+		return "client"
+	case DHTModeServer:
+		return "server"
+	case DHTModeDisabled:
+		return "disabled"
+	}
+
+	return fmt.Sprintf("DHTMode(%d)", int(m))
+}
+
+// NetworkConditions are the inputs of the DHT mode, they are reported by the
+// platform, e.g. the mobile bridge.
+type NetworkConditions struct {
+	WiFi     bool
+	Charging bool
+	Metered  bool
+}
+
+// DHTMode returns the mode fitting the conditions: a server answers the
+// queries of the other peers, it's only worth it on an unmetered Wi-Fi
+// network while charging.
+func (c NetworkConditions) DHTMode() DHTMode {
+	if c.WiFi && c.Charging && !c.Metered {
+		return DHTModeServer
+	}
+
+	return DHTModeClient
+}
+
+// DHTModeOpts configures a DHT mode controller.
+type DHTModeOpts struct {
+	Logger *zap.Logger
+
+	// Mode is the mode the node starts in, DHTModeClient by default
+	Mode DHTMode
+}
+
+// DHTModeController switches the mode of the DHT of the node at runtime, it
+// is the routing of the node.
+//
+// The DHT can't change the mode of a running instance, except from its
+// reachability in auto mode: it is closed and created again in the new mode.
+// The routing table is filled again from the bootstrap and connected peers.
+type DHTModeController struct {
+	logger *zap.Logger
+
+	muDHT       sync.RWMutex
+	mode        DHTMode
+	disabled    bool
+	routing     p2p_routing.Routing
+	routingMode DHTMode
+	closed      bool
+
+	// set by the routing option
+	newRouting func(mode DHTMode) (p2p_routing.Routing, error)
+
+	// set once the node bootstraps the routing
+	bootstrapCtx context.Context
+}
+
+var _ p2p_routing.Routing = (*DHTModeController)(nil)
+
+func NewDHTModeController(opts DHTModeOpts) *DHTModeController {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	return &DHTModeController{
+		logger:      opts.Logger,
+		mode:        opts.Mode,
+		routing:     p2p_routinghelpers.Null{},
+		routingMode: DHTModeDisabled,
+	}
+}
+
+// RoutingOption returns the routing option of the node, it creates the DHT
+// with the given options in the current mode.
+func (c *DHTModeController) RoutingOption(dhtOpts ...p2p_dht.Option) ipfs_libp2p.RoutingOption {
+	return func(
+		ctx context.Context,
+		host p2p_host.Host,
+		dstore datastore.Batching,
+		validator p2p_record.Validator,
+		bootstrapPeers ...p2p_peer.AddrInfo,
+	) (p2p_routing.Routing, error) {
+		c.muDHT.Lock()
+		defer c.muDHT.Unlock()
+
+		c.newRouting = func(mode DHTMode) (p2p_routing.Routing, error) {
+			if mode == DHTModeDisabled {
+				return p2p_routinghelpers.Null{}, nil
+			}
+
+			dhtMode := p2p_dht.ModeClient
+			if mode == DHTModeServer {
+				dhtMode = p2p_dht.ModeServer
+			}
+
+			return p2p_dualdht.New(ctx, host,
+				append(append([]p2p_dht.Option{}, dhtOpts...),
+					p2p_dht.Mode(dhtMode),
+					p2p_dht.Datastore(dstore),
+					p2p_dht.Validator(validator),
+					p2p_dht.BootstrapPeers(bootstrapPeers...),
+				)...)
+		}
+
+		mode := c.effectiveMode()
+		routing, err := c.newRouting(mode)
+		if err != nil {
+			return nil, err
+		}
+
+		c.routing, c.routingMode = routing, mode
+
+		// the lifecycle of the node only closes the DHT it created itself
+		go func() {
+			<-ctx.Done()
+			c.close()
+		}()
+
+		return c, nil
+	}
+}
+
+func (c *DHTModeController) effectiveMode() DHTMode {
+	if c.disabled {
+		return DHTModeDisabled
+	}
+
+	return c.mode
+}
+
+// Mode returns the current mode of the DHT.
+func (c *DHTModeController) Mode() DHTMode {
+	c.muDHT.RLock()
+	defer c.muDHT.RUnlock()
+
+	return c.effectiveMode()
+}
+
+// SetMode switches the DHT to the given mode.
+func (c *DHTModeController) SetMode(mode DHTMode) error {
+	c.muDHT.Lock()
+	defer c.muDHT.Unlock()
+
+	c.mode = mode
+
+	return c.apply()
+}
+
+// SetConditions switches the DHT to the mode fitting the network conditions.
+func (c *DHTModeController) SetConditions(conditions NetworkConditions) error {
+	return c.SetMode(conditions.DHTMode())
+}
+
+// SetDisabled keeps the node off the DHT whatever its mode, until it's
+// enabled again.
+func (c *DHTModeController) SetDisabled(disabled bool) error {
+	c.muDHT.Lock()
+	defer c.muDHT.Unlock()
+
+	c.disabled = disabled
+
+	return c.apply()
+}
+
+// apply recreates the DHT if its mode changed, muDHT must be held.
+func (c *DHTModeController) apply() error {
+	// the DHT is created along with the node
+	if c.newRouting == nil || c.closed {
+		return nil
+	}
+
+	mode := c.effectiveMode()
+	if mode == c.routingMode {
+		return nil
+	}
+
+	// both DHTs would answer on the same protocols, the previous one is
+	// closed first
+	closeRouting(c.routing)
+	c.routing, c.routingMode = p2p_routinghelpers.Null{}, DHTModeDisabled
+
+	routing, err := c.newRouting(mode)
+	if err != nil {
+		return err
+	}
+
+	c.routing, c.routingMode = routing, mode
+	c.logger.Info("DHT mode switched", zap.Stringer("mode", mode))
+
+	// the node only bootstraps the DHT it starts with
+	if c.bootstrapCtx != nil {
+		if err := routing.Bootstrap(c.bootstrapCtx); err != nil {
+			c.logger.Warn("unable to bootstrap DHT", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+func (c *DHTModeController) close() {
+	c.muDHT.Lock()
+	defer c.muDHT.Unlock()
+
+	c.closed = true
+	closeRouting(c.routing)
+	c.routing, c.routingMode = p2p_routinghelpers.Null{}, DHTModeDisabled
+}
+
+func closeRouting(routing p2p_routing.Routing) {
+	if closer, ok := routing.(interface{ Close() error }); ok {
+		_ = closer.Close()
+	}
+}
+
+func (c *DHTModeController) current() p2p_routing.Routing {
+	c.muDHT.RLock()
+	defer c.muDHT.RUnlock()
+
+	return c.routing
+}
+
+func (c *DHTModeController) Provide(ctx context.Context, id cid.Cid, announce bool) error {
+	return c.current().Provide(ctx, id, announce)
+}
+
+func (c *DHTModeController) FindProvidersAsync(ctx context.Context, id cid.Cid, count int) <-chan p2p_peer.AddrInfo {
+	return c.current().FindProvidersAsync(ctx, id, count)
+}
+
+func (c *DHTModeController) FindPeer(ctx context.Context, pid p2p_peer.ID) (p2p_peer.AddrInfo, error) {
+	return c.current().FindPeer(ctx, pid)
+}
+
+func (c *DHTModeController) PutValue(ctx context.Context, key string, value []byte, opts ...p2p_routing.Option) error {
+	return c.current().PutValue(ctx, key, value, opts...)
+}
+
+func (c *DHTModeController) GetValue(ctx context.Context, key string, opts ...p2p_routing.Option) ([]byte, error) {
+	return c.current().GetValue(ctx, key, opts...)
+}
+
+func (c *DHTModeController) SearchValue(ctx context.Context, key string, opts ...p2p_routing.Option) (<-chan []byte, error) {
+	return c.current().SearchValue(ctx, key, opts...)
+}
+
+func (c *DHTModeController) Bootstrap(ctx context.Context) error {
+	c.muDHT.Lock()
+	c.bootstrapCtx = ctx
+	c.muDHT.Unlock()
+
+	return c.current().Bootstrap(ctx)
+}
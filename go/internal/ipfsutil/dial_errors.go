@@ -0,0 +1,63 @@
+package ipfsutil
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultDialErrorsSize is the number of dial errors kept by a DialErrors.
+const DefaultDialErrorsSize = 50
+
+// DialError is a failed dial, its IPs are redacted.
+type DialError struct {
+	Transport string    `json:"transport"`
+	Error     string    `json:"error"`
+	Date      time.Time `json:"date"`
+}
+
+// DialErrors keeps the last dial errors for the diagnostics, Record is a
+// DialSchedulerOpts.OnDial.
+type DialErrors struct {
+	lock   sync.Mutex
+	errors []DialError
+	size   int
+}
+
+// NewDialErrors keeps the last size errors, DefaultDialErrorsSize if zero.
+func NewDialErrors(size int) *DialErrors {
+	if size <= 0 {
+		size = DefaultDialErrorsSize
+	}
+
+	return &DialErrors{size: size}
+}
+
+// Record records a dial, the successful ones are ignored.
+func (d *DialErrors) Record(transport string, err error) {
+	if err == nil {
+		return
+	}
+
+	e := DialError{Transport: transport, Error: RedactIPs(err.Error()), Date: time.Now()}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.errors = append(d.errors, e)
+	if len(d.errors) > d.size {
+		d.errors = d.errors[len(d.errors)-d.size:]
+	}
+}
+
+// List returns the last dial errors, the most recent first.
+func (d *DialErrors) List() []DialError {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	list := make([]DialError, len(d.errors))
+	for i, e := range d.errors {
+		list[len(d.errors)-1-i] = e
+	}
+
+	return list
+}
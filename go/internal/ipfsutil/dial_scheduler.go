@@ -0,0 +1,269 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	p2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+// ErrDialUnnecessary is returned by the queued dials canceled because the
+// peer connected in the meantime.
+var ErrDialUnnecessary = fmt.Errorf("dial unnecessary: peer already connected")
+
+// DefaultMaxDials caps the concurrent dials of all the scheduled transports.
+const DefaultMaxDials = 8
+
+// DefaultMaxDialsPerTransport caps the dials of the radio transports, they
+// choke on parallel connects.
+var DefaultMaxDialsPerTransport = map[string]int{
+	"MC":    1,
+	"Wi-Fi": 2,
+}
+
+// DialSchedulerOpts configures a dial scheduler.
+type DialSchedulerOpts struct {
+	Logger *zap.Logger
+
+	// MaxDials caps the concurrent dials of all the scheduled transports,
+	// set it to a negative value to disable the global cap
+	MaxDials int
+
+	// MaxDialsPerTransport caps the concurrent dials by transport name,
+	// DefaultMaxDialsPerTransport is used if nil
+	MaxDialsPerTransport map[string]int
+
+	// Policy, if set, delays the dials of the addrs ranked below the other
+	// addrs of the peer
+	Policy *TransportPolicy
+
+	// OnDial, if set, is called with the outcome of the dials, the canceled
+	// ones aren't reported
+	OnDial func(transport string, err error)
+}
+
+// DialScheduler caps the concurrent outbound dials of the transports it
+// wraps, the other dials are queued. The queued dials to a peer are canceled
+// when it connects inbound.
+//
+// The transports set up by libp2p itself, e.g. the circuit relay, can't be
+// wrapped: their dials are never delayed by the policy.
+type DialScheduler struct {
+	logger       *zap.Logger
+	global       chan struct{}
+	perTransport map[string]chan struct{}
+	policy       *TransportPolicy
+	onDial       func(transport string, err error)
+	host         host.Host
+	attach       sync.Once
+
+	muQueued sync.Mutex
+	queued   map[peer.ID]map[*queuedDial]struct{}
+}
+
+type queuedDial struct {
+	cancel context.CancelFunc
+}
+
+func NewDialScheduler(opts DialSchedulerOpts) *DialScheduler {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.MaxDials == 0 {
+		opts.MaxDials = DefaultMaxDials
+	}
+
+	if opts.MaxDialsPerTransport == nil {
+		opts.MaxDialsPerTransport = DefaultMaxDialsPerTransport
+	}
+
+	s := &DialScheduler{
+		logger:       opts.Logger,
+		perTransport: make(map[string]chan struct{}),
+		policy:       opts.Policy,
+		onDial:       opts.OnDial,
+		queued:       make(map[peer.ID]map[*queuedDial]struct{}),
+	}
+
+	if opts.MaxDials > 0 {
+		s.global = make(chan struct{}, opts.MaxDials)
+	}
+
+	for name, max := range opts.MaxDialsPerTransport {
+		if max > 0 {
+			s.perTransport[name] = make(chan struct{}, max)
+		}
+	}
+
+	return s
+}
+
+// TransportOption returns a libp2p option adding the transport built by the
+// constructor, its dials go through the scheduler.
+func (s *DialScheduler) TransportOption(ctor func(h host.Host, u *tptu.Upgrader) (tpt.Transport, error)) p2p.Option {
+	return p2p.Transport(func(h host.Host, u *tptu.Upgrader) (tpt.Transport, error) {
+		t, err := ctor(h, u)
+		if err != nil {
+			return nil, err
+		}
+
+		s.attachHost(h)
+
+		return s.WrapTransport(t), nil
+	})
+}
+
+// WrapTransport returns a transport whose dials go through the scheduler.
+func (s *DialScheduler) WrapTransport(t tpt.Transport) tpt.Transport {
+	return &scheduledTransport{Transport: t, scheduler: s, name: fmt.Sprint(t)}
+}
+
+// attachHost cancels the queued dials to the peers connecting inbound.
+func (s *DialScheduler) attachHost(h host.Host) {
+	s.attach.Do(func() {
+		s.host = h
+		h.Network().Notify(&network.NotifyBundle{
+			ConnectedF: func(_ network.Network, c network.Conn) {
+				if c.Stat().Direction == network.DirInbound {
+					s.cancelQueued(c.RemotePeer())
+				}
+			},
+		})
+	})
+}
+
+func (s *DialScheduler) cancelQueued(p peer.ID) {
+	s.muQueued.Lock()
+	defer s.muQueued.Unlock()
+
+	for q := range s.queued[p] {
+		q.cancel()
+	}
+
+	if len(s.queued[p]) > 0 {
+		s.logger.Debug("queued dials canceled, peer connected inbound", zap.Stringer("peer", p), zap.Int("dials", len(s.queued[p])))
+	}
+
+	delete(s.queued, p)
+}
+
+func (s *DialScheduler) enqueue(ctx context.Context, p peer.ID) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	q := &queuedDial{cancel: cancel}
+
+	s.muQueued.Lock()
+	if s.queued[p] == nil {
+		s.queued[p] = make(map[*queuedDial]struct{})
+	}
+	s.queued[p][q] = struct{}{}
+	s.muQueued.Unlock()
+
+	return ctx, func() {
+		cancel()
+
+		s.muQueued.Lock()
+		delete(s.queued[p], q)
+		if len(s.queued[p]) == 0 {
+			delete(s.queued, p)
+		}
+		s.muQueued.Unlock()
+	}
+}
+
+// dialDelay returns the delay of the dial given the policy and the other
+// addrs of the peer.
+func (s *DialScheduler) dialDelay(raddr ma.Multiaddr, p peer.ID) time.Duration {
+	if s.policy == nil || s.host == nil {
+		return 0
+	}
+
+	return s.policy.DialDelay(raddr, s.host.Peerstore().Addrs(p))
+}
+
+// acquire waits for the delay of the dial, for a dial slot of the transport,
+// then for a global one, it returns a function releasing them.
+func (s *DialScheduler) acquire(ctx context.Context, name string, p peer.ID, delay time.Duration) (func(), error) {
+	qctx, dequeue := s.enqueue(ctx, p)
+	defer dequeue()
+
+	unnecessary := func() error {
+		if ctx.Err() == nil {
+			return ErrDialUnnecessary
+		}
+
+		return ctx.Err()
+	}
+
+	// the dial is canceled by the swarm once a better addr connects
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-qctx.Done():
+			return nil, unnecessary()
+		}
+	}
+
+	sems := []chan struct{}{}
+	if sem, ok := s.perTransport[name]; ok {
+		sems = append(sems, sem)
+	}
+
+	if s.global != nil {
+		sems = append(sems, s.global)
+	}
+
+	release := func(n int) {
+		for _, sem := range sems[:n] {
+			<-sem
+		}
+	}
+
+	for i, sem := range sems {
+		select {
+		case sem <- struct{}{}:
+		case <-qctx.Done():
+			release(i)
+			return nil, unnecessary()
+		}
+	}
+
+	return func() { release(len(sems)) }, nil
+}
+
+type scheduledTransport struct {
+	tpt.Transport
+	scheduler *DialScheduler
+	name      string
+}
+
+func (t *scheduledTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	release, err := t.scheduler.acquire(ctx, t.name, p, t.scheduler.dialDelay(raddr, p))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	c, err := t.Transport.Dial(ctx, raddr, p)
+	if t.scheduler.onDial != nil && ctx.Err() == nil {
+		t.scheduler.onDial(t.name, err)
+	}
+
+	return c, err
+}
+
+func (t *scheduledTransport) String() string {
+	return t.name
+}
@@ -0,0 +1,357 @@
+package ipfsutil
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/tracer"
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
+)
+
+// GroupDirectProtocolID is the protocol of the messages sent directly to the
+// members which aren't subscribed to the topic of the group.
+const GroupDirectProtocolID = protocol.ID("/berty/group-direct/1.0.0")
+
+const (
+	// DefaultGroupMaxMessageSize caps the messages of the groups
+	DefaultGroupMaxMessageSize = 1 << 20
+
+	groupDirectTimeout  = 30 * time.Second
+	maxGroupDirectSends = 8
+)
+
+// GroupSignFunc signs a message for a group, it returns the public key of the
+// signer and the signature.
+type GroupSignFunc func(groupPK []byte, data []byte) (signer []byte, sig []byte, err error)
+
+// GroupVerifyFunc reports whether a message of a group is signed by one of
+// its members.
+type GroupVerifyFunc func(groupPK []byte, signer []byte, data []byte, sig []byte) bool
+
+// GroupMessageHandler is called with the verified messages of a group.
+type GroupMessageHandler func(groupPK []byte, from peer.ID, data []byte)
+
+// GroupPubSubOpts configures a group dissemination layer.
+type GroupPubSubOpts struct {
+	Logger *zap.Logger
+
+	Sign    GroupSignFunc
+	Verify  GroupVerifyFunc
+	Handler GroupMessageHandler
+
+	MaxMessageSize int
+
+	// Lanes schedules the messages ahead of the bulk transfers to the same
+	// peers
+	Lanes *OutboundLanes
+}
+
+func (opts *GroupPubSubOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Sign == nil {
+		opts.Sign = func([]byte, []byte) ([]byte, []byte, error) { return nil, nil, nil }
+	}
+
+	if opts.Verify == nil {
+		opts.Verify = func([]byte, []byte, []byte, []byte) bool { return true }
+	}
+
+	if opts.Handler == nil {
+		opts.Handler = func([]byte, peer.ID, []byte) {}
+	}
+
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultGroupMaxMessageSize
+	}
+}
+
+// GroupTopic returns the topic of a group, derived from its public key
+// without revealing it.
+func GroupTopic(groupPK []byte) string {
+	mac := hmac.New(sha256.New, groupPK)
+	_, _ = mac.Write([]byte("berty group topic"))
+
+	return "/berty/group/1.0.0/" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// groupEnvelope is a signed message of a group, on its topic or sent
+// directly.
+type groupEnvelope struct {
+	Topic  string `json:"topic"`
+	Data   []byte `json:"data"`
+	Signer []byte `json:"signer,omitempty"`
+	Sig    []byte `json:"sig,omitempty"`
+}
+
+type groupTopic struct {
+	groupPK []byte
+	topic   *pubsub.Topic
+	sub     *pubsub.Subscription
+}
+
+// GroupPubSub disseminates the messages of the groups over gossipsub, instead
+// of sending them to each member. The members not subscribed to the topic,
+// e.g. the ones still joining the mesh, get the messages directly.
+type GroupPubSub struct {
+	logger *zap.Logger
+	host   host.Host
+	ps     *pubsub.PubSub
+	opts   GroupPubSubOpts
+
+	muTopics sync.Mutex
+	topics   map[string]*groupTopic
+}
+
+// NewGroupPubSub registers the direct protocol on the host.
+func NewGroupPubSub(h host.Host, ps *pubsub.PubSub, opts GroupPubSubOpts) *GroupPubSub {
+	opts.applyDefaults()
+
+	gp := &GroupPubSub{
+		logger: opts.Logger,
+		host:   h,
+		ps:     ps,
+		opts:   opts,
+		topics: make(map[string]*groupTopic),
+	}
+
+	h.SetStreamHandler(GroupDirectProtocolID, gp.handleDirect)
+
+	return gp
+}
+
+// Join subscribes to the topic of a group until Leave is called or the
+// context is done.
+func (gp *GroupPubSub) Join(ctx context.Context, groupPK []byte) error {
+	name := GroupTopic(groupPK)
+
+	gp.muTopics.Lock()
+	defer gp.muTopics.Unlock()
+
+	if _, ok := gp.topics[name]; ok {
+		return nil
+	}
+
+	validator := func(_ context.Context, _ peer.ID, msg *pubsub.Message) bool {
+		_, ok := gp.open(name, groupPK, msg.GetData())
+		return ok
+	}
+
+	if err := gp.ps.RegisterTopicValidator(name, validator); err != nil {
+		return err
+	}
+
+	topic, err := gp.ps.Join(name)
+	if err != nil {
+		_ = gp.ps.UnregisterTopicValidator(name)
+		return err
+	}
+
+	sub, err := topic.Subscribe()
+	if err != nil {
+		_ = topic.Close()
+		_ = gp.ps.UnregisterTopicValidator(name)
+		return err
+	}
+
+	gp.topics[name] = &groupTopic{groupPK: groupPK, topic: topic, sub: sub}
+
+	go func() {
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+
+			if msg.GetFrom() == gp.host.ID() {
+				continue
+			}
+
+			// the message was validated already
+			if env, ok := gp.open(name, groupPK, msg.GetData()); ok {
+				gp.opts.Handler(groupPK, msg.GetFrom(), env.Data)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Leave unsubscribes from the topic of a group.
+func (gp *GroupPubSub) Leave(groupPK []byte) error {
+	name := GroupTopic(groupPK)
+
+	gp.muTopics.Lock()
+	t, ok := gp.topics[name]
+	delete(gp.topics, name)
+	gp.muTopics.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	t.sub.Cancel()
+	_ = gp.ps.UnregisterTopicValidator(name)
+
+	return t.topic.Close()
+}
+
+// Publish signs and publishes a message on the topic of a group, it is sent
+// directly to the given members not subscribed to the topic.
+func (gp *GroupPubSub) Publish(ctx context.Context, groupPK []byte, data []byte, members []peer.ID) error {
+	name := GroupTopic(groupPK)
+
+	gp.muTopics.Lock()
+	t, ok := gp.topics[name]
+	gp.muTopics.Unlock()
+
+	if !ok {
+		return fmt.Errorf("group topic not joined")
+	}
+
+	signer, sig, err := gp.opts.Sign(groupPK, data)
+	if err != nil {
+		return err
+	}
+
+	msg, err := json.Marshal(&groupEnvelope{Topic: name, Data: data, Signer: signer, Sig: sig})
+	if err != nil {
+		return err
+	}
+
+	if len(msg) > gp.opts.MaxMessageSize {
+		return fmt.Errorf("group message of %d bytes, max %d", len(msg), gp.opts.MaxMessageSize)
+	}
+
+	defer gp.opts.Lanes.Hold(members, PriorityText)()
+
+	_, span := tracer.From(ctx).Start(ctx, "Publish Group Message", trace.WithAttributes(kv.Int("size", len(msg))))
+	err = t.topic.Publish(ctx, msg)
+	span.End()
+	if err != nil {
+		return err
+	}
+
+	subscribed := make(map[peer.ID]struct{})
+	for _, p := range t.topic.ListPeers() {
+		subscribed[p] = struct{}{}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxGroupDirectSends)
+	for _, p := range members {
+		if _, ok := subscribed[p]; ok || p == gp.host.ID() {
+			continue
+		}
+
+		if gp.host.Network().Connectedness(p) != network.Connected {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p peer.ID) {
+			defer func() { <-sem; wg.Done() }()
+
+			if err := gp.sendDirect(ctx, p, msg); err != nil {
+				gp.logger.Debug("unable to send group message directly", zap.Stringer("peer", p), zap.Error(err))
+			}
+		}(p)
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+func (gp *GroupPubSub) sendDirect(ctx context.Context, p peer.ID, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, groupDirectTimeout)
+	defer cancel()
+
+	stream, err := gp.host.NewStream(network.WithNoDial(ctx, "group direct"), p, GroupDirectProtocolID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// the peers are reached over different transports, e.g. MC nearby
+	_, span := tracer.From(ctx).Start(ctx, "Send Group Message", trace.WithAttributes(
+		kv.String("transport", TransportName(stream.Conn().RemoteMultiaddr())),
+		kv.Int("size", len(msg)),
+	))
+	defer span.End()
+
+	if _, err := gp.opts.Lanes.Stream(stream, PriorityText).Write(msg); err != nil {
+		span.RecordError(ctx, err)
+		_ = stream.Reset()
+		return err
+	}
+
+	return nil
+}
+
+func (gp *GroupPubSub) handleDirect(stream network.Stream) {
+	defer stream.Close()
+
+	from := stream.Conn().RemotePeer()
+	_ = stream.SetDeadline(time.Now().Add(groupDirectTimeout))
+
+	data, err := ioutil.ReadAll(io.LimitReader(stream, int64(gp.opts.MaxMessageSize)+1))
+	if err != nil || len(data) > gp.opts.MaxMessageSize {
+		_ = stream.Reset()
+		return
+	}
+
+	env := &groupEnvelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		_ = stream.Reset()
+		return
+	}
+
+	gp.muTopics.Lock()
+	t, ok := gp.topics[env.Topic]
+	gp.muTopics.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if env, ok := gp.open(env.Topic, t.groupPK, data); ok {
+		gp.opts.Handler(t.groupPK, from, env.Data)
+	}
+}
+
+// open decodes and verifies a message of a group.
+func (gp *GroupPubSub) open(name string, groupPK []byte, data []byte) (*groupEnvelope, bool) {
+	if len(data) > gp.opts.MaxMessageSize {
+		return nil, false
+	}
+
+	env := &groupEnvelope{}
+	if err := json.Unmarshal(data, env); err != nil || env.Topic != name {
+		return nil, false
+	}
+
+	if !gp.opts.Verify(groupPK, env.Signer, env.Data, env.Sig) {
+		return nil, false
+	}
+
+	return env, true
+}
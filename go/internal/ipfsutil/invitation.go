@@ -0,0 +1,474 @@
+package ipfsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	ipfs_dsq "github.com/ipfs/go-datastore/query"
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+// InvitationProtocolID is the protocol the invitations are redeemed with.
+const InvitationProtocolID = protocol.ID("/berty/invitation/1.0.0")
+
+const (
+	// InvitationVersion is the version of the encoded invitations, the
+	// invitations of another version are refused
+	InvitationVersion byte = 1
+
+	// DefaultInvitationTTL is how long an invitation can be redeemed
+	DefaultInvitationTTL = 24 * time.Hour
+
+	// MaxInvitationTTL caps the lifetime of the invitations
+	MaxInvitationTTL = 30 * 24 * time.Hour
+
+	invitationTokenSize     = 16
+	invitationRedeemTimeout = 30 * time.Second
+	maxInvitationSize       = 4 << 10
+
+	invitationStatusOK       byte = 0
+	invitationStatusRefused  byte = 1
+	invitationStatusRedeemed byte = 2
+)
+
+var (
+	invitationIssuedKey   = ipfs_ds.NewKey("issued")
+	invitationRedeemedKey = ipfs_ds.NewKey("redeemed")
+)
+
+// Invitation is an out-of-band invitation to connect to a peer, rendered by
+// the clients as a QR code or a deep link. Its token can only be redeemed
+// once, before its expiry.
+type Invitation struct {
+	Version byte    `json:"-"`
+	PeerID  peer.ID `json:"peer"`
+
+	// Rendezvous are hints to reach the peer: its addrs, or the addrs of
+	// the rendezvous points it is registered on
+	Rendezvous []string `json:"rdv,omitempty"`
+
+	Token   []byte `json:"token"`
+	Expires int64  `json:"exp"`
+}
+
+// ExpiresAt returns the expiry of the invitation.
+func (inv *Invitation) ExpiresAt() time.Time {
+	return time.Unix(inv.Expires, 0)
+}
+
+// AddrInfo returns the addrs of the peer found in the hints of the
+// invitation.
+func (inv *Invitation) AddrInfo() peer.AddrInfo {
+	pi := peer.AddrInfo{ID: inv.PeerID}
+	for _, s := range inv.Rendezvous {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			continue
+		}
+
+		transport, id := peer.SplitAddr(addr)
+		if transport != nil && (id == "" || id == inv.PeerID) {
+			pi.Addrs = append(pi.Addrs, transport)
+		}
+	}
+
+	return pi
+}
+
+func invitationBody(inv *Invitation) ([]byte, error) {
+	body, err := json.Marshal(inv)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(inv.Version)
+
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	buf.Write(lenBuf[:binary.PutUvarint(lenBuf, uint64(len(body)))])
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// EncodeInvitation signs an invitation with the key of its peer, the result
+// is URL-safe.
+func EncodeInvitation(h host.Host, inv *Invitation) (string, error) {
+	sk := h.Peerstore().PrivKey(h.ID())
+	if sk == nil || inv.PeerID != h.ID() {
+		return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("invitation not issued by the host"))
+	}
+
+	body, err := invitationBody(inv)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := sk.Sign(body)
+	if err != nil {
+		return "", errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(append(body, sig...)), nil
+}
+
+// DecodeInvitation verifies an encoded invitation, it must be signed by the
+// key of its peer, inlined in the peer ID, and not be expired.
+func DecodeInvitation(encoded string, now time.Time) (*Invitation, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(data) > maxInvitationSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid invitation encoding"))
+	}
+
+	if len(data) == 0 || data[0] != InvitationVersion {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported invitation version"))
+	}
+
+	bodyLen, n := binary.Uvarint(data[1:])
+	if n <= 0 || bodyLen > uint64(len(data)-1-n) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("truncated invitation"))
+	}
+
+	signed := data[:1+n+int(bodyLen)]
+	inv := &Invitation{Version: data[0]}
+	if err := json.Unmarshal(signed[1+n:], inv); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	pk, err := inv.PeerID.ExtractPublicKey()
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if ok, err := pk.Verify(signed, data[len(signed):]); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification
+	}
+
+	if len(inv.Token) != invitationTokenSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid invitation token"))
+	}
+
+	if !now.Before(inv.ExpiresAt()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invitation expired"))
+	}
+
+	return inv, nil
+}
+
+// InvitationURL returns the deep link of an encoded invitation, its HTML
+// version is the https://berty.tech/invite#i=<encoded> link.
+func InvitationURL(encoded string) string {
+	return "berty://invite/#i=" + url.QueryEscape(encoded)
+}
+
+// ParseInvitationURL returns the encoded invitation of a deep link, or of its
+// HTML version.
+func ParseInvitationURL(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	switch {
+	case u.Scheme == "berty" && u.Host == "invite":
+	case u.Scheme == "https" && u.Host == "berty.tech" && u.Path == "/invite":
+	default:
+		return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("not an invitation link"))
+	}
+
+	query, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return "", errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	encoded := query.Get("i")
+	if encoded == "" {
+		return "", errcode.ErrMissingInput
+	}
+
+	return encoded, nil
+}
+
+// InvitationHandler is called on the issuer when an invitation is redeemed.
+type InvitationHandler func(p peer.ID, inv *Invitation)
+
+// InvitationOpts configures an invitation manager.
+type InvitationOpts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the issued and redeemed tokens
+	Datastore ipfs_ds.Datastore
+
+	Handler InvitationHandler
+}
+
+type invitationRecord struct {
+	Expires int64 `json:"exp"`
+}
+
+// InvitationManager issues the invitations of the host and redeems the
+// invitations of the other peers. The issued tokens are single-use: once
+// redeemed, they are kept until their expiry so they can't be replayed.
+type InvitationManager struct {
+	logger  *zap.Logger
+	host    host.Host
+	store   ipfs_ds.Datastore
+	handler InvitationHandler
+
+	muTokens sync.Mutex
+}
+
+func NewInvitationManager(h host.Host, opts InvitationOpts) (*InvitationManager, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("no invitation datastore"))
+	}
+
+	if opts.Handler == nil {
+		opts.Handler = func(peer.ID, *Invitation) {}
+	}
+
+	m := &InvitationManager{
+		logger:  opts.Logger,
+		host:    h,
+		store:   opts.Datastore,
+		handler: opts.Handler,
+	}
+
+	h.SetStreamHandler(InvitationProtocolID, m.handleStream)
+
+	return m, nil
+}
+
+// Issue creates an invitation valid for the given duration, reachable through
+// the given rendezvous hints in addition to the public addrs of the host.
+func (m *InvitationManager) Issue(ttl time.Duration, rendezvous []string) (*Invitation, string, error) {
+	if ttl <= 0 {
+		ttl = DefaultInvitationTTL
+	}
+
+	if ttl > MaxInvitationTTL {
+		return nil, "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("invitation ttl above %s", MaxInvitationTTL))
+	}
+
+	token := make([]byte, invitationTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, "", errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	hints := append([]string{}, rendezvous...)
+	for _, addr := range m.host.Addrs() {
+		if ClassifyAddr(addr) == ClassInternet {
+			hints = append(hints, addr.String())
+		}
+	}
+
+	inv := &Invitation{
+		Version:    InvitationVersion,
+		PeerID:     m.host.ID(),
+		Rendezvous: hints,
+		Token:      token,
+		Expires:    time.Now().Add(ttl).Unix(),
+	}
+
+	encoded, err := EncodeInvitation(m.host, inv)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := m.putRecord(invitationIssuedKey, token, inv.Expires); err != nil {
+		return nil, "", err
+	}
+
+	return inv, encoded, nil
+}
+
+// Redeem connects to the issuer of an invitation and redeems its token.
+func (m *InvitationManager) Redeem(ctx context.Context, encoded string) (*Invitation, error) {
+	inv, err := DecodeInvitation(encoded, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if inv.PeerID == m.host.ID() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("can't redeem own invitation"))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, invitationRedeemTimeout)
+	defer cancel()
+
+	pi := inv.AddrInfo()
+	m.host.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
+
+	if err := m.host.Connect(ctx, pi); err != nil {
+		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("unable to reach invitation issuer: %w", err))
+	}
+
+	s, err := m.host.NewStream(ctx, pi.ID, InvitationProtocolID)
+	if err != nil {
+		return nil, errcode.ErrStreamWrite.Wrap(err)
+	}
+	defer s.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+
+	if _, err := s.Write(inv.Token); err != nil {
+		_ = s.Reset()
+		return nil, errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(s, status); err != nil {
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	switch status[0] {
+	case invitationStatusOK:
+		return inv, nil
+	case invitationStatusRedeemed:
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invitation already redeemed"))
+	default:
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invitation refused"))
+	}
+}
+
+func (m *InvitationManager) handleStream(s network.Stream) {
+	defer s.Close()
+
+	_ = s.SetDeadline(time.Now().Add(invitationRedeemTimeout))
+
+	token := make([]byte, invitationTokenSize)
+	if _, err := io.ReadFull(s, token); err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	from := s.Conn().RemotePeer()
+	status, inv := m.redeem(token, time.Now())
+	if _, err := s.Write([]byte{status}); err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	if status != invitationStatusOK {
+		m.logger.Debug("invitation refused", zap.Stringer("peer", from), zap.Uint8("status", status))
+		return
+	}
+
+	m.handler(from, inv)
+}
+
+// redeem consumes an issued token.
+func (m *InvitationManager) redeem(token []byte, now time.Time) (byte, *Invitation) {
+	m.muTokens.Lock()
+	defer m.muTokens.Unlock()
+
+	if rec, err := m.getRecord(invitationRedeemedKey, token); err == nil && now.Before(time.Unix(rec.Expires, 0)) {
+		return invitationStatusRedeemed, nil
+	}
+
+	rec, err := m.getRecord(invitationIssuedKey, token)
+	if err != nil || !now.Before(time.Unix(rec.Expires, 0)) {
+		return invitationStatusRefused, nil
+	}
+
+	if err := m.putRecord(invitationRedeemedKey, token, rec.Expires); err != nil {
+		m.logger.Warn("unable to record redeemed invitation", zap.Error(err))
+		return invitationStatusRefused, nil
+	}
+
+	_ = m.store.Delete(tokenKey(invitationIssuedKey, token))
+
+	return invitationStatusOK, &Invitation{
+		Version: InvitationVersion,
+		PeerID:  m.host.ID(),
+		Token:   token,
+		Expires: rec.Expires,
+	}
+}
+
+// Expire drops the expired tokens, the redeemed ones can't be replayed
+// anymore once expired.
+func (m *InvitationManager) Expire(now time.Time) error {
+	m.muTokens.Lock()
+	defer m.muTokens.Unlock()
+
+	for _, prefix := range []ipfs_ds.Key{invitationIssuedKey, invitationRedeemedKey} {
+		res, err := m.store.Query(ipfs_dsq.Query{Prefix: prefix.String()})
+		if err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		entries, err := res.Rest()
+		if err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		for _, entry := range entries {
+			rec := &invitationRecord{}
+			if err := json.Unmarshal(entry.Value, rec); err == nil && now.Before(time.Unix(rec.Expires, 0)) {
+				continue
+			}
+
+			if err := m.store.Delete(ipfs_ds.RawKey(entry.Key)); err != nil {
+				return errcode.ErrInternal.Wrap(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func tokenKey(prefix ipfs_ds.Key, token []byte) ipfs_ds.Key {
+	return prefix.ChildString(hex.EncodeToString(token))
+}
+
+func (m *InvitationManager) putRecord(prefix ipfs_ds.Key, token []byte, expires int64) error {
+	data, err := json.Marshal(&invitationRecord{Expires: expires})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := m.store.Put(tokenKey(prefix, token), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (m *InvitationManager) getRecord(prefix ipfs_ds.Key, token []byte) (*invitationRecord, error) {
+	data, err := m.store.Get(tokenKey(prefix, token))
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &invitationRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,226 @@
+package ipfsutil
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	host "github.com/libp2p/go-libp2p-core/host"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testInvitationHosts returns linked hosts, their ed25519 keys are inlined
+// in their peer IDs like the keys of the Berty nodes.
+func testInvitationHosts(t *testing.T, ctx context.Context, n int) []host.Host {
+	t.Helper()
+
+	mn := libp2p_mocknet.New(ctx)
+
+	hosts := make([]host.Host, n)
+	for i := range hosts {
+		sk, _, err := crypto.GenerateEd25519Key(crand.Reader)
+		require.NoError(t, err)
+
+		hosts[i], err = mn.AddPeer(sk, ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4242+i)))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, mn.LinkAll())
+
+	return hosts
+}
+
+func testInvitationManager(t *testing.T, h host.Host, handler InvitationHandler) *InvitationManager {
+	t.Helper()
+
+	m, err := NewInvitationManager(h, InvitationOpts{
+		Datastore: ds_sync.MutexWrap(ipfs_ds.NewMapDatastore()),
+		Handler:   handler,
+	})
+	require.NoError(t, err)
+
+	return m
+}
+
+// tamper flips a bit of an encoded invitation, offset from the end.
+func tamper(t *testing.T, encoded string, offset int) string {
+	t.Helper()
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+
+	data[len(data)-offset] ^= 1
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestInvitationRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := testInvitationHosts(t, ctx, 1)
+	m := testInvitationManager(t, hosts[0], nil)
+
+	inv, encoded, err := m.Issue(time.Hour, []string{"/ip4/1.2.3.4/tcp/4242"})
+	require.NoError(t, err)
+
+	decoded, err := DecodeInvitation(encoded, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, hosts[0].ID(), decoded.PeerID)
+	assert.Equal(t, inv.Token, decoded.Token)
+	assert.Equal(t, inv.Expires, decoded.Expires)
+	assert.Equal(t, inv.Rendezvous, decoded.Rendezvous)
+	assert.Len(t, decoded.AddrInfo().Addrs, 1)
+
+	for _, link := range []string{InvitationURL(encoded), "https://berty.tech/invite#i=" + encoded} {
+		parsed, err := ParseInvitationURL(link)
+		require.NoError(t, err)
+		assert.Equal(t, encoded, parsed)
+	}
+
+	_, err = ParseInvitationURL("https://example.com/invite#i=" + encoded)
+	assert.Error(t, err)
+
+	_, _, err = m.Issue(MaxInvitationTTL+time.Hour, nil)
+	assert.Error(t, err)
+}
+
+func TestInvitationTamperedSignature(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := testInvitationHosts(t, ctx, 2)
+	m := testInvitationManager(t, hosts[0], nil)
+
+	inv, encoded, err := m.Issue(time.Hour, nil)
+	require.NoError(t, err)
+
+	_, err = DecodeInvitation(tamper(t, encoded, 1), time.Now())
+	assert.True(t, errcode.Is(err, errcode.ErrCryptoSignatureVerification), err)
+
+	// another token with the signature of the invitation
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+
+	sig := data[len(mustInvitationBody(t, inv)):]
+
+	other := *inv
+	other.Token = make([]byte, invitationTokenSize)
+
+	_, err = DecodeInvitation(base64.RawURLEncoding.EncodeToString(append(mustInvitationBody(t, &other), sig...)), time.Now())
+	assert.True(t, errcode.Is(err, errcode.ErrCryptoSignatureVerification), err)
+
+	// an invitation is only signed by the host it invites to
+	_, err = EncodeInvitation(hosts[1], inv)
+	assert.Error(t, err)
+
+	forged := *inv
+	forged.PeerID = hosts[1].ID()
+
+	body := mustInvitationBody(t, &forged)
+	sig, err = hosts[0].Peerstore().PrivKey(hosts[0].ID()).Sign(body)
+	require.NoError(t, err)
+
+	_, err = DecodeInvitation(base64.RawURLEncoding.EncodeToString(append(body, sig...)), time.Now())
+	assert.True(t, errcode.Is(err, errcode.ErrCryptoSignatureVerification), err)
+}
+
+func mustInvitationBody(t *testing.T, inv *Invitation) []byte {
+	t.Helper()
+
+	body, err := invitationBody(inv)
+	require.NoError(t, err)
+
+	return body
+}
+
+func TestInvitationExpired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := testInvitationHosts(t, ctx, 1)
+	m := testInvitationManager(t, hosts[0], nil)
+
+	inv, encoded, err := m.Issue(time.Hour, nil)
+	require.NoError(t, err)
+
+	_, err = DecodeInvitation(encoded, inv.ExpiresAt())
+	assert.Error(t, err)
+
+	// the issuer refuses the expired tokens, and forgets them
+	status, _ := m.redeem(inv.Token, inv.ExpiresAt())
+	assert.Equal(t, invitationStatusRefused, status)
+
+	require.NoError(t, m.Expire(inv.ExpiresAt()))
+
+	status, _ = m.redeem(inv.Token, time.Now())
+	assert.Equal(t, invitationStatusRefused, status)
+}
+
+func TestInvitationReplayedRedeem(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := testInvitationHosts(t, ctx, 3)
+
+	redeemed := make(chan peer.ID, 2)
+	issuer := testInvitationManager(t, hosts[0], func(p peer.ID, _ *Invitation) { redeemed <- p })
+	alice := testInvitationManager(t, hosts[1], nil)
+	bob := testInvitationManager(t, hosts[2], nil)
+
+	addrs := []string{}
+	for _, addr := range hosts[0].Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+
+	inv, encoded, err := issuer.Issue(time.Hour, addrs)
+	require.NoError(t, err)
+
+	// the issuer can't redeem its own invitation
+	_, err = issuer.Redeem(ctx, encoded)
+	assert.Error(t, err)
+
+	got, err := alice.Redeem(ctx, encoded)
+	require.NoError(t, err)
+	assert.Equal(t, inv.Token, got.Token)
+
+	select {
+	case p := <-redeemed:
+		assert.Equal(t, hosts[1].ID(), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("invitation not redeemed")
+	}
+
+	// the token is single-use, whoever replays it
+	_, err = alice.Redeem(ctx, encoded)
+	assert.Error(t, err)
+
+	_, err = bob.Redeem(ctx, encoded)
+	assert.Error(t, err)
+
+	status, _ := issuer.redeem(inv.Token, time.Now())
+	assert.Equal(t, invitationStatusRedeemed, status)
+
+	// the redeemed token is kept until its expiry
+	require.NoError(t, issuer.Expire(time.Now()))
+
+	status, _ = issuer.redeem(inv.Token, time.Now())
+	assert.Equal(t, invitationStatusRedeemed, status)
+
+	select {
+	case p := <-redeemed:
+		t.Fatalf("invitation redeemed again by %s", p)
+	default:
+	}
+}
@@ -0,0 +1,202 @@
+package ipfsutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-ipfs/keystore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// KeyWrapper seals the private keys of a keystore with a key it holds, e.g.
+// in the Secure Enclave or the Android Keystore where the key can't be
+// exported.
+type KeyWrapper interface {
+	Wrap(data []byte) ([]byte, error)
+	Unwrap(data []byte) ([]byte, error)
+
+	// Hardware reports whether the key of the wrapper is held by a secure
+	// hardware
+	Hardware() bool
+}
+
+// wrappedKeyMagic prefixes the wrapped keys, a marshaled private key starts
+// with the protobuf tag of its type instead
+var wrappedKeyMagic = []byte("bwk1")
+
+type softwareKeyWrapper struct {
+	key []byte
+}
+
+// NewSoftwareKeyWrapper returns a wrapper sealing the keys with a 32 bytes
+// key, the fallback of the devices without a secure hardware.
+func NewSoftwareKeyWrapper(key []byte) (KeyWrapper, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid key wrapper key size"))
+	}
+
+	return &softwareKeyWrapper{key: append([]byte{}, key...)}, nil
+}
+
+func (w *softwareKeyWrapper) Wrap(data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(w.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (w *softwareKeyWrapper) Unwrap(data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(w.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+func (w *softwareKeyWrapper) Hardware() bool { return false }
+
+// wrappedKeystore stores the private keys wrapped in a datastore, they are
+// unwrapped when they're read.
+type wrappedKeystore struct {
+	ds datastore.Datastore
+	w  KeyWrapper
+}
+
+// NewWrappedKeystore returns a keystore wrapping its keys with w, the keys
+// stored unwrapped by a datastore keystore are wrapped on their first use.
+//
+// A key wrapped by a secure hardware can only be unwrapped on the device it
+// was wrapped on, the account is moved to another device by an account
+// export or by linking the devices.
+func NewWrappedKeystore(ds datastore.Datastore, w KeyWrapper) keystore.Keystore {
+	return &wrappedKeystore{ds: ds, w: w}
+}
+
+// the name is sealed with the key, so a wrapped key can't be swapped with
+// another one of the keystore
+func (k *wrappedKeystore) wrap(name string, key crypto.PrivKey) ([]byte, error) {
+	raw, err := key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := append(append([]byte(name), 0), raw...)
+	wrapped, err := k.w.Wrap(plaintext)
+	if err != nil {
+		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
+	}
+
+	return append(append([]byte{}, wrappedKeyMagic...), wrapped...), nil
+}
+
+func (k *wrappedKeystore) unwrap(name string, data []byte) (crypto.PrivKey, error) {
+	plaintext, err := k.w.Unwrap(data[len(wrappedKeyMagic):])
+	if err != nil {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+	}
+
+	prefix := append([]byte(name), 0)
+	if !bytes.HasPrefix(plaintext, prefix) {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("wrapped key of another name"))
+	}
+
+	return crypto.UnmarshalPrivateKey(plaintext[len(prefix):])
+}
+
+func (k *wrappedKeystore) Has(name string) (bool, error) {
+	return k.ds.Has(datastore.NewKey(name))
+}
+
+func (k *wrappedKeystore) Put(name string, key crypto.PrivKey) error {
+	data, err := k.wrap(name, key)
+	if err != nil {
+		return err
+	}
+
+	return k.ds.Put(datastore.NewKey(name), data)
+}
+
+func (k *wrappedKeystore) Get(name string) (crypto.PrivKey, error) {
+	data, err := k.ds.Get(datastore.NewKey(name))
+	if err == datastore.ErrNotFound {
+		return nil, keystore.ErrNoSuchKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, wrappedKeyMagic) {
+		return k.unwrap(name, data)
+	}
+
+	// stored before the keystore was wrapped
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := k.Put(name, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (k *wrappedKeystore) Delete(name string) error {
+	return k.ds.Delete(datastore.NewKey(name))
+}
+
+func (k *wrappedKeystore) List() ([]string, error) {
+	return nil, errcode.ErrNotImplemented
+}
+
+// WrapKeystoreKeys wraps with w the keys stored unwrapped in the datastore
+// of a keystore, it returns the number of keys wrapped.
+func WrapKeystoreKeys(ds datastore.Datastore, w KeyWrapper) (int, error) {
+	res, err := ds.Query(query.Query{})
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return 0, err
+	}
+
+	k := &wrappedKeystore{ds: ds, w: w}
+	count := 0
+	for _, entry := range entries {
+		if bytes.HasPrefix(entry.Value, wrappedKeyMagic) {
+			continue
+		}
+
+		key, err := crypto.UnmarshalPrivateKey(entry.Value)
+		if err != nil {
+			continue
+		}
+
+		if err := k.Put(datastore.RawKey(entry.Key).String()[1:], key); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,36 @@
+package ipfsutil
+
+import (
+	mcma "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/multiaddr"
+	host "github.com/libp2p/go-libp2p-core/host"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// IsConstrainedAddr reports whether the given multiaddr is a low-bandwidth
+// link, i.e. a proximity transport or a relayed connection.
+func IsConstrainedAddr(addr ma.Multiaddr) bool {
+	for _, p := range addr.Protocols() {
+		if p.Code == mcma.P_MC || p.Code == ma.P_CIRCUIT {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ConstrainedLinksOnly reports whether every open connection of the host is
+// a low-bandwidth link. It returns false when the host isn't connected.
+func ConstrainedLinksOnly(h host.Host) bool {
+	conns := h.Network().Conns()
+	if len(conns) == 0 {
+		return false
+	}
+
+	for _, c := range conns {
+		if !IsConstrainedAddr(c.RemoteMultiaddr()) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -7,31 +7,125 @@ import (
 	"berty.tech/berty/v2/go/pkg/errcode"
 	ipfs_core "github.com/ipfs/go-ipfs/core"
 	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	host "github.com/libp2p/go-libp2p-core/host"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p/p2p/discovery"
+	"go.uber.org/zap"
 )
 
+const (
+	// DefaultMDNSInterval is the interval between two mDNS queries
+	DefaultMDNSInterval = 5 * time.Second
+
+	// DefaultMDNSPeerTTL is how long the addrs of a peer found on the LAN are
+	// kept in the peerstore
+	DefaultMDNSPeerTTL = 10 * time.Minute
+
+	defaultMDNSDialTimeout = 15 * time.Second
+)
+
+// MDNSOpts contains the configuration of the LAN discovery.
+type MDNSOpts struct {
+	Logger   *zap.Logger
+	Interval time.Duration
+	PeerTTL  time.Duration
+
+	// ServiceTag is the mDNS service name, the default libp2p one is used if
+	// empty
+	ServiceTag string
+
+	// PeerFilter, if set, is used to only dial the peers found on the LAN
+	// that are known, e.g. the devices of the contacts. The other peers are
+	// only added to the peerstore.
+	PeerFilter func(peer.ID) bool
+}
+
+func (opts *MDNSOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultMDNSInterval
+	}
+
+	if opts.PeerTTL <= 0 {
+		opts.PeerTTL = DefaultMDNSPeerTTL
+	}
+}
+
 type DiscoveryNotifee struct {
-	api ipfs_interface.CoreAPI
+	ctx    context.Context
+	logger *zap.Logger
+	host   host.Host
+	ttl    time.Duration
+	filter func(peer.ID) bool
 }
 
 func (n *DiscoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
-	if err := n.api.Swarm().Connect(context.Background(), pi); err != nil {
-		_ = err
-		// TODO: log
-		// println("HandlePeerFound: Unable to connect to peer", err.Error())
+	if pi.ID == n.host.ID() {
+		return
+	}
+
+	n.host.Peerstore().AddAddrs(pi.ID, pi.Addrs, n.ttl)
+
+	if n.filter != nil && !n.filter(pi.ID) {
+		n.logger.Debug("mdns: skipping unknown peer", zap.Stringer("peer", pi.ID))
+		return
 	}
+
+	if len(n.host.Network().ConnsToPeer(pi.ID)) > 0 {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(n.ctx, defaultMDNSDialTimeout)
+		defer cancel()
+
+		if err := n.host.Connect(ctx, pi); err != nil {
+			n.logger.Debug("mdns: unable to connect to peer", zap.Stringer("peer", pi.ID), zap.Error(err))
+			return
+		}
+
+		n.logger.Debug("mdns: connected to peer", zap.Stringer("peer", pi.ID))
+	}()
 }
 
-func OptionMDNSDiscovery(ctx context.Context, node *ipfs_core.IpfsNode, api ipfs_interface.CoreAPI) error {
-	s, err := discovery.NewMdnsService(ctx, node.PeerHost, time.Second, "")
+// NewMDNSDiscovery starts looking for the peers on the LAN, they are added to
+// the peerstore and dialed if they pass the filter.
+func NewMDNSDiscovery(ctx context.Context, h host.Host, opts MDNSOpts) (discovery.Service, error) {
+	opts.applyDefaults()
+
+	s, err := discovery.NewMdnsService(ctx, h, opts.Interval, opts.ServiceTag)
 	if err != nil {
-		return errcode.TODO.Wrap(err)
+		return nil, errcode.TODO.Wrap(err)
 	}
 
-	n := &DiscoveryNotifee{api: api}
+	s.RegisterNotifee(&DiscoveryNotifee{
+		ctx:    ctx,
+		logger: opts.Logger,
+		host:   h,
+		ttl:    opts.PeerTTL,
+		filter: opts.PeerFilter,
+	})
 
-	s.RegisterNotifee(n)
+	return s, nil
+}
 
-	return nil
+// OptionMDNSDiscovery returns a CoreAPIOption starting the LAN discovery on the
+// node host.
+func OptionMDNSDiscovery(opts MDNSOpts) CoreAPIOption {
+	return func(ctx context.Context, node *ipfs_core.IpfsNode, _ ipfs_interface.CoreAPI) error {
+		s, err := NewMDNSDiscovery(ctx, node.PeerHost, opts)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			<-ctx.Done()
+			_ = s.Close()
+		}()
+
+		return nil
+	}
 }
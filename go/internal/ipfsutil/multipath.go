@@ -0,0 +1,461 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ipfs_libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
+	p2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	p2p_ps "github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	ma "github.com/multiformats/go-multiaddr"
+	msmux "github.com/multiformats/go-multistream"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMultipathCheckInterval is the interval between two checks of the
+	// paths to the peers
+	DefaultMultipathCheckInterval = 30 * time.Second
+
+	multipathDialTimeout   = 15 * time.Second
+	multipathInjectTimeout = 5 * time.Second
+)
+
+// ErrNoMultipathListener is returned when a second path can't be handed to
+// the swarm, none of the wrapped transports is listening.
+var ErrNoMultipathListener = fmt.Errorf("no multipath listener")
+
+// PathKind is the kind of a path to a peer, the proximity transports and the
+// IP ones fail independently.
+type PathKind string
+
+const (
+	PathProximity PathKind = "proximity"
+	PathIP        PathKind = "ip"
+)
+
+// PathKindOf returns the kind of the path of a multiaddr.
+func PathKindOf(addr ma.Multiaddr) PathKind {
+	switch ClassifyAddr(addr) {
+	case ClassBLE, ClassWifi:
+		return PathProximity
+	}
+
+	return PathIP
+}
+
+// MultipathPolicy selects the path the new streams to a peer are opened on.
+type MultipathPolicy string
+
+const (
+	// MultipathPrefer opens the streams on the path ranked best by the
+	// transport policy
+	MultipathPrefer MultipathPolicy = "prefer"
+
+	// MultipathBalance opens the streams on the path with the fewest streams
+	MultipathBalance MultipathPolicy = "balance"
+)
+
+// ParseMultipathPolicy parses a multipath policy, it defaults to
+// MultipathPrefer if empty.
+func ParseMultipathPolicy(s string) (MultipathPolicy, error) {
+	switch p := MultipathPolicy(s); p {
+	case "":
+		return MultipathPrefer, nil
+	case MultipathPrefer, MultipathBalance:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown multipath policy %q", s)
+}
+
+// MultipathOpts configures a multipath manager.
+type MultipathOpts struct {
+	Logger *zap.Logger
+
+	Policy MultipathPolicy
+
+	// Ranking ranks the paths for MultipathPrefer, a default transport
+	// policy is used if nil
+	Ranking *TransportPolicy
+
+	// Peers returns the peers kept connected over both kinds of paths, e.g.
+	// the peers of the active conversations
+	Peers func() []peer.ID
+
+	CheckInterval time.Duration
+}
+
+func (opts *MultipathOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Policy == "" {
+		opts.Policy = MultipathPrefer
+	}
+
+	if opts.Ranking == nil {
+		opts.Ranking = NewTransportPolicy(TransportPolicyOpts{})
+	}
+
+	if opts.Peers == nil {
+		opts.Peers = func() []peer.ID { return nil }
+	}
+
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = DefaultMultipathCheckInterval
+	}
+}
+
+// Multipath keeps the given peers connected over both a proximity path and
+// an IP one when their addrs allow it, so losing a path doesn't stall the
+// conversations: the streams reset with the dead connection are reopened by
+// the protocols on the remaining one, as the peer is still connected.
+//
+// The swarm reuses the connection to a peer instead of dialing a second one,
+// the second path is dialed through the transport of the addr then handed to
+// the swarm by one of the listeners of the transports wrapped by
+// WrapTransport, the swarm sees it as an inbound connection. No second path
+// is opened if none of them is listening.
+type Multipath struct {
+	logger *zap.Logger
+	opts   MultipathOpts
+	notify chan struct{}
+
+	muListeners sync.Mutex
+	listeners   map[*multipathListener]struct{}
+}
+
+func NewMultipath(opts MultipathOpts) *Multipath {
+	opts.applyDefaults()
+
+	return &Multipath{
+		logger:    opts.Logger,
+		opts:      opts,
+		notify:    make(chan struct{}, 1),
+		listeners: make(map[*multipathListener]struct{}),
+	}
+}
+
+// HostOption returns a host option whose hosts open the streams on the path
+// selected by the policy, the paths are checked until the context of the host
+// is done.
+func (m *Multipath) HostOption(hf ipfs_libp2p.HostOption) ipfs_libp2p.HostOption {
+	return func(ctx context.Context, id peer.ID, ps p2p_ps.Peerstore, options ...p2p.Option) (host.Host, error) {
+		h, err := hf(ctx, id, ps, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		m.start(ctx, h)
+
+		return &multipathHost{Host: h, multipath: m}, nil
+	}
+}
+
+// WrapTransport returns a transport whose listeners can hand the second
+// paths to the swarm.
+func (m *Multipath) WrapTransport(t tpt.Transport) tpt.Transport {
+	return &multipathTransport{Transport: t, multipath: m}
+}
+
+func (m *Multipath) start(ctx context.Context, h host.Host) {
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			p := c.RemotePeer()
+			if n.Connectedness(p) != network.Connected {
+				return
+			}
+
+			kind := PathKindOf(c.RemoteMultiaddr())
+			if hasPathKind(n.ConnsToPeer(p), kind) {
+				return
+			}
+
+			m.logger.Info("path lost, failing over", zap.Stringer("peer", p), zap.String("path", string(kind)))
+
+			select {
+			case m.notify <- struct{}{}:
+			default:
+			}
+		},
+	})
+
+	go func() {
+		ticker := time.NewTicker(m.opts.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-m.notify:
+			case <-ctx.Done():
+				return
+			}
+
+			m.check(ctx, h)
+		}
+	}()
+}
+
+// check dials the missing path of the peers, one at a time so the radio
+// transports aren't choked.
+func (m *Multipath) check(ctx context.Context, h host.Host) {
+	sw, ok := h.Network().(*swarm.Swarm)
+	if !ok || !m.listening() {
+		return
+	}
+
+	for _, p := range m.opts.Peers() {
+		conns := h.Network().ConnsToPeer(p)
+		if len(conns) == 0 {
+			continue
+		}
+
+		for _, kind := range []PathKind{PathProximity, PathIP} {
+			if hasPathKind(conns, kind) {
+				continue
+			}
+
+			if err := m.dialPath(ctx, sw, h.Peerstore().Addrs(p), p, kind); err != nil {
+				m.logger.Debug("unable to open second path", zap.Stringer("peer", p), zap.String("path", string(kind)), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (m *Multipath) dialPath(ctx context.Context, sw *swarm.Swarm, addrs []ma.Multiaddr, p peer.ID, kind PathKind) error {
+	candidates := []ma.Multiaddr{}
+	for _, addr := range addrs {
+		if PathKindOf(addr) == kind {
+			candidates = append(candidates, addr)
+		}
+	}
+
+	err := fmt.Errorf("no %s addr", kind)
+	for _, addr := range m.opts.Ranking.Rank(candidates) {
+		t := sw.TransportForDialing(addr)
+		if t == nil {
+			continue
+		}
+
+		dctx, cancel := context.WithTimeout(ctx, multipathDialTimeout)
+		var c tpt.CapableConn
+		c, err = t.Dial(dctx, addr, p)
+		cancel()
+
+		if err != nil {
+			continue
+		}
+
+		if err = m.inject(ctx, c); err != nil {
+			_ = c.Close()
+			return err
+		}
+
+		m.logger.Debug("second path opened", zap.Stringer("peer", p), zap.String("path", string(kind)), zap.Stringer("addr", addr))
+
+		return nil
+	}
+
+	return err
+}
+
+func (m *Multipath) listening() bool {
+	m.muListeners.Lock()
+	defer m.muListeners.Unlock()
+
+	return len(m.listeners) > 0
+}
+
+// inject hands a connection to the swarm through one of the listeners.
+func (m *Multipath) inject(ctx context.Context, c tpt.CapableConn) error {
+	m.muListeners.Lock()
+	var l *multipathListener
+	for l = range m.listeners {
+		break
+	}
+	m.muListeners.Unlock()
+
+	if l == nil {
+		return ErrNoMultipathListener
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, multipathInjectTimeout)
+	defer cancel()
+
+	select {
+	case l.injected <- c:
+		return nil
+	case <-l.closed:
+		return ErrNoMultipathListener
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pick returns the connection the new streams are opened on.
+func (m *Multipath) pick(conns []network.Conn) network.Conn {
+	best := conns[0]
+	for _, c := range conns[1:] {
+		switch m.opts.Policy {
+		case MultipathBalance:
+			if len(c.GetStreams()) < len(best.GetStreams()) {
+				best = c
+			}
+		default:
+			if m.opts.Ranking.compare(ClassifyAddr(c.RemoteMultiaddr()), ClassifyAddr(best.RemoteMultiaddr())) < 0 {
+				best = c
+			}
+		}
+	}
+
+	return best
+}
+
+func hasPathKind(conns []network.Conn, kind PathKind) bool {
+	for _, c := range conns {
+		if PathKindOf(c.RemoteMultiaddr()) == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+type multipathHost struct {
+	host.Host
+	multipath *Multipath
+}
+
+// NewStream opens the stream on the path selected by the policy when the
+// peer is connected through several paths.
+func (h *multipathHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	conns := h.Network().ConnsToPeer(p)
+	if len(conns) < 2 {
+		return h.Host.NewStream(ctx, p, pids...)
+	}
+
+	s, err := h.multipath.pick(conns).NewStream()
+	if err != nil {
+		// the path is dying, the swarm picks another one
+		return h.Host.NewStream(ctx, p, pids...)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+		defer s.SetDeadline(time.Time{}) // nolint:errcheck
+	}
+
+	selected, err := msmux.SelectOneOf(protocol.ConvertToStrings(pids), s)
+	if err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+
+	s.SetProtocol(protocol.ID(selected))
+	_ = h.Peerstore().AddProtocols(p, selected)
+
+	return s, nil
+}
+
+type multipathTransport struct {
+	tpt.Transport
+	multipath *Multipath
+}
+
+func (t *multipathTransport) Listen(laddr ma.Multiaddr) (tpt.Listener, error) {
+	l, err := t.Transport.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ml := &multipathListener{
+		Listener:  l,
+		multipath: t.multipath,
+		accepted:  make(chan acceptResult),
+		injected:  make(chan tpt.CapableConn),
+		closed:    make(chan struct{}),
+	}
+
+	t.multipath.muListeners.Lock()
+	t.multipath.listeners[ml] = struct{}{}
+	t.multipath.muListeners.Unlock()
+
+	go ml.acceptLoop()
+
+	return ml, nil
+}
+
+func (t *multipathTransport) String() string {
+	return fmt.Sprint(t.Transport)
+}
+
+type acceptResult struct {
+	conn tpt.CapableConn
+	err  error
+}
+
+// multipathListener merges the connections accepted by the listener and the
+// second paths dialed by the multipath manager.
+type multipathListener struct {
+	tpt.Listener
+	multipath *Multipath
+
+	accepted  chan acceptResult
+	injected  chan tpt.CapableConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *multipathListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+
+		select {
+		case l.accepted <- acceptResult{conn: c, err: err}:
+		case <-l.closed:
+			if c != nil {
+				_ = c.Close()
+			}
+
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (l *multipathListener) Accept() (tpt.CapableConn, error) {
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case c := <-l.injected:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+func (l *multipathListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		l.multipath.muListeners.Lock()
+		delete(l.multipath.listeners, l)
+		l.multipath.muListeners.Unlock()
+	})
+
+	return l.Listener.Close()
+}
@@ -0,0 +1,297 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultNetworkDebounce is the delay the reactor waits for the
+	// connectivity to settle, the platforms report a transition as a burst
+	// of events
+	DefaultNetworkDebounce = 2 * time.Second
+
+	// DefaultNetworkPollInterval is the interval between two checks of the
+	// interface addrs, for the platforms which don't report the transitions
+	DefaultNetworkPollInterval = 30 * time.Second
+
+	networkRedialTimeout = 15 * time.Second
+	maxNetworkRedials    = 8
+)
+
+// Connectivity is the kind of network the device is connected to, as
+// reported by the platform.
+type Connectivity string
+
+const (
+	ConnectivityNone     Connectivity = "none"
+	ConnectivityWiFi     Connectivity = "wifi"
+	ConnectivityCellular Connectivity = "cellular"
+	ConnectivityEthernet Connectivity = "ethernet"
+	ConnectivityUnknown  Connectivity = "unknown"
+)
+
+// ParseConnectivity parses a connectivity reported by the platform.
+func ParseConnectivity(s string) (Connectivity, error) {
+	switch c := Connectivity(s); c {
+	case ConnectivityNone, ConnectivityWiFi, ConnectivityCellular, ConnectivityEthernet, ConnectivityUnknown:
+		return c, nil
+	}
+
+	return "", fmt.Errorf("unknown connectivity %q", s)
+}
+
+// NetworkReactorOpts configures a network reactor.
+type NetworkReactorOpts struct {
+	Logger *zap.Logger
+
+	// Peers returns the peers re-dialed after a transition, e.g. the peers
+	// of the active conversations
+	Peers func() []peer.ID
+
+	Debounce     time.Duration
+	PollInterval time.Duration
+}
+
+func (opts *NetworkReactorOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Peers == nil {
+		opts.Peers = func() []peer.ID { return nil }
+	}
+
+	if opts.Debounce <= 0 {
+		opts.Debounce = DefaultNetworkDebounce
+	}
+
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultNetworkPollInterval
+	}
+}
+
+// NetworkReactor reacts to the connectivity transitions, e.g. from cellular
+// to Wi-Fi: it refreshes the addrs announced by the host, closes the
+// connections bound to the addrs gone with the previous network, then
+// re-dials the given peers.
+//
+// The transitions are reported by the platform through Changed, and detected
+// by polling the interface addrs otherwise.
+type NetworkReactor struct {
+	logger *zap.Logger
+	host   host.Host
+	opts   NetworkReactorOpts
+	notify chan struct{}
+
+	muState      sync.Mutex
+	connectivity Connectivity
+}
+
+func NewNetworkReactor(h host.Host, opts NetworkReactorOpts) *NetworkReactor {
+	opts.applyDefaults()
+
+	return &NetworkReactor{
+		logger:       opts.Logger,
+		host:         h,
+		opts:         opts,
+		notify:       make(chan struct{}, 1),
+		connectivity: ConnectivityUnknown,
+	}
+}
+
+// Changed reports a connectivity transition.
+func (r *NetworkReactor) Changed(connectivity Connectivity) {
+	r.muState.Lock()
+	previous := r.connectivity
+	r.connectivity = connectivity
+	r.muState.Unlock()
+
+	r.logger.Debug("connectivity changed", zap.String("from", string(previous)), zap.String("to", string(connectivity)))
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Connectivity returns the last connectivity reported.
+func (r *NetworkReactor) Connectivity() Connectivity {
+	r.muState.Lock()
+	defer r.muState.Unlock()
+
+	return r.connectivity
+}
+
+// Start reacts to the transitions until the context is done.
+func (r *NetworkReactor) Start(ctx context.Context) {
+	go func() {
+		poll := time.NewTicker(r.opts.PollInterval)
+		defer poll.Stop()
+
+		lastAddrs := interfaceAddrs()
+
+		for {
+			select {
+			case <-r.notify:
+			case <-poll.C:
+				addrs := interfaceAddrs()
+				if sameAddrSet(addrs, lastAddrs) {
+					continue
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			// waits for the network to settle, the next events are merged
+			select {
+			case <-time.After(r.opts.Debounce):
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case <-r.notify:
+			default:
+			}
+
+			lastAddrs = interfaceAddrs()
+			r.react(ctx, lastAddrs)
+		}
+	}()
+}
+
+func (r *NetworkReactor) react(ctx context.Context, addrs map[string]struct{}) {
+	// the host also refreshes its addrs periodically, the identify push
+	// announces them to the connected peers
+	if signaler, ok := r.host.(interface{ SignalAddressChange() }); ok {
+		signaler.SignalAddressChange()
+	}
+
+	closed := 0
+	for _, c := range r.host.Network().Conns() {
+		if isDeadConn(c, addrs) {
+			_ = c.Close()
+			closed++
+		}
+	}
+
+	if r.Connectivity() == ConnectivityNone {
+		r.logger.Info("network lost", zap.Int("closed", closed))
+		return
+	}
+
+	redialed := r.redial(ctx)
+	r.logger.Info("network changed", zap.Int("closed", closed), zap.Int("redialed", redialed))
+}
+
+// Redial dials the peers which have no connection left, e.g. when the app
+// is woken up in the background, it returns the number of peers
+// reconnected.
+func (r *NetworkReactor) Redial(ctx context.Context) int {
+	return r.redial(ctx)
+}
+
+// redial dials the peers which have no connection left, it returns the
+// number of peers reconnected.
+func (r *NetworkReactor) redial(ctx context.Context) int {
+	var (
+		wg       sync.WaitGroup
+		muCount  sync.Mutex
+		redialed int
+	)
+
+	sem := make(chan struct{}, maxNetworkRedials)
+	for _, p := range r.opts.Peers() {
+		if r.host.Network().Connectedness(p) == network.Connected {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p peer.ID) {
+			defer func() { <-sem; wg.Done() }()
+
+			dctx, cancel := context.WithTimeout(ctx, networkRedialTimeout)
+			defer cancel()
+
+			// the backoff of the previous failures doesn't apply to the new
+			// network
+			if sw, ok := r.host.Network().(*swarm.Swarm); ok {
+				sw.Backoff().Clear(p)
+			}
+
+			if err := r.host.Connect(dctx, peer.AddrInfo{ID: p}); err != nil {
+				r.logger.Debug("unable to redial peer", zap.Stringer("peer", p), zap.Error(err))
+				return
+			}
+
+			muCount.Lock()
+			redialed++
+			muCount.Unlock()
+		}(p)
+	}
+
+	wg.Wait()
+
+	return redialed
+}
+
+// isDeadConn reports whether the local addr of the connection is gone, the
+// connections of the proximity transports and the relayed ones are kept,
+// the underlying connection of the latter is checked on its own.
+func isDeadConn(c network.Conn, addrs map[string]struct{}) bool {
+	if IsConstrainedAddr(c.RemoteMultiaddr()) {
+		return false
+	}
+
+	ip, err := manet.ToIP(c.LocalMultiaddr())
+	if err != nil || ip.IsUnspecified() || ip.IsLoopback() {
+		return false
+	}
+
+	_, ok := addrs[ip.String()]
+
+	return !ok
+}
+
+// interfaceAddrs returns the IPs of the interfaces of the device.
+func interfaceAddrs() map[string]struct{} {
+	addrs := make(map[string]struct{})
+
+	maddrs, err := manet.InterfaceMultiaddrs()
+	if err != nil {
+		return addrs
+	}
+
+	for _, maddr := range maddrs {
+		if ip, err := manet.ToIP(maddr); err == nil {
+			addrs[ip.String()] = struct{}{}
+		}
+	}
+
+	return addrs
+}
+
+func sameAddrSet(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for addr := range a {
+		if _, ok := b[addr]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
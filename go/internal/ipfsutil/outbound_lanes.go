@@ -0,0 +1,170 @@
+package ipfsutil
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Priority is the class of the data sent to a peer, the data of a higher
+// class is always sent first.
+type Priority int
+
+const (
+	// PriorityMedia is for the bulk transfers, e.g. the attachment chunks
+	PriorityMedia Priority = iota
+
+	// PriorityText is for the messages of the conversations
+	PriorityText
+
+	// PriorityControl is for the small signals, e.g. the acknowledgements
+	PriorityControl
+
+	priorityCount = int(PriorityControl) + 1
+)
+
+// laneFrameSize bounds how long a write holds the lane of a peer, so a
+// bulk transfer yields quickly to the higher classes
+const laneFrameSize = 16 << 10
+
+// OutboundLanes schedules the writes to each peer by priority: a wrapped
+// stream writes by frames, each frame waits while the peer has data of a
+// higher class to send. A nil OutboundLanes doesn't schedule anything.
+type OutboundLanes struct {
+	mu    sync.Mutex
+	peers map[peer.ID]*peerLane
+}
+
+type peerLane struct {
+	cond    *sync.Cond
+	refs    int
+	busy    bool
+	waiting [priorityCount]int
+}
+
+// NewOutboundLanes returns an empty scheduler.
+func NewOutboundLanes() *OutboundLanes {
+	return &OutboundLanes{peers: make(map[peer.ID]*peerLane)}
+}
+
+// lane returns the lane of a peer with the lock of its scheduler held, put
+// has to be called once done.
+func (l *OutboundLanes) lane(p peer.ID) *peerLane {
+	l.mu.Lock()
+
+	lane, ok := l.peers[p]
+	if !ok {
+		lane = &peerLane{cond: sync.NewCond(&l.mu)}
+		l.peers[p] = lane
+	}
+	lane.refs++
+
+	return lane
+}
+
+func (l *OutboundLanes) put(p peer.ID, lane *peerLane) {
+	if lane.refs--; lane.refs == 0 {
+		delete(l.peers, p)
+	}
+
+	l.mu.Unlock()
+}
+
+func (lane *peerLane) higherWaiting(prio Priority) bool {
+	for q := int(prio) + 1; q < priorityCount; q++ {
+		if lane.waiting[q] > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acquire waits for the lane of a peer, it returns the function releasing
+// it.
+func (l *OutboundLanes) acquire(p peer.ID, prio Priority) func() {
+	lane := l.lane(p)
+
+	lane.waiting[prio]++
+	for lane.busy || lane.higherWaiting(prio) {
+		lane.cond.Wait()
+	}
+	lane.waiting[prio]--
+	lane.busy = true
+
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		lane.busy = false
+		lane.cond.Broadcast()
+		l.put(p, lane)
+	}
+}
+
+// Hold makes the lower classes yield to the given peers until the returned
+// function is called, for the data sent by another path than a wrapped
+// stream, e.g. a pubsub message.
+func (l *OutboundLanes) Hold(peers []peer.ID, prio Priority) func() {
+	if l == nil || len(peers) == 0 {
+		return func() {}
+	}
+
+	lanes := make([]*peerLane, len(peers))
+	for i, p := range peers {
+		lanes[i] = l.lane(p)
+		lanes[i].waiting[prio]++
+		l.mu.Unlock()
+	}
+
+	return func() {
+		for i, p := range peers {
+			l.mu.Lock()
+			lanes[i].waiting[prio]--
+			lanes[i].cond.Broadcast()
+			l.put(p, lanes[i])
+		}
+	}
+}
+
+// Stream schedules the writes of a stream in the lane of its peer.
+func (l *OutboundLanes) Stream(s network.Stream, prio Priority) network.Stream {
+	if l == nil {
+		return s
+	}
+
+	return &laneStream{Stream: s, lanes: l, prio: prio}
+}
+
+type laneStream struct {
+	network.Stream
+
+	lanes *OutboundLanes
+	prio  Priority
+}
+
+func (s *laneStream) Write(b []byte) (int, error) {
+	p := s.Conn().RemotePeer()
+
+	written := 0
+	for len(b) > 0 {
+		frame := b
+		if len(frame) > laneFrameSize {
+			frame = frame[:laneFrameSize]
+		}
+
+		release := s.lanes.acquire(p, s.prio)
+		n, err := s.Stream.Write(frame)
+		release()
+
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,552 @@
+package ipfsutil
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultPeerScoresUpdateInterval is the interval between two updates of
+	// the tags of the peers in the connection manager and of the relays
+	DefaultPeerScoresUpdateInterval = 30 * time.Second
+
+	// DefaultPeerScoresPersistInterval is the interval between two writes of
+	// the scores
+	DefaultPeerScoresPersistInterval = 5 * time.Minute
+
+	// DefaultPeerScoresHalfLife is the duration after which the deliveries
+	// and the misbehaviors of a peer weigh half as much, a peer isn't judged
+	// forever on its past
+	DefaultPeerScoresHalfLife = 24 * time.Hour
+
+	// DefaultMinRelayScore is the score under which a relay is disconnected
+	// so another one is selected
+	DefaultMinRelayScore = 20
+
+	// DefaultBanScore is the score under which the connections of a peer are
+	// closed as soon as they are opened, until its misbehaviors decay
+	DefaultBanScore = -50
+
+	// PeerScoreTag is the tag of the score of the peers in the connection
+	// manager, the peers with the lowest scores are pruned first
+	PeerScoreTag = "berty-peer-score"
+
+	// relayProtectTag protects the connections of the relays the node is
+	// reachable through, with a good score
+	relayProtectTag = "berty-peer-score-relay"
+
+	// maxPersistedPeerScores caps the peers persisted, the ones seen the
+	// least recently are dropped
+	maxPersistedPeerScores = 1000
+
+	// uptimeTarget is the connected time of a peer giving it the full
+	// uptime score
+	uptimeTarget = 24 * time.Hour
+
+	// latencyReference is the latency giving a peer half the latency score
+	latencyReference = 200 * time.Millisecond
+
+	// misbehaviorPenalty is the score removed by misbehavior
+	misbehaviorPenalty = 25
+)
+
+var peerScoresKey = ipfs_ds.NewKey("scores")
+
+// PeerScore is the reputation of a peer, from 0 to 100 for a peer behaving,
+// each misbehavior takes 25 off.
+type PeerScore struct {
+	Peer  string  `json:"peer"`
+	Score float64 `json:"score"`
+
+	// Deliveries and Failures are the exchanges with the peer which
+	// succeeded and failed, e.g. the deliveries and the store-and-forward
+	// exchanges, decayed by the half-life
+	Deliveries float64 `json:"deliveries"`
+	Failures   float64 `json:"failures"`
+
+	// Misbehaviors are the invalid messages and bundles sent by the peer,
+	// decayed by the half-life
+	Misbehaviors float64 `json:"misbehaviors"`
+
+	// Uptime is the time the node was connected to the peer
+	Uptime time.Duration `json:"uptime"`
+
+	// Latency is the average round trip time to the peer, 0 if unknown
+	Latency time.Duration `json:"latency,omitempty"`
+
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// peerRecord is the persisted state of a peer.
+type peerRecord struct {
+	Deliveries   float64 `json:"deliveries,omitempty"`
+	Failures     float64 `json:"failures,omitempty"`
+	Misbehaviors float64 `json:"misbehaviors,omitempty"`
+	Uptime       int64   `json:"uptime,omitempty"`
+	Latency      int64   `json:"latency,omitempty"`
+	Decayed      int64   `json:"decayed"`
+	LastSeen     int64   `json:"lastSeen"`
+
+	// connected is the start of the current connection to the peer
+	connected time.Time
+}
+
+// decay weighs down the past exchanges of the peer until now.
+func (r *peerRecord) decay(now time.Time, halfLife time.Duration) {
+	elapsed := now.Sub(time.Unix(0, r.Decayed))
+	if elapsed <= 0 {
+		return
+	}
+
+	f := math.Pow(0.5, float64(elapsed)/float64(halfLife))
+	r.Deliveries *= f
+	r.Failures *= f
+	r.Misbehaviors *= f
+	r.Decayed = now.UnixNano()
+}
+
+// uptime returns the connected time, the current connection included.
+func (r *peerRecord) uptime(now time.Time) time.Duration {
+	uptime := time.Duration(r.Uptime)
+	if !r.connected.IsZero() {
+		uptime += now.Sub(r.connected)
+	}
+
+	return uptime
+}
+
+// score weighs the reliability of the exchanges with the peer first, its
+// uptime and latency then. An unknown peer has an average reliability.
+func (r *peerRecord) score(now time.Time) float64 {
+	reliability := (r.Deliveries + 1) / (r.Deliveries + r.Failures + 2)
+	uptime := math.Min(float64(r.uptime(now))/float64(uptimeTarget), 1)
+
+	latency := 0.5
+	if r.Latency > 0 {
+		latency = float64(latencyReference) / float64(time.Duration(r.Latency)+latencyReference)
+	}
+
+	return 100*(0.5*reliability+0.2*uptime+0.3*latency) - misbehaviorPenalty*r.Misbehaviors
+}
+
+// PeerScoresOpts configures the scores of the peers.
+type PeerScoresOpts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the scores across restarts
+	Datastore ipfs_ds.Datastore
+
+	UpdateInterval  time.Duration
+	PersistInterval time.Duration
+	HalfLife        time.Duration
+
+	// MinRelayScore is the score under which a relay is dropped, BanScore
+	// the one under which a peer is rejected
+	MinRelayScore float64
+	BanScore      float64
+}
+
+func (opts *PeerScoresOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		opts.Datastore = ipfs_ds.NewMapDatastore()
+	}
+
+	if opts.UpdateInterval <= 0 {
+		opts.UpdateInterval = DefaultPeerScoresUpdateInterval
+	}
+
+	if opts.PersistInterval <= 0 {
+		opts.PersistInterval = DefaultPeerScoresPersistInterval
+	}
+
+	if opts.HalfLife <= 0 {
+		opts.HalfLife = DefaultPeerScoresHalfLife
+	}
+
+	if opts.MinRelayScore == 0 {
+		opts.MinRelayScore = DefaultMinRelayScore
+	}
+
+	if opts.BanScore == 0 {
+		opts.BanScore = DefaultBanScore
+	}
+}
+
+// PeerScores keeps the reputation of the peers from the deliveries, the
+// uptime, the latency and the misbehaviors recorded, e.g. by the delivery
+// acks and the store-and-forward exchanges.
+//
+// The scores are tagged in the connection manager so the least reliable
+// peers are pruned first. The relays the node is reachable through are
+// protected while their score is good, and disconnected under MinRelayScore
+// so the autorelay selects another one. A nil PeerScores records nothing and
+// scores every peer the same.
+type PeerScores struct {
+	logger *zap.Logger
+	store  ipfs_ds.Datastore
+	host   host.Host
+	opts   PeerScoresOpts
+
+	muPeers sync.Mutex
+	peers   map[peer.ID]*peerRecord
+}
+
+func NewPeerScores(h host.Host, opts PeerScoresOpts) (*PeerScores, error) {
+	opts.applyDefaults()
+
+	s := &PeerScores{
+		logger: opts.Logger,
+		store:  opts.Datastore,
+		host:   h,
+		opts:   opts,
+		peers:  make(map[peer.ID]*peerRecord),
+	}
+
+	data, err := s.store.Get(peerScoresKey)
+	switch err {
+	case nil:
+		persisted := map[string]*peerRecord{}
+		if err := json.Unmarshal(data, &persisted); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		for id, r := range persisted {
+			p, err := peer.Decode(id)
+			if err != nil {
+				continue
+			}
+
+			s.peers[p] = r
+		}
+	case ipfs_ds.ErrNotFound:
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return s, nil
+}
+
+// Start tracks the uptime and the latency of the peers and updates their
+// tags until the context is done, the scores are persisted periodically and
+// once done.
+func (s *PeerScores) Start(ctx context.Context) {
+	s.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			if s.Banned(c.RemotePeer()) {
+				s.logger.Debug("peer banned, connection closed", zap.Stringer("peer", c.RemotePeer()))
+				_ = c.Close()
+				return
+			}
+
+			if len(n.ConnsToPeer(c.RemotePeer())) == 1 {
+				s.connected(c.RemotePeer(), time.Now())
+			}
+		},
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				s.disconnected(c.RemotePeer(), time.Now())
+			}
+		},
+	})
+
+	for _, p := range s.host.Network().Peers() {
+		s.connected(p, time.Now())
+	}
+
+	go func() {
+		update := time.NewTicker(s.opts.UpdateInterval)
+		defer update.Stop()
+
+		persist := time.NewTicker(s.opts.PersistInterval)
+		defer persist.Stop()
+
+		for {
+			select {
+			case <-update.C:
+				s.update()
+			case <-persist.C:
+				if err := s.persist(); err != nil {
+					s.logger.Warn("unable to persist peer scores", zap.Error(err))
+				}
+			case <-ctx.Done():
+				if err := s.persist(); err != nil {
+					s.logger.Warn("unable to persist peer scores", zap.Error(err))
+				}
+
+				return
+			}
+		}
+	}()
+}
+
+// recordLocked returns the record of a peer, decayed until now.
+func (s *PeerScores) recordLocked(p peer.ID, now time.Time) *peerRecord {
+	r, ok := s.peers[p]
+	if !ok {
+		r = &peerRecord{Decayed: now.UnixNano()}
+		s.peers[p] = r
+	}
+
+	r.decay(now, s.opts.HalfLife)
+	r.LastSeen = now.UnixNano()
+
+	return r
+}
+
+func (s *PeerScores) connected(p peer.ID, now time.Time) {
+	s.muPeers.Lock()
+	defer s.muPeers.Unlock()
+
+	r := s.recordLocked(p, now)
+	if r.connected.IsZero() {
+		r.connected = now
+	}
+}
+
+func (s *PeerScores) disconnected(p peer.ID, now time.Time) {
+	s.muPeers.Lock()
+	defer s.muPeers.Unlock()
+
+	r, ok := s.peers[p]
+	if !ok || r.connected.IsZero() {
+		return
+	}
+
+	r.Uptime = int64(r.uptime(now))
+	r.connected = time.Time{}
+	r.LastSeen = now.UnixNano()
+}
+
+// RecordDelivery records an exchange with the peer, e.g. a delivery or a
+// store-and-forward exchange, and whether it succeeded.
+func (s *PeerScores) RecordDelivery(p peer.ID, success bool) {
+	if s == nil {
+		return
+	}
+
+	s.muPeers.Lock()
+	defer s.muPeers.Unlock()
+
+	r := s.recordLocked(p, time.Now())
+	if success {
+		r.Deliveries++
+	} else {
+		r.Failures++
+	}
+}
+
+// RecordLatency records a round trip to the peer, it is averaged with the
+// previous ones.
+func (s *PeerScores) RecordLatency(p peer.ID, rtt time.Duration) {
+	if s == nil || rtt <= 0 {
+		return
+	}
+
+	s.muPeers.Lock()
+	defer s.muPeers.Unlock()
+
+	r := s.recordLocked(p, time.Now())
+	if r.Latency == 0 {
+		r.Latency = int64(rtt)
+	} else {
+		r.Latency = int64(0.8*float64(r.Latency) + 0.2*float64(rtt))
+	}
+}
+
+// RecordMisbehavior records an invalid message sent by the peer, e.g. a
+// forged ack or a bundle over the room announced.
+func (s *PeerScores) RecordMisbehavior(p peer.ID, reason string) {
+	if s == nil {
+		return
+	}
+
+	s.muPeers.Lock()
+	r := s.recordLocked(p, time.Now())
+	r.Misbehaviors++
+	score := r.score(time.Now())
+	s.muPeers.Unlock()
+
+	s.logger.Debug("peer misbehaved", zap.Stringer("peer", p), zap.String("reason", reason), zap.Float64("score", score))
+
+	if score < s.opts.BanScore {
+		_ = s.host.Network().ClosePeer(p)
+	}
+}
+
+// Score returns the score of a peer, the one of an unknown peer if the peer
+// wasn't met yet.
+func (s *PeerScores) Score(p peer.ID) float64 {
+	if s == nil {
+		return (&peerRecord{}).score(time.Now())
+	}
+
+	s.muPeers.Lock()
+	defer s.muPeers.Unlock()
+
+	now := time.Now()
+	r, ok := s.peers[p]
+	if !ok {
+		return (&peerRecord{}).score(now)
+	}
+
+	r.decay(now, s.opts.HalfLife)
+
+	return r.score(now)
+}
+
+// Banned reports whether the score of the peer is under the ban score.
+func (s *PeerScores) Banned(p peer.ID) bool {
+	return s != nil && s.Score(p) < s.opts.BanScore
+}
+
+// Rank sorts the peers by descending score.
+func (s *PeerScores) Rank(peers []peer.ID) {
+	scores := make(map[peer.ID]float64, len(peers))
+	for _, p := range peers {
+		scores[p] = s.Score(p)
+	}
+
+	sort.SliceStable(peers, func(i, j int) bool {
+		return scores[peers[i]] > scores[peers[j]]
+	})
+}
+
+// Scores returns the scores of the peers met, by descending score.
+func (s *PeerScores) Scores() []*PeerScore {
+	if s == nil {
+		return []*PeerScore{}
+	}
+
+	s.muPeers.Lock()
+	defer s.muPeers.Unlock()
+
+	now := time.Now()
+	scores := make([]*PeerScore, 0, len(s.peers))
+	for p, r := range s.peers {
+		r.decay(now, s.opts.HalfLife)
+		scores = append(scores, &PeerScore{
+			Peer:         p.Pretty(),
+			Score:        r.score(now),
+			Deliveries:   r.Deliveries,
+			Failures:     r.Failures,
+			Misbehaviors: r.Misbehaviors,
+			Uptime:       r.uptime(now),
+			Latency:      time.Duration(r.Latency),
+			LastSeen:     time.Unix(0, r.LastSeen),
+		})
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].Score > scores[j].Score
+	})
+
+	return scores
+}
+
+// relays returns the relays the node is reachable through, from its
+// circuit addrs.
+func (s *PeerScores) relays() map[peer.ID]struct{} {
+	relays := make(map[peer.ID]struct{})
+	for _, addr := range s.host.Addrs() {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			continue
+		}
+
+		id, err := addr.ValueForProtocol(ma.P_P2P)
+		if err != nil {
+			continue
+		}
+
+		if p, err := peer.Decode(id); err == nil {
+			relays[p] = struct{}{}
+		}
+	}
+
+	return relays
+}
+
+// update samples the latency of the connected peers, then tags them in the
+// connection manager and keeps or drops the relays by their score.
+func (s *PeerScores) update() {
+	peers := s.host.Network().Peers()
+	for _, p := range peers {
+		s.RecordLatency(p, s.host.Peerstore().LatencyEWMA(p))
+	}
+
+	cm := s.host.ConnManager()
+	relays := s.relays()
+	for _, p := range peers {
+		score := s.Score(p)
+		cm.TagPeer(p, PeerScoreTag, int(score))
+
+		if _, ok := relays[p]; !ok {
+			continue
+		}
+
+		if score < s.opts.MinRelayScore {
+			s.logger.Info("relay score too low, relay dropped", zap.Stringer("relay", p), zap.Float64("score", score))
+			cm.Unprotect(p, relayProtectTag)
+			_ = s.host.Network().ClosePeer(p)
+		} else {
+			cm.Protect(p, relayProtectTag)
+		}
+	}
+}
+
+func (s *PeerScores) persist() error {
+	s.muPeers.Lock()
+
+	now := time.Now()
+	peers := make([]peer.ID, 0, len(s.peers))
+	for p := range s.peers {
+		peers = append(peers, p)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return s.peers[peers[i]].LastSeen > s.peers[peers[j]].LastSeen
+	})
+
+	if len(peers) > maxPersistedPeerScores {
+		for _, p := range peers[maxPersistedPeerScores:] {
+			delete(s.peers, p)
+		}
+
+		peers = peers[:maxPersistedPeerScores]
+	}
+
+	persisted := make(map[string]*peerRecord, len(peers))
+	for _, p := range peers {
+		r := *s.peers[p]
+		r.Uptime = int64(r.uptime(now))
+		persisted[p.Pretty()] = &r
+	}
+
+	s.muPeers.Unlock()
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := s.store.Put(peerScoresKey, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package ipfsutil
+
+import (
+	"bytes"
+	"fmt"
+
+	ipfs_repo "github.com/ipfs/go-ipfs/repo"
+	"github.com/libp2p/go-libp2p-core/pnet"
+)
+
+// ParseSwarmKey decodes a swarm key in the go-ipfs "swarm.key" format:
+//
+//	/key/swarm/psk/1.0.0/
+//	/base16/
+//	<64 hex chars>
+func ParseSwarmKey(data []byte) (pnet.PSK, error) {
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid swarm key: %w", err)
+	}
+
+	return psk, nil
+}
+
+// swarmKeyRepo serves the swarm key of the config instead of the one of the
+// repo directory, go-ipfs then sets up the private network itself: the
+// connections of every upgraded transport, including the proximity ones, are
+// protected and the peers without the key fail the handshake. go-ipfs also
+// leaves out QUIC, which doesn't support private networks.
+type swarmKeyRepo struct {
+	ipfs_repo.Repo
+
+	key []byte
+}
+
+func (r *swarmKeyRepo) SwarmKey() ([]byte, error) {
+	return r.key, nil
+}
+
+func withSwarmKey(repo ipfs_repo.Repo, key []byte) (ipfs_repo.Repo, error) {
+	if _, err := ParseSwarmKey(key); err != nil {
+		return nil, err
+	}
+
+	if current, err := repo.SwarmKey(); err == nil && len(current) > 0 && !bytes.Equal(current, key) {
+		return nil, fmt.Errorf("the repo already has another swarm key")
+	}
+
+	return &swarmKeyRepo{Repo: repo, key: key}, nil
+}
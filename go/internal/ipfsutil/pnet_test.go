@@ -0,0 +1,120 @@
+package ipfsutil
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	ipfs_core "github.com/ipfs/go-ipfs/core"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const swarmKeyHeader = "/key/swarm/psk/1.0.0/\n/base16/\n"
+
+func testSwarmKey(t *testing.T) []byte {
+	t.Helper()
+
+	raw := make([]byte, 32)
+	_, err := crand.Read(raw)
+	require.NoError(t, err)
+
+	return []byte(swarmKeyHeader + hex.EncodeToString(raw) + "\n")
+}
+
+func TestParseSwarmKey(t *testing.T) {
+	key := testSwarmKey(t)
+
+	psk, err := ParseSwarmKey(key)
+	require.NoError(t, err)
+	assert.Len(t, psk, 32)
+
+	hexKey := strings.TrimPrefix(strings.TrimSpace(string(key)), swarmKeyHeader)
+
+	for name, data := range map[string]string{
+		"empty":            "",
+		"unknown version":  "/key/swarm/psk/2.0.0/\n/base16/\n" + hexKey,
+		"unknown encoding": "/key/swarm/psk/1.0.0/\n/base42/\n" + hexKey,
+		"short key":        swarmKeyHeader + hexKey[:32],
+		"not hex":          swarmKeyHeader + strings.Repeat("z", 64),
+	} {
+		_, err := ParseSwarmKey([]byte(data))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestWithSwarmKey(t *testing.T) {
+	key := testSwarmKey(t)
+
+	repo, err := withSwarmKey(TestingRepo(t), key)
+	require.NoError(t, err)
+
+	served, err := repo.SwarmKey()
+	require.NoError(t, err)
+	assert.Equal(t, key, served)
+
+	// the same key can be given again, not another one
+	_, err = withSwarmKey(repo, key)
+	assert.NoError(t, err)
+
+	_, err = withSwarmKey(repo, testSwarmKey(t))
+	assert.Error(t, err)
+
+	_, err = withSwarmKey(TestingRepo(t), []byte("not a swarm key"))
+	assert.Error(t, err)
+}
+
+func testPrivateNode(t *testing.T, ctx context.Context, key []byte) *ipfs_core.IpfsNode {
+	t.Helper()
+
+	cfg := &CoreAPIConfig{
+		SwarmAddrs:     []string{"/ip4/127.0.0.1/tcp/0"},
+		BootstrapAddrs: []string{},
+		SwarmKey:       key,
+		DisableMDNS:    true,
+		DisableDHT:     true,
+	}
+
+	_, node, err := NewCoreAPI(ctx, cfg)
+	require.NoError(t, err)
+
+	// QUIC doesn't support private networks
+	assert.True(t, cfg.QUIC.Disable)
+	for _, addr := range node.PeerHost.Addrs() {
+		_, err := addr.ValueForProtocol(ma.P_QUIC)
+		assert.Error(t, err, addr.String())
+	}
+
+	return node
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testSwarmKey(t)
+
+	a := testPrivateNode(t, ctx, key)
+	defer a.Close()
+	b := testPrivateNode(t, ctx, key)
+	defer b.Close()
+	other := testPrivateNode(t, ctx, testSwarmKey(t))
+	defer other.Close()
+
+	connect := func(from, to *ipfs_core.IpfsNode) error {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		return from.PeerHost.Connect(ctx, peer.AddrInfo{ID: to.Identity, Addrs: to.PeerHost.Addrs()})
+	}
+
+	// the peers sharing the key connect, the others fail the handshake
+	require.NoError(t, connect(a, b))
+	assert.Error(t, connect(a, other))
+	assert.Error(t, connect(other, b))
+}
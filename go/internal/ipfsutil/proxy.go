@@ -0,0 +1,373 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	tcp "github.com/libp2p/go-tcp-transport"
+	ws "github.com/libp2p/go-ws-transport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+// The transports a proxy applies to. QUIC can't go through a SOCKS5 proxy,
+// it is disabled and its peers are dialed on their TCP addrs.
+const (
+	ProxyTransportTCP       = "tcp"
+	ProxyTransportWebSocket = "ws"
+)
+
+// ProxyDirect is the override of a transport dialing without proxy.
+const ProxyDirect = "direct"
+
+const defaultProxyDialTimeout = 30 * time.Second
+
+// ProxyOpts configures the SOCKS5 proxy the IP dials of a node go through,
+// e.g. to pass a corporate firewall. The listeners aren't proxied.
+type ProxyOpts struct {
+	Logger *zap.Logger
+
+	// Addr is the proxy, host:port or socks5://[user:password@]host:port,
+	// disabled if empty
+	Addr string
+
+	// Overrides replaces the proxy of a transport, ProxyTransportTCP or
+	// ProxyTransportWebSocket, by another proxy addr or ProxyDirect
+	Overrides map[string]string
+
+	// FallbackDirect retries a dial directly when the proxy can't be
+	// reached, the dial fails otherwise and only the transports overridden
+	// by ProxyDirect dial directly
+	FallbackDirect bool
+}
+
+func (opts *ProxyOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+}
+
+// Enabled reports whether a proxy is configured.
+func (opts ProxyOpts) Enabled() bool {
+	return opts.Addr != ""
+}
+
+// proxyAddr returns the proxy of a transport, empty for a direct dial.
+func (opts ProxyOpts) proxyAddr(transport string) string {
+	addr, ok := opts.Overrides[transport]
+	switch {
+	case !ok:
+		return opts.Addr
+	case addr == ProxyDirect:
+		return ""
+	}
+
+	return addr
+}
+
+func (opts ProxyOpts) validate() error {
+	if _, _, err := parseProxyAddr(opts.Addr); err != nil {
+		return err
+	}
+
+	for transport, addr := range opts.Overrides {
+		if transport != ProxyTransportTCP && transport != ProxyTransportWebSocket {
+			return fmt.Errorf("unknown proxied transport %q", transport)
+		}
+
+		if addr == ProxyDirect {
+			continue
+		}
+
+		if _, _, err := parseProxyAddr(addr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseProxyOverrides parses a comma-separated list of transport=proxy, e.g.
+// "ws=direct,tcp=socks5://10.0.0.1:1080".
+func ParseProxyOverrides(s string) (map[string]string, error) {
+	overrides := map[string]string{}
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid proxy override %q, transport=proxy expected", field)
+		}
+
+		if _, ok := overrides[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate proxy override of %q", kv[0])
+		}
+
+		overrides[kv[0]] = kv[1]
+	}
+
+	return overrides, nil
+}
+
+// parseProxyAddr returns the host:port of a SOCKS5 proxy and its
+// credentials, nil if none.
+func parseProxyAddr(addr string) (string, *proxy.Auth, error) {
+	if !strings.Contains(addr, "://") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", nil, fmt.Errorf("invalid proxy addr %q: %w", addr, err)
+		}
+
+		return addr, nil, nil
+	}
+
+	u, err := url.Parse(addr)
+	switch {
+	case err != nil:
+		// the error would show the password
+		return "", nil, fmt.Errorf("invalid proxy URL")
+	case u.Scheme != "socks5" && u.Scheme != "socks5h":
+		return "", nil, fmt.Errorf("unsupported proxy scheme %q, only SOCKS5 is supported", u.Scheme)
+	case u.Port() == "":
+		return "", nil, fmt.Errorf("no port in the proxy addr %q", u.Host)
+	}
+
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+
+	return u.Host, auth, nil
+}
+
+func newSOCKS5Dialer(addr string, forward proxy.Dialer) (proxy.Dialer, error) {
+	host, auth, err := parseProxyAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	socks, err := proxy.SOCKS5("tcp", host, auth, forward)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use SOCKS proxy %s: %w", host, err)
+	}
+
+	return socks, nil
+}
+
+// Dialer returns the proxy of the TCP dials, e.g. for the HTTP clients of
+// the node, nil if they are direct.
+func (opts ProxyOpts) Dialer() (proxy.Dialer, error) {
+	addr := opts.proxyAddr(ProxyTransportTCP)
+	if !opts.Enabled() || addr == "" {
+		return nil, nil
+	}
+
+	return newSOCKS5Dialer(addr, &net.Dialer{Timeout: defaultProxyDialTimeout})
+}
+
+var _ tpt.Transport = (*ProxyTransport)(nil)
+
+// ProxyTransport dials the TCP and WebSocket addrs through SOCKS5 proxies,
+// it proxies the ip and dns protocols so every IP dial of the node goes
+// through it.
+type ProxyTransport struct {
+	opts     ProxyOpts
+	upgrader *tptu.Upgrader
+	direct   *net.Dialer
+
+	// socks are the proxies by transport, nil for a direct dial
+	socks map[string]proxy.Dialer
+
+	// the swarm listens through the proxy transports, the listeners are
+	// the ones of the transports replaced
+	tcp tpt.Transport
+	ws  tpt.Transport
+}
+
+// newProxyTransportConstructor returns a libp2p transport constructor.
+func newProxyTransportConstructor(opts ProxyOpts) func(u *tptu.Upgrader) (*ProxyTransport, error) {
+	opts.applyDefaults()
+
+	return func(u *tptu.Upgrader) (*ProxyTransport, error) {
+		t := &ProxyTransport{
+			opts:     opts,
+			upgrader: u,
+			direct:   &net.Dialer{Timeout: defaultProxyDialTimeout},
+			socks:    map[string]proxy.Dialer{},
+			tcp:      tcp.NewTCPTransport(u),
+			ws:       ws.New(u),
+		}
+
+		for _, transport := range []string{ProxyTransportTCP, ProxyTransportWebSocket} {
+			addr := opts.proxyAddr(transport)
+			if addr == "" {
+				continue
+			}
+
+			socks, err := newSOCKS5Dialer(addr, t.direct)
+			if err != nil {
+				return nil, err
+			}
+
+			t.socks[transport] = socks
+		}
+
+		return t, nil
+	}
+}
+
+// proxyDialTarget returns the transport of the addr and the host:port to
+// dial, the names are resolved by the proxy so there is no DNS leak.
+func proxyDialTarget(addr ma.Multiaddr) (string, string, error) {
+	first, rest := ma.SplitFirst(addr)
+	if first == nil || rest == nil {
+		return "", "", fmt.Errorf("unsupported addr %s", addr)
+	}
+
+	switch first.Protocol().Code {
+	case ma.P_IP4, ma.P_IP6, ma.P_DNS4, ma.P_DNS6:
+	default:
+		return "", "", fmt.Errorf("unsupported addr %s", addr)
+	}
+
+	port, err := rest.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		return "", "", fmt.Errorf("unsupported addr %s", addr)
+	}
+
+	target := net.JoinHostPort(first.Value(), port)
+	switch protos := rest.Protocols(); {
+	case len(protos) == 1:
+		return ProxyTransportTCP, target, nil
+	case len(protos) == 2 && protos[1].Code == ma.P_WS:
+		return ProxyTransportWebSocket, target, nil
+	}
+
+	return "", "", fmt.Errorf("unsupported addr %s", addr)
+}
+
+func (t *ProxyTransport) dial(ctx context.Context, transport, target string) (net.Conn, error) {
+	socks := t.socks[transport]
+	if socks == nil {
+		return t.direct.DialContext(ctx, "tcp", target)
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if d, ok := socks.(proxy.ContextDialer); ok {
+		conn, err = d.DialContext(ctx, "tcp", target)
+	} else {
+		conn, err = socks.Dial("tcp", target)
+	}
+
+	if err == nil {
+		return conn, nil
+	}
+
+	if !t.opts.FallbackDirect || ctx.Err() != nil {
+		return nil, fmt.Errorf("unable to dial %s through the proxy: %w", target, err)
+	}
+
+	t.opts.Logger.Warn("unable to dial through the proxy, dialing directly", zap.String("transport", transport), zap.Error(err))
+
+	return t.direct.DialContext(ctx, "tcp", target)
+}
+
+// Dial dials the peer through the proxy of the transport of the addr, the
+// dial is only retried directly with FallbackDirect.
+func (t *ProxyTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	transport, target, err := proxyDialTarget(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := t.dial(ctx, transport, target)
+	if err != nil {
+		return nil, err
+	}
+
+	laddr, err := manet.FromNetAddr(conn.LocalAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if transport == ProxyTransportWebSocket {
+		if conn, err = websocketClient(ctx, conn, target); err != nil {
+			return nil, err
+		}
+
+		laddr = laddr.Encapsulate(ma.StringCast("/ws"))
+	}
+
+	return t.upgrader.UpgradeOutbound(ctx, t, &proxiedConn{Conn: conn, laddr: laddr, raddr: raddr}, p)
+}
+
+// websocketClient makes the WebSocket handshake of a libp2p client over an
+// established connection.
+func websocketClient(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+	dialer := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+		HandshakeTimeout: defaultProxyDialTimeout,
+	}
+
+	raw, resp, err := dialer.DialContext(ctx, "ws://"+target, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake failed: %w", err)
+	}
+
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+
+	return ws.NewConn(raw), nil
+}
+
+// CanDial returns true for the TCP and WebSocket addrs.
+func (t *ProxyTransport) CanDial(addr ma.Multiaddr) bool {
+	_, _, err := proxyDialTarget(addr)
+	return err == nil
+}
+
+// Listen listens directly, with the TCP or the WebSocket transport.
+func (t *ProxyTransport) Listen(laddr ma.Multiaddr) (tpt.Listener, error) {
+	if t.ws.CanDial(laddr) {
+		return t.ws.Listen(laddr)
+	}
+
+	return t.tcp.Listen(laddr)
+}
+
+// Protocols returns the set of protocols handled by this transport.
+func (t *ProxyTransport) Protocols() []int {
+	return []int{ma.P_IP4, ma.P_IP6, ma.P_DNS4, ma.P_DNS6}
+}
+
+// Proxy returns true, the ip and dns protocols are proxied.
+func (t *ProxyTransport) Proxy() bool {
+	return true
+}
+
+func (t *ProxyTransport) String() string {
+	return "Proxy"
+}
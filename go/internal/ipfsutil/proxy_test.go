@@ -0,0 +1,117 @@
+package ipfsutil
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyDialTarget(t *testing.T) {
+	for addr, expected := range map[string][2]string{
+		"/ip4/1.2.3.4/tcp/4242":             {ProxyTransportTCP, "1.2.3.4:4242"},
+		"/ip6/::1/tcp/4242":                 {ProxyTransportTCP, "[::1]:4242"},
+		"/dns4/example.com/tcp/443":         {ProxyTransportTCP, "example.com:443"},
+		"/dns6/example.com/tcp/80/ws":       {ProxyTransportWebSocket, "example.com:80"},
+		"/ip4/1.2.3.4/tcp/4242/ws":          {ProxyTransportWebSocket, "1.2.3.4:4242"},
+		"/ip4/1.2.3.4/udp/4242/quic":        {},
+		"/ip4/1.2.3.4/tcp/4242/p2p-circuit": {},
+		"/dnsaddr/example.com/tcp/443":      {},
+		"/ip4/1.2.3.4":                      {},
+		"/unix/tmp/berty.sock":              {},
+	} {
+		transport, target, err := proxyDialTarget(ma.StringCast(addr))
+		if expected[0] == "" {
+			assert.Error(t, err, addr)
+			continue
+		}
+
+		require.NoError(t, err, addr)
+		assert.Equal(t, expected[0], transport, addr)
+		assert.Equal(t, expected[1], target, addr)
+	}
+}
+
+func TestProxyOverrides(t *testing.T) {
+	overrides, err := ParseProxyOverrides("ws=direct, tcp=socks5://10.0.0.1:1080")
+	require.NoError(t, err)
+
+	opts := ProxyOpts{Addr: "127.0.0.1:9050", Overrides: overrides}
+	require.NoError(t, opts.validate())
+	assert.Equal(t, "socks5://10.0.0.1:1080", opts.proxyAddr(ProxyTransportTCP))
+	assert.Equal(t, "", opts.proxyAddr(ProxyTransportWebSocket))
+
+	opts.Overrides = nil
+	assert.Equal(t, "127.0.0.1:9050", opts.proxyAddr(ProxyTransportWebSocket))
+
+	for _, s := range []string{"tcp", "tcp=", "tcp=direct,tcp=direct"} {
+		_, err := ParseProxyOverrides(s)
+		assert.Error(t, err, s)
+	}
+
+	opts.Overrides = map[string]string{"quic": ProxyDirect}
+	assert.Error(t, opts.validate())
+
+	opts.Overrides = map[string]string{ProxyTransportTCP: "http://10.0.0.1:8080"}
+	assert.Error(t, opts.validate())
+}
+
+// unreachableAddr returns the addr of a closed local port.
+func unreachableAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	return addr
+}
+
+func TestProxyFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Close()
+		}
+	}()
+
+	dial := func(opts ProxyOpts) error {
+		transport, err := newProxyTransportConstructor(opts)(nil)
+		require.NoError(t, err)
+
+		conn, err := transport.dial(ctx, ProxyTransportTCP, target.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+
+		return err
+	}
+
+	proxyAddr := unreachableAddr(t)
+
+	// the dials are refused when the proxy can't be reached
+	assert.Error(t, dial(ProxyOpts{Addr: proxyAddr}))
+
+	// unless they fall back to a direct dial
+	assert.NoError(t, dial(ProxyOpts{Addr: proxyAddr, FallbackDirect: true}))
+
+	// the transports overridden by ProxyDirect always dial directly
+	assert.NoError(t, dial(ProxyOpts{Addr: proxyAddr, Overrides: map[string]string{ProxyTransportTCP: ProxyDirect}}))
+}
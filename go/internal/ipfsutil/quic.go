@@ -0,0 +1,95 @@
+package ipfsutil
+
+import (
+	"fmt"
+
+	ipfs_cfg "github.com/ipfs/go-ipfs-config"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// QUICOpts configures the QUIC transport of a node. QUIC behaves better than
+// TCP on lossy mobile networks, it is enabled by default.
+type QUICOpts struct {
+	Disable bool
+
+	// Port is the UDP port to listen on, a random one is picked if 0
+	Port uint16
+}
+
+// Listeners returns the QUIC multiaddrs to listen on.
+func (opts QUICOpts) Listeners() []string {
+	if opts.Disable {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic", opts.Port),
+		fmt.Sprintf("/ip6/::/udp/%d/quic", opts.Port),
+	}
+}
+
+// IsQUICAddr reports whether the given multiaddr is a QUIC one.
+func IsQUICAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_QUIC)
+	return err == nil
+}
+
+// applyQUICConfig replaces the QUIC listeners of the repo config, and adds
+// a QUIC address next to each announced TCP one when the port is known.
+func applyQUICConfig(rcfg *ipfs_cfg.Config, opts QUICOpts) error {
+	swarm := []string{}
+	for _, addr := range rcfg.Addresses.Swarm {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err == nil && IsQUICAddr(maddr) {
+			continue
+		}
+
+		swarm = append(swarm, addr)
+	}
+
+	rcfg.Addresses.Swarm = append(swarm, opts.Listeners()...)
+
+	announce := []string{}
+	for _, addr := range rcfg.Addresses.Announce {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid announce addr %q: %w", addr, err)
+		}
+
+		if IsQUICAddr(maddr) {
+			continue
+		}
+
+		announce = append(announce, addr)
+
+		if opts.Disable || opts.Port == 0 {
+			continue
+		}
+
+		// /ip4/<ip>/tcp/<port> => /ip4/<ip>/udp/<quic port>/quic
+		ip, rest := ma.SplitFirst(maddr)
+		if ip == nil || rest == nil || !isIPComponent(ip) {
+			continue
+		}
+
+		if _, err := rest.ValueForProtocol(ma.P_TCP); err != nil {
+			continue
+		}
+
+		quic, err := ma.NewMultiaddr(fmt.Sprintf("/udp/%d/quic", opts.Port))
+		if err != nil {
+			return err
+		}
+
+		announce = append(announce, ip.Encapsulate(quic).String())
+	}
+
+	rcfg.Addresses.Announce = announce
+
+	return nil
+}
+
+func isIPComponent(c *ma.Component) bool {
+	code := c.Protocol().Code
+	return code == ma.P_IP4 || code == ma.P_IP6
+}
@@ -0,0 +1,83 @@
+package ipfsutil
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	// the IPs of the multiaddrs, e.g. /ip4/192.168.1.2
+	redactMultiaddrIP = regexp.MustCompile(`/ip[46]/[0-9A-Fa-f.:]+`)
+
+	// the IPs of the net errors, e.g. dial tcp 192.168.1.2:4001 or [fe80::1]:4001
+	redactIPv4 = regexp.MustCompile(`\b[0-9]{1,3}(\.[0-9]{1,3}){3}\b`)
+	redactIPv6 = regexp.MustCompile(`\[[0-9A-Fa-f:.]+(%[^\]]*)?\]`)
+)
+
+// IPScope returns the scope of an IP: unspecified, loopback, link-local,
+// private or public.
+func IPScope(ip net.IP) string {
+	switch {
+	case ip.IsUnspecified():
+		return "unspecified"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "link-local"
+	case isPrivateIP(ip):
+		return "private"
+	default:
+		return "public"
+	}
+}
+
+var privateNets = func() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+
+	return nets
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RedactIPs replaces the IPs of a text by their scope, e.g. the multiaddrs or
+// the dial errors sent in a report, the values which aren't IPs are kept.
+func RedactIPs(s string) string {
+	s = redactMultiaddrIP.ReplaceAllStringFunc(s, func(m string) string {
+		ip := net.ParseIP(m[5:])
+		if ip == nil {
+			return m
+		}
+
+		return m[:4] + "/" + IPScope(ip)
+	})
+
+	s = redactIPv6.ReplaceAllStringFunc(s, func(m string) string {
+		ip := net.ParseIP(strings.SplitN(m[1:len(m)-1], "%", 2)[0])
+		if ip == nil {
+			return m
+		}
+
+		return "[" + IPScope(ip) + "]"
+	})
+
+	return redactIPv4.ReplaceAllStringFunc(s, func(m string) string {
+		if ip := net.ParseIP(m); ip != nil {
+			return IPScope(ip)
+		}
+
+		return m
+	})
+}
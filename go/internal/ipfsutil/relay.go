@@ -0,0 +1,98 @@
+package ipfsutil
+
+import (
+	"context"
+
+	ipfs_cfg "github.com/ipfs/go-ipfs-config"
+	ipfs_core "github.com/ipfs/go-ipfs/core"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	"github.com/libp2p/go-libp2p/p2p/host/relay"
+	"go.uber.org/zap"
+)
+
+// RelayOpts configures the circuit relays. By default the node looks for
+// relays once it finds out it is behind a NAT, and announces its relayed
+// addrs, they are refreshed as the relays come and go.
+type RelayOpts struct {
+	Logger *zap.Logger
+
+	// Disable prevents the node from using and serving relays
+	Disable bool
+
+	// Service makes the node relay the traffic of the other peers, e.g. on
+	// desktops and servers. It only advertises itself as a relay while it is
+	// publicly reachable through unconstrained links. A service node doesn't
+	// use the other relays.
+	Service bool
+}
+
+// applyRelayConfig selects the relay options of go-ipfs, the relay service is
+// advertised by OptionRelayService instead, so it can follow the
+// reachability of the node.
+func applyRelayConfig(rcfg *ipfs_cfg.Config, opts RelayOpts) {
+	rcfg.Swarm.DisableRelay = opts.Disable
+	rcfg.Swarm.EnableRelayHop = !opts.Disable && opts.Service
+	rcfg.Swarm.EnableAutoRelay = !opts.Disable && !opts.Service
+	rcfg.Swarm.EnableAutoNATService = !opts.Disable && opts.Service
+}
+
+// OptionRelayService returns a CoreAPIOption advertising the node as a relay
+// while it is publicly reachable.
+func OptionRelayService(opts RelayOpts) CoreAPIOption {
+	return func(ctx context.Context, node *ipfs_core.IpfsNode, _ ipfs_interface.CoreAPI) error {
+		if opts.Logger == nil {
+			opts.Logger = zap.NewNop()
+		}
+
+		sub, err := node.PeerHost.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+		if err != nil {
+			return err
+		}
+
+		disc := discovery.NewRoutingDiscovery(node.Routing)
+
+		go func() {
+			defer sub.Close()
+
+			var (
+				advertising bool
+				stop        context.CancelFunc = func() {}
+			)
+			defer func() { stop() }()
+
+			for {
+				var evt event.EvtLocalReachabilityChanged
+				select {
+				case e, ok := <-sub.Out():
+					if !ok {
+						return
+					}
+					evt = e.(event.EvtLocalReachabilityChanged)
+				case <-ctx.Done():
+					return
+				}
+
+				// relaying through constrained links would choke them
+				public := evt.Reachability == network.ReachabilityPublic && !ConstrainedLinksOnly(node.PeerHost)
+
+				switch {
+				case public && !advertising:
+					var actx context.Context
+					actx, stop = context.WithCancel(ctx)
+					discovery.Advertise(actx, disc, relay.RelayRendezvous)
+					opts.Logger.Info("advertising relay service")
+				case !public && advertising:
+					stop()
+					opts.Logger.Info("relay service no longer advertised", zap.Stringer("reachability", evt.Reachability))
+				}
+
+				advertising = public
+			}
+		}()
+
+		return nil
+	}
+}
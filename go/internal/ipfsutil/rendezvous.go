@@ -0,0 +1,63 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+
+	datastore "github.com/ipfs/go-datastore"
+	ipfs_core "github.com/ipfs/go-ipfs/core"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	p2p_host "github.com/libp2p/go-libp2p-core/host"
+	p2p_peer "github.com/libp2p/go-libp2p-core/peer"
+	p2p_routing "github.com/libp2p/go-libp2p-core/routing"
+	p2p_record "github.com/libp2p/go-libp2p-record"
+	rendezvous "github.com/libp2p/go-libp2p-rendezvous"
+	p2p_rpdb "github.com/libp2p/go-libp2p-rendezvous/db/sqlite"
+	p2p_routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"go.uber.org/zap"
+)
+
+// RendezvousServerOpts configures the rendezvous server role of the node, the
+// peers register and discover each other on it instead of the public DHT.
+type RendezvousServerOpts struct {
+	Logger *zap.Logger
+
+	// DB is the URN of the registrations sqlite database, they are kept in
+	// memory if empty
+	DB string
+}
+
+// OptionRendezvousServer returns a CoreAPIOption serving the rendezvous
+// protocol, the db is closed once the context of the node is done.
+func OptionRendezvousServer(opts RendezvousServerOpts) CoreAPIOption {
+	return func(ctx context.Context, node *ipfs_core.IpfsNode, _ ipfs_interface.CoreAPI) error {
+		if opts.Logger == nil {
+			opts.Logger = zap.NewNop()
+		}
+
+		if opts.DB == "" {
+			opts.DB = ":memory:"
+		}
+
+		db, err := p2p_rpdb.OpenDB(ctx, opts.DB)
+		if err != nil {
+			return fmt.Errorf("unable to open rendezvous db: %w", err)
+		}
+
+		rendezvous.NewRendezvousService(node.PeerHost, db)
+
+		go func() {
+			<-ctx.Done()
+			db.Close()
+		}()
+
+		opts.Logger.Info("rendezvous server started", zap.String("db", opts.DB))
+
+		return nil
+	}
+}
+
+// nilRouting replaces the DHT, the host config still runs.
+func nilRouting(context.Context, p2p_host.Host, datastore.Batching, p2p_record.Validator, ...p2p_peer.AddrInfo) (p2p_routing.Routing, error) {
+	return p2p_routinghelpers.Null{}, nil
+}
@@ -82,6 +82,9 @@ type TestingAPIOpts struct {
 	Logger  *zap.Logger
 	Mocknet libp2p_mocknet.Mocknet
 	RDVPeer peer.AddrInfo
+
+	// Chaos, if set, injects network conditions in the streams of the node
+	Chaos *Chaos
 }
 
 // TestingCoreAPIUsingMockNet returns a fully initialized mocked Core API with the given mocknet
@@ -98,7 +101,9 @@ func TestingCoreAPIUsingMockNet(ctx context.Context, t testing.TB, opts *Testing
 	repo := TestingRepo(t)
 	exapi, node, err := NewCoreAPIFromRepo(ctx, repo, &CoreAPIConfig{
 		DisableCorePubSub: true,
+		DisableMDNS:       true,
 		Host:              ipfs_mock.MockHostOption(opts.Mocknet),
+		Chaos:             opts.Chaos,
 		HostConfig: func(h host.Host, r routing.Routing) error {
 			var err error
 
@@ -0,0 +1,271 @@
+package ipfsutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	ipfs_cfg "github.com/ipfs/go-ipfs-config"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// DefaultTorSocksAddr is the SOCKS5 proxy address of a system Tor
+	DefaultTorSocksAddr = "127.0.0.1:9050"
+
+	// DefaultTorOnionPort is the virtual port of the onion service
+	DefaultTorOnionPort = 4001
+
+	defaultTorDialTimeout = time.Minute
+)
+
+// TorOpts configures the Tor mode of a node. When enabled, the TCP and onion
+// addrs are dialed through the Tor SOCKS proxy, the other transports can't be
+// used over Tor so QUIC is disabled.
+type TorOpts struct {
+	Enable bool
+	Logger *zap.Logger
+
+	// SocksAddr is the address of the SOCKS5 proxy of the system or of an
+	// embedded Tor
+	SocksAddr string
+
+	// ControlAddr is the address of the Tor control port, used to publish
+	// an onion service listener. No onion service is published if empty.
+	ControlAddr     string
+	ControlPassword string
+	OnionPort       uint16
+
+	// Strict refuses any clearnet traffic: dials aren't retried without Tor,
+	// the node only listens on its onion service, and the LAN discovery is
+	// disabled.
+	Strict bool
+}
+
+func (opts *TorOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.SocksAddr == "" {
+		opts.SocksAddr = DefaultTorSocksAddr
+	}
+
+	if opts.OnionPort == 0 {
+		opts.OnionPort = DefaultTorOnionPort
+	}
+}
+
+// IsOnionAddr reports whether the given multiaddr is an onion service one.
+func IsOnionAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_ONION3)
+	return err == nil
+}
+
+// applyTorConfig replaces the listeners and the announced addrs of the repo
+// config, the onion addr is nil if no onion service is published.
+func applyTorConfig(rcfg *ipfs_cfg.Config, opts TorOpts, onion ma.Multiaddr) {
+	if opts.Strict {
+		rcfg.Addresses.Swarm = []string{}
+		rcfg.Addresses.Announce = []string{}
+		rcfg.Swarm.DisableNatPortMap = true
+	}
+
+	if onion == nil {
+		return
+	}
+
+	rcfg.Addresses.Swarm = append(rcfg.Addresses.Swarm, onion.String())
+	if opts.Strict || len(rcfg.Addresses.Announce) > 0 {
+		rcfg.Addresses.Announce = append(rcfg.Addresses.Announce, onion.String())
+	}
+}
+
+var _ tpt.Transport = (*TorTransport)(nil)
+
+// TorTransport dials through the Tor SOCKS proxy, it proxies the ip and dns
+// protocols so every TCP dial of the node goes through it.
+type TorTransport struct {
+	opts     TorOpts
+	upgrader *tptu.Upgrader
+	socks    proxy.Dialer
+	direct   *net.Dialer
+	onion    *onionService
+}
+
+// newTorTransportConstructor returns a libp2p transport constructor, the onion
+// service is optional.
+func newTorTransportConstructor(opts TorOpts, onion *onionService) func(u *tptu.Upgrader) (*TorTransport, error) {
+	opts.applyDefaults()
+
+	return func(u *tptu.Upgrader) (*TorTransport, error) {
+		direct := &net.Dialer{Timeout: defaultTorDialTimeout}
+
+		socks, err := proxy.SOCKS5("tcp", opts.SocksAddr, nil, direct)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use Tor SOCKS proxy: %w", err)
+		}
+
+		return &TorTransport{
+			opts:     opts,
+			upgrader: u,
+			socks:    socks,
+			direct:   direct,
+			onion:    onion,
+		}, nil
+	}
+}
+
+// torDialTarget returns the host:port to dial through the proxy, the names
+// are resolved by Tor so there is no DNS leak.
+func torDialTarget(addr ma.Multiaddr) (string, error) {
+	if onion, err := addr.ValueForProtocol(ma.P_ONION3); err == nil {
+		// <id>:<port>
+		id, port, err := net.SplitHostPort(onion)
+		if err != nil {
+			return "", err
+		}
+
+		return net.JoinHostPort(id+".onion", port), nil
+	}
+
+	first, rest := ma.SplitFirst(addr)
+	if first == nil || rest == nil {
+		return "", fmt.Errorf("unsupported addr %s", addr)
+	}
+
+	port, err := rest.ValueForProtocol(ma.P_TCP)
+	if err != nil || len(rest.Protocols()) != 1 {
+		return "", fmt.Errorf("unsupported addr %s", addr)
+	}
+
+	switch first.Protocol().Code {
+	case ma.P_IP4, ma.P_IP6, ma.P_DNS4, ma.P_DNS6:
+		return net.JoinHostPort(first.Value(), port), nil
+	}
+
+	return "", fmt.Errorf("unsupported addr %s", addr)
+}
+
+func (t *TorTransport) dial(ctx context.Context, target string) (net.Conn, error) {
+	if d, ok := t.socks.(proxy.ContextDialer); ok {
+		return d.DialContext(ctx, "tcp", target)
+	}
+
+	return t.socks.Dial("tcp", target)
+}
+
+// Dial dials the peer through Tor, the dial is retried without Tor in non
+// strict mode, except for onion addrs.
+func (t *TorTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	target, err := torDialTarget(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := t.dial(ctx, target)
+	if err != nil {
+		if t.opts.Strict || IsOnionAddr(raddr) {
+			return nil, fmt.Errorf("unable to dial %s through Tor: %w", raddr, err)
+		}
+
+		t.opts.Logger.Warn("unable to dial through Tor, falling back to clearnet", zap.Stringer("addr", raddr), zap.Error(err))
+
+		conn, err = t.direct.DialContext(ctx, "tcp", target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	laddr, err := manet.FromNetAddr(conn.LocalAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return t.upgrader.UpgradeOutbound(ctx, t, &proxiedConn{Conn: conn, laddr: laddr, raddr: raddr}, p)
+}
+
+// CanDial returns true for the TCP and onion addrs.
+func (t *TorTransport) CanDial(addr ma.Multiaddr) bool {
+	_, err := torDialTarget(addr)
+	return err == nil
+}
+
+// Listen only accepts the addr of the onion service.
+func (t *TorTransport) Listen(laddr ma.Multiaddr) (tpt.Listener, error) {
+	if t.onion == nil || !t.onion.addr.Equal(laddr) {
+		return nil, fmt.Errorf("unable to listen on %s: not the onion service addr", laddr)
+	}
+
+	return t.upgrader.UpgradeListener(t, &onionListener{service: t.onion}), nil
+}
+
+// Protocols returns the set of protocols handled by this transport.
+func (t *TorTransport) Protocols() []int {
+	return []int{ma.P_ONION3, ma.P_IP4, ma.P_IP6, ma.P_DNS4, ma.P_DNS6}
+}
+
+// Proxy returns true, the ip and dns protocols are proxied.
+func (t *TorTransport) Proxy() bool {
+	return true
+}
+
+func (t *TorTransport) String() string {
+	return "Tor"
+}
+
+// proxiedConn is a connection going through a proxy, the remote addr is
+// the one of the peer, not the one of the proxy.
+type proxiedConn struct {
+	net.Conn
+	laddr, raddr ma.Multiaddr
+}
+
+func (c *proxiedConn) LocalMultiaddr() ma.Multiaddr  { return c.laddr }
+func (c *proxiedConn) RemoteMultiaddr() ma.Multiaddr { return c.raddr }
+
+// onionListener accepts the connections forwarded by Tor to the onion
+// service local port.
+type onionListener struct {
+	service *onionService
+}
+
+func (l *onionListener) Accept() (manet.Conn, error) {
+	conn, err := l.service.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	raddr, err := manet.FromNetAddr(conn.RemoteAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &proxiedConn{Conn: conn, laddr: l.service.addr, raddr: raddr}, nil
+}
+
+func (l *onionListener) Close() error {
+	return l.service.listener.Close()
+}
+
+func (l *onionListener) Addr() net.Addr {
+	return l.service.listener.Addr()
+}
+
+func (l *onionListener) Multiaddr() ma.Multiaddr {
+	return l.service.addr
+}
+
+func onionMultiaddr(serviceID string, port uint16) (ma.Multiaddr, error) {
+	return ma.NewMultiaddr("/onion3/" + serviceID + ":" + strconv.Itoa(int(port)))
+}
@@ -0,0 +1,137 @@
+package ipfsutil
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const torControlOK = 250
+
+// onionService is an ephemeral onion service published through the Tor
+// control port, Tor removes it once the control connection is closed.
+type onionService struct {
+	control  *textproto.Conn
+	listener net.Listener
+	addr     ma.Multiaddr
+}
+
+// newOnionService listens on a local port and asks Tor to forward the onion
+// service port to it.
+func newOnionService(opts TorOpts) (*onionService, error) {
+	opts.applyDefaults()
+
+	conn, err := net.DialTimeout("tcp", opts.ControlAddr, defaultTorDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach Tor control port: %w", err)
+	}
+
+	control := textproto.NewConn(conn)
+	if err := torAuthenticate(control, opts.ControlPassword); err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	target := listener.Addr().(*net.TCPAddr)
+	reply, err := torCommand(control, "ADD_ONION NEW:ED25519-V3 Flags=DiscardPK Port=%d,127.0.0.1:%d", opts.OnionPort, target.Port)
+	if err != nil {
+		listener.Close()
+		control.Close()
+		return nil, fmt.Errorf("unable to publish onion service: %w", err)
+	}
+
+	serviceID := torReplyValue(reply, "ServiceID")
+	if serviceID == "" {
+		listener.Close()
+		control.Close()
+		return nil, fmt.Errorf("unable to publish onion service: no service id in %q", reply)
+	}
+
+	addr, err := onionMultiaddr(serviceID, opts.OnionPort)
+	if err != nil {
+		listener.Close()
+		control.Close()
+		return nil, err
+	}
+
+	return &onionService{control: control, listener: listener, addr: addr}, nil
+}
+
+func (s *onionService) Close() error {
+	s.listener.Close()
+	return s.control.Close()
+}
+
+func torCommand(control *textproto.Conn, format string, args ...interface{}) (string, error) {
+	id, err := control.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+
+	control.StartResponse(id)
+	defer control.EndResponse(id)
+
+	_, reply, err := control.ReadResponse(torControlOK)
+
+	return reply, err
+}
+
+// torReplyValue returns the value of the given key of a reply, e.g.
+// ServiceID in "ServiceID=xxx\nOK".
+func torReplyValue(reply, key string) string {
+	for _, line := range strings.Split(reply, "\n") {
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, key+"=") {
+				return strings.Trim(strings.TrimPrefix(field, key+"="), `"`)
+			}
+		}
+	}
+
+	return ""
+}
+
+// torAuthenticate uses the password if set, then the cookie or the null
+// authentication methods, depending on the ones supported by Tor.
+func torAuthenticate(control *textproto.Conn, password string) error {
+	if password != "" {
+		_, err := torCommand(control, "AUTHENTICATE %s", strconv.Quote(password))
+		return err
+	}
+
+	info, err := torCommand(control, "PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+
+	methods := strings.Split(torReplyValue(info, "METHODS"), ",")
+	for _, m := range methods {
+		switch m {
+		case "NULL":
+			_, err := torCommand(control, "AUTHENTICATE")
+			return err
+
+		case "COOKIE":
+			cookie, err := ioutil.ReadFile(torReplyValue(info, "COOKIEFILE"))
+			if err != nil {
+				return fmt.Errorf("unable to read Tor cookie: %w", err)
+			}
+
+			_, err = torCommand(control, "AUTHENTICATE %s", hex.EncodeToString(cookie))
+			return err
+		}
+	}
+
+	return fmt.Errorf("unsupported Tor authentication methods %q", methods)
+}
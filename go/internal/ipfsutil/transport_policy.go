@@ -0,0 +1,247 @@
+package ipfsutil
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mcma "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/multiaddr"
+	wifi "berty.tech/berty/v2/go/internal/wifi-transport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// TransportCriterion is a property of a transport the dials are ranked by.
+type TransportCriterion string
+
+const (
+	CriterionBandwidth TransportCriterion = "bandwidth"
+	CriterionCost      TransportCriterion = "cost"
+	CriterionBattery   TransportCriterion = "battery"
+	CriterionPrivacy   TransportCriterion = "privacy"
+)
+
+// DefaultTransportPriority favors the unmetered links, then the ones saving
+// battery.
+var DefaultTransportPriority = []TransportCriterion{CriterionCost, CriterionBattery, CriterionBandwidth, CriterionPrivacy}
+
+// TransportClass groups the addrs sharing the same properties.
+type TransportClass string
+
+const (
+	ClassBLE      TransportClass = "ble"
+	ClassWifi     TransportClass = "wifi"
+	ClassLAN      TransportClass = "lan"
+	ClassInternet TransportClass = "internet"
+	ClassRelay    TransportClass = "relay"
+	ClassTor      TransportClass = "tor"
+	ClassUnknown  TransportClass = "unknown"
+)
+
+// TransportScores rates a transport class by criterion, the higher the
+// better, e.g. a free link has the highest cost score.
+type TransportScores map[TransportCriterion]int
+
+// DefaultTransportScores are rough estimations: the proximity links are free
+// and don't leave the room but are slow, the relays consume the data plan of
+// both peers and are seen by the relay, Tor hides the addrs of the peers.
+var DefaultTransportScores = map[TransportClass]TransportScores{
+	ClassBLE:      {CriterionBandwidth: 0, CriterionCost: 3, CriterionBattery: 2, CriterionPrivacy: 2},
+	ClassWifi:     {CriterionBandwidth: 2, CriterionCost: 3, CriterionBattery: 1, CriterionPrivacy: 2},
+	ClassLAN:      {CriterionBandwidth: 3, CriterionCost: 3, CriterionBattery: 3, CriterionPrivacy: 2},
+	ClassInternet: {CriterionBandwidth: 2, CriterionCost: 1, CriterionBattery: 2, CriterionPrivacy: 1},
+	ClassRelay:    {CriterionBandwidth: 1, CriterionCost: 0, CriterionBattery: 1, CriterionPrivacy: 0},
+	ClassTor:      {CriterionBandwidth: 0, CriterionCost: 1, CriterionBattery: 0, CriterionPrivacy: 3},
+}
+
+// DefaultTransportStagger is the delay between the dials of two consecutive
+// classes of addrs.
+const DefaultTransportStagger = 500 * time.Millisecond
+
+// ParseTransportPriority parses a comma separated list of criteria, e.g.
+// "privacy,cost". The missing criteria keep their default order after the
+// given ones.
+func ParseTransportPriority(s string) ([]TransportCriterion, error) {
+	priority := []TransportCriterion{}
+	known := map[TransportCriterion]bool{}
+
+	for _, field := range strings.Split(s, ",") {
+		c := TransportCriterion(strings.TrimSpace(field))
+		if c == "" {
+			continue
+		}
+
+		if _, ok := DefaultTransportScores[ClassLAN][c]; !ok {
+			return nil, fmt.Errorf("unknown transport criterion %q", c)
+		}
+
+		if known[c] {
+			return nil, fmt.Errorf("duplicate transport criterion %q", c)
+		}
+
+		known[c] = true
+		priority = append(priority, c)
+	}
+
+	for _, c := range DefaultTransportPriority {
+		if !known[c] {
+			priority = append(priority, c)
+		}
+	}
+
+	return priority, nil
+}
+
+// ClassifyAddr returns the transport class of the addr.
+func ClassifyAddr(addr ma.Multiaddr) TransportClass {
+	protos := addr.Protocols()
+	for _, p := range protos {
+		switch p.Code {
+		case ma.P_CIRCUIT:
+			return ClassRelay
+		case ma.P_ONION, ma.P_ONION3:
+			return ClassTor
+		}
+	}
+
+	for _, p := range protos {
+		switch p.Code {
+		case mcma.P_MC:
+			return ClassBLE
+		case wifi.P_WIFI:
+			return ClassWifi
+		}
+	}
+
+	if _, err := manet.ToIP(addr); err == nil {
+		if manet.IsPrivateAddr(addr) || manet.IsIPLoopback(addr) {
+			return ClassLAN
+		}
+
+		return ClassInternet
+	}
+
+	for _, p := range protos {
+		if p.Code == ma.P_DNS4 || p.Code == ma.P_DNS6 || p.Code == ma.P_DNSADDR {
+			return ClassInternet
+		}
+	}
+
+	return ClassUnknown
+}
+
+// TransportPolicyOpts configures a transport policy.
+type TransportPolicyOpts struct {
+	// Priority orders the criteria, DefaultTransportPriority is used if empty
+	Priority []TransportCriterion
+
+	// Scores overrides the DefaultTransportScores of the given classes
+	Scores map[TransportClass]TransportScores
+
+	// Stagger is the delay between two classes of dials,
+	// DefaultTransportStagger is used if 0
+	Stagger time.Duration
+}
+
+// TransportPolicy ranks the addrs of a peer by comparing the scores of their
+// classes criterion by criterion, in the priority order. The dials of the
+// ranked addrs are staggered, so the best path is tried first and wins as
+// long as it succeeds quickly.
+type TransportPolicy struct {
+	scores  map[TransportClass]TransportScores
+	stagger time.Duration
+
+	muPriority sync.RWMutex
+	priority   []TransportCriterion
+}
+
+func NewTransportPolicy(opts TransportPolicyOpts) *TransportPolicy {
+	if len(opts.Priority) == 0 {
+		opts.Priority = DefaultTransportPriority
+	}
+
+	if opts.Stagger == 0 {
+		opts.Stagger = DefaultTransportStagger
+	}
+
+	scores := make(map[TransportClass]TransportScores)
+	for class, s := range DefaultTransportScores {
+		scores[class] = s
+	}
+
+	for class, s := range opts.Scores {
+		scores[class] = s
+	}
+
+	return &TransportPolicy{
+		priority: opts.Priority,
+		scores:   scores,
+		stagger:  opts.Stagger,
+	}
+}
+
+// compare returns a negative value if a is better than b, a positive one if
+// b is better, 0 if they are equivalent. The unknown classes come last.
+func (p *TransportPolicy) compare(a, b TransportClass) int {
+	sa, oka := p.scores[a]
+	sb, okb := p.scores[b]
+
+	switch {
+	case !oka && !okb:
+		return 0
+	case !oka:
+		return 1
+	case !okb:
+		return -1
+	}
+
+	p.muPriority.RLock()
+	defer p.muPriority.RUnlock()
+
+	for _, c := range p.priority {
+		if d := sb[c] - sa[c]; d != 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// SetPriority replaces the order of the criteria, the next dials are ranked
+// with it. DefaultTransportPriority is used if empty.
+func (p *TransportPolicy) SetPriority(priority []TransportCriterion) {
+	if len(priority) == 0 {
+		priority = DefaultTransportPriority
+	}
+
+	p.muPriority.Lock()
+	p.priority = priority
+	p.muPriority.Unlock()
+}
+
+// Rank returns the addrs sorted from the best to the worst.
+func (p *TransportPolicy) Rank(addrs []ma.Multiaddr) []ma.Multiaddr {
+	ranked := append([]ma.Multiaddr{}, addrs...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return p.compare(ClassifyAddr(ranked[i]), ClassifyAddr(ranked[j])) < 0
+	})
+
+	return ranked
+}
+
+// DialDelay returns how long the dial of addr waits, given the other addrs of
+// the peer: one stagger by class of addrs ranked better.
+func (p *TransportPolicy) DialDelay(addr ma.Multiaddr, candidates []ma.Multiaddr) time.Duration {
+	class := ClassifyAddr(addr)
+
+	better := map[TransportClass]struct{}{}
+	for _, c := range candidates {
+		if other := ClassifyAddr(c); p.compare(other, class) < 0 {
+			better[other] = struct{}{}
+		}
+	}
+
+	return time.Duration(len(better)) * p.stagger
+}
@@ -0,0 +1,182 @@
+package ipfsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	ipfs_cfg "github.com/ipfs/go-ipfs-config"
+	ipfs_core "github.com/ipfs/go-ipfs/core"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+const defaultWebSocketDialTimeout = 10 * time.Second
+
+// WebSocketOpts configures the WebSocket listener used by the browser
+// clients. Browsers only dial WSS from a secure page, the WSS addr, e.g.
+// /dns4/<cert name>/tcp/<tls port>/wss, has to be part of the announced addrs
+// since the certificate name can't be guessed.
+type WebSocketOpts struct {
+	Logger *zap.Logger
+
+	// Port is the TCP port of the WebSocket listener, disabled if 0
+	Port uint16
+
+	// TLSPort, if set, is the port of the WSS listener, the TLS connections
+	// are terminated with the given certificate then forwarded to the
+	// WebSocket listener
+	TLSPort  uint16
+	CertFile string
+	KeyFile  string
+}
+
+func (opts WebSocketOpts) validate() error {
+	if opts.TLSPort == 0 {
+		return nil
+	}
+
+	switch {
+	case opts.Port == 0:
+		return fmt.Errorf("WSS needs the WebSocket listener to be enabled")
+	case opts.Port == opts.TLSPort:
+		return fmt.Errorf("WSS and WebSocket listeners can't share port %d", opts.Port)
+	case opts.CertFile == "" || opts.KeyFile == "":
+		return fmt.Errorf("WSS needs a certificate and a key")
+	}
+
+	return nil
+}
+
+// Listeners returns the WebSocket multiaddrs to listen on.
+func (opts WebSocketOpts) Listeners() []string {
+	if opts.Port == 0 {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d/ws", opts.Port),
+		fmt.Sprintf("/ip6/::/tcp/%d/ws", opts.Port),
+	}
+}
+
+// applyWebSocketConfig adds the WebSocket listeners to the repo config, and a
+// WebSocket address next to each announced TCP one.
+func applyWebSocketConfig(rcfg *ipfs_cfg.Config, opts WebSocketOpts) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	if opts.Port == 0 {
+		return nil
+	}
+
+	rcfg.Addresses.Swarm = append(rcfg.Addresses.Swarm, opts.Listeners()...)
+
+	announce := []string{}
+	for _, addr := range rcfg.Addresses.Announce {
+		announce = append(announce, addr)
+
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid announce addr %q: %w", addr, err)
+		}
+
+		// /ip4/<ip>/tcp/<port> => /ip4/<ip>/tcp/<ws port>/ws
+		ip, rest := ma.SplitFirst(maddr)
+		if ip == nil || rest == nil || !isIPComponent(ip) || len(rest.Protocols()) != 1 {
+			continue
+		}
+
+		if _, err := rest.ValueForProtocol(ma.P_TCP); err != nil {
+			continue
+		}
+
+		ws, err := ma.NewMultiaddr(fmt.Sprintf("/tcp/%d/ws", opts.Port))
+		if err != nil {
+			return err
+		}
+
+		announce = append(announce, ip.Encapsulate(ws).String())
+	}
+
+	rcfg.Addresses.Announce = announce
+
+	return nil
+}
+
+// OptionWebSocketTLS returns a CoreAPIOption terminating the WSS connections
+// and forwarding them to the WebSocket listener.
+func OptionWebSocketTLS(opts WebSocketOpts) CoreAPIOption {
+	return func(ctx context.Context, _ *ipfs_core.IpfsNode, _ ipfs_interface.CoreAPI) error {
+		if opts.Logger == nil {
+			opts.Logger = zap.NewNop()
+		}
+
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load WSS certificate: %w", err)
+		}
+
+		l, err := tls.Listen("tcp", ":"+strconv.Itoa(int(opts.TLSPort)), &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+
+		target := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(opts.Port)))
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					if ctx.Err() == nil {
+						opts.Logger.Error("WSS listener stopped", zap.Error(err))
+					}
+
+					return
+				}
+
+				go forwardConn(opts.Logger, conn, target)
+			}
+		}()
+
+		opts.Logger.Info("WSS listener started", zap.Uint16("port", opts.TLSPort), zap.String("target", target))
+
+		return nil
+	}
+}
+
+func forwardConn(logger *zap.Logger, conn net.Conn, target string) {
+	defer conn.Close()
+
+	upstream, err := net.DialTimeout("tcp", target, defaultWebSocketDialTimeout)
+	if err != nil {
+		logger.Warn("unable to reach WebSocket listener", zap.Error(err))
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+
+	// the first side closed ends both
+	<-done
+}
@@ -0,0 +1,10 @@
+// Package kyber implements ML-KEM-768, the key encapsulation mechanism
+// standardized from Kyber by FIPS 203.
+//
+// A decapsulation key is derived from a 64 bytes seed, only the seed needs
+// to be stored. The encapsulation key is 1184 bytes, a ciphertext 1088
+// bytes and a shared key 32 bytes.
+//
+// It is meant to be combined with a classical key exchange, so the keys
+// established stay confidential even if one of the two is broken.
+package kyber
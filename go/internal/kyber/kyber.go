@@ -0,0 +1,450 @@
+package kyber
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"io"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// SeedSize is the size of the seed a decapsulation key is derived from
+	SeedSize = 64
+
+	// SharedKeySize is the size of the shared keys
+	SharedKeySize = 32
+
+	EncapsulationKeySize = encodedPolySize*k + 32
+	CiphertextSize       = 32 * (du*k + dv)
+)
+
+const (
+	n = 256
+	q = 3329
+	k = 3
+
+	eta1 = 2
+	eta2 = 2
+	du   = 10
+	dv   = 4
+
+	encodedPolySize = 32 * 12
+
+	// nInv is 128^-1 mod q, the scaling of the inverse NTT
+	nInv = 3303
+)
+
+// zetas are the powers of the root of unity 17 in the bit reversed order,
+// gammas the odd powers of the base case multiplications
+var zetas, gammas [128]uint16
+
+func init() {
+	for i := range zetas {
+		r := bitRev7(uint(i))
+		zetas[i] = pow17(r)
+		gammas[i] = pow17(2*r + 1)
+	}
+}
+
+func bitRev7(i uint) uint {
+	r := uint(0)
+	for b := 0; b < 7; b++ {
+		r |= (i >> b & 1) << (6 - b)
+	}
+
+	return r
+}
+
+func pow17(e uint) uint16 {
+	x := uint32(1)
+	for ; e > 0; e-- {
+		x = x * 17 % q
+	}
+
+	return uint16(x)
+}
+
+type poly [n]uint16
+
+func add(a, b uint16) uint16 {
+	return uint16((uint32(a) + uint32(b)) % q)
+}
+
+func sub(a, b uint16) uint16 {
+	return uint16((uint32(a) + q - uint32(b)) % q)
+}
+
+func mul(a, b uint16) uint16 {
+	return uint16(uint32(a) * uint32(b) % q)
+}
+
+func (f *poly) add(g *poly) {
+	for i := range f {
+		f[i] = add(f[i], g[i])
+	}
+}
+
+func (f *poly) ntt() {
+	i := 1
+	for length := 128; length >= 2; length /= 2 {
+		for start := 0; start < n; start += 2 * length {
+			zeta := zetas[i]
+			i++
+			for j := start; j < start+length; j++ {
+				t := mul(zeta, f[j+length])
+				f[j+length] = sub(f[j], t)
+				f[j] = add(f[j], t)
+			}
+		}
+	}
+}
+
+func (f *poly) invNTT() {
+	i := 127
+	for length := 2; length <= 128; length *= 2 {
+		for start := 0; start < n; start += 2 * length {
+			zeta := zetas[i]
+			i--
+			for j := start; j < start+length; j++ {
+				t := f[j]
+				f[j] = add(t, f[j+length])
+				f[j+length] = mul(zeta, sub(f[j+length], t))
+			}
+		}
+	}
+
+	for j := range f {
+		f[j] = mul(f[j], nInv)
+	}
+}
+
+// mulAddNTT adds the product of two polynomials in the NTT domain to h.
+func mulAddNTT(h, f, g *poly) {
+	for i := 0; i < 128; i++ {
+		a0, a1, b0, b1 := f[2*i], f[2*i+1], g[2*i], g[2*i+1]
+		c0 := add(mul(a0, b0), mul(mul(a1, b1), gammas[i]))
+		c1 := add(mul(a0, b1), mul(a1, b0))
+		h[2*i] = add(h[2*i], c0)
+		h[2*i+1] = add(h[2*i+1], c1)
+	}
+}
+
+// sampleNTT samples a polynomial in the NTT domain from a seed and the
+// indexes of the matrix.
+func sampleNTT(rho []byte, j, i byte) *poly {
+	xof := sha3.NewShake128()
+	_, _ = xof.Write(rho)
+	_, _ = xof.Write([]byte{j, i})
+
+	f := &poly{}
+	buf := make([]byte, 3)
+	for c := 0; c < n; {
+		_, _ = xof.Read(buf)
+		d1 := uint16(buf[0]) | uint16(buf[1]&0x0f)<<8
+		d2 := uint16(buf[1]>>4) | uint16(buf[2])<<4
+
+		if d1 < q {
+			f[c] = d1
+			c++
+		}
+
+		if d2 < q && c < n {
+			f[c] = d2
+			c++
+		}
+	}
+
+	return f
+}
+
+// samplePolyCBD samples a polynomial from the centered binomial distribution
+// of parameter 2, the only one used by ML-KEM-768.
+func samplePolyCBD(seed []byte, nonce byte) *poly {
+	prf := sha3.NewShake256()
+	_, _ = prf.Write(seed)
+	_, _ = prf.Write([]byte{nonce})
+
+	buf := make([]byte, 64*eta1)
+	_, _ = prf.Read(buf)
+
+	f := &poly{}
+	for i := 0; i < n; i++ {
+		b := buf[i/2] >> (4 * (i % 2))
+		x := uint16(b&1) + uint16((b>>1)&1)
+		y := uint16((b>>2)&1) + uint16((b>>3)&1)
+		f[i] = sub(x, y)
+	}
+
+	return f
+}
+
+func compress(x uint16, d uint) uint16 {
+	return uint16(((uint32(x)<<d)+q/2)/q) & (1<<d - 1)
+}
+
+func decompress(y uint16, d uint) uint16 {
+	return uint16((uint32(y)*q + 1<<(d-1)) >> d)
+}
+
+// encode packs the coefficients of f on d bits each, little-endian.
+func encode(out []byte, f *poly, d uint) []byte {
+	var acc uint32
+	var bits uint
+	for _, c := range f {
+		acc |= uint32(c) << bits
+		bits += d
+		for bits >= 8 {
+			out = append(out, byte(acc))
+			acc >>= 8
+			bits -= 8
+		}
+	}
+
+	return out
+}
+
+// decode unpacks the coefficients of f on d bits each, the 12 bits ones are
+// reduced modulo q.
+func decode(b []byte, d uint) *poly {
+	f := &poly{}
+	var acc uint32
+	var bits uint
+	c := 0
+	for _, x := range b {
+		acc |= uint32(x) << bits
+		bits += 8
+		for bits >= d && c < n {
+			f[c] = uint16(acc & (1<<d - 1))
+			if d == 12 {
+				f[c] %= q
+			}
+			acc >>= d
+			bits -= d
+			c++
+		}
+	}
+
+	return f
+}
+
+func g(parts ...[]byte) ([]byte, []byte) {
+	h := sha3.New512()
+	for _, p := range parts {
+		_, _ = h.Write(p)
+	}
+
+	sum := h.Sum(nil)
+
+	return sum[:32], sum[32:]
+}
+
+// pkeKeyGen derives the key pair of the underlying encryption scheme.
+func pkeKeyGen(d []byte) (ek []byte, dk []byte) {
+	rho, sigma := g(d, []byte{k})
+
+	var nonce byte
+	s, e := [k]*poly{}, [k]*poly{}
+	for i := range s {
+		s[i] = samplePolyCBD(sigma, nonce)
+		s[i].ntt()
+		nonce++
+	}
+
+	for i := range e {
+		e[i] = samplePolyCBD(sigma, nonce)
+		e[i].ntt()
+		nonce++
+	}
+
+	ek = make([]byte, 0, EncapsulationKeySize)
+	dk = make([]byte, 0, encodedPolySize*k)
+	for i := 0; i < k; i++ {
+		t := e[i]
+		for j := 0; j < k; j++ {
+			mulAddNTT(t, sampleNTT(rho, byte(j), byte(i)), s[j])
+		}
+
+		ek = encode(ek, t, 12)
+		dk = encode(dk, s[i], 12)
+	}
+
+	return append(ek, rho...), dk
+}
+
+func pkeEncrypt(ek, m, r []byte) []byte {
+	t := [k]*poly{}
+	for i := range t {
+		t[i] = decode(ek[encodedPolySize*i:encodedPolySize*(i+1)], 12)
+	}
+	rho := ek[encodedPolySize*k:]
+
+	var nonce byte
+	y := [k]*poly{}
+	for i := range y {
+		y[i] = samplePolyCBD(r, nonce)
+		y[i].ntt()
+		nonce++
+	}
+
+	c := make([]byte, 0, CiphertextSize)
+	for i := 0; i < k; i++ {
+		u := &poly{}
+		for j := 0; j < k; j++ {
+			mulAddNTT(u, sampleNTT(rho, byte(i), byte(j)), y[j])
+		}
+
+		u.invNTT()
+		u.add(samplePolyCBD(r, nonce))
+		nonce++
+
+		for j := range u {
+			u[j] = compress(u[j], du)
+		}
+
+		c = encode(c, u, du)
+	}
+
+	v := &poly{}
+	for i := 0; i < k; i++ {
+		mulAddNTT(v, t[i], y[i])
+	}
+
+	v.invNTT()
+	v.add(samplePolyCBD(r, nonce))
+
+	mu := decode(m, 1)
+	for j := range mu {
+		mu[j] = decompress(mu[j], 1)
+	}
+	v.add(mu)
+
+	for j := range v {
+		v[j] = compress(v[j], dv)
+	}
+
+	return encode(c, v, dv)
+}
+
+func pkeDecrypt(dk, c []byte) []byte {
+	w := &poly{}
+	for i := 0; i < k; i++ {
+		u := decode(c[32*du*i:32*du*(i+1)], du)
+		for j := range u {
+			u[j] = decompress(u[j], du)
+		}
+
+		u.ntt()
+		mulAddNTT(w, decode(dk[encodedPolySize*i:encodedPolySize*(i+1)], 12), u)
+	}
+
+	w.invNTT()
+
+	v := decode(c[32*du*k:], dv)
+	for j := range v {
+		v[j] = compress(sub(decompress(v[j], dv), w[j]), 1)
+	}
+
+	return encode(make([]byte, 0, 32), v, 1)
+}
+
+// DecapsulationKey is the private key of ML-KEM-768.
+type DecapsulationKey struct {
+	seed []byte
+	dk   []byte
+	ek   []byte
+	h    [32]byte
+}
+
+// GenerateKey generates a new decapsulation key.
+func GenerateKey() (*DecapsulationKey, error) {
+	seed := make([]byte, SeedSize)
+	if _, err := io.ReadFull(crand.Reader, seed); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	return NewDecapsulationKey(seed)
+}
+
+// NewDecapsulationKey derives a decapsulation key from its seed.
+func NewDecapsulationKey(seed []byte) (*DecapsulationKey, error) {
+	if len(seed) != SeedSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid seed size"))
+	}
+
+	ek, dk := pkeKeyGen(seed[:32])
+
+	return &DecapsulationKey{
+		seed: append([]byte{}, seed...),
+		dk:   dk,
+		ek:   ek,
+		h:    sha3.Sum256(ek),
+	}, nil
+}
+
+// Bytes returns the seed of the key.
+func (key *DecapsulationKey) Bytes() []byte {
+	return append([]byte{}, key.seed...)
+}
+
+// EncapsulationKey returns the public key shared with the encapsulating
+// party.
+func (key *DecapsulationKey) EncapsulationKey() []byte {
+	return append([]byte{}, key.ek...)
+}
+
+// Decapsulate returns the shared key of a ciphertext. An invalid ciphertext
+// results in a random looking key, the mismatch is only detected by the use
+// of the key.
+func (key *DecapsulationKey) Decapsulate(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) != CiphertextSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid ciphertext size"))
+	}
+
+	m := pkeDecrypt(key.dk, ciphertext)
+	shared, r := g(m, key.h[:])
+
+	rejected := make([]byte, SharedKeySize)
+	j := sha3.NewShake256()
+	_, _ = j.Write(key.seed[32:])
+	_, _ = j.Write(ciphertext)
+	_, _ = j.Read(rejected)
+
+	expected := pkeEncrypt(key.ek, m, r)
+	subtle.ConstantTimeCopy(1-subtle.ConstantTimeCompare(ciphertext, expected), shared, rejected)
+
+	return shared, nil
+}
+
+// Encapsulate generates a shared key and its ciphertext for an encapsulation
+// key.
+func Encapsulate(ek []byte) (sharedKey []byte, ciphertext []byte, err error) {
+	m := make([]byte, 32)
+	if _, err := io.ReadFull(crand.Reader, m); err != nil {
+		return nil, nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	return encapsulate(ek, m)
+}
+
+func encapsulate(ek []byte, m []byte) ([]byte, []byte, error) {
+	if len(ek) != EncapsulationKeySize {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid encapsulation key size"))
+	}
+
+	// the coefficients of the key must be reduced
+	for i := 0; i < k; i++ {
+		chunk := ek[encodedPolySize*i : encodedPolySize*(i+1)]
+		if !bytes.Equal(encode(nil, decode(chunk, 12), 12), chunk) {
+			return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid encapsulation key"))
+		}
+	}
+
+	h := sha3.Sum256(ek)
+	shared, r := g(m, h[:])
+
+	return shared, pkeEncrypt(ek, m, r), nil
+}
@@ -0,0 +1,90 @@
+package kyber
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncapsulate(t *testing.T) {
+	dk, err := GenerateKey()
+	require.NoError(t, err)
+
+	shared, ciphertext, err := Encapsulate(dk.EncapsulationKey())
+	require.NoError(t, err)
+	assert.Len(t, shared, SharedKeySize)
+	assert.Len(t, ciphertext, CiphertextSize)
+
+	opened, err := dk.Decapsulate(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, shared, opened)
+
+	// the key is restored from its seed
+	restored, err := NewDecapsulationKey(dk.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, dk.EncapsulationKey(), restored.EncapsulationKey())
+
+	opened, err = restored.Decapsulate(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, shared, opened)
+}
+
+func TestDecapsulateRejected(t *testing.T) {
+	dk, err := GenerateKey()
+	require.NoError(t, err)
+
+	shared, ciphertext, err := Encapsulate(dk.EncapsulationKey())
+	require.NoError(t, err)
+
+	ciphertext[0] ^= 1
+	rejected, err := dk.Decapsulate(ciphertext)
+	require.NoError(t, err)
+	assert.NotEqual(t, shared, rejected)
+
+	// the rejection is deterministic
+	again, err := dk.Decapsulate(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, rejected, again)
+
+	_, err = dk.Decapsulate(ciphertext[1:])
+	assert.Error(t, err)
+}
+
+func TestInvalidEncapsulationKey(t *testing.T) {
+	dk, err := GenerateKey()
+	require.NoError(t, err)
+
+	ek := dk.EncapsulationKey()
+	_, _, err = Encapsulate(ek[1:])
+	assert.Error(t, err)
+
+	// a coefficient which isn't reduced modulo q
+	ek[0], ek[1] = 0xff, ek[1]|0x0f
+	_, _, err = Encapsulate(ek)
+	assert.Error(t, err)
+}
+
+// the expected values were computed with another ML-KEM-768 implementation
+func TestKnownAnswer(t *testing.T) {
+	seed := make([]byte, SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+
+	dk, err := NewDecapsulationKey(seed)
+	require.NoError(t, err)
+
+	ekHash := sha256.Sum256(dk.EncapsulationKey())
+	assert.Equal(t, "0b7934c83125c788995e2ba6bd761e33046b3e40571be53e023309a29f398cc9", hex.EncodeToString(ekHash[:]))
+
+	shared, ciphertext, err := encapsulate(dk.EncapsulationKey(), bytes.Repeat([]byte{0x42}, 32))
+	require.NoError(t, err)
+
+	ctHash := sha256.Sum256(ciphertext)
+	assert.Equal(t, "9c7b2f8d05c70575ec03ed8f93b7bb298e1506b97e54e5e885748965b1466f1c", hex.EncodeToString(ctHash[:]))
+	assert.Equal(t, "b83e7f23b33f909715c7a50b0d4b1f6684d53e1f4b9056f803b29f058ccb5566", hex.EncodeToString(shared))
+}
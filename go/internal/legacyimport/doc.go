@@ -0,0 +1,8 @@
+// Package legacyimport converts the data written by previous generations of
+// the daemon into the current store layout.
+//
+// The legacy layout kept the device keystore under the `/account` namespace,
+// with keys serialized as raw ed25519 private keys (64 bytes) or seeds (32
+// bytes). The current layout keeps them under `/accountGroup`, serialized
+// using the libp2p protobuf key format.
+package legacyimport
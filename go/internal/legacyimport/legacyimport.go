@@ -0,0 +1,177 @@
+package legacyimport
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
+)
+
+var (
+	// LegacyKeystoreNamespace is where the previous generation stored its keys
+	LegacyKeystoreNamespace = datastore.NewKey("account")
+
+	// KeystoreNamespace is where the current generation stores its keys
+	KeystoreNamespace = datastore.NewKey("accountGroup")
+
+	// doneKey is set once an import has been committed
+	doneKey = datastore.NewKey("legacyimport/done")
+)
+
+// Opts contains optional configuration flags for the import
+type Opts struct {
+	Logger *zap.Logger
+
+	// DryRun validates and converts the legacy data without writing anything
+	DryRun bool
+}
+
+// Report summarizes an import
+type Report struct {
+	DryRun bool
+
+	// AlreadyDone is true when an import has previously been committed
+	AlreadyDone bool
+
+	// Imported lists the keys converted (or that would be converted)
+	Imported []string
+
+	// Skipped lists the keys already present in the current store
+	Skipped []string
+
+	// Invalid lists the legacy entries that couldn't be converted
+	Invalid map[string]error
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("imported: %d, skipped: %d, invalid: %d, dry run: %t, already done: %t",
+		len(r.Imported), len(r.Skipped), len(r.Invalid), r.DryRun, r.AlreadyDone)
+}
+
+// Import reads the legacy data from the root datastore and converts it into
+// the current layout of the same datastore. Entries already present in the
+// current layout are never overwritten and the legacy entries are kept, so a
+// failed or partial import can safely be retried.
+func Import(root datastore.Batching, opts Opts) (*Report, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	logger := opts.Logger.Named("legacyimport")
+
+	report := &Report{
+		DryRun:  opts.DryRun,
+		Invalid: map[string]error{},
+	}
+
+	done, err := root.Has(doneKey)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if done {
+		report.AlreadyDone = true
+		return report, nil
+	}
+
+	res, err := root.Query(query.Query{Prefix: LegacyKeystoreNamespace.String()})
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	converted := map[datastore.Key][]byte{}
+	for _, entry := range entries {
+		name := strings.TrimPrefix(entry.Key, LegacyKeystoreNamespace.String()+"/")
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+
+		dstKey := KeystoreNamespace.ChildString(name)
+		exists, err := root.Has(dstKey)
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		if exists {
+			report.Skipped = append(report.Skipped, name)
+			continue
+		}
+
+		value, err := convertKey(entry.Value)
+		if err != nil {
+			logger.Warn("unable to convert legacy key", zap.String("name", name), zap.Error(err))
+			report.Invalid[name] = err
+			continue
+		}
+
+		converted[dstKey] = value
+		report.Imported = append(report.Imported, name)
+	}
+
+	if opts.DryRun {
+		logger.Info("legacy import dry run", zap.Stringer("report", report))
+		return report, nil
+	}
+
+	batch, err := root.Batch()
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	for key, value := range converted {
+		if err := batch.Put(key, value); err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+	}
+
+	if err := batch.Put(doneKey, []byte{1}); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if err := batch.Commit(); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	logger.Info("legacy import done", zap.Stringer("report", report))
+
+	return report, nil
+}
+
+// convertKey converts a legacy private key into the libp2p protobuf format
+func convertKey(value []byte) ([]byte, error) {
+	// already using the current format
+	if sk, err := crypto.UnmarshalPrivateKey(value); err == nil {
+		return crypto.MarshalPrivateKey(sk)
+	}
+
+	var raw []byte
+	switch len(value) {
+	case ed25519.PrivateKeySize:
+		raw = value
+	case ed25519.SeedSize:
+		raw = ed25519.NewKeyFromSeed(value)
+	default:
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("unexpected key size %d", len(value)))
+	}
+
+	sk, err := crypto.UnmarshalEd25519PrivateKey(raw)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	bytes, err := crypto.MarshalPrivateKey(sk)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return bytes, nil
+}
@@ -0,0 +1,73 @@
+package legacyimport
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	datastore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImport(t *testing.T) {
+	_, legacy, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	current, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	currentBytes, err := crypto.MarshalPrivateKey(current)
+	require.NoError(t, err)
+
+	root := dssync.MutexWrap(datastore.NewMapDatastore())
+	require.NoError(t, root.Put(LegacyKeystoreNamespace.ChildString("device"), legacy))
+	require.NoError(t, root.Put(LegacyKeystoreNamespace.ChildString("seed"), legacy.Seed()))
+	require.NoError(t, root.Put(LegacyKeystoreNamespace.ChildString("broken"), []byte("broken")))
+	require.NoError(t, root.Put(LegacyKeystoreNamespace.ChildString("existing"), legacy))
+	require.NoError(t, root.Put(KeystoreNamespace.ChildString("existing"), currentBytes))
+
+	opts := Opts{Logger: testutil.Logger(t)}
+
+	// dry run
+	opts.DryRun = true
+	report, err := Import(root, opts)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"device", "seed"}, report.Imported)
+	assert.Equal(t, []string{"existing"}, report.Skipped)
+	assert.Contains(t, report.Invalid, "broken")
+
+	has, err := root.Has(KeystoreNamespace.ChildString("device"))
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	// actual import
+	opts.DryRun = false
+	report, err = Import(root, opts)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"device", "seed"}, report.Imported)
+
+	for _, name := range []string{"device", "seed"} {
+		value, err := root.Get(KeystoreNamespace.ChildString(name))
+		require.NoError(t, err)
+
+		sk, err := crypto.UnmarshalPrivateKey(value)
+		require.NoError(t, err)
+
+		raw, err := sk.Raw()
+		require.NoError(t, err)
+		assert.Equal(t, []byte(legacy), raw)
+	}
+
+	value, err := root.Get(KeystoreNamespace.ChildString("existing"))
+	require.NoError(t, err)
+	assert.Equal(t, currentBytes, value)
+
+	// second run is a no-op
+	report, err = Import(root, opts)
+	require.NoError(t, err)
+	assert.True(t, report.AlreadyDone)
+	assert.Empty(t, report.Imported)
+}
@@ -0,0 +1,13 @@
+// Package linkpreview fetches the previews of the links of the messages
+// without revealing the IP of their recipients to the linked servers.
+//
+// The sender attaches the previews to its messages, so the recipients never
+// fetch the links. The previews are fetched directly, through the SOCKS5
+// proxy of the node, or through a preview relay: a self-hosted service,
+// started with `berty link-preview-relay`, fetching the pages on behalf of
+// the devices. The recipients showing the preview of a link received without
+// one only fetch it through the proxy or the relay.
+//
+// A preview only holds the metadata of the page and a small thumbnail, the
+// images are embedded so they aren't fetched by the recipients either.
+package linkpreview
@@ -0,0 +1,345 @@
+package linkpreview
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+// Route is how the previews are fetched.
+type Route string
+
+const (
+	// RouteDirect fetches the pages from the device, it reveals its IP to
+	// the linked servers
+	RouteDirect Route = "direct"
+
+	// RouteProxy fetches the pages through the SOCKS5 proxy of the node
+	RouteProxy Route = "proxy"
+
+	// RouteRelay asks a preview relay to fetch the pages
+	RouteRelay Route = "relay"
+)
+
+// ParseRoute parses the name of a route.
+func ParseRoute(s string) (Route, error) {
+	switch r := Route(s); r {
+	case RouteDirect, RouteProxy, RouteRelay:
+		return r, nil
+	}
+
+	return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown link preview route %q, expected direct, proxy or relay", s))
+}
+
+const (
+	// DefaultCacheTTL is how long a preview is reused
+	DefaultCacheTTL = 24 * time.Hour
+
+	// DefaultTimeout caps the fetch of a preview, the message attaching it
+	// waits for it
+	DefaultTimeout = 5 * time.Second
+
+	maxRedirects = 5
+	userAgent    = "Mozilla/5.0 (compatible; BertyLinkPreview/1.0)"
+)
+
+var previewsKey = ipfs_ds.NewKey("linkpreview")
+
+// Opts configures a preview fetcher.
+type Opts struct {
+	Logger *zap.Logger
+	Route  Route
+
+	// Proxy is the SOCKS5 proxy of RouteProxy, see ipfsutil.ProxyOpts.Dialer
+	Proxy proxy.Dialer
+
+	// Host dials the Relay of RouteRelay
+	Host  host.Host
+	Relay *peer.AddrInfo
+
+	// Datastore caches the previews, in memory if nil
+	Datastore ipfs_ds.Datastore
+	CacheTTL  time.Duration
+	Timeout   time.Duration
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		opts.Datastore = ipfs_ds.NewMapDatastore()
+	}
+
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = DefaultCacheTTL
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+}
+
+// Fetcher fetches and caches the previews of the links through its route.
+type Fetcher struct {
+	logger *zap.Logger
+	opts   Opts
+
+	// client fetches the pages, nil for RouteRelay
+	client *http.Client
+}
+
+func NewFetcher(opts Opts) (*Fetcher, error) {
+	opts.applyDefaults()
+
+	f := &Fetcher{
+		logger: opts.Logger.Named("linkpreview"),
+		opts:   opts,
+	}
+
+	switch opts.Route {
+	case RouteDirect:
+		f.client = newHTTPClient(directDialer(opts.Timeout), opts.Timeout)
+	case RouteProxy:
+		if opts.Proxy == nil {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the proxy route needs a proxy"))
+		}
+
+		f.client = newHTTPClient(proxyDialer(opts.Proxy), opts.Timeout)
+	case RouteRelay:
+		if opts.Host == nil || opts.Relay == nil {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the relay route needs a relay"))
+		}
+	default:
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown link preview route %q", opts.Route))
+	}
+
+	return f, nil
+}
+
+// Route returns how the previews are fetched.
+func (f *Fetcher) Route() Route {
+	return f.opts.Route
+}
+
+// Fetch returns the preview of a link, from the cache if it was fetched less
+// than CacheTTL ago.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Preview, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	rawURL = u.String()
+	key := previewKey(rawURL)
+	if p := f.cached(key, time.Now()); p != nil {
+		return p, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.opts.Timeout)
+	defer cancel()
+
+	var p *Preview
+	if f.opts.Route == RouteRelay {
+		p, err = fetchFromRelay(ctx, f.opts.Host, *f.opts.Relay, rawURL)
+	} else {
+		p, err = f.fetchPage(ctx, u)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	if p.URL != rawURL {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("preview of another URL"))
+	}
+
+	if data, err := json.Marshal(p); err == nil {
+		if err := f.opts.Datastore.Put(key, data); err != nil {
+			f.logger.Warn("unable to cache the preview", zap.Error(err))
+		}
+	}
+
+	return p, nil
+}
+
+func previewKey(rawURL string) ipfs_ds.Key {
+	sum := sha256.Sum256([]byte(rawURL))
+	return previewsKey.ChildString(hex.EncodeToString(sum[:]))
+}
+
+func (f *Fetcher) cached(key ipfs_ds.Key, now time.Time) *Preview {
+	data, err := f.opts.Datastore.Get(key)
+	if err != nil {
+		return nil
+	}
+
+	p := &Preview{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil
+	}
+
+	if now.Sub(time.Unix(0, p.FetchedDate*int64(time.Millisecond))) >= f.opts.CacheTTL {
+		return nil
+	}
+
+	return p
+}
+
+// fetchPage fetches the metadata of a page and its thumbnail, the preview is
+// kept without thumbnail if it can't be fetched.
+func (f *Fetcher) fetchPage(ctx context.Context, u *url.URL) (*Preview, error) {
+	data, mediaType, final, err := get(ctx, f.client, u.String(), "text/html,application/xhtml+xml", maxPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no preview of %q documents", mediaType))
+	}
+
+	// the relative addrs are the ones of the page redirected to
+	p, imageURL := parsePage(final, bytes.NewReader(data))
+	p.URL = u.String()
+	p.FetchedDate = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if imageURL == "" {
+		return p, nil
+	}
+
+	image, imageType, _, err := get(ctx, f.client, imageURL, "image/*", MaxImageSize+1)
+	switch {
+	case err != nil:
+		f.logger.Debug("unable to fetch the preview image", zap.Error(err))
+	case len(image) > MaxImageSize || !imageTypes[imageType]:
+		f.logger.Debug("preview image skipped", zap.String("type", imageType), zap.Int("size", len(image)))
+	default:
+		p.Image, p.ImageType = image, imageType
+	}
+
+	return p, nil
+}
+
+// get returns the first limit bytes of a document, its media type and its
+// URL once redirected.
+func get(ctx context.Context, client *http.Client, rawURL, accept string, limit int64) ([]byte, string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", accept)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", nil, errcode.ErrInternal.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", nil, errcode.ErrInternal.Wrap(fmt.Errorf("unexpected status %s", resp.Status))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, "", nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	return data, mediaType, resp.Request.URL, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func newHTTPClient(dial dialFunc, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// never the proxy of the environment, the route decides
+			Proxy:                  nil,
+			DialContext:            dial,
+			ForceAttemptHTTP2:      true,
+			TLSHandshakeTimeout:    timeout,
+			ResponseHeaderTimeout:  timeout,
+			MaxResponseHeaderBytes: 64 << 10,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("too many redirects")
+			}
+
+			_, err := parseURL(req.URL.String())
+			return err
+		},
+	}
+}
+
+// checkDialAddr refuses the addrs of the device and its networks, their
+// pages are never previewed.
+var checkDialAddr = func(ip net.IP) error {
+	if scope := ipfsutil.IPScope(ip); scope != "public" {
+		return fmt.Errorf("no preview of the %s addrs", scope)
+	}
+
+	return nil
+}
+
+// directDialer checks the addrs once resolved, a name can't point to the
+// local network.
+func directDialer(timeout time.Duration) dialFunc {
+	d := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("invalid addr %q", address)
+			}
+
+			return checkDialAddr(ip)
+		},
+	}
+
+	return d.DialContext
+}
+
+// proxyDialer dials through the proxy, which resolves the names.
+func proxyDialer(d proxy.Dialer) dialFunc {
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext
+	}
+
+	return func(_ context.Context, network, addr string) (net.Conn, error) {
+		return d.Dial(network, addr)
+	}
+}
@@ -0,0 +1,174 @@
+package linkpreview
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPage = `<!DOCTYPE html>
+<html><head>
+<title>Fallback title</title>
+<meta property="og:title" content="Berty &amp; friends">
+<meta property="og:site_name" content="Berty">
+<meta name="description" content="  a   secure
+  messenger ">
+<meta property="og:image" content="/logo.png">
+</head><body><meta property="og:title" content="ignored"></body></html>`
+
+// testPNG is a 1x1 PNG
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\rIDATx\x9cc\xf8\x0f\x00\x00\x01\x01\x00\x05\x18\xd8N\x00\x00\x00\x00IEND\xaeB`\x82")
+
+func newTestServer(t *testing.T) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var pages int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pages, 1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(testPage))
+	})
+	mux.HandleFunc("/logo.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(testPNG)
+	})
+	mux.HandleFunc("/file.zip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		_, _ = w.Write([]byte("PK"))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv, &pages
+}
+
+// allowLoopback lets the fetchers reach the test servers.
+func allowLoopback(t *testing.T) {
+	t.Helper()
+
+	check := checkDialAddr
+	checkDialAddr = func(ip net.IP) error {
+		if ip.IsLoopback() {
+			return nil
+		}
+
+		return check(ip)
+	}
+
+	t.Cleanup(func() { checkDialAddr = check })
+}
+
+func TestFindURLs(t *testing.T) {
+	assert.Equal(t, []string{"https://berty.tech/docs", "http://example.com/a?b=c"},
+		FindURLs("see https://berty.tech/docs, and (http://example.com/a?b=c). https://berty.tech/docs again, ftp://example.com"))
+
+	assert.Len(t, FindURLs("https://a.com https://b.com https://c.com https://d.com"), MaxPreviews)
+	assert.Empty(t, FindURLs("no link"))
+}
+
+func TestFetcher(t *testing.T) {
+	allowLoopback(t)
+	srv, pages := newTestServer(t)
+
+	f, err := NewFetcher(Opts{Route: RouteDirect})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	p, err := f.Fetch(ctx, srv.URL+"/article")
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL+"/article", p.URL)
+	assert.Equal(t, "Berty & friends", p.Title)
+	assert.Equal(t, "a secure messenger", p.Description)
+	assert.Equal(t, "Berty", p.SiteName)
+	assert.Equal(t, testPNG, p.Image)
+	assert.Equal(t, "image/png", p.ImageType)
+
+	// the second fetch is served by the cache
+	_, err = f.Fetch(ctx, srv.URL+"/article")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(pages))
+
+	_, err = f.Fetch(ctx, srv.URL+"/file.zip")
+	assert.Error(t, err)
+
+	_, err = f.Fetch(ctx, "file:///etc/passwd")
+	assert.Error(t, err)
+
+	_, err = NewFetcher(Opts{Route: RouteProxy})
+	assert.Error(t, err)
+
+	_, err = NewFetcher(Opts{Route: RouteRelay})
+	assert.Error(t, err)
+}
+
+func TestFetcherLocalNetwork(t *testing.T) {
+	srv, pages := newTestServer(t)
+
+	// the pages of the local network are never previewed
+	f, err := NewFetcher(Opts{Route: RouteDirect})
+	require.NoError(t, err)
+
+	_, err = f.Fetch(context.Background(), srv.URL)
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(pages))
+}
+
+func TestPreviewValidate(t *testing.T) {
+	assert.NoError(t, (&Preview{URL: "https://berty.tech", Title: "Berty"}).Validate())
+	assert.Error(t, (&Preview{URL: "javascript:alert(1)"}).Validate())
+	assert.Error(t, (&Preview{URL: "https://berty.tech", Title: strings.Repeat("a", MaxTitleLength+1)}).Validate())
+	assert.Error(t, (&Preview{URL: "https://berty.tech", Image: testPNG, ImageType: "image/svg+xml"}).Validate())
+	assert.Error(t, (&Preview{URL: "https://berty.tech", Image: make([]byte, MaxImageSize+1), ImageType: "image/png"}).Validate())
+}
+
+func TestRelay(t *testing.T) {
+	allowLoopback(t)
+	srv, _ := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	defer mn.Close()
+
+	relayHost, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	client, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	_, err = NewRelay(relayHost, RelayOpts{MaxPeerRequests: 2})
+	require.NoError(t, err)
+
+	f, err := NewFetcher(Opts{
+		Route: RouteRelay,
+		Host:  client,
+		Relay: &peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()},
+	})
+	require.NoError(t, err)
+
+	p, err := f.Fetch(ctx, srv.URL+"/relayed")
+	require.NoError(t, err)
+	assert.Equal(t, "Berty & friends", p.Title)
+	assert.Equal(t, testPNG, p.Image)
+
+	_, err = f.Fetch(ctx, srv.URL+"/file.zip")
+	assert.Error(t, err)
+
+	// the client is rate limited by the relay
+	_, err = f.Fetch(ctx, srv.URL+"/limited")
+	assert.Error(t, err)
+}
@@ -0,0 +1,224 @@
+package linkpreview
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// MaxPreviews is the number of links of a message previewed
+	MaxPreviews = 3
+
+	MaxURLLength         = 2048
+	MaxTitleLength       = 256
+	MaxDescriptionLength = 512
+
+	// MaxImageSize caps the thumbnail embedded in a preview
+	MaxImageSize = 64 << 10
+
+	maxPageSize = 512 << 10
+)
+
+// imageTypes are the types of the thumbnails displayed by the clients.
+var imageTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// Preview is the metadata of a linked page, the fields follow the ones of
+// the user message payloads.
+type Preview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+
+	// Image is the thumbnail of the page, embedded so the recipients don't
+	// fetch it
+	Image     []byte `json:"image,omitempty"`
+	ImageType string `json:"imageType,omitempty"`
+
+	// FetchedDate is in milliseconds, as the dates of the payloads
+	FetchedDate int64 `json:"fetchedDate"`
+}
+
+// Validate checks the limits of a preview, e.g. one received from a relay.
+func (p *Preview) Validate() error {
+	if _, err := parseURL(p.URL); err != nil {
+		return err
+	}
+
+	switch {
+	case utf8.RuneCountInString(p.Title) > MaxTitleLength, utf8.RuneCountInString(p.SiteName) > MaxTitleLength:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("preview title too long"))
+	case utf8.RuneCountInString(p.Description) > MaxDescriptionLength:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("preview description too long"))
+	case len(p.Image) > MaxImageSize:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("preview image too large"))
+	case len(p.Image) > 0 && !imageTypes[p.ImageType]:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported preview image type %q", p.ImageType))
+	}
+
+	return nil
+}
+
+// parseURL only accepts the absolute http and https URLs.
+func parseURL(rawURL string) (*url.URL, error) {
+	if len(rawURL) > MaxURLLength {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("URL too long"))
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the http and https URLs are previewed"))
+	}
+
+	return u, nil
+}
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// FindURLs returns the first MaxPreviews distinct links of a text.
+func FindURLs(text string) []string {
+	urls := []string{}
+	seen := map[string]bool{}
+
+	for _, match := range urlRegexp.FindAllString(text, -1) {
+		// the punctuation ending a sentence
+		match = strings.TrimRight(match, ".,;:!?)]}")
+		if seen[match] {
+			continue
+		}
+
+		if _, err := parseURL(match); err != nil {
+			continue
+		}
+
+		seen[match] = true
+		urls = append(urls, match)
+
+		if len(urls) == MaxPreviews {
+			break
+		}
+	}
+
+	return urls
+}
+
+// parsePage reads the metadata of the head of a page, the Open Graph ones
+// first. It returns the preview and the URL of its image, empty if none.
+func parsePage(pageURL *url.URL, r io.Reader) (*Preview, string) {
+	var (
+		p                        = &Preview{URL: pageURL.String()}
+		title, description       string
+		ogTitle, ogDesc, ogImage string
+		inTitle                  bool
+	)
+
+	z := html.NewTokenizer(io.LimitReader(r, maxPageSize))
+
+loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break loop
+
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = string(z.Text())
+			}
+
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Title:
+				inTitle = false
+			case atom.Head:
+				break loop
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Title:
+				inTitle = true
+			case atom.Body:
+				break loop
+			case atom.Meta:
+				attrs := map[string]string{}
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					attrs[strings.ToLower(string(key))] = string(val)
+				}
+
+				property := attrs["property"]
+				if property == "" {
+					property = attrs["name"]
+				}
+
+				switch content := attrs["content"]; strings.ToLower(property) {
+				case "og:title":
+					ogTitle = content
+				case "og:description":
+					ogDesc = content
+				case "og:site_name":
+					p.SiteName = content
+				case "og:image":
+					ogImage = content
+				case "description":
+					description = content
+				}
+			}
+		}
+	}
+
+	p.Title = truncate(firstNonEmpty(ogTitle, title), MaxTitleLength)
+	p.Description = truncate(firstNonEmpty(ogDesc, description), MaxDescriptionLength)
+	p.SiteName = truncate(p.SiteName, MaxTitleLength)
+
+	imageURL := ""
+	if ogImage != "" {
+		if u, err := pageURL.Parse(strings.TrimSpace(ogImage)); err == nil {
+			if _, err := parseURL(u.String()); err == nil {
+				imageURL = u.String()
+			}
+		}
+	}
+
+	return p, imageURL
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// truncate cuts a text to max runes, and collapses its whitespaces.
+func truncate(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+
+	return string([]rune(s)[:max-1]) + "…"
+}
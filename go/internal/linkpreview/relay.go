@@ -0,0 +1,209 @@
+package linkpreview
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const ProtocolID = protocol.ID("/berty/link-preview/1.0.0")
+
+const (
+	// DefaultMaxPeerRequests is the number of previews a peer can ask in a
+	// DefaultPeerRequestWindow
+	DefaultMaxPeerRequests   = 30
+	DefaultPeerRequestWindow = time.Minute
+
+	defaultStreamTimeout = 30 * time.Second
+	maxRequestSize       = 4 << 10
+	maxResponseSize      = 256 << 10
+)
+
+type request struct {
+	URL string `json:"url"`
+}
+
+type response struct {
+	Preview *Preview `json:"preview,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// RelayOpts configures a preview relay.
+type RelayOpts struct {
+	Logger *zap.Logger
+
+	// Datastore caches the previews, in memory if nil
+	Datastore ipfs_ds.Datastore
+	CacheTTL  time.Duration
+
+	// MaxPeerRequests caps the requests of a peer in a PeerRequestWindow, the
+	// others are refused
+	MaxPeerRequests   int
+	PeerRequestWindow time.Duration
+}
+
+func (opts *RelayOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.MaxPeerRequests <= 0 {
+		opts.MaxPeerRequests = DefaultMaxPeerRequests
+	}
+
+	if opts.PeerRequestWindow <= 0 {
+		opts.PeerRequestWindow = DefaultPeerRequestWindow
+	}
+}
+
+// Relay fetches the previews asked by the peers, the linked servers only see
+// the IP of the relay.
+type Relay struct {
+	logger  *zap.Logger
+	opts    RelayOpts
+	fetcher *Fetcher
+
+	muPeers sync.Mutex
+	peers   map[peer.ID]*peerWindow
+}
+
+type peerWindow struct {
+	start    time.Time
+	requests int
+}
+
+// NewRelay registers the preview relay protocol on the host.
+func NewRelay(h host.Host, opts RelayOpts) (*Relay, error) {
+	opts.applyDefaults()
+
+	fetcher, err := NewFetcher(Opts{
+		Logger:    opts.Logger,
+		Route:     RouteDirect,
+		Datastore: opts.Datastore,
+		CacheTTL:  opts.CacheTTL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Relay{
+		logger:  opts.Logger.Named("linkpreview-relay"),
+		opts:    opts,
+		fetcher: fetcher,
+		peers:   make(map[peer.ID]*peerWindow),
+	}
+
+	if h != nil {
+		h.SetStreamHandler(ProtocolID, r.handleStream)
+	}
+
+	return r, nil
+}
+
+func (r *Relay) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	pid := stream.Conn().RemotePeer()
+	_ = stream.SetDeadline(time.Now().Add(defaultStreamTimeout))
+
+	req := &request{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxRequestSize)).Decode(req); err != nil {
+		r.logger.Debug("invalid request", zap.Stringer("peer", pid), zap.Error(err))
+		_ = stream.Reset()
+		return
+	}
+
+	res := &response{}
+	if !r.allowPeer(pid, time.Now()) {
+		res.Error = "rate limited"
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultStreamTimeout)
+		p, err := r.fetcher.Fetch(ctx, req.URL)
+		cancel()
+
+		if err != nil {
+			// the URL isn't logged, the relay doesn't keep the links
+			r.logger.Debug("preview failed", zap.Stringer("peer", pid), zap.Error(err))
+			res.Error = err.Error()
+		}
+
+		res.Preview = p
+	}
+
+	if err := json.NewEncoder(stream).Encode(res); err != nil {
+		_ = stream.Reset()
+	}
+}
+
+func (r *Relay) allowPeer(pid peer.ID, now time.Time) bool {
+	r.muPeers.Lock()
+	defer r.muPeers.Unlock()
+
+	for p, w := range r.peers {
+		if now.Sub(w.start) >= r.opts.PeerRequestWindow {
+			delete(r.peers, p)
+		}
+	}
+
+	w, ok := r.peers[pid]
+	if !ok {
+		w = &peerWindow{start: now}
+		r.peers[pid] = w
+	}
+
+	if w.requests >= r.opts.MaxPeerRequests {
+		return false
+	}
+
+	w.requests++
+
+	return true
+}
+
+// fetchFromRelay asks a relay for the preview of a link.
+func fetchFromRelay(ctx context.Context, h host.Host, relay peer.AddrInfo, rawURL string) (*Preview, error) {
+	if err := h.Connect(ctx, relay); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	stream, err := h.NewStream(ctx, relay.ID, ProtocolID)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(stream).Encode(&request{URL: rawURL}); err != nil {
+		_ = stream.Reset()
+		return nil, errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	res := &response{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxResponseSize)).Decode(res); err != nil {
+		_ = stream.Reset()
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	switch {
+	case res.Error != "":
+		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("link preview relay: %s", res.Error))
+	case res.Preview == nil:
+		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("link preview relay: no preview"))
+	}
+
+	return res.Preview, nil
+}
@@ -0,0 +1,7 @@
+// Package logutil changes the levels of the logs of a node at runtime, by
+// subsystem, and keeps the last entries for the bug reports.
+//
+// The entries are routed to their subsystem by the names of their loggers,
+// e.g. "protocol.grouppubsub" is in the network subsystem. The loggers which
+// aren't routed are in the node subsystem.
+package logutil
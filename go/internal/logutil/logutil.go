@@ -0,0 +1,280 @@
+package logutil
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The subsystems of the logs.
+const (
+	SubsystemNode    = "node"
+	SubsystemNetwork = "network"
+	SubsystemBLE     = "ble-tpt"
+	SubsystemStorage = "storage"
+)
+
+// DefaultRingSize is the number of entries kept for the bug reports.
+const DefaultRingSize = 2000
+
+// defaultRoutes are the subsystems of the loggers of the node, by name.
+var defaultRoutes = map[string]string{
+	"ble-tpt":      SubsystemBLE,
+	"mc-transport": SubsystemBLE,
+
+	"dial":         SubsystemNetwork,
+	"relay":        SubsystemNetwork,
+	"ws":           SubsystemNetwork,
+	"tor":          SubsystemNetwork,
+	"mdns":         SubsystemNetwork,
+	"dht":          SubsystemNetwork,
+	"rdvp":         SubsystemNetwork,
+	"multipath":    SubsystemNetwork,
+	"ps":           SubsystemNetwork,
+	"grouppubsub":  SubsystemNetwork,
+	"storeforward": SubsystemNetwork,
+	"chaos":        SubsystemNetwork,
+	"conn-limiter": SubsystemNetwork,
+
+	"odb":       SubsystemStorage,
+	"migrate":   SubsystemStorage,
+	"retention": SubsystemStorage,
+	"backup":    SubsystemStorage,
+}
+
+// Opts configures a Manager.
+type Opts struct {
+	// Level is the initial level of the subsystems
+	Level zapcore.Level
+
+	// RingSize is the number of entries kept, DefaultRingSize if zero
+	RingSize int
+
+	// Routes are added to the default ones, by logger name
+	Routes map[string]string
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.RingSize <= 0 {
+		opts.RingSize = DefaultRingSize
+	}
+}
+
+// Subsystem is the state of a subsystem of the logs.
+type Subsystem struct {
+	Name  string `json:"name"`
+	Level string `json:"level"`
+}
+
+// Manager filters the entries of a logger by subsystem.
+type Manager struct {
+	logger *zap.Logger
+	ring   *ring
+	levels map[string]zap.AtomicLevel
+	routes map[string]string
+}
+
+// New wraps a logger, its own level should let all the entries through, the
+// manager filters them.
+func New(base *zap.Logger, opts Opts) *Manager {
+	opts.applyDefaults()
+
+	m := &Manager{
+		ring:   newRing(opts.RingSize),
+		levels: make(map[string]zap.AtomicLevel),
+		routes: make(map[string]string),
+	}
+
+	for _, name := range []string{SubsystemNode, SubsystemNetwork, SubsystemBLE, SubsystemStorage} {
+		m.levels[name] = zap.NewAtomicLevelAt(opts.Level)
+	}
+
+	for name, subsystem := range defaultRoutes {
+		m.routes[name] = subsystem
+	}
+
+	for name, subsystem := range opts.Routes {
+		if _, ok := m.levels[subsystem]; ok {
+			m.routes[name] = subsystem
+		}
+	}
+
+	// the captured entries are encoded apart, the outputs of the base logger
+	// can't be read back
+	captured := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), m.ring, zapcore.DebugLevel)
+	m.logger = base.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &routingCore{Core: zapcore.NewTee(c, captured), m: m}
+	}))
+
+	return m
+}
+
+// Logger returns the logger filtered by subsystem.
+func (m *Manager) Logger() *zap.Logger {
+	return m.logger
+}
+
+// Subsystems returns the subsystems and their levels, by name.
+func (m *Manager) Subsystems() []Subsystem {
+	subsystems := make([]Subsystem, 0, len(m.levels))
+	for name, level := range m.levels {
+		subsystems = append(subsystems, Subsystem{Name: name, Level: level.Level().String()})
+	}
+
+	sort.Slice(subsystems, func(i, j int) bool { return subsystems[i].Name < subsystems[j].Name })
+
+	return subsystems
+}
+
+// SetLevel changes the level of a subsystem, e.g. "warn".
+func (m *Manager) SetLevel(subsystem string, level string) error {
+	l, ok := m.levels[subsystem]
+	if !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown log subsystem %q", subsystem))
+	}
+
+	var parsed zapcore.Level
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	l.SetLevel(parsed)
+
+	return nil
+}
+
+// SetLevels changes the levels of the subsystems from a comma separated list,
+// a level alone applies to all of them, e.g. "info,ble-tpt=error". Nothing is
+// changed if one of them is invalid.
+func (m *Manager) SetLevels(spec string) error {
+	levels := map[string]zapcore.Level{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		subsystems := []string{}
+		level := item
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			subsystems, level = []string{strings.TrimSpace(item[:i])}, strings.TrimSpace(item[i+1:])
+			if _, ok := m.levels[subsystems[0]]; !ok {
+				return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown log subsystem %q", subsystems[0]))
+			}
+		} else {
+			for name := range m.levels {
+				subsystems = append(subsystems, name)
+			}
+		}
+
+		var parsed zapcore.Level
+		if err := parsed.UnmarshalText([]byte(level)); err != nil {
+			return errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		for _, name := range subsystems {
+			levels[name] = parsed
+		}
+	}
+
+	for name, level := range levels {
+		m.levels[name].SetLevel(level)
+	}
+
+	return nil
+}
+
+// Capture returns the last entries logged, oldest first, one JSON object
+// per line.
+func (m *Manager) Capture() []byte {
+	return m.ring.dump()
+}
+
+// subsystem returns the subsystem of a logger, its last routed name wins.
+func (m *Manager) subsystem(loggerName string) string {
+	names := strings.Split(loggerName, ".")
+	for i := len(names) - 1; i >= 0; i-- {
+		if subsystem, ok := m.routes[names[i]]; ok {
+			return subsystem
+		}
+	}
+
+	return SubsystemNode
+}
+
+// routingCore drops the entries below the level of their subsystem.
+type routingCore struct {
+	zapcore.Core
+	m *Manager
+}
+
+func (c *routingCore) Enabled(level zapcore.Level) bool {
+	for _, l := range c.m.levels {
+		if l.Enabled(level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *routingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &routingCore{Core: c.Core.With(fields), m: c.m}
+}
+
+func (c *routingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.m.levels[c.m.subsystem(entry.LoggerName)].Enabled(entry.Level) {
+		return checked
+	}
+
+	return c.Core.Check(entry, checked)
+}
+
+// ring keeps the last encoded entries, it is the output of the capture core.
+type ring struct {
+	lock    sync.Mutex
+	entries [][]byte
+	next    int
+	full    bool
+}
+
+func newRing(size int) *ring {
+	return &ring{entries: make([][]byte, size)}
+}
+
+func (r *ring) Write(p []byte) (int, error) {
+	// the encoder reuses its buffer
+	entry := append([]byte(nil), p...)
+
+	r.lock.Lock()
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.lock.Unlock()
+
+	return len(p), nil
+}
+
+func (r *ring) Sync() error {
+	return nil
+}
+
+func (r *ring) dump() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entries := r.entries[:r.next]
+	if r.full {
+		entries = append(append([][]byte{}, r.entries[r.next:]...), entries...)
+	}
+
+	return bytes.Join(entries, nil)
+}
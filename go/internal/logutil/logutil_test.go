@@ -0,0 +1,76 @@
+package logutil
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestManagerLevels(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	m := New(zap.New(core), Opts{Level: zapcore.InfoLevel})
+	logger := m.Logger()
+
+	logger.Named("ble-tpt").Debug("ble debug")
+	logger.Named("protocol").Named("odb").Info("odb info")
+	assert.Equal(t, 0, logs.FilterMessage("ble debug").Len())
+	assert.Equal(t, 1, logs.FilterMessage("odb info").Len())
+
+	require.NoError(t, m.SetLevel(SubsystemBLE, "debug"))
+	require.NoError(t, m.SetLevel(SubsystemStorage, "warn"))
+	logger.Named("ble-tpt").Debug("ble debug")
+	logger.Named("protocol").Named("odb").Info("odb info")
+	logger.Named("protocol").Info("protocol info")
+	assert.Equal(t, 1, logs.FilterMessage("ble debug").Len())
+	assert.Equal(t, 1, logs.FilterMessage("odb info").Len())
+	assert.Equal(t, 1, logs.FilterMessage("protocol info").Len())
+
+	assert.Error(t, m.SetLevel("bluetooth", "debug"))
+	assert.Error(t, m.SetLevel(SubsystemBLE, "chatty"))
+
+	require.NoError(t, m.SetLevels("error, network=debug"))
+	assert.Equal(t, []Subsystem{
+		{Name: SubsystemBLE, Level: "error"},
+		{Name: SubsystemNetwork, Level: "debug"},
+		{Name: SubsystemNode, Level: "error"},
+		{Name: SubsystemStorage, Level: "error"},
+	}, m.Subsystems())
+
+	// nothing is changed by an invalid list
+	assert.Error(t, m.SetLevels("info,bluetooth=debug"))
+	assert.Error(t, m.SetLevels("info,network=chatty"))
+	assert.Equal(t, "error", m.Subsystems()[2].Level)
+
+	logger.Named("dial").Debug("dial debug")
+	logger.Named("protocol").Warn("protocol warn")
+	assert.Equal(t, 1, logs.FilterMessage("dial debug").Len())
+	assert.Equal(t, 0, logs.FilterMessage("protocol warn").Len())
+}
+
+func TestManagerCapture(t *testing.T) {
+	core, _ := observer.New(zapcore.DebugLevel)
+	m := New(zap.New(core), Opts{Level: zapcore.InfoLevel, RingSize: 2})
+	logger := m.Logger()
+
+	assert.Empty(t, m.Capture())
+
+	logger.Info("first")
+	logger.Debug("dropped")
+	assert.Equal(t, 1, bytes.Count(m.Capture(), []byte("\n")))
+
+	logger.Info("second")
+	logger.With(zap.String("key", "value")).Info("third")
+
+	// only the last entries are kept
+	captured := string(m.Capture())
+	assert.NotContains(t, captured, "first")
+	assert.NotContains(t, captured, "dropped")
+	assert.Contains(t, captured, `"msg":"second"`)
+	assert.Contains(t, captured, `"key":"value"`)
+	assert.Less(t, bytes.Index(m.Capture(), []byte("second")), bytes.Index(m.Capture(), []byte("third")))
+}
@@ -0,0 +1,8 @@
+// Package metrics exposes the metrics of a node in the Prometheus format, for
+// the operators of the relays and the bootstrap nodes.
+//
+// The metrics cover the connections by transport, MC being the proximity
+// transport over BLE and Wi-Fi, the dials, the messages and their delivery
+// latency, the bytes saved by their compression, the outbound queue, the
+// sizes of the datastores and the outcomes of the pushes. They never carry a peer ID or a group, only counts.
+package metrics
@@ -0,0 +1,320 @@
+package metrics
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "berty"
+
+// The results of the dials and the pushes.
+const (
+	ResultSuccess      = "success"
+	ResultFailure      = "failure"
+	ResultUnregistered = "unregistered"
+	ResultRateLimited  = "rate_limited"
+)
+
+// The directions of the messages.
+const (
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+)
+
+// storageCacheTTL is how long the size of a directory is cached, walking it
+// on every scrape would be too slow.
+const storageCacheTTL = time.Minute
+
+// Registry holds the metrics of a node. A nil registry records nothing, so
+// the components can be given one unconditionally.
+type Registry struct {
+	registry *prometheus.Registry
+
+	dials      *prometheus.CounterVec
+	messages   *prometheus.CounterVec
+	latency    prometheus.Histogram
+	pushes     *prometheus.CounterVec
+	dispatches *prometheus.CounterVec
+	compressed *prometheus.CounterVec
+	saved      *prometheus.CounterVec
+
+	connections *prometheus.Desc
+	storage     *prometheus.Desc
+
+	lock   sync.Mutex
+	hosts  []host.Host
+	stores map[string]*storageSize
+}
+
+type storageSize struct {
+	size func() (uint64, error)
+
+	// the size is cached, see storageCacheTTL
+	cached bool
+	at     time.Time
+	value  uint64
+}
+
+// New returns a registry with the metrics of the node and the ones of the
+// Go runtime and the process.
+func New() *Registry {
+	r := &Registry{
+		registry: prometheus.NewRegistry(),
+		dials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dials_total",
+			Help:      "Dials by transport and result.",
+		}, []string{"transport", "result"}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_total",
+			Help:      "Messages by direction.",
+		}, []string{"direction"}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "message_delivery_seconds",
+			Help:      "Delay between the sending of a message and its first ack.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+		}),
+		pushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "push_requests_total",
+			Help:      "Pushes requested to the relays by result.",
+		}, []string{"result"}),
+		dispatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "push_dispatches_total",
+			Help:      "Pushes dispatched by the relay to the push services by platform and result.",
+		}, []string{"platform", "result"}),
+		compressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "envelope_compressions_total",
+			Help:      "Message payloads compressed by codec.",
+		}, []string{"codec"}),
+		saved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "envelope_compression_saved_bytes_total",
+			Help:      "Bytes saved by the compression of the message payloads by codec.",
+		}, []string{"codec"}),
+		connections: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "connections"),
+			"Open connections by transport and direction.",
+			[]string{"transport", "direction"}, nil,
+		),
+		storage: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "storage_bytes"),
+			"Sizes of the datastores.",
+			[]string{"store"}, nil,
+		),
+		stores: make(map[string]*storageSize),
+	}
+
+	r.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		r.dials, r.messages, r.latency, r.pushes, r.dispatches, r.compressed, r.saved,
+		(*registryCollector)(r),
+	)
+
+	return r
+}
+
+// Handler returns the handler of the /metrics endpoint.
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{})
+}
+
+// RecordDial records a dial, it is an ipfsutil.DialSchedulerOpts.OnDial.
+func (r *Registry) RecordDial(transport string, err error) {
+	if r == nil {
+		return
+	}
+
+	result := ResultSuccess
+	if err != nil {
+		result = ResultFailure
+	}
+
+	r.dials.WithLabelValues(transport, result).Inc()
+}
+
+// RecordMessage records a message sent or received.
+func (r *Registry) RecordMessage(direction string) {
+	if r == nil {
+		return
+	}
+
+	r.messages.WithLabelValues(direction).Inc()
+}
+
+// ObserveDeliveryLatency records the delay before the first ack of a
+// message.
+func (r *Registry) ObserveDeliveryLatency(latency time.Duration) {
+	if r == nil {
+		return
+	}
+
+	r.latency.Observe(latency.Seconds())
+}
+
+// RecordPushRequest records the result of a push requested to a relay.
+func (r *Registry) RecordPushRequest(result string) {
+	if r == nil {
+		return
+	}
+
+	r.pushes.WithLabelValues(result).Inc()
+}
+
+// RecordPushDispatch records the result of a push dispatched by a relay.
+func (r *Registry) RecordPushDispatch(platform string, result string) {
+	if r == nil {
+		return
+	}
+
+	r.dispatches.WithLabelValues(platform, result).Inc()
+}
+
+// RecordCompression records a message payload compressed and the bytes it
+// saved.
+func (r *Registry) RecordCompression(codec string, saved int) {
+	if r == nil {
+		return
+	}
+
+	r.compressed.WithLabelValues(codec).Inc()
+	r.saved.WithLabelValues(codec).Add(float64(saved))
+}
+
+// RegisterHost adds the connections of a host to the metrics.
+func (r *Registry) RegisterHost(h host.Host) {
+	if r == nil || h == nil {
+		return
+	}
+
+	r.lock.Lock()
+	r.hosts = append(r.hosts, h)
+	r.lock.Unlock()
+}
+
+// RegisterGauge adds a gauge read on each scrape, e.g. the depth of a queue.
+func (r *Registry) RegisterGauge(name string, help string, value func() float64) error {
+	if r == nil {
+		return nil
+	}
+
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, value)
+
+	return r.registry.Register(gauge)
+}
+
+// RegisterDatastore adds the size of a datastore to the metrics, the
+// datastores which don't report their size are ignored.
+func (r *Registry) RegisterDatastore(name string, ds datastore.Datastore) {
+	if _, ok := ds.(datastore.PersistentDatastore); !ok {
+		return
+	}
+
+	r.registerStorage(name, func() (uint64, error) { return datastore.DiskUsage(ds) })
+}
+
+// RegisterDirectory adds the size of a directory to the metrics, e.g. the
+// one of the orbitdb stores.
+func (r *Registry) RegisterDirectory(name string, path string) {
+	if path == "" {
+		return
+	}
+
+	r.registerStorage(name, func() (uint64, error) { return directorySize(path) })
+}
+
+func (r *Registry) registerStorage(name string, size func() (uint64, error)) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	r.stores[name] = &storageSize{size: size}
+	r.lock.Unlock()
+}
+
+func directorySize(path string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the files can be removed during the walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !info.IsDir() {
+			size += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// registryCollector collects the metrics read on each scrape: the
+// connections and the sizes of the datastores.
+type registryCollector Registry
+
+func (c *registryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connections
+	ch <- c.storage
+}
+
+func (c *registryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	type key struct{ transport, direction string }
+	conns := make(map[key]int)
+	for _, h := range c.hosts {
+		for _, conn := range h.Network().Conns() {
+			direction := "inbound"
+			if conn.Stat().Direction == network.DirOutbound {
+				direction = "outbound"
+			}
+
+			conns[key{ipfsutil.TransportName(conn.RemoteMultiaddr()), direction}]++
+		}
+	}
+
+	for k, n := range conns {
+		ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(n), k.transport, k.direction)
+	}
+
+	now := time.Now()
+	for name, store := range c.stores {
+		if !store.cached || now.Sub(store.at) >= storageCacheTTL {
+			value, err := store.size()
+			if err != nil {
+				continue
+			}
+
+			store.cached, store.at, store.value = true, now, value
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.storage, prometheus.GaugeValue, float64(store.value), name)
+	}
+}
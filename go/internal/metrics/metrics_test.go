@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, rec.Code)
+
+	return rec.Body.String()
+}
+
+func TestRegistry(t *testing.T) {
+	r := New()
+
+	r.RecordDial("TCP", nil)
+	r.RecordDial("MC", fmt.Errorf("unreachable"))
+	r.RecordMessage(DirectionSent)
+	r.ObserveDeliveryLatency(300 * time.Millisecond)
+	r.RecordPushRequest(ResultSuccess)
+	r.RecordPushDispatch("apns", ResultUnregistered)
+	r.RecordCompression("snappy", 512)
+
+	depth := 3.0
+	require.NoError(t, r.RegisterGauge("outbound_queue_depth", "Messages waiting for an ack.", func() float64 { return depth }))
+	assert.Error(t, r.RegisterGauge("outbound_queue_depth", "Messages waiting for an ack.", func() float64 { return depth }))
+
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "store"), make([]byte, 1024), 0600))
+	r.RegisterDirectory("orbitdb", dir)
+
+	// the in memory datastores don't report their size
+	r.RegisterDatastore("root", datastore.NewMapDatastore())
+
+	out := scrape(t, r)
+	assert.Contains(t, out, `berty_dials_total{result="success",transport="TCP"} 1`)
+	assert.Contains(t, out, `berty_dials_total{result="failure",transport="MC"} 1`)
+	assert.Contains(t, out, `berty_messages_total{direction="sent"} 1`)
+	assert.Contains(t, out, `berty_message_delivery_seconds_count 1`)
+	assert.Contains(t, out, `berty_push_requests_total{result="success"} 1`)
+	assert.Contains(t, out, `berty_push_dispatches_total{platform="apns",result="unregistered"} 1`)
+	assert.Contains(t, out, `berty_envelope_compressions_total{codec="snappy"} 1`)
+	assert.Contains(t, out, `berty_envelope_compression_saved_bytes_total{codec="snappy"} 512`)
+	assert.Contains(t, out, `berty_outbound_queue_depth 3`)
+	assert.Contains(t, out, `berty_storage_bytes{store="orbitdb"} 1024`)
+	assert.NotContains(t, out, `store="root"`)
+
+	// the sizes are cached between the scrapes
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other"), make([]byte, 1024), 0600))
+	assert.Contains(t, scrape(t, r), `berty_storage_bytes{store="orbitdb"} 1024`)
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+
+	// the components record unconditionally
+	r.RecordDial("TCP", nil)
+	r.RecordMessage(DirectionReceived)
+	r.ObserveDeliveryLatency(time.Second)
+	r.RecordPushRequest(ResultFailure)
+	r.RecordPushDispatch("fcm", ResultSuccess)
+	r.RecordCompression("snappy", 0)
+	r.RegisterHost(nil)
+	r.RegisterDirectory("orbitdb", "/tmp")
+	assert.NoError(t, r.RegisterGauge("depth", "", func() float64 { return 0 }))
+}
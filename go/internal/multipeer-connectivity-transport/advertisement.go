@@ -0,0 +1,161 @@
+package mc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+// advertisementHashSize is the number of bytes of the peerID hash put in the
+// advertisement, it only needs to be long enough to make false positives rare
+// among the peers nearby.
+const advertisementHashSize = 8
+
+// DefaultAdvertisementSalt is the default salt used to hash the peerID put in
+// the advertisement.
+var DefaultAdvertisementSalt = []byte("berty-mc-advertisement")
+
+// knownPeersRefresh is the minimum delay between two reloads of the known
+// peers, an unknown advertisement doesn't reload them more often.
+const knownPeersRefresh = time.Minute
+
+// proximityFilter decides, using the hash found in the advertisement, if the
+// native driver should connect to a remote device.
+//
+// The hashes of the known peers are indexed, so an advertisement is checked
+// without hashing every peer: the index is reloaded from knownPeers on a
+// miss, at most every knownPeersRefresh, and updated right away by add and
+// clear.
+type proximityFilter struct {
+	salt         []byte
+	contactsOnly bool
+	knownPeers   func() []peer.ID
+	blocked      func(peer.ID) bool
+
+	mu       sync.Mutex
+	index    map[string]peer.ID
+	added    map[peer.ID]struct{}
+	reloaded time.Time
+	now      func() time.Time
+}
+
+// advertisementHash returns the truncated salted hash of a peerID.
+func advertisementHash(salt []byte, pid peer.ID) string {
+	h := sha256.New()
+	_, _ = h.Write(salt)
+	_, _ = h.Write([]byte(pid))
+
+	return hex.EncodeToString(h.Sum(nil)[:advertisementHashSize])
+}
+
+// Allow reports whether the device advertising the given hash should be
+// connected. In contacts-only mode, only the known peers are allowed.
+func (pf *proximityFilter) Allow(hash string) bool {
+	if pf == nil || !pf.contactsOnly {
+		return true
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if _, ok := pf.index[hash]; ok {
+		return true
+	}
+
+	if pf.knownPeers == nil || pf.clock().Sub(pf.reloaded) < knownPeersRefresh {
+		return false
+	}
+
+	pf.reload()
+
+	_, ok := pf.index[hash]
+	return ok
+}
+
+// AllowPeer is like Allow but for an already known peerID.
+func (pf *proximityFilter) AllowPeer(pid peer.ID) bool {
+	if pf != nil && pf.blocked != nil && pf.blocked(pid) {
+		return false
+	}
+
+	if pf == nil || !pf.contactsOnly {
+		return true
+	}
+
+	return pf.Allow(advertisementHash(pf.salt, pid))
+}
+
+// add allows a peer without waiting for the next reload of the known peers.
+func (pf *proximityFilter) add(pid peer.ID) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.added == nil {
+		pf.added = make(map[peer.ID]struct{})
+	}
+	pf.added[pid] = struct{}{}
+
+	pf.indexPeer(pid)
+}
+
+// clear forgets the indexed peers, the known peers are reloaded on the next
+// advertisement.
+func (pf *proximityFilter) clear() {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	pf.index, pf.added = nil, nil
+	pf.reloaded = time.Time{}
+}
+
+// reload rebuilds the index from the known peers and the added ones.
+func (pf *proximityFilter) reload() {
+	pf.index = make(map[string]peer.ID)
+	for _, pid := range pf.knownPeers() {
+		pf.indexPeer(pid)
+	}
+
+	for pid := range pf.added {
+		pf.indexPeer(pid)
+	}
+
+	pf.reloaded = pf.clock()
+}
+
+func (pf *proximityFilter) indexPeer(pid peer.ID) {
+	if pf.index == nil {
+		pf.index = make(map[string]peer.ID)
+	}
+
+	pf.index[advertisementHash(pf.salt, pid)] = pid
+}
+
+func (pf *proximityFilter) clock() time.Time {
+	if pf.now != nil {
+		return pf.now()
+	}
+
+	return time.Now()
+}
+
+// handleAdvertisement is called by the native driver when a device is found,
+// before connecting to it.
+func handleAdvertisement(hash string) bool {
+	markDiscovery()
+
+	// Checks if a listener is currently running.
+	if gListener == nil || gListener.ctx.Err() != nil {
+		return false
+	}
+
+	if !gListener.transport.proximity.Allow(hash) {
+		logger.Debug("discovery handle advertisement skipped: unknown peer", zap.String("hash", hash))
+		return false
+	}
+
+	return true
+}
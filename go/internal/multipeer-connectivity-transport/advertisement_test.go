@@ -0,0 +1,61 @@
+package mc
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProximityFilter_Index(t *testing.T) {
+	clock := &testingClock{t: time.Unix(1600000000, 0)}
+	contacts := []peer.ID{"alice", "bob"}
+	loads := 0
+
+	pf := &proximityFilter{
+		salt:         DefaultAdvertisementSalt,
+		contactsOnly: true,
+		knownPeers: func() []peer.ID {
+			loads++
+			return contacts
+		},
+		now: clock.now,
+	}
+
+	assert.True(t, pf.Allow(advertisementHash(pf.salt, "alice")))
+	assert.True(t, pf.AllowPeer("bob"))
+	assert.Equal(t, 1, loads)
+
+	// the unknown devices don't reload the known peers every time
+	assert.False(t, pf.Allow(advertisementHash(pf.salt, "mallory")))
+	assert.False(t, pf.Allow(advertisementHash(pf.salt, "mallory")))
+	assert.Equal(t, 1, loads)
+
+	// a new contact is found on the next reload, or right away once added
+	contacts = append(contacts, "carol")
+	assert.False(t, pf.AllowPeer("carol"))
+	pf.add("dave")
+	assert.True(t, pf.AllowPeer("dave"))
+
+	clock.advance(knownPeersRefresh)
+	assert.True(t, pf.AllowPeer("carol"))
+	assert.True(t, pf.AllowPeer("dave"))
+	assert.Equal(t, 2, loads)
+
+	// a removed contact is forgotten once cleared
+	contacts = []peer.ID{"alice"}
+	pf.clear()
+	assert.False(t, pf.AllowPeer("bob"))
+	assert.False(t, pf.AllowPeer("dave"))
+	assert.True(t, pf.AllowPeer("alice"))
+	assert.Equal(t, 3, loads)
+}
+
+func TestProximityFilter_NotContactsOnly(t *testing.T) {
+	pf := &proximityFilter{salt: DefaultAdvertisementSalt}
+	assert.True(t, pf.Allow("anything"))
+
+	var none *proximityFilter
+	assert.True(t, none.AllowPeer("alice"))
+}
@@ -0,0 +1,76 @@
+package mc
+
+import (
+	"sync"
+)
+
+// frameBufferSizes are the size classes of the pooled frame buffers, the
+// native driver delivers frames of up to a few tens of KB.
+var frameBufferSizes = []int{512, 4 << 10, 16 << 10, 64 << 10}
+
+// gFramePool is shared by the conns, the frames outlive the conn that
+// received them only until they are read.
+var gFramePool = newFramePool(frameBufferSizes)
+
+// frame is a payload received from the native driver, owned by the conn until
+// it is fully read.
+type frame struct {
+	buf []byte
+	off int
+
+	class int
+}
+
+// framePool recycles the frames by size class, so a bulk transfer doesn't
+// allocate a buffer for every frame. The frames bigger than the biggest
+// class aren't recycled.
+type framePool struct {
+	sizes []int
+	pools []sync.Pool
+}
+
+func newFramePool(sizes []int) *framePool {
+	fp := &framePool{
+		sizes: sizes,
+		pools: make([]sync.Pool, len(sizes)),
+	}
+
+	for i := range fp.pools {
+		size, class := sizes[i], i
+		fp.pools[i].New = func() interface{} {
+			return &frame{buf: make([]byte, size), class: class}
+		}
+	}
+
+	return fp
+}
+
+// get returns a frame holding a copy of the payload.
+func (fp *framePool) get(payload []byte) *frame {
+	f := (*frame)(nil)
+	for i, size := range fp.sizes {
+		if len(payload) <= size {
+			f = fp.pools[i].Get().(*frame)
+			break
+		}
+	}
+
+	if f == nil {
+		f = &frame{buf: make([]byte, len(payload)), class: -1}
+	}
+
+	f.buf = f.buf[:cap(f.buf)]
+	f.buf = f.buf[:copy(f.buf, payload)]
+	f.off = 0
+
+	return f
+}
+
+// put recycles a frame, it must not be used afterwards.
+func (fp *framePool) put(f *frame) {
+	if f == nil || f.class < 0 || f.class >= len(fp.pools) {
+		return
+	}
+
+	fp.pools[f.class].Put(f)
+}
@@ -0,0 +1,68 @@
+package mc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFramePool(t *testing.T) {
+	fp := newFramePool([]int{8, 32})
+
+	f := fp.get([]byte("small"))
+	assert.Equal(t, []byte("small"), f.buf)
+	assert.Equal(t, 0, f.class)
+	assert.Equal(t, 8, cap(f.buf))
+
+	f = fp.get(bytes.Repeat([]byte("m"), 20))
+	assert.Len(t, f.buf, 20)
+	assert.Equal(t, 1, f.class)
+
+	// the frames bigger than the biggest class aren't recycled
+	f = fp.get(bytes.Repeat([]byte("l"), 40))
+	assert.Len(t, f.buf, 40)
+	assert.Equal(t, -1, f.class)
+	fp.put(f)
+
+	// a recycled frame doesn't keep its previous payload
+	f = fp.get([]byte("previous"))
+	fp.put(f)
+	f = fp.get([]byte("new"))
+	assert.Equal(t, []byte("new"), f.buf)
+	assert.Equal(t, 0, f.off)
+}
+
+func TestConnFrames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{frames: make(chan *frame, connFrameQueueSize), ctx: ctx, cancel: cancel}
+
+	// the frames are copied, the native driver reuses its memory
+	payload := []byte("hello")
+	require.NoError(t, c.push(payload))
+	copy(payload, "xxxxx")
+	require.NoError(t, c.push([]byte(" world")))
+	require.NoError(t, c.push(nil))
+
+	// a frame is read across calls
+	buf := make([]byte, 3)
+	read := []byte{}
+	for len(read) < len("hello world") {
+		n, err := c.Read(buf)
+		require.NoError(t, err)
+		read = append(read, buf[:n]...)
+	}
+	assert.Equal(t, "hello world", string(read))
+
+	cancel()
+	assert.Error(t, c.push([]byte("late")))
+
+	_, err := c.Read(buf)
+	assert.Error(t, err)
+
+	_, err = io.ReadFull(c, buf)
+	assert.Error(t, err)
+}
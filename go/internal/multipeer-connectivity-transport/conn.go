@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
-	mcdrv "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/driver"
 	mcma "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/multiaddr"
 
 	ma "github.com/multiformats/go-multiaddr"
@@ -15,21 +15,30 @@ import (
 	"github.com/pkg/errors"
 )
 
+// connFrameQueueSize is the number of received frames a conn holds before
+// the native driver is blocked.
+const connFrameQueueSize = 16
+
 // Conn is a manet.Conn.
 var _ manet.Conn = &Conn{}
 
 // Conn is the equivalent of a net.Conn object. It is the
 // result of calling the Dial or Listen functions in this
 // package, with associated local and remote Multiaddrs.
+//
+// The frames received from the native driver are copied to pooled buffers
+// handed to the read loop as is, and recycled once read.
 type Conn struct {
-	readIn  *io.PipeWriter
-	readOut *io.PipeReader
+	frames   chan *frame
+	readLock sync.Mutex
+	pending  *frame
 
 	localMa  ma.Multiaddr
 	remoteMa ma.Multiaddr
 
 	ctx    context.Context
 	cancel func()
+	driver NativeDriver
 }
 
 // Read reads data from the connection.
@@ -39,12 +48,45 @@ func (c *Conn) Read(payload []byte) (n int, err error) {
 		return 0, fmt.Errorf("conn read failed: conn already closed")
 	}
 
-	n, err = c.readOut.Read(payload)
-	if err != nil {
-		err = errors.Wrap(err, "conn read failed")
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if c.pending == nil {
+		select {
+		case c.pending = <-c.frames:
+		case <-c.ctx.Done():
+			return 0, errors.Wrap(io.ErrClosedPipe, "conn read failed")
+		}
 	}
 
-	return n, err
+	n = copy(payload, c.pending.buf[c.pending.off:])
+	c.pending.off += n
+
+	if c.pending.off == len(c.pending.buf) {
+		gFramePool.put(c.pending)
+		c.pending = nil
+	}
+
+	return n, nil
+}
+
+// push hands a payload received from the native driver to the read loop, it
+// is copied to a pooled frame so the driver can reuse its memory once push
+// returns.
+func (c *Conn) push(payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	f := gFramePool.get(payload)
+
+	select {
+	case c.frames <- f:
+		return nil
+	case <-c.ctx.Done():
+		gFramePool.put(f)
+		return errors.Wrap(io.ErrClosedPipe, "conn push failed")
+	}
 }
 
 // Write writes data to the connection.
@@ -55,7 +97,7 @@ func (c *Conn) Write(payload []byte) (n int, err error) {
 	}
 
 	// Write to the peer's device using native driver.
-	if !mcdrv.SendToPeer(c.RemoteAddr().String(), payload) {
+	if !c.driver.SendToPeer(c.RemoteAddr().String(), payload) {
 		return 0, fmt.Errorf("conn write failed: native write failed")
 	}
 
@@ -67,15 +109,29 @@ func (c *Conn) Write(payload []byte) (n int, err error) {
 func (c *Conn) Close() error {
 	c.cancel()
 
-	// Closes read pipe
-	c.readIn.Close()
-	c.readOut.Close()
+	// Recycles the frames left unread
+	c.readLock.Lock()
+	gFramePool.put(c.pending)
+	c.pending = nil
+	c.readLock.Unlock()
+
+	for done := false; !done; {
+		select {
+		case f := <-c.frames:
+			gFramePool.put(f)
+		default:
+			done = true
+		}
+	}
 
 	// Removes conn from connmgr's connMap
 	connMap.Delete(c.RemoteAddr().String())
 
+	// Allows the peer to be handled again as soon as it is found
+	gDiscoveryLimiter.Forget(c.RemoteAddr().String())
+
 	// Notify the native driver that the conn was cloed with this peer.
-	mcdrv.CloseConnWithPeer(c.RemoteAddr().String())
+	c.driver.CloseConnWithPeer(c.RemoteAddr().String())
 
 	return nil
 }
@@ -2,11 +2,10 @@ package mc
 
 import (
 	"context"
-	"io"
+	"errors"
 	"sync"
 	"time"
 
-	mcdrv "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/driver"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
 	ma "github.com/multiformats/go-multiaddr"
@@ -21,21 +20,28 @@ var connMap sync.Map
 func newConn(ctx context.Context, t *Transport, remoteMa ma.Multiaddr,
 	remotePID peer.ID, inbound bool) (tpt.CapableConn, error) {
 	// Creates a manet.Conn
-	pr, pw := io.Pipe()
 	connCtx, cancel := context.WithCancel(gListener.ctx)
 
 	maconn := &Conn{
-		readIn:   pw,
-		readOut:  pr,
+		frames:   make(chan *frame, connFrameQueueSize),
 		localMa:  gListener.localMa,
 		remoteMa: remoteMa,
 		ctx:      connCtx,
 		cancel:   cancel,
+		driver:   t.driver,
 	}
 
-	// Unlock gListener locked from discovery.go (HandlePeerFound)
+	// Unlock gListener locked from discovery.go (handleFoundPeer)
 	gListener.inUse.Done()
 
+	// The upgrader only gates the conns accepted by its own listeners, the
+	// peer stays debounced so it isn't handled again right away.
+	if inbound && t.upgrader.ConnGater != nil && !t.upgrader.ConnGater.InterceptAccept(maconn) {
+		cancel()
+		t.driver.CloseConnWithPeer(maconn.RemoteAddr().String())
+		return nil, errors.New("conn refused by the connection gater")
+	}
+
 	// Stores the conn in connMap, will be deleted during conn.Close()
 	connMap.Store(maconn.RemoteAddr().String(), maconn)
 
@@ -46,15 +52,17 @@ func newConn(ctx context.Context, t *Transport, remoteMa ma.Multiaddr,
 	return t.upgrader.UpgradeOutbound(ctx, t, maconn, remotePID)
 }
 
-// ReceiveFromPeer is called by native driver when peer's device sent data.
-func ReceiveFromPeer(remotePID string, payload []byte) {
+// receiveFromPeer is called by native driver when peer's device sent data.
+// The payload is borrowed from the native driver, it is only valid during the
+// call.
+func receiveFromPeer(driver NativeDriver, remotePID string, payload []byte) {
 	// TODO: implement a cleaner way to do that
 	// Checks during 100 ms if the conn is available, because remote device can
 	// be ready to write while local device is still creating the new conn.
 	for i := 0; i < 100; i++ {
 		c, ok := connMap.Load(remotePID)
 		if ok {
-			_, err := c.(*Conn).readIn.Write(payload)
+			err := c.(*Conn).push(payload)
 			if err != nil {
 				logger.Error("receive from peer: write", zap.Error(err))
 			}
@@ -67,5 +75,5 @@ func ReceiveFromPeer(remotePID string, payload []byte) {
 		"connmgr failed to read from conn: unknown conn",
 		zap.String("remote address", remotePID),
 	)
-	mcdrv.CloseConnWithPeer(remotePID)
+	driver.CloseConnWithPeer(remotePID)
 }
@@ -10,8 +10,10 @@ import (
 	"go.uber.org/zap"
 )
 
-// HandleFoundPeer is called by the native driver when a new peer is found.
-func HandleFoundPeer(sRemotePID string) bool {
+// handleFoundPeer is called by the native driver when a new peer is found.
+func handleFoundPeer(sRemotePID string) bool {
+	markDiscovery()
+
 	remotePID, err := peer.Decode(sRemotePID)
 	if err != nil {
 		logger.Error("discovery handle peer failed: wrong remote peerID")
@@ -30,6 +32,19 @@ func HandleFoundPeer(sRemotePID string) bool {
 		return false
 	}
 
+	// In contacts-only mode, drops the peers that aren't known.
+	if !gListener.transport.proximity.AllowPeer(remotePID) {
+		logger.Debug("discovery handle peer skipped: unknown peer", zap.String("remote address", sRemotePID))
+		return false
+	}
+
+	// Drops repeated announcements, the native driver can report the same
+	// peer many times per second.
+	if !gDiscoveryLimiter.Allow(sRemotePID) {
+		logger.Debug("discovery handle peer skipped: debounced or rate limited", zap.String("remote address", sRemotePID))
+		return false
+	}
+
 	// Ensures that gListener won't be unset until operations using it are finished
 	gListener.inUse.Add(1)
 
@@ -37,9 +52,14 @@ func HandleFoundPeer(sRemotePID string) bool {
 	gListener.transport.host.Peerstore().AddAddr(remotePID, remoteMa,
 		pstore.TempAddrTTL)
 
+	// Remembers the peer for the next restarts.
+	if err := gListener.transport.cache.Put(remotePID); err != nil {
+		logger.Warn("discovery handle peer: unable to cache peer", zap.Error(err))
+	}
+
 	// Peer with lexicographical smallest peerID inits libp2p connection.
 	if gListener.Addr().String() < sRemotePID {
-		// Async connect so HandleFoundPeer can return and unlock the native driver.
+		// Async connect so handleFoundPeer can return and unlock the native driver.
 		// Needed to read and write during the connect handshake.
 		go func() {
 			err := gListener.transport.host.Connect(context.Background(), peer.AddrInfo{
@@ -0,0 +1,110 @@
+package mc
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDiscoveryDebounce is the default minimum delay between two
+	// handled announcements of the same peer.
+	DefaultDiscoveryDebounce = 5 * time.Second
+
+	// DefaultDiscoveryRate is the default number of announcements handled per
+	// second, all peers included.
+	DefaultDiscoveryRate = 10.0
+
+	// DefaultDiscoveryBurst is the default number of announcements that can be
+	// handled at once before the rate limit applies.
+	DefaultDiscoveryBurst = 20
+)
+
+// discoveryLimiter filters the announcements forwarded by the native driver
+// so a peer advertising many times per second (or a crowded room) won't
+// trigger a peerstore update and a connection attempt on every callback.
+type discoveryLimiter struct {
+	window time.Duration
+	rate   float64
+	burst  float64
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	lastGC   time.Time
+	tokens   float64
+	lastFill time.Time
+	now      func() time.Time
+}
+
+func newDiscoveryLimiter(window time.Duration, rate float64, burst int) *discoveryLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := time.Now()
+	return &discoveryLimiter{
+		window:   window,
+		rate:     rate,
+		burst:    float64(burst),
+		lastSeen: make(map[string]time.Time),
+		lastGC:   now,
+		tokens:   float64(burst),
+		lastFill: now,
+		now:      time.Now,
+	}
+}
+
+// Allow reports whether the announcement of the given peer should be handled.
+// A zero window disables debouncing and a zero rate disables rate limiting.
+func (dl *discoveryLimiter) Allow(remotePID string) bool {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	now := dl.now()
+
+	if last, ok := dl.lastSeen[remotePID]; ok && now.Sub(last) < dl.window {
+		return false
+	}
+
+	if dl.rate > 0 {
+		dl.tokens += now.Sub(dl.lastFill).Seconds() * dl.rate
+		if dl.tokens > dl.burst {
+			dl.tokens = dl.burst
+		}
+		dl.lastFill = now
+
+		if dl.tokens < 1 {
+			return false
+		}
+		dl.tokens--
+	}
+
+	if dl.window > 0 {
+		dl.lastSeen[remotePID] = now
+		dl.gc(now)
+	}
+
+	return true
+}
+
+// Forget removes the debounce entry of a peer, so its next announcement is
+// handled right away (e.g. after its connection was closed).
+func (dl *discoveryLimiter) Forget(remotePID string) {
+	dl.mu.Lock()
+	delete(dl.lastSeen, remotePID)
+	dl.mu.Unlock()
+}
+
+// gc drops expired entries, at most once per window.
+func (dl *discoveryLimiter) gc(now time.Time) {
+	if now.Sub(dl.lastGC) < dl.window {
+		return
+	}
+
+	for pid, last := range dl.lastSeen {
+		if now.Sub(last) >= dl.window {
+			delete(dl.lastSeen, pid)
+		}
+	}
+
+	dl.lastGC = now
+}
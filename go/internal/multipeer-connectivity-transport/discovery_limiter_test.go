@@ -0,0 +1,70 @@
+package mc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testingClock struct{ t time.Time }
+
+func (c *testingClock) now() time.Time          { return c.t }
+func (c *testingClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func testingDiscoveryLimiter(window time.Duration, rate float64, burst int) (*discoveryLimiter, *testingClock) {
+	clock := &testingClock{t: time.Unix(1600000000, 0)}
+	dl := newDiscoveryLimiter(window, rate, burst)
+	dl.now = clock.now
+	dl.lastFill = clock.t
+	dl.lastGC = clock.t
+
+	return dl, clock
+}
+
+func TestDiscoveryLimiter_Debounce(t *testing.T) {
+	dl, clock := testingDiscoveryLimiter(time.Second, 0, 1)
+
+	assert.True(t, dl.Allow("peerA"))
+	assert.False(t, dl.Allow("peerA"))
+	assert.True(t, dl.Allow("peerB"))
+
+	clock.advance(500 * time.Millisecond)
+	assert.False(t, dl.Allow("peerA"))
+
+	clock.advance(500 * time.Millisecond)
+	assert.True(t, dl.Allow("peerA"))
+
+	dl.Forget("peerA")
+	assert.True(t, dl.Allow("peerA"))
+}
+
+func TestDiscoveryLimiter_RateLimit(t *testing.T) {
+	dl, clock := testingDiscoveryLimiter(0, 2, 3)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, dl.Allow("peerA"), "burst %d", i)
+	}
+	assert.False(t, dl.Allow("peerB"))
+
+	clock.advance(500 * time.Millisecond)
+	assert.True(t, dl.Allow("peerB"))
+	assert.False(t, dl.Allow("peerC"))
+
+	clock.advance(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		assert.True(t, dl.Allow("peerC"), "refilled burst %d", i)
+	}
+	assert.False(t, dl.Allow("peerC"))
+}
+
+func TestDiscoveryLimiter_GC(t *testing.T) {
+	dl, clock := testingDiscoveryLimiter(time.Second, 0, 1)
+
+	assert.True(t, dl.Allow("peerA"))
+	assert.True(t, dl.Allow("peerB"))
+
+	clock.advance(2 * time.Second)
+	assert.True(t, dl.Allow("peerC"))
+	assert.Len(t, dl.lastSeen, 1)
+}
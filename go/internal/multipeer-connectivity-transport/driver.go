@@ -0,0 +1,101 @@
+package mc
+
+import (
+	mcdrv "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/driver"
+)
+
+// NativeDriver is implemented by the native proximity driver, the Multipeer
+// Connectivity driver of Darwin by default, or the BLE driver given by the
+// bridge. Once started, it reports the devices found nearby and the payloads
+// they send to the handler.
+type NativeDriver interface {
+	Start(localPID string, advertisement string, handler NativeHandler)
+	Stop()
+	DialPeer(remotePID string) bool
+	SendToPeer(remotePID string, payload []byte) bool
+	CloseConnWithPeer(remotePID string)
+
+	// Started, Advertising and Browsing report the state of the driver
+	// for the self test
+	Started() bool
+	Advertising() bool
+	Browsing() bool
+}
+
+// The duty cycles of the native driver, in percent of the time it scans and
+// advertises.
+const (
+	DutyCycleFull = 100
+	DutyCycleLow  = 20
+)
+
+// DutyCycler is implemented by the native drivers able to scan and advertise
+// intermittently, to save the battery.
+type DutyCycler interface {
+	SetDutyCycle(percent int)
+}
+
+// NativeHandler is called by a NativeDriver.
+type NativeHandler interface {
+	// HandleAdvertisement is called when a device is found, before
+	// connecting to it, it returns false if the device must be skipped
+	HandleAdvertisement(advertisement string) bool
+
+	// HandleFoundPeer is called once connected to a peer
+	HandleFoundPeer(remotePID string) bool
+
+	ReceiveFromPeer(remotePID string, payload []byte)
+}
+
+// driverHandler hands the calls of the driver to the listener running.
+type driverHandler struct {
+	driver NativeDriver
+}
+
+func (driverHandler) HandleAdvertisement(advertisement string) bool {
+	return handleAdvertisement(advertisement)
+}
+
+func (driverHandler) HandleFoundPeer(remotePID string) bool {
+	return handleFoundPeer(remotePID)
+}
+
+func (h driverHandler) ReceiveFromPeer(remotePID string, payload []byte) {
+	receiveFromPeer(h.driver, remotePID, payload)
+}
+
+// mcDriver is the Multipeer Connectivity driver, a noop off Darwin.
+type mcDriver struct{}
+
+func (mcDriver) Start(localPID string, advertisement string, handler NativeHandler) {
+	mcdrv.BindNativeToGoFunctions(handler.HandleFoundPeer, handler.ReceiveFromPeer, handler.HandleAdvertisement)
+	mcdrv.StartMCDriver(localPID, advertisement)
+}
+
+func (mcDriver) Stop() {
+	mcdrv.StopMCDriver()
+}
+
+func (mcDriver) DialPeer(remotePID string) bool {
+	return mcdrv.DialPeer(remotePID)
+}
+
+func (mcDriver) SendToPeer(remotePID string, payload []byte) bool {
+	return mcdrv.SendToPeer(remotePID, payload)
+}
+
+func (mcDriver) CloseConnWithPeer(remotePID string) {
+	mcdrv.CloseConnWithPeer(remotePID)
+}
+
+func (mcDriver) Started() bool {
+	return mcdrv.DriverStarted()
+}
+
+func (mcDriver) Advertising() bool {
+	return mcdrv.Advertising()
+}
+
+func (mcDriver) Browsing() bool {
+	return mcdrv.Browsing()
+}
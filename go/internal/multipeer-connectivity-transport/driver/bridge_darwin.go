@@ -7,14 +7,15 @@ import (
 )
 
 // Native -> Go functions
-func BindNativeToGoFunctions(hfp func(string) bool, rfp func(string, []byte)) {
+func BindNativeToGoFunctions(hfp func(string) bool, rfp func(string, []byte), hap func(string) bool) {
 	native.GoHandleFoundPeer = hfp
 	native.GoReceiveFromPeer = rfp
+	native.GoHandleAdvertisement = hap
 }
 
 // Go -> Native functions
-func StartMCDriver(localPID string) {
-	native.StartMCDriver(localPID)
+func StartMCDriver(localPID string, advertisement string) {
+	native.StartMCDriver(localPID, advertisement)
 }
 
 func StopMCDriver() {
@@ -32,3 +33,15 @@ func SendToPeer(remotePID string, payload []byte) bool {
 func CloseConnWithPeer(remotePID string) {
 	native.CloseConnWithPeer(remotePID)
 }
+
+func DriverStarted() bool {
+	return native.DriverStarted()
+}
+
+func Advertising() bool {
+	return native.Advertising()
+}
+
+func Browsing() bool {
+	return native.Browsing()
+}
@@ -5,12 +5,15 @@ package driver
 // Noop implementation for platform that are not Darwin
 
 // Native -> Go functions
-func BindNativeToGoFunctions(_ func(string) bool, _ func(string, []byte)) {}
+func BindNativeToGoFunctions(_ func(string) bool, _ func(string, []byte), _ func(string) bool) {}
 
 // Go -> Native functions
 // StartMCDriver returns true else the main app will stop
-func StartMCDriver(_ string)             {}
+func StartMCDriver(_ string, _ string)   {}
 func StopMCDriver()                      {}
 func DialPeer(_ string) bool             { return false }
 func SendToPeer(_ string, _ []byte) bool { return false }
 func CloseConnWithPeer(_ string)         {}
+func DriverStarted() bool                { return false }
+func Advertising() bool                  { return false }
+func Browsing() bool                     { return false }
@@ -17,9 +17,10 @@ NS_ASSUME_NONNULL_BEGIN
 @property (nonatomic, strong, nullable) MCNearbyServiceAdvertiser *mServiceAdvertiser;
 @property (nonatomic, strong, nullable) MCNearbyServiceBrowser *mServiceBrowser;
 @property (nonatomic, strong) MCPeerID *mPeerID;
+@property (nonatomic, strong) NSString *mAdvertisement;
 
 - (MCPeerID *)getMCPeerID:(NSString *)peerID;
-- (id)init:(NSString *)peerID;
+- (id)init:(NSString *)peerID advertisement:(NSString *)advertisement;
 - (int)startServiceAdvertiser;
 - (int)startServiceBrowser;
 - (void)stopServiceAdvertiser;
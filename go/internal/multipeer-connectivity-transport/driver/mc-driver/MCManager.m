@@ -5,6 +5,7 @@
 #import "mc-driver.h"
 
 NSString *BERTY_DRIVER_MC = @"berty-mc";
+NSString *BERTY_DRIVER_MC_ADV_KEY = @"h";
 
 @implementation MCManager
 
@@ -39,9 +40,10 @@ NSString *BERTY_DRIVER_MC = @"berty-mc";
     return (peerID);
 }
 
-- (id)init:(NSString *)peerID {
+- (id)init:(NSString *)peerID advertisement:(NSString *)advertisement {
     if (self = [super init]) {
         self.mPeerID = [[MCPeerID alloc] initWithDisplayName:peerID];
+        self.mAdvertisement = advertisement;
         if (!(self.mSession = [[MCSession alloc] initWithPeer:self.mPeerID securityIdentity:nil encryptionPreference:MCEncryptionRequired])) {
             NSLog(@"MC: MCSession init failed");
             return (self = nil);
@@ -52,7 +54,7 @@ NSString *BERTY_DRIVER_MC = @"berty-mc";
 }
 
 - (int)startServiceAdvertiser {
-    if (!(self.mServiceAdvertiser = [[MCNearbyServiceAdvertiser alloc] initWithPeer:self.mPeerID discoveryInfo:nil serviceType:BERTY_DRIVER_MC])) {
+    if (!(self.mServiceAdvertiser = [[MCNearbyServiceAdvertiser alloc] initWithPeer:self.mPeerID discoveryInfo:@{BERTY_DRIVER_MC_ADV_KEY: self.mAdvertisement} serviceType:BERTY_DRIVER_MC])) {
         NSLog(@"MC: MCNearbyServiceAdvertiser init failed");
         return (0);
     }
@@ -177,6 +179,11 @@ NSString *BERTY_DRIVER_MC = @"berty-mc";
 
 - (void)browser:(MCNearbyServiceBrowser *)browser foundPeer:(MCPeerID *)peerID withDiscoveryInfo:(NSDictionary<NSString *,NSString *> *)info {
     NSLog(@"MC: foundPeer: %@", [peerID displayName]);
+    // Skips the peer before connecting if the transport doesn't want it
+    if (!BridgeHandleAdvertisement(info[BERTY_DRIVER_MC_ADV_KEY] ?: @"")) {
+        NSLog(@"MC: foundPeer: skipped: %@", [peerID displayName]);
+        return ;
+    }
     [browser invitePeer:peerID toSession:self.mSession withContext:nil timeout:10];
 }
 
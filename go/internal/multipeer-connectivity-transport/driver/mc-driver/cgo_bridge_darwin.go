@@ -11,11 +11,13 @@ package mcdriver
 import "C"
 import "unsafe"
 
-func StartMCDriver(localPID string) {
+func StartMCDriver(localPID string, advertisement string) {
 	cPID := C.CString(localPID)
 	defer C.free(unsafe.Pointer(cPID))
+	cAdvertisement := C.CString(advertisement)
+	defer C.free(unsafe.Pointer(cAdvertisement))
 
-	C.StartMCDriver(cPID)
+	C.StartMCDriver(cPID, cAdvertisement)
 }
 
 func StopMCDriver() {
@@ -24,6 +26,7 @@ func StopMCDriver() {
 
 var GoHandleFoundPeer func(remotePID string) bool = nil
 var GoReceiveFromPeer func(remotePID string, payload []byte) = nil
+var GoHandleAdvertisement func(advertisement string) bool = nil
 
 //export HandleFoundPeer
 func HandleFoundPeer(remotePID *C.char) C.int {
@@ -35,10 +38,27 @@ func HandleFoundPeer(remotePID *C.char) C.int {
 	return 0
 }
 
+//export HandleAdvertisement
+func HandleAdvertisement(advertisement *C.char) C.int {
+	goAdvertisement := C.GoString(advertisement)
+
+	if GoHandleAdvertisement(goAdvertisement) {
+		return 1
+	}
+	return 0
+}
+
 //export ReceiveFromPeer
 func ReceiveFromPeer(remotePID *C.char, payload unsafe.Pointer, length C.int) {
 	goPID := C.GoString(remotePID)
-	goPayload := C.GoBytes(payload, length)
+
+	// The payload is borrowed from the native driver for the call, the
+	// receiver copies it to a pooled buffer instead of allocating one for
+	// every frame.
+	var goPayload []byte
+	if length > 0 {
+		goPayload = (*[1 << 30]byte)(payload)[:length:length]
+	}
 
 	GoReceiveFromPeer(goPID, goPayload)
 }
@@ -46,8 +66,13 @@ func ReceiveFromPeer(remotePID *C.char, payload unsafe.Pointer, length C.int) {
 func SendToPeer(remotePID string, payload []byte) bool {
 	cPID := C.CString(remotePID)
 	defer C.free(unsafe.Pointer(cPID))
-	cPayload := C.CBytes(payload)
-	defer C.free(cPayload)
+
+	// The native driver copies the payload before returning, it can read
+	// the Go memory directly.
+	var cPayload unsafe.Pointer
+	if len(payload) > 0 {
+		cPayload = unsafe.Pointer(&payload[0])
+	}
 
 	if C.SendToPeer(cPID, cPayload, C.int(len(payload))) == 1 {
 		return true
@@ -71,3 +96,15 @@ func CloseConnWithPeer(remotePID string) {
 
 	C.CloseConnWithPeer(cPID)
 }
+
+func DriverStarted() bool {
+	return C.DriverStarted() == 1
+}
+
+func Advertising() bool {
+	return C.Advertising() == 1
+}
+
+func Browsing() bool {
+	return C.Browsing() == 1
+}
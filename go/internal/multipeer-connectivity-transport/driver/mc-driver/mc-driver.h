@@ -8,10 +8,14 @@
 
 #import <Foundation/Foundation.h>
 
-void StartMCDriver(char *localPId);
+void StartMCDriver(char *localPId, char *advertisement);
 void StopMCDriver(void);
 int SendToPeer(char *remotePID, void *payload, int length);
 int DialPeer(char *remotePID);
 void CloseConnWithPeer(char *remotePID);
+int DriverStarted(void);
+int Advertising(void);
+int Browsing(void);
 int BridgeHandleFoundPeer(NSString *remotePID);
 void BridgeReceiveFromPeer(NSString *remotePID, NSData *payload);
+int BridgeHandleAdvertisement(NSString *advertisement);
@@ -8,23 +8,25 @@
 // This functions are Go functions so they aren't defined here
 extern int HandleFoundPeer(char *);
 extern void ReceiveFromPeer(char *, void *, unsigned long);
+extern int HandleAdvertisement(char *);
 
 int driverStarted = 0;
 
 // MCManager must be unique
 static MCManager *gMCManager = nil;
-MCManager* getMCManager(NSString *peerID) {
+MCManager* getMCManager(NSString *peerID, NSString *advertisement) {
     static dispatch_once_t onceToken;
     dispatch_once(&onceToken, ^{
-        gMCManager = [[MCManager alloc] init:peerID];
+        gMCManager = [[MCManager alloc] init:peerID advertisement:advertisement];
     });
     return gMCManager;
 }
 
-void StartMCDriver(char *localPID) {
+void StartMCDriver(char *localPID, char *advertisement) {
     if (!driverStarted) {
         NSString *cPID = [[NSString alloc] initWithUTF8String:localPID];
-        if (!getMCManager(cPID)) {
+        NSString *cAdvertisement = [[NSString alloc] initWithUTF8String:advertisement];
+        if (!getMCManager(cPID, cAdvertisement)) {
             NSLog(@"MC: StartMCDriver failed");
             return ;
         }
@@ -64,6 +66,18 @@ int DialPeer(char *remotePID) {
 void CloseConnWithPeer(char *peerID) {
 }
 
+int DriverStarted() {
+    return (driverStarted);
+}
+
+int Advertising() {
+    return (driverStarted && gMCManager.mServiceAdvertiser != nil);
+}
+
+int Browsing() {
+    return (driverStarted && gMCManager.mServiceBrowser != nil);
+}
+
 int BridgeHandleFoundPeer(NSString *remotePID) {
     char *cPID = (char *)[remotePID UTF8String];
     if (HandleFoundPeer(cPID)) {
@@ -78,3 +92,11 @@ void BridgeReceiveFromPeer(NSString *remotePID, NSData *payload) {
     int length = (int)[payload length];
     ReceiveFromPeer(cPID, cPayload, length);
 }
+
+int BridgeHandleAdvertisement(NSString *advertisement) {
+    char *cAdvertisement = (char *)[advertisement UTF8String];
+    if (HandleAdvertisement(cAdvertisement)) {
+        return (1);
+    }
+    return (0);
+}
@@ -0,0 +1,106 @@
+package mc
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testingDriver struct {
+	mu            sync.Mutex
+	localPID      string
+	advertisement string
+	handler       NativeHandler
+	closed        []string
+	started       bool
+}
+
+func (d *testingDriver) Start(localPID string, advertisement string, handler NativeHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.localPID, d.advertisement, d.handler, d.started = localPID, advertisement, handler, true
+}
+
+func (d *testingDriver) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.started = false
+}
+
+func (d *testingDriver) DialPeer(string) bool           { return false }
+func (d *testingDriver) SendToPeer(string, []byte) bool { return false }
+
+func (d *testingDriver) CloseConnWithPeer(remotePID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = append(d.closed, remotePID)
+}
+
+func (d *testingDriver) Started() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.started
+}
+
+func (d *testingDriver) Advertising() bool { return d.Started() }
+func (d *testingDriver) Browsing() bool    { return d.Started() }
+
+type testingDutyCycler struct {
+	*testingDriver
+	percent int
+}
+
+func (d *testingDutyCycler) SetDutyCycle(percent int) { d.percent = percent }
+
+func TestNativeDriver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := libp2p_mocknet.New(ctx).GenPeer()
+	require.NoError(t, err)
+
+	driver := &testingDriver{}
+	tpt, err := NewTransportConstructorWithOpts(Opts{Driver: driver})(h, nil)
+	require.NoError(t, err)
+
+	l, err := tpt.Listen(ma.StringCast(DefaultBind))
+	require.NoError(t, err)
+
+	// the driver is started with the advertisement of the host
+	require.True(t, driver.Started())
+	assert.Equal(t, h.ID().Pretty(), driver.localPID)
+	assert.Equal(t, advertisementHash(DefaultAdvertisementSalt, h.ID()), driver.advertisement)
+
+	report := tpt.SelfTest(ctx)
+	assert.True(t, report.OK, "%+v", report.Checks)
+
+	// the calls of the driver are handled by the listener
+	assert.True(t, driver.handler.HandleAdvertisement("unknown"))
+
+	driver.handler.ReceiveFromPeer("unknown", []byte("hello"))
+	assert.Equal(t, []string{"unknown"}, driver.closed)
+
+	require.NoError(t, l.Close())
+	assert.False(t, driver.Started())
+	assert.False(t, driver.handler.HandleAdvertisement("unknown"))
+
+	// the duty cycle is only set on the drivers supporting it
+	assert.False(t, tpt.SetDutyCycle(DutyCycleLow))
+
+	cycler := &testingDutyCycler{testingDriver: &testingDriver{}}
+	tpt, err = NewTransportConstructorWithOpts(Opts{Driver: cycler})(h, nil)
+	require.NoError(t, err)
+	require.True(t, tpt.SetDutyCycle(DutyCycleLow))
+	assert.Equal(t, DutyCycleLow, cycler.percent)
+	require.True(t, tpt.SetDutyCycle(0))
+	assert.Equal(t, DutyCycleFull, cycler.percent)
+}
@@ -6,7 +6,6 @@ import (
 	"net"
 	"sync"
 
-	mcdrv "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/driver"
 	mcma "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/multiaddr"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
@@ -54,7 +53,7 @@ func newListener(localMa ma.Multiaddr, t *Transport) *Listener {
 	// Starts the native driver.
 	// If it failed, don't return a error because no other transport
 	// on the libp2p node will be created.
-	mcdrv.StartMCDriver(t.host.ID().Pretty())
+	t.driver.Start(t.host.ID().Pretty(), advertisementHash(t.proximity.salt, t.host.ID()), driverHandler{driver: t.driver})
 
 	// Sets listener as global listener
 	gListener = listener
@@ -86,7 +85,7 @@ func (l *Listener) Close() error {
 	l.cancel()
 
 	// Stops the native driver.
-	mcdrv.StopMCDriver()
+	l.transport.driver.Stop()
 
 	// Removes global listener so transport can instantiate a new one later.
 	if gListener != nil {
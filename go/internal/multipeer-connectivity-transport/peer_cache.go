@@ -0,0 +1,134 @@
+package mc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	host "github.com/libp2p/go-libp2p-core/host"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DefaultPeerCacheTTL is the default duration a peer found through the native
+// driver is remembered after it was last seen.
+const DefaultPeerCacheTTL = 7 * 24 * time.Hour
+
+// peerCache persists the peers found through the native driver, so their MC
+// address is known by the peerstore right after a restart instead of waiting
+// for the next announcement.
+// Each record is signed with the local host key, records that were not
+// written by this host (or that were tampered with) are dropped on load.
+type peerCache struct {
+	ds  datastore.Datastore
+	sk  crypto.PrivKey
+	ttl time.Duration
+	now func() time.Time
+}
+
+func newPeerCache(ds datastore.Datastore, sk crypto.PrivKey, ttl time.Duration) *peerCache {
+	return &peerCache{
+		ds:  ds,
+		sk:  sk,
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+// Put records the given peer as seen now.
+func (pc *peerCache) Put(remotePID peer.ID) error {
+	if pc == nil {
+		return nil
+	}
+
+	expire := pc.now().Add(pc.ttl).UnixNano()
+	sig, err := pc.sk.Sign(peerCacheSignedData(remotePID, expire))
+	if err != nil {
+		return errors.Wrap(err, "peer cache: unable to sign record")
+	}
+
+	value := make([]byte, 8, 8+len(sig))
+	binary.BigEndian.PutUint64(value, uint64(expire))
+	value = append(value, sig...)
+
+	return pc.ds.Put(datastore.NewKey(remotePID.Pretty()), value)
+}
+
+// Preload adds the valid records to the peerstore of the given host and
+// removes the expired or invalid ones.
+func (pc *peerCache) Preload(h host.Host) error {
+	if pc == nil {
+		return nil
+	}
+
+	res, err := pc.ds.Query(query.Query{})
+	if err != nil {
+		return errors.Wrap(err, "peer cache: unable to query records")
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return errors.Wrap(err, "peer cache: unable to read records")
+	}
+
+	now := pc.now()
+	for _, entry := range entries {
+		key := datastore.NewKey(entry.Key)
+
+		remotePID, ttl, err := pc.validate(key, entry.Value, now)
+		if err != nil {
+			logger.Debug("peer cache: dropping record", zap.String("key", entry.Key), zap.Error(err))
+			if err := pc.ds.Delete(key); err != nil {
+				logger.Warn("peer cache: unable to delete record", zap.String("key", entry.Key), zap.Error(err))
+			}
+			continue
+		}
+
+		remoteMa, err := ma.NewMultiaddr(fmt.Sprintf("/mc/%s", remotePID.Pretty()))
+		if err != nil {
+			// Should never occur
+			panic(err)
+		}
+
+		h.Peerstore().AddAddr(remotePID, remoteMa, ttl)
+	}
+
+	return nil
+}
+
+// validate returns the peer ID and the remaining TTL of a record.
+func (pc *peerCache) validate(key datastore.Key, value []byte, now time.Time) (peer.ID, time.Duration, error) {
+	remotePID, err := peer.Decode(key.Name())
+	if err != nil {
+		return "", 0, errors.Wrap(err, "wrong peerID")
+	}
+
+	if len(value) < 8 {
+		return "", 0, errors.New("record too short")
+	}
+
+	expire := int64(binary.BigEndian.Uint64(value[:8]))
+	ttl := time.Unix(0, expire).Sub(now)
+	if ttl <= 0 {
+		return "", 0, errors.New("record expired")
+	}
+
+	ok, err := pc.sk.GetPublic().Verify(peerCacheSignedData(remotePID, expire), value[8:])
+	if err != nil || !ok {
+		return "", 0, errors.New("invalid signature")
+	}
+
+	return remotePID, ttl, nil
+}
+
+func peerCacheSignedData(remotePID peer.ID, expire int64) []byte {
+	data := make([]byte, len(remotePID)+8)
+	n := copy(data, remotePID)
+	binary.BigEndian.PutUint64(data[n:], uint64(expire))
+	return data
+}
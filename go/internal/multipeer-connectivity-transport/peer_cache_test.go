@@ -0,0 +1,63 @@
+package mc
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	local, err := mn.GenPeer()
+	require.NoError(t, err)
+	remote, err := mn.GenPeer()
+	require.NoError(t, err)
+	expired, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	clock := &testingClock{t: time.Unix(1600000000, 0)}
+
+	pc := newPeerCache(ds, local.Peerstore().PrivKey(local.ID()), time.Hour)
+	pc.now = clock.now
+
+	require.NoError(t, pc.Put(expired.ID()))
+	clock.advance(30 * time.Minute)
+	require.NoError(t, pc.Put(remote.ID()))
+	clock.advance(45 * time.Minute)
+
+	// a record signed by another key must be dropped
+	otherSK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	other := newPeerCache(ds, otherSK, time.Hour)
+	other.now = clock.now
+	require.NoError(t, other.Put(local.ID()))
+
+	require.NoError(t, pc.Preload(local))
+
+	assert.NotEmpty(t, local.Peerstore().Addrs(remote.ID()))
+	assert.Empty(t, local.Peerstore().Addrs(expired.ID()))
+	assert.Empty(t, local.Peerstore().Addrs(local.ID()))
+
+	has, err := ds.Has(datastore.NewKey(expired.ID().Pretty()))
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	has, err = ds.Has(datastore.NewKey(local.ID().Pretty()))
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	has, err = ds.Has(datastore.NewKey(remote.ID().Pretty()))
+	require.NoError(t, err)
+	assert.True(t, has)
+}
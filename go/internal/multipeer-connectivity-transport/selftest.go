@@ -0,0 +1,143 @@
+package mc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// SelfTestStatus is the result of a self-test check.
+type SelfTestStatus string
+
+const (
+	SelfTestOK      SelfTestStatus = "ok"
+	SelfTestWarning SelfTestStatus = "warning"
+	SelfTestFailed  SelfTestStatus = "failed"
+)
+
+// selfTestLoopbackAddr is the connMap key used by the loopback check, it can't
+// collide with a real peer since it isn't a valid peerID.
+const selfTestLoopbackAddr = "mc-selftest-loopback"
+
+// SelfTestCheck is a single check of a self-test.
+type SelfTestCheck struct {
+	Name   string         `json:"name"`
+	Status SelfTestStatus `json:"status"`
+	Detail string         `json:"detail,omitempty"`
+}
+
+// SelfTestReport is the result of Transport.SelfTest, it can be displayed by
+// the app or attached to a bug report.
+type SelfTestReport struct {
+	Checks []SelfTestCheck `json:"checks"`
+	OK     bool            `json:"ok"`
+	Date   time.Time       `json:"date"`
+}
+
+func (r *SelfTestReport) add(name string, status SelfTestStatus, detail string) {
+	r.Checks = append(r.Checks, SelfTestCheck{Name: name, Status: status, Detail: detail})
+	if status == SelfTestFailed {
+		r.OK = false
+	}
+}
+
+// gLastDiscovery is the time (unix nano) of the last discovery callback from
+// the native driver, accessed atomically
+var gLastDiscovery int64
+
+func markDiscovery() {
+	atomic.StoreInt64(&gLastDiscovery, time.Now().UnixNano())
+}
+
+// SelfTest checks that the native driver and the transport are working, it
+// doesn't need any peer nearby.
+func (t *Transport) SelfTest(ctx context.Context) *SelfTestReport {
+	report := &SelfTestReport{OK: true, Date: time.Now()}
+
+	// listener
+	if gListener == nil || gListener.ctx.Err() != nil {
+		report.add("listener", SelfTestFailed, "no active listener")
+	} else {
+		report.add("listener", SelfTestOK, gListener.Multiaddr().String())
+	}
+
+	// native driver
+	driver := t.driver
+	if driver == nil {
+		driver = mcDriver{}
+	}
+
+	if driver.Started() {
+		report.add("driver", SelfTestOK, "")
+	} else {
+		report.add("driver", SelfTestFailed, "native driver not started or not supported on this platform")
+	}
+
+	// advertising
+	if driver.Advertising() {
+		report.add("advertising", SelfTestOK, "")
+	} else {
+		report.add("advertising", SelfTestFailed, "advertiser not registered")
+	}
+
+	// scan callbacks
+	switch last := atomic.LoadInt64(&gLastDiscovery); {
+	case !driver.Browsing():
+		report.add("browsing", SelfTestFailed, "browser not registered")
+	case last == 0:
+		report.add("browsing", SelfTestWarning, "no device found yet")
+	default:
+		report.add("browsing", SelfTestOK, fmt.Sprintf("last device found at %s", time.Unix(0, last).Format(time.RFC3339)))
+	}
+
+	// loopback
+	if err := selfTestLoopback(ctx, driver); err != nil {
+		report.add("loopback", SelfTestFailed, err.Error())
+	} else {
+		report.add("loopback", SelfTestOK, "")
+	}
+
+	return report
+}
+
+// selfTestLoopback checks that a payload received by the native driver is
+// dispatched to the right conn.
+func selfTestLoopback(ctx context.Context, driver NativeDriver) error {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := &Conn{frames: make(chan *frame, connFrameQueueSize), ctx: connCtx, cancel: cancel}
+	connMap.Store(selfTestLoopbackAddr, c)
+	defer connMap.Delete(selfTestLoopbackAddr)
+
+	payload := []byte(selfTestLoopbackAddr)
+	go receiveFromPeer(driver, selfTestLoopbackAddr, payload)
+
+	read := make(chan error, 1)
+	go func() {
+		buf := make([]byte, len(payload))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			read <- err
+			return
+		}
+
+		if !bytes.Equal(buf, payload) {
+			read <- fmt.Errorf("payload mismatch")
+			return
+		}
+
+		read <- nil
+	}()
+
+	select {
+	case err := <-read:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Second):
+		return fmt.Errorf("timeout reading payload")
+	}
+}
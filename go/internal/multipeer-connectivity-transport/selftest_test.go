@@ -0,0 +1,21 @@
+package mc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTestWithoutListener(t *testing.T) {
+	report := (&Transport{}).SelfTest(context.Background())
+	assert.False(t, report.OK)
+
+	statuses := map[string]SelfTestStatus{}
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+
+	assert.Equal(t, SelfTestFailed, statuses["listener"])
+	assert.Equal(t, SelfTestOK, statuses["loopback"])
+}
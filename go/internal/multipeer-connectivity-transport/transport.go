@@ -3,10 +3,11 @@ package mc
 import (
 	"context"
 	"fmt"
+	"time"
 
-	mcdrv "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/driver"
 	mcma "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/multiaddr"
 
+	datastore "github.com/ipfs/go-datastore"
 	host "github.com/libp2p/go-libp2p-core/host"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
@@ -18,33 +19,153 @@ import (
 
 const DefaultBind = "/mc/Qmeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"
 
-// logger is global because HandleFoundPeer must be able to call it
+// logger is global because handleFoundPeer must be able to call it
 // FIXME: remove global logger
 var logger *zap.Logger = zap.L().Named("mc-transport")
 
+// gDiscoveryLimiter is global because handleFoundPeer must be able to call it
+// FIXME: remove global discovery limiter
+var gDiscoveryLimiter = newDiscoveryLimiter(DefaultDiscoveryDebounce, DefaultDiscoveryRate, DefaultDiscoveryBurst)
+
 // Transport is a tpt.transport.
 var _ tpt.Transport = &Transport{}
 
 // Transport represents any device by which you can connect to and accept
 // connections from other peers.
 type Transport struct {
-	host     host.Host
-	upgrader *tptu.Upgrader
+	host      host.Host
+	upgrader  *tptu.Upgrader
+	cache     *peerCache
+	proximity *proximityFilter
+	driver    NativeDriver
+}
+
+// Opts contains optional configuration flags for the MC transport
+type Opts struct {
+	Logger *zap.Logger
+
+	// Driver runs the native proximity links, it defaults to the Multipeer
+	// Connectivity driver, which is a noop off Darwin.
+	Driver NativeDriver
+
+	// DiscoveryDebounce is the minimum delay between two handled
+	// announcements of the same peer, set it to a negative value to disable
+	// debouncing.
+	DiscoveryDebounce time.Duration
+
+	// DiscoveryRate is the maximum number of announcements handled per
+	// second, all peers included, with bursts up to DiscoveryBurst. Set it to
+	// a negative value to disable rate limiting.
+	DiscoveryRate  float64
+	DiscoveryBurst int
+
+	// Datastore is used to remember the peers found through the native
+	// driver across restarts, nothing is persisted if it's nil.
+	Datastore datastore.Datastore
+
+	// PeerCacheTTL is the duration a peer is remembered after it was last
+	// seen.
+	PeerCacheTTL time.Duration
+
+	// ContactsOnly makes the native driver skip the devices whose
+	// advertisement doesn't match one of the peers returned by KnownPeers.
+	// KnownPeers is called at most once a minute, Transport.AddKnownPeer
+	// allows a new contact right away.
+	ContactsOnly bool
+	KnownPeers   func() []peer.ID
+
+	// BlockedPeer, if set, makes the transport ignore the announcements of
+	// the peers it returns true for.
+	BlockedPeer func(peer.ID) bool
+
+	// AdvertisementSalt is used to hash the peerID put in the advertisement.
+	AdvertisementSalt []byte
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.DiscoveryDebounce == 0 {
+		opts.DiscoveryDebounce = DefaultDiscoveryDebounce
+	} else if opts.DiscoveryDebounce < 0 {
+		opts.DiscoveryDebounce = 0
+	}
+
+	if opts.DiscoveryRate == 0 {
+		opts.DiscoveryRate = DefaultDiscoveryRate
+	} else if opts.DiscoveryRate < 0 {
+		opts.DiscoveryRate = 0
+	}
+
+	if opts.DiscoveryBurst <= 0 {
+		opts.DiscoveryBurst = DefaultDiscoveryBurst
+	}
+
+	if opts.PeerCacheTTL <= 0 {
+		opts.PeerCacheTTL = DefaultPeerCacheTTL
+	}
+
+	if len(opts.AdvertisementSalt) == 0 {
+		opts.AdvertisementSalt = DefaultAdvertisementSalt
+	}
 }
 
 func NewTransportConstructorWithLogger(l *zap.Logger) func(h host.Host, u *tptu.Upgrader) (*Transport, error) {
-	if l != nil {
-		logger = l
+	return NewTransportConstructorWithOpts(Opts{Logger: l})
+}
+
+func NewTransportConstructorWithOpts(opts Opts) func(h host.Host, u *tptu.Upgrader) (*Transport, error) {
+	opts.applyDefaults()
+
+	if opts.Logger != nil {
+		logger = opts.Logger
+	}
+	gDiscoveryLimiter = newDiscoveryLimiter(opts.DiscoveryDebounce, opts.DiscoveryRate, opts.DiscoveryBurst)
+
+	return func(h host.Host, u *tptu.Upgrader) (*Transport, error) {
+		t, err := NewTransport(h, u)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.Driver != nil {
+			t.driver = opts.Driver
+		}
+
+		t.proximity = &proximityFilter{
+			salt:         opts.AdvertisementSalt,
+			contactsOnly: opts.ContactsOnly,
+			knownPeers:   opts.KnownPeers,
+			blocked:      opts.BlockedPeer,
+		}
+
+		if opts.Datastore == nil {
+			return t, nil
+		}
+
+		sk := h.Peerstore().PrivKey(h.ID())
+		if sk == nil {
+			return nil, errors.New("transport creation failed: no private key for local peer")
+		}
+
+		t.cache = newPeerCache(opts.Datastore, sk, opts.PeerCacheTTL)
+
+		// Known peers are added to the peerstore straight away, so there is
+		// no need to wait for their next announcement.
+		if err := t.cache.Preload(h); err != nil {
+			logger.Warn("unable to preload peer cache", zap.Error(err))
+		}
+
+		return t, nil
 	}
-	return NewTransport
 }
 
 // NewTransport creates a transport object that tracks dialers and listener.
 // It also starts the discovery service.
 func NewTransport(h host.Host, u *tptu.Upgrader) (*Transport, error) {
 	return &Transport{
-		host:     h,
-		upgrader: u,
+		host:      h,
+		upgrader:  u,
+		proximity: &proximityFilter{salt: DefaultAdvertisementSalt},
+		driver:    mcDriver{},
 	}, nil
 }
 
@@ -66,7 +187,7 @@ func (t *Transport) Dial(ctx context.Context, remoteMa ma.Multiaddr, remotePID p
 
 	// Check if native driver is already connected to peer's device.
 	// With MC you can't really dial, only auto-connect with peer nearby.
-	if !mcdrv.DialPeer(remoteAddr) {
+	if !t.driver.DialPeer(remoteAddr) {
 		return nil, errors.New("transport dialing peer failed: peer not connected through MC")
 	}
 
@@ -128,3 +249,32 @@ func (t *Transport) Protocols() []int {
 func (t *Transport) String() string {
 	return "MC"
 }
+
+// AddKnownPeer allows a peer in contacts-only mode, without waiting for the
+// next reload of the known peers, e.g. a contact that was just added.
+func (t *Transport) AddKnownPeer(pid peer.ID) {
+	t.proximity.add(pid)
+}
+
+// SetDutyCycle sets the share of the time the native driver scans and
+// advertises, e.g. DutyCycleLow while the battery is low. It returns false
+// if the driver doesn't support it.
+func (t *Transport) SetDutyCycle(percent int) bool {
+	d, ok := t.driver.(DutyCycler)
+	if !ok {
+		return false
+	}
+
+	if percent <= 0 || percent > DutyCycleFull {
+		percent = DutyCycleFull
+	}
+
+	d.SetDutyCycle(percent)
+	return true
+}
+
+// ClearKnownPeers forgets the allowed peers, e.g. after a contact was
+// removed, they're reloaded from KnownPeers on the next advertisement.
+func (t *Transport) ClearKnownPeers() {
+	t.proximity.clear()
+}
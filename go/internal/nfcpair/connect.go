@@ -0,0 +1,52 @@
+package nfcpair
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ProximityDialTimeout bounds the dial of the proximity transports, the peer
+// is right there so the datapath is quick to establish when supported.
+const ProximityDialTimeout = 20 * time.Second
+
+// ProximityAddrs returns the addrs of a peer on the proximity transports:
+// multipeer connectivity, over BLE and peer-to-peer Wi-Fi, and Wi-Fi Direct.
+func ProximityAddrs(pid peer.ID) []ma.Multiaddr {
+	addrs := []ma.Multiaddr{}
+	for _, s := range []string{"/mc/%s", "/wifi/%s"} {
+		if addr, err := ma.NewMultiaddr(fmt.Sprintf(s, pid.Pretty())); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// Connect connects to the peer of a record through a proximity transport, or
+// through its current addrs if no proximity datapath is available.
+func Connect(ctx context.Context, h host.Host, r *Record) error {
+	if r.PeerID == h.ID() {
+		return fmt.Errorf("can't pair with self")
+	}
+
+	// the addrs of the record are only added after the proximity dial, which
+	// would dial them too otherwise
+	proxCtx, cancel := context.WithTimeout(ctx, ProximityDialTimeout)
+	err := h.Connect(proxCtx, peer.AddrInfo{ID: r.PeerID, Addrs: ProximityAddrs(r.PeerID)})
+	cancel()
+
+	addrs := r.Multiaddrs()
+	h.Peerstore().AddAddrs(r.PeerID, addrs, peerstore.TempAddrTTL)
+
+	if err == nil || len(addrs) == 0 {
+		return err
+	}
+
+	return h.Connect(ctx, peer.AddrInfo{ID: r.PeerID, Addrs: addrs})
+}
@@ -0,0 +1,8 @@
+// Package nfcpair implements the NFC tap-to-pair bootstrap: the devices
+// exchange a peer record signed by their peer key over NDEF, then connect
+// through a proximity transport and send a contact request.
+//
+// The record only gives the proximity transports the peer to dial, it isn't
+// trusted beyond its signature: the contact request is still sent through
+// the protocol, and its recipient accepts it or not.
+package nfcpair
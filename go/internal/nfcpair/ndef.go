@@ -0,0 +1,115 @@
+package nfcpair
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// RecordType is the NFC Forum external type of the NDEF record holding a
+// signed peer record.
+const RecordType = "berty.tech:pair"
+
+const (
+	ndefFlagMB = 0x80
+	ndefFlagME = 0x40
+	ndefFlagCF = 0x20
+	ndefFlagSR = 0x10
+	ndefFlagIL = 0x08
+
+	ndefTNFMask     = 0x07
+	ndefTNFExternal = 0x04
+)
+
+// ErrNoRecord is returned when an NDEF message doesn't hold a peer record.
+var ErrNoRecord = fmt.Errorf("no peer record in NDEF message")
+
+// EncodeNDEF wraps a signed record in an NDEF message made of a single
+// external record, written by the native driver as is.
+func EncodeNDEF(signed []byte) []byte {
+	buf := &bytes.Buffer{}
+
+	header := byte(ndefFlagMB | ndefFlagME | ndefTNFExternal)
+	if len(signed) < 256 {
+		header |= ndefFlagSR
+	}
+
+	buf.WriteByte(header)
+	buf.WriteByte(byte(len(RecordType)))
+
+	if header&ndefFlagSR != 0 {
+		buf.WriteByte(byte(len(signed)))
+	} else {
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(signed)))
+	}
+
+	buf.WriteString(RecordType)
+	buf.Write(signed)
+
+	return buf.Bytes()
+}
+
+// DecodeNDEF returns the payload of the peer record of an NDEF message, the
+// other records, e.g. an Android application record, are skipped.
+func DecodeNDEF(msg []byte) ([]byte, error) {
+	for len(msg) > 0 {
+		header := msg[0]
+		msg = msg[1:]
+
+		if header&ndefFlagCF != 0 {
+			return nil, fmt.Errorf("chunked NDEF records are not supported")
+		}
+
+		if len(msg) < 1 {
+			return nil, fmt.Errorf("truncated NDEF record")
+		}
+
+		typeLen := int(msg[0])
+		msg = msg[1:]
+
+		var payloadLen int
+		if header&ndefFlagSR != 0 {
+			if len(msg) < 1 {
+				return nil, fmt.Errorf("truncated NDEF record")
+			}
+
+			payloadLen = int(msg[0])
+			msg = msg[1:]
+		} else {
+			if len(msg) < 4 {
+				return nil, fmt.Errorf("truncated NDEF record")
+			}
+
+			payloadLen = int(binary.BigEndian.Uint32(msg))
+			msg = msg[4:]
+		}
+
+		idLen := 0
+		if header&ndefFlagIL != 0 {
+			if len(msg) < 1 {
+				return nil, fmt.Errorf("truncated NDEF record")
+			}
+
+			idLen = int(msg[0])
+			msg = msg[1:]
+		}
+
+		if payloadLen < 0 || len(msg) < typeLen+idLen+payloadLen {
+			return nil, fmt.Errorf("truncated NDEF record")
+		}
+
+		recordType := string(msg[:typeLen])
+		payload := msg[typeLen+idLen : typeLen+idLen+payloadLen]
+		msg = msg[typeLen+idLen+payloadLen:]
+
+		if header&ndefTNFMask == ndefTNFExternal && recordType == RecordType {
+			return payload, nil
+		}
+
+		if header&ndefFlagME != 0 {
+			break
+		}
+	}
+
+	return nil, ErrNoRecord
+}
@@ -0,0 +1,103 @@
+package nfcpair
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	return sk
+}
+
+func TestSignOpen(t *testing.T) {
+	sk := testKey(t)
+	now := time.Now()
+
+	signed, err := Sign(sk, &Record{
+		BLEUUID:      "c5d8a1e6-6f0b-4b5e-9d3f-1a2b3c4d5e6f",
+		Addrs:        []string{"/ip4/192.168.1.2/tcp/4242", "invalid"},
+		ContactToken: []byte("token"),
+	}, now)
+	require.NoError(t, err)
+
+	r, err := Open(signed, now.Add(time.Minute))
+	require.NoError(t, err)
+
+	pid, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+	assert.Equal(t, pid, r.PeerID)
+	assert.Equal(t, []byte("token"), r.ContactToken)
+	assert.Len(t, r.Multiaddrs(), 1)
+
+	_, err = Open(signed, now.Add(MaxRecordAge+time.Second))
+	assert.Equal(t, ErrExpired, err)
+}
+
+func TestOpenForged(t *testing.T) {
+	sk, other := testKey(t), testKey(t)
+	now := time.Now()
+
+	signed, err := Sign(sk, &Record{ContactToken: []byte("token")}, now)
+	require.NoError(t, err)
+
+	// the record is tampered with
+	sr := &signedRecord{}
+	require.NoError(t, json.Unmarshal(signed, sr))
+	sr.Record = bytes.Replace(sr.Record, []byte("dG9rZW4"), []byte("b3RoZXI"), 1)
+	tampered, err := json.Marshal(sr)
+	require.NoError(t, err)
+
+	_, err = Open(tampered, now)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	// the record is signed by another key than the one of its peer
+	require.NoError(t, json.Unmarshal(signed, sr))
+	sr.Signature, err = other.Sign(sr.Record)
+	require.NoError(t, err)
+	sr.PublicKey, err = crypto.MarshalPublicKey(other.GetPublic())
+	require.NoError(t, err)
+	forged, err := json.Marshal(sr)
+	require.NoError(t, err)
+
+	_, err = Open(forged, now)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestNDEF(t *testing.T) {
+	for _, size := range []int{10, 300} {
+		payload := bytes.Repeat([]byte{1}, size)
+
+		decoded, err := DecodeNDEF(EncodeNDEF(payload))
+		require.NoError(t, err)
+		assert.Equal(t, payload, decoded)
+	}
+
+	// an Android application record precedes the peer record
+	aar := []byte{ndefFlagMB | ndefFlagSR | ndefTNFExternal, 15, 4}
+	aar = append(aar, []byte("android.com:pkgtech")...)
+	msg := EncodeNDEF([]byte("payload"))
+	msg[0] &^= ndefFlagMB
+
+	decoded, err := DecodeNDEF(append(aar, msg...))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("payload"), decoded)
+
+	_, err = DecodeNDEF(aar[:len(aar)-1])
+	assert.Error(t, err)
+
+	_, err = DecodeNDEF([]byte{ndefFlagMB | ndefFlagME | ndefFlagSR | 0x01, 1, 1, 'T', 'x'})
+	assert.Equal(t, ErrNoRecord, err)
+}
@@ -0,0 +1,127 @@
+package nfcpair
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// MaxRecordAge is how long a record is accepted after being signed, the
+// records are exchanged during the tap so a captured one can't be replayed
+// later.
+const MaxRecordAge = 5 * time.Minute
+
+// maxClockSkew tolerates the records signed by a device with a clock ahead.
+const maxClockSkew = time.Minute
+
+var (
+	// ErrInvalidSignature is returned when a record isn't signed by the key
+	// of its peer
+	ErrInvalidSignature = fmt.Errorf("invalid peer record signature")
+
+	// ErrExpired is returned for the records signed too long ago
+	ErrExpired = fmt.Errorf("peer record expired")
+)
+
+// Record is the peer record exchanged during the tap.
+type Record struct {
+	PeerID peer.ID `json:"peer_id"`
+
+	// BLEUUID is the service UUID advertised by the native BLE driver of the
+	// device, if any
+	BLEUUID string `json:"ble_uuid,omitempty"`
+
+	// Addrs are the current listen addrs of the device
+	Addrs []string `json:"addrs,omitempty"`
+
+	// ContactToken is the contact request reference of the account, i.e. a
+	// serialized bertytypes.ShareableContact
+	ContactToken []byte `json:"contact_token"`
+
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Multiaddrs returns the valid addrs of the record.
+func (r *Record) Multiaddrs() []ma.Multiaddr {
+	addrs := []ma.Multiaddr{}
+	for _, s := range r.Addrs {
+		if addr, err := ma.NewMultiaddr(s); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+type signedRecord struct {
+	Record    []byte `json:"record"`
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign signs a record with the peer key of the device, the peer ID and the
+// timestamp of the record are set from it.
+func Sign(sk crypto.PrivKey, r *Record, now time.Time) ([]byte, error) {
+	pid, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	r.PeerID = pid
+	r.Timestamp = now.Unix()
+
+	record, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := sk.Sign(record)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := crypto.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&signedRecord{Record: record, PublicKey: pk, Signature: sig})
+}
+
+// Open verifies a signed record, it must be signed by the key of its peer
+// less than MaxRecordAge ago.
+func Open(data []byte, now time.Time) (*Record, error) {
+	signed := &signedRecord{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, err
+	}
+
+	pk, err := crypto.UnmarshalPublicKey(signed.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := pk.Verify(signed.Record, signed.Signature); err != nil || !ok {
+		return nil, ErrInvalidSignature
+	}
+
+	r := &Record{}
+	if err := json.Unmarshal(signed.Record, r); err != nil {
+		return nil, err
+	}
+
+	if !r.PeerID.MatchesPublicKey(pk) {
+		return nil, ErrInvalidSignature
+	}
+
+	signedAt := time.Unix(r.Timestamp, 0)
+	if now.Sub(signedAt) > MaxRecordAge || signedAt.Sub(now) > maxClockSkew {
+		return nil, ErrExpired
+	}
+
+	return r, nil
+}
@@ -0,0 +1,5 @@
+// Package observedaddr learns the external addrs of the node from the addrs
+// its peers see it at. An addr observed by enough distinct networks is
+// confirmed: it is announced, and so part of the signed peer record, and the
+// changes of the confirmed addrs are emitted on the event bus of the host.
+package observedaddr
@@ -0,0 +1,215 @@
+package observedaddr
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	p2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	p2p_config "github.com/libp2p/go-libp2p/config"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+const ProtocolID = protocol.ID("/berty/observed-addr/1.0.0")
+
+const (
+	// DefaultThreshold is the number of distinct observer networks needed to
+	// confirm an addr
+	DefaultThreshold = 3
+
+	// DefaultTTL is the lifetime of an observation
+	DefaultTTL = 30 * time.Minute
+
+	defaultRefreshInterval = time.Minute
+	defaultReportTimeout   = 10 * time.Second
+)
+
+// EvtExternalAddrsChanged is emitted on the event bus of the host when the
+// confirmed external addrs change.
+type EvtExternalAddrsChanged struct {
+	Current []ma.Multiaddr
+	Added   []ma.Multiaddr
+	Removed []ma.Multiaddr
+}
+
+// report is sent to the peer right after connecting, it carries the addr the
+// peer is seen at.
+type report struct {
+	Addr string `json:"addr"`
+}
+
+// Opts contains the configuration of the observed addrs service.
+type Opts struct {
+	Logger    *zap.Logger
+	Threshold int
+	TTL       time.Duration
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultThreshold
+	}
+
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultTTL
+	}
+}
+
+// Service reports to the peers the addrs they are seen at, and tracks the
+// addrs reported by them.
+type Service struct {
+	logger  *zap.Logger
+	tracker *tracker
+	host    host.Host
+	emitter event.Emitter
+
+	// confirmed addrs, only used by the refresh loop
+	current []ma.Multiaddr
+	notify  chan struct{}
+}
+
+// New returns a service, its AddrsFactoryOption has to be given to the host
+// before calling Start.
+func New(opts Opts) *Service {
+	opts.applyDefaults()
+
+	return &Service{
+		logger:  opts.Logger.Named("observedaddr"),
+		tracker: newTracker(opts.Threshold, opts.TTL),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// AddrsFactoryOption returns a libp2p option appending the confirmed addrs to
+// the addrs announced by the host, they are signed in its peer record. It
+// wraps the addrs factory already configured, so it has to come last.
+func (s *Service) AddrsFactoryOption() p2p.Option {
+	return func(cfg *p2p_config.Config) error {
+		next := cfg.AddrsFactory
+		cfg.AddrsFactory = func(addrs []ma.Multiaddr) []ma.Multiaddr {
+			if next != nil {
+				addrs = next(addrs)
+			}
+
+			added, _ := diffAddrs(addrs, s.tracker.confirmed(time.Now()))
+			return append(addrs, added...)
+		}
+
+		return nil
+	}
+}
+
+// Start registers the protocol on the host, and emits the changes of the
+// confirmed addrs until ctx is done.
+func (s *Service) Start(ctx context.Context, h host.Host) error {
+	emitter, err := h.EventBus().Emitter(new(EvtExternalAddrsChanged))
+	if err != nil {
+		return err
+	}
+
+	s.host = h
+	s.emitter = emitter
+
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			// the addrs seen through a relay are the ones of the relay
+			if !isRelayedAddr(c.RemoteMultiaddr()) {
+				go s.report(c)
+			}
+		},
+	})
+
+	go s.refresh(ctx)
+
+	return nil
+}
+
+// report sends to the peer the addr of the connection.
+func (s *Service) report(c network.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultReportTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(network.WithNoDial(ctx, "observed addr"), c.RemotePeer(), ProtocolID)
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(defaultReportTimeout))
+
+	if err := json.NewEncoder(stream).Encode(&report{Addr: c.RemoteMultiaddr().String()}); err != nil {
+		s.logger.Debug("unable to report observed addr", zap.Stringer("peer", c.RemotePeer()), zap.Error(err))
+		_ = stream.Reset()
+	}
+}
+
+func (s *Service) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(defaultReportTimeout))
+
+	r := report{}
+	if err := json.NewDecoder(stream).Decode(&r); err != nil {
+		_ = stream.Reset()
+		return
+	}
+
+	observed, err := ma.NewMultiaddr(r.Addr)
+	if err != nil {
+		return
+	}
+
+	c := stream.Conn()
+	if s.tracker.observe(c.RemotePeer(), c.RemoteMultiaddr(), c.LocalMultiaddr(), observed, time.Now()) {
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// refresh emits an event when the confirmed addrs change, either after an
+// observation or once the old ones expire.
+func (s *Service) refresh(ctx context.Context) {
+	defer s.emitter.Close()
+
+	ticker := time.NewTicker(defaultRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.notify:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		confirmed := s.tracker.confirmed(time.Now())
+		added, removed := diffAddrs(s.current, confirmed)
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+
+		s.current = confirmed
+		s.logger.Info("external addrs changed",
+			zap.Any("current", confirmed), zap.Any("added", added), zap.Any("removed", removed))
+
+		if err := s.emitter.Emit(EvtExternalAddrsChanged{
+			Current: confirmed,
+			Added:   added,
+			Removed: removed,
+		}); err != nil {
+			s.logger.Warn("unable to emit external addrs event", zap.Error(err))
+		}
+	}
+}
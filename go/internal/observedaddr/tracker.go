@@ -0,0 +1,201 @@
+package observedaddr
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// tracker scores the observed addrs, the score of an addr is the number of
+// distinct observer networks that reported it recently. The addrs mapped by
+// symmetric NATs change with each observer and are never confirmed.
+type tracker struct {
+	threshold int
+	ttl       time.Duration
+
+	muAddrs sync.Mutex
+	addrs   map[string]*observedAddr
+}
+
+type observedAddr struct {
+	addr ma.Multiaddr
+
+	// last observation by observer network
+	seen map[string]time.Time
+
+	// peers that reported the addr, a peer only counts once
+	observers map[peer.ID]string
+}
+
+func newTracker(threshold int, ttl time.Duration) *tracker {
+	return &tracker{
+		threshold: threshold,
+		ttl:       ttl,
+		addrs:     make(map[string]*observedAddr),
+	}
+}
+
+// observe records that the peer, connected from observer, reported the local
+// addr as observed. Only the public addrs using the same transport as the
+// local end of the connection are kept.
+func (t *tracker) observe(pid peer.ID, observer, local, observed ma.Multiaddr, now time.Time) bool {
+	if !manet.IsPublicAddr(observed) || isRelayedAddr(observed) || !sameTransport(local, observed) {
+		return false
+	}
+
+	group, ok := observerGroup(observer)
+	if !ok {
+		return false
+	}
+
+	t.muAddrs.Lock()
+	defer t.muAddrs.Unlock()
+
+	key := string(observed.Bytes())
+	oa, ok := t.addrs[key]
+	if !ok {
+		oa = &observedAddr{
+			addr:      observed,
+			seen:      make(map[string]time.Time),
+			observers: make(map[peer.ID]string),
+		}
+		t.addrs[key] = oa
+	}
+
+	// a peer moving to another network replaces its previous observation
+	if prev, ok := oa.observers[pid]; ok && prev != group {
+		delete(oa.seen, prev)
+	}
+
+	oa.observers[pid] = group
+	oa.seen[group] = now
+
+	return true
+}
+
+// confirmed expires the old observations, then returns the addrs reported by
+// at least threshold observer networks, sorted by score.
+func (t *tracker) confirmed(now time.Time) []ma.Multiaddr {
+	t.muAddrs.Lock()
+	defer t.muAddrs.Unlock()
+
+	type scored struct {
+		addr  ma.Multiaddr
+		score int
+	}
+
+	addrs := []scored{}
+	for key, oa := range t.addrs {
+		for group, seen := range oa.seen {
+			if now.Sub(seen) > t.ttl {
+				delete(oa.seen, group)
+			}
+		}
+
+		for pid, group := range oa.observers {
+			if _, ok := oa.seen[group]; !ok {
+				delete(oa.observers, pid)
+			}
+		}
+
+		if len(oa.seen) == 0 {
+			delete(t.addrs, key)
+			continue
+		}
+
+		if len(oa.seen) >= t.threshold {
+			addrs = append(addrs, scored{addr: oa.addr, score: len(oa.seen)})
+		}
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		if addrs[i].score != addrs[j].score {
+			return addrs[i].score > addrs[j].score
+		}
+
+		return addrs[i].addr.String() < addrs[j].addr.String()
+	})
+
+	res := make([]ma.Multiaddr, len(addrs))
+	for i, s := range addrs {
+		res[i] = s.addr
+	}
+
+	return res
+}
+
+// observerGroup returns the network of the observer, a /16 for IPv4 and a
+// /32 for IPv6, so that the peers of a single network count once.
+func observerGroup(addr ma.Multiaddr) (string, bool) {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return "", false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String(), true
+	}
+
+	return ip.Mask(net.CIDRMask(32, 128)).String(), true
+}
+
+// sameTransport compares the protocols of the addrs after the IP, e.g. an
+// addr observed on a QUIC connection can't be announced for TCP.
+func sameTransport(a, b ma.Multiaddr) bool {
+	_, ta := ma.SplitFirst(a)
+	_, tb := ma.SplitFirst(b)
+	if ta == nil || tb == nil {
+		return false
+	}
+
+	pa, pb := ta.Protocols(), tb.Protocols()
+	if len(pa) != len(pb) {
+		return false
+	}
+
+	for i := range pa {
+		if pa[i].Code != pb[i].Code {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isRelayedAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// diffAddrs returns the addrs of b missing in a, and the addrs of a missing
+// in b.
+func diffAddrs(a, b []ma.Multiaddr) (added, removed []ma.Multiaddr) {
+	contains := func(addrs []ma.Multiaddr, addr ma.Multiaddr) bool {
+		for _, other := range addrs {
+			if other.Equal(addr) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, addr := range b {
+		if !contains(a, addr) {
+			added = append(added, addr)
+		}
+	}
+
+	for _, addr := range a {
+		if !contains(b, addr) {
+			removed = append(removed, addr)
+		}
+	}
+
+	return added, removed
+}
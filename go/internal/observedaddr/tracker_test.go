@@ -0,0 +1,61 @@
+package observedaddr
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackerConfirm(t *testing.T) {
+	local := ma.StringCast("/ip4/192.168.1.2/tcp/4001")
+	observed := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	now := time.Now()
+
+	tr := newTracker(2, time.Minute)
+
+	// two peers of the same network count once
+	assert.True(t, tr.observe(peer.ID("a"), ma.StringCast("/ip4/5.6.1.1/tcp/4001"), local, observed, now))
+	assert.True(t, tr.observe(peer.ID("b"), ma.StringCast("/ip4/5.6.2.2/tcp/4001"), local, observed, now))
+	assert.Empty(t, tr.confirmed(now))
+
+	assert.True(t, tr.observe(peer.ID("c"), ma.StringCast("/ip4/7.8.9.10/tcp/4001"), local, observed, now))
+	addrs := tr.confirmed(now)
+	require.Len(t, addrs, 1)
+	assert.True(t, addrs[0].Equal(observed))
+
+	// the observations expire
+	assert.Empty(t, tr.confirmed(now.Add(2*time.Minute)))
+	assert.Empty(t, tr.addrs)
+}
+
+func TestTrackerFilter(t *testing.T) {
+	observer := ma.StringCast("/ip4/5.6.7.8/tcp/4001")
+	local := ma.StringCast("/ip4/192.168.1.2/tcp/4001")
+	now := time.Now()
+
+	tr := newTracker(1, time.Minute)
+
+	// private addr
+	assert.False(t, tr.observe(peer.ID("a"), observer, local, ma.StringCast("/ip4/10.0.0.1/tcp/4001"), now))
+	// other transport
+	assert.False(t, tr.observe(peer.ID("a"), observer, local, ma.StringCast("/ip4/1.2.3.4/udp/4001/quic"), now))
+	// relayed addr
+	assert.False(t, tr.observe(peer.ID("a"), observer, local, ma.StringCast("/ip4/1.2.3.4/tcp/4001/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC/p2p-circuit"), now))
+
+	assert.Empty(t, tr.confirmed(now))
+}
+
+func TestDiffAddrs(t *testing.T) {
+	a := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001"), ma.StringCast("/ip4/1.2.3.4/udp/4001/quic")}
+	b := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/udp/4001/quic"), ma.StringCast("/ip4/5.6.7.8/tcp/4001")}
+
+	added, removed := diffAddrs(a, b)
+	require.Len(t, added, 1)
+	require.Len(t, removed, 1)
+	assert.True(t, added[0].Equal(b[1]))
+	assert.True(t, removed[0].Equal(a[0]))
+}
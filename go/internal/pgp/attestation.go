@@ -0,0 +1,166 @@
+package pgp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const (
+	// MaxKeySize is the maximum size of the certificate of an attestation,
+	// a 4096 bits RSA key with a few user IDs
+	MaxKeySize = 16 << 10
+
+	// MaxSignatureSize is the maximum size of the signature of an
+	// attestation
+	MaxSignatureSize = 2 << 10
+)
+
+var (
+	clearsignHeader = []byte("-----BEGIN PGP SIGNED MESSAGE-----")
+	clearsignFooter = []byte("-----BEGIN PGP SIGNATURE-----")
+)
+
+// Statement is the text the user signs with an OpenPGP key to attest that
+// it controls the account.
+func Statement(accountPK []byte) []byte {
+	return []byte(fmt.Sprintf("I control the berty account %s\n", base64.RawURLEncoding.EncodeToString(accountPK)))
+}
+
+// Attestation is the signature of the statement of an account by an OpenPGP
+// key, with its certificate.
+type Attestation struct {
+	Key       []byte `json:"key"`
+	Signature []byte `json:"signature"`
+}
+
+// Identity is the OpenPGP key of an attestation.
+type Identity struct {
+	Fingerprint string    `json:"fingerprint"`
+	Algorithm   string    `json:"algorithm"`
+	UserIDs     []string  `json:"user_ids,omitempty"`
+	SignedAt    time.Time `json:"signed_at"`
+
+	// Verified is false if the signature isn't the one of the statement of
+	// the account by the key
+	Verified bool `json:"verified"`
+}
+
+// NewAttestation returns the attestation of a certificate and a signature,
+// armored or not. The signature is either detached or the one of a
+// clearsigned statement.
+func NewAttestation(key, sig []byte) (*Attestation, error) {
+	rawKey, err := dearmor(key, publicKeyBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(sig); bytes.HasPrefix(trimmed, clearsignHeader) {
+		i := bytes.Index(trimmed, clearsignFooter)
+		if i < 0 {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no signature in the clearsigned message"))
+		}
+
+		sig = trimmed[i:]
+	}
+
+	rawSig, err := dearmor(sig, signatureBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Attestation{Key: rawKey, Signature: rawSig}
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+
+	if _, err := ReadPublicKey(a.Key); err != nil {
+		return nil, err
+	}
+
+	if _, err := a.signature(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *Attestation) validate() error {
+	if len(a.Key) == 0 || len(a.Key) > MaxKeySize || len(a.Signature) == 0 || len(a.Signature) > MaxSignatureSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid attestation size"))
+	}
+
+	return nil
+}
+
+func (a *Attestation) signature() (*signature, error) {
+	packets, err := readPackets(a.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(packets) != 1 || packets[0].tag != tagSignature {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("one signature expected"))
+	}
+
+	sig, err := parseSignature(packets[0].body)
+	if err != nil {
+		return nil, err
+	}
+
+	if sig.sigType != sigTypeBinary && sig.sigType != sigTypeText {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("signature of a document expected, got type 0x%02x", sig.sigType))
+	}
+
+	return sig, nil
+}
+
+// Verify checks that the key of the attestation signed the statement of the
+// account. The identity is returned once the key is read, unverified if it
+// didn't.
+func (a *Attestation) Verify(accountPK []byte, now time.Time) (*Identity, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+
+	k, err := ReadPublicKey(a.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &Identity{
+		Fingerprint: k.FingerprintString(),
+		Algorithm:   k.Algorithm,
+		UserIDs:     k.UserIDs,
+	}
+
+	sig, err := a.signature()
+	if err != nil {
+		return id, err
+	}
+
+	id.SignedAt = sig.created
+
+	if sig.expires > 0 && now.After(sig.created.Add(sig.expires)) {
+		return id, errcode.ErrInvalidInput.Wrap(fmt.Errorf("signature expired"))
+	}
+
+	statement := Statement(accountPK)
+	candidates := [][]byte{statement}
+	if sig.sigType == sigTypeText {
+		// a clearsigned text doesn't sign its last line ending
+		candidates = [][]byte{canonicalText(statement), canonicalText(bytes.TrimRight(statement, "\n"))}
+	}
+
+	for _, data := range candidates {
+		if err = sig.verify(k, data); err == nil {
+			id.Verified = true
+			return id, nil
+		}
+	}
+
+	return id, err
+}
@@ -0,0 +1,14 @@
+// Package pgp links a berty account to the OpenPGP keys of its user, with
+// the subset of RFC 4880 needed to do it.
+//
+// The account key is exported as an OpenPGP EdDSA key, certified by itself,
+// so it can be imported in a keyring and signed by the other keys of the
+// user. The other way, the user signs a statement naming the account with
+// an existing key, e.g. with `gpg --armor --detach-sign` or `gpg
+// --clearsign`: the signature and the public key form an attestation the
+// account publishes, its contacts verify it with the account they got it
+// from.
+//
+// Only the v4 keys and signatures of the RSA and EdDSA algorithms are
+// supported, the attestations are checked against the primary key.
+package pgp
@@ -0,0 +1,253 @@
+package pgp
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec // the v4 fingerprints are SHA-1 digests
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// The public key algorithms, see RFC 4880 section 9.1.
+const (
+	algoRSA         = 1
+	algoRSASignOnly = 3
+	algoEdDSA       = 22
+)
+
+// ed25519OID is the curve of the EdDSA keys, 1.3.6.1.4.1.11591.15.1.
+var ed25519OID = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+
+// exportedKeyCreation is the creation time of the exported account keys, it
+// is part of their fingerprint which then only depends on the account key.
+var exportedKeyCreation = time.Unix(0, 0)
+
+// PublicKey is the primary key of an OpenPGP certificate.
+type PublicKey struct {
+	Algorithm   string
+	Fingerprint [sha1.Size]byte
+	Created     time.Time
+
+	// UserIDs are the user IDs certified by the key
+	UserIDs []string
+
+	body    []byte
+	rsa     *rsa.PublicKey
+	ed25519 ed25519.PublicKey
+}
+
+// FingerprintString returns the fingerprint in uppercase hexadecimal, as
+// shown by the OpenPGP tools.
+func (k *PublicKey) FingerprintString() string {
+	return strings.ToUpper(hex.EncodeToString(k.Fingerprint[:]))
+}
+
+// KeyID is the low 64 bits of the fingerprint.
+func (k *PublicKey) KeyID() uint64 {
+	return binary.BigEndian.Uint64(k.Fingerprint[sha1.Size-8:])
+}
+
+func parsePublicKey(body []byte) (*PublicKey, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("only the v4 keys are supported"))
+	}
+
+	k := &PublicKey{
+		Created: time.Unix(int64(binary.BigEndian.Uint32(body[1:5])), 0),
+		body:    body,
+	}
+
+	prefix := &bytes.Buffer{}
+	writeKeyPrefix(prefix, body)
+	k.Fingerprint = sha1.Sum(prefix.Bytes()) // nolint:gosec
+
+	material := body[6:]
+	switch body[5] {
+	case algoRSA, algoRSASignOnly:
+		n, rest, err := readMPI(material)
+		if err != nil {
+			return nil, err
+		}
+
+		e, _, err := readMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid RSA exponent"))
+		}
+
+		k.Algorithm = "rsa"
+		k.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+
+	case algoEdDSA:
+		if len(material) < 1 || len(material) < 1+int(material[0]) || !bytes.Equal(material[1:1+int(material[0])], ed25519OID) {
+			return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("only the Ed25519 curve is supported"))
+		}
+
+		point, _, err := readMPI(material[1+int(material[0]):])
+		if err != nil {
+			return nil, err
+		}
+
+		if len(point) != 1+ed25519.PublicKeySize || point[0] != 0x40 {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid Ed25519 point"))
+		}
+
+		k.Algorithm = "ed25519"
+		k.ed25519 = ed25519.PublicKey(point[1:])
+
+	default:
+		return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("unsupported public key algorithm %d", body[5]))
+	}
+
+	return k, nil
+}
+
+// ReadPublicKey reads the primary key of a certificate, armored or not, and
+// the user IDs it certified. The subkeys are ignored.
+func ReadPublicKey(data []byte) (*PublicKey, error) {
+	raw, err := dearmor(data, publicKeyBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	packets, err := readPackets(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(packets) == 0 || packets[0].tag != tagPublicKey {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no public key"))
+	}
+
+	k, err := parsePublicKey(packets[0].body)
+	if err != nil {
+		return nil, err
+	}
+
+	var userID []byte
+	for _, p := range packets[1:] {
+		switch p.tag {
+		case tagUserID:
+			userID = p.body
+
+		case tagSignature:
+			if userID == nil {
+				continue
+			}
+
+			sig, err := parseSignature(p.body)
+			if err != nil || !sig.isCertification() {
+				continue
+			}
+
+			if sig.verify(k, certificationData(k.body, userID)) == nil {
+				k.UserIDs = append(k.UserIDs, string(userID))
+				userID = nil
+			}
+
+		case tagPublicSubkey:
+			// the subkeys follow the user IDs
+			return k, nil
+
+		case tagTrust:
+
+		default:
+			userID = nil
+		}
+	}
+
+	return k, nil
+}
+
+func (k *PublicKey) verifyDigest(hash stdcrypto.Hash, digest []byte, mpis [][]byte) error {
+	switch {
+	case k.rsa != nil && len(mpis) == 1:
+		if err := rsa.VerifyPKCS1v15(k.rsa, hash, digest, leftPad(mpis[0], (k.rsa.N.BitLen()+7)/8)); err != nil {
+			return errcode.ErrCryptoSignatureVerification.Wrap(err)
+		}
+
+	case k.ed25519 != nil && len(mpis) == 2:
+		sig := append(leftPad(mpis[0], 32), leftPad(mpis[1], 32)...)
+		if !ed25519.Verify(k.ed25519, digest, sig) {
+			return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid EdDSA signature"))
+		}
+
+	default:
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("signature of another algorithm"))
+	}
+
+	return nil
+}
+
+func writeKeyPrefix(buf *bytes.Buffer, body []byte) {
+	buf.WriteByte(0x99)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(body)))
+	buf.Write(body)
+}
+
+// certificationData is what a certification of a user ID hashes before its
+// trailer.
+func certificationData(keyBody, userID []byte) []byte {
+	buf := &bytes.Buffer{}
+	writeKeyPrefix(buf, keyBody)
+	buf.WriteByte(0xb4)
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(userID)))
+	buf.Write(userID)
+
+	return buf.Bytes()
+}
+
+// ExportKey returns the account key as an armored OpenPGP certificate, with
+// the user ID certified by the key.
+func ExportKey(accountSK crypto.PrivKey, userID string, now time.Time) ([]byte, error) {
+	if accountSK.Type() != crypto.Ed25519 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("Ed25519 key expected"))
+	}
+
+	pk, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	body := &bytes.Buffer{}
+	body.WriteByte(4)
+	_ = binary.Write(body, binary.BigEndian, uint32(exportedKeyCreation.Unix()))
+	body.WriteByte(algoEdDSA)
+	body.WriteByte(byte(len(ed25519OID)))
+	body.Write(ed25519OID)
+	writeMPI(body, append([]byte{0x40}, pk...))
+
+	k, err := parsePublicKey(body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := newSignature(sigTypePositiveCertification, k, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sig.sign(accountSK, certificationData(k.body, []byte(userID))); err != nil {
+		return nil, err
+	}
+
+	raw := &bytes.Buffer{}
+	writePacket(raw, tagPublicKey, k.body)
+	writePacket(raw, tagUserID, []byte(userID))
+	writePacket(raw, tagSignature, sig.serialize())
+
+	return armorBlock(publicKeyBlock, raw.Bytes())
+}
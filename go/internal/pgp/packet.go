@@ -0,0 +1,243 @@
+package pgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// The tags of the packets, see RFC 4880 section 4.3.
+const (
+	tagSignature    = 2
+	tagPublicKey    = 6
+	tagTrust        = 12
+	tagUserID       = 13
+	tagPublicSubkey = 14
+)
+
+// The armor types of the blocks.
+const (
+	publicKeyBlock = "PGP PUBLIC KEY BLOCK"
+	signatureBlock = "PGP SIGNATURE"
+)
+
+type packet struct {
+	tag  byte
+	body []byte
+}
+
+// dearmor returns the binary content of an armored block of the given type,
+// the data is returned as is if not armored.
+func dearmor(data []byte, blockType string) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN ")) {
+		return data, nil
+	}
+
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if block.Type != blockType {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("%s expected, got %s", blockType, block.Type))
+	}
+
+	raw, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return raw, nil
+}
+
+func armorBlock(blockType string, raw []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	w, err := armor.Encode(buf, blockType, nil)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := w.Write(raw); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
+
+// readPackets splits binary data in packets, the partial lengths aren't
+// supported, they are only used by the compressed or encrypted data.
+func readPackets(data []byte) ([]packet, error) {
+	packets := []packet{}
+	r := bytes.NewReader(data)
+
+	for r.Len() > 0 {
+		p, err := readPacket(r)
+		if err != nil {
+			return nil, err
+		}
+
+		packets = append(packets, p)
+	}
+
+	return packets, nil
+}
+
+func readPacket(r *bytes.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if header&0x80 == 0 {
+		return packet{}, errcode.ErrDeserialization.Wrap(fmt.Errorf("invalid packet header 0x%02x", header))
+	}
+
+	var (
+		tag    byte
+		length int
+	)
+
+	if header&0x40 != 0 {
+		// new format
+		tag = header & 0x3f
+
+		first, err := r.ReadByte()
+		if err != nil {
+			return packet{}, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		switch {
+		case first < 192:
+			length = int(first)
+		case first < 224:
+			second, err := r.ReadByte()
+			if err != nil {
+				return packet{}, errcode.ErrDeserialization.Wrap(err)
+			}
+
+			length = (int(first)-192)<<8 + int(second) + 192
+		case first == 255:
+			var l uint32
+			if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+				return packet{}, errcode.ErrDeserialization.Wrap(err)
+			}
+
+			length = int(l)
+		default:
+			return packet{}, errcode.ErrDeserialization.Wrap(fmt.Errorf("partial packet lengths not supported"))
+		}
+	} else {
+		// old format
+		tag = (header & 0x3f) >> 2
+
+		size := map[byte]int{0: 1, 1: 2, 2: 4}[header&0x03]
+		if size == 0 {
+			return packet{}, errcode.ErrDeserialization.Wrap(fmt.Errorf("indeterminate packet lengths not supported"))
+		}
+
+		for i := 0; i < size; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return packet{}, errcode.ErrDeserialization.Wrap(err)
+			}
+
+			length = length<<8 | int(b)
+		}
+	}
+
+	if length < 0 || length > r.Len() {
+		return packet{}, errcode.ErrDeserialization.Wrap(fmt.Errorf("truncated packet"))
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return packet{tag: tag, body: body}, nil
+}
+
+// writePacket writes a packet in the new format.
+func writePacket(buf *bytes.Buffer, tag byte, body []byte) {
+	buf.WriteByte(0xc0 | tag)
+
+	switch l := len(body); {
+	case l < 192:
+		buf.WriteByte(byte(l))
+	case l < 8384:
+		l -= 192
+		buf.WriteByte(byte(l>>8) + 192)
+		buf.WriteByte(byte(l))
+	default:
+		buf.WriteByte(255)
+		_ = binary.Write(buf, binary.BigEndian, uint32(l))
+	}
+
+	buf.Write(body)
+}
+
+// readMPI returns the value of the multiprecision integer at the start of
+// data and the data following it.
+func readMPI(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("truncated MPI"))
+	}
+
+	bits := int(binary.BigEndian.Uint16(data))
+	size := (bits + 7) / 8
+	if len(data) < 2+size {
+		return nil, nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("truncated MPI"))
+	}
+
+	return data[2 : 2+size], data[2+size:], nil
+}
+
+func writeMPI(buf *bytes.Buffer, value []byte) {
+	value = bytes.TrimLeft(value, "\x00")
+
+	bits := 0
+	if len(value) > 0 {
+		bits = (len(value)-1)*8 + bitLen(value[0])
+	}
+
+	_ = binary.Write(buf, binary.BigEndian, uint16(bits))
+	buf.Write(value)
+}
+
+func bitLen(b byte) int {
+	n := 0
+	for ; b != 0; b >>= 1 {
+		n++
+	}
+
+	return n
+}
+
+// leftPad returns value padded with zeros to size bytes, the MPIs drop the
+// leading zeros of the signatures.
+func leftPad(value []byte, size int) []byte {
+	if len(value) >= size {
+		return value
+	}
+
+	return append(make([]byte, size-len(value)), value...)
+}
+
+// canonicalText converts the line endings of a text to CRLF, as signed by
+// the text signatures.
+func canonicalText(text []byte) []byte {
+	return []byte(strings.ReplaceAll(strings.ReplaceAll(string(text), "\r\n", "\n"), "\n", "\r\n"))
+}
@@ -0,0 +1,162 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the fixtures are made by GnuPG for the statement of testAccountPK, with
+// an Ed25519 key and a RSA 2048 one
+const (
+	testEd25519Key = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEas8/fBYJKwYBBAHaRw8BAQdANdaS5yawSOUPPvzkuHLzspyd4uh5hj72i4n1
+eFBh0le0GUFsaWNlIDxhbGljZUBleGFtcGxlLmNvbT6IkAQTFggAOBYhBHvJHJ92
+8my7Ti+Lo0USp8ESERc/BQJqzz98AhsDBQsJCAcCBhUKCQgLAgQWAgMBAh4BAheA
+AAoJEEUSp8ESERc/sn4BAKY1WzRzi1/jIet77GfaUawU1jRvNJ0bfqpfHOWcsOb6
+AQCgoNF52mBrzC0WGHVJOODE1p+BTnGB3nhmU9n91lejDw==
+=/lfT
+-----END PGP PUBLIC KEY BLOCK-----`
+
+	testEd25519Signature = `-----BEGIN PGP SIGNATURE-----
+
+iIgEABYIADAWIQR7yRyfdvJsu04vi6NFEqfBEhEXPwUCas8/fBIcYWxpY2VAZXhh
+bXBsZS5jb20ACgkQRRKnwRIRFz9NtwEA1gCwxtBecwLKjprGkN6HCc3AUk5b9nu+
+XPz7qgoaYiABALvRoipZVKajKOLtpROoIraZQmP0I4hkTm0Quu5gJLMG
+=Ntd5
+-----END PGP SIGNATURE-----`
+
+	testRSAKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mQENBGrPP3wBCAC9WGaDzZjOKK2PKJWdJjJUIjvEf7+qNYBvNfV+qe19r3tDwtkk
+lkcqtre9rytsyV/G5KdWYJmoeInUzSa+ikMFjCB3w5nmvY8amtNHLwX09LZ0u8WO
+xExAQsdOE49u/odwaO5Ep4BC3hG7QY0zALtKLfYceiYUK8G93kjBmU5tIRdeRzKf
+MYrBYAYUC0q3F10NkLt5Vvgwecn/lWj/8BNedP+ZIWb2ZYpwueEs7Z7wSCC38UAo
+ENAH9jV3S3EQawFdRIbhVM84Zz1yRjjWhcIy4hUhx54iQAtDP4whlLp77BQ7oMtz
+7VvpCLQTwiC/U20Oa9kVaGJ23KYYYaZQuwK5ABEBAAG0FUJvYiA8Ym9iQGV4YW1w
+bGUuY29tPokBTgQTAQoAOBYhBEUN58Ub73jjMQgrIQ9fJrwMp/HkBQJqzz98AhsD
+BQsJCAcCBhUKCQgLAgQWAgMBAh4BAheAAAoJEA9fJrwMp/Hk7YwH/AuqVy9CPg8Z
+sJSYizplv297Gef7jXcmi0tda/7SeaiigSNpU1DoJQLEHnUlP5f9QZEdU5Qr1BDb
+f+IjsTjvVyiwYrYqpnfOcH6YvfyV5xv0LWT+Bf/jDrZIVyVZhd9/LVujLtII5feV
+3EfDaCLvL5LOhNoTI2nGcmB8nUwuEdvbr1oJ10sozG6Nk4rCOpXnfKCjWxyBSgWu
+PFdd/CfEoqjW48yr98zkJNfFAppYXi9gleR5uNtBriS3ALyNfsJ6KcdizelWZTJD
+UNPTh5sKzq0JusUFZv6xckY0h1iG7yw59Vxc1rVrNKwlMIHtmuacMjxPl8C0Y5V8
+pKDBbMsJKo8=
+=9w/l
+-----END PGP PUBLIC KEY BLOCK-----`
+
+	testRSAClearsigned = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+I control the berty account O2onvM62pC1io6jQKm8Nc2UyFXcd4kOmOsBIoYtZ2ik
+-----BEGIN PGP SIGNATURE-----
+
+iQFEBAEBCgAuFiEERQ3nxRvveOMxCCshD18mvAyn8eQFAmrPP3wQHGJvYkBleGFt
+cGxlLmNvbQAKCRAPXya8DKfx5Ja5CACwhYA3n8xqyOJPrtim/Kk6EXnZyHwxpZZ/
+pNL5x0J7Vl8fRgMlZSGWq1S5n8hZhAGMJDvwXz6FCQeKLQmZFQOmxXi8Bzjcq3ao
+p+CyYt+jDEdK4dsiNWgI74D41ihjfM4myo5e5nblY73S6zDwDQijl5FM+kFJQwNO
+TiB98I5MuQhfq5vu5w9ugaM34lzAdgEzJgDuxdYK7pQGcoVjrUJ/uvBUBvg44vin
+uDI/ru/+vDj0ZGeyIy8xlJu98BqOJ+HcXms5IsUyjAsGZnEYxhJiKDHaVDCW/Uwo
+728KsFYAh+hF4urdglJmhC0n3AhhCGx20C81kqWiz407x2UCk4YE
+=tGfo
+-----END PGP SIGNATURE-----`
+)
+
+var testAccountPK = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+
+func TestAttestation(t *testing.T) {
+	now := time.Now()
+
+	for _, tc := range []struct {
+		key, sig    string
+		fingerprint string
+		algorithm   string
+		userID      string
+	}{
+		{testEd25519Key, testEd25519Signature, "7BC91C9F76F26CBB4E2F8BA34512A7C11211173F", "ed25519", "Alice <alice@example.com>"},
+		{testRSAKey, testRSAClearsigned, "450DE7C51BEF78E331082B210F5F26BC0CA7F1E4", "rsa", "Bob <bob@example.com>"},
+	} {
+		a, err := NewAttestation([]byte(tc.key), []byte(tc.sig))
+		require.NoError(t, err)
+
+		id, err := a.Verify(testAccountPK, now)
+		require.NoError(t, err)
+		assert.True(t, id.Verified)
+		assert.Equal(t, tc.fingerprint, id.Fingerprint)
+		assert.Equal(t, tc.algorithm, id.Algorithm)
+		assert.Equal(t, []string{tc.userID}, id.UserIDs)
+		assert.False(t, id.SignedAt.IsZero())
+
+		// the statement names another account
+		other := make([]byte, ed25519.PublicKeySize)
+		id, err = a.Verify(other, now)
+		assert.Error(t, err)
+		require.NotNil(t, id)
+		assert.False(t, id.Verified)
+
+		tampered := &Attestation{Key: a.Key, Signature: append([]byte{}, a.Signature...)}
+		tampered.Signature[len(tampered.Signature)-1] ^= 1
+		_, err = tampered.Verify(testAccountPK, now)
+		assert.Error(t, err)
+	}
+
+	// the signature of another key
+	a, err := NewAttestation([]byte(testEd25519Key), []byte(testRSAClearsigned))
+	require.NoError(t, err)
+	id, err := a.Verify(testAccountPK, now)
+	assert.Error(t, err)
+	assert.False(t, id.Verified)
+
+	_, err = NewAttestation([]byte(testRSAClearsigned), []byte(testEd25519Signature))
+	assert.Error(t, err)
+}
+
+func TestExportKey(t *testing.T) {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	armored, err := ExportKey(sk, "berty account", time.Now())
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(armored), "-----BEGIN PGP PUBLIC KEY BLOCK-----"))
+
+	k, err := ReadPublicKey(armored)
+	require.NoError(t, err)
+	assert.Equal(t, "ed25519", k.Algorithm)
+	assert.Equal(t, []string{"berty account"}, k.UserIDs)
+
+	pk, err := sk.GetPublic().Raw()
+	require.NoError(t, err)
+	assert.Equal(t, ed25519.PublicKey(pk), k.ed25519)
+
+	// the fingerprint only depends on the account key
+	again, err := ExportKey(sk, "berty account", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	k2, err := ReadPublicKey(again)
+	require.NoError(t, err)
+	assert.Equal(t, k.Fingerprint, k2.Fingerprint)
+
+	// the user IDs not certified by the key are ignored
+	raw, err := dearmor(armored, publicKeyBlock)
+	require.NoError(t, err)
+	packets, err := readPackets(raw)
+	require.NoError(t, err)
+	require.Len(t, packets, 3)
+
+	forged := &bytes.Buffer{}
+	writePacket(forged, tagPublicKey, packets[0].body)
+	writePacket(forged, tagUserID, []byte("mallory"))
+	writePacket(forged, tagSignature, packets[2].body)
+
+	k, err = ReadPublicKey(forged.Bytes())
+	require.NoError(t, err)
+	assert.Empty(t, k.UserIDs)
+}
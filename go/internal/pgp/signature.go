@@ -0,0 +1,272 @@
+package pgp
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	_ "crypto/sha256" // registers the hashes of the signatures
+	_ "crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// The signature types, see RFC 4880 section 5.2.1.
+const (
+	sigTypeBinary                = 0x00
+	sigTypeText                  = 0x01
+	sigTypeGenericCertification  = 0x10
+	sigTypePositiveCertification = 0x13
+)
+
+// The signature subpackets, see RFC 4880 section 5.2.3.1.
+const (
+	subpacketCreationTime      = 2
+	subpacketExpirationTime    = 3
+	subpacketIssuer            = 16
+	subpacketKeyFlags          = 27
+	subpacketIssuerFingerprint = 33
+)
+
+// the SHA-1 and MD5 signatures are refused
+var hashAlgorithms = map[byte]stdcrypto.Hash{
+	8:  stdcrypto.SHA256,
+	9:  stdcrypto.SHA384,
+	10: stdcrypto.SHA512,
+	11: stdcrypto.SHA224,
+}
+
+type signature struct {
+	sigType    byte
+	pubKeyAlgo byte
+	hashAlgo   byte
+
+	// hashed is the part of the packet covered by the signature, from its
+	// version to its hashed subpackets
+	hashed   []byte
+	unhashed []byte
+	hashTag  [2]byte
+	mpis     [][]byte
+
+	created           time.Time
+	expires           time.Duration
+	issuerKeyID       uint64
+	issuerFingerprint []byte
+}
+
+func parseSignature(body []byte) (*signature, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("only the v4 signatures are supported"))
+	}
+
+	sig := &signature{sigType: body[1], pubKeyAlgo: body[2], hashAlgo: body[3]}
+
+	hashedLen := int(binary.BigEndian.Uint16(body[4:6]))
+	if len(body) < 6+hashedLen+2 {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("truncated signature"))
+	}
+
+	sig.hashed = body[:6+hashedLen]
+	rest := body[6+hashedLen:]
+
+	unhashedLen := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+unhashedLen+2 {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("truncated signature"))
+	}
+
+	sig.unhashed = rest[2 : 2+unhashedLen]
+	copy(sig.hashTag[:], rest[2+unhashedLen:])
+	rest = rest[2+unhashedLen+2:]
+
+	if err := sig.parseSubpackets(sig.hashed[6:], true); err != nil {
+		return nil, err
+	}
+
+	if err := sig.parseSubpackets(sig.unhashed, false); err != nil {
+		return nil, err
+	}
+
+	for len(rest) > 0 {
+		mpi, next, err := readMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		sig.mpis = append(sig.mpis, mpi)
+		rest = next
+	}
+
+	return sig, nil
+}
+
+// parseSubpackets reads the subpackets of the signature, only the issuer
+// is trusted from the unhashed ones, it is checked against the key anyway.
+func (sig *signature) parseSubpackets(data []byte, hashed bool) error {
+	for len(data) > 0 {
+		var length int
+		switch first := int(data[0]); {
+		case first < 192:
+			length, data = first, data[1:]
+		case first < 255 && len(data) >= 2:
+			length, data = (first-192)<<8+int(data[1])+192, data[2:]
+		case first == 255 && len(data) >= 5:
+			length, data = int(binary.BigEndian.Uint32(data[1:5])), data[5:]
+		default:
+			return errcode.ErrDeserialization.Wrap(fmt.Errorf("truncated subpacket"))
+		}
+
+		if length < 1 || length > len(data) {
+			return errcode.ErrDeserialization.Wrap(fmt.Errorf("truncated subpacket"))
+		}
+
+		typ, content := data[0]&0x7f, data[1:length]
+		data = data[length:]
+
+		switch {
+		case typ == subpacketIssuer && len(content) == 8:
+			sig.issuerKeyID = binary.BigEndian.Uint64(content)
+		case typ == subpacketIssuerFingerprint && len(content) > 1 && content[0] == 4:
+			sig.issuerFingerprint = content[1:]
+		case !hashed:
+		case typ == subpacketCreationTime && len(content) == 4:
+			sig.created = time.Unix(int64(binary.BigEndian.Uint32(content)), 0)
+		case typ == subpacketExpirationTime && len(content) == 4:
+			sig.expires = time.Duration(binary.BigEndian.Uint32(content)) * time.Second
+		}
+	}
+
+	return nil
+}
+
+func (sig *signature) isCertification() bool {
+	return sig.sigType >= sigTypeGenericCertification && sig.sigType <= sigTypePositiveCertification
+}
+
+// digest hashes the signed data followed by the trailer of the signature.
+func (sig *signature) digest(data []byte) (stdcrypto.Hash, []byte, error) {
+	hash, ok := hashAlgorithms[sig.hashAlgo]
+	if !ok {
+		return 0, nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("unsupported hash algorithm %d", sig.hashAlgo))
+	}
+
+	h := hash.New()
+	_, _ = h.Write(data)
+	_, _ = h.Write(sig.hashed)
+	_, _ = h.Write([]byte{4, 0xff})
+	_ = binary.Write(h, binary.BigEndian, uint32(len(sig.hashed)))
+
+	return hash, h.Sum(nil), nil
+}
+
+// verify checks that the key made the signature of the data.
+func (sig *signature) verify(k *PublicKey, data []byte) error {
+	switch {
+	case sig.issuerFingerprint != nil && !bytes.Equal(sig.issuerFingerprint, k.Fingerprint[:]):
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("signature made by another key"))
+	case sig.issuerKeyID != 0 && sig.issuerKeyID != k.KeyID():
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("signature made by the key %016X", sig.issuerKeyID))
+	case sig.created.IsZero():
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("signature without creation time"))
+	}
+
+	hash, digest, err := sig.digest(data)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(digest[:2], sig.hashTag[:]) {
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("signature of other data"))
+	}
+
+	return k.verifyDigest(hash, digest, sig.mpis)
+}
+
+// newSignature returns an EdDSA signature of the key to be signed, with
+// its creation time and issuer.
+func newSignature(sigType byte, k *PublicKey, now time.Time) (*signature, error) {
+	if k.ed25519 == nil {
+		return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("only the EdDSA signatures can be made"))
+	}
+
+	subpackets := &bytes.Buffer{}
+	writeSubpacket(subpackets, subpacketCreationTime, func(buf *bytes.Buffer) {
+		_ = binary.Write(buf, binary.BigEndian, uint32(now.Unix()))
+	})
+	writeSubpacket(subpackets, subpacketIssuerFingerprint, func(buf *bytes.Buffer) {
+		buf.WriteByte(4)
+		buf.Write(k.Fingerprint[:])
+	})
+
+	if sigType == sigTypePositiveCertification {
+		// certify and sign
+		writeSubpacket(subpackets, subpacketKeyFlags, func(buf *bytes.Buffer) { buf.WriteByte(0x03) })
+	}
+
+	hashed := &bytes.Buffer{}
+	hashed.Write([]byte{4, sigType, algoEdDSA, 8})
+	_ = binary.Write(hashed, binary.BigEndian, uint16(subpackets.Len()))
+	hashed.Write(subpackets.Bytes())
+
+	unhashed := &bytes.Buffer{}
+	writeSubpacket(unhashed, subpacketIssuer, func(buf *bytes.Buffer) {
+		_ = binary.Write(buf, binary.BigEndian, k.KeyID())
+	})
+
+	return &signature{
+		sigType:     sigType,
+		pubKeyAlgo:  algoEdDSA,
+		hashAlgo:    8,
+		hashed:      hashed.Bytes(),
+		unhashed:    unhashed.Bytes(),
+		created:     time.Unix(now.Unix(), 0),
+		issuerKeyID: k.KeyID(),
+	}, nil
+}
+
+func (sig *signature) sign(sk crypto.PrivKey, data []byte) error {
+	_, digest, err := sig.digest(data)
+	if err != nil {
+		return err
+	}
+
+	// the EdDSA signatures of OpenPGP sign the digest
+	raw, err := sk.Sign(digest)
+	if err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	if len(raw) != 64 {
+		return errcode.ErrCryptoSignature.Wrap(fmt.Errorf("invalid Ed25519 signature"))
+	}
+
+	copy(sig.hashTag[:], digest[:2])
+	sig.mpis = [][]byte{raw[:32], raw[32:]}
+
+	return nil
+}
+
+func (sig *signature) serialize() []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(sig.hashed)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(sig.unhashed)))
+	buf.Write(sig.unhashed)
+	buf.Write(sig.hashTag[:])
+
+	for _, mpi := range sig.mpis {
+		writeMPI(buf, mpi)
+	}
+
+	return buf.Bytes()
+}
+
+func writeSubpacket(buf *bytes.Buffer, typ byte, content func(*bytes.Buffer)) {
+	data := &bytes.Buffer{}
+	content(data)
+
+	// the subpackets written are shorter than 191 bytes
+	buf.WriteByte(byte(data.Len() + 1))
+	buf.WriteByte(typ)
+	buf.Write(data.Bytes())
+}
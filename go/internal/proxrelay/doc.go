@@ -0,0 +1,4 @@
+// Package proxrelay lets a device forward streams between two peers it is
+// connected to through proximity transports, expanding the proximity range
+// to two hops.
+package proxrelay
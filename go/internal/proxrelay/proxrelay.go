@@ -0,0 +1,256 @@
+package proxrelay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	mcma "berty.tech/berty/v2/go/internal/multipeer-connectivity-transport/multiaddr"
+	wifi "berty.tech/berty/v2/go/internal/wifi-transport"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+const ProtocolID = protocol.ID("/berty/proxrelay/1.0.0")
+
+const (
+	msgHop  byte = 1 // source -> relay, asks to forward to the target
+	msgStop byte = 2 // relay -> target, announces the source
+
+	statusOK      byte = 0
+	statusRefused byte = 1
+)
+
+// Handler is called on the target device for each relayed stream. The relay
+// only forwards bytes, the payloads (e.g. envelopes) must already be
+// encrypted end-to-end.
+type Handler func(src peer.ID, relay peer.ID, s io.ReadWriteCloser)
+
+// Relay forwards streams between peers connected through proximity
+// transports and accepts the streams forwarded to the local peer.
+type Relay struct {
+	host   host.Host
+	logger *zap.Logger
+
+	muHandler sync.RWMutex
+	handler   Handler
+}
+
+// New registers the relay protocol on the host.
+func New(logger *zap.Logger, h host.Host) *Relay {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	r := &Relay{
+		host:   h,
+		logger: logger.Named("proxrelay"),
+	}
+
+	h.SetStreamHandler(ProtocolID, r.handleStream)
+
+	return r
+}
+
+// SetHandler sets the handler of the streams relayed to the local peer.
+func (r *Relay) SetHandler(handler Handler) {
+	r.muHandler.Lock()
+	r.handler = handler
+	r.muHandler.Unlock()
+}
+
+// Dial opens a stream to the target, forwarded by the relay. Both the local
+// peer and the target must be connected to the relay through a proximity
+// transport.
+func (r *Relay) Dial(ctx context.Context, relay peer.ID, target peer.ID) (io.ReadWriteCloser, error) {
+	s, err := r.host.NewStream(ctx, relay, ProtocolID)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if !isProximityConn(s.Conn()) {
+		_ = s.Reset()
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("relay not connected through a proximity transport"))
+	}
+
+	if err := writeHeader(s, msgHop, target); err != nil {
+		_ = s.Reset()
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := readStatus(s); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (r *Relay) handleStream(s network.Stream) {
+	// The relay only forwards between proximity peers, so it can't be used
+	// to reach the device from the internet.
+	if !isProximityConn(s.Conn()) {
+		_ = s.Reset()
+		return
+	}
+
+	msgType, pid, err := readHeader(s)
+	if err != nil {
+		r.logger.Debug("invalid header", zap.Error(err))
+		_ = s.Reset()
+		return
+	}
+
+	switch msgType {
+	case msgHop:
+		r.handleHop(s, pid)
+	case msgStop:
+		r.handleStop(s, pid)
+	default:
+		_ = s.Reset()
+	}
+}
+
+func (r *Relay) handleHop(src network.Stream, target peer.ID) {
+	srcPID := src.Conn().RemotePeer()
+
+	if target == r.host.ID() || target == srcPID || !r.connectedThroughProximity(target) {
+		_, _ = src.Write([]byte{statusRefused})
+		_ = src.Close()
+		return
+	}
+
+	dst, err := r.host.NewStream(network.WithNoDial(context.Background(), "proxrelay"), target, ProtocolID)
+	if err != nil {
+		r.logger.Debug("unable to open stream to target", zap.Error(err))
+		_, _ = src.Write([]byte{statusRefused})
+		_ = src.Close()
+		return
+	}
+
+	if err := writeHeader(dst, msgStop, srcPID); err != nil {
+		_ = dst.Reset()
+		_, _ = src.Write([]byte{statusRefused})
+		_ = src.Close()
+		return
+	}
+
+	if err := readStatus(dst); err != nil {
+		_ = dst.Reset()
+		_, _ = src.Write([]byte{statusRefused})
+		_ = src.Close()
+		return
+	}
+
+	if _, err := src.Write([]byte{statusOK}); err != nil {
+		_ = dst.Reset()
+		_ = src.Reset()
+		return
+	}
+
+	r.logger.Debug("relaying", zap.String("src", srcPID.Pretty()), zap.String("dst", target.Pretty()))
+
+	go pipe(src, dst)
+	go pipe(dst, src)
+}
+
+func (r *Relay) handleStop(s network.Stream, src peer.ID) {
+	r.muHandler.RLock()
+	handler := r.handler
+	r.muHandler.RUnlock()
+
+	if handler == nil {
+		_, _ = s.Write([]byte{statusRefused})
+		_ = s.Close()
+		return
+	}
+
+	if _, err := s.Write([]byte{statusOK}); err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	handler(src, s.Conn().RemotePeer(), s)
+}
+
+func (r *Relay) connectedThroughProximity(pid peer.ID) bool {
+	for _, c := range r.host.Network().ConnsToPeer(pid) {
+		if isProximityConn(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isProximityConn(c network.Conn) bool {
+	for _, p := range c.RemoteMultiaddr().Protocols() {
+		switch p.Code {
+		case ma.P_CIRCUIT:
+			return false
+		case mcma.P_MC, wifi.P_WIFI:
+			return true
+		}
+	}
+
+	return false
+}
+
+func pipe(dst, src network.Stream) {
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Reset()
+		_ = src.Reset()
+		return
+	}
+
+	_ = dst.Close()
+}
+
+// header: 1 byte type, 1 byte length, peerID bytes
+func writeHeader(w io.Writer, msgType byte, pid peer.ID) error {
+	b := []byte(pid)
+	if len(b) > 255 {
+		return fmt.Errorf("peer ID too long")
+	}
+
+	_, err := w.Write(append([]byte{msgType, byte(len(b))}, b...))
+	return err
+}
+
+func readHeader(rd io.Reader) (byte, peer.ID, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(rd, head); err != nil {
+		return 0, "", err
+	}
+
+	b := make([]byte, head[1])
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return 0, "", err
+	}
+
+	pid, err := peer.IDFromBytes(b)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return head[0], pid, nil
+}
+
+func readStatus(rd io.Reader) error {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(rd, status); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if status[0] != statusOK {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("refused by relay"))
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package pushrelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const (
+	DefaultAPNsEndpoint = "https://api.push.apple.com"
+	DefaultFCMEndpoint  = "https://fcm.googleapis.com/fcm/send"
+
+	// DefaultAlert is shown until the notification service extension of the
+	// app replaces it with the fetched message
+	DefaultAlert = "New message"
+
+	// apnsTokenLifetime is the lifetime of the provider tokens, APNs refuses
+	// them after an hour
+	apnsTokenLifetime = 50 * time.Minute
+
+	maxResponseSize = 64 << 10
+)
+
+// ParseAPNsKey parses the .p8 signing key of an APNs provider.
+func ParseAPNsKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("no PEM block"))
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("not an ECDSA key"))
+	}
+
+	return ecKey, nil
+}
+
+// APNsOpts configures an APNs dispatcher, authenticated with a provider
+// token.
+type APNsOpts struct {
+	TeamID string
+	KeyID  string
+	Key    *ecdsa.PrivateKey
+
+	Endpoint string
+	Alert    string
+	Client   *http.Client
+}
+
+func (opts *APNsOpts) applyDefaults() {
+	if opts.Endpoint == "" {
+		opts.Endpoint = DefaultAPNsEndpoint
+	}
+
+	if opts.Alert == "" {
+		opts.Alert = DefaultAlert
+	}
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+}
+
+type apnsDispatcher struct {
+	opts APNsOpts
+
+	muToken  sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// NewAPNsDispatcher returns a dispatcher of the APNs notifications, they are
+// mutable so the notification service extension of the app is woken.
+func NewAPNsDispatcher(opts APNsOpts) Dispatcher {
+	opts.applyDefaults()
+
+	return &apnsDispatcher{opts: opts}
+}
+
+// providerToken returns the JWT authenticating the provider, it is renewed
+// before APNs refuses it.
+func (d *apnsDispatcher) providerToken(now time.Time) (string, error) {
+	d.muToken.Lock()
+	defer d.muToken.Unlock()
+
+	if d.token != "" && now.Sub(d.issuedAt) < apnsTokenLifetime {
+		return d.token, nil
+	}
+
+	token, err := signJWT(d.opts.Key, map[string]interface{}{"alg": "ES256", "kid": d.opts.KeyID}, map[string]interface{}{"iss": d.opts.TeamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	d.token = token
+	d.issuedAt = now
+
+	return d.token, nil
+}
+
+// signJWT returns a JWT signed with ES256.
+func signJWT(key *ecdsa.PrivateKey, header, claims map[string]interface{}) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signed))
+
+	r, s, err := ecdsa.Sign(crand.Reader, key, digest[:])
+	if err != nil {
+		return "", errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	// ES256 signatures are the concatenation of r and s
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (d *apnsDispatcher) Dispatch(ctx context.Context, token *Token, payload []byte) error {
+	providerToken, err := d.providerToken(time.Now())
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert":           d.opts.Alert,
+			"mutable-content": 1,
+		},
+		"berty": payload,
+	})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.opts.Endpoint+"/3/device/"+url.PathEscape(token.Token), bytes.NewReader(body))
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-topic", token.BundleID)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	res, err := d.opts.Client.Do(req)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer drain(res)
+
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	reply := struct {
+		Reason string `json:"reason"`
+	}{}
+	_ = json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(&reply)
+
+	// the token isn't valid for the topic anymore
+	if res.StatusCode == http.StatusGone || reply.Reason == "BadDeviceToken" || reply.Reason == "Unregistered" {
+		return ErrUnregistered
+	}
+
+	return errcode.ErrInternal.Wrap(fmt.Errorf("apns: %s %s", res.Status, reply.Reason))
+}
+
+// FCMOpts configures a FCM dispatcher, authenticated with the server key of
+// the app.
+type FCMOpts struct {
+	ServerKey string
+
+	Endpoint string
+	Client   *http.Client
+}
+
+func (opts *FCMOpts) applyDefaults() {
+	if opts.Endpoint == "" {
+		opts.Endpoint = DefaultFCMEndpoint
+	}
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+}
+
+type fcmDispatcher struct {
+	opts FCMOpts
+}
+
+// NewFCMDispatcher returns a dispatcher of the FCM data messages, they are
+// sent with a high priority so the app is woken.
+func NewFCMDispatcher(opts FCMOpts) Dispatcher {
+	opts.applyDefaults()
+
+	return &fcmDispatcher{opts: opts}
+}
+
+func (d *fcmDispatcher) Dispatch(ctx context.Context, token *Token, payload []byte) error {
+	message := map[string]interface{}{
+		"to":       token.Token,
+		"priority": "high",
+		"data":     map[string]string{"berty": base64.StdEncoding.EncodeToString(payload)},
+	}
+
+	if token.BundleID != "" {
+		message["restricted_package_name"] = token.BundleID
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "key="+d.opts.ServerKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := d.opts.Client.Do(req)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer drain(res)
+
+	if res.StatusCode != http.StatusOK {
+		return errcode.ErrInternal.Wrap(fmt.Errorf("fcm: %s", res.Status))
+	}
+
+	reply := struct {
+		Failure int `json:"failure"`
+		Results []struct {
+			Error string `json:"error"`
+		} `json:"results"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(&reply); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if reply.Failure == 0 {
+		return nil
+	}
+
+	for _, result := range reply.Results {
+		switch result.Error {
+		case "":
+		case "NotRegistered", "InvalidRegistration", "MismatchSenderId":
+			return ErrUnregistered
+		default:
+			return errcode.ErrInternal.Wrap(fmt.Errorf("fcm: %s", result.Error))
+		}
+	}
+
+	return errcode.ErrInternal.Wrap(fmt.Errorf("fcm: push failed"))
+}
+
+func drain(res *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxResponseSize))
+	_ = res.Body.Close()
+}
@@ -0,0 +1,16 @@
+// Package pushrelay wakes the devices killed in background through the push
+// services of their platform, APNs on iOS, FCM on Android and Web Push in the
+// browsers.
+//
+// A device registers its push token with a relay, which returns it sealed
+// with a key only the relay knows. The device shares the sealed token with
+// its contacts, who ask the relay to push an opaque payload to it: the relay
+// learns neither the sender nor the content, the push service only sees the
+// payload encrypted by the sender. The woken device then connects and fetches
+// the actual message from its peers.
+//
+// The relay keeps no state besides its rate limits and can be self-hosted,
+// with `berty push-relay` or next to a rendezvous point, with the credentials
+// of the push services of the app. The Web Push payloads are encrypted for
+// the browser again, as defined by RFC 8291.
+package pushrelay
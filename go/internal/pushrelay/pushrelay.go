@@ -0,0 +1,408 @@
+package pushrelay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const ProtocolID = protocol.ID("/berty/push/1.0.0")
+
+// The platforms of the push tokens.
+const (
+	PlatformAPNs = "apns"
+	PlatformFCM  = "fcm"
+)
+
+const (
+	// MaxPayloadSize is the maximum size of a pushed payload, the push
+	// services cap a notification at 4 KiB
+	MaxPayloadSize = 2 << 10
+
+	// DefaultMinPushInterval is the minimum delay between two pushes to the
+	// same device, a woken device fetches all its pending messages at once
+	DefaultMinPushInterval = 10 * time.Second
+
+	// DefaultMaxPeerRequests is the number of requests a peer can send in a
+	// DefaultPeerRequestWindow
+	DefaultMaxPeerRequests   = 60
+	DefaultPeerRequestWindow = time.Minute
+
+	defaultStreamTimeout = 30 * time.Second
+	maxRequestSize       = 16 << 10
+	maxTokenSize         = 4 << 10
+)
+
+// ErrUnregistered is returned when the push service doesn't know a token
+// anymore, e.g. once the app was uninstalled.
+var ErrUnregistered = fmt.Errorf("push token unregistered")
+
+// Token is the push token of a device, as given by its platform.
+type Token struct {
+	Platform string `json:"platform"`
+
+	// BundleID is the app the token was issued for, the topic of the APNs
+	// notifications
+	BundleID string `json:"bundleId"`
+	Token    string `json:"token"`
+}
+
+type request struct {
+	// Register is set to register a token, the others request a push
+	Register *Token `json:"register,omitempty"`
+
+	SealedToken []byte `json:"sealedToken,omitempty"`
+	Payload     []byte `json:"payload,omitempty"`
+}
+
+type response struct {
+	SealedToken  []byte `json:"sealedToken,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Unregistered bool   `json:"unregistered,omitempty"`
+}
+
+// Register sends the push token of the device to a relay, it returns the
+// token sealed by the relay to be shared with the senders.
+func Register(ctx context.Context, h host.Host, relay peer.AddrInfo, token *Token) ([]byte, error) {
+	if token == nil || token.Token == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	res, err := roundTrip(ctx, h, relay, &request{Register: token})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.SealedToken) == 0 {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("no sealed token"))
+	}
+
+	return res.SealedToken, nil
+}
+
+// Push asks a relay to push a payload to the device of a sealed token, it
+// returns ErrUnregistered if the token isn't valid anymore.
+func Push(ctx context.Context, h host.Host, relay peer.AddrInfo, sealedToken, payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("payload too large: %d bytes", len(payload)))
+	}
+
+	_, err := roundTrip(ctx, h, relay, &request{SealedToken: sealedToken, Payload: payload})
+
+	return err
+}
+
+func roundTrip(ctx context.Context, h host.Host, relay peer.AddrInfo, req *request) (*response, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultStreamTimeout)
+	defer cancel()
+
+	if err := h.Connect(ctx, relay); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	stream, err := h.NewStream(ctx, relay.ID, ProtocolID)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(stream).Encode(req); err != nil {
+		_ = stream.Reset()
+		return nil, errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	res := &response{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxRequestSize)).Decode(res); err != nil {
+		_ = stream.Reset()
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	switch {
+	case res.Unregistered:
+		return nil, ErrUnregistered
+	case res.Error != "":
+		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("push relay: %s", res.Error))
+	}
+
+	return res, nil
+}
+
+// Dispatcher sends the notifications of a platform.
+type Dispatcher interface {
+	Dispatch(ctx context.Context, token *Token, payload []byte) error
+}
+
+// RelayOpts configures a push relay.
+type RelayOpts struct {
+	Logger *zap.Logger
+
+	// Dispatchers are the dispatchers by platform, the tokens of the other
+	// platforms are refused
+	Dispatchers map[string]Dispatcher
+
+	MinPushInterval time.Duration
+
+	// MaxPeerRequests caps the requests of a peer in a PeerRequestWindow, the
+	// others are refused
+	MaxPeerRequests   int
+	PeerRequestWindow time.Duration
+
+	// Metrics, if set, records the outcomes of the dispatches
+	Metrics *metrics.Registry
+}
+
+func (opts *RelayOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.MinPushInterval <= 0 {
+		opts.MinPushInterval = DefaultMinPushInterval
+	}
+
+	if opts.MaxPeerRequests <= 0 {
+		opts.MaxPeerRequests = DefaultMaxPeerRequests
+	}
+
+	if opts.PeerRequestWindow <= 0 {
+		opts.PeerRequestWindow = DefaultPeerRequestWindow
+	}
+}
+
+// Relay pushes the payloads of the senders to the devices of the sealed
+// tokens.
+type Relay struct {
+	logger *zap.Logger
+	opts   RelayOpts
+	key    *[cryptoutil.KeySize]byte
+
+	muPushes   sync.Mutex
+	lastPushes map[[sha256.Size]byte]time.Time
+
+	muPeers sync.Mutex
+	peers   map[peer.ID]*peerWindow
+}
+
+type peerWindow struct {
+	start    time.Time
+	requests int
+}
+
+// NewRelay registers the push protocol on the host. The tokens are sealed
+// with a key derived from the given private key, they stay valid as long as
+// the relay keeps it.
+func NewRelay(h host.Host, priv crypto.PrivKey, opts RelayOpts) (*Relay, error) {
+	opts.applyDefaults()
+
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	key := make([]byte, cryptoutil.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, raw, nil, []byte("berty push relay")), key); err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	r := &Relay{
+		logger:     opts.Logger.Named("pushrelay"),
+		opts:       opts,
+		lastPushes: make(map[[sha256.Size]byte]time.Time),
+		peers:      make(map[peer.ID]*peerWindow),
+	}
+
+	if r.key, err = cryptoutil.KeySliceToArray(key); err != nil {
+		return nil, err
+	}
+
+	if h != nil {
+		h.SetStreamHandler(ProtocolID, r.handleStream)
+	}
+
+	return r, nil
+}
+
+func (r *Relay) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	pid := stream.Conn().RemotePeer()
+	_ = stream.SetDeadline(time.Now().Add(defaultStreamTimeout))
+
+	req := &request{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxRequestSize)).Decode(req); err != nil {
+		r.logger.Debug("invalid request", zap.Stringer("peer", pid), zap.Error(err))
+		_ = stream.Reset()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStreamTimeout)
+	defer cancel()
+
+	res := &response{}
+	var err error
+	switch {
+	case !r.allowPeer(pid, time.Now()):
+		err = errcode.ErrInvalidInput.Wrap(fmt.Errorf("rate limited"))
+	case req.Register != nil:
+		res.SealedToken, err = r.register(req.Register)
+	default:
+		err = r.push(ctx, req.SealedToken, req.Payload)
+	}
+
+	switch {
+	case err == ErrUnregistered:
+		res.Unregistered = true
+	case err != nil:
+		r.logger.Debug("request refused", zap.Stringer("peer", pid), zap.Error(err))
+		res.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(stream).Encode(res); err != nil {
+		_ = stream.Reset()
+	}
+}
+
+func (r *Relay) register(token *Token) ([]byte, error) {
+	if _, ok := r.opts.Dispatchers[token.Platform]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported platform %q", token.Platform))
+	}
+
+	if token.Token == "" || len(token.Token)+len(token.BundleID) > maxTokenSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid token"))
+	}
+
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	return secretbox.Seal(nonce[:], plaintext, nonce, r.key), nil
+}
+
+func (r *Relay) openToken(sealed []byte) (*Token, error) {
+	if len(sealed) < cryptoutil.NonceSize+secretbox.Overhead {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("sealed token too short"))
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(sealed[:cryptoutil.NonceSize])
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	plaintext, ok := secretbox.Open(nil, sealed[cryptoutil.NonceSize:], nonce, r.key)
+	if !ok {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("token not sealed by this relay"))
+	}
+
+	token := &Token{}
+	if err := json.Unmarshal(plaintext, token); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return token, nil
+}
+
+func (r *Relay) push(ctx context.Context, sealedToken, payload []byte) error {
+	if len(payload) == 0 || len(payload) > MaxPayloadSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid payload size: %d bytes", len(payload)))
+	}
+
+	token, err := r.openToken(sealedToken)
+	if err != nil {
+		return err
+	}
+
+	dispatcher, ok := r.opts.Dispatchers[token.Platform]
+	if !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported platform %q", token.Platform))
+	}
+
+	// the pushes following a recent one are dropped, the device is already
+	// awake
+	if !r.allow(sha256.Sum256(sealedToken), time.Now()) {
+		r.opts.Metrics.RecordPushDispatch(token.Platform, metrics.ResultRateLimited)
+		return nil
+	}
+
+	err = dispatcher.Dispatch(ctx, token, payload)
+	switch {
+	case err == nil:
+		r.opts.Metrics.RecordPushDispatch(token.Platform, metrics.ResultSuccess)
+	case err == ErrUnregistered:
+		r.opts.Metrics.RecordPushDispatch(token.Platform, metrics.ResultUnregistered)
+	default:
+		r.opts.Metrics.RecordPushDispatch(token.Platform, metrics.ResultFailure)
+	}
+
+	return err
+}
+
+func (r *Relay) allow(id [sha256.Size]byte, now time.Time) bool {
+	r.muPushes.Lock()
+	defer r.muPushes.Unlock()
+
+	if last, ok := r.lastPushes[id]; ok && now.Sub(last) < r.opts.MinPushInterval {
+		return false
+	}
+
+	// the tokens are only kept to rate limit their pushes
+	for t, last := range r.lastPushes {
+		if now.Sub(last) >= r.opts.MinPushInterval {
+			delete(r.lastPushes, t)
+		}
+	}
+
+	r.lastPushes[id] = now
+
+	return true
+}
+
+func (r *Relay) allowPeer(pid peer.ID, now time.Time) bool {
+	r.muPeers.Lock()
+	defer r.muPeers.Unlock()
+
+	for p, w := range r.peers {
+		if now.Sub(w.start) >= r.opts.PeerRequestWindow {
+			delete(r.peers, p)
+		}
+	}
+
+	w, ok := r.peers[pid]
+	if !ok {
+		w = &peerWindow{start: now}
+		r.peers[pid] = w
+	}
+
+	if w.requests >= r.opts.MaxPeerRequests {
+		return false
+	}
+
+	w.requests++
+
+	return true
+}
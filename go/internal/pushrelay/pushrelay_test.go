@@ -0,0 +1,257 @@
+package pushrelay
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDispatcher struct {
+	tokens   []*Token
+	payloads [][]byte
+}
+
+func (d *testDispatcher) Dispatch(_ context.Context, token *Token, payload []byte) error {
+	d.tokens = append(d.tokens, token)
+	d.payloads = append(d.payloads, payload)
+
+	return nil
+}
+
+func newTestRelay(t *testing.T, dispatcher Dispatcher) *Relay {
+	t.Helper()
+
+	priv, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	r, err := NewRelay(nil, priv, RelayOpts{Dispatchers: map[string]Dispatcher{PlatformAPNs: dispatcher}, MinPushInterval: time.Hour})
+	require.NoError(t, err)
+
+	return r
+}
+
+func TestRelayPush(t *testing.T) {
+	ctx := context.Background()
+	dispatcher := &testDispatcher{}
+	r := newTestRelay(t, dispatcher)
+
+	token := &Token{Platform: PlatformAPNs, BundleID: "tech.berty.ios", Token: "device token"}
+	sealed, err := r.register(token)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), token.Token)
+
+	_, err = r.register(&Token{Platform: PlatformFCM, Token: "device token"})
+	assert.Error(t, err)
+
+	require.NoError(t, r.push(ctx, sealed, []byte("opaque")))
+	require.Len(t, dispatcher.tokens, 1)
+	assert.Equal(t, token, dispatcher.tokens[0])
+	assert.Equal(t, []byte("opaque"), dispatcher.payloads[0])
+
+	// the device is already awake
+	require.NoError(t, r.push(ctx, sealed, []byte("opaque")))
+	assert.Len(t, dispatcher.tokens, 1)
+
+	// the tokens of another relay can't be opened
+	other := newTestRelay(t, dispatcher)
+	assert.Error(t, other.push(ctx, sealed, []byte("opaque")))
+
+	assert.Error(t, r.push(ctx, sealed, make([]byte, MaxPayloadSize+1)))
+}
+
+func TestRelayPeerRateLimit(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	r, err := NewRelay(nil, priv, RelayOpts{MaxPeerRequests: 2, PeerRequestWindow: time.Minute})
+	require.NoError(t, err)
+
+	now := time.Now()
+	pid, other := peer.ID("peer"), peer.ID("other")
+
+	assert.True(t, r.allowPeer(pid, now))
+	assert.True(t, r.allowPeer(pid, now))
+	assert.False(t, r.allowPeer(pid, now))
+	assert.True(t, r.allowPeer(other, now))
+
+	// the count starts over with the next window
+	assert.True(t, r.allowPeer(pid, now.Add(time.Minute)))
+}
+
+func TestAPNsDispatcher(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+
+	var body map[string]json.RawMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.URL.Path, "/3/device/"))
+		assert.Equal(t, "tech.berty.ios", r.Header.Get("apns-topic"))
+
+		// the provider token is signed with the key of the provider
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "bearer "), ".")
+		require.Len(t, parts, 3)
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.True(t, ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])))
+
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		if r.URL.Path == "/3/device/gone" {
+			w.WriteHeader(http.StatusGone)
+			_, _ = w.Write([]byte(`{"reason":"Unregistered"}`))
+		}
+	}))
+	defer srv.Close()
+
+	d := NewAPNsDispatcher(APNsOpts{TeamID: "team", KeyID: "key", Key: key, Endpoint: srv.URL})
+	require.NoError(t, d.Dispatch(context.Background(), &Token{BundleID: "tech.berty.ios", Token: "device"}, []byte("opaque")))
+
+	var payload []byte
+	require.NoError(t, json.Unmarshal(body["berty"], &payload))
+	assert.Equal(t, []byte("opaque"), payload)
+
+	err = d.Dispatch(context.Background(), &Token{BundleID: "tech.berty.ios", Token: "gone"}, []byte("opaque"))
+	assert.Equal(t, ErrUnregistered, err)
+}
+
+func TestFCMDispatcher(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "key=server key", r.Header.Get("Authorization"))
+
+		message := struct {
+			To   string            `json:"to"`
+			Data map[string]string `json:"data"`
+		}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("opaque")), message.Data["berty"])
+
+		if message.To == "gone" {
+			_, _ = w.Write([]byte(`{"failure":1,"results":[{"error":"NotRegistered"}]}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"success":1,"results":[{"message_id":"1"}]}`))
+	}))
+	defer srv.Close()
+
+	d := NewFCMDispatcher(FCMOpts{ServerKey: "server key", Endpoint: srv.URL})
+	require.NoError(t, d.Dispatch(context.Background(), &Token{Token: "device"}, []byte("opaque")))
+
+	err := d.Dispatch(context.Background(), &Token{Token: "gone"}, []byte("opaque"))
+	assert.Equal(t, ErrUnregistered, err)
+}
+
+func TestWebPushDispatcher(t *testing.T) {
+	ctx := context.Background()
+
+	vapidKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+
+	// the keys of the subscription of the browser
+	curve := elliptic.P256()
+	uaPrivate, uaX, uaY, err := elliptic.GenerateKey(curve, crand.Reader)
+	require.NoError(t, err)
+	uaPublic := elliptic.Marshal(curve, uaX, uaY)
+	authSecret := make([]byte, 16)
+	_, err = crand.Read(authSecret)
+	require.NoError(t, err)
+
+	var received []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "aes128gcm", r.Header.Get("Content-Encoding"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "vapid t="))
+		assert.True(t, strings.HasSuffix(r.Header.Get("Authorization"), ", k="+VAPIDPublicKey(vapidKey)))
+
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = decryptWebPush(t, uaPrivate, uaPublic, authSecret, body)
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	sub := &WebPushSubscription{Endpoint: srv.URL + "/push"}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(uaPublic)
+	sub.Keys.Auth = base64.URLEncoding.EncodeToString(authSecret)
+	subJSON, err := json.Marshal(sub)
+	require.NoError(t, err)
+
+	d := NewWebPushDispatcher(WebPushOpts{Key: vapidKey, Subject: "mailto:ops@berty.tech", Client: srv.Client()})
+	require.NoError(t, d.Dispatch(ctx, &Token{Platform: PlatformWebPush, Token: string(subJSON)}, []byte("opaque")))
+	assert.Equal(t, []byte("opaque"), received)
+
+	sub.Endpoint = srv.URL + "/gone"
+	subJSON, err = json.Marshal(sub)
+	require.NoError(t, err)
+	assert.Equal(t, ErrUnregistered, d.Dispatch(ctx, &Token{Platform: PlatformWebPush, Token: string(subJSON)}, []byte("opaque")))
+
+	// the payloads are never sent in clear
+	sub.Endpoint = strings.Replace(srv.URL, "https://", "http://", 1) + "/push"
+	subJSON, err = json.Marshal(sub)
+	require.NoError(t, err)
+	assert.Error(t, d.Dispatch(ctx, &Token{Platform: PlatformWebPush, Token: string(subJSON)}, []byte("opaque")))
+}
+
+// decryptWebPush decrypts a single record message as a browser would.
+func decryptWebPush(t *testing.T, uaPrivate, uaPublic, authSecret, body []byte) []byte {
+	t.Helper()
+
+	require.True(t, len(body) > 21)
+	salt, keyLen := body[:16], int(body[20])
+	assert.Equal(t, uint32(webPushRecordSize), binary.BigEndian.Uint32(body[16:20]))
+	require.True(t, len(body) > 21+keyLen)
+	asPublic, record := body[21:21+keyLen], body[21+keyLen:]
+
+	curve := elliptic.P256()
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	require.NotNil(t, asX)
+	sharedX, _ := curve.ScalarMult(asX, asY, uaPrivate)
+	ecdhSecret := make([]byte, 32)
+	copy(ecdhSecret[32-len(sharedX.Bytes()):], sharedX.Bytes())
+
+	ikm, err := webPushKey(authSecret, ecdhSecret, append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...), 32)
+	require.NoError(t, err)
+	cek, err := webPushKey(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	require.NoError(t, err)
+	nonce, err := webPushKey(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	require.NoError(t, err)
+
+	block, err := aes.NewCipher(cek)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	plaintext, err := gcm.Open(nil, nonce, record, nil)
+	require.NoError(t, err)
+
+	// the last record ends with its delimiter
+	require.NotEmpty(t, plaintext)
+	assert.Equal(t, byte(2), plaintext[len(plaintext)-1])
+
+	return plaintext[:len(plaintext)-1]
+}
@@ -0,0 +1,250 @@
+package pushrelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"golang.org/x/crypto/hkdf"
+)
+
+// PlatformWebPush is the platform of the Web Push subscriptions, the token is
+// the JSON of the subscription of the browser.
+const PlatformWebPush = "webpush"
+
+const (
+	// DefaultWebPushTTL is how long the push services keep a notification
+	// for an offline browser
+	DefaultWebPushTTL = 24 * time.Hour
+
+	// vapidTokenLifetime is the lifetime of the VAPID tokens, the push
+	// services refuse the ones expiring after 24 hours
+	vapidTokenLifetime = 12 * time.Hour
+
+	webPushRecordSize = 4096
+)
+
+// WebPushSubscription is a push subscription of a browser, as returned by
+// PushSubscription.toJSON().
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// ParseVAPIDKey parses the PEM encoded P-256 key of an application server,
+// as PKCS #8 or SEC 1.
+func ParseVAPIDKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errcode.ErrDeserialization.Wrap(fmt.Errorf("no PEM block"))
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return ParseAPNsKey(data)
+}
+
+// VAPIDPublicKey returns the applicationServerKey the browsers subscribe
+// with.
+func VAPIDPublicKey(key *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+}
+
+// WebPushOpts configures a Web Push dispatcher, identified with VAPID.
+type WebPushOpts struct {
+	Key *ecdsa.PrivateKey
+
+	// Subject is the contact of the operator of the relay, a mailto: or an
+	// https: URL
+	Subject string
+
+	TTL    time.Duration
+	Client *http.Client
+}
+
+func (opts *WebPushOpts) applyDefaults() {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultWebPushTTL
+	}
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+}
+
+type webPushDispatcher struct {
+	opts WebPushOpts
+}
+
+// NewWebPushDispatcher returns a dispatcher of the Web Push notifications,
+// the payload is encrypted for the browser as defined by RFC 8291.
+func NewWebPushDispatcher(opts WebPushOpts) Dispatcher {
+	opts.applyDefaults()
+
+	return &webPushDispatcher{opts: opts}
+}
+
+func (d *webPushDispatcher) Dispatch(ctx context.Context, token *Token, payload []byte) error {
+	sub := &WebPushSubscription{}
+	if err := json.Unmarshal([]byte(token.Token), sub); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid push endpoint"))
+	}
+
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return err
+	}
+
+	vapid, err := signJWT(d.opts.Key, map[string]interface{}{"typ": "JWT", "alg": "ES256"}, map[string]interface{}{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": time.Now().Add(vapidTokenLifetime).Unix(),
+		"sub": d.opts.Subject,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "vapid t="+vapid+", k="+VAPIDPublicKey(d.opts.Key))
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(d.opts.TTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+
+	res, err := d.opts.Client.Do(req)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer drain(res)
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return nil
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return ErrUnregistered
+	default:
+		return errcode.ErrInternal.Wrap(fmt.Errorf("webpush: %s", res.Status))
+	}
+}
+
+func webPushKey(salt, ikm, info []byte, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, info), key); err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return key, nil
+}
+
+// encryptWebPush encrypts a payload for a subscription in a single aes128gcm
+// record.
+func encryptWebPush(sub *WebPushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := base64.RawURLEncoding.DecodeString(trimPadding(sub.Keys.P256dh))
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	authSecret, err := base64.RawURLEncoding.DecodeString(trimPadding(sub.Keys.Auth))
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid subscription key"))
+	}
+
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, crand.Reader)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	sharedX, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	copy(ecdhSecret[32-len(sharedX.Bytes()):], sharedX.Bytes())
+
+	keyInfo := bytes.Join([][]byte{[]byte("WebPush: info\x00"), uaPublic, asPublic}, nil)
+	ikm, err := webPushKey(authSecret, ecdhSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(crand.Reader, salt); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	cek, err := webPushKey(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := webPushKey(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
+	}
+
+	if len(payload)+1+gcm.Overhead() > webPushRecordSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("payload too large: %d bytes", len(payload)))
+	}
+
+	// the header of the content coding, salt, record size and key, then the
+	// single record with its delimiter
+	header := append(append([]byte{}, salt...), 0, 0, 0, 0, byte(len(asPublic)))
+	binary.BigEndian.PutUint32(header[16:20], webPushRecordSize)
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, append(append([]byte{}, payload...), 2), nil), nil
+}
+
+func trimPadding(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+
+	return s
+}
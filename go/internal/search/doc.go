@@ -0,0 +1,10 @@
+// Package search implements the local full-text index of the messages.
+//
+// The texts are split in terms, lowercased and without their diacritics, and
+// the index maps each term to the documents containing it, in a datastore.
+// A query matches the documents having all its terms, ranked with BM25 then
+// by date, and returns a snippet of each document around the first match.
+//
+// The documents are grouped by scope, i.e. by conversation, so a query can
+// be restricted to a scope.
+package search
@@ -0,0 +1,538 @@
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// DefaultLimit is the number of results of a query without limit
+	DefaultLimit = 20
+
+	// SnippetLength is the length of the snippets, in characters
+	SnippetLength = 80
+
+	// the BM25 parameters
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var (
+	docsKey  = datastore.NewKey("docs")
+	termsKey = datastore.NewKey("terms")
+	statsKey = datastore.NewKey("stats")
+)
+
+// Document is a text of the index.
+type Document struct {
+	Scope []byte
+	ID    []byte
+	Text  string
+
+	// At orders the results of the same score, it defaults to the date of
+	// the previous version of the document, or to now
+	At time.Time
+}
+
+// Query is a search of the index.
+type Query struct {
+	Text string
+
+	// Scope restricts the search to the documents of a scope, all of them
+	// if nil
+	Scope []byte
+
+	// Limit defaults to DefaultLimit
+	Limit int
+}
+
+// Range is a range of bytes of a snippet.
+type Range struct {
+	Start int
+	End   int
+}
+
+// Result is a document matching a query.
+type Result struct {
+	Scope []byte
+	ID    []byte
+	At    time.Time
+	Score float64
+
+	// Snippet is the part of the text around the first match, Highlights
+	// are the ranges of the terms of the query in it
+	Snippet    string
+	Highlights []Range
+}
+
+type docRecord struct {
+	Text   string         `json:"text"`
+	At     int64          `json:"at"`
+	Length int            `json:"length"`
+	Terms  map[string]int `json:"terms"`
+}
+
+type statsRecord struct {
+	Docs   int `json:"docs"`
+	Length int `json:"length"`
+}
+
+// Index is a full-text index persisted in a datastore.
+type Index struct {
+	store datastore.Batching
+	lock  sync.Mutex
+}
+
+// New returns the index persisted in store.
+func New(store datastore.Batching) *Index {
+	return &Index{store: store}
+}
+
+func encodeBytes(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func docKey(scope, id []byte) datastore.Key {
+	return docsKey.ChildString(encodeBytes(scope)).ChildString(encodeBytes(id))
+}
+
+func postingKey(term string, scope, id []byte) datastore.Key {
+	return termsKey.ChildString(term).ChildString(encodeBytes(scope)).ChildString(encodeBytes(id))
+}
+
+func (idx *Index) load(key datastore.Key, v interface{}) (bool, error) {
+	data, err := idx.store.Get(key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return true, nil
+}
+
+func putJSON(b datastore.Batch, key datastore.Key, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := b.Put(key, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// Put indexes a document, replacing its previous version. A document without
+// terms is removed from the index.
+func (idx *Index) Put(doc *Document) error {
+	terms := Terms(doc.Text)
+	if len(terms) == 0 {
+		return idx.Delete(doc.Scope, doc.ID)
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	stats := &statsRecord{}
+	if _, err := idx.load(statsKey, stats); err != nil {
+		return err
+	}
+
+	b, err := idx.store.Batch()
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	at := doc.At
+	prev := &docRecord{}
+	if ok, err := idx.load(docKey(doc.Scope, doc.ID), prev); err != nil {
+		return err
+	} else if ok {
+		if err := idx.remove(b, doc.Scope, doc.ID, prev, stats); err != nil {
+			return err
+		}
+
+		if at.IsZero() {
+			at = time.Unix(0, prev.At)
+		}
+	}
+
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	rec := &docRecord{Text: doc.Text, At: at.UnixNano(), Length: len(terms), Terms: map[string]int{}}
+	for _, term := range terms {
+		rec.Terms[term]++
+	}
+
+	for term, tf := range rec.Terms {
+		if err := b.Put(postingKey(term, doc.Scope, doc.ID), []byte(strconv.Itoa(tf))); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	stats.Docs++
+	stats.Length += rec.Length
+
+	if err := putJSON(b, docKey(doc.Scope, doc.ID), rec); err != nil {
+		return err
+	}
+
+	if err := putJSON(b, statsKey, stats); err != nil {
+		return err
+	}
+
+	if err := b.Commit(); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// remove deletes a document and its postings in a batch.
+func (idx *Index) remove(b datastore.Batch, scope, id []byte, rec *docRecord, stats *statsRecord) error {
+	for term := range rec.Terms {
+		if err := b.Delete(postingKey(term, scope, id)); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	if err := b.Delete(docKey(scope, id)); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if stats.Docs--; stats.Docs < 0 {
+		stats.Docs = 0
+	}
+
+	if stats.Length -= rec.Length; stats.Length < 0 {
+		stats.Length = 0
+	}
+
+	return nil
+}
+
+// Delete removes a document from the index.
+func (idx *Index) Delete(scope, id []byte) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	return idx.deleteLocked([][]byte{id}, scope)
+}
+
+func (idx *Index) deleteLocked(ids [][]byte, scope []byte) error {
+	stats := &statsRecord{}
+	if _, err := idx.load(statsKey, stats); err != nil {
+		return err
+	}
+
+	b, err := idx.store.Batch()
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	removed := false
+	for _, id := range ids {
+		rec := &docRecord{}
+		if ok, err := idx.load(docKey(scope, id), rec); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+
+		if err := idx.remove(b, scope, id, rec, stats); err != nil {
+			return err
+		}
+
+		removed = true
+	}
+
+	if !removed {
+		return nil
+	}
+
+	if err := putJSON(b, statsKey, stats); err != nil {
+		return err
+	}
+
+	if err := b.Commit(); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// IDs returns the IDs of the documents of a scope.
+func (idx *Index) IDs(scope []byte) ([][]byte, error) {
+	res, err := idx.store.Query(query.Query{Prefix: docsKey.ChildString(encodeBytes(scope)).String(), KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	ids := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		id, err := base64.RawURLEncoding.DecodeString(datastore.RawKey(entry.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// DeleteScope removes the documents of a scope from the index.
+func (idx *Index) DeleteScope(scope []byte) error {
+	ids, err := idx.IDs(scope)
+	if err != nil {
+		return err
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	return idx.deleteLocked(ids, scope)
+}
+
+type candidate struct {
+	scope, id []byte
+	tfs       map[string]int
+}
+
+// Search returns the documents having all the terms of a query, the best
+// ranked first.
+func (idx *Index) Search(q *Query) ([]*Result, error) {
+	terms := uniqueTerms(Terms(q.Text))
+	if len(terms) == 0 {
+		return []*Result{}, nil
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	stats := &statsRecord{}
+	if _, err := idx.load(statsKey, stats); err != nil {
+		return nil, err
+	}
+
+	var (
+		candidates map[string]*candidate
+		dfs        = map[string]int{}
+	)
+
+	for _, term := range terms {
+		res, err := idx.store.Query(query.Query{Prefix: termsKey.ChildString(term).String()})
+		if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		entries, err := res.Rest()
+		if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		dfs[term] = len(entries)
+
+		matches := map[string]*candidate{}
+		for _, entry := range entries {
+			key := datastore.RawKey(entry.Key)
+			encodedScope, encodedID := key.Parent().BaseNamespace(), key.BaseNamespace()
+
+			if q.Scope != nil && encodedScope != encodeBytes(q.Scope) {
+				continue
+			}
+
+			ref := encodedScope + "/" + encodedID
+
+			c := &candidate{tfs: map[string]int{}}
+			if candidates != nil {
+				if c = candidates[ref]; c == nil {
+					continue
+				}
+			} else {
+				if c.scope, err = base64.RawURLEncoding.DecodeString(encodedScope); err != nil {
+					continue
+				}
+
+				if c.id, err = base64.RawURLEncoding.DecodeString(encodedID); err != nil {
+					continue
+				}
+			}
+
+			tf, err := strconv.Atoi(string(entry.Value))
+			if err != nil {
+				continue
+			}
+
+			c.tfs[term] = tf
+			matches[ref] = c
+		}
+
+		candidates = matches
+		if len(candidates) == 0 {
+			return []*Result{}, nil
+		}
+	}
+
+	avgLength := 1.0
+	if stats.Docs > 0 {
+		avgLength = float64(stats.Length) / float64(stats.Docs)
+	}
+
+	results := make([]*Result, 0, len(candidates))
+	for _, c := range candidates {
+		rec := &docRecord{}
+		if ok, err := idx.load(docKey(c.scope, c.id), rec); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		score := 0.0
+		for term, tf := range c.tfs {
+			df := float64(dfs[term])
+			idf := math.Log(1 + (float64(stats.Docs)-df+0.5)/(df+0.5))
+			norm := float64(tf) + bm25K1*(1-bm25B+bm25B*float64(rec.Length)/avgLength)
+			score += idf * float64(tf) * (bm25K1 + 1) / norm
+		}
+
+		r := &Result{Scope: c.scope, ID: c.id, At: time.Unix(0, rec.At), Score: score}
+		r.Snippet, r.Highlights = snippet(rec.Text, terms)
+		results = append(results, r)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+
+		return results[i].At.After(results[j].At)
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			unique = append(unique, term)
+		}
+	}
+
+	return unique
+}
+
+// snippet extracts up to SnippetLength characters of a text around its
+// first term matching the query, cut on the words.
+func snippet(text string, terms []string) (string, []Range) {
+	matching := map[string]bool{}
+	for _, term := range terms {
+		matching[term] = true
+	}
+
+	tokens := tokenize(text)
+
+	first := -1
+	for i, t := range tokens {
+		if matching[t.term] {
+			first = i
+			break
+		}
+	}
+
+	if first < 0 {
+		first = 0
+	}
+
+	// a third of the snippet comes before the match
+	start := 0
+	if len(tokens) > 0 {
+		i := first
+		for i > 0 && utf8.RuneCountInString(text[tokens[i-1].start:tokens[first].start]) <= SnippetLength/3 {
+			i--
+		}
+
+		// the beginning of the text is kept whole
+		if i > 0 {
+			start = tokens[i].start
+		}
+	}
+
+	end, n := start, 0
+	for end < len(text) && n < SnippetLength {
+		_, size := utf8.DecodeRuneInString(text[end:])
+		end += size
+		n++
+	}
+
+	// the last word isn't cut
+	if end < len(text) {
+		for _, t := range tokens {
+			if t.start < end && t.end > end {
+				if t.start > start {
+					end = t.start
+				}
+				break
+			}
+		}
+	}
+
+	prefix, suffix := "", ""
+	if start > 0 {
+		prefix = "…"
+	}
+
+	if end < len(text) {
+		suffix = "…"
+	}
+
+	segment := text[start:end]
+	body := strings.TrimRightFunc(strings.TrimLeftFunc(segment, unicode.IsSpace), unicode.IsSpace)
+	offset := len(prefix) - (len(segment) - len(strings.TrimLeftFunc(segment, unicode.IsSpace)))
+
+	highlights := []Range{}
+	for _, t := range tokens {
+		if t.start < start || t.end > end || !matching[t.term] {
+			continue
+		}
+
+		highlights = append(highlights, Range{Start: t.start - start + offset, End: t.end - start + offset})
+	}
+
+	return prefix + body + suffix, highlights
+}
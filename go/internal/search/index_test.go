@@ -0,0 +1,97 @@
+package search
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTerms(t *testing.T) {
+	assert.Equal(t, []string{"ete", "a", "paris", "2020"}, Terms("Été à Paris, 2020!"))
+	assert.Equal(t, []string{"東", "京", "tokyo"}, Terms("東京 (Tokyo)"))
+	assert.Empty(t, Terms(" ?! "))
+}
+
+func TestIndex(t *testing.T) {
+	idx := New(ds_sync.MutexWrap(datastore.NewMapDatastore()))
+
+	alice, bob := []byte("alice"), []byte("bob")
+	now := time.Now()
+
+	put := func(scope []byte, id, text string, at time.Time) {
+		require.NoError(t, idx.Put(&Document{Scope: scope, ID: []byte(id), Text: text, At: at}))
+	}
+
+	put(alice, "1", "Let's meet at the café tomorrow", now.Add(-time.Hour))
+	put(alice, "2", "The cafe is closed, let's meet at the park", now)
+	put(bob, "3", "cafe cafe cafe", now)
+	put(bob, "4", "nothing to see", now)
+
+	search := func(text string, scope []byte) []string {
+		results, err := idx.Search(&Query{Text: text, Scope: scope})
+		require.NoError(t, err)
+
+		ids := []string{}
+		for _, r := range results {
+			ids = append(ids, string(r.ID))
+		}
+
+		return ids
+	}
+
+	// the diacritics and the case are ignored, the most relevant first
+	assert.Equal(t, []string{"3", "1", "2"}, search("CAFÉ", nil))
+	assert.Equal(t, []string{"1", "2"}, search("cafe", alice))
+
+	// all the terms must match, the shortest text first
+	assert.Equal(t, []string{"1", "2"}, search("meet cafe", nil))
+	assert.Empty(t, search("cafe park", bob))
+	assert.Empty(t, search("unknown", nil))
+
+	// the newest first on the same score
+	put(bob, "5", "hello world", now.Add(-time.Minute))
+	put(bob, "6", "hello world", now)
+	assert.Equal(t, []string{"6", "5"}, search("hello", nil))
+
+	// replaced, the date is kept
+	put(alice, "1", "see you at the park", time.Time{})
+	assert.Equal(t, []string{"2"}, search("cafe meet", nil))
+
+	results, err := idx.Search(&Query{Text: "park"})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "1", string(results[0].ID))
+	assert.Equal(t, now.Add(-time.Hour).UnixNano(), results[0].At.UnixNano())
+
+	require.NoError(t, idx.Delete(alice, []byte("2")))
+	assert.Equal(t, []string{"1"}, search("park", nil))
+
+	require.NoError(t, idx.DeleteScope(bob))
+	assert.Empty(t, search("cafe", nil))
+
+	ids, err := idx.IDs(alice)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("1")}, ids)
+}
+
+func TestSnippet(t *testing.T) {
+	text := strings.Repeat("lorem ipsum ", 20) + "the Café is open " + strings.Repeat("dolor sit ", 20)
+
+	s, highlights := snippet(text, []string{"cafe"})
+	assert.True(t, strings.HasPrefix(s, "…"))
+	assert.True(t, strings.HasSuffix(s, "…"))
+	require.Len(t, highlights, 1)
+	assert.Equal(t, "Café", s[highlights[0].Start:highlights[0].End])
+	assert.LessOrEqual(t, len([]rune(s)), SnippetLength+2)
+
+	// a short text is kept whole
+	s, highlights = snippet("(hello) world", []string{"world"})
+	assert.Equal(t, "(hello) world", s)
+	require.Len(t, highlights, 1)
+	assert.Equal(t, "world", s[highlights[0].Start:highlights[0].End])
+}
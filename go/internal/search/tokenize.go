@@ -0,0 +1,77 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// token is a term of a text and its byte offsets in the text.
+type token struct {
+	term       string
+	start, end int
+}
+
+// ideographic scripts don't separate their words, each character is a term
+var ideographic = []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana}
+
+// Terms returns the terms of a text, in order, with duplicates.
+func Terms(text string) []string {
+	tokens := tokenize(text)
+
+	terms := make([]string, len(tokens))
+	for i, t := range tokens {
+		terms[i] = t.term
+	}
+
+	return terms
+}
+
+func tokenize(text string) []token {
+	tokens := []token{}
+	start := -1
+
+	flush := func(end int) {
+		if start >= 0 {
+			if term := fold(text[start:end]); term != "" {
+				tokens = append(tokens, token{term: term, start: start, end: end})
+			}
+			start = -1
+		}
+	}
+
+	for i, r := range text {
+		switch {
+		case unicode.IsOneOf(ideographic, r):
+			flush(i)
+			start = i
+			flush(i + utf8.RuneLen(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+			if start < 0 {
+				start = i
+			}
+		default:
+			flush(i)
+		}
+	}
+
+	flush(len(text))
+
+	return tokens
+}
+
+// fold lowercases a word and removes its diacritics, e.g. "Été" is "ete".
+func fold(word string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+	folded, _, err := transform.String(t, word)
+	if err != nil {
+		folded = word
+	}
+
+	return strings.ToLower(folded)
+}
@@ -0,0 +1,20 @@
+// Package simulation serves the client API backed by synthetic peers, living
+// in memory on a mocked network, and replays a recorded timeline of events,
+// so the UI can be developed against realistic data without real peers or
+// radios.
+//
+// A fixture looks like:
+//
+//	{
+//	  "account": {"name": "me"},
+//	  "contacts": [{"name": "alice"}, {"name": "bob"}],
+//	  "conversations": [{"name": "climbing", "members": ["alice", "bob"]}],
+//	  "timeline": [
+//	    {"at": "2s", "from": "alice", "to": "alice", "message": "hey!"},
+//	    {"at": "5s", "from": "bob", "to": "climbing", "message": "who's in?"}
+//	  ]
+//	}
+//
+// "to" is either a contact name, for the contact conversation, or a
+// conversation name. "from" is a contact name, or empty for the account.
+package simulation
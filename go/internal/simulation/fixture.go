@@ -0,0 +1,147 @@
+package simulation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// Fixture describes the synthetic data of a simulation.
+type Fixture struct {
+	Account       FixtureAccount        `json:"account"`
+	Contacts      []FixtureContact      `json:"contacts"`
+	Conversations []FixtureConversation `json:"conversations"`
+	Timeline      []FixtureEvent        `json:"timeline"`
+
+	// Loop restarts the timeline once its last event is replayed
+	Loop bool `json:"loop,omitempty"`
+}
+
+type FixtureAccount struct {
+	Name string `json:"name"`
+}
+
+type FixtureContact struct {
+	Name string `json:"name"`
+}
+
+type FixtureConversation struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// FixtureEvent is a message sent at a given time after the start of the
+// simulation.
+type FixtureEvent struct {
+	At      Duration `json:"at"`
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to"`
+	Message string   `json:"message"`
+}
+
+// Duration is a time.Duration encoded as a string in JSON, e.g. "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// ParseFixture decodes and checks a fixture, the timeline is sorted.
+func ParseFixture(r io.Reader) (*Fixture, error) {
+	f := &Fixture{}
+	if err := json.NewDecoder(r).Decode(f); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if err := f.check(); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	sort.SliceStable(f.Timeline, func(i, j int) bool { return f.Timeline[i].At < f.Timeline[j].At })
+
+	return f, nil
+}
+
+func (f *Fixture) check() error {
+	contacts := map[string]bool{}
+	for _, c := range f.Contacts {
+		if c.Name == "" {
+			return fmt.Errorf("contact without a name")
+		}
+
+		if contacts[c.Name] {
+			return fmt.Errorf("duplicate contact %q", c.Name)
+		}
+
+		contacts[c.Name] = true
+	}
+
+	conversations := map[string]map[string]bool{}
+	for _, c := range f.Conversations {
+		if c.Name == "" {
+			return fmt.Errorf("conversation without a name")
+		}
+
+		if _, ok := conversations[c.Name]; ok || contacts[c.Name] {
+			return fmt.Errorf("duplicate conversation %q", c.Name)
+		}
+
+		members := map[string]bool{}
+		for _, m := range c.Members {
+			if !contacts[m] {
+				return fmt.Errorf("unknown member %q in conversation %q", m, c.Name)
+			}
+
+			members[m] = true
+		}
+
+		conversations[c.Name] = members
+	}
+
+	for i, e := range f.Timeline {
+		if e.At < 0 {
+			return fmt.Errorf("event %d: negative time", i)
+		}
+
+		if e.From != "" && !contacts[e.From] {
+			return fmt.Errorf("event %d: unknown sender %q", i, e.From)
+		}
+
+		if members, ok := conversations[e.To]; ok {
+			if e.From != "" && !members[e.From] {
+				return fmt.Errorf("event %d: %q isn't a member of %q", i, e.From, e.To)
+			}
+
+			continue
+		}
+
+		if !contacts[e.To] {
+			return fmt.Errorf("event %d: unknown conversation %q", i, e.To)
+		}
+
+		if e.From != "" && e.From != e.To {
+			return fmt.Errorf("event %d: %q can't send a message to the contact conversation of %q", i, e.From, e.To)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package simulation
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFixture(t *testing.T) {
+	f, err := ParseFixture(strings.NewReader(`{
+		"contacts": [{"name": "alice"}, {"name": "bob"}],
+		"conversations": [{"name": "climbing", "members": ["alice", "bob"]}],
+		"timeline": [
+			{"at": "5s", "from": "bob", "to": "climbing", "message": "who's in?"},
+			{"at": "2s", "from": "alice", "to": "alice", "message": "hey!"},
+			{"at": "1m", "to": "climbing", "message": "me"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	require.Len(t, f.Timeline, 3)
+	assert.Equal(t, Duration(2*time.Second), f.Timeline[0].At)
+	assert.Equal(t, "alice", f.Timeline[0].From)
+	assert.Equal(t, Duration(time.Minute), f.Timeline[2].At)
+
+	for _, invalid := range []string{
+		`{"contacts": [{"name": "alice"}, {"name": "alice"}]}`,
+		`{"conversations": [{"name": "climbing", "members": ["alice"]}]}`,
+		`{"contacts": [{"name": "alice"}], "timeline": [{"at": "1s", "from": "bob", "to": "alice"}]}`,
+		`{"contacts": [{"name": "alice"}, {"name": "bob"}], "timeline": [{"at": "1s", "from": "bob", "to": "alice"}]}`,
+		`{"contacts": [{"name": "alice"}], "timeline": [{"at": "soon", "to": "alice"}]}`,
+	} {
+		_, err := ParseFixture(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,123 @@
+package simulation
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/tinder"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	ipfs_mock "github.com/ipfs/go-ipfs/core/mock"
+	"github.com/ipfs/go-ipfs/keystore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/routing"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"go.uber.org/zap"
+)
+
+// node is an in-memory berty instance connected to the mocked network.
+type node struct {
+	name    string
+	service bertyprotocol.Service
+	client  bertyprotocol.Client
+	config  *bertytypes.InstanceGetConfiguration_Reply
+	close   func()
+}
+
+func newNode(ctx context.Context, logger *zap.Logger, mn libp2p_mocknet.Mocknet, rdv *tinder.MockDriverServer, name string) (*node, error) {
+	logger = logger.Named(name)
+
+	repo, err := ipfsutil.CreateMockedRepo(ds_sync.MutexWrap(datastore.NewMapDatastore()))
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	var (
+		ps   *pubsub.PubSub
+		disc tinder.Driver
+	)
+
+	api, ipfsNode, err := ipfsutil.NewCoreAPIFromRepo(ctx, repo, &ipfsutil.CoreAPIConfig{
+		DisableCorePubSub: true,
+		DisableMDNS:       true,
+		BootstrapAddrs:    []string{},
+		Host:              ipfs_mock.MockHostOption(mn),
+		HostConfig: func(h host.Host, _ routing.Routing) error {
+			var err error
+
+			minBackoff, maxBackoff := time.Second, time.Minute
+			rng := rand.New(rand.NewSource(rand.Int63()))
+			disc, err = tinder.NewService(
+				logger,
+				tinder.NewMockedDriverClient(h, rdv),
+				discovery.NewExponentialBackoff(minBackoff, maxBackoff, discovery.FullJitter, time.Second, 5.0, 0, rng),
+			)
+			if err != nil {
+				return err
+			}
+
+			ps, err = pubsub.NewGossipSub(ctx, h,
+				pubsub.WithMessageSigning(true),
+				pubsub.WithFloodPublish(true),
+				pubsub.WithDiscovery(disc),
+			)
+
+			return err
+		},
+	})
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	psapi := ipfsutil.NewPubSubAPI(ctx, logger.Named("ps"), disc, ps)
+	api = ipfsutil.InjectPubSubCoreAPIExtendedAdaptater(api, psapi)
+
+	service, err := bertyprotocol.New(bertyprotocol.Opts{
+		Host:            ipfsNode.PeerHost,
+		PubSub:          ps,
+		TinderDriver:    disc,
+		IpfsCoreAPI:     api,
+		Logger:          logger.Named("protocol"),
+		RootContext:     ctx,
+		DeviceKeystore:  bertyprotocol.NewDeviceKeystore(keystore.NewMemKeystore()),
+		MessageKeystore: bertyprotocol.NewInMemMessageKeystore(),
+	})
+	if err != nil {
+		ipfsNode.Close()
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	client, err := bertyprotocol.NewClient(service)
+	if err != nil {
+		service.Close()
+		ipfsNode.Close()
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	config, err := client.InstanceGetConfiguration(ctx, &bertytypes.InstanceGetConfiguration_Request{})
+	if err != nil {
+		client.Close()
+		service.Close()
+		ipfsNode.Close()
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &node{
+		name:    name,
+		service: service,
+		client:  client,
+		config:  config,
+		close: func() {
+			client.Close()
+			service.Close()
+			ipfsNode.Close()
+		},
+	}, nil
+}
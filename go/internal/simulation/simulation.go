@@ -0,0 +1,319 @@
+package simulation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/tinder"
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"go.uber.org/zap"
+)
+
+const defaultAccountName = "me"
+
+// Opts contains the configuration of a simulation.
+type Opts struct {
+	Logger  *zap.Logger
+	Fixture *Fixture
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Fixture == nil {
+		opts.Fixture = &Fixture{}
+	}
+
+	if opts.Fixture.Account.Name == "" {
+		opts.Fixture.Account.Name = defaultAccountName
+	}
+}
+
+// Simulation is a set of in-memory nodes, the local one is served to the
+// clients and the others play the contacts of the fixture.
+type Simulation struct {
+	logger  *zap.Logger
+	fixture *Fixture
+
+	local *node
+	peers map[string]*node
+
+	// groups are the conversations group pks, by contact or conversation
+	// name
+	groups map[string][]byte
+}
+
+// New starts the nodes and creates the contacts and the conversations of the
+// fixture, the timeline is replayed by Run.
+func New(ctx context.Context, opts Opts) (*Simulation, error) {
+	opts.applyDefaults()
+
+	mn := libp2p_mocknet.New(ctx)
+	rdv := tinder.NewMockedDriverServer()
+
+	s := &Simulation{
+		logger:  opts.Logger,
+		fixture: opts.Fixture,
+		peers:   make(map[string]*node),
+		groups:  make(map[string][]byte),
+	}
+
+	var err error
+	if s.local, err = newNode(ctx, s.logger, mn, rdv, opts.Fixture.Account.Name); err != nil {
+		return nil, err
+	}
+
+	for _, c := range opts.Fixture.Contacts {
+		n, err := newNode(ctx, s.logger, mn, rdv, c.Name)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.peers[c.Name] = n
+	}
+
+	if err := mn.LinkAll(); err != nil {
+		s.Close()
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if err := mn.ConnectAllButSelf(); err != nil {
+		s.Close()
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	for _, c := range opts.Fixture.Contacts {
+		if err := s.addContact(ctx, s.peers[c.Name]); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("unable to add contact %q: %w", c.Name, err)
+		}
+	}
+
+	for _, c := range opts.Fixture.Conversations {
+		if err := s.createConversation(ctx, c); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("unable to create conversation %q: %w", c.Name, err)
+		}
+	}
+
+	s.logger.Info("simulation ready",
+		zap.Int("contacts", len(opts.Fixture.Contacts)),
+		zap.Int("conversations", len(opts.Fixture.Conversations)),
+		zap.Int("events", len(opts.Fixture.Timeline)),
+	)
+
+	return s, nil
+}
+
+// Protocol returns the protocol service of the local node.
+func (s *Simulation) Protocol() bertyprotocol.Service {
+	return s.local.service
+}
+
+// Run replays the timeline of the fixture, it returns once the last event is
+// replayed, or when the context is done if the timeline loops.
+func (s *Simulation) Run(ctx context.Context) error {
+	for {
+		start := time.Now()
+
+		for _, e := range s.fixture.Timeline {
+			select {
+			case <-time.After(time.Until(start.Add(time.Duration(e.At)))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if err := s.replay(ctx, e); err != nil {
+				s.logger.Warn("unable to replay event", zap.String("to", e.To), zap.String("from", e.From), zap.Error(err))
+			}
+		}
+
+		if !s.fixture.Loop || len(s.fixture.Timeline) == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *Simulation) Close() error {
+	if s.local != nil {
+		s.local.close()
+	}
+
+	for _, n := range s.peers {
+		n.close()
+	}
+
+	return nil
+}
+
+func (s *Simulation) replay(ctx context.Context, e FixtureEvent) error {
+	sender := s.local
+	if e.From != "" {
+		sender = s.peers[e.From]
+	}
+
+	groupPK, ok := s.groups[e.To]
+	if !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown conversation %q", e.To))
+	}
+
+	payload, err := json.Marshal(&bertymessenger.PayloadUserMessage{
+		Type:     bertymessenger.AppMessageType_UserMessage,
+		Body:     e.Message,
+		SentDate: time.Now().UnixNano() / 1000000,
+	})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	_, err = sender.client.AppMessageSend(ctx, &bertytypes.AppMessageSend_Request{
+		GroupPK: groupPK,
+		Payload: payload,
+	})
+
+	return err
+}
+
+func nameMetadata(name string) []byte {
+	metadata, _ := json.Marshal(map[string]string{"name": name})
+	return metadata
+}
+
+// addContact makes the peer send a contact request to the local node, which
+// accepts it.
+func (s *Simulation) addContact(ctx context.Context, peer *node) error {
+	local := s.local
+
+	if _, err := local.client.ContactRequestEnable(ctx, &bertytypes.ContactRequestEnable_Request{}); err != nil {
+		return err
+	}
+
+	ref, err := local.client.ContactRequestResetReference(ctx, &bertytypes.ContactRequestResetReference_Request{})
+	if err != nil {
+		return err
+	}
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	sub, err := local.client.GroupMetadataSubscribe(subCtx, &bertytypes.GroupMetadataSubscribe_Request{
+		GroupPK: local.config.AccountGroupPK,
+		Since:   []byte("give me everything"),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = peer.client.ContactRequestSend(ctx, &bertytypes.ContactRequestSend_Request{
+		Contact: &bertytypes.ShareableContact{
+			PK:                   local.config.AccountPK,
+			PublicRendezvousSeed: ref.PublicRendezvousSeed,
+			Metadata:             nameMetadata(s.fixture.Account.Name),
+		},
+		OwnMetadata: nameMetadata(peer.name),
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		evt, err := sub.Recv()
+		if err == io.EOF {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("contact request not received"))
+		} else if err != nil {
+			return err
+		}
+
+		if evt == nil || evt.Metadata.EventType != bertytypes.EventTypeAccountContactRequestIncomingReceived {
+			continue
+		}
+
+		req := &bertytypes.AccountContactRequestReceived{}
+		if err := req.Unmarshal(evt.Event); err != nil {
+			return errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if bytes.Equal(req.ContactPK, peer.config.AccountPK) {
+			break
+		}
+	}
+
+	if _, err := local.client.ContactRequestAccept(ctx, &bertytypes.ContactRequestAccept_Request{
+		ContactPK: peer.config.AccountPK,
+	}); err != nil {
+		return err
+	}
+
+	info, err := local.client.GroupInfo(ctx, &bertytypes.GroupInfo_Request{ContactPK: peer.config.AccountPK})
+	if err != nil {
+		return err
+	}
+
+	for _, n := range []*node{local, peer} {
+		if _, err := n.client.ActivateGroup(ctx, &bertytypes.ActivateGroup_Request{GroupPK: info.Group.PublicKey}); err != nil {
+			return err
+		}
+	}
+
+	s.groups[peer.name] = info.Group.PublicKey
+
+	return nil
+}
+
+// createConversation creates a multi member group on the local node and
+// makes the members join it.
+func (s *Simulation) createConversation(ctx context.Context, c FixtureConversation) error {
+	created, err := s.local.client.MultiMemberGroupCreate(ctx, &bertytypes.MultiMemberGroupCreate_Request{})
+	if err != nil {
+		return err
+	}
+
+	invitation, err := s.local.client.MultiMemberGroupInvitationCreate(ctx, &bertytypes.MultiMemberGroupInvitationCreate_Request{
+		GroupPK: created.GroupPK,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range c.Members {
+		peer := s.peers[name]
+
+		if _, err := peer.client.MultiMemberGroupJoin(ctx, &bertytypes.MultiMemberGroupJoin_Request{Group: invitation.Group}); err != nil {
+			return err
+		}
+
+		if _, err := peer.client.ActivateGroup(ctx, &bertytypes.ActivateGroup_Request{GroupPK: created.GroupPK}); err != nil {
+			return err
+		}
+	}
+
+	payload, err := json.Marshal(&bertymessenger.PayloadSetGroupName{
+		Type: bertymessenger.AppMessageType_SetGroupName,
+		Name: c.Name,
+	})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := s.local.client.AppMetadataSend(ctx, &bertytypes.AppMetadataSend_Request{
+		GroupPK: created.GroupPK,
+		Payload: payload,
+	}); err != nil {
+		return err
+	}
+
+	s.groups[c.Name] = created.GroupPK
+
+	return nil
+}
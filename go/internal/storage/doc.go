@@ -0,0 +1,20 @@
+// Package storage opens the root datastore of a node on a backend selected by
+// config: in memory for the tests, sqlite for the iOS shared containers,
+// where a single file is easier to share with an app extension, and badger
+// on the desktop for its performance.
+//
+// The backends are registered by name, the sqlite one is only available
+// when built with cgo.
+//
+// Given a secret, the values are encrypted at rest whatever the backend:
+// the messages, the contacts and the keys of the account sit in the root
+// datastore, as well as the IPFS blocks of the attachments. On the mobile
+// the secret is held by the platform keystore (the keychain, the Android
+// keystore). On the desktop it's derived from the device key, whose keystore
+// namespace is then left in the clear, unless a key file is kept apart from
+// the datastore. A plaintext datastore is encrypted in place when first
+// opened with a secret.
+//
+// The layout of the entries is versioned, Migrate brings a datastore to a
+// schema version by running or rolling back the migrations in between.
+package storage
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const encryptionInfo = "berty datastore encryption"
+
+var (
+	// encryptionKey holds the check value sealed with the key, it tells a
+	// wrong key from a plaintext datastore
+	encryptionKey = datastore.NewKey("/_storage/encryption")
+
+	// migratingKey is set while the entries of a plaintext datastore are
+	// encrypted, the migration resumes on the next open if interrupted
+	migratingKey = datastore.NewKey("/_storage/migrating")
+
+	encryptionCheck = []byte("berty datastore")
+)
+
+// migrateBatchSize bounds the entries encrypted by a batch of the migration.
+const migrateBatchSize = 1024
+
+// ErrWrongKey is returned when an encrypted datastore is opened with another
+// key.
+var ErrWrongKey = fmt.Errorf("wrong datastore encryption key")
+
+// encryptedDatastore seals the values of a datastore with XChaCha20-Poly1305,
+// the key of an entry is the associated data so a value can't be moved to
+// another key. The keys are left in the clear, they are needed to run the
+// prefix queries.
+type encryptedDatastore struct {
+	Datastore
+
+	// the values of these namespaces are left in the clear
+	clear []datastore.Key
+
+	aead interface {
+		Seal(dst, nonce, plaintext, additionalData []byte) []byte
+		Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+		NonceSize() int
+		Overhead() int
+	}
+}
+
+// NewEncrypted returns a datastore encrypting the values of ds at rest with a
+// key derived from secret. The values of a plaintext datastore, i.e. of an
+// existing install, are encrypted in place first.
+//
+// The values of the clear namespaces are stored as is, e.g. the keystore
+// the secret is derived from.
+func NewEncrypted(ds Datastore, secret []byte, clear ...datastore.Key) (Datastore, error) {
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("the datastore encryption secret is too short")
+	}
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(encryptionInfo)), key); err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &encryptedDatastore{Datastore: ds, clear: clear, aead: aead}
+
+	sealed, err := ds.Get(encryptionKey)
+	switch err {
+	case nil:
+		check, err := e.open(encryptionKey, sealed)
+		if err != nil || subtle.ConstantTimeCompare(check, encryptionCheck) != 1 {
+			return nil, ErrWrongKey
+		}
+
+	case datastore.ErrNotFound:
+		if err := ds.Put(migratingKey, []byte{}); err != nil {
+			return nil, err
+		}
+
+		if sealed, err = e.seal(encryptionKey, encryptionCheck); err != nil {
+			return nil, err
+		}
+
+		if err := ds.Put(encryptionKey, sealed); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, err
+	}
+
+	if migrating, err := ds.Has(migratingKey); err != nil {
+		return nil, err
+	} else if migrating {
+		if err := e.migrate(); err != nil {
+			return nil, fmt.Errorf("unable to encrypt the datastore: %w", err)
+		}
+	}
+
+	return e, nil
+}
+
+// IsEncrypted reports whether the values of ds have been encrypted by
+// NewEncrypted, it's then opened with the same secret only.
+func IsEncrypted(ds Datastore) (bool, error) {
+	return ds.Has(encryptionKey)
+}
+
+func isStorageKey(key string) bool {
+	return key == encryptionKey.String() || key == migratingKey.String()
+}
+
+func (e *encryptedDatastore) isClear(key datastore.Key) bool {
+	for _, ns := range e.clear {
+		if key.Equal(ns) || key.IsDescendantOf(ns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *encryptedDatastore) seal(key datastore.Key, value []byte) ([]byte, error) {
+	if e.isClear(key) {
+		return value, nil
+	}
+
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(value)+e.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return e.aead.Seal(nonce, nonce, value, []byte(key.String())), nil
+}
+
+func (e *encryptedDatastore) open(key datastore.Key, sealed []byte) ([]byte, error) {
+	if e.isClear(key) {
+		return sealed, nil
+	}
+
+	if len(sealed) < e.aead.NonceSize()+e.aead.Overhead() {
+		return nil, fmt.Errorf("invalid encrypted value of %s", key)
+	}
+
+	n := e.aead.NonceSize()
+	value, err := e.aead.Open(nil, sealed[:n], sealed[n:], []byte(key.String()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the value of %s: %w", key, err)
+	}
+
+	return value, nil
+}
+
+// migrate encrypts the plaintext values by batches of migrateBatchSize, the
+// values already encrypted by an interrupted migration are authenticated and
+// left untouched. The marker is only deleted once every batch is committed.
+func (e *encryptedDatastore) migrate() error {
+	res, err := e.Datastore.Query(query.Query{})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	batch, err := e.Datastore.Batch()
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+
+		if isStorageKey(r.Key) {
+			continue
+		}
+
+		key := datastore.RawKey(r.Key)
+		if _, err := e.open(key, r.Value); err == nil {
+			continue
+		}
+
+		sealed, err := e.seal(key, r.Value)
+		if err != nil {
+			return err
+		}
+
+		if err := batch.Put(key, sealed); err != nil {
+			return err
+		}
+
+		pending++
+		if pending < migrateBatchSize {
+			continue
+		}
+
+		if err := batch.Commit(); err != nil {
+			return err
+		}
+
+		if batch, err = e.Datastore.Batch(); err != nil {
+			return err
+		}
+
+		pending = 0
+	}
+
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+
+	return e.Datastore.Delete(migratingKey)
+}
+
+func (e *encryptedDatastore) Get(key datastore.Key) ([]byte, error) {
+	sealed, err := e.Datastore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.open(key, sealed)
+}
+
+func (e *encryptedDatastore) GetSize(key datastore.Key) (int, error) {
+	size, err := e.Datastore.GetSize(key)
+	if err != nil || e.isClear(key) {
+		return size, err
+	}
+
+	return size - e.aead.NonceSize() - e.aead.Overhead(), nil
+}
+
+func (e *encryptedDatastore) Put(key datastore.Key, value []byte) error {
+	sealed, err := e.seal(key, value)
+	if err != nil {
+		return err
+	}
+
+	return e.Datastore.Put(key, sealed)
+}
+
+// Query runs the prefix on the underlying datastore, the filters and the
+// orders need the decrypted values so they are applied afterwards. The
+// entries are decrypted as they're read, and not at all for the keys only.
+func (e *encryptedDatastore) Query(q query.Query) (query.Results, error) {
+	keysOnly := q.KeysOnly && len(q.Filters) == 0 && len(q.Orders) == 0
+
+	res, err := e.Datastore.Query(query.Query{Prefix: q.Prefix, KeysOnly: keysOnly, ReturnsSizes: q.ReturnsSizes})
+	if err != nil {
+		return nil, err
+	}
+
+	naive := q
+	naive.Prefix = ""
+
+	next := func() (query.Result, bool) {
+		for {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil {
+				return r, ok
+			}
+
+			if isStorageKey(r.Key) {
+				continue
+			}
+
+			if keysOnly {
+				if r.Size > 0 && !e.isClear(datastore.RawKey(r.Key)) {
+					r.Size -= e.aead.NonceSize() + e.aead.Overhead()
+				}
+
+				return r, true
+			}
+
+			value, err := e.open(datastore.RawKey(r.Key), r.Value)
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+
+			// the values are kept for the filters and the orders even
+			// with the keys only
+			r.Value, r.Size = value, len(value)
+
+			return r, true
+		}
+	}
+
+	iter := query.Iterator{Next: next, Close: res.Close}
+
+	return query.NaiveQueryApply(naive, query.ResultsFromIterator(naive, iter)), nil
+}
+
+func (e *encryptedDatastore) Batch() (datastore.Batch, error) {
+	b, err := e.Datastore.Batch()
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedBatch{Batch: b, ds: e}, nil
+}
+
+type encryptedBatch struct {
+	datastore.Batch
+
+	ds *encryptedDatastore
+}
+
+func (b *encryptedBatch) Put(key datastore.Key, value []byte) error {
+	sealed, err := b.ds.seal(key, value)
+	if err != nil {
+		return err
+	}
+
+	return b.Batch.Put(key, sealed)
+}
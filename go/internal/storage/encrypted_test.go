@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncrypted(t *testing.T) {
+	inner, err := Open(Opts{Path: InMemoryPath})
+	require.NoError(t, err)
+	defer inner.Close()
+
+	ds, err := NewEncrypted(inner, testSecret)
+	require.NoError(t, err)
+	testDatastore(t, ds)
+
+	// the values are sealed in the underlying datastore
+	raw, err := inner.Get(datastore.NewKey("/b"))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("batched")))
+
+	// a value can't be moved to another key
+	require.NoError(t, inner.Put(datastore.NewKey("/c"), raw))
+	_, err = ds.Get(datastore.NewKey("/c"))
+	assert.Error(t, err)
+
+	// reopening with the same secret
+	ds, err = NewEncrypted(inner, testSecret)
+	require.NoError(t, err)
+	value, err := ds.Get(datastore.NewKey("/b"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("batched"), value)
+
+	_, err = NewEncrypted(inner, []byte("another secret of the datastore"))
+	assert.Equal(t, ErrWrongKey, err)
+
+	_, err = NewEncrypted(inner, []byte("short"))
+	assert.Error(t, err)
+}
+
+func TestEncryptedMigration(t *testing.T) {
+	inner, err := Open(Opts{Path: InMemoryPath})
+	require.NoError(t, err)
+	defer inner.Close()
+
+	// an existing install
+	require.NoError(t, inner.Put(datastore.NewKey("/messages/1"), []byte("hello")))
+	require.NoError(t, inner.Put(datastore.NewKey("/contacts/1"), []byte("alice")))
+
+	// a migration interrupted after the first entry
+	e, err := NewEncrypted(inner, testSecret)
+	require.NoError(t, err)
+	require.NoError(t, inner.Put(migratingKey, []byte{}))
+	require.NoError(t, e.Put(datastore.NewKey("/messages/2"), []byte("world")))
+	require.NoError(t, inner.Put(datastore.NewKey("/contacts/2"), []byte("bob")))
+
+	ds, err := NewEncrypted(inner, testSecret)
+	require.NoError(t, err)
+
+	has, err := inner.Has(migratingKey)
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	for key, expected := range map[string]string{
+		"/messages/1": "hello",
+		"/messages/2": "world",
+		"/contacts/1": "alice",
+		"/contacts/2": "bob",
+	} {
+		raw, err := inner.Get(datastore.NewKey(key))
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(raw, []byte(expected)), key)
+
+		value, err := ds.Get(datastore.NewKey(key))
+		require.NoError(t, err)
+		assert.Equal(t, []byte(expected), value, key)
+	}
+
+	// the markers are hidden from the queries
+	res, err := ds.Query(query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestEncryptedMigrationBatches(t *testing.T) {
+	inner, err := Open(Opts{Path: InMemoryPath})
+	require.NoError(t, err)
+	defer inner.Close()
+
+	count := 2*migrateBatchSize + 10
+	for i := 0; i < count; i++ {
+		require.NoError(t, inner.Put(datastore.NewKey(fmt.Sprintf("/messages/%d", i)), []byte("hello")))
+	}
+
+	ds, err := NewEncrypted(inner, testSecret)
+	require.NoError(t, err)
+
+	res, err := inner.Query(query.Query{Prefix: "/messages"})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, count)
+
+	for _, entry := range entries {
+		assert.NotEqual(t, []byte("hello"), entry.Value, entry.Key)
+	}
+
+	value, err := ds.Get(datastore.NewKey(fmt.Sprintf("/messages/%d", count-1)))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), value)
+}
+
+func TestEncryptedKeysOnly(t *testing.T) {
+	inner, err := Open(Opts{Path: InMemoryPath})
+	require.NoError(t, err)
+	defer inner.Close()
+
+	ds, err := NewEncrypted(inner, testSecret)
+	require.NoError(t, err)
+
+	require.NoError(t, ds.Put(datastore.NewKey("/a"), []byte("value")))
+
+	// a value that can't be decrypted
+	require.NoError(t, inner.Put(datastore.NewKey("/b"), []byte("garbage")))
+
+	res, err := ds.Query(query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Nil(t, entries[0].Value)
+
+	res, err = ds.Query(query.Query{})
+	require.NoError(t, err)
+	_, err = res.Rest()
+	assert.Error(t, err)
+}
+
+func TestEncryptedClear(t *testing.T) {
+	inner, err := Open(Opts{Path: InMemoryPath})
+	require.NoError(t, err)
+	defer inner.Close()
+
+	require.NoError(t, inner.Put(datastore.NewKey("/keystore/device"), []byte("device key")))
+
+	ds, err := NewEncrypted(inner, testSecret, datastore.NewKey("/keystore"))
+	require.NoError(t, err)
+
+	require.NoError(t, ds.Put(datastore.NewKey("/keystore/account"), []byte("account key")))
+	require.NoError(t, ds.Put(datastore.NewKey("/keystores/1"), []byte("sealed")))
+
+	for key, expected := range map[string]string{
+		"/keystore/device":  "device key",
+		"/keystore/account": "account key",
+	} {
+		raw, err := inner.Get(datastore.NewKey(key))
+		require.NoError(t, err)
+		assert.Equal(t, []byte(expected), raw, key)
+
+		value, err := ds.Get(datastore.NewKey(key))
+		require.NoError(t, err)
+		assert.Equal(t, []byte(expected), value, key)
+	}
+
+	raw, err := inner.Get(datastore.NewKey("/keystores/1"))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("sealed")))
+
+	encrypted, err := IsEncrypted(inner)
+	require.NoError(t, err)
+	assert.True(t, encrypted)
+}
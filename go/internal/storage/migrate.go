@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// versionKey holds the schema version of the datastore, a datastore without
+// it is at version 0
+var versionKey = datastore.NewKey("/_storage/version")
+
+// ErrFutureVersion is returned when the datastore has been migrated by a
+// newer release, its entries can't be read safely.
+var ErrFutureVersion = fmt.Errorf("datastore schema from a newer version")
+
+// Migration changes the layout of the entries from the schema Version-1 to
+// Version.
+type Migration struct {
+	// Version is the schema version after the migration, the versions of a
+	// list start at 1 and are consecutive
+	Version int
+
+	// Name describes the migration in the reports
+	Name string
+
+	// Up migrates the entries to Version
+	Up func(ds datastore.Datastore) error
+
+	// Down reverts Up, the migration can't be rolled back if nil
+	Down func(ds datastore.Datastore) error
+}
+
+// MigrateOpts are the options of Migrate.
+type MigrateOpts struct {
+	// Target is the version to migrate to, an older one rolls back the
+	// migrations, defaults to the latest version
+	Target int
+
+	// DryRun runs the migrations without writing them, to report their
+	// changes
+	DryRun bool
+}
+
+// MigrationStep is a migration run by Migrate.
+type MigrationStep struct {
+	Version  int
+	Name     string
+	Rollback bool
+	Puts     int
+	Deletes  int
+}
+
+// MigrationReport reports the migrations run by Migrate.
+type MigrationReport struct {
+	From   int
+	To     int
+	DryRun bool
+	Steps  []MigrationStep
+}
+
+// Version returns the schema version of ds.
+func Version(ds datastore.Read) (int, error) {
+	data, err := ds.Get(versionKey)
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("invalid datastore schema version %q", data)
+	}
+
+	return version, nil
+}
+
+// Migrate runs the migrations between the schema version of ds and the
+// target one, in order. Each migration is written in a single batch along
+// with the version it reaches, i.e. a failed migration leaves nothing
+// behind and the next run starts from it again. The datastore is left
+// untouched, with ErrFutureVersion, if its version is unknown.
+func Migrate(ds datastore.Batching, migrations []Migration, opts MigrateOpts) (*MigrationReport, error) {
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Up == nil {
+			return nil, fmt.Errorf("invalid migration %d %q", m.Version, m.Name)
+		}
+	}
+
+	latest := len(migrations)
+	current, err := Version(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	if current > latest {
+		return nil, fmt.Errorf("%w: version %d, this release knows up to %d", ErrFutureVersion, current, latest)
+	}
+
+	target := opts.Target
+	if target == 0 {
+		target = latest
+	} else if target < 0 || target > latest {
+		return nil, fmt.Errorf("unknown datastore schema version %d", target)
+	}
+
+	report := &MigrationReport{From: current, To: target, DryRun: opts.DryRun}
+
+	// the overlay carries the changes of the previous steps on a dry run
+	ov := newOverlay(ds)
+	for current != target {
+		var (
+			m    Migration
+			run  func(datastore.Datastore) error
+			next int
+		)
+
+		if current < target {
+			m, next = migrations[current], current+1
+			run = m.Up
+		} else {
+			m, next = migrations[current-1], current-1
+			run = m.Down
+		}
+
+		if run == nil {
+			return report, fmt.Errorf("migration %d %q can't be rolled back", m.Version, m.Name)
+		}
+
+		step := MigrationStep{Version: m.Version, Name: m.Name, Rollback: next < current}
+		puts, deletes := ov.puts, ov.deletes
+
+		if err := run(ov); err != nil {
+			return report, fmt.Errorf("migration %d %q failed: %w", m.Version, m.Name, err)
+		}
+
+		step.Puts, step.Deletes = ov.puts-puts, ov.deletes-deletes
+
+		if err := ov.Put(versionKey, []byte(strconv.Itoa(next))); err != nil {
+			return report, err
+		}
+
+		if !opts.DryRun {
+			if err := ov.commit(); err != nil {
+				return report, fmt.Errorf("unable to write migration %d %q: %w", m.Version, m.Name, err)
+			}
+
+			ov = newOverlay(ds)
+		}
+
+		report.Steps = append(report.Steps, step)
+		current = next
+	}
+
+	return report, nil
+}
+
+// overlay buffers the writes of a migration over ds until committed.
+type overlay struct {
+	ds  datastore.Batching
+	ops map[datastore.Key][]byte // a nil value deletes the key
+
+	puts, deletes int
+}
+
+func newOverlay(ds datastore.Batching) *overlay {
+	return &overlay{ds: ds, ops: map[datastore.Key][]byte{}}
+}
+
+func (o *overlay) Get(key datastore.Key) ([]byte, error) {
+	if value, ok := o.ops[key]; ok {
+		if value == nil {
+			return nil, datastore.ErrNotFound
+		}
+
+		return append([]byte{}, value...), nil
+	}
+
+	return o.ds.Get(key)
+}
+
+func (o *overlay) Has(key datastore.Key) (bool, error) {
+	if value, ok := o.ops[key]; ok {
+		return value != nil, nil
+	}
+
+	return o.ds.Has(key)
+}
+
+func (o *overlay) GetSize(key datastore.Key) (int, error) {
+	if value, ok := o.ops[key]; ok {
+		if value == nil {
+			return -1, datastore.ErrNotFound
+		}
+
+		return len(value), nil
+	}
+
+	return o.ds.GetSize(key)
+}
+
+func (o *overlay) Put(key datastore.Key, value []byte) error {
+	o.ops[key] = append([]byte{}, value...)
+	o.puts++
+	return nil
+}
+
+func (o *overlay) Delete(key datastore.Key) error {
+	o.ops[key] = nil
+	o.deletes++
+	return nil
+}
+
+// Query merges the buffered writes in the entries of ds, the keys of the
+// storage package are hidden.
+func (o *overlay) Query(q query.Query) (query.Results, error) {
+	res, err := o.ds.Query(query.Query{Prefix: q.Prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(raw))
+	for _, e := range raw {
+		values[e.Key] = e.Value
+	}
+
+	prefix := datastore.NewKey(q.Prefix)
+	for key, value := range o.ops {
+		if prefix.String() != "/" && !prefix.IsAncestorOf(key) {
+			continue
+		}
+
+		if value == nil {
+			delete(values, key.String())
+		} else {
+			values[key.String()] = value
+		}
+	}
+
+	entries := make([]query.Entry, 0, len(values))
+	for key, value := range values {
+		if strings.HasPrefix(key, "/_storage/") {
+			continue
+		}
+
+		e := query.Entry{Key: key, Value: value, Size: len(value)}
+		if q.KeysOnly {
+			e.Value = nil
+		}
+
+		entries = append(entries, e)
+	}
+
+	naive := q
+	naive.Prefix = ""
+
+	return query.NaiveQueryApply(naive, query.ResultsWithEntries(naive, entries)), nil
+}
+
+func (o *overlay) Sync(datastore.Key) error {
+	return nil
+}
+
+// Close leaves ds open.
+func (o *overlay) Close() error {
+	return nil
+}
+
+func (o *overlay) commit() error {
+	b, err := o.ds.Batch()
+	if err != nil {
+		return err
+	}
+
+	for key, value := range o.ops {
+		if value == nil {
+			err = b.Delete(key)
+		} else {
+			err = b.Put(key, value)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.Commit()
+}
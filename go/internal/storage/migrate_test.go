@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMigrations moves the entries of /old to /new, then adds a /count of
+// them
+func testMigrations() []Migration {
+	move := func(from, to string) func(ds datastore.Datastore) error {
+		return func(ds datastore.Datastore) error {
+			res, err := ds.Query(query.Query{Prefix: from})
+			if err != nil {
+				return err
+			}
+
+			entries, err := res.Rest()
+			if err != nil {
+				return err
+			}
+
+			for _, e := range entries {
+				key := datastore.NewKey(to).Child(datastore.NewKey(e.Key).BaseNamespace())
+				if err := ds.Put(key, e.Value); err != nil {
+					return err
+				}
+
+				if err := ds.Delete(datastore.NewKey(e.Key)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	}
+
+	return []Migration{
+		{Version: 1, Name: "move", Up: move("/old", "/new"), Down: move("/new", "/old")},
+		{
+			Version: 2,
+			Name:    "count",
+			Up: func(ds datastore.Datastore) error {
+				res, err := ds.Query(query.Query{Prefix: "/new", KeysOnly: true})
+				if err != nil {
+					return err
+				}
+
+				entries, err := res.Rest()
+				if err != nil {
+					return err
+				}
+
+				return ds.Put(datastore.NewKey("/count"), []byte(fmt.Sprint(len(entries))))
+			},
+			Down: func(ds datastore.Datastore) error {
+				return ds.Delete(datastore.NewKey("/count"))
+			},
+		},
+	}
+}
+
+func newTestMigrationDatastore(t *testing.T) Datastore {
+	t.Helper()
+
+	ds, err := Open(Opts{Path: InMemoryPath})
+	require.NoError(t, err)
+	t.Cleanup(func() { ds.Close() })
+
+	require.NoError(t, ds.Put(datastore.NewKey("/old/a"), []byte("1")))
+	require.NoError(t, ds.Put(datastore.NewKey("/old/b"), []byte("2")))
+
+	return ds
+}
+
+func TestMigrate(t *testing.T) {
+	ds := newTestMigrationDatastore(t)
+
+	report, err := Migrate(ds, testMigrations(), MigrateOpts{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.From)
+	assert.Equal(t, 2, report.To)
+	require.Len(t, report.Steps, 2)
+	assert.Equal(t, MigrationStep{Version: 1, Name: "move", Puts: 2, Deletes: 2}, report.Steps[0])
+
+	version, err := Version(ds)
+	require.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	value, err := ds.Get(datastore.NewKey("/count"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), value)
+
+	// already up to date
+	report, err = Migrate(ds, testMigrations(), MigrateOpts{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Steps)
+
+	// rollback
+	report, err = Migrate(ds, testMigrations(), MigrateOpts{Target: 1})
+	require.NoError(t, err)
+	require.Len(t, report.Steps, 1)
+	assert.True(t, report.Steps[0].Rollback)
+
+	has, err := ds.Has(datastore.NewKey("/count"))
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	version, err = Version(ds)
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	ds := newTestMigrationDatastore(t)
+
+	// the second step sees the changes of the first one
+	report, err := Migrate(ds, testMigrations(), MigrateOpts{DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, report.Steps, 2)
+	assert.Equal(t, 1, report.Steps[1].Puts)
+
+	version, err := Version(ds)
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	has, err := ds.Has(datastore.NewKey("/old/a"))
+	require.NoError(t, err)
+	assert.True(t, has)
+}
+
+func TestMigrateFailure(t *testing.T) {
+	ds := newTestMigrationDatastore(t)
+
+	migrations := testMigrations()
+	migrations[1].Up = func(ds datastore.Datastore) error {
+		if err := ds.Delete(datastore.NewKey("/new/a")); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("failure")
+	}
+
+	_, err := Migrate(ds, migrations, MigrateOpts{})
+	require.Error(t, err)
+
+	// the first migration is kept, nothing of the failed one
+	version, err := Version(ds)
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	has, err := ds.Has(datastore.NewKey("/new/a"))
+	require.NoError(t, err)
+	assert.True(t, has)
+}
+
+func TestMigrateFutureVersion(t *testing.T) {
+	ds := newTestMigrationDatastore(t)
+
+	_, err := Migrate(ds, testMigrations(), MigrateOpts{})
+	require.NoError(t, err)
+
+	// an older release
+	_, err = Migrate(ds, testMigrations()[:1], MigrateOpts{})
+	assert.True(t, errors.Is(err, ErrFutureVersion))
+
+	// a migration without Down can't be rolled back
+	migrations := testMigrations()
+	migrations[1].Down = nil
+	_, err = Migrate(ds, migrations, MigrateOpts{Target: 1})
+	assert.Error(t, err)
+
+	_, err = Migrate(ds, testMigrations(), MigrateOpts{Target: 3})
+	assert.Error(t, err)
+}
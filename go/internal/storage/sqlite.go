@@ -0,0 +1,197 @@
+// +build cgo
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	_ "github.com/mattn/go-sqlite3" // sqlite driver
+)
+
+func init() {
+	Register(BackendSQLite, openSQLite)
+}
+
+// sqliteDatastore keeps the entries in a single table of a sqlite file.
+type sqliteDatastore struct {
+	db *sql.DB
+}
+
+func openSQLite(opts Opts) (Datastore, error) {
+	// the WAL lets the readers run while writing, e.g. from an app extension
+	dsn := "file:" + filepath.Join(opts.Path, sqliteFile) + "?_journal_mode=WAL&_busy_timeout=5000"
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite serializes the writes anyway, a single connection avoids the
+	// busy errors
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS datastore (key TEXT PRIMARY KEY NOT NULL, value BLOB NOT NULL) WITHOUT ROWID`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create the sqlite datastore: %w", err)
+	}
+
+	return &sqliteDatastore{db: db}, nil
+}
+
+func (d *sqliteDatastore) Get(key datastore.Key) ([]byte, error) {
+	var value []byte
+	err := d.db.QueryRow(`SELECT value FROM datastore WHERE key = ?`, key.String()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, datastore.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (d *sqliteDatastore) Has(key datastore.Key) (bool, error) {
+	var exists bool
+	if err := d.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM datastore WHERE key = ?)`, key.String()).Scan(&exists); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func (d *sqliteDatastore) GetSize(key datastore.Key) (int, error) {
+	var size int
+	err := d.db.QueryRow(`SELECT length(value) FROM datastore WHERE key = ?`, key.String()).Scan(&size)
+	if err == sql.ErrNoRows {
+		return -1, datastore.ErrNotFound
+	} else if err != nil {
+		return -1, err
+	}
+
+	return size, nil
+}
+
+func (d *sqliteDatastore) Put(key datastore.Key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	_, err := d.db.Exec(`INSERT INTO datastore (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key.String(), value)
+	return err
+}
+
+func (d *sqliteDatastore) Delete(key datastore.Key) error {
+	_, err := d.db.Exec(`DELETE FROM datastore WHERE key = ?`, key.String())
+	return err
+}
+
+// Query selects the entries of the prefix in sqlite, the filters, orders,
+// offset and limit are applied on them.
+func (d *sqliteDatastore) Query(q query.Query) (query.Results, error) {
+	prefix := datastore.NewKey(q.Prefix).String()
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	// the keys are compared bytewise, the ones of the prefix sort before
+	// the prefix followed by the byte after '/'
+	upper := prefix[:len(prefix)-1] + "0"
+
+	rows, err := d.db.Query(`SELECT key, value FROM datastore WHERE key >= ? AND key < ? ORDER BY key`, prefix, upper)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []query.Entry{}
+	for rows.Next() {
+		var e query.Entry
+		if err := rows.Scan(&e.Key, &e.Value); err != nil {
+			return nil, err
+		}
+
+		e.Size = len(e.Value)
+		if q.KeysOnly {
+			e.Value = nil
+		}
+
+		entries = append(entries, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the prefix is already applied
+	naive := q
+	naive.Prefix = ""
+
+	return query.NaiveQueryApply(naive, query.ResultsWithEntries(naive, entries)), nil
+}
+
+func (d *sqliteDatastore) Sync(datastore.Key) error {
+	return nil
+}
+
+func (d *sqliteDatastore) Batch() (datastore.Batch, error) {
+	return &sqliteBatch{ds: d, ops: map[datastore.Key][]byte{}}, nil
+}
+
+func (d *sqliteDatastore) Close() error {
+	return d.db.Close()
+}
+
+// sqliteBatch applies its operations in a single transaction, a nil value
+// deletes the key.
+type sqliteBatch struct {
+	ds  *sqliteDatastore
+	ops map[datastore.Key][]byte
+}
+
+func (b *sqliteBatch) Put(key datastore.Key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	b.ops[key] = value
+	return nil
+}
+
+func (b *sqliteBatch) Delete(key datastore.Key) error {
+	b.ops[key] = nil
+	return nil
+}
+
+func (b *sqliteBatch) Commit() error {
+	tx, err := b.ds.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for key, value := range b.ops {
+		if value == nil {
+			_, err = tx.Exec(`DELETE FROM datastore WHERE key = ?`, key.String())
+		} else {
+			_, err = tx.Exec(`INSERT INTO datastore (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key.String(), value)
+		}
+
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	b.ops = map[datastore.Key][]byte{}
+
+	return nil
+}
+
+var _ datastore.Batching = (*sqliteDatastore)(nil)
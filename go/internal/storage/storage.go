@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	badger_opts "github.com/dgraph-io/badger/options"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	ipfs_badger "github.com/ipfs/go-ds-badger"
+)
+
+// Backend is the name of a storage backend.
+type Backend string
+
+const (
+	BackendMemory Backend = "memory"
+	BackendBadger Backend = "badger"
+	BackendSQLite Backend = "sqlite"
+)
+
+// InMemoryPath opens an in memory datastore whatever the backend.
+const InMemoryPath = ":memory:"
+
+// sqliteFile is the database of the sqlite backend in the directory
+const sqliteFile = "datastore.sqlite"
+
+// Datastore is the root datastore of a node, every backend implements it.
+// It is safe for concurrent use.
+type Datastore interface {
+	datastore.Batching
+}
+
+// Opts are the options of a datastore.
+type Opts struct {
+	// Backend defaults to the backend of the datastore already in Path, or
+	// to badger
+	Backend Backend
+
+	// Path is the directory of the datastore, it's created if missing
+	Path string
+
+	// LowMemory reads the value log of badger from the files instead of
+	// mapping it in memory, e.g. on mobile
+	LowMemory bool
+
+	// Secret encrypts the values at rest with a key derived from it, see
+	// NewEncrypted, the values are left in the clear if empty
+	Secret []byte
+
+	// Clear are the namespaces left in the clear in an encrypted datastore
+	Clear []datastore.Key
+}
+
+// OpenFunc opens a datastore of a backend.
+type OpenFunc func(opts Opts) (Datastore, error)
+
+var (
+	muBackends sync.RWMutex
+	backends   = map[Backend]OpenFunc{}
+)
+
+func init() {
+	Register(BackendMemory, openMemory)
+	Register(BackendBadger, openBadger)
+}
+
+// Register makes a backend available, replacing the one of the same name.
+func Register(b Backend, open OpenFunc) {
+	muBackends.Lock()
+	backends[b] = open
+	muBackends.Unlock()
+}
+
+// Backends returns the names of the available backends.
+func Backends() []Backend {
+	muBackends.RLock()
+	defer muBackends.RUnlock()
+
+	names := make([]Backend, 0, len(backends))
+	for b := range backends {
+		names = append(names, b)
+	}
+
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	return names
+}
+
+// ParseBackend returns the backend named s, the empty name is the default
+// one.
+func ParseBackend(s string) (Backend, error) {
+	b := Backend(strings.ToLower(strings.TrimSpace(s)))
+	if b == "" {
+		return "", nil
+	}
+
+	muBackends.RLock()
+	_, ok := backends[b]
+	muBackends.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("unknown storage backend %q, available: %v", s, Backends())
+	}
+
+	return b, nil
+}
+
+// Detect returns the backend of the datastore in path, empty if there is
+// none.
+func Detect(path string) Backend {
+	if path == "" || path == InMemoryPath {
+		return BackendMemory
+	}
+
+	if _, err := os.Stat(filepath.Join(path, sqliteFile)); err == nil {
+		return BackendSQLite
+	}
+
+	// badger keeps a manifest next to its tables
+	if _, err := os.Stat(filepath.Join(path, "MANIFEST")); err == nil {
+		return BackendBadger
+	}
+
+	return ""
+}
+
+// Open opens the datastore of the options.
+func Open(opts Opts) (Datastore, error) {
+	b := opts.Backend
+	if opts.Path == "" || opts.Path == InMemoryPath {
+		b = BackendMemory
+	}
+
+	if b == "" {
+		if b = Detect(opts.Path); b == "" {
+			b = BackendBadger
+		}
+	} else if existing := Detect(opts.Path); existing != "" && existing != b {
+		// the data would be left aside, it has to be migrated first
+		return nil, fmt.Errorf("%s holds a %s datastore, not a %s one", opts.Path, existing, b)
+	}
+
+	muBackends.RLock()
+	open, ok := backends[b]
+	muBackends.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("storage backend %q not available in this build", b)
+	}
+
+	if b != BackendMemory {
+		if err := os.MkdirAll(opts.Path, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	ds, err := open(opts)
+	if err != nil || len(opts.Secret) == 0 {
+		return ds, err
+	}
+
+	eds, err := NewEncrypted(ds, opts.Secret, opts.Clear...)
+	if err != nil {
+		ds.Close()
+		return nil, err
+	}
+
+	return eds, nil
+}
+
+func openMemory(Opts) (Datastore, error) {
+	return ds_sync.MutexWrap(datastore.NewMapDatastore()), nil
+}
+
+func openBadger(opts Opts) (Datastore, error) {
+	bopts := ipfs_badger.DefaultOptions
+	if opts.LowMemory {
+		bopts.Options = bopts.Options.WithValueLogLoadingMode(badger_opts.FileIO)
+	}
+
+	ds, err := ipfs_badger.NewDatastore(opts.Path, &bopts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load datastore on: `%s`: %w", opts.Path, err)
+	}
+
+	return ds, nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDatastore(t *testing.T, ds Datastore) {
+	t.Helper()
+
+	_, err := ds.Get(datastore.NewKey("/missing"))
+	assert.Equal(t, datastore.ErrNotFound, err)
+
+	require.NoError(t, ds.Put(datastore.NewKey("/a/1"), []byte("one")))
+	require.NoError(t, ds.Put(datastore.NewKey("/a/2"), []byte("two")))
+	require.NoError(t, ds.Put(datastore.NewKey("/ab"), []byte("other")))
+	require.NoError(t, ds.Put(datastore.NewKey("/a/1"), []byte("uno")))
+
+	value, err := ds.Get(datastore.NewKey("/a/1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("uno"), value)
+
+	has, err := ds.Has(datastore.NewKey("/a/2"))
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	size, err := ds.GetSize(datastore.NewKey("/a/2"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, size)
+
+	// the prefix matches the children only
+	res, err := ds.Query(query.Query{Prefix: "/a", Orders: []query.Order{query.OrderByKey{}}})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "/a/1", entries[0].Key)
+	assert.Equal(t, []byte("two"), entries[1].Value)
+
+	res, err = ds.Query(query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	batch, err := ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, batch.Put(datastore.NewKey("/b"), []byte("batched")))
+	require.NoError(t, batch.Delete(datastore.NewKey("/ab")))
+	require.NoError(t, batch.Commit())
+
+	value, err = ds.Get(datastore.NewKey("/b"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("batched"), value)
+
+	require.NoError(t, ds.Delete(datastore.NewKey("/a/2")))
+	has, err = ds.Has(datastore.NewKey("/a/2"))
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	has, err = ds.Has(datastore.NewKey("/ab"))
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestBackends(t *testing.T) {
+	for _, b := range Backends() {
+		b := b
+		t.Run(string(b), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			path := dir
+			if b == BackendMemory {
+				path = InMemoryPath
+			}
+
+			ds, err := Open(Opts{Backend: b, Path: path})
+			require.NoError(t, err)
+			testDatastore(t, ds)
+			require.NoError(t, ds.Close())
+
+			if b == BackendMemory {
+				return
+			}
+
+			// the entries survive a restart, the backend is detected
+			assert.Equal(t, b, Detect(dir))
+
+			ds, err = Open(Opts{Path: dir})
+			require.NoError(t, err)
+			defer ds.Close()
+
+			value, err := ds.Get(datastore.NewKey("/b"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("batched"), value)
+		})
+	}
+}
+
+func TestOpenMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ds, err := Open(Opts{Backend: BackendBadger, Path: dir})
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+
+	// the badger data would be left aside
+	_, err = Open(Opts{Backend: BackendSQLite, Path: dir})
+	assert.Error(t, err)
+}
+
+func TestParseBackend(t *testing.T) {
+	b, err := ParseBackend(" Badger ")
+	require.NoError(t, err)
+	assert.Equal(t, BackendBadger, b)
+
+	b, err = ParseBackend("")
+	require.NoError(t, err)
+	assert.Equal(t, Backend(""), b)
+
+	_, err = ParseBackend("leveldb")
+	assert.Error(t, err)
+}
@@ -0,0 +1,12 @@
+// Package storeforward carries encrypted bundles for offline third parties:
+// the devices exchange the bundles they carry when they meet over a
+// proximity or a LAN link, until one of them reaches a device able to
+// deliver it.
+//
+// The bundles are opaque, only their tag, which identifies the destination
+// without revealing it, their expiry and their hop limit are seen by the
+// carriers. The carried bytes are capped by quotas, and the delivered bundles
+// are acknowledged: the acknowledgements spread like the bundles so the
+// carriers drop them. The sender chooses the lifetime of its bundles within
+// the limit of each carrier, and learns which of them expired undelivered.
+package storeforward
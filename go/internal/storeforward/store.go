@@ -0,0 +1,397 @@
+package storeforward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+var (
+	bundlesKey = ipfs_ds.NewKey("bundles")
+	acksKey    = ipfs_ds.NewKey("acks")
+	ownKey     = ipfs_ds.NewKey("own")
+)
+
+var (
+	// ErrQuotaExceeded is returned when a bundle doesn't fit in the quotas
+	ErrQuotaExceeded = fmt.Errorf("store-and-forward quota exceeded")
+
+	// ErrExpired is returned for the bundles past their expiry
+	ErrExpired = fmt.Errorf("bundle expired")
+)
+
+// Bundle is a payload carried for a destination.
+type Bundle struct {
+	// Tag identifies the destination, only the devices able to deliver the
+	// bundle know it
+	Tag []byte `json:"tag"`
+
+	// Payload is encrypted for the destination
+	Payload []byte `json:"payload"`
+
+	Expires time.Time `json:"expires"`
+
+	// Hops is the number of transfers left, it isn't part of the ID
+	Hops int `json:"hops"`
+}
+
+// ID identifies a bundle whatever its carrier.
+func (b *Bundle) ID() []byte {
+	h := sha256.New()
+	_, _ = h.Write(b.Tag)
+	_, _ = h.Write(b.Payload)
+
+	return h.Sum(nil)
+}
+
+func (b *Bundle) size() int64 {
+	return int64(len(b.Tag) + len(b.Payload))
+}
+
+// Stats are the bundles carried by the device.
+type Stats struct {
+	Bundles   int   `json:"bundles"`
+	Bytes     int64 `json:"bytes"`
+	Acks      int   `json:"acks"`
+	Delivered int   `json:"delivered"`
+}
+
+// bundleStore keeps the carried bundles and the acknowledgements, an index of
+// both is kept in memory. The bundles carried for the device are recorded
+// until they expire.
+type bundleStore struct {
+	ds   ipfs_ds.Datastore
+	opts Opts
+
+	muStore   sync.Mutex
+	bundles   map[string]*Bundle
+	acks      map[string]time.Time
+	own       map[string]struct{}
+	bytes     int64
+	tagBytes  map[string]int64
+	delivered int
+}
+
+func newBundleStore(opts Opts) (*bundleStore, error) {
+	s := &bundleStore{
+		ds:       opts.Datastore,
+		opts:     opts,
+		bundles:  make(map[string]*Bundle),
+		acks:     make(map[string]time.Time),
+		own:      make(map[string]struct{}),
+		tagBytes: make(map[string]int64),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *bundleStore) load() error {
+	results, err := s.ds.Query(query.Query{Prefix: bundlesKey.String()})
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return errcode.ErrInternal.Wrap(result.Error)
+		}
+
+		b := &Bundle{}
+		if err := json.Unmarshal(result.Value, b); err != nil {
+			_ = s.ds.Delete(ipfs_ds.NewKey(result.Key))
+			continue
+		}
+
+		s.index(b)
+	}
+
+	results, err = s.ds.Query(query.Query{Prefix: acksKey.String()})
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return errcode.ErrInternal.Wrap(result.Error)
+		}
+
+		var expires time.Time
+		if err := expires.UnmarshalText(result.Value); err != nil {
+			_ = s.ds.Delete(ipfs_ds.NewKey(result.Key))
+			continue
+		}
+
+		s.acks[ipfs_ds.RawKey(result.Key).BaseNamespace()] = expires
+	}
+
+	results, err = s.ds.Query(query.Query{Prefix: ownKey.String(), KeysOnly: true})
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return errcode.ErrInternal.Wrap(result.Error)
+		}
+
+		s.own[ipfs_ds.RawKey(result.Key).BaseNamespace()] = struct{}{}
+	}
+
+	return nil
+}
+
+func (s *bundleStore) index(b *Bundle) {
+	id := hex.EncodeToString(b.ID())
+	s.bundles[id] = b
+	s.bytes += b.size()
+	s.tagBytes[string(b.Tag)] += b.size()
+}
+
+func (s *bundleStore) unindex(id string) {
+	b, ok := s.bundles[id]
+	if !ok {
+		return
+	}
+
+	delete(s.bundles, id)
+	s.bytes -= b.size()
+	if s.tagBytes[string(b.Tag)] -= b.size(); s.tagBytes[string(b.Tag)] <= 0 {
+		delete(s.tagBytes, string(b.Tag))
+	}
+}
+
+// validate checks the limits of a bundle, whatever the quotas.
+func (s *bundleStore) validate(b *Bundle, now time.Time) error {
+	if len(b.Tag) == 0 || len(b.Payload) == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("empty bundle"))
+	}
+
+	if b.size() > int64(s.opts.MaxBundleSize) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("bundle of %d bytes, max %d", b.size(), s.opts.MaxBundleSize))
+	}
+
+	if !b.Expires.After(now) {
+		return ErrExpired
+	}
+
+	if b.Expires.After(now.Add(s.opts.MaxTTL)) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("bundle expires in %s, max %s", b.Expires.Sub(now).Round(time.Second), s.opts.MaxTTL))
+	}
+
+	return nil
+}
+
+// known reports whether the bundle is carried or was delivered.
+func (s *bundleStore) known(id []byte) bool {
+	s.muStore.Lock()
+	defer s.muStore.Unlock()
+
+	key := hex.EncodeToString(id)
+	_, carried := s.bundles[key]
+	_, acked := s.acks[key]
+
+	return carried || acked
+}
+
+// put carries a bundle within the quotas, own is set for the bundles carried
+// for the device.
+func (s *bundleStore) put(b *Bundle, own bool) error {
+	s.muStore.Lock()
+	defer s.muStore.Unlock()
+
+	id := hex.EncodeToString(b.ID())
+	if _, ok := s.bundles[id]; ok {
+		return nil
+	}
+
+	if _, ok := s.acks[id]; ok {
+		return nil
+	}
+
+	if s.bytes+b.size() > s.opts.MaxBytes || s.tagBytes[string(b.Tag)]+b.size() > s.opts.MaxTagBytes {
+		return ErrQuotaExceeded
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := s.ds.Put(bundlesKey.ChildString(id), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if own {
+		if err := s.ds.Put(ownKey.ChildString(id), []byte{}); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		s.own[id] = struct{}{}
+	}
+
+	s.index(b)
+
+	return nil
+}
+
+// get returns a carried bundle, nil if it isn't.
+func (s *bundleStore) get(id string) *Bundle {
+	s.muStore.Lock()
+	defer s.muStore.Unlock()
+
+	return s.bundles[id]
+}
+
+// lookup returns the bundles carried for a tag.
+func (s *bundleStore) lookup(tag []byte) []*Bundle {
+	s.muStore.Lock()
+	defer s.muStore.Unlock()
+
+	bundles := []*Bundle{}
+	for _, b := range s.bundles {
+		if bytes.Equal(b.Tag, tag) {
+			bundles = append(bundles, b)
+		}
+	}
+
+	return bundles
+}
+
+// ack records the delivery of a bundle and drops it, the acknowledgement is
+// kept until the bundle expires.
+func (s *bundleStore) ack(id string, expires time.Time, delivered bool) error {
+	s.muStore.Lock()
+	defer s.muStore.Unlock()
+
+	if delivered {
+		s.delivered++
+	}
+
+	if _, ok := s.acks[id]; ok {
+		return nil
+	}
+
+	data, err := expires.MarshalText()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := s.ds.Put(acksKey.ChildString(id), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	s.acks[id] = expires
+
+	if _, ok := s.bundles[id]; ok {
+		s.unindex(id)
+		if err := s.ds.Delete(bundlesKey.ChildString(id)); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// expire drops the bundles and the acknowledgements past their expiry, it
+// returns the bundles of the device expired, with whether they were
+// delivered.
+func (s *bundleStore) expire(now time.Time) (map[string]bool, error) {
+	s.muStore.Lock()
+	defer s.muStore.Unlock()
+
+	expired := map[string]bool{}
+
+	for id, b := range s.bundles {
+		if !b.Expires.After(now) {
+			s.unindex(id)
+			if err := s.ds.Delete(bundlesKey.ChildString(id)); err != nil {
+				return expired, errcode.ErrInternal.Wrap(err)
+			}
+
+			if err := s.disown(id, false, expired); err != nil {
+				return expired, err
+			}
+		}
+	}
+
+	for id, expires := range s.acks {
+		if !expires.After(now) {
+			delete(s.acks, id)
+			if err := s.ds.Delete(acksKey.ChildString(id)); err != nil {
+				return expired, errcode.ErrInternal.Wrap(err)
+			}
+
+			if err := s.disown(id, true, expired); err != nil {
+				return expired, err
+			}
+		}
+	}
+
+	return expired, nil
+}
+
+func (s *bundleStore) disown(id string, delivered bool, expired map[string]bool) error {
+	if _, ok := s.own[id]; !ok {
+		return nil
+	}
+
+	if err := s.ds.Delete(ownKey.ChildString(id)); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	delete(s.own, id)
+	expired[id] = delivered
+
+	return nil
+}
+
+// summary returns the IDs of the carried bundles and the acknowledgements.
+func (s *bundleStore) summary() *summary {
+	s.muStore.Lock()
+	defer s.muStore.Unlock()
+
+	sum := &summary{
+		Have: make([]string, 0, len(s.bundles)),
+		Acks: make(map[string]time.Time, len(s.acks)),
+		Room: s.opts.MaxBytes - s.bytes,
+	}
+
+	for id := range s.bundles {
+		sum.Have = append(sum.Have, id)
+	}
+
+	for id, expires := range s.acks {
+		sum.Acks[id] = expires
+	}
+
+	// the bundles delivered by the peer don't use its quotas
+	if sum.Room < s.opts.DeliveryReserve {
+		sum.Room = s.opts.DeliveryReserve
+	}
+
+	return sum
+}
+
+func (s *bundleStore) stats() *Stats {
+	s.muStore.Lock()
+	defer s.muStore.Unlock()
+
+	return &Stats{
+		Bundles:   len(s.bundles),
+		Bytes:     s.bytes,
+		Acks:      len(s.acks),
+		Delivered: s.delivered,
+	}
+}
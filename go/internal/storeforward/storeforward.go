@@ -0,0 +1,602 @@
+package storeforward
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const ProtocolID = protocol.ID("/berty/storeforward/1.0.0")
+
+const (
+	// DefaultTTL is the lifetime of the bundles carried for the device
+	// without a TTL given
+	DefaultTTL = 72 * time.Hour
+
+	// DefaultMaxTTL caps the lifetime of the bundles accepted
+	DefaultMaxTTL = 7 * 24 * time.Hour
+
+	// DefaultHops is the number of transfers of the bundles carried for the
+	// device
+	DefaultHops = 4
+
+	DefaultMaxBytes        = 16 << 20
+	DefaultMaxTagBytes     = 2 << 20
+	DefaultMaxBundleSize   = 256 << 10
+	DefaultDeliveryReserve = 1 << 20
+
+	// DefaultExchangeInterval is the interval between two exchanges with the
+	// same peer
+	DefaultExchangeInterval = 5 * time.Minute
+
+	// DefaultMinCarrierScore is the score under which a peer isn't given the
+	// bundles carried, it still gives its own
+	DefaultMinCarrierScore = 30
+
+	exchangeTimeout = 2 * time.Minute
+
+	// the peer with the greatest ID starts the exchange only if the other one
+	// didn't in the meantime
+	exchangeDelay = 10 * time.Second
+
+	maxSummaryIDs = 10000
+)
+
+// DeliverFunc delivers a bundle if the device is its destination, it reports
+// whether the bundle was delivered.
+type DeliverFunc func(ctx context.Context, b *Bundle) (bool, error)
+
+// Opts configures a store-and-forward service.
+type Opts struct {
+	Logger *zap.Logger
+
+	// Datastore persists the carried bundles
+	Datastore ipfs_ds.Datastore
+
+	// Deliver is called with the bundles received before they are carried
+	Deliver DeliverFunc
+
+	// Expired is called once a bundle carried for the device expired, with
+	// whether it was delivered before
+	Expired func(id []byte, delivered bool)
+
+	// MaxBytes caps the carried bytes, MaxTagBytes those of a destination
+	MaxBytes    int64
+	MaxTagBytes int64
+
+	MaxBundleSize int
+	MaxTTL        time.Duration
+
+	// DeliveryReserve is the room announced to the peers once the quota is
+	// reached, for the bundles the device delivers
+	DeliveryReserve int64
+
+	ExchangeInterval time.Duration
+
+	// Scores are the reputations of the peers, the best carriers are
+	// exchanged with first and the exchanges are recorded in return
+	Scores          *ipfsutil.PeerScores
+	MinCarrierScore float64
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Datastore == nil {
+		opts.Datastore = ipfs_ds.NewMapDatastore()
+	}
+
+	if opts.Deliver == nil {
+		opts.Deliver = func(context.Context, *Bundle) (bool, error) { return false, nil }
+	}
+
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+
+	if opts.MaxTagBytes <= 0 {
+		opts.MaxTagBytes = DefaultMaxTagBytes
+	}
+
+	if opts.MaxBundleSize <= 0 {
+		opts.MaxBundleSize = DefaultMaxBundleSize
+	}
+
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = DefaultMaxTTL
+	}
+
+	if opts.DeliveryReserve <= 0 {
+		opts.DeliveryReserve = DefaultDeliveryReserve
+	}
+
+	if opts.ExchangeInterval <= 0 {
+		opts.ExchangeInterval = DefaultExchangeInterval
+	}
+
+	if opts.MinCarrierScore == 0 {
+		opts.MinCarrierScore = DefaultMinCarrierScore
+	}
+}
+
+// summary is sent by both peers at the beginning of an exchange.
+type summary struct {
+	Have []string             `json:"have"`
+	Acks map[string]time.Time `json:"acks"`
+
+	// Room is the bytes the peer accepts
+	Room int64 `json:"room"`
+}
+
+// frame is a message of an exchange, the bundles sent are followed by a done
+// frame.
+type frame struct {
+	Summary *summary `json:"summary,omitempty"`
+	Bundle  *Bundle  `json:"bundle,omitempty"`
+	Done    bool     `json:"done,omitempty"`
+}
+
+// Service exchanges the carried bundles with the peers met over a proximity or
+// a LAN link.
+type Service struct {
+	logger *zap.Logger
+	host   host.Host
+	store  *bundleStore
+	opts   Opts
+
+	muExchanges sync.Mutex
+	exchanges   map[peer.ID]time.Time
+}
+
+// New registers the store-and-forward protocol on the host.
+func New(h host.Host, opts Opts) (*Service, error) {
+	opts.applyDefaults()
+
+	store, err := newBundleStore(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		logger:    opts.Logger,
+		host:      h,
+		store:     store,
+		opts:      opts,
+		exchanges: make(map[peer.ID]time.Time),
+	}
+
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+
+	return s, nil
+}
+
+// Start exchanges the bundles with the peers met until the context is done.
+func (s *Service) Start(ctx context.Context) {
+	s.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if !opportunistic(c) {
+				return
+			}
+
+			go s.exchangeOnConnect(ctx, c.RemotePeer())
+		},
+	})
+
+	go func() {
+		ticker := time.NewTicker(s.opts.ExchangeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.expire(time.Now()); err != nil {
+					s.logger.Warn("unable to expire bundles", zap.Error(err))
+				}
+
+				peers := []peer.ID{}
+				for _, p := range s.host.Network().Peers() {
+					if s.opportunisticPeer(p) {
+						peers = append(peers, p)
+					}
+				}
+
+				s.opts.Scores.Rank(peers)
+				for _, p := range peers {
+					s.exchange(ctx, p)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Carry adds a bundle for the destination of a payload and returns its ID.
+// The bundle lives for the TTL of the sender, DefaultTTL if zero, within the
+// MaxTTL of the device.
+func (s *Service) Carry(tag []byte, payload []byte, ttl time.Duration) ([]byte, error) {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	if ttl > s.opts.MaxTTL {
+		ttl = s.opts.MaxTTL
+	}
+
+	now := time.Now()
+	b := &Bundle{
+		Tag:     tag,
+		Payload: payload,
+		Expires: now.Add(ttl),
+		Hops:    DefaultHops,
+	}
+
+	if err := s.store.validate(b, now); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.put(b, true); err != nil {
+		return nil, err
+	}
+
+	return b.ID(), nil
+}
+
+// expire drops the bundles past their expiry, the ones carried for the
+// device are reported.
+func (s *Service) expire(now time.Time) error {
+	expired, err := s.store.expire(now)
+
+	if s.opts.Expired != nil {
+		for id, delivered := range expired {
+			raw, err := hex.DecodeString(id)
+			if err != nil {
+				continue
+			}
+
+			s.opts.Expired(raw, delivered)
+		}
+	}
+
+	return err
+}
+
+// Lookup returns the unexpired bundles carried for a tag, e.g. for the
+// bundles published to whoever knows the tag rather than delivered.
+func (s *Service) Lookup(tag []byte) []*Bundle {
+	now := time.Now()
+	bundles := []*Bundle{}
+	for _, b := range s.store.lookup(tag) {
+		if b.Expires.After(now) {
+			bundles = append(bundles, b)
+		}
+	}
+
+	return bundles
+}
+
+// Stats returns the bundles carried by the device.
+func (s *Service) Stats() *Stats {
+	return s.store.stats()
+}
+
+// opportunistic reports whether the bundles are exchanged over the
+// connection, the exchanges don't go through the internet.
+func opportunistic(c network.Conn) bool {
+	switch ipfsutil.ClassifyAddr(c.RemoteMultiaddr()) {
+	case ipfsutil.ClassBLE, ipfsutil.ClassWifi, ipfsutil.ClassLAN:
+		return true
+	}
+
+	return false
+}
+
+func (s *Service) opportunisticPeer(p peer.ID) bool {
+	for _, c := range s.host.Network().ConnsToPeer(p) {
+		if opportunistic(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Service) exchangeOnConnect(ctx context.Context, p peer.ID) {
+	if s.host.ID() > p {
+		select {
+		case <-time.After(exchangeDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	s.exchange(ctx, p)
+}
+
+// begin reports whether an exchange with the peer can start, an exchange is
+// done at most once by interval.
+func (s *Service) begin(p peer.ID) bool {
+	s.muExchanges.Lock()
+	defer s.muExchanges.Unlock()
+
+	now := time.Now()
+	if last, ok := s.exchanges[p]; ok && now.Sub(last) < s.opts.ExchangeInterval {
+		return false
+	}
+
+	for pid, last := range s.exchanges {
+		if now.Sub(last) >= s.opts.ExchangeInterval {
+			delete(s.exchanges, pid)
+		}
+	}
+
+	s.exchanges[p] = now
+
+	return true
+}
+
+func (s *Service) exchange(ctx context.Context, p peer.ID) {
+	if !s.begin(p) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(network.WithNoDial(ctx, "storeforward"), p, ProtocolID)
+	if err != nil {
+		s.logger.Debug("unable to start exchange", zap.Stringer("peer", p), zap.Error(err))
+		return
+	}
+	defer stream.Close()
+
+	err = s.run(ctx, stream, true)
+	s.recordExchange(p, err)
+
+	if err != nil {
+		s.logger.Debug("exchange failed", zap.Stringer("peer", p), zap.Error(err))
+		_ = stream.Reset()
+	}
+}
+
+func (s *Service) handleStream(stream network.Stream) {
+	defer stream.Close()
+
+	p := stream.Conn().RemotePeer()
+	if !opportunistic(stream.Conn()) {
+		_ = stream.Reset()
+		return
+	}
+
+	s.muExchanges.Lock()
+	s.exchanges[p] = time.Now()
+	s.muExchanges.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+	defer cancel()
+
+	err := s.run(ctx, stream, false)
+	s.recordExchange(p, err)
+
+	if err != nil {
+		s.logger.Debug("exchange failed", zap.Stringer("peer", p), zap.Error(err))
+		_ = stream.Reset()
+	}
+}
+
+// recordExchange scores the peer by the outcome of an exchange, the frames
+// breaking the protocol are misbehaviors.
+func (s *Service) recordExchange(p peer.ID, err error) {
+	switch {
+	case err == nil:
+		s.opts.Scores.RecordDelivery(p, true)
+	case err == ErrQuotaExceeded, errcode.Is(err, errcode.ErrInvalidInput):
+		s.opts.Scores.RecordMisbehavior(p, err.Error())
+	default:
+		s.opts.Scores.RecordDelivery(p, false)
+	}
+}
+
+// carrier reports whether the carried bundles are given to the peer.
+func (s *Service) carrier(p peer.ID) bool {
+	return s.opts.Scores == nil || s.opts.Scores.Score(p) >= s.opts.MinCarrierScore
+}
+
+// run exchanges the summaries, then the initiator receives the bundles it
+// doesn't know before sending the ones the responder doesn't know.
+func (s *Service) run(ctx context.Context, stream network.Stream, initiator bool) error {
+	_ = stream.SetDeadline(time.Now().Add(exchangeTimeout))
+
+	// the bundles received are capped by the room announced, they are
+	// base64 encoded
+	local := s.store.summary()
+	dec := json.NewDecoder(io.LimitReader(stream, 2*local.Room+int64(maxSummaryIDs)*256))
+	enc := json.NewEncoder(stream)
+
+	var remote *summary
+	if initiator {
+		if err := enc.Encode(&frame{Summary: local}); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+		var err error
+		if remote, err = readSummary(dec); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if remote, err = readSummary(dec); err != nil {
+			return err
+		}
+
+		if err := enc.Encode(&frame{Summary: local}); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+	}
+
+	s.applyAcks(remote.Acks)
+
+	// the unreliable peers only get the acks, they give their bundles
+	if !s.carrier(stream.Conn().RemotePeer()) {
+		remote.Room = 0
+	}
+
+	if initiator {
+		if err := s.receive(ctx, dec, local.Room); err != nil {
+			return err
+		}
+
+		return s.send(enc, remote)
+	}
+
+	if err := s.send(enc, remote); err != nil {
+		return err
+	}
+
+	return s.receive(ctx, dec, local.Room)
+}
+
+func readSummary(dec *json.Decoder) (*summary, error) {
+	f := &frame{}
+	if err := dec.Decode(f); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if f.Summary == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("summary expected"))
+	}
+
+	if len(f.Summary.Have) > maxSummaryIDs || len(f.Summary.Acks) > maxSummaryIDs {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("summary too large"))
+	}
+
+	return f.Summary, nil
+}
+
+// applyAcks drops the bundles delivered according to the peer.
+func (s *Service) applyAcks(acks map[string]time.Time) {
+	now := time.Now()
+	for id, expires := range acks {
+		if !expires.After(now) {
+			continue
+		}
+
+		if expires.After(now.Add(s.opts.MaxTTL)) {
+			expires = now.Add(s.opts.MaxTTL)
+		}
+
+		if err := s.store.ack(id, expires, false); err != nil {
+			s.logger.Warn("unable to record ack", zap.Error(err))
+		}
+	}
+}
+
+// send sends the bundles the peer doesn't know, within its room.
+func (s *Service) send(enc *json.Encoder, remote *summary) error {
+	known := make(map[string]struct{}, len(remote.Have)+len(remote.Acks))
+	for _, id := range remote.Have {
+		known[id] = struct{}{}
+	}
+
+	for id := range remote.Acks {
+		known[id] = struct{}{}
+	}
+
+	room := remote.Room
+	for _, id := range s.store.summary().Have {
+		if _, ok := known[id]; ok {
+			continue
+		}
+
+		b := s.store.get(id)
+		if b == nil || b.Hops <= 0 || b.size() > room {
+			continue
+		}
+
+		sent := *b
+		sent.Hops--
+
+		if err := enc.Encode(&frame{Bundle: &sent}); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+		room -= b.size()
+	}
+
+	if err := enc.Encode(&frame{Done: true}); err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return nil
+}
+
+// receive delivers or carries the bundles sent by the peer.
+func (s *Service) receive(ctx context.Context, dec *json.Decoder, room int64) error {
+	for {
+		f := &frame{}
+		if err := dec.Decode(f); err != nil {
+			return errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if f.Done {
+			return nil
+		}
+
+		if f.Bundle == nil {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("bundle expected"))
+		}
+
+		if room -= f.Bundle.size(); room < 0 {
+			return ErrQuotaExceeded
+		}
+
+		if err := s.accept(ctx, f.Bundle); err != nil {
+			s.logger.Debug("bundle dropped", zap.Error(err))
+		}
+	}
+}
+
+func (s *Service) accept(ctx context.Context, b *Bundle) error {
+	// the bundles are carried for the TTL of their sender within the MaxTTL
+	// of the device
+	now := time.Now()
+	if max := now.Add(s.opts.MaxTTL); b.Expires.After(max) {
+		b.Expires = max
+	}
+
+	if err := s.store.validate(b, now); err != nil {
+		return err
+	}
+
+	id := b.ID()
+	if s.store.known(id) {
+		return nil
+	}
+
+	delivered, err := s.opts.Deliver(ctx, b)
+	if err != nil {
+		return err
+	}
+
+	if delivered {
+		s.logger.Debug("bundle delivered", zap.String("id", fmt.Sprintf("%.12s", hex.EncodeToString(id))))
+		return s.store.ack(hex.EncodeToString(id), b.Expires, true)
+	}
+
+	return s.store.put(b, false)
+}
@@ -0,0 +1,234 @@
+package storeforward
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	ipfs_ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func testService(t *testing.T, ds ipfs_ds.Datastore, deliver DeliverFunc) *Service {
+	t.Helper()
+
+	opts := Opts{
+		Datastore:       ds,
+		Deliver:         deliver,
+		MaxBytes:        1000,
+		MaxTagBytes:     600,
+		MaxBundleSize:   500,
+		DeliveryReserve: 100,
+	}
+	opts.applyDefaults()
+
+	store, err := newBundleStore(opts)
+	require.NoError(t, err)
+
+	return &Service{
+		logger:    zap.NewNop(),
+		store:     store,
+		opts:      opts,
+		exchanges: make(map[peer.ID]time.Time),
+	}
+}
+
+func carry(s *Service, tag, payload []byte) error {
+	_, err := s.Carry(tag, payload, 0)
+	return err
+}
+
+func TestCarryQuotas(t *testing.T) {
+	s := testService(t, nil, nil)
+	payload := bytes.Repeat([]byte{1}, 399)
+
+	require.NoError(t, carry(s, []byte("a"), payload))
+
+	// the same bundle is carried once
+	require.NoError(t, carry(s, []byte("a"), payload))
+	assert.Equal(t, 1, s.Stats().Bundles)
+
+	assert.Equal(t, ErrQuotaExceeded, carry(s, []byte("a"), bytes.Repeat([]byte{2}, 399)))
+	require.NoError(t, carry(s, []byte("b"), payload))
+	assert.Equal(t, ErrQuotaExceeded, carry(s, []byte("c"), payload))
+
+	assert.Error(t, carry(s, []byte("d"), bytes.Repeat([]byte{3}, 600)))
+	assert.Equal(t, int64(800), s.Stats().Bytes)
+}
+
+func TestAckPersisted(t *testing.T) {
+	ds := ipfs_ds.NewMapDatastore()
+	s := testService(t, ds, nil)
+
+	require.NoError(t, carry(s, []byte("a"), []byte("payload")))
+	id := s.store.summary().Have[0]
+
+	require.NoError(t, s.store.ack(id, time.Now().Add(time.Hour), false))
+	assert.Equal(t, 0, s.Stats().Bundles)
+
+	reloaded := testService(t, ds, nil)
+	assert.Equal(t, 0, reloaded.Stats().Bundles)
+	assert.Equal(t, 1, reloaded.Stats().Acks)
+
+	// a delivered bundle isn't carried again
+	require.NoError(t, carry(reloaded, []byte("a"), []byte("payload")))
+	assert.Equal(t, 0, reloaded.Stats().Bundles)
+}
+
+func TestExpire(t *testing.T) {
+	s := testService(t, nil, nil)
+
+	require.NoError(t, carry(s, []byte("a"), []byte("payload")))
+	_, err := s.store.expire(time.Now().Add(DefaultTTL + time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 0, s.Stats().Bundles)
+
+	expired := &Bundle{Tag: []byte("a"), Payload: []byte("payload"), Expires: time.Now().Add(-time.Second), Hops: 1}
+	assert.Equal(t, ErrExpired, s.accept(context.Background(), expired))
+}
+
+func TestAcceptMaxTTL(t *testing.T) {
+	s := testService(t, nil, nil)
+	now := time.Now()
+
+	// the bundles are carried within the limit of the carrier
+	received := &Bundle{Tag: []byte("b"), Payload: []byte("received"), Expires: now.Add(2 * DefaultMaxTTL), Hops: 1}
+	require.NoError(t, s.accept(context.Background(), received))
+	assert.WithinDuration(t, now.Add(DefaultMaxTTL), s.store.get(hex.EncodeToString(received.ID())).Expires, time.Second)
+}
+
+func TestCarryTTL(t *testing.T) {
+	ds := ipfs_ds.NewMapDatastore()
+	s := testService(t, ds, nil)
+	now := time.Now()
+
+	short, err := s.Carry([]byte("a"), []byte("short"), time.Minute)
+	require.NoError(t, err)
+
+	b := s.store.get(hex.EncodeToString(short))
+	require.NotNil(t, b)
+	assert.WithinDuration(t, now.Add(time.Minute), b.Expires, time.Second)
+
+	// the TTL of the sender is capped by the policy of the carrier
+	long, err := s.Carry([]byte("a"), []byte("long"), 2*DefaultMaxTTL)
+	require.NoError(t, err)
+	assert.WithinDuration(t, now.Add(DefaultMaxTTL), s.store.get(hex.EncodeToString(long)).Expires, time.Second)
+
+	delivered, err := s.Carry([]byte("a"), []byte("delivered"), time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, s.store.ack(hex.EncodeToString(delivered), now.Add(time.Minute), false))
+
+	// the bundles of the device are reported once expired, whether they were
+	// delivered or not, after a restart too
+	s = testService(t, ds, nil)
+
+	expired := map[string]bool{}
+	s.opts.Expired = func(id []byte, ok bool) { expired[string(id)] = ok }
+
+	require.NoError(t, s.expire(now.Add(2*time.Minute)))
+	assert.Equal(t, map[string]bool{string(short): false, string(delivered): true}, expired)
+
+	require.NoError(t, s.expire(now.Add(DefaultMaxTTL+time.Minute)))
+	assert.Len(t, expired, 3)
+	assert.False(t, expired[string(long)])
+	assert.Equal(t, 0, s.Stats().Bundles)
+}
+
+func TestLookup(t *testing.T) {
+	s := testService(t, nil, nil)
+
+	require.NoError(t, carry(s, []byte("a"), []byte("payload 1")))
+	require.NoError(t, carry(s, []byte("a"), []byte("payload 2")))
+	require.NoError(t, carry(s, []byte("b"), []byte("payload 3")))
+
+	assert.Len(t, s.Lookup([]byte("a")), 2)
+	assert.Len(t, s.Lookup([]byte("c")), 0)
+}
+
+func transfer(t *testing.T, from, to *Service) {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, from.send(json.NewEncoder(buf), to.store.summary()))
+	require.NoError(t, to.receive(context.Background(), json.NewDecoder(buf), to.store.summary().Room))
+}
+
+func TestTransferAndDelivery(t *testing.T) {
+	origin := testService(t, nil, nil)
+	carrier := testService(t, nil, nil)
+	recipient := testService(t, nil, func(_ context.Context, b *Bundle) (bool, error) {
+		return bytes.Equal(b.Tag, []byte("recipient")), nil
+	})
+
+	require.NoError(t, carry(origin, []byte("recipient"), []byte("payload")))
+	id := origin.store.summary().Have[0]
+
+	transfer(t, origin, carrier)
+	carried := carrier.store.get(id)
+	require.NotNil(t, carried)
+	assert.Equal(t, DefaultHops-1, carried.Hops)
+
+	// the bundles known by the peer aren't sent again
+	transfer(t, origin, carrier)
+	assert.Equal(t, 1, carrier.Stats().Bundles)
+
+	transfer(t, carrier, recipient)
+	assert.Equal(t, 0, recipient.Stats().Bundles)
+	assert.Equal(t, 1, recipient.Stats().Delivered)
+
+	// the acknowledgement spreads back to the carriers
+	carrier.applyAcks(recipient.store.summary().Acks)
+	origin.applyAcks(carrier.store.summary().Acks)
+	assert.Equal(t, 0, carrier.Stats().Bundles)
+	assert.Equal(t, 0, origin.Stats().Bundles)
+	assert.True(t, origin.store.known(mustDecodeHex(t, id)))
+}
+
+func TestHopLimit(t *testing.T) {
+	origin := testService(t, nil, nil)
+	require.NoError(t, origin.store.put(&Bundle{Tag: []byte("a"), Payload: []byte("payload"), Expires: time.Now().Add(time.Hour), Hops: 0}, false))
+
+	carrier := testService(t, nil, nil)
+	transfer(t, origin, carrier)
+	assert.Equal(t, 0, carrier.Stats().Bundles)
+}
+
+func TestCarrierScores(t *testing.T) {
+	s := testService(t, nil, nil)
+	p := peer.ID("carrier")
+
+	// every peer is a carrier without the scores
+	assert.True(t, s.carrier(p))
+
+	scores, err := ipfsutil.NewPeerScores(nil, ipfsutil.PeerScoresOpts{})
+	require.NoError(t, err)
+	s.opts.Scores = scores
+
+	s.recordExchange(p, nil)
+	assert.True(t, s.carrier(p))
+
+	// a bundle over the room announced is a misbehavior
+	s.recordExchange(p, ErrQuotaExceeded)
+	assert.False(t, s.carrier(p))
+	assert.Less(t, scores.Score(p), scores.Score(peer.ID("other")))
+
+	peers := []peer.ID{p, peer.ID("other")}
+	scores.Rank(peers)
+	assert.Equal(t, peer.ID("other"), peers[0])
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+
+	return b
+}
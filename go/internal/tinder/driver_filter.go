@@ -0,0 +1,51 @@
+package tinder
+
+import (
+	"context"
+
+	p2p_discovery "github.com/libp2p/go-libp2p-core/discovery"
+	p2p_peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// filterDriver is a Driver
+var _ Driver = (*filterDriver)(nil)
+
+// filterDriver drops the peers found by a driver that don't pass the filter,
+// e.g. the blocked ones.
+type filterDriver struct {
+	Driver
+
+	filter func(p2p_peer.ID) bool
+}
+
+// NewFilterDriver returns a driver only forwarding the peers found for which
+// the filter returns true.
+func NewFilterDriver(driver Driver, filter func(p2p_peer.ID) bool) Driver {
+	return &filterDriver{Driver: driver, filter: filter}
+}
+
+func (fd *filterDriver) FindPeers(ctx context.Context, ns string, opts ...p2p_discovery.Option) (<-chan p2p_peer.AddrInfo, error) {
+	in, err := fd.Driver.FindPeers(ctx, ns, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan p2p_peer.AddrInfo)
+	go func() {
+		defer close(out)
+
+		for peer := range in {
+			if !fd.filter(peer.ID) {
+				continue
+			}
+
+			select {
+			case out <- peer:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,42 @@
+package tinder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	p2p_discovery "github.com/libp2p/go-libp2p-core/discovery"
+	p2p_host "github.com/libp2p/go-libp2p-core/host"
+	p2p_peer "github.com/libp2p/go-libp2p-core/peer"
+	p2p_disc "github.com/libp2p/go-libp2p-discovery"
+	p2p_mock "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterDriver_FindPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ms := NewMockedDriverServer()
+	mn := p2p_mock.New(ctx)
+
+	peers := testingPeers(t, mn, 3)
+	drivers := testingMockedDriverClients(t, ms, peers...)
+
+	const testKey = "testkey"
+	for _, d := range drivers {
+		_, err := d.Advertise(ctx, testKey, p2p_discovery.TTL(time.Minute))
+		require.NoError(t, err)
+	}
+
+	blocked := peers[1].ID()
+	fd := NewFilterDriver(drivers[0], func(pid p2p_peer.ID) bool { return pid != blocked })
+
+	ps, err := p2p_disc.FindPeers(ctx, fd, testKey)
+	require.NoError(t, err)
+
+	assert.Contains(t, ps, *p2p_host.InfoFromHost(peers[0]))
+	assert.Contains(t, ps, *p2p_host.InfoFromHost(peers[2]))
+	assert.NotContains(t, ps, *p2p_host.InfoFromHost(peers[1]))
+}
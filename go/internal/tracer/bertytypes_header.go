@@ -40,7 +40,14 @@ func ExtractSpanContextFromMessageHeaders(ctx context.Context, h *bertytypes.Mes
 }
 
 func SpanFromMessageHeaders(ctx context.Context, h *bertytypes.MessageHeaders, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	return StartFromMessageHeaders(From(ctx), h, name, attrs...)
+}
+
+// StartFromMessageHeaders starts a span of the given tracer linked to the
+// span of the sender of a message, for the background receivers which don't
+// have a span in their context.
+func StartFromMessageHeaders(tr trace.Tracer, h *bertytypes.MessageHeaders, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
 	hctx := ExtractSpanContextFromMessageHeaders(context.Background(), h)
 	sctx := trace.RemoteSpanContextFromContext(hctx)
-	return From(ctx).Start(hctx, name, trace.LinkedTo(sctx))
+	return tr.Start(hctx, name, trace.LinkedTo(sctx), trace.WithAttributes(attrs...))
 }
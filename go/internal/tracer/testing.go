@@ -1,12 +1,16 @@
 package tracer
 
 import (
+	"context"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel/api/global"
 	"go.opentelemetry.io/otel/api/trace"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func NewTestingProvider(t *testing.T, name string) trace.Provider {
@@ -34,3 +38,54 @@ func NewTestingProvider(t *testing.T, name string) trace.Provider {
 	SetGlobalTraceProvider(tp)
 	return tp
 }
+
+// SpanRecorder keeps the spans once they are ended, e.g. to check the spans
+// of a test, see NewRecordingProvider.
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []*export.SpanData
+}
+
+func (r *SpanRecorder) ExportSpan(_ context.Context, span *export.SpanData) {
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+}
+
+// Spans returns the spans of a name ended so far.
+func (r *SpanRecorder) Spans(name string) []*export.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := []*export.SpanData{}
+	for _, span := range r.spans {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+// Reset forgets the spans ended so far.
+func (r *SpanRecorder) Reset() {
+	r.mu.Lock()
+	r.spans = nil
+	r.mu.Unlock()
+}
+
+// NewRecordingProvider returns a provider recording every span, it is the
+// global provider until the end of the test.
+func NewRecordingProvider(t *testing.T) (trace.Provider, *SpanRecorder) {
+	r := &SpanRecorder{}
+	tp, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithSyncer(r),
+	)
+	require.NoError(t, err)
+
+	SetGlobalTraceProvider(tp)
+	t.Cleanup(func() { SetGlobalTraceProvider(&trace.NoopProvider{}) })
+
+	return tp, r
+}
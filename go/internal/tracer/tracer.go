@@ -30,14 +30,27 @@ type Config struct {
 	ServiceName     string
 	RuntimeProvider bool
 
+	// SampleRatio is the fraction of the traces exported, all of them if it
+	// isn't in ]0, 1[
+	SampleRatio float64
+
 	// Jaeger config
 	JaegerHost string
 }
 
-func InitTracer(flag, service string) func() {
+func (cfg *Config) sampler() sdktrace.Sampler {
+	if cfg.SampleRatio <= 0 || cfg.SampleRatio >= 1 {
+		return sdktrace.AlwaysSample()
+	}
+
+	return sdktrace.ProbabilitySampler(cfg.SampleRatio)
+}
+
+func InitTracer(flag, service string, sampleRatio float64) func() {
 	cfg := &Config{
 		RuntimeProvider: true,
 		ServiceName:     service,
+		SampleRatio:     sampleRatio,
 	}
 
 	switch flag {
@@ -62,9 +75,10 @@ func InitTracer(flag, service string) func() {
 func ConfigureProvider(cfg *Config) (pt trace.Provider, cl Cleanup, err error) {
 	switch cfg.ExporterType {
 	case ExporterTypeJaeger:
-		pt, cl, err = NewJaegerProvider(cfg.JaegerHost, cfg.ServiceName)
+		pt, cl, err = NewJaegerProvider(cfg.JaegerHost, cfg.ServiceName, cfg.sampler())
 	case ExporterTypeStdout:
-		pt, err = NewStdoutProvider()
+		pt, err = NewStdoutProvider(cfg.sampler())
+		cl = func() {}
 	default:
 		pt, cl, err = &trace.NoopProvider{}, func() {}, nil
 		return
@@ -81,18 +95,18 @@ func SetGlobalTraceProvider(tp trace.Provider) {
 	global.SetTraceProvider(tp)
 }
 
-func NewStdoutProvider() (trace.Provider, error) {
+func NewStdoutProvider(sampler sdktrace.Sampler) (trace.Provider, error) {
 	exporter, err := stdout.NewExporter(stdout.Options{PrettyPrint: true})
 	if err != nil {
 		return nil, err
 	}
 	return sdktrace.NewProvider(sdktrace.WithConfig(
-		sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.Config{DefaultSampler: sampler}),
 		sdktrace.WithSyncer(exporter),
 	)
 }
 
-func NewJaegerProvider(host, service string) (trace.Provider, func(), error) {
+func NewJaegerProvider(host, service string, sampler sdktrace.Sampler) (trace.Provider, func(), error) {
 	return jaeger.NewExportPipeline(
 		jaeger.WithCollectorEndpoint(fmt.Sprintf("http://%s/api/traces", host)),
 		jaeger.WithProcess(jaeger.Process{
@@ -104,7 +118,7 @@ func NewJaegerProvider(host, service string) (trace.Provider, func(), error) {
 				kv.String("go", runtime.Version()),
 			},
 		}),
-		jaeger.WithSDK(&sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		jaeger.WithSDK(&sdktrace.Config{DefaultSampler: sampler}),
 	)
 }
 
@@ -0,0 +1,12 @@
+//
+//  awdl-driver.h
+//  awdl-driver
+//
+
+#import <Foundation/Foundation.h>
+
+int AWDLStart(char *localPID);
+void AWDLStop(void);
+int AWDLDialPeer(char *remotePID);
+int AWDLSendToPeer(char *remotePID, void *payload, int length);
+void AWDLCloseConnWithPeer(char *remotePID);
@@ -0,0 +1,232 @@
+// +build darwin
+
+#import <Network/Network.h>
+#import "awdl-driver.h"
+
+// This functions are Go functions so they aren't defined here
+extern int AWDLHandleFoundPeer(char *);
+extern void AWDLReceiveFromPeer(char *, void *, int);
+
+static NSString *BERTY_DRIVER_AWDL = @"_berty-awdl._tcp";
+
+static dispatch_queue_t gQueue = nil;
+static nw_listener_t gListener = nil;
+static nw_browser_t gBrowser = nil;
+static NSString *gLocalPID = nil;
+static NSMutableDictionary<NSString *, nw_connection_t> *gConns = nil;
+
+// The libp2p upgrader secures the conn, so TLS isn't needed here.
+// Including peer-to-peer interfaces is what enables AWDL.
+static nw_parameters_t awdlParameters(void) {
+    nw_parameters_t params = nw_parameters_create_secure_tcp(NW_PARAMETERS_DISABLE_PROTOCOL, NW_PARAMETERS_DEFAULT_CONFIGURATION);
+    nw_parameters_set_include_peer_to_peer(params, true);
+    return (params);
+}
+
+static void addConn(NSString *remotePID, nw_connection_t conn) {
+    @synchronized (gConns) {
+        gConns[remotePID] = conn;
+    }
+}
+
+static nw_connection_t getConn(NSString *remotePID) {
+    @synchronized (gConns) {
+        return (gConns[remotePID]);
+    }
+}
+
+static void removeConn(NSString *remotePID) {
+    nw_connection_t conn;
+    @synchronized (gConns) {
+        conn = gConns[remotePID];
+        [gConns removeObjectForKey:remotePID];
+    }
+    if (conn) {
+        nw_connection_cancel(conn);
+    }
+}
+
+static void receiveLoop(nw_connection_t conn, NSString *remotePID) {
+    nw_connection_receive(conn, 1, UINT32_MAX, ^(dispatch_data_t content, nw_content_context_t context, bool is_complete, nw_error_t error) {
+        if (content) {
+            dispatch_data_apply(content, ^bool(dispatch_data_t region, size_t offset, const void *buffer, size_t size) {
+                AWDLReceiveFromPeer((char *)[remotePID UTF8String], (void *)buffer, (int)size);
+                return (true);
+            });
+        }
+        if (error || is_complete) {
+            NSLog(@"AWDL: conn closed: %@", remotePID);
+            removeConn(remotePID);
+            return ;
+        }
+        receiveLoop(conn, remotePID);
+    });
+}
+
+// The initiator sends its peerID first, prefixed by its length, so the
+// listener side knows who is connected.
+static void sendHello(nw_connection_t conn) {
+    NSData *pid = [gLocalPID dataUsingEncoding:NSUTF8StringEncoding];
+    uint8_t length = (uint8_t)[pid length];
+    NSMutableData *hello = [NSMutableData dataWithBytes:&length length:1];
+    [hello appendData:pid];
+
+    dispatch_data_t data = dispatch_data_create([hello bytes], [hello length], gQueue, DISPATCH_DATA_DESTRUCTOR_DEFAULT);
+    nw_connection_send(conn, data, NW_CONNECTION_DEFAULT_MESSAGE_CONTEXT, true, ^(nw_error_t error) {
+        if (error) {
+            NSLog(@"AWDL: sendHello error: %@", error);
+        }
+    });
+}
+
+static void readHello(nw_connection_t conn) {
+    nw_connection_receive(conn, 1, 1, ^(dispatch_data_t lengthContent, nw_content_context_t context, bool is_complete, nw_error_t error) {
+        if (!lengthContent || error) {
+            nw_connection_cancel(conn);
+            return ;
+        }
+        __block uint8_t length = 0;
+        dispatch_data_apply(lengthContent, ^bool(dispatch_data_t region, size_t offset, const void *buffer, size_t size) {
+            length = ((const uint8_t *)buffer)[0];
+            return (false);
+        });
+        nw_connection_receive(conn, length, length, ^(dispatch_data_t pidContent, nw_content_context_t context, bool is_complete, nw_error_t error) {
+            if (!pidContent || error) {
+                nw_connection_cancel(conn);
+                return ;
+            }
+            NSMutableData *pid = [NSMutableData data];
+            dispatch_data_apply(pidContent, ^bool(dispatch_data_t region, size_t offset, const void *buffer, size_t size) {
+                [pid appendBytes:buffer length:size];
+                return (true);
+            });
+            NSString *remotePID = [[NSString alloc] initWithData:pid encoding:NSUTF8StringEncoding];
+            NSLog(@"AWDL: incoming conn: %@", remotePID);
+            addConn(remotePID, conn);
+            if (!AWDLHandleFoundPeer((char *)[remotePID UTF8String])) {
+                removeConn(remotePID);
+                return ;
+            }
+            receiveLoop(conn, remotePID);
+        });
+    });
+}
+
+static void connectToPeer(nw_endpoint_t endpoint, NSString *remotePID) {
+    if (getConn(remotePID)) {
+        return ;
+    }
+
+    nw_connection_t conn = nw_connection_create(endpoint, awdlParameters());
+    nw_connection_set_queue(conn, gQueue);
+    nw_connection_set_state_changed_handler(conn, ^(nw_connection_state_t state, nw_error_t error) {
+        switch (state) {
+        case nw_connection_state_ready:
+            NSLog(@"AWDL: connected: %@", remotePID);
+            sendHello(conn);
+            addConn(remotePID, conn);
+            receiveLoop(conn, remotePID);
+            AWDLHandleFoundPeer((char *)[remotePID UTF8String]);
+            break;
+        case nw_connection_state_failed:
+            NSLog(@"AWDL: connection failed: %@: %@", remotePID, error);
+            removeConn(remotePID);
+            break;
+        default:
+            break;
+        }
+    });
+    nw_connection_start(conn);
+}
+
+int AWDLStart(char *localPID) {
+    if (gListener) {
+        return (1);
+    }
+
+    gLocalPID = [[NSString alloc] initWithUTF8String:localPID];
+    gConns = [NSMutableDictionary dictionary];
+    gQueue = dispatch_queue_create("tech.berty.awdl", DISPATCH_QUEUE_SERIAL);
+
+    // Advertises the local peerID as Bonjour service name
+    if (!(gListener = nw_listener_create(awdlParameters()))) {
+        NSLog(@"AWDL: nw_listener_create failed");
+        return (0);
+    }
+    nw_advertise_descriptor_t advertise = nw_advertise_descriptor_create_bonjour_service([gLocalPID UTF8String], [BERTY_DRIVER_AWDL UTF8String], "local.");
+    nw_listener_set_advertise_descriptor(gListener, advertise);
+    nw_listener_set_queue(gListener, gQueue);
+    nw_listener_set_new_connection_handler(gListener, ^(nw_connection_t conn) {
+        nw_connection_set_queue(conn, gQueue);
+        nw_connection_start(conn);
+        readHello(conn);
+    });
+    nw_listener_start(gListener);
+
+    // Peer with lexicographical smallest peerID inits the connection
+    nw_browse_descriptor_t browse = nw_browse_descriptor_create_bonjour_service([BERTY_DRIVER_AWDL UTF8String], "local.");
+    gBrowser = nw_browser_create(browse, awdlParameters());
+    nw_browser_set_queue(gBrowser, gQueue);
+    nw_browser_set_browse_results_changed_handler(gBrowser, ^(nw_browse_result_t old_result, nw_browse_result_t new_result, bool batch_complete) {
+        if (!(nw_browse_result_get_changes(old_result, new_result) & nw_browse_result_change_result_added)) {
+            return ;
+        }
+        nw_endpoint_t endpoint = nw_browse_result_copy_endpoint(new_result);
+        NSString *remotePID = [[NSString alloc] initWithUTF8String:nw_endpoint_get_bonjour_service_name(endpoint)];
+        NSLog(@"AWDL: foundPeer: %@", remotePID);
+        if ([gLocalPID compare:remotePID] == NSOrderedAscending) {
+            connectToPeer(endpoint, remotePID);
+        }
+    });
+    nw_browser_start(gBrowser);
+
+    return (1);
+}
+
+void AWDLStop() {
+    if (!gListener) {
+        return ;
+    }
+
+    nw_browser_cancel(gBrowser);
+    nw_listener_cancel(gListener);
+    gBrowser = nil;
+    gListener = nil;
+
+    NSArray<NSString *> *pids;
+    @synchronized (gConns) {
+        pids = [gConns allKeys];
+    }
+    for (NSString *pid in pids) {
+        removeConn(pid);
+    }
+}
+
+int AWDLDialPeer(char *remotePID) {
+    if (!gListener || !getConn([[NSString alloc] initWithUTF8String:remotePID])) {
+        return (0);
+    }
+    return (1);
+}
+
+int AWDLSendToPeer(char *remotePID, void *payload, int length) {
+    nw_connection_t conn;
+    if (!gListener || !(conn = getConn([[NSString alloc] initWithUTF8String:remotePID]))) {
+        return (0);
+    }
+
+    dispatch_data_t data = dispatch_data_create(payload, length, gQueue, DISPATCH_DATA_DESTRUCTOR_DEFAULT);
+    nw_connection_send(conn, data, NW_CONNECTION_DEFAULT_MESSAGE_CONTEXT, false, ^(nw_error_t error) {
+        if (error) {
+            NSLog(@"AWDL: sendToPeer error: %@", error);
+        }
+    });
+    return (1);
+}
+
+void AWDLCloseConnWithPeer(char *remotePID) {
+    if (!gListener) {
+        return ;
+    }
+    removeConn([[NSString alloc] initWithUTF8String:remotePID]);
+}
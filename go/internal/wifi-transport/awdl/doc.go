@@ -0,0 +1,3 @@
+// Package awdl is a native driver for the Wi-Fi transport using Apple
+// Wireless Direct Link, through Bonjour and peer-to-peer NWConnections.
+package awdl
@@ -0,0 +1,72 @@
+// +build darwin
+
+package awdl
+
+/*
+#cgo CFLAGS: -x objective-c -fobjc-arc
+#cgo darwin LDFLAGS: -framework Foundation -framework Network
+#include <stdlib.h>
+#include "awdl-driver.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	wifi "berty.tech/berty/v2/go/internal/wifi-transport"
+)
+
+// Supported reports whether AWDL is available on this platform.
+func Supported() bool { return true }
+
+// NewDriver returns the AWDL driver, there is only one per process.
+func NewDriver() wifi.NativeDriver { return &driver{} }
+
+type driver struct{}
+
+func (*driver) Start(localPID string) bool {
+	cPID := C.CString(localPID)
+	defer C.free(unsafe.Pointer(cPID))
+
+	return C.AWDLStart(cPID) == 1
+}
+
+func (*driver) Stop() {
+	C.AWDLStop()
+}
+
+func (*driver) DialPeer(remotePID string) bool {
+	cPID := C.CString(remotePID)
+	defer C.free(unsafe.Pointer(cPID))
+
+	return C.AWDLDialPeer(cPID) == 1
+}
+
+func (*driver) SendToPeer(remotePID string, payload []byte) bool {
+	cPID := C.CString(remotePID)
+	defer C.free(unsafe.Pointer(cPID))
+	cPayload := C.CBytes(payload)
+	defer C.free(cPayload)
+
+	return C.AWDLSendToPeer(cPID, cPayload, C.int(len(payload))) == 1
+}
+
+func (*driver) CloseConnWithPeer(remotePID string) {
+	cPID := C.CString(remotePID)
+	defer C.free(unsafe.Pointer(cPID))
+
+	C.AWDLCloseConnWithPeer(cPID)
+}
+
+//export AWDLHandleFoundPeer
+func AWDLHandleFoundPeer(remotePID *C.char) C.int {
+	if wifi.HandleFoundPeer(C.GoString(remotePID)) {
+		return 1
+	}
+	return 0
+}
+
+//export AWDLReceiveFromPeer
+func AWDLReceiveFromPeer(remotePID *C.char, payload unsafe.Pointer, length C.int) {
+	wifi.ReceiveFromPeer(C.GoString(remotePID), C.GoBytes(payload, length))
+}
@@ -0,0 +1,12 @@
+// +build !darwin
+
+package awdl
+
+import (
+	wifi "berty.tech/berty/v2/go/internal/wifi-transport"
+)
+
+// Noop implementation for platform that are not Darwin
+
+func Supported() bool              { return false }
+func NewDriver() wifi.NativeDriver { return nil }
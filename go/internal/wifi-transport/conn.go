@@ -0,0 +1,170 @@
+package wifi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// connMap keeps tracks of opened conn so the native driver can read from them
+// and close them.
+var connMap sync.Map
+
+// Conn is a manet.Conn.
+var _ manet.Conn = &Conn{}
+
+// Conn is the equivalent of a net.Conn object, over a native datapath.
+type Conn struct {
+	readIn  *io.PipeWriter
+	readOut *io.PipeReader
+	driver  NativeDriver
+
+	localMa  ma.Multiaddr
+	remoteMa ma.Multiaddr
+
+	ctx    context.Context
+	cancel func()
+}
+
+// newConn returns an inbound or outbound tpt.CapableConn upgraded from a Conn.
+func newConn(ctx context.Context, t *Transport, remoteMa ma.Multiaddr,
+	remotePID peer.ID, inbound bool) (tpt.CapableConn, error) {
+	pr, pw := io.Pipe()
+	connCtx, cancel := context.WithCancel(gListener.ctx)
+
+	maconn := &Conn{
+		readIn:   pw,
+		readOut:  pr,
+		driver:   t.driver,
+		localMa:  gListener.localMa,
+		remoteMa: remoteMa,
+		ctx:      connCtx,
+		cancel:   cancel,
+	}
+
+	// Unlock gListener locked by HandleFoundPeer
+	if inbound {
+		gListener.inUse.Done()
+	}
+
+	// The upgrader only gates the conns accepted by its own listeners
+	if inbound && t.upgrader.ConnGater != nil && !t.upgrader.ConnGater.InterceptAccept(maconn) {
+		cancel()
+		t.driver.CloseConnWithPeer(maconn.RemoteAddr().String())
+		return nil, errors.New("conn refused by the connection gater")
+	}
+
+	// Stores the conn in connMap, will be deleted during conn.Close()
+	connMap.Store(maconn.RemoteAddr().String(), maconn)
+
+	if inbound {
+		return t.upgrader.UpgradeInbound(ctx, t, maconn)
+	}
+	return t.upgrader.UpgradeOutbound(ctx, t, maconn, remotePID)
+}
+
+// ReceiveFromPeer is called by the native driver when peer's device sent data.
+func ReceiveFromPeer(remotePID string, payload []byte) {
+	// Checks during 100 ms if the conn is available, because remote device can
+	// be ready to write while local device is still creating the new conn.
+	for i := 0; i < 100; i++ {
+		c, ok := connMap.Load(remotePID)
+		if ok {
+			_, err := c.(*Conn).readIn.Write(payload)
+			if err != nil {
+				logger.Error("receive from peer: write", zap.Error(err))
+			}
+			return
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	logger.Error(
+		"failed to read from conn: unknown conn",
+		zap.String("remote address", remotePID),
+	)
+
+	if gListener != nil {
+		gListener.transport.driver.CloseConnWithPeer(remotePID)
+	}
+}
+
+// Read reads data from the connection.
+func (c *Conn) Read(payload []byte) (n int, err error) {
+	if c.ctx.Err() != nil {
+		return 0, fmt.Errorf("conn read failed: conn already closed")
+	}
+
+	n, err = c.readOut.Read(payload)
+	if err != nil {
+		err = errors.Wrap(err, "conn read failed")
+	}
+
+	return n, err
+}
+
+// Write writes data to the connection.
+func (c *Conn) Write(payload []byte) (n int, err error) {
+	if c.ctx.Err() != nil {
+		return 0, fmt.Errorf("conn write failed: conn already closed")
+	}
+
+	if !c.driver.SendToPeer(c.RemoteAddr().String(), payload) {
+		return 0, fmt.Errorf("conn write failed: native write failed")
+	}
+
+	return len(payload), nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.cancel()
+
+	c.readIn.Close()
+	c.readOut.Close()
+
+	connMap.Delete(c.RemoteAddr().String())
+
+	c.driver.CloseConnWithPeer(c.RemoteAddr().String())
+
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	lAddr, _ := c.LocalMultiaddr().ValueForProtocol(P_WIFI)
+	return &Addr{
+		Address: lAddr,
+	}
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	rAddr, _ := c.RemoteMultiaddr().ValueForProtocol(P_WIFI)
+	return &Addr{
+		Address: rAddr,
+	}
+}
+
+// LocalMultiaddr returns the local Multiaddr associated
+// with this connection.
+func (c *Conn) LocalMultiaddr() ma.Multiaddr { return c.localMa }
+
+// RemoteMultiaddr returns the remote Multiaddr associated
+// with this connection.
+func (c *Conn) RemoteMultiaddr() ma.Multiaddr { return c.remoteMa }
+
+// Noop deadline methods, handled by the native driver.
+func (c *Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,67 @@
+package wifi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pstore "github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+// HandleFoundPeer is called by the native driver when a datapath with a peer
+// is ready.
+func HandleFoundPeer(sRemotePID string) bool {
+	remotePID, err := peer.Decode(sRemotePID)
+	if err != nil {
+		logger.Error("handle peer failed: wrong remote peerID")
+		return false
+	}
+
+	remoteMa, err := ma.NewMultiaddr(fmt.Sprintf("/wifi/%s", sRemotePID))
+	if err != nil {
+		// Should never occur
+		panic(err)
+	}
+
+	// Checks if a listener is currently running.
+	if gListener == nil || gListener.ctx.Err() != nil {
+		logger.Error("handle peer failed: listener not running")
+		return false
+	}
+
+	gListener.transport.host.Peerstore().AddAddr(remotePID, remoteMa,
+		pstore.TempAddrTTL)
+
+	// Peer with lexicographical smallest peerID inits libp2p connection.
+	if gListener.Addr().String() < sRemotePID {
+		// Async connect so HandleFoundPeer can return and unlock the native driver.
+		go func() {
+			err := gListener.transport.host.Connect(context.Background(), peer.AddrInfo{
+				ID:    remotePID,
+				Addrs: []ma.Multiaddr{remoteMa},
+			})
+			if err != nil {
+				logger.Error("async connect", zap.Error(err))
+			}
+		}()
+
+		return true
+	}
+
+	// Ensures that gListener won't be unset until the inbound conn is created
+	gListener.inUse.Add(1)
+
+	// Peer with lexicographical biggest peerID accepts incoming connection.
+	select {
+	case gListener.inboundConnReq <- connReq{
+		remoteMa:  remoteMa,
+		remotePID: remotePID,
+	}:
+		return true
+	case <-gListener.ctx.Done():
+		gListener.inUse.Done()
+		return false
+	}
+}
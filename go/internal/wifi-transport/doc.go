@@ -0,0 +1,4 @@
+// Package wifi is a libp2p transport over the Wi-Fi Direct (Android) or Wi-Fi
+// Aware datapaths established by a native driver, used for bulk transfers
+// between nearby devices.
+package wifi
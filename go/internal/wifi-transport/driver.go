@@ -0,0 +1,27 @@
+package wifi
+
+// NativeDriver is implemented by the platform code managing the Wi-Fi Direct
+// or Wi-Fi Aware datapaths. When a datapath with a peer is ready, the driver
+// must call HandleFoundPeer, then ReceiveFromPeer for each payload received.
+type NativeDriver interface {
+	// Start starts advertising the local peer, it returns false if the
+	// datapaths aren't supported by the device.
+	Start(localPID string) bool
+	Stop()
+
+	// DialPeer requests a datapath with a peer, it returns true if it is
+	// already established.
+	DialPeer(remotePID string) bool
+
+	SendToPeer(remotePID string, payload []byte) bool
+	CloseConnWithPeer(remotePID string)
+}
+
+// noopDriver is used when no native driver is available.
+type noopDriver struct{}
+
+func (noopDriver) Start(_ string) bool                { return false }
+func (noopDriver) Stop()                              {}
+func (noopDriver) DialPeer(_ string) bool             { return false }
+func (noopDriver) SendToPeer(_ string, _ []byte) bool { return false }
+func (noopDriver) CloseConnWithPeer(_ string)         {}
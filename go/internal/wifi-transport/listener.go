@@ -0,0 +1,104 @@
+package wifi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Global listener is used by the native callbacks (to send incoming conn
+// request to Accept()) and transport (to ensure that only one listener is
+// running at a time).
+var gListener *Listener
+
+// Listener is a tpt.Listener.
+var _ tpt.Listener = &Listener{}
+
+// Listener is an interface closely resembling the net.Listener interface.
+type Listener struct {
+	transport      *Transport
+	localMa        ma.Multiaddr
+	inboundConnReq chan connReq // Chan used to accept inbound conn.
+	inUse          sync.WaitGroup
+	supported      bool
+	ctx            context.Context
+	cancel         func()
+}
+
+// connReq holds data necessary for inbound conn creation.
+type connReq struct {
+	remoteMa  ma.Multiaddr
+	remotePID peer.ID
+}
+
+// newListener starts the native driver then returns a new Listener.
+func newListener(localMa ma.Multiaddr, t *Transport) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	listener := &Listener{
+		transport:      t,
+		localMa:        localMa,
+		inboundConnReq: make(chan connReq),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	// Starts the native driver.
+	// If it failed, don't return a error because no other transport
+	// on the libp2p node will be created.
+	listener.supported = t.driver.Start(t.host.ID().Pretty())
+	if !listener.supported {
+		logger.Info("Wi-Fi datapaths not supported on this device")
+	}
+
+	gListener = listener
+
+	return listener
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *Listener) Accept() (tpt.CapableConn, error) {
+	for {
+		select {
+		case req := <-l.inboundConnReq:
+			conn, err := newConn(l.ctx, l.transport, req.remoteMa, req.remotePID, true)
+			// If the newConn failed for some reason, Accept won't return an error
+			// because otherwise it will close the listener
+			if err == nil {
+				return conn, nil
+			}
+		case <-l.ctx.Done():
+			return nil, errors.New("listener accept failed: listener already closed")
+		}
+	}
+}
+
+// Close closes the listener.
+func (l *Listener) Close() error {
+	l.cancel()
+
+	l.transport.driver.Stop()
+
+	if gListener != nil {
+		gListener.inUse.Wait()
+		gListener = nil
+	}
+
+	return nil
+}
+
+// Multiaddr returns the listener's (local) Multiaddr.
+func (l *Listener) Multiaddr() ma.Multiaddr { return l.localMa }
+
+// Addr returns the net.Listener's network address.
+func (l *Listener) Addr() net.Addr {
+	lAddr, _ := l.localMa.ValueForProtocol(P_WIFI)
+	return &Addr{
+		Address: lAddr,
+	}
+}
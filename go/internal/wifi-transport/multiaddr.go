@@ -0,0 +1,57 @@
+package wifi
+
+import (
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	mafmt "github.com/multiformats/go-multiaddr-fmt"
+)
+
+// Wi-Fi multiaddr protocol definition, multiaddr = /wifi/<peerID>
+// See https://github.com/multiformats/go-multiaddr/blob/master/protocols.go
+const P_WIFI = 0x0044 // nolint: golint
+
+var protoWifi = ma.Protocol{
+	Name:       "wifi",
+	Code:       P_WIFI,
+	VCode:      ma.CodeToVarint(P_WIFI),
+	Size:       -1,
+	Path:       false,
+	Transcoder: TranscoderWifi,
+}
+
+// Wifi multiaddr validation checker
+var Wifi = mafmt.Base(P_WIFI)
+
+// TranscoderWifi is a Wi-Fi multiaddr transcoder
+var TranscoderWifi = ma.NewTranscoderFromFunctions(wifiStB, wifiBtS, wifiVal)
+
+// Add Wi-Fi to the list of libp2p's multiaddr protocols
+// FIXME: remove this init
+// nolint: gochecknoinits
+func init() {
+	err := ma.AddProtocol(protoWifi)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func wifiStB(s string) ([]byte, error) {
+	_, err := peer.Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+func wifiBtS(b []byte) (string, error) {
+	_, err := peer.Decode(string(b))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func wifiVal(b []byte) error {
+	_, err := peer.Decode(string(b))
+	return err
+}
@@ -0,0 +1,22 @@
+package wifi
+
+import (
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiaddr(t *testing.T) {
+	addr, err := ma.NewMultiaddr(DefaultBind)
+	require.NoError(t, err)
+	assert.True(t, Wifi.Matches(addr))
+
+	_, err = ma.NewMultiaddr("/wifi/invalid")
+	assert.Error(t, err)
+
+	addr, err = ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4242")
+	require.NoError(t, err)
+	assert.False(t, Wifi.Matches(addr))
+}
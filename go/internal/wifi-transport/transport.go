@@ -0,0 +1,133 @@
+package wifi
+
+import (
+	"context"
+	"fmt"
+
+	host "github.com/libp2p/go-libp2p-core/host"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const DefaultBind = "/wifi/Qmeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"
+
+// logger is global because HandleFoundPeer must be able to call it
+// FIXME: remove global logger
+var logger *zap.Logger = zap.L().Named("wifi-transport")
+
+// Transport is a tpt.transport.
+var _ tpt.Transport = &Transport{}
+
+// Transport represents any device by which you can connect to and accept
+// connections from other peers.
+type Transport struct {
+	host     host.Host
+	upgrader *tptu.Upgrader
+	driver   NativeDriver
+}
+
+// Opts contains optional configuration flags for the Wi-Fi transport
+type Opts struct {
+	Logger *zap.Logger
+
+	// Driver manages the native datapaths, the transport can't dial nor
+	// accept anything without it.
+	Driver NativeDriver
+}
+
+func NewTransportConstructorWithOpts(opts Opts) func(h host.Host, u *tptu.Upgrader) (*Transport, error) {
+	if opts.Logger != nil {
+		logger = opts.Logger.Named("wifi-transport")
+	}
+
+	if opts.Driver == nil {
+		opts.Driver = noopDriver{}
+	}
+
+	return func(h host.Host, u *tptu.Upgrader) (*Transport, error) {
+		t := &Transport{
+			host:     h,
+			upgrader: u,
+			driver:   opts.Driver,
+		}
+
+		// Lets the MC peers ask for a Wi-Fi datapath.
+		h.SetStreamHandler(UpgradeProtocolID, t.handleUpgrade)
+
+		return t, nil
+	}
+}
+
+// Dial dials the peer at the remote address.
+// The native driver must have established a datapath with the peer.
+func (t *Transport) Dial(ctx context.Context, remoteMa ma.Multiaddr, remotePID peer.ID) (tpt.CapableConn, error) {
+	if gListener == nil {
+		return nil, errors.New("transport dialing peer failed: no active listener")
+	}
+
+	// remoteAddr is supposed to be equal to remotePID since with Wi-Fi
+	// transport: multiaddr = /wifi/<peerID>
+	remoteAddr, err := remoteMa.ValueForProtocol(P_WIFI)
+	if err != nil || remoteAddr != remotePID.Pretty() {
+		return nil, errors.Wrap(err, "transport dialing peer failed: wrong multiaddr")
+	}
+
+	if !t.driver.DialPeer(remoteAddr) {
+		return nil, errors.New("transport dialing peer failed: no datapath with peer")
+	}
+
+	// Can't have two connections on the same multiaddr
+	if _, ok := connMap.Load(remoteAddr); ok {
+		return nil, errors.New("transport dialing peer failed: already connected to this address")
+	}
+
+	return newConn(ctx, t, remoteMa, remotePID, false)
+}
+
+// CanDial returns true if this transport believes it can dial the given
+// multiaddr.
+func (t *Transport) CanDial(remoteMa ma.Multiaddr) bool {
+	return Wifi.Matches(remoteMa)
+}
+
+// Listen listens on the given multiaddr.
+// Wi-Fi transport can't listen on more than one listener.
+func (t *Transport) Listen(localMa ma.Multiaddr) (tpt.Listener, error) {
+	localPID := t.host.ID().Pretty()
+	localAddr, err := localMa.ValueForProtocol(P_WIFI)
+	if err != nil || (localMa.String() != DefaultBind && localAddr != localPID) {
+		return nil, errors.Wrap(err, "transport listen failed: wrong multiaddr")
+	}
+
+	// Replaces default bind by local host peerID
+	if localMa.String() == DefaultBind {
+		localMa, err = ma.NewMultiaddr(fmt.Sprintf("/wifi/%s", localPID))
+		if err != nil { // Should never append.
+			panic(err)
+		}
+	}
+
+	if gListener != nil {
+		gListener.Close()
+	}
+
+	return newListener(localMa, t), nil
+}
+
+// Proxy returns true if this transport proxies.
+func (t *Transport) Proxy() bool {
+	return false
+}
+
+// Protocols returns the set of protocols handled by this transport.
+func (t *Transport) Protocols() []int {
+	return []int{P_WIFI}
+}
+
+func (t *Transport) String() string {
+	return "Wi-Fi"
+}
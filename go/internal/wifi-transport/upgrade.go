@@ -0,0 +1,84 @@
+package wifi
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// UpgradeProtocolID is used by a peer connected through a slow transport
+// (e.g. MC) to ask for a Wi-Fi datapath before a bulk transfer.
+const UpgradeProtocolID = protocol.ID("/berty/wifi-upgrade/1.0.0")
+
+const (
+	upgradeRequest  byte = 1
+	upgradeAccepted byte = 1
+	upgradeRefused  byte = 0
+)
+
+// RequestUpgrade asks a connected peer to establish a Wi-Fi datapath. Once
+// the native driver reports the datapath as ready, a new libp2p connection
+// is opened over it.
+func RequestUpgrade(ctx context.Context, h host.Host, remotePID peer.ID) error {
+	if gListener == nil || !gListener.supported {
+		return errors.New("upgrade failed: Wi-Fi datapaths not supported")
+	}
+
+	// Already upgraded
+	if _, ok := connMap.Load(remotePID.Pretty()); ok {
+		return nil
+	}
+
+	s, err := h.NewStream(ctx, remotePID, UpgradeProtocolID)
+	if err != nil {
+		return errors.Wrap(err, "upgrade failed: unable to open stream")
+	}
+	defer s.Close()
+
+	if _, err := s.Write([]byte{upgradeRequest}); err != nil {
+		return errors.Wrap(err, "upgrade failed: unable to send request")
+	}
+
+	reply := make([]byte, 1)
+	if _, err := s.Read(reply); err != nil {
+		return errors.Wrap(err, "upgrade failed: unable to read reply")
+	}
+
+	if reply[0] != upgradeAccepted {
+		return errors.New("upgrade failed: refused by peer")
+	}
+
+	gListener.transport.driver.DialPeer(remotePID.Pretty())
+
+	return nil
+}
+
+func (t *Transport) handleUpgrade(s network.Stream) {
+	defer s.Close()
+
+	req := make([]byte, 1)
+	if _, err := s.Read(req); err != nil || req[0] != upgradeRequest {
+		logger.Debug("upgrade handler: invalid request", zap.Error(err))
+		return
+	}
+
+	remotePID := s.Conn().RemotePeer().Pretty()
+	reply := upgradeRefused
+	if gListener != nil && gListener.supported {
+		reply = upgradeAccepted
+	}
+
+	if _, err := s.Write([]byte{reply}); err != nil {
+		logger.Debug("upgrade handler: unable to send reply", zap.Error(err))
+		return
+	}
+
+	if reply == upgradeAccepted {
+		t.driver.DialPeer(remotePID)
+	}
+}
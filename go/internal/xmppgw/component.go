@@ -0,0 +1,185 @@
+package xmppgw
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" // nolint:gosec // the handshake of XEP-0114 is defined with SHA-1
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const handshakeTimeout = 30 * time.Second
+
+// component is a connection to an XMPP server as an external component, see
+// XEP-0114.
+type component struct {
+	conn io.ReadWriteCloser
+	dec  *xml.Decoder
+
+	muWrite sync.Mutex
+}
+
+func dialComponent(ctx context.Context, addr, domain, secret string) (*component, error) {
+	var dialer net.Dialer
+
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	c, err := newComponent(conn, domain, secret)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+// newComponent opens the stream of the component on conn and authenticates
+// it with the shared secret of the server.
+func newComponent(conn io.ReadWriteCloser, domain, secret string) (*component, error) {
+	c := &component{conn: conn, dec: xml.NewDecoder(conn)}
+
+	if err := c.write(fmt.Sprintf("<stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>", nsComponent, nsStream, escape(domain))); err != nil {
+		return nil, err
+	}
+
+	stream, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if stream.Name.Space != nsStream || stream.Name.Local != "stream" {
+		return nil, errcode.ErrStreamRead.Wrap(fmt.Errorf("unexpected element <%s>", stream.Name.Local))
+	}
+
+	var streamID string
+	for _, attr := range stream.Attr {
+		if attr.Name.Local == "id" {
+			streamID = attr.Value
+		}
+	}
+
+	if streamID == "" {
+		return nil, errcode.ErrStreamRead.Wrap(fmt.Errorf("no stream id"))
+	}
+
+	digest := sha1.Sum([]byte(streamID + secret)) // nolint:gosec
+	if err := c.send(&handshake{Digest: hex.EncodeToString(digest[:])}); err != nil {
+		return nil, err
+	}
+
+	reply, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.dec.Skip(); err != nil {
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	if reply.Name.Local != "handshake" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("handshake refused by the server"))
+	}
+
+	return c, nil
+}
+
+// next returns the next element of the stream, io.EOF once the stream is
+// closed by the server.
+func (c *component) next() (xml.StartElement, error) {
+	for {
+		tok, err := c.dec.Token()
+		if err != nil {
+			return xml.StartElement{}, errcode.ErrStreamRead.Wrap(err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			return tok, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
+
+// read returns the next message or presence stanza, the other stanzas are
+// ignored.
+func (c *component) read() (interface{}, error) {
+	for {
+		start, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+
+		var stanza interface{}
+		switch {
+		case start.Name.Local == "message":
+			stanza = &message{}
+		case start.Name.Local == "presence":
+			stanza = &presence{}
+		case start.Name.Space == nsStream && start.Name.Local == "error":
+			_ = c.dec.Skip()
+			return nil, errcode.ErrStreamRead.Wrap(fmt.Errorf("stream error from the server"))
+		default:
+			if err := c.dec.Skip(); err != nil {
+				return nil, errcode.ErrStreamRead.Wrap(err)
+			}
+			continue
+		}
+
+		if err := c.dec.DecodeElement(stanza, &start); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		return stanza, nil
+	}
+}
+
+func (c *component) send(stanza interface{}) error {
+	raw, err := xml.Marshal(stanza)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return c.write(string(raw))
+}
+
+func (c *component) write(raw string) error {
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		return errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (c *component) Close() error {
+	_ = c.write("</stream:stream>")
+
+	return c.conn.Close()
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+
+	return buf.String()
+}
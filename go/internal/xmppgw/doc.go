@@ -0,0 +1,17 @@
+// Package xmppgw exposes the contacts and the conversations of a berty
+// account to an XMPP client, through an XMPP server.
+//
+// The gateway connects to the server as an external component, as defined by
+// XEP-0114, under a domain of its own: every accepted contact of the account
+// is a JID of this domain, e.g. <contact>@berty.example.com. The one-to-one
+// messages of the owner of the account to those JIDs are sent in the contact
+// groups, the messages of the contacts are forwarded to the owner, and the
+// availability of their devices is published as their presence.
+//
+// The delivery receipts of XEP-0184 are translated both ways: a receipt is
+// sent to the owner once a device of the contact acknowledged the message, and
+// a receipt of the owner is sent to the contact as an acknowledgement.
+//
+// Only the stanzas of the owner are handled, the gateway is meant to be run
+// per account, with `berty daemon -xmpp-server` or from the mobile bridge.
+package xmppgw
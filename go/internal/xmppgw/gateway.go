@@ -0,0 +1,558 @@
+package xmppgw
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultPresenceInterval = time.Minute
+	DefaultReconnectDelay   = 10 * time.Second
+)
+
+// The presences of the contacts, as shown to the owner.
+const (
+	presenceAvailable   = "available"
+	presenceAway        = "away"
+	presenceUnavailable = "unavailable"
+)
+
+// Node is the part of the protocol service used by the gateway, see
+// bertyprotocol.Service.
+type Node interface {
+	SubscribeNodeEvents(ctx context.Context, req *bertyprotocol.EventStreamRequest) (<-chan *bertyprotocol.NodeEvent, error)
+	ContactLifecycleList(ctx context.Context, states ...bertyprotocol.ContactLifecycleState) ([]*bertyprotocol.ContactLifecycle, error)
+	ContactAvailability(ctx context.Context, contactPK []byte) (*bertyprotocol.ContactAvailability, error)
+	GroupInfo(ctx context.Context, req *bertytypes.GroupInfo_Request) (*bertytypes.GroupInfo_Reply, error)
+	AppMessageSendWithID(ctx context.Context, groupPK []byte, payload []byte) ([]byte, error)
+}
+
+type Opts struct {
+	Logger *zap.Logger
+
+	// Server is the address of the component port of the XMPP server, e.g.
+	// localhost:5347
+	Server string
+
+	// Domain is the domain of the component on the server, Secret its shared
+	// secret
+	Domain string
+	Secret string
+
+	// Owner is the JID of the XMPP user of the account, the stanzas of the
+	// other users are ignored
+	Owner string
+
+	// PresenceInterval is the delay between two checks of the availability
+	// of the contacts, they are also checked when a peer (dis)connects
+	PresenceInterval time.Duration
+	ReconnectDelay   time.Duration
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.PresenceInterval == 0 {
+		opts.PresenceInterval = DefaultPresenceInterval
+	}
+
+	if opts.ReconnectDelay == 0 {
+		opts.ReconnectDelay = DefaultReconnectDelay
+	}
+}
+
+type contact struct {
+	pk      []byte
+	groupPK []byte
+	jid     string
+
+	// devicePK is the device of the account in the contact group
+	devicePK []byte
+
+	// presence is the last presence sent to the owner, empty if none was
+	// sent on the current connection
+	presence string
+}
+
+// Gateway relays the contacts of an account to an XMPP server, see the
+// package doc.
+type Gateway struct {
+	node   Node
+	opts   Opts
+	logger *zap.Logger
+
+	muContacts sync.Mutex
+	contacts   map[string]*contact // by contact pk
+	groups     map[string]*contact // by group pk
+
+	// receipts are the ids of the stanzas of the owner which requested a
+	// receipt, by id of the message sent in the group
+	muReceipts sync.Mutex
+	receipts   map[string]string
+}
+
+func New(node Node, opts Opts) (*Gateway, error) {
+	if node == nil {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("no node"))
+	}
+
+	if opts.Server == "" || opts.Domain == "" || opts.Owner == "" {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("the server, the domain and the owner of the gateway are required"))
+	}
+
+	opts.applyDefaults()
+
+	return &Gateway{
+		node:     node,
+		opts:     opts,
+		logger:   opts.Logger.Named("xmpp"),
+		contacts: make(map[string]*contact),
+		groups:   make(map[string]*contact),
+		receipts: make(map[string]string),
+	}, nil
+}
+
+// Run connects to the server and relays the stanzas until the context is
+// done, the connection is opened again when it is lost.
+func (g *Gateway) Run(ctx context.Context) error {
+	for {
+		err := g.serve(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		g.logger.Warn("disconnected from the xmpp server", zap.String("server", g.opts.Server), zap.Error(err))
+
+		select {
+		case <-time.After(g.opts.ReconnectDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (g *Gateway) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := g.node.SubscribeNodeEvents(ctx, &bertyprotocol.EventStreamRequest{
+		Types: []string{
+			bertyprotocol.NodeEventMessageReceived,
+			bertyprotocol.NodeEventMessageDelivery,
+			bertyprotocol.NodeEventContactRequest,
+			bertyprotocol.NodeEventPeerConnected,
+			bertyprotocol.NodeEventPeerDisconnected,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := g.refreshContacts(ctx); err != nil {
+		return err
+	}
+
+	comp, err := dialComponent(ctx, g.opts.Server, g.opts.Domain, g.opts.Secret)
+	if err != nil {
+		return err
+	}
+	defer comp.Close()
+
+	g.logger.Info("connected to the xmpp server", zap.String("server", g.opts.Server), zap.String("domain", g.opts.Domain))
+
+	stanzas := make(chan interface{})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			stanza, err := comp.read()
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			select {
+			case stanzas <- stanza:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	g.resetPresences()
+	if err := g.sendPresences(ctx, comp, nil); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(g.opts.PresenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case stanza := <-stanzas:
+			err = g.handleStanza(ctx, comp, stanza)
+		case evt, ok := <-events:
+			if !ok {
+				return errcode.ErrInternal.Wrap(fmt.Errorf("node events closed"))
+			}
+			err = g.handleEvent(ctx, comp, evt)
+		case <-ticker.C:
+			err = g.sendPresences(ctx, comp, nil)
+		case err = <-readErr:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleStanza handles a stanza of the server, only the errors of the
+// connection are returned.
+func (g *Gateway) handleStanza(ctx context.Context, comp *component, stanza interface{}) error {
+	switch stanza := stanza.(type) {
+	case *message:
+		if bareJID(stanza.From) != bareJID(g.opts.Owner) {
+			g.logger.Debug("message from another user ignored", zap.String("from", stanza.From))
+			return nil
+		}
+
+		return g.handleMessage(ctx, stanza)
+
+	case *presence:
+		if bareJID(stanza.From) != bareJID(g.opts.Owner) {
+			return nil
+		}
+
+		return g.handlePresence(ctx, comp, stanza)
+	}
+
+	return nil
+}
+
+func (g *Gateway) handleMessage(ctx context.Context, m *message) error {
+	c := g.contactForJID(m.To)
+	if c == nil {
+		g.logger.Debug("message to an unknown contact", zap.String("to", m.To))
+		return nil
+	}
+
+	// the owner read a message of the contact
+	if m.Received != nil && m.Received.ID != "" {
+		target, err := base64.RawURLEncoding.DecodeString(m.Received.ID)
+		if err != nil {
+			g.logger.Debug("receipt of an unknown message", zap.String("id", m.Received.ID))
+			return nil
+		}
+
+		payload, err := json.Marshal(&bertymessenger.PayloadAcknowledge{
+			Type:   bertymessenger.AppMessageType_Acknowledge,
+			Target: base64.StdEncoding.EncodeToString(target),
+		})
+		if err == nil {
+			_, err = g.node.AppMessageSendWithID(ctx, c.groupPK, payload)
+		}
+		if err != nil {
+			g.logger.Warn("unable to acknowledge a message", zap.Error(err))
+		}
+	}
+
+	switch {
+	case m.Body == "":
+		return nil
+	case m.Type != "" && m.Type != messageTypeChat && m.Type != messageTypeNormal:
+		g.logger.Debug("message ignored", zap.String("type", m.Type))
+		return nil
+	}
+
+	payload, err := json.Marshal(&bertymessenger.PayloadUserMessage{
+		Type:     bertymessenger.AppMessageType_UserMessage,
+		Body:     m.Body,
+		SentDate: time.Now().UnixNano() / 1000000,
+	})
+
+	var messageID []byte
+	if err == nil {
+		messageID, err = g.node.AppMessageSendWithID(ctx, c.groupPK, payload)
+	}
+	if err != nil {
+		g.logger.Warn("unable to send a message", zap.String("to", c.jid), zap.Error(err))
+		return nil
+	}
+
+	if m.Request != nil && m.ID != "" && messageID != nil {
+		g.muReceipts.Lock()
+		g.receipts[string(messageID)] = m.ID
+		g.muReceipts.Unlock()
+	}
+
+	return nil
+}
+
+func (g *Gateway) handlePresence(ctx context.Context, comp *component, p *presence) error {
+	var only *contact
+	if bareJID(p.To) != bareJID(g.opts.Domain) {
+		if only = g.contactForJID(p.To); only == nil {
+			if p.Type == presenceTypeSubscribe {
+				return comp.send(&presence{From: bareJID(p.To), To: g.opts.Owner, Type: presenceTypeUnsubscribed})
+			}
+			return nil
+		}
+	}
+
+	switch p.Type {
+	case presenceTypeSubscribe:
+		if only == nil {
+			return nil
+		}
+
+		if err := comp.send(&presence{From: only.jid, To: g.opts.Owner, Type: presenceTypeSubscribed}); err != nil {
+			return err
+		}
+
+	case "", presenceTypeProbe:
+	default:
+		return nil
+	}
+
+	// the owner came online or asked for the presences
+	g.resetPresences()
+
+	return g.sendPresences(ctx, comp, only)
+}
+
+func (g *Gateway) handleEvent(ctx context.Context, comp *component, evt *bertyprotocol.NodeEvent) error {
+	switch evt.Type {
+	case bertyprotocol.NodeEventContactRequest:
+		if err := g.refreshContacts(ctx); err != nil {
+			g.logger.Warn("unable to list the contacts", zap.Error(err))
+			return nil
+		}
+
+		return g.sendPresences(ctx, comp, nil)
+
+	case bertyprotocol.NodeEventPeerConnected, bertyprotocol.NodeEventPeerDisconnected:
+		return g.sendPresences(ctx, comp, nil)
+
+	case bertyprotocol.NodeEventMessageReceived:
+		c := g.contactForGroup(ctx, evt.GroupPK)
+		if c == nil {
+			return nil
+		}
+
+		received := &bertyprotocol.MessageReceivedEvent{}
+		if err := json.Unmarshal(evt.Payload, received); err != nil {
+			return nil
+		}
+
+		// the messages of the account are already seen by the owner
+		if bytes.Equal(received.DevicePK, c.devicePK) {
+			return nil
+		}
+
+		body := userMessageBody(received.Message)
+		if body == "" {
+			return nil
+		}
+
+		return comp.send(&message{
+			From:    c.jid,
+			To:      g.opts.Owner,
+			ID:      base64.RawURLEncoding.EncodeToString(received.MessageID),
+			Type:    messageTypeChat,
+			Body:    body,
+			Request: &receiptRequest{},
+		})
+
+	case bertyprotocol.NodeEventMessageDelivery:
+		delivery := &bertyprotocol.MessageDelivery{}
+		if err := json.Unmarshal(evt.Payload, delivery); err != nil {
+			return nil
+		}
+
+		if delivery.Status != bertyprotocol.DeliveryStatusDelivered && delivery.Status != bertyprotocol.DeliveryStatusRead {
+			return nil
+		}
+
+		g.muReceipts.Lock()
+		stanzaID, ok := g.receipts[string(delivery.MessageID)]
+		delete(g.receipts, string(delivery.MessageID))
+		g.muReceipts.Unlock()
+
+		c := g.contactForGroup(ctx, delivery.GroupPK)
+		if !ok || c == nil {
+			return nil
+		}
+
+		return comp.send(&message{From: c.jid, To: g.opts.Owner, Received: &receiptReceived{ID: stanzaID}})
+	}
+
+	return nil
+}
+
+// userMessageBody returns the body of an app message, empty for the other
+// payloads, e.g. the acknowledgements.
+func userMessageBody(payload []byte) string {
+	decoded, err := bertymessenger.DecodePayload(payload)
+	if err != nil {
+		return ""
+	}
+
+	msg := &bertymessenger.PayloadUserMessage{}
+	if err := json.Unmarshal(decoded, msg); err != nil || msg.Type != bertymessenger.AppMessageType_UserMessage {
+		return ""
+	}
+
+	return msg.Body
+}
+
+// sendPresences sends the presence of the contacts which changed since the
+// last one sent, or only the one of c if set.
+func (g *Gateway) sendPresences(ctx context.Context, comp *component, only *contact) error {
+	g.muContacts.Lock()
+	contacts := make([]*contact, 0, len(g.contacts))
+	for _, c := range g.contacts {
+		if only == nil || c == only {
+			contacts = append(contacts, c)
+		}
+	}
+	g.muContacts.Unlock()
+
+	for _, c := range contacts {
+		availability, err := g.node.ContactAvailability(ctx, c.pk)
+		if err != nil {
+			g.logger.Debug("unable to get the availability of a contact", zap.String("contact", c.jid), zap.Error(err))
+			continue
+		}
+
+		state := presenceUnavailable
+		switch {
+		case availability.ReachableNow:
+			state = presenceAvailable
+		case availability.LikelyReachableNow:
+			state = presenceAway
+		}
+
+		g.muContacts.Lock()
+		changed := c.presence != state
+		c.presence = state
+		g.muContacts.Unlock()
+
+		if !changed {
+			continue
+		}
+
+		p := &presence{From: c.jid, To: g.opts.Owner}
+		switch state {
+		case presenceAway:
+			p.Show = presenceAway
+		case presenceUnavailable:
+			p.Type = presenceTypeUnavailable
+		}
+
+		if err := comp.send(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *Gateway) resetPresences() {
+	g.muContacts.Lock()
+	defer g.muContacts.Unlock()
+
+	for _, c := range g.contacts {
+		c.presence = ""
+	}
+}
+
+// refreshContacts adds the contacts accepted since the last call.
+func (g *Gateway) refreshContacts(ctx context.Context) error {
+	accepted, err := g.node.ContactLifecycleList(ctx, bertyprotocol.ContactLifecycleAccepted)
+	if err != nil {
+		return err
+	}
+
+	for _, lifecycle := range accepted {
+		g.muContacts.Lock()
+		_, known := g.contacts[string(lifecycle.ContactPK)]
+		g.muContacts.Unlock()
+
+		if known {
+			continue
+		}
+
+		info, err := g.node.GroupInfo(ctx, &bertytypes.GroupInfo_Request{ContactPK: lifecycle.ContactPK})
+		if err != nil || info.Group == nil {
+			g.logger.Debug("unable to get the group of a contact", zap.Error(err))
+			continue
+		}
+
+		c := &contact{
+			pk:       lifecycle.ContactPK,
+			groupPK:  info.Group.PublicKey,
+			devicePK: info.DevicePK,
+			jid:      contactJID(lifecycle.ContactPK, g.opts.Domain),
+		}
+
+		g.muContacts.Lock()
+		g.contacts[string(c.pk)] = c
+		g.groups[string(c.groupPK)] = c
+		g.muContacts.Unlock()
+	}
+
+	return nil
+}
+
+func (g *Gateway) contactForJID(jid string) *contact {
+	contactPK := parseContactJID(jid, g.opts.Domain)
+	if contactPK == nil {
+		return nil
+	}
+
+	g.muContacts.Lock()
+	defer g.muContacts.Unlock()
+
+	return g.contacts[string(contactPK)]
+}
+
+// contactForGroup returns the contact of a group, the contacts are listed
+// again if the group is unknown, nil for the multi-member groups.
+func (g *Gateway) contactForGroup(ctx context.Context, groupPK []byte) *contact {
+	g.muContacts.Lock()
+	c, ok := g.groups[string(groupPK)]
+	g.muContacts.Unlock()
+
+	if ok {
+		return c
+	}
+
+	if err := g.refreshContacts(ctx); err != nil {
+		return nil
+	}
+
+	g.muContacts.Lock()
+	defer g.muContacts.Unlock()
+
+	// the other groups are remembered as nil, the contacts added later
+	// replace them
+	c = g.groups[string(groupPK)]
+	g.groups[string(groupPK)] = c
+
+	return c
+}
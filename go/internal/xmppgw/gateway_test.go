@@ -0,0 +1,218 @@
+package xmppgw
+
+import (
+	"context"
+	"crypto/sha1" // nolint:gosec
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testingDomain = "berty.localhost"
+	testingSecret = "secret"
+	testingOwner  = "alice@localhost"
+)
+
+type testingNode struct {
+	contactPK, groupPK, devicePK []byte
+
+	events chan *bertyprotocol.NodeEvent
+	sent   chan []byte
+	count  int32
+}
+
+func newTestingNode() *testingNode {
+	return &testingNode{
+		contactPK: []byte("contact-pk-contact-pk-contact-pk"),
+		groupPK:   []byte("group-pk"),
+		devicePK:  []byte("device-pk"),
+		events:    make(chan *bertyprotocol.NodeEvent, 10),
+		sent:      make(chan []byte, 10),
+	}
+}
+
+func (n *testingNode) SubscribeNodeEvents(context.Context, *bertyprotocol.EventStreamRequest) (<-chan *bertyprotocol.NodeEvent, error) {
+	return n.events, nil
+}
+
+func (n *testingNode) ContactLifecycleList(context.Context, ...bertyprotocol.ContactLifecycleState) ([]*bertyprotocol.ContactLifecycle, error) {
+	return []*bertyprotocol.ContactLifecycle{{ContactPK: n.contactPK, State: bertyprotocol.ContactLifecycleAccepted}}, nil
+}
+
+func (n *testingNode) ContactAvailability(context.Context, []byte) (*bertyprotocol.ContactAvailability, error) {
+	return &bertyprotocol.ContactAvailability{ReachableNow: true}, nil
+}
+
+func (n *testingNode) GroupInfo(context.Context, *bertytypes.GroupInfo_Request) (*bertytypes.GroupInfo_Reply, error) {
+	return &bertytypes.GroupInfo_Reply{Group: &bertytypes.Group{PublicKey: n.groupPK}, DevicePK: n.devicePK}, nil
+}
+
+func (n *testingNode) AppMessageSendWithID(_ context.Context, _ []byte, payload []byte) ([]byte, error) {
+	id := atomic.AddInt32(&n.count, 1)
+	n.sent <- payload
+
+	return []byte(fmt.Sprintf("message-%d", id)), nil
+}
+
+// testingServer accepts a component and checks its handshake.
+func testingServer(t *testing.T, l net.Listener) (net.Conn, *xml.Decoder) {
+	t.Helper()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+
+	dec := xml.NewDecoder(conn)
+	stream := nextElement(t, dec)
+	require.Equal(t, "stream", stream.Name.Local)
+
+	_, err = fmt.Fprintf(conn, "<stream:stream xmlns:stream='%s' xmlns='%s' id='stream-id' from='%s'>", nsStream, nsComponent, testingDomain)
+	require.NoError(t, err)
+
+	h := &handshake{}
+	start := nextElement(t, dec)
+	require.NoError(t, dec.DecodeElement(h, &start))
+
+	digest := sha1.Sum([]byte("stream-id" + testingSecret)) // nolint:gosec
+	require.Equal(t, hex.EncodeToString(digest[:]), h.Digest)
+
+	_, err = fmt.Fprint(conn, "<handshake/>")
+	require.NoError(t, err)
+
+	return conn, dec
+}
+
+func nextElement(t *testing.T, dec *xml.Decoder) xml.StartElement {
+	t.Helper()
+
+	for {
+		tok, err := dec.Token()
+		require.NoError(t, err)
+
+		if start, ok := tok.(xml.StartElement); ok {
+			return start
+		}
+	}
+}
+
+func expectStanza(t *testing.T, dec *xml.Decoder, stanza interface{}) {
+	t.Helper()
+
+	start := nextElement(t, dec)
+	require.NoError(t, dec.DecodeElement(stanza, &start))
+}
+
+func sendStanza(t *testing.T, conn net.Conn, stanza interface{}) {
+	t.Helper()
+
+	raw, err := xml.Marshal(stanza)
+	require.NoError(t, err)
+	_, err = conn.Write(raw)
+	require.NoError(t, err)
+}
+
+func TestGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	node := newTestingNode()
+	gw, err := New(node, Opts{Server: l.Addr().String(), Domain: testingDomain, Secret: testingSecret, Owner: testingOwner})
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() { done <- gw.Run(ctx) }()
+
+	conn, dec := testingServer(t, l)
+	defer conn.Close()
+
+	jid := contactJID(node.contactPK, testingDomain)
+
+	// the presence of the contact is sent once connected
+	p := &presence{}
+	expectStanza(t, dec, p)
+	assert.Equal(t, jid, p.From)
+	assert.Equal(t, testingOwner, p.To)
+	assert.Empty(t, p.Type)
+
+	// the messages of the other users are ignored, the ones of the owner are
+	// sent to the contact group
+	sendStanza(t, conn, &message{From: "mallory@localhost/web", To: jid, Type: messageTypeChat, Body: "spam"})
+	sendStanza(t, conn, &message{From: testingOwner + "/phone", To: jid, ID: "stanza-1", Type: messageTypeChat, Body: "hello", Request: &receiptRequest{}})
+
+	msg := &bertymessenger.PayloadUserMessage{}
+	require.NoError(t, json.Unmarshal(<-node.sent, msg))
+	assert.Equal(t, bertymessenger.AppMessageType_UserMessage, msg.Type)
+	assert.Equal(t, "hello", msg.Body)
+
+	// the receipt is sent once the message is delivered
+	delivery, err := json.Marshal(&bertyprotocol.MessageDelivery{GroupPK: node.groupPK, MessageID: []byte("message-1"), Status: bertyprotocol.DeliveryStatusDelivered})
+	require.NoError(t, err)
+	node.events <- &bertyprotocol.NodeEvent{Type: bertyprotocol.NodeEventMessageDelivery, GroupPK: node.groupPK, Payload: delivery}
+
+	receipt := &message{}
+	expectStanza(t, dec, receipt)
+	assert.Equal(t, jid, receipt.From)
+	require.NotNil(t, receipt.Received)
+	assert.Equal(t, "stanza-1", receipt.Received.ID)
+
+	// the messages of the contact are forwarded to the owner, not the ones of
+	// the account
+	for _, devicePK := range [][]byte{node.devicePK, []byte("contact-device")} {
+		userMessage, err := json.Marshal(&bertymessenger.PayloadUserMessage{Type: bertymessenger.AppMessageType_UserMessage, Body: "hi " + string(devicePK)})
+		require.NoError(t, err)
+		received, err := json.Marshal(&bertyprotocol.MessageReceivedEvent{MessageID: []byte("contact-message"), DevicePK: devicePK, Message: userMessage})
+		require.NoError(t, err)
+		node.events <- &bertyprotocol.NodeEvent{Type: bertyprotocol.NodeEventMessageReceived, GroupPK: node.groupPK, Payload: received}
+	}
+
+	forwarded := &message{}
+	expectStanza(t, dec, forwarded)
+	assert.Equal(t, jid, forwarded.From)
+	assert.Equal(t, "hi contact-device", forwarded.Body)
+	assert.NotNil(t, forwarded.Request)
+
+	// the receipt of the owner acknowledges the message
+	sendStanza(t, conn, &message{From: testingOwner, To: jid, Received: &receiptReceived{ID: forwarded.ID}})
+
+	ack := &bertymessenger.PayloadAcknowledge{}
+	require.NoError(t, json.Unmarshal(<-node.sent, ack))
+	assert.Equal(t, bertymessenger.AppMessageType_Acknowledge, ack.Type)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("contact-message")), ack.Target)
+
+	// a probe of the owner is answered again
+	sendStanza(t, conn, &presence{From: testingOwner, To: jid, Type: presenceTypeProbe})
+	p = &presence{}
+	expectStanza(t, dec, p)
+	assert.Equal(t, jid, p.From)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Len(t, node.sent, 0)
+}
+
+func TestContactJID(t *testing.T) {
+	contactPK := []byte("contact-pk")
+
+	jid := contactJID(contactPK, "Berty.Example.com")
+	assert.Equal(t, contactPK, parseContactJID(jid+"/resource", "Berty.Example.com"))
+	assert.Equal(t, contactPK, parseContactJID(jid, "berty.example.com"))
+	assert.Nil(t, parseContactJID(jid, "example.com"))
+	assert.Nil(t, parseContactJID("not-base32!@berty.example.com", "berty.example.com"))
+	assert.Equal(t, "alice@example.com", bareJID("Alice@Example.com/phone"))
+}
@@ -0,0 +1,91 @@
+package xmppgw
+
+import (
+	"encoding/base32"
+	"encoding/xml"
+	"strings"
+)
+
+const (
+	nsComponent = "jabber:component:accept"
+	nsStream    = "http://etherx.jabber.org/streams"
+	nsReceipts  = "urn:xmpp:receipts"
+)
+
+// The types of the stanzas used by the gateway.
+const (
+	messageTypeChat   = "chat"
+	messageTypeNormal = "normal"
+
+	presenceTypeUnavailable  = "unavailable"
+	presenceTypeProbe        = "probe"
+	presenceTypeSubscribe    = "subscribe"
+	presenceTypeSubscribed   = "subscribed"
+	presenceTypeUnsubscribed = "unsubscribed"
+)
+
+type message struct {
+	XMLName xml.Name `xml:"message"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	ID      string   `xml:"id,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Body    string   `xml:"body,omitempty"`
+
+	// Request and Received are the delivery receipts of XEP-0184
+	Request  *receiptRequest  `xml:"urn:xmpp:receipts request,omitempty"`
+	Received *receiptReceived `xml:"urn:xmpp:receipts received,omitempty"`
+}
+
+type receiptRequest struct{}
+
+type receiptReceived struct {
+	ID string `xml:"id,attr"`
+}
+
+type presence struct {
+	XMLName xml.Name `xml:"presence"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Show    string   `xml:"show,omitempty"`
+	Status  string   `xml:"status,omitempty"`
+}
+
+type handshake struct {
+	XMLName xml.Name `xml:"handshake"`
+	Digest  string   `xml:",chardata"`
+}
+
+var localpartEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// contactJID returns the JID of a contact in the domain of the gateway.
+func contactJID(contactPK []byte, domain string) string {
+	return strings.ToLower(localpartEncoding.EncodeToString(contactPK)) + "@" + domain
+}
+
+// parseContactJID returns the public key of the contact of a JID, nil if the
+// JID isn't in the domain of the gateway.
+func parseContactJID(jid, domain string) []byte {
+	local := strings.SplitN(bareJID(jid), "@", 2)
+	if len(local) != 2 || local[1] != strings.ToLower(domain) {
+		return nil
+	}
+
+	contactPK, err := localpartEncoding.DecodeString(strings.ToUpper(local[0]))
+	if err != nil {
+		return nil
+	}
+
+	return contactPK
+}
+
+// bareJID returns a JID without its resource, JIDs are compared in lower
+// case.
+func bareJID(jid string) string {
+	if i := strings.IndexByte(jid, '/'); i >= 0 {
+		jid = jid[:i]
+	}
+
+	return strings.ToLower(jid)
+}
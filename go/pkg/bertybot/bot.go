@@ -0,0 +1,249 @@
+package bertybot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.uber.org/zap"
+)
+
+// resubscribeDelay is the delay before the event stream of a bot is
+// resumed, once ended.
+const resubscribeDelay = time.Second
+
+// Message is a message received in a conversation of the bot, Body is only
+// set for the user messages. Payload is the JSON of the app message.
+type Message struct {
+	GroupPK   []byte
+	MessageID []byte
+	DevicePK  []byte
+	Type      bertymessenger.AppMessageType
+	Body      string
+	Payload   []byte
+}
+
+// ContactRequest is a contact request received by the account of the bot.
+type ContactRequest struct {
+	ContactPK []byte
+	Metadata  []byte
+}
+
+// MessageHandler handles the messages received by a bot, an error is logged
+// and the next handlers are called anyway.
+type MessageHandler func(ctx context.Context, bot *Bot, msg *Message) error
+
+// ContactRequestHandler handles the contact requests received by a bot, the
+// request is left pending unless a handler accepts or discards it.
+type ContactRequestHandler func(ctx context.Context, bot *Bot, req *ContactRequest) error
+
+// AcceptContactRequests is a ContactRequestHandler accepting every request.
+func AcceptContactRequests(ctx context.Context, bot *Bot, req *ContactRequest) error {
+	return bot.AcceptContact(ctx, req.ContactPK)
+}
+
+// Opts configures a bot.
+type Opts struct {
+	Logger *zap.Logger
+
+	// Client is the client of the node, see bertyprotocol.NewClient
+	Client bertyprotocol.Client
+
+	// Messenger sends the messages, defaults to a messenger of the client
+	Messenger bertymessenger.Service
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Messenger == nil && opts.Client != nil {
+		opts.Messenger = bertymessenger.New(opts.Client, &bertymessenger.Opts{Logger: opts.Logger.Named("messenger")})
+	}
+}
+
+// Bot calls its handlers on the events of a node, see Run.
+type Bot struct {
+	logger    *zap.Logger
+	client    bertyprotocol.Client
+	messenger bertymessenger.Service
+
+	lock            sync.RWMutex
+	messageHandlers []MessageHandler
+	contactHandlers []ContactRequestHandler
+}
+
+// New returns a bot of a node, its handlers are registered before it runs.
+func New(opts Opts) (*Bot, error) {
+	if opts.Client == nil {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("the bot requires a client"))
+	}
+
+	opts.applyDefaults()
+
+	return &Bot{
+		logger:    opts.Logger,
+		client:    opts.Client,
+		messenger: opts.Messenger,
+	}, nil
+}
+
+// OnMessage registers a handler of the messages, the handlers are called in
+// their order of registration.
+func (b *Bot) OnMessage(h MessageHandler) {
+	b.lock.Lock()
+	b.messageHandlers = append(b.messageHandlers, h)
+	b.lock.Unlock()
+}
+
+// OnContactRequest registers a handler of the contact requests, the handlers
+// are called in their order of registration.
+func (b *Bot) OnContactRequest(h ContactRequestHandler) {
+	b.lock.Lock()
+	b.contactHandlers = append(b.contactHandlers, h)
+	b.lock.Unlock()
+}
+
+// Client returns the client of the node, for the calls not wrapped by the
+// bot.
+func (b *Bot) Client() bertyprotocol.Client {
+	return b.client
+}
+
+// Run calls the handlers on the events of the node until the context is
+// done, one event at a time. The event stream is resumed if it ends.
+func (b *Bot) Run(ctx context.Context) error {
+	cursor := ""
+
+	for {
+		last, err := b.stream(ctx, cursor)
+		if last != "" {
+			cursor = last
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// the events after the cursor were dropped
+		if errcode.Has(err, errcode.ErrInvalidInput) {
+			cursor = ""
+		}
+
+		b.logger.Warn("bot event stream ended, resuming it", zap.Error(err))
+
+		select {
+		case <-time.After(resubscribeDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// stream handles the events after a cursor, it returns the cursor of the
+// last one handled.
+func (b *Bot) stream(ctx context.Context, cursor string) (string, error) {
+	cl, err := b.client.EventStream(ctx, &bertyprotocol.EventStreamRequest{
+		Types:  []string{bertyprotocol.NodeEventMessageReceived, bertyprotocol.NodeEventContactRequest},
+		Cursor: cursor,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	last := ""
+	for {
+		e, err := cl.Recv()
+		if err != nil {
+			return last, err
+		}
+
+		b.handleEvent(ctx, e)
+		last = e.Cursor
+	}
+}
+
+func (b *Bot) handleEvent(ctx context.Context, e *bertyprotocol.NodeEvent) {
+	switch e.Type {
+	case bertyprotocol.NodeEventMessageReceived:
+		msg, err := decodeMessage(e)
+		if err != nil {
+			b.logger.Warn("unable to decode message", zap.String("cursor", e.Cursor), zap.Error(err))
+			return
+		}
+
+		b.lock.RLock()
+		handlers := b.messageHandlers
+		b.lock.RUnlock()
+
+		for _, h := range handlers {
+			if err := h(ctx, b, msg); err != nil {
+				b.logger.Warn("message handler failed", zap.String("cursor", e.Cursor), zap.Error(err))
+			}
+		}
+
+	case bertyprotocol.NodeEventContactRequest:
+		contact := &bertyprotocol.ContactLifecycle{}
+		if err := json.Unmarshal(e.Payload, contact); err != nil {
+			b.logger.Warn("unable to decode contact", zap.String("cursor", e.Cursor), zap.Error(err))
+			return
+		}
+
+		// the other changes of the contacts are ignored
+		if contact.Outgoing || contact.State != bertyprotocol.ContactLifecycleRequestReceived {
+			return
+		}
+
+		req := &ContactRequest{ContactPK: contact.ContactPK, Metadata: contact.Metadata}
+
+		b.lock.RLock()
+		handlers := b.contactHandlers
+		b.lock.RUnlock()
+
+		for _, h := range handlers {
+			if err := h(ctx, b, req); err != nil {
+				b.logger.Warn("contact request handler failed", zap.String("cursor", e.Cursor), zap.Error(err))
+			}
+		}
+	}
+}
+
+func decodeMessage(e *bertyprotocol.NodeEvent) (*Message, error) {
+	received := &bertyprotocol.MessageReceivedEvent{}
+	if err := json.Unmarshal(e.Payload, received); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	payload, err := bertymessenger.DecodePayload(received.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	var typed struct {
+		Type bertymessenger.AppMessageType `json:"type"`
+		Body string                        `json:"body"`
+	}
+	if err := json.Unmarshal(payload, &typed); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	msg := &Message{
+		GroupPK:   e.GroupPK,
+		MessageID: received.MessageID,
+		DevicePK:  received.DevicePK,
+		Type:      typed.Type,
+		Payload:   payload,
+	}
+
+	if typed.Type == bertymessenger.AppMessageType_UserMessage {
+		msg.Body = typed.Body
+	}
+
+	return msg, nil
+}
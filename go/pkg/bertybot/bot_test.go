@@ -0,0 +1,87 @@
+package bertybot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func nodeEvent(t *testing.T, typ string, groupPK []byte, payload interface{}) *bertyprotocol.NodeEvent {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	return &bertyprotocol.NodeEvent{Type: typ, GroupPK: groupPK, Payload: data}
+}
+
+func TestBotHandlers(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := New(Opts{})
+	assert.Error(t, err)
+
+	b := &Bot{logger: zap.NewNop()}
+
+	var messages []*Message
+	b.OnMessage(func(context.Context, *Bot, *Message) error {
+		return fmt.Errorf("the next handlers are called anyway")
+	})
+	b.OnMessage(func(_ context.Context, _ *Bot, msg *Message) error {
+		messages = append(messages, msg)
+		return nil
+	})
+
+	var requests []*ContactRequest
+	b.OnContactRequest(func(_ context.Context, _ *Bot, req *ContactRequest) error {
+		requests = append(requests, req)
+		return nil
+	})
+
+	userMessage, err := json.Marshal(&bertymessenger.PayloadUserMessage{Type: bertymessenger.AppMessageType_UserMessage, Body: "hello"})
+	require.NoError(t, err)
+	reaction, err := json.Marshal(&bertymessenger.PayloadUserReaction{Type: bertymessenger.AppMessageType_UserReaction, Emoji: "+1"})
+	require.NoError(t, err)
+
+	b.handleEvent(ctx, nodeEvent(t, bertyprotocol.NodeEventMessageReceived, []byte("group"), &bertyprotocol.MessageReceivedEvent{
+		MessageID: []byte("id"),
+		Message:   userMessage,
+	}))
+	b.handleEvent(ctx, nodeEvent(t, bertyprotocol.NodeEventMessageReceived, []byte("group"), &bertyprotocol.MessageReceivedEvent{Message: reaction}))
+	b.handleEvent(ctx, nodeEvent(t, bertyprotocol.NodeEventMessageReceived, []byte("group"), &bertyprotocol.MessageReceivedEvent{Message: []byte("invalid")}))
+
+	require.Len(t, messages, 2)
+	assert.Equal(t, []byte("group"), messages[0].GroupPK)
+	assert.Equal(t, []byte("id"), messages[0].MessageID)
+	assert.Equal(t, "hello", messages[0].Body)
+	assert.Equal(t, bertymessenger.AppMessageType_UserReaction, messages[1].Type)
+	assert.Empty(t, messages[1].Body)
+	assert.JSONEq(t, string(reaction), string(messages[1].Payload))
+
+	// only the requests received are handled
+	b.handleEvent(ctx, nodeEvent(t, bertyprotocol.NodeEventContactRequest, nil, &bertyprotocol.ContactLifecycle{
+		ContactPK: []byte("sent"),
+		State:     bertyprotocol.ContactLifecycleRequestSent,
+		Outgoing:  true,
+	}))
+	b.handleEvent(ctx, nodeEvent(t, bertyprotocol.NodeEventContactRequest, nil, &bertyprotocol.ContactLifecycle{
+		ContactPK: []byte("accepted"),
+		State:     bertyprotocol.ContactLifecycleAccepted,
+	}))
+	b.handleEvent(ctx, nodeEvent(t, bertyprotocol.NodeEventContactRequest, nil, &bertyprotocol.ContactLifecycle{
+		ContactPK: []byte("contact"),
+		State:     bertyprotocol.ContactLifecycleRequestReceived,
+		Metadata:  []byte("alice"),
+	}))
+
+	require.Len(t, requests, 1)
+	assert.Equal(t, []byte("contact"), requests[0].ContactPK)
+	assert.Equal(t, []byte("alice"), requests[0].Metadata)
+}
@@ -0,0 +1,84 @@
+package bertybot
+
+import (
+	"context"
+	"encoding/json"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// SendMessage sends a user message to a conversation.
+func (b *Bot) SendMessage(ctx context.Context, groupPK []byte, body string) error {
+	_, err := b.messenger.SendMessage(ctx, &bertymessenger.SendMessage_Request{GroupPK: groupPK, Message: body})
+	return err
+}
+
+// Reply sends a user message to the conversation of a message.
+func (b *Bot) Reply(ctx context.Context, msg *Message, body string) error {
+	return b.SendMessage(ctx, msg.GroupPK, body)
+}
+
+// AcceptContact accepts the contact request of a contact, its conversation
+// is activated so the bot can reply.
+func (b *Bot) AcceptContact(ctx context.Context, contactPK []byte) error {
+	if _, err := b.client.ContactRequestAccept(ctx, &bertytypes.ContactRequestAccept_Request{ContactPK: contactPK}); err != nil {
+		return err
+	}
+
+	info, err := b.client.GroupInfo(ctx, &bertytypes.GroupInfo_Request{ContactPK: contactPK})
+	if err != nil {
+		return err
+	}
+
+	_, err = b.client.ActivateGroup(ctx, &bertytypes.ActivateGroup_Request{GroupPK: info.Group.PublicKey})
+	return err
+}
+
+// DiscardContact ignores the contact request of a contact.
+func (b *Bot) DiscardContact(ctx context.Context, contactPK []byte) error {
+	_, err := b.client.ContactRequestDiscard(ctx, &bertytypes.ContactRequestDiscard_Request{ContactPK: contactPK})
+	return err
+}
+
+// CreateConversation creates a multi-member conversation named name, if not
+// empty, it returns its group PK.
+func (b *Bot) CreateConversation(ctx context.Context, name string) ([]byte, error) {
+	created, err := b.client.MultiMemberGroupCreate(ctx, &bertytypes.MultiMemberGroupCreate_Request{})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := b.client.ActivateGroup(ctx, &bertytypes.ActivateGroup_Request{GroupPK: created.GroupPK}); err != nil {
+		return nil, err
+	}
+
+	if name != "" {
+		if err := b.SetConversationName(ctx, created.GroupPK, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return created.GroupPK, nil
+}
+
+// SetConversationName renames a multi-member conversation.
+func (b *Bot) SetConversationName(ctx context.Context, groupPK []byte, name string) error {
+	payload, err := json.Marshal(&bertymessenger.PayloadSetGroupName{
+		Type: bertymessenger.AppMessageType_SetGroupName,
+		Name: name,
+	})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	_, err = b.client.AppMessageSend(ctx, &bertytypes.AppMessageSend_Request{GroupPK: groupPK, Payload: payload})
+	return err
+}
+
+// LeaveConversation leaves a multi-member conversation.
+func (b *Bot) LeaveConversation(ctx context.Context, groupPK []byte) error {
+	_, err := b.client.MultiMemberGroupLeave(ctx, &bertytypes.MultiMemberGroupLeave_Request{GroupPK: groupPK})
+	return err
+}
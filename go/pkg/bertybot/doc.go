@@ -0,0 +1,5 @@
+// Package bertybot is the SDK of the bots running in the process of a Berty
+// node, e.g. the auto-responders and the bridges to other messengers: they
+// register handlers for the incoming messages and contact requests, and
+// reply or manage their conversations from Go code.
+package bertybot
@@ -349,6 +349,16 @@ func (s *service) SendAck(ctx context.Context, request *SendAck_Request) (*SendA
 		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only %s groups are supported", bertytypes.GroupTypeContact.String()))
 	}
 
+	mode, err := s.ConversationMode(ctx, request.GroupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	// receipts are suppressed in low-bandwidth mode
+	if mode == ConversationModeLowBandwidth {
+		return nil, nil
+	}
+
 	payload, err := json.Marshal(&PayloadAcknowledge{
 		Type:   AppMessageType_Acknowledge,
 		Target: base64.StdEncoding.EncodeToString(request.MessageID),
@@ -376,6 +386,17 @@ func (s *service) SendMessage(ctx context.Context, request *SendMessage_Request)
 		return nil, err
 	}
 
+	mode, err := s.ConversationMode(ctx, request.GroupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == ConversationModeLowBandwidth {
+		if payload, err = compressPayload(payload); err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+	}
+
 	_, err = s.protocolClient.AppMessageSend(ctx, &bertytypes.AppMessageSend_Request{
 		GroupPK: request.GroupPK,
 		Payload: payload,
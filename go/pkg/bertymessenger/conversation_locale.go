@@ -0,0 +1,114 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// AppMetadataTypeSetGroupLocale is the type of the group metadata payload
+// carrying a conversation locale hint.
+const AppMetadataTypeSetGroupLocale = "SetGroupLocale"
+
+// localeRegexp loosely matches a BCP 47 language tag, e.g. "fr" or "pt-BR".
+var localeRegexp = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// PayloadSetGroupLocale is sent as group metadata, so the hint is shared
+// with every member and every device of the conversation.
+type PayloadSetGroupLocale struct {
+	Type     string `json:"type"`
+	Locale   string `json:"locale"`
+	Inferred bool   `json:"inferred,omitempty"`
+	SetDate  int64  `json:"setDate"`
+}
+
+// ConversationLocale is the locale hint of a conversation, it can be used by
+// the clients to pick keyboards, spellcheck and translation defaults.
+type ConversationLocale struct {
+	Locale string
+
+	// Inferred is true when the hint was guessed rather than explicitly set
+	Inferred bool
+
+	SetDate time.Time
+}
+
+// ConversationLocaleSet stores the locale hint of a conversation, an empty
+// locale clears it. An inferred hint never replaces an explicit one.
+func (s *service) ConversationLocaleSet(ctx context.Context, groupPK []byte, locale string, inferred bool) error {
+	if len(groupPK) == 0 {
+		return errcode.ErrMissingInput
+	}
+
+	if locale != "" && (len(locale) > 35 || !localeRegexp.MatchString(locale)) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid locale %q", locale))
+	}
+
+	if inferred {
+		current, err := s.ConversationLocale(ctx, groupPK)
+		if err != nil {
+			return err
+		}
+
+		if current != nil && !current.Inferred {
+			return nil
+		}
+	}
+
+	payload, err := json.Marshal(&PayloadSetGroupLocale{
+		Type:     AppMetadataTypeSetGroupLocale,
+		Locale:   locale,
+		Inferred: inferred,
+		SetDate:  time.Now().UnixNano() / 1000000,
+	})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	_, err = s.protocolClient.AppMetadataSend(ctx, &bertytypes.AppMetadataSend_Request{
+		GroupPK: groupPK,
+		Payload: payload,
+	})
+
+	return err
+}
+
+// ConversationLocale returns the latest locale hint of a conversation, or nil
+// if none is set.
+func (s *service) ConversationLocale(ctx context.Context, groupPK []byte) (*ConversationLocale, error) {
+	if len(groupPK) == 0 {
+		return nil, errcode.ErrMissingInput
+	}
+
+	payloads, err := s.listGroupMetadataPayloads(ctx, groupPK, AppMetadataTypeSetGroupLocale)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *PayloadSetGroupLocale
+	for _, raw := range payloads {
+		payload := &PayloadSetGroupLocale{}
+		if err := json.Unmarshal(raw, payload); err != nil {
+			continue
+		}
+
+		if latest == nil || payload.SetDate > latest.SetDate {
+			latest = payload
+		}
+	}
+
+	if latest == nil || latest.Locale == "" {
+		return nil, nil
+	}
+
+	return &ConversationLocale{
+		Locale:   latest.Locale,
+		Inferred: latest.Inferred,
+		SetDate:  time.Unix(0, latest.SetDate*int64(time.Millisecond)),
+	}, nil
+}
@@ -0,0 +1,147 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// AppMetadataTypeSetGroupMode is the type of the group metadata payload
+// carrying the mode of a conversation.
+const AppMetadataTypeSetGroupMode = "SetGroupMode"
+
+// ConversationMode defines what is exchanged in a conversation.
+type ConversationMode string
+
+const (
+	// ConversationModeDefault exchanges everything, unless the only links
+	// available are constrained.
+	ConversationModeDefault ConversationMode = ""
+
+	// ConversationModeNormal exchanges everything.
+	ConversationModeNormal ConversationMode = "normal"
+
+	// ConversationModeLowBandwidth only exchanges compressed text messages,
+	// receipts are suppressed.
+	ConversationModeLowBandwidth ConversationMode = "lowBandwidth"
+)
+
+// compressedPayloadPrefix marks a compressed payload, it can't be the first
+// byte of a JSON payload.
+const compressedPayloadPrefix = 0x00
+
+// PayloadSetGroupMode is sent as group metadata, so every member of the
+// conversation agrees on the same mode.
+type PayloadSetGroupMode struct {
+	Type    string           `json:"type"`
+	Mode    ConversationMode `json:"mode"`
+	SetDate int64            `json:"setDate"`
+}
+
+// ConversationModeSet selects the mode of a conversation for all its members,
+// ConversationModeDefault restores the automatic selection.
+func (s *service) ConversationModeSet(ctx context.Context, groupPK []byte, mode ConversationMode) error {
+	if len(groupPK) == 0 {
+		return errcode.ErrMissingInput
+	}
+
+	switch mode {
+	case ConversationModeDefault, ConversationModeNormal, ConversationModeLowBandwidth:
+	default:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown conversation mode %q", mode))
+	}
+
+	payload, err := json.Marshal(&PayloadSetGroupMode{
+		Type:    AppMetadataTypeSetGroupMode,
+		Mode:    mode,
+		SetDate: time.Now().UnixNano() / 1000000,
+	})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	_, err = s.protocolClient.AppMetadataSend(ctx, &bertytypes.AppMetadataSend_Request{
+		GroupPK: groupPK,
+		Payload: payload,
+	})
+
+	return err
+}
+
+// ConversationMode returns the effective mode of a conversation. When no mode
+// has been selected, the low-bandwidth mode is used if the only links
+// available are constrained.
+func (s *service) ConversationMode(ctx context.Context, groupPK []byte) (ConversationMode, error) {
+	if len(groupPK) == 0 {
+		return ConversationModeDefault, errcode.ErrMissingInput
+	}
+
+	payloads, err := s.listGroupMetadataPayloads(ctx, groupPK, AppMetadataTypeSetGroupMode)
+	if err != nil {
+		return ConversationModeDefault, err
+	}
+
+	var latest *PayloadSetGroupMode
+	for _, raw := range payloads {
+		payload := &PayloadSetGroupMode{}
+		if err := json.Unmarshal(raw, payload); err != nil {
+			continue
+		}
+
+		if latest == nil || payload.SetDate > latest.SetDate {
+			latest = payload
+		}
+	}
+
+	if latest != nil && latest.Mode != ConversationModeDefault {
+		return latest.Mode, nil
+	}
+
+	if s.linkConstrained != nil && s.linkConstrained() {
+		return ConversationModeLowBandwidth, nil
+	}
+
+	return ConversationModeNormal, nil
+}
+
+// compressPayload compresses a payload sent in low-bandwidth mode.
+func compressPayload(payload []byte) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{compressedPayloadPrefix})
+
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodePayload returns the JSON of an app message payload, decompressing it
+// if it was sent in low-bandwidth mode.
+func DecodePayload(payload []byte) ([]byte, error) {
+	if len(payload) == 0 || payload[0] != compressedPayloadPrefix {
+		return payload, nil
+	}
+
+	decoded, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload[1:])))
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return decoded, nil
+}
@@ -0,0 +1,26 @@
+package bertymessenger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressPayload(t *testing.T) {
+	payload := []byte(`{"type":"UserMessage","body":"` + strings.Repeat("hello ", 100) + `"}`)
+
+	compressed, err := compressPayload(payload)
+	require.NoError(t, err)
+	assert.Less(t, len(compressed), len(payload))
+
+	decoded, err := DecodePayload(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded)
+
+	// uncompressed payloads are returned as is
+	decoded, err = DecodePayload(payload)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded)
+}
@@ -0,0 +1,324 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// ExportFormat is the format of a conversation history export.
+type ExportFormat string
+
+const (
+	// ExportFormatJSON is a single JSON document, to migrate the history
+	ExportFormatJSON ExportFormat = "json"
+
+	// ExportFormatText is readable plaintext, to archive the history
+	ExportFormatText ExportFormat = "text"
+)
+
+// exportVersion is the version of the JSON export document
+const exportVersion = 1
+
+// ParseExportFormat returns the export format of a name, JSON if empty.
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch f := ExportFormat(strings.ToLower(name)); f {
+	case "", ExportFormatJSON:
+		return ExportFormatJSON, nil
+	case ExportFormatText, "txt", "plaintext":
+		return ExportFormatText, nil
+	}
+
+	return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown export format %q", name))
+}
+
+// ExportedAttachment is the manifest of an attachment of an exported
+// message, the attachment itself is not exported.
+type ExportedAttachment struct {
+	Type string `json:"type"`
+	URI  string `json:"uri"`
+}
+
+// ExportedMessage is a user message of an exported conversation, with its
+// latest content if it was edited.
+type ExportedMessage struct {
+	ID       []byte    `json:"id"`
+	DevicePK []byte    `json:"device_pk"`
+	SentAt   time.Time `json:"sent_at"`
+	Body     string    `json:"body,omitempty"`
+
+	Attachments []*ExportedAttachment `json:"attachments,omitempty"`
+
+	// Deleted is set on a retracted message, it has no content left
+	Deleted   bool       `json:"deleted,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// exporter writes an export as the messages are listed.
+type exporter interface {
+	begin(exportedAt time.Time) error
+	conversation(groupPK []byte, groupType bertytypes.GroupType) error
+	message(m *ExportedMessage) error
+	end() error
+}
+
+// ConversationExport writes the history of a conversation, or of all the
+// conversations if groupPK is empty, as the messages are listed so a large
+// history is never held in memory.
+func (s *service) ConversationExport(ctx context.Context, groupPK []byte, format ExportFormat, w io.Writer) error {
+	format, err := ParseExportFormat(string(format))
+	if err != nil {
+		return err
+	}
+
+	conversations := []*bertytypes.Group{}
+	if len(groupPK) > 0 {
+		info, err := s.protocolClient.GroupInfo(ctx, &bertytypes.GroupInfo_Request{GroupPK: groupPK})
+		if err != nil {
+			return err
+		}
+
+		conversations = append(conversations, info.Group)
+	} else {
+		if s.protocolService == nil {
+			return errcode.ErrNotImplemented
+		}
+
+		for _, archived := range []bool{false, true} {
+			list, err := s.protocolService.ConversationList(ctx, archived)
+			if err != nil {
+				return err
+			}
+
+			for _, c := range list {
+				conversations = append(conversations, c.Group)
+			}
+		}
+	}
+
+	var e exporter
+	switch format {
+	case ExportFormatText:
+		e = &textExporter{w: w}
+	default:
+		e = &jsonExporter{w: w}
+	}
+
+	if err := e.begin(time.Now()); err != nil {
+		return err
+	}
+
+	for _, g := range conversations {
+		if err := e.conversation(g.PublicKey, g.GroupType); err != nil {
+			return err
+		}
+
+		if err := s.exportMessages(ctx, g.PublicKey, e); err != nil {
+			return err
+		}
+	}
+
+	return e.end()
+}
+
+func (s *service) exportMessages(ctx context.Context, groupPK []byte, e exporter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cl, err := s.protocolClient.GroupMessageList(ctx, &bertytypes.GroupMessageList_Request{GroupPK: groupPK})
+	if err != nil {
+		return err
+	}
+
+	for {
+		evt, err := cl.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if m := exportedMessage(evt); m != nil {
+			if err := e.message(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exportedMessage returns the user message of an event, nil for the other
+// payloads, e.g. the acknowledgements or the reactions.
+func exportedMessage(evt *bertytypes.GroupMessageEvent) *ExportedMessage {
+	if evt == nil || evt.EventContext == nil || evt.Headers == nil {
+		return nil
+	}
+
+	m := &ExportedMessage{ID: evt.EventContext.ID, DevicePK: evt.Headers.DevicePK}
+
+	decoded, err := DecodePayload(evt.Message)
+	if err != nil {
+		return nil
+	}
+
+	typed := struct {
+		Type        string `json:"type"`
+		RetractedAt int64  `json:"retractedAt"`
+	}{}
+	if err := json.Unmarshal(decoded, &typed); err == nil && typed.Type == bertyprotocol.TombstonePayloadType {
+		deletedAt := millisTime(typed.RetractedAt)
+		m.Deleted, m.DeletedAt = true, &deletedAt
+		return m
+	}
+
+	msg := &PayloadUserMessage{}
+	if err := json.Unmarshal(decoded, msg); err != nil || msg.Type != AppMessageType_UserMessage {
+		return nil
+	}
+
+	m.SentAt, m.Body = millisTime(msg.SentDate), msg.Body
+	for _, a := range msg.Attachments {
+		m.Attachments = append(m.Attachments, &ExportedAttachment{Type: a.Type.String(), URI: a.Uri})
+	}
+
+	return m
+}
+
+func millisTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// jsonExporter writes a document with the conversations and their messages,
+// each message is encoded once listed.
+type jsonExporter struct {
+	w        io.Writer
+	messages int
+	opened   bool
+	err      error
+}
+
+func (e *jsonExporter) write(parts ...interface{}) error {
+	for _, part := range parts {
+		if e.err != nil {
+			return e.err
+		}
+
+		switch p := part.(type) {
+		case string:
+			_, e.err = io.WriteString(e.w, p)
+		default:
+			var data []byte
+			if data, e.err = json.Marshal(p); e.err == nil {
+				_, e.err = e.w.Write(data)
+			} else {
+				e.err = errcode.ErrSerialization.Wrap(e.err)
+			}
+		}
+	}
+
+	return e.err
+}
+
+func (e *jsonExporter) begin(exportedAt time.Time) error {
+	return e.write(`{"version":`, exportVersion, `,"exported_at":`, exportedAt.UTC(), `,"conversations":[`)
+}
+
+func (e *jsonExporter) conversation(groupPK []byte, groupType bertytypes.GroupType) error {
+	sep := ""
+	if e.opened {
+		sep = "]},"
+	}
+
+	e.opened, e.messages = true, 0
+
+	return e.write(sep, `{"group_pk":`, groupPK, `,"group_type":`, groupType.String(), `,"messages":[`)
+}
+
+func (e *jsonExporter) message(m *ExportedMessage) error {
+	sep := ""
+	if e.messages > 0 {
+		sep = ","
+	}
+
+	e.messages++
+
+	return e.write(sep, m)
+}
+
+func (e *jsonExporter) end() error {
+	if e.opened {
+		return e.write("]}]}\n")
+	}
+
+	return e.write("]}\n")
+}
+
+// textExporter writes a readable transcript, a line by message.
+type textExporter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *textExporter) printf(format string, args ...interface{}) error {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, args...)
+	}
+
+	return e.err
+}
+
+func (e *textExporter) begin(exportedAt time.Time) error {
+	return e.printf("Berty conversation export, %s\n", exportedAt.UTC().Format(time.RFC3339))
+}
+
+func (e *textExporter) conversation(groupPK []byte, groupType bertytypes.GroupType) error {
+	return e.printf("\n== Conversation %s (%s) ==\n\n", base64.StdEncoding.EncodeToString(groupPK), groupType)
+}
+
+func (e *textExporter) message(m *ExportedMessage) error {
+	at := m.SentAt
+	if m.DeletedAt != nil {
+		at = *m.DeletedAt
+	}
+
+	date := "unknown date"
+	if !at.IsZero() {
+		date = at.Format("2006-01-02 15:04:05 UTC")
+	}
+
+	// the device is shortened like in the logs
+	author := fmt.Sprintf("%.8s", base64.StdEncoding.EncodeToString(m.DevicePK))
+
+	if m.Deleted {
+		return e.printf("[%s] %s: (message deleted)\n", date, author)
+	}
+
+	// the following lines of a message are indented under it
+	body := strings.ReplaceAll(m.Body, "\n", "\n    ")
+	if err := e.printf("[%s] %s: %s\n", date, author, body); err != nil {
+		return err
+	}
+
+	for _, a := range m.Attachments {
+		if err := e.printf("    [attachment %s] %s\n", a.Type, a.URI); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *textExporter) end() error {
+	return e.err
+}
@@ -0,0 +1,92 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportedMessage(t *testing.T) {
+	event := func(payload string) *bertytypes.GroupMessageEvent {
+		return &bertytypes.GroupMessageEvent{
+			EventContext: &bertytypes.EventContext{ID: []byte("message")},
+			Headers:      &bertytypes.MessageHeaders{DevicePK: []byte("device")},
+			Message:      []byte(payload),
+		}
+	}
+
+	m := exportedMessage(event(`{"type":"UserMessage","body":"hello","attachments":[{"type":"UserMessage","uri":"berty://file"}],"sentDate":1600000000000}`))
+	require.NotNil(t, m)
+	assert.Equal(t, "hello", m.Body)
+	assert.Equal(t, time.Unix(1600000000, 0).UTC(), m.SentAt)
+	assert.Equal(t, []*ExportedAttachment{{Type: "UserMessage", URI: "berty://file"}}, m.Attachments)
+
+	m = exportedMessage(event(`{"type":"MessageDeleted","messageId":"bWVzc2FnZQ==","retractedAt":1600000000000}`))
+	require.NotNil(t, m)
+	assert.True(t, m.Deleted)
+	assert.Empty(t, m.Body)
+
+	assert.Nil(t, exportedMessage(event(`{"type":"Acknowledge","target":"x"}`)))
+	assert.Nil(t, exportedMessage(event("not json")))
+	assert.Nil(t, exportedMessage(&bertytypes.GroupMessageEvent{Message: []byte(`{"type":"UserMessage"}`)}))
+}
+
+func TestExporters(t *testing.T) {
+	sentAt := time.Date(2020, 7, 10, 15, 30, 0, 0, time.UTC)
+	messages := []*ExportedMessage{
+		{ID: []byte("1"), DevicePK: []byte("device a"), SentAt: sentAt, Body: "hello\nworld"},
+		{ID: []byte("2"), DevicePK: []byte("device b"), SentAt: sentAt, Attachments: []*ExportedAttachment{{Type: "UserMessage", URI: "berty://file"}}},
+		{ID: []byte("3"), DevicePK: []byte("device b"), Deleted: true, DeletedAt: &sentAt},
+	}
+
+	write := func(e exporter) {
+		require.NoError(t, e.begin(sentAt))
+		require.NoError(t, e.conversation([]byte("group 1"), bertytypes.GroupTypeContact))
+		for _, m := range messages {
+			require.NoError(t, e.message(m))
+		}
+		require.NoError(t, e.conversation([]byte("group 2"), bertytypes.GroupTypeMultiMember))
+		require.NoError(t, e.end())
+	}
+
+	buf := &bytes.Buffer{}
+	write(&jsonExporter{w: buf})
+
+	doc := struct {
+		Version       int `json:"version"`
+		Conversations []struct {
+			GroupPK   []byte             `json:"group_pk"`
+			GroupType string             `json:"group_type"`
+			Messages  []*ExportedMessage `json:"messages"`
+		} `json:"conversations"`
+	}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(t, exportVersion, doc.Version)
+	require.Len(t, doc.Conversations, 2)
+	assert.Equal(t, []byte("group 1"), doc.Conversations[0].GroupPK)
+	assert.Equal(t, bertytypes.GroupTypeContact.String(), doc.Conversations[0].GroupType)
+	assert.Equal(t, messages, doc.Conversations[0].Messages)
+	assert.Empty(t, doc.Conversations[1].Messages)
+
+	// an export without conversation is still a document
+	buf.Reset()
+	e := &jsonExporter{w: buf}
+	require.NoError(t, e.begin(sentAt))
+	require.NoError(t, e.end())
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	assert.Empty(t, doc.Conversations)
+
+	buf.Reset()
+	write(&textExporter{w: buf})
+
+	text := buf.String()
+	assert.Contains(t, text, "[2020-07-10 15:30:00 UTC] ZGV2aWNl: hello\n    world\n")
+	assert.Contains(t, text, "    [attachment UserMessage] berty://file\n")
+	assert.Contains(t, text, "ZGV2aWNl: (message deleted)\n")
+	assert.Contains(t, text, "== Conversation Z3JvdXAgMg== (GroupTypeMultiMember) ==")
+}
@@ -0,0 +1,280 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// DefaultFormatLocale is used for the locales without translations.
+const DefaultFormatLocale = "en"
+
+// DeliveryStatus is the progress of the delivery of a message.
+type DeliveryStatus int
+
+const (
+	// DeliveryPending messages aren't written to the group yet
+	DeliveryPending DeliveryStatus = iota
+
+	// DeliverySent messages are written but not acknowledged yet
+	DeliverySent
+
+	// DeliveryAcknowledged messages are acknowledged by some or all of the
+	// recipients
+	DeliveryAcknowledged
+
+	// DeliveryFailed messages couldn't be written
+	DeliveryFailed
+)
+
+// DeliveryState summarizes the delivery of a message to its recipients.
+type DeliveryState struct {
+	Status DeliveryStatus
+
+	// Acknowledged and Recipients are only used by DeliveryAcknowledged, a
+	// multi-member group message is partially delivered until every member
+	// acknowledged it
+	Acknowledged int
+	Recipients   int
+}
+
+// formatLocale holds the strings of a language, the plural forms have a %d
+// verb.
+type formatLocale struct {
+	justNow   string
+	minutes   [2]string
+	hours     [2]string
+	yesterday string
+	days      [2]string
+
+	pending     string
+	sent        string
+	delivered   string
+	deliveredTo string
+	failed      string
+
+	dateLayout string
+
+	// plural reports whether n takes the plural form
+	plural func(n int) bool
+}
+
+func pluralAboveOne(n int) bool { return n > 1 }
+func pluralNotOne(n int) bool   { return n != 1 }
+
+var formatLocales = map[string]*formatLocale{
+	"en": {
+		justNow:     "just now",
+		minutes:     [2]string{"%d minute ago", "%d minutes ago"},
+		hours:       [2]string{"%d hour ago", "%d hours ago"},
+		yesterday:   "yesterday",
+		days:        [2]string{"%d day ago", "%d days ago"},
+		pending:     "sending",
+		sent:        "sent",
+		delivered:   "delivered",
+		deliveredTo: "delivered to %d of %d",
+		failed:      "not sent",
+		dateLayout:  "02/01/2006",
+		plural:      pluralNotOne,
+	},
+	"en-US": {
+		dateLayout: "01/02/2006",
+	},
+	"fr": {
+		justNow:     "à l'instant",
+		minutes:     [2]string{"il y a %d minute", "il y a %d minutes"},
+		hours:       [2]string{"il y a %d heure", "il y a %d heures"},
+		yesterday:   "hier",
+		days:        [2]string{"il y a %d jour", "il y a %d jours"},
+		pending:     "envoi en cours",
+		sent:        "envoyé",
+		delivered:   "distribué",
+		deliveredTo: "distribué à %d sur %d",
+		failed:      "non envoyé",
+		dateLayout:  "02/01/2006",
+		plural:      pluralAboveOne,
+	},
+	"de": {
+		justNow:     "gerade eben",
+		minutes:     [2]string{"vor %d Minute", "vor %d Minuten"},
+		hours:       [2]string{"vor %d Stunde", "vor %d Stunden"},
+		yesterday:   "gestern",
+		days:        [2]string{"vor %d Tag", "vor %d Tagen"},
+		pending:     "wird gesendet",
+		sent:        "gesendet",
+		delivered:   "zugestellt",
+		deliveredTo: "an %d von %d zugestellt",
+		failed:      "nicht gesendet",
+		dateLayout:  "02.01.2006",
+		plural:      pluralNotOne,
+	},
+	"es": {
+		justNow:     "ahora mismo",
+		minutes:     [2]string{"hace %d minuto", "hace %d minutos"},
+		hours:       [2]string{"hace %d hora", "hace %d horas"},
+		yesterday:   "ayer",
+		days:        [2]string{"hace %d día", "hace %d días"},
+		pending:     "enviando",
+		sent:        "enviado",
+		delivered:   "entregado",
+		deliveredTo: "entregado a %d de %d",
+		failed:      "no enviado",
+		dateLayout:  "02/01/2006",
+		plural:      pluralNotOne,
+	},
+}
+
+// resolveFormatLocale returns the strings of the locale, the missing ones are
+// taken from its language then from DefaultFormatLocale, e.g. "en-US" only
+// overrides the date layout of "en".
+func resolveFormatLocale(locale string) (*formatLocale, error) {
+	if locale == "" {
+		locale = DefaultFormatLocale
+	}
+
+	if len(locale) > 35 || !localeRegexp.MatchString(locale) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid locale %q", locale))
+	}
+
+	// the region is matched case-insensitively, e.g. "en-us"
+	parts := strings.Split(locale, "-")
+	lang := strings.ToLower(parts[0])
+
+	chain := []*formatLocale{}
+	if len(parts) > 1 {
+		if l, ok := formatLocales[lang+"-"+strings.ToUpper(parts[1])]; ok {
+			chain = append(chain, l)
+		}
+	}
+
+	if l, ok := formatLocales[lang]; ok {
+		chain = append(chain, l)
+	}
+
+	chain = append(chain, formatLocales[DefaultFormatLocale])
+
+	res := *chain[len(chain)-1]
+	for i := len(chain) - 2; i >= 0; i-- {
+		mergeFormatLocale(&res, chain[i])
+	}
+
+	return &res, nil
+}
+
+func mergeFormatLocale(dst, src *formatLocale) {
+	set := func(d *string, s string) {
+		if s != "" {
+			*d = s
+		}
+	}
+
+	set(&dst.justNow, src.justNow)
+	set(&dst.yesterday, src.yesterday)
+	set(&dst.pending, src.pending)
+	set(&dst.sent, src.sent)
+	set(&dst.delivered, src.delivered)
+	set(&dst.deliveredTo, src.deliveredTo)
+	set(&dst.failed, src.failed)
+	set(&dst.dateLayout, src.dateLayout)
+
+	for _, forms := range []struct{ d, s *[2]string }{{&dst.minutes, &src.minutes}, {&dst.hours, &src.hours}, {&dst.days, &src.days}} {
+		if forms.s[0] != "" {
+			*forms.d = *forms.s
+		}
+	}
+
+	if src.plural != nil {
+		dst.plural = src.plural
+	}
+}
+
+func (l *formatLocale) count(forms [2]string, n int) string {
+	if l.plural(n) {
+		return fmt.Sprintf(forms[1], n)
+	}
+
+	return fmt.Sprintf(forms[0], n)
+}
+
+// relativeTime formats ts relatively to now, in the location of now. The
+// timestamps older than a week are formatted as dates.
+func (l *formatLocale) relativeTime(ts, now time.Time) string {
+	ts = ts.In(now.Location())
+	elapsed := now.Sub(ts)
+
+	// the clocks of the devices may be slightly skewed
+	if elapsed < time.Minute {
+		return l.justNow
+	}
+
+	if elapsed < time.Hour {
+		return l.count(l.minutes, int(elapsed/time.Minute))
+	}
+
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	if !ts.Before(today) {
+		return l.count(l.hours, int(elapsed/time.Hour))
+	}
+
+	if !ts.Before(today.AddDate(0, 0, -1)) {
+		return l.yesterday
+	}
+
+	for days := 2; days < 7; days++ {
+		if !ts.Before(today.AddDate(0, 0, -days)) {
+			return l.count(l.days, days)
+		}
+	}
+
+	return ts.Format(l.dateLayout)
+}
+
+func (l *formatLocale) deliveryState(state DeliveryState) (string, error) {
+	switch state.Status {
+	case DeliveryPending:
+		return l.pending, nil
+	case DeliverySent:
+		return l.sent, nil
+	case DeliveryFailed:
+		return l.failed, nil
+	case DeliveryAcknowledged:
+		if state.Recipients < 0 || state.Acknowledged < 0 || state.Acknowledged > state.Recipients {
+			return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid acknowledgment count %d of %d", state.Acknowledged, state.Recipients))
+		}
+
+		if state.Recipients <= 1 || state.Acknowledged == state.Recipients {
+			return l.delivered, nil
+		}
+
+		return fmt.Sprintf(l.deliveredTo, state.Acknowledged, state.Recipients), nil
+	}
+
+	return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown delivery status %d", state.Status))
+}
+
+// FormatRelativeTime returns the timestamp formatted relatively to now for
+// the locale, e.g. "5 minutes ago" or "yesterday". The daemon does the
+// formatting so every client displays the same strings.
+func (s *service) FormatRelativeTime(locale string, ts time.Time) (string, error) {
+	l, err := resolveFormatLocale(locale)
+	if err != nil {
+		return "", err
+	}
+
+	return l.relativeTime(ts, time.Now()), nil
+}
+
+// FormatDeliveryState returns the summary of the delivery of a message for
+// the locale, e.g. "delivered to 2 of 3".
+func (s *service) FormatDeliveryState(locale string, state DeliveryState) (string, error) {
+	l, err := resolveFormatLocale(locale)
+	if err != nil {
+		return "", err
+	}
+
+	return l.deliveryState(state)
+}
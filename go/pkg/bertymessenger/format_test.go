@@ -0,0 +1,70 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatRelativeTime(t *testing.T) {
+	now := time.Date(2020, 7, 10, 15, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		locale   string
+		ts       time.Time
+		expected string
+	}{
+		{"en", now.Add(-10 * time.Second), "just now"},
+		{"en", now.Add(time.Minute), "just now"},
+		{"en", now.Add(-time.Minute), "1 minute ago"},
+		{"en", now.Add(-5 * time.Minute), "5 minutes ago"},
+		{"en", now.Add(-3 * time.Hour), "3 hours ago"},
+		{"en", time.Date(2020, 7, 9, 23, 0, 0, 0, time.UTC), "yesterday"},
+		{"en", time.Date(2020, 7, 7, 8, 0, 0, 0, time.UTC), "3 days ago"},
+		{"en", time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC), "01/06/2020"},
+		{"en-US", time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC), "06/01/2020"},
+		{"en-us", time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC), "06/01/2020"},
+		{"fr", now.Add(-time.Hour), "il y a 1 heure"},
+		{"fr-CA", now.Add(-2 * time.Hour), "il y a 2 heures"},
+		{"de", time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC), "01.06.2020"},
+		// untranslated languages fall back to english
+		{"ja", now.Add(-2 * time.Minute), "2 minutes ago"},
+	}
+
+	for _, c := range cases {
+		l, err := resolveFormatLocale(c.locale)
+		require.NoError(t, err)
+		assert.Equal(t, c.expected, l.relativeTime(c.ts, now), c.locale)
+	}
+
+	_, err := resolveFormatLocale("not a locale")
+	assert.Error(t, err)
+}
+
+func TestFormatDeliveryState(t *testing.T) {
+	en, err := resolveFormatLocale("en")
+	require.NoError(t, err)
+	es, err := resolveFormatLocale("es")
+	require.NoError(t, err)
+
+	res, err := en.deliveryState(DeliveryState{Status: DeliverySent})
+	require.NoError(t, err)
+	assert.Equal(t, "sent", res)
+
+	res, err = en.deliveryState(DeliveryState{Status: DeliveryAcknowledged, Acknowledged: 1, Recipients: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "delivered", res)
+
+	res, err = en.deliveryState(DeliveryState{Status: DeliveryAcknowledged, Acknowledged: 2, Recipients: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "delivered to 2 of 3", res)
+
+	res, err = es.deliveryState(DeliveryState{Status: DeliveryAcknowledged, Acknowledged: 2, Recipients: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "entregado a 2 de 3", res)
+
+	_, err = en.deliveryState(DeliveryState{Status: DeliveryAcknowledged, Acknowledged: 4, Recipients: 3})
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+)
+
+// listGroupMetadataPayloads returns the app metadata payloads of the given
+// type sent in a group.
+func (s *service) listGroupMetadataPayloads(ctx context.Context, groupPK []byte, payloadType string) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cl, err := s.protocolClient.GroupMetadataList(ctx, &bertytypes.GroupMetadataList_Request{GroupPK: groupPK})
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads [][]byte
+	for {
+		evt, err := cl.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if evt == nil || evt.Metadata == nil || evt.Metadata.EventType != bertytypes.EventTypeGroupMetadataPayloadSent {
+			continue
+		}
+
+		am := &bertytypes.AppMetadata{}
+		if err := am.Unmarshal(evt.Event); err != nil {
+			continue
+		}
+
+		typed := struct {
+			Type string `json:"type"`
+		}{}
+		if err := json.Unmarshal(am.Message, &typed); err != nil || typed.Type != payloadType {
+			continue
+		}
+
+		payloads = append(payloads, am.Message)
+	}
+
+	return payloads, nil
+}
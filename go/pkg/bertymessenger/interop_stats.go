@@ -0,0 +1,33 @@
+package bertymessenger
+
+import (
+	"encoding/json"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/interopstats"
+)
+
+// recordDeliveryLatency records the delay between the sending of a user
+// message and its reception. The clocks of the devices aren't synchronized,
+// the collector clamps the latencies.
+func recordDeliveryLatency(collector *interopstats.Collector, payload []byte, receivedAt time.Time) {
+	if latency, ok := deliveryLatency(payload, receivedAt); ok {
+		collector.RecordDelivery(latency)
+	}
+}
+
+func deliveryLatency(payload []byte, receivedAt time.Time) (time.Duration, bool) {
+	decoded, err := DecodePayload(payload)
+	if err != nil {
+		return 0, false
+	}
+
+	msg := &PayloadUserMessage{}
+	if err := json.Unmarshal(decoded, msg); err != nil || msg.Type != AppMessageType_UserMessage || msg.SentDate == 0 {
+		return 0, false
+	}
+
+	sentAt := time.Unix(0, msg.SentDate*int64(time.Millisecond))
+
+	return receivedAt.Sub(sentAt), true
+}
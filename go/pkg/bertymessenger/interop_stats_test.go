@@ -0,0 +1,24 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveryLatency(t *testing.T) {
+	sentAt := time.Unix(1600000000, 0)
+
+	latency, ok := deliveryLatency([]byte(`{"type":"UserMessage","body":"hello","sentDate":1600000000000}`), sentAt.Add(1500*time.Millisecond))
+	require.True(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, latency)
+
+	// only the user messages carry their sent date
+	_, ok = deliveryLatency([]byte(`{"type":"Acknowledge","target":"abc"}`), sentAt)
+	assert.False(t, ok)
+
+	_, ok = deliveryLatency([]byte(`not json`), sentAt)
+	assert.False(t, ok)
+}
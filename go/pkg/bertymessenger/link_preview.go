@@ -0,0 +1,100 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"berty.tech/berty/v2/go/internal/linkpreview"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.uber.org/zap"
+)
+
+// attachLinkPreviews adds the previews of the links of a user message to its
+// payload, so its recipients don't fetch them. The other payloads, the
+// compressed ones and the ones already carrying previews, even none, are
+// returned as is.
+func (s *service) attachLinkPreviews(ctx context.Context, payload []byte) []byte {
+	if s.linkPreviews == nil || len(payload) == 0 || payload[0] == compressedPayloadPrefix {
+		return payload
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &fields); err != nil || !isUserMessageType(fields["type"]) {
+		return payload
+	}
+
+	if _, ok := fields[userMessageLinkPreviews]; ok {
+		return payload
+	}
+
+	var body string
+	if err := json.Unmarshal(fields["body"], &body); err != nil {
+		return payload
+	}
+
+	previews := []*linkpreview.Preview{}
+	for _, u := range linkpreview.FindURLs(body) {
+		p, err := s.linkPreviews.Fetch(ctx, u)
+		if err != nil {
+			s.logger.Debug("link preview failed", zap.Error(err))
+			continue
+		}
+
+		previews = append(previews, p)
+	}
+
+	if len(previews) == 0 {
+		return payload
+	}
+
+	raw, err := json.Marshal(previews)
+	if err != nil {
+		return payload
+	}
+
+	fields[userMessageLinkPreviews] = raw
+
+	enriched, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+
+	return enriched
+}
+
+// isUserMessageType reports whether the type of a payload is the one of the
+// user messages, by name or by number.
+func isUserMessageType(raw json.RawMessage) bool {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return name == AppMessageType_UserMessage.String()
+	}
+
+	var typ AppMessageType
+	return json.Unmarshal(raw, &typ) == nil && typ == AppMessageType_UserMessage
+}
+
+// LinkPreview returns the preview of a link received without one. It is only
+// fetched through the proxy or the relay, the linked server doesn't learn the
+// IP of the recipient.
+func (s *service) LinkPreview(ctx context.Context, url string) (*linkpreview.Preview, error) {
+	if s.linkPreviews == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("link previews disabled"))
+	}
+
+	if s.linkPreviews.Route() == linkpreview.RouteDirect {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the link previews are fetched directly, only attached by their senders"))
+	}
+
+	minimal, err := s.AccountMinimalMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if minimal {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("link previews disabled in minimal metadata mode"))
+	}
+
+	return s.linkPreviews.Fetch(ctx, url)
+}
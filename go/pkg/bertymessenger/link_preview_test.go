@@ -0,0 +1,73 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/linkpreview"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAttachLinkPreviews(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><title>Berty</title></head></html>`))
+	}))
+	defer srv.Close()
+
+	// the proxy route reaches the test server, a direct dialer stands for
+	// the proxy
+	fetcher, err := linkpreview.NewFetcher(linkpreview.Opts{Route: linkpreview.RouteProxy, Proxy: &net.Dialer{}})
+	require.NoError(t, err)
+
+	svc := &service{logger: zap.NewNop(), linkPreviews: fetcher}
+	ctx := context.Background()
+
+	for _, typ := range []string{`"UserMessage"`, `1`} {
+		enriched := svc.attachLinkPreviews(ctx, []byte(`{"type":`+typ+`,"body":"see `+srv.URL+`/page"}`))
+
+		msg := struct {
+			Body         string                 `json:"body"`
+			LinkPreviews []*linkpreview.Preview `json:"linkPreviews"`
+		}{}
+		require.NoError(t, json.Unmarshal(enriched, &msg))
+		assert.Equal(t, "see "+srv.URL+"/page", msg.Body)
+		require.Len(t, msg.LinkPreviews, 1)
+		assert.Equal(t, srv.URL+"/page", msg.LinkPreviews[0].URL)
+		assert.Equal(t, "Berty", msg.LinkPreviews[0].Title)
+	}
+
+	// the payloads of the other types, the ones with previews or without
+	// links are left as is
+	for _, payload := range []string{
+		`{"type":"TypingIndicator","body":"` + srv.URL + `"}`,
+		`{"type":"UserMessage","body":"` + srv.URL + `","linkPreviews":[]}`,
+		`{"type":"UserMessage","body":"hello"}`,
+		`not json ` + srv.URL,
+	} {
+		assert.Equal(t, payload, string(svc.attachLinkPreviews(ctx, []byte(payload))))
+	}
+
+	compressed, err := compressPayload([]byte(`{"type":"UserMessage","body":"` + srv.URL + `"}`))
+	require.NoError(t, err)
+	assert.Equal(t, compressed, svc.attachLinkPreviews(ctx, compressed))
+}
+
+func TestLinkPreviewDirectRoute(t *testing.T) {
+	fetcher, err := linkpreview.NewFetcher(linkpreview.Opts{Route: linkpreview.RouteDirect})
+	require.NoError(t, err)
+
+	// the recipients never fetch the previews directly
+	svc := &service{logger: zap.NewNop(), linkPreviews: fetcher}
+	_, err = svc.LinkPreview(context.Background(), "https://berty.tech")
+	assert.Error(t, err)
+
+	_, err = (&service{logger: zap.NewNop()}).LinkPreview(context.Background(), "https://berty.tech")
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// AppMetadataTypeSetMinimalMetadata is the type of the account metadata
+// payload switching the minimal metadata mode.
+const AppMetadataTypeSetMinimalMetadata = "SetMinimalMetadata"
+
+// The app payload types only sent by the clients, they are suppressed in
+// minimal metadata mode along with the receipts.
+const (
+	AppMessageTypeTypingIndicator = "TypingIndicator"
+	AppMessageTypeSetUserProfile  = "SetUserProfile"
+	AppMessageTypeLastSeen        = "LastSeen"
+)
+
+// userMessageLinkPreviews is the field of the user messages carrying the
+// previews of their links.
+const userMessageLinkPreviews = "linkPreviews"
+
+var minimalMetadataSuppressed = map[string]bool{
+	AppMessageType_Acknowledge.String(): true,
+	AppMessageTypeTypingIndicator:       true,
+	AppMessageTypeSetUserProfile:        true,
+	AppMessageTypeLastSeen:              true,
+}
+
+// PayloadSetMinimalMetadata is sent as account metadata, so every device of
+// the account applies the same mode.
+type PayloadSetMinimalMetadata struct {
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+	SetDate int64  `json:"setDate"`
+}
+
+// AccountMinimalMetadataSet switches the minimal metadata mode of the account:
+// read receipts, typing indicators, profile propagation, link previews and
+// last seen sharing are disabled. The mode is enforced by the protocol
+// service, whatever the client sending the payloads.
+func (s *service) AccountMinimalMetadataSet(ctx context.Context, enabled bool) error {
+	config, err := s.protocolClient.InstanceGetConfiguration(ctx, &bertytypes.InstanceGetConfiguration_Request{})
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(&PayloadSetMinimalMetadata{
+		Type:    AppMetadataTypeSetMinimalMetadata,
+		Enabled: enabled,
+		SetDate: time.Now().UnixNano() / 1000000,
+	})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := s.protocolClient.AppMetadataSend(ctx, &bertytypes.AppMetadataSend_Request{
+		GroupPK: config.AccountGroupPK,
+		Payload: payload,
+	}); err != nil {
+		return err
+	}
+
+	s.muMinimalMetadata.Lock()
+	s.minimalMetadata = &enabled
+	s.muMinimalMetadata.Unlock()
+
+	return nil
+}
+
+// AccountMinimalMetadata reports whether the minimal metadata mode is enabled,
+// the mode is read from the account metadata once then cached.
+func (s *service) AccountMinimalMetadata(ctx context.Context) (bool, error) {
+	s.muMinimalMetadata.Lock()
+	defer s.muMinimalMetadata.Unlock()
+
+	if s.minimalMetadata != nil {
+		return *s.minimalMetadata, nil
+	}
+
+	config, err := s.protocolClient.InstanceGetConfiguration(ctx, &bertytypes.InstanceGetConfiguration_Request{})
+	if err != nil {
+		return false, err
+	}
+
+	payloads, err := s.listGroupMetadataPayloads(ctx, config.AccountGroupPK, AppMetadataTypeSetMinimalMetadata)
+	if err != nil {
+		return false, err
+	}
+
+	var latest *PayloadSetMinimalMetadata
+	for _, raw := range payloads {
+		payload := &PayloadSetMinimalMetadata{}
+		if err := json.Unmarshal(raw, payload); err != nil {
+			continue
+		}
+
+		if latest == nil || payload.SetDate > latest.SetDate {
+			latest = payload
+		}
+	}
+
+	enabled := latest != nil && latest.Enabled
+	s.minimalMetadata = &enabled
+
+	return enabled, nil
+}
+
+// filterOutgoingPayload is the bertyprotocol.OutgoingPayloadFilter applying
+// the minimal metadata mode, the link previews are attached otherwise.
+func (s *service) filterOutgoingPayload(ctx context.Context, kind bertyprotocol.OutgoingPayloadKind, _ []byte, payload []byte) ([]byte, error) {
+	enabled, err := s.AccountMinimalMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled {
+		if kind == bertyprotocol.OutgoingAppMessage {
+			return s.attachLinkPreviews(ctx, payload), nil
+		}
+
+		return payload, nil
+	}
+
+	// the profile of the account isn't sent with the contact requests
+	if kind == bertyprotocol.OutgoingContactMetadata {
+		return nil, nil
+	}
+
+	filtered, err := minimizePayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if filtered == nil {
+		s.logger.Debug("payload suppressed in minimal metadata mode")
+	}
+
+	return filtered, nil
+}
+
+// minimizePayload returns nil for the payloads leaking metadata, and removes
+// the link previews of the user messages. The payloads which aren't JSON
+// objects are returned as is.
+func minimizePayload(payload []byte) ([]byte, error) {
+	decoded, err := DecodePayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(decoded, &fields); err != nil {
+		return payload, nil
+	}
+
+	var typ string
+	if err := json.Unmarshal(fields["type"], &typ); err != nil {
+		return payload, nil
+	}
+
+	if minimalMetadataSuppressed[typ] {
+		return nil, nil
+	}
+
+	if _, ok := fields[userMessageLinkPreviews]; !ok || typ != AppMessageType_UserMessage.String() {
+		return payload, nil
+	}
+
+	delete(fields, userMessageLinkPreviews)
+
+	minimized, err := json.Marshal(fields)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	// the payload was compressed in low-bandwidth mode
+	if len(payload) != 0 && payload[0] == compressedPayloadPrefix {
+		if minimized, err = compressPayload(minimized); err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+	}
+
+	return minimized, nil
+}
@@ -0,0 +1,60 @@
+package bertymessenger
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinimizePayload(t *testing.T) {
+	for _, typ := range []string{AppMessageType_Acknowledge.String(), AppMessageTypeTypingIndicator, AppMessageTypeSetUserProfile, AppMessageTypeLastSeen} {
+		minimized, err := minimizePayload([]byte(`{"type":"` + typ + `"}`))
+		require.NoError(t, err)
+		assert.Nil(t, minimized, typ)
+	}
+
+	// the link previews are removed from the user messages
+	minimized, err := minimizePayload([]byte(`{"type":"UserMessage","body":"hello","linkPreviews":[{"url":"https://berty.tech"}]}`))
+	require.NoError(t, err)
+
+	fields := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(minimized, &fields))
+	assert.Equal(t, "hello", fields["body"])
+	assert.NotContains(t, fields, userMessageLinkPreviews)
+
+	// the other payloads are kept as is
+	payload := []byte(`{"type":"UserMessage","body":"hello"}`)
+	minimized, err = minimizePayload(payload)
+	require.NoError(t, err)
+	assert.Equal(t, payload, minimized)
+
+	payload = []byte("not json")
+	minimized, err = minimizePayload(payload)
+	require.NoError(t, err)
+	assert.Equal(t, payload, minimized)
+}
+
+func TestMinimizeCompressedPayload(t *testing.T) {
+	body := strings.Repeat("hello ", 100)
+
+	compressed, err := compressPayload([]byte(`{"type":"UserMessage","body":"` + body + `","linkPreviews":[]}`))
+	require.NoError(t, err)
+
+	minimized, err := minimizePayload(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, byte(compressedPayloadPrefix), minimized[0])
+
+	decoded, err := DecodePayload(minimized)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"UserMessage","body":"`+body+`"}`, string(decoded))
+
+	compressed, err = compressPayload([]byte(`{"type":"Acknowledge","target":"` + body + `"}`))
+	require.NoError(t, err)
+
+	minimized, err = minimizePayload(compressed)
+	require.NoError(t, err)
+	assert.Nil(t, minimized)
+}
@@ -0,0 +1,21 @@
+package bertymessenger
+
+import (
+	"encoding/json"
+)
+
+// searchText returns the text of a payload indexed by the protocol search,
+// the body of the user messages.
+func searchText(payload []byte) string {
+	decoded, err := DecodePayload(payload)
+	if err != nil {
+		return ""
+	}
+
+	msg := &PayloadUserMessage{}
+	if err := json.Unmarshal(decoded, msg); err != nil || msg.Type != AppMessageType_UserMessage {
+		return ""
+	}
+
+	return msg.Body
+}
@@ -0,0 +1,18 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchText(t *testing.T) {
+	assert.Equal(t, "hello", searchText([]byte(`{"type":"UserMessage","body":"hello","sentDate":1600000000000}`)))
+	assert.Empty(t, searchText([]byte(`{"type":"UserReaction","emoji":"👍"}`)))
+	assert.Empty(t, searchText([]byte("not json")))
+
+	compressed, err := compressPayload([]byte(`{"type":"UserMessage","body":"compressed"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "compressed", searchText(compressed))
+}
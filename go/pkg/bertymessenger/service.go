@@ -1,25 +1,77 @@
 package bertymessenger
 
 import (
+	"context"
+	"io"
+	"sync"
 	"time"
 
+	"berty.tech/berty/v2/go/internal/interopstats"
+	"berty.tech/berty/v2/go/internal/linkpreview"
 	"berty.tech/berty/v2/go/pkg/bertyprotocol"
 	"go.uber.org/zap"
 )
 
-func New(client bertyprotocol.ProtocolServiceClient, opts *Opts) MessengerServiceServer {
+// Service is the main Berty Messenger interface
+type Service interface {
+	MessengerServiceServer
+
+	ConversationLocaleSet(ctx context.Context, groupPK []byte, locale string, inferred bool) error
+	ConversationLocale(ctx context.Context, groupPK []byte) (*ConversationLocale, error)
+	ConversationModeSet(ctx context.Context, groupPK []byte, mode ConversationMode) error
+	ConversationMode(ctx context.Context, groupPK []byte) (ConversationMode, error)
+	FormatRelativeTime(locale string, ts time.Time) (string, error)
+	FormatDeliveryState(locale string, state DeliveryState) (string, error)
+	AccountMinimalMetadataSet(ctx context.Context, enabled bool) error
+	AccountMinimalMetadata(ctx context.Context) (bool, error)
+	ConversationExport(ctx context.Context, groupPK []byte, format ExportFormat, w io.Writer) error
+	LinkPreview(ctx context.Context, url string) (*linkpreview.Preview, error)
+}
+
+func New(client bertyprotocol.ProtocolServiceClient, opts *Opts) Service {
 	svc := service{
 		protocolClient:  client,
 		logger:          opts.Logger,
 		startedAt:       time.Now(),
 		protocolService: opts.ProtocolService,
+		linkConstrained: opts.LinkConstrained,
+		linkPreviews:    opts.LinkPreviews,
+	}
+
+	// the minimal metadata mode is enforced by the protocol service, so the
+	// payloads sent by the other clients are filtered too
+	if opts.ProtocolService != nil {
+		opts.ProtocolService.SetOutgoingPayloadFilter(svc.filterOutgoingPayload)
+
+		// the protocol indexes the body of the user messages for the search
+		opts.ProtocolService.SetSearchTextExtractor(searchText)
+
+		if opts.InteropStats != nil {
+			opts.ProtocolService.SetIncomingPayloadObserver(func(_ []byte, payload []byte) {
+				recordDeliveryLatency(opts.InteropStats, payload, time.Now())
+			})
+		}
 	}
+
 	return &svc
 }
 
 type Opts struct {
 	Logger          *zap.Logger
 	ProtocolService bertyprotocol.Service
+
+	// LinkConstrained reports whether the only links available are
+	// low-bandwidth ones, it enables the low-bandwidth mode of the
+	// conversations without an explicit mode.
+	LinkConstrained func() bool
+
+	// InteropStats, if set, records the delivery latency of the user
+	// messages received
+	InteropStats *interopstats.Collector
+
+	// LinkPreviews, if set, attaches the previews of the links to the user
+	// messages sent
+	LinkPreviews *linkpreview.Fetcher
 }
 
 type service struct {
@@ -27,6 +79,11 @@ type service struct {
 	protocolClient  bertyprotocol.ProtocolServiceClient
 	startedAt       time.Time
 	protocolService bertyprotocol.Service // optional, for debugging only
+	linkConstrained func() bool
+	linkPreviews    *linkpreview.Fetcher
+
+	muMinimalMetadata sync.Mutex
+	minimalMetadata   *bool
 }
 
-var _ MessengerServiceServer = (*service)(nil)
+var _ Service = (*service)(nil)
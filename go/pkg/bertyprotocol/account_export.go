@@ -0,0 +1,419 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/accountbackup"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
+)
+
+// AccountExportVersion is the version of the account export format produced
+// by this package.
+const AccountExportVersion = 1
+
+var accountImportKey = datastore.NewKey("pending")
+
+// AccountExport is the state of an account moved to a new device without
+// linking both devices: the keys of the account, its contacts, the
+// conversations it joined and its settings. The history of the
+// conversations isn't exported, it is synced back from their members.
+//
+// It is sealed with a passphrase, see the accountbackup package.
+type AccountExport struct {
+	Version        int    `json:"version"`
+	AccountSK      []byte `json:"account_sk,omitempty"`
+	AccountProofSK []byte `json:"account_proof_sk,omitempty"`
+
+	Contacts *ContactList `json:"contacts"`
+
+	// Groups are the serialized MultiMember groups, with their secrets
+	Groups [][]byte `json:"groups,omitempty"`
+
+	// ContactRequestsEnabled and RendezvousSeed keep the contact link of the
+	// account valid
+	ContactRequestsEnabled bool   `json:"contact_requests_enabled"`
+	RendezvousSeed         []byte `json:"rendezvous_seed,omitempty"`
+
+	Flags           []*ConversationFlags `json:"flags,omitempty"`
+	ContactMetadata []*ContactMetadata   `json:"contact_metadata,omitempty"`
+	Profile         *Profile             `json:"profile,omitempty"`
+
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// AccountImportReport summarizes an account import, the state is restored
+// once the node is restarted on the imported account.
+type AccountImportReport struct {
+	AccountPK  []byte    `json:"account_pk"`
+	ExportedAt time.Time `json:"exported_at"`
+	Contacts   int       `json:"contacts"`
+	Blocked    int       `json:"blocked"`
+	Groups     int       `json:"groups"`
+}
+
+// pendingAccountImport is the imported state waiting for the node to restart
+// on the imported account, without its keys.
+type pendingAccountImport struct {
+	AccountPK []byte         `json:"account_pk"`
+	Export    *AccountExport `json:"export"`
+}
+
+// AccountExport returns the account of the device in a file sealed with the
+// passphrase.
+func (s *service) AccountExport(ctx context.Context, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	exp, err := s.accountExport(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(exp)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	data, err := accountbackup.Seal(passphrase, payload)
+	if err != nil {
+		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
+	}
+
+	return data, nil
+}
+
+func (s *service) accountExport(ctx context.Context) (*AccountExport, error) {
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	proofSK, err := s.deviceKeystore.AccountProofPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	exp := &AccountExport{
+		Version:    AccountExportVersion,
+		ExportedAt: time.Now(),
+	}
+
+	if exp.AccountSK, err = crypto.MarshalPrivateKey(accountSK); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if exp.AccountProofSK, err = crypto.MarshalPrivateKey(proofSK); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if exp.Contacts, err = s.ContactListExport(ctx); err != nil {
+		return nil, err
+	}
+
+	meta := s.accountGroup.MetadataStore()
+	for _, g := range meta.ListMultiMemberGroups() {
+		data, err := g.Marshal()
+		if err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+
+		exp.Groups = append(exp.Groups, data)
+	}
+
+	var ref *bertytypes.ShareableContact
+	if exp.ContactRequestsEnabled, ref = meta.GetIncomingContactRequestsStatus(); ref != nil {
+		exp.RendezvousSeed = ref.PublicRendezvousSeed
+	}
+
+	flags, err := s.flags.all()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range flags {
+		if f.Archived || f.Pinned || f.Muted {
+			exp.Flags = append(exp.Flags, f)
+		}
+	}
+
+	for _, c := range exp.Contacts.Contacts {
+		m, err := s.contactMeta.get(c.PK)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.Nickname != "" || m.Avatar != "" {
+			exp.ContactMetadata = append(exp.ContactMetadata, &ContactMetadata{ContactPK: c.PK, Nickname: m.Nickname, Avatar: m.Avatar})
+		}
+	}
+
+	if exp.Profile, err = s.Profile(ctx); err != nil {
+		return nil, err
+	}
+
+	return exp, nil
+}
+
+// AccountImport opens an account exported with AccountExport and replaces
+// the account of the device by it. Its state is restored and the device
+// announced to its groups once the node is restarted on it.
+func (s *service) AccountImport(_ context.Context, data []byte, passphrase string) (*AccountImportReport, error) {
+	if len(data) == 0 || passphrase == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	payload, err := accountbackup.Open(passphrase, data)
+	if err == accountbackup.ErrDecrypt {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	exp := &AccountExport{}
+	if err := json.Unmarshal(payload, exp); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if exp.Version != AccountExportVersion {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported account export version %d", exp.Version))
+	}
+
+	if exp.Contacts == nil {
+		exp.Contacts = &ContactList{Version: ContactListVersion}
+	}
+
+	accountSK, err := crypto.UnmarshalPrivateKey(exp.AccountSK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	proofSK, err := crypto.UnmarshalPrivateKey(exp.AccountProofSK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	accountPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	ks, ok := s.deviceKeystore.(*deviceKeystore)
+	if !ok {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	// the keys are already in the keystore
+	exp.AccountSK, exp.AccountProofSK = nil, nil
+
+	pending, err := json.Marshal(&pendingAccountImport{AccountPK: accountPK, Export: exp})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := s.imports.Put(accountImportKey, pending); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := ks.importAccountKeys(accountSK, proofSK); err != nil {
+		_ = s.imports.Delete(accountImportKey)
+		return nil, err
+	}
+
+	s.logger.Info("account imported, restart to open it", zap.Time("exported-at", exp.ExportedAt))
+
+	return &AccountImportReport{
+		AccountPK:  accountPK,
+		ExportedAt: exp.ExportedAt,
+		Contacts:   len(exp.Contacts.Contacts),
+		Blocked:    len(exp.Contacts.Blocked),
+		Groups:     len(exp.Groups),
+	}, nil
+}
+
+// restoreAccountImport restores the state of an account imported before the
+// node was restarted on it.
+func (s *service) restoreAccountImport(ctx context.Context) {
+	data, err := s.imports.Get(accountImportKey)
+	if err == datastore.ErrNotFound {
+		return
+	} else if err != nil {
+		s.logger.Error("unable to read the imported account", zap.Error(err))
+		return
+	}
+
+	pending := &pendingAccountImport{}
+	if err := json.Unmarshal(data, pending); err != nil || pending.Export == nil {
+		s.logger.Error("invalid imported account, dropped", zap.Error(err))
+		_ = s.imports.Delete(accountImportKey)
+		return
+	}
+
+	accountPK, err := s.accountGroup.MemberPubKey().Raw()
+	if err != nil {
+		return
+	}
+
+	// the node is still on the previous account or another one was imported
+	// since
+	if string(accountPK) != string(pending.AccountPK) {
+		s.logger.Warn("imported account not opened, restart to open it")
+		return
+	}
+
+	if err := s.applyAccountExport(ctx, pending.Export); err != nil {
+		s.logger.Error("unable to restore the imported account", zap.Error(err))
+		return
+	}
+
+	if err := s.imports.Delete(accountImportKey); err != nil {
+		s.logger.Warn("unable to clear the imported account", zap.Error(err))
+	}
+
+	s.logger.Info("imported account restored")
+}
+
+// applyAccountExport restores the state of an export on the account group of
+// the device, the entries already known are left untouched so it can be
+// applied again if interrupted.
+func (s *service) applyAccountExport(ctx context.Context, exp *AccountExport) error {
+	meta := s.accountGroup.MetadataStore()
+
+	// the contacts accepted the account already, they are added back
+	// without sending them a request
+	for _, entry := range exp.Contacts.Contacts {
+		pk, err := crypto.UnmarshalEd25519PublicKey(entry.PK)
+		if err != nil {
+			continue
+		}
+
+		if meta.checkContactStatus(pk, bertytypes.ContactStateUndefined) {
+			contact := &bertytypes.ShareableContact{
+				PK:                   entry.PK,
+				PublicRendezvousSeed: entry.PublicRendezvousSeed,
+				Metadata:             entry.Metadata,
+			}
+
+			if _, err := meta.ContactRequestOutgoingEnqueue(ctx, contact, nil); err != nil {
+				s.logger.Warn("unable to restore contact", zap.Error(err))
+				continue
+			}
+		}
+
+		if meta.checkContactStatus(pk, bertytypes.ContactStateToRequest) {
+			if _, err := meta.ContactRequestOutgoingSent(ctx, pk); err != nil {
+				return errcode.ErrOrbitDBAppend.Wrap(err)
+			}
+		}
+
+		if g, err := s.getContactGroup(pk); err == nil {
+			s.activateRestoredGroup(ctx, g.PublicKey)
+		}
+	}
+
+	for _, entry := range exp.Contacts.Blocked {
+		pk, err := crypto.UnmarshalEd25519PublicKey(entry.PK)
+		if err != nil || meta.checkContactStatus(pk, bertytypes.ContactStateBlocked) {
+			continue
+		}
+
+		if _, err := meta.ContactBlock(ctx, pk); err != nil {
+			return errcode.ErrOrbitDBAppend.Wrap(err)
+		}
+	}
+
+	for _, data := range exp.Groups {
+		g := &bertytypes.Group{}
+		if err := g.Unmarshal(data); err != nil {
+			s.logger.Warn("invalid group in imported account", zap.Error(err))
+			continue
+		}
+
+		if !meta.checkIfInGroup(g.PublicKey) {
+			if _, err := meta.GroupJoin(ctx, g); err != nil {
+				return errcode.ErrOrbitDBAppend.Wrap(err)
+			}
+		}
+
+		s.activateRestoredGroup(ctx, g.PublicKey)
+	}
+
+	if len(exp.RendezvousSeed) > 0 {
+		if _, ref := meta.GetIncomingContactRequestsStatus(); ref == nil || string(ref.PublicRendezvousSeed) != string(exp.RendezvousSeed) {
+			if _, err := meta.attributeSignAndAddEvent(ctx, &bertytypes.AccountContactRequestReferenceReset{
+				PublicRendezvousSeed: exp.RendezvousSeed,
+			}, bertytypes.EventTypeAccountContactRequestReferenceReset); err != nil {
+				return errcode.ErrOrbitDBAppend.Wrap(err)
+			}
+		}
+	}
+
+	if enabled, _ := meta.GetIncomingContactRequestsStatus(); exp.ContactRequestsEnabled && !enabled {
+		if _, err := meta.ContactRequestEnable(ctx); err != nil {
+			return errcode.ErrOrbitDBAppend.Wrap(err)
+		}
+	}
+
+	for _, f := range exp.Flags {
+		s.restoreConversationFlags(ctx, f)
+	}
+
+	for _, m := range exp.ContactMetadata {
+		for field, value := range map[ContactMetadataField]string{ContactMetadataNickname: m.Nickname, ContactMetadataAvatar: m.Avatar} {
+			if value == "" {
+				continue
+			}
+
+			if err := s.ContactMetadataSet(ctx, m.ContactPK, field, value); err != nil {
+				s.logger.Warn("unable to restore contact metadata", zap.Error(err))
+			}
+		}
+	}
+
+	// the profile is published again, with this device
+	if exp.Profile != nil {
+		if err := s.ProfileSet(ctx, exp.Profile.DisplayName, exp.Profile.Avatar); err != nil {
+			s.logger.Warn("unable to restore profile", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// activateRestoredGroup opens a group of the imported account, which
+// announces the device to its members.
+func (s *service) activateRestoredGroup(ctx context.Context, groupPK []byte) {
+	if _, err := s.ActivateGroup(ctx, &bertytypes.ActivateGroup_Request{GroupPK: groupPK}); err != nil {
+		s.logger.Warn("unable to open group of imported account", zap.Error(err))
+	}
+}
+
+func (s *service) restoreConversationFlags(ctx context.Context, f *ConversationFlags) {
+	current, err := s.flags.get(f.GroupPK)
+	if err != nil {
+		return
+	}
+
+	set := func(flag ConversationFlag, value, was bool, until time.Time) {
+		if !value || was {
+			return
+		}
+
+		if err := s.ConversationFlagSet(ctx, f.GroupPK, flag, true, until); err != nil {
+			s.logger.Warn("unable to restore conversation flag", zap.String("flag", string(flag)), zap.Error(err))
+		}
+	}
+
+	set(ConversationFlagArchived, f.Archived, current.Archived, time.Time{})
+	set(ConversationFlagPinned, f.Pinned, current.Pinned, time.Time{})
+
+	// an expired mute isn't restored
+	set(ConversationFlagMuted, f.IsMuted(time.Now()), current.Muted, f.MutedUntil)
+}
@@ -0,0 +1,70 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountExportImport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	old, cleanupOld := TestingService(t, Opts{RootContext: ctx})
+	defer cleanupOld()
+
+	require.NoError(t, old.ProfileSet(ctx, "alice", ""))
+
+	created, err := old.MultiMemberGroupCreate(ctx, &bertytypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	data, err := old.AccountExport(ctx, "passphrase")
+	require.NoError(t, err)
+
+	_, err = old.AccountExport(ctx, "")
+	assert.True(t, errcode.Is(err, errcode.ErrMissingInput))
+
+	// the new device runs its own account until the import
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	phone, cleanupPhone := TestingService(t, Opts{RootContext: ctx, RootDatastore: store})
+
+	_, err = phone.AccountImport(ctx, data, "wrong")
+	assert.True(t, errcode.Is(err, errcode.ErrCryptoDecrypt))
+
+	report, err := phone.AccountImport(ctx, data, "passphrase")
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Groups)
+
+	oldInfo, err := old.InstanceGetConfiguration(ctx, &bertytypes.InstanceGetConfiguration_Request{})
+	require.NoError(t, err)
+	assert.Equal(t, oldInfo.AccountPK, report.AccountPK)
+
+	cleanupPhone()
+
+	// the state is restored once restarted on the imported account
+	phone, cleanupPhone = TestingService(t, Opts{RootContext: ctx, RootDatastore: store})
+	defer cleanupPhone()
+
+	info, err := phone.InstanceGetConfiguration(ctx, &bertytypes.InstanceGetConfiguration_Request{})
+	require.NoError(t, err)
+	assert.Equal(t, oldInfo.AccountPK, info.AccountPK)
+	assert.NotEqual(t, oldInfo.DevicePK, info.DevicePK)
+
+	s := phone.(*service)
+	require.Eventually(t, func() bool {
+		profile, err := phone.Profile(ctx)
+		return err == nil && profile != nil && profile.DisplayName == "alice" && s.accountGroup.MetadataStore().checkIfInGroup(created.GroupPK)
+	}, 10*time.Second, 50*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		_, err := s.imports.Get(accountImportKey)
+		return err == datastore.ErrNotFound
+	}, 10*time.Second, 50*time.Millisecond)
+}
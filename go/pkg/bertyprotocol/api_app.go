@@ -2,9 +2,13 @@ package bertyprotocol
 
 import (
 	"context"
+	"time"
 
+	bertymetrics "berty.tech/berty/v2/go/internal/metrics"
 	"berty.tech/berty/v2/go/pkg/bertytypes"
 	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.uber.org/zap"
 )
 
 func (s *service) AppMetadataSend(ctx context.Context, req *bertytypes.AppMetadataSend_Request) (*bertytypes.AppMetadataSend_Reply, error) {
@@ -13,7 +17,17 @@ func (s *service) AppMetadataSend(ctx context.Context, req *bertytypes.AppMetada
 		return nil, errcode.ErrGroupMissing.Wrap(err)
 	}
 
-	if _, err := g.MetadataStore().SendAppMetadata(ctx, req.Payload); err != nil {
+	payload, err := s.filterOutgoing(ctx, OutgoingAppMetadata, req.GroupPK, req.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// suppressed by the filter
+	if payload == nil {
+		return &bertytypes.AppMetadataSend_Reply{}, nil
+	}
+
+	if _, err := g.MetadataStore().SendAppMetadata(ctx, payload); err != nil {
 		return nil, errcode.ErrOrbitDBAppend.Wrap(err)
 	}
 
@@ -21,14 +35,94 @@ func (s *service) AppMetadataSend(ctx context.Context, req *bertytypes.AppMetada
 }
 
 func (s *service) AppMessageSend(ctx context.Context, req *bertytypes.AppMessageSend_Request) (*bertytypes.AppMessageSend_Reply, error) {
-	g, err := s.getContextGroupForID(req.GroupPK)
+	if _, err := s.AppMessageSendWithID(ctx, req.GroupPK, req.Payload); err != nil {
+		return nil, err
+	}
+
+	return &bertytypes.AppMessageSend_Reply{}, nil
+}
+
+// AppMessageSendWithID is AppMessageSend returning the ID of the message sent,
+// e.g. to follow its deliveries, it is nil if the message was suppressed by
+// the outgoing filter.
+func (s *service) AppMessageSendWithID(ctx context.Context, groupPK []byte, payload []byte) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "Send Message")
+	defer span.End()
+
+	g, err := s.getContextGroupForID(groupPK)
 	if err != nil {
 		return nil, errcode.ErrGroupMissing.Wrap(err)
 	}
 
-	if _, err := g.MessageStore().AddMessage(ctx, req.Payload); err != nil {
+	_, compose := s.tracer.Start(ctx, "Compose Message")
+	payload, err = s.filterOutgoing(ctx, OutgoingAppMessage, groupPK, payload)
+	if err != nil {
+		compose.End()
+		return nil, err
+	}
+
+	// suppressed by the filter
+	if payload == nil {
+		compose.End()
+		return nil, nil
+	}
+
+	ttl := time.Duration(0)
+	if g.Group().GroupType != bertytypes.GroupTypeAccount {
+		if payload, ttl, err = s.sealOutgoingEphemeral(groupPK, payload); err != nil {
+			compose.End()
+			return nil, err
+		}
+	}
+	compose.End()
+
+	// compressed before being sealed, the ciphertexts don't shrink
+	payload = s.compressPayload(g, payload)
+
+	_, encrypt := s.tracer.Start(ctx, "Encrypt Message")
+	payload, err = s.sealRatchetPayload(g, payload)
+	encrypt.End()
+	if err != nil {
+		return nil, err
+	}
+
+	// the envelope is sealed while it is added to the store
+	enqueueCtx, enqueue := s.tracer.Start(ctx, "Enqueue Message")
+	op, err := g.MessageStore().AddMessage(enqueueCtx, payload)
+	if err != nil {
+		enqueue.End()
 		return nil, errcode.ErrOrbitDBAppend.Wrap(err)
 	}
 
-	return &bertytypes.AppMessageSend_Reply{}, nil
+	span.SetAttributes(kv.String("message.cid", op.GetEntry().GetHash().String()))
+	s.metrics.RecordMessage(bertymetrics.DirectionSent)
+
+	if ttl > 0 {
+		if _, err := s.ephemeral.schedule(groupPK, op.GetEntry().GetHash().Bytes(), time.Now().Add(ttl)); err != nil {
+			s.logger.Warn("unable to schedule message deletion", zap.Error(err))
+		}
+	}
+
+	if g.Group().GroupType != bertytypes.GroupTypeAccount {
+		if err := s.deliveries.sent(g.Group().PublicKey, op.GetEntry().GetHash().Bytes(), time.Now()); err != nil {
+			s.logger.Warn("unable to record sent message", zap.Error(err))
+		}
+
+		if err := s.outbound.add(g.Group().PublicKey, op.GetEntry().GetHash().Bytes(), len(payload), time.Now()); err != nil {
+			s.logger.Warn("unable to queue sent message", zap.Error(err))
+		}
+	}
+	enqueue.End()
+
+	if err := s.carryMessage(ctx, g.Group(), op.GetEntry()); err != nil {
+		s.logger.Warn("unable to carry message", zap.Error(err))
+	}
+
+	if err := s.publishMessage(ctx, g.Group(), op.GetEntry()); err != nil {
+		s.logger.Warn("unable to publish message", zap.Error(err))
+	}
+
+	s.pushMessage(g, op.GetEntry())
+
+	return op.GetEntry().GetHash().Bytes(), nil
 }
@@ -0,0 +1,108 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	"berty.tech/berty/v2/go/internal/tracer"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/api/kv"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+)
+
+func spanAttr(span *export.SpanData, key kv.Key) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value.AsString()
+		}
+	}
+
+	return ""
+}
+
+func childSpans(spans []*export.SpanData, parent *export.SpanData) []*export.SpanData {
+	children := []*export.SpanData{}
+	for _, span := range spans {
+		if span.ParentSpanID == parent.SpanContext.SpanID {
+			children = append(children, span)
+		}
+	}
+
+	return children
+}
+
+func TestAppMessageSendSpans(t *testing.T) {
+	_, spans := tracer.NewRecordingProvider(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	opts := TestingOpts{
+		Mocknet: libp2p_mocknet.New(ctx),
+		Logger:  testutil.Logger(t),
+	}
+
+	tps, cleanup := newTestingProtocolWithMockedPeers(ctx, t, &opts, 2)
+	defer cleanup()
+
+	ConnectAll(t, opts.Mocknet)
+
+	groupPK := createMultiMemberGroup(ctx, t, tps...)
+	spans.Reset()
+
+	_, err := tps[0].Client.AppMessageSend(ctx, &bertytypes.AppMessageSend_Request{
+		GroupPK: groupPK,
+		Payload: []byte("hello"),
+	})
+	require.NoError(t, err)
+
+	sends := spans.Spans("Send Message")
+	require.Len(t, sends, 1)
+	send := sends[0]
+
+	cid := spanAttr(send, "message.cid")
+	require.NotEmpty(t, cid)
+
+	// the stages of the sender are children of its span
+	for _, name := range []string{"Compose Message", "Encrypt Message", "Enqueue Message"} {
+		assert.Len(t, childSpans(spans.Spans(name), send), 1, name)
+	}
+
+	// a write by transport, the pubsub one publishes on the topic of the group
+	published := false
+	for _, write := range childSpans(spans.Spans("Write Message"), send) {
+		if spanAttr(write, "transport") == string(EnvelopeSourcePubSub) {
+			published = len(childSpans(spans.Spans("Publish Group Message"), write)) == 1
+		}
+	}
+	assert.True(t, published)
+
+	// the message is decrypted by the members, its dispatch is linked to the
+	// trace of the sender
+	require.Eventually(t, func() bool {
+		for _, span := range spans.Spans("Decrypt Message") {
+			if spanAttr(span, "message.cid") == cid {
+				return true
+			}
+		}
+
+		return false
+	}, 10*time.Second, 50*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		for _, span := range spans.Spans("Dispatch Message") {
+			for _, link := range span.Links {
+				if link.SpanContext.TraceID == send.SpanContext.TraceID {
+					return true
+				}
+			}
+		}
+
+		return false
+	}, 10*time.Second, 50*time.Millisecond)
+}
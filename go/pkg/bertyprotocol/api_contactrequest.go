@@ -75,7 +75,12 @@ func (s *service) ContactRequestSend(ctx context.Context, req *bertytypes.Contac
 		return nil, errcode.ErrInvalidInput
 	}
 
-	if _, err := s.accountGroup.MetadataStore().ContactRequestOutgoingEnqueue(ctx, shareableContact, req.OwnMetadata); err != nil {
+	ownMetadata, err := s.filterOutgoing(ctx, OutgoingContactMetadata, nil, req.OwnMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.accountGroup.MetadataStore().ContactRequestOutgoingEnqueue(ctx, shareableContact, ownMetadata); err != nil {
 		return nil, errcode.ErrOrbitDBAppend.Wrap(err)
 	}
 
@@ -97,6 +102,8 @@ func (s *service) ContactRequestAccept(ctx context.Context, req *bertytypes.Cont
 		return nil, err
 	}
 
+	go s.sendContactAccepted(s.ctx, pk)
+
 	return &bertytypes.ContactRequestAccept_Reply{}, nil
 }
 
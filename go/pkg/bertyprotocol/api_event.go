@@ -91,6 +91,11 @@ func (s *service) GroupMessageSubscribe(req *bertytypes.GroupMessageSubscribe_Re
 			}
 
 			for e := range ch {
+				e, ok := s.renderMessage(cg, e)
+				if !ok {
+					continue
+				}
+
 				if inErr := sub.Send(e); inErr != nil {
 					if sub.Context().Err() != nil {
 						return
@@ -110,11 +115,31 @@ func (s *service) GroupMessageSubscribe(req *bertytypes.GroupMessageSubscribe_Re
 	ch := cg.MessageStore().Subscribe(sub.Context())
 
 	for evt := range ch {
+		if expired, ok := evt.(*EvtMessageExpired); ok {
+			e, err := renderExpired(expired)
+			if err != nil {
+				continue
+			}
+
+			if err := sub.Send(e); err != nil {
+				if sub.Context().Err() != nil {
+					return nil
+				}
+				return err
+			}
+
+			continue
+		}
+
 		e, ok := evt.(*bertytypes.GroupMessageEvent)
 		if !ok {
 			continue
 		}
 
+		if e, ok = s.renderMessage(cg, e); !ok {
+			continue
+		}
+
 		_, span := tracer.SpanFromMessageHeaders(sub.Context(), e.Headers, "Receive Group Message")
 		err := sub.Send(e)
 		span.End()
@@ -164,6 +189,11 @@ func (s *service) GroupMessageList(req *bertytypes.GroupMessageList_Request, sub
 	}
 
 	for evt := range messages {
+		evt, ok := s.renderMessage(cg, evt)
+		if !ok {
+			continue
+		}
+
 		if err := sub.Send(evt); err != nil {
 			if sub.Context().Err() != nil {
 				cg.logger.Error("context closed", zap.Error(err))
@@ -7,6 +7,7 @@ import (
 	"berty.tech/berty/v2/go/pkg/bertytypes"
 	"berty.tech/berty/v2/go/pkg/errcode"
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
 )
 
 // MultiMemberGroupCreate creates a new MultiMember group
@@ -62,6 +63,12 @@ func (s *service) MultiMemberGroupLeave(ctx context.Context, req *bertytypes.Mul
 		return nil, errcode.ErrDeserialization.Wrap(err)
 	}
 
+	if gc, err := s.getMultiMemberGroupContext(req.GroupPK); err == nil {
+		if err := s.sendMembershipOp(ctx, gc, MembershipOpLeave, nil); err != nil {
+			s.logger.Warn("unable to announce group leave", zap.Error(err))
+		}
+	}
+
 	_, err = s.accountGroup.MetadataStore().GroupLeave(ctx, pk)
 	if err != nil {
 		return nil, errcode.ErrOrbitDBAppend.Wrap(err)
@@ -0,0 +1,142 @@
+package bertyprotocol
+
+import (
+	"context"
+	"io"
+
+	"berty.tech/berty/v2/go/internal/attachment"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.uber.org/zap"
+)
+
+// AttachmentAdd stores a file to attach to a message, the returned
+// descriptor has to be sent within the message. The files from
+// Opts.AttachmentPublishSize are published on IPFS.
+func (s *service) AttachmentAdd(ctx context.Context, r io.Reader) (*attachment.Descriptor, error) {
+	if s.attachments == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	d, err := s.attachments.Add(r)
+	if err != nil || s.attachPublish <= 0 || d.Size < s.attachPublish {
+		return d, err
+	}
+
+	// the attachment is still served to the members if it can't be published
+	published, err := s.attachments.Publish(ctx, d)
+	if err != nil {
+		s.logger.Warn("unable to publish attachment", zap.Int64("size", d.Size), zap.Error(err))
+		return d, nil
+	}
+
+	return published, nil
+}
+
+// AttachmentFetch gets an attachment received in a group from the peers of
+// the group holding it, i.e. the devices of its sender or of the members
+// which already fetched it. It fails while chunks are missing, the transfer
+// is resumed once one of the peers is connected again.
+func (s *service) AttachmentFetch(ctx context.Context, groupPK []byte, d *attachment.Descriptor) error {
+	if s.attachments == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	if _, err := s.getContextGroupForID(groupPK); err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	return s.attachments.Fetch(ctx, groupPK, d, s.conversations.groupPeers(groupPK))
+}
+
+// AttachmentRead writes the content of an attachment once it is fetched.
+func (s *service) AttachmentRead(_ context.Context, d *attachment.Descriptor, w io.Writer) error {
+	if s.attachments == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	return s.attachments.Read(d, w)
+}
+
+// AttachmentPin pins an attachment published on IPFS on the node, e.g. on
+// the other devices of the account of its sender.
+func (s *service) AttachmentPin(ctx context.Context, d *attachment.Descriptor) error {
+	if s.attachments == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	return s.attachments.Pin(ctx, d)
+}
+
+// AttachmentProgress returns the state of the transfer of an attachment.
+func (s *service) AttachmentProgress(_ context.Context, d *attachment.Descriptor) (*attachment.Progress, error) {
+	if s.attachments == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.attachments.Progress(d)
+}
+
+// AttachmentSubscribe returns the progress of the transfers until the
+// context is done.
+func (s *service) AttachmentSubscribe(ctx context.Context) (<-chan *attachment.Progress, error) {
+	if s.attachments == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.attachments.Subscribe(ctx), nil
+}
+
+// StreamOpen opens a stream, e.g. a voice message, its descriptor has to be
+// sent within a message as soon as it is opened, the chunks are then served
+// as they are written.
+func (s *service) StreamOpen(_ context.Context) (*attachment.StreamWriter, error) {
+	if s.attachments == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.attachments.NewStream()
+}
+
+// StreamFetch follows a stream received in a group from the peers of the
+// group, it blocks until its last chunk is received or the peers are gone,
+// the transfer is then resumed once one of them is connected again.
+func (s *service) StreamFetch(ctx context.Context, groupPK []byte, d *attachment.StreamDescriptor) error {
+	if s.attachments == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	if _, err := s.getContextGroupForID(groupPK); err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	return s.attachments.FetchStream(ctx, groupPK, d, s.conversations.groupPeers(groupPK))
+}
+
+// StreamChunk returns a received chunk of a stream and whether it is the
+// last one.
+func (s *service) StreamChunk(_ context.Context, d *attachment.StreamDescriptor, index int) ([]byte, bool, error) {
+	if s.attachments == nil {
+		return nil, false, errcode.ErrNotImplemented
+	}
+
+	return s.attachments.StreamChunk(d, index)
+}
+
+// StreamReader returns the content of a stream as it is received, to play it
+// before its end.
+func (s *service) StreamReader(ctx context.Context, d *attachment.StreamDescriptor) (io.Reader, error) {
+	if s.attachments == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.attachments.StreamReader(ctx, d)
+}
+
+// StreamProgress returns the state of the transfer of a stream.
+func (s *service) StreamProgress(_ context.Context, d *attachment.StreamDescriptor) (*attachment.Progress, error) {
+	if s.attachments == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.attachments.StreamProgress(d)
+}
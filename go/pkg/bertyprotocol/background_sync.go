@@ -0,0 +1,135 @@
+package bertyprotocol
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"go.uber.org/zap"
+)
+
+const (
+	// backgroundSyncCheckpointMargin is the part of the budget of a
+	// background sync kept to checkpoint the state before the OS deadline
+	backgroundSyncCheckpointMargin = 2 * time.Second
+
+	// backgroundSyncPollInterval is the delay between two checks of the
+	// outbound queue while it is drained
+	backgroundSyncPollInterval = 500 * time.Millisecond
+)
+
+// BackgroundSyncReport is the result of a background sync.
+type BackgroundSyncReport struct {
+	// Redialed is the number of peers of the active conversations connected
+	// again
+	Redialed int `json:"redialed"`
+
+	// Pushes is the number of pushes opened, Fetched the ones whose message
+	// was fetched
+	Pushes  int `json:"pushes"`
+	Fetched int `json:"fetched"`
+
+	// Retried is the number of outbound messages retried, Pending the ones
+	// still waiting for an ack at the end of the sync
+	Retried int `json:"retried"`
+	Pending int `json:"pending"`
+
+	Checkpointed bool  `json:"checkpointed"`
+	ElapsedMS    int64 `json:"elapsed_ms"`
+}
+
+// BackgroundSync does a bounded sync when the OS wakes up the app for a
+// background task (BGTaskScheduler, WorkManager): it connects again to the
+// peers of the active conversations, fetches the messages of the pushes
+// received meanwhile, retries the outbound messages until they are acked,
+// then checkpoints the state before the budget is spent.
+func (s *service) BackgroundSync(ctx context.Context, budget time.Duration, pushes [][]byte) (*BackgroundSyncReport, error) {
+	if budget <= backgroundSyncCheckpointMargin {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("background sync budget of %s, min %s", budget, backgroundSyncCheckpointMargin))
+	}
+
+	started := time.Now()
+	report := &BackgroundSyncReport{}
+
+	syncCtx, cancel := context.WithTimeout(ctx, budget-backgroundSyncCheckpointMargin)
+	defer cancel()
+
+	if s.network != nil {
+		report.Redialed = s.network.Redial(syncCtx)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		muCount sync.Mutex
+	)
+
+	for _, payload := range pushes {
+		wg.Add(1)
+		go func(payload []byte) {
+			defer wg.Done()
+
+			received, err := s.PushReceive(syncCtx, payload)
+			if err != nil {
+				s.logger.Debug("unable to open push", zap.Error(err))
+				return
+			}
+
+			muCount.Lock()
+			defer muCount.Unlock()
+
+			report.Pushes++
+			if received.Fetched {
+				report.Fetched++
+			}
+		}(payload)
+	}
+
+	if retried, err := s.outbound.expedite(time.Now()); err != nil {
+		s.logger.Warn("unable to retry the outbound messages", zap.Error(err))
+	} else {
+		report.Retried = retried
+	}
+
+	report.Pending = s.drainOutbound(syncCtx)
+	wg.Wait()
+
+	if s.rootDatastore != nil {
+		if err := s.rootDatastore.Sync(datastore.NewKey("/")); err != nil {
+			s.logger.Warn("unable to checkpoint the datastore", zap.Error(err))
+		} else {
+			report.Checkpointed = true
+		}
+	}
+
+	report.ElapsedMS = time.Since(started).Milliseconds()
+
+	return report, nil
+}
+
+// drainOutbound waits for the outbound messages to be acked until the
+// context is done, it returns the number of messages left.
+func (s *service) drainOutbound(ctx context.Context) int {
+	ticker := time.NewTicker(backgroundSyncPollInterval)
+	defer ticker.Stop()
+
+	for {
+		waiting, err := s.outbound.waiting()
+		if err != nil {
+			s.logger.Warn("unable to list the outbound messages", zap.Error(err))
+			return 0
+		}
+
+		if waiting == 0 {
+			return 0
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return waiting
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBackgroundSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	q, err := newOutboundQueue(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	groupPK := []byte("group")
+
+	// the acks come back once the message is retried
+	q.retry = func(m *OutboundMessage) (int, error) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			assert.NoError(t, q.done(m.GroupPK, m.MessageID))
+		}()
+
+		return m.Size, nil
+	}
+	go q.run(ctx)
+
+	require.NoError(t, q.add(groupPK, []byte("acked"), 1<<10, time.Now()))
+
+	s := &service{logger: zap.NewNop(), outbound: q, rootDatastore: store}
+
+	_, err = s.BackgroundSync(ctx, time.Second, nil)
+	assert.Error(t, err)
+
+	report, err := s.BackgroundSync(ctx, 5*time.Second, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Retried)
+	assert.Equal(t, 0, report.Pending)
+	assert.True(t, report.Checkpointed)
+	assert.Less(t, report.ElapsedMS, int64(3000))
+
+	// the quarantined messages wait for a flush
+	require.NoError(t, q.add(groupPK, []byte("quarantined"), 1<<10, time.Now()))
+	q.lock.Lock()
+	m, err := q.getLocked(groupPK, []byte("quarantined"))
+	require.NoError(t, err)
+	m.Quarantined = true
+	require.NoError(t, q.putLocked(m))
+	q.lock.Unlock()
+
+	report, err = s.BackgroundSync(ctx, 5*time.Second, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Retried)
+	assert.Equal(t, 0, report.Pending)
+}
@@ -0,0 +1,332 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/backup"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"go.uber.org/zap"
+)
+
+const (
+	// backupCheckInterval is how often the schedule is checked for a due
+	// backup
+	backupCheckInterval = 10 * time.Minute
+
+	backupMinInterval = 15 * time.Minute
+	backupDefaultKeep = 7
+)
+
+// BackupNamespace is the namespace of the root datastore holding the backup
+// schedule and its key, it is never backed up nor restored.
+const BackupNamespace = "backup"
+
+// BackupExcluded are the keys of the root datastore left out of the backups.
+var BackupExcluded = []datastore.Key{datastore.NewKey(BackupNamespace)}
+
+var backupStateKey = datastore.NewKey("state")
+
+// BackupSchedule configures the backups of the node.
+type BackupSchedule struct {
+	Target *backup.TargetConfig `json:"target"`
+
+	// Interval is the minimum time between two scheduled backups
+	Interval time.Duration `json:"interval"`
+
+	// Keep is the count of snapshots kept on the target
+	Keep int `json:"keep"`
+
+	Enabled bool `json:"enabled"`
+}
+
+func (b *BackupSchedule) validate() error {
+	if b.Target == nil || b.Keep < 0 || (b.Enabled && b.Interval < backupMinInterval) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid backup schedule"))
+	}
+
+	return nil
+}
+
+// BackupStatus is the schedule of the backups and the result of the last
+// one, the credentials of the target are not returned.
+type BackupStatus struct {
+	Schedule     *BackupSchedule `json:"schedule,omitempty"`
+	LastRun      time.Time       `json:"last_run"`
+	LastSnapshot string          `json:"last_snapshot,omitempty"`
+	LastError    string          `json:"last_error,omitempty"`
+	NextRun      time.Time       `json:"next_run"`
+}
+
+type backupState struct {
+	Schedule     *BackupSchedule `json:"schedule"`
+	Key          []byte          `json:"key"`
+	LastRun      time.Time       `json:"last_run"`
+	LastSnapshot string          `json:"last_snapshot,omitempty"`
+	LastError    string          `json:"last_error,omitempty"`
+}
+
+func (st *backupState) nextRun() time.Time {
+	if st.Schedule == nil || !st.Schedule.Enabled {
+		return time.Time{}
+	}
+
+	return st.LastRun.Add(st.Schedule.Interval)
+}
+
+func (st *backupState) status() *BackupStatus {
+	status := &BackupStatus{
+		LastRun:      st.LastRun,
+		LastSnapshot: st.LastSnapshot,
+		LastError:    st.LastError,
+		NextRun:      st.nextRun(),
+	}
+
+	if st.Schedule != nil {
+		schedule := *st.Schedule
+		if schedule.Target != nil {
+			target := *schedule.Target
+			target.Password, target.SecretKey = "", ""
+			schedule.Target = &target
+		}
+		status.Schedule = &schedule
+	}
+
+	return status
+}
+
+// backupScheduler persists the backup schedule, the key of the repository
+// derived from the passphrase is kept instead of the passphrase.
+type backupScheduler struct {
+	logger *zap.Logger
+	store  datastore.Datastore
+
+	lock sync.Mutex
+
+	// running serializes the backups
+	running sync.Mutex
+}
+
+func newBackupScheduler(logger *zap.Logger, store datastore.Datastore) *backupScheduler {
+	return &backupScheduler{logger: logger, store: store}
+}
+
+func (b *backupScheduler) get() (*backupState, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.getUnlocked()
+}
+
+func (b *backupScheduler) getUnlocked() (*backupState, error) {
+	data, err := b.store.Get(backupStateKey)
+	if err == datastore.ErrNotFound {
+		return &backupState{}, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	st := &backupState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return st, nil
+}
+
+func (b *backupScheduler) update(f func(st *backupState)) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	st, err := b.getUnlocked()
+	if err != nil {
+		return err
+	}
+
+	f(st)
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := b.store.Put(backupStateKey, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// BackupScheduleSet replaces the backup schedule of the node. The
+// repository of the target is opened with the passphrase, or created, an
+// empty passphrase keeps the key of the previous schedule.
+func (s *service) BackupScheduleSet(ctx context.Context, schedule *BackupSchedule, passphrase string) (*BackupStatus, error) {
+	if schedule == nil {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	sc := *schedule
+	if sc.Keep == 0 {
+		sc.Keep = backupDefaultKeep
+	}
+
+	if err := sc.validate(); err != nil {
+		return nil, err
+	}
+
+	target, err := backup.NewTarget(sc.Target, nil)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	var repository *backup.Repository
+	if passphrase != "" {
+		repository, err = backup.Open(ctx, target, passphrase)
+	} else {
+		var st *backupState
+		if st, err = s.backups.get(); err != nil {
+			return nil, err
+		}
+
+		repository, err = backup.OpenWithKey(ctx, target, st.Key)
+	}
+
+	if err == backup.ErrWrongKey {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	var status *BackupStatus
+	err = s.backups.update(func(st *backupState) {
+		// the results of the last backup are kept for the same target only
+		if st.Schedule == nil || st.Schedule.Target == nil || *st.Schedule.Target != *sc.Target {
+			st.LastRun, st.LastSnapshot, st.LastError = time.Time{}, "", ""
+		}
+
+		st.Schedule = &sc
+		st.Key = repository.Key()
+		status = st.status()
+	})
+
+	return status, err
+}
+
+// BackupScheduleGet returns the backup schedule of the node and the result
+// of the last backup.
+func (s *service) BackupScheduleGet(_ context.Context) (*BackupStatus, error) {
+	st, err := s.backups.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return st.status(), nil
+}
+
+// BackupRun backs up the node to the target of the schedule right away,
+// even if the schedule is disabled.
+func (s *service) BackupRun(ctx context.Context) (*backup.Report, error) {
+	return s.runBackup(ctx, time.Now())
+}
+
+func (s *service) backupRepository(ctx context.Context) (*backup.Repository, *backupState, error) {
+	st, err := s.backups.get()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if st.Schedule == nil || len(st.Key) == 0 {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no backup configured"))
+	}
+
+	target, err := backup.NewTarget(st.Schedule.Target, nil)
+	if err != nil {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	repository, err := backup.OpenWithKey(ctx, target, st.Key)
+	if err != nil {
+		return nil, nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return repository, st, nil
+}
+
+func (s *service) runBackup(ctx context.Context, now time.Time) (*backup.Report, error) {
+	s.backups.running.Lock()
+	defer s.backups.running.Unlock()
+
+	repository, st, err := s.backupRepository(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := repository.Backup(ctx, s.rootDatastore, BackupExcluded)
+	if err == nil {
+		_, err = repository.Prune(ctx, st.Schedule.Keep)
+	}
+
+	if uerr := s.backups.update(func(st *backupState) {
+		st.LastRun, st.LastError = now, ""
+		if err != nil {
+			st.LastError = err.Error()
+		} else {
+			st.LastSnapshot = report.Snapshot.ID
+		}
+	}); uerr != nil {
+		s.logger.Warn("unable to save backup status", zap.Error(uerr))
+	}
+
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return report, nil
+}
+
+// BackupSnapshots returns the snapshots on the target of the schedule.
+func (s *service) BackupSnapshots(ctx context.Context) ([]*backup.Snapshot, error) {
+	repository, _, err := s.backupRepository(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := repository.Snapshots(ctx)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return snapshots, nil
+}
+
+func (s *service) backupLoop(ctx context.Context) {
+	ticker := time.NewTicker(backupCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			st, err := s.backups.get()
+			if err != nil {
+				s.logger.Warn("unable to read backup schedule", zap.Error(err))
+				continue
+			}
+
+			if next := st.nextRun(); next.IsZero() || now.Before(next) {
+				continue
+			}
+
+			if report, err := s.runBackup(ctx, now); err != nil {
+				s.logger.Warn("scheduled backup failed", zap.Error(err))
+			} else {
+				s.logger.Info("scheduled backup done", zap.String("snapshot", report.Snapshot.ID), zap.Int("changed", report.Changed))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
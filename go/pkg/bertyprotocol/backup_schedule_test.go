@@ -0,0 +1,81 @@
+package bertyprotocol
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/backup"
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBackupSchedule(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "backup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	root := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	require.NoError(t, root.Put(datastore.NewKey("messages/key"), []byte("value")))
+
+	s := &service{
+		logger:        zap.NewNop(),
+		rootDatastore: root,
+		backups:       newBackupScheduler(zap.NewNop(), ipfsutil.NewNamespacedDatastore(root, datastore.NewKey(BackupNamespace))),
+	}
+
+	_, err = s.BackupRun(ctx)
+	require.Error(t, err)
+
+	_, err = s.BackupScheduleSet(ctx, &BackupSchedule{Target: &backup.TargetConfig{Type: backup.TargetFile, Path: dir}, Enabled: true, Interval: time.Minute}, "passphrase")
+	require.Error(t, err)
+
+	schedule := &BackupSchedule{Target: &backup.TargetConfig{Type: backup.TargetFile, Path: dir, Password: "secret"}, Enabled: true, Interval: time.Hour}
+	status, err := s.BackupScheduleSet(ctx, schedule, "passphrase")
+	require.NoError(t, err)
+	assert.Equal(t, backupDefaultKeep, status.Schedule.Keep)
+	assert.Empty(t, status.Schedule.Target.Password)
+
+	report, err := s.BackupRun(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Snapshot.Entries)
+
+	status, err = s.BackupScheduleGet(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, report.Snapshot.ID, status.LastSnapshot)
+	assert.Equal(t, status.LastRun.Add(time.Hour), status.NextRun)
+
+	// the schedule and its key are not backed up
+	repository, err := backup.Open(ctx, backup.NewFileTarget(dir), "passphrase")
+	require.NoError(t, err)
+
+	restored := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	_, err = repository.Restore(ctx, "", restored, BackupExcluded)
+	require.NoError(t, err)
+
+	has, err := restored.Has(datastore.NewKey("messages/key"))
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	has, err = restored.Has(datastore.NewKey(BackupNamespace).Child(backupStateKey))
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	snapshots, err := s.BackupSnapshots(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+
+	// the key is kept without passphrase, a wrong one is rejected
+	_, err = s.BackupScheduleSet(ctx, schedule, "")
+	require.NoError(t, err)
+	_, err = s.BackupScheduleSet(ctx, schedule, "wrong")
+	require.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package bertyprotocol
+
+import (
+	"context"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// BandwidthStats returns the traffic of the node since its first run, by
+// transport, peer and protocol, with the current rates.
+func (s *service) BandwidthStats(context.Context) (*ipfsutil.BandwidthStats, error) {
+	if s.bandwidth == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.bandwidth.Stats(), nil
+}
+
+// BandwidthSeries returns the traffic of this run by minute since a date, by
+// transport and peer, e.g. for the network activity graphs. The updates are
+// streamed as NodeEventNetworkActivity events.
+func (s *service) BandwidthSeries(_ context.Context, since time.Time) ([]*ipfsutil.BandwidthPoint, error) {
+	if s.bandwidth == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.bandwidth.Series(since), nil
+}
+
+// publishNetworkActivity publishes the point of the current minute when it
+// changes, the idle minutes aren't published.
+func (s *service) publishNetworkActivity(ctx context.Context) {
+	if s.bandwidth == nil {
+		return
+	}
+
+	var (
+		start time.Time
+		last  ipfsutil.BandwidthTotals
+	)
+
+	for p := range s.bandwidth.SubscribeSeries(ctx) {
+		if !p.Start.Equal(start) {
+			start, last = p.Start, ipfsutil.BandwidthTotals{}
+		}
+
+		if p.Totals == last {
+			continue
+		}
+
+		last = p.Totals
+		s.events.publish(NodeEventNetworkActivity, nil, "", p)
+	}
+}
@@ -0,0 +1,58 @@
+package bertyprotocol
+
+import (
+	"context"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// bootstrapManager returns the manager of the bootstrap peers, they are only
+// managed at runtime when Opts.BootstrapAddrs is set.
+func (s *service) bootstrapManager() (*ipfsutil.BootstrapManager, error) {
+	if s.bootstrap == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.bootstrap, nil
+}
+
+// BootstrapPeerList returns the bootstrap peers by priority, with their
+// connection status.
+func (s *service) BootstrapPeerList(context.Context) ([]*ipfsutil.BootstrapPeer, error) {
+	m, err := s.bootstrapManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.List(), nil
+}
+
+// BootstrapPeerAdd adds a bootstrap peer, 0 is the highest priority and a
+// negative one appends the peer to the list.
+func (s *service) BootstrapPeerAdd(_ context.Context, addr string, priority int) error {
+	m, err := s.bootstrapManager()
+	if err != nil {
+		return err
+	}
+
+	return m.Add(addr, priority)
+}
+
+func (s *service) BootstrapPeerRemove(_ context.Context, addr string) error {
+	m, err := s.bootstrapManager()
+	if err != nil {
+		return err
+	}
+
+	return m.Remove(addr)
+}
+
+func (s *service) BootstrapPeerSetPriority(_ context.Context, addr string, priority int) error {
+	m, err := s.bootstrapManager()
+	if err != nil {
+		return err
+	}
+
+	return m.SetPriority(addr, priority)
+}
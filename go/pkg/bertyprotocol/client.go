@@ -9,12 +9,18 @@ const ClientBufferSize = 256 * 1024
 
 type Client interface {
 	ProtocolServiceClient
+	EventServiceClient
+	PeerServiceClient
+	WebhookServiceClient
 
 	Close() error
 }
 
 type client struct {
 	ProtocolServiceClient
+	EventServiceClient
+	PeerServiceClient
+	WebhookServiceClient
 
 	l *grpcutil.BufListener
 }
@@ -35,6 +41,9 @@ func NewClientFromServer(s *grpc.Server, svc Service, opts ...grpc.DialOption) (
 	}
 
 	RegisterProtocolServiceServer(s, svc)
+	RegisterEventServiceServer(s, svc)
+	RegisterPeerServiceServer(s, svc)
+	RegisterWebhookServiceServer(s, svc)
 	go func() {
 		err := s.Serve(bl)
 		if err != nil && err.Error() != "closed" {
@@ -44,6 +53,9 @@ func NewClientFromServer(s *grpc.Server, svc Service, opts ...grpc.DialOption) (
 
 	c := client{
 		ProtocolServiceClient: NewProtocolServiceClient(cc),
+		EventServiceClient:    NewEventServiceClient(cc),
+		PeerServiceClient:     NewPeerServiceClient(cc),
+		WebhookServiceClient:  NewWebhookServiceClient(cc),
 		l:                     bl,
 	}
 	return &c, nil
@@ -0,0 +1,203 @@
+package bertyprotocol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// defaultConversationProtection is how long the peers of a group stay
+// protected after its last message.
+const defaultConversationProtection = 5 * time.Minute
+
+func contactProtectionTag(id []byte) string {
+	return fmt.Sprintf("contact_%s", string(id))
+}
+
+func conversationProtectionTag(id []byte) string {
+	return fmt.Sprintf("conv_%s", string(id))
+}
+
+// conversationProtector protects the connections to the peers of the groups
+// with recent messages, so the connection manager never prunes them in the
+// middle of a conversation.
+type conversationProtector struct {
+	connMgr ipfsutil.ConnMgr
+	period  time.Duration
+
+	lock   sync.Mutex
+	groups map[string]*protectedGroup
+}
+
+type protectedGroup struct {
+	peers map[peer.ID]struct{}
+
+	// timer is set while the group is active, until the protection ends
+	timer *time.Timer
+	until time.Time
+}
+
+func newConversationProtector(connMgr ipfsutil.ConnMgr, period time.Duration) *conversationProtector {
+	return &conversationProtector{
+		connMgr: connMgr,
+		period:  period,
+		groups:  make(map[string]*protectedGroup),
+	}
+}
+
+func (cp *conversationProtector) group(id []byte) *protectedGroup {
+	g, ok := cp.groups[string(id)]
+	if !ok {
+		g = &protectedGroup{peers: make(map[peer.ID]struct{})}
+		cp.groups[string(id)] = g
+	}
+
+	return g
+}
+
+// addPeer records a peer of the group, it is protected right away if the
+// group is active.
+func (cp *conversationProtector) addPeer(id []byte, pid peer.ID) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	g := cp.group(id)
+	g.peers[pid] = struct{}{}
+
+	if g.timer != nil {
+		cp.connMgr.Protect(pid, conversationProtectionTag(id))
+	}
+}
+
+// touch protects the peers of the group until no message was exchanged for
+// the protection period.
+func (cp *conversationProtector) touch(id []byte) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	g := cp.group(id)
+	g.until = time.Now().Add(cp.period)
+	if g.timer != nil {
+		return
+	}
+
+	tag := conversationProtectionTag(id)
+	for pid := range g.peers {
+		cp.connMgr.Protect(pid, tag)
+	}
+
+	g.timer = time.AfterFunc(cp.period, func() { cp.expire(id, g) })
+}
+
+func (cp *conversationProtector) expire(id []byte, g *protectedGroup) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	// the group may have been removed in the meantime
+	if cp.groups[string(id)] != g || g.timer == nil {
+		return
+	}
+
+	// a message was exchanged since the timer was set
+	if remaining := time.Until(g.until); remaining > 0 {
+		g.timer = time.AfterFunc(remaining, func() { cp.expire(id, g) })
+		return
+	}
+
+	cp.unprotect(id, g)
+}
+
+func (cp *conversationProtector) unprotect(id []byte, g *protectedGroup) {
+	if g.timer == nil {
+		return
+	}
+
+	g.timer.Stop()
+	g.timer = nil
+
+	tag := conversationProtectionTag(id)
+	for pid := range g.peers {
+		cp.connMgr.Unprotect(pid, tag)
+	}
+}
+
+// removeGroup unprotects the peers of a deactivated group.
+func (cp *conversationProtector) removeGroup(id []byte) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if g, ok := cp.groups[string(id)]; ok {
+		cp.unprotect(id, g)
+		delete(cp.groups, string(id))
+	}
+}
+
+// activePeers returns the peers of the active groups.
+func (cp *conversationProtector) activePeers() []peer.ID {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	seen := make(map[peer.ID]struct{})
+	peers := []peer.ID{}
+	for _, g := range cp.groups {
+		if g.timer == nil {
+			continue
+		}
+
+		for pid := range g.peers {
+			if _, ok := seen[pid]; !ok {
+				seen[pid] = struct{}{}
+				peers = append(peers, pid)
+			}
+		}
+	}
+
+	return peers
+}
+
+// groupPeers returns the peers of a group.
+func (cp *conversationProtector) groupPeers(id []byte) []peer.ID {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	peers := []peer.ID{}
+	if g, ok := cp.groups[string(id)]; ok {
+		for pid := range g.peers {
+			peers = append(peers, pid)
+		}
+	}
+
+	return peers
+}
+
+// hasPeer reports whether a peer is a peer of any group.
+func (cp *conversationProtector) hasPeer(pid peer.ID) bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	for _, g := range cp.groups {
+		if _, ok := g.peers[pid]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasGroupPeer reports whether a peer is a peer of the group.
+func (cp *conversationProtector) hasGroupPeer(id []byte, pid peer.ID) bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	g, ok := cp.groups[string(id)]
+	if !ok {
+		return false
+	}
+
+	_, ok = g.peers[pid]
+
+	return ok
+}
@@ -0,0 +1,77 @@
+package bertyprotocol
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+type testConnMgr struct {
+	lock      sync.Mutex
+	protected map[peer.ID]map[string]struct{}
+}
+
+func (m *testConnMgr) TagPeer(peer.ID, string, int)        {}
+func (m *testConnMgr) UntagPeer(peer.ID, string)           {}
+func (m *testConnMgr) GetTagInfo(peer.ID) *connmgr.TagInfo { return nil }
+
+func (m *testConnMgr) Protect(pid peer.ID, tag string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.protected[pid] == nil {
+		m.protected[pid] = make(map[string]struct{})
+	}
+	m.protected[pid][tag] = struct{}{}
+}
+
+func (m *testConnMgr) Unprotect(pid peer.ID, tag string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.protected[pid], tag)
+	return len(m.protected[pid]) > 0
+}
+
+func (m *testConnMgr) isProtected(pid peer.ID) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.protected[pid]) > 0
+}
+
+func TestConversationProtector(t *testing.T) {
+	cm := &testConnMgr{protected: make(map[peer.ID]map[string]struct{})}
+	cp := newConversationProtector(cm, 100*time.Millisecond)
+	id := []byte("group")
+
+	cp.addPeer(id, peer.ID("a"))
+	assert.False(t, cm.isProtected(peer.ID("a")))
+
+	cp.touch(id)
+	assert.True(t, cm.isProtected(peer.ID("a")))
+
+	// the peers joining an active conversation are protected too
+	cp.addPeer(id, peer.ID("b"))
+	assert.True(t, cm.isProtected(peer.ID("b")))
+
+	// each message extends the protection
+	time.Sleep(60 * time.Millisecond)
+	cp.touch(id)
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, cm.isProtected(peer.ID("a")))
+
+	assert.Eventually(t, func() bool {
+		return !cm.isProtected(peer.ID("a")) && !cm.isProtected(peer.ID("b"))
+	}, time.Second, 10*time.Millisecond)
+
+	cp.touch(id)
+	assert.True(t, cm.isProtected(peer.ID("a")))
+
+	cp.removeGroup(id)
+	assert.False(t, cm.isProtected(peer.ID("a")))
+}
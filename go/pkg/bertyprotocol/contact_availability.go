@@ -0,0 +1,353 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/go-orbit-db/stores"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+const (
+	// availabilitySampleInterval is the interval between two checks of the
+	// connected contacts, an hour can't be counted twice anyway
+	availabilitySampleInterval = 15 * time.Minute
+
+	// availabilityMaxDays halves the counters once reached, so the old habits
+	// fade out
+	availabilityMaxDays = 60
+
+	// availabilityMinDays is the number of days a contact has to be seen
+	// before predicting its habits
+	availabilityMinDays = 3
+
+	// availabilityLikelyThreshold is the likelihood above which a contact is
+	// expected online
+	availabilityLikelyThreshold = .5
+
+	availabilityMaxPeers = 8
+)
+
+// ContactAvailability is a local estimation of when a contact can be reached,
+// based on the hours (in local time) its devices were seen online. It is only
+// a hint: the contact devices never share their schedule.
+type ContactAvailability struct {
+	// ReachableNow is true if a device of the contact is connected
+	ReachableNow bool
+
+	// Likelihood is the share of the days the contact was online during the
+	// current hour
+	Likelihood float64
+
+	// LikelyReachableNow is true if the contact is connected, or usually
+	// online at this hour
+	LikelyReachableNow bool
+
+	// UsualHour is the hour of the day the contact is the most often online,
+	// -1 if unknown
+	UsualHour int
+
+	// NextLikelyOnline is the start of the next hour the contact is usually
+	// online, zero if unknown
+	NextLikelyOnline time.Time
+
+	// LastSeen is the last time a device of the contact was online
+	LastSeen time.Time
+}
+
+// availabilityRecord is stored by contact group.
+type availabilityRecord struct {
+	// Hours counts the days the contact was online by hour of the day
+	Hours [24]uint32 `json:"hours"`
+
+	// Days counts the days the contact was online
+	Days     uint32   `json:"days"`
+	LastSeen int64    `json:"last_seen"`
+	Peers    []string `json:"peers,omitempty"`
+}
+
+func (r *availabilityRecord) seen(pid peer.ID, now time.Time) {
+	last := time.Unix(r.LastSeen, 0).In(now.Location())
+
+	if r.LastSeen == 0 || !sameDay(last, now) {
+		r.Days++
+		r.Hours[now.Hour()]++
+	} else if last.Hour() != now.Hour() {
+		r.Hours[now.Hour()]++
+	}
+
+	if r.Days >= availabilityMaxDays {
+		r.Days /= 2
+		for i := range r.Hours {
+			r.Hours[i] /= 2
+		}
+	}
+
+	if now.Unix() > r.LastSeen {
+		r.LastSeen = now.Unix()
+	}
+
+	if pid == "" {
+		return
+	}
+
+	for _, p := range r.Peers {
+		if p == pid.Pretty() {
+			return
+		}
+	}
+
+	r.Peers = append(r.Peers, pid.Pretty())
+	if len(r.Peers) > availabilityMaxPeers {
+		r.Peers = r.Peers[len(r.Peers)-availabilityMaxPeers:]
+	}
+}
+
+func (r *availabilityRecord) likelihood(hour int) float64 {
+	if r.Days < availabilityMinDays {
+		return 0
+	}
+
+	l := float64(r.Hours[hour]) / float64(r.Days)
+	if l > 1 {
+		return 1
+	}
+
+	return l
+}
+
+func (r *availabilityRecord) availability(now time.Time, connected bool) *ContactAvailability {
+	a := &ContactAvailability{
+		ReachableNow: connected,
+		Likelihood:   r.likelihood(now.Hour()),
+		UsualHour:    -1,
+	}
+
+	if r.LastSeen != 0 {
+		a.LastSeen = time.Unix(r.LastSeen, 0)
+	}
+
+	if connected {
+		a.Likelihood = 1
+	}
+
+	a.LikelyReachableNow = a.Likelihood >= availabilityLikelyThreshold
+
+	best := 0.
+	for hour := range r.Hours {
+		if l := r.likelihood(hour); l > best {
+			best, a.UsualHour = l, hour
+		}
+	}
+
+	start := now.Truncate(time.Hour)
+	for i := 1; i <= 24; i++ {
+		next := start.Add(time.Duration(i) * time.Hour)
+		if r.likelihood(next.Hour()) >= availabilityLikelyThreshold {
+			a.NextLikelyOnline = next
+			break
+		}
+	}
+
+	return a
+}
+
+func sameDay(a, b time.Time) bool {
+	ya, ma, da := a.Date()
+	yb, mb, db := b.Date()
+
+	return ya == yb && ma == mb && da == db
+}
+
+// contactAvailability records when the devices of the contacts are online.
+// The devices of the account also join the contact groups, they are
+// recognized once seen in the account group.
+type contactAvailability struct {
+	logger *zap.Logger
+	store  datastore.Datastore
+	host   host.Host
+	lock   sync.Mutex
+}
+
+var (
+	availabilityContactsKey = datastore.NewKey("contacts")
+	availabilityOwnPeersKey = datastore.NewKey("own")
+)
+
+func availabilityKey(groupPK []byte) datastore.Key {
+	return availabilityContactsKey.ChildString(base64.RawURLEncoding.EncodeToString(groupPK))
+}
+
+func (ca *contactAvailability) addOwnPeer(pid peer.ID) {
+	if err := ca.store.Put(availabilityOwnPeersKey.ChildString(pid.Pretty()), []byte{}); err != nil {
+		ca.logger.Warn("unable to store own peer", zap.Stringer("peer", pid), zap.Error(err))
+	}
+}
+
+func (ca *contactAvailability) removeOwnPeer(pid peer.ID) {
+	if err := ca.store.Delete(availabilityOwnPeersKey.ChildString(pid.Pretty())); err != nil && err != datastore.ErrNotFound {
+		ca.logger.Warn("unable to remove own peer", zap.Stringer("peer", pid), zap.Error(err))
+	}
+}
+
+func (ca *contactAvailability) isOwnPeer(pid peer.ID) bool {
+	ok, err := ca.store.Has(availabilityOwnPeersKey.ChildString(pid.Pretty()))
+	return err == nil && ok
+}
+
+func (ca *contactAvailability) get(key datastore.Key) (*availabilityRecord, error) {
+	r := &availabilityRecord{}
+
+	data, err := ca.store.Get(key)
+	if err == datastore.ErrNotFound {
+		return r, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return r, nil
+}
+
+func (ca *contactAvailability) seen(groupPK []byte, pid peer.ID, now time.Time) {
+	if pid != "" && ca.isOwnPeer(pid) {
+		return
+	}
+
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	key := availabilityKey(groupPK)
+
+	r, err := ca.get(key)
+	if err != nil {
+		ca.logger.Warn("unable to read contact availability", zap.Error(err))
+		return
+	}
+
+	r.seen(pid, now)
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		ca.logger.Warn("unable to serialize contact availability", zap.Error(err))
+		return
+	}
+
+	if err := ca.store.Put(key, data); err != nil {
+		ca.logger.Warn("unable to store contact availability", zap.Error(err))
+	}
+}
+
+func (ca *contactAvailability) connected(r *availabilityRecord) bool {
+	if ca.host == nil {
+		return false
+	}
+
+	for _, p := range r.Peers {
+		pid, err := peer.Decode(p)
+		if err == nil && !ca.isOwnPeer(pid) && ca.host.Network().Connectedness(pid) == network.Connected {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ca *contactAvailability) availability(groupPK []byte, now time.Time) (*ContactAvailability, error) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	r, err := ca.get(availabilityKey(groupPK))
+	if err != nil {
+		return nil, err
+	}
+
+	return r.availability(now, ca.connected(r)), nil
+}
+
+// sample records the contacts connected right now, the contact groups only
+// report the devices joining them.
+func (ca *contactAvailability) sample(now time.Time) {
+	res, err := ca.store.Query(query.Query{Prefix: availabilityContactsKey.String()})
+	if err != nil {
+		ca.logger.Warn("unable to list contact availabilities", zap.Error(err))
+		return
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		ca.logger.Warn("unable to list contact availabilities", zap.Error(err))
+		return
+	}
+
+	for _, entry := range entries {
+		r := &availabilityRecord{}
+		if err := json.Unmarshal(entry.Value, r); err != nil || !ca.connected(r) {
+			continue
+		}
+
+		groupPK, err := base64.RawURLEncoding.DecodeString(datastore.RawKey(entry.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		ca.seen(groupPK, "", now)
+	}
+}
+
+// watchOwnPeers records the peers of the account group.
+func (ca *contactAvailability) watchOwnPeers(ctx context.Context, acc *groupContext) {
+	for e := range acc.metadataStore.Subscribe(ctx) {
+		if evt, ok := e.(*stores.EventNewPeer); ok {
+			ca.addOwnPeer(evt.Peer)
+		}
+	}
+}
+
+func (ca *contactAvailability) sampleLoop(ctx context.Context) {
+	if ca.host == nil {
+		return
+	}
+
+	ticker := time.NewTicker(availabilitySampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			ca.sample(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ContactAvailability estimates when the contact can be reached, e.g. to
+// schedule the retries of a send or to tell the user when an offline contact
+// is usually online.
+func (s *service) ContactAvailability(_ context.Context, contactPK []byte) (*ContactAvailability, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(contactPK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	g, err := s.getContactGroup(pk)
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	return s.availability.availability(g.PublicKey, time.Now())
+}
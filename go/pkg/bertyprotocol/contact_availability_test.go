@@ -0,0 +1,75 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestContactAvailability(t *testing.T) {
+	ca := &contactAvailability{
+		logger: zap.NewNop(),
+		store:  ds_sync.MutexWrap(datastore.NewMapDatastore()),
+	}
+
+	groupPK := []byte("group")
+	day := time.Date(2020, 7, 1, 18, 10, 0, 0, time.UTC)
+
+	// unknown contact
+	a, err := ca.availability(groupPK, day)
+	require.NoError(t, err)
+	assert.False(t, a.LikelyReachableNow)
+	assert.Equal(t, -1, a.UsualHour)
+	assert.True(t, a.LastSeen.IsZero())
+
+	// online around 18:00 four days out of five
+	for i := 0; i < 5; i++ {
+		d := day.AddDate(0, 0, i)
+		ca.seen(groupPK, peer.ID("device"), d.Add(-8*time.Hour))
+		if i != 2 {
+			ca.seen(groupPK, peer.ID("device"), d)
+			// the same hour counts once
+			ca.seen(groupPK, peer.ID("device"), d.Add(20*time.Minute))
+		}
+	}
+
+	now := day.AddDate(0, 0, 5)
+	a, err = ca.availability(groupPK, now)
+	require.NoError(t, err)
+	assert.False(t, a.ReachableNow)
+	assert.InDelta(t, .8, a.Likelihood, .001)
+	assert.True(t, a.LikelyReachableNow)
+	assert.Equal(t, 10, a.UsualHour)
+	assert.Equal(t, now.Add(16*time.Hour).Truncate(time.Hour), a.NextLikelyOnline)
+
+	a, err = ca.availability(groupPK, now.Add(3*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0., a.Likelihood)
+	assert.False(t, a.LikelyReachableNow)
+
+	// the devices of the account are ignored
+	ca.addOwnPeer(peer.ID("own"))
+	ca.seen([]byte("other"), peer.ID("own"), now)
+	a, err = ca.availability([]byte("other"), now)
+	require.NoError(t, err)
+	assert.True(t, a.LastSeen.IsZero())
+}
+
+func TestAvailabilityRecordDecay(t *testing.T) {
+	r := &availabilityRecord{}
+	day := time.Date(2020, 7, 1, 9, 0, 0, 0, time.UTC)
+
+	for i := 0; i < availabilityMaxDays; i++ {
+		r.seen(peer.ID("device"), day.AddDate(0, 0, i))
+	}
+
+	assert.Equal(t, uint32(availabilityMaxDays/2), r.Days)
+	assert.Equal(t, uint32(availabilityMaxDays/2), r.Hours[9])
+	assert.Len(t, r.Peers, 1)
+}
@@ -0,0 +1,184 @@
+package bertyprotocol
+
+import (
+	"context"
+	"sync"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+// contactBlocks keeps the contact groups of the blocked contacts, the peers
+// seen in them are blocked at the network layer, the new devices of the
+// contact included.
+type contactBlocks struct {
+	logger    *zap.Logger
+	blocklist *ipfsutil.Blocklist
+
+	lock   sync.Mutex
+	groups map[string]struct{}
+}
+
+func newContactBlocks(logger *zap.Logger, blocklist *ipfsutil.Blocklist) *contactBlocks {
+	return &contactBlocks{
+		logger:    logger,
+		blocklist: blocklist,
+		groups:    make(map[string]struct{}),
+	}
+}
+
+func (cb *contactBlocks) isBlockedGroup(groupPK []byte) bool {
+	cb.lock.Lock()
+	_, ok := cb.groups[string(groupPK)]
+	cb.lock.Unlock()
+
+	return ok
+}
+
+// block blocks the peers of a contact group, and the ones seen in it later.
+func (cb *contactBlocks) block(groupPK []byte, pids []peer.ID) {
+	if cb.blocklist == nil {
+		return
+	}
+
+	cb.lock.Lock()
+	cb.groups[string(groupPK)] = struct{}{}
+	cb.lock.Unlock()
+
+	for _, pid := range pids {
+		if err := cb.blocklist.Block(pid); err != nil {
+			cb.logger.Warn("unable to block contact peer", zap.Stringer("peer", pid), zap.Error(err))
+		}
+	}
+}
+
+// unblock accepts the peers of a contact group again.
+func (cb *contactBlocks) unblock(groupPK []byte, pids []peer.ID) {
+	if cb.blocklist == nil {
+		return
+	}
+
+	cb.lock.Lock()
+	delete(cb.groups, string(groupPK))
+	cb.lock.Unlock()
+
+	for _, pid := range pids {
+		if err := cb.blocklist.Unblock(pid); err != nil {
+			cb.logger.Warn("unable to unblock contact peer", zap.Stringer("peer", pid), zap.Error(err))
+		}
+	}
+}
+
+// peerJoined blocks a peer seen in the group of a blocked contact.
+func (cb *contactBlocks) peerJoined(groupPK []byte, pid peer.ID) {
+	if cb.blocklist == nil || !cb.isBlockedGroup(groupPK) {
+		return
+	}
+
+	if err := cb.blocklist.Block(pid); err != nil {
+		cb.logger.Warn("unable to block contact peer", zap.Stringer("peer", pid), zap.Error(err))
+	}
+}
+
+// contactPeerIDs returns the peers known for a contact: the ones seen in its
+// contact group and the one its request came from. The devices of the
+// account, which join the contact groups too, are left out.
+func (s *service) contactPeerIDs(contactPK []byte) ([]byte, []peer.ID) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(contactPK)
+	if err != nil {
+		return nil, nil
+	}
+
+	g, err := s.getContactGroup(pk)
+	if err != nil {
+		return nil, nil
+	}
+
+	seen := map[peer.ID]struct{}{}
+	add := func(pid peer.ID) {
+		if pid == "" || s.availability.isOwnPeer(pid) || (s.host != nil && pid == s.host.ID()) {
+			return
+		}
+
+		seen[pid] = struct{}{}
+	}
+
+	for _, pid := range s.conversations.groupPeers(g.PublicKey) {
+		add(pid)
+	}
+
+	if r, err := s.availability.get(availabilityKey(g.PublicKey)); err == nil {
+		for _, p := range r.Peers {
+			if pid, err := peer.Decode(p); err == nil {
+				add(pid)
+			}
+		}
+	}
+
+	if rec, err := s.lifecycles.get(contactPK); err == nil {
+		add(rec.RequestPeer)
+	}
+
+	pids := make([]peer.ID, 0, len(seen))
+	for pid := range seen {
+		pids = append(pids, pid)
+	}
+
+	return g.PublicKey, pids
+}
+
+// watchContactBlocks blocks the peers of the contacts blocked from any
+// device of the account, the blocks made while the device was offline are
+// applied from the history first.
+func (s *service) watchContactBlocks(ctx context.Context, acc *groupContext) {
+	if s.blocks.blocklist == nil {
+		return
+	}
+
+	apply := func(evt *bertytypes.GroupMetadataEvent) {
+		if evt == nil || evt.Metadata == nil {
+			return
+		}
+
+		switch evt.Metadata.EventType {
+		case bertytypes.EventTypeAccountContactBlocked:
+			e := &bertytypes.AccountContactBlocked{}
+			if err := e.Unmarshal(evt.Event); err != nil {
+				return
+			}
+
+			if groupPK, pids := s.contactPeerIDs(e.ContactPK); groupPK != nil {
+				s.blocks.block(groupPK, pids)
+			}
+
+		case bertytypes.EventTypeAccountContactUnblocked:
+			e := &bertytypes.AccountContactUnblocked{}
+			if err := e.Unmarshal(evt.Event); err != nil {
+				return
+			}
+
+			if groupPK, pids := s.contactPeerIDs(e.ContactPK); groupPK != nil {
+				s.blocks.unblock(groupPK, pids)
+			}
+		}
+	}
+
+	sub := acc.metadataStore.Subscribe(ctx)
+
+	for evt := range acc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		apply(evt)
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			apply(evt)
+		}
+	}
+}
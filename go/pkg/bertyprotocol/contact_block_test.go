@@ -0,0 +1,55 @@
+package bertyprotocol
+
+import (
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestContactBlocks(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	bl, err := ipfsutil.NewBlocklist(zap.NewNop(), store)
+	require.NoError(t, err)
+
+	cb := newContactBlocks(zap.NewNop(), bl)
+
+	groupPK, otherPK := []byte("group"), []byte("other")
+	phone, laptop, stranger := peer.ID("phone"), peer.ID("laptop"), peer.ID("stranger")
+
+	cb.block(groupPK, []peer.ID{phone})
+	assert.True(t, bl.IsBlocked(phone))
+	assert.False(t, bl.InterceptPeerDial(phone))
+	assert.False(t, bl.InterceptSecured(0, phone, nil))
+
+	// the new devices of a blocked contact are blocked once seen in its group
+	cb.peerJoined(groupPK, laptop)
+	cb.peerJoined(otherPK, stranger)
+	assert.True(t, bl.IsBlocked(laptop))
+	assert.False(t, bl.IsBlocked(stranger))
+	assert.True(t, bl.InterceptPeerDial(stranger))
+
+	// the blocks survive a restart
+	bl, err = ipfsutil.NewBlocklist(zap.NewNop(), store)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []peer.ID{phone, laptop}, bl.List())
+
+	cb = newContactBlocks(zap.NewNop(), bl)
+	cb.block(groupPK, nil)
+	cb.unblock(groupPK, []peer.ID{phone, laptop})
+	assert.False(t, bl.IsBlocked(phone))
+	assert.Empty(t, bl.List())
+
+	cb.peerJoined(groupPK, laptop)
+	assert.False(t, bl.IsBlocked(laptop))
+
+	// nothing is blocked without a blocklist
+	cb = newContactBlocks(zap.NewNop(), nil)
+	cb.block(groupPK, []peer.ID{phone})
+	cb.peerJoined(groupPK, laptop)
+}
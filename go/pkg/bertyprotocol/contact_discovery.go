@@ -0,0 +1,214 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"berty.tech/berty/v2/go/internal/contactdisc"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+// DiscoveredContact is an account registered on the contact discovery
+// service for an identifier of the address book, State is empty if it isn't
+// a contact of the account yet.
+type DiscoveredContact struct {
+	Identifier string                       `json:"identifier"`
+	Contact    *bertytypes.ShareableContact `json:"contact"`
+	State      ContactLifecycleState        `json:"state,omitempty"`
+}
+
+// contactDiscovery keeps the tokens of the identifiers registered by the
+// account, to remove them without evaluating them again.
+type contactDiscovery struct {
+	logger  *zap.Logger
+	store   datastore.Datastore
+	service *peer.AddrInfo
+}
+
+func newContactDiscovery(logger *zap.Logger, store datastore.Datastore, service string) (*contactDiscovery, error) {
+	cd := &contactDiscovery{logger: logger, store: store}
+	if service == "" {
+		return cd, nil
+	}
+
+	var err error
+	if cd.service, err = parsePushRelay(service); err != nil {
+		return nil, err
+	}
+
+	return cd, nil
+}
+
+func (cd *contactDiscovery) token(identifier string) ([]byte, error) {
+	t, err := cd.store.Get(contactDiscoveryKey(identifier))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return t, nil
+}
+
+func contactDiscoveryKey(identifier string) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString([]byte(identifier)))
+}
+
+func (s *service) contactDiscoveryTokens(ctx context.Context, identifiers ...string) (map[string][]byte, error) {
+	if s.host == nil || s.discovery.service == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return contactdisc.Tokens(ctx, s.host, *s.discovery.service, identifiers)
+}
+
+// ContactDiscoveryRegister publishes the contact request reference of the
+// account, which has to be enabled, for a phone number or an email of its
+// owner. The other accounts having it in their address book discover the
+// account, the service doesn't learn the identifier.
+func (s *service) ContactDiscoveryRegister(ctx context.Context, identifier string) error {
+	identifier, err := contactdisc.NormalizeIdentifier(identifier)
+	if err != nil {
+		return err
+	}
+
+	enabled, shareableContact := s.accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
+	if !enabled || shareableContact == nil || len(shareableContact.PublicRendezvousSeed) == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("contact requests disabled"))
+	}
+
+	tokens, err := s.contactDiscoveryTokens(ctx, identifier)
+	if err != nil {
+		return err
+	}
+
+	if err := s.contactDiscoveryPublish(ctx, tokens[identifier], shareableContact.PublicRendezvousSeed, shareableContact.Metadata); err != nil {
+		return err
+	}
+
+	if err := s.discovery.store.Put(contactDiscoveryKey(identifier), tokens[identifier]); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// ContactDiscoveryUnregister removes the account from the identifier on the
+// contact discovery service.
+func (s *service) ContactDiscoveryUnregister(ctx context.Context, identifier string) error {
+	identifier, err := contactdisc.NormalizeIdentifier(identifier)
+	if err != nil {
+		return err
+	}
+
+	t, err := s.discovery.token(identifier)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		tokens, err := s.contactDiscoveryTokens(ctx, identifier)
+		if err != nil {
+			return err
+		}
+
+		t = tokens[identifier]
+	}
+
+	if err := s.contactDiscoveryPublish(ctx, t, nil, nil); err != nil {
+		return err
+	}
+
+	if err := s.discovery.store.Delete(contactDiscoveryKey(identifier)); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (s *service) contactDiscoveryPublish(ctx context.Context, t, rdvSeed, metadata []byte) error {
+	if s.host == nil || s.discovery.service == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	rec, err := contactdisc.NewRecord(accountSK, t, rdvSeed, metadata)
+	if err != nil {
+		return err
+	}
+
+	return contactdisc.Register(ctx, s.host, *s.discovery.service, rec)
+}
+
+// ContactDiscover returns the accounts registered for the phone numbers and
+// emails of the address book, to send them a contact request. The
+// identifiers which can't be normalized are skipped.
+func (s *service) ContactDiscover(ctx context.Context, identifiers []string) ([]*DiscoveredContact, error) {
+	normalized, seen := []string(nil), map[string]bool{}
+	for _, identifier := range identifiers {
+		if identifier, err := contactdisc.NormalizeIdentifier(identifier); err == nil && !seen[identifier] {
+			seen[identifier] = true
+			normalized = append(normalized, identifier)
+		}
+	}
+
+	discovered := []*DiscoveredContact{}
+	if len(normalized) == 0 {
+		return discovered, nil
+	}
+
+	tokens, err := s.contactDiscoveryTokens(ctx, normalized...)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := contactdisc.Lookup(ctx, s.host, *s.discovery.service, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	ownPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	for _, identifier := range normalized {
+		for _, rec := range found[identifier] {
+			if bytes.Equal(rec.AccountPK, ownPK) {
+				continue
+			}
+
+			contact := &bertytypes.ShareableContact{
+				PK:                   rec.AccountPK,
+				PublicRendezvousSeed: rec.PublicRendezvousSeed,
+				Metadata:             rec.Metadata,
+			}
+
+			d := &DiscoveredContact{Identifier: identifier, Contact: contact}
+			if c, err := s.contactLifecycle(contact); err != nil {
+				return nil, err
+			} else if c != nil {
+				d.State = c.State
+			}
+
+			discovered = append(discovered, d)
+		}
+	}
+
+	return discovered, nil
+}
@@ -0,0 +1,49 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestContactDiscovery(t *testing.T) {
+	_, err := newContactDiscovery(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), "/ip4/127.0.0.1/tcp/4245")
+	assert.Error(t, err)
+
+	cd, err := newContactDiscovery(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), "/ip4/127.0.0.1/tcp/4245/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN")
+	require.NoError(t, err)
+	require.NotNil(t, cd.service)
+
+	// the tokens are kept by normalized identifier
+	require.NoError(t, cd.store.Put(contactDiscoveryKey("alice@berty.tech"), []byte("token")))
+	tok, err := cd.token("alice@berty.tech")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("token"), tok)
+
+	tok, err = cd.token("+33612345678")
+	require.NoError(t, err)
+	assert.Nil(t, tok)
+
+	disabled, err := newContactDiscovery(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), "")
+	require.NoError(t, err)
+
+	svc := &service{logger: zap.NewNop(), discovery: disabled}
+	ctx := context.Background()
+
+	// the identifiers which can't be normalized are skipped
+	discovered, err := svc.ContactDiscover(ctx, []string{"not an identifier", "0612345678"})
+	require.NoError(t, err)
+	assert.Empty(t, discovered)
+
+	_, err = svc.ContactDiscover(ctx, []string{"+33 6 12 34 56 78"})
+	assert.True(t, errcode.Is(err, errcode.ErrNotImplemented))
+
+	assert.True(t, errcode.Is(svc.ContactDiscoveryUnregister(ctx, "+33612345678"), errcode.ErrNotImplemented))
+	assert.Error(t, svc.ContactDiscoveryUnregister(ctx, "not an identifier"))
+}
@@ -0,0 +1,679 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+// contactResponsePrefix marks the app metadata of a contact group answering
+// a contact request
+const contactResponsePrefix = "\x00berty.contact/1\x00"
+
+// contactResponseProtocolID delivers the declines, the declining account
+// doesn't join the contact group
+const contactResponseProtocolID = protocol.ID("/berty/contact-response/1.0.0")
+
+const contactResponseTimeout = 30 * time.Second
+
+// ContactLifecycleState is the state of a contact of the account.
+type ContactLifecycleState string
+
+const (
+	ContactLifecycleRequestSent     ContactLifecycleState = "request_sent"
+	ContactLifecycleRequestReceived ContactLifecycleState = "request_received"
+	ContactLifecycleAccepted        ContactLifecycleState = "accepted"
+	ContactLifecycleDeclined        ContactLifecycleState = "declined"
+	ContactLifecycleBlocked         ContactLifecycleState = "blocked"
+)
+
+// ContactLifecycle is a contact of the account in its lifecycle, Outgoing
+// tells whether the account sent the request.
+type ContactLifecycle struct {
+	ContactPK []byte                `json:"contact_pk"`
+	State     ContactLifecycleState `json:"state"`
+	Outgoing  bool                  `json:"outgoing"`
+	Metadata  []byte                `json:"metadata,omitempty"`
+	UpdatedAt time.Time             `json:"updated_at"`
+}
+
+// EvtContactLifecycleChanged is emitted on the event bus of the host when a
+// contact changes state, on any device of the account or by an answer of the
+// contact.
+type EvtContactLifecycleChanged struct {
+	Contact *ContactLifecycle
+}
+
+// contactResponse answers a contact request, signed by the account
+// answering.
+type contactResponse struct {
+	From  []byte                `json:"from"`
+	To    []byte                `json:"to"`
+	State ContactLifecycleState `json:"state"`
+	At    int64                 `json:"at"`
+}
+
+type signedContactResponse struct {
+	Response  []byte `json:"response"`
+	Signature []byte `json:"signature"`
+}
+
+func signContactResponse(accountSK crypto.PrivKey, to []byte, state ContactLifecycleState, now time.Time) ([]byte, error) {
+	from, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	data, err := json.Marshal(&contactResponse{From: from, To: to, State: state, At: now.UnixNano()})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sig, err := accountSK.Sign(data)
+	if err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	signed, err := json.Marshal(&signedContactResponse{Response: data, Signature: sig})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return signed, nil
+}
+
+func openContactResponse(data []byte) (*contactResponse, error) {
+	signed := &signedContactResponse{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	r := &contactResponse{}
+	if err := json.Unmarshal(signed.Response, r); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(r.From)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := pk.Verify(signed.Response, signed.Signature); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid contact response signature"))
+	}
+
+	if r.State != ContactLifecycleAccepted && r.State != ContactLifecycleDeclined {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid contact response %q", r.State))
+	}
+
+	return r, nil
+}
+
+// contactRecord is what the account log doesn't tell about a contact.
+type contactRecord struct {
+	Outgoing bool `json:"outgoing"`
+
+	// Remote is the answer of the contact to an outgoing request
+	Remote ContactLifecycleState `json:"remote,omitempty"`
+
+	// RequestPeer is the peer an incoming request was received from, the
+	// decline is sent to it
+	RequestPeer peer.ID `json:"request_peer,omitempty"`
+
+	// PendingDecline is the decline not delivered yet
+	PendingDecline []byte `json:"pending_decline,omitempty"`
+
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// contactLifecycles persists the direction of the requests and the answers
+// of the contacts, the states themselves come from the account log.
+type contactLifecycles struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+
+	lock sync.Mutex
+}
+
+func newContactLifecycles(logger *zap.Logger, store datastore.Batching, h host.Host) (*contactLifecycles, error) {
+	cl := &contactLifecycles{
+		logger: logger,
+		store:  store,
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtContactLifecycleChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		cl.emitter = emitter
+	}
+
+	return cl, nil
+}
+
+func contactRecordKey(contactPK []byte) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(contactPK))
+}
+
+func (cl *contactLifecycles) getLocked(contactPK []byte) (*contactRecord, error) {
+	data, err := cl.store.Get(contactRecordKey(contactPK))
+	if err == datastore.ErrNotFound {
+		return &contactRecord{}, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	rec := &contactRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return rec, nil
+}
+
+func (cl *contactLifecycles) get(contactPK []byte) (*contactRecord, error) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	return cl.getLocked(contactPK)
+}
+
+// update changes the record of a contact, it is only stored if change
+// returns true.
+func (cl *contactLifecycles) update(contactPK []byte, now time.Time, change func(rec *contactRecord) bool) (bool, error) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	rec, err := cl.getLocked(contactPK)
+	if err != nil {
+		return false, err
+	}
+
+	if !change(rec) {
+		return false, nil
+	}
+
+	rec.UpdatedAt = now.UnixNano()
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := cl.store.Put(contactRecordKey(contactPK), data); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	return true, nil
+}
+
+// requestReceived keeps the peer a contact request was received from.
+func (cl *contactLifecycles) requestReceived(contactPK []byte, pid peer.ID) {
+	if _, err := cl.update(contactPK, time.Now(), func(rec *contactRecord) bool {
+		rec.RequestPeer = pid
+		return true
+	}); err != nil {
+		cl.logger.Warn("unable to keep contact request peer", zap.Error(err))
+	}
+}
+
+// pendingDeclines returns the contacts whose decline wasn't delivered, by
+// peer.
+func (cl *contactLifecycles) pendingDeclines() (map[peer.ID][]byte, error) {
+	res, err := cl.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	pending := map[peer.ID][]byte{}
+	for _, entry := range entries {
+		rec := &contactRecord{}
+		if err := json.Unmarshal(entry.Value, rec); err != nil || len(rec.PendingDecline) == 0 || rec.RequestPeer == "" {
+			continue
+		}
+
+		pending[rec.RequestPeer] = rec.PendingDecline
+	}
+
+	return pending, nil
+}
+
+func (cl *contactLifecycles) emit(c *ContactLifecycle) {
+	if cl.emitter == nil {
+		return
+	}
+
+	if err := cl.emitter.Emit(EvtContactLifecycleChanged{Contact: c}); err != nil {
+		cl.logger.Warn("unable to emit contact lifecycle change", zap.Error(err))
+	}
+}
+
+// contactLifecycleState returns the lifecycle state of a contact from its
+// state in the account log, false if it isn't in the lifecycle anymore.
+func contactLifecycleState(state bertytypes.ContactState, rec *contactRecord) (ContactLifecycleState, bool) {
+	switch state {
+	case bertytypes.ContactStateToRequest:
+		return ContactLifecycleRequestSent, true
+	case bertytypes.ContactStateReceived:
+		return ContactLifecycleRequestReceived, true
+	case bertytypes.ContactStateDiscarded:
+		return ContactLifecycleDeclined, true
+	case bertytypes.ContactStateBlocked:
+		return ContactLifecycleBlocked, true
+	case bertytypes.ContactStateAdded:
+		// the request is sent, the contact didn't answer yet
+		if rec.Outgoing && rec.Remote == "" {
+			return ContactLifecycleRequestSent, true
+		} else if rec.Outgoing && rec.Remote == ContactLifecycleDeclined {
+			return ContactLifecycleDeclined, true
+		}
+
+		return ContactLifecycleAccepted, true
+	}
+
+	return "", false
+}
+
+func (s *service) contactLifecycle(contact *bertytypes.ShareableContact) (*ContactLifecycle, error) {
+	pk, err := contact.GetPubKey()
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	rec, err := s.lifecycles.get(contact.PK)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.accountGroup.MetadataStore().Index().(*metadataStoreIndex).getContact(pk)
+	if err != nil {
+		return nil, nil
+	}
+
+	state, ok := contactLifecycleState(c.state, rec)
+	if !ok {
+		return nil, nil
+	}
+
+	return &ContactLifecycle{
+		ContactPK: contact.PK,
+		State:     state,
+		Outgoing:  rec.Outgoing,
+		Metadata:  contact.Metadata,
+		UpdatedAt: time.Unix(0, rec.UpdatedAt),
+	}, nil
+}
+
+// ContactLifecycleList lists the contacts of the account in the given
+// states, all of them if none is given, e.g. the requests received for an
+// inbox.
+func (s *service) ContactLifecycleList(ctx context.Context, states ...ContactLifecycleState) ([]*ContactLifecycle, error) {
+	wanted := map[ContactLifecycleState]bool{}
+	for _, state := range states {
+		wanted[state] = true
+	}
+
+	contacts := s.accountGroup.MetadataStore().ListContactsByStatus(
+		bertytypes.ContactStateToRequest,
+		bertytypes.ContactStateReceived,
+		bertytypes.ContactStateAdded,
+		bertytypes.ContactStateDiscarded,
+		bertytypes.ContactStateBlocked,
+	)
+
+	list := []*ContactLifecycle{}
+	for _, contact := range contacts {
+		c, err := s.contactLifecycle(contact)
+		if err != nil {
+			return nil, err
+		} else if c == nil || (len(wanted) > 0 && !wanted[c.State]) {
+			continue
+		}
+
+		list = append(list, c)
+	}
+
+	return list, nil
+}
+
+// ContactRequestDecline ignores a contact request and tells its sender, the
+// answer is delivered once the peer which sent the request is reachable.
+func (s *service) ContactRequestDecline(ctx context.Context, contactPK []byte) error {
+	pk, err := crypto.UnmarshalEd25519PublicKey(contactPK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := s.accountGroup.MetadataStore().ContactRequestIncomingDiscard(ctx, pk); err != nil {
+		return errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	signed, err := signContactResponse(accountSK, contactPK, ContactLifecycleDeclined, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rec := (*contactRecord)(nil)
+	if _, err := s.lifecycles.update(contactPK, time.Now(), func(r *contactRecord) bool {
+		r.PendingDecline = signed
+		rec = r
+		return true
+	}); err != nil {
+		return err
+	}
+
+	if rec.RequestPeer != "" {
+		go s.deliverDecline(s.ctx, rec.RequestPeer, signed)
+	}
+
+	return nil
+}
+
+func (s *service) deliverDecline(ctx context.Context, pid peer.ID, signed []byte) {
+	if s.host == nil {
+		return
+	}
+
+	r, err := openContactResponse(signed)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, contactResponseTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(ctx, pid, contactResponseProtocolID)
+	if err != nil {
+		s.logger.Debug("unable to deliver contact decline", zap.Stringer("peer", pid), zap.Error(err))
+		return
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(contactResponseTimeout))
+
+	if _, err := stream.Write(signed); err != nil {
+		_ = stream.Reset()
+		return
+	}
+
+	if _, err := s.lifecycles.update(r.To, time.Now(), func(rec *contactRecord) bool {
+		rec.PendingDecline = nil
+		return true
+	}); err != nil {
+		s.logger.Warn("unable to mark contact decline delivered", zap.Error(err))
+	}
+}
+
+// deliverPendingDeclines sends the declines once the peers which sent the
+// requests connect.
+func (s *service) deliverPendingDeclines(ctx context.Context) {
+	s.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			pending, err := s.lifecycles.pendingDeclines()
+			if err != nil {
+				return
+			}
+
+			if signed, ok := pending[c.RemotePeer()]; ok {
+				go s.deliverDecline(ctx, c.RemotePeer(), signed)
+			}
+		},
+	})
+}
+
+func (s *service) handleContactResponse(stream network.Stream) {
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(contactResponseTimeout))
+
+	data, err := ioutil.ReadAll(io.LimitReader(stream, 4<<10))
+	if err != nil {
+		_ = stream.Reset()
+		return
+	}
+
+	s.applyContactResponse(data)
+}
+
+// applyContactResponse keeps the answer of a contact to a request sent by
+// the account.
+func (s *service) applyContactResponse(signed []byte) {
+	r, err := openContactResponse(signed)
+	if err != nil {
+		s.logger.Debug("invalid contact response", zap.Error(err))
+		return
+	}
+
+	if !bytes.Equal(r.To, s.accountGroup.Group().PublicKey) {
+		return
+	}
+
+	changed, err := s.lifecycles.update(r.From, time.Now(), func(rec *contactRecord) bool {
+		if !rec.Outgoing || rec.Remote == r.State {
+			return false
+		}
+
+		rec.Remote = r.State
+		return true
+	})
+	if err != nil {
+		s.logger.Warn("unable to keep contact response", zap.Error(err))
+	} else if changed {
+		s.emitContactLifecycle(r.From)
+	}
+}
+
+func (s *service) emitContactLifecycle(contactPK []byte) {
+	for _, contact := range s.accountGroup.MetadataStore().ListContactsByStatus(
+		bertytypes.ContactStateToRequest,
+		bertytypes.ContactStateReceived,
+		bertytypes.ContactStateAdded,
+		bertytypes.ContactStateDiscarded,
+		bertytypes.ContactStateBlocked,
+	) {
+		if !bytes.Equal(contact.PK, contactPK) {
+			continue
+		}
+
+		if c, err := s.contactLifecycle(contact); err == nil && c != nil {
+			s.lifecycles.emit(c)
+		}
+	}
+}
+
+// sendContactAccepted tells the contact its request was accepted, in the
+// contact group both accounts are now members of.
+func (s *service) sendContactAccepted(ctx context.Context, contactPK crypto.PubKey) {
+	raw, err := contactPK.Raw()
+	if err != nil {
+		return
+	}
+
+	g, err := s.getContactGroup(contactPK)
+	if err != nil {
+		s.logger.Warn("unable to get contact group", zap.Error(err))
+		return
+	}
+
+	groupPK, err := g.GetPubKey()
+	if err != nil {
+		return
+	}
+
+	if err := s.activateGroup(groupPK); err != nil {
+		s.logger.Warn("unable to activate contact group", zap.Error(err))
+		return
+	}
+
+	gc, err := s.getContextGroupForID(g.PublicKey)
+	if err != nil {
+		return
+	}
+
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return
+	}
+
+	signed, err := signContactResponse(accountSK, raw, ContactLifecycleAccepted, time.Now())
+	if err != nil {
+		return
+	}
+
+	if _, err := gc.MetadataStore().SendAppMetadata(ctx, append([]byte(contactResponsePrefix), signed...)); err != nil {
+		s.logger.Warn("unable to send contact acceptance", zap.Error(err))
+	}
+}
+
+// watchContactResponses applies the acceptance sent in a contact group.
+func (s *service) watchContactResponses(ctx context.Context, gc *groupContext) {
+	apply := func(evt *bertytypes.GroupMetadataEvent) {
+		if evt == nil || evt.Metadata == nil || evt.Metadata.EventType != bertytypes.EventTypeGroupMetadataPayloadSent {
+			return
+		}
+
+		am := &bertytypes.AppMetadata{}
+		if err := am.Unmarshal(evt.Event); err != nil || !bytes.HasPrefix(am.Message, []byte(contactResponsePrefix)) {
+			return
+		}
+
+		s.applyContactResponse(am.Message[len(contactResponsePrefix):])
+	}
+
+	sub := gc.metadataStore.Subscribe(ctx)
+
+	for evt := range gc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		apply(evt)
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			apply(evt)
+		}
+	}
+}
+
+type contactEvent interface {
+	Unmarshal([]byte) error
+	GetContactPK() []byte
+}
+
+func newContactEvent(t bertytypes.EventType) contactEvent {
+	switch t {
+	case bertytypes.EventTypeAccountContactRequestOutgoingSent:
+		return &bertytypes.AccountContactRequestSent{}
+	case bertytypes.EventTypeAccountContactRequestIncomingReceived:
+		return &bertytypes.AccountContactRequestReceived{}
+	case bertytypes.EventTypeAccountContactRequestIncomingDiscarded:
+		return &bertytypes.AccountContactRequestDiscarded{}
+	case bertytypes.EventTypeAccountContactRequestIncomingAccepted:
+		return &bertytypes.AccountContactRequestAccepted{}
+	case bertytypes.EventTypeAccountContactBlocked:
+		return &bertytypes.AccountContactBlocked{}
+	}
+
+	return &bertytypes.AccountContactUnblocked{}
+}
+
+// watchContactLifecycle follows the contact events of the account log, on
+// every device of the account, the ones made while the device was offline
+// are applied from the history first.
+func (s *service) watchContactLifecycle(ctx context.Context, acc *groupContext) {
+	apply := func(evt *bertytypes.GroupMetadataEvent, emit bool) {
+		if evt == nil || evt.Metadata == nil {
+			return
+		}
+
+		var contactPK []byte
+		switch evt.Metadata.EventType {
+		case bertytypes.EventTypeAccountContactRequestOutgoingEnqueued:
+			e := &bertytypes.AccountContactRequestEnqueued{}
+			if err := e.Unmarshal(evt.Event); err != nil || e.Contact == nil {
+				return
+			}
+
+			contactPK = e.Contact.PK
+			if _, err := s.lifecycles.update(contactPK, time.Now(), func(rec *contactRecord) bool {
+				if rec.Outgoing {
+					return false
+				}
+
+				rec.Outgoing = true
+				return true
+			}); err != nil {
+				s.logger.Warn("unable to keep outgoing contact request", zap.Error(err))
+			}
+
+		case bertytypes.EventTypeAccountContactRequestOutgoingSent,
+			bertytypes.EventTypeAccountContactRequestIncomingReceived,
+			bertytypes.EventTypeAccountContactRequestIncomingDiscarded,
+			bertytypes.EventTypeAccountContactRequestIncomingAccepted,
+			bertytypes.EventTypeAccountContactBlocked,
+			bertytypes.EventTypeAccountContactUnblocked:
+			e := newContactEvent(evt.Metadata.EventType)
+			if err := e.Unmarshal(evt.Event); err != nil {
+				return
+			}
+
+			contactPK = e.GetContactPK()
+
+		default:
+			return
+		}
+
+		if emit {
+			s.emitContactLifecycle(contactPK)
+		}
+	}
+
+	sub := acc.metadataStore.Subscribe(ctx)
+
+	for evt := range acc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		apply(evt, false)
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			apply(evt, true)
+		}
+	}
+}
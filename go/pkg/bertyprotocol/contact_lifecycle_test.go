@@ -0,0 +1,102 @@
+package bertyprotocol
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestContactLifecycleState(t *testing.T) {
+	for _, tc := range []struct {
+		state    bertytypes.ContactState
+		rec      contactRecord
+		expected ContactLifecycleState
+	}{
+		{bertytypes.ContactStateToRequest, contactRecord{Outgoing: true}, ContactLifecycleRequestSent},
+		{bertytypes.ContactStateAdded, contactRecord{Outgoing: true}, ContactLifecycleRequestSent},
+		{bertytypes.ContactStateAdded, contactRecord{Outgoing: true, Remote: ContactLifecycleAccepted}, ContactLifecycleAccepted},
+		{bertytypes.ContactStateAdded, contactRecord{Outgoing: true, Remote: ContactLifecycleDeclined}, ContactLifecycleDeclined},
+		{bertytypes.ContactStateReceived, contactRecord{}, ContactLifecycleRequestReceived},
+		{bertytypes.ContactStateAdded, contactRecord{}, ContactLifecycleAccepted},
+		{bertytypes.ContactStateDiscarded, contactRecord{}, ContactLifecycleDeclined},
+		{bertytypes.ContactStateBlocked, contactRecord{Outgoing: true}, ContactLifecycleBlocked},
+	} {
+		rec := tc.rec
+		state, ok := contactLifecycleState(tc.state, &rec)
+		assert.True(t, ok)
+		assert.Equal(t, tc.expected, state, "%s %+v", tc.state, tc.rec)
+	}
+
+	_, ok := contactLifecycleState(bertytypes.ContactStateRemoved, &contactRecord{})
+	assert.False(t, ok)
+}
+
+func TestContactResponse(t *testing.T) {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	signed, err := signContactResponse(sk, []byte("requester"), ContactLifecycleDeclined, time.Now())
+	require.NoError(t, err)
+
+	r, err := openContactResponse(signed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("requester"), r.To)
+	assert.Equal(t, ContactLifecycleDeclined, r.State)
+
+	// only the answers to a request are sent
+	blocked, err := signContactResponse(sk, []byte("requester"), ContactLifecycleBlocked, time.Now())
+	require.NoError(t, err)
+	_, err = openContactResponse(blocked)
+	assert.Error(t, err)
+
+	signed[len(signed)/2] ^= 1
+	_, err = openContactResponse(signed)
+	assert.Error(t, err)
+}
+
+func TestContactLifecycles(t *testing.T) {
+	cl, err := newContactLifecycles(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	contactPK, pid := []byte("contact"), peer.ID("requester")
+	now := time.Now()
+
+	rec, err := cl.get(contactPK)
+	require.NoError(t, err)
+	assert.False(t, rec.Outgoing)
+
+	cl.requestReceived(contactPK, pid)
+
+	pending, err := cl.pendingDeclines()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	changed, err := cl.update(contactPK, now, func(rec *contactRecord) bool {
+		rec.PendingDecline = []byte("decline")
+		return true
+	})
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	pending, err = cl.pendingDeclines()
+	require.NoError(t, err)
+	assert.Equal(t, map[peer.ID][]byte{pid: []byte("decline")}, pending)
+
+	changed, err = cl.update(contactPK, now, func(*contactRecord) bool { return false })
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	rec, err = cl.get(contactPK)
+	require.NoError(t, err)
+	assert.Equal(t, pid, rec.RequestPeer)
+	assert.Equal(t, now.UnixNano(), rec.UpdatedAt)
+}
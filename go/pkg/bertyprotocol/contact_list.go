@@ -0,0 +1,181 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// ContactListVersion is the version of the contact list format produced by
+// this package.
+const ContactListVersion = 1
+
+// ContactList is a portable list of accounts, used to move the contacts and
+// the block list from a device to another or to share a moderation list.
+//
+// It is serialized as JSON, binary fields being encoded in standard base64:
+//
+//	{
+//	  "version": 1,
+//	  "contacts": [{"pk": "<base64>", "public_rendezvous_seed": "<base64>", "metadata": "<base64>"}],
+//	  "blocked": [{"pk": "<base64>"}]
+//	}
+//
+// "pk" is the raw ed25519 account public key, the other fields are optional
+// and only meaningful for contacts.
+type ContactList struct {
+	Version  int                 `json:"version"`
+	Contacts []*ContactListEntry `json:"contacts,omitempty"`
+	Blocked  []*ContactListEntry `json:"blocked,omitempty"`
+}
+
+// ContactListEntry is an account in a ContactList.
+type ContactListEntry struct {
+	PK                   []byte `json:"pk"`
+	PublicRendezvousSeed []byte `json:"public_rendezvous_seed,omitempty"`
+	Metadata             []byte `json:"metadata,omitempty"`
+}
+
+// ContactListImportReport summarizes a contact list import.
+type ContactListImportReport struct {
+	// Requested is the number of contact requests enqueued
+	Requested int
+
+	// Blocked is the number of accounts blocked
+	Blocked int
+
+	// Skipped is the number of entries already known or invalid
+	Skipped int
+}
+
+// ParseContactList decodes and checks a serialized contact list.
+func ParseContactList(data []byte) (*ContactList, error) {
+	list := &ContactList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if list.Version != ContactListVersion {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported contact list version %d", list.Version))
+	}
+
+	for _, entries := range [][]*ContactListEntry{list.Contacts, list.Blocked} {
+		for _, entry := range entries {
+			if entry == nil {
+				return nil, errcode.ErrInvalidInput
+			}
+
+			if _, err := crypto.UnmarshalEd25519PublicKey(entry.PK); err != nil {
+				return nil, errcode.ErrDeserialization.Wrap(err)
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// Marshal serializes the contact list.
+func (l *ContactList) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return data, nil
+}
+
+// ContactListExport returns the contacts and the block list of the account.
+func (s *service) ContactListExport(_ context.Context) (*ContactList, error) {
+	list := &ContactList{Version: ContactListVersion}
+	meta := s.accountGroup.MetadataStore()
+
+	for _, c := range meta.ListContactsByStatus(bertytypes.ContactStateAdded) {
+		list.Contacts = append(list.Contacts, &ContactListEntry{
+			PK:                   c.PK,
+			PublicRendezvousSeed: c.PublicRendezvousSeed,
+			Metadata:             c.Metadata,
+		})
+	}
+
+	for _, c := range meta.ListContactsByStatus(bertytypes.ContactStateBlocked) {
+		list.Blocked = append(list.Blocked, &ContactListEntry{PK: c.PK})
+	}
+
+	return list, nil
+}
+
+// ContactListImport blocks the accounts of the block list and sends a contact
+// request to the unknown contacts of the list. Entries already known by the
+// account are left untouched.
+func (s *service) ContactListImport(ctx context.Context, list *ContactList) (*ContactListImportReport, error) {
+	if list == nil {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if list.Version != ContactListVersion {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported contact list version %d", list.Version))
+	}
+
+	accSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	meta := s.accountGroup.MetadataStore()
+	report := &ContactListImportReport{}
+
+	for _, entry := range list.Blocked {
+		if entry == nil {
+			report.Skipped++
+			continue
+		}
+
+		pk, err := crypto.UnmarshalEd25519PublicKey(entry.PK)
+		if err != nil || pk.Equals(accSK.GetPublic()) || meta.checkContactStatus(pk, bertytypes.ContactStateBlocked) {
+			report.Skipped++
+			continue
+		}
+
+		if _, err := meta.ContactBlock(ctx, pk); err != nil {
+			return report, errcode.ErrOrbitDBAppend.Wrap(err)
+		}
+
+		report.Blocked++
+	}
+
+	for _, entry := range list.Contacts {
+		if entry == nil {
+			report.Skipped++
+			continue
+		}
+
+		pk, err := crypto.UnmarshalEd25519PublicKey(entry.PK)
+		if err != nil || pk.Equals(accSK.GetPublic()) || !meta.checkContactStatus(pk, bertytypes.ContactStateUndefined) {
+			report.Skipped++
+			continue
+		}
+
+		contact := &bertytypes.ShareableContact{
+			PK:                   entry.PK,
+			PublicRendezvousSeed: entry.PublicRendezvousSeed,
+			Metadata:             entry.Metadata,
+		}
+
+		if err := contact.CheckFormat(); err != nil {
+			report.Skipped++
+			continue
+		}
+
+		if _, err := meta.ContactRequestOutgoingEnqueue(ctx, contact, nil); err != nil {
+			return report, errcode.ErrOrbitDBAppend.Wrap(err)
+		}
+
+		report.Requested++
+	}
+
+	return report, nil
+}
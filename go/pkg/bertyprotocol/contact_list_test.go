@@ -0,0 +1,48 @@
+package bertyprotocol
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactListMarshalParse(t *testing.T) {
+	_, contactPK, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	_, blockedPK, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	contactPKBytes, err := contactPK.Raw()
+	require.NoError(t, err)
+	blockedPKBytes, err := blockedPK.Raw()
+	require.NoError(t, err)
+
+	list := &ContactList{
+		Version: ContactListVersion,
+		Contacts: []*ContactListEntry{{
+			PK:                   contactPKBytes,
+			PublicRendezvousSeed: []byte("seed"),
+			Metadata:             []byte("metadata"),
+		}},
+		Blocked: []*ContactListEntry{{PK: blockedPKBytes}},
+	}
+
+	data, err := list.Marshal()
+	require.NoError(t, err)
+
+	parsed, err := ParseContactList(data)
+	require.NoError(t, err)
+	assert.Equal(t, list, parsed)
+
+	_, err = ParseContactList([]byte(`{"version": 42}`))
+	assert.Error(t, err)
+
+	_, err = ParseContactList([]byte(`{"version": 1, "blocked": [{"pk": "aW52YWxpZA=="}]}`))
+	assert.Error(t, err)
+
+	_, err = ParseContactList([]byte(`not json`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,629 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/pgp"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+// contactMetadataPrefix marks the app metadata of the account group changing
+// the local metadata of a contact, so every device of the account applies it
+const contactMetadataPrefix = "\x00berty.contact-meta/1\x00"
+
+// profilePrefix marks the app metadata publishing the profile of an account,
+// in its contact groups and in its account group
+const profilePrefix = "\x00berty.profile/1\x00"
+
+// maxContactMetadataLength caps the nicknames, the display names and the
+// avatar hashes
+const maxContactMetadataLength = 256
+
+// maxPGPAttestations caps the OpenPGP attestations of a profile
+const maxPGPAttestations = 4
+
+// ContactMetadataField is a local metadata of a contact, only seen by the
+// devices of the account.
+type ContactMetadataField string
+
+const (
+	ContactMetadataNickname ContactMetadataField = "nickname"
+
+	// ContactMetadataAvatar is the hash of the avatar, e.g. the CID of an
+	// attachment
+	ContactMetadataAvatar ContactMetadataField = "avatar"
+)
+
+// Profile is what an account publishes to its contacts.
+type Profile struct {
+	DisplayName string    `json:"display_name,omitempty"`
+	Avatar      string    `json:"avatar,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at,omitempty"`
+
+	// PGPIdentities are the OpenPGP keys attesting the account, verified
+	// against the account the profile was published by
+	PGPIdentities []*pgp.Identity `json:"pgp_identities,omitempty"`
+}
+
+// ContactMetadata is the local metadata of a contact and the profile it
+// published.
+type ContactMetadata struct {
+	ContactPK []byte   `json:"contact_pk"`
+	Nickname  string   `json:"nickname,omitempty"`
+	Avatar    string   `json:"avatar,omitempty"`
+	Profile   *Profile `json:"profile,omitempty"`
+}
+
+// EvtContactMetadataChanged is emitted on the event bus of the host when the
+// local metadata of a contact is changed, by any device of the account, or
+// when the contact publishes its profile.
+type EvtContactMetadataChanged struct {
+	Metadata *ContactMetadata
+}
+
+// contactMetadataOp is the change of a local metadata, sent on the account
+// group.
+type contactMetadataOp struct {
+	ContactPK []byte               `json:"contact_pk"`
+	Field     ContactMetadataField `json:"field"`
+	Value     string               `json:"value"`
+	At        int64                `json:"at"`
+}
+
+// profileOp is a profile published by an account.
+type profileOp struct {
+	DisplayName string `json:"display_name,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+	At          int64  `json:"at"`
+
+	PGPAttestations []*pgp.Attestation `json:"pgp_attestations,omitempty"`
+}
+
+func validContactMetadataField(field ContactMetadataField) error {
+	switch field {
+	case ContactMetadataNickname, ContactMetadataAvatar:
+		return nil
+	}
+
+	return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown contact metadata %q", field))
+}
+
+func (op *profileOp) validate() error {
+	if len(op.DisplayName) > maxContactMetadataLength || len(op.Avatar) > maxContactMetadataLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("profile too long"))
+	}
+
+	if len(op.PGPAttestations) > maxPGPAttestations {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many OpenPGP attestations"))
+	}
+
+	for _, a := range op.PGPAttestations {
+		if a == nil || len(a.Key) > pgp.MaxKeySize || len(a.Signature) > pgp.MaxSignatureSize {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid OpenPGP attestation"))
+		}
+	}
+
+	return nil
+}
+
+// profile returns the profile published by an account, its OpenPGP
+// attestations are verified against it, the unreadable ones are left out.
+func (op *profileOp) profile(accountPK []byte) *Profile {
+	p := &Profile{DisplayName: op.DisplayName, Avatar: op.Avatar, UpdatedAt: time.Unix(0, op.At)}
+
+	for _, a := range op.PGPAttestations {
+		if id, _ := a.Verify(accountPK, time.Now()); id != nil {
+			p.PGPIdentities = append(p.PGPIdentities, id)
+		}
+	}
+
+	return p
+}
+
+type metadataFieldRecord struct {
+	Value    string `json:"value"`
+	At       int64  `json:"at"`
+	DevicePK []byte `json:"device_pk"`
+}
+
+// newer reports whether a change wins over the current one, the latest wins
+// and the device keys break the ties so every device converges.
+func (r *metadataFieldRecord) newer(at int64, devicePK []byte) bool {
+	if at != r.At {
+		return at > r.At
+	}
+
+	return bytes.Compare(devicePK, r.DevicePK) > 0
+}
+
+type contactMetadataRecord struct {
+	Fields  map[ContactMetadataField]*metadataFieldRecord `json:"fields"`
+	Profile *profileOp                                    `json:"profile,omitempty"`
+}
+
+// contactMetadatas persists the metadata of the contacts, each local
+// metadata is changed by the last writer, a profile replaces an older one.
+type contactMetadatas struct {
+	logger  *zap.Logger
+	store   datastore.Datastore
+	emitter event.Emitter
+
+	lock sync.Mutex
+}
+
+var (
+	contactMetadataContactsKey = datastore.NewKey("contacts")
+	contactMetadataProfileKey  = datastore.NewKey("profile")
+)
+
+func newContactMetadatas(logger *zap.Logger, store datastore.Datastore, h host.Host) (*contactMetadatas, error) {
+	cm := &contactMetadatas{
+		logger: logger,
+		store:  store,
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtContactMetadataChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		cm.emitter = emitter
+	}
+
+	return cm, nil
+}
+
+func contactMetadataKey(contactPK []byte) datastore.Key {
+	return contactMetadataContactsKey.ChildString(base64.RawURLEncoding.EncodeToString(contactPK))
+}
+
+func (cm *contactMetadatas) getLocked(contactPK []byte) (*contactMetadataRecord, error) {
+	rec := &contactMetadataRecord{}
+
+	data, err := cm.store.Get(contactMetadataKey(contactPK))
+	if err == datastore.ErrNotFound {
+		data = nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	if data != nil {
+		if err := json.Unmarshal(data, rec); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+	}
+
+	if rec.Fields == nil {
+		rec.Fields = make(map[ContactMetadataField]*metadataFieldRecord)
+	}
+
+	return rec, nil
+}
+
+func (cm *contactMetadatas) putLocked(contactPK []byte, rec *contactMetadataRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := cm.store.Put(contactMetadataKey(contactPK), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	cm.emit(newContactMetadataFromRecord(contactPK, rec))
+
+	return nil
+}
+
+func newContactMetadataFromRecord(contactPK []byte, rec *contactMetadataRecord) *ContactMetadata {
+	m := &ContactMetadata{ContactPK: contactPK}
+
+	if f, ok := rec.Fields[ContactMetadataNickname]; ok {
+		m.Nickname = f.Value
+	}
+
+	if f, ok := rec.Fields[ContactMetadataAvatar]; ok {
+		m.Avatar = f.Value
+	}
+
+	if rec.Profile != nil {
+		m.Profile = rec.Profile.profile(contactPK)
+	}
+
+	return m
+}
+
+// change applies the change of a local metadata by a device, it reports
+// whether the metadata changed.
+func (cm *contactMetadatas) change(op *contactMetadataOp, devicePK []byte) (bool, error) {
+	if err := validContactMetadataField(op.Field); err != nil {
+		return false, err
+	}
+
+	if len(op.Value) > maxContactMetadataLength {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("contact metadata too long"))
+	}
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	rec, err := cm.getLocked(op.ContactPK)
+	if err != nil {
+		return false, err
+	}
+
+	if current, ok := rec.Fields[op.Field]; ok && !current.newer(op.At, devicePK) {
+		return false, nil
+	}
+
+	rec.Fields[op.Field] = &metadataFieldRecord{Value: op.Value, At: op.At, DevicePK: devicePK}
+
+	return true, cm.putLocked(op.ContactPK, rec)
+}
+
+// profileReceived keeps the profile published by a contact, it reports
+// whether it replaced the known one.
+func (cm *contactMetadatas) profileReceived(contactPK []byte, op *profileOp) (bool, error) {
+	if err := op.validate(); err != nil {
+		return false, err
+	}
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	rec, err := cm.getLocked(contactPK)
+	if err != nil {
+		return false, err
+	}
+
+	if rec.Profile != nil && rec.Profile.At >= op.At {
+		return false, nil
+	}
+
+	rec.Profile = op
+
+	return true, cm.putLocked(contactPK, rec)
+}
+
+func (cm *contactMetadatas) get(contactPK []byte) (*ContactMetadata, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	rec, err := cm.getLocked(contactPK)
+	if err != nil {
+		return nil, err
+	}
+
+	return newContactMetadataFromRecord(contactPK, rec), nil
+}
+
+func (cm *contactMetadatas) ownProfileLocked() (*profileOp, error) {
+	data, err := cm.store.Get(contactMetadataProfileKey)
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	op := &profileOp{}
+	if err := json.Unmarshal(data, op); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return op, nil
+}
+
+// ownProfile returns the profile of the account, nil if never set.
+func (cm *contactMetadatas) ownProfile() (*profileOp, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	return cm.ownProfileLocked()
+}
+
+// setOwnProfile keeps the profile of the account if newer than the known
+// one, it reports whether it was kept.
+func (cm *contactMetadatas) setOwnProfile(op *profileOp) (bool, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	current, err := cm.ownProfileLocked()
+	if err != nil {
+		return false, err
+	}
+
+	if current != nil && current.At >= op.At {
+		return false, nil
+	}
+
+	data, err := json.Marshal(op)
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := cm.store.Put(contactMetadataProfileKey, data); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	return true, nil
+}
+
+func (cm *contactMetadatas) emit(m *ContactMetadata) {
+	if cm.emitter == nil {
+		return
+	}
+
+	if err := cm.emitter.Emit(EvtContactMetadataChanged{Metadata: m}); err != nil {
+		cm.logger.Warn("unable to emit contact metadata change", zap.Error(err))
+	}
+}
+
+func appMetadataWithPrefix(evt *bertytypes.GroupMetadataEvent, prefix string) (*bertytypes.AppMetadata, []byte, bool) {
+	if evt == nil || evt.Metadata == nil || evt.Metadata.EventType != bertytypes.EventTypeGroupMetadataPayloadSent {
+		return nil, nil, false
+	}
+
+	am := &bertytypes.AppMetadata{}
+	if err := am.Unmarshal(evt.Event); err != nil || !bytes.HasPrefix(am.Message, []byte(prefix)) {
+		return nil, nil, false
+	}
+
+	return am, am.Message[len(prefix):], true
+}
+
+// applyContactMetadata applies an app metadata event of the account group if
+// it changes a local metadata of a contact or the profile of the account.
+func (s *service) applyContactMetadata(evt *bertytypes.GroupMetadataEvent) {
+	if am, payload, ok := appMetadataWithPrefix(evt, contactMetadataPrefix); ok {
+		op := &contactMetadataOp{}
+		if err := json.Unmarshal(payload, op); err != nil {
+			s.logger.Debug("invalid contact metadata change", zap.Error(err))
+			return
+		}
+
+		if _, err := s.contactMeta.change(op, am.DevicePK); err != nil {
+			s.logger.Debug("unable to apply contact metadata change", zap.Error(err))
+		}
+
+		return
+	}
+
+	if _, payload, ok := appMetadataWithPrefix(evt, profilePrefix); ok {
+		op := &profileOp{}
+		if err := json.Unmarshal(payload, op); err != nil || op.validate() != nil {
+			s.logger.Debug("invalid profile", zap.Error(err))
+			return
+		}
+
+		if _, err := s.contactMeta.setOwnProfile(op); err != nil {
+			s.logger.Debug("unable to keep profile", zap.Error(err))
+		}
+	}
+}
+
+// watchContactMetadata applies the changes of the account group, the ones
+// made by the other devices while this one was offline, or before it was
+// installed, are applied from the history first.
+func (s *service) watchContactMetadata(ctx context.Context, acc *groupContext) {
+	sub := acc.metadataStore.Subscribe(ctx)
+
+	for evt := range acc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		s.applyContactMetadata(evt)
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			s.applyContactMetadata(evt)
+		}
+	}
+}
+
+// watchContactProfile keeps the profiles published by the contact of a
+// contact group. The profile of the account is published in the group if
+// the contact doesn't have the latest one.
+func (s *service) watchContactProfile(ctx context.Context, gc *groupContext) {
+	ownPK, err := s.ownAccountPK()
+	if err != nil {
+		return
+	}
+
+	var published int64
+
+	apply := func(evt *bertytypes.GroupMetadataEvent) {
+		am, payload, ok := appMetadataWithPrefix(evt, profilePrefix)
+		if !ok {
+			return
+		}
+
+		op := &profileOp{}
+		if err := json.Unmarshal(payload, op); err != nil {
+			s.logger.Debug("invalid contact profile", zap.Error(err))
+			return
+		}
+
+		devicePK, err := crypto.UnmarshalEd25519PublicKey(am.DevicePK)
+		if err != nil {
+			return
+		}
+
+		memberPK, err := gc.MetadataStore().GetMemberByDevice(devicePK)
+		if err != nil {
+			return
+		}
+
+		contactPK, err := memberPK.Raw()
+		if err != nil {
+			return
+		}
+
+		if bytes.Equal(contactPK, ownPK) {
+			if op.At > published {
+				published = op.At
+			}
+
+			return
+		}
+
+		if ok, err := s.contactMeta.profileReceived(contactPK, op); err != nil {
+			s.logger.Debug("unable to keep contact profile", zap.Error(err))
+		} else if ok {
+			s.logger.Debug("contact profile updated")
+		}
+	}
+
+	sub := gc.metadataStore.Subscribe(ctx)
+
+	for evt := range gc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		apply(evt)
+	}
+
+	if own, err := s.contactMeta.ownProfile(); err == nil && own != nil && own.At > published {
+		if err := s.publishProfile(ctx, gc, own); err != nil {
+			s.logger.Debug("unable to publish profile", zap.Error(err))
+		}
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			apply(evt)
+		}
+	}
+}
+
+func (s *service) publishProfile(ctx context.Context, gc *groupContext, op *profileOp) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := gc.MetadataStore().SendAppMetadata(ctx, append([]byte(profilePrefix), data...)); err != nil {
+		return errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
+
+// ContactMetadataSet changes a local metadata of a contact on every device
+// of the account, an empty value clears it.
+func (s *service) ContactMetadataSet(ctx context.Context, contactPK []byte, field ContactMetadataField, value string) error {
+	if err := validContactMetadataField(field); err != nil {
+		return err
+	}
+
+	if _, err := crypto.UnmarshalEd25519PublicKey(contactPK); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	op := &contactMetadataOp{ContactPK: contactPK, Field: field, Value: value, At: time.Now().UnixNano()}
+
+	data, err := json.Marshal(op)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	devicePK, err := s.accountGroup.DevicePubKey().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := s.contactMeta.change(op, devicePK); err != nil {
+		return err
+	}
+
+	if _, err := s.accountGroup.MetadataStore().SendAppMetadata(ctx, append([]byte(contactMetadataPrefix), data...)); err != nil {
+		return errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
+
+// ContactMetadata returns the local metadata of a contact and the profile it
+// published.
+func (s *service) ContactMetadata(_ context.Context, contactPK []byte) (*ContactMetadata, error) {
+	return s.contactMeta.get(contactPK)
+}
+
+// ProfileSet publishes the profile of the account to the devices of the
+// account and to the contacts, the contact groups not opened get it once
+// opened.
+func (s *service) ProfileSet(ctx context.Context, displayName, avatar string) error {
+	current, err := s.contactMeta.ownProfile()
+	if err != nil {
+		return err
+	}
+
+	op := &profileOp{DisplayName: displayName, Avatar: avatar, At: time.Now().UnixNano()}
+	if current != nil {
+		op.PGPAttestations = current.PGPAttestations
+	}
+
+	return s.publishOwnProfile(ctx, op)
+}
+
+// publishOwnProfile keeps the profile of the account and publishes it.
+func (s *service) publishOwnProfile(ctx context.Context, op *profileOp) error {
+	if err := op.validate(); err != nil {
+		return err
+	}
+
+	if _, err := s.contactMeta.setOwnProfile(op); err != nil {
+		return err
+	}
+
+	if err := s.publishProfile(ctx, s.accountGroup, op); err != nil {
+		return err
+	}
+
+	s.lock.RLock()
+	groups := []*groupContext{}
+	for _, gc := range s.openedGroups {
+		if gc.Group().GroupType == bertytypes.GroupTypeContact {
+			groups = append(groups, gc)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, gc := range groups {
+		if err := s.publishProfile(ctx, gc, op); err != nil {
+			s.logger.Warn("unable to publish profile", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// Profile returns the profile of the account, nil if never set.
+func (s *service) Profile(context.Context) (*Profile, error) {
+	op, err := s.contactMeta.ownProfile()
+	if err != nil || op == nil {
+		return nil, err
+	}
+
+	accountPK, err := s.ownAccountPK()
+	if err != nil {
+		return nil, err
+	}
+
+	return op.profile(accountPK), nil
+}
@@ -0,0 +1,75 @@
+package bertyprotocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestContactMetadatas(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	cm, err := newContactMetadatas(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	contactPK, phone, laptop := []byte("contact"), []byte("phone"), []byte("laptop")
+	now := time.Now()
+
+	change := func(devicePK []byte, field ContactMetadataField, value string, at time.Time) bool {
+		changed, err := cm.change(&contactMetadataOp{ContactPK: contactPK, Field: field, Value: value, At: at.UnixNano()}, devicePK)
+		require.NoError(t, err)
+		return changed
+	}
+
+	// the last writer wins, whatever the order the changes are received in
+	assert.True(t, change(laptop, ContactMetadataNickname, "Bob", now.Add(time.Second)))
+	assert.False(t, change(phone, ContactMetadataNickname, "Robert", now))
+	assert.True(t, change(phone, ContactMetadataAvatar, "bafyavatar", now))
+
+	_, err = cm.change(&contactMetadataOp{ContactPK: contactPK, Field: "color", Value: "red", At: now.UnixNano()}, phone)
+	assert.Error(t, err)
+
+	_, err = cm.change(&contactMetadataOp{ContactPK: contactPK, Field: ContactMetadataNickname, Value: strings.Repeat("a", maxContactMetadataLength+1), At: now.Add(time.Hour).UnixNano()}, phone)
+	assert.Error(t, err)
+
+	// a profile only replaces an older one
+	ok, err := cm.profileReceived(contactPK, &profileOp{DisplayName: "bob", At: now.UnixNano()})
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = cm.profileReceived(contactPK, &profileOp{DisplayName: "old bob", At: now.Add(-time.Hour).UnixNano()})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	cm, err = newContactMetadatas(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	m, err := cm.get(contactPK)
+	require.NoError(t, err)
+	assert.Equal(t, "Bob", m.Nickname)
+	assert.Equal(t, "bafyavatar", m.Avatar)
+	require.NotNil(t, m.Profile)
+	assert.Equal(t, "bob", m.Profile.DisplayName)
+
+	own, err := cm.ownProfile()
+	require.NoError(t, err)
+	assert.Nil(t, own)
+
+	ok, err = cm.setOwnProfile(&profileOp{DisplayName: "alice", At: now.UnixNano()})
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = cm.setOwnProfile(&profileOp{DisplayName: "old alice", At: now.Add(-time.Second).UnixNano()})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	own, err = cm.ownProfile()
+	require.NoError(t, err)
+	require.NotNil(t, own)
+	assert.Equal(t, "alice", own.DisplayName)
+}
@@ -0,0 +1,31 @@
+package bertyprotocol
+
+import (
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+// contactPeers remembers the peers met in the contact groups, so they can be
+// recognized when found nearby before any group is synchronized.
+type contactPeers struct {
+	logger *zap.Logger
+	store  datastore.Datastore
+}
+
+func (cp *contactPeers) add(pid peer.ID) {
+	if err := cp.store.Put(datastore.NewKey(pid.Pretty()), []byte{}); err != nil {
+		cp.logger.Warn("unable to store contact peer", zap.Stringer("peer", pid), zap.Error(err))
+	}
+}
+
+func (cp *contactPeers) has(pid peer.ID) bool {
+	ok, err := cp.store.Has(datastore.NewKey(pid.Pretty()))
+	return err == nil && ok
+}
+
+// IsContactPeer reports whether a peer has already been seen in one of the
+// contact groups of the account.
+func (s *service) IsContactPeer(pid peer.ID) bool {
+	return s.contactPeers.has(pid)
+}
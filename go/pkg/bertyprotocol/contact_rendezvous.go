@@ -0,0 +1,130 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/tinder"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	p2p_discovery "github.com/libp2p/go-libp2p-discovery"
+	"go.uber.org/zap"
+)
+
+const (
+	contactRendezvousTopic        = "berty_contact_rdv"
+	contactRendezvousFindInterval = 5 * time.Minute
+)
+
+// contactRendezvousNamespace derives the rendezvous namespace of a contact
+// for the period, from the secret of the contact group: only the two contacts
+// can compute it, and the rendezvous node can't link the namespaces of two
+// periods.
+func contactRendezvousNamespace(g *bertytypes.Group, period time.Time) string {
+	return hex.EncodeToString(generateRendezvousPointForPeriod([]byte(contactRendezvousTopic), g.Secret, period))
+}
+
+// contactRendezvous registers the device on the rendezvous namespaces of its
+// contacts and connects to the contact devices registered there, so the
+// contacts reach each other without the public DHT.
+type contactRendezvous struct {
+	logger   *zap.Logger
+	host     host.Host
+	driver   tinder.Driver
+	interval time.Duration
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newContactRendezvous(logger *zap.Logger, h host.Host, driver tinder.Driver, interval time.Duration) *contactRendezvous {
+	return &contactRendezvous{
+		logger:   logger,
+		host:     h,
+		driver:   driver,
+		interval: interval,
+		cancels:  make(map[string]context.CancelFunc),
+	}
+}
+
+func (cr *contactRendezvous) start(ctx context.Context, g *bertytypes.Group) {
+	if cr == nil || g.GroupType != bertytypes.GroupTypeContact {
+		return
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if _, ok := cr.cancels[string(g.PublicKey)]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cr.cancels[string(g.PublicKey)] = cancel
+
+	go cr.run(ctx, g)
+}
+
+func (cr *contactRendezvous) stop(groupPK []byte) {
+	if cr == nil {
+		return
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cancel, ok := cr.cancels[string(groupPK)]; ok {
+		cancel()
+		delete(cr.cancels, string(groupPK))
+	}
+}
+
+// run follows the namespace of the current period until ctx is done.
+func (cr *contactRendezvous) run(ctx context.Context, g *bertytypes.Group) {
+	for ctx.Err() == nil {
+		period := roundTimePeriod(time.Now(), cr.interval)
+		end := nextTimePeriod(period, cr.interval)
+		ns := contactRendezvousNamespace(g, period)
+
+		pctx, cancel := context.WithDeadline(ctx, end)
+		p2p_discovery.Advertise(pctx, cr.driver, ns, p2p_discovery.TTL(time.Until(end)))
+		cr.findLoop(pctx, ns)
+		cancel()
+	}
+}
+
+func (cr *contactRendezvous) findLoop(ctx context.Context, ns string) {
+	ticker := time.NewTicker(contactRendezvousFindInterval)
+	defer ticker.Stop()
+
+	for {
+		cr.find(ctx, ns)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cr *contactRendezvous) find(ctx context.Context, ns string) {
+	peers, err := cr.driver.FindPeers(ctx, ns)
+	if err != nil {
+		cr.logger.Debug("unable to find contact peers", zap.Error(err))
+		return
+	}
+
+	for p := range peers {
+		if p.ID == cr.host.ID() || cr.host.Network().Connectedness(p.ID) == network.Connected {
+			continue
+		}
+
+		if err := cr.host.Connect(ctx, p); err != nil {
+			cr.logger.Debug("unable to connect to contact peer", zap.Stringer("peer", p.ID), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContactRendezvousNamespace(t *testing.T) {
+	g1 := &bertytypes.Group{PublicKey: []byte("group_1"), Secret: []byte("secret_1"), GroupType: bertytypes.GroupTypeContact}
+	g2 := &bertytypes.Group{PublicKey: []byte("group_2"), Secret: []byte("secret_2"), GroupType: bertytypes.GroupTypeContact}
+
+	period := roundTimePeriod(time.Date(2020, 04, 10, 12, 30, 00, 0, time.UTC), time.Hour*24)
+	next := nextTimePeriod(period, time.Hour*24)
+
+	ns := contactRendezvousNamespace(g1, period)
+
+	// both contacts derive the same namespace
+	assert.Equal(t, ns, contactRendezvousNamespace(&bertytypes.Group{Secret: []byte("secret_1")}, period))
+
+	assert.NotEqual(t, ns, contactRendezvousNamespace(g1, next))
+	assert.NotEqual(t, ns, contactRendezvousNamespace(g2, period))
+
+	// the namespace doesn't reveal the group
+	assert.NotContains(t, ns, string(g1.PublicKey))
+	assert.Len(t, ns, 64)
+}
@@ -0,0 +1,568 @@
+package bertyprotocol
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultContactRequestPoWDifficulty is the leading zero bits of the
+	// proof of work asked to the senders of a contact request, a fraction of
+	// a second on a phone
+	DefaultContactRequestPoWDifficulty = 18
+
+	// DefaultContactRequestsPerSource is the number of contact requests a
+	// peer, a network or an account can send in a DefaultContactRequestWindow
+	DefaultContactRequestsPerSource = 10
+	DefaultContactRequestWindow     = time.Hour
+
+	// DefaultContactRequestQuarantineScore is the spam score from which the
+	// requests of the strangers are quarantined
+	DefaultContactRequestQuarantineScore = 50
+
+	// maxContactRequestPoWDifficulty is the hardest proof of work solved
+	// when sending a request, the recipients asking more are given up on
+	maxContactRequestPoWDifficulty = 24
+
+	maxQuarantinedRequests = 200
+	quarantinedRequestTTL  = 30 * 24 * time.Hour
+
+	contactRequestPoWContext = "berty contact request pow"
+	contactRequestNonceSize  = 32
+)
+
+// NodeEventContactRequestQuarantined is the type of the node events of the
+// quarantined contact requests, their payload is a QuarantinedRequest.
+const NodeEventContactRequestQuarantined = "contact_request_quarantined"
+
+// Reasons of the spam score of a contact request.
+const (
+	SpamReasonNoProofOfWork  = "no_proof_of_work"
+	SpamReasonNoMetadata     = "no_metadata"
+	SpamReasonNetworkBurst   = "network_burst"
+	SpamReasonDeclinedBefore = "declined_before"
+)
+
+var spamReasonScores = map[string]int{
+	SpamReasonNoProofOfWork:  40,
+	SpamReasonNoMetadata:     20,
+	SpamReasonNetworkBurst:   10,
+	SpamReasonDeclinedBefore: 50,
+}
+
+// maxNetworkBurstScore caps the score of the requests sent from the network
+// of the request
+const maxNetworkBurstScore = 30
+
+// localNetworks are the networks where every peer is a neighbour, the
+// requests from them aren't counted by network. 100::/64 is the discard
+// prefix.
+var localNetworks = func() []*net.IPNet {
+	nets := []*net.IPNet(nil)
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "100.64.0.0/10", "fc00::/7", "fe80::/10", "100::/64"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+
+	return nets
+}()
+
+// QuarantinedRequest is a contact request of a stranger held back for its
+// spam score, it only reaches the account log once released.
+type QuarantinedRequest struct {
+	ContactPK  []byte    `json:"contact_pk"`
+	Metadata   []byte    `json:"metadata,omitempty"`
+	Score      int       `json:"score"`
+	Reasons    []string  `json:"reasons"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// EvtContactRequestQuarantined is emitted on the event bus of the host when a
+// contact request is quarantined.
+type EvtContactRequestQuarantined struct {
+	Request *QuarantinedRequest
+}
+
+type quarantinedRequest struct {
+	Contact    *bertytypes.ShareableContact `json:"contact"`
+	Peer       peer.ID                      `json:"peer,omitempty"`
+	Score      int                          `json:"score"`
+	Reasons    []string                     `json:"reasons"`
+	ReceivedAt int64                        `json:"received_at"`
+}
+
+func (q *quarantinedRequest) public() *QuarantinedRequest {
+	return &QuarantinedRequest{
+		ContactPK:  q.Contact.PK,
+		Metadata:   q.Contact.Metadata,
+		Score:      q.Score,
+		Reasons:    q.Reasons,
+		ReceivedAt: time.Unix(0, q.ReceivedAt),
+	}
+}
+
+type contactRequestGuardOpts struct {
+	// PoWDifficulty is the bits of proof of work asked, none if negative
+	PoWDifficulty int
+
+	RequestsPerSource int
+	Window            time.Duration
+
+	// QuarantineScore is the score from which the requests are quarantined,
+	// never if negative
+	QuarantineScore int
+}
+
+func (opts *contactRequestGuardOpts) applyDefaults() {
+	if opts.PoWDifficulty == 0 {
+		opts.PoWDifficulty = DefaultContactRequestPoWDifficulty
+	} else if opts.PoWDifficulty > maxContactRequestPoWDifficulty {
+		opts.PoWDifficulty = maxContactRequestPoWDifficulty
+	}
+
+	if opts.RequestsPerSource <= 0 {
+		opts.RequestsPerSource = DefaultContactRequestsPerSource
+	}
+
+	if opts.Window <= 0 {
+		opts.Window = DefaultContactRequestWindow
+	}
+
+	if opts.QuarantineScore == 0 {
+		opts.QuarantineScore = DefaultContactRequestQuarantineScore
+	}
+}
+
+// contactRequestGuard rate limits the incoming contact requests by source,
+// scores them and keeps the quarantined ones.
+type contactRequestGuard struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+	opts    contactRequestGuardOpts
+
+	muSources sync.Mutex
+	sources   map[string]*sourceWindow
+
+	muQuarantine sync.Mutex
+}
+
+type sourceWindow struct {
+	start    time.Time
+	requests int
+}
+
+func newContactRequestGuard(logger *zap.Logger, store datastore.Batching, h host.Host, opts contactRequestGuardOpts) (*contactRequestGuard, error) {
+	opts.applyDefaults()
+
+	g := &contactRequestGuard{
+		logger:  logger,
+		store:   store,
+		opts:    opts,
+		sources: make(map[string]*sourceWindow),
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtContactRequestQuarantined))
+		if err != nil {
+			return nil, err
+		}
+
+		g.emitter = emitter
+	}
+
+	return g, nil
+}
+
+// requestNetwork returns the /24 or /64 of the public addr the request comes
+// from, empty for the local and relayed connections.
+func requestNetwork(addr ma.Multiaddr) string {
+	if addr == nil {
+		return ""
+	}
+
+	ip, err := manet.ToIP(addr)
+	if err != nil || ip.IsLoopback() {
+		return ""
+	}
+
+	for _, local := range localNetworks {
+		if local.Contains(ip) {
+			return ""
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// allow counts a request of the sources, it is refused once one of them
+// sent too many.
+func (g *contactRequestGuard) allow(now time.Time, sources ...string) bool {
+	g.muSources.Lock()
+	defer g.muSources.Unlock()
+
+	for key, w := range g.sources {
+		if now.Sub(w.start) >= g.opts.Window {
+			delete(g.sources, key)
+		}
+	}
+
+	for _, source := range sources {
+		if w, ok := g.sources[source]; ok && w.requests >= g.opts.RequestsPerSource {
+			return false
+		}
+	}
+
+	for _, source := range sources {
+		w, ok := g.sources[source]
+		if !ok {
+			w = &sourceWindow{start: now}
+			g.sources[source] = w
+		}
+
+		w.requests++
+	}
+
+	return true
+}
+
+// allowStream counts a request of the peer and of its network, before the
+// handshake.
+func (g *contactRequestGuard) allowStream(pid peer.ID, netw string, now time.Time) bool {
+	sources := []string{"peer/" + pid.String()}
+	if netw != "" {
+		sources = append(sources, "net/"+netw)
+	}
+
+	return g.allow(now, sources...)
+}
+
+// allowAccount counts a request of the account, once authenticated.
+func (g *contactRequestGuard) allowAccount(contactPK []byte, now time.Time) bool {
+	return g.allow(now, "account/"+base64.RawURLEncoding.EncodeToString(contactPK))
+}
+
+// score rates a request of a stranger, the higher the more likely a spam.
+func (g *contactRequestGuard) score(contact *bertytypes.ShareableContact, pow bool, netw string, declined bool) (int, []string) {
+	score, reasons := 0, []string(nil)
+	add := func(reason string, points int) {
+		score += points
+		reasons = append(reasons, reason)
+	}
+
+	if !pow && g.opts.PoWDifficulty > 0 {
+		add(SpamReasonNoProofOfWork, spamReasonScores[SpamReasonNoProofOfWork])
+	}
+
+	if len(contact.Metadata) == 0 {
+		add(SpamReasonNoMetadata, spamReasonScores[SpamReasonNoMetadata])
+	}
+
+	if netw != "" {
+		g.muSources.Lock()
+		others := 0
+		if w, ok := g.sources["net/"+netw]; ok {
+			others = w.requests - 1
+		}
+		g.muSources.Unlock()
+
+		if points := others * spamReasonScores[SpamReasonNetworkBurst]; points > 0 {
+			if points > maxNetworkBurstScore {
+				points = maxNetworkBurstScore
+			}
+
+			add(SpamReasonNetworkBurst, points)
+		}
+	}
+
+	if declined {
+		add(SpamReasonDeclinedBefore, spamReasonScores[SpamReasonDeclinedBefore])
+	}
+
+	return score, reasons
+}
+
+func (g *contactRequestGuard) quarantines(score int) bool {
+	return g.opts.QuarantineScore > 0 && score >= g.opts.QuarantineScore
+}
+
+func quarantineKey(contactPK []byte) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(contactPK))
+}
+
+// quarantine keeps a request aside, the oldest are dropped beyond
+// maxQuarantinedRequests.
+func (g *contactRequestGuard) quarantine(contact *bertytypes.ShareableContact, pid peer.ID, score int, reasons []string, now time.Time) error {
+	g.muQuarantine.Lock()
+	defer g.muQuarantine.Unlock()
+
+	q := &quarantinedRequest{
+		Contact:    contact,
+		Peer:       pid,
+		Score:      score,
+		Reasons:    reasons,
+		ReceivedAt: now.UnixNano(),
+	}
+
+	data, err := json.Marshal(q)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := g.store.Put(quarantineKey(contact.PK), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	list, err := g.listLocked(now)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(list)-maxQuarantinedRequests; i++ {
+		if err := g.store.Delete(quarantineKey(list[i].Contact.PK)); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	g.logger.Info("contact request quarantined", zap.Int("score", score), zap.Strings("reasons", reasons))
+
+	if g.emitter != nil {
+		if err := g.emitter.Emit(EvtContactRequestQuarantined{Request: q.public()}); err != nil {
+			g.logger.Warn("unable to emit quarantined contact request", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// listLocked returns the quarantined requests from the oldest, the expired
+// ones are dropped.
+func (g *contactRequestGuard) listLocked(now time.Time) ([]*quarantinedRequest, error) {
+	res, err := g.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	list := []*quarantinedRequest{}
+	for _, entry := range entries {
+		q := &quarantinedRequest{}
+		if err := json.Unmarshal(entry.Value, q); err != nil || q.Contact == nil {
+			g.logger.Warn("invalid quarantined contact request", zap.String("key", entry.Key), zap.Error(err))
+			continue
+		}
+
+		if now.Sub(time.Unix(0, q.ReceivedAt)) >= quarantinedRequestTTL {
+			if err := g.store.Delete(datastore.RawKey(entry.Key)); err != nil {
+				return nil, errcode.ErrInternal.Wrap(err)
+			}
+
+			continue
+		}
+
+		list = append(list, q)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ReceivedAt < list[j].ReceivedAt })
+
+	return list, nil
+}
+
+func (g *contactRequestGuard) list(now time.Time) ([]*quarantinedRequest, error) {
+	g.muQuarantine.Lock()
+	defer g.muQuarantine.Unlock()
+
+	return g.listLocked(now)
+}
+
+// take removes a request from the quarantine, nil if it isn't there.
+func (g *contactRequestGuard) take(contactPK []byte) (*quarantinedRequest, error) {
+	g.muQuarantine.Lock()
+	defer g.muQuarantine.Unlock()
+
+	data, err := g.store.Get(quarantineKey(contactPK))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	q := &quarantinedRequest{}
+	if err := json.Unmarshal(data, q); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if err := g.store.Delete(quarantineKey(contactPK)); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return q, nil
+}
+
+// sendContactRequestChallenge asks the sender of a request for a proof of
+// work on a fresh nonce, it returns whether the one received is valid.
+func sendContactRequestChallenge(stream network.Stream, difficulty int) (bool, error) {
+	if difficulty < 0 {
+		difficulty = 0
+	}
+
+	challenge := make([]byte, contactRequestNonceSize+1)
+	if _, err := crand.Read(challenge[:contactRequestNonceSize]); err != nil {
+		return false, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+	challenge[contactRequestNonceSize] = byte(difficulty)
+
+	if _, err := stream.Write(challenge); err != nil {
+		return false, errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	solution := make([]byte, 8)
+	if _, err := io.ReadFull(stream, solution); err != nil {
+		return false, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	return verifyContactRequestPoW(challenge[:contactRequestNonceSize], difficulty, binary.BigEndian.Uint64(solution)), nil
+}
+
+// answerContactRequestChallenge solves the proof of work asked by the
+// recipient of a request.
+func answerContactRequestChallenge(ctx context.Context, stream network.Stream) error {
+	challenge := make([]byte, contactRequestNonceSize+1)
+	if _, err := io.ReadFull(stream, challenge); err != nil {
+		return errcode.ErrStreamRead.Wrap(err)
+	}
+
+	difficulty := int(challenge[contactRequestNonceSize])
+	if difficulty > maxContactRequestPoWDifficulty {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("proof of work of %d bits asked, at most %d", difficulty, maxContactRequestPoWDifficulty))
+	}
+
+	counter, err := solveContactRequestPoW(ctx, challenge[:contactRequestNonceSize], difficulty)
+	if err != nil {
+		return err
+	}
+
+	solution := make([]byte, 8)
+	binary.BigEndian.PutUint64(solution, counter)
+
+	if _, err := stream.Write(solution); err != nil {
+		return errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func contactRequestPoWBits(nonce []byte, counter uint64) int {
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+
+	h := sha256.New()
+	_, _ = h.Write([]byte(contactRequestPoWContext))
+	_, _ = h.Write(nonce)
+	_, _ = h.Write(c[:])
+
+	zeros := 0
+	for _, b := range h.Sum(nil) {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	return zeros
+}
+
+func verifyContactRequestPoW(nonce []byte, difficulty int, counter uint64) bool {
+	return contactRequestPoWBits(nonce, counter) >= difficulty
+}
+
+func solveContactRequestPoW(ctx context.Context, nonce []byte, difficulty int) (uint64, error) {
+	for counter := uint64(0); ; counter++ {
+		if counter%4096 == 0 && ctx.Err() != nil {
+			return 0, errcode.ErrInternal.Wrap(ctx.Err())
+		}
+
+		if verifyContactRequestPoW(nonce, difficulty, counter) {
+			return counter, nil
+		}
+	}
+}
+
+// ContactRequestQuarantine lists the contact requests of the strangers held
+// back for their spam score, from the oldest.
+func (s *service) ContactRequestQuarantine(ctx context.Context) ([]*QuarantinedRequest, error) {
+	list, err := s.requestGuard.list(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]*QuarantinedRequest, len(list))
+	for i, q := range list {
+		requests[i] = q.public()
+	}
+
+	return requests, nil
+}
+
+// ContactRequestRelease moves a quarantined request to the received ones, it
+// can then be accepted or declined.
+func (s *service) ContactRequestRelease(ctx context.Context, contactPK []byte) error {
+	q, err := s.requestGuard.take(contactPK)
+	if err != nil {
+		return err
+	} else if q == nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no quarantined request of the contact"))
+	}
+
+	if _, err := s.accountGroup.MetadataStore().ContactRequestIncomingReceived(ctx, q.Contact); err != nil {
+		return errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	s.lifecycles.requestReceived(q.Contact.PK, q.Peer)
+
+	return nil
+}
+
+// ContactRequestQuarantineDrop deletes a quarantined request, nothing is
+// sent to its sender.
+func (s *service) ContactRequestQuarantineDrop(ctx context.Context, contactPK []byte) error {
+	q, err := s.requestGuard.take(contactPK)
+	if err != nil {
+		return err
+	} else if q == nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no quarantined request of the contact"))
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package bertyprotocol
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestContactRequestPoW(t *testing.T) {
+	nonce := []byte("nonce")
+
+	counter, err := solveContactRequestPoW(context.Background(), nonce, 12)
+	require.NoError(t, err)
+	assert.True(t, verifyContactRequestPoW(nonce, 12, counter))
+	assert.True(t, contactRequestPoWBits(nonce, counter) >= 12)
+
+	assert.True(t, verifyContactRequestPoW(nonce, 0, 42))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = solveContactRequestPoW(ctx, nonce, 64)
+	assert.Error(t, err)
+}
+
+func TestRequestNetwork(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"/ip4/203.0.113.7/tcp/4242":        "203.0.113.0",
+		"/ip4/203.0.113.200/udp/4242/quic": "203.0.113.0",
+		"/ip6/2001:db8:1:2:3::1/tcp/4242":  "2001:db8:1:2::",
+		"/ip4/127.0.0.1/tcp/4242":          "",
+		"/ip4/192.168.1.12/tcp/4242":       "",
+		"/ip6/100::1/tcp/4242":             "",
+		"/p2p-circuit":                     "",
+	} {
+		assert.Equal(t, expected, requestNetwork(ma.StringCast(addr)), addr)
+	}
+
+	assert.Equal(t, "", requestNetwork(nil))
+}
+
+func TestContactRequestGuardLimits(t *testing.T) {
+	g, err := newContactRequestGuard(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil, contactRequestGuardOpts{RequestsPerSource: 2, Window: time.Minute})
+	require.NoError(t, err)
+
+	now := time.Now()
+	pid1, pid2, pid3 := peer.ID("peer1"), peer.ID("peer2"), peer.ID("peer3")
+
+	assert.True(t, g.allowStream(pid1, "203.0.113.0", now))
+	assert.True(t, g.allowStream(pid1, "", now))
+	assert.False(t, g.allowStream(pid1, "", now), "peer limit")
+
+	// the network of the peers is limited too
+	assert.True(t, g.allowStream(pid2, "203.0.113.0", now))
+	assert.False(t, g.allowStream(pid3, "203.0.113.0", now), "network limit")
+	assert.True(t, g.allowStream(pid3, "198.51.100.0", now))
+
+	assert.True(t, g.allowAccount([]byte("account"), now))
+	assert.True(t, g.allowAccount([]byte("account"), now))
+	assert.False(t, g.allowAccount([]byte("account"), now))
+
+	// the windows end
+	assert.True(t, g.allowStream(pid1, "", now.Add(time.Minute)))
+	assert.True(t, g.allowAccount([]byte("account"), now.Add(time.Minute)))
+}
+
+func TestContactRequestGuardScore(t *testing.T) {
+	g, err := newContactRequestGuard(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil, contactRequestGuardOpts{})
+	require.NoError(t, err)
+
+	withMetadata := &bertytypes.ShareableContact{PK: []byte("pk"), Metadata: []byte("alice")}
+	anonymous := &bertytypes.ShareableContact{PK: []byte("pk")}
+
+	score, reasons := g.score(withMetadata, true, "", false)
+	assert.Equal(t, 0, score)
+	assert.Empty(t, reasons)
+	assert.False(t, g.quarantines(score))
+
+	score, reasons = g.score(anonymous, false, "", false)
+	assert.Equal(t, []string{SpamReasonNoProofOfWork, SpamReasonNoMetadata}, reasons)
+	assert.True(t, g.quarantines(score))
+
+	score, reasons = g.score(withMetadata, true, "", true)
+	assert.Equal(t, []string{SpamReasonDeclinedBefore}, reasons)
+	assert.True(t, g.quarantines(score))
+
+	// the requests sent from the same network add up
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		require.True(t, g.allowStream(peer.ID([]byte{byte('a' + i)}), "203.0.113.0", now))
+	}
+
+	score, reasons = g.score(anonymous, true, "203.0.113.0", false)
+	assert.Equal(t, []string{SpamReasonNoMetadata, SpamReasonNetworkBurst}, reasons)
+	assert.Equal(t, spamReasonScores[SpamReasonNoMetadata]+maxNetworkBurstScore, score)
+
+	// the proof of work isn't expected once disabled, nor the quarantine
+	disabled, err := newContactRequestGuard(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil, contactRequestGuardOpts{PoWDifficulty: -1, QuarantineScore: -1})
+	require.NoError(t, err)
+
+	score, reasons = disabled.score(anonymous, false, "", true)
+	assert.Equal(t, []string{SpamReasonNoMetadata, SpamReasonDeclinedBefore}, reasons)
+	assert.False(t, disabled.quarantines(score))
+}
+
+func TestContactRequestQuarantine(t *testing.T) {
+	g, err := newContactRequestGuard(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil, contactRequestGuardOpts{})
+	require.NoError(t, err)
+
+	_, pk, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	pid, err := peer.IDFromPublicKey(pk)
+	require.NoError(t, err)
+
+	now := time.Now()
+	for i := 0; i < maxQuarantinedRequests+2; i++ {
+		contact := &bertytypes.ShareableContact{PK: []byte{byte(i), byte(i >> 8)}, PublicRendezvousSeed: []byte("seed")}
+		require.NoError(t, g.quarantine(contact, pid, 60, []string{SpamReasonNoProofOfWork}, now.Add(time.Duration(i)*time.Second)))
+	}
+
+	// the oldest requests are dropped
+	list, err := g.list(now)
+	require.NoError(t, err)
+	require.Len(t, list, maxQuarantinedRequests)
+	assert.Equal(t, []byte{2, 0}, list[0].Contact.PK)
+
+	q, err := g.take([]byte{2, 0})
+	require.NoError(t, err)
+	require.NotNil(t, q)
+	assert.Equal(t, pid, q.Peer)
+	assert.Equal(t, []byte("seed"), q.Contact.PublicRendezvousSeed)
+	assert.Equal(t, 60, q.public().Score)
+
+	q, err = g.take([]byte{2, 0})
+	require.NoError(t, err)
+	assert.Nil(t, q)
+
+	// and the expired ones
+	list, err = g.list(now.Add(quarantinedRequestTTL + time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
@@ -106,6 +106,8 @@ type contactRequestsManager struct {
 	logger         *zap.Logger
 	swiper         *Swiper
 	toAdd          map[string]*pendingRequest
+	received       func(contactPK []byte, pid peer.ID)
+	guard          *contactRequestGuard
 }
 
 func (c *contactRequestsManager) metadataRequestDisabled(_ *bertytypes.GroupMetadataEvent) error {
@@ -113,6 +115,7 @@ func (c *contactRequestsManager) metadataRequestDisabled(_ *bertytypes.GroupMeta
 	if c.announceCancel != nil {
 		c.announceCancel()
 		c.ipfs.RemoveStreamHandler(contactRequestV1)
+		c.ipfs.RemoveStreamHandler(contactRequestV2)
 	}
 
 	c.announceCancel = nil
@@ -121,7 +124,8 @@ func (c *contactRequestsManager) metadataRequestDisabled(_ *bertytypes.GroupMeta
 }
 
 func (c *contactRequestsManager) metadataRequestEnabled(_ *bertytypes.GroupMetadataEvent) error {
-	c.ipfs.SetStreamHandler(contactRequestV1, c.incomingHandler)
+	c.ipfs.SetStreamHandler(contactRequestV1, c.incomingHandlerV1)
+	c.ipfs.SetStreamHandler(contactRequestV2, c.incomingHandlerV2)
 
 	c.enabled = true
 	if c.announceCancel != nil {
@@ -211,7 +215,7 @@ func (c *contactRequestsManager) enqueueRequest(contact *bertytypes.ShareableCon
 					return
 				}
 
-				stream, err := c.ipfs.NewStream(context.TODO(), addr.ID, contactRequestV1)
+				stream, err := c.ipfs.NewStream(context.TODO(), addr.ID, contactRequestV2, contactRequestV1)
 				if err != nil {
 					c.logger.Error("error while opening stream with other peer", zap.Error(err))
 					return
@@ -289,13 +293,43 @@ func (c *contactRequestsManager) metadataWatcher(ctx context.Context) {
 
 const contactRequestV1 = "/berty/contact_req/1.0.0"
 
-func (c *contactRequestsManager) incomingHandler(stream network.Stream) {
+// contactRequestV2 asks a proof of work to the sender before the handshake
+const contactRequestV2 = "/berty/contact_req/2.0.0"
+
+func (c *contactRequestsManager) incomingHandlerV1(stream network.Stream) {
+	c.incomingHandler(stream, false)
+}
+
+func (c *contactRequestsManager) incomingHandlerV2(stream network.Stream) {
+	c.incomingHandler(stream, true)
+}
+
+func (c *contactRequestsManager) incomingHandler(stream network.Stream, challenge bool) {
 	defer func() {
 		if err := p2phelpers.FullClose(stream); err != nil {
 			c.logger.Warn("error while closing stream with other peer", zap.Error(err))
 		}
 	}()
 
+	pid := stream.Conn().RemotePeer()
+	netw := requestNetwork(stream.Conn().RemoteMultiaddr())
+	if !c.guard.allowStream(pid, netw, time.Now()) {
+		c.logger.Debug("contact request rate limited", zap.Stringer("peer", pid))
+		return
+	}
+
+	pow := false
+	if challenge {
+		var err error
+		if pow, err = sendContactRequestChallenge(stream, c.guard.opts.PoWDifficulty); err != nil {
+			c.logger.Error("an error occurred during the proof of work", zap.Error(err))
+			return
+		} else if !pow {
+			c.logger.Warn("invalid proof of work of a contact request", zap.Stringer("peer", pid))
+			return
+		}
+	}
+
 	reader := ggio.NewDelimitedReader(stream, 2048)
 	writer := ggio.NewDelimitedWriter(stream)
 
@@ -328,14 +362,40 @@ func (c *contactRequestsManager) incomingHandler(stream network.Stream) {
 		return
 	}
 
-	if _, err = c.metadataStore.ContactRequestIncomingReceived(c.ctx, &bertytypes.ShareableContact{
+	received := &bertytypes.ShareableContact{
 		PK:                   otherPKBytes,
 		PublicRendezvousSeed: contact.PublicRendezvousSeed,
 		Metadata:             contact.Metadata,
-	}); err != nil {
+	}
+
+	// the requests of the strangers, the accounts not requested or declined
+	// before, are rate limited and scored
+	if c.metadataStore.checkContactStatus(otherPK, bertytypes.ContactStateBlocked) {
+		return
+	} else if c.metadataStore.checkContactStatus(otherPK, bertytypes.ContactStateUndefined, bertytypes.ContactStateDiscarded) {
+		if !c.guard.allowAccount(otherPKBytes, time.Now()) {
+			c.logger.Debug("contact request rate limited", zap.Stringer("peer", pid))
+			return
+		}
+
+		declined := c.metadataStore.checkContactStatus(otherPK, bertytypes.ContactStateDiscarded)
+		if score, reasons := c.guard.score(received, pow, netw, declined); c.guard.quarantines(score) {
+			if err := c.guard.quarantine(received, pid, score, reasons, time.Now()); err != nil {
+				c.logger.Error("unable to quarantine contact request", zap.Error(err))
+			}
+
+			return
+		}
+	}
+
+	if _, err = c.metadataStore.ContactRequestIncomingReceived(c.ctx, received); err != nil {
 		c.logger.Error("an error occurred while adding contact request to received", zap.Error(err))
 		return
 	}
+
+	if c.received != nil {
+		c.received(otherPKBytes, pid)
+	}
 }
 
 func (c *contactRequestsManager) performSend(otherPK crypto.PubKey, stream network.Stream) error {
@@ -363,6 +423,12 @@ func (c *contactRequestsManager) performSend(otherPK crypto.PubKey, stream netwo
 
 	contact.Metadata = ownMetadata
 
+	if stream.Protocol() == contactRequestV2 {
+		if err := answerContactRequestChallenge(c.ctx, stream); err != nil {
+			return fmt.Errorf("an error occurred during the proof of work: %w", err)
+		}
+	}
+
 	reader := ggio.NewDelimitedReader(stream, 2048)
 	writer := ggio.NewDelimitedWriter(stream)
 
@@ -405,7 +471,7 @@ func (c *contactRequestsManager) enableIncomingRequests() error {
 	return nil
 }
 
-func initContactRequestsManager(ctx context.Context, s *Swiper, store *metadataStore, ipfs ipfsutil.ExtendedCoreAPI, logger *zap.Logger) error {
+func initContactRequestsManager(ctx context.Context, s *Swiper, store *metadataStore, ipfs ipfsutil.ExtendedCoreAPI, logger *zap.Logger, guard *contactRequestGuard, received func(contactPK []byte, pid peer.ID)) error {
 	sk, err := store.devKS.AccountPrivKey()
 	if err != nil {
 		return err
@@ -419,6 +485,8 @@ func initContactRequestsManager(ctx context.Context, s *Swiper, store *metadataS
 		ctx:           ctx,
 		swiper:        s,
 		toAdd:         map[string]*pendingRequest{},
+		received:      received,
+		guard:         guard,
 	}
 
 	go cm.metadataWatcher(ctx)
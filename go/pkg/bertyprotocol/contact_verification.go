@@ -0,0 +1,416 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+const (
+	// safetyNumberVersion is hashed with the keys, so the numbers of two
+	// versions are never equal
+	safetyNumberVersion = 0
+
+	// safetyNumberIterations slows down the search of a key whose number
+	// matches another one
+	safetyNumberIterations = 5200
+
+	// safetyNumberChunks is the number of 5 digits groups by account
+	safetyNumberChunks = 6
+)
+
+// ContactVerificationState is the verification state of a contact.
+type ContactVerificationState string
+
+const (
+	ContactUnverified ContactVerificationState = "unverified"
+	ContactVerified   ContactVerificationState = "verified"
+
+	// ContactKeyChanged is a verified contact which added a device since
+	// its verification
+	ContactKeyChanged ContactVerificationState = "key_changed"
+)
+
+// ContactVerification is the safety number of a contact and its verification
+// state.
+type ContactVerification struct {
+	ContactPK []byte `json:"contact_pk"`
+
+	// SafetyNumber is the same on both sides, the users compare them to
+	// verify they talk to each other
+	SafetyNumber string                   `json:"safety_number"`
+	State        ContactVerificationState `json:"state"`
+	VerifiedAt   time.Time                `json:"verified_at,omitempty"`
+	KeyChangedAt time.Time                `json:"key_changed_at,omitempty"`
+}
+
+// EvtContactKeyChanged is emitted on the event bus of the host when a new
+// device of a contact is seen, WasVerified tells whether the contact was
+// verified before.
+type EvtContactKeyChanged struct {
+	ContactPK   []byte
+	DevicePK    []byte
+	WasVerified bool
+}
+
+// safetyNumber returns the number displayed for two accounts, the keys are
+// sorted so both get the same. It is made of 12 groups of 5 digits, the ones
+// of each account computed from its key only.
+func safetyNumber(localPK, remotePK []byte) string {
+	local, remote := safetyNumberHalf(localPK), safetyNumberHalf(remotePK)
+	if local > remote {
+		local, remote = remote, local
+	}
+
+	digits := local + remote
+
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+
+	return strings.Join(groups, " ")
+}
+
+func safetyNumberHalf(pk []byte) string {
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, safetyNumberVersion)
+
+	digest := append(version, pk...)
+	for i := 0; i < safetyNumberIterations; i++ {
+		sum := sha512.Sum512(append(digest, pk...))
+		digest = sum[:]
+	}
+
+	var b strings.Builder
+	for i := 0; i < safetyNumberChunks; i++ {
+		chunk := digest[i*5 : i*5+5]
+		v := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 | uint64(chunk[4])
+		fmt.Fprintf(&b, "%05d", v%100000)
+	}
+
+	return b.String()
+}
+
+// verificationRecord is stored by contact, the devices seen are kept so the
+// new ones are noticed, the first ones are trusted on first use.
+type verificationRecord struct {
+	Verified     bool     `json:"verified,omitempty"`
+	VerifiedAt   int64    `json:"verified_at,omitempty"`
+	KeyChanged   bool     `json:"key_changed,omitempty"`
+	KeyChangedAt int64    `json:"key_changed_at,omitempty"`
+	Devices      []string `json:"devices,omitempty"`
+}
+
+func (r *verificationRecord) hasDevice(devicePK []byte) bool {
+	encoded := base64.RawURLEncoding.EncodeToString(devicePK)
+	for _, d := range r.Devices {
+		if d == encoded {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *verificationRecord) state() ContactVerificationState {
+	switch {
+	case r.Verified && r.KeyChanged:
+		return ContactKeyChanged
+	case r.Verified:
+		return ContactVerified
+	}
+
+	return ContactUnverified
+}
+
+// contactVerifications persists the verification state of the contacts.
+type contactVerifications struct {
+	logger  *zap.Logger
+	store   datastore.Datastore
+	emitter event.Emitter
+
+	lock sync.Mutex
+}
+
+func newContactVerifications(logger *zap.Logger, store datastore.Datastore, h host.Host) (*contactVerifications, error) {
+	cv := &contactVerifications{
+		logger: logger,
+		store:  store,
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtContactKeyChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		cv.emitter = emitter
+	}
+
+	return cv, nil
+}
+
+func (cv *contactVerifications) getLocked(contactPK []byte) (*verificationRecord, error) {
+	data, err := cv.store.Get(contactRecordKey(contactPK))
+	if err == datastore.ErrNotFound {
+		return &verificationRecord{}, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	rec := &verificationRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return rec, nil
+}
+
+func (cv *contactVerifications) putLocked(contactPK []byte, rec *verificationRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := cv.store.Put(contactRecordKey(contactPK), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (cv *contactVerifications) get(contactPK []byte) (*verificationRecord, error) {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+
+	return cv.getLocked(contactPK)
+}
+
+func (cv *contactVerifications) setVerified(contactPK []byte, verified bool, now time.Time) error {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+
+	rec, err := cv.getLocked(contactPK)
+	if err != nil {
+		return err
+	}
+
+	rec.Verified, rec.KeyChanged, rec.KeyChangedAt = verified, false, 0
+	rec.VerifiedAt = 0
+	if verified {
+		rec.VerifiedAt = now.UnixNano()
+	}
+
+	return cv.putLocked(contactPK, rec)
+}
+
+// deviceSeen records a device of a contact, a device not seen before is a
+// key change unless trusted, the verification is then lost.
+func (cv *contactVerifications) deviceSeen(contactPK, devicePK []byte, trust bool, now time.Time) (*EvtContactKeyChanged, error) {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+
+	rec, err := cv.getLocked(contactPK)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.hasDevice(devicePK) {
+		return nil, nil
+	}
+
+	rec.Devices = append(rec.Devices, base64.RawURLEncoding.EncodeToString(devicePK))
+
+	var evt *EvtContactKeyChanged
+	if !trust {
+		evt = &EvtContactKeyChanged{ContactPK: contactPK, DevicePK: devicePK, WasVerified: rec.Verified}
+		if rec.Verified && !rec.KeyChanged {
+			rec.KeyChanged, rec.KeyChangedAt = true, now.UnixNano()
+		}
+	}
+
+	if err := cv.putLocked(contactPK, rec); err != nil {
+		return nil, err
+	}
+
+	return evt, nil
+}
+
+func (cv *contactVerifications) emit(evt *EvtContactKeyChanged) {
+	if cv.emitter == nil || evt == nil {
+		return
+	}
+
+	if err := cv.emitter.Emit(*evt); err != nil {
+		cv.logger.Warn("unable to emit contact key change", zap.Error(err))
+	}
+}
+
+func (s *service) ownAccountPK() ([]byte, error) {
+	sk, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	pk, err := sk.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return pk, nil
+}
+
+// ContactVerification returns the safety number of a contact and its
+// verification state.
+func (s *service) ContactVerification(_ context.Context, contactPK []byte) (*ContactVerification, error) {
+	if _, err := crypto.UnmarshalEd25519PublicKey(contactPK); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	ownPK, err := s.ownAccountPK()
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := s.verifications.get(contactPK)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &ContactVerification{
+		ContactPK:    contactPK,
+		SafetyNumber: safetyNumber(ownPK, contactPK),
+		State:        rec.state(),
+	}
+
+	if rec.VerifiedAt != 0 {
+		v.VerifiedAt = time.Unix(0, rec.VerifiedAt)
+	}
+
+	if rec.KeyChangedAt != 0 {
+		v.KeyChangedAt = time.Unix(0, rec.KeyChangedAt)
+	}
+
+	return v, nil
+}
+
+// ContactVerify marks a contact as verified, the safety number compared by
+// the users must be the one of the contact.
+func (s *service) ContactVerify(ctx context.Context, contactPK []byte, number string) error {
+	v, err := s.ContactVerification(ctx, contactPK)
+	if err != nil {
+		return err
+	}
+
+	if strings.Join(strings.Fields(number), " ") != v.SafetyNumber {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("safety number doesn't match"))
+	}
+
+	if err := s.verifications.setVerified(contactPK, true, time.Now()); err != nil {
+		return err
+	}
+
+	s.audit.add(&securityRecord{Type: SecurityContactVerified, ContactPK: contactPK})
+
+	return nil
+}
+
+// ContactUnverify marks a contact as not verified.
+func (s *service) ContactUnverify(_ context.Context, contactPK []byte) error {
+	if _, err := crypto.UnmarshalEd25519PublicKey(contactPK); err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if err := s.verifications.setVerified(contactPK, false, time.Now()); err != nil {
+		return err
+	}
+
+	s.audit.add(&securityRecord{Type: SecurityContactUnverified, ContactPK: contactPK})
+
+	return nil
+}
+
+// watchContactKeys records the devices of the contact of a contact group,
+// trusted on first use: the history of a contact never seen before is
+// trusted, the devices added since are key changes.
+func (s *service) watchContactKeys(ctx context.Context, gc *groupContext) {
+	ownPK, err := s.ownAccountPK()
+	if err != nil {
+		return
+	}
+
+	firstUse := map[string]bool{}
+
+	apply := func(evt *bertytypes.GroupMetadataEvent, history bool) {
+		if evt == nil || evt.Metadata == nil || evt.Metadata.EventType != bertytypes.EventTypeGroupMemberDeviceAdded {
+			return
+		}
+
+		e := &bertytypes.GroupAddMemberDevice{}
+		if err := e.Unmarshal(evt.Event); err != nil || bytes.Equal(e.MemberPK, ownPK) {
+			return
+		}
+
+		trust := false
+		if history {
+			first, ok := firstUse[string(e.MemberPK)]
+			if !ok {
+				rec, err := s.verifications.get(e.MemberPK)
+				first = err == nil && len(rec.Devices) == 0
+				firstUse[string(e.MemberPK)] = first
+			}
+
+			trust = first
+		}
+
+		changed, err := s.verifications.deviceSeen(e.MemberPK, e.DevicePK, trust, time.Now())
+		if err != nil {
+			s.logger.Warn("unable to record contact device", zap.Error(err))
+			return
+		}
+
+		if changed != nil {
+			s.logger.Info("contact key changed", zap.Bool("verified", changed.WasVerified))
+			s.verifications.emit(changed)
+
+			rec := &securityRecord{Type: SecurityKeyChanged, ContactPK: changed.ContactPK, DevicePK: changed.DevicePK, GroupPK: gc.Group().PublicKey}
+			if changed.WasVerified {
+				rec.Details = "verification lost"
+			}
+
+			s.audit.add(rec)
+		}
+	}
+
+	sub := gc.metadataStore.Subscribe(ctx)
+
+	for evt := range gc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		apply(evt, true)
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			apply(evt, false)
+		}
+	}
+}
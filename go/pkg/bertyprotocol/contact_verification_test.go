@@ -0,0 +1,74 @@
+package bertyprotocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob, eve := []byte("alice account key"), []byte("bob account key"), []byte("eve account key")
+
+	number := safetyNumber(alice, bob)
+	assert.Equal(t, number, safetyNumber(bob, alice))
+	assert.NotEqual(t, number, safetyNumber(alice, eve))
+
+	groups := strings.Split(number, " ")
+	require.Len(t, groups, 2*safetyNumberChunks)
+	for _, g := range groups {
+		assert.Len(t, g, 5)
+	}
+}
+
+func TestContactVerifications(t *testing.T) {
+	cv, err := newContactVerifications(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	contactPK, phone, laptop, tablet := []byte("contact"), []byte("phone"), []byte("laptop"), []byte("tablet")
+	now := time.Now()
+
+	// the devices of the history are trusted on first use
+	evt, err := cv.deviceSeen(contactPK, phone, true, now)
+	require.NoError(t, err)
+	assert.Nil(t, evt)
+
+	evt, err = cv.deviceSeen(contactPK, laptop, false, now)
+	require.NoError(t, err)
+	require.NotNil(t, evt)
+	assert.False(t, evt.WasVerified)
+
+	rec, err := cv.get(contactPK)
+	require.NoError(t, err)
+	assert.Equal(t, ContactUnverified, rec.state())
+
+	require.NoError(t, cv.setVerified(contactPK, true, now))
+
+	// a device already seen isn't a change
+	evt, err = cv.deviceSeen(contactPK, phone, false, now)
+	require.NoError(t, err)
+	assert.Nil(t, evt)
+
+	evt, err = cv.deviceSeen(contactPK, tablet, false, now)
+	require.NoError(t, err)
+	require.NotNil(t, evt)
+	assert.True(t, evt.WasVerified)
+	assert.Equal(t, tablet, evt.DevicePK)
+
+	rec, err = cv.get(contactPK)
+	require.NoError(t, err)
+	assert.Equal(t, ContactKeyChanged, rec.state())
+	assert.NotZero(t, rec.KeyChangedAt)
+
+	// verifying again acknowledges the change
+	require.NoError(t, cv.setVerified(contactPK, true, now))
+	rec, err = cv.get(contactPK)
+	require.NoError(t, err)
+	assert.Equal(t, ContactVerified, rec.state())
+	assert.Len(t, rec.Devices, 3)
+}
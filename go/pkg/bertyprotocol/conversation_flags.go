@@ -0,0 +1,405 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+// conversationFlagsPrefix marks the app metadata of the account group
+// changing a flag of a conversation, so every device of the account applies
+// it
+const conversationFlagsPrefix = "\x00berty.flags/1\x00"
+
+// ConversationFlag is a per-conversation state of the account, shared by its
+// devices.
+type ConversationFlag string
+
+const (
+	ConversationFlagArchived ConversationFlag = "archived"
+	ConversationFlagMuted    ConversationFlag = "muted"
+	ConversationFlagPinned   ConversationFlag = "pinned"
+)
+
+// ConversationFlags are the flags of a conversation.
+type ConversationFlags struct {
+	GroupPK  []byte `json:"group_pk"`
+	Archived bool   `json:"archived"`
+	Pinned   bool   `json:"pinned"`
+	Muted    bool   `json:"muted"`
+
+	// MutedUntil is when the mute ends, zero while muted means forever
+	MutedUntil time.Time `json:"muted_until,omitempty"`
+
+	// PinnedAt orders the pinned conversations, the last pinned first
+	PinnedAt time.Time `json:"pinned_at,omitempty"`
+}
+
+// IsMuted reports whether the conversation is muted at the given time.
+func (f *ConversationFlags) IsMuted(now time.Time) bool {
+	return f.Muted && (f.MutedUntil.IsZero() || now.Before(f.MutedUntil))
+}
+
+// EvtConversationFlagsChanged is emitted on the event bus of the host when a
+// flag of a conversation is changed, by any device of the account.
+type EvtConversationFlagsChanged struct {
+	Flags *ConversationFlags
+}
+
+// Conversation is a conversation of the account with its flags.
+type Conversation struct {
+	Group *bertytypes.Group  `json:"group"`
+	Flags *ConversationFlags `json:"flags"`
+}
+
+// conversationFlagOp is the change of a flag, sent on the account group.
+type conversationFlagOp struct {
+	GroupPK []byte           `json:"group_pk"`
+	Flag    ConversationFlag `json:"flag"`
+	Value   bool             `json:"value"`
+	Until   int64            `json:"until,omitempty"`
+	At      int64            `json:"at"`
+}
+
+func validConversationFlag(flag ConversationFlag) error {
+	switch flag {
+	case ConversationFlagArchived, ConversationFlagMuted, ConversationFlagPinned:
+		return nil
+	}
+
+	return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown conversation flag %q", flag))
+}
+
+type flagRecord struct {
+	Value    bool   `json:"value"`
+	Until    int64  `json:"until,omitempty"`
+	At       int64  `json:"at"`
+	DevicePK []byte `json:"device_pk"`
+}
+
+// newer reports whether a change wins over the current one, the latest wins
+// and the device keys break the ties so every device converges.
+func (r *flagRecord) newer(at int64, devicePK []byte) bool {
+	if at != r.At {
+		return at > r.At
+	}
+
+	return bytes.Compare(devicePK, r.DevicePK) > 0
+}
+
+type conversationFlagsRecord struct {
+	Flags map[ConversationFlag]*flagRecord `json:"flags"`
+}
+
+// conversationFlags persists the flags of the conversations, each flag is
+// changed by the last writer.
+type conversationFlags struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+
+	lock sync.Mutex
+}
+
+func newConversationFlags(logger *zap.Logger, store datastore.Batching, h host.Host) (*conversationFlags, error) {
+	cf := &conversationFlags{
+		logger: logger,
+		store:  store,
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtConversationFlagsChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		cf.emitter = emitter
+	}
+
+	return cf, nil
+}
+
+func conversationFlagsKey(groupPK []byte) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(groupPK))
+}
+
+func (cf *conversationFlags) getLocked(groupPK []byte) (*conversationFlagsRecord, error) {
+	data, err := cf.store.Get(conversationFlagsKey(groupPK))
+	if err == datastore.ErrNotFound {
+		return &conversationFlagsRecord{Flags: make(map[ConversationFlag]*flagRecord)}, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	rec := &conversationFlagsRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if rec.Flags == nil {
+		rec.Flags = make(map[ConversationFlag]*flagRecord)
+	}
+
+	return rec, nil
+}
+
+func newConversationFlagsFromRecord(groupPK []byte, rec *conversationFlagsRecord) *ConversationFlags {
+	flags := &ConversationFlags{GroupPK: groupPK}
+
+	if f, ok := rec.Flags[ConversationFlagArchived]; ok {
+		flags.Archived = f.Value
+	}
+
+	if f, ok := rec.Flags[ConversationFlagPinned]; ok && f.Value {
+		flags.Pinned = true
+		flags.PinnedAt = time.Unix(0, f.At)
+	}
+
+	if f, ok := rec.Flags[ConversationFlagMuted]; ok && f.Value {
+		flags.Muted = true
+		if f.Until != 0 {
+			flags.MutedUntil = time.Unix(0, f.Until)
+		}
+	}
+
+	return flags
+}
+
+// change applies the change of a flag by a device, it reports whether the
+// flag changed.
+func (cf *conversationFlags) change(op *conversationFlagOp, devicePK []byte) (bool, error) {
+	if err := validConversationFlag(op.Flag); err != nil {
+		return false, err
+	}
+
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	rec, err := cf.getLocked(op.GroupPK)
+	if err != nil {
+		return false, err
+	}
+
+	if current, ok := rec.Flags[op.Flag]; ok && !current.newer(op.At, devicePK) {
+		return false, nil
+	}
+
+	rec.Flags[op.Flag] = &flagRecord{Value: op.Value, Until: op.Until, At: op.At, DevicePK: devicePK}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := cf.store.Put(conversationFlagsKey(op.GroupPK), data); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if cf.emitter != nil {
+		if err := cf.emitter.Emit(EvtConversationFlagsChanged{Flags: newConversationFlagsFromRecord(op.GroupPK, rec)}); err != nil {
+			cf.logger.Warn("unable to emit conversation flags event", zap.Error(err))
+		}
+	}
+
+	return true, nil
+}
+
+func (cf *conversationFlags) get(groupPK []byte) (*ConversationFlags, error) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	rec, err := cf.getLocked(groupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConversationFlagsFromRecord(groupPK, rec), nil
+}
+
+// all returns the flags of the conversations by group.
+func (cf *conversationFlags) all() (map[string]*ConversationFlags, error) {
+	res, err := cf.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	flags := make(map[string]*ConversationFlags)
+	for _, entry := range entries {
+		groupPK, err := base64.RawURLEncoding.DecodeString(datastore.RawKey(entry.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		rec := &conversationFlagsRecord{}
+		if err := json.Unmarshal(entry.Value, rec); err != nil {
+			cf.logger.Warn("unable to read conversation flags", zap.Error(err))
+			continue
+		}
+
+		flags[string(groupPK)] = newConversationFlagsFromRecord(groupPK, rec)
+	}
+
+	return flags, nil
+}
+
+// applyConversationFlags applies an app metadata event of the account group
+// if it changes a flag of a conversation.
+func (s *service) applyConversationFlags(evt *bertytypes.GroupMetadataEvent) {
+	if evt == nil || evt.Metadata == nil || evt.Metadata.EventType != bertytypes.EventTypeGroupMetadataPayloadSent {
+		return
+	}
+
+	am := &bertytypes.AppMetadata{}
+	if err := am.Unmarshal(evt.Event); err != nil || !bytes.HasPrefix(am.Message, []byte(conversationFlagsPrefix)) {
+		return
+	}
+
+	op := &conversationFlagOp{}
+	if err := json.Unmarshal(am.Message[len(conversationFlagsPrefix):], op); err != nil {
+		s.logger.Debug("invalid conversation flag change", zap.Error(err))
+		return
+	}
+
+	if _, err := s.flags.change(op, am.DevicePK); err != nil {
+		s.logger.Debug("unable to apply conversation flag change", zap.Error(err))
+	}
+}
+
+// watchConversationFlags applies the flag changes of the account group, the
+// ones made by the other devices while this one was offline, or before it
+// was installed, are applied from the history first.
+func (s *service) watchConversationFlags(ctx context.Context, acc *groupContext) {
+	sub := acc.metadataStore.Subscribe(ctx)
+
+	for evt := range acc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		s.applyConversationFlags(evt)
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			s.applyConversationFlags(evt)
+		}
+	}
+}
+
+// ConversationFlagSet changes a flag of a conversation on every device of
+// the account, until bounds a mute, zero mutes forever.
+func (s *service) ConversationFlagSet(ctx context.Context, groupPK []byte, flag ConversationFlag, value bool, until time.Time) error {
+	if err := validConversationFlag(flag); err != nil {
+		return err
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(groupPK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	g, err := s.getGroupForPK(pk)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if g.GroupType == bertytypes.GroupTypeAccount {
+		return errcode.ErrInvalidInput
+	}
+
+	op := &conversationFlagOp{GroupPK: groupPK, Flag: flag, Value: value, At: time.Now().UnixNano()}
+	if flag == ConversationFlagMuted && value && !until.IsZero() {
+		op.Until = until.UnixNano()
+	}
+
+	data, err := json.Marshal(op)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	devicePK, err := s.accountGroup.DevicePubKey().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := s.flags.change(op, devicePK); err != nil {
+		return err
+	}
+
+	if _, err := s.accountGroup.MetadataStore().SendAppMetadata(ctx, append([]byte(conversationFlagsPrefix), data...)); err != nil {
+		return errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
+
+// ConversationFlags returns the flags of a conversation.
+func (s *service) ConversationFlags(_ context.Context, groupPK []byte) (*ConversationFlags, error) {
+	return s.flags.get(groupPK)
+}
+
+// ConversationList returns the conversations of the account with their
+// flags, the archived ones only if archived is true, the others otherwise.
+// The pinned conversations come first, the last pinned first.
+func (s *service) ConversationList(_ context.Context, archived bool) ([]*Conversation, error) {
+	if err := s.indexGroups(); err != nil {
+		return nil, err
+	}
+
+	flags, err := s.flags.all()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	conversations := []*Conversation{}
+	for id, g := range s.groups {
+		if g.GroupType == bertytypes.GroupTypeAccount {
+			continue
+		}
+
+		f, ok := flags[id]
+		if !ok {
+			f = &ConversationFlags{GroupPK: g.PublicKey}
+		}
+
+		if f.Archived == archived {
+			conversations = append(conversations, &Conversation{Group: g, Flags: f})
+		}
+	}
+	s.lock.RUnlock()
+
+	sort.Slice(conversations, func(i, j int) bool {
+		a, b := conversations[i].Flags, conversations[j].Flags
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+
+		if a.Pinned && !a.PinnedAt.Equal(b.PinnedAt) {
+			return a.PinnedAt.After(b.PinnedAt)
+		}
+
+		return bytes.Compare(a.GroupPK, b.GroupPK) < 0
+	})
+
+	return conversations, nil
+}
@@ -0,0 +1,64 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConversationFlags(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	cf, err := newConversationFlags(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	groupPK, phone, laptop := []byte("group"), []byte("phone"), []byte("laptop")
+	now := time.Now()
+
+	change := func(devicePK []byte, flag ConversationFlag, value bool, at time.Time) bool {
+		changed, err := cf.change(&conversationFlagOp{GroupPK: groupPK, Flag: flag, Value: value, At: at.UnixNano()}, devicePK)
+		require.NoError(t, err)
+		return changed
+	}
+
+	flags, err := cf.get(groupPK)
+	require.NoError(t, err)
+	assert.False(t, flags.Archived)
+
+	// each flag is changed by the last writer, whatever the order the
+	// changes are received in
+	assert.True(t, change(laptop, ConversationFlagArchived, true, now.Add(time.Second)))
+	assert.False(t, change(phone, ConversationFlagArchived, false, now))
+	assert.True(t, change(phone, ConversationFlagPinned, true, now))
+	assert.False(t, change(phone, ConversationFlagPinned, true, now))
+
+	// the device keys break the ties
+	assert.True(t, change(phone, ConversationFlagMuted, true, now))
+	assert.False(t, change(laptop, ConversationFlagMuted, false, now))
+
+	flags, err = cf.get(groupPK)
+	require.NoError(t, err)
+	assert.True(t, flags.Archived)
+	assert.True(t, flags.Pinned)
+	assert.True(t, flags.IsMuted(now))
+
+	_, err = cf.change(&conversationFlagOp{GroupPK: groupPK, Flag: "starred", Value: true, At: now.UnixNano()}, phone)
+	assert.Error(t, err)
+
+	// a mute can end
+	_, err = cf.change(&conversationFlagOp{GroupPK: groupPK, Flag: ConversationFlagMuted, Value: true, Until: now.Add(time.Hour).UnixNano(), At: now.Add(time.Second).UnixNano()}, phone)
+	require.NoError(t, err)
+
+	cf, err = newConversationFlags(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	all, err := cf.all()
+	require.NoError(t, err)
+	require.Contains(t, all, string(groupPK))
+	assert.True(t, all[string(groupPK)].IsMuted(now))
+	assert.False(t, all[string(groupPK)].IsMuted(now.Add(time.Hour)))
+}
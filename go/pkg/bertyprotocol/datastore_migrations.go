@@ -0,0 +1,40 @@
+package bertyprotocol
+
+import (
+	"berty.tech/berty/v2/go/internal/storage"
+	datastore "github.com/ipfs/go-datastore"
+	"go.uber.org/zap"
+)
+
+// datastoreMigrations are the schema versions of the root datastore. A
+// migration is appended whenever the layout of the entries changes, the ones
+// already released are never edited.
+var datastoreMigrations = []storage.Migration{
+	{
+		// the datastores created before the schema versions
+		Version: 1,
+		Name:    "initial schema",
+		Up:      func(datastore.Datastore) error { return nil },
+	},
+}
+
+// DatastoreMigrations returns the migrations of the root datastore, e.g. to
+// roll them back before a downgrade.
+func DatastoreMigrations() []storage.Migration {
+	return append([]storage.Migration{}, datastoreMigrations...)
+}
+
+// migrateDatastore brings the root datastore to the latest schema version on
+// startup, a datastore migrated by a newer release is refused.
+func migrateDatastore(logger *zap.Logger, ds datastore.Batching) error {
+	report, err := storage.Migrate(ds, datastoreMigrations, storage.MigrateOpts{})
+	if err != nil {
+		return err
+	}
+
+	for _, step := range report.Steps {
+		logger.Info("datastore migrated", zap.Int("version", step.Version), zap.String("name", step.Name), zap.Int("puts", step.Puts), zap.Int("deletes", step.Deletes))
+	}
+
+	return nil
+}
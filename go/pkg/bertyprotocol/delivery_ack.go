@@ -0,0 +1,614 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const deliveryAckProtocolID = protocol.ID("/berty/delivery-ack/1.0.0")
+
+const (
+	deliveryAckTimeout = 30 * time.Second
+
+	// maxPendingDeliveryAcks caps the acks of a group waiting for one of its
+	// peers to be connected
+	maxPendingDeliveryAcks = 256
+)
+
+// DeliveryStatus is the status of a message sent by the device.
+type DeliveryStatus string
+
+const (
+	// DeliveryStatusSent messages are in the store of the device, not
+	// acknowledged by any other device yet
+	DeliveryStatusSent DeliveryStatus = "sent"
+
+	// DeliveryStatusDelivered messages reached at least one other device of
+	// the group
+	DeliveryStatusDelivered DeliveryStatus = "delivered"
+
+	// DeliveryStatusRead messages were read on at least one other device of
+	// the group
+	DeliveryStatusRead DeliveryStatus = "read"
+
+	// DeliveryStatusExpiredUndelivered messages weren't acknowledged by any
+	// other device once a store-and-forward bundle carrying them expired
+	DeliveryStatusExpiredUndelivered DeliveryStatus = "expired-undelivered"
+)
+
+// deliveryCarriedKey prefixes the store-and-forward bundles carrying the
+// messages sent by the device, by bundle ID.
+var deliveryCarriedKey = datastore.NewKey("carried")
+
+// MessageDelivery is the delivery state of a message sent by the device.
+type MessageDelivery struct {
+	GroupPK   []byte
+	MessageID []byte
+	Status    DeliveryStatus
+	SentAt    time.Time
+
+	// Devices are the devices which acknowledged the message, by base64
+	// encoded public key
+	Devices map[string]time.Time
+
+	// Readers are the devices which sent a read receipt for the message
+	Readers map[string]time.Time
+
+	// CarryExpiredAt is when a bundle carrying the undelivered message
+	// expired, zero if none did
+	CarryExpiredAt time.Time
+}
+
+// EvtMessageDeliveryChanged is emitted on the event bus of the host when a
+// message is sent by the device and each time another device acknowledges or
+// reads it.
+type EvtMessageDeliveryChanged struct {
+	Delivery *MessageDelivery
+}
+
+type ackKind string
+
+const (
+	ackDelivered ackKind = ""
+	ackRead      ackKind = "read"
+)
+
+// deliveryAck is sent by a device to the peers of a group once a message of
+// another device is received, then once it is read.
+type deliveryAck struct {
+	Kind      ackKind `json:"kind,omitempty"`
+	GroupPK   []byte  `json:"group_pk"`
+	MessageID []byte  `json:"message_id"`
+	DevicePK  []byte  `json:"device_pk"`
+	Sig       []byte  `json:"sig"`
+}
+
+func (a *deliveryAck) signedBytes() []byte {
+	prefix := []byte("berty delivery ack")
+	if a.Kind == ackRead {
+		prefix = []byte("berty read receipt")
+	}
+
+	return bytes.Join([][]byte{prefix, a.GroupPK, a.MessageID}, nil)
+}
+
+type deliveryRecord struct {
+	SentAt         int64            `json:"sent_at"`
+	Devices        map[string]int64 `json:"devices,omitempty"`
+	Readers        map[string]int64 `json:"readers,omitempty"`
+	CarryExpiredAt int64            `json:"carry_expired_at,omitempty"`
+}
+
+// carriedRecord is the message of a store-and-forward bundle.
+type carriedRecord struct {
+	GroupPK   []byte `json:"group_pk"`
+	MessageID []byte `json:"message_id"`
+}
+
+// deliveryTracker persists the acks of the messages sent by the device, and
+// holds the acks of the device until they can be sent.
+type deliveryTracker struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+
+	// delivered, if set, is called with the delay before the first ack of
+	// a message
+	delivered func(latency time.Duration)
+
+	muRecords sync.Mutex
+
+	muPending sync.Mutex
+	pending   map[string][]*deliveryAck
+}
+
+func newDeliveryTracker(logger *zap.Logger, store datastore.Batching, h host.Host) (*deliveryTracker, error) {
+	t := &deliveryTracker{
+		logger:  logger,
+		store:   store,
+		pending: make(map[string][]*deliveryAck),
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtMessageDeliveryChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		t.emitter = emitter
+	}
+
+	return t, nil
+}
+
+func deliveryKey(groupPK, messageID []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		base64.RawURLEncoding.EncodeToString(groupPK),
+		base64.RawURLEncoding.EncodeToString(messageID),
+	})
+}
+
+func (t *deliveryTracker) getRecord(key datastore.Key) (*deliveryRecord, error) {
+	data, err := t.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &deliveryRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return rec, nil
+}
+
+func (t *deliveryTracker) putRecord(key datastore.Key, rec *deliveryRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := t.store.Put(key, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func newMessageDelivery(groupPK, messageID []byte, rec *deliveryRecord) *MessageDelivery {
+	d := &MessageDelivery{
+		GroupPK:   groupPK,
+		MessageID: messageID,
+		Status:    DeliveryStatusSent,
+		SentAt:    time.Unix(0, rec.SentAt),
+		Devices:   make(map[string]time.Time),
+		Readers:   make(map[string]time.Time),
+	}
+
+	for device, at := range rec.Devices {
+		d.Devices[device] = time.Unix(0, at)
+	}
+
+	for device, at := range rec.Readers {
+		d.Readers[device] = time.Unix(0, at)
+	}
+
+	if rec.CarryExpiredAt != 0 {
+		d.CarryExpiredAt = time.Unix(0, rec.CarryExpiredAt)
+	}
+
+	switch {
+	case len(d.Readers) > 0:
+		d.Status = DeliveryStatusRead
+	case len(d.Devices) > 0:
+		d.Status = DeliveryStatusDelivered
+	case rec.CarryExpiredAt != 0:
+		d.Status = DeliveryStatusExpiredUndelivered
+	}
+
+	return d
+}
+
+func (t *deliveryTracker) emit(d *MessageDelivery) {
+	if t.emitter == nil {
+		return
+	}
+
+	if err := t.emitter.Emit(EvtMessageDeliveryChanged{Delivery: d}); err != nil {
+		t.logger.Warn("unable to emit delivery event", zap.Error(err))
+	}
+}
+
+// sent records a message sent by the device.
+func (t *deliveryTracker) sent(groupPK, messageID []byte, now time.Time) error {
+	t.muRecords.Lock()
+	defer t.muRecords.Unlock()
+
+	key := deliveryKey(groupPK, messageID)
+	if _, err := t.getRecord(key); err == nil {
+		return nil
+	}
+
+	rec := &deliveryRecord{SentAt: now.UnixNano()}
+	if err := t.putRecord(key, rec); err != nil {
+		return err
+	}
+
+	t.emit(newMessageDelivery(groupPK, messageID, rec))
+
+	return nil
+}
+
+// acked records the ack of a device, the acks of the messages not sent by
+// the device, e.g. by another device of the account, are ignored. A read
+// receipt acknowledges the delivery too.
+func (t *deliveryTracker) acked(kind ackKind, groupPK, messageID, devicePK []byte, now time.Time) (bool, error) {
+	t.muRecords.Lock()
+	defer t.muRecords.Unlock()
+
+	key := deliveryKey(groupPK, messageID)
+	rec, err := t.getRecord(key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	device := base64.StdEncoding.EncodeToString(devicePK)
+	changed := false
+
+	if len(rec.Devices) == 0 && t.delivered != nil {
+		t.delivered(now.Sub(time.Unix(0, rec.SentAt)))
+	}
+
+	if _, ok := rec.Devices[device]; !ok {
+		if rec.Devices == nil {
+			rec.Devices = make(map[string]int64)
+		}
+		rec.Devices[device] = now.UnixNano()
+		changed = true
+	}
+
+	if _, ok := rec.Readers[device]; !ok && kind == ackRead {
+		if rec.Readers == nil {
+			rec.Readers = make(map[string]int64)
+		}
+		rec.Readers[device] = now.UnixNano()
+		changed = true
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	if err := t.putRecord(key, rec); err != nil {
+		return false, err
+	}
+
+	t.emit(newMessageDelivery(groupPK, messageID, rec))
+
+	return true, nil
+}
+
+func deliveryCarriedBundleKey(bundleID []byte) datastore.Key {
+	return deliveryCarriedKey.ChildString(base64.RawURLEncoding.EncodeToString(bundleID))
+}
+
+// carried records a store-and-forward bundle carrying a message sent by the
+// device, the other messages are ignored.
+func (t *deliveryTracker) carried(groupPK, messageID, bundleID []byte) error {
+	t.muRecords.Lock()
+	defer t.muRecords.Unlock()
+
+	if _, err := t.getRecord(deliveryKey(groupPK, messageID)); err == datastore.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&carriedRecord{GroupPK: groupPK, MessageID: messageID})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := t.store.Put(deliveryCarriedBundleKey(bundleID), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// carryExpired records the expiry of a bundle carrying a message, the
+// message is reported expired undelivered unless a device acknowledged it or
+// a carrier delivered the bundle.
+func (t *deliveryTracker) carryExpired(bundleID []byte, delivered bool, now time.Time) error {
+	t.muRecords.Lock()
+	defer t.muRecords.Unlock()
+
+	key := deliveryCarriedBundleKey(bundleID)
+	data, err := t.store.Get(key)
+	if err == datastore.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := t.store.Delete(key); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	carried := &carriedRecord{}
+	if err := json.Unmarshal(data, carried); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if delivered {
+		return nil
+	}
+
+	recKey := deliveryKey(carried.GroupPK, carried.MessageID)
+	rec, err := t.getRecord(recKey)
+	if err == datastore.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(rec.Devices) > 0 || rec.CarryExpiredAt != 0 {
+		return nil
+	}
+
+	rec.CarryExpiredAt = now.UnixNano()
+	if err := t.putRecord(recKey, rec); err != nil {
+		return err
+	}
+
+	t.emit(newMessageDelivery(carried.GroupPK, carried.MessageID, rec))
+
+	return nil
+}
+
+func (t *deliveryTracker) get(groupPK, messageID []byte) (*MessageDelivery, error) {
+	t.muRecords.Lock()
+	defer t.muRecords.Unlock()
+
+	rec, err := t.getRecord(deliveryKey(groupPK, messageID))
+	if err == datastore.ErrNotFound {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown message"))
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return newMessageDelivery(groupPK, messageID, rec), nil
+}
+
+func (t *deliveryTracker) queue(ack *deliveryAck) {
+	t.muPending.Lock()
+	defer t.muPending.Unlock()
+
+	id := string(ack.GroupPK)
+	if len(t.pending[id]) >= maxPendingDeliveryAcks {
+		t.pending[id] = t.pending[id][1:]
+	}
+
+	t.pending[id] = append(t.pending[id], ack)
+}
+
+func (t *deliveryTracker) takePending(groupPK []byte) []*deliveryAck {
+	t.muPending.Lock()
+	defer t.muPending.Unlock()
+
+	acks := t.pending[string(groupPK)]
+	delete(t.pending, string(groupPK))
+
+	return acks
+}
+
+func (t *deliveryTracker) requeue(acks []*deliveryAck) {
+	for _, ack := range acks {
+		t.queue(ack)
+	}
+}
+
+func (s *service) isOwnDevice(g *bertytypes.Group, devicePK []byte) bool {
+	md, err := s.deviceKeystore.MemberDeviceForGroup(g)
+	if err != nil {
+		return false
+	}
+
+	own, err := md.device.GetPublic().Raw()
+
+	return err == nil && bytes.Equal(own, devicePK)
+}
+
+// acknowledgeMessage acks a message received from another device, the ack
+// is sent to the peers of the group once one of them is connected.
+func (s *service) acknowledgeMessage(g *bertytypes.Group, evt *bertytypes.GroupMessageEvent) {
+	if s.host == nil || g.GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil {
+		return
+	}
+
+	if s.isOwnDevice(g, evt.Headers.DevicePK) {
+		return
+	}
+
+	if gc, err := s.getContextGroupForID(g.PublicKey); err != nil || !gc.MetadataStore().isCurrentDevice(evt.Headers.DevicePK) {
+		return
+	}
+
+	if err := s.deliveries.received(g.PublicKey, evt.EventContext.ID); err != nil {
+		s.logger.Warn("unable to record unread message", zap.Error(err))
+	}
+
+	ack, err := s.signDeliveryAck(g, ackDelivered, evt.EventContext.ID)
+	if err != nil {
+		s.logger.Warn("unable to sign delivery ack", zap.Error(err))
+		return
+	}
+
+	s.deliveries.queue(ack)
+	s.flushDeliveryAcks(g.PublicKey)
+}
+
+func (s *service) signDeliveryAck(g *bertytypes.Group, kind ackKind, messageID []byte) (*deliveryAck, error) {
+	md, err := s.deviceKeystore.MemberDeviceForGroup(g)
+	if err != nil {
+		return nil, err
+	}
+
+	devicePK, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	ack := &deliveryAck{Kind: kind, GroupPK: g.PublicKey, MessageID: messageID, DevicePK: devicePK}
+	if ack.Sig, err = md.device.Sign(ack.signedBytes()); err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	return ack, nil
+}
+
+// flushDeliveryAcks sends the pending acks of a group to its connected peers,
+// they are kept until one of them accepts them.
+func (s *service) flushDeliveryAcks(groupPK []byte) {
+	if s.host == nil {
+		return
+	}
+
+	peers := []peer.ID{}
+	for _, p := range s.conversations.groupPeers(groupPK) {
+		if s.host.Network().Connectedness(p) == network.Connected {
+			peers = append(peers, p)
+		}
+	}
+
+	if len(peers) == 0 {
+		return
+	}
+
+	acks := s.deliveries.takePending(groupPK)
+	if len(acks) == 0 {
+		return
+	}
+
+	go func() {
+		sent := false
+		for _, p := range peers {
+			if err := s.sendDeliveryAcks(p, acks); err != nil {
+				s.logger.Debug("unable to send delivery acks", zap.Stringer("peer", p), zap.Error(err))
+				s.scores.RecordDelivery(p, false)
+				continue
+			}
+
+			s.scores.RecordDelivery(p, true)
+			sent = true
+		}
+
+		if !sent {
+			s.deliveries.requeue(acks)
+		}
+	}()
+}
+
+func (s *service) sendDeliveryAcks(p peer.ID, acks []*deliveryAck) error {
+	ctx, cancel := context.WithTimeout(s.ctx, deliveryAckTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(network.WithNoDial(ctx, "delivery ack"), p, deliveryAckProtocolID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(deliveryAckTimeout))
+
+	if err := json.NewEncoder(s.lanes.Stream(stream, ipfsutil.PriorityControl)).Encode(acks); err != nil {
+		_ = stream.Reset()
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) handleDeliveryAcks(stream network.Stream) {
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(deliveryAckTimeout))
+
+	acks := []*deliveryAck{}
+	if err := json.NewDecoder(io.LimitReader(stream, 1<<20)).Decode(&acks); err != nil || len(acks) > maxPendingDeliveryAcks {
+		_ = stream.Reset()
+		return
+	}
+
+	for _, ack := range acks {
+		if err := s.receiveDeliveryAck(ack); err != nil {
+			s.logger.Debug("invalid delivery ack", zap.Stringer("peer", stream.Conn().RemotePeer()), zap.Error(err))
+			if errcode.Is(err, errcode.ErrCryptoSignatureVerification) {
+				s.scores.RecordMisbehavior(stream.Conn().RemotePeer(), "forged delivery ack")
+			}
+		}
+	}
+}
+
+// receiveDeliveryAck only accepts the acks signed by a device of a member of
+// the group.
+func (s *service) receiveDeliveryAck(ack *deliveryAck) error {
+	gc, err := s.getContextGroupForID(ack.GroupPK)
+	if err != nil {
+		return err
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(ack.DevicePK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := gc.MetadataStore().GetMemberByDevice(pk); err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if !gc.MetadataStore().isCurrentDevice(ack.DevicePK) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("not a member of the group anymore"))
+	}
+
+	if ack.Kind != ackDelivered && ack.Kind != ackRead {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown ack kind %q", ack.Kind))
+	}
+
+	if ok, err := pk.Verify(ack.signedBytes(), ack.Sig); err != nil || !ok {
+		return errcode.ErrCryptoSignatureVerification
+	}
+
+	if _, err := s.deliveries.acked(ack.Kind, ack.GroupPK, ack.MessageID, ack.DevicePK, time.Now()); err != nil {
+		return err
+	}
+
+	// the message reached the group, it isn't retried anymore
+	return s.outbound.done(ack.GroupPK, ack.MessageID)
+}
+
+// MessageDeliveryStatus returns the delivery state of a message sent by the
+// device, by its ID, i.e. the ID of its event.
+func (s *service) MessageDeliveryStatus(_ context.Context, groupPK []byte, messageID []byte) (*MessageDelivery, error) {
+	return s.deliveries.get(groupPK, messageID)
+}
@@ -0,0 +1,168 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDeliveryTracker(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	tracker, err := newDeliveryTracker(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	groupPK, messageID := []byte("group"), []byte("message")
+	now := time.Now()
+
+	_, err = tracker.get(groupPK, messageID)
+	assert.Error(t, err)
+
+	require.NoError(t, tracker.sent(groupPK, messageID, now))
+
+	d, err := tracker.get(groupPK, messageID)
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusSent, d.Status)
+	assert.Empty(t, d.Devices)
+
+	changed, err := tracker.acked(ackDelivered, groupPK, messageID, []byte("device1"), now.Add(time.Second))
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	// the same device acks once
+	changed, err = tracker.acked(ackDelivered, groupPK, messageID, []byte("device1"), now.Add(2*time.Second))
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// the acks of the messages not sent by the device are ignored
+	changed, err = tracker.acked(ackDelivered, groupPK, []byte("other"), []byte("device1"), now)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	_, err = tracker.acked(ackDelivered, groupPK, messageID, []byte("device2"), now.Add(3*time.Second))
+	require.NoError(t, err)
+
+	reloaded, err := newDeliveryTracker(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	d, err = reloaded.get(groupPK, messageID)
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusDelivered, d.Status)
+	assert.Len(t, d.Devices, 2)
+	assert.Equal(t, now.UnixNano(), d.SentAt.UnixNano())
+}
+
+func TestDeliveryCarryExpired(t *testing.T) {
+	tracker, err := newDeliveryTracker(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	groupPK, now := []byte("group"), time.Now()
+	require.NoError(t, tracker.sent(groupPK, []byte("lost"), now))
+	require.NoError(t, tracker.sent(groupPK, []byte("carried"), now))
+	require.NoError(t, tracker.sent(groupPK, []byte("acked"), now))
+
+	require.NoError(t, tracker.carried(groupPK, []byte("lost"), []byte("bundle1")))
+	require.NoError(t, tracker.carried(groupPK, []byte("carried"), []byte("bundle2")))
+	require.NoError(t, tracker.carried(groupPK, []byte("acked"), []byte("bundle3")))
+
+	// the bundles of the messages not sent by the device aren't recorded
+	require.NoError(t, tracker.carried(groupPK, []byte("other"), []byte("bundle4")))
+
+	_, err = tracker.acked(ackDelivered, groupPK, []byte("acked"), []byte("device1"), now)
+	require.NoError(t, err)
+
+	require.NoError(t, tracker.carryExpired([]byte("bundle1"), false, now.Add(time.Hour)))
+	require.NoError(t, tracker.carryExpired([]byte("bundle2"), true, now.Add(time.Hour)))
+	require.NoError(t, tracker.carryExpired([]byte("bundle3"), false, now.Add(time.Hour)))
+	require.NoError(t, tracker.carryExpired([]byte("bundle4"), false, now.Add(time.Hour)))
+
+	d, err := tracker.get(groupPK, []byte("lost"))
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusExpiredUndelivered, d.Status)
+	assert.Equal(t, now.Add(time.Hour).UnixNano(), d.CarryExpiredAt.UnixNano())
+
+	d, err = tracker.get(groupPK, []byte("carried"))
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusSent, d.Status)
+	assert.True(t, d.CarryExpiredAt.IsZero())
+
+	d, err = tracker.get(groupPK, []byte("acked"))
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusDelivered, d.Status)
+
+	// a later ack still marks the message delivered
+	_, err = tracker.acked(ackDelivered, groupPK, []byte("lost"), []byte("device1"), now.Add(2*time.Hour))
+	require.NoError(t, err)
+
+	d, err = tracker.get(groupPK, []byte("lost"))
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusDelivered, d.Status)
+}
+
+func TestReadReceipts(t *testing.T) {
+	tracker, err := newDeliveryTracker(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	groupPK, messageID := []byte("group"), []byte("message")
+	require.NoError(t, tracker.sent(groupPK, messageID, time.Now()))
+
+	// a read receipt acknowledges the delivery too
+	changed, err := tracker.acked(ackRead, groupPK, messageID, []byte("device1"), time.Now())
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	d, err := tracker.get(groupPK, messageID)
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusRead, d.Status)
+	assert.Len(t, d.Devices, 1)
+	assert.Len(t, d.Readers, 1)
+
+	require.NoError(t, tracker.received(groupPK, []byte("unread1")))
+	require.NoError(t, tracker.received(groupPK, []byte("unread2")))
+	require.NoError(t, tracker.received([]byte("other"), []byte("unread3")))
+
+	unread, err := tracker.takeUnread(groupPK)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, [][]byte{[]byte("unread1"), []byte("unread2")}, unread)
+
+	unread, err = tracker.takeUnread(groupPK)
+	require.NoError(t, err)
+	assert.Empty(t, unread)
+
+	enabled, err := tracker.readReceiptsEnabled(groupPK)
+	require.NoError(t, err)
+	assert.True(t, enabled)
+
+	require.NoError(t, tracker.setReadReceipts(groupPK, false))
+	enabled, err = tracker.readReceiptsEnabled(groupPK)
+	require.NoError(t, err)
+	assert.False(t, enabled)
+
+	// the global setting overrides the conversations
+	require.NoError(t, tracker.setReadReceipts(groupPK, true))
+	require.NoError(t, tracker.setReadReceipts(nil, false))
+	enabled, err = tracker.readReceiptsEnabled(groupPK)
+	require.NoError(t, err)
+	assert.False(t, enabled)
+}
+
+func TestDeliveryTrackerPending(t *testing.T) {
+	tracker, err := newDeliveryTracker(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	for i := 0; i < maxPendingDeliveryAcks+1; i++ {
+		tracker.queue(&deliveryAck{GroupPK: []byte("group"), MessageID: []byte{byte(i)}})
+	}
+
+	acks := tracker.takePending([]byte("group"))
+	require.Len(t, acks, maxPendingDeliveryAcks)
+	assert.Equal(t, []byte{1}, acks[0].MessageID)
+	assert.Empty(t, tracker.takePending([]byte("group")))
+
+	tracker.requeue(acks[:1])
+	assert.Len(t, tracker.takePending([]byte("group")), 1)
+}
@@ -0,0 +1,429 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/devicelink"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const deviceLinkProtocolID = protocol.ID("/berty/device-link/1.0.0")
+
+const (
+	deviceLinkTimeout = time.Minute
+
+	// maxDeviceLinkSize bounds the bundle received, the snapshot lists the
+	// entries of the opened groups
+	maxDeviceLinkSize = 16 << 20
+)
+
+var (
+	deviceLinkKey   = datastore.NewKey("linked")
+	deviceIssuedKey = datastore.NewKey("issued")
+)
+
+// deviceLinkRequest is sent by the existing device to the new one: its
+// ephemeral key and the bundle sealed with the agreed key.
+type deviceLinkRequest struct {
+	PublicKey []byte `json:"public_key"`
+	Sealed    []byte `json:"sealed"`
+}
+
+type deviceLinkReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// DeviceLink is a device linked to the account.
+type DeviceLink struct {
+	Certificate      *devicelink.Certificate `json:"certificate"`
+	VerificationCode string                  `json:"verification_code"`
+	LinkedAt         time.Time               `json:"linked_at"`
+
+	// SignedCertificate is the certificate signed by the account, it is sent
+	// along the revocation of the device
+	SignedCertificate []byte `json:"signed_certificate,omitempty"`
+
+	// Snapshot is the state of the device which linked this one, only set
+	// on the new device
+	Snapshot *StateSnapshot `json:"snapshot,omitempty"`
+}
+
+type pendingDeviceLink struct {
+	offer *devicelink.Offer
+	priv  []byte
+}
+
+// deviceLinks keeps the offer of the device while it is shown, the link it
+// received and the certificates it issued.
+type deviceLinks struct {
+	logger *zap.Logger
+	store  datastore.Batching
+
+	lock    sync.Mutex
+	pending *pendingDeviceLink
+}
+
+func newDeviceLinks(logger *zap.Logger, store datastore.Batching) *deviceLinks {
+	return &deviceLinks{
+		logger: logger,
+		store:  store,
+	}
+}
+
+// take returns the pending offer, an offer is only answered once.
+func (dl *deviceLinks) take(now time.Time) *pendingDeviceLink {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	pending := dl.pending
+	dl.pending = nil
+
+	if pending == nil || now.Sub(time.Unix(pending.offer.Timestamp, 0)) > devicelink.MaxOfferAge {
+		return nil
+	}
+
+	return pending
+}
+
+func (dl *deviceLinks) put(key datastore.Key, link *DeviceLink) error {
+	data, err := json.Marshal(link)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := dl.store.Put(key, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (dl *deviceLinks) linked() (*DeviceLink, error) {
+	data, err := dl.store.Get(deviceLinkKey)
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	link := &DeviceLink{}
+	if err := json.Unmarshal(data, link); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return link, nil
+}
+
+func (dl *deviceLinks) issued() ([]*DeviceLink, error) {
+	res, err := dl.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	links := []*DeviceLink{}
+	for _, entry := range entries {
+		if datastore.RawKey(entry.Key).Parent() != deviceIssuedKey {
+			continue
+		}
+
+		link := &DeviceLink{}
+		if err := json.Unmarshal(entry.Value, link); err != nil {
+			dl.logger.Warn("invalid issued device certificate", zap.Error(err))
+			continue
+		}
+
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+// DeviceLinkOffer returns the offer the new device shows as a QR code, the
+// device linking it to an account scans it.
+func (s *service) DeviceLinkOffer(context.Context) (string, error) {
+	if s.host == nil {
+		return "", errcode.ErrNotImplemented
+	}
+
+	deviceSK, err := s.deviceKeystore.DevicePrivKey()
+	if err != nil {
+		return "", errcode.ErrInternal.Wrap(err)
+	}
+
+	devicePK, err := deviceSK.GetPublic().Raw()
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	addrs := []string{}
+	for _, addr := range s.host.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+
+	offer, priv, err := devicelink.NewOffer(s.host.ID(), addrs, devicePK, time.Now())
+	if err != nil {
+		return "", errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encoded, err := offer.Encode()
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	s.links.lock.Lock()
+	s.links.pending = &pendingDeviceLink{offer: offer, priv: priv}
+	s.links.lock.Unlock()
+
+	return encoded, nil
+}
+
+// DeviceLinkAccept links the device which shows an offer to the account: it
+// receives the account keys, a certificate signed by the account and the
+// state snapshot of this device.
+func (s *service) DeviceLinkAccept(ctx context.Context, encoded string) (*DeviceLink, error) {
+	if s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	offer, err := devicelink.DecodeOffer(encoded, time.Now())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if offer.PeerID == s.host.ID() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("can't link the device to itself"))
+	}
+
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	proofSK, err := s.deviceKeystore.AccountProofPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	deviceSK, err := s.deviceKeystore.DevicePrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	issuerPK, err := deviceSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	now := time.Now()
+	bundle := &devicelink.Bundle{}
+	bundle.Certificate, err = devicelink.SignCertificate(accountSK, &devicelink.Certificate{
+		DevicePK: offer.DevicePK,
+		PeerID:   offer.PeerID,
+		IssuerPK: issuerPK,
+	}, now)
+	if err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	if bundle.AccountSK, err = crypto.MarshalPrivateKey(accountSK); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if bundle.AccountProofSK, err = crypto.MarshalPrivateKey(proofSK); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	snapshot, err := s.StateSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if bundle.Snapshot, err = snapshot.Marshal(); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	answer, key, err := devicelink.Answer(offer)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	payload, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sealed, err := key.Seal(payload)
+	if err != nil {
+		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
+	}
+
+	if err := s.sendDeviceLink(ctx, offer, &deviceLinkRequest{PublicKey: answer, Sealed: sealed}); err != nil {
+		return nil, err
+	}
+
+	cert, err := devicelink.OpenCertificate(bundle.Certificate)
+	if err != nil {
+		return nil, errcode.ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	link := &DeviceLink{
+		Certificate:       cert,
+		VerificationCode:  key.VerificationCode(),
+		LinkedAt:          now,
+		SignedCertificate: bundle.Certificate,
+	}
+
+	if err := s.links.put(deviceIssuedKey.ChildString(base64.RawURLEncoding.EncodeToString(offer.DevicePK)), link); err != nil {
+		return nil, err
+	}
+
+	s.audit.add(&securityRecord{Type: SecurityDeviceLinked, DevicePK: offer.DevicePK, Details: "linked by this device"})
+
+	// the device syncs the stores of the account once it restarted
+	s.availability.addOwnPeer(offer.PeerID)
+
+	return link, nil
+}
+
+func (s *service) sendDeviceLink(ctx context.Context, offer *devicelink.Offer, req *deviceLinkRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, deviceLinkTimeout)
+	defer cancel()
+
+	s.host.Peerstore().AddAddrs(offer.PeerID, offer.Multiaddrs(), peerstore.TempAddrTTL)
+	if err := s.host.Connect(ctx, peer.AddrInfo{ID: offer.PeerID}); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	stream, err := s.host.NewStream(ctx, offer.PeerID, deviceLinkProtocolID)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(deviceLinkTimeout))
+
+	if err := json.NewEncoder(stream).Encode(req); err != nil {
+		_ = stream.Reset()
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	reply := &deviceLinkReply{}
+	if err := json.NewDecoder(io.LimitReader(stream, 4<<10)).Decode(reply); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if reply.Error != "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("device link refused: %s", reply.Error))
+	}
+
+	return nil
+}
+
+func (s *service) handleDeviceLink(stream network.Stream) {
+	defer stream.Close()
+
+	pending := s.links.take(time.Now())
+	if pending == nil || stream.Conn().RemotePeer() == s.host.ID() {
+		_ = stream.Reset()
+		return
+	}
+
+	_ = stream.SetDeadline(time.Now().Add(deviceLinkTimeout))
+
+	reply := &deviceLinkReply{}
+	if err := s.receiveDeviceLink(stream, pending); err != nil {
+		s.logger.Warn("unable to link device", zap.Stringer("peer", stream.Conn().RemotePeer()), zap.Error(err))
+		reply.Error = err.Error()
+	}
+
+	_ = json.NewEncoder(stream).Encode(reply)
+}
+
+func (s *service) receiveDeviceLink(stream network.Stream, pending *pendingDeviceLink) error {
+	req := &deviceLinkRequest{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxDeviceLinkSize)).Decode(req); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	key, err := devicelink.Agree(pending.offer, pending.priv, req.PublicKey)
+	if err != nil {
+		return errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	payload, err := key.Open(req.Sealed)
+	if err != nil {
+		return errcode.ErrCryptoDecrypt.Wrap(err)
+	}
+
+	bundle := &devicelink.Bundle{}
+	if err := json.Unmarshal(payload, bundle); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	cert, accountSK, proofSK, err := bundle.Check(pending.offer.DevicePK, s.host.ID())
+	if err != nil {
+		return errcode.ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	link := &DeviceLink{
+		Certificate:      cert,
+		VerificationCode: key.VerificationCode(),
+		LinkedAt:         time.Now(),
+	}
+
+	if len(bundle.Snapshot) > 0 {
+		if link.Snapshot, err = ParseStateSnapshot(bundle.Snapshot); err != nil {
+			return err
+		}
+	}
+
+	ks, ok := s.deviceKeystore.(*deviceKeystore)
+	if !ok {
+		return errcode.ErrNotImplemented
+	}
+
+	if err := ks.importAccountKeys(accountSK, proofSK); err != nil {
+		return err
+	}
+
+	if err := s.links.put(deviceLinkKey, link); err != nil {
+		return err
+	}
+
+	s.audit.add(&securityRecord{Type: SecurityDeviceLinked, DevicePK: cert.IssuerPK, Details: "linked to the account"})
+
+	s.availability.addOwnPeer(stream.Conn().RemotePeer())
+	s.logger.Info("device linked to account, restart to open it", zap.Stringer("issuer", stream.Conn().RemotePeer()))
+
+	return nil
+}
+
+// DeviceLinked returns the link the device received, or nil if it wasn't
+// linked to an account.
+func (s *service) DeviceLinked(context.Context) (*DeviceLink, error) {
+	return s.links.linked()
+}
+
+// DeviceLinksIssued returns the devices this device linked to the account.
+func (s *service) DeviceLinksIssued(context.Context) ([]*DeviceLink, error) {
+	return s.links.issued()
+}
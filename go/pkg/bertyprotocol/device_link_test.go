@@ -0,0 +1,48 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/devicelink"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDeviceLinks(t *testing.T) {
+	dl := newDeviceLinks(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()))
+	now := time.Now()
+
+	assert.Nil(t, dl.take(now))
+
+	// an offer is only answered once
+	offer, priv, err := devicelink.NewOffer("peer", nil, []byte("device"), now)
+	require.NoError(t, err)
+
+	dl.pending = &pendingDeviceLink{offer: offer, priv: priv}
+	assert.NotNil(t, dl.take(now))
+	assert.Nil(t, dl.take(now))
+
+	// nor after it expired
+	dl.pending = &pendingDeviceLink{offer: offer, priv: priv}
+	assert.Nil(t, dl.take(now.Add(devicelink.MaxOfferAge+time.Second)))
+
+	link, err := dl.linked()
+	require.NoError(t, err)
+	assert.Nil(t, link)
+
+	require.NoError(t, dl.put(deviceLinkKey, &DeviceLink{VerificationCode: "123456", LinkedAt: now}))
+	require.NoError(t, dl.put(deviceIssuedKey.ChildString("laptop"), &DeviceLink{VerificationCode: "654321", LinkedAt: now}))
+
+	link, err = dl.linked()
+	require.NoError(t, err)
+	assert.Equal(t, "123456", link.VerificationCode)
+
+	issued, err := dl.issued()
+	require.NoError(t, err)
+	require.Len(t, issued, 1)
+	assert.Equal(t, "654321", issued[0].VerificationCode)
+}
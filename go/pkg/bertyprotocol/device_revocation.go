@@ -0,0 +1,512 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/devicelink"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+// deviceRevocationPrefix marks the app metadata revoking a device, sent to
+// the account group and to the contact groups
+const deviceRevocationPrefix = "\x00berty.revoke/1\x00"
+
+// DeviceRevocation revokes a device of an account, it is signed by the
+// account key so the contacts can check it.
+type DeviceRevocation struct {
+	AccountPK []byte  `json:"account_pk"`
+	DevicePK  []byte  `json:"device_pk"`
+	PeerID    peer.ID `json:"peer_id,omitempty"`
+
+	// Certificate is the signed certificate of the device, it binds the peer
+	// to the device, the peer is ignored without it
+	Certificate []byte `json:"certificate,omitempty"`
+
+	// IssuerPK is the device key of the device which revoked it
+	IssuerPK  []byte `json:"issuer_pk"`
+	RevokedAt int64  `json:"revoked_at"`
+
+	// SignerPK is the identity key signing the revocation once the identity
+	// of the account was rotated, the account key if empty
+	SignerPK []byte `json:"signer_pk,omitempty"`
+}
+
+type signedDeviceRevocation struct {
+	Revocation []byte `json:"revocation"`
+	Signature  []byte `json:"signature"`
+}
+
+// signDeviceRevocation signs a revocation with the identity key of its
+// account, the account is the one of the key if r.AccountPK is empty.
+func signDeviceRevocation(identitySK crypto.PrivKey, r *DeviceRevocation, now time.Time) ([]byte, error) {
+	signerPK, err := identitySK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if len(r.AccountPK) == 0 {
+		r.AccountPK = signerPK
+	} else if !bytes.Equal(r.AccountPK, signerPK) {
+		r.SignerPK = signerPK
+	}
+
+	r.RevokedAt = now.UnixNano()
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sig, err := identitySK.Sign(data)
+	if err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	signed, err := json.Marshal(&signedDeviceRevocation{Revocation: data, Signature: sig})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return signed, nil
+}
+
+func openDeviceRevocation(data []byte) (*DeviceRevocation, error) {
+	signed := &signedDeviceRevocation{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	r := &DeviceRevocation{}
+	if err := json.Unmarshal(signed.Revocation, r); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	signerPK := r.AccountPK
+	if len(r.SignerPK) > 0 {
+		signerPK = r.SignerPK
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(signerPK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := pk.Verify(signed.Revocation, signed.Signature); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid device revocation signature"))
+	}
+
+	if len(r.DevicePK) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no device revoked"))
+	}
+
+	if r.PeerID != "" && !certifiesPeer(r) {
+		r.PeerID = ""
+	}
+
+	return r, nil
+}
+
+// certifiesPeer reports whether the certificate of a revocation, signed by
+// the account, binds its peer to the device revoked.
+func certifiesPeer(r *DeviceRevocation) bool {
+	cert, err := devicelink.OpenCertificate(r.Certificate)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(cert.AccountPK, r.AccountPK) && bytes.Equal(cert.DevicePK, r.DevicePK) && cert.PeerID == r.PeerID
+}
+
+func revocationKey(accountPK, devicePK []byte) string {
+	return string(accountPK) + "/" + string(devicePK)
+}
+
+// deviceRevocations keeps the revocations received, for the devices of the
+// account and of the contacts, by account. A revocation is permanent.
+type deviceRevocations struct {
+	logger *zap.Logger
+	store  datastore.Batching
+
+	lock    sync.RWMutex
+	devices map[string]*DeviceRevocation
+	peers   map[peer.ID]struct{}
+
+	// identities checks the identity keys signing the revocations, only the
+	// account keys are accepted without it
+	identities *identityChains
+}
+
+func newDeviceRevocations(logger *zap.Logger, store datastore.Batching) (*deviceRevocations, error) {
+	dr := &deviceRevocations{
+		logger:  logger,
+		store:   store,
+		devices: make(map[string]*DeviceRevocation),
+		peers:   make(map[peer.ID]struct{}),
+	}
+
+	res, err := store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		r, err := openDeviceRevocation(entry.Value)
+		if err != nil {
+			logger.Warn("invalid device revocation", zap.Error(err))
+			continue
+		}
+
+		dr.index(r)
+	}
+
+	return dr, nil
+}
+
+func (dr *deviceRevocations) index(r *DeviceRevocation) {
+	dr.devices[revocationKey(r.AccountPK, r.DevicePK)] = r
+	if r.PeerID != "" {
+		dr.peers[r.PeerID] = struct{}{}
+	}
+}
+
+// add keeps a signed revocation, it returns nil if the device was already
+// revoked. The device must have been checked to be one of the account.
+func (dr *deviceRevocations) add(signed []byte) (*DeviceRevocation, error) {
+	r, err := openDeviceRevocation(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.SignerPK) > 0 && !dr.identities.validSigner(r.AccountPK, r.SignerPK, time.Unix(0, r.RevokedAt)) {
+		return nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("device revocation not signed by an identity key of the account"))
+	}
+
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	if _, ok := dr.devices[revocationKey(r.AccountPK, r.DevicePK)]; ok {
+		return nil, nil
+	}
+
+	key := datastore.NewKey(base64.RawURLEncoding.EncodeToString(r.AccountPK)).ChildString(base64.RawURLEncoding.EncodeToString(r.DevicePK))
+	if err := dr.store.Put(key, signed); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	dr.index(r)
+
+	return r, nil
+}
+
+// isRevoked reports whether a device of an account was revoked by the
+// account.
+func (dr *deviceRevocations) isRevoked(accountPK, devicePK []byte) bool {
+	if dr == nil || accountPK == nil {
+		return false
+	}
+
+	dr.lock.RLock()
+	defer dr.lock.RUnlock()
+
+	_, ok := dr.devices[revocationKey(accountPK, devicePK)]
+	return ok
+}
+
+func (dr *deviceRevocations) get(accountPK, devicePK []byte) *DeviceRevocation {
+	dr.lock.RLock()
+	defer dr.lock.RUnlock()
+
+	return dr.devices[revocationKey(accountPK, devicePK)]
+}
+
+func (dr *deviceRevocations) isRevokedPeer(pid peer.ID) bool {
+	dr.lock.RLock()
+	defer dr.lock.RUnlock()
+
+	_, ok := dr.peers[pid]
+	return ok
+}
+
+// rejectPeers closes the connections of the revoked peers as soon as they
+// are opened.
+func (dr *deviceRevocations) rejectPeers(n network.Network) {
+	n.Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if dr.isRevokedPeer(c.RemotePeer()) {
+				_ = c.Close()
+			}
+		},
+	})
+}
+
+// AccountDevice is a device of the account.
+type AccountDevice struct {
+	DevicePK []byte `json:"device_pk"`
+	PeerID   string `json:"peer_id,omitempty"`
+	Self     bool   `json:"self"`
+
+	Revoked   bool      `json:"revoked"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// DeviceList lists the devices of the account, the revoked ones included.
+func (s *service) DeviceList(ctx context.Context) ([]*AccountDevice, error) {
+	ownSK, err := s.deviceKeystore.DevicePrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	ownPK, err := ownSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	// the peers are only known for the devices linked by this one
+	peers := map[string]peer.ID{}
+	if s.host != nil {
+		peers[string(ownPK)] = s.host.ID()
+	}
+
+	issued, err := s.links.issued()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, link := range issued {
+		peers[string(link.Certificate.DevicePK)] = link.Certificate.PeerID
+	}
+
+	devices := []*AccountDevice{}
+	for _, pk := range s.accountGroup.MetadataStore().ListDevices() {
+		raw, err := pk.Raw()
+		if err != nil {
+			continue
+		}
+
+		d := &AccountDevice{DevicePK: raw, Self: bytes.Equal(raw, ownPK)}
+		if pid, ok := peers[string(raw)]; ok {
+			d.PeerID = pid.Pretty()
+		}
+
+		if r := s.revocations.get(s.accountGroup.Group().PublicKey, raw); r != nil {
+			d.Revoked = true
+			d.RevokedAt = time.Unix(0, r.RevokedAt)
+		}
+
+		devices = append(devices, d)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return bytes.Compare(devices[i].DevicePK, devices[j].DevicePK) < 0 })
+
+	return devices, nil
+}
+
+// DeviceRevoke revokes a device of the account, e.g. a lost phone: the
+// revocation is sent to the other devices and to the contacts, which reject
+// the messages signed by the device and the connections of its peer from
+// then on. The messages it sent before are rejected too, as nothing tells
+// them apart from the ones a thief would send.
+//
+// In the multi-member groups the device signs with a key derived for the
+// group, only its peer is rejected there.
+func (s *service) DeviceRevoke(ctx context.Context, devicePK []byte) error {
+	devices, err := s.DeviceList(ctx)
+	if err != nil {
+		return err
+	}
+
+	target := (*AccountDevice)(nil)
+	for _, d := range devices {
+		if bytes.Equal(d.DevicePK, devicePK) {
+			target = d
+		}
+	}
+
+	if target == nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("not a device of the account"))
+	} else if target.Self {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("can't revoke the device itself"))
+	} else if target.Revoked {
+		return nil
+	}
+
+	identitySK, err := s.identityPrivKey()
+	if err != nil {
+		return err
+	}
+
+	deviceSK, err := s.deviceKeystore.DevicePrivKey()
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	issuerPK, err := deviceSK.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	r := &DeviceRevocation{AccountPK: s.accountGroup.Group().PublicKey, DevicePK: devicePK, IssuerPK: issuerPK}
+
+	// the peer is only known, and certified, for the devices linked by this
+	// one
+	issued, err := s.links.issued()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range issued {
+		if bytes.Equal(link.Certificate.DevicePK, devicePK) && len(link.SignedCertificate) > 0 {
+			r.PeerID, r.Certificate = link.Certificate.PeerID, link.SignedCertificate
+		}
+	}
+
+	signed, err := signDeviceRevocation(identitySK, r, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.revocations.add(signed); err != nil {
+		return err
+	}
+
+	s.deviceRevoked(r)
+
+	payload := append([]byte(deviceRevocationPrefix), signed...)
+	if _, err := s.accountGroup.MetadataStore().SendAppMetadata(ctx, payload); err != nil {
+		return err
+	}
+
+	s.sendToContacts(ctx, payload)
+
+	return nil
+}
+
+// deviceRevoked logs a revoked device and drops its connections.
+func (s *service) deviceRevoked(r *DeviceRevocation) {
+	s.audit.add(&securityRecord{Type: SecurityDeviceRevoked, ContactPK: r.AccountPK, DevicePK: r.DevicePK})
+
+	if r.PeerID == "" || s.host == nil {
+		return
+	}
+
+	s.availability.removeOwnPeer(r.PeerID)
+	_ = s.host.Network().ClosePeer(r.PeerID)
+}
+
+// applyDeviceRevocation keeps the revocations of the metadata of a group, the
+// account group revokes the devices of the account, a contact group the
+// devices of the contact.
+func (s *service) applyDeviceRevocation(gc *groupContext, evt *bertytypes.GroupMetadataEvent) {
+	if evt == nil || evt.Metadata == nil || evt.Metadata.EventType != bertytypes.EventTypeGroupMetadataPayloadSent {
+		return
+	}
+
+	am := &bertytypes.AppMetadata{}
+	if err := am.Unmarshal(evt.Event); err != nil || !bytes.HasPrefix(am.Message, []byte(deviceRevocationPrefix)) {
+		return
+	}
+
+	signed := am.Message[len(deviceRevocationPrefix):]
+	r, err := openDeviceRevocation(signed)
+	if err != nil {
+		s.logger.Debug("invalid device revocation", zap.Error(err))
+		return
+	}
+
+	ownPK := s.accountGroup.Group().PublicKey
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		if !bytes.Equal(r.AccountPK, ownPK) {
+			return
+		}
+	} else if bytes.Equal(r.AccountPK, ownPK) || !s.isGroupMember(gc, r.AccountPK) {
+		return
+	}
+
+	// an account can only revoke its own devices
+	if !s.isMemberDevice(gc, r.AccountPK, r.DevicePK) {
+		s.logger.Warn("device revocation for a device of another account")
+		return
+	}
+
+	r, err = s.revocations.add(signed)
+	if err != nil {
+		s.logger.Warn("unable to keep device revocation", zap.Error(err))
+		return
+	} else if r == nil {
+		return
+	}
+
+	if ownSK, err := s.deviceKeystore.DevicePrivKey(); err == nil {
+		if ownPK, err := ownSK.GetPublic().Raw(); err == nil && bytes.Equal(ownPK, r.DevicePK) {
+			s.logger.Warn("this device was revoked by another device of the account")
+		}
+	}
+
+	s.deviceRevoked(r)
+}
+
+func (s *service) isGroupMember(gc *groupContext, memberPK []byte) bool {
+	for _, pk := range gc.MetadataStore().ListMembers() {
+		if raw, err := pk.Raw(); err == nil && bytes.Equal(raw, memberPK) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isMemberDevice reports whether a device is a device of a member in the
+// metadata of a group.
+func (s *service) isMemberDevice(gc *groupContext, memberPK, devicePK []byte) bool {
+	pk, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+	if err != nil {
+		return false
+	}
+
+	member, err := gc.MetadataStore().GetMemberByDevice(pk)
+	if err != nil {
+		return false
+	}
+
+	raw, err := member.Raw()
+	return err == nil && bytes.Equal(raw, memberPK)
+}
+
+// watchDeviceRevocations applies the revocations of a group, the ones sent
+// while the device was offline are applied from the history first.
+func (s *service) watchDeviceRevocations(ctx context.Context, gc *groupContext) {
+	sub := gc.metadataStore.Subscribe(ctx)
+
+	for evt := range gc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		s.applyDeviceRevocation(gc, evt)
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			s.applyDeviceRevocation(gc, evt)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package bertyprotocol
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/devicelink"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDeviceRevocations(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	dr, err := newDeviceRevocations(zap.NewNop(), store)
+	require.NoError(t, err)
+
+	accountSK, accountPubKey, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	accountPK, err := accountPubKey.Raw()
+	require.NoError(t, err)
+
+	phone, pid := []byte("phone"), peer.ID("phone peer")
+	assert.False(t, dr.isRevoked(accountPK, phone))
+
+	cert, err := devicelink.SignCertificate(accountSK, &devicelink.Certificate{DevicePK: phone, PeerID: pid}, time.Now())
+	require.NoError(t, err)
+
+	signed, err := signDeviceRevocation(accountSK, &DeviceRevocation{DevicePK: phone, PeerID: pid, Certificate: cert}, time.Now())
+	require.NoError(t, err)
+
+	r, err := dr.add(signed)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.True(t, dr.isRevoked(accountPK, phone))
+	assert.True(t, dr.isRevokedPeer(pid))
+
+	// the revocation is only for the devices of the account
+	otherSK, otherPubKey, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	otherPK, err := otherPubKey.Raw()
+	require.NoError(t, err)
+	assert.False(t, dr.isRevoked(otherPK, phone))
+
+	// a peer which isn't certified for the device by the account is ignored
+	tablet, tabletPID := []byte("tablet"), peer.ID("tablet peer")
+	otherCert, err := devicelink.SignCertificate(otherSK, &devicelink.Certificate{DevicePK: tablet, PeerID: tabletPID}, time.Now())
+	require.NoError(t, err)
+
+	signed, err = signDeviceRevocation(accountSK, &DeviceRevocation{DevicePK: tablet, PeerID: tabletPID, Certificate: otherCert}, time.Now())
+	require.NoError(t, err)
+
+	r, err = dr.add(signed)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.True(t, dr.isRevoked(accountPK, tablet))
+	assert.False(t, dr.isRevokedPeer(tabletPID))
+
+	signed, err = signDeviceRevocation(accountSK, &DeviceRevocation{DevicePK: phone, PeerID: pid, Certificate: cert}, time.Now())
+	require.NoError(t, err)
+
+	// a revocation is only applied once
+	r, err = dr.add(signed)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	// a revocation which isn't signed by its account is rejected
+	sdr := &signedDeviceRevocation{}
+	require.NoError(t, json.Unmarshal(signed, sdr))
+	forged, err := signDeviceRevocation(accountSK, &DeviceRevocation{DevicePK: []byte("laptop")}, time.Now())
+	require.NoError(t, err)
+	fdr := &signedDeviceRevocation{}
+	require.NoError(t, json.Unmarshal(forged, fdr))
+	fdr.Signature = sdr.Signature
+	forged, err = json.Marshal(fdr)
+	require.NoError(t, err)
+
+	_, err = dr.add(forged)
+	assert.Error(t, err)
+	assert.False(t, dr.isRevoked(accountPK, []byte("laptop")))
+
+	// the revocations are kept
+	dr, err = newDeviceRevocations(zap.NewNop(), store)
+	require.NoError(t, err)
+	assert.True(t, dr.isRevoked(accountPK, phone))
+	assert.True(t, dr.isRevokedPeer(pid))
+	assert.False(t, dr.isRevokedPeer(tabletPID))
+
+	var none *deviceRevocations
+	assert.False(t, none.isRevoked(accountPK, phone))
+}
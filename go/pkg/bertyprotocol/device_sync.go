@@ -0,0 +1,365 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-ipfs-log/entry"
+	"berty.tech/go-orbit-db/stores"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const deviceSyncProtocolID = protocol.ID("/berty/device-sync/1.0.0")
+
+const (
+	deviceSyncTimeout = 2 * time.Minute
+
+	// deviceSyncInterval is the interval between two syncs with a connected
+	// device of the account, the stores replicate on their own meanwhile
+	deviceSyncInterval = 10 * time.Minute
+
+	// maxDeviceSyncHeads caps the heads of a store sent in a sync, the
+	// others are reached through the entries they point to
+	maxDeviceSyncHeads = 32
+)
+
+type deviceSyncStoreKind string
+
+const (
+	deviceSyncMetadata deviceSyncStoreKind = "metadata"
+	deviceSyncMessages deviceSyncStoreKind = "messages"
+)
+
+// deviceSyncHeads are the heads of a store of a group, sent to another
+// device of the account, as carried entries so the device can sync them
+// before fetching their parents.
+type deviceSyncHeads struct {
+	GroupPK []byte              `json:"group_pk"`
+	Store   deviceSyncStoreKind `json:"store"`
+	Entries [][]byte            `json:"entries"`
+}
+
+// DeviceSyncState is the state of the sync with another device of the
+// account.
+type DeviceSyncState struct {
+	PeerID     string    `json:"peer_id"`
+	LastSyncAt time.Time `json:"last_sync_at"`
+
+	// Sent and Received are the heads exchanged in the last sync, Synced the
+	// ones received which were missing
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+	Synced   int `json:"synced"`
+}
+
+// syncableStore is a store of a group synced from another device.
+type syncableStore interface {
+	OpLog() ipfslog.Log
+	Sync(ctx context.Context, heads []ipfslog.Entry) error
+}
+
+// deviceSync keeps the state of the syncs with the other devices of the
+// account.
+type deviceSync struct {
+	lock   sync.Mutex
+	states map[peer.ID]*DeviceSyncState
+}
+
+func newDeviceSync() *deviceSync {
+	return &deviceSync{states: make(map[peer.ID]*DeviceSyncState)}
+}
+
+func (ds *deviceSync) state(pid peer.ID) *DeviceSyncState {
+	state, ok := ds.states[pid]
+	if !ok {
+		state = &DeviceSyncState{PeerID: pid.Pretty()}
+		ds.states[pid] = state
+	}
+
+	return state
+}
+
+func (ds *deviceSync) sent(pid peer.ID, count int, now time.Time) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	state := ds.state(pid)
+	state.LastSyncAt = now
+	state.Sent = count
+}
+
+func (ds *deviceSync) received(pid peer.ID, count, synced int, now time.Time) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	state := ds.state(pid)
+	state.LastSyncAt = now
+	state.Received = count
+	state.Synced = synced
+}
+
+func (ds *deviceSync) list() []*DeviceSyncState {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	states := make([]*DeviceSyncState, 0, len(ds.states))
+	for _, state := range ds.states {
+		copied := *state
+		states = append(states, &copied)
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].PeerID < states[j].PeerID })
+
+	return states
+}
+
+// logHeads returns the entries of a log no other entry points to, the latest
+// first.
+func logHeads(log ipfslog.Log) []ipfslog.Entry {
+	entries := log.GetEntries().Slice()
+
+	parents := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		for _, next := range e.GetNext() {
+			parents[next.String()] = struct{}{}
+		}
+	}
+
+	heads := []ipfslog.Entry{}
+	for _, e := range entries {
+		if _, ok := parents[e.GetHash().String()]; !ok {
+			heads = append(heads, e)
+		}
+	}
+
+	sort.Slice(heads, func(i, j int) bool { return heads[i].GetClock().GetTime() > heads[j].GetClock().GetTime() })
+
+	if len(heads) > maxDeviceSyncHeads {
+		heads = heads[:maxDeviceSyncHeads]
+	}
+
+	return heads
+}
+
+// localHeads returns the heads of the stores of the opened groups, the
+// account group included.
+func (s *service) localHeads(ctx context.Context) []*deviceSyncHeads {
+	s.lock.RLock()
+	groups := make([]*groupContext, 0, len(s.openedGroups))
+	for _, gc := range s.openedGroups {
+		groups = append(groups, gc)
+	}
+	s.lock.RUnlock()
+
+	all := []*deviceSyncHeads{}
+	for _, gc := range groups {
+		for kind, store := range map[deviceSyncStoreKind]syncableStore{
+			deviceSyncMetadata: gc.MetadataStore(),
+			deviceSyncMessages: gc.MessageStore(),
+		} {
+			heads := &deviceSyncHeads{GroupPK: gc.Group().PublicKey, Store: kind}
+			for _, e := range logHeads(store.OpLog()) {
+				payload, err := s.carriedPayload(ctx, e)
+				if err != nil {
+					s.logger.Debug("unable to read store head", zap.Error(err))
+					continue
+				}
+
+				heads.Entries = append(heads.Entries, payload)
+			}
+
+			if len(heads.Entries) > 0 {
+				all = append(all, heads)
+			}
+		}
+	}
+
+	return all
+}
+
+// syncStoreEntry syncs a carried entry in a store, the store fetches its
+// missing parents, it returns false if the entry was already in the store.
+func (s *service) syncStoreEntry(ctx context.Context, store syncableStore, payload []byte) (bool, error) {
+	carried := &carriedEntry{}
+	if err := json.Unmarshal(payload, carried); err != nil {
+		return false, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	e := &entry.Entry{}
+	if err := json.Unmarshal(carried.Entry, e); err != nil {
+		return false, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if _, ok := store.OpLog().GetEntries().Get(e.GetHash().String()); ok {
+		return false, nil
+	}
+
+	stat, err := s.ipfsCoreAPI.Block().Put(ctx, bytes.NewReader(carried.Block), options.Block.Format("cbor"))
+	if err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if !stat.Path().Cid().Equals(e.GetHash()) {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("block doesn't match the entry"))
+	}
+
+	if err := store.Sync(ctx, []ipfslog.Entry{e}); err != nil {
+		return false, errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return true, nil
+}
+
+// syncDevice sends the heads of the stores to another device of the
+// account, the device syncs the ones it misses and fetches their history.
+func (s *service) syncDevice(ctx context.Context, pid peer.ID) error {
+	if s.host == nil || pid == s.host.ID() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deviceSyncTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(network.WithNoDial(ctx, "device sync"), pid, deviceSyncProtocolID)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(deviceSyncTimeout))
+
+	sent := 0
+	enc := json.NewEncoder(s.lanes.Stream(stream, ipfsutil.PriorityText))
+	for _, heads := range s.localHeads(ctx) {
+		if err := enc.Encode(heads); err != nil {
+			_ = stream.Reset()
+			return errcode.ErrInternal.Wrap(err)
+		}
+		sent += len(heads.Entries)
+	}
+
+	s.devices.sent(pid, sent, time.Now())
+
+	return nil
+}
+
+func (s *service) handleDeviceSync(stream network.Stream) {
+	defer stream.Close()
+
+	pid := stream.Conn().RemotePeer()
+	if !s.availability.isOwnPeer(pid) {
+		_ = stream.Reset()
+		return
+	}
+
+	_ = stream.SetDeadline(time.Now().Add(deviceSyncTimeout))
+
+	ctx, cancel := context.WithTimeout(s.ctx, deviceSyncTimeout)
+	defer cancel()
+
+	received, synced := 0, 0
+	dec := json.NewDecoder(stream)
+	for {
+		heads := &deviceSyncHeads{}
+		if err := dec.Decode(heads); err == io.EOF {
+			break
+		} else if err != nil {
+			s.logger.Debug("invalid device sync", zap.Stringer("peer", pid), zap.Error(err))
+			_ = stream.Reset()
+			break
+		}
+
+		// the groups not opened yet catch up once activated
+		gc, err := s.getContextGroupForID(heads.GroupPK)
+		if err != nil {
+			continue
+		}
+
+		var store syncableStore
+		switch heads.Store {
+		case deviceSyncMetadata:
+			store = gc.MetadataStore()
+		case deviceSyncMessages:
+			store = gc.MessageStore()
+		default:
+			continue
+		}
+
+		for _, payload := range heads.Entries {
+			received++
+
+			ok, err := s.syncStoreEntry(ctx, store, payload)
+			if err != nil {
+				s.logger.Debug("unable to sync device head", zap.Stringer("peer", pid), zap.Error(err))
+				continue
+			}
+
+			if ok {
+				synced++
+			}
+		}
+	}
+
+	s.devices.received(pid, received, synced, time.Now())
+
+	if synced > 0 {
+		s.logger.Info("caught up with device", zap.Stringer("peer", pid), zap.Int("heads", synced))
+	}
+}
+
+// watchOwnDevices syncs with the other devices of the account once they are
+// connected, then periodically.
+func (s *service) watchOwnDevices(ctx context.Context, acc *groupContext) {
+	if s.host == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(deviceSyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				for _, pid := range s.host.Network().Peers() {
+					if s.availability.isOwnPeer(pid) {
+						go s.syncOwnDevice(ctx, pid)
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for e := range acc.metadataStore.Subscribe(ctx) {
+		if evt, ok := e.(*stores.EventNewPeer); ok {
+			go s.syncOwnDevice(ctx, evt.Peer)
+		}
+	}
+}
+
+func (s *service) syncOwnDevice(ctx context.Context, pid peer.ID) {
+	if err := s.syncDevice(ctx, pid); err != nil {
+		s.logger.Debug("unable to sync with device", zap.Stringer("peer", pid), zap.Error(err))
+	}
+}
+
+// DeviceSyncStatus returns the state of the syncs with the other devices of
+// the account.
+func (s *service) DeviceSyncStatus(context.Context) ([]*DeviceSyncState, error) {
+	return s.devices.list(), nil
+}
@@ -0,0 +1,39 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceSyncStates(t *testing.T) {
+	ds := newDeviceSync()
+	assert.Empty(t, ds.list())
+
+	laptop, phone := peer.ID("laptop"), peer.ID("phone")
+	now := time.Now()
+
+	ds.sent(phone, 4, now)
+	ds.received(laptop, 6, 2, now)
+	ds.received(phone, 3, 0, now.Add(time.Minute))
+
+	states := ds.list()
+	require.Len(t, states, 2)
+
+	byPeer := map[string]*DeviceSyncState{}
+	for _, state := range states {
+		byPeer[state.PeerID] = state
+	}
+
+	assert.Equal(t, 4, byPeer[phone.Pretty()].Sent)
+	assert.Equal(t, 3, byPeer[phone.Pretty()].Received)
+	assert.True(t, byPeer[phone.Pretty()].LastSyncAt.Equal(now.Add(time.Minute)))
+	assert.Equal(t, 2, byPeer[laptop.Pretty()].Synced)
+
+	// the states listed are copies
+	states[0].Sent = 42
+	assert.NotEqual(t, 42, ds.list()[0].Sent)
+}
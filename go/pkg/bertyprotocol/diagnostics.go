@@ -0,0 +1,237 @@
+package bertyprotocol
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/observedaddr"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+// Diagnostics is a report of the network state of the node for the support
+// requests. It is sanitized: the IPs are replaced by their scope and it
+// doesn't reveal the groups, the contacts or the messages.
+type Diagnostics struct {
+	Date         time.Time              `json:"date"`
+	PeerID       string                 `json:"peer_id,omitempty"`
+	Connectivity string                 `json:"connectivity,omitempty"`
+	ListenAddrs  []string               `json:"listen_addrs"`
+	Transports   []DiagnosticsTransport `json:"transports"`
+	Peers        []DiagnosticsPeer      `json:"peers"`
+	NAT          DiagnosticsNAT         `json:"nat"`
+	Queues       DiagnosticsQueues      `json:"queues"`
+}
+
+// DiagnosticsTransport counts the listeners and the connections of a
+// transport.
+type DiagnosticsTransport struct {
+	Name      string `json:"name"`
+	Listeners int    `json:"listeners"`
+	Inbound   int    `json:"inbound"`
+	Outbound  int    `json:"outbound"`
+}
+
+// DiagnosticsPeer is a connected peer and the paths to it.
+type DiagnosticsPeer struct {
+	ID        string            `json:"id"`
+	Contact   bool              `json:"contact,omitempty"`
+	LatencyMS int64             `json:"latency_ms,omitempty"`
+	Paths     []DiagnosticsPath `json:"paths"`
+}
+
+// DiagnosticsPath is a connection to a peer.
+type DiagnosticsPath struct {
+	Transport string `json:"transport"`
+	Direction string `json:"direction"`
+	Addr      string `json:"addr"`
+	Relayed   bool   `json:"relayed,omitempty"`
+}
+
+// DiagnosticsNAT is the reachability of the node found by AutoNAT and its
+// external addrs confirmed by its peers.
+type DiagnosticsNAT struct {
+	Reachability  string   `json:"reachability"`
+	ExternalAddrs []string `json:"external_addrs,omitempty"`
+	Relayed       bool     `json:"relayed"`
+}
+
+// DiagnosticsQueues are the depths of the queues of the node.
+type DiagnosticsQueues struct {
+	Outbound       int        `json:"outbound"`
+	Quarantined    int        `json:"quarantined"`
+	OldestOutbound *time.Time `json:"oldest_outbound,omitempty"`
+	Carried        int        `json:"carried"`
+}
+
+// natStatus keeps the last reachability and external addrs of the node, the
+// events are only emitted when they change.
+type natStatus struct {
+	lock         sync.Mutex
+	reachability network.Reachability
+	external     []ma.Multiaddr
+}
+
+func (n *natStatus) get() (network.Reachability, []ma.Multiaddr) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.reachability, n.external
+}
+
+func (s *service) watchNATStatus(ctx context.Context) {
+	if s.host == nil {
+		return
+	}
+
+	sub, err := s.host.EventBus().Subscribe([]interface{}{
+		new(event.EvtLocalReachabilityChanged),
+		new(observedaddr.EvtExternalAddrsChanged),
+	})
+	if err != nil {
+		s.logger.Warn("unable to subscribe to the NAT status", zap.Error(err))
+		return
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case e, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+
+			s.nat.lock.Lock()
+			switch evt := e.(type) {
+			case event.EvtLocalReachabilityChanged:
+				s.nat.reachability = evt.Reachability
+			case observedaddr.EvtExternalAddrsChanged:
+				s.nat.external = evt.Current
+			}
+			s.nat.lock.Unlock()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Diagnostics returns a sanitized report of the network state of the node.
+func (s *service) Diagnostics(_ context.Context) (*Diagnostics, error) {
+	d := &Diagnostics{
+		Date:        time.Now(),
+		ListenAddrs: []string{},
+		Transports:  []DiagnosticsTransport{},
+		Peers:       []DiagnosticsPeer{},
+	}
+
+	if s.network != nil {
+		d.Connectivity = string(s.network.Connectivity())
+	}
+
+	if s.host != nil {
+		s.diagnoseNetwork(d)
+	}
+
+	queued, err := s.outbound.list(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range queued {
+		d.Queues.Outbound++
+		if m.Quarantined {
+			d.Queues.Quarantined++
+		}
+
+		if d.Queues.OldestOutbound == nil || m.QueuedAt.Before(*d.Queues.OldestOutbound) {
+			queuedAt := m.QueuedAt
+			d.Queues.OldestOutbound = &queuedAt
+		}
+	}
+
+	if s.storeForward != nil {
+		d.Queues.Carried = s.storeForward.Stats().Bundles
+	}
+
+	return d, nil
+}
+
+func (s *service) diagnoseNetwork(d *Diagnostics) {
+	d.PeerID = s.host.ID().Pretty()
+
+	transports := map[string]*DiagnosticsTransport{}
+	transport := func(addr ma.Multiaddr) *DiagnosticsTransport {
+		name := ipfsutil.TransportName(addr)
+		if _, ok := transports[name]; !ok {
+			transports[name] = &DiagnosticsTransport{Name: name}
+		}
+
+		return transports[name]
+	}
+
+	for _, addr := range s.host.Network().ListenAddresses() {
+		d.ListenAddrs = append(d.ListenAddrs, ipfsutil.RedactIPs(addr.String()))
+		transport(addr).Listeners++
+	}
+
+	for _, addr := range s.host.Addrs() {
+		if isRelayedAddr(addr) {
+			d.NAT.Relayed = true
+		}
+	}
+
+	reachability, external := s.nat.get()
+	d.NAT.Reachability = strings.ToLower(reachability.String())
+	for _, addr := range external {
+		d.NAT.ExternalAddrs = append(d.NAT.ExternalAddrs, ipfsutil.RedactIPs(addr.String()))
+	}
+
+	for _, pid := range s.host.Network().Peers() {
+		p := DiagnosticsPeer{
+			ID:        pid.Pretty(),
+			Contact:   s.contactPeers.has(pid),
+			LatencyMS: s.host.Peerstore().LatencyEWMA(pid).Milliseconds(),
+			Paths:     []DiagnosticsPath{},
+		}
+
+		for _, c := range s.host.Network().ConnsToPeer(pid) {
+			path := DiagnosticsPath{
+				Transport: ipfsutil.TransportName(c.RemoteMultiaddr()),
+				Direction: "inbound",
+				Addr:      ipfsutil.RedactIPs(c.RemoteMultiaddr().String()),
+				Relayed:   isRelayedAddr(c.RemoteMultiaddr()),
+			}
+
+			if c.Stat().Direction == network.DirOutbound {
+				path.Direction = "outbound"
+				transport(c.RemoteMultiaddr()).Outbound++
+			} else {
+				transport(c.RemoteMultiaddr()).Inbound++
+			}
+
+			p.Paths = append(p.Paths, path)
+		}
+
+		d.Peers = append(d.Peers, p)
+	}
+
+	sort.Slice(d.Peers, func(i, j int) bool { return d.Peers[i].ID < d.Peers[j].ID })
+
+	for _, t := range transports {
+		d.Transports = append(d.Transports, *t)
+	}
+
+	sort.Slice(d.Transports, func(i, j int) bool { return d.Transports[i].Name < d.Transports[j].Name })
+}
+
+func isRelayedAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
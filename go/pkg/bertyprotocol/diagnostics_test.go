@@ -0,0 +1,76 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDiagnostics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	require.NoError(t, err)
+	remote, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	outbound, err := newOutboundQueue(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+	require.NoError(t, outbound.add([]byte("group"), []byte("message"), 42, time.Now()))
+
+	s := &service{
+		logger:   zap.NewNop(),
+		host:     h,
+		nat:      &natStatus{},
+		outbound: outbound,
+		contactPeers: &contactPeers{
+			logger: zap.NewNop(),
+			store:  datastore.NewMapDatastore(),
+		},
+	}
+	s.contactPeers.add(remote.ID())
+
+	_, err = mn.ConnectPeers(h.ID(), remote.ID())
+	require.NoError(t, err)
+
+	d, err := s.Diagnostics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, h.ID().Pretty(), d.PeerID)
+	assert.Equal(t, 1, d.Queues.Outbound)
+	assert.NotNil(t, d.Queues.OldestOutbound)
+
+	require.Len(t, d.Peers, 1)
+	assert.Equal(t, remote.ID().Pretty(), d.Peers[0].ID)
+	assert.True(t, d.Peers[0].Contact)
+	require.Len(t, d.Peers[0].Paths, 1)
+	assert.Equal(t, "TCP", d.Peers[0].Paths[0].Transport)
+	assert.Equal(t, "outbound", d.Peers[0].Paths[0].Direction)
+
+	require.Len(t, d.Transports, 1)
+	assert.Equal(t, DiagnosticsTransport{Name: "TCP", Listeners: 1, Outbound: 1}, d.Transports[0])
+
+	// the report doesn't reveal the IPs
+	out, err := json.Marshal(d)
+	require.NoError(t, err)
+	for _, addr := range append(h.Addrs(), remote.Addrs()...) {
+		for _, code := range []int{ma.P_IP4, ma.P_IP6} {
+			if ip, err := addr.ValueForProtocol(code); err == nil {
+				assert.NotContains(t, string(out), ip)
+			}
+		}
+	}
+	assert.Equal(t, []string{ipfsutil.RedactIPs(h.Addrs()[0].String())}, d.ListenAddrs)
+}
@@ -0,0 +1,265 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bertymetrics "berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
+)
+
+// envelopeCompressionPayloadType is the type of the app metadata payloads
+// announcing the codecs a device decompresses.
+const envelopeCompressionPayloadType = "berty.envelope.compression"
+
+// EnvelopeCodecSnappy is the only codec for now, the announces list the
+// codecs so others can be negotiated later.
+const EnvelopeCodecSnappy = "snappy"
+
+const (
+	// DefaultEnvelopeCompressionThreshold is the size under which the
+	// payloads are sent as is, the small ones barely shrink.
+	DefaultEnvelopeCompressionThreshold = 256
+
+	// maxEnvelopeDecodedSize bounds a decompressed payload, so a forged
+	// one can't exhaust the memory of the device
+	maxEnvelopeDecodedSize = 16 << 20
+)
+
+// snappyPayloadPrefix prefixes the message payloads compressed with snappy,
+// the other payloads are left as is.
+var snappyPayloadPrefix = []byte("\x00berty.snappy/1\x00")
+
+type envelopeCompressionAnnounce struct {
+	Type     string   `json:"type"`
+	DevicePK []byte   `json:"device_pk"`
+	Codecs   []string `json:"codecs"`
+	At       int64    `json:"at"`
+}
+
+func (a *envelopeCompressionAnnounce) hasCodec(codec string) bool {
+	for _, c := range a.Codecs {
+		if c == codec {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EnvelopeCompressionStats counts the payloads compressed by the device since
+// the node started, and the bytes they saved.
+type EnvelopeCompressionStats struct {
+	Compressed int64 `json:"compressed"`
+
+	// Skipped is the number of payloads over the threshold sent as is, as
+	// they didn't shrink or a device of their group can't decompress them
+	Skipped    int64 `json:"skipped"`
+	BytesSaved int64 `json:"bytes_saved"`
+}
+
+// envelopeCompression compresses the message payloads over a threshold, in
+// the groups whose other devices all announced they decompress them. The
+// payloads are compressed before being sealed, the envelopes stay opaque to
+// the peers replicating them.
+type envelopeCompression struct {
+	threshold int
+	metrics   *bertymetrics.Registry
+
+	lock  sync.Mutex
+	stats EnvelopeCompressionStats
+}
+
+func newEnvelopeCompression(threshold int, metrics *bertymetrics.Registry) *envelopeCompression {
+	if threshold <= 0 {
+		threshold = DefaultEnvelopeCompressionThreshold
+	}
+
+	return &envelopeCompression{
+		threshold: threshold,
+		metrics:   metrics,
+	}
+}
+
+// compress returns the payload compressed if it is worth it, the group must
+// support the compression.
+func (c *envelopeCompression) compress(payload []byte, supported bool) []byte {
+	if len(payload) < c.threshold {
+		return payload
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !supported {
+		c.stats.Skipped++
+		return payload
+	}
+
+	compressed := append(append([]byte{}, snappyPayloadPrefix...), snappy.Encode(nil, payload)...)
+	if len(compressed) >= len(payload) {
+		c.stats.Skipped++
+		return payload
+	}
+
+	c.stats.Compressed++
+	c.stats.BytesSaved += int64(len(payload) - len(compressed))
+	c.metrics.RecordCompression(EnvelopeCodecSnappy, len(payload)-len(compressed))
+
+	return compressed
+}
+
+func (c *envelopeCompression) getStats() *EnvelopeCompressionStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	return &stats
+}
+
+func isCompressedPayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, snappyPayloadPrefix)
+}
+
+// decompressPayload returns the payload of a compressed one.
+func decompressPayload(payload []byte) ([]byte, error) {
+	data := payload[len(snappyPayloadPrefix):]
+
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if size > maxEnvelopeDecodedSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("compressed payload of %d bytes, max %d", size, maxEnvelopeDecodedSize))
+	}
+
+	decoded, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return decoded, nil
+}
+
+// compressPayload compresses the payload of a message if the compression is
+// enabled and every other device of the group decompresses it. The account
+// groups are left out, their devices don't announce their codecs.
+func (s *service) compressPayload(gc *groupContext, payload []byte) []byte {
+	if s.compression == nil || gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return payload
+	}
+
+	return s.compression.compress(payload, gc.MetadataStore().supportsCodec(gc.DevicePubKey(), EnvelopeCodecSnappy))
+}
+
+// EnvelopeCompressionStats returns the number of payloads compressed and the
+// bytes saved.
+func (s *service) EnvelopeCompressionStats(context.Context) (*EnvelopeCompressionStats, error) {
+	if s.compression == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.compression.getStats(), nil
+}
+
+// announceEnvelopeCompression announces the codecs of the device in a group
+// unless already known by the group.
+func (s *service) announceEnvelopeCompression(g *bertytypes.Group) {
+	gc, err := s.getContextGroupForID(g.PublicKey)
+	if err != nil {
+		return
+	}
+
+	devicePK, err := gc.DevicePubKey().Raw()
+	if err != nil {
+		return
+	}
+
+	if known := gc.MetadataStore().Index().(*metadataStoreIndex).envelopeCodecs(devicePK); known != nil && known.hasCodec(EnvelopeCodecSnappy) {
+		return
+	}
+
+	payload, err := json.Marshal(&envelopeCompressionAnnounce{
+		Type:     envelopeCompressionPayloadType,
+		DevicePK: devicePK,
+		Codecs:   []string{EnvelopeCodecSnappy},
+		At:       time.Now().UnixNano(),
+	})
+	if err != nil {
+		return
+	}
+
+	if _, err := gc.MetadataStore().SendAppMetadata(s.ctx, payload); err != nil {
+		s.logger.Warn("unable to announce envelope compression", zap.Error(err))
+	}
+}
+
+func (m *metadataStoreIndex) handleEnvelopeCompression(event proto.Message) error {
+	e, ok := event.(*bertytypes.AppMetadata)
+	if !ok {
+		return errcode.ErrInvalidInput
+	}
+
+	announce := &envelopeCompressionAnnounce{}
+	if err := json.Unmarshal(e.Message, announce); err != nil || announce.Type != envelopeCompressionPayloadType {
+		// not a compression announce
+		return nil
+	}
+
+	// the app metadata are signed by the device
+	if !bytes.Equal(announce.DevicePK, e.DevicePK) {
+		return errcode.ErrInvalidInput
+	}
+
+	if known, ok := m.compressionCodecs[string(announce.DevicePK)]; ok && known.At > announce.At {
+		return nil
+	}
+
+	m.compressionCodecs[string(announce.DevicePK)] = announce
+
+	return nil
+}
+
+func (m *metadataStoreIndex) envelopeCodecs(devicePK []byte) *envelopeCompressionAnnounce {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.compressionCodecs[string(devicePK)]
+}
+
+// supportsCodec returns whether the other devices of the group all announced
+// the codec, a group without another device doesn't as the devices joining
+// it may not.
+func (m *metadataStore) supportsCodec(ownDevice crypto.PubKey, codec string) bool {
+	index := m.Index().(*metadataStoreIndex)
+	others := 0
+
+	for _, device := range m.ListDevices() {
+		if device.Equals(ownDevice) {
+			continue
+		}
+
+		raw, err := device.Raw()
+		if err != nil {
+			return false
+		}
+
+		if announce := index.envelopeCodecs(raw); announce == nil || !announce.hasCodec(codec) {
+			return false
+		}
+
+		others++
+	}
+
+	return others > 0
+}
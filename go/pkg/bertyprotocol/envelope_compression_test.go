@@ -0,0 +1,49 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeCompression(t *testing.T) {
+	c := newEnvelopeCompression(0, nil)
+	text := bytes.Repeat([]byte("a long text message, "), 100)
+
+	// the small payloads and the groups not supporting it are left as is
+	assert.Equal(t, []byte("hello"), c.compress([]byte("hello"), true))
+	assert.Equal(t, text, c.compress(text, false))
+
+	compressed := c.compress(text, true)
+	require.True(t, isCompressedPayload(compressed))
+	assert.Less(t, len(compressed), len(text))
+
+	decompressed, err := decompressPayload(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, text, decompressed)
+
+	// the payloads which don't shrink are sent as is
+	random := make([]byte, 1024)
+	_, err = crand.Read(random)
+	require.NoError(t, err)
+	assert.Equal(t, random, c.compress(random, true))
+
+	stats := c.getStats()
+	assert.Equal(t, int64(1), stats.Compressed)
+	assert.Equal(t, int64(2), stats.Skipped)
+	assert.Equal(t, int64(len(text)-len(compressed)), stats.BytesSaved)
+}
+
+func TestEnvelopeCompressionInvalid(t *testing.T) {
+	_, err := decompressPayload(append(append([]byte{}, snappyPayloadPrefix...), 0xff, 0xff))
+	assert.Error(t, err)
+
+	// the announced size of a payload is checked before it is decompressed
+	bomb := snappy.Encode(nil, make([]byte, maxEnvelopeDecodedSize+1))
+	_, err = decompressPayload(append(append([]byte{}, snappyPayloadPrefix...), bomb...))
+	assert.Error(t, err)
+}
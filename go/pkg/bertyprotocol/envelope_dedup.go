@@ -0,0 +1,190 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+)
+
+const (
+	// envelopeDedupWindow is how long the ID of an envelope received is
+	// kept, the copies arriving later by another path are dropped
+	envelopeDedupWindow = 24 * time.Hour
+
+	envelopeDedupGCInterval = time.Hour
+)
+
+// EnvelopeSource is the path an envelope of a group arrived by.
+type EnvelopeSource string
+
+const (
+	// EnvelopeSourcePubSub envelopes are published on the topic of the group
+	// or sent directly by a member
+	EnvelopeSourcePubSub EnvelopeSource = "pubsub"
+
+	// EnvelopeSourceStoreForward envelopes are carried by another peer
+	EnvelopeSourceStoreForward EnvelopeSource = "storeforward"
+)
+
+// EnvelopeDedupStats counts the duplicate envelopes dropped since the node
+// started.
+type EnvelopeDedupStats struct {
+	// Tracked is the number of IDs in the window
+	Tracked int `json:"tracked"`
+
+	Suppressed int64                    `json:"suppressed"`
+	BySource   map[EnvelopeSource]int64 `json:"by_source"`
+}
+
+// envelopeDedup keeps the IDs of the envelopes received over the window, so
+// an envelope arriving over several transports is only synced once. The IDs
+// are persisted, an index is kept in memory.
+type envelopeDedup struct {
+	logger *zap.Logger
+	store  datastore.Batching
+
+	lock       sync.Mutex
+	seen       map[string]time.Time
+	suppressed map[EnvelopeSource]int64
+}
+
+func newEnvelopeDedup(logger *zap.Logger, store datastore.Batching) (*envelopeDedup, error) {
+	d := &envelopeDedup{
+		logger:     logger,
+		store:      store,
+		seen:       make(map[string]time.Time),
+		suppressed: make(map[EnvelopeSource]int64),
+	}
+
+	res, err := store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		if len(entry.Value) != 8 {
+			continue
+		}
+
+		id, err := base64.RawURLEncoding.DecodeString(datastore.RawKey(entry.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		d.seen[string(id)] = time.Unix(0, int64(binary.BigEndian.Uint64(entry.Value)))
+	}
+
+	return d, nil
+}
+
+func envelopeDedupKey(id []byte) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(id))
+}
+
+// duplicate reports whether an envelope was received within the window.
+func (d *envelopeDedup) duplicate(id []byte, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	at, ok := d.seen[string(id)]
+
+	return ok && now.Sub(at) < envelopeDedupWindow
+}
+
+// suppress counts a duplicate dropped.
+func (d *envelopeDedup) suppress(source EnvelopeSource) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.suppressed[source]++
+}
+
+// record adds the ID of an envelope to the window, it must only be called
+// once the envelope is verified, a forged ID would drop the genuine one.
+func (d *envelopeDedup) record(id []byte, now time.Time) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.seen[string(id)]; ok {
+		return nil
+	}
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(now.UnixNano()))
+
+	if err := d.store.Put(envelopeDedupKey(id), value); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	d.seen[string(id)] = now
+
+	return nil
+}
+
+// gc drops the IDs out of the window.
+func (d *envelopeDedup) gc(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for id, at := range d.seen {
+		if now.Sub(at) < envelopeDedupWindow {
+			continue
+		}
+
+		if err := d.store.Delete(envelopeDedupKey([]byte(id))); err != nil && err != datastore.ErrNotFound {
+			d.logger.Warn("unable to delete envelope ID", zap.Error(err))
+			continue
+		}
+
+		delete(d.seen, id)
+	}
+}
+
+func (d *envelopeDedup) gcLoop(ctx context.Context) {
+	ticker := time.NewTicker(envelopeDedupGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			d.gc(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *envelopeDedup) stats() *EnvelopeDedupStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	stats := &EnvelopeDedupStats{
+		Tracked:  len(d.seen),
+		BySource: make(map[EnvelopeSource]int64, len(d.suppressed)),
+	}
+
+	for source, count := range d.suppressed {
+		stats.Suppressed += count
+		stats.BySource[source] = count
+	}
+
+	return stats
+}
+
+// EnvelopeDedupStats returns the number of duplicate envelopes dropped, by
+// the path they arrived by.
+func (s *service) EnvelopeDedupStats(context.Context) (*EnvelopeDedupStats, error) {
+	return s.dedup.stats(), nil
+}
@@ -0,0 +1,47 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestEnvelopeDedup(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	d, err := newEnvelopeDedup(zap.NewNop(), store)
+	require.NoError(t, err)
+
+	now := time.Now()
+	id := []byte("envelope")
+
+	assert.False(t, d.duplicate(id, now))
+	require.NoError(t, d.record(id, now))
+	assert.True(t, d.duplicate(id, now.Add(time.Minute)))
+
+	d.suppress(EnvelopeSourcePubSub)
+	d.suppress(EnvelopeSourcePubSub)
+	d.suppress(EnvelopeSourceStoreForward)
+
+	stats := d.stats()
+	assert.Equal(t, 1, stats.Tracked)
+	assert.Equal(t, int64(3), stats.Suppressed)
+	assert.Equal(t, int64(2), stats.BySource[EnvelopeSourcePubSub])
+
+	// the window is kept across restarts, the IDs out of it are dropped
+	d, err = newEnvelopeDedup(zap.NewNop(), store)
+	require.NoError(t, err)
+	assert.True(t, d.duplicate(id, now.Add(time.Minute)))
+	assert.False(t, d.duplicate(id, now.Add(envelopeDedupWindow)))
+
+	d.gc(now.Add(envelopeDedupWindow))
+	assert.Zero(t, d.stats().Tracked)
+
+	d, err = newEnvelopeDedup(zap.NewNop(), store)
+	require.NoError(t, err)
+	assert.Zero(t, d.stats().Tracked)
+}
@@ -0,0 +1,306 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
+)
+
+// envelopePartPrefix marks a part of an envelope split to fit the frames of
+// the transports and the relays
+const envelopePartPrefix = "\x00berty.part/1\x00"
+
+const (
+	// maxEnvelopePartSize is the size above which an envelope is split, small
+	// enough for the BLE frames and the relays
+	maxEnvelopePartSize = 64 << 10
+
+	// maxEnvelopeParts caps the size of an envelope reassembled
+	maxEnvelopeParts = 256
+
+	// envelopePartialTimeout is how long the parts of an envelope are kept
+	// waiting for the missing ones, the carried parts can arrive days apart
+	envelopePartialTimeout = 72 * time.Hour
+
+	envelopePartsGCInterval = time.Hour
+)
+
+// envelopePart is a part of an envelope, its ID is the hash of the whole
+// envelope so the reassembly is checked.
+type envelopePart struct {
+	ID    []byte `json:"id"`
+	Index int    `json:"index"`
+	Count int    `json:"count"`
+	Data  []byte `json:"data"`
+}
+
+// splitEnvelope splits an envelope in parts of size bytes at most, an
+// envelope which fits is returned as is.
+func splitEnvelope(payload []byte, size int) ([][]byte, error) {
+	if len(payload) <= size {
+		return [][]byte{payload}, nil
+	}
+
+	count := (len(payload) + size - 1) / size
+	if count > maxEnvelopeParts {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("envelope of %d bytes, max %d", len(payload), maxEnvelopeParts*size))
+	}
+
+	id := sha256.Sum256(payload)
+	parts := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		data, err := json.Marshal(&envelopePart{ID: id[:], Index: i, Count: count, Data: payload[i*size : end]})
+		if err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+
+		parts = append(parts, append([]byte(envelopePartPrefix), data...))
+	}
+
+	return parts, nil
+}
+
+// openEnvelopePart returns the part in an envelope, or nil if the envelope
+// isn't split.
+func openEnvelopePart(data []byte) (*envelopePart, error) {
+	if !bytes.HasPrefix(data, []byte(envelopePartPrefix)) {
+		return nil, nil
+	}
+
+	p := &envelopePart{}
+	if err := json.Unmarshal(data[len(envelopePartPrefix):], p); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if len(p.ID) != sha256.Size || p.Count < 2 || p.Count > maxEnvelopeParts || p.Index < 0 || p.Index >= p.Count || len(p.Data) > maxEnvelopePartSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid envelope part"))
+	}
+
+	return p, nil
+}
+
+type partialEnvelope struct {
+	FirstSeen int64 `json:"first_seen"`
+	Count     int   `json:"count"`
+	Received  int   `json:"received"`
+}
+
+// envelopeReassembler persists the parts of the envelopes received until the
+// last one arrives, the partial envelopes are dropped after a timeout.
+type envelopeReassembler struct {
+	logger *zap.Logger
+	store  datastore.Batching
+
+	lock sync.Mutex
+}
+
+func newEnvelopeReassembler(logger *zap.Logger, store datastore.Batching) *envelopeReassembler {
+	return &envelopeReassembler{
+		logger: logger,
+		store:  store,
+	}
+}
+
+func partialKey(groupPK, id []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		base64.RawURLEncoding.EncodeToString(groupPK),
+		base64.RawURLEncoding.EncodeToString(id),
+	})
+}
+
+func (r *envelopeReassembler) getPartialLocked(key datastore.Key) (*partialEnvelope, error) {
+	data, err := r.store.Get(key.ChildString("meta"))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	partial := &partialEnvelope{}
+	if err := json.Unmarshal(data, partial); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return partial, nil
+}
+
+func (r *envelopeReassembler) putPartialLocked(key datastore.Key, partial *partialEnvelope) error {
+	data, err := json.Marshal(partial)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := r.store.Put(key.ChildString("meta"), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (r *envelopeReassembler) deleteLocked(key datastore.Key, count int) {
+	for i := 0; i < count; i++ {
+		if err := r.store.Delete(key.ChildString(strconv.Itoa(i))); err != nil && err != datastore.ErrNotFound {
+			r.logger.Warn("unable to delete envelope part", zap.Error(err))
+		}
+	}
+
+	if err := r.store.Delete(key.ChildString("meta")); err != nil && err != datastore.ErrNotFound {
+		r.logger.Warn("unable to delete partial envelope", zap.Error(err))
+	}
+}
+
+// add keeps a part of an envelope of a group, it returns the whole envelope
+// once all its parts are received, nil otherwise.
+func (r *envelopeReassembler) add(groupPK []byte, p *envelopePart, now time.Time) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := partialKey(groupPK, p.ID)
+
+	partial, err := r.getPartialLocked(key)
+	if err != nil {
+		return nil, err
+	} else if partial == nil {
+		partial = &partialEnvelope{FirstSeen: now.UnixNano(), Count: p.Count}
+	} else if partial.Count != p.Count {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("envelope part count mismatch"))
+	}
+
+	partKey := key.ChildString(strconv.Itoa(p.Index))
+	if has, err := r.store.Has(partKey); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	} else if has {
+		// received over another path
+		return nil, nil
+	}
+
+	if err := r.store.Put(partKey, p.Data); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	partial.Received++
+	if partial.Received < partial.Count {
+		return nil, r.putPartialLocked(key, partial)
+	}
+
+	payload := []byte{}
+	for i := 0; i < partial.Count; i++ {
+		data, err := r.store.Get(key.ChildString(strconv.Itoa(i)))
+		if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		payload = append(payload, data...)
+	}
+
+	r.deleteLocked(key, partial.Count)
+
+	if sum := sha256.Sum256(payload); !bytes.Equal(sum[:], p.ID) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("envelope parts don't match their envelope"))
+	}
+
+	return payload, nil
+}
+
+// gc drops the partial envelopes received before the timeout.
+func (r *envelopeReassembler) gc(now time.Time) {
+	res, err := r.store.Query(query.Query{})
+	if err != nil {
+		r.logger.Warn("unable to list partial envelopes", zap.Error(err))
+		return
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		r.logger.Warn("unable to list partial envelopes", zap.Error(err))
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	dropped := 0
+	for _, entry := range entries {
+		key := datastore.RawKey(entry.Key)
+		if key.BaseNamespace() != "meta" {
+			continue
+		}
+
+		partial := &partialEnvelope{}
+		if err := json.Unmarshal(entry.Value, partial); err != nil {
+			continue
+		}
+
+		if now.Sub(time.Unix(0, partial.FirstSeen)) < envelopePartialTimeout {
+			continue
+		}
+
+		r.deleteLocked(key.Parent(), partial.Count)
+		dropped++
+	}
+
+	if dropped > 0 {
+		r.logger.Debug("partial envelopes dropped", zap.Int("count", dropped))
+	}
+}
+
+func (r *envelopeReassembler) gcLoop(ctx context.Context) {
+	ticker := time.NewTicker(envelopePartsGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.gc(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receiveEnvelope syncs an envelope of a group, or keeps it until the other
+// parts are received if it is a part of a split one. A sealed envelope is
+// opened first.
+func (s *service) receiveEnvelope(ctx context.Context, gc *groupContext, data []byte, source EnvelopeSource) (bool, error) {
+	ctx, span := s.tracer.Start(ctx, "Receive Message", trace.WithAttributes(kv.String("source", string(source))))
+	defer span.End()
+
+	data, err := s.openFromGroup(gc, data)
+	if err != nil {
+		return false, err
+	}
+
+	p, err := openEnvelopePart(data)
+	if err != nil {
+		return false, err
+	} else if p == nil {
+		return s.syncCarriedEntry(ctx, gc, data, source)
+	}
+
+	payload, err := s.parts.add(gc.Group().PublicKey, p, time.Now())
+	if err != nil {
+		return false, err
+	} else if payload == nil {
+		return true, nil
+	}
+
+	return s.syncCarriedEntry(ctx, gc, payload, source)
+}
@@ -0,0 +1,94 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSplitEnvelope(t *testing.T) {
+	parts, err := splitEnvelope([]byte("small"), 16)
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+
+	p, err := openEnvelopePart(parts[0])
+	require.NoError(t, err)
+	assert.Nil(t, p)
+
+	parts, err = splitEnvelope(bytes.Repeat([]byte{1}, 40), 16)
+	require.NoError(t, err)
+	require.Len(t, parts, 3)
+
+	p, err = openEnvelopePart(parts[2])
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.Index)
+	assert.Equal(t, 3, p.Count)
+	assert.Len(t, p.Data, 8)
+
+	_, err = splitEnvelope(make([]byte, 16*maxEnvelopeParts+1), 16)
+	assert.Error(t, err)
+}
+
+func TestEnvelopeReassembler(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	r := newEnvelopeReassembler(zap.NewNop(), store)
+
+	groupPK := []byte("group")
+	now := time.Now()
+
+	envelope := []byte("an envelope too large for a single frame")
+	parts, err := splitEnvelope(envelope, 8)
+	require.NoError(t, err)
+
+	add := func(data []byte) []byte {
+		p, err := openEnvelopePart(data)
+		require.NoError(t, err)
+
+		payload, err := r.add(groupPK, p, now)
+		require.NoError(t, err)
+		return payload
+	}
+
+	// the parts can arrive in any order, and more than once
+	for i := len(parts) - 1; i > 0; i-- {
+		assert.Nil(t, add(parts[i]))
+	}
+	assert.Nil(t, add(parts[1]))
+	assert.Equal(t, envelope, add(parts[0]))
+
+	res, err := store.Query(query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// a part which doesn't match its envelope drops it
+	forged, err := openEnvelopePart(parts[0])
+	require.NoError(t, err)
+	forged.Data = []byte("forged!!")
+
+	for _, data := range parts[1:] {
+		assert.Nil(t, add(data))
+	}
+	_, err = r.add(groupPK, forged, now)
+	assert.Error(t, err)
+
+	// the partial envelopes are dropped after the timeout
+	assert.Nil(t, add(parts[0]))
+	r.gc(now.Add(envelopePartialTimeout - time.Minute))
+	assert.Nil(t, add(parts[1]))
+
+	r.gc(now.Add(envelopePartialTimeout))
+	res, err = store.Query(query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,666 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+const (
+	ttlPayloadPrefix       = "\x00berty.ttl/1\x00"
+	ephemeralPayloadPrefix = "\x00berty.ephemeral/1\x00"
+
+	// maxMessageTTL is the longest lifetime of the disappearing messages
+	maxMessageTTL = 4 * 7 * 24 * time.Hour
+
+	// TTLChangedPayloadType is the type of the JSON payload replacing the
+	// changes of the disappearing message setting in the message lists and
+	// subscriptions.
+	TTLChangedPayloadType = "MessageTTLChanged"
+
+	// ExpiredPayloadType is the type of the JSON payload sent to the message
+	// subscriptions once a disappearing message is deleted.
+	ExpiredPayloadType = "MessageExpired"
+)
+
+var (
+	ephemeralSettingKey = datastore.NewKey("settings")
+	ephemeralExpiryKey  = datastore.NewKey("expiries")
+	ephemeralExpiredKey = datastore.NewKey("expired")
+)
+
+// MessageTTL is the disappearing message setting of a group, the messages
+// sent while it is set are deleted by all the devices once their lifetime
+// is over. A zero TTL disables it.
+type MessageTTL struct {
+	GroupPK   []byte
+	DevicePK  []byte
+	TTL       time.Duration
+	ChangedAt time.Time
+}
+
+// EvtMessageTTLChanged is emitted on the event bus of the host once the
+// disappearing message setting of a group is changed.
+type EvtMessageTTLChanged struct {
+	Setting *MessageTTL
+}
+
+// EvtMessageExpired is emitted on the event bus of the host and to the
+// message subscriptions of the group once a disappearing message is
+// deleted.
+type EvtMessageExpired struct {
+	GroupPK   []byte
+	MessageID []byte
+	ExpiredAt time.Time
+}
+
+// ttlPayload is the payload sent to the clients in place of a change of the
+// setting.
+type ttlPayload struct {
+	Type      string `json:"type"`
+	TTL       int64  `json:"ttl"`
+	ChangedAt int64  `json:"changedAt"`
+}
+
+// expiredPayload is the payload sent to the clients once a message expired.
+type expiredPayload struct {
+	Type      string `json:"type"`
+	MessageID []byte `json:"messageId"`
+	ExpiredAt int64  `json:"expiredAt"`
+}
+
+// ttlOp is sent as a message of the group, any member can change the
+// setting, the latest change wins.
+type ttlOp struct {
+	GroupPK  []byte `json:"group_pk"`
+	DevicePK []byte `json:"device_pk"`
+	TTL      int64  `json:"ttl"`
+	At       int64  `json:"at"`
+	Sig      []byte `json:"sig"`
+}
+
+func (o *ttlOp) signedBytes() []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(o.TTL))
+	binary.BigEndian.PutUint64(buf[8:], uint64(o.At))
+
+	return bytes.Join([][]byte{[]byte("berty ttl"), o.GroupPK, buf}, nil)
+}
+
+func isTTLPayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(ttlPayloadPrefix))
+}
+
+func unmarshalTTL(payload []byte) (*ttlOp, error) {
+	if !isTTLPayload(payload) {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	o := &ttlOp{}
+	if err := json.Unmarshal(payload[len(ttlPayloadPrefix):], o); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if o.TTL < 0 || time.Duration(o.TTL) > maxMessageTTL {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid message TTL"))
+	}
+
+	return o, nil
+}
+
+// sealEphemeral prefixes a payload with its lifetime, it is encrypted with
+// the payload.
+func sealEphemeral(ttl time.Duration, payload []byte) []byte {
+	buf := make([]byte, len(ephemeralPayloadPrefix)+8, len(ephemeralPayloadPrefix)+8+len(payload))
+	copy(buf, ephemeralPayloadPrefix)
+	binary.BigEndian.PutUint64(buf[len(ephemeralPayloadPrefix):], uint64(ttl))
+
+	return append(buf, payload...)
+}
+
+// openEphemeral returns the lifetime and the payload of a disappearing
+// message, or a zero TTL for another message.
+func openEphemeral(payload []byte) (time.Duration, []byte, error) {
+	if !bytes.HasPrefix(payload, []byte(ephemeralPayloadPrefix)) {
+		return 0, payload, nil
+	}
+
+	payload = payload[len(ephemeralPayloadPrefix):]
+	if len(payload) < 8 {
+		return 0, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid ephemeral payload"))
+	}
+
+	ttl := time.Duration(binary.BigEndian.Uint64(payload))
+	if ttl <= 0 || ttl > maxMessageTTL {
+		return 0, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid message TTL"))
+	}
+
+	return ttl, payload[8:], nil
+}
+
+type ttlRecord struct {
+	DevicePK []byte `json:"device_pk"`
+	TTL      int64  `json:"ttl"`
+	At       int64  `json:"at"`
+}
+
+type expiryRecord struct {
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// ephemeralMessages persists the disappearing message settings and the
+// deletion schedule of the messages, the deletions of a group are only run
+// while it is active.
+type ephemeralMessages struct {
+	logger         *zap.Logger
+	store          datastore.Batching
+	changedEmitter event.Emitter
+	expiredEmitter event.Emitter
+
+	// expire deletes a message once its lifetime is over, it is set by the
+	// service
+	expire func(groupPK, messageID []byte)
+
+	lock   sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newEphemeralMessages(logger *zap.Logger, store datastore.Batching, h host.Host) (*ephemeralMessages, error) {
+	em := &ephemeralMessages{
+		logger: logger,
+		store:  store,
+		timers: make(map[string]*time.Timer),
+	}
+
+	if h != nil {
+		var err error
+		if em.changedEmitter, err = h.EventBus().Emitter(new(EvtMessageTTLChanged)); err != nil {
+			return nil, err
+		}
+
+		if em.expiredEmitter, err = h.EventBus().Emitter(new(EvtMessageExpired)); err != nil {
+			return nil, err
+		}
+	}
+
+	return em, nil
+}
+
+func (em *ephemeralMessages) load(key datastore.Key, v interface{}) (bool, error) {
+	data, err := em.store.Get(key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return true, nil
+}
+
+func (em *ephemeralMessages) save(key datastore.Key, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := em.store.Put(key, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func ephemeralSettingKeyFor(groupPK []byte) datastore.Key {
+	return ephemeralSettingKey.ChildString(base64.RawURLEncoding.EncodeToString(groupPK))
+}
+
+// setting returns the disappearing message setting of a group, or nil if it
+// was never set.
+func (em *ephemeralMessages) setting(groupPK []byte) (*MessageTTL, error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	return em.settingLocked(groupPK)
+}
+
+func (em *ephemeralMessages) settingLocked(groupPK []byte) (*MessageTTL, error) {
+	rec := &ttlRecord{}
+	if ok, err := em.load(ephemeralSettingKeyFor(groupPK), rec); err != nil || !ok {
+		return nil, err
+	}
+
+	return &MessageTTL{
+		GroupPK:   groupPK,
+		DevicePK:  rec.DevicePK,
+		TTL:       time.Duration(rec.TTL),
+		ChangedAt: time.Unix(0, rec.At),
+	}, nil
+}
+
+// change applies a change of the setting if it is the latest one, it
+// reports whether it was applied.
+func (em *ephemeralMessages) change(setting *MessageTTL) (bool, error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	current, err := em.settingLocked(setting.GroupPK)
+	if err != nil {
+		return false, err
+	}
+
+	if current != nil {
+		if setting.ChangedAt.Before(current.ChangedAt) {
+			return false, nil
+		}
+
+		if setting.ChangedAt.Equal(current.ChangedAt) && bytes.Compare(setting.DevicePK, current.DevicePK) <= 0 {
+			return false, nil
+		}
+	}
+
+	rec := &ttlRecord{DevicePK: setting.DevicePK, TTL: int64(setting.TTL), At: setting.ChangedAt.UnixNano()}
+	if err := em.save(ephemeralSettingKeyFor(setting.GroupPK), rec); err != nil {
+		return false, err
+	}
+
+	if em.changedEmitter != nil {
+		if err := em.changedEmitter.Emit(EvtMessageTTLChanged{Setting: setting}); err != nil {
+			em.logger.Warn("unable to emit message TTL changed event", zap.Error(err))
+		}
+	}
+
+	return true, nil
+}
+
+// schedule records the deletion of a message the first time it is seen, it
+// returns when the message expires.
+func (em *ephemeralMessages) schedule(groupPK, messageID []byte, expiresAt time.Time) (time.Time, error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	if ok, err := em.store.Has(retractionKey(ephemeralExpiredKey, groupPK, messageID)); err != nil {
+		return time.Time{}, errcode.ErrInternal.Wrap(err)
+	} else if ok {
+		return time.Time{}, nil
+	}
+
+	rec := &expiryRecord{}
+	if ok, err := em.load(retractionKey(ephemeralExpiryKey, groupPK, messageID), rec); err != nil {
+		return time.Time{}, err
+	} else if ok {
+		return time.Unix(0, rec.ExpiresAt), nil
+	}
+
+	rec.ExpiresAt = expiresAt.UnixNano()
+	if err := em.save(retractionKey(ephemeralExpiryKey, groupPK, messageID), rec); err != nil {
+		return time.Time{}, err
+	}
+
+	em.armLocked(groupPK, messageID, expiresAt)
+
+	return expiresAt, nil
+}
+
+// expiry returns when a message expires, or a zero time if it is not a
+// disappearing message or was already deleted.
+func (em *ephemeralMessages) expiry(groupPK, messageID []byte) (time.Time, error) {
+	rec := &expiryRecord{}
+	if ok, err := em.load(retractionKey(ephemeralExpiryKey, groupPK, messageID), rec); err != nil || !ok {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, rec.ExpiresAt), nil
+}
+
+func (em *ephemeralMessages) isExpired(groupPK, messageID []byte) bool {
+	ok, err := em.store.Has(retractionKey(ephemeralExpiredKey, groupPK, messageID))
+	return err == nil && ok
+}
+
+func (em *ephemeralMessages) armLocked(groupPK, messageID []byte, expiresAt time.Time) {
+	key := string(groupPK) + string(messageID)
+	if _, ok := em.timers[key]; ok || em.expire == nil {
+		return
+	}
+
+	em.timers[key] = time.AfterFunc(time.Until(expiresAt), func() {
+		em.lock.Lock()
+		delete(em.timers, key)
+		em.lock.Unlock()
+
+		em.expire(groupPK, messageID)
+	})
+}
+
+// arm schedules the deletions recorded for a group, it is called once the
+// group is active.
+func (em *ephemeralMessages) arm(groupPK []byte) {
+	prefix := ephemeralExpiryKey.ChildString(base64.RawURLEncoding.EncodeToString(groupPK))
+	res, err := em.store.Query(query.Query{Prefix: prefix.String()})
+	if err != nil {
+		em.logger.Error("unable to list message expiries", zap.Error(err))
+		return
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		em.logger.Error("unable to list message expiries", zap.Error(err))
+		return
+	}
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	for _, entry := range entries {
+		messageID, err := base64.RawURLEncoding.DecodeString(datastore.RawKey(entry.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		rec := &expiryRecord{}
+		if err := json.Unmarshal(entry.Value, rec); err != nil {
+			continue
+		}
+
+		em.armLocked(groupPK, messageID, time.Unix(0, rec.ExpiresAt))
+	}
+}
+
+// expired replaces the deletion of a message by a marker, so the message
+// isn't scheduled again if it is seen again.
+func (em *ephemeralMessages) expired(groupPK, messageID []byte, now time.Time) error {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	if err := em.store.Put(retractionKey(ephemeralExpiredKey, groupPK, messageID), []byte{}); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := em.store.Delete(retractionKey(ephemeralExpiryKey, groupPK, messageID)); err != nil && err != datastore.ErrNotFound {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if em.expiredEmitter != nil {
+		if err := em.expiredEmitter.Emit(EvtMessageExpired{GroupPK: groupPK, MessageID: messageID, ExpiredAt: now}); err != nil {
+			em.logger.Warn("unable to emit message expired event", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// MessageTTLSet changes the disappearing message setting of a group for all
+// its members, the messages sent afterwards are deleted by all the devices
+// once the TTL is over. A zero TTL disables it.
+func (s *service) MessageTTLSet(ctx context.Context, groupPK []byte, ttl time.Duration) error {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return errcode.ErrInvalidInput
+	}
+
+	if ttl < 0 || ttl > maxMessageTTL {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("message TTL must be between 0 and %s", maxMessageTTL))
+	}
+
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	devicePK, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	op := &ttlOp{GroupPK: groupPK, DevicePK: devicePK, TTL: int64(ttl), At: time.Now().UnixNano()}
+	if op.Sig, err = md.device.Sign(op.signedBytes()); err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	data, err := json.Marshal(op)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	// the messages sent from now on use the new setting
+	if _, err := s.ephemeral.change(&MessageTTL{GroupPK: groupPK, DevicePK: devicePK, TTL: ttl, ChangedAt: time.Unix(0, op.At)}); err != nil {
+		return err
+	}
+
+	return s.sendControlMessage(ctx, gc, append([]byte(ttlPayloadPrefix), data...))
+}
+
+// MessageTTL returns the disappearing message setting of a group, or nil if
+// it was never set.
+func (s *service) MessageTTL(_ context.Context, groupPK []byte) (*MessageTTL, error) {
+	return s.ephemeral.setting(groupPK)
+}
+
+// MessageExpiry returns when a disappearing message will be deleted by the
+// device, or a zero time for another message.
+func (s *service) MessageExpiry(_ context.Context, groupPK []byte, messageID []byte) (time.Time, error) {
+	return s.ephemeral.expiry(groupPK, messageID)
+}
+
+// sealOutgoingEphemeral prefixes a message with the TTL of its group, if
+// the disappearing messages are enabled.
+func (s *service) sealOutgoingEphemeral(groupPK []byte, payload []byte) ([]byte, time.Duration, error) {
+	setting, err := s.ephemeral.setting(groupPK)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if setting == nil || setting.TTL <= 0 {
+		return payload, 0, nil
+	}
+
+	return sealEphemeral(setting.TTL, payload), setting.TTL, nil
+}
+
+// applyTTL applies a change of the setting received in a group, it must be
+// signed by the device which sent it.
+func (s *service) applyTTL(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*MessageTTL, error) {
+	op, err := unmarshalTTL(evt.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(op.GroupPK, gc.Group().PublicKey) || !bytes.Equal(op.DevicePK, evt.Headers.DevicePK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("message TTL not sent by its signer"))
+	}
+
+	pk, _, err := deviceMember(gc, evt.Headers.DevicePK)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := pk.Verify(op.signedBytes(), op.Sig); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification
+	}
+
+	setting := &MessageTTL{GroupPK: op.GroupPK, DevicePK: op.DevicePK, TTL: time.Duration(op.TTL), ChangedAt: time.Unix(0, op.At)}
+	if _, err := s.ephemeral.change(setting); err != nil {
+		return nil, err
+	}
+
+	return setting, nil
+}
+
+// trackTTL is called for each message of a group, it reports whether the
+// message is a change of the setting.
+func (s *service) trackTTL(gc *groupContext, evt *bertytypes.GroupMessageEvent) bool {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil || !isTTLPayload(evt.Message) {
+		return false
+	}
+
+	if _, err := s.applyTTL(gc, evt); err != nil {
+		s.logger.Debug("invalid message TTL", zap.Error(err))
+	}
+
+	return true
+}
+
+// trackEphemeral schedules the deletion of a disappearing message the first
+// time it is seen, its lifetime starts then on each device. It returns the
+// message without its TTL and when it expires.
+func (s *service) trackEphemeral(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*bertytypes.GroupMessageEvent, time.Time) {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.EventContext == nil {
+		return evt, time.Time{}
+	}
+
+	ttl, payload, err := openEphemeral(evt.Message)
+	if err != nil {
+		s.logger.Debug("invalid ephemeral message", zap.Error(err))
+		return evt, time.Time{}
+	} else if ttl == 0 {
+		return evt, time.Time{}
+	}
+
+	expiresAt, err := s.ephemeral.schedule(gc.Group().PublicKey, evt.EventContext.ID, time.Now().Add(ttl))
+	if err != nil {
+		s.logger.Warn("unable to schedule message deletion", zap.Error(err))
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	opened := *evt
+	opened.Message = payload
+
+	return &opened, expiresAt
+}
+
+// renderEphemeral removes the TTL of a message for the clients, it reports
+// whether the message must be sent, the expired ones and the invalid changes
+// of the setting are not.
+func (s *service) renderEphemeral(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*bertytypes.GroupMessageEvent, bool) {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil {
+		return evt, true
+	}
+
+	if isTTLPayload(evt.Message) {
+		setting, err := s.applyTTL(gc, evt)
+		if err != nil {
+			return evt, false
+		}
+
+		payload, err := json.Marshal(&ttlPayload{
+			Type:      TTLChangedPayloadType,
+			TTL:       int64(setting.TTL / time.Millisecond),
+			ChangedAt: setting.ChangedAt.UnixNano() / int64(time.Millisecond),
+		})
+		if err != nil {
+			return evt, false
+		}
+
+		rendered := *evt
+		rendered.Message = payload
+
+		return &rendered, true
+	}
+
+	rendered, expiresAt := s.trackEphemeral(gc, evt)
+	if rendered != evt && (expiresAt.IsZero() || !time.Now().Before(expiresAt)) {
+		return evt, false
+	}
+
+	return rendered, true
+}
+
+// renderExpired prepares the event sent to the message subscriptions once a
+// message expired.
+func renderExpired(evt *EvtMessageExpired) (*bertytypes.GroupMessageEvent, error) {
+	payload, err := json.Marshal(&expiredPayload{
+		Type:      ExpiredPayloadType,
+		MessageID: evt.MessageID,
+		ExpiredAt: evt.ExpiredAt.UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return &bertytypes.GroupMessageEvent{
+		EventContext: &bertytypes.EventContext{ID: evt.MessageID, GroupPK: evt.GroupPK},
+		Message:      payload,
+	}, nil
+}
+
+// expireMessage deletes the keys of a disappearing message and the content
+// of its edits, so it can't be opened anymore. It is retried once the group
+// is active again if it isn't now.
+func (s *service) expireMessage(groupPK, messageID []byte) {
+	logger := s.logger.With(zap.String("message", fmt.Sprintf("%.12x", messageID)))
+
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		logger.Debug("group not active, message deletion postponed")
+		return
+	}
+
+	ids := [][]byte{messageID}
+
+	editIDs, err := s.edits.forget(groupPK, messageID)
+	if err != nil {
+		logger.Warn("unable to delete message edits", zap.Error(err))
+	}
+	ids = append(ids, editIDs...)
+
+	if err := s.reactions.forget(groupPK, messageID); err != nil {
+		logger.Warn("unable to delete message reactions", zap.Error(err))
+	}
+
+	if err := s.outbound.done(groupPK, messageID); err != nil {
+		logger.Warn("unable to dequeue message", zap.Error(err))
+	}
+
+	if err := s.searchIndex.Delete(groupPK, messageID); err != nil {
+		logger.Warn("unable to remove message from the search index", zap.Error(err))
+	}
+
+	for _, id := range ids {
+		c, err := cid.Cast(id)
+		if err != nil {
+			continue
+		}
+
+		if err := gc.MessageKeystore().ForgetMessage(c); err != nil {
+			logger.Warn("unable to delete message key", zap.Error(err))
+			return
+		}
+
+		if s.odb.ratchets != nil {
+			if err := s.odb.ratchets.forget(c); err != nil {
+				logger.Warn("unable to delete message content key", zap.Error(err))
+				return
+			}
+		}
+	}
+
+	now := time.Now()
+	if err := s.ephemeral.expired(groupPK, messageID, now); err != nil {
+		logger.Warn("unable to record message deletion", zap.Error(err))
+		return
+	}
+
+	gc.messageStore.Emit(s.ctx, &EvtMessageExpired{GroupPK: groupPK, MessageID: messageID, ExpiredAt: now})
+}
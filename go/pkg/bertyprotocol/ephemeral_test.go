@@ -0,0 +1,142 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestEphemeralPayload(t *testing.T) {
+	ttl, payload, err := openEphemeral(sealEphemeral(time.Hour, []byte("message")))
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, ttl)
+	assert.Equal(t, []byte("message"), payload)
+
+	ttl, payload, err = openEphemeral([]byte("message"))
+	require.NoError(t, err)
+	assert.Zero(t, ttl)
+	assert.Equal(t, []byte("message"), payload)
+
+	_, _, err = openEphemeral(sealEphemeral(maxMessageTTL+1, []byte("message")))
+	assert.Error(t, err)
+}
+
+func TestEphemeralMessages(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	em, err := newEphemeralMessages(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	groupPK, alice, bob := []byte("group"), []byte("alice"), []byte("bob")
+	now := time.Now()
+
+	setting, err := em.setting(groupPK)
+	require.NoError(t, err)
+	assert.Nil(t, setting)
+
+	change := func(devicePK []byte, ttl time.Duration, at time.Time) bool {
+		changed, err := em.change(&MessageTTL{GroupPK: groupPK, DevicePK: devicePK, TTL: ttl, ChangedAt: at})
+		require.NoError(t, err)
+		return changed
+	}
+
+	// the latest change wins whatever the order
+	assert.True(t, change(alice, time.Hour, now))
+	assert.True(t, change(bob, time.Minute, now.Add(time.Second)))
+	assert.False(t, change(alice, time.Hour, now))
+	assert.False(t, change(bob, time.Minute, now.Add(time.Second)))
+
+	setting, err = em.setting(groupPK)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, setting.TTL)
+	assert.Equal(t, bob, setting.DevicePK)
+
+	expired := make(chan []byte, 2)
+	em.expire = func(_, messageID []byte) { expired <- messageID }
+
+	// the first sight sets the expiry
+	expiresAt, err := em.schedule(groupPK, []byte("m1"), now.Add(50*time.Millisecond))
+	require.NoError(t, err)
+	again, err := em.schedule(groupPK, []byte("m1"), now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, expiresAt.UnixNano(), again.UnixNano())
+
+	select {
+	case id := <-expired:
+		assert.Equal(t, []byte("m1"), id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not expired")
+	}
+
+	require.NoError(t, em.expired(groupPK, []byte("m1"), time.Now()))
+	assert.True(t, em.isExpired(groupPK, []byte("m1")))
+
+	// an expired message isn't scheduled again
+	expiresAt, err = em.schedule(groupPK, []byte("m1"), now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, expiresAt.IsZero())
+
+	// the deletions are armed again after a restart
+	_, err = em.schedule(groupPK, []byte("m2"), now)
+	require.NoError(t, err)
+	<-expired
+
+	em, err = newEphemeralMessages(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+	em.expire = func(_, messageID []byte) { expired <- messageID }
+	em.arm(groupPK)
+
+	select {
+	case id := <-expired:
+		assert.Equal(t, []byte("m2"), id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not expired after restart")
+	}
+}
+
+// TestEphemeralExpiredOnSender checks the sender can't open its message once
+// the keys are deleted by expireMessage.
+func TestEphemeralExpiredOnSender(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	alice, bob := newTestRatchetDevice(t, g), newTestRatchetDevice(t, g)
+
+	sealed, err := alice.rm.seal(g, map[string][]byte{string(bob.devicePK): bob.ratchetPK(t, g)}, sealEphemeral(time.Minute, []byte("ephemeral")))
+	require.NoError(t, err)
+
+	id, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(sealed)
+	require.NoError(t, err)
+
+	headers := &bertytypes.MessageHeaders{DevicePK: alice.devicePK}
+
+	// the sender opens its message once written to the log
+	payload, err := alice.rm.open(g, headers, id, sealed)
+	require.NoError(t, err)
+
+	_, payload, err = openEphemeral(payload)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ephemeral"), payload)
+
+	_, err = bob.rm.open(g, headers, id, sealed)
+	require.NoError(t, err)
+
+	require.NoError(t, alice.rm.forget(id))
+	require.NoError(t, bob.rm.forget(id))
+
+	_, err = alice.rm.open(g, headers, id, sealed)
+	assert.Error(t, err)
+
+	_, err = alice.rm.open(g, headers, cid.Undef, sealed)
+	assert.Error(t, err)
+
+	_, err = bob.rm.open(g, headers, id, sealed)
+	assert.Error(t, err)
+}
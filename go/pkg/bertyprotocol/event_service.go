@@ -0,0 +1,151 @@
+package bertyprotocol
+
+import (
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// The event service is served next to the ProtocolService, on each of its
+// listeners: the UIs subscribe to the updates of the node over a WebSocket
+// with the grpcws one. Its messages are plain protobuf messages:
+//
+//   service EventService {
+//     rpc EventStream (EventStreamRequest) returns (stream NodeEvent);
+//   }
+//
+//   message EventStreamRequest {
+//     repeated string types = 1;
+//     bytes group_pk = 2;
+//     string cursor = 3;
+//   }
+//
+//   message NodeEvent {
+//     string cursor = 1;
+//     string type = 2;
+//     int64 at = 3;
+//     bytes group_pk = 4;
+//     string peer_id = 5;
+//     bytes payload = 6;
+//   }
+
+// EventStreamRequest selects the events sent by EventStream, Types and
+// GroupPK filter them when set. Cursor resumes the stream after the event it
+// was taken from.
+type EventStreamRequest struct {
+	Types   []string `protobuf:"bytes,1,rep,name=types,proto3" json:"types,omitempty"`
+	GroupPK []byte   `protobuf:"bytes,2,opt,name=group_pk,json=groupPk,proto3" json:"group_pk,omitempty"`
+	Cursor  string   `protobuf:"bytes,3,opt,name=cursor,proto3" json:"cursor,omitempty"`
+}
+
+func (m *EventStreamRequest) Reset()         { *m = EventStreamRequest{} }
+func (m *EventStreamRequest) String() string { return proto.CompactTextString(m) }
+func (*EventStreamRequest) ProtoMessage()    {}
+
+// NodeEvent is an event of the node, Payload is the JSON encoded event of
+// its type.
+type NodeEvent struct {
+	Cursor  string `protobuf:"bytes,1,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	Type    string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	At      int64  `protobuf:"varint,3,opt,name=at,proto3" json:"at,omitempty"`
+	GroupPK []byte `protobuf:"bytes,4,opt,name=group_pk,json=groupPk,proto3" json:"group_pk,omitempty"`
+	PeerID  string `protobuf:"bytes,5,opt,name=peer_id,json=peerId,proto3" json:"peer_id,omitempty"`
+	Payload []byte `protobuf:"bytes,6,opt,name=payload,proto3" json:"payload,omitempty"`
+}
+
+func (m *NodeEvent) Reset()         { *m = NodeEvent{} }
+func (m *NodeEvent) String() string { return proto.CompactTextString(m) }
+func (*NodeEvent) ProtoMessage()    {}
+
+// EventServiceClient is the client API for EventService service.
+type EventServiceClient interface {
+	// EventStream streams the events of the node, the buffered ones after
+	// the cursor first
+	EventStream(ctx context.Context, in *EventStreamRequest, opts ...grpc.CallOption) (EventService_EventStreamClient, error)
+}
+
+type eventServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewEventServiceClient(cc *grpc.ClientConn) EventServiceClient {
+	return &eventServiceClient{cc}
+}
+
+func (c *eventServiceClient) EventStream(ctx context.Context, in *EventStreamRequest, opts ...grpc.CallOption) (EventService_EventStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_EventService_serviceDesc.Streams[0], "/berty.protocol.v1.EventService/EventStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &eventServiceEventStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type EventService_EventStreamClient interface {
+	Recv() (*NodeEvent, error)
+	grpc.ClientStream
+}
+
+type eventServiceEventStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *eventServiceEventStreamClient) Recv() (*NodeEvent, error) {
+	m := new(NodeEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EventServiceServer is the server API for EventService service.
+type EventServiceServer interface {
+	// EventStream streams the events of the node, the buffered ones after
+	// the cursor first
+	EventStream(*EventStreamRequest, EventService_EventStreamServer) error
+}
+
+func RegisterEventServiceServer(s *grpc.Server, srv EventServiceServer) {
+	s.RegisterService(&_EventService_serviceDesc, srv)
+}
+
+func _EventService_EventStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(EventStreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EventServiceServer).EventStream(m, &eventServiceEventStreamServer{stream})
+}
+
+type EventService_EventStreamServer interface {
+	Send(*NodeEvent) error
+	grpc.ServerStream
+}
+
+type eventServiceEventStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *eventServiceEventStreamServer) Send(m *NodeEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _EventService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "berty.protocol.v1.EventService",
+	HandlerType: (*EventServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "EventStream",
+			Handler:       _EventService_EventStream_Handler,
+			ServerStreams: true,
+		},
+	},
+}
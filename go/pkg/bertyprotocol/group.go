@@ -70,12 +70,14 @@ func getKeysForGroupOfContact(contactPairSK crypto.PrivKey) (crypto.PrivKey, cry
 	if err != nil {
 		return nil, nil, errcode.ErrSerialization.Wrap(err)
 	}
+	defer cryptoutil.Wipe(ck)
 
 	// Generate Pseudo Random Key using ck as IKM and salt
 	prk := hkdf.Extract(hash, ck, nil)
 	if len(prk) == 0 {
 		return nil, nil, errcode.ErrInternal
 	}
+	defer cryptoutil.Wipe(prk)
 
 	// Expand using extracted prk and groupID as info (kind of namespace)
 	kdf := hkdf.Expand(hash, prk, nil)
@@ -85,11 +87,13 @@ func getKeysForGroupOfContact(contactPairSK crypto.PrivKey) (crypto.PrivKey, cry
 	if err != nil {
 		return nil, nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
 	}
+	defer cryptoutil.Wipe(groupSeed)
 
 	groupSecretSeed, err := ioutil.ReadAll(io.LimitReader(kdf, 32))
 	if err != nil {
 		return nil, nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
 	}
+	defer cryptoutil.Wipe(groupSecretSeed)
 
 	sk1 := ed25519.NewKeyFromSeed(groupSeed)
 	groupSK, _, err := crypto.KeyPairFromStdKey(&sk1)
@@ -271,6 +275,10 @@ func SendSecretsToExistingMembers(ctx context.Context, gctx *groupContext) {
 	wg := sync.WaitGroup{}
 
 	for _, pk := range members {
+		if !gctx.MetadataStore().IsCurrentMember(pk) {
+			continue
+		}
+
 		wg.Add(1)
 
 		go func(pk crypto.PubKey) {
@@ -319,6 +327,10 @@ func WatchNewMembersAndSendSecrets(ctx context.Context, logger *zap.Logger, gctx
 				return
 			}
 
+			if !gctx.MetadataStore().IsCurrentMember(memberPK) {
+				return
+			}
+
 			if _, err := gctx.MetadataStore().SendSecret(ctx, memberPK); err != nil {
 				if !errcode.Is(err, errcode.ErrGroupSecretAlreadySentToMember) {
 					logger.Error("unable to send secret to member", zap.Error(err))
@@ -356,6 +368,7 @@ func openDeviceSecret(m *bertytypes.GroupMetadata, localMemberPrivateKey crypto.
 	if err != nil {
 		return nil, nil, errcode.ErrCryptoKeyConversion.Wrap(err)
 	}
+	defer cryptoutil.WipeKey(mongPriv)
 
 	nonce := groupIDToNonce(group)
 	decryptedSecret := &bertytypes.DeviceSecret{}
@@ -363,6 +376,7 @@ func openDeviceSecret(m *bertytypes.GroupMetadata, localMemberPrivateKey crypto.
 	if !ok {
 		return nil, nil, errcode.ErrCryptoDecrypt
 	}
+	defer cryptoutil.Wipe(decryptedMessage)
 
 	err = decryptedSecret.Unmarshal(decryptedMessage)
 	if err != nil {
@@ -3,6 +3,7 @@ package bertyprotocol
 import (
 	"encoding/base64"
 	"fmt"
+	"sync"
 
 	"berty.tech/berty/v2/go/pkg/bertytypes"
 	"github.com/libp2p/go-libp2p-core/crypto"
@@ -16,6 +17,9 @@ type groupContext struct {
 	messageKeystore *MessageKeystore
 	memberDevice    *ownMemberDevice
 	logger          *zap.Logger
+
+	// rotationLock serializes the rotations of the device secret
+	rotationLock sync.Mutex
 }
 
 func (gc *groupContext) MessageKeystore() *MessageKeystore {
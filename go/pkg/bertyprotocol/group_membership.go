@@ -0,0 +1,602 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfslog "berty.tech/go-ipfs-log"
+	"github.com/gogo/protobuf/proto"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
+)
+
+// membershipPayloadType is the type of the app metadata payloads carrying the
+// membership operations of a MultiMember group.
+const membershipPayloadType = "berty.membership"
+
+type MembershipOpKind string
+
+const (
+	MembershipOpInvite MembershipOpKind = "invite"
+	MembershipOpJoin   MembershipOpKind = "join"
+	MembershipOpLeave  MembershipOpKind = "leave"
+	MembershipOpKick   MembershipOpKind = "kick"
+)
+
+type MemberState string
+
+const (
+	MemberStateInvited MemberState = "invited"
+	MemberStateJoined  MemberState = "joined"
+	MemberStateLeft    MemberState = "left"
+	MemberStateKicked  MemberState = "kicked"
+)
+
+// GroupMember is a member of a MultiMember group and its membership state.
+type GroupMember struct {
+	MemberPK []byte
+	State    MemberState
+}
+
+// EventMembershipChanged is emitted by the metadata store of a MultiMember
+// group when the members who left or were kicked change.
+type EventMembershipChanged struct {
+	Removed [][]byte
+
+	// Removals are the operations which removed the members, by member in
+	// the same order, a member removed again is removed by a new operation
+	Removals [][]byte
+}
+
+// membershipOp is signed by the member key of its author, it is appended to
+// the metadata store of the group so every device of every member replays
+// the same operations.
+type membershipOp struct {
+	Type     string           `json:"type"`
+	Op       MembershipOpKind `json:"op"`
+	MemberPK []byte           `json:"member_pk"`
+	ByPK     []byte           `json:"by_pk"`
+	At       int64            `json:"at"`
+	Sig      []byte           `json:"sig"`
+
+	// hash and clock are the entry of the operation in the log, past the
+	// entries before it, i.e. what its author had seen
+	hash  string
+	clock int
+	past  map[string]bool
+}
+
+// concurrent reports whether neither of the operations had seen the other.
+func (o *membershipOp) concurrent(other *membershipOp) bool {
+	return !o.past[other.hash] && !other.past[o.hash]
+}
+
+// causalPast returns the hashes of the entries before an entry of a log. The
+// Lamport clocks are set by the writers, an entry whose clock isn't after the
+// ones of its past is rejected so the clocks order the entries causally.
+func causalPast(log ipfslog.Log, e ipfslog.Entry) (map[string]bool, error) {
+	past := map[string]bool{}
+	queue := append([]cid.Cid{}, e.GetNext()...)
+
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		if past[c.String()] {
+			continue
+		}
+
+		past[c.String()] = true
+
+		prev, ok := log.GetEntries().Get(c.String())
+		if !ok {
+			continue
+		}
+
+		if prev.GetClock().GetTime() >= e.GetClock().GetTime() {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("membership operation out of causal order"))
+		}
+
+		queue = append(queue, prev.GetNext()...)
+	}
+
+	return past, nil
+}
+
+func (o *membershipOp) signedBytes(groupPK []byte) []byte {
+	at := make([]byte, 8)
+	binary.BigEndian.PutUint64(at, uint64(o.At))
+
+	return bytes.Join([][]byte{[]byte("berty membership"), groupPK, []byte(o.Op), o.MemberPK, o.ByPK, at}, nil)
+}
+
+func (o *membershipOp) verify(groupPK []byte) error {
+	switch o.Op {
+	case MembershipOpInvite, MembershipOpJoin, MembershipOpLeave, MembershipOpKick:
+	default:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown membership operation %q", o.Op))
+	}
+
+	if _, err := crypto.UnmarshalEd25519PublicKey(o.MemberPK); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	by, err := crypto.UnmarshalEd25519PublicKey(o.ByPK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := by.Verify(o.signedBytes(groupPK), o.Sig); err != nil || !ok {
+		return errcode.ErrCryptoSignatureVerification
+	}
+
+	return nil
+}
+
+// computeMembership replays the operations in their causal order, the
+// devices having indexed the same operations converge to the same state
+// whatever the order they were received in.
+//
+// The members having added a device are joined until an admin manages the
+// membership, the members whose first device comes afterwards need an
+// invitation. An invitation can only be issued by a joined member, the ones
+// a kicked member issued without having seen its kick are void. A join needs
+// an invitation, unless the member left, and a kick is only accepted from a
+// joined admin.
+func computeMembership(ops []*membershipOp, admins map[string]bool, members map[string][]string) map[string]MemberState {
+	states, _ := replayMembership(ops, admins, members)
+
+	return states
+}
+
+// replayMembership returns the states of the members and the operations
+// which removed the members who left or were kicked, by member.
+func replayMembership(ops []*membershipOp, admins map[string]bool, members map[string][]string) (map[string]MemberState, map[string][]byte) {
+	sorted := make([]*membershipOp, len(ops))
+	copy(sorted, ops)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].clock != sorted[j].clock {
+			return sorted[i].clock < sorted[j].clock
+		}
+
+		if sorted[i].hash != sorted[j].hash {
+			return sorted[i].hash < sorted[j].hash
+		}
+
+		return bytes.Compare(sorted[i].Sig, sorted[j].Sig) < 0
+	})
+
+	var managed *membershipOp
+	for _, op := range sorted {
+		if admins[string(op.ByPK)] {
+			managed = op
+			break
+		}
+	}
+
+	states := map[string]MemberState{}
+	for member, adds := range members {
+		for _, add := range adds {
+			if managed == nil || managed.past[add] {
+				states[member] = MemberStateJoined
+				break
+			}
+		}
+	}
+
+	for admin := range admins {
+		states[admin] = MemberStateJoined
+	}
+
+	void := map[string]bool{}
+	for _, kick := range sorted {
+		if kick.Op != MembershipOpKick || !admins[string(kick.ByPK)] {
+			continue
+		}
+
+		for _, op := range sorted {
+			if op.Op == MembershipOpInvite && bytes.Equal(op.ByPK, kick.MemberPK) && op.concurrent(kick) {
+				void[string(op.Sig)] = true
+			}
+		}
+	}
+
+	removals := map[string][]byte{}
+	for _, op := range sorted {
+		member, by := string(op.MemberPK), string(op.ByPK)
+		current, known := states[member]
+
+		switch op.Op {
+		case MembershipOpInvite:
+			if void[string(op.Sig)] || states[by] != MemberStateJoined || current == MemberStateJoined {
+				continue
+			}
+
+			states[member] = MemberStateInvited
+
+		case MembershipOpJoin:
+			if member != by || (current != MemberStateInvited && current != MemberStateLeft) {
+				continue
+			}
+
+			states[member] = MemberStateJoined
+
+		case MembershipOpLeave:
+			if member != by || (current != MemberStateJoined && current != MemberStateInvited) {
+				continue
+			}
+
+			states[member] = MemberStateLeft
+			removals[member] = op.Sig
+
+		case MembershipOpKick:
+			if member == by || !admins[by] || states[by] != MemberStateJoined || !known {
+				continue
+			}
+
+			states[member] = MemberStateKicked
+			removals[member] = op.Sig
+		}
+	}
+
+	for member := range removals {
+		if state := states[member]; state != MemberStateLeft && state != MemberStateKicked {
+			delete(removals, member)
+		}
+	}
+
+	return states, removals
+}
+
+func (m *metadataStoreIndex) handleMembershipOp(event proto.Message) error {
+	e, ok := event.(*bertytypes.AppMetadata)
+	if !ok {
+		return errcode.ErrInvalidInput
+	}
+
+	if m.g.GroupType != bertytypes.GroupTypeMultiMember {
+		return nil
+	}
+
+	op := &membershipOp{}
+	if err := json.Unmarshal(e.Message, op); err != nil || op.Type != membershipPayloadType {
+		// not a membership operation
+		return nil
+	}
+
+	if err := op.verify(m.g.PublicKey); err != nil {
+		return err
+	}
+
+	if m.entry != nil {
+		past, err := causalPast(m.log, m.entry)
+		if err != nil {
+			return err
+		}
+
+		op.hash, op.clock, op.past = m.entry.GetHash().String(), m.entry.GetClock().GetTime(), past
+	}
+
+	m.membershipOps[string(op.Sig)] = op
+
+	return nil
+}
+
+func (m *metadataStoreIndex) postHandlerMembership() error {
+	if m.g.GroupType != bertytypes.GroupTypeMultiMember {
+		return nil
+	}
+
+	ops := make([]*membershipOp, 0, len(m.membershipOps))
+	for _, op := range m.membershipOps {
+		ops = append(ops, op)
+	}
+
+	admins := map[string]bool{}
+	for admin := range m.admins {
+		raw, err := admin.Raw()
+		if err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+		admins[string(raw)] = true
+	}
+
+	states, removals := replayMembership(ops, admins, m.memberAdds)
+	m.membership = states
+
+	removed := make([][]byte, 0, len(removals))
+	for pk := range removals {
+		removed = append(removed, []byte(pk))
+	}
+
+	sort.Slice(removed, func(i, j int) bool { return bytes.Compare(removed[i], removed[j]) < 0 })
+
+	evt := &EventMembershipChanged{Removed: removed, Removals: make([][]byte, len(removed))}
+	for i, pk := range removed {
+		evt.Removals[i] = removals[string(pk)]
+	}
+
+	if key := bytes.Join(evt.Removals, nil); !bytes.Equal(key, m.removedMembers) {
+		m.removedMembers = key
+
+		// the index is locked while the post index actions run
+		go m.eventEmitter.Emit(m.ctx, evt)
+	}
+
+	return nil
+}
+
+func (m *metadataStoreIndex) memberState(pk []byte) (MemberState, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	state, ok := m.membership[string(pk)]
+
+	return state, ok
+}
+
+// managesMembership reports whether the group has membership operations,
+// the members are then only the ones the operations accept.
+func (m *metadataStoreIndex) managesMembership() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.membershipOps) > 0
+}
+
+func (m *metadataStoreIndex) listMembership() []*GroupMember {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	members := make([]*GroupMember, 0, len(m.membership))
+	for pk, state := range m.membership {
+		members = append(members, &GroupMember{MemberPK: []byte(pk), State: state})
+	}
+
+	return members
+}
+
+// IsCurrentMember reports whether a member is part of the group, i.e. it
+// didn't leave nor was kicked from it. It is always true outside of the
+// MultiMember groups, an unknown member is a member until the group has
+// membership operations.
+func (m *metadataStore) IsCurrentMember(pk crypto.PubKey) bool {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return true
+	}
+
+	raw, err := pk.Raw()
+	if err != nil {
+		return false
+	}
+
+	index := m.Index().(*metadataStoreIndex)
+	state, ok := index.memberState(raw)
+	if !ok {
+		return !index.managesMembership()
+	}
+
+	return state == MemberStateJoined
+}
+
+// isCurrentDevice reports whether a device belongs to a current member of the
+// group.
+func (m *metadataStore) isCurrentDevice(devicePK []byte) bool {
+	pk, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+	if err != nil {
+		return false
+	}
+
+	member, err := m.GetMemberByDevice(pk)
+	if err != nil {
+		return false
+	}
+
+	return m.IsCurrentMember(member)
+}
+
+func (s *service) sendMembershipOp(ctx context.Context, gc *groupContext, kind MembershipOpKind, memberPK []byte) error {
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	byPK, err := md.member.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if memberPK == nil {
+		memberPK = byPK
+	}
+
+	op := &membershipOp{
+		Type:     membershipPayloadType,
+		Op:       kind,
+		MemberPK: memberPK,
+		ByPK:     byPK,
+		At:       time.Now().UnixNano(),
+	}
+
+	if op.Sig, err = md.member.Sign(op.signedBytes(gc.Group().PublicKey)); err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	payload, err := json.Marshal(op)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := gc.MetadataStore().SendAppMetadata(ctx, payload); err != nil {
+		return errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
+
+func (s *service) getMultiMemberGroupContext(groupPK []byte) (*groupContext, error) {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType != bertytypes.GroupTypeMultiMember {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return gc, nil
+}
+
+// GroupMemberInvite records the invitation of a member to a MultiMember
+// group, the returned group has to be shared with the member to let it join.
+// Inviting a kicked member allows it to join again.
+func (s *service) GroupMemberInvite(ctx context.Context, groupPK []byte, memberPK []byte) (*bertytypes.Group, error) {
+	gc, err := s.getMultiMemberGroupContext(groupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	if !gc.MetadataStore().IsCurrentMember(gc.MemberPubKey()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("not a member of the group"))
+	}
+
+	if _, err := crypto.UnmarshalEd25519PublicKey(memberPK); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if err := s.sendMembershipOp(ctx, gc, MembershipOpInvite, memberPK); err != nil {
+		return nil, err
+	}
+
+	return gc.Group(), nil
+}
+
+// GroupMemberKick removes a member from a MultiMember group, only an admin
+// can kick a member. The devices of the current members then rotate their
+// secret, the kicked member can still read the messages sent before.
+func (s *service) GroupMemberKick(ctx context.Context, groupPK []byte, memberPK []byte) error {
+	gc, err := s.getMultiMemberGroupContext(groupPK)
+	if err != nil {
+		return err
+	}
+
+	isAdmin := false
+	for _, admin := range gc.MetadataStore().ListAdmins() {
+		if admin.Equals(gc.MemberPubKey()) {
+			isAdmin = true
+			break
+		}
+	}
+
+	if !isAdmin {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only an admin can kick a member"))
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(memberPK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if pk.Equals(gc.MemberPubKey()) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("can't kick self"))
+	}
+
+	return s.sendMembershipOp(ctx, gc, MembershipOpKick, memberPK)
+}
+
+// GroupMembers returns the members of a MultiMember group and their
+// membership state.
+func (s *service) GroupMembers(_ context.Context, groupPK []byte) ([]*GroupMember, error) {
+	gc, err := s.getMultiMemberGroupContext(groupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	return gc.MetadataStore().Index().(*metadataStoreIndex).listMembership(), nil
+}
+
+// announceMembership sends a join operation once the group is opened if the
+// member was only invited or left it before.
+func (s *service) announceMembership(gc *groupContext) {
+	raw, err := gc.MemberPubKey().Raw()
+	if err != nil {
+		return
+	}
+
+	state, ok := gc.MetadataStore().Index().(*metadataStoreIndex).memberState(raw)
+	if !ok || (state != MemberStateInvited && state != MemberStateLeft) {
+		return
+	}
+
+	if err := s.sendMembershipOp(s.ctx, gc, MembershipOpJoin, nil); err != nil {
+		s.logger.Warn("unable to announce group membership", zap.Error(err))
+	}
+}
+
+// rotateDeviceSecret rotates the secret of the device once a member left or
+// was kicked, the new secret is only sent to the current members so the
+// messages sent afterwards can't be read by the removed members. The new
+// members don't need a rotation, they only receive the current secret.
+//
+// A rotation is done once by removal, a member invited again and removed
+// again causes a new one. The rotations of a group are serialized, the
+// concurrent changes only rotate once.
+func (s *service) rotateDeviceSecret(gc *groupContext, evt *EventMembershipChanged) {
+	gc.rotationLock.Lock()
+	defer gc.rotationLock.Unlock()
+
+	rotated := true
+	for _, removalID := range evt.Removals {
+		ok, err := gc.MessageKeystore().IsRotatedFor(gc.DevicePubKey(), removalID)
+		if err != nil {
+			s.logger.Warn("unable to check device secret rotation", zap.Error(err))
+			return
+		}
+
+		rotated = rotated && ok
+	}
+
+	if rotated {
+		return
+	}
+
+	ds, err := gc.MessageKeystore().RotateDeviceSecret(gc.memberDevice.device)
+	if err != nil {
+		s.logger.Error("unable to rotate device secret", zap.Error(err))
+		return
+	}
+
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		s.logger.Error("unable to get member device", zap.Error(err))
+		return
+	}
+
+	for _, memberPK := range gc.MetadataStore().ListMembers() {
+		if !gc.MetadataStore().IsCurrentMember(memberPK) {
+			continue
+		}
+
+		if _, err := metadataStoreSendSecret(s.ctx, gc.MetadataStore(), gc.Group(), md, memberPK, ds); err != nil {
+			// the rotation is retried on the next membership change or once
+			// the group is opened again
+			s.logger.Error("unable to send rotated device secret", zap.Error(err))
+			return
+		}
+	}
+
+	for _, removalID := range evt.Removals {
+		if err := gc.MessageKeystore().MarkRotatedFor(gc.DevicePubKey(), removalID); err != nil {
+			s.logger.Warn("unable to record device secret rotation", zap.Error(err))
+		}
+	}
+}
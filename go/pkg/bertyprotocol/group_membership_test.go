@@ -0,0 +1,162 @@
+package bertyprotocol
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chainMembershipOps sets the operations one after the other in the log,
+// each one having seen the previous ones.
+func chainMembershipOps(ops ...*membershipOp) []*membershipOp {
+	past := map[string]bool{}
+	for i, op := range ops {
+		op.hash, op.clock, op.past = string(op.Sig), i+1, map[string]bool{}
+		for h := range past {
+			op.past[h] = true
+		}
+
+		past[op.hash] = true
+	}
+
+	return ops
+}
+
+func TestComputeMembership(t *testing.T) {
+	admin, alice, bob, carol := []byte("admin"), []byte("alice"), []byte("bob"), []byte("carol")
+	admins := map[string]bool{string(admin): true}
+
+	ops := chainMembershipOps(
+		&membershipOp{Op: MembershipOpInvite, MemberPK: alice, ByPK: admin, At: 1, Sig: []byte("1")},
+		&membershipOp{Op: MembershipOpJoin, MemberPK: alice, ByPK: alice, At: 2, Sig: []byte("2")},
+		&membershipOp{Op: MembershipOpInvite, MemberPK: bob, ByPK: alice, At: 3, Sig: []byte("3")},
+		&membershipOp{Op: MembershipOpJoin, MemberPK: bob, ByPK: bob, At: 4, Sig: []byte("4")},
+		// only an admin can kick
+		&membershipOp{Op: MembershipOpKick, MemberPK: bob, ByPK: alice, At: 5, Sig: []byte("5")},
+		&membershipOp{Op: MembershipOpKick, MemberPK: alice, ByPK: admin, At: 6, Sig: []byte("6")},
+		// a kicked member can't join again without a new invitation
+		&membershipOp{Op: MembershipOpJoin, MemberPK: alice, ByPK: alice, At: 7, Sig: []byte("7")},
+		// a kicked member can't invite
+		&membershipOp{Op: MembershipOpInvite, MemberPK: carol, ByPK: alice, At: 8, Sig: []byte("8")},
+		&membershipOp{Op: MembershipOpLeave, MemberPK: bob, ByPK: bob, At: 9, Sig: []byte("9")},
+	)
+
+	expected := map[string]MemberState{
+		string(admin): MemberStateJoined,
+		string(alice): MemberStateKicked,
+		string(bob):   MemberStateLeft,
+	}
+
+	assert.Equal(t, expected, computeMembership(ops, admins, nil))
+
+	// the state doesn't depend on the order the operations were received in
+	for i := 0; i < 10; i++ {
+		shuffled := make([]*membershipOp, len(ops))
+		copy(shuffled, ops)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+		assert.Equal(t, expected, computeMembership(shuffled, admins, nil))
+	}
+
+	// a new invitation lets a kicked member join again
+	rejoined := chainMembershipOps(append(append([]*membershipOp{}, ops...),
+		&membershipOp{Op: MembershipOpInvite, MemberPK: alice, ByPK: admin, At: 10, Sig: []byte("10")},
+		&membershipOp{Op: MembershipOpJoin, MemberPK: alice, ByPK: alice, At: 11, Sig: []byte("11")},
+	)...)
+	assert.Equal(t, MemberStateJoined, computeMembership(rejoined, admins, nil)[string(alice)])
+
+	// the members having added a device are joined
+	assert.Equal(t, MemberStateJoined, computeMembership(nil, admins, map[string][]string{string(carol): {"carol device"}})[string(carol)])
+}
+
+func TestComputeMembershipKickBypass(t *testing.T) {
+	admin, alice, dave := []byte("admin"), []byte("alice"), []byte("dave")
+	admins := map[string]bool{string(admin): true}
+
+	ops := chainMembershipOps(
+		&membershipOp{Op: MembershipOpInvite, MemberPK: alice, ByPK: admin, At: 1, Sig: []byte("1")},
+		&membershipOp{Op: MembershipOpJoin, MemberPK: alice, ByPK: alice, At: 2, Sig: []byte("2")},
+		&membershipOp{Op: MembershipOpKick, MemberPK: alice, ByPK: admin, At: 3, Sig: []byte("3")},
+	)
+
+	// an invitation of the kicked member dated before its kick, but which the
+	// admin didn't see, is void
+	backdated := &membershipOp{
+		Op: MembershipOpInvite, MemberPK: dave, ByPK: alice, At: 0, Sig: []byte("backdated"),
+		hash: "backdated", clock: 3, past: map[string]bool{"1": true, "2": true},
+	}
+	join := &membershipOp{
+		Op: MembershipOpJoin, MemberPK: dave, ByPK: dave, At: 4, Sig: []byte("join"),
+		hash: "join", clock: 4, past: map[string]bool{"1": true, "2": true, "3": true, "backdated": true},
+	}
+
+	states := computeMembership(append(ops, backdated, join), admins, nil)
+	assert.Equal(t, MemberStateKicked, states[string(alice)])
+	assert.NotContains(t, states, string(dave))
+
+	// an invitation the admin saw before the kick is kept
+	seen := &membershipOp{
+		Op: MembershipOpInvite, MemberPK: dave, ByPK: alice, At: 0, Sig: []byte("seen"),
+		hash: "seen", clock: 3, past: map[string]bool{"1": true, "2": true},
+	}
+	kick := &membershipOp{
+		Op: MembershipOpKick, MemberPK: alice, ByPK: admin, At: 3, Sig: []byte("kick"),
+		hash: "kick", clock: 4, past: map[string]bool{"1": true, "2": true, "seen": true},
+	}
+
+	states = computeMembership(append(ops[:2:2], seen, kick), admins, nil)
+	assert.Equal(t, MemberStateInvited, states[string(dave)])
+
+	// a member key whose device comes after the admin managed the membership
+	// needs an invitation, a join alone isn't enough
+	members := map[string][]string{
+		string(alice): {"alice device"},
+		string(dave):  {"dave device"},
+	}
+	ops[0].past["alice device"] = true
+
+	join = &membershipOp{
+		Op: MembershipOpJoin, MemberPK: dave, ByPK: dave, At: 4, Sig: []byte("join"),
+		hash: "join", clock: 4, past: map[string]bool{"1": true, "2": true, "3": true, "dave device": true},
+	}
+
+	states = computeMembership(append(ops, join), admins, members)
+	assert.Equal(t, MemberStateKicked, states[string(alice)])
+	assert.NotContains(t, states, string(dave))
+
+	// the devices are joined as long as no admin manages the membership
+	states = computeMembership(nil, admins, members)
+	assert.Equal(t, MemberStateJoined, states[string(dave)])
+}
+
+func TestReplayMembershipRemovals(t *testing.T) {
+	admin, alice := []byte("admin"), []byte("alice")
+	admins := map[string]bool{string(admin): true}
+
+	ops := chainMembershipOps(
+		&membershipOp{Op: MembershipOpInvite, MemberPK: alice, ByPK: admin, At: 1, Sig: []byte("1")},
+		&membershipOp{Op: MembershipOpJoin, MemberPK: alice, ByPK: alice, At: 2, Sig: []byte("2")},
+		&membershipOp{Op: MembershipOpKick, MemberPK: alice, ByPK: admin, At: 3, Sig: []byte("3")},
+	)
+
+	_, removals := replayMembership(ops, admins, nil)
+	assert.Equal(t, map[string][]byte{string(alice): []byte("3")}, removals)
+
+	// a member invited again isn't removed anymore
+	ops = chainMembershipOps(append(ops,
+		&membershipOp{Op: MembershipOpInvite, MemberPK: alice, ByPK: admin, At: 4, Sig: []byte("4")},
+		&membershipOp{Op: MembershipOpJoin, MemberPK: alice, ByPK: alice, At: 5, Sig: []byte("5")},
+	)...)
+
+	_, removals = replayMembership(ops, admins, nil)
+	assert.Empty(t, removals)
+
+	// removed again by a new operation, so the secret is rotated again
+	ops = chainMembershipOps(append(ops,
+		&membershipOp{Op: MembershipOpKick, MemberPK: alice, ByPK: admin, At: 6, Sig: []byte("6")},
+	)...)
+
+	_, removals = replayMembership(ops, admins, nil)
+	assert.Equal(t, map[string][]byte{string(alice): []byte("6")}, removals)
+}
@@ -0,0 +1,156 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfslog "berty.tech/go-ipfs-log"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
+)
+
+func (s *service) newGroupPubSub(opts *Opts) *ipfsutil.GroupPubSub {
+	return ipfsutil.NewGroupPubSub(opts.Host, opts.PubSub, ipfsutil.GroupPubSubOpts{
+		Logger:  opts.Logger.Named("grouppubsub"),
+		Sign:    s.signGroupMessage,
+		Verify:  s.verifyGroupMessage,
+		Handler: s.handleGroupMessage,
+		Lanes:   s.lanes,
+	})
+}
+
+// signGroupMessage signs the messages published on the topic of a group with
+// the key of the device for the group. The sealed envelopes are signed
+// inside, so the relays of the topic don't learn their sender.
+func (s *service) signGroupMessage(groupPK []byte, data []byte) ([]byte, []byte, error) {
+	if bytes.HasPrefix(data, []byte(sealedEnvelopePrefix)) {
+		return nil, nil, nil
+	}
+
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return nil, nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	signer, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return nil, nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sig, err := md.device.Sign(data)
+	if err != nil {
+		return nil, nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	return signer, sig, nil
+}
+
+// verifyGroupMessage only accepts the messages signed by a device of a member
+// of the group, the sealed ones are opened to check their sender.
+func (s *service) verifyGroupMessage(groupPK []byte, signer []byte, data []byte, sig []byte) bool {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return false
+	}
+
+	if len(signer) == 0 {
+		if !bytes.HasPrefix(data, []byte(sealedEnvelopePrefix)) {
+			return false
+		}
+
+		_, err = s.openFromGroup(gc, data)
+		return err == nil
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(signer)
+	if err != nil {
+		return false
+	}
+
+	// the members who left or were kicked can't publish anymore
+	if !gc.MetadataStore().isCurrentDevice(signer) {
+		return false
+	}
+
+	ok, err := pk.Verify(data, sig)
+
+	return err == nil && ok
+}
+
+func (s *service) handleGroupMessage(groupPK []byte, from peer.ID, data []byte) {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return
+	}
+
+	if _, err := s.receiveEnvelope(s.ctx, gc, data, EnvelopeSourcePubSub); err != nil {
+		s.logger.Debug("unable to sync group message", zap.Stringer("peer", from), zap.Error(err))
+	}
+}
+
+func (s *service) joinGroupTopic(g *bertytypes.Group) {
+	if s.groupPubSub == nil {
+		return
+	}
+
+	if err := s.groupPubSub.Join(s.ctx, g.PublicKey); err != nil {
+		s.logger.Warn("unable to join group topic", zap.Error(err))
+	}
+}
+
+func (s *service) leaveGroupTopic(id []byte) {
+	if s.groupPubSub == nil {
+		return
+	}
+
+	if err := s.groupPubSub.Leave(id); err != nil {
+		s.logger.Warn("unable to leave group topic", zap.Error(err))
+	}
+}
+
+// publishMessage disseminates an entry of the device on the topic of the
+// group, the members replicating the store sync it from them otherwise.
+func (s *service) publishMessage(ctx context.Context, g *bertytypes.Group, e ipfslog.Entry) error {
+	if s.groupPubSub == nil || e == nil || g.GroupType == bertytypes.GroupTypeAccount {
+		return nil
+	}
+
+	ctx, span := s.tracer.Start(ctx, "Write Message", trace.WithAttributes(kv.String("transport", string(EnvelopeSourcePubSub))))
+	defer span.End()
+
+	payload, err := s.carriedPayload(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	// the large entries are split to fit the frames of every path
+	parts, err := splitEnvelope(payload, maxEnvelopePartSize)
+	if err != nil {
+		return err
+	}
+
+	members := s.conversations.groupPeers(g.PublicKey)
+	for _, part := range parts {
+		sealed, err := s.sealForGroup(g, part)
+		if err != nil {
+			return err
+		}
+
+		if err := s.groupPubSub.Publish(ctx, g.PublicKey, sealed, members); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/handledir"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+// HandleRegistration is the handle of the account published on the
+// directory.
+type HandleRegistration struct {
+	Handle       string    `json:"handle"`
+	Seq          uint64    `json:"seq"`
+	Directory    string    `json:"directory"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// handlePin is the chain of a handle as first seen from the directory, a
+// later lookup has to extend it.
+type handlePin struct {
+	First   []byte             `json:"first"`
+	Receipt *handledir.Receipt `json:"receipt"`
+}
+
+// handleDirectories keeps the pins of the handles looked up on the
+// directory.
+type handleDirectories struct {
+	logger    *zap.Logger
+	store     datastore.Datastore
+	directory *peer.AddrInfo
+	lock      sync.Mutex
+}
+
+func newHandleDirectories(logger *zap.Logger, store datastore.Datastore, directory string) (*handleDirectories, error) {
+	hd := &handleDirectories{logger: logger, store: store}
+	if directory == "" {
+		return hd, nil
+	}
+
+	var err error
+	if hd.directory, err = parsePushRelay(directory); err != nil {
+		return nil, err
+	}
+
+	return hd, nil
+}
+
+// check verifies that the entry extends the chain pinned for its handle,
+// the first chain seen is pinned.
+func (hd *handleDirectories) check(entry *handledir.Entry) error {
+	hd.lock.Lock()
+	defer hd.lock.Unlock()
+
+	head := entry.Head()
+	key := datastore.NewKey(head.Handle)
+
+	first, err := entry.Chain[0].Hash()
+	if err != nil {
+		return err
+	}
+
+	pin := &handlePin{}
+	data, err := hd.store.Get(key)
+	switch {
+	case err == datastore.ErrNotFound:
+		pin.First = first
+
+	case err != nil:
+		return errcode.ErrInternal.Wrap(err)
+
+	default:
+		if err := json.Unmarshal(data, pin); err != nil {
+			return errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if err := hd.extends(pin, first, entry); err != nil {
+			hd.logger.Warn("handle directory served a diverging chain", zap.String("handle", head.Handle), zap.Error(err))
+			return err
+		}
+	}
+
+	pin.Receipt = entry.Receipt
+
+	if data, err = json.Marshal(pin); err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := hd.store.Put(key, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (hd *handleDirectories) extends(pin *handlePin, first []byte, entry *handledir.Entry) error {
+	handle := entry.Head().Handle
+
+	switch {
+	case !bytes.Equal(pin.First, first):
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("handle %q registered by another account since the last lookup", handle))
+	case handledir.Conflicting(pin.Receipt, entry.Receipt):
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("conflicting receipts for the record %d of %q", pin.Receipt.Seq, handle))
+	case entry.Receipt.Seq < pin.Receipt.Seq:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("chain of %q rolled back to the record %d, %d seen", handle, entry.Receipt.Seq, pin.Receipt.Seq))
+	}
+
+	pinned, err := entry.Chain[pin.Receipt.Seq].Hash()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(pinned, pin.Receipt.Head) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("chain of %q forked after the record %d", handle, pin.Receipt.Seq))
+	}
+
+	return nil
+}
+
+// HandleRegister publishes the handle of the account on the directory,
+// mapped to its contact request reference, which has to be enabled. The
+// handle is kept by the first account registering it.
+func (s *service) HandleRegister(ctx context.Context, handle string) (*HandleRegistration, error) {
+	if s.host == nil || s.handles.directory == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	handle, err := handledir.NormalizeHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled, shareableContact := s.accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
+	if !enabled || shareableContact == nil || len(shareableContact.PublicRendezvousSeed) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("contact requests disabled"))
+	}
+
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	accountPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	var prev *handledir.Record
+	switch entry, err := s.handleLookup(ctx, handle); err {
+	case nil:
+		prev = entry.Head()
+	case handledir.ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	addrs, err := peer.AddrInfoToP2pAddrs(s.handles.directory)
+	if err != nil || len(addrs) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no addr for the handle directory"))
+	}
+
+	// the chain only grows when the reference changes
+	if prev != nil && bytes.Equal(prev.AccountPK, accountPK) && bytes.Equal(prev.PublicRendezvousSeed, shareableContact.PublicRendezvousSeed) && bytes.Equal(prev.Metadata, shareableContact.Metadata) {
+		return &HandleRegistration{
+			Handle:       handle,
+			Seq:          prev.Seq,
+			Directory:    addrs[0].String(),
+			RegisteredAt: time.Unix(0, prev.Timestamp),
+		}, nil
+	}
+
+	rec, err := handledir.NewRecord(accountSK, handle, prev, shareableContact.PublicRendezvousSeed, shareableContact.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt, err := handledir.Register(ctx, s.host, *s.handles.directory, rec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HandleRegistration{
+		Handle:       handle,
+		Seq:          receipt.Seq,
+		Directory:    addrs[0].String(),
+		RegisteredAt: time.Now(),
+	}, nil
+}
+
+// HandleLookup returns the contact an account published on the directory
+// for a handle, to send it a contact request.
+func (s *service) HandleLookup(ctx context.Context, handle string) (*bertytypes.ShareableContact, error) {
+	if s.host == nil || s.handles.directory == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	entry, err := s.handleLookup(ctx, handle)
+	if err == handledir.ErrNotFound {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	head := entry.Head()
+
+	return &bertytypes.ShareableContact{
+		PK:                   head.AccountPK,
+		PublicRendezvousSeed: head.PublicRendezvousSeed,
+		Metadata:             head.Metadata,
+	}, nil
+}
+
+func (s *service) handleLookup(ctx context.Context, handle string) (*handledir.Entry, error) {
+	entry, err := handledir.Lookup(ctx, s.host, *s.handles.directory, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.handles.check(entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
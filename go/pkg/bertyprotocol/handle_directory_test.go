@@ -0,0 +1,72 @@
+package bertyprotocol
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/handledir"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func testHandleEntry(t *testing.T, chain ...*handledir.Record) *handledir.Entry {
+	t.Helper()
+
+	head := chain[len(chain)-1]
+	hash, err := head.Hash()
+	require.NoError(t, err)
+
+	return &handledir.Entry{
+		Chain:   chain,
+		Receipt: &handledir.Receipt{Handle: head.Handle, Seq: head.Seq, Head: hash},
+	}
+}
+
+func TestHandleDirectoriesPin(t *testing.T) {
+	_, err := newHandleDirectories(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), "/ip4/127.0.0.1/tcp/4040")
+	assert.Error(t, err)
+
+	hd, err := newHandleDirectories(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), "/ip4/127.0.0.1/tcp/4040/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN")
+	require.NoError(t, err)
+	require.NotNil(t, hd.directory)
+
+	alice, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	mallory, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	first, err := handledir.NewRecord(alice, "alice", nil, []byte("seed 1"), nil)
+	require.NoError(t, err)
+
+	second, err := handledir.NewRecord(alice, "alice", first, []byte("seed 2"), nil)
+	require.NoError(t, err)
+
+	forked, err := handledir.NewRecord(alice, "alice", first, []byte("forked seed"), nil)
+	require.NoError(t, err)
+
+	require.NoError(t, hd.check(testHandleEntry(t, first)))
+	require.NoError(t, hd.check(testHandleEntry(t, first, second)))
+	require.NoError(t, hd.check(testHandleEntry(t, first, second)))
+
+	// the directory can't roll back, fork or swap the chain once seen
+	assert.Error(t, hd.check(testHandleEntry(t, first)))
+	assert.Error(t, hd.check(testHandleEntry(t, first, forked)))
+
+	swapped, err := handledir.NewRecord(mallory, "alice", nil, []byte("seed"), nil)
+	require.NoError(t, err)
+	assert.Error(t, hd.check(testHandleEntry(t, swapped)))
+
+	third, err := handledir.NewRecord(alice, "alice", second, []byte("seed 3"), nil)
+	require.NoError(t, err)
+	require.NoError(t, hd.check(testHandleEntry(t, first, second, third)))
+
+	// the other handles are pinned on their own
+	bob, err := handledir.NewRecord(mallory, "bob", nil, []byte("seed"), nil)
+	require.NoError(t, err)
+	require.NoError(t, hd.check(testHandleEntry(t, bob)))
+}
@@ -0,0 +1,135 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/pgp"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// IdentityOpenPGPKey returns the account key as an armored OpenPGP
+// certificate, to be signed by the other keys of the user.
+func (s *service) IdentityOpenPGPKey(context.Context) (string, error) {
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return "", errcode.ErrInternal.Wrap(err)
+	}
+
+	accountPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	armored, err := pgp.ExportKey(accountSK, "berty account "+base64.RawURLEncoding.EncodeToString(accountPK), time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return string(armored), nil
+}
+
+// IdentityAttestationStatement returns the statement to sign with an OpenPGP
+// key to attest the account.
+func (s *service) IdentityAttestationStatement(context.Context) (string, error) {
+	accountPK, err := s.ownAccountPK()
+	if err != nil {
+		return "", err
+	}
+
+	return string(pgp.Statement(accountPK)), nil
+}
+
+// IdentityAttestationAdd publishes the signature of the statement of the
+// account by an OpenPGP key in its profile, replacing the previous one of
+// the key. The signature is either detached or the clearsigned statement.
+func (s *service) IdentityAttestationAdd(ctx context.Context, key, signature []byte) (*pgp.Identity, error) {
+	accountPK, err := s.ownAccountPK()
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := pgp.NewAttestation(key, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := a.Verify(accountPK, time.Now())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	op, err := s.ownProfileForUpdate()
+	if err != nil {
+		return nil, err
+	}
+
+	attestations := []*pgp.Attestation{a}
+	for _, other := range op.PGPAttestations {
+		if otherID, _ := other.Verify(accountPK, time.Now()); otherID == nil || otherID.Fingerprint != id.Fingerprint {
+			attestations = append(attestations, other)
+		}
+	}
+
+	if len(attestations) > maxPGPAttestations {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("at most %d OpenPGP attestations", maxPGPAttestations))
+	}
+
+	op.PGPAttestations = attestations
+	if err := s.publishOwnProfile(ctx, op); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// IdentityAttestationRemove removes the attestation of an OpenPGP key from
+// the profile of the account, by fingerprint.
+func (s *service) IdentityAttestationRemove(ctx context.Context, fingerprint string) error {
+	accountPK, err := s.ownAccountPK()
+	if err != nil {
+		return err
+	}
+
+	op, err := s.ownProfileForUpdate()
+	if err != nil {
+		return err
+	}
+
+	fingerprint = strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+	attestations := []*pgp.Attestation{}
+	for _, a := range op.PGPAttestations {
+		if id, _ := a.Verify(accountPK, time.Now()); id == nil || id.Fingerprint != fingerprint {
+			attestations = append(attestations, a)
+		}
+	}
+
+	if len(attestations) == len(op.PGPAttestations) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no attestation of the key %s", fingerprint))
+	}
+
+	op.PGPAttestations = attestations
+
+	return s.publishOwnProfile(ctx, op)
+}
+
+// ownProfileForUpdate returns a copy of the profile of the account dated of
+// now, an empty one if never set.
+func (s *service) ownProfileForUpdate() (*profileOp, error) {
+	current, err := s.contactMeta.ownProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	op := &profileOp{}
+	if current != nil {
+		*op = *current
+	}
+
+	op.At = time.Now().UnixNano()
+
+	return op, nil
+}
@@ -0,0 +1,74 @@
+package bertyprotocol
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/pgp"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// made by GnuPG for the statement of the account of a zero seed
+const (
+	testPGPKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEas8/fBYJKwYBBAHaRw8BAQdANdaS5yawSOUPPvzkuHLzspyd4uh5hj72i4n1
+eFBh0le0GUFsaWNlIDxhbGljZUBleGFtcGxlLmNvbT6IkAQTFggAOBYhBHvJHJ92
+8my7Ti+Lo0USp8ESERc/BQJqzz98AhsDBQsJCAcCBhUKCQgLAgQWAgMBAh4BAheA
+AAoJEEUSp8ESERc/sn4BAKY1WzRzi1/jIet77GfaUawU1jRvNJ0bfqpfHOWcsOb6
+AQCgoNF52mBrzC0WGHVJOODE1p+BTnGB3nhmU9n91lejDw==
+=/lfT
+-----END PGP PUBLIC KEY BLOCK-----`
+
+	testPGPSignature = `-----BEGIN PGP SIGNATURE-----
+
+iIgEABYIADAWIQR7yRyfdvJsu04vi6NFEqfBEhEXPwUCas8/fBIcYWxpY2VAZXhh
+bXBsZS5jb20ACgkQRRKnwRIRFz9NtwEA1gCwxtBecwLKjprGkN6HCc3AUk5b9nu+
+XPz7qgoaYiABALvRoipZVKajKOLtpROoIraZQmP0I4hkTm0Quu5gJLMG
+=Ntd5
+-----END PGP SIGNATURE-----`
+)
+
+func TestProfilePGPAttestations(t *testing.T) {
+	cm, err := newContactMetadatas(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	a, err := pgp.NewAttestation([]byte(testPGPKey), []byte(testPGPSignature))
+	require.NoError(t, err)
+
+	contactPK := []byte(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey))
+	otherPK := make([]byte, ed25519.PublicKeySize)
+	op := &profileOp{DisplayName: "alice", At: time.Now().UnixNano(), PGPAttestations: []*pgp.Attestation{a}}
+
+	for _, pk := range [][]byte{contactPK, otherPK} {
+		ok, err := cm.profileReceived(pk, op)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	// the attestation is only verified for the account of the statement
+	m, err := cm.get(contactPK)
+	require.NoError(t, err)
+	require.Len(t, m.Profile.PGPIdentities, 1)
+	assert.True(t, m.Profile.PGPIdentities[0].Verified)
+	assert.Equal(t, "7BC91C9F76F26CBB4E2F8BA34512A7C11211173F", m.Profile.PGPIdentities[0].Fingerprint)
+	assert.Equal(t, []string{"Alice <alice@example.com>"}, m.Profile.PGPIdentities[0].UserIDs)
+
+	m, err = cm.get(otherPK)
+	require.NoError(t, err)
+	require.Len(t, m.Profile.PGPIdentities, 1)
+	assert.False(t, m.Profile.PGPIdentities[0].Verified)
+
+	tooMany := &profileOp{DisplayName: "alice", At: time.Now().UnixNano()}
+	for i := 0; i <= maxPGPAttestations; i++ {
+		tooMany.PGPAttestations = append(tooMany.PGPAttestations, a)
+	}
+
+	_, err = cm.profileReceived(contactPK, tooMany)
+	assert.Error(t, err)
+}
@@ -0,0 +1,655 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-ipfs/keystore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// identityRotationPrefix marks the app metadata rotating the identity key of
+// an account, sent to the account group and to the contact groups
+const identityRotationPrefix = "\x00berty.rotate/1\x00"
+
+// keyIdentity names the identity keys of the device keystore, by sequence
+const keyIdentity = "identitySK"
+
+// IdentityRotation replaces the identity key of an account, the key signing
+// its statements, e.g. the device revocations. The account key stays the
+// identity of the account in the groups, it is the first key of the chain.
+//
+// A rotation is signed by the key it retires and by the new key, a retired
+// key is still valid for what it signed before its rotation.
+type IdentityRotation struct {
+	AccountPK  []byte `json:"account_pk"`
+	PreviousPK []byte `json:"previous_pk"`
+	NewPK      []byte `json:"new_pk"`
+	Seq        uint64 `json:"seq"`
+	RotatedAt  int64  `json:"rotated_at"`
+}
+
+type signedIdentityRotation struct {
+	Rotation []byte `json:"rotation"`
+
+	// PreviousSig proves the rotation is allowed, NewSig that the new key is
+	// held by the account
+	PreviousSig []byte `json:"previous_sig"`
+	NewSig      []byte `json:"new_sig"`
+}
+
+// sealedIdentityKey is the new identity key sealed for a device of the
+// account.
+type sealedIdentityKey struct {
+	DevicePK []byte `json:"device_pk"`
+	Nonce    []byte `json:"nonce"`
+	Sealed   []byte `json:"sealed"`
+}
+
+// identityRotationPayload is sent to the account group with the new key
+// sealed for each device, the revoked ones excluded. The contacts only get
+// the signed rotation.
+type identityRotationPayload struct {
+	Signed   []byte               `json:"signed"`
+	SenderPK []byte               `json:"sender_pk,omitempty"`
+	Keys     []*sealedIdentityKey `json:"keys,omitempty"`
+}
+
+func signIdentityRotation(previousSK, newSK crypto.PrivKey, accountPK []byte, seq uint64, now time.Time) ([]byte, error) {
+	previousPK, err := previousSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	newPK, err := newSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	data, err := json.Marshal(&IdentityRotation{
+		AccountPK:  accountPK,
+		PreviousPK: previousPK,
+		NewPK:      newPK,
+		Seq:        seq,
+		RotatedAt:  now.UnixNano(),
+	})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	signed := &signedIdentityRotation{Rotation: data}
+	if signed.PreviousSig, err = previousSK.Sign(data); err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	if signed.NewSig, err = newSK.Sign(data); err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	ret, err := json.Marshal(signed)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return ret, nil
+}
+
+func openIdentityRotation(data []byte) (*IdentityRotation, error) {
+	signed := &signedIdentityRotation{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	r := &IdentityRotation{}
+	if err := json.Unmarshal(signed.Rotation, r); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	for _, k := range []struct{ pk, sig []byte }{{r.PreviousPK, signed.PreviousSig}, {r.NewPK, signed.NewSig}} {
+		pk, err := crypto.UnmarshalEd25519PublicKey(k.pk)
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if ok, err := pk.Verify(signed.Rotation, k.sig); err != nil || !ok {
+			return nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid identity rotation signature"))
+		}
+	}
+
+	if r.Seq == 0 || len(r.AccountPK) == 0 || bytes.Equal(r.PreviousPK, r.NewPK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid identity rotation"))
+	}
+
+	return r, nil
+}
+
+// identityChains keeps the identity rotations of the account and of the
+// contacts, each chain starts with the account key. The first rotation of a
+// sequence received wins, a concurrent one is rejected.
+type identityChains struct {
+	logger *zap.Logger
+	store  datastore.Batching
+
+	lock   sync.RWMutex
+	chains map[string][]*IdentityRotation
+}
+
+func identityRotationKey(accountPK []byte, seq uint64) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(accountPK)).ChildString(fmt.Sprintf("%020d", seq))
+}
+
+func newIdentityChains(logger *zap.Logger, store datastore.Batching) (*identityChains, error) {
+	ic := &identityChains{
+		logger: logger,
+		store:  store,
+		chains: make(map[string][]*IdentityRotation),
+	}
+
+	res, err := store.Query(query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		r, err := openIdentityRotation(entry.Value)
+		if err != nil {
+			logger.Warn("invalid identity rotation", zap.Error(err))
+			continue
+		}
+
+		ic.chains[string(r.AccountPK)] = append(ic.chains[string(r.AccountPK)], r)
+	}
+
+	return ic, nil
+}
+
+func (ic *identityChains) headLocked(accountPK []byte) ([]byte, uint64) {
+	chain := ic.chains[string(accountPK)]
+	if len(chain) == 0 {
+		return accountPK, 0
+	}
+
+	last := chain[len(chain)-1]
+	return last.NewPK, last.Seq
+}
+
+// head returns the current identity key of an account and its sequence, the
+// account key until its first rotation.
+func (ic *identityChains) head(accountPK []byte) ([]byte, uint64) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	return ic.headLocked(accountPK)
+}
+
+// add keeps a signed rotation extending the chain of its account, it returns
+// nil if it was already known.
+func (ic *identityChains) add(signed []byte) (*IdentityRotation, error) {
+	r, err := openIdentityRotation(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	chain := ic.chains[string(r.AccountPK)]
+	if r.Seq <= uint64(len(chain)) {
+		if known := chain[r.Seq-1]; bytes.Equal(known.NewPK, r.NewPK) && known.RotatedAt == r.RotatedAt {
+			return nil, nil
+		}
+
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("identity rotation %d already replaced", r.Seq))
+	}
+
+	head, seq := ic.headLocked(r.AccountPK)
+	if r.Seq != seq+1 || !bytes.Equal(r.PreviousPK, head) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("identity rotation %d doesn't extend the chain", r.Seq))
+	}
+
+	if len(chain) > 0 && r.RotatedAt <= chain[len(chain)-1].RotatedAt {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("identity rotation %d older than the previous one", r.Seq))
+	}
+
+	if err := ic.store.Put(identityRotationKey(r.AccountPK, r.Seq), signed); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	ic.chains[string(r.AccountPK)] = append(chain, r)
+
+	return r, nil
+}
+
+// validSigner reports whether a key could sign for an account at a date: the
+// current identity key, or a retired one before its rotation.
+func (ic *identityChains) validSigner(accountPK, signerPK []byte, at time.Time) bool {
+	if ic == nil {
+		return bytes.Equal(accountPK, signerPK)
+	}
+
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	if head, _ := ic.headLocked(accountPK); bytes.Equal(head, signerPK) {
+		return true
+	}
+
+	for _, r := range ic.chains[string(accountPK)] {
+		if bytes.Equal(r.PreviousPK, signerPK) {
+			return at.UnixNano() < r.RotatedAt
+		}
+	}
+
+	return false
+}
+
+func (ic *identityChains) chain(accountPK []byte) []*IdentityRotation {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	return append([]*IdentityRotation{}, ic.chains[string(accountPK)]...)
+}
+
+func identityKeyName(seq uint64) string {
+	return strings.Join([]string{keyIdentity, strconv.FormatUint(seq, 10)}, "_")
+}
+
+// identityPrivKey returns the identity key of a sequence, the account key for
+// the sequence 0.
+func (a *deviceKeystore) identityPrivKey(seq uint64) (crypto.PrivKey, error) {
+	if seq == 0 {
+		return a.AccountPrivKey()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sk, err := a.ks.Get(identityKeyName(seq))
+	if err != nil && err.Error() == keystore.ErrNoSuchKey.Error() {
+		return nil, errcode.ErrMissingMapKey.Wrap(fmt.Errorf("identity key %d not received yet", seq))
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return sk, nil
+}
+
+func (a *deviceKeystore) hasIdentityKey(seq uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	has, err := a.ks.Has(identityKeyName(seq))
+	return err == nil && has
+}
+
+func (a *deviceKeystore) putIdentityKey(seq uint64, sk crypto.PrivKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.ks.Put(identityKeyName(seq), sk); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// identityPrivKey returns the current identity key of the account.
+func (s *service) identityPrivKey() (crypto.PrivKey, error) {
+	_, seq := s.identities.head(s.accountGroup.Group().PublicKey)
+	if seq == 0 {
+		return s.deviceKeystore.AccountPrivKey()
+	}
+
+	ks, ok := s.deviceKeystore.(*deviceKeystore)
+	if !ok {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return ks.identityPrivKey(seq)
+}
+
+// IdentityRotate replaces the identity key of the account with a new one. The
+// rotation is sent with the new key to the other devices of the account, and
+// to the contacts.
+func (s *service) IdentityRotate(ctx context.Context) (*IdentityRotation, error) {
+	ks, ok := s.deviceKeystore.(*deviceKeystore)
+	if !ok {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	accountPK := s.accountGroup.Group().PublicKey
+	_, seq := s.identities.head(accountPK)
+
+	previousSK, err := ks.identityPrivKey(seq)
+	if err != nil {
+		return nil, err
+	}
+
+	newSK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	signed, err := signIdentityRotation(previousSK, newSK, accountPK, seq+1, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// the key is kept first, a rotation known without its key would lock the
+	// device out of its identity
+	if err := ks.putIdentityKey(seq+1, newSK); err != nil {
+		return nil, err
+	}
+
+	r, err := s.identities.add(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	s.auditIdentityRotated(r)
+
+	payload, err := s.sealIdentityKey(signed, newSK)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.accountGroup.MetadataStore().SendAppMetadata(ctx, payload); err != nil {
+		return nil, err
+	}
+
+	s.sendToContacts(ctx, identityRotationMetadata(&identityRotationPayload{Signed: signed}))
+
+	return r, nil
+}
+
+func (s *service) auditIdentityRotated(r *IdentityRotation) {
+	s.audit.add(&securityRecord{Type: SecurityIdentityRotated, ContactPK: r.AccountPK, Details: fmt.Sprintf("rotation %d", r.Seq)})
+}
+
+func identityRotationMetadata(p *identityRotationPayload) []byte {
+	data, _ := json.Marshal(p)
+	return append([]byte(identityRotationPrefix), data...)
+}
+
+// sealIdentityKey seals a new identity key for the other devices of the
+// account which are not revoked.
+func (s *service) sealIdentityKey(signed []byte, newSK crypto.PrivKey) ([]byte, error) {
+	deviceSK, err := s.deviceKeystore.DevicePrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	senderPK, err := deviceSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	raw, err := newSK.Bytes()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+	defer cryptoutil.Wipe(raw)
+
+	p := &identityRotationPayload{Signed: signed, SenderPK: senderPK}
+	for _, pk := range s.accountGroup.MetadataStore().ListDevices() {
+		devicePK, err := pk.Raw()
+		if err != nil || bytes.Equal(devicePK, senderPK) || s.revocations.isRevoked(s.accountGroup.Group().PublicKey, devicePK) {
+			continue
+		}
+
+		mongPriv, mongPub, err := cryptoutil.EdwardsToMontgomery(deviceSK, pk)
+		if err != nil {
+			return nil, errcode.ErrCryptoKeyConversion.Wrap(err)
+		}
+
+		nonce, err := cryptoutil.GenerateNonce()
+		if err != nil {
+			return nil, errcode.ErrCryptoNonceGeneration.Wrap(err)
+		}
+
+		p.Keys = append(p.Keys, &sealedIdentityKey{
+			DevicePK: devicePK,
+			Nonce:    nonce[:],
+			Sealed:   box.Seal(nil, raw, nonce, mongPub, mongPriv),
+		})
+		cryptoutil.WipeKey(mongPriv)
+	}
+
+	return identityRotationMetadata(p), nil
+}
+
+// openIdentityKey opens the identity key sealed for this device.
+func (s *service) openIdentityKey(p *identityRotationPayload, r *IdentityRotation) (crypto.PrivKey, error) {
+	deviceSK, err := s.deviceKeystore.DevicePrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	ownPK, err := deviceSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	for _, k := range p.Keys {
+		if !bytes.Equal(k.DevicePK, ownPK) {
+			continue
+		}
+
+		senderPK, err := crypto.UnmarshalEd25519PublicKey(p.SenderPK)
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		nonce, err := cryptoutil.NonceSliceToArray(k.Nonce)
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		mongPriv, mongPub, err := cryptoutil.EdwardsToMontgomery(deviceSK, senderPK)
+		if err != nil {
+			return nil, errcode.ErrCryptoKeyConversion.Wrap(err)
+		}
+
+		raw, ok := box.Open(nil, k.Sealed, nonce, mongPub, mongPriv)
+		cryptoutil.WipeKey(mongPriv)
+		if !ok {
+			return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open identity key"))
+		}
+
+		sk, err := crypto.UnmarshalPrivateKey(raw)
+		cryptoutil.Wipe(raw)
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if pk, err := sk.GetPublic().Raw(); err != nil || !bytes.Equal(pk, r.NewPK) {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("identity key doesn't match its rotation"))
+		}
+
+		return sk, nil
+	}
+
+	return nil, nil
+}
+
+// sendToContacts sends an app metadata to the contact groups opened, the
+// others get it once the contact syncs with another device of the account.
+func (s *service) sendToContacts(ctx context.Context, payload []byte) {
+	s.lock.RLock()
+	contacts := []*groupContext{}
+	for _, gc := range s.openedGroups {
+		if gc.Group().GroupType == bertytypes.GroupTypeContact {
+			contacts = append(contacts, gc)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, gc := range contacts {
+		if _, err := gc.MetadataStore().SendAppMetadata(ctx, payload); err != nil {
+			s.logger.Warn("unable to send to contact", zap.Error(err))
+		}
+	}
+}
+
+// applyIdentityRotation keeps the rotations of the metadata of a group, the
+// account group rotates the identity of the account, a contact group the
+// identity of the contact.
+func (s *service) applyIdentityRotation(gc *groupContext, evt *bertytypes.GroupMetadataEvent) {
+	if evt == nil || evt.Metadata == nil || evt.Metadata.EventType != bertytypes.EventTypeGroupMetadataPayloadSent {
+		return
+	}
+
+	am := &bertytypes.AppMetadata{}
+	if err := am.Unmarshal(evt.Event); err != nil || !bytes.HasPrefix(am.Message, []byte(identityRotationPrefix)) {
+		return
+	}
+
+	p := &identityRotationPayload{}
+	if err := json.Unmarshal(am.Message[len(identityRotationPrefix):], p); err != nil {
+		s.logger.Debug("invalid identity rotation", zap.Error(err))
+		return
+	}
+
+	r, err := openIdentityRotation(p.Signed)
+	if err != nil {
+		s.logger.Debug("invalid identity rotation", zap.Error(err))
+		return
+	}
+
+	ownPK := s.accountGroup.Group().PublicKey
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		if !bytes.Equal(r.AccountPK, ownPK) {
+			return
+		}
+
+		// the key is kept even for a rotation already known, it may be sent
+		// again for a device linked after the rotation
+		ks, ok := s.deviceKeystore.(*deviceKeystore)
+		if ok && !ks.hasIdentityKey(r.Seq) {
+			sk, err := s.openIdentityKey(p, r)
+			if err != nil {
+				s.logger.Warn("unable to open identity key", zap.Error(err))
+				return
+			}
+
+			if sk != nil {
+				if err := ks.putIdentityKey(r.Seq, sk); err != nil {
+					s.logger.Warn("unable to keep identity key", zap.Error(err))
+					return
+				}
+			}
+		}
+	} else if bytes.Equal(r.AccountPK, ownPK) || !s.isGroupMember(gc, r.AccountPK) {
+		return
+	}
+
+	if r, err = s.identities.add(p.Signed); err != nil {
+		s.logger.Warn("unable to keep identity rotation", zap.Error(err))
+	} else if r != nil {
+		s.logger.Info("identity rotated", zap.Binary("account", r.AccountPK), zap.Uint64("seq", r.Seq))
+		s.auditIdentityRotated(r)
+	}
+}
+
+// watchIdentityRotations applies the rotations of a group, the ones sent
+// while the device was offline are applied from the history first.
+func (s *service) watchIdentityRotations(ctx context.Context, gc *groupContext) {
+	sub := gc.metadataStore.Subscribe(ctx)
+
+	for evt := range gc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		s.applyIdentityRotation(gc, evt)
+	}
+
+	for e := range sub {
+		evt, ok := e.(*bertytypes.GroupMetadataEvent)
+		if !ok {
+			continue
+		}
+
+		s.applyIdentityRotation(gc, evt)
+
+		if gc.Group().GroupType == bertytypes.GroupTypeAccount && evt.Metadata != nil && evt.Metadata.EventType == bertytypes.EventTypeGroupMemberDeviceAdded {
+			go s.shareIdentityKey(ctx)
+		}
+	}
+}
+
+// shareIdentityKey sends again the current identity key sealed for the
+// devices of the account, e.g. for a device linked after the rotation.
+func (s *service) shareIdentityKey(ctx context.Context) {
+	accountPK := s.accountGroup.Group().PublicKey
+	_, seq := s.identities.head(accountPK)
+	if seq == 0 {
+		return
+	}
+
+	ks, ok := s.deviceKeystore.(*deviceKeystore)
+	if !ok || !ks.hasIdentityKey(seq) {
+		return
+	}
+
+	sk, err := ks.identityPrivKey(seq)
+	if err != nil {
+		return
+	}
+
+	signed, err := s.identities.store.Get(identityRotationKey(accountPK, seq))
+	if err != nil {
+		s.logger.Warn("unable to read identity rotation", zap.Error(err))
+		return
+	}
+
+	payload, err := s.sealIdentityKey(signed, sk)
+	if err != nil {
+		s.logger.Warn("unable to seal identity key", zap.Error(err))
+		return
+	}
+
+	if _, err := s.accountGroup.MetadataStore().SendAppMetadata(ctx, payload); err != nil {
+		s.logger.Warn("unable to share identity key", zap.Error(err))
+	}
+}
+
+// IdentityChain returns the identity rotations of an account, the own
+// account if accountPK is empty, the oldest first.
+func (s *service) IdentityChain(_ context.Context, accountPK []byte) ([]*IdentityRotation, error) {
+	if len(accountPK) == 0 {
+		accountPK = s.accountGroup.Group().PublicKey
+	}
+
+	return s.identities.chain(accountPK), nil
+}
+
+// IdentityKeyValid reports whether a key could sign for an account at a
+// date, the old signatures staying valid after a rotation.
+func (s *service) IdentityKeyValid(_ context.Context, accountPK, signerPK []byte, at time.Time) (bool, error) {
+	if len(accountPK) == 0 || len(signerPK) == 0 {
+		return false, errcode.ErrInvalidInput
+	}
+
+	return s.identities.validSigner(accountPK, signerPK, at), nil
+}
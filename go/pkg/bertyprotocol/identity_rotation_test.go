@@ -0,0 +1,108 @@
+package bertyprotocol
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIdentityChains(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	ic, err := newIdentityChains(zap.NewNop(), store)
+	require.NoError(t, err)
+
+	genKey := func() (crypto.PrivKey, []byte) {
+		sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		require.NoError(t, err)
+
+		pk, err := sk.GetPublic().Raw()
+		require.NoError(t, err)
+
+		return sk, pk
+	}
+
+	accountSK, accountPK := genKey()
+	key1, pk1 := genKey()
+	key2, pk2 := genKey()
+
+	head, seq := ic.head(accountPK)
+	assert.Equal(t, accountPK, head)
+	assert.Equal(t, uint64(0), seq)
+
+	t0 := time.Now()
+	signed1, err := signIdentityRotation(accountSK, key1, accountPK, 1, t0)
+	require.NoError(t, err)
+
+	r, err := ic.add(signed1)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	head, seq = ic.head(accountPK)
+	assert.Equal(t, pk1, head)
+	assert.Equal(t, uint64(1), seq)
+
+	// a rotation is only applied once
+	r, err = ic.add(signed1)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	// a concurrent rotation of the same sequence is rejected
+	forked, err := signIdentityRotation(accountSK, key2, accountPK, 1, t0.Add(time.Second))
+	require.NoError(t, err)
+	_, err = ic.add(forked)
+	assert.Error(t, err)
+
+	// the retired key can't rotate the identity anymore
+	stale, err := signIdentityRotation(accountSK, key2, accountPK, 2, t0.Add(time.Second))
+	require.NoError(t, err)
+	_, err = ic.add(stale)
+	assert.Error(t, err)
+
+	signed2, err := signIdentityRotation(key1, key2, accountPK, 2, t0.Add(time.Minute))
+	require.NoError(t, err)
+	_, err = ic.add(signed2)
+	require.NoError(t, err)
+
+	// the old keys are valid for what they signed before their rotation
+	assert.True(t, ic.validSigner(accountPK, accountPK, t0.Add(-time.Second)))
+	assert.False(t, ic.validSigner(accountPK, accountPK, t0.Add(time.Second)))
+	assert.True(t, ic.validSigner(accountPK, pk1, t0.Add(time.Second)))
+	assert.False(t, ic.validSigner(accountPK, pk1, t0.Add(time.Hour)))
+	assert.True(t, ic.validSigner(accountPK, pk2, t0.Add(time.Hour)))
+	assert.False(t, ic.validSigner(pk1, pk2, t0))
+
+	// the chains are kept
+	ic, err = newIdentityChains(zap.NewNop(), store)
+	require.NoError(t, err)
+	head, seq = ic.head(accountPK)
+	assert.Equal(t, pk2, head)
+	assert.Equal(t, uint64(2), seq)
+	assert.Len(t, ic.chain(accountPK), 2)
+
+	// the device revocations are signed by the identity key
+	dr, err := newDeviceRevocations(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, err)
+
+	revocation, err := signDeviceRevocation(key2, &DeviceRevocation{AccountPK: accountPK, DevicePK: []byte("phone")}, time.Now())
+	require.NoError(t, err)
+
+	_, err = dr.add(revocation)
+	assert.Error(t, err)
+
+	dr.identities = ic
+	_, err = dr.add(revocation)
+	require.NoError(t, err)
+	assert.True(t, dr.isRevoked(accountPK, []byte("phone")))
+
+	// a retired key can't sign a revocation
+	revocation, err = signDeviceRevocation(key1, &DeviceRevocation{AccountPK: accountPK, DevicePK: []byte("laptop")}, time.Now())
+	require.NoError(t, err)
+	_, err = dr.add(revocation)
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+package bertyprotocol
+
+import (
+	bertymetrics "berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+)
+
+// IncomingPayloadObserver is called with the app messages received from the
+// other devices, once decrypted.
+type IncomingPayloadObserver func(groupPK []byte, payload []byte)
+
+// SetIncomingPayloadObserver replaces the observer of the incoming app
+// messages, nil removes it.
+func (s *service) SetIncomingPayloadObserver(f IncomingPayloadObserver) {
+	s.muIncomingObserver.Lock()
+	s.incomingObserver = f
+	s.muIncomingObserver.Unlock()
+}
+
+func (s *service) observeIncoming(g *bertytypes.Group, evt *bertytypes.GroupMessageEvent) {
+	s.muIncomingObserver.RLock()
+	f := s.incomingObserver
+	s.muIncomingObserver.RUnlock()
+
+	if evt.Headers == nil {
+		return
+	}
+
+	// the messages sent by the device are emitted too
+	if s.isOwnDevice(g, evt.Headers.DevicePK) {
+		return
+	}
+
+	s.metrics.RecordMessage(bertymetrics.DirectionReceived)
+	s.publishMessageReceived(g, evt)
+
+	if f == nil {
+		return
+	}
+
+	f(g.PublicKey, evt.Message)
+}
@@ -0,0 +1,74 @@
+package bertyprotocol
+
+import (
+	"context"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+const invitationPeerTag = "invitation"
+
+// InvitationCreate issues a single-use invitation to connect to the device,
+// valid for the given duration, and returns its deep link.
+func (s *service) InvitationCreate(ctx context.Context, ttl time.Duration) (string, error) {
+	if s.invitations == nil {
+		return "", errcode.ErrNotImplemented
+	}
+
+	_, encoded, err := s.invitations.Issue(ttl, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return ipfsutil.InvitationURL(encoded), nil
+}
+
+// InvitationRedeem connects to the issuer of an invitation deep link and
+// redeems it, it returns the peer of the issuer.
+func (s *service) InvitationRedeem(ctx context.Context, link string) (peer.ID, error) {
+	if s.invitations == nil {
+		return "", errcode.ErrNotImplemented
+	}
+
+	encoded, err := ipfsutil.ParseInvitationURL(link)
+	if err != nil {
+		return "", err
+	}
+
+	inv, err := s.invitations.Redeem(ctx, encoded)
+	if err != nil {
+		return "", err
+	}
+
+	s.invitationRedeemed(inv.PeerID, inv)
+
+	return inv.PeerID, nil
+}
+
+// invitationRedeemed keeps the connection between the issuer and the
+// redeemer of an invitation until it expires.
+func (s *service) invitationRedeemed(p peer.ID, inv *ipfsutil.Invitation) {
+	s.ipfsCoreAPI.ConnMgr().TagPeer(p, invitationPeerTag, 42)
+	s.logger.Info("invitation redeemed", zap.Stringer("peer", p), zap.Time("expires", inv.ExpiresAt()))
+}
+
+func (s *service) expireInvitations(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := s.invitations.Expire(time.Now()); err != nil {
+			s.logger.Warn("unable to expire invitations", zap.Error(err))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -24,6 +24,7 @@ type DeviceKeystore interface {
 	DevicePrivKey() (crypto.PrivKey, error)
 	ContactGroupPrivKey(pk crypto.PubKey) (crypto.PrivKey, error)
 	MemberDeviceForGroup(g *bertytypes.Group) (*ownMemberDevice, error)
+	ForgetGroup(groupPK crypto.PubKey) error
 }
 
 type deviceKeystore struct {
@@ -122,6 +123,46 @@ func (a *deviceKeystore) MemberDeviceForGroup(g *bertytypes.Group) (*ownMemberDe
 	return nil, errcode.ErrInvalidInput
 }
 
+// ForgetGroup deletes the member and device keys generated for a multi member
+// group, they can't be recovered afterwards
+func (a *deviceKeystore) ForgetGroup(groupPK crypto.PubKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	groupPKRaw, err := groupPK.Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	for _, nameSpace := range []string{keyMember, keyMemberDevice} {
+		name := strings.Join([]string{nameSpace, hex.EncodeToString(groupPKRaw)}, "_")
+		if err := a.ks.Delete(name); err != nil && err.Error() != keystore.ErrNoSuchKey.Error() {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// importAccountKeys replaces the account keys of the device with the ones of
+// the account it is linked to, the account group is opened on the next start
+func (a *deviceKeystore) importAccountKeys(accountSK, proofSK crypto.PrivKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for name, sk := range map[string]crypto.PrivKey{keyAccount: accountSK, keyAccountProof: proofSK} {
+		if err := a.ks.Delete(name); err != nil && err.Error() != keystore.ErrNoSuchKey.Error() {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		if err := a.ks.Put(name, sk); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
 func (a *deviceKeystore) getOrGenerateNamedKey(name string) (crypto.PrivKey, error) {
 	sk, err := a.ks.Get(name)
 	if err == nil {
@@ -180,7 +221,10 @@ func (a *deviceKeystore) getOrComputeECDH(nameSpace string, pk crypto.PubKey, ow
 	}
 
 	secret := ecdh.X25519().ComputeSecret(skB, pkB)
+	cryptoutil.WipeKey(skB)
+
 	groupSK := ed25519.NewKeyFromSeed(secret)
+	cryptoutil.Wipe(secret)
 
 	sk, _, err = crypto.KeyPairFromStdKey(&groupSK)
 	if err != nil {
@@ -1,10 +1,15 @@
 package bertyprotocol
 
 import (
+	"bytes"
 	"testing"
 
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
 	keystore "github.com/ipfs/go-ipfs-keystore"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_New_AccountPrivKey_AccountProofPrivKey(t *testing.T) {
@@ -171,3 +176,50 @@ func Test_MemberDeviceForGroup_multimember(t *testing.T) {
 	assert.Equal(t, omd1MB, omd2MB)
 	assert.NotEqual(t, omd1DB, omd2DB)
 }
+
+func Test_WrappedKeystore(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+
+	// keys stored before the keystore was wrapped
+	sk1, err := NewDeviceKeystore(ipfsutil.NewDatastoreKeystore(store)).AccountPrivKey()
+	require.NoError(t, err)
+
+	raw, err := store.Get(datastore.NewKey(keyAccount))
+	require.NoError(t, err)
+
+	w, err := ipfsutil.NewSoftwareKeyWrapper(make([]byte, 32))
+	require.NoError(t, err)
+
+	count, err := ipfsutil.WrapKeystoreKeys(store, w)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	wrapped, err := store.Get(datastore.NewKey(keyAccount))
+	require.NoError(t, err)
+	assert.NotEqual(t, raw, wrapped)
+
+	// the wrapped keys are not wrapped again
+	count, err = ipfsutil.WrapKeystoreKeys(store, w)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	acc := NewDeviceKeystore(ipfsutil.NewWrappedKeystore(store, w))
+	sk2, err := acc.AccountPrivKey()
+	require.NoError(t, err)
+	assert.True(t, sk1.Equals(sk2))
+
+	// a key is bound to its name
+	require.NoError(t, store.Put(datastore.NewKey(keyDevice), wrapped))
+	_, err = acc.DevicePrivKey()
+	assert.Error(t, err)
+
+	// another wrapper can't unwrap the keys
+	other, err := ipfsutil.NewSoftwareKeyWrapper(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+
+	_, err = NewDeviceKeystore(ipfsutil.NewWrappedKeystore(store, other)).AccountPrivKey()
+	assert.Error(t, err)
+
+	_, err = ipfsutil.NewSoftwareKeyWrapper(make([]byte, 16))
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package bertyprotocol
 
 import (
 	"context"
+	"encoding/hex"
 	"sync"
 
 	"fmt"
@@ -11,11 +12,16 @@ import (
 	"berty.tech/berty/v2/go/pkg/errcode"
 	cid "github.com/ipfs/go-cid"
 	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+// deviceSecretRotationGap is the counter increment of a rotated device
+// secret, far above the count of the precomputed keys.
+const deviceSecretRotationGap = 1 << 20
+
 type MessageKeystore struct {
 	lock                 sync.Mutex
 	preComputedKeysCount int
@@ -175,8 +181,9 @@ func (m *MessageKeystore) registerChainKey(g *bertytypes.Group, devicePK crypto.
 
 	var err error
 
-	if _, err := m.getDeviceChainKey(devicePK); err == nil {
-		// device is already registered, ignore it
+	// device is already registered, ignore it unless the secret was rotated,
+	// a rotated secret starts after the known counter
+	if known, err := m.getDeviceChainKey(devicePK); err == nil && ds.Counter <= known.Counter {
 		return nil
 	}
 
@@ -207,6 +214,7 @@ func (m *MessageKeystore) preComputeKeys(device crypto.PubKey, g *bertytypes.Gro
 
 	ck := ds.ChainKey
 	counter := ds.Counter
+	derived := false
 
 	knownCK, err := m.getDeviceChainKey(device)
 	if err != nil && !errcode.Is(err, errcode.ErrMissingInput) {
@@ -220,6 +228,7 @@ func (m *MessageKeystore) preComputeKeys(device crypto.PubKey, g *bertytypes.Gro
 		if err != nil && !errcode.Is(err, errcode.ErrMissingInput) {
 			return nil, errcode.ErrInternal.Wrap(err)
 		}
+		cryptoutil.WipeKey(knownMK)
 
 		if knownMK != nil && knownCK != nil {
 			if knownCK.Counter != counter-1 {
@@ -234,11 +243,17 @@ func (m *MessageKeystore) preComputeKeys(device crypto.PubKey, g *bertytypes.Gro
 		}
 
 		err = m.putPrecomputedKey(device, counter, &mk)
+		cryptoutil.WipeKey(&mk)
 		if err != nil {
 			return nil, errcode.TODO.Wrap(err)
 		}
 
-		ck = newCK
+		// the initial chain key belongs to the caller
+		if derived {
+			cryptoutil.Wipe(ck)
+		}
+
+		ck, derived = newCK, true
 	}
 
 	return &bertytypes.DeviceSecret{
@@ -288,7 +303,9 @@ func (m *MessageKeystore) putPrecomputedKey(device crypto.PubKey, counter uint64
 
 	id := idForCachedKey(deviceRaw, counter)
 
-	if err := m.store.Put(id, mk[:]); err != nil {
+	// the in memory datastores keep the given slice, the key is wiped by the
+	// caller
+	if err := m.store.Put(id, append([]byte(nil), mk[:]...)); err != nil {
 		return errcode.ErrMessageKeyPersistencePut.Wrap(err)
 	}
 
@@ -304,7 +321,7 @@ func (m *MessageKeystore) putKeyForCID(id cid.Cid, key *[32]byte) error {
 		return nil
 	}
 
-	err := m.store.Put(idForCID(id), key[:])
+	err := m.store.Put(idForCID(id), append([]byte(nil), key[:]...))
 	if err != nil {
 		return errcode.ErrMessageKeyPersistencePut.Wrap(err)
 	}
@@ -330,6 +347,9 @@ func (m *MessageKeystore) OpenEnvelope(ctx context.Context, g *bertytypes.Group,
 		return nil, nil, errcode.ErrCryptoDecrypt.Wrap(err)
 	}
 
+	// the message key is persisted by the post decrypt actions
+	defer cryptoutil.WipeKey(decryptInfo.MK)
+
 	if err := m.postDecryptActions(decryptInfo, g, ownPK, headers); err != nil {
 		return nil, nil, errcode.TODO.Wrap(err)
 	}
@@ -484,7 +504,10 @@ func (m *MessageKeystore) deriveDeviceSecret(g *bertytypes.Group, deviceSK crypt
 		return errcode.ErrCryptoKeyGeneration.Wrap(err)
 	}
 
-	if err = m.putPrecomputedKey(deviceSK.GetPublic(), ds.Counter+1, &mk); err != nil {
+	err = m.putPrecomputedKey(deviceSK.GetPublic(), ds.Counter+1, &mk)
+	cryptoutil.WipeKey(&mk)
+	cryptoutil.Wipe(ds.ChainKey)
+	if err != nil {
 		return errcode.ErrMessageKeyPersistencePut.Wrap(err)
 	}
 
@@ -512,6 +535,135 @@ func (m *MessageKeystore) updateCurrentKey(pk crypto.PubKey, ds *bertytypes.Devi
 	return nil
 }
 
+// RotateDeviceSecret replaces the chain key of the device by a new one, the
+// messages sealed afterwards can only be opened by the members receiving the
+// new secret. The counter jumps by deviceSecretRotationGap so the new chain
+// never overlaps the keys precomputed by the other devices for the old one.
+func (m *MessageKeystore) RotateDeviceSecret(deviceSK crypto.PrivKey) (*bertytypes.DeviceSecret, error) {
+	if m == nil || deviceSK == nil {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	current, err := m.getDeviceChainKey(deviceSK.GetPublic())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	ds, err := newDeviceSecret()
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	ds.Counter = current.Counter + deviceSecretRotationGap
+	cryptoutil.Wipe(current.ChainKey)
+
+	if err := m.putDeviceChainKey(deviceSK.GetPublic(), ds); err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// IsRotatedFor reports whether the secret of the device was rotated since the
+// given removal of a member, i.e. the operation which removed it.
+func (m *MessageKeystore) IsRotatedFor(device crypto.PubKey, removalID []byte) (bool, error) {
+	if m == nil {
+		return false, errcode.ErrInvalidInput
+	}
+
+	deviceRaw, err := device.Raw()
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	ok, err := m.store.Has(idForRotation(deviceRaw, removalID))
+	if err != nil {
+		return false, errcode.ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	return ok, nil
+}
+
+// MarkRotatedFor records that the secret of the device was rotated since the
+// given removal of a member.
+func (m *MessageKeystore) MarkRotatedFor(device crypto.PubKey, removalID []byte) error {
+	if m == nil {
+		return errcode.ErrInvalidInput
+	}
+
+	deviceRaw, err := device.Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := m.store.Put(idForRotation(deviceRaw, removalID), []byte{}); err != nil {
+		return errcode.ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	return nil
+}
+
+// ForgetDevice deletes the chain key and the precomputed message keys of a
+// device
+func (m *MessageKeystore) ForgetDevice(device crypto.PubKey) error {
+	if m == nil {
+		return errcode.ErrInvalidInput
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	deviceRaw, err := device.Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := m.store.Delete(idForCurrentCK(deviceRaw)); err != nil && err != datastore.ErrNotFound {
+		return errcode.ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	results, err := m.store.Query(query.Query{
+		Prefix:   datastore.KeyWithNamespaces([]string{"cachedCKs", hex.EncodeToString(deviceRaw)}).String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return errcode.ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return errcode.ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		if err := m.store.Delete(datastore.NewKey(entry.Key)); err != nil && err != datastore.ErrNotFound {
+			return errcode.ErrMessageKeyPersistencePut.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// ForgetMessage deletes the key of an already decrypted message
+func (m *MessageKeystore) ForgetMessage(id cid.Cid) error {
+	if m == nil {
+		return errcode.ErrInvalidInput
+	}
+
+	if !id.Defined() {
+		return nil
+	}
+
+	if err := m.store.Delete(idForCID(id)); err != nil && err != datastore.ErrNotFound {
+		return errcode.ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	return nil
+}
+
 // NewMessageKeystore instantiate a new MessageKeystore
 func NewMessageKeystore(s datastore.Datastore) *MessageKeystore {
 	return &MessageKeystore{
@@ -35,6 +35,7 @@ func sealPayload(payload []byte, ds *bertytypes.DeviceSecret, deviceSK crypto.Pr
 	if _, msgKey, err = deriveNextKeys(ds.ChainKey, nil, g.GetPublicKey()); err != nil {
 		return nil, nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
 	}
+	defer cryptoutil.WipeKey(&msgKey)
 
 	return secretbox.Seal(nil, payload, uint64AsNonce(ds.Counter+1), &msgKey), sig, nil
 }
@@ -109,6 +110,9 @@ func openEnvelopeHeaders(data []byte, g *bertytypes.Group) (*bertytypes.MessageE
 		return nil, nil, errcode.ErrCryptoDecrypt
 	}
 
+	// the unmarshaled headers don't share the decrypted buffer
+	defer cryptoutil.Wipe(headersBytes)
+
 	headers := &bertytypes.MessageHeaders{}
 	if err := headers.Unmarshal(headersBytes); err != nil {
 		return nil, nil, errcode.ErrDeserialization.Wrap(err)
@@ -131,6 +135,7 @@ func deriveNextKeys(ck []byte, salt []byte, groupID []byte) ([]byte, [32]byte, e
 	if len(prk) == 0 {
 		return nil, nextMsg, errcode.ErrInternal
 	}
+	defer cryptoutil.Wipe(prk)
 
 	// Expand using extracted prk and groupID as info (kind of namespace)
 	kdf := hkdf.Expand(hash, prk, groupID)
@@ -146,9 +151,8 @@ func deriveNextKeys(ck []byte, salt []byte, groupID []byte) ([]byte, [32]byte, e
 		return nil, nextMsg, errcode.ErrCryptoKeyGeneration.Wrap(err)
 	}
 
-	for i, b := range nextMsgSlice {
-		nextMsg[i] = b
-	}
+	copy(nextMsg[:], nextMsgSlice)
+	cryptoutil.Wipe(nextMsgSlice)
 
 	return nextCK, nextMsg, nil
 }
@@ -161,6 +165,10 @@ func idForCurrentCK(pk []byte) datastore.Key {
 	return datastore.KeyWithNamespaces([]string{"currentCKs", hex.EncodeToString(pk)})
 }
 
+func idForRotation(pk []byte, removalID []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{"rotations", hex.EncodeToString(pk), hex.EncodeToString(removalID)})
+}
+
 func idForCID(id cid.Cid) datastore.Key {
 	// TODO: specify the id
 	return datastore.KeyWithNamespaces([]string{"cid", id.String()})
@@ -358,6 +358,62 @@ func Test_EncryptMessageEnvelopeAndDerive(t *testing.T) {
 	}
 }
 
+func TestMessageKeystoreRotateDeviceSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	assert.NoError(t, err)
+
+	omd1, err := NewDeviceKeystore(keystore.NewMemKeystore()).MemberDeviceForGroup(g)
+	assert.NoError(t, err)
+
+	ds1, err := newDeviceSecret()
+	assert.NoError(t, err)
+
+	sender, member, removed := NewInMemMessageKeystore(), NewInMemMessageKeystore(), NewInMemMessageKeystore()
+	assert.NoError(t, sender.RegisterChainKey(g, omd1.device.GetPublic(), ds1, true))
+	assert.NoError(t, member.RegisterChainKey(g, omd1.device.GetPublic(), ds1, false))
+	assert.NoError(t, removed.RegisterChainKey(g, omd1.device.GetPublic(), ds1, false))
+
+	before, err := sender.SealEnvelope(ctx, g, omd1.device, []byte("before"))
+	assert.NoError(t, err)
+
+	rotated, err := sender.IsRotatedFor(omd1.device.GetPublic(), []byte("removed"))
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+
+	ds2, err := sender.RotateDeviceSecret(omd1.device)
+	assert.NoError(t, err)
+	assert.NoError(t, sender.MarkRotatedFor(omd1.device.GetPublic(), []byte("removed")))
+
+	rotated, err = sender.IsRotatedFor(omd1.device.GetPublic(), []byte("removed"))
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+
+	// the new secret is only sent to the current members
+	assert.NoError(t, member.RegisterChainKey(g, omd1.device.GetPublic(), ds2, false))
+
+	// registering the initial secret again doesn't undo the rotation
+	assert.NoError(t, member.RegisterChainKey(g, omd1.device.GetPublic(), ds1, false))
+
+	after, err := sender.SealEnvelope(ctx, g, omd1.device, []byte("after"))
+	assert.NoError(t, err)
+
+	for _, mks := range []*MessageKeystore{member, removed} {
+		_, payload, err := mks.OpenEnvelope(ctx, g, nil, before, cid.Undef)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("before"), payload)
+	}
+
+	_, payload, err := member.OpenEnvelope(ctx, g, nil, after, cid.Undef)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("after"), payload)
+
+	_, _, err = removed.OpenEnvelope(ctx, g, nil, after, cid.Undef)
+	assert.Error(t, err)
+}
+
 func testMessageKeyHolderCatchUp(t *testing.T, expectedNewDevices int, isSlow bool) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -0,0 +1,590 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const locationProtocolID = protocol.ID("/berty/location/1.0.0")
+
+const (
+	// LocationPayloadType is the type of the JSON app message sharing a
+	// location, a pin or the start of a live share.
+	LocationPayloadType = "Location"
+
+	// MaxLiveLocationDuration caps the duration of a live share.
+	MaxLiveLocationDuration = 8 * time.Hour
+
+	// liveLocationInterval is the minimum interval between two updates of a
+	// share, the other ones are dropped
+	liveLocationInterval = 5 * time.Second
+
+	// locationMaxAge refuses the updates replayed later
+	locationMaxAge = 30 * time.Second
+
+	locationSendTimeout   = 5 * time.Second
+	maxLocationSignalSize = 4 << 10
+)
+
+// Location is a point, its accuracy is in meters.
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Accuracy  float64 `json:"accuracy,omitempty"`
+}
+
+func (l *Location) validate() error {
+	switch {
+	case l == nil:
+		return errcode.ErrMissingInput
+	case math.IsNaN(l.Latitude) || l.Latitude < -90 || l.Latitude > 90:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid latitude"))
+	case math.IsNaN(l.Longitude) || l.Longitude < -180 || l.Longitude > 180:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid longitude"))
+	case math.IsNaN(l.Accuracy) || l.Accuracy < 0:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid accuracy"))
+	}
+
+	return nil
+}
+
+// locationPayload is the app message sharing a location, ExpiresDate is
+// only set for a live share.
+type locationPayload struct {
+	Type string `json:"type"`
+	Location
+	ExpiresDate int64 `json:"expiresDate,omitempty"`
+	SentDate    int64 `json:"sentDate"`
+}
+
+// LiveLocation is the last location of a live share.
+type LiveLocation struct {
+	GroupPK  []byte `json:"group_pk"`
+	DevicePK []byte `json:"device_pk"`
+
+	// ShareID is the ID of the message starting the share
+	ShareID []byte `json:"share_id"`
+
+	Location  *Location `json:"location"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Expires   time.Time `json:"expires"`
+}
+
+// EvtLiveLocationChanged is emitted on the event bus of the host when a
+// device of a conversation updates its live location, or once the share is
+// stopped or expires, Location is nil then.
+type EvtLiveLocationChanged struct {
+	GroupPK  []byte
+	DevicePK []byte
+	ShareID  []byte
+	Location *Location
+}
+
+// locationSignal is only sent over the open connections, it is never queued
+// nor persisted. The update is sealed with the secret of the group, only its
+// members read it.
+type locationSignal struct {
+	GroupPK []byte `json:"group_pk"`
+	Sealed  []byte `json:"sealed"`
+}
+
+// locationUpdate is sealed in a locationSignal, Location is nil when the
+// share is stopped.
+type locationUpdate struct {
+	ShareID  []byte    `json:"share_id"`
+	DevicePK []byte    `json:"device_pk"`
+	Location *Location `json:"location,omitempty"`
+	Expires  int64     `json:"expires"`
+	SentAt   int64     `json:"sent_at"`
+	Sig      []byte    `json:"sig"`
+}
+
+func (u *locationUpdate) signedBytes(groupPK []byte) []byte {
+	buf := make([]byte, 41)
+	binary.BigEndian.PutUint64(buf, uint64(u.SentAt))
+	binary.BigEndian.PutUint64(buf[8:], uint64(u.Expires))
+	if u.Location != nil {
+		binary.BigEndian.PutUint64(buf[16:], math.Float64bits(u.Location.Latitude))
+		binary.BigEndian.PutUint64(buf[24:], math.Float64bits(u.Location.Longitude))
+		binary.BigEndian.PutUint64(buf[32:], math.Float64bits(u.Location.Accuracy))
+		buf[40] = 1
+	}
+
+	return bytes.Join([][]byte{[]byte("berty location"), groupPK, u.ShareID, buf}, nil)
+}
+
+func sealLocationUpdate(g *bertytypes.Group, u *locationUpdate) (*locationSignal, error) {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	secret, err := g.GetSharedSecret()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	return &locationSignal{
+		GroupPK: g.PublicKey,
+		Sealed:  secretbox.Seal(nonce[:], data, nonce, secret),
+	}, nil
+}
+
+func openLocationUpdate(g *bertytypes.Group, signal *locationSignal) (*locationUpdate, error) {
+	if len(signal.Sealed) < cryptoutil.NonceSize {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(signal.Sealed[:cryptoutil.NonceSize])
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	secret, err := g.GetSharedSecret()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	data, ok := secretbox.Open(nil, signal.Sealed[cryptoutil.NonceSize:], nonce, secret)
+	if !ok {
+		return nil, errcode.ErrCryptoDecrypt
+	}
+
+	u := &locationUpdate{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if u.Location != nil {
+		if err := u.Location.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return u, nil
+}
+
+// ownLocationShare is a live share of the device, it is stopped once
+// expired.
+type ownLocationShare struct {
+	groupPK  []byte
+	expires  time.Time
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+type liveLocationState struct {
+	location *LiveLocation
+	timer    *time.Timer
+}
+
+// liveLocations tracks the live shares of the device and expires the ones of
+// the other devices.
+type liveLocations struct {
+	logger  *zap.Logger
+	emitter event.Emitter
+
+	muOwn sync.Mutex
+	own   map[string]*ownLocationShare
+
+	muStates sync.Mutex
+	states   map[string]*liveLocationState
+}
+
+func newLiveLocations(logger *zap.Logger, h host.Host) (*liveLocations, error) {
+	ll := &liveLocations{
+		logger: logger,
+		own:    make(map[string]*ownLocationShare),
+		states: make(map[string]*liveLocationState),
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtLiveLocationChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		ll.emitter = emitter
+	}
+
+	return ll, nil
+}
+
+func (ll *liveLocations) emit(evt EvtLiveLocationChanged) {
+	if ll.emitter == nil {
+		return
+	}
+
+	if err := ll.emitter.Emit(evt); err != nil {
+		ll.logger.Warn("unable to emit live location event", zap.Error(err))
+	}
+}
+
+// start registers a share of the device whose first location was sent at
+// now, expired is called once it expires.
+func (ll *liveLocations) start(groupPK, shareID []byte, now, expires time.Time, expired func()) {
+	share := &ownLocationShare{groupPK: groupPK, expires: expires, lastSent: now}
+
+	ll.muOwn.Lock()
+	defer ll.muOwn.Unlock()
+
+	share.timer = time.AfterFunc(expires.Sub(now), func() {
+		if ll.stop(shareID) != nil {
+			expired()
+		}
+	})
+	ll.own[string(shareID)] = share
+}
+
+// stop unregisters a share of the device, it returns nil if it was already
+// stopped.
+func (ll *liveLocations) stop(shareID []byte) *ownLocationShare {
+	ll.muOwn.Lock()
+	defer ll.muOwn.Unlock()
+
+	share, ok := ll.own[string(shareID)]
+	if !ok {
+		return nil
+	}
+
+	share.timer.Stop()
+	delete(ll.own, string(shareID))
+
+	return share
+}
+
+// shouldSend returns the share of an update of the device, nil if the update
+// must be dropped, at most one every liveLocationInterval.
+func (ll *liveLocations) shouldSend(shareID []byte, now time.Time) (*ownLocationShare, error) {
+	ll.muOwn.Lock()
+	defer ll.muOwn.Unlock()
+
+	share, ok := ll.own[string(shareID)]
+	if !ok || !now.Before(share.expires) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no live location share with this ID"))
+	}
+
+	if now.Sub(share.lastSent) < liveLocationInterval {
+		return nil, nil
+	}
+
+	share.lastSent = now
+
+	return share, nil
+}
+
+// received updates the location of a share of another device, it expires
+// with the share.
+func (ll *liveLocations) received(groupPK, devicePK []byte, u *locationUpdate, now time.Time) {
+	key := string(groupPK) + string(devicePK) + string(u.ShareID)
+	expires := time.Unix(0, u.Expires)
+
+	ll.muStates.Lock()
+	defer ll.muStates.Unlock()
+
+	state, ok := ll.states[key]
+	if ok {
+		state.timer.Stop()
+	}
+
+	if u.Location == nil || !now.Before(expires) {
+		delete(ll.states, key)
+		if ok {
+			ll.emit(EvtLiveLocationChanged{GroupPK: groupPK, DevicePK: devicePK, ShareID: u.ShareID})
+		}
+
+		return
+	}
+
+	state = &liveLocationState{location: &LiveLocation{
+		GroupPK:   groupPK,
+		DevicePK:  devicePK,
+		ShareID:   u.ShareID,
+		Location:  u.Location,
+		UpdatedAt: time.Unix(0, u.SentAt),
+		Expires:   expires,
+	}}
+	state.timer = time.AfterFunc(expires.Sub(now), func() {
+		ll.muStates.Lock()
+		defer ll.muStates.Unlock()
+
+		if ll.states[key] != state {
+			return
+		}
+
+		delete(ll.states, key)
+		ll.emit(EvtLiveLocationChanged{GroupPK: groupPK, DevicePK: devicePK, ShareID: u.ShareID})
+	})
+	ll.states[key] = state
+
+	ll.emit(EvtLiveLocationChanged{GroupPK: groupPK, DevicePK: devicePK, ShareID: u.ShareID, Location: u.Location})
+}
+
+// list returns the live locations of the other devices in a conversation.
+func (ll *liveLocations) list(groupPK []byte) []*LiveLocation {
+	ll.muStates.Lock()
+	defer ll.muStates.Unlock()
+
+	locations := []*LiveLocation{}
+	for _, state := range ll.states {
+		if bytes.Equal(state.location.GroupPK, groupPK) {
+			locations = append(locations, state.location)
+		}
+	}
+
+	return locations
+}
+
+// LocationShare sends a location to a conversation, as a pin if duration is
+// 0, otherwise it starts a live share updated by LocationUpdate until
+// LocationShareStop or until it expires. It returns the ID of the message,
+// the ID of the live share.
+func (s *service) LocationShare(ctx context.Context, groupPK []byte, location *Location, duration time.Duration) ([]byte, error) {
+	if err := location.validate(); err != nil {
+		return nil, err
+	}
+
+	if duration < 0 || duration > MaxLiveLocationDuration {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the duration of a live location share is at most %s", MaxLiveLocationDuration))
+	}
+
+	if duration > 0 && s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	now := time.Now()
+	payload := &locationPayload{
+		Type:     LocationPayloadType,
+		Location: *location,
+		SentDate: now.UnixNano() / int64(time.Millisecond),
+	}
+
+	expires := now.Add(duration)
+	if duration > 0 {
+		payload.ExpiresDate = expires.UnixNano() / int64(time.Millisecond)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	shareID, err := s.AppMessageSendWithID(ctx, groupPK, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if duration == 0 || shareID == nil {
+		return shareID, nil
+	}
+
+	s.locations.start(groupPK, shareID, now, expires, func() {
+		if err := s.sendLocationUpdate(gc, shareID, nil, expires, time.Now()); err != nil {
+			s.logger.Debug("unable to end the live location share", zap.Error(err))
+		}
+	})
+
+	if err := s.sendLocationUpdate(gc, shareID, location, expires, now); err != nil {
+		return nil, err
+	}
+
+	return shareID, nil
+}
+
+// LocationUpdate sends the new location of a live share to the connected
+// devices of the conversation, the updates closer than a few seconds are
+// dropped.
+func (s *service) LocationUpdate(_ context.Context, groupPK []byte, shareID []byte, location *Location) error {
+	if err := location.validate(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	share, err := s.locations.shouldSend(shareID, now)
+	if err != nil || share == nil {
+		return err
+	}
+
+	if !bytes.Equal(share.groupPK, groupPK) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("live location share of another conversation"))
+	}
+
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	return s.sendLocationUpdate(gc, shareID, location, share.expires, now)
+}
+
+// LocationShareStop ends a live share before it expires.
+func (s *service) LocationShareStop(_ context.Context, groupPK []byte, shareID []byte) error {
+	share := s.locations.stop(shareID)
+	if share == nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no live location share with this ID"))
+	}
+
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	return s.sendLocationUpdate(gc, shareID, nil, share.expires, time.Now())
+}
+
+// LiveLocations returns the live locations shared by the other devices of a
+// conversation.
+func (s *service) LiveLocations(_ context.Context, groupPK []byte) ([]*LiveLocation, error) {
+	if s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.locations.list(groupPK), nil
+}
+
+func (s *service) sendLocationUpdate(gc *groupContext, shareID []byte, location *Location, expires, now time.Time) error {
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	devicePK, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	u := &locationUpdate{ShareID: shareID, DevicePK: devicePK, Location: location, Expires: expires.UnixNano(), SentAt: now.UnixNano()}
+	if u.Sig, err = md.device.Sign(u.signedBytes(gc.Group().PublicKey)); err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	signal, err := sealLocationUpdate(gc.Group(), u)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range s.conversations.groupPeers(gc.Group().PublicKey) {
+		if s.host.Network().Connectedness(p) != network.Connected {
+			continue
+		}
+
+		go func(p peer.ID) {
+			if err := s.sendLocationSignal(p, signal); err != nil {
+				s.logger.Debug("unable to send live location", zap.Stringer("peer", p), zap.Error(err))
+			}
+		}(p)
+	}
+
+	return nil
+}
+
+func (s *service) sendLocationSignal(p peer.ID, signal *locationSignal) error {
+	ctx, cancel := context.WithTimeout(s.ctx, locationSendTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(network.WithNoDial(ctx, "location"), p, locationProtocolID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(locationSendTimeout))
+
+	if err := json.NewEncoder(s.lanes.Stream(stream, ipfsutil.PriorityText)).Encode(signal); err != nil {
+		_ = stream.Reset()
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) handleLocationSignal(stream network.Stream) {
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(locationSendTimeout))
+
+	signal := &locationSignal{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxLocationSignalSize)).Decode(signal); err != nil {
+		_ = stream.Reset()
+		return
+	}
+
+	if err := s.receiveLocationSignal(signal, time.Now()); err != nil {
+		s.logger.Debug("invalid live location", zap.Stringer("peer", stream.Conn().RemotePeer()), zap.Error(err))
+	}
+}
+
+func (s *service) receiveLocationSignal(signal *locationSignal, now time.Time) error {
+	gc, err := s.getContextGroupForID(signal.GroupPK)
+	if err != nil {
+		return err
+	}
+
+	u, err := openLocationUpdate(gc.Group(), signal)
+	if err != nil {
+		return err
+	}
+
+	if sentAt := time.Unix(0, u.SentAt); now.Sub(sentAt) > locationMaxAge || sentAt.Sub(now) > locationMaxAge {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("live location too old"))
+	}
+
+	if time.Unix(0, u.Expires).Sub(now) > MaxLiveLocationDuration {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("live location share too long"))
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(u.DevicePK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := gc.MetadataStore().GetMemberByDevice(pk); err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if !gc.MetadataStore().isCurrentDevice(u.DevicePK) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("not a member of the group anymore"))
+	}
+
+	if ok, err := pk.Verify(u.signedBytes(signal.GroupPK), u.Sig); err != nil || !ok {
+		return errcode.ErrCryptoSignatureVerification
+	}
+
+	s.locations.received(signal.GroupPK, u.DevicePK, u, now)
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package bertyprotocol
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestLocationValidate(t *testing.T) {
+	assert.NoError(t, (&Location{Latitude: 48.85, Longitude: 2.35, Accuracy: 10}).validate())
+	assert.Error(t, (*Location)(nil).validate())
+	assert.Error(t, (&Location{Latitude: 91}).validate())
+	assert.Error(t, (&Location{Longitude: -181}).validate())
+	assert.Error(t, (&Location{Latitude: math.NaN()}).validate())
+	assert.Error(t, (&Location{Accuracy: -1}).validate())
+}
+
+func TestLocationUpdateSealed(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	other, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	u := &locationUpdate{ShareID: []byte("share"), DevicePK: []byte("device"), Location: &Location{Latitude: 1, Longitude: 2}, Expires: 2, SentAt: 1}
+	signal, err := sealLocationUpdate(g, u)
+	require.NoError(t, err)
+	assert.NotContains(t, string(signal.Sealed), "share")
+
+	opened, err := openLocationUpdate(g, signal)
+	require.NoError(t, err)
+	assert.Equal(t, u, opened)
+
+	// only the members of the group read the updates
+	_, err = openLocationUpdate(other, signal)
+	assert.Error(t, err)
+
+	// the signature covers the location
+	moved := *u
+	moved.Location = &Location{Latitude: 1, Longitude: 3}
+	assert.NotEqual(t, u.signedBytes(g.PublicKey), moved.signedBytes(g.PublicKey))
+	assert.NotEqual(t, u.signedBytes(g.PublicKey), u.signedBytes(other.PublicKey))
+}
+
+func TestLiveLocationsOwnShare(t *testing.T) {
+	ll, err := newLiveLocations(zap.NewNop(), nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	ll.start([]byte("group"), []byte("share"), now, now.Add(2*liveLocationInterval), func() {})
+
+	// the updates closer than liveLocationInterval are dropped
+	share, err := ll.shouldSend([]byte("share"), now.Add(liveLocationInterval/2))
+	require.NoError(t, err)
+	assert.Nil(t, share)
+
+	share, err = ll.shouldSend([]byte("share"), now.Add(liveLocationInterval))
+	require.NoError(t, err)
+	require.NotNil(t, share)
+	assert.Equal(t, []byte("group"), share.groupPK)
+
+	_, err = ll.shouldSend([]byte("share"), now.Add(3*liveLocationInterval))
+	assert.Error(t, err, "expired share")
+
+	_, err = ll.shouldSend([]byte("unknown"), now)
+	assert.Error(t, err)
+
+	assert.NotNil(t, ll.stop([]byte("share")))
+	assert.Nil(t, ll.stop([]byte("share")))
+
+	// the shares stop themselves once expired
+	expired := make(chan struct{})
+	ll.start([]byte("group"), []byte("short"), now, now.Add(100*time.Millisecond), func() { close(expired) })
+
+	select {
+	case <-expired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the share didn't expire")
+	}
+
+	assert.Nil(t, ll.stop([]byte("short")))
+}
+
+func TestLiveLocationsReceived(t *testing.T) {
+	ll, err := newLiveLocations(zap.NewNop(), nil)
+	require.NoError(t, err)
+
+	groupPK := []byte("group")
+	now := time.Now()
+
+	ll.received(groupPK, []byte("device1"), &locationUpdate{ShareID: []byte("share1"), Location: &Location{Latitude: 1}, Expires: now.Add(time.Hour).UnixNano(), SentAt: now.UnixNano()}, now)
+	ll.received(groupPK, []byte("device2"), &locationUpdate{ShareID: []byte("share2"), Location: &Location{Latitude: 2}, Expires: now.Add(100 * time.Millisecond).UnixNano(), SentAt: now.UnixNano()}, now)
+	ll.received([]byte("other"), []byte("device3"), &locationUpdate{ShareID: []byte("share3"), Location: &Location{Latitude: 3}, Expires: now.Add(time.Hour).UnixNano(), SentAt: now.UnixNano()}, now)
+	require.Len(t, ll.list(groupPK), 2)
+
+	// the shares end once expired
+	require.Eventually(t, func() bool { return len(ll.list(groupPK)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []byte("share1"), ll.list(groupPK)[0].ShareID)
+
+	// or once stopped
+	ll.received(groupPK, []byte("device1"), &locationUpdate{ShareID: []byte("share1"), Expires: now.Add(time.Hour).UnixNano(), SentAt: now.UnixNano()}, now)
+	assert.Empty(t, ll.list(groupPK))
+}
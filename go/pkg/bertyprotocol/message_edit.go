@@ -0,0 +1,432 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+const (
+	editPayloadPrefix = "\x00berty.edit/1\x00"
+
+	// EditPayloadType is the type of the JSON payload replacing the edits in
+	// the message lists and subscriptions, the edited messages are listed
+	// with their latest content.
+	EditPayloadType = "MessageEdited"
+)
+
+var messageEditsKey = datastore.NewKey("edits")
+
+// MessageEdit is a version of a message, edited by its author.
+type MessageEdit struct {
+	GroupPK   []byte
+	MessageID []byte
+	EditID    []byte
+	DevicePK  []byte
+	Payload   []byte
+	EditedAt  time.Time
+}
+
+// EvtMessageEdited is emitted on the event bus of the host once an edit is
+// received, the edits of another member than the author are only dropped
+// when the history is read.
+type EvtMessageEdited struct {
+	Edit *MessageEdit
+}
+
+// editPayload is the payload sent to the clients in place of an edit.
+type editPayload struct {
+	Type      string `json:"type"`
+	MessageID []byte `json:"messageId"`
+	EditID    []byte `json:"editId"`
+	Payload   []byte `json:"payload"`
+	EditedAt  int64  `json:"editedAt"`
+}
+
+// messageEditOp is sent as a message of the group and carries the whole new
+// content of the message.
+type messageEditOp struct {
+	GroupPK   []byte `json:"group_pk"`
+	MessageID []byte `json:"message_id"`
+	DevicePK  []byte `json:"device_pk"`
+	Payload   []byte `json:"payload"`
+	At        int64  `json:"at"`
+	Sig       []byte `json:"sig"`
+}
+
+func (e *messageEditOp) signedBytes() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(e.At))
+
+	return bytes.Join([][]byte{[]byte("berty edit"), e.GroupPK, e.MessageID, buf, e.Payload}, nil)
+}
+
+func isEditPayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(editPayloadPrefix))
+}
+
+func unmarshalEdit(payload []byte) (*messageEditOp, error) {
+	if !isEditPayload(payload) {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	e := &messageEditOp{}
+	if err := json.Unmarshal(payload[len(editPayloadPrefix):], e); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return e, nil
+}
+
+type editRecord struct {
+	DevicePK []byte `json:"device_pk"`
+	Payload  []byte `json:"payload"`
+	EditedAt int64  `json:"edited_at"`
+}
+
+// messageEdits persists the edit chains of the messages, by member: the
+// edits may be received before the message they edit, the author of the
+// message only selects the chain to use.
+type messageEdits struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+}
+
+func newMessageEdits(logger *zap.Logger, store datastore.Batching, h host.Host) (*messageEdits, error) {
+	me := &messageEdits{
+		logger: logger,
+		store:  store,
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtMessageEdited))
+		if err != nil {
+			return nil, err
+		}
+
+		me.emitter = emitter
+	}
+
+	return me, nil
+}
+
+func messageEditsKeyFor(groupPK, messageID, memberPK []byte) datastore.Key {
+	return retractionKey(messageEditsKey, groupPK, messageID).ChildString(base64.RawURLEncoding.EncodeToString(memberPK))
+}
+
+// add records an edit of a member, it reports whether it was unknown.
+func (me *messageEdits) add(edit *MessageEdit, memberPK []byte) (bool, error) {
+	key := messageEditsKeyFor(edit.GroupPK, edit.MessageID, memberPK).ChildString(base64.RawURLEncoding.EncodeToString(edit.EditID))
+	if ok, err := me.store.Has(key); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	} else if ok {
+		return false, nil
+	}
+
+	data, err := json.Marshal(&editRecord{DevicePK: edit.DevicePK, Payload: edit.Payload, EditedAt: edit.EditedAt.UnixNano()})
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := me.store.Put(key, data); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if me.emitter != nil {
+		if err := me.emitter.Emit(EvtMessageEdited{Edit: edit}); err != nil {
+			me.logger.Warn("unable to emit message edited event", zap.Error(err))
+		}
+	}
+
+	return true, nil
+}
+
+// history returns the edits of a member for a message, the latest last.
+func (me *messageEdits) history(groupPK, messageID, memberPK []byte) ([]*MessageEdit, error) {
+	res, err := me.store.Query(query.Query{Prefix: messageEditsKeyFor(groupPK, messageID, memberPK).String()})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	edits := []*MessageEdit{}
+	for _, entry := range entries {
+		editID, err := base64.RawURLEncoding.DecodeString(datastore.RawKey(entry.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		rec := &editRecord{}
+		if err := json.Unmarshal(entry.Value, rec); err != nil {
+			me.logger.Warn("unable to read edit", zap.Error(err))
+			continue
+		}
+
+		edits = append(edits, &MessageEdit{
+			GroupPK:   groupPK,
+			MessageID: messageID,
+			EditID:    editID,
+			DevicePK:  rec.DevicePK,
+			Payload:   rec.Payload,
+			EditedAt:  time.Unix(0, rec.EditedAt),
+		})
+	}
+
+	sort.Slice(edits, func(i, j int) bool {
+		if !edits[i].EditedAt.Equal(edits[j].EditedAt) {
+			return edits[i].EditedAt.Before(edits[j].EditedAt)
+		}
+
+		return bytes.Compare(edits[i].EditID, edits[j].EditID) < 0
+	})
+
+	return edits, nil
+}
+
+// forget deletes the edits of a message by all the members, it returns
+// their IDs.
+func (me *messageEdits) forget(groupPK, messageID []byte) ([][]byte, error) {
+	res, err := me.store.Query(query.Query{Prefix: retractionKey(messageEditsKey, groupPK, messageID).String(), KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	ids := [][]byte{}
+	for _, entry := range entries {
+		if editID, err := base64.RawURLEncoding.DecodeString(datastore.RawKey(entry.Key).BaseNamespace()); err == nil {
+			ids = append(ids, editID)
+		}
+
+		if err := me.store.Delete(datastore.RawKey(entry.Key)); err != nil && err != datastore.ErrNotFound {
+			return ids, errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return ids, nil
+}
+
+// MessageEdit replaces the content of a message of the device for everyone,
+// the previous versions are kept in its history.
+func (s *service) MessageEdit(ctx context.Context, groupPK []byte, messageID []byte, payload []byte) error {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return errcode.ErrInvalidInput
+	}
+
+	if _, err := s.deliveries.get(groupPK, messageID); err != nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the author can edit a message"))
+	}
+
+	if tombstone, err := s.retractions.tombstone(groupPK, messageID); err != nil {
+		return err
+	} else if tombstone != nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("message retracted"))
+	}
+
+	if s.ephemeral.isExpired(groupPK, messageID) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("message expired"))
+	}
+
+	payload, err = s.filterOutgoing(ctx, OutgoingAppMessage, groupPK, payload)
+	if err != nil {
+		return err
+	}
+
+	// suppressed by the filter
+	if payload == nil {
+		return nil
+	}
+
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	devicePK, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	op := &messageEditOp{GroupPK: groupPK, MessageID: messageID, DevicePK: devicePK, Payload: payload, At: time.Now().UnixNano()}
+	if op.Sig, err = md.device.Sign(op.signedBytes()); err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	data, err := json.Marshal(op)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return s.sendControlMessage(ctx, gc, append([]byte(editPayloadPrefix), data...))
+}
+
+// MessageEditHistory returns the edits of a message by its author, the
+// latest last.
+func (s *service) MessageEditHistory(_ context.Context, groupPK []byte, messageID []byte) ([]*MessageEdit, error) {
+	author, err := s.retractions.author(groupPK, messageID)
+	if err != nil {
+		return nil, err
+	} else if author == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown message"))
+	}
+
+	return s.edits.history(groupPK, messageID, author)
+}
+
+// applyEdit records an edit received in a group, it must be signed by the
+// device which sent it.
+func (s *service) applyEdit(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*MessageEdit, []byte, error) {
+	op, err := unmarshalEdit(evt.Message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(op.GroupPK, gc.Group().PublicKey) || !bytes.Equal(op.DevicePK, evt.Headers.DevicePK) {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("edit not sent by its signer"))
+	}
+
+	pk, memberPK, err := deviceMember(gc, evt.Headers.DevicePK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ok, err := pk.Verify(op.signedBytes(), op.Sig); err != nil || !ok {
+		return nil, nil, errcode.ErrCryptoSignatureVerification
+	}
+
+	// the content of an expired message isn't kept
+	if s.ephemeral.isExpired(op.GroupPK, op.MessageID) {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("message expired"))
+	}
+
+	edit := &MessageEdit{
+		GroupPK:   op.GroupPK,
+		MessageID: op.MessageID,
+		EditID:    evt.EventContext.ID,
+		DevicePK:  op.DevicePK,
+		Payload:   op.Payload,
+		EditedAt:  time.Unix(0, op.At),
+	}
+
+	if _, err := s.edits.add(edit, memberPK); err != nil {
+		return nil, nil, err
+	}
+
+	return edit, memberPK, nil
+}
+
+// trackEdit is called for each message of a group, it reports whether the
+// message is an edit.
+func (s *service) trackEdit(gc *groupContext, evt *bertytypes.GroupMessageEvent) bool {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil || !isEditPayload(evt.Message) {
+		return false
+	}
+
+	if _, _, err := s.applyEdit(gc, evt); err != nil {
+		s.logger.Debug("invalid edit", zap.Error(err))
+	}
+
+	return true
+}
+
+// renderMessage prepares a message of a group for the clients, it reports
+// whether the message must be sent.
+func (s *service) renderMessage(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*bertytypes.GroupMessageEvent, bool) {
+	evt, ok := s.renderEphemeral(gc, evt)
+	if !ok || isTTLPayload(evt.Message) {
+		return evt, ok
+	}
+
+	rendered, ok := s.renderRetraction(gc, evt)
+	if !ok || rendered != evt {
+		return rendered, ok
+	}
+
+	if isReactionPayload(evt.Message) {
+		return s.renderReaction(gc, evt)
+	}
+
+	if isPollPayload(evt.Message) || isPollVotePayload(evt.Message) {
+		return s.renderPoll(gc, evt)
+	}
+
+	return s.renderEdit(gc, evt)
+}
+
+// renderEdit replaces the payload of an edited message with its latest
+// content and the payload of an edit with an edit payload, the edits of
+// another member than the author of the message are not sent.
+func (s *service) renderEdit(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*bertytypes.GroupMessageEvent, bool) {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil {
+		return evt, true
+	}
+
+	rendered := *evt
+
+	if !isEditPayload(evt.Message) {
+		edits, err := s.MessageEditHistory(s.ctx, gc.Group().PublicKey, evt.EventContext.ID)
+		if err != nil || len(edits) == 0 {
+			return evt, true
+		}
+
+		rendered.Message = edits[len(edits)-1].Payload
+
+		return &rendered, true
+	}
+
+	// the edit may not be tracked yet
+	edit, memberPK, err := s.applyEdit(gc, evt)
+	if err != nil {
+		return evt, false
+	}
+
+	if author, err := s.retractions.author(edit.GroupPK, edit.MessageID); err != nil || !bytes.Equal(author, memberPK) {
+		return evt, false
+	}
+
+	if tombstone, err := s.retractions.tombstone(edit.GroupPK, edit.MessageID); err != nil || tombstone != nil {
+		return evt, false
+	}
+
+	payload, err := json.Marshal(&editPayload{
+		Type:      EditPayloadType,
+		MessageID: edit.MessageID,
+		EditID:    edit.EditID,
+		Payload:   edit.Payload,
+		EditedAt:  edit.EditedAt.UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		return evt, false
+	}
+
+	rendered.Message = payload
+
+	return &rendered, true
+}
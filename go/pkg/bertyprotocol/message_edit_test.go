@@ -0,0 +1,51 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMessageEdits(t *testing.T) {
+	edits, err := newMessageEdits(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	groupPK, messageID, author, other := []byte("group"), []byte("message"), []byte("author"), []byte("other")
+	now := time.Now()
+
+	newEdit := func(editID string, payload string, at time.Time) *MessageEdit {
+		return &MessageEdit{GroupPK: groupPK, MessageID: messageID, EditID: []byte(editID), Payload: []byte(payload), EditedAt: at}
+	}
+
+	// the edits may be received out of order
+	added, err := edits.add(newEdit("edit2", "second", now.Add(time.Minute)), author)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = edits.add(newEdit("edit1", "first", now), author)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = edits.add(newEdit("edit1", "first", now), author)
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	_, err = edits.add(newEdit("forged", "forged", now.Add(time.Hour)), other)
+	require.NoError(t, err)
+
+	history, err := edits.history(groupPK, messageID, author)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, []byte("first"), history[0].Payload)
+	assert.Equal(t, []byte("second"), history[1].Payload)
+	assert.Equal(t, []byte("edit2"), history[1].EditID)
+
+	history, err = edits.history(groupPK, []byte("unedited"), author)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
@@ -0,0 +1,255 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"berty.tech/berty/v2/go/internal/search"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.uber.org/zap"
+)
+
+// the payloads handled by the protocol itself, e.g. the edits or the
+// reactions, start with it
+var controlPayloadPrefix = []byte("\x00berty.")
+
+// SearchTextExtractor returns the text of an app message to index, empty if
+// it has none.
+type SearchTextExtractor func(payload []byte) string
+
+// MessageSearchResult is a message matching a search.
+type MessageSearchResult struct {
+	GroupPK   []byte
+	MessageID []byte
+	At        time.Time
+	Score     float64
+
+	// Snippet is the part of the text around the first match, Highlights
+	// are the ranges of bytes of the search terms in it
+	Snippet    string
+	Highlights []search.Range
+
+	// Signature is the verification of the signature of the message, nil
+	// if it wasn't verified yet, e.g. indexed by a previous version
+	Signature *MessageSignature
+}
+
+// SetSearchTextExtractor replaces the extractor of the text of the messages
+// to index, nil restores the default one, which indexes the payloads made of
+// text. The messages already indexed are only updated by a rebuild.
+func (s *service) SetSearchTextExtractor(f SearchTextExtractor) {
+	s.muSearchText.Lock()
+	s.searchText = f
+	s.muSearchText.Unlock()
+}
+
+func defaultSearchText(payload []byte) string {
+	if bytes.HasPrefix(payload, controlPayloadPrefix) || !utf8.Valid(payload) {
+		return ""
+	}
+
+	return string(payload)
+}
+
+func (s *service) extractSearchText(payload []byte) string {
+	s.muSearchText.RLock()
+	f := s.searchText
+	s.muSearchText.RUnlock()
+
+	if bytes.HasPrefix(payload, controlPayloadPrefix) {
+		return ""
+	}
+
+	if f == nil {
+		f = defaultSearchText
+	}
+
+	return f(payload)
+}
+
+// messageSearchText returns the text to index of a message, with the latest
+// content of an edited one. The retracted and expired messages have none.
+func (s *service) messageSearchText(groupPK, messageID, payload []byte) string {
+	if tombstone, err := s.retractions.tombstone(groupPK, messageID); err != nil || tombstone != nil {
+		return ""
+	}
+
+	if s.ephemeral.isExpired(groupPK, messageID) {
+		return ""
+	}
+
+	if edits, err := s.MessageEditHistory(s.ctx, groupPK, messageID); err == nil && len(edits) > 0 {
+		payload = edits[len(edits)-1].Payload
+	}
+
+	return s.extractSearchText(payload)
+}
+
+// indexMessage updates the search index with a message of a group once it
+// is tracked: the message itself or, for an edit or a retraction, the
+// message it targets.
+func (s *service) indexMessage(gc *groupContext, evt *bertytypes.GroupMessageEvent) {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil {
+		return
+	}
+
+	groupPK, messageID, payload := gc.Group().PublicKey, evt.EventContext.ID, evt.Message
+
+	switch {
+	case isEditPayload(evt.Message):
+		op, err := unmarshalEdit(evt.Message)
+		if err != nil {
+			return
+		}
+
+		// the edit came before its message, indexed once it shows up
+		if author, err := s.retractions.author(groupPK, op.MessageID); err != nil || author == nil {
+			return
+		}
+
+		messageID, payload = op.MessageID, nil
+
+	case isRetractionPayload(evt.Message):
+		r, err := unmarshalRetraction(evt.Message)
+		if err != nil {
+			return
+		}
+
+		messageID, payload = r.MessageID, nil
+
+	case bytes.HasPrefix(evt.Message, controlPayloadPrefix):
+		return
+	}
+
+	doc := &search.Document{Scope: groupPK, ID: messageID, Text: s.messageSearchText(groupPK, messageID, payload)}
+	if err := s.searchIndex.Put(doc); err != nil {
+		s.logger.Warn("unable to index message", zap.Error(err))
+	}
+}
+
+// MessageSearch returns the messages matching a text, in a group or in all
+// of them if groupPK is nil, the most relevant first.
+func (s *service) MessageSearch(_ context.Context, text string, groupPK []byte, limit int) ([]*MessageSearchResult, error) {
+	results, err := s.searchIndex.Search(&search.Query{Text: text, Scope: groupPK, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*MessageSearchResult, len(results))
+	for i, r := range results {
+		list[i] = &MessageSearchResult{
+			GroupPK:    r.Scope,
+			MessageID:  r.ID,
+			At:         r.At,
+			Score:      r.Score,
+			Snippet:    r.Snippet,
+			Highlights: r.Highlights,
+		}
+
+		if list[i].Signature, err = s.signatures.get(r.Scope, r.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+// MessageSearchRebuild indexes again the messages of a group, or of all the
+// active groups if groupPK is nil, e.g. after a change of the text
+// extractor. It returns the number of messages indexed.
+func (s *service) MessageSearchRebuild(ctx context.Context, groupPK []byte) (int, error) {
+	groups := []*groupContext{}
+	if groupPK != nil {
+		gc, err := s.getContextGroupForID(groupPK)
+		if err != nil {
+			return 0, errcode.ErrGroupMissing.Wrap(err)
+		}
+
+		groups = append(groups, gc)
+	} else {
+		s.lock.RLock()
+		for _, gc := range s.openedGroups {
+			groups = append(groups, gc)
+		}
+		s.lock.RUnlock()
+	}
+
+	count := 0
+	for _, gc := range groups {
+		n, err := s.rebuildGroupSearch(ctx, gc)
+		count += n
+
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+func (s *service) rebuildGroupSearch(ctx context.Context, gc *groupContext) (int, error) {
+	g := gc.Group()
+	if g.GroupType == bertytypes.GroupTypeAccount {
+		return 0, nil
+	}
+
+	messages, err := gc.MessageStore().ListMessages(ctx)
+	if err != nil {
+		return 0, errcode.ErrOrbitDBOpen.Wrap(err)
+	}
+
+	ids, err := s.searchIndex.IDs(g.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	stale := map[string]bool{}
+	for _, id := range ids {
+		stale[string(id)] = true
+	}
+
+	var (
+		count  int
+		putErr error
+	)
+
+	// the list is drained on error, it's sent by a goroutine
+	for evt := range messages {
+		if putErr != nil || evt.Headers == nil || evt.EventContext == nil || isTTLPayload(evt.Message) {
+			continue
+		}
+
+		// the TTL of a disappearing message is removed
+		rendered, ok := s.renderEphemeral(gc, evt)
+		if !ok {
+			continue
+		}
+
+		text := s.messageSearchText(g.PublicKey, evt.EventContext.ID, rendered.Message)
+		if text == "" {
+			continue
+		}
+
+		if putErr = s.searchIndex.Put(&search.Document{Scope: g.PublicKey, ID: evt.EventContext.ID, Text: text}); putErr != nil {
+			continue
+		}
+
+		delete(stale, string(evt.EventContext.ID))
+		count++
+	}
+
+	if putErr != nil {
+		return count, putErr
+	}
+
+	for id := range stale {
+		if err := s.searchIndex.Delete(g.PublicKey, []byte(id)); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
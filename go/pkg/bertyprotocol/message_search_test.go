@@ -0,0 +1,54 @@
+package bertyprotocol
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/search"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMessageSearchText(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+
+	retractions, err := newRetractionTracker(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+	edits, err := newMessageEdits(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+	ephemeral, err := newEphemeralMessages(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	s := &service{
+		ctx:         context.Background(),
+		retractions: retractions,
+		edits:       edits,
+		ephemeral:   ephemeral,
+		searchIndex: search.New(store),
+	}
+
+	groupPK, messageID, author := []byte("group"), []byte("message"), []byte("author")
+
+	assert.Equal(t, "hello", s.messageSearchText(groupPK, messageID, []byte("hello")))
+	assert.Empty(t, s.messageSearchText(groupPK, messageID, []byte(editPayloadPrefix+"{}")))
+	assert.Empty(t, s.messageSearchText(groupPK, messageID, []byte{0xff, 0xfe}))
+
+	// the latest content of an edited message
+	_, err = retractions.seen(groupPK, messageID, author, time.Now())
+	require.NoError(t, err)
+	_, err = edits.add(&MessageEdit{GroupPK: groupPK, MessageID: messageID, EditID: []byte("edit"), Payload: []byte("hello world"), EditedAt: time.Now()}, author)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", s.messageSearchText(groupPK, messageID, []byte("hello")))
+
+	s.SetSearchTextExtractor(func(payload []byte) string { return strings.ToUpper(string(payload)) })
+	assert.Equal(t, "HELLO WORLD", s.messageSearchText(groupPK, messageID, []byte("hello")))
+
+	// an expired message has no content left
+	require.NoError(t, ephemeral.expired(groupPK, messageID, time.Now()))
+	assert.Empty(t, s.messageSearchText(groupPK, messageID, []byte("hello")))
+}
@@ -0,0 +1,322 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-orbit-db/stores/operation"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
+)
+
+// SignatureStatus is the result of the verification of the signature of a
+// message.
+type SignatureStatus string
+
+const (
+	// SignatureValid messages are signed by a device of a member of the
+	// group
+	SignatureValid SignatureStatus = "valid"
+
+	// SignatureInvalid messages don't match the signature of their device
+	SignatureInvalid SignatureStatus = "invalid"
+
+	// SignatureUnknownDevice messages are signed by a device which isn't in
+	// the metadata of the group, yet or anymore
+	SignatureUnknownDevice SignatureStatus = "unknown_device"
+
+	// SignatureRevokedDevice messages are signed by a revoked device
+	SignatureRevokedDevice SignatureStatus = "revoked_device"
+)
+
+// MessageSignature is the verification of the signature of a message.
+type MessageSignature struct {
+	GroupPK   []byte          `json:"group_pk"`
+	MessageID []byte          `json:"message_id"`
+	DevicePK  []byte          `json:"device_pk"`
+	MemberPK  []byte          `json:"member_pk,omitempty"`
+	Status    SignatureStatus `json:"status"`
+
+	// KeyVersion is the sequence of the identity key of the member when the
+	// message was first verified with it, 0 before the first rotation of the
+	// key
+	KeyVersion uint64 `json:"key_version"`
+
+	// VerifiedAt is the verification which gave the status
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// MessageReverifyReport is the result of a verification of the messages
+// replayed, e.g. once a device was revoked.
+type MessageReverifyReport struct {
+	Checked int `json:"checked"`
+
+	// Changed are the messages whose status changed
+	Changed []*MessageSignature `json:"changed"`
+}
+
+type signatureRecord struct {
+	DevicePK   []byte          `json:"device_pk"`
+	MemberPK   []byte          `json:"member_pk,omitempty"`
+	Status     SignatureStatus `json:"status"`
+	KeyVersion uint64          `json:"key_version,omitempty"`
+	VerifiedAt int64           `json:"verified_at"`
+}
+
+// messageSignatures verifies the signatures of the messages opened and keeps
+// their status. The status is only written when it changes, the messages are
+// opened again each time they are listed.
+type messageSignatures struct {
+	logger      *zap.Logger
+	store       datastore.Batching
+	revocations *deviceRevocations
+	identities  *identityChains
+	audit       *securityAudit
+
+	// members returns the member of a device in the metadata of a group,
+	// nil if it isn't there
+	members func(g *bertytypes.Group, devicePK crypto.PubKey) []byte
+
+	lock sync.Mutex
+}
+
+func newMessageSignatures(logger *zap.Logger, store datastore.Batching) *messageSignatures {
+	return &messageSignatures{
+		logger: logger,
+		store:  store,
+	}
+}
+
+func (ms *messageSignatures) getLocked(key datastore.Key) (*signatureRecord, error) {
+	data, err := ms.store.Get(key)
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	rec := &signatureRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return rec, nil
+}
+
+// status checks the signature of the payload sealed in an envelope, the
+// payload before the ratchet and the compression are removed.
+func (ms *messageSignatures) status(g *bertytypes.Group, headers *bertytypes.MessageHeaders, payload []byte) (SignatureStatus, []byte) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(headers.DevicePK)
+	if err != nil {
+		return SignatureInvalid, nil
+	}
+
+	if ok, err := pk.Verify(payload, headers.Sig); err != nil || !ok {
+		return SignatureInvalid, nil
+	}
+
+	var memberPK []byte
+	if ms.members != nil {
+		memberPK = ms.members(g, pk)
+	}
+
+	if ms.revocations.isRevoked(memberPK, headers.DevicePK) {
+		return SignatureRevokedDevice, nil
+	}
+
+	if memberPK == nil {
+		return SignatureUnknownDevice, nil
+	}
+
+	return SignatureValid, memberPK
+}
+
+// verify checks the signature of a message and keeps its status, it
+// returns the verification and whether its status changed.
+func (ms *messageSignatures) verify(g *bertytypes.Group, messageID []byte, headers *bertytypes.MessageHeaders, payload []byte, now time.Time) (*MessageSignature, bool, error) {
+	if ms == nil {
+		return nil, false, nil
+	}
+
+	status, memberPK := ms.status(g, headers, payload)
+	key := deliveryKey(g.PublicKey, messageID)
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	rec, err := ms.getLocked(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if rec != nil && rec.Status == status && bytes.Equal(rec.DevicePK, headers.DevicePK) && bytes.Equal(rec.MemberPK, memberPK) {
+		return newMessageSignature(g.PublicKey, messageID, rec), false, nil
+	}
+
+	first := rec == nil
+	if first {
+		rec = &signatureRecord{}
+	}
+
+	if rec.MemberPK == nil && memberPK != nil && ms.identities != nil {
+		_, rec.KeyVersion = ms.identities.head(memberPK)
+	}
+
+	rec.DevicePK, rec.MemberPK, rec.Status, rec.VerifiedAt = headers.DevicePK, memberPK, status, now.UnixNano()
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := ms.store.Put(key, data); err != nil {
+		return nil, false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if status == SignatureInvalid {
+		ms.audit.add(&securityRecord{
+			Type:     SecurityInvalidSignature,
+			DevicePK: headers.DevicePK,
+			GroupPK:  g.PublicKey,
+			Ref:      base64.RawURLEncoding.EncodeToString(messageID),
+		})
+	}
+
+	// a message verified for the first time isn't a change
+	return newMessageSignature(g.PublicKey, messageID, rec), !first, nil
+}
+
+func (ms *messageSignatures) get(groupPK, messageID []byte) (*MessageSignature, error) {
+	if ms == nil {
+		return nil, nil
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	rec, err := ms.getLocked(deliveryKey(groupPK, messageID))
+	if err != nil || rec == nil {
+		return nil, err
+	}
+
+	return newMessageSignature(groupPK, messageID, rec), nil
+}
+
+func newMessageSignature(groupPK, messageID []byte, rec *signatureRecord) *MessageSignature {
+	return &MessageSignature{
+		GroupPK:    groupPK,
+		MessageID:  messageID,
+		DevicePK:   rec.DevicePK,
+		MemberPK:   rec.MemberPK,
+		Status:     rec.Status,
+		KeyVersion: rec.KeyVersion,
+		VerifiedAt: time.Unix(0, rec.VerifiedAt),
+	}
+}
+
+// memberByDevice returns the member of a device of an opened group.
+func (s *bertyOrbitDB) memberByDevice(g *bertytypes.Group, devicePK crypto.PubKey) []byte {
+	gc, err := s.getGroupContext(g.GroupIDAsString())
+	if err != nil || gc.metadataStore == nil {
+		return nil
+	}
+
+	member, err := gc.metadataStore.GetMemberByDevice(devicePK)
+	if err != nil {
+		return nil
+	}
+
+	raw, err := member.Raw()
+	if err != nil {
+		return nil
+	}
+
+	return raw
+}
+
+// reverify opens the messages of the store again to check their signatures,
+// the messages which can't be decrypted anymore are skipped.
+func (m *messageStore) reverify(ctx context.Context, report *MessageReverifyReport) {
+	for _, e := range m.OpLog().GetEntries().Slice() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		headers, payload, err := m.openEnvelope(ctx, e)
+		if err != nil {
+			continue
+		}
+
+		v, changed, err := m.signatures.verify(m.g, e.GetHash().Bytes(), headers, payload, time.Now())
+		if err != nil {
+			m.logger.Warn("unable to verify message signature", zap.Error(err))
+			continue
+		}
+
+		report.Checked++
+		if changed {
+			report.Changed = append(report.Changed, v)
+		}
+	}
+}
+
+func (m *messageStore) openEnvelope(ctx context.Context, e ipfslog.Entry) (*bertytypes.MessageHeaders, []byte, error) {
+	op, err := operation.ParseOperation(e)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ownPK := crypto.PubKey(nil)
+	if md, err := m.devKS.MemberDeviceForGroup(m.g); err == nil {
+		ownPK = md.device.GetPublic()
+	}
+
+	return m.mks.OpenEnvelope(ctx, m.g, ownPK, op.GetValue(), e.GetHash())
+}
+
+// MessageSignature returns the verification of the signature of a message, by
+// its ID, nil if it wasn't opened by the device yet.
+func (s *service) MessageSignature(_ context.Context, groupPK []byte, messageID []byte) (*MessageSignature, error) {
+	return s.signatures.get(groupPK, messageID)
+}
+
+// MessageReverify checks again the signatures of the messages of a group, or
+// of all the opened groups if groupPK is nil, e.g. after a key change or once
+// a device was revoked. The messages of a revoked device aren't listed, they
+// are only found revoked by it.
+func (s *service) MessageReverify(ctx context.Context, groupPK []byte) (*MessageReverifyReport, error) {
+	groups := []*groupContext{}
+	if groupPK != nil {
+		gc, err := s.getContextGroupForID(groupPK)
+		if err != nil {
+			return nil, errcode.ErrGroupMissing.Wrap(err)
+		}
+
+		groups = append(groups, gc)
+	} else {
+		s.lock.RLock()
+		for _, gc := range s.openedGroups {
+			groups = append(groups, gc)
+		}
+		s.lock.RUnlock()
+	}
+
+	report := &MessageReverifyReport{Changed: []*MessageSignature{}}
+	for _, gc := range groups {
+		gc.MessageStore().reverify(ctx, report)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,120 @@
+package bertyprotocol
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMessageSignatures(t *testing.T) {
+	newKey := func() (crypto.PrivKey, []byte) {
+		sk, pk, err := crypto.GenerateEd25519Key(rand.Reader)
+		require.NoError(t, err)
+
+		raw, err := pk.Raw()
+		require.NoError(t, err)
+
+		return sk, raw
+	}
+
+	accountSK, accountPK := newKey()
+	deviceSK, devicePK := newKey()
+
+	revocations, err := newDeviceRevocations(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, err)
+
+	identities, err := newIdentityChains(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, err)
+
+	audit, err := newSecurityAudit(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), deviceSK, nil)
+	require.NoError(t, err)
+
+	members := map[string][]byte{}
+	ms := newMessageSignatures(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()))
+	ms.revocations, ms.identities, ms.audit = revocations, identities, audit
+	ms.members = func(_ *bertytypes.Group, pk crypto.PubKey) []byte {
+		raw, _ := pk.Raw()
+		return members[string(raw)]
+	}
+
+	g := &bertytypes.Group{PublicKey: []byte("group")}
+	payload := []byte("payload")
+
+	sig, err := deviceSK.Sign(payload)
+	require.NoError(t, err)
+
+	headers := &bertytypes.MessageHeaders{DevicePK: devicePK, Sig: sig}
+	now := time.Now()
+
+	v, err := ms.get(g.PublicKey, []byte("message"))
+	require.NoError(t, err)
+	assert.Nil(t, v)
+
+	// the device isn't in the metadata of the group yet
+	v, changed, err := ms.verify(g, []byte("message"), headers, payload, now)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, SignatureUnknownDevice, v.Status)
+
+	members[string(devicePK)] = accountPK
+
+	v, changed, err = ms.verify(g, []byte("message"), headers, payload, now)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, SignatureValid, v.Status)
+	assert.Equal(t, accountPK, v.MemberPK)
+	assert.Equal(t, uint64(0), v.KeyVersion)
+
+	// the key version is the one of the first verification with the member
+	nextSK, _ := newKey()
+	rotation, err := signIdentityRotation(accountSK, nextSK, accountPK, 1, now)
+	require.NoError(t, err)
+
+	_, err = identities.add(rotation)
+	require.NoError(t, err)
+
+	v, changed, err = ms.verify(g, []byte("other message"), headers, payload, now)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, uint64(1), v.KeyVersion)
+
+	// the status is only written when it changes
+	_, changed, err = ms.verify(g, []byte("message"), headers, payload, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	v, err = ms.get(g.PublicKey, []byte("message"))
+	require.NoError(t, err)
+	assert.Equal(t, now.UnixNano(), v.VerifiedAt.UnixNano())
+
+	// a payload not signed by the device
+	v, _, err = ms.verify(g, []byte("forged"), headers, []byte("forged payload"), now)
+	require.NoError(t, err)
+	assert.Equal(t, SignatureInvalid, v.Status)
+
+	events, err := audit.list(0, 0, SecurityInvalidSignature)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, devicePK, events[0].DevicePK)
+
+	// the device is revoked later on
+	signed, err := signDeviceRevocation(accountSK, &DeviceRevocation{DevicePK: devicePK}, now)
+	require.NoError(t, err)
+
+	_, err = revocations.add(signed)
+	require.NoError(t, err)
+
+	v, changed, err = ms.verify(g, []byte("message"), headers, payload, now)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, SignatureRevokedDevice, v.Status)
+	assert.Equal(t, uint64(0), v.KeyVersion)
+}
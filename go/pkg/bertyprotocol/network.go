@@ -0,0 +1,31 @@
+package bertyprotocol
+
+import (
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// NetworkChanged reports a connectivity transition of the device, e.g. from
+// cellular to Wi-Fi, the node refreshes its addrs and re-dials the peers of
+// the active conversations, the messages deferred by the retry policy of
+// the previous network are retried.
+func (s *service) NetworkChanged(connectivity ipfsutil.Connectivity) error {
+	if s.network == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	s.network.Changed(connectivity)
+	s.outbound.networkChanged(time.Now())
+	s.events.publish(NodeEventTransportState, nil, "", &TransportStateEvent{Connectivity: string(connectivity)})
+
+	return nil
+}
+
+// ConversationPeers returns the peers of the conversations with recent
+// messages.
+func (s *service) ConversationPeers() []peer.ID {
+	return s.conversations.activePeers()
+}
@@ -0,0 +1,91 @@
+package bertyprotocol
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/nfcpair"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"go.uber.org/zap"
+)
+
+// NFCPairingRecord returns the NDEF message the native NFC driver exchanges
+// during a tap: the peer record of the device, with its BLE service UUID if
+// any, its addrs and the contact request reference of the account.
+func (s *service) NFCPairingRecord(ctx context.Context, bleUUID string) ([]byte, error) {
+	if s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	enabled, contact := s.accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
+	if !enabled || contact == nil || len(contact.PublicRendezvousSeed) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("contact requests are disabled"))
+	}
+
+	token, err := contact.Marshal()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sk := s.host.Peerstore().PrivKey(s.host.ID())
+	if sk == nil {
+		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("no peer key"))
+	}
+
+	addrs := []string{}
+	for _, addr := range s.host.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+
+	signed, err := nfcpair.Sign(sk, &nfcpair.Record{
+		BLEUUID:      bleUUID,
+		Addrs:        addrs,
+		ContactToken: token,
+	}, time.Now())
+	if err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	return nfcpair.EncodeNDEF(signed), nil
+}
+
+// NFCPairingReceived pairs with the device which sent an NDEF message during
+// a tap, it connects to it through a proximity transport and sends a contact
+// request to its account.
+func (s *service) NFCPairingReceived(ctx context.Context, ndef []byte, ownMetadata []byte) error {
+	if s.host == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	signed, err := nfcpair.DecodeNDEF(ndef)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	r, err := nfcpair.Open(signed, time.Now())
+	if err != nil {
+		return errcode.ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	contact := &bertytypes.ShareableContact{}
+	if err := contact.Unmarshal(r.ContactToken); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	// the contact request is sent through the rendezvous of the contact
+	// anyway, the connection only makes it immediate
+	go func() {
+		if err := nfcpair.Connect(s.ctx, s.host, r); err != nil {
+			s.logger.Warn("unable to connect to paired peer", zap.Stringer("peer", r.PeerID), zap.Error(err))
+		}
+	}()
+
+	_, err = s.ContactRequestSend(ctx, &bertytypes.ContactRequestSend_Request{
+		Contact:     contact,
+		OwnMetadata: ownMetadata,
+	})
+
+	return err
+}
@@ -0,0 +1,392 @@
+package bertyprotocol
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+// The types of the node events.
+const (
+	NodeEventMessageReceived     = "message_received"
+	NodeEventMessageDelivery     = "message_delivery"
+	NodeEventContactRequest      = "contact_request"
+	NodeEventConversationChanged = "conversation_changed"
+	NodeEventPeerConnected       = "peer_connected"
+	NodeEventPeerDisconnected    = "peer_disconnected"
+	NodeEventTransportState      = "transport_state"
+	NodeEventNetworkActivity     = "network_activity"
+)
+
+const (
+	// nodeEventsBufferSize is the number of events kept to resume a stream
+	nodeEventsBufferSize = 1024
+
+	// nodeEventsSubscriberBuffer is the number of events a stream can lag
+	// behind before being closed, the client resumes it from its cursor
+	nodeEventsSubscriberBuffer = 256
+)
+
+// ErrEventCursorExpired is returned when the events after a cursor aren't
+// buffered anymore, or were buffered by a previous run of the node.
+var ErrEventCursorExpired = errcode.ErrInvalidInput.Wrap(fmt.Errorf("event cursor expired"))
+
+// MessageReceivedEvent is the payload of the NodeEventMessageReceived events.
+type MessageReceivedEvent struct {
+	MessageID []byte `json:"message_id"`
+	DevicePK  []byte `json:"device_pk"`
+	Message   []byte `json:"message"`
+
+	// Notification is the decision of the notification rules
+	Notification *NotificationDecision `json:"notification"`
+
+	// Signature is the verification of the signature of the message
+	Signature *MessageSignature `json:"signature,omitempty"`
+}
+
+// TransportStateEvent is the payload of the NodeEventTransportState events.
+type TransportStateEvent struct {
+	Connectivity string `json:"connectivity"`
+}
+
+type nodeEventsSubscriber struct {
+	ch      chan *NodeEvent
+	types   map[string]struct{}
+	groupPK []byte
+}
+
+func (sub *nodeEventsSubscriber) match(e *NodeEvent) bool {
+	if len(sub.types) > 0 {
+		if _, ok := sub.types[e.Type]; !ok {
+			return false
+		}
+	}
+
+	return len(sub.groupPK) == 0 || string(sub.groupPK) == string(e.GroupPK)
+}
+
+// nodeEvents dispatches the events of the node to the streams, the last ones
+// are buffered so a stream can be resumed from the cursor of an event. The
+// cursors are only valid during a run of the node.
+type nodeEvents struct {
+	logger *zap.Logger
+	epoch  string
+
+	lock   sync.Mutex
+	seq    uint64
+	buffer []*NodeEvent
+	subs   map[*nodeEventsSubscriber]struct{}
+}
+
+func newNodeEvents(logger *zap.Logger) *nodeEvents {
+	epoch := make([]byte, 4)
+	_, _ = crand.Read(epoch)
+
+	return &nodeEvents{
+		logger: logger,
+		epoch:  hex.EncodeToString(epoch),
+		subs:   make(map[*nodeEventsSubscriber]struct{}),
+	}
+}
+
+func (ne *nodeEvents) cursor(seq uint64) string {
+	return ne.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+func (ne *nodeEvents) parseCursor(cursor string) (uint64, error) {
+	parts := strings.SplitN(cursor, "-", 2)
+	if len(parts) != 2 || parts[0] != ne.epoch {
+		return 0, ErrEventCursorExpired
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	return seq, nil
+}
+
+func (ne *nodeEvents) publish(typ string, groupPK []byte, pid peer.ID, payload interface{}) {
+	if ne == nil {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		ne.logger.Warn("unable to serialize node event", zap.String("type", typ), zap.Error(err))
+		return
+	}
+
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+
+	ne.seq++
+	e := &NodeEvent{
+		Cursor:  ne.cursor(ne.seq),
+		Type:    typ,
+		At:      time.Now().UnixNano(),
+		GroupPK: groupPK,
+		Payload: data,
+	}
+
+	if pid != "" {
+		e.PeerID = pid.Pretty()
+	}
+
+	ne.buffer = append(ne.buffer, e)
+	if len(ne.buffer) > nodeEventsBufferSize {
+		ne.buffer = ne.buffer[len(ne.buffer)-nodeEventsBufferSize:]
+	}
+
+	for sub := range ne.subs {
+		if !sub.match(e) {
+			continue
+		}
+
+		select {
+		case sub.ch <- e:
+		default:
+			// the stream ends, it is resumed from its last cursor
+			delete(ne.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// subscribe returns the buffered events after the cursor of the request and
+// a subscriber receiving the next ones.
+func (ne *nodeEvents) subscribe(req *EventStreamRequest) ([]*NodeEvent, *nodeEventsSubscriber, error) {
+	sub := &nodeEventsSubscriber{
+		ch:      make(chan *NodeEvent, nodeEventsSubscriberBuffer),
+		types:   make(map[string]struct{}, len(req.Types)),
+		groupPK: req.GroupPK,
+	}
+
+	for _, t := range req.Types {
+		sub.types[t] = struct{}{}
+	}
+
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+
+	replay := []*NodeEvent{}
+	if req.Cursor != "" {
+		seq, err := ne.parseCursor(req.Cursor)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the events in between were dropped
+		oldest := ne.seq - uint64(len(ne.buffer)) + 1
+		if seq > ne.seq || seq+1 < oldest {
+			return nil, nil, ErrEventCursorExpired
+		}
+
+		for _, e := range ne.buffer[seq+1-oldest:] {
+			if sub.match(e) {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	ne.subs[sub] = struct{}{}
+
+	return replay, sub, nil
+}
+
+func (ne *nodeEvents) unsubscribe(sub *nodeEventsSubscriber) {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+
+	if _, ok := ne.subs[sub]; ok {
+		delete(ne.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// start publishes the events of the host: the deliveries, the contact
+// requests, the changes of the conversations and the connections of the
+// peers.
+func (ne *nodeEvents) start(ctx context.Context, h host.Host) {
+	if h == nil {
+		return
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			if len(n.ConnsToPeer(c.RemotePeer())) == 1 {
+				ne.publish(NodeEventPeerConnected, nil, c.RemotePeer(), struct{}{})
+			}
+		},
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				ne.publish(NodeEventPeerDisconnected, nil, c.RemotePeer(), struct{}{})
+			}
+		},
+	})
+
+	sub, err := h.EventBus().Subscribe([]interface{}{
+		new(EvtMessageDeliveryChanged),
+		new(EvtContactLifecycleChanged),
+		new(EvtConversationFlagsChanged),
+		new(EvtContactRequestQuarantined),
+		new(EvtSecurityEvent),
+	})
+	if err != nil {
+		ne.logger.Warn("unable to subscribe to the node events", zap.Error(err))
+		return
+	}
+
+	go func() {
+		defer sub.Close()
+
+		for {
+			select {
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+
+				switch evt := e.(type) {
+				case EvtMessageDeliveryChanged:
+					ne.publish(NodeEventMessageDelivery, evt.Delivery.GroupPK, "", evt.Delivery)
+				case EvtContactLifecycleChanged:
+					ne.publish(NodeEventContactRequest, nil, "", evt.Contact)
+				case EvtConversationFlagsChanged:
+					ne.publish(NodeEventConversationChanged, evt.Flags.GroupPK, "", evt.Flags)
+				case EvtContactRequestQuarantined:
+					ne.publish(NodeEventContactRequestQuarantined, nil, "", evt.Request)
+				case EvtSecurityEvent:
+					ne.publish(NodeEventSecurity, evt.Event.GroupPK, "", evt.Event)
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *service) publishMessageReceived(g *bertytypes.Group, evt *bertytypes.GroupMessageEvent) {
+	e := &MessageReceivedEvent{Message: evt.Message, Notification: s.notificationDecision(g, evt)}
+	if evt.EventContext != nil {
+		e.MessageID = evt.EventContext.ID
+		e.Signature, _ = s.signatures.get(g.PublicKey, evt.EventContext.ID)
+	}
+
+	if evt.Headers != nil {
+		e.DevicePK = evt.Headers.DevicePK
+	}
+
+	s.events.publish(NodeEventMessageReceived, g.PublicKey, "", e)
+}
+
+// EventStream streams the events of the node, the buffered ones after the
+// cursor of the request first. A stream lagging too far behind is closed,
+// the client resumes it from the cursor of the last event it received.
+func (s *service) EventStream(req *EventStreamRequest, srv EventService_EventStreamServer) error {
+	replay, sub, err := s.events.subscribe(req)
+	if err != nil {
+		return err
+	}
+	defer s.events.unsubscribe(sub)
+
+	for _, e := range replay {
+		if err := srv.Send(e); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			if !ok {
+				return errcode.ErrInternal.Wrap(fmt.Errorf("event stream lagging, resume it from the last cursor"))
+			}
+
+			if err := srv.Send(e); err != nil {
+				return err
+			}
+
+		case <-srv.Context().Done():
+			return nil
+		}
+	}
+}
+
+// SubscribeNodeEvents streams the events of the node to an in-process
+// client, e.g. the native callbacks of the bridge, until ctx is done. Unlike
+// EventStream, a subscription lagging behind is resumed from its last event,
+// the events dropped in between are skipped.
+func (s *service) SubscribeNodeEvents(ctx context.Context, req *EventStreamRequest) (<-chan *NodeEvent, error) {
+	replay, sub, err := s.events.subscribe(req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *NodeEvent)
+	go func() {
+		defer close(out)
+
+		cursor := req.Cursor
+		for {
+			for _, e := range replay {
+				select {
+				case out <- e:
+					cursor = e.Cursor
+				case <-ctx.Done():
+					s.events.unsubscribe(sub)
+					return
+				}
+			}
+
+		forward:
+			for {
+				select {
+				case e, ok := <-sub.ch:
+					if !ok {
+						break forward
+					}
+
+					select {
+					case out <- e:
+						cursor = e.Cursor
+					case <-ctx.Done():
+						s.events.unsubscribe(sub)
+						return
+					}
+
+				case <-ctx.Done():
+					s.events.unsubscribe(sub)
+					return
+				}
+			}
+
+			next := &EventStreamRequest{Types: req.Types, GroupPK: req.GroupPK, Cursor: cursor}
+			if replay, sub, err = s.events.subscribe(next); err != nil {
+				s.logger.Warn("node events missed by a subscription", zap.Error(err))
+
+				next.Cursor = ""
+				if replay, sub, err = s.events.subscribe(next); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,91 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNodeEvents(t *testing.T) {
+	ne := newNodeEvents(zap.NewNop())
+	groupPK, otherPK := []byte("group"), []byte("other")
+
+	_, all, err := ne.subscribe(&EventStreamRequest{})
+	require.NoError(t, err)
+
+	_, filtered, err := ne.subscribe(&EventStreamRequest{Types: []string{NodeEventMessageReceived}, GroupPK: groupPK})
+	require.NoError(t, err)
+
+	ne.publish(NodeEventMessageReceived, groupPK, "", &MessageReceivedEvent{Message: []byte("hello")})
+	ne.publish(NodeEventMessageReceived, otherPK, "", &MessageReceivedEvent{Message: []byte("other")})
+	ne.publish(NodeEventTransportState, nil, "", &TransportStateEvent{Connectivity: "wifi"})
+
+	first := <-all.ch
+	assert.Equal(t, NodeEventMessageReceived, first.Type)
+	assert.Equal(t, NodeEventMessageReceived, (<-all.ch).Type)
+	assert.Equal(t, NodeEventTransportState, (<-all.ch).Type)
+
+	e := <-filtered.ch
+	assert.Equal(t, groupPK, e.GroupPK)
+	assert.JSONEq(t, `{"message_id":null,"device_pk":null,"message":"aGVsbG8="}`, string(e.Payload))
+	assert.Len(t, filtered.ch, 0)
+
+	// a stream resumed from a cursor gets the events after it
+	replay, resumed, err := ne.subscribe(&EventStreamRequest{Cursor: first.Cursor})
+	require.NoError(t, err)
+	require.Len(t, replay, 2)
+	assert.Equal(t, otherPK, replay[0].GroupPK)
+	assert.Equal(t, NodeEventTransportState, replay[1].Type)
+	ne.unsubscribe(resumed)
+
+	// the cursors of another run, or of dropped events, are refused
+	_, _, err = ne.subscribe(&EventStreamRequest{Cursor: "deadbeef-1"})
+	assert.Equal(t, ErrEventCursorExpired, err)
+
+	for i := 0; i < nodeEventsBufferSize; i++ {
+		ne.publish(NodeEventPeerConnected, nil, "", struct{}{})
+	}
+
+	_, _, err = ne.subscribe(&EventStreamRequest{Cursor: first.Cursor})
+	assert.Equal(t, ErrEventCursorExpired, err)
+
+	// the lagging streams are closed
+	_, ok := <-all.ch
+	for ok {
+		_, ok = <-all.ch
+	}
+
+	ne.unsubscribe(filtered)
+	_, ok = <-filtered.ch
+	assert.False(t, ok)
+}
+
+func TestSubscribeNodeEvents(t *testing.T) {
+	s := &service{logger: zap.NewNop(), events: newNodeEvents(zap.NewNop())}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := s.SubscribeNodeEvents(ctx, &EventStreamRequest{Types: []string{NodeEventPeerConnected}})
+	require.NoError(t, err)
+
+	// a subscription lagging behind is resumed without missing an event
+	n := nodeEventsSubscriberBuffer + 100
+	for i := 0; i < n; i++ {
+		s.events.publish(NodeEventPeerConnected, nil, "", struct{}{})
+		s.events.publish(NodeEventTransportState, nil, "", &TransportStateEvent{})
+	}
+
+	last := ""
+	for i := 0; i < n; i++ {
+		e := <-ch
+		assert.Equal(t, NodeEventPeerConnected, e.Type)
+		assert.NotEqual(t, last, e.Cursor)
+		last = e.Cursor
+	}
+
+	cancel()
+	for range ch {
+	}
+}
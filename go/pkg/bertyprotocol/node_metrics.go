@@ -0,0 +1,50 @@
+package bertyprotocol
+
+import (
+	bertymetrics "berty.tech/berty/v2/go/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// registerMetrics adds the state of the service read on each scrape to the
+// metrics: the outbound queue, the active groups and the datastores.
+func (s *service) registerMetrics(reg *bertymetrics.Registry) {
+	if reg == nil {
+		return
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func() float64
+	}{
+		{"outbound_queue_depth", "Messages sent by the device waiting for an ack.", func() float64 {
+			queued, err := s.outbound.list(nil)
+			if err != nil {
+				return 0
+			}
+
+			return float64(len(queued))
+		}},
+		{"active_groups", "Groups activated on the device.", func() float64 {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+
+			return float64(len(s.openedGroups))
+		}},
+		{"conversation_peers", "Peers connected for the conversations.", func() float64 {
+			return float64(len(s.ConversationPeers()))
+		}},
+	}
+
+	for _, g := range gauges {
+		if err := reg.RegisterGauge(g.name, g.help, g.value); err != nil {
+			s.logger.Warn("unable to register metric", zap.String("name", g.name), zap.Error(err))
+		}
+	}
+
+	reg.RegisterDatastore("root", s.rootDatastore)
+
+	if s.orbitDir != "" && s.orbitDir != ":memory:" {
+		reg.RegisterDirectory("orbitdb", s.orbitDir)
+	}
+}
@@ -0,0 +1,469 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+)
+
+// notificationRulesPrefix marks the app metadata of the account group
+// changing a notification rule, so every device of the account applies it
+const notificationRulesPrefix = "\x00berty.notifrules/1\x00"
+
+// minutesPerDay bounds the quiet hours.
+const minutesPerDay = 24 * 60
+
+// NotificationRuleKind is the kind of a notification rule.
+type NotificationRuleKind string
+
+const (
+	// NotificationRuleMentionOnly only notifies the messages mentioning one
+	// of the keywords of the rule, e.g. @alice.
+	NotificationRuleMentionOnly NotificationRuleKind = "mention_only"
+
+	// NotificationRuleQuietHours silences the notifications between the
+	// start and the end of the rule, every day.
+	NotificationRuleQuietHours NotificationRuleKind = "quiet_hours"
+
+	// NotificationRuleContactPriority notifies the messages of a contact
+	// with a high priority, they break through the mention only rules and
+	// the quiet hours, not through a mute.
+	NotificationRuleContactPriority NotificationRuleKind = "contact_priority"
+)
+
+// The reasons of the notification decisions.
+const (
+	NotificationReasonMuted       = "muted"
+	NotificationReasonMentionOnly = "mention_only"
+	NotificationReasonQuietHours  = "quiet_hours"
+	NotificationReasonPriority    = "priority"
+)
+
+// NotificationRule is a rule deciding whether a message is notified, shared
+// by the devices of the account. The muted conversations are never
+// notified, see ConversationFlagMuted.
+type NotificationRule struct {
+	ID   string               `json:"id"`
+	Kind NotificationRuleKind `json:"kind"`
+
+	// GroupPK restricts a mention only or quiet hours rule to a
+	// conversation, they apply to all of them otherwise
+	GroupPK []byte `json:"group_pk,omitempty"`
+
+	// ContactPK is the contact of a contact priority rule, its messages are
+	// matched in the conversation with the contact
+	ContactPK []byte `json:"contact_pk,omitempty"`
+
+	// Keywords are the mentions of a mention only rule, matched without the
+	// case after an @
+	Keywords []string `json:"keywords,omitempty"`
+
+	// Start and End are the quiet hours in minutes since midnight, the
+	// hours span midnight if End is before Start. Location is the IANA time
+	// zone they are in, the local one if empty.
+	Start    int    `json:"start,omitempty"`
+	End      int    `json:"end,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+// NotificationDecision tags the message received events, the clients only
+// notify the messages with Notify set.
+type NotificationDecision struct {
+	Notify   bool `json:"notify"`
+	Priority bool `json:"priority,omitempty"`
+
+	// Reason is the rule which silenced the message, or
+	// NotificationReasonPriority for the priority ones
+	Reason string `json:"reason,omitempty"`
+}
+
+func validNotificationRule(rule *NotificationRule) error {
+	switch rule.Kind {
+	case NotificationRuleMentionOnly:
+		if len(rule.Keywords) == 0 {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no keyword"))
+		}
+
+	case NotificationRuleQuietHours:
+		if rule.Start < 0 || rule.Start >= minutesPerDay || rule.End < 0 || rule.End >= minutesPerDay || rule.Start == rule.End {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid quiet hours %d-%d", rule.Start, rule.End))
+		}
+
+		if _, err := rule.location(); err != nil {
+			return errcode.ErrInvalidInput.Wrap(err)
+		}
+
+	case NotificationRuleContactPriority:
+		if len(rule.ContactPK) == 0 {
+			return errcode.ErrMissingInput.Wrap(fmt.Errorf("no contact"))
+		}
+
+	default:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown notification rule kind %q", rule.Kind))
+	}
+
+	return nil
+}
+
+// appliesTo reports whether a rule applies to a conversation.
+func (rule *NotificationRule) appliesTo(groupPK []byte) bool {
+	return len(rule.GroupPK) == 0 || bytes.Equal(rule.GroupPK, groupPK)
+}
+
+// mentioned reports whether a text mentions one of the keywords of a rule.
+func (rule *NotificationRule) mentioned(text string) bool {
+	text = strings.ToLower(text)
+	for _, keyword := range rule.Keywords {
+		if keyword != "" && strings.Contains(text, "@"+strings.ToLower(keyword)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule *NotificationRule) location() (*time.Location, error) {
+	if rule.Location == "" {
+		return time.Local, nil
+	}
+
+	return time.LoadLocation(rule.Location)
+}
+
+// quiet reports whether a time is in the quiet hours of a rule.
+func (rule *NotificationRule) quiet(now time.Time) bool {
+	loc, err := rule.location()
+	if err != nil {
+		return false
+	}
+
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+
+	if rule.Start < rule.End {
+		return minute >= rule.Start && minute < rule.End
+	}
+
+	return minute >= rule.Start || minute < rule.End
+}
+
+// decideNotification applies the rules to a message of a member of a
+// conversation, text is the text of the message.
+func decideNotification(rules []*NotificationRule, flags *ConversationFlags, groupPK, memberPK []byte, text string, now time.Time) *NotificationDecision {
+	if flags != nil && flags.IsMuted(now) {
+		return &NotificationDecision{Reason: NotificationReasonMuted}
+	}
+
+	for _, rule := range rules {
+		if rule.Kind == NotificationRuleContactPriority && len(memberPK) > 0 && bytes.Equal(rule.ContactPK, memberPK) {
+			return &NotificationDecision{Notify: true, Priority: true, Reason: NotificationReasonPriority}
+		}
+	}
+
+	for _, rule := range rules {
+		if !rule.appliesTo(groupPK) {
+			continue
+		}
+
+		switch {
+		case rule.Kind == NotificationRuleMentionOnly && !rule.mentioned(text):
+			return &NotificationDecision{Reason: NotificationReasonMentionOnly}
+		case rule.Kind == NotificationRuleQuietHours && rule.quiet(now):
+			return &NotificationDecision{Reason: NotificationReasonQuietHours}
+		}
+	}
+
+	return &NotificationDecision{Notify: true}
+}
+
+// notificationRuleOp is the change of a rule, sent on the account group.
+type notificationRuleOp struct {
+	ID      string            `json:"id"`
+	Rule    *NotificationRule `json:"rule,omitempty"`
+	Deleted bool              `json:"deleted,omitempty"`
+	At      int64             `json:"at"`
+}
+
+type notificationRuleRecord struct {
+	Rule     *NotificationRule `json:"rule,omitempty"`
+	Deleted  bool              `json:"deleted,omitempty"`
+	At       int64             `json:"at"`
+	DevicePK []byte            `json:"device_pk"`
+}
+
+// newer reports whether a change wins over the current one, the latest wins
+// and the device keys break the ties so every device converges.
+func (r *notificationRuleRecord) newer(at int64, devicePK []byte) bool {
+	if at != r.At {
+		return at > r.At
+	}
+
+	return bytes.Compare(devicePK, r.DevicePK) > 0
+}
+
+// notificationRules persists the notification rules, each rule is changed by
+// the last writer. The deleted rules are kept so an older change can't
+// restore them.
+type notificationRules struct {
+	logger *zap.Logger
+	store  datastore.Batching
+
+	lock  sync.Mutex
+	cache []*NotificationRule
+}
+
+func newNotificationRules(logger *zap.Logger, store datastore.Batching) *notificationRules {
+	return &notificationRules{
+		logger: logger,
+		store:  store,
+	}
+}
+
+// change applies the change of a rule by a device, it reports whether the
+// rule changed.
+func (nr *notificationRules) change(op *notificationRuleOp, devicePK []byte) (bool, error) {
+	if op.ID == "" {
+		return false, errcode.ErrMissingInput
+	}
+
+	if !op.Deleted {
+		if op.Rule == nil || op.Rule.ID != op.ID {
+			return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid notification rule"))
+		}
+
+		if err := validNotificationRule(op.Rule); err != nil {
+			return false, err
+		}
+	}
+
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+
+	key := datastore.NewKey(base64.RawURLEncoding.EncodeToString([]byte(op.ID)))
+	data, err := nr.store.Get(key)
+	switch err {
+	case nil:
+		current := &notificationRuleRecord{}
+		if err := json.Unmarshal(data, current); err != nil {
+			return false, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if !current.newer(op.At, devicePK) {
+			return false, nil
+		}
+
+	case datastore.ErrNotFound:
+
+	default:
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	rec := &notificationRuleRecord{At: op.At, DevicePK: devicePK, Deleted: op.Deleted}
+	if !op.Deleted {
+		rec.Rule = op.Rule
+	}
+
+	if data, err = json.Marshal(rec); err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := nr.store.Put(key, data); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	nr.cache = nil
+
+	return true, nil
+}
+
+// all returns the rules, ordered by ID. They are read from the store once,
+// then cached until a change.
+func (nr *notificationRules) all() ([]*NotificationRule, error) {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+
+	if nr.cache != nil {
+		return nr.cache, nil
+	}
+
+	res, err := nr.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	rules := []*NotificationRule{}
+	for _, entry := range entries {
+		rec := &notificationRuleRecord{}
+		if err := json.Unmarshal(entry.Value, rec); err != nil {
+			nr.logger.Warn("unable to read notification rule", zap.Error(err))
+			continue
+		}
+
+		if !rec.Deleted && rec.Rule != nil {
+			rules = append(rules, rec.Rule)
+		}
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	nr.cache = rules
+
+	return rules, nil
+}
+
+// applyNotificationRule applies an app metadata event of the account group
+// if it changes a notification rule.
+func (s *service) applyNotificationRule(evt *bertytypes.GroupMetadataEvent) {
+	am, payload, ok := appMetadataWithPrefix(evt, notificationRulesPrefix)
+	if !ok {
+		return
+	}
+
+	op := &notificationRuleOp{}
+	if err := json.Unmarshal(payload, op); err != nil {
+		s.logger.Debug("invalid notification rule change", zap.Error(err))
+		return
+	}
+
+	if _, err := s.notifRules.change(op, am.DevicePK); err != nil {
+		s.logger.Debug("unable to apply notification rule change", zap.Error(err))
+	}
+}
+
+// watchNotificationRules applies the rule changes of the account group, the
+// ones made by the other devices while this one was offline are applied from
+// the history first.
+func (s *service) watchNotificationRules(ctx context.Context, acc *groupContext) {
+	sub := acc.metadataStore.Subscribe(ctx)
+
+	for evt := range acc.metadataStore.ListEvents(ctx) {
+		if evt == nil {
+			break
+		}
+
+		s.applyNotificationRule(evt)
+	}
+
+	for e := range sub {
+		if evt, ok := e.(*bertytypes.GroupMetadataEvent); ok {
+			s.applyNotificationRule(evt)
+		}
+	}
+}
+
+// sendNotificationRuleOp applies a change of a rule and sends it to the
+// other devices of the account.
+func (s *service) sendNotificationRuleOp(ctx context.Context, op *notificationRuleOp) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	devicePK, err := s.accountGroup.DevicePubKey().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := s.notifRules.change(op, devicePK); err != nil {
+		return err
+	}
+
+	if _, err := s.accountGroup.MetadataStore().SendAppMetadata(ctx, append([]byte(notificationRulesPrefix), data...)); err != nil {
+		return errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
+
+// NotificationRuleSet creates or replaces a notification rule on every
+// device of the account, a rule without ID is given a new one.
+func (s *service) NotificationRuleSet(ctx context.Context, rule *NotificationRule) (*NotificationRule, error) {
+	if rule == nil {
+		return nil, errcode.ErrMissingInput
+	}
+
+	copied := *rule
+	rule = &copied
+	if rule.ID == "" {
+		id := make([]byte, 8)
+		if _, err := crand.Read(id); err != nil {
+			return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+		}
+
+		rule.ID = hex.EncodeToString(id)
+	}
+
+	if err := validNotificationRule(rule); err != nil {
+		return nil, err
+	}
+
+	if err := s.sendNotificationRuleOp(ctx, &notificationRuleOp{ID: rule.ID, Rule: rule, At: time.Now().UnixNano()}); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// NotificationRuleDelete deletes a notification rule on every device of the
+// account.
+func (s *service) NotificationRuleDelete(ctx context.Context, id string) error {
+	rules, err := s.notifRules.all()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, rule := range rules {
+		found = found || rule.ID == id
+	}
+
+	if !found {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown rule %q", id))
+	}
+
+	return s.sendNotificationRuleOp(ctx, &notificationRuleOp{ID: id, Deleted: true, At: time.Now().UnixNano()})
+}
+
+// NotificationRuleList returns the notification rules of the account.
+func (s *service) NotificationRuleList(_ context.Context) ([]*NotificationRule, error) {
+	return s.notifRules.all()
+}
+
+// notificationDecision decides whether a message received in a group is
+// notified. The events are always emitted, failing the rules notifies.
+func (s *service) notificationDecision(g *bertytypes.Group, evt *bertytypes.GroupMessageEvent) *NotificationDecision {
+	rules, err := s.notifRules.all()
+	if err != nil {
+		s.logger.Warn("unable to read the notification rules", zap.Error(err))
+	}
+
+	flags, err := s.flags.get(g.PublicKey)
+	if err != nil {
+		s.logger.Warn("unable to read the conversation flags", zap.Error(err))
+	}
+
+	var memberPK []byte
+	if gc, err := s.getContextGroupForID(g.PublicKey); err == nil && evt.Headers != nil {
+		_, memberPK, _ = deviceMember(gc, evt.Headers.DevicePK)
+	}
+
+	return decideNotification(rules, flags, g.PublicKey, memberPK, s.extractSearchText(evt.Message), time.Now())
+}
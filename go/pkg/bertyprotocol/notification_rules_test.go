@@ -0,0 +1,82 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDecideNotification(t *testing.T) {
+	groupPK, otherPK, alicePK := []byte("group"), []byte("other"), []byte("alice")
+	night := time.Date(2020, 10, 14, 23, 30, 0, 0, time.UTC)
+	day := time.Date(2020, 10, 14, 14, 0, 0, 0, time.UTC)
+
+	rules := []*NotificationRule{
+		{ID: "1", Kind: NotificationRuleMentionOnly, GroupPK: groupPK, Keywords: []string{"Bob"}},
+		{ID: "2", Kind: NotificationRuleQuietHours, Start: 22 * 60, End: 7 * 60, Location: "UTC"},
+		{ID: "3", Kind: NotificationRuleContactPriority, ContactPK: alicePK},
+	}
+
+	decision := decideNotification(rules, nil, groupPK, nil, "hello", day)
+	assert.False(t, decision.Notify)
+	assert.Equal(t, NotificationReasonMentionOnly, decision.Reason)
+
+	decision = decideNotification(rules, nil, groupPK, nil, "hello @bob", day)
+	assert.True(t, decision.Notify)
+
+	// the mention only rule is scoped to the group, the quiet hours span
+	// midnight
+	assert.True(t, decideNotification(rules, nil, otherPK, nil, "hello", day).Notify)
+	decision = decideNotification(rules, nil, otherPK, nil, "hello", night)
+	assert.False(t, decision.Notify)
+	assert.Equal(t, NotificationReasonQuietHours, decision.Reason)
+
+	// the priority contacts break through, not through a mute
+	decision = decideNotification(rules, nil, groupPK, alicePK, "hello", night)
+	assert.True(t, decision.Notify)
+	assert.True(t, decision.Priority)
+
+	muted := &ConversationFlags{GroupPK: groupPK, Muted: true}
+	decision = decideNotification(rules, muted, groupPK, alicePK, "hello @bob", day)
+	assert.False(t, decision.Notify)
+	assert.Equal(t, NotificationReasonMuted, decision.Reason)
+}
+
+func TestNotificationRules(t *testing.T) {
+	nr := newNotificationRules(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()))
+	phone, laptop := []byte("phone"), []byte("laptop")
+	now := time.Now()
+
+	change := func(op *notificationRuleOp, devicePK []byte) bool {
+		changed, err := nr.change(op, devicePK)
+		require.NoError(t, err)
+		return changed
+	}
+
+	quiet := &NotificationRule{ID: "quiet", Kind: NotificationRuleQuietHours, Start: 22 * 60, End: 7 * 60}
+	assert.True(t, change(&notificationRuleOp{ID: "quiet", Rule: quiet, At: now.UnixNano()}, phone))
+
+	rules, err := nr.all()
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, quiet, rules[0])
+
+	// a deletion can't be undone by an older change
+	assert.True(t, change(&notificationRuleOp{ID: "quiet", Deleted: true, At: now.Add(time.Second).UnixNano()}, laptop))
+	assert.False(t, change(&notificationRuleOp{ID: "quiet", Rule: quiet, At: now.UnixNano()}, phone))
+
+	rules, err = nr.all()
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	_, err = nr.change(&notificationRuleOp{ID: "invalid", Rule: &NotificationRule{ID: "invalid", Kind: NotificationRuleQuietHours, Start: 60, End: 60}, At: now.UnixNano()}, phone)
+	assert.Error(t, err)
+
+	_, err = nr.change(&notificationRuleOp{ID: "unknown", Rule: &NotificationRule{ID: "unknown", Kind: "starred"}, At: now.UnixNano()}, phone)
+	assert.Error(t, err)
+}
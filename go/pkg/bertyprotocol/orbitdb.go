@@ -30,6 +30,11 @@ type bertyOrbitDB struct {
 	keyStore        *BertySignedKeyStore
 	messageKeystore *MessageKeystore
 	deviceKeystore  DeviceKeystore
+	ratchets        *ratchetManager
+	revocations     *deviceRevocations
+	audit           *securityAudit
+	signatures      *messageSignatures
+	tracer          trace.Tracer
 }
 
 func (s *bertyOrbitDB) GetContactGroup(pk crypto.PubKey) (*bertytypes.Group, error) {
@@ -89,6 +94,7 @@ func newBertyOrbitDB(ctx context.Context, ipfs coreapi.CoreAPI, acc DeviceKeysto
 		keyStore:        ks,
 		deviceKeystore:  acc,
 		messageKeystore: mk,
+		tracer:          options.Tracer,
 	}
 
 	if err := bertyDB.RegisterAccessControllerType(NewSimpleAccessController); err != nil {
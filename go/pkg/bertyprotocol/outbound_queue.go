@@ -0,0 +1,605 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"go.uber.org/zap"
+)
+
+const (
+	// outboundBaseDelay is the delay before the first retry of a message,
+	// longer than an ack takes to come back from a reachable device
+	outboundBaseDelay = time.Minute
+
+	// outboundMaxDelay caps the exponential backoff of the retries
+	outboundMaxDelay = time.Hour
+
+	// maxOutboundFailures is the number of failed retries after which a
+	// message is quarantined, the retries without any member reachable
+	// don't count
+	maxOutboundFailures = 8
+
+	// outboundBudgetWindow is the period the retry budgets are counted over
+	outboundBudgetWindow = time.Hour
+)
+
+// OutboundMessage is a message sent by the device and not acknowledged by
+// any other device of its group yet, its entry is published again until it
+// is.
+type OutboundMessage struct {
+	GroupPK   []byte    `json:"group_pk"`
+	MessageID []byte    `json:"message_id"`
+	Size      int       `json:"size"`
+	QueuedAt  time.Time `json:"queued_at"`
+
+	// Attempts are the retries so far, Failures the ones which failed
+	// while a member was reachable
+	Attempts  int    `json:"attempts"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+
+	// Quarantined messages kept failing, they aren't retried anymore until
+	// the queue is flushed
+	Quarantined bool `json:"quarantined,omitempty"`
+
+	// Deferred messages wait for the retry policy of the current network to
+	// allow them, or for another network
+	Deferred bool `json:"deferred,omitempty"`
+
+	// Flushed messages are retried once whatever the retry policy
+	Flushed bool `json:"flushed,omitempty"`
+}
+
+// EvtOutboundMessageQuarantined is emitted on the event bus of the host
+// when a message is quarantined.
+type EvtOutboundMessageQuarantined struct {
+	Message *OutboundMessage
+}
+
+// OutboundRetryPolicy bounds the retries while the device is on a kind of
+// network, so a metered link isn't drained by the large messages.
+type OutboundRetryPolicy struct {
+	// MaxMessageSize is the size of the largest message retried, 0 doesn't
+	// limit it
+	MaxMessageSize int
+
+	// Budget is the number of bytes the retries can send per
+	// outboundBudgetWindow, 0 doesn't limit it
+	Budget int64
+}
+
+// DefaultOutboundRetryPolicies only limits the retries over cellular, no
+// retry is attempted without a network and the other kinds aren't limited.
+var DefaultOutboundRetryPolicies = map[ipfsutil.Connectivity]OutboundRetryPolicy{
+	ipfsutil.ConnectivityCellular: {MaxMessageSize: 64 << 10, Budget: 2 << 20},
+}
+
+// errOutboundPolicy is returned for a retry deferred by the policy of the
+// current network
+var errOutboundPolicy = fmt.Errorf("retry deferred by the network policy")
+
+type outboundBudget struct {
+	start time.Time
+	spent int64
+}
+
+// outboundQueue persists the messages of the device waiting for an ack and
+// retries them with an exponential backoff, the retries are handed to the
+// service.
+type outboundQueue struct {
+	logger   *zap.Logger
+	store    datastore.Batching
+	emitter  event.Emitter
+	policies map[ipfsutil.Connectivity]OutboundRetryPolicy
+	notify   chan struct{}
+
+	// retry publishes a message again, it returns the number of bytes sent,
+	// 0 if no member is reachable, it is set by the service
+	retry func(m *OutboundMessage) (int, error)
+
+	// connectivity returns the current network of the device
+	connectivity func() ipfsutil.Connectivity
+
+	lock    sync.Mutex
+	budgets map[ipfsutil.Connectivity]*outboundBudget
+}
+
+func newOutboundQueue(logger *zap.Logger, store datastore.Batching, h host.Host) (*outboundQueue, error) {
+	q := &outboundQueue{
+		logger:       logger,
+		store:        store,
+		policies:     DefaultOutboundRetryPolicies,
+		notify:       make(chan struct{}, 1),
+		connectivity: func() ipfsutil.Connectivity { return ipfsutil.ConnectivityUnknown },
+		budgets:      make(map[ipfsutil.Connectivity]*outboundBudget),
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtOutboundMessageQuarantined))
+		if err != nil {
+			return nil, err
+		}
+
+		q.emitter = emitter
+	}
+
+	return q, nil
+}
+
+func outboundKey(groupPK, messageID []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		base64.RawURLEncoding.EncodeToString(groupPK),
+		base64.RawURLEncoding.EncodeToString(messageID),
+	})
+}
+
+func (q *outboundQueue) getLocked(groupPK, messageID []byte) (*OutboundMessage, error) {
+	data, err := q.store.Get(outboundKey(groupPK, messageID))
+	if err == datastore.ErrNotFound {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("message not queued"))
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	m := &OutboundMessage{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return m, nil
+}
+
+func (q *outboundQueue) putLocked(m *OutboundMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := q.store.Put(outboundKey(m.GroupPK, m.MessageID), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (q *outboundQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// add queues a message just sent.
+func (q *outboundQueue) add(groupPK, messageID []byte, size int, now time.Time) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, err := q.getLocked(groupPK, messageID); err == nil {
+		return nil
+	}
+
+	m := &OutboundMessage{
+		GroupPK:       groupPK,
+		MessageID:     messageID,
+		Size:          size,
+		QueuedAt:      now,
+		NextAttemptAt: now.Add(outboundBaseDelay),
+	}
+
+	if err := q.putLocked(m); err != nil {
+		return err
+	}
+
+	q.wake()
+
+	return nil
+}
+
+// done removes a message once acknowledged, or once it shouldn't be sent
+// anymore.
+func (q *outboundQueue) done(groupPK, messageID []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.store.Delete(outboundKey(groupPK, messageID)); err != nil && err != datastore.ErrNotFound {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// list returns the queued messages of a group, or of all the groups if it is
+// nil, the next one first.
+func (q *outboundQueue) list(groupPK []byte) ([]*OutboundMessage, error) {
+	res, err := q.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	messages := []*OutboundMessage{}
+	for _, entry := range entries {
+		m := &OutboundMessage{}
+		if err := json.Unmarshal(entry.Value, m); err != nil {
+			q.logger.Warn("unable to read outbound message", zap.Error(err))
+			continue
+		}
+
+		if groupPK == nil || string(m.GroupPK) == string(groupPK) {
+			messages = append(messages, m)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].NextAttemptAt.Before(messages[j].NextAttemptAt) })
+
+	return messages, nil
+}
+
+// flush retries the messages of a group, or of all the groups if it is nil,
+// right away, the quarantined ones included, it returns the number of
+// messages flushed.
+func (q *outboundQueue) flush(groupPK []byte, now time.Time) (int, error) {
+	messages, err := q.list(groupPK)
+	if err != nil {
+		return 0, err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	count := 0
+	for _, queued := range messages {
+		m, err := q.getLocked(queued.GroupPK, queued.MessageID)
+		if err != nil {
+			// acknowledged meanwhile
+			continue
+		}
+
+		m.Quarantined = false
+		m.Failures = 0
+		m.Deferred = false
+		m.Flushed = true
+		m.NextAttemptAt = now
+
+		if err := q.putLocked(m); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	q.wake()
+
+	return count, nil
+}
+
+// networkChanged makes the deferred messages due, the policy of the new
+// network may allow them.
+func (q *outboundQueue) networkChanged(now time.Time) {
+	messages, err := q.list(nil)
+	if err != nil {
+		q.logger.Error("unable to list outbound messages", zap.Error(err))
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, queued := range messages {
+		m, err := q.getLocked(queued.GroupPK, queued.MessageID)
+		if err != nil || !m.Deferred {
+			continue
+		}
+
+		m.Deferred = false
+		m.NextAttemptAt = now
+
+		if err := q.putLocked(m); err != nil {
+			q.logger.Error("unable to keep outbound message", zap.Error(err))
+			return
+		}
+	}
+
+	q.wake()
+}
+
+// expedite makes the messages waiting for their backoff due, e.g. during a
+// background sync, the quarantined and deferred ones are left as is. It
+// returns the number of messages retried.
+func (q *outboundQueue) expedite(now time.Time) (int, error) {
+	messages, err := q.list(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	count := 0
+	for _, queued := range messages {
+		m, err := q.getLocked(queued.GroupPK, queued.MessageID)
+		if err != nil || m.Quarantined || m.Deferred {
+			continue
+		}
+
+		if m.NextAttemptAt.After(now) {
+			m.NextAttemptAt = now
+			if err := q.putLocked(m); err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+
+	q.wake()
+
+	return count, nil
+}
+
+// waiting returns the number of messages which can still be retried.
+func (q *outboundQueue) waiting() (int, error) {
+	messages, err := q.list(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range messages {
+		if !m.Quarantined && !m.Deferred {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// allowed reports whether the policy of the current network lets a message
+// be retried, and spends its size from the budget if so.
+func (q *outboundQueue) allowed(connectivity ipfsutil.Connectivity, m *OutboundMessage, now time.Time) bool {
+	policy, ok := q.policies[connectivity]
+	if !ok {
+		return true
+	}
+
+	if policy.MaxMessageSize > 0 && m.Size > policy.MaxMessageSize {
+		return false
+	}
+
+	if policy.Budget <= 0 {
+		return true
+	}
+
+	b, ok := q.budgets[connectivity]
+	if !ok || now.Sub(b.start) >= outboundBudgetWindow {
+		b = &outboundBudget{start: now}
+		q.budgets[connectivity] = b
+	}
+
+	if b.spent+int64(m.Size) > policy.Budget {
+		return false
+	}
+
+	b.spent += int64(m.Size)
+
+	return true
+}
+
+func outboundBackoff(attempts int) time.Duration {
+	delay := outboundBaseDelay
+	for i := 1; i < attempts && delay < outboundMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > outboundMaxDelay {
+		delay = outboundMaxDelay
+	}
+
+	return delay
+}
+
+// attempt retries a due message and schedules its next attempt, a message
+// failing maxOutboundFailures times, or failing to be encoded, is
+// quarantined.
+func (q *outboundQueue) attempt(groupPK, messageID []byte, now time.Time) {
+	q.lock.Lock()
+	m, err := q.getLocked(groupPK, messageID)
+	if err != nil {
+		// acknowledged meanwhile
+		q.lock.Unlock()
+		return
+	}
+	allowed := m.Flushed || q.allowed(q.connectivity(), m, now)
+	q.lock.Unlock()
+
+	sent := 0
+	err = errOutboundPolicy
+	if allowed {
+		sent, err = q.retry(m)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// acknowledged meanwhile
+	if _, getErr := q.getLocked(m.GroupPK, m.MessageID); getErr != nil {
+		return
+	}
+
+	if err == errOutboundPolicy {
+		m.Deferred = true
+		m.NextAttemptAt = now.Add(outboundBudgetWindow)
+		if err := q.putLocked(m); err != nil {
+			q.logger.Error("unable to keep outbound message", zap.Error(err))
+		}
+		return
+	}
+
+	m.Flushed = false
+	m.Attempts++
+	m.NextAttemptAt = now.Add(outboundBackoff(m.Attempts))
+
+	switch {
+	case err != nil:
+		m.Failures++
+		m.LastError = err.Error()
+		if m.Failures >= maxOutboundFailures || errcode.Has(err, errcode.ErrSerialization) {
+			m.Quarantined = true
+		}
+	case sent == 0:
+		m.LastError = "no member reachable"
+	default:
+		m.LastError = ""
+	}
+
+	if err := q.putLocked(m); err != nil {
+		q.logger.Error("unable to keep outbound message", zap.Error(err))
+		return
+	}
+
+	if m.Quarantined && q.emitter != nil {
+		if err := q.emitter.Emit(EvtOutboundMessageQuarantined{Message: m}); err != nil {
+			q.logger.Warn("unable to emit quarantined message event", zap.Error(err))
+		}
+	}
+}
+
+// run retries the due messages until the context is done, it is woken up by
+// the new messages, the flushes and the network changes.
+func (q *outboundQueue) run(ctx context.Context) {
+	for {
+		next := outboundMaxDelay
+
+		messages, err := q.list(nil)
+		if err != nil {
+			q.logger.Error("unable to list outbound messages", zap.Error(err))
+		}
+
+		offline := q.connectivity() == ipfsutil.ConnectivityNone
+		for _, m := range messages {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if m.Quarantined || (offline && !m.Flushed) {
+				continue
+			}
+
+			now := time.Now()
+			if delay := m.NextAttemptAt.Sub(now); delay > 0 {
+				if delay < next {
+					next = delay
+				}
+				continue
+			}
+
+			q.attempt(m.GroupPK, m.MessageID, now)
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-q.notify:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// retryOutbound publishes the entry of a queued message again to the
+// members of its group, it fails while the group isn't active.
+func (s *service) retryOutbound(m *OutboundMessage) (int, error) {
+	gc, err := s.getContextGroupForID(m.GroupPK)
+	if err != nil {
+		return 0, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if s.host != nil {
+		reachable := false
+		for _, p := range s.conversations.groupPeers(m.GroupPK) {
+			if s.host.Network().Connectedness(p) == network.Connected {
+				reachable = true
+				break
+			}
+		}
+
+		if !reachable {
+			return 0, nil
+		}
+	}
+
+	c, err := cid.Cast(m.MessageID)
+	if err != nil {
+		return 0, errcode.ErrSerialization.Wrap(err)
+	}
+
+	e, ok := gc.MessageStore().OpLog().GetEntries().Get(c.String())
+	if !ok {
+		return 0, errcode.ErrSerialization.Wrap(fmt.Errorf("entry not found in the message store"))
+	}
+
+	if err := s.carryMessage(s.ctx, gc.Group(), e); err != nil {
+		s.logger.Warn("unable to carry message", zap.Error(err))
+	}
+
+	if err := s.publishMessage(s.ctx, gc.Group(), e); err != nil {
+		return 0, err
+	}
+
+	return m.Size, nil
+}
+
+func (s *service) outboundConnectivity() ipfsutil.Connectivity {
+	if s.network == nil {
+		return ipfsutil.ConnectivityUnknown
+	}
+
+	return s.network.Connectivity()
+}
+
+// OutboundQueue returns the messages of a group waiting for an ack, or of
+// all the groups if groupPK is nil, the next retried first.
+func (s *service) OutboundQueue(_ context.Context, groupPK []byte) ([]*OutboundMessage, error) {
+	return s.outbound.list(groupPK)
+}
+
+// OutboundFlush retries the queued messages of a group, or of all the groups
+// if groupPK is nil, right away whatever the retry policy, the quarantined
+// ones included. It returns the number of messages retried.
+func (s *service) OutboundFlush(_ context.Context, groupPK []byte) (int, error) {
+	return s.outbound.flush(groupPK, time.Now())
+}
+
+// OutboundDrop stops retrying a message, e.g. a quarantined one, it stays in
+// the store of its group.
+func (s *service) OutboundDrop(_ context.Context, groupPK []byte, messageID []byte) error {
+	s.outbound.lock.Lock()
+	_, err := s.outbound.getLocked(groupPK, messageID)
+	s.outbound.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return s.outbound.done(groupPK, messageID)
+}
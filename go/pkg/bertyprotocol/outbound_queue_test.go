@@ -0,0 +1,132 @@
+package bertyprotocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestOutboundBackoff(t *testing.T) {
+	assert.Equal(t, outboundBaseDelay, outboundBackoff(1))
+	assert.Equal(t, 2*outboundBaseDelay, outboundBackoff(2))
+	assert.Equal(t, outboundMaxDelay, outboundBackoff(64))
+}
+
+func TestOutboundQueue(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	q, err := newOutboundQueue(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	connectivity := ipfsutil.ConnectivityWiFi
+	q.connectivity = func() ipfsutil.Connectivity { return connectivity }
+
+	var (
+		retried []string
+		result  = func() (int, error) { return 0, nil }
+	)
+	q.retry = func(m *OutboundMessage) (int, error) {
+		retried = append(retried, string(m.MessageID))
+		return result()
+	}
+
+	groupPK := []byte("group")
+	now := time.Now()
+
+	get := func(messageID string) *OutboundMessage {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+
+		m, err := q.getLocked(groupPK, []byte(messageID))
+		require.NoError(t, err)
+		return m
+	}
+
+	require.NoError(t, q.add(groupPK, []byte("small"), 1<<10, now))
+	require.NoError(t, q.add(groupPK, []byte("large"), 1<<20, now))
+	require.NoError(t, q.add(groupPK, []byte("large"), 1<<20, now.Add(time.Hour)))
+
+	list, err := q.list(groupPK)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, now.Add(outboundBaseDelay).UnixNano(), list[0].NextAttemptAt.UnixNano())
+
+	// the retries without any member reachable don't count as failures
+	q.attempt(groupPK, []byte("small"), now)
+	m := get("small")
+	assert.Equal(t, 1, m.Attempts)
+	assert.Zero(t, m.Failures)
+	assert.False(t, m.Quarantined)
+
+	// a large message isn't retried over cellular, until another network
+	connectivity = ipfsutil.ConnectivityCellular
+	q.attempt(groupPK, []byte("large"), now)
+	assert.Equal(t, []string{"small"}, retried)
+	assert.True(t, get("large").Deferred)
+
+	connectivity = ipfsutil.ConnectivityWiFi
+	q.networkChanged(now)
+	m = get("large")
+	assert.False(t, m.Deferred)
+	assert.Equal(t, now.UnixNano(), m.NextAttemptAt.UnixNano())
+
+	// a message failing repeatedly is quarantined, a flush retries it once
+	// whatever the network
+	result = func() (int, error) { return 0, fmt.Errorf("publish failed") }
+	for i := 0; i < maxOutboundFailures; i++ {
+		q.attempt(groupPK, []byte("large"), now)
+	}
+	m = get("large")
+	assert.True(t, m.Quarantined)
+	assert.Equal(t, "publish failed", m.LastError)
+
+	connectivity = ipfsutil.ConnectivityCellular
+	result = func() (int, error) { return 1 << 20, nil }
+	count, err := q.flush(groupPK, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	retried = nil
+	q.attempt(groupPK, []byte("large"), now)
+	assert.Equal(t, []string{"large"}, retried)
+	m = get("large")
+	assert.False(t, m.Quarantined)
+	assert.False(t, m.Flushed)
+	assert.Empty(t, m.LastError)
+
+	// an acknowledged message isn't retried anymore
+	require.NoError(t, q.done(groupPK, []byte("small")))
+	retried = nil
+	q.attempt(groupPK, []byte("small"), now)
+	assert.Empty(t, retried)
+
+	list, err = q.list(nil)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestOutboundBudget(t *testing.T) {
+	q, err := newOutboundQueue(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	q.policies = map[ipfsutil.Connectivity]OutboundRetryPolicy{
+		ipfsutil.ConnectivityCellular: {MaxMessageSize: 100, Budget: 150},
+	}
+
+	now := time.Now()
+	m := &OutboundMessage{Size: 100}
+
+	assert.True(t, q.allowed(ipfsutil.ConnectivityCellular, m, now))
+	assert.False(t, q.allowed(ipfsutil.ConnectivityCellular, m, now))
+	assert.False(t, q.allowed(ipfsutil.ConnectivityCellular, &OutboundMessage{Size: 101}, now))
+	assert.True(t, q.allowed(ipfsutil.ConnectivityWiFi, &OutboundMessage{Size: 1 << 20}, now))
+
+	// the budget is renewed every window
+	assert.True(t, q.allowed(ipfsutil.ConnectivityCellular, m, now.Add(outboundBudgetWindow)))
+}
@@ -0,0 +1,49 @@
+package bertyprotocol
+
+import (
+	"context"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// OutgoingPayloadKind is the kind of an app payload sent by the protocol.
+type OutgoingPayloadKind int
+
+const (
+	OutgoingAppMessage OutgoingPayloadKind = iota
+	OutgoingAppMetadata
+
+	// OutgoingContactMetadata is the metadata sent with a contact request,
+	// it has no group
+	OutgoingContactMetadata
+)
+
+// OutgoingPayloadFilter rewrites an app payload before it is sent, whatever
+// the client sending it. A nil payload suppresses an app message or metadata,
+// the contact requests are sent without metadata.
+type OutgoingPayloadFilter func(ctx context.Context, kind OutgoingPayloadKind, groupPK []byte, payload []byte) ([]byte, error)
+
+// SetOutgoingPayloadFilter replaces the filter of the outgoing app payloads,
+// nil removes it.
+func (s *service) SetOutgoingPayloadFilter(f OutgoingPayloadFilter) {
+	s.muOutgoingFilter.Lock()
+	s.outgoingFilter = f
+	s.muOutgoingFilter.Unlock()
+}
+
+func (s *service) filterOutgoing(ctx context.Context, kind OutgoingPayloadKind, groupPK []byte, payload []byte) ([]byte, error) {
+	s.muOutgoingFilter.RLock()
+	f := s.outgoingFilter
+	s.muOutgoingFilter.RUnlock()
+
+	if f == nil {
+		return payload, nil
+	}
+
+	filtered, err := f(ctx, kind, groupPK, payload)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return filtered, nil
+}
@@ -0,0 +1,18 @@
+package bertyprotocol
+
+import (
+	"context"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// PeerScores returns the reputations of the peers met, by descending score,
+// e.g. to find out why a relay or a carrier was dropped.
+func (s *service) PeerScores(context.Context) ([]*ipfsutil.PeerScore, error) {
+	if s.scores == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.scores.Scores(), nil
+}
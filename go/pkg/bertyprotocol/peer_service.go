@@ -0,0 +1,382 @@
+package bertyprotocol
+
+import (
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// The peer service exposes the libp2p peers of the node, for the operators
+// of a daemon, see `berty peers`. Its messages are plain protobuf messages:
+//
+//   service PeerService {
+//     rpc PeerList (PeerList.Request) returns (PeerList.Reply);
+//     rpc PeerInfo (PeerInfo.Request) returns (PeerInfo.Reply);
+//     rpc PeerConnect (PeerConnect.Request) returns (PeerConnect.Reply);
+//     rpc PeerDisconnect (PeerDisconnect.Request) returns (PeerDisconnect.Reply);
+//     rpc PeerBan (PeerBan.Request) returns (PeerBan.Reply);
+//     rpc PeerUnban (PeerUnban.Request) returns (PeerUnban.Reply);
+//   }
+//
+//   message PeerInfo {
+//     string id = 1;
+//     bool connected = 2;
+//     repeated string transports = 3;
+//     repeated string addrs = 4;
+//     repeated string known_addrs = 5;
+//     int64 latency = 6;
+//     repeated string protocols = 7;
+//     int64 total_in = 8;
+//     int64 total_out = 9;
+//     double rate_in = 10;
+//     double rate_out = 11;
+//     bool banned = 12;
+//   }
+
+// PeerInfo describes a peer: Transports and Addrs are the ones of its
+// current connections, KnownAddrs the ones of the peerstore. Latency is in
+// nanoseconds, the traffic in bytes and bytes per second.
+type PeerInfo struct {
+	ID         string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Connected  bool     `protobuf:"varint,2,opt,name=connected,proto3" json:"connected,omitempty"`
+	Transports []string `protobuf:"bytes,3,rep,name=transports,proto3" json:"transports,omitempty"`
+	Addrs      []string `protobuf:"bytes,4,rep,name=addrs,proto3" json:"addrs,omitempty"`
+	KnownAddrs []string `protobuf:"bytes,5,rep,name=known_addrs,json=knownAddrs,proto3" json:"known_addrs,omitempty"`
+	Latency    int64    `protobuf:"varint,6,opt,name=latency,proto3" json:"latency,omitempty"`
+	Protocols  []string `protobuf:"bytes,7,rep,name=protocols,proto3" json:"protocols,omitempty"`
+	TotalIn    int64    `protobuf:"varint,8,opt,name=total_in,json=totalIn,proto3" json:"total_in,omitempty"`
+	TotalOut   int64    `protobuf:"varint,9,opt,name=total_out,json=totalOut,proto3" json:"total_out,omitempty"`
+	RateIn     float64  `protobuf:"fixed64,10,opt,name=rate_in,json=rateIn,proto3" json:"rate_in,omitempty"`
+	RateOut    float64  `protobuf:"fixed64,11,opt,name=rate_out,json=rateOut,proto3" json:"rate_out,omitempty"`
+	Banned     bool     `protobuf:"varint,12,opt,name=banned,proto3" json:"banned,omitempty"`
+}
+
+func (m *PeerInfo) Reset()         { *m = PeerInfo{} }
+func (m *PeerInfo) String() string { return proto.CompactTextString(m) }
+func (*PeerInfo) ProtoMessage()    {}
+
+// PeerList_Request lists the connected peers, or the banned ones.
+type PeerList_Request struct {
+	Banned bool `protobuf:"varint,1,opt,name=banned,proto3" json:"banned,omitempty"`
+}
+
+func (m *PeerList_Request) Reset()         { *m = PeerList_Request{} }
+func (m *PeerList_Request) String() string { return proto.CompactTextString(m) }
+func (*PeerList_Request) ProtoMessage()    {}
+
+type PeerList_Reply struct {
+	Peers []*PeerInfo `protobuf:"bytes,1,rep,name=peers,proto3" json:"peers,omitempty"`
+}
+
+func (m *PeerList_Reply) Reset()         { *m = PeerList_Reply{} }
+func (m *PeerList_Reply) String() string { return proto.CompactTextString(m) }
+func (*PeerList_Reply) ProtoMessage()    {}
+
+type PeerInfo_Request struct {
+	PeerID string `protobuf:"bytes,1,opt,name=peer_id,json=peerId,proto3" json:"peer_id,omitempty"`
+}
+
+func (m *PeerInfo_Request) Reset()         { *m = PeerInfo_Request{} }
+func (m *PeerInfo_Request) String() string { return proto.CompactTextString(m) }
+func (*PeerInfo_Request) ProtoMessage()    {}
+
+type PeerInfo_Reply struct {
+	Peer *PeerInfo `protobuf:"bytes,1,opt,name=peer,proto3" json:"peer,omitempty"`
+}
+
+func (m *PeerInfo_Reply) Reset()         { *m = PeerInfo_Reply{} }
+func (m *PeerInfo_Reply) String() string { return proto.CompactTextString(m) }
+func (*PeerInfo_Reply) ProtoMessage()    {}
+
+// PeerConnect_Request dials a peer, Addr is a multiaddr ending with its
+// /p2p/ part.
+type PeerConnect_Request struct {
+	Addr string `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+}
+
+func (m *PeerConnect_Request) Reset()         { *m = PeerConnect_Request{} }
+func (m *PeerConnect_Request) String() string { return proto.CompactTextString(m) }
+func (*PeerConnect_Request) ProtoMessage()    {}
+
+type PeerConnect_Reply struct {
+	Peer *PeerInfo `protobuf:"bytes,1,opt,name=peer,proto3" json:"peer,omitempty"`
+}
+
+func (m *PeerConnect_Reply) Reset()         { *m = PeerConnect_Reply{} }
+func (m *PeerConnect_Reply) String() string { return proto.CompactTextString(m) }
+func (*PeerConnect_Reply) ProtoMessage()    {}
+
+type PeerDisconnect_Request struct {
+	PeerID string `protobuf:"bytes,1,opt,name=peer_id,json=peerId,proto3" json:"peer_id,omitempty"`
+}
+
+func (m *PeerDisconnect_Request) Reset()         { *m = PeerDisconnect_Request{} }
+func (m *PeerDisconnect_Request) String() string { return proto.CompactTextString(m) }
+func (*PeerDisconnect_Request) ProtoMessage()    {}
+
+type PeerDisconnect_Reply struct{}
+
+func (m *PeerDisconnect_Reply) Reset()         { *m = PeerDisconnect_Reply{} }
+func (m *PeerDisconnect_Reply) String() string { return proto.CompactTextString(m) }
+func (*PeerDisconnect_Reply) ProtoMessage()    {}
+
+type PeerBan_Request struct {
+	PeerID string `protobuf:"bytes,1,opt,name=peer_id,json=peerId,proto3" json:"peer_id,omitempty"`
+}
+
+func (m *PeerBan_Request) Reset()         { *m = PeerBan_Request{} }
+func (m *PeerBan_Request) String() string { return proto.CompactTextString(m) }
+func (*PeerBan_Request) ProtoMessage()    {}
+
+type PeerBan_Reply struct{}
+
+func (m *PeerBan_Reply) Reset()         { *m = PeerBan_Reply{} }
+func (m *PeerBan_Reply) String() string { return proto.CompactTextString(m) }
+func (*PeerBan_Reply) ProtoMessage()    {}
+
+type PeerUnban_Request struct {
+	PeerID string `protobuf:"bytes,1,opt,name=peer_id,json=peerId,proto3" json:"peer_id,omitempty"`
+}
+
+func (m *PeerUnban_Request) Reset()         { *m = PeerUnban_Request{} }
+func (m *PeerUnban_Request) String() string { return proto.CompactTextString(m) }
+func (*PeerUnban_Request) ProtoMessage()    {}
+
+type PeerUnban_Reply struct{}
+
+func (m *PeerUnban_Reply) Reset()         { *m = PeerUnban_Reply{} }
+func (m *PeerUnban_Reply) String() string { return proto.CompactTextString(m) }
+func (*PeerUnban_Reply) ProtoMessage()    {}
+
+// PeerServiceClient is the client API for PeerService service.
+type PeerServiceClient interface {
+	PeerList(ctx context.Context, in *PeerList_Request, opts ...grpc.CallOption) (*PeerList_Reply, error)
+	PeerInfo(ctx context.Context, in *PeerInfo_Request, opts ...grpc.CallOption) (*PeerInfo_Reply, error)
+	PeerConnect(ctx context.Context, in *PeerConnect_Request, opts ...grpc.CallOption) (*PeerConnect_Reply, error)
+	PeerDisconnect(ctx context.Context, in *PeerDisconnect_Request, opts ...grpc.CallOption) (*PeerDisconnect_Reply, error)
+	PeerBan(ctx context.Context, in *PeerBan_Request, opts ...grpc.CallOption) (*PeerBan_Reply, error)
+	PeerUnban(ctx context.Context, in *PeerUnban_Request, opts ...grpc.CallOption) (*PeerUnban_Reply, error)
+}
+
+type peerServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewPeerServiceClient(cc *grpc.ClientConn) PeerServiceClient {
+	return &peerServiceClient{cc}
+}
+
+func (c *peerServiceClient) PeerList(ctx context.Context, in *PeerList_Request, opts ...grpc.CallOption) (*PeerList_Reply, error) {
+	out := new(PeerList_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.PeerService/PeerList", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peerServiceClient) PeerInfo(ctx context.Context, in *PeerInfo_Request, opts ...grpc.CallOption) (*PeerInfo_Reply, error) {
+	out := new(PeerInfo_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.PeerService/PeerInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peerServiceClient) PeerConnect(ctx context.Context, in *PeerConnect_Request, opts ...grpc.CallOption) (*PeerConnect_Reply, error) {
+	out := new(PeerConnect_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.PeerService/PeerConnect", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peerServiceClient) PeerDisconnect(ctx context.Context, in *PeerDisconnect_Request, opts ...grpc.CallOption) (*PeerDisconnect_Reply, error) {
+	out := new(PeerDisconnect_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.PeerService/PeerDisconnect", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peerServiceClient) PeerBan(ctx context.Context, in *PeerBan_Request, opts ...grpc.CallOption) (*PeerBan_Reply, error) {
+	out := new(PeerBan_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.PeerService/PeerBan", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peerServiceClient) PeerUnban(ctx context.Context, in *PeerUnban_Request, opts ...grpc.CallOption) (*PeerUnban_Reply, error) {
+	out := new(PeerUnban_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.PeerService/PeerUnban", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PeerServiceServer is the server API for PeerService service.
+type PeerServiceServer interface {
+	// PeerList returns the connected peers, or the banned ones
+	PeerList(context.Context, *PeerList_Request) (*PeerList_Reply, error)
+	// PeerInfo describes a peer, connected or not
+	PeerInfo(context.Context, *PeerInfo_Request) (*PeerInfo_Reply, error)
+	// PeerConnect dials a peer
+	PeerConnect(context.Context, *PeerConnect_Request) (*PeerConnect_Reply, error)
+	// PeerDisconnect closes the connections of a peer, it may reconnect
+	PeerDisconnect(context.Context, *PeerDisconnect_Request) (*PeerDisconnect_Reply, error)
+	// PeerBan refuses the connections of a peer, the current ones are closed
+	PeerBan(context.Context, *PeerBan_Request) (*PeerBan_Reply, error)
+	// PeerUnban accepts the connections of a banned peer again
+	PeerUnban(context.Context, *PeerUnban_Request) (*PeerUnban_Reply, error)
+}
+
+func RegisterPeerServiceServer(s *grpc.Server, srv PeerServiceServer) {
+	s.RegisterService(&_PeerService_serviceDesc, srv)
+}
+
+func _PeerService_PeerList_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeerList_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerServiceServer).PeerList(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.PeerService/PeerList",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerServiceServer).PeerList(ctx, req.(*PeerList_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeerService_PeerInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeerInfo_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerServiceServer).PeerInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.PeerService/PeerInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerServiceServer).PeerInfo(ctx, req.(*PeerInfo_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeerService_PeerConnect_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeerConnect_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerServiceServer).PeerConnect(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.PeerService/PeerConnect",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerServiceServer).PeerConnect(ctx, req.(*PeerConnect_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeerService_PeerDisconnect_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeerDisconnect_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerServiceServer).PeerDisconnect(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.PeerService/PeerDisconnect",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerServiceServer).PeerDisconnect(ctx, req.(*PeerDisconnect_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeerService_PeerBan_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeerBan_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerServiceServer).PeerBan(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.PeerService/PeerBan",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerServiceServer).PeerBan(ctx, req.(*PeerBan_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeerService_PeerUnban_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeerUnban_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerServiceServer).PeerUnban(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.PeerService/PeerUnban",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerServiceServer).PeerUnban(ctx, req.(*PeerUnban_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _PeerService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "berty.protocol.v1.PeerService",
+	HandlerType: (*PeerServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PeerList",
+			Handler:    _PeerService_PeerList_Handler,
+		},
+		{
+			MethodName: "PeerInfo",
+			Handler:    _PeerService_PeerInfo_Handler,
+		},
+		{
+			MethodName: "PeerConnect",
+			Handler:    _PeerService_PeerConnect_Handler,
+		},
+		{
+			MethodName: "PeerDisconnect",
+			Handler:    _PeerService_PeerDisconnect_Handler,
+		},
+		{
+			MethodName: "PeerBan",
+			Handler:    _PeerService_PeerBan_Handler,
+		},
+		{
+			MethodName: "PeerUnban",
+			Handler:    _PeerService_PeerUnban_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
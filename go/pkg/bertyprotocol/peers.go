@@ -0,0 +1,184 @@
+package bertyprotocol
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+func parsePeerID(s string) (peer.ID, error) {
+	pid, err := peer.Decode(s)
+	if err != nil {
+		return "", errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	return pid, nil
+}
+
+// peerInfo describes a peer from the host state, the bandwidth meter and
+// the blocklist.
+func (s *service) peerInfo(pid peer.ID) *PeerInfo {
+	info := &PeerInfo{
+		ID:        pid.Pretty(),
+		Connected: s.host.Network().Connectedness(pid) == network.Connected,
+		Latency:   int64(s.host.Peerstore().LatencyEWMA(pid)),
+	}
+
+	for _, c := range s.host.Network().ConnsToPeer(pid) {
+		info.Transports = append(info.Transports, ipfsutil.TransportName(c.RemoteMultiaddr()))
+		info.Addrs = append(info.Addrs, c.RemoteMultiaddr().String())
+	}
+
+	for _, addr := range s.host.Peerstore().Addrs(pid) {
+		info.KnownAddrs = append(info.KnownAddrs, addr.String())
+	}
+
+	if protocols, err := s.host.Peerstore().GetProtocols(pid); err == nil {
+		sort.Strings(protocols)
+		info.Protocols = protocols
+	}
+
+	if s.bandwidth != nil {
+		stats := s.bandwidth.PeerStats(pid)
+		info.TotalIn, info.TotalOut = stats.TotalIn, stats.TotalOut
+		info.RateIn, info.RateOut = stats.RateIn, stats.RateOut
+	}
+
+	if s.blocks.blocklist != nil {
+		info.Banned = s.blocks.blocklist.IsBlocked(pid)
+	}
+
+	return info
+}
+
+func (s *service) PeerList(_ context.Context, req *PeerList_Request) (*PeerList_Reply, error) {
+	if s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	var pids []peer.ID
+	if req.Banned {
+		if s.blocks.blocklist == nil {
+			return nil, errcode.ErrNotImplemented
+		}
+
+		pids = s.blocks.blocklist.List()
+	} else {
+		pids = s.host.Network().Peers()
+	}
+
+	reply := &PeerList_Reply{Peers: make([]*PeerInfo, len(pids))}
+	for i, pid := range pids {
+		reply.Peers[i] = s.peerInfo(pid)
+	}
+
+	sort.Slice(reply.Peers, func(i, j int) bool { return reply.Peers[i].ID < reply.Peers[j].ID })
+
+	return reply, nil
+}
+
+func (s *service) PeerInfo(_ context.Context, req *PeerInfo_Request) (*PeerInfo_Reply, error) {
+	if s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	pid, err := parsePeerID(req.PeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PeerInfo_Reply{Peer: s.peerInfo(pid)}, nil
+}
+
+func (s *service) PeerConnect(ctx context.Context, req *PeerConnect_Request) (*PeerConnect_Reply, error) {
+	if s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	maddr, err := ma.NewMultiaddr(req.Addr)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	pi, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	// the blocklist would refuse the dial anyway
+	if s.blocks.blocklist != nil && s.blocks.blocklist.IsBlocked(pi.ID) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("peer %s is banned", pi.ID.Pretty()))
+	}
+
+	if err := s.host.Connect(ctx, *pi); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	s.logger.Info("peer connected on request", zap.String("peer", pi.ID.Pretty()))
+
+	return &PeerConnect_Reply{Peer: s.peerInfo(pi.ID)}, nil
+}
+
+func (s *service) PeerDisconnect(_ context.Context, req *PeerDisconnect_Request) (*PeerDisconnect_Reply, error) {
+	if s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	pid, err := parsePeerID(req.PeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.host.Network().ClosePeer(pid); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	s.logger.Info("peer disconnected on request", zap.String("peer", pid.Pretty()))
+
+	return &PeerDisconnect_Reply{}, nil
+}
+
+func (s *service) PeerBan(_ context.Context, req *PeerBan_Request) (*PeerBan_Reply, error) {
+	if s.blocks.blocklist == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	pid, err := parsePeerID(req.PeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.blocks.blocklist.Block(pid); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("peer banned", zap.String("peer", pid.Pretty()))
+
+	return &PeerBan_Reply{}, nil
+}
+
+func (s *service) PeerUnban(_ context.Context, req *PeerUnban_Request) (*PeerUnban_Reply, error) {
+	if s.blocks.blocklist == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	pid, err := parsePeerID(req.PeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.blocks.blocklist.Unblock(pid); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("peer unbanned", zap.String("peer", pid.Pretty()))
+
+	return &PeerUnban_Reply{}, nil
+}
@@ -0,0 +1,70 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPeerService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := libp2p_mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	require.NoError(t, err)
+	remote, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	bl, err := ipfsutil.NewBlocklist(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, err)
+
+	s := &service{logger: zap.NewNop(), host: h, blocks: newContactBlocks(zap.NewNop(), bl)}
+
+	addr := remote.Addrs()[0].String() + "/p2p/" + remote.ID().Pretty()
+	connected, err := s.PeerConnect(ctx, &PeerConnect_Request{Addr: addr})
+	require.NoError(t, err)
+	assert.True(t, connected.Peer.Connected)
+	assert.Equal(t, []string{remote.Addrs()[0].String()}, connected.Peer.Addrs)
+	assert.Equal(t, []string{"TCP"}, connected.Peer.Transports)
+
+	list, err := s.PeerList(ctx, &PeerList_Request{})
+	require.NoError(t, err)
+	require.Len(t, list.Peers, 1)
+	assert.Equal(t, remote.ID().Pretty(), list.Peers[0].ID)
+
+	_, err = s.PeerDisconnect(ctx, &PeerDisconnect_Request{PeerID: remote.ID().Pretty()})
+	require.NoError(t, err)
+
+	info, err := s.PeerInfo(ctx, &PeerInfo_Request{PeerID: remote.ID().Pretty()})
+	require.NoError(t, err)
+	assert.False(t, info.Peer.Connected)
+	assert.NotEmpty(t, info.Peer.KnownAddrs)
+
+	// the banned peers can't be dialed
+	_, err = s.PeerBan(ctx, &PeerBan_Request{PeerID: remote.ID().Pretty()})
+	require.NoError(t, err)
+
+	_, err = s.PeerConnect(ctx, &PeerConnect_Request{Addr: addr})
+	assert.Error(t, err)
+
+	banned, err := s.PeerList(ctx, &PeerList_Request{Banned: true})
+	require.NoError(t, err)
+	require.Len(t, banned.Peers, 1)
+	assert.True(t, banned.Peers[0].Banned)
+
+	_, err = s.PeerUnban(ctx, &PeerUnban_Request{PeerID: remote.ID().Pretty()})
+	require.NoError(t, err)
+	assert.False(t, bl.IsBlocked(remote.ID()))
+
+	_, err = s.PeerInfo(ctx, &PeerInfo_Request{PeerID: "invalid"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,632 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+const (
+	pollPayloadPrefix      = "\x00berty.poll/1\x00"
+	pollVotePayloadPrefix  = "\x00berty.poll-vote/1\x00"
+	pollClosePayloadPrefix = "\x00berty.poll-close/1\x00"
+
+	// PollPayloadType is the type of the JSON payload replacing a poll in
+	// the message lists and subscriptions, it carries its results.
+	PollPayloadType = "Poll"
+
+	// PollResultsPayloadType is the type of the JSON payload replacing the
+	// votes and the closing of a poll, it carries the results of the poll.
+	PollResultsPayloadType = "PollResults"
+
+	// NoPollOption withdraws the vote of a member.
+	NoPollOption = -1
+
+	maxPollQuestionSize = 512
+	maxPollOptionSize   = 128
+	minPollOptions      = 2
+	maxPollOptions      = 12
+)
+
+var pollsKey = datastore.NewKey("polls")
+
+// PollOption is an option of a poll and the members which chose it, the
+// members are not listed for an anonymous poll.
+type PollOption struct {
+	Text    string   `json:"text"`
+	Votes   int      `json:"votes"`
+	Members [][]byte `json:"members,omitempty"`
+}
+
+// PollResults is the tally of the votes of a poll.
+type PollResults struct {
+	PollID    []byte        `json:"pollId"`
+	AuthorPK  []byte        `json:"authorPk"`
+	Question  string        `json:"question"`
+	Options   []*PollOption `json:"options"`
+	Anonymous bool          `json:"anonymous"`
+	Closed    bool          `json:"closed"`
+	Voters    int           `json:"voters"`
+}
+
+// EvtPollChanged is emitted on the event bus of the host when a poll is
+// received, voted or closed.
+type EvtPollChanged struct {
+	GroupPK []byte
+	PollID  []byte
+}
+
+// pollPayload is the payload sent to the clients in place of a poll, a vote
+// or a closing.
+type pollPayload struct {
+	Type string `json:"type"`
+	*PollResults
+}
+
+// pollOp is sent as a message of the group, its ID is the ID of the poll.
+// Anonymous only hides the voters in the results, the devices of the group
+// still verify who voted.
+type pollOp struct {
+	Question  string   `json:"question"`
+	Options   []string `json:"options"`
+	Anonymous bool     `json:"anonymous"`
+}
+
+func (p *pollOp) validate() error {
+	if p.Question == "" || len(p.Question) > maxPollQuestionSize || !utf8.ValidString(p.Question) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid poll question"))
+	}
+
+	if len(p.Options) < minPollOptions || len(p.Options) > maxPollOptions {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll has between %d and %d options", minPollOptions, maxPollOptions))
+	}
+
+	seen := map[string]bool{}
+	for _, option := range p.Options {
+		if option == "" || len(option) > maxPollOptionSize || !utf8.ValidString(option) || seen[option] {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid poll option"))
+		}
+
+		seen[option] = true
+	}
+
+	return nil
+}
+
+// pollVoteOp is sent as a message of the group, Close ends the poll, it is
+// only valid from the author of the poll.
+type pollVoteOp struct {
+	GroupPK  []byte `json:"group_pk"`
+	PollID   []byte `json:"poll_id"`
+	DevicePK []byte `json:"device_pk"`
+	Option   int    `json:"option"`
+	Close    bool   `json:"close"`
+	At       int64  `json:"at"`
+	Sig      []byte `json:"sig"`
+}
+
+func (v *pollVoteOp) signedBytes() []byte {
+	buf := make([]byte, 17)
+	binary.BigEndian.PutUint64(buf, uint64(v.At))
+	binary.BigEndian.PutUint64(buf[8:], uint64(int64(v.Option)))
+	if v.Close {
+		buf[16] = 1
+	}
+
+	return bytes.Join([][]byte{[]byte("berty poll vote"), v.GroupPK, v.PollID, buf}, nil)
+}
+
+func isPollPayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(pollPayloadPrefix))
+}
+
+func isPollVotePayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(pollVotePayloadPrefix)) || bytes.HasPrefix(payload, []byte(pollClosePayloadPrefix))
+}
+
+func unmarshalPoll(payload []byte) (*pollOp, error) {
+	if !isPollPayload(payload) {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	p := &pollOp{}
+	if err := json.Unmarshal(payload[len(pollPayloadPrefix):], p); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func unmarshalPollVote(payload []byte) (*pollVoteOp, error) {
+	prefix := pollVotePayloadPrefix
+	if bytes.HasPrefix(payload, []byte(pollClosePayloadPrefix)) {
+		prefix = pollClosePayloadPrefix
+	} else if !bytes.HasPrefix(payload, []byte(prefix)) {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	v := &pollVoteOp{}
+	if err := json.Unmarshal(payload[len(prefix):], v); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	// the prefix tells the payloads apart before they are parsed
+	if v.Close != (prefix == pollClosePayloadPrefix) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid poll vote"))
+	}
+
+	return v, nil
+}
+
+// pollRecord is a poll of a group and its author.
+type pollRecord struct {
+	AuthorPK []byte `json:"author_pk"`
+	pollOp
+}
+
+// pollVoteRecord is an operation of a member on a poll, every operation is
+// kept. The tally of a member is its last operation, by time then by ID,
+// before the poll is closed: the devices converge whatever the order in which
+// they receive the operations.
+type pollVoteRecord struct {
+	Option int    `json:"option"`
+	Close  bool   `json:"close"`
+	At     int64  `json:"at"`
+	ID     []byte `json:"id"`
+}
+
+func (r *pollVoteRecord) after(other *pollVoteRecord) bool {
+	if r.At != other.At {
+		return r.At > other.At
+	}
+
+	return bytes.Compare(r.ID, other.ID) > 0
+}
+
+// pollTallies stores the polls of the groups and the operations of their
+// members.
+type pollTallies struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+	lock    sync.Mutex
+}
+
+func newPollTallies(logger *zap.Logger, store datastore.Batching, h host.Host) (*pollTallies, error) {
+	pt := &pollTallies{
+		logger: logger,
+		store:  store,
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtPollChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		pt.emitter = emitter
+	}
+
+	return pt, nil
+}
+
+func pollKey(groupPK, pollID []byte) datastore.Key {
+	return retractionKey(pollsKey, groupPK, pollID)
+}
+
+// add records a poll, it reports whether it was unknown.
+func (pt *pollTallies) add(groupPK, pollID, authorPK []byte, p *pollOp) (bool, error) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	key := pollKey(groupPK, pollID).ChildString("poll")
+	if ok, err := pt.store.Has(key); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	} else if ok {
+		return false, nil
+	}
+
+	data, err := json.Marshal(&pollRecord{AuthorPK: authorPK, pollOp: *p})
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := pt.store.Put(key, data); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	return true, nil
+}
+
+// merge records an operation of a member, it reports whether it was
+// unknown. The operations may be received before their poll.
+func (pt *pollTallies) merge(groupPK, pollID, memberPK []byte, rec *pollVoteRecord) (bool, error) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	key := pollKey(groupPK, pollID).ChildString("votes").
+		ChildString(base64.RawURLEncoding.EncodeToString(memberPK)).
+		ChildString(base64.RawURLEncoding.EncodeToString(rec.ID))
+
+	if ok, err := pt.store.Has(key); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	} else if ok {
+		return false, nil
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := pt.store.Put(key, data); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	return true, nil
+}
+
+func (pt *pollTallies) poll(groupPK, pollID []byte) (*pollRecord, error) {
+	data, err := pt.store.Get(pollKey(groupPK, pollID).ChildString("poll"))
+	switch err {
+	case nil:
+	case datastore.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	p := &pollRecord{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return p, nil
+}
+
+// results tallies the votes of a poll, nil if the poll wasn't received yet.
+func (pt *pollTallies) results(groupPK, pollID []byte) (*PollResults, error) {
+	p, err := pt.poll(groupPK, pollID)
+	if err != nil || p == nil {
+		return nil, err
+	}
+
+	prefix := pollKey(groupPK, pollID).ChildString("votes")
+	res, err := pt.store.Query(query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	// the earliest closing of the author ends the poll
+	votes := map[string][]*pollVoteRecord{}
+	var closing *pollVoteRecord
+	for _, entry := range entries {
+		memberPK, err := base64.RawURLEncoding.DecodeString(datastore.RawKey(entry.Key).Parent().BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		rec := &pollVoteRecord{}
+		if err := json.Unmarshal(entry.Value, rec); err != nil {
+			continue
+		}
+
+		if !rec.Close {
+			votes[string(memberPK)] = append(votes[string(memberPK)], rec)
+		} else if bytes.Equal(memberPK, p.AuthorPK) && (closing == nil || closing.after(rec)) {
+			closing = rec
+		}
+	}
+
+	results := &PollResults{
+		PollID:    pollID,
+		AuthorPK:  p.AuthorPK,
+		Question:  p.Question,
+		Options:   make([]*PollOption, len(p.Options)),
+		Anonymous: p.Anonymous,
+		Closed:    closing != nil,
+	}
+
+	for i, text := range p.Options {
+		results.Options[i] = &PollOption{Text: text}
+	}
+
+	for memberPK, recs := range votes {
+		var last *pollVoteRecord
+		for _, rec := range recs {
+			if rec.Option < NoPollOption || rec.Option >= len(p.Options) {
+				continue
+			}
+
+			if closing != nil && !closing.after(rec) {
+				continue
+			}
+
+			if last == nil || rec.after(last) {
+				last = rec
+			}
+		}
+
+		if last == nil || last.Option == NoPollOption {
+			continue
+		}
+
+		option := results.Options[last.Option]
+		option.Votes++
+		results.Voters++
+		if !p.Anonymous {
+			option.Members = append(option.Members, []byte(memberPK))
+		}
+	}
+
+	for _, option := range results.Options {
+		sort.Slice(option.Members, func(i, j int) bool { return bytes.Compare(option.Members[i], option.Members[j]) < 0 })
+	}
+
+	return results, nil
+}
+
+func (pt *pollTallies) emit(groupPK, pollID []byte) {
+	if pt.emitter == nil {
+		return
+	}
+
+	if err := pt.emitter.Emit(EvtPollChanged{GroupPK: groupPK, PollID: pollID}); err != nil {
+		pt.logger.Warn("unable to emit poll changed event", zap.Error(err))
+	}
+}
+
+// PollCreate sends a poll to a group, it returns the ID of the poll. The
+// voters of an anonymous poll are hidden in its results.
+func (s *service) PollCreate(ctx context.Context, groupPK []byte, question string, options []string, anonymous bool) ([]byte, error) {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	p := &pollOp{Question: strings.TrimSpace(question), Options: make([]string, len(options)), Anonymous: anonymous}
+	for i, option := range options {
+		p.Options[i] = strings.TrimSpace(option)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return s.sendControlMessageWithID(ctx, gc, append([]byte(pollPayloadPrefix), data...))
+}
+
+// PollVote sets the vote of the member, NoPollOption withdraws it. The last
+// vote of the member counts, whatever its device.
+func (s *service) PollVote(ctx context.Context, groupPK []byte, pollID []byte, option int) error {
+	return s.sendPollVote(ctx, groupPK, pollID, option, false)
+}
+
+// PollClose ends a poll, only its author can close it, the later votes are
+// ignored.
+func (s *service) PollClose(ctx context.Context, groupPK []byte, pollID []byte) error {
+	return s.sendPollVote(ctx, groupPK, pollID, NoPollOption, true)
+}
+
+// PollResults returns the tally of the votes of a poll.
+func (s *service) PollResults(_ context.Context, groupPK []byte, pollID []byte) (*PollResults, error) {
+	results, err := s.polls.results(groupPK, pollID)
+	if err != nil {
+		return nil, err
+	}
+
+	if results == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown poll"))
+	}
+
+	return results, nil
+}
+
+func (s *service) sendPollVote(ctx context.Context, groupPK []byte, pollID []byte, option int, closing bool) error {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return errcode.ErrInvalidInput
+	}
+
+	results, err := s.PollResults(ctx, groupPK, pollID)
+	if err != nil {
+		return err
+	}
+
+	if results.Closed {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("poll closed"))
+	}
+
+	if option < NoPollOption || option >= len(results.Options) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown poll option"))
+	}
+
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if closing {
+		memberPK, err := md.member.GetPublic().Raw()
+		if err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+		if !bytes.Equal(memberPK, results.AuthorPK) {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the author of the poll can close it"))
+		}
+	}
+
+	devicePK, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	v := &pollVoteOp{GroupPK: groupPK, PollID: pollID, DevicePK: devicePK, Option: option, Close: closing, At: time.Now().UnixNano()}
+	if v.Sig, err = md.device.Sign(v.signedBytes()); err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	prefix := pollVotePayloadPrefix
+	if closing {
+		prefix = pollClosePayloadPrefix
+	}
+
+	return s.sendControlMessage(ctx, gc, append([]byte(prefix), data...))
+}
+
+// applyPoll records a poll, or merges a vote or a closing signed by a current
+// device of the group. It returns the ID of the poll.
+func (s *service) applyPoll(gc *groupContext, evt *bertytypes.GroupMessageEvent) ([]byte, error) {
+	if isPollPayload(evt.Message) {
+		p, err := unmarshalPoll(evt.Message)
+		if err != nil {
+			return nil, err
+		}
+
+		_, memberPK, err := deviceMember(gc, evt.Headers.DevicePK)
+		if err != nil {
+			return nil, err
+		}
+
+		added, err := s.polls.add(gc.Group().PublicKey, evt.EventContext.ID, memberPK, p)
+		if err != nil {
+			return nil, err
+		}
+
+		if added {
+			s.polls.emit(gc.Group().PublicKey, evt.EventContext.ID)
+		}
+
+		return evt.EventContext.ID, nil
+	}
+
+	v, err := unmarshalPollVote(evt.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(v.GroupPK, gc.Group().PublicKey) || !bytes.Equal(v.DevicePK, evt.Headers.DevicePK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("poll vote not sent by its signer"))
+	}
+
+	if !gc.MetadataStore().isCurrentDevice(v.DevicePK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("not a member of the group anymore"))
+	}
+
+	pk, memberPK, err := deviceMember(gc, v.DevicePK)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := pk.Verify(v.signedBytes(), v.Sig); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification
+	}
+
+	changed, err := s.polls.merge(v.GroupPK, v.PollID, memberPK, &pollVoteRecord{Option: v.Option, Close: v.Close, At: v.At, ID: evt.EventContext.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		s.polls.emit(v.GroupPK, v.PollID)
+	}
+
+	return v.PollID, nil
+}
+
+// trackPoll is called for each message of a group, it reports whether the
+// message is a vote or a closing, the polls themselves are messages.
+func (s *service) trackPoll(gc *groupContext, evt *bertytypes.GroupMessageEvent) bool {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil {
+		return false
+	}
+
+	poll, vote := isPollPayload(evt.Message), isPollVotePayload(evt.Message)
+	if !poll && !vote {
+		return false
+	}
+
+	if _, err := s.applyPoll(gc, evt); err != nil {
+		s.logger.Debug("invalid poll", zap.Error(err))
+	}
+
+	return vote
+}
+
+// renderPoll replaces the payload of a poll, a vote or a closing with the
+// results of the poll.
+func (s *service) renderPoll(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*bertytypes.GroupMessageEvent, bool) {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil {
+		return evt, true
+	}
+
+	// the poll may not be recorded yet
+	pollID, err := s.applyPoll(gc, evt)
+	if err != nil {
+		return evt, false
+	}
+
+	results, err := s.polls.results(gc.Group().PublicKey, pollID)
+	if err != nil || results == nil {
+		return evt, false
+	}
+
+	typ := PollResultsPayloadType
+	if isPollPayload(evt.Message) {
+		typ = PollPayloadType
+	}
+
+	payload, err := json.Marshal(&pollPayload{Type: typ, PollResults: results})
+	if err != nil {
+		return evt, false
+	}
+
+	rendered := *evt
+	rendered.Message = payload
+
+	return &rendered, true
+}
@@ -0,0 +1,118 @@
+package bertyprotocol
+
+import (
+	"strings"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPollValidate(t *testing.T) {
+	assert.NoError(t, (&pollOp{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}}).validate())
+	assert.Error(t, (&pollOp{Options: []string{"Pizza", "Sushi"}}).validate())
+	assert.Error(t, (&pollOp{Question: "Lunch?", Options: []string{"Pizza"}}).validate())
+	assert.Error(t, (&pollOp{Question: "Lunch?", Options: []string{"Pizza", "Pizza"}}).validate())
+	assert.Error(t, (&pollOp{Question: "Lunch?", Options: []string{"Pizza", strings.Repeat("a", maxPollOptionSize+1)}}).validate())
+	assert.Error(t, (&pollOp{Question: "Lunch?", Options: make([]string, maxPollOptions+1)}).validate())
+}
+
+func TestPollVotePayload(t *testing.T) {
+	v, err := unmarshalPollVote([]byte(pollClosePayloadPrefix + `{"option":-1,"close":true}`))
+	require.NoError(t, err)
+	assert.True(t, v.Close)
+
+	// a vote can't pass for a closing
+	_, err = unmarshalPollVote([]byte(pollVotePayloadPrefix + `{"option":-1,"close":true}`))
+	assert.Error(t, err)
+
+	_, err = unmarshalPollVote([]byte(pollPayloadPrefix + `{}`))
+	assert.Error(t, err)
+}
+
+func TestPollTallies(t *testing.T) {
+	newTallies := func() *pollTallies {
+		polls, err := newPollTallies(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+		require.NoError(t, err)
+		return polls
+	}
+
+	groupPK, pollID, alice, bob, carol := []byte("group"), []byte("poll"), []byte("alice"), []byte("bob"), []byte("carol")
+	poll := &pollOp{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}}
+
+	ops := []struct {
+		memberPK []byte
+		rec      *pollVoteRecord
+	}{
+		{alice, &pollVoteRecord{Option: 0, At: 1, ID: []byte("a1")}},
+		{bob, &pollVoteRecord{Option: 1, At: 2, ID: []byte("b1")}},
+		{alice, &pollVoteRecord{Option: 1, At: 3, ID: []byte("a2")}},
+		{carol, &pollVoteRecord{Option: 0, At: 4, ID: []byte("c1")}},
+		{carol, &pollVoteRecord{Option: NoPollOption, At: 5, ID: []byte("c2")}},
+		{bob, &pollVoteRecord{Option: 7, At: 6, ID: []byte("b2")}},
+		// only the author closes the poll, the later votes are ignored
+		{bob, &pollVoteRecord{Option: NoPollOption, Close: true, At: 7, ID: []byte("b3")}},
+		{alice, &pollVoteRecord{Option: NoPollOption, Close: true, At: 8, ID: []byte("a3")}},
+		{bob, &pollVoteRecord{Option: 0, At: 9, ID: []byte("b4")}},
+	}
+
+	// the devices converge whatever the order of the operations, the votes
+	// may even be received before their poll
+	forward, backward := newTallies(), newTallies()
+	_, err := forward.add(groupPK, pollID, alice, poll)
+	require.NoError(t, err)
+
+	for i := range ops {
+		changed, err := forward.merge(groupPK, pollID, ops[i].memberPK, ops[i].rec)
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		_, err = backward.merge(groupPK, pollID, ops[len(ops)-1-i].memberPK, ops[len(ops)-1-i].rec)
+		require.NoError(t, err)
+	}
+
+	results, err := backward.results(groupPK, pollID)
+	require.NoError(t, err)
+	assert.Nil(t, results, "unknown poll")
+
+	added, err := backward.add(groupPK, pollID, alice, poll)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = backward.add(groupPK, pollID, bob, poll)
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	changed, err := forward.merge(groupPK, pollID, alice, ops[0].rec)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	for _, polls := range []*pollTallies{forward, backward} {
+		results, err := polls.results(groupPK, pollID)
+		require.NoError(t, err)
+		require.NotNil(t, results)
+
+		assert.True(t, results.Closed)
+		assert.Equal(t, alice, results.AuthorPK)
+		assert.Equal(t, 2, results.Voters)
+		assert.Equal(t, 0, results.Options[0].Votes)
+		assert.Equal(t, 2, results.Options[1].Votes)
+		assert.Equal(t, [][]byte{alice, bob}, results.Options[1].Members)
+	}
+
+	// the voters of an anonymous poll are hidden
+	anonymous := newTallies()
+	_, err = anonymous.add(groupPK, pollID, alice, &pollOp{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}, Anonymous: true})
+	require.NoError(t, err)
+	_, err = anonymous.merge(groupPK, pollID, bob, &pollVoteRecord{Option: 0, At: 1, ID: []byte("b1")})
+	require.NoError(t, err)
+
+	results, err = anonymous.results(groupPK, pollID)
+	require.NoError(t, err)
+	assert.False(t, results.Closed)
+	assert.Equal(t, 1, results.Options[0].Votes)
+	assert.Empty(t, results.Options[0].Members)
+}
@@ -0,0 +1,712 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-ipfs/keystore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// prekeyCount is the number of one-time prekeys of a bundle, they are
+	// replenished once fewer than prekeyThreshold are left
+	prekeyCount     = 20
+	prekeyThreshold = 5
+
+	// prekeyCheckInterval is how often the contact requests pending are sent
+	// to the bundles carried by the device
+	prekeyCheckInterval = 5 * time.Minute
+
+	// prekeyRepublishInterval is the interval between two publications of an
+	// unchanged bundle, within the lifetime of the carried bundles
+	prekeyRepublishInterval = 24 * time.Hour
+)
+
+// keyPrekey names the one-time prekeys of the device keystore, by public key
+const keyPrekey = "prekeySK"
+
+var (
+	prekeysKey         = datastore.NewKey("prekeys")
+	prekeySentKey      = datastore.NewKey("sent")
+	prekeyPublishedKey = datastore.NewKey("published")
+)
+
+// errPrekeyUnknown is returned for a request sealed to a prekey the device
+// doesn't hold, e.g. one of another device of the account or one consumed
+var errPrekeyUnknown = errcode.ErrMissingMapKey.Wrap(fmt.Errorf("unknown prekey"))
+
+// PrekeyBundle is a set of one-time keys published by a device, a stranger
+// knowing the shareable contact of the account seals a contact request to
+// one of them while the device is offline. The bundle is signed by the
+// account key.
+type PrekeyBundle struct {
+	AccountPK []byte   `json:"account_pk"`
+	Prekeys   [][]byte `json:"prekeys"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+type signedPrekeyBundle struct {
+	Bundle    []byte `json:"bundle"`
+	Signature []byte `json:"signature"`
+}
+
+// prekeyRequest is the contact request sent to a bundle, it is signed by the
+// account key of the requester and bound to the recipient.
+type prekeyRequest struct {
+	Contact     []byte `json:"contact"`
+	RecipientPK []byte `json:"recipient_pk"`
+	SentAt      int64  `json:"sent_at"`
+}
+
+type signedPrekeyRequest struct {
+	Request   []byte `json:"request"`
+	Signature []byte `json:"signature"`
+}
+
+// sealedPrekeyRequest is a contact request sealed to a prekey with an
+// ephemeral key, only the device holding the prekey opens it, once.
+type sealedPrekeyRequest struct {
+	PrekeyPK    []byte `json:"prekey_pk"`
+	EphemeralPK []byte `json:"ephemeral_pk"`
+	Nonce       []byte `json:"nonce"`
+	Sealed      []byte `json:"sealed"`
+}
+
+// PrekeyStatus is the prekeys left on the device and their last publication.
+type PrekeyStatus struct {
+	Available   int       `json:"available"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+type prekeyPublication struct {
+	Tag []byte    `json:"tag"`
+	At  time.Time `json:"at"`
+}
+
+// prekeyBundleTag identifies the bundles of an account, only those knowing
+// its shareable contact can compute it.
+func prekeyBundleTag(accountPK, seed []byte) []byte {
+	mac := hmac.New(sha256.New, seed)
+	_, _ = mac.Write([]byte("berty prekey bundle"))
+	_, _ = mac.Write(accountPK)
+
+	return mac.Sum(nil)
+}
+
+// prekeyRequestTag identifies the contact requests sent to the bundles of an
+// account.
+func prekeyRequestTag(accountPK, seed []byte) []byte {
+	mac := hmac.New(sha256.New, seed)
+	_, _ = mac.Write([]byte("berty prekey request"))
+	_, _ = mac.Write(accountPK)
+
+	return mac.Sum(nil)
+}
+
+func signPrekeyBundle(accountSK crypto.PrivKey, prekeys [][]byte, now time.Time) ([]byte, error) {
+	accountPK, err := accountSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	data, err := json.Marshal(&PrekeyBundle{
+		AccountPK: accountPK,
+		Prekeys:   prekeys,
+		CreatedAt: now.UnixNano(),
+	})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	signed := &signedPrekeyBundle{Bundle: data}
+	if signed.Signature, err = accountSK.Sign(data); err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	ret, err := json.Marshal(signed)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return ret, nil
+}
+
+// openPrekeyBundle verifies a bundle is signed by the account expected.
+func openPrekeyBundle(data []byte, accountPK []byte) (*PrekeyBundle, error) {
+	signed := &signedPrekeyBundle{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(accountPK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := pk.Verify(signed.Bundle, signed.Signature); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid prekey bundle signature"))
+	}
+
+	bundle := &PrekeyBundle{}
+	if err := json.Unmarshal(signed.Bundle, bundle); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if !bytes.Equal(bundle.AccountPK, accountPK) || len(bundle.Prekeys) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid prekey bundle"))
+	}
+
+	return bundle, nil
+}
+
+// sealPrekeyRequest seals the shareable contact of the requester, with its
+// metadata, to a prekey of the bundle picked at random so two requesters
+// rarely use the same one.
+func sealPrekeyRequest(accountSK crypto.PrivKey, contact *bertytypes.ShareableContact, bundle *PrekeyBundle, now time.Time) ([]byte, error) {
+	contactBytes, err := contact.Marshal()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	data, err := json.Marshal(&prekeyRequest{
+		Contact:     contactBytes,
+		RecipientPK: bundle.AccountPK,
+		SentAt:      now.UnixNano(),
+	})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	signed := &signedPrekeyRequest{Request: data}
+	if signed.Signature, err = accountSK.Sign(data); err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	plaintext, err := json.Marshal(signed)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	index := make([]byte, 1)
+	if _, err := rand.Read(index); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	prekeyPK := bundle.Prekeys[int(index[0])%len(bundle.Prekeys)]
+	pk, err := crypto.UnmarshalEd25519PublicKey(prekeyPK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	mongPub, err := cryptoutil.EdwardsToMontgomeryPub(pk)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	ephemeralPub, ephemeralPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+	defer cryptoutil.WipeKey(ephemeralPriv)
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	ret, err := json.Marshal(&sealedPrekeyRequest{
+		PrekeyPK:    prekeyPK,
+		EphemeralPK: ephemeralPub[:],
+		Nonce:       nonce[:],
+		Sealed:      box.Seal(nil, plaintext, nonce, mongPub, ephemeralPriv),
+	})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return ret, nil
+}
+
+func prekeyKeyName(pk []byte) string {
+	return strings.Join([]string{keyPrekey, hex.EncodeToString(pk)}, "_")
+}
+
+func (a *deviceKeystore) prekeyPrivKey(pk []byte) (crypto.PrivKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sk, err := a.ks.Get(prekeyKeyName(pk))
+	if err != nil && err.Error() == keystore.ErrNoSuchKey.Error() {
+		return nil, errPrekeyUnknown
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return sk, nil
+}
+
+func (a *deviceKeystore) putPrekey(sk crypto.PrivKey) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pk, err := sk.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := a.ks.Put(prekeyKeyName(pk), sk); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return pk, nil
+}
+
+func (a *deviceKeystore) deletePrekey(pk []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.ks.Delete(prekeyKeyName(pk)); err != nil && err.Error() != keystore.ErrNoSuchKey.Error() {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// prekeyStore keeps the public keys of the prekeys of the device, their
+// private keys are in the device keystore, and the contact requests already
+// sent to a bundle.
+type prekeyStore struct {
+	logger *zap.Logger
+	store  datastore.Batching
+	ks     *deviceKeystore
+
+	lock sync.Mutex
+}
+
+func newPrekeyStore(logger *zap.Logger, store datastore.Batching, ks DeviceKeystore) *prekeyStore {
+	dks, _ := ks.(*deviceKeystore)
+	return &prekeyStore{logger: logger, store: store, ks: dks}
+}
+
+func (ps *prekeyStore) list() ([][]byte, error) {
+	res, err := ps.store.Query(query.Query{Prefix: prekeysKey.String(), KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	prekeys := [][]byte{}
+	for _, entry := range entries {
+		pk, err := hex.DecodeString(datastore.RawKey(entry.Key).Name())
+		if err != nil {
+			continue
+		}
+
+		prekeys = append(prekeys, pk)
+	}
+
+	return prekeys, nil
+}
+
+// replenish generates new prekeys once fewer than prekeyThreshold are left,
+// it returns the number of prekeys added.
+func (ps *prekeyStore) replenish() (int, error) {
+	if ps.ks == nil {
+		return 0, errcode.ErrNotImplemented
+	}
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	prekeys, err := ps.list()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(prekeys) >= prekeyThreshold {
+		return 0, nil
+	}
+
+	added := 0
+	for i := len(prekeys); i < prekeyCount; i++ {
+		sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			return added, errcode.ErrCryptoKeyGeneration.Wrap(err)
+		}
+
+		pk, err := ps.ks.putPrekey(sk)
+		if err != nil {
+			return added, err
+		}
+
+		if err := ps.store.Put(prekeysKey.ChildString(hex.EncodeToString(pk)), []byte{}); err != nil {
+			return added, errcode.ErrInternal.Wrap(err)
+		}
+
+		added++
+	}
+
+	return added, nil
+}
+
+// open opens a contact request sealed to a prekey of the device and consumes
+// the prekey, the request can't be replayed.
+func (ps *prekeyStore) open(data []byte, ownPK []byte) (*bertytypes.ShareableContact, error) {
+	if ps.ks == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	sealed := &sealedPrekeyRequest{}
+	if err := json.Unmarshal(data, sealed); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	prekeySK, err := ps.ks.prekeyPrivKey(sealed.PrekeyPK)
+	if err != nil {
+		return nil, err
+	}
+
+	mongPriv, err := cryptoutil.EdwardsToMontgomeryPriv(prekeySK)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyConversion.Wrap(err)
+	}
+	defer cryptoutil.WipeKey(mongPriv)
+
+	ephemeralPK, err := cryptoutil.KeySliceToArray(sealed.EphemeralPK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(sealed.Nonce)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	plaintext, ok := box.Open(nil, sealed.Sealed, nonce, ephemeralPK, mongPriv)
+	if !ok {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open prekey request"))
+	}
+
+	// the prekey is consumed even if the request turns out to be invalid
+	if err := ps.ks.deletePrekey(sealed.PrekeyPK); err != nil {
+		return nil, err
+	}
+
+	if err := ps.store.Delete(prekeysKey.ChildString(hex.EncodeToString(sealed.PrekeyPK))); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	signed := &signedPrekeyRequest{}
+	if err := json.Unmarshal(plaintext, signed); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	r := &prekeyRequest{}
+	if err := json.Unmarshal(signed.Request, r); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if !bytes.Equal(r.RecipientPK, ownPK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("prekey request for another account"))
+	}
+
+	contact := &bertytypes.ShareableContact{}
+	if err := contact.Unmarshal(r.Contact); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if err := contact.CheckFormat(bertytypes.ShareableContactOptionsAllowMissingRDVSeed); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	senderPK, err := crypto.UnmarshalEd25519PublicKey(contact.PK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := senderPK.Verify(signed.Request, signed.Signature); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid prekey request signature"))
+	}
+
+	return contact, nil
+}
+
+func (ps *prekeyStore) sent(contactPK []byte) bool {
+	has, err := ps.store.Has(prekeySentKey.ChildString(hex.EncodeToString(contactPK)))
+	return err == nil && has
+}
+
+func (ps *prekeyStore) markSent(contactPK []byte, at time.Time) error {
+	data, err := at.MarshalText()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := ps.store.Put(prekeySentKey.ChildString(hex.EncodeToString(contactPK)), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (ps *prekeyStore) publication() *prekeyPublication {
+	p := &prekeyPublication{}
+
+	data, err := ps.store.Get(prekeyPublishedKey)
+	if err != nil {
+		return p
+	}
+
+	if err := json.Unmarshal(data, p); err != nil {
+		ps.logger.Warn("invalid prekey publication", zap.Error(err))
+	}
+
+	return p
+}
+
+func (ps *prekeyStore) setPublication(p *prekeyPublication) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := ps.store.Put(prekeyPublishedKey, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// prekeyPublish replenishes the prekeys of the device and publishes them, the
+// bundle is carried by the store-and-forward peers for the strangers knowing
+// the shareable contact of the account. Nothing is published while the
+// contact requests are disabled.
+func (s *service) prekeyPublish(force bool) (*PrekeyStatus, error) {
+	if s.storeForward == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	enabled, own := s.accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
+	if !enabled || own == nil || len(own.PublicRendezvousSeed) == 0 {
+		return s.prekeyStatus()
+	}
+
+	added, err := s.prekeys.replenish()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tag := prekeyBundleTag(own.PK, own.PublicRendezvousSeed)
+	last := s.prekeys.publication()
+	if !force && added == 0 && hmac.Equal(last.Tag, tag) && now.Sub(last.At) < prekeyRepublishInterval {
+		return s.prekeyStatus()
+	}
+
+	prekeys, err := s.prekeys.list()
+	if err != nil {
+		return nil, err
+	}
+
+	accountSK, err := s.deviceKeystore.AccountPrivKey()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	signed, err := signPrekeyBundle(accountSK, prekeys, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.storeForward.Carry(tag, signed, 0); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := s.prekeys.setPublication(&prekeyPublication{Tag: tag, At: now}); err != nil {
+		return nil, err
+	}
+
+	s.logger.Debug("prekey bundle published", zap.Int("prekeys", len(prekeys)), zap.Int("added", added))
+
+	return s.prekeyStatus()
+}
+
+func (s *service) prekeyStatus() (*PrekeyStatus, error) {
+	prekeys, err := s.prekeys.list()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrekeyStatus{Available: len(prekeys), PublishedAt: s.prekeys.publication().At}, nil
+}
+
+// newestPrekeyBundle returns the latest bundle of an account among the ones
+// carried by the device, nil if there is none.
+func (s *service) newestPrekeyBundle(contact *bertytypes.ShareableContact) *PrekeyBundle {
+	var newest *PrekeyBundle
+	for _, b := range s.storeForward.Lookup(prekeyBundleTag(contact.PK, contact.PublicRendezvousSeed)) {
+		bundle, err := openPrekeyBundle(b.Payload, contact.PK)
+		if err != nil {
+			s.logger.Debug("invalid prekey bundle", zap.Error(err))
+			continue
+		}
+
+		if newest == nil || bundle.CreatedAt > newest.CreatedAt {
+			newest = bundle
+		}
+	}
+
+	return newest
+}
+
+// prekeySendPending sends the contact requests pending to the bundles of the
+// contacts carried by the device, once per contact. The requests are still
+// sent directly if both devices meet.
+func (s *service) prekeySendPending() {
+	if s.storeForward == nil {
+		return
+	}
+
+	store := s.accountGroup.MetadataStore()
+	for _, contact := range store.ListContactsByStatus(bertytypes.ContactStateToRequest) {
+		if len(contact.PublicRendezvousSeed) == 0 || s.prekeys.sent(contact.PK) {
+			continue
+		}
+
+		bundle := s.newestPrekeyBundle(contact)
+		if bundle == nil {
+			continue
+		}
+
+		_, own := store.GetIncomingContactRequestsStatus()
+		if own == nil {
+			s.logger.Warn("unable to retrieve own contact information")
+			return
+		}
+
+		ownMetadata, err := store.GetRequestOwnMetadataForContact(contact.PK)
+		if err != nil {
+			s.logger.Warn("unable to get own metadata for contact", zap.Error(err))
+		}
+		own.Metadata = ownMetadata
+
+		accountSK, err := s.deviceKeystore.AccountPrivKey()
+		if err != nil {
+			s.logger.Warn("unable to get account key", zap.Error(err))
+			return
+		}
+
+		now := time.Now()
+		sealed, err := sealPrekeyRequest(accountSK, own, bundle, now)
+		if err != nil {
+			s.logger.Warn("unable to seal prekey request", zap.Error(err))
+			continue
+		}
+
+		if _, err := s.storeForward.Carry(prekeyRequestTag(contact.PK, contact.PublicRendezvousSeed), sealed, 0); err != nil {
+			s.logger.Warn("unable to carry prekey request", zap.Error(err))
+			continue
+		}
+
+		if err := s.prekeys.markSent(contact.PK, now); err != nil {
+			s.logger.Warn("unable to keep prekey request", zap.Error(err))
+		}
+
+		s.logger.Info("contact request sent to prekey bundle", zap.Binary("contact", contact.PK))
+	}
+}
+
+// deliverPrekeyRequest receives a contact request sent to a prekey of the
+// device, a request for a prekey held by another device of the account is
+// left to be carried to it.
+func (s *service) deliverPrekeyRequest(ctx context.Context, tag []byte, payload []byte) (bool, error) {
+	enabled, own := s.accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
+	if own == nil || len(own.PublicRendezvousSeed) == 0 || !hmac.Equal(tag, prekeyRequestTag(own.PK, own.PublicRendezvousSeed)) {
+		return false, nil
+	}
+
+	if !enabled {
+		return false, nil
+	}
+
+	contact, err := s.prekeys.open(payload, own.PK)
+	if err == errPrekeyUnknown {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if _, err := s.accountGroup.MetadataStore().ContactRequestIncomingReceived(ctx, contact); err != nil {
+		s.logger.Debug("prekey request not added", zap.Error(err))
+	} else {
+		s.lifecycles.requestReceived(contact.PK, "")
+		s.logger.Info("contact request received through prekey", zap.Binary("contact", contact.PK))
+	}
+
+	go func() {
+		if _, err := s.prekeyPublish(false); err != nil {
+			s.logger.Warn("unable to replenish prekeys", zap.Error(err))
+		}
+	}()
+
+	return true, nil
+}
+
+func (s *service) prekeyLoop(ctx context.Context) {
+	ticker := time.NewTicker(prekeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.prekeyPublish(false); err != nil {
+			s.logger.Warn("unable to publish prekeys", zap.Error(err))
+		}
+
+		s.prekeySendPending()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// PrekeyStatus returns the one-time prekeys left on the device and their
+// last publication.
+func (s *service) PrekeyStatus(context.Context) (*PrekeyStatus, error) {
+	if s.storeForward == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.prekeyStatus()
+}
+
+// PrekeyReplenish tops up the one-time prekeys of the device and publishes
+// them again right away.
+func (s *service) PrekeyReplenish(context.Context) (*PrekeyStatus, error) {
+	return s.prekeyPublish(true)
+}
@@ -0,0 +1,125 @@
+package bertyprotocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-ipfs/keystore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPrekeyRequest(t *testing.T) {
+	recipientKS := NewDeviceKeystore(keystore.NewMemKeystore())
+	recipientSK, err := recipientKS.AccountPrivKey()
+	require.NoError(t, err)
+	recipientPK, err := recipientSK.GetPublic().Raw()
+	require.NoError(t, err)
+
+	ps := newPrekeyStore(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), recipientKS)
+	added, err := ps.replenish()
+	require.NoError(t, err)
+	assert.Equal(t, prekeyCount, added)
+
+	// enough prekeys are left
+	added, err = ps.replenish()
+	require.NoError(t, err)
+	assert.Equal(t, 0, added)
+
+	prekeys, err := ps.list()
+	require.NoError(t, err)
+	signed, err := signPrekeyBundle(recipientSK, prekeys, time.Now())
+	require.NoError(t, err)
+
+	// a bundle is only valid for the account signing it
+	requesterSK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	requesterPK, err := requesterSK.GetPublic().Raw()
+	require.NoError(t, err)
+	_, err = openPrekeyBundle(signed, requesterPK)
+	assert.Error(t, err)
+
+	bundle, err := openPrekeyBundle(signed, recipientPK)
+	require.NoError(t, err)
+	assert.Len(t, bundle.Prekeys, prekeyCount)
+
+	contact := &bertytypes.ShareableContact{
+		PK:                   requesterPK,
+		PublicRendezvousSeed: []byte("requester seed"),
+		Metadata:             []byte("hello"),
+	}
+
+	// the prekey of the bundle is picked at random
+	withPrekey := func(i int) *PrekeyBundle {
+		return &PrekeyBundle{AccountPK: bundle.AccountPK, Prekeys: bundle.Prekeys[i : i+1], CreatedAt: bundle.CreatedAt}
+	}
+
+	sealed, err := sealPrekeyRequest(requesterSK, contact, withPrekey(0), time.Now())
+	require.NoError(t, err)
+
+	// a request for another account is rejected
+	_, err = ps.open(sealed, requesterPK)
+	assert.Error(t, err)
+
+	sealed, err = sealPrekeyRequest(requesterSK, contact, withPrekey(1), time.Now())
+	require.NoError(t, err)
+
+	received, err := ps.open(sealed, recipientPK)
+	require.NoError(t, err)
+	assert.Equal(t, contact.PK, received.PK)
+	assert.Equal(t, contact.Metadata, received.Metadata)
+
+	// the prekey is consumed, the request can't be replayed
+	_, err = ps.open(sealed, recipientPK)
+	assert.Equal(t, errPrekeyUnknown, err)
+
+	prekeys, err = ps.list()
+	require.NoError(t, err)
+	assert.Len(t, prekeys, prekeyCount-2)
+
+	// a request signed by another key than the one of the contact is rejected
+	impostorSK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	sealed, err = sealPrekeyRequest(impostorSK, contact, withPrekey(2), time.Now())
+	require.NoError(t, err)
+	_, err = ps.open(sealed, recipientPK)
+	assert.Error(t, err)
+	assert.NotEqual(t, errPrekeyUnknown, err)
+}
+
+func TestPrekeyReplenish(t *testing.T) {
+	ks := NewDeviceKeystore(keystore.NewMemKeystore())
+	ps := newPrekeyStore(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), ks)
+
+	_, err := ps.replenish()
+	require.NoError(t, err)
+
+	prekeys, err := ps.list()
+	require.NoError(t, err)
+
+	dks := ks.(*deviceKeystore)
+	for _, pk := range prekeys[:prekeyCount-prekeyThreshold+1] {
+		require.NoError(t, dks.deletePrekey(pk))
+		require.NoError(t, ps.store.Delete(prekeysKey.ChildString(hex.EncodeToString(pk))))
+	}
+
+	added, err := ps.replenish()
+	require.NoError(t, err)
+	assert.Equal(t, prekeyCount-prekeyThreshold+1, added)
+
+	prekeys, err = ps.list()
+	require.NoError(t, err)
+	assert.Len(t, prekeys, prekeyCount)
+
+	for _, pk := range prekeys {
+		_, err := dks.prekeyPrivKey(pk)
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,439 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bertymetrics "berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/internal/pushrelay"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfslog "berty.tech/go-ipfs-log"
+	"github.com/gogo/protobuf/proto"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+// pushTokenPayloadType is the type of the app metadata payloads announcing
+// the sealed push token of a device.
+const pushTokenPayloadType = "berty.push.token"
+
+const (
+	// pushTimeout bounds a push request to the relay of a device
+	pushTimeout = 30 * time.Second
+
+	// pushFetchTimeout is how long a woken device waits for the pushed
+	// message, the notification service extensions are killed after 30s
+	pushFetchTimeout = 25 * time.Second
+
+	pushFetchInterval = 500 * time.Millisecond
+)
+
+var pushRegistrationKey = datastore.NewKey("registration")
+
+type pushTokenAnnounce struct {
+	Type     string `json:"type"`
+	DevicePK []byte `json:"device_pk"`
+
+	// Relay is the addr of the relay which sealed the token, both are empty
+	// once the device unregistered
+	Relay       string `json:"relay,omitempty"`
+	SealedToken []byte `json:"sealed_token,omitempty"`
+	At          int64  `json:"at"`
+}
+
+// PushRegistration is the push token of the device registered with its
+// relay.
+type PushRegistration struct {
+	Platform     string    `json:"platform"`
+	Relay        string    `json:"relay"`
+	SealedToken  []byte    `json:"sealed_token"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// PushReceived is the message a push woke the device for.
+type PushReceived struct {
+	GroupPK   []byte `json:"group_pk"`
+	MessageID []byte `json:"message_id"`
+
+	// Fetched is false if the message wasn't synced before the deadline,
+	// it will be once the group is replicated
+	Fetched bool `json:"fetched"`
+}
+
+// pushTokens keeps the push token registered by the device.
+type pushTokens struct {
+	logger *zap.Logger
+	store  datastore.Datastore
+	relay  *peer.AddrInfo
+	lock   sync.Mutex
+}
+
+func newPushTokens(logger *zap.Logger, store datastore.Datastore, relay string) (*pushTokens, error) {
+	pt := &pushTokens{logger: logger, store: store}
+	if relay == "" {
+		return pt, nil
+	}
+
+	var err error
+	if pt.relay, err = parsePushRelay(relay); err != nil {
+		return nil, err
+	}
+
+	return pt, nil
+}
+
+func (pt *pushTokens) get() (*PushRegistration, error) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	data, err := pt.store.Get(pushRegistrationKey)
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	reg := &PushRegistration{}
+	if err := json.Unmarshal(data, reg); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return reg, nil
+}
+
+func (pt *pushTokens) set(reg *PushRegistration) error {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	if reg == nil {
+		if err := pt.store.Delete(pushRegistrationKey); err != nil && err != datastore.ErrNotFound {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		return nil
+	}
+
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := pt.store.Put(pushRegistrationKey, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// pushTag identifies the group of a pushed payload, only its members can
+// compute it. The push services can link the pushes of a group together.
+func pushTag(groupPK []byte) []byte {
+	mac := hmac.New(sha256.New, groupPK)
+	_, _ = mac.Write([]byte("berty push"))
+
+	return mac.Sum(nil)
+}
+
+// PushTokenRegister registers the push token of the device with its relay,
+// the sealed token is then announced in its groups so its contacts can wake
+// it.
+func (s *service) PushTokenRegister(ctx context.Context, platform, bundleID, token string) (*PushRegistration, error) {
+	if s.host == nil || s.pushTokens.relay == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	sealed, err := pushrelay.Register(ctx, s.host, *s.pushTokens.relay, &pushrelay.Token{Platform: platform, BundleID: bundleID, Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := peer.AddrInfoToP2pAddrs(s.pushTokens.relay)
+	if err != nil || len(addrs) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no addr for the push relay"))
+	}
+
+	reg := &PushRegistration{
+		Platform:     platform,
+		Relay:        addrs[0].String(),
+		SealedToken:  sealed,
+		RegisteredAt: time.Now(),
+	}
+
+	if err := s.pushTokens.set(reg); err != nil {
+		return nil, err
+	}
+
+	s.announcePushTokens()
+
+	return reg, nil
+}
+
+// PushTokenUnregister stops the pushes to the device, its groups are told to
+// forget its token.
+func (s *service) PushTokenUnregister(context.Context) error {
+	if err := s.pushTokens.set(nil); err != nil {
+		return err
+	}
+
+	s.announcePushTokens()
+
+	return nil
+}
+
+func (s *service) announcePushTokens() {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, gc := range s.openedGroups {
+		if gc.Group().GroupType != bertytypes.GroupTypeAccount {
+			go s.announcePushToken(gc.Group())
+		}
+	}
+}
+
+// announcePushToken announces the push token of the device in a group
+// unless already known by the group.
+func (s *service) announcePushToken(g *bertytypes.Group) {
+	gc, err := s.getContextGroupForID(g.PublicKey)
+	if err != nil {
+		return
+	}
+
+	reg, err := s.pushTokens.get()
+	if err != nil {
+		s.logger.Warn("unable to get push registration", zap.Error(err))
+		return
+	}
+
+	devicePK, err := gc.DevicePubKey().Raw()
+	if err != nil {
+		return
+	}
+
+	announce := &pushTokenAnnounce{Type: pushTokenPayloadType, DevicePK: devicePK, At: time.Now().UnixNano()}
+	if reg != nil {
+		announce.Relay, announce.SealedToken = reg.Relay, reg.SealedToken
+	}
+
+	known := gc.MetadataStore().Index().(*metadataStoreIndex).pushToken(devicePK)
+	if (known == nil && reg == nil) || (known != nil && bytes.Equal(known.SealedToken, announce.SealedToken)) {
+		return
+	}
+
+	payload, err := json.Marshal(announce)
+	if err != nil {
+		return
+	}
+
+	if _, err := gc.MetadataStore().SendAppMetadata(s.ctx, payload); err != nil {
+		s.logger.Warn("unable to announce push token", zap.Error(err))
+	}
+}
+
+func (m *metadataStoreIndex) handlePushToken(event proto.Message) error {
+	e, ok := event.(*bertytypes.AppMetadata)
+	if !ok {
+		return errcode.ErrInvalidInput
+	}
+
+	if m.g.GroupType == bertytypes.GroupTypeAccount {
+		return nil
+	}
+
+	announce := &pushTokenAnnounce{}
+	if err := json.Unmarshal(e.Message, announce); err != nil || announce.Type != pushTokenPayloadType {
+		// not a push token
+		return nil
+	}
+
+	// the app metadata are signed by the device
+	if !bytes.Equal(announce.DevicePK, e.DevicePK) {
+		return errcode.ErrInvalidInput
+	}
+
+	if known, ok := m.pushTokens[string(announce.DevicePK)]; ok && known.At > announce.At {
+		return nil
+	}
+
+	m.pushTokens[string(announce.DevicePK)] = announce
+
+	return nil
+}
+
+func (m *metadataStoreIndex) pushToken(devicePK []byte) *pushTokenAnnounce {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.pushTokens[string(devicePK)]
+}
+
+// pushMessage wakes the other devices of the group having announced a push
+// token, the pushed payload is sealed for the group and only carries the ID
+// of the message.
+func (s *service) pushMessage(gc *groupContext, e ipfslog.Entry) {
+	if s.host == nil || e == nil || gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return
+	}
+
+	index := gc.MetadataStore().Index().(*metadataStoreIndex)
+	var payload []byte
+
+	for _, device := range gc.MetadataStore().ListDevices() {
+		if device.Equals(gc.DevicePubKey()) {
+			continue
+		}
+
+		raw, err := device.Raw()
+		if err != nil {
+			continue
+		}
+
+		announce := index.pushToken(raw)
+		if announce == nil || len(announce.SealedToken) == 0 {
+			continue
+		}
+
+		relay, err := parsePushRelay(announce.Relay)
+		if err != nil {
+			s.logger.Debug("invalid push relay", zap.String("relay", announce.Relay), zap.Error(err))
+			continue
+		}
+
+		if payload == nil {
+			sealed, err := s.sealForGroup(gc.Group(), e.GetHash().Bytes())
+			if err != nil {
+				s.logger.Warn("unable to seal push payload", zap.Error(err))
+				return
+			}
+
+			payload = append(pushTag(gc.Group().PublicKey), sealed...)
+		}
+
+		go func(sealedToken []byte) {
+			ctx, cancel := context.WithTimeout(s.ctx, pushTimeout)
+			defer cancel()
+
+			err := pushrelay.Push(ctx, s.host, *relay, sealedToken, payload)
+			switch {
+			case err == nil:
+				s.metrics.RecordPushRequest(bertymetrics.ResultSuccess)
+			case err == pushrelay.ErrUnregistered:
+				s.metrics.RecordPushRequest(bertymetrics.ResultUnregistered)
+			default:
+				s.metrics.RecordPushRequest(bertymetrics.ResultFailure)
+				s.logger.Debug("unable to push message", zap.Stringer("relay", relay.ID), zap.Error(err))
+			}
+		}(announce.SealedToken)
+	}
+}
+
+func parsePushRelay(relay string) (*peer.AddrInfo, error) {
+	maddr, err := ma.NewMultiaddr(relay)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	return info, nil
+}
+
+func (s *service) groupForPushTag(tag []byte) (*bertytypes.Group, error) {
+	if err := s.indexGroups(); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, g := range s.groups {
+		if g.GroupType != bertytypes.GroupTypeAccount && hmac.Equal(pushTag(g.PublicKey), tag) {
+			return g, nil
+		}
+	}
+
+	return nil, errcode.ErrGroupMissing
+}
+
+// PushReceive opens the payload of a push, the group of the message is
+// activated and its message fetched from the peers, until the context is done
+// or the fetch timeout.
+func (s *service) PushReceive(ctx context.Context, payload []byte) (*PushReceived, error) {
+	if len(payload) < sha256.Size {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("push payload too short"))
+	}
+
+	g, err := s.groupForPushTag(payload[:sha256.Size])
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := openSealedEnvelope(g, payload[sha256.Size:])
+	if err != nil {
+		return nil, err
+	} else if env == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("push payload not sealed"))
+	}
+
+	_, id, err := cid.CidFromBytes(env.Payload)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(g.PublicKey)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if err := s.activateGroup(pk); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	gc, err := s.getContextGroupForID(g.PublicKey)
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	// the sender must still be a device of the group
+	if !gc.MetadataStore().isCurrentDevice(env.Signer) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("push of a device not in the group"))
+	}
+
+	received := &PushReceived{GroupPK: g.PublicKey, MessageID: id.Bytes()}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pushFetchTimeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(pushFetchInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, ok := gc.MessageStore().OpLog().GetEntries().Get(id.String()); ok {
+			received.Fetched = true
+			return received, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return received, nil
+		}
+	}
+}
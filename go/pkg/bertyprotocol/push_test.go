@@ -0,0 +1,70 @@
+package bertyprotocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPushTokens(t *testing.T) {
+	_, err := newPushTokens(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), "/ip4/127.0.0.1/tcp/4040")
+	assert.Error(t, err)
+
+	pt, err := newPushTokens(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), "/ip4/127.0.0.1/tcp/4040/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN")
+	require.NoError(t, err)
+	require.NotNil(t, pt.relay)
+
+	reg, err := pt.get()
+	require.NoError(t, err)
+	assert.Nil(t, reg)
+
+	require.NoError(t, pt.set(&PushRegistration{Platform: "apns", SealedToken: []byte("sealed"), RegisteredAt: time.Now()}))
+	reg, err = pt.get()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("sealed"), reg.SealedToken)
+
+	require.NoError(t, pt.set(nil))
+	reg, err = pt.get()
+	require.NoError(t, err)
+	assert.Nil(t, reg)
+}
+
+func TestPushPayload(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	other, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	deviceSK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	id, err := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("entry"))
+	require.NoError(t, err)
+
+	sealed, err := sealEnvelope(g, deviceSK, id.Bytes())
+	require.NoError(t, err)
+	payload := append(pushTag(g.PublicKey), sealed...)
+
+	// only the members of the group recognize its pushes
+	assert.True(t, hmac.Equal(pushTag(g.PublicKey), payload[:sha256.Size]))
+	assert.False(t, hmac.Equal(pushTag(other.PublicKey), payload[:sha256.Size]))
+
+	env, err := openSealedEnvelope(g, payload[sha256.Size:])
+	require.NoError(t, err)
+
+	_, opened, err := cid.CidFromBytes(env.Payload)
+	require.NoError(t, err)
+	assert.True(t, id.Equals(opened))
+}
@@ -0,0 +1,1077 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"berty.tech/berty/v2/go/internal/doubleratchet"
+	"berty.tech/berty/v2/go/internal/kyber"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/gogo/protobuf/proto"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// ratchetKeyPayloadType is the type of the app metadata payloads announcing
+// the ratchet public key of a device.
+const ratchetKeyPayloadType = "berty.ratchet.key"
+
+// ratchetCapabilityHybridKEM is announced by the devices mixing a ML-KEM-768
+// shared key in the secret of their sessions, a session is only hybrid once
+// both devices announced it.
+const ratchetCapabilityHybridKEM = "hybrid-kem/x25519-mlkem768"
+
+// ratchetPayloadPrefix prefixes the message payloads sealed by the double
+// ratchet layer, the other payloads are left as is.
+var ratchetPayloadPrefix = []byte("\x00berty.ratchet/1\x00")
+
+var errRatchetUnavailable = fmt.Errorf("a device of the group didn't announce its ratchet key yet")
+
+var (
+	ratchetOwnKeysKey      = datastore.NewKey("keys")
+	ratchetPreviousKeysKey = datastore.NewKey("previous-keys")
+	ratchetSelfKey         = datastore.NewKey("self")
+	ratchetSessionKey      = datastore.NewKey("sessions")
+	ratchetCIDKey          = datastore.NewKey("cids")
+	ratchetKEMKey          = datastore.NewKey("kem")
+)
+
+type ratchetKeyAnnounce struct {
+	Type      string `json:"type"`
+	DevicePK  []byte `json:"device_pk"`
+	RatchetPK []byte `json:"ratchet_pk"`
+	Epoch     uint64 `json:"epoch"`
+
+	// Capabilities are the optional features supported by the device
+	Capabilities []string `json:"capabilities,omitempty"`
+	KEMPK        []byte   `json:"kem_pk,omitempty"`
+}
+
+func (a *ratchetKeyAnnounce) hasCapability(capability string) bool {
+	for _, c := range a.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ratchetOwnKey struct {
+	Epoch   uint64                 `json:"epoch"`
+	KeyPair *doubleratchet.KeyPair `json:"key_pair"`
+	KEMSeed []byte                 `json:"kem_seed,omitempty"`
+}
+
+// ratchetPreviousKey is a previous ratchet key of the device, kept while the
+// sessions of remote devices use it.
+type ratchetPreviousKey struct {
+	ratchetOwnKey
+
+	// Devices are the remote devices whose sessions still use the key
+	Devices [][]byte `json:"devices"`
+}
+
+func (k *ratchetPreviousKey) hasDevice(device []byte) bool {
+	for _, d := range k.Devices {
+		if bytes.Equal(d, device) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ratchetSessionRecord struct {
+	OwnKey    []byte `json:"own_key"`
+	RemoteKey []byte `json:"remote_key"`
+	State     []byte `json:"state"`
+}
+
+// ratchetKEMRecord is the ML-KEM shared key of a hybrid session, the
+// initiator of the session encapsulates it for the KEM key announced by the
+// responder.
+type ratchetKEMRecord struct {
+	Ciphertext []byte `json:"ciphertext"`
+	SharedKey  []byte `json:"shared_key"`
+}
+
+// ratchetEnvelope is sealed once with a random content key, which is sealed
+// by the session of each recipient device, and for the sender by a key of
+// the message.
+type ratchetEnvelope struct {
+	Ciphertext []byte              `json:"ciphertext"`
+	Self       []byte              `json:"self"`
+	Recipients []*ratchetRecipient `json:"recipients"`
+
+	// SelfID identifies the key sealing Self, it is kept by the sender until
+	// it knows the CID of the message
+	SelfID []byte `json:"self_id"`
+}
+
+type ratchetRecipient struct {
+	DevicePK     []byte `json:"device_pk"`
+	SenderKey    []byte `json:"sender_key"`
+	RecipientKey []byte `json:"recipient_key"`
+	Header       []byte `json:"header"`
+	Key          []byte `json:"key"`
+
+	// KEMCiphertext is set for the hybrid sessions
+	KEMCiphertext []byte `json:"kem_ct,omitempty"`
+}
+
+// ratchetManager seals the messages of the contact groups with a double
+// ratchet session per pair of devices, the state of the sessions is
+// persisted. A session is reset when a message can't be opened, the device
+// then announces a new ratchet key and keeps the previous one for the
+// sessions of the other devices until they use the new key.
+type ratchetManager struct {
+	logger *zap.Logger
+	store  datastore.Datastore
+	devKS  DeviceKeystore
+
+	// hybrid enables the hybrid sessions with the devices announcing them
+	hybrid bool
+
+	// announce is called once the ratchet key of the device changed
+	announce func(g *bertytypes.Group)
+
+	lock sync.Mutex
+}
+
+func newRatchetManager(logger *zap.Logger, store datastore.Datastore, devKS DeviceKeystore) *ratchetManager {
+	return &ratchetManager{
+		logger: logger,
+		store:  store,
+		devKS:  devKS,
+	}
+}
+
+func isRatchetPayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, ratchetPayloadPrefix)
+}
+
+func ratchetGroupKey(prefix datastore.Key, g *bertytypes.Group) datastore.Key {
+	return prefix.ChildString(base64.RawURLEncoding.EncodeToString(g.PublicKey))
+}
+
+// ratchetSessionID identifies the session of a remote device for a pair of
+// ratchet keys, the session of a previous key of the remote device is kept
+// for its messages still to be received. A hybrid session is also identified
+// by its KEM ciphertext.
+func ratchetSessionID(g *bertytypes.Group, remoteDevice, ownKey, remoteKey, kemCiphertext []byte) datastore.Key {
+	return ratchetPairKey(ratchetSessionKey, g, remoteDevice, ownKey, remoteKey, kemCiphertext)
+}
+
+func ratchetPairKey(prefix datastore.Key, g *bertytypes.Group, remoteDevice []byte, parts ...[]byte) datastore.Key {
+	id := sha256.Sum256(bytes.Join(parts, nil))
+
+	return ratchetGroupKey(prefix, g).
+		ChildString(base64.RawURLEncoding.EncodeToString(remoteDevice)).
+		ChildString(base64.RawURLEncoding.EncodeToString(id[:16]))
+}
+
+func ratchetSharedSecret(g *bertytypes.Group, devA, devB []byte) ([]byte, error) {
+	if bytes.Compare(devA, devB) > 0 {
+		devA, devB = devB, devA
+	}
+
+	info := bytes.Join([][]byte{[]byte("berty double ratchet"), devA, devB}, nil)
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, g.Secret, nil, info), secret); err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return secret, nil
+}
+
+// ratchetHybridSecret mixes the KEM shared key of a hybrid session in the
+// classical secret of the devices.
+func ratchetHybridSecret(secret, kemSharedKey []byte) ([]byte, error) {
+	hybrid := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, append(append([]byte(nil), secret...), kemSharedKey...), nil, []byte("berty hybrid ratchet")), hybrid); err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return hybrid, nil
+}
+
+func ratchetAssociatedData(g *bertytypes.Group, sender, recipient []byte) []byte {
+	return bytes.Join([][]byte{g.PublicKey, sender, recipient}, nil)
+}
+
+func (rm *ratchetManager) get(key datastore.Key, v interface{}) error {
+	data, err := rm.store.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return nil
+}
+
+func (rm *ratchetManager) put(key datastore.Key, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := rm.store.Put(key, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// ownKey returns the ratchet key of the device for a group, it is created
+// if missing. A key without KEM key is renewed once the hybrid sessions are
+// enabled.
+func (rm *ratchetManager) ownKey(g *bertytypes.Group) (*ratchetOwnKey, error) {
+	key := &ratchetOwnKey{}
+	switch err := rm.get(ratchetGroupKey(ratchetOwnKeysKey, g), key); err {
+	case nil:
+		if rm.hybrid && len(key.KEMSeed) == 0 {
+			return rm.rotateOwnKey(g, key, nil)
+		}
+
+		return key, nil
+	case datastore.ErrNotFound:
+		return rm.renewOwnKey(g, 0)
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+}
+
+func (rm *ratchetManager) renewOwnKey(g *bertytypes.Group, epoch uint64) (*ratchetOwnKey, error) {
+	kp, err := doubleratchet.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	key := &ratchetOwnKey{Epoch: epoch + 1, KeyPair: kp}
+	if rm.hybrid {
+		kem, err := kyber.GenerateKey()
+		if err != nil {
+			return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+		}
+
+		key.KEMSeed = kem.Bytes()
+	}
+
+	if err := rm.put(ratchetGroupKey(ratchetOwnKeysKey, g), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// rotateOwnKey renews the ratchet key of the device, the previous key is kept
+// for the remote devices having a session using it, but the reset one whose
+// session is deleted.
+func (rm *ratchetManager) rotateOwnKey(g *bertytypes.Group, own *ratchetOwnKey, reset []byte) (*ratchetOwnKey, error) {
+	if reset != nil {
+		if err := rm.deleteSessions(g, reset, own.KeyPair.Public); err != nil {
+			return nil, err
+		}
+	}
+
+	records, err := rm.sessionRecords(g, nil, own.KeyPair.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := &ratchetPreviousKey{ratchetOwnKey: *own}
+	for key := range records {
+		device, err := base64.RawURLEncoding.DecodeString(key.Parent().BaseNamespace())
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if !previous.hasDevice(device) {
+			previous.Devices = append(previous.Devices, device)
+		}
+	}
+
+	if len(previous.Devices) > 0 {
+		if err := rm.put(ratchetPreviousKeyID(g, own.Epoch), previous); err != nil {
+			return nil, err
+		}
+	}
+
+	return rm.renewOwnKey(g, own.Epoch)
+}
+
+func ratchetPreviousKeyID(g *bertytypes.Group, epoch uint64) datastore.Key {
+	return ratchetGroupKey(ratchetPreviousKeysKey, g).ChildString(strconv.FormatUint(epoch, 10))
+}
+
+// previousKeys returns the previous ratchet keys of the device kept for a
+// group.
+func (rm *ratchetManager) previousKeys(g *bertytypes.Group) ([]*ratchetPreviousKey, error) {
+	res, err := rm.store.Query(query.Query{Prefix: ratchetGroupKey(ratchetPreviousKeysKey, g).String()})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	keys := make([]*ratchetPreviousKey, 0, len(entries))
+	for _, entry := range entries {
+		key := &ratchetPreviousKey{}
+		if err := json.Unmarshal(entry.Value, key); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// previousKey returns the previous ratchet key of the device with a public
+// key, or nil if it isn't kept.
+func (rm *ratchetManager) previousKey(g *bertytypes.Group, public []byte) (*ratchetPreviousKey, error) {
+	keys, err := rm.previousKeys(g)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if bytes.Equal(key.KeyPair.Public, public) {
+			return key, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// releasePreviousKeys deletes the sessions of a remote device using the
+// previous keys once it uses the current one, a previous key is deleted once
+// no session uses it.
+func (rm *ratchetManager) releasePreviousKeys(g *bertytypes.Group, remoteDevice []byte) error {
+	keys, err := rm.previousKeys(g)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !key.hasDevice(remoteDevice) {
+			continue
+		}
+
+		if err := rm.deleteSessions(g, remoteDevice, key.KeyPair.Public); err != nil {
+			return err
+		}
+
+		devices := key.Devices[:0]
+		for _, d := range key.Devices {
+			if !bytes.Equal(d, remoteDevice) {
+				devices = append(devices, d)
+			}
+		}
+
+		key.Devices = devices
+		if len(key.Devices) > 0 {
+			if err := rm.put(ratchetPreviousKeyID(g, key.Epoch), key); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := rm.store.Delete(ratchetPreviousKeyID(g, key.Epoch)); err != nil && err != datastore.ErrNotFound {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+func ratchetSelfKeyID(g *bertytypes.Group, id []byte) datastore.Key {
+	return ratchetGroupKey(ratchetSelfKey, g).ChildString(base64.RawURLEncoding.EncodeToString(id))
+}
+
+// newSelfKey returns a key sealing the content key of a message for the
+// device, a key by message so it is deleted with the message.
+func (rm *ratchetManager) newSelfKey(g *bertytypes.Group) ([]byte, *[32]byte, error) {
+	var key [32]byte
+	id := make([]byte, 16)
+
+	if _, err := io.ReadFull(crand.Reader, id); err != nil {
+		return nil, nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	if _, err := io.ReadFull(crand.Reader, key[:]); err != nil {
+		return nil, nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	if err := rm.store.Put(ratchetSelfKeyID(g, id), key[:]); err != nil {
+		return nil, nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return id, &key, nil
+}
+
+// openSelf opens the content key of a message of the device. Once the CID of
+// the message is known, the content key is kept for it like for the received
+// messages and the key of the message is deleted, so the content key is
+// deleted with the message.
+func (rm *ratchetManager) openSelf(g *bertytypes.Group, id cid.Cid, env *ratchetEnvelope) ([]byte, error) {
+	if len(env.SelfID) == 0 {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("message not sealed for this device"))
+	}
+
+	data, err := rm.store.Get(ratchetSelfKeyID(g, env.SelfID))
+	switch err {
+	case nil:
+	case datastore.ErrNotFound:
+		return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("message key deleted"))
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	var key [32]byte
+	copy(key[:], data)
+
+	contentKey, err := openRatchetSecret(&key, env.Self)
+	if err != nil || !id.Defined() {
+		return contentKey, err
+	}
+
+	if err := rm.store.Put(ratchetCIDKey.ChildString(id.String()), contentKey); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := rm.store.Delete(ratchetSelfKeyID(g, env.SelfID)); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return contentKey, nil
+}
+
+func sealRatchetSecret(key *[32]byte, message []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(crand.Reader, nonce[:]); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	return secretbox.Seal(nonce[:], message, &nonce, key), nil
+}
+
+func openRatchetSecret(key *[32]byte, sealed []byte) ([]byte, error) {
+	var nonce [24]byte
+	if len(sealed) < len(nonce) {
+		return nil, errcode.ErrCryptoDecrypt
+	}
+
+	copy(nonce[:], sealed)
+
+	message, ok := secretbox.Open(nil, sealed[len(nonce):], &nonce, key)
+	if !ok {
+		return nil, errcode.ErrCryptoDecrypt
+	}
+
+	return message, nil
+}
+
+// kemRecord returns the KEM shared key of the hybrid session with a remote
+// device for the given keys, or nil if the session isn't hybrid yet.
+func (rm *ratchetManager) kemRecord(g *bertytypes.Group, remoteDevice []byte, own *doubleratchet.KeyPair, remoteKey []byte) (*ratchetKEMRecord, error) {
+	record := &ratchetKEMRecord{}
+	switch err := rm.get(ratchetPairKey(ratchetKEMKey, g, remoteDevice, own.Public, remoteKey), record); err {
+	case nil:
+		return record, nil
+	case datastore.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+}
+
+func (rm *ratchetManager) saveKEMRecord(g *bertytypes.Group, remoteDevice []byte, own *doubleratchet.KeyPair, remoteKey []byte, record *ratchetKEMRecord) error {
+	return rm.put(ratchetPairKey(ratchetKEMKey, g, remoteDevice, own.Public, remoteKey), record)
+}
+
+// sendingKEM returns the KEM shared key to seal a payload for a remote
+// device. The initiator of the session encapsulates a new one for the KEM key
+// of the remote device, the responder waits to receive it.
+func (rm *ratchetManager) sendingKEM(g *bertytypes.Group, ownDevice, remoteDevice []byte, own *ratchetOwnKey, remoteKey, remoteKEMPK []byte) (*ratchetKEMRecord, error) {
+	if len(own.KEMSeed) == 0 {
+		return nil, nil
+	}
+
+	record, err := rm.kemRecord(g, remoteDevice, own.KeyPair, remoteKey)
+	if err != nil || record != nil {
+		return record, err
+	}
+
+	if !rm.hybrid || remoteKEMPK == nil || bytes.Compare(ownDevice, remoteDevice) > 0 {
+		return nil, nil
+	}
+
+	sharedKey, ciphertext, err := kyber.Encapsulate(remoteKEMPK)
+	if err != nil {
+		return nil, err
+	}
+
+	record = &ratchetKEMRecord{Ciphertext: ciphertext, SharedKey: sharedKey}
+	if err := rm.saveKEMRecord(g, remoteDevice, own.KeyPair, remoteKey, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// receivedKEM returns the KEM shared key of a received ciphertext, it is
+// decapsulated unless already known.
+func (rm *ratchetManager) receivedKEM(g *bertytypes.Group, remoteDevice []byte, own *ratchetOwnKey, remoteKey, ciphertext []byte) (*ratchetKEMRecord, error) {
+	record, err := rm.kemRecord(g, remoteDevice, own.KeyPair, remoteKey)
+	if err != nil {
+		return nil, err
+	} else if record != nil && bytes.Equal(record.Ciphertext, ciphertext) {
+		return record, nil
+	}
+
+	if len(own.KEMSeed) == 0 {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("hybrid message without KEM key"))
+	}
+
+	kem, err := kyber.NewDecapsulationKey(own.KEMSeed)
+	if err != nil {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+	}
+
+	sharedKey, err := kem.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+	}
+
+	return &ratchetKEMRecord{Ciphertext: ciphertext, SharedKey: sharedKey}, nil
+}
+
+// session returns the session with a remote device for the given keys, it
+// is created if missing. The KEM shared key is set for the hybrid sessions.
+func (rm *ratchetManager) session(g *bertytypes.Group, ownDevice, remoteDevice []byte, own *doubleratchet.KeyPair, remoteKey []byte, kem *ratchetKEMRecord) (*doubleratchet.Session, error) {
+	record := &ratchetSessionRecord{}
+	switch err := rm.get(ratchetSessionID(g, remoteDevice, own.Public, remoteKey, kem.ciphertext()), record); err {
+	case nil:
+		session, err := doubleratchet.Unmarshal(record.State)
+		if err == nil {
+			return session, nil
+		}
+
+		rm.logger.Warn("unable to restore ratchet session", zap.Error(err))
+	case datastore.ErrNotFound:
+	default:
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	secret, err := ratchetSharedSecret(g, ownDevice, remoteDevice)
+	if err != nil {
+		return nil, err
+	}
+
+	if kem != nil {
+		if secret, err = ratchetHybridSecret(secret, kem.SharedKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return doubleratchet.NewSession(secret, own, remoteKey, bytes.Compare(ownDevice, remoteDevice) < 0)
+}
+
+// sessionRecords returns the sessions using an own key, with a remote device
+// or with every device if nil.
+func (rm *ratchetManager) sessionRecords(g *bertytypes.Group, remoteDevice []byte, ownKey []byte) (map[datastore.Key]*ratchetSessionRecord, error) {
+	prefix := ratchetGroupKey(ratchetSessionKey, g)
+	if remoteDevice != nil {
+		prefix = prefix.ChildString(base64.RawURLEncoding.EncodeToString(remoteDevice))
+	}
+
+	res, err := rm.store.Query(query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	records := map[datastore.Key]*ratchetSessionRecord{}
+	for _, entry := range entries {
+		record := &ratchetSessionRecord{}
+		if err := json.Unmarshal(entry.Value, record); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if bytes.Equal(record.OwnKey, ownKey) {
+			records[datastore.RawKey(entry.Key)] = record
+		}
+	}
+
+	return records, nil
+}
+
+// deleteSessions deletes the sessions with a remote device using an own
+// key, and their KEM shared keys.
+func (rm *ratchetManager) deleteSessions(g *bertytypes.Group, remoteDevice []byte, ownKey []byte) error {
+	records, err := rm.sessionRecords(g, remoteDevice, ownKey)
+	if err != nil {
+		return err
+	}
+
+	for key, record := range records {
+		if err := rm.store.Delete(key); err != nil && err != datastore.ErrNotFound {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		if err := rm.store.Delete(ratchetPairKey(ratchetKEMKey, g, remoteDevice, record.OwnKey, record.RemoteKey)); err != nil && err != datastore.ErrNotFound {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+func (rm *ratchetManager) saveSession(g *bertytypes.Group, remoteDevice []byte, own *doubleratchet.KeyPair, remoteKey []byte, kem *ratchetKEMRecord, session *doubleratchet.Session) error {
+	state, err := session.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return rm.put(ratchetSessionID(g, remoteDevice, own.Public, remoteKey, kem.ciphertext()), &ratchetSessionRecord{OwnKey: own.Public, RemoteKey: remoteKey, State: state})
+}
+
+func (r *ratchetKEMRecord) ciphertext() []byte {
+	if r == nil {
+		return nil
+	}
+
+	return r.Ciphertext
+}
+
+// seal seals a payload for the other devices of a group given their
+// announced ratchet public key.
+func (rm *ratchetManager) seal(g *bertytypes.Group, recipients map[string][]byte, payload []byte) ([]byte, error) {
+	return rm.sealHybrid(g, recipients, nil, payload)
+}
+
+// sealHybrid seals a payload like seal, the sessions with the devices given
+// a KEM key are hybrid.
+func (rm *ratchetManager) sealHybrid(g *bertytypes.Group, recipients, kemKeys map[string][]byte, payload []byte) ([]byte, error) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	md, err := rm.devKS.MemberDeviceForGroup(g)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	ownDevice, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	own, err := rm.ownKey(g)
+	if err != nil {
+		return nil, err
+	}
+
+	selfID, self, err := rm.newSelfKey(g)
+	if err != nil {
+		return nil, err
+	}
+
+	var contentKey [32]byte
+	if _, err := io.ReadFull(crand.Reader, contentKey[:]); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	env := &ratchetEnvelope{SelfID: selfID}
+	if env.Ciphertext, err = sealRatchetSecret(&contentKey, payload); err != nil {
+		return nil, err
+	}
+
+	if env.Self, err = sealRatchetSecret(self, contentKey[:]); err != nil {
+		return nil, err
+	}
+
+	for device, remoteKey := range recipients {
+		remoteDevice := []byte(device)
+
+		kem, err := rm.sendingKEM(g, ownDevice, remoteDevice, own, remoteKey, kemKeys[device])
+		if err != nil {
+			return nil, err
+		}
+
+		session, err := rm.session(g, ownDevice, remoteDevice, own.KeyPair, remoteKey, kem)
+		if err != nil {
+			return nil, err
+		}
+
+		header, sealed, err := session.Encrypt(contentKey[:], ratchetAssociatedData(g, ownDevice, remoteDevice))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := rm.saveSession(g, remoteDevice, own.KeyPair, remoteKey, kem, session); err != nil {
+			return nil, err
+		}
+
+		env.Recipients = append(env.Recipients, &ratchetRecipient{
+			DevicePK:      remoteDevice,
+			SenderKey:     own.KeyPair.Public,
+			RecipientKey:  remoteKey,
+			Header:        header.Marshal(),
+			Key:           sealed,
+			KEMCiphertext: kem.ciphertext(),
+		})
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return append(append([]byte(nil), ratchetPayloadPrefix...), data...), nil
+}
+
+// open opens a sealed payload, the content key of each message is kept so it
+// can be opened again later.
+func (rm *ratchetManager) open(g *bertytypes.Group, headers *bertytypes.MessageHeaders, id cid.Cid, payload []byte) ([]byte, error) {
+	env := &ratchetEnvelope{}
+	if err := json.Unmarshal(payload[len(ratchetPayloadPrefix):], env); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	contentKey, err := rm.contentKey(g, headers, id, env)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	copy(key[:], contentKey)
+
+	return openRatchetSecret(&key, env.Ciphertext)
+}
+
+func (rm *ratchetManager) contentKey(g *bertytypes.Group, headers *bertytypes.MessageHeaders, id cid.Cid, env *ratchetEnvelope) ([]byte, error) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	if id.Defined() {
+		if contentKey, err := rm.store.Get(ratchetCIDKey.ChildString(id.String())); err == nil {
+			return contentKey, nil
+		}
+	}
+
+	md, err := rm.devKS.MemberDeviceForGroup(g)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	ownDevice, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if bytes.Equal(headers.DevicePK, ownDevice) {
+		return rm.openSelf(g, id, env)
+	}
+
+	var recipient *ratchetRecipient
+	for _, r := range env.Recipients {
+		if bytes.Equal(r.DevicePK, ownDevice) {
+			recipient = r
+			break
+		}
+	}
+
+	if recipient == nil {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("message not sealed for this device"))
+	}
+
+	current, err := rm.ownKey(g)
+	if err != nil {
+		return nil, err
+	}
+
+	// the messages sealed for a previous key are opened while the session of
+	// their device uses it
+	own, previous := current, (*ratchetPreviousKey)(nil)
+	if !bytes.Equal(recipient.RecipientKey, current.KeyPair.Public) {
+		if previous, err = rm.previousKey(g, recipient.RecipientKey); err != nil {
+			return nil, err
+		}
+
+		if previous == nil || !previous.hasDevice(headers.DevicePK) {
+			return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("message sealed for a previous ratchet key"))
+		}
+
+		own = &previous.ratchetOwnKey
+	}
+
+	header, err := doubleratchet.UnmarshalHeader(recipient.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	var kem *ratchetKEMRecord
+	if len(recipient.KEMCiphertext) > 0 {
+		if kem, err = rm.receivedKEM(g, headers.DevicePK, own, recipient.SenderKey, recipient.KEMCiphertext); err != nil {
+			return nil, err
+		}
+	}
+
+	session, err := rm.session(g, ownDevice, headers.DevicePK, own.KeyPair, recipient.SenderKey, kem)
+	if err != nil {
+		return nil, err
+	}
+
+	contentKey, err := session.Decrypt(header, recipient.Key, ratchetAssociatedData(g, headers.DevicePK, ownDevice))
+	if err != nil {
+		// only a session using the current key is reset, the one using a
+		// previous key is released once its device uses the current key
+		if previous == nil {
+			rm.reset(g, current, headers.DevicePK)
+		}
+
+		return nil, err
+	}
+
+	if err := rm.saveSession(g, headers.DevicePK, own.KeyPair, recipient.SenderKey, kem, session); err != nil {
+		return nil, err
+	}
+
+	// the responder of a hybrid session uses it to reply once it opened a
+	// message of the initiator
+	if kem != nil && bytes.Compare(headers.DevicePK, ownDevice) < 0 {
+		if err := rm.saveKEMRecord(g, headers.DevicePK, own.KeyPair, recipient.SenderKey, kem); err != nil {
+			return nil, err
+		}
+	}
+
+	// the device uses the current key, its sessions using the previous ones
+	// are replaced
+	if previous == nil {
+		if err := rm.releasePreviousKeys(g, headers.DevicePK); err != nil {
+			return nil, err
+		}
+	}
+
+	if id.Defined() {
+		if err := rm.store.Put(ratchetCIDKey.ChildString(id.String()), contentKey); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return contentKey, nil
+}
+
+// forget deletes the content key kept for a message.
+func (rm *ratchetManager) forget(id cid.Cid) error {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	if err := rm.store.Delete(ratchetCIDKey.ChildString(id.String())); err != nil && err != datastore.ErrNotFound {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// reset resets the session with a remote device by renewing the ratchet key
+// of the device, the sessions of the other devices use the previous key until
+// they learn the new one.
+func (rm *ratchetManager) reset(g *bertytypes.Group, own *ratchetOwnKey, remoteDevice []byte) {
+	if _, err := rm.rotateOwnKey(g, own, remoteDevice); err != nil {
+		rm.logger.Error("unable to reset ratchet key", zap.Error(err))
+		return
+	}
+
+	rm.logger.Warn("ratchet session reset", zap.Uint64("epoch", own.Epoch+1))
+
+	if rm.announce != nil {
+		go rm.announce(g)
+	}
+}
+
+func (m *metadataStoreIndex) handleRatchetKey(event proto.Message) error {
+	e, ok := event.(*bertytypes.AppMetadata)
+	if !ok {
+		return errcode.ErrInvalidInput
+	}
+
+	if m.g.GroupType != bertytypes.GroupTypeContact {
+		return nil
+	}
+
+	announce := &ratchetKeyAnnounce{}
+	if err := json.Unmarshal(e.Message, announce); err != nil || announce.Type != ratchetKeyPayloadType {
+		// not a ratchet key
+		return nil
+	}
+
+	// the app metadata are signed by the device
+	if !bytes.Equal(announce.DevicePK, e.DevicePK) || len(announce.RatchetPK) != doubleratchet.KeySize {
+		return errcode.ErrInvalidInput
+	}
+
+	if announce.hasCapability(ratchetCapabilityHybridKEM) && len(announce.KEMPK) != kyber.EncapsulationKeySize {
+		return errcode.ErrInvalidInput
+	}
+
+	if known, ok := m.ratchetKeys[string(announce.DevicePK)]; ok && known.Epoch > announce.Epoch {
+		return nil
+	}
+
+	m.ratchetKeys[string(announce.DevicePK)] = announce
+
+	return nil
+}
+
+func (m *metadataStoreIndex) ratchetKey(devicePK []byte) *ratchetKeyAnnounce {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.ratchetKeys[string(devicePK)]
+}
+
+// ratchetRecipients returns the announced ratchet keys of the other devices
+// of the group, or errRatchetUnavailable if one of them is unknown.
+func (m *metadataStore) ratchetRecipients(ownDevice crypto.PubKey) (map[string][]byte, error) {
+	index := m.Index().(*metadataStoreIndex)
+	recipients := map[string][]byte{}
+
+	for _, device := range m.ListDevices() {
+		if device.Equals(ownDevice) {
+			continue
+		}
+
+		raw, err := device.Raw()
+		if err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+
+		announce := index.ratchetKey(raw)
+		if announce == nil {
+			return nil, errRatchetUnavailable
+		}
+
+		recipients[string(raw)] = announce.RatchetPK
+	}
+
+	if len(recipients) == 0 {
+		return nil, errRatchetUnavailable
+	}
+
+	return recipients, nil
+}
+
+// ratchetKEMKeys returns the KEM keys of the recipients announcing the hybrid
+// sessions.
+func (m *metadataStore) ratchetKEMKeys(recipients map[string][]byte) map[string][]byte {
+	index := m.Index().(*metadataStoreIndex)
+	kemKeys := map[string][]byte{}
+
+	for device, ratchetPK := range recipients {
+		announce := index.ratchetKey([]byte(device))
+		if announce != nil && bytes.Equal(announce.RatchetPK, ratchetPK) && announce.hasCapability(ratchetCapabilityHybridKEM) {
+			kemKeys[device] = announce.KEMPK
+		}
+	}
+
+	return kemKeys
+}
+
+// sealRatchetPayload seals the payload of a contact group message, the
+// payload is left as is while a device of the group didn't announce its
+// ratchet key.
+func (s *service) sealRatchetPayload(gc *groupContext, payload []byte) ([]byte, error) {
+	if s.disableRatchet || s.odb.ratchets == nil || gc.Group().GroupType != bertytypes.GroupTypeContact {
+		return payload, nil
+	}
+
+	recipients, err := gc.MetadataStore().ratchetRecipients(gc.DevicePubKey())
+	if err == errRatchetUnavailable {
+		return payload, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s.odb.ratchets.sealHybrid(gc.Group(), recipients, gc.MetadataStore().ratchetKEMKeys(recipients), payload)
+}
+
+// announceRatchetKey announces the ratchet key of the device in a contact
+// group unless already known by the group.
+func (s *service) announceRatchetKey(g *bertytypes.Group) {
+	gc, err := s.getContextGroupForID(g.PublicKey)
+	if err != nil {
+		return
+	}
+
+	s.odb.ratchets.lock.Lock()
+	own, err := s.odb.ratchets.ownKey(g)
+	s.odb.ratchets.lock.Unlock()
+	if err != nil {
+		s.logger.Warn("unable to get ratchet key", zap.Error(err))
+		return
+	}
+
+	devicePK, err := gc.DevicePubKey().Raw()
+	if err != nil {
+		return
+	}
+
+	announce := &ratchetKeyAnnounce{
+		Type:      ratchetKeyPayloadType,
+		DevicePK:  devicePK,
+		RatchetPK: own.KeyPair.Public,
+		Epoch:     own.Epoch,
+	}
+
+	if s.odb.ratchets.hybrid && len(own.KEMSeed) > 0 {
+		kem, err := kyber.NewDecapsulationKey(own.KEMSeed)
+		if err != nil {
+			s.logger.Warn("unable to get ratchet KEM key", zap.Error(err))
+			return
+		}
+
+		announce.Capabilities = []string{ratchetCapabilityHybridKEM}
+		announce.KEMPK = kem.EncapsulationKey()
+	}
+
+	known := gc.MetadataStore().Index().(*metadataStoreIndex).ratchetKey(devicePK)
+	if known != nil && bytes.Equal(known.RatchetPK, announce.RatchetPK) && known.hasCapability(ratchetCapabilityHybridKEM) == announce.hasCapability(ratchetCapabilityHybridKEM) {
+		return
+	}
+
+	payload, err := json.Marshal(announce)
+	if err != nil {
+		return
+	}
+
+	if _, err := gc.MetadataStore().SendAppMetadata(s.ctx, payload); err != nil {
+		s.logger.Warn("unable to announce ratchet key", zap.Error(err))
+	}
+}
@@ -0,0 +1,261 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"berty.tech/berty/v2/go/internal/kyber"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type testRatchetDevice struct {
+	rm       *ratchetManager
+	devicePK []byte
+}
+
+func newTestRatchetDevice(t *testing.T, g *bertytypes.Group) *testRatchetDevice {
+	t.Helper()
+
+	devKS := NewDeviceKeystore(keystore.NewMemKeystore())
+	md, err := devKS.MemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	devicePK, err := md.device.GetPublic().Raw()
+	require.NoError(t, err)
+
+	return &testRatchetDevice{
+		rm:       newRatchetManager(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), devKS),
+		devicePK: devicePK,
+	}
+}
+
+func (d *testRatchetDevice) ratchetPK(t *testing.T, g *bertytypes.Group) []byte {
+	t.Helper()
+
+	own, err := d.rm.ownKey(g)
+	require.NoError(t, err)
+
+	return own.KeyPair.Public
+}
+
+func TestRatchetManager(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	alice, bob := newTestRatchetDevice(t, g), newTestRatchetDevice(t, g)
+
+	announced := make(chan struct{}, 1)
+	bob.rm.announce = func(*bertytypes.Group) { announced <- struct{}{} }
+
+	sealed, err := alice.rm.seal(g, map[string][]byte{string(bob.devicePK): bob.ratchetPK(t, g)}, []byte("hello"))
+	require.NoError(t, err)
+	assert.True(t, isRatchetPayload(sealed))
+
+	id, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(sealed)
+	require.NoError(t, err)
+
+	payload, err := bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, id, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), payload)
+
+	// the key of an opened message is kept
+	payload, err = bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, id, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), payload)
+
+	// the own messages can be opened too
+	payload, err = alice.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, cid.Undef, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), payload)
+
+	reply, err := bob.rm.seal(g, map[string][]byte{string(alice.devicePK): alice.ratchetPK(t, g)}, []byte("world"))
+	require.NoError(t, err)
+
+	payload, err = alice.rm.open(g, &bertytypes.MessageHeaders{DevicePK: bob.devicePK}, cid.Undef, reply)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("world"), payload)
+
+	// a message which can't be opened resets the session
+	previousPK := bob.ratchetPK(t, g)
+	sealed, err = alice.rm.seal(g, map[string][]byte{string(bob.devicePK): previousPK}, []byte("replayed"))
+	require.NoError(t, err)
+
+	_, err = bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, cid.Undef, sealed)
+	require.NoError(t, err)
+
+	_, err = bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, cid.Undef, sealed)
+	require.Error(t, err)
+	<-announced
+
+	assert.NotEqual(t, previousPK, bob.ratchetPK(t, g))
+
+	// the messages sealed for the previous key are refused
+	sealed, err = alice.rm.seal(g, map[string][]byte{string(bob.devicePK): previousPK}, []byte("stale"))
+	require.NoError(t, err)
+
+	_, err = bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, cid.Undef, sealed)
+	require.Error(t, err)
+
+	// a new session is used once the new key is known
+	sealed, err = alice.rm.seal(g, map[string][]byte{string(bob.devicePK): bob.ratchetPK(t, g)}, []byte("after reset"))
+	require.NoError(t, err)
+
+	payload, err = bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, cid.Undef, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("after reset"), payload)
+}
+
+func TestRatchetManagerResetOneSession(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	alice, bob, carol := newTestRatchetDevice(t, g), newTestRatchetDevice(t, g), newTestRatchetDevice(t, g)
+	bob.rm.announce = func(*bertytypes.Group) {}
+
+	send := func(from *testRatchetDevice, bobPK []byte, payload string) ([]byte, error) {
+		sealed, err := from.rm.seal(g, map[string][]byte{string(bob.devicePK): bobPK}, []byte(payload))
+		require.NoError(t, err)
+
+		return bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: from.devicePK}, cid.Undef, sealed)
+	}
+
+	previousPK := bob.ratchetPK(t, g)
+
+	_, err = send(alice, previousPK, "hello from alice")
+	require.NoError(t, err)
+	_, err = send(carol, previousPK, "hello from carol")
+	require.NoError(t, err)
+
+	// the session with alice fails, bob announces a new key
+	sealed, err := alice.rm.seal(g, map[string][]byte{string(bob.devicePK): previousPK}, []byte("replayed"))
+	require.NoError(t, err)
+
+	_, err = bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, cid.Undef, sealed)
+	require.NoError(t, err)
+	_, err = bob.rm.open(g, &bertytypes.MessageHeaders{DevicePK: alice.devicePK}, cid.Undef, sealed)
+	require.Error(t, err)
+
+	currentPK := bob.ratchetPK(t, g)
+	require.NotEqual(t, previousPK, currentPK)
+
+	// the session with carol still uses the previous key, the one with alice
+	// is reset
+	payload, err := send(carol, previousPK, "still there")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("still there"), payload)
+
+	_, err = send(alice, previousPK, "stale")
+	require.Error(t, err)
+
+	// the previous key is kept until carol uses the new one
+	previous, err := bob.rm.previousKey(g, previousPK)
+	require.NoError(t, err)
+	require.NotNil(t, previous)
+	assert.Equal(t, [][]byte{carol.devicePK}, previous.Devices)
+
+	payload, err = send(carol, currentPK, "new key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new key"), payload)
+
+	previous, err = bob.rm.previousKey(g, previousPK)
+	require.NoError(t, err)
+	assert.Nil(t, previous)
+
+	_, err = send(carol, previousPK, "late")
+	require.Error(t, err)
+
+	payload, err = send(alice, currentPK, "after reset")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("after reset"), payload)
+}
+
+func (d *testRatchetDevice) kemPK(t *testing.T, g *bertytypes.Group) []byte {
+	t.Helper()
+
+	own, err := d.rm.ownKey(g)
+	require.NoError(t, err)
+
+	kem, err := kyber.NewDecapsulationKey(own.KEMSeed)
+	require.NoError(t, err)
+
+	return kem.EncapsulationKey()
+}
+
+func testRatchetKEMCiphertext(t *testing.T, sealed []byte) []byte {
+	t.Helper()
+
+	env := &ratchetEnvelope{}
+	require.NoError(t, json.Unmarshal(sealed[len(ratchetPayloadPrefix):], env))
+	require.Len(t, env.Recipients, 1)
+
+	return env.Recipients[0].KEMCiphertext
+}
+
+func TestRatchetManagerHybrid(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	initiator, responder := newTestRatchetDevice(t, g), newTestRatchetDevice(t, g)
+	if bytes.Compare(initiator.devicePK, responder.devicePK) > 0 {
+		initiator, responder = responder, initiator
+	}
+
+	initiator.rm.hybrid, responder.rm.hybrid = true, true
+
+	toInitiator := func(payload string) []byte {
+		sealed, err := responder.rm.sealHybrid(g,
+			map[string][]byte{string(initiator.devicePK): initiator.ratchetPK(t, g)},
+			map[string][]byte{string(initiator.devicePK): initiator.kemPK(t, g)},
+			[]byte(payload))
+		require.NoError(t, err)
+
+		opened, err := initiator.rm.open(g, &bertytypes.MessageHeaders{DevicePK: responder.devicePK}, cid.Undef, sealed)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(payload), opened)
+
+		return sealed
+	}
+
+	toResponder := func(payload string) []byte {
+		sealed, err := initiator.rm.sealHybrid(g,
+			map[string][]byte{string(responder.devicePK): responder.ratchetPK(t, g)},
+			map[string][]byte{string(responder.devicePK): responder.kemPK(t, g)},
+			[]byte(payload))
+		require.NoError(t, err)
+
+		opened, err := responder.rm.open(g, &bertytypes.MessageHeaders{DevicePK: initiator.devicePK}, cid.Undef, sealed)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(payload), opened)
+
+		return sealed
+	}
+
+	// the responder waits for the KEM ciphertext of the initiator
+	assert.Empty(t, testRatchetKEMCiphertext(t, toInitiator("classical")))
+
+	ciphertext := testRatchetKEMCiphertext(t, toResponder("hybrid"))
+	assert.Len(t, ciphertext, kyber.CiphertextSize)
+
+	// both devices then use the same hybrid session
+	assert.Equal(t, ciphertext, testRatchetKEMCiphertext(t, toInitiator("hybrid reply")))
+	assert.Equal(t, ciphertext, testRatchetKEMCiphertext(t, toResponder("hybrid again")))
+
+	// the devices not announcing the hybrid sessions keep the classical ones
+	legacy := newTestRatchetDevice(t, g)
+	sealed, err := initiator.rm.sealHybrid(g, map[string][]byte{string(legacy.devicePK): legacy.ratchetPK(t, g)}, map[string][]byte{}, []byte("legacy"))
+	require.NoError(t, err)
+	assert.Empty(t, testRatchetKEMCiphertext(t, sealed))
+
+	payload, err := legacy.rm.open(g, &bertytypes.MessageHeaders{DevicePK: initiator.devicePK}, cid.Undef, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("legacy"), payload)
+}
@@ -0,0 +1,419 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+const (
+	reactionPayloadPrefix = "\x00berty.reaction/1\x00"
+
+	// ReactionsPayloadType is the type of the JSON payload replacing the
+	// reactions in the message lists and subscriptions, it carries all the
+	// reactions of the message.
+	ReactionsPayloadType = "MessageReactions"
+
+	maxReactionSize = 32
+)
+
+var messageReactionsKey = datastore.NewKey("reactions")
+
+// MessageReaction lists the members which reacted to a message with an
+// emoji.
+type MessageReaction struct {
+	Emoji   string   `json:"emoji"`
+	Members [][]byte `json:"members"`
+}
+
+// EvtMessageReactionsChanged is emitted on the event bus of the host when a
+// member adds or removes a reaction.
+type EvtMessageReactionsChanged struct {
+	GroupPK   []byte
+	MessageID []byte
+	Reactions []*MessageReaction
+}
+
+// reactionsPayload is the payload sent to the clients in place of a
+// reaction.
+type reactionsPayload struct {
+	Type      string             `json:"type"`
+	MessageID []byte             `json:"messageId"`
+	Reactions []*MessageReaction `json:"reactions"`
+}
+
+// reactionOp is sent as a message of the group.
+type reactionOp struct {
+	GroupPK   []byte `json:"group_pk"`
+	MessageID []byte `json:"message_id"`
+	DevicePK  []byte `json:"device_pk"`
+	Emoji     string `json:"emoji"`
+	Add       bool   `json:"add"`
+	At        int64  `json:"at"`
+	Sig       []byte `json:"sig"`
+}
+
+func (r *reactionOp) signedBytes() []byte {
+	buf := make([]byte, 9)
+	binary.BigEndian.PutUint64(buf, uint64(r.At))
+	if r.Add {
+		buf[8] = 1
+	}
+
+	return bytes.Join([][]byte{[]byte("berty reaction"), r.GroupPK, r.MessageID, buf, []byte(r.Emoji)}, nil)
+}
+
+func isReactionPayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(reactionPayloadPrefix))
+}
+
+func unmarshalReaction(payload []byte) (*reactionOp, error) {
+	if !isReactionPayload(payload) {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	r := &reactionOp{}
+	if err := json.Unmarshal(payload[len(reactionPayloadPrefix):], r); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if !validReaction(r.Emoji) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid reaction"))
+	}
+
+	return r, nil
+}
+
+func validReaction(emoji string) bool {
+	return emoji != "" && len(emoji) <= maxReactionSize && utf8.ValidString(emoji)
+}
+
+// reactionRecord is the last operation of a member for an emoji, the
+// operations of all its devices are merged by time, then by ID.
+type reactionRecord struct {
+	Add bool   `json:"add"`
+	At  int64  `json:"at"`
+	ID  []byte `json:"id"`
+}
+
+func (r *reactionRecord) after(other *reactionRecord) bool {
+	if r.At != other.At {
+		return r.At > other.At
+	}
+
+	return bytes.Compare(r.ID, other.ID) > 0
+}
+
+// messageReactions aggregates the reactions of the messages, by member and
+// emoji.
+type messageReactions struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+	lock    sync.Mutex
+}
+
+func newMessageReactions(logger *zap.Logger, store datastore.Batching, h host.Host) (*messageReactions, error) {
+	mr := &messageReactions{
+		logger: logger,
+		store:  store,
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtMessageReactionsChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		mr.emitter = emitter
+	}
+
+	return mr, nil
+}
+
+// merge applies an operation of a member, it reports whether the reactions
+// of the message changed.
+func (mr *messageReactions) merge(groupPK, messageID, memberPK []byte, emoji string, rec *reactionRecord) (bool, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	key := retractionKey(messageReactionsKey, groupPK, messageID).
+		ChildString(base64.RawURLEncoding.EncodeToString(memberPK)).
+		ChildString(base64.RawURLEncoding.EncodeToString([]byte(emoji)))
+
+	current := &reactionRecord{}
+	data, err := mr.store.Get(key)
+	switch err {
+	case nil:
+		if err := json.Unmarshal(data, current); err != nil {
+			return false, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if !rec.after(current) {
+			return false, nil
+		}
+	case datastore.ErrNotFound:
+	default:
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if data, err = json.Marshal(rec); err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := mr.store.Put(key, data); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	return current.Add != rec.Add, nil
+}
+
+// list returns the reactions of a message, by emoji.
+func (mr *messageReactions) list(groupPK, messageID []byte) ([]*MessageReaction, error) {
+	res, err := mr.store.Query(query.Query{Prefix: retractionKey(messageReactionsKey, groupPK, messageID).String()})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	byEmoji := map[string]*MessageReaction{}
+	for _, entry := range entries {
+		key := datastore.RawKey(entry.Key)
+
+		emoji, err := base64.RawURLEncoding.DecodeString(key.BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		memberPK, err := base64.RawURLEncoding.DecodeString(key.Parent().BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		rec := &reactionRecord{}
+		if err := json.Unmarshal(entry.Value, rec); err != nil || !rec.Add {
+			continue
+		}
+
+		reaction, ok := byEmoji[string(emoji)]
+		if !ok {
+			reaction = &MessageReaction{Emoji: string(emoji)}
+			byEmoji[string(emoji)] = reaction
+		}
+
+		reaction.Members = append(reaction.Members, memberPK)
+	}
+
+	reactions := make([]*MessageReaction, 0, len(byEmoji))
+	for _, reaction := range byEmoji {
+		sort.Slice(reaction.Members, func(i, j int) bool { return bytes.Compare(reaction.Members[i], reaction.Members[j]) < 0 })
+		reactions = append(reactions, reaction)
+	}
+
+	sort.Slice(reactions, func(i, j int) bool {
+		if len(reactions[i].Members) != len(reactions[j].Members) {
+			return len(reactions[i].Members) > len(reactions[j].Members)
+		}
+
+		return reactions[i].Emoji < reactions[j].Emoji
+	})
+
+	return reactions, nil
+}
+
+// forget deletes the reactions to a message.
+func (mr *messageReactions) forget(groupPK, messageID []byte) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	res, err := mr.store.Query(query.Query{Prefix: retractionKey(messageReactionsKey, groupPK, messageID).String(), KeysOnly: true})
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		if err := mr.store.Delete(datastore.RawKey(entry.Key)); err != nil && err != datastore.ErrNotFound {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+func (mr *messageReactions) emit(groupPK, messageID []byte) {
+	if mr.emitter == nil {
+		return
+	}
+
+	reactions, err := mr.list(groupPK, messageID)
+	if err != nil {
+		mr.logger.Warn("unable to list reactions", zap.Error(err))
+		return
+	}
+
+	if err := mr.emitter.Emit(EvtMessageReactionsChanged{GroupPK: groupPK, MessageID: messageID, Reactions: reactions}); err != nil {
+		mr.logger.Warn("unable to emit reactions changed event", zap.Error(err))
+	}
+}
+
+// MessageReact adds or removes a reaction of the member to a message of a
+// group.
+func (s *service) MessageReact(ctx context.Context, groupPK []byte, messageID []byte, emoji string, add bool) error {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return errcode.ErrInvalidInput
+	}
+
+	if !validReaction(emoji) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid reaction"))
+	}
+
+	if tombstone, err := s.retractions.tombstone(groupPK, messageID); err != nil {
+		return err
+	} else if tombstone != nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("message retracted"))
+	}
+
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	devicePK, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	op := &reactionOp{GroupPK: groupPK, MessageID: messageID, DevicePK: devicePK, Emoji: emoji, Add: add, At: time.Now().UnixNano()}
+	if op.Sig, err = md.device.Sign(op.signedBytes()); err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	data, err := json.Marshal(op)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return s.sendControlMessage(ctx, gc, append([]byte(reactionPayloadPrefix), data...))
+}
+
+// MessageReactions returns the reactions to a message, the most used first.
+func (s *service) MessageReactions(_ context.Context, groupPK []byte, messageID []byte) ([]*MessageReaction, error) {
+	return s.reactions.list(groupPK, messageID)
+}
+
+// applyReaction merges a reaction received in a group, it must be signed by
+// a current device of the group.
+func (s *service) applyReaction(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*reactionOp, error) {
+	op, err := unmarshalReaction(evt.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(op.GroupPK, gc.Group().PublicKey) || !bytes.Equal(op.DevicePK, evt.Headers.DevicePK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("reaction not sent by its signer"))
+	}
+
+	if !gc.MetadataStore().isCurrentDevice(op.DevicePK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("not a member of the group anymore"))
+	}
+
+	pk, memberPK, err := deviceMember(gc, op.DevicePK)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := pk.Verify(op.signedBytes(), op.Sig); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification
+	}
+
+	if s.ephemeral.isExpired(op.GroupPK, op.MessageID) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("message expired"))
+	}
+
+	changed, err := s.reactions.merge(op.GroupPK, op.MessageID, memberPK, op.Emoji, &reactionRecord{Add: op.Add, At: op.At, ID: evt.EventContext.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		s.reactions.emit(op.GroupPK, op.MessageID)
+	}
+
+	return op, nil
+}
+
+// trackReaction is called for each message of a group, it reports whether
+// the message is a reaction.
+func (s *service) trackReaction(gc *groupContext, evt *bertytypes.GroupMessageEvent) bool {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil || !isReactionPayload(evt.Message) {
+		return false
+	}
+
+	if _, err := s.applyReaction(gc, evt); err != nil {
+		s.logger.Debug("invalid reaction", zap.Error(err))
+	}
+
+	return true
+}
+
+// renderReaction replaces the payload of a reaction with the reactions of
+// its message.
+func (s *service) renderReaction(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*bertytypes.GroupMessageEvent, bool) {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil || !isReactionPayload(evt.Message) {
+		return evt, true
+	}
+
+	// the reaction may not be merged yet
+	op, err := s.applyReaction(gc, evt)
+	if err != nil {
+		return evt, false
+	}
+
+	if tombstone, err := s.retractions.tombstone(op.GroupPK, op.MessageID); err != nil || tombstone != nil {
+		return evt, false
+	}
+
+	reactions, err := s.reactions.list(op.GroupPK, op.MessageID)
+	if err != nil {
+		return evt, false
+	}
+
+	payload, err := json.Marshal(&reactionsPayload{Type: ReactionsPayloadType, MessageID: op.MessageID, Reactions: reactions})
+	if err != nil {
+		return evt, false
+	}
+
+	rendered := *evt
+	rendered.Message = payload
+
+	return &rendered, true
+}
@@ -0,0 +1,52 @@
+package bertyprotocol
+
+import (
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMessageReactions(t *testing.T) {
+	reactions, err := newMessageReactions(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	groupPK, messageID, alice, bob := []byte("group"), []byte("message"), []byte("alice"), []byte("bob")
+
+	merge := func(memberPK []byte, emoji string, add bool, at int64, id string) bool {
+		changed, err := reactions.merge(groupPK, messageID, memberPK, emoji, &reactionRecord{Add: add, At: at, ID: []byte(id)})
+		require.NoError(t, err)
+		return changed
+	}
+
+	assert.True(t, merge(alice, "👍", true, 1, "a1"))
+	assert.True(t, merge(bob, "👍", true, 2, "b1"))
+	assert.True(t, merge(bob, "🎉", true, 3, "b2"))
+
+	// the operations of the devices of a member are merged by time, the
+	// older ones are ignored whatever their order
+	assert.True(t, merge(alice, "👍", false, 5, "a3"))
+	assert.False(t, merge(alice, "👍", true, 4, "a2"))
+	assert.False(t, merge(alice, "👍", false, 5, "a3"))
+
+	list, err := reactions.list(groupPK, messageID)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "🎉", list[0].Emoji)
+	assert.Equal(t, [][]byte{bob}, list[0].Members)
+	assert.Equal(t, [][]byte{bob}, list[1].Members)
+
+	// same time, the highest ID wins
+	assert.True(t, merge(alice, "🎉", true, 6, "a5"))
+	assert.True(t, merge(alice, "🎉", false, 6, "a6"))
+	assert.False(t, merge(alice, "🎉", true, 6, "a4"))
+
+	list, err = reactions.list(groupPK, messageID)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Len(t, list[0].Members, 1)
+	assert.Len(t, list[1].Members, 1)
+}
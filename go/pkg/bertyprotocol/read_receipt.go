@@ -0,0 +1,156 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/base64"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+)
+
+var (
+	unreadMessagesKey = datastore.NewKey("unread")
+	readReceiptsKey   = datastore.NewKey("settings/readReceipts")
+)
+
+func unreadGroupKey(groupPK []byte) datastore.Key {
+	return unreadMessagesKey.ChildString(base64.RawURLEncoding.EncodeToString(groupPK))
+}
+
+func readReceiptsSettingKey(groupPK []byte) datastore.Key {
+	if len(groupPK) == 0 {
+		return readReceiptsKey
+	}
+
+	return readReceiptsKey.ChildString(base64.RawURLEncoding.EncodeToString(groupPK))
+}
+
+// received records a message of another device, unread until its
+// conversation is marked read.
+func (t *deliveryTracker) received(groupPK, messageID []byte) error {
+	key := unreadGroupKey(groupPK).ChildString(base64.RawURLEncoding.EncodeToString(messageID))
+	if err := t.store.Put(key, []byte{}); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// takeUnread returns and forgets the unread messages of a group.
+func (t *deliveryTracker) takeUnread(groupPK []byte) ([][]byte, error) {
+	t.muRecords.Lock()
+	defer t.muRecords.Unlock()
+
+	res, err := t.store.Query(query.Query{Prefix: unreadGroupKey(groupPK).String(), KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	messageIDs := [][]byte{}
+	for _, entry := range entries {
+		key := datastore.RawKey(entry.Key)
+		if messageID, err := base64.RawURLEncoding.DecodeString(key.BaseNamespace()); err == nil {
+			messageIDs = append(messageIDs, messageID)
+		}
+
+		if err := t.store.Delete(key); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return messageIDs, nil
+}
+
+func (t *deliveryTracker) setReadReceipts(groupPK []byte, enabled bool) error {
+	value := []byte("false")
+	if enabled {
+		value = []byte("true")
+	}
+
+	if err := t.store.Put(readReceiptsSettingKey(groupPK), value); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// readReceiptsEnabled returns the effective setting of a conversation, the
+// receipts are sent unless disabled globally or for the conversation.
+func (t *deliveryTracker) readReceiptsEnabled(groupPK []byte) (bool, error) {
+	keys := []datastore.Key{readReceiptsSettingKey(nil)}
+	if len(groupPK) > 0 {
+		keys = append(keys, readReceiptsSettingKey(groupPK))
+	}
+
+	for _, key := range keys {
+		value, err := t.store.Get(key)
+		switch err {
+		case nil:
+			if string(value) == "false" {
+				return false, nil
+			}
+		case datastore.ErrNotFound:
+		default:
+			return false, errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return true, nil
+}
+
+// ConversationMarkRead marks the messages received in a conversation as read,
+// a read receipt is sent to their senders unless disabled.
+func (s *service) ConversationMarkRead(ctx context.Context, groupPK []byte) error {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return errcode.ErrInvalidInput
+	}
+
+	messageIDs, err := s.deliveries.takeUnread(groupPK)
+	if err != nil {
+		return err
+	}
+
+	enabled, err := s.deliveries.readReceiptsEnabled(groupPK)
+	if err != nil || !enabled || len(messageIDs) == 0 {
+		return err
+	}
+
+	for _, messageID := range messageIDs {
+		ack, err := s.signDeliveryAck(gc.Group(), ackRead, messageID)
+		if err != nil {
+			s.logger.Warn("unable to sign read receipt", zap.Error(err))
+			continue
+		}
+
+		s.deliveries.queue(ack)
+	}
+
+	s.flushDeliveryAcks(groupPK)
+
+	return nil
+}
+
+// ReadReceiptsSet enables or disables the read receipts of a conversation,
+// or of every conversation if no group is given.
+func (s *service) ReadReceiptsSet(_ context.Context, groupPK []byte, enabled bool) error {
+	return s.deliveries.setReadReceipts(groupPK, enabled)
+}
+
+// ReadReceiptsEnabled returns whether the read receipts of a conversation are
+// sent, or the global setting if no group is given.
+func (s *service) ReadReceiptsEnabled(_ context.Context, groupPK []byte) (bool, error) {
+	return s.deliveries.readReceiptsEnabled(groupPK)
+}
@@ -0,0 +1,107 @@
+package bertyprotocol
+
+import (
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// The network types of the ResourceHints.
+const (
+	NetworkTypeUnknown  = ""
+	NetworkTypeWiFi     = "wifi"
+	NetworkTypeCellular = "cellular"
+	NetworkTypeEthernet = "ethernet"
+	NetworkTypeNone     = "none"
+)
+
+const (
+	// LowBatteryLevel is the battery level, in percent, under which the
+	// node saves the battery while not charging
+	LowBatteryLevel = 15
+
+	// CellularAutoDownloadSize is the size of the largest attachments
+	// downloaded in the background over a cellular network
+	CellularAutoDownloadSize = 1 << 20
+)
+
+// ResourceHints are the constraints of the device reported by the mobile
+// OS, the node adapts its background work to them, see
+// Service.SetResourceHints.
+type ResourceHints struct {
+	// BatteryLevel is in percent, negative if unknown
+	BatteryLevel int    `json:"battery_level"`
+	Charging     bool   `json:"charging"`
+	NetworkType  string `json:"network_type"`
+	DataSaver    bool   `json:"data_saver"`
+}
+
+func (h *ResourceHints) validate() error {
+	if h.BatteryLevel > 100 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid battery level %d", h.BatteryLevel))
+	}
+
+	switch h.NetworkType {
+	case NetworkTypeUnknown, NetworkTypeWiFi, NetworkTypeCellular, NetworkTypeEthernet, NetworkTypeNone:
+		return nil
+	}
+
+	return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown network type %q", h.NetworkType))
+}
+
+// LowBattery returns whether the battery is low and not charging.
+func (h *ResourceHints) LowBattery() bool {
+	return !h.Charging && h.BatteryLevel >= 0 && h.BatteryLevel < LowBatteryLevel
+}
+
+// Metered returns whether the traffic of the device is charged or limited
+// by the user.
+func (h *ResourceHints) Metered() bool {
+	return h.DataSaver || h.NetworkType == NetworkTypeCellular
+}
+
+// AutoDownloadSize returns the size of the largest attachments worth
+// downloading in the background, negative if there is no limit.
+func (h *ResourceHints) AutoDownloadSize() int64 {
+	switch {
+	case h.NetworkType == NetworkTypeNone, h.DataSaver, h.LowBattery():
+		return 0
+	case h.NetworkType == NetworkTypeCellular:
+		return CellularAutoDownloadSize
+	}
+
+	return -1
+}
+
+// SetResourceHints reports the constraints of the device, the attachments
+// over the size returned by ResourceHints.AutoDownloadSize are only fetched
+// when asked.
+func (s *service) SetResourceHints(hints *ResourceHints) error {
+	if err := hints.validate(); err != nil {
+		return err
+	}
+
+	copied := *hints
+
+	s.muResourceHints.Lock()
+	s.resourceHints = &copied
+	s.muResourceHints.Unlock()
+
+	return nil
+}
+
+// AttachmentAutoDownload returns whether an attachment of the given size may
+// be fetched without the user asking for it, given the constraints reported
+// by the device. Streams are given a size of 0.
+func (s *service) AttachmentAutoDownload(size int64) bool {
+	s.muResourceHints.RLock()
+	hints := s.resourceHints
+	s.muResourceHints.RUnlock()
+
+	if hints == nil {
+		return true
+	}
+
+	max := hints.AutoDownloadSize()
+	return max < 0 || (max > 0 && size <= max)
+}
@@ -0,0 +1,44 @@
+package bertyprotocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourceHints(t *testing.T) {
+	for _, tc := range []struct {
+		hints ResourceHints
+		size  int64
+	}{
+		{ResourceHints{BatteryLevel: 80, NetworkType: NetworkTypeWiFi}, -1},
+		{ResourceHints{BatteryLevel: -1, NetworkType: NetworkTypeUnknown}, -1},
+		{ResourceHints{BatteryLevel: 80, NetworkType: NetworkTypeCellular}, CellularAutoDownloadSize},
+		{ResourceHints{BatteryLevel: 80, NetworkType: NetworkTypeWiFi, DataSaver: true}, 0},
+		{ResourceHints{BatteryLevel: 80, NetworkType: NetworkTypeNone}, 0},
+		{ResourceHints{BatteryLevel: 5, NetworkType: NetworkTypeWiFi}, 0},
+		{ResourceHints{BatteryLevel: 5, Charging: true, NetworkType: NetworkTypeWiFi}, -1},
+	} {
+		assert.Equal(t, tc.size, tc.hints.AutoDownloadSize(), "%+v", tc.hints)
+	}
+}
+
+func TestAttachmentAutoDownload(t *testing.T) {
+	s := &service{}
+
+	// nothing is reported yet
+	assert.True(t, s.AttachmentAutoDownload(100<<20))
+
+	require.NoError(t, s.SetResourceHints(&ResourceHints{BatteryLevel: 50, NetworkType: NetworkTypeCellular}))
+	assert.True(t, s.AttachmentAutoDownload(0))
+	assert.True(t, s.AttachmentAutoDownload(CellularAutoDownloadSize))
+	assert.False(t, s.AttachmentAutoDownload(CellularAutoDownloadSize+1))
+
+	require.NoError(t, s.SetResourceHints(&ResourceHints{BatteryLevel: 50, NetworkType: NetworkTypeCellular, DataSaver: true}))
+	assert.False(t, s.AttachmentAutoDownload(0))
+
+	assert.Error(t, s.SetResourceHints(&ResourceHints{BatteryLevel: 101}))
+	assert.Error(t, s.SetResourceHints(&ResourceHints{NetworkType: "5g"}))
+	assert.False(t, s.AttachmentAutoDownload(0))
+}
@@ -0,0 +1,497 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+const (
+	// retractionWindow is how long after a message its author can retract
+	// it, measured between the times both were first seen by the device
+	retractionWindow = 48 * time.Hour
+
+	retractionPayloadPrefix = "\x00berty.retraction/1\x00"
+
+	// TombstonePayloadType is the type of the JSON payload replacing the
+	// retracted messages and the retractions in the message lists and
+	// subscriptions.
+	TombstonePayloadType = "MessageDeleted"
+)
+
+var (
+	retractionSeenKey      = datastore.NewKey("seen")
+	retractionPendingKey   = datastore.NewKey("pending")
+	retractionTombstoneKey = datastore.NewKey("tombstones")
+)
+
+// MessageTombstone replaces a message retracted by its author.
+type MessageTombstone struct {
+	GroupPK     []byte
+	MessageID   []byte
+	DevicePK    []byte
+	RetractedAt time.Time
+}
+
+// EvtMessageRetracted is emitted on the event bus of the host once a message
+// is tombstoned.
+type EvtMessageRetracted struct {
+	Tombstone *MessageTombstone
+}
+
+// tombstonePayload is the payload sent to the clients in place of a
+// retracted message.
+type tombstonePayload struct {
+	Type        string `json:"type"`
+	MessageID   []byte `json:"messageId"`
+	RetractedAt int64  `json:"retractedAt"`
+}
+
+// retraction is sent as a message of the group, so it reaches the devices
+// which received the retracted message.
+type retraction struct {
+	GroupPK   []byte `json:"group_pk"`
+	MessageID []byte `json:"message_id"`
+	DevicePK  []byte `json:"device_pk"`
+	At        int64  `json:"at"`
+	Sig       []byte `json:"sig"`
+}
+
+func (r *retraction) signedBytes() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(r.At))
+
+	return bytes.Join([][]byte{[]byte("berty retraction"), r.GroupPK, r.MessageID, buf}, nil)
+}
+
+func isRetractionPayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(retractionPayloadPrefix))
+}
+
+func unmarshalRetraction(payload []byte) (*retraction, error) {
+	if !isRetractionPayload(payload) {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	r := &retraction{}
+	if err := json.Unmarshal(payload[len(retractionPayloadPrefix):], r); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return r, nil
+}
+
+type seenRecord struct {
+	SeenAt   int64  `json:"seen_at"`
+	MemberPK []byte `json:"member_pk"`
+}
+
+type pendingRetraction struct {
+	Retraction *retraction `json:"retraction"`
+	MemberPK   []byte      `json:"member_pk"`
+	SeenAt     int64       `json:"seen_at"`
+}
+
+type tombstoneRecord struct {
+	DevicePK    []byte `json:"device_pk"`
+	RetractedAt int64  `json:"retracted_at"`
+}
+
+// retractionTracker records the author of the messages and when they were
+// first seen, to check the retractions, and persists the tombstones. A
+// retraction seen before its message is kept until the message shows up.
+type retractionTracker struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+	lock    sync.Mutex
+}
+
+func newRetractionTracker(logger *zap.Logger, store datastore.Batching, h host.Host) (*retractionTracker, error) {
+	t := &retractionTracker{
+		logger: logger,
+		store:  store,
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtMessageRetracted))
+		if err != nil {
+			return nil, err
+		}
+
+		t.emitter = emitter
+	}
+
+	return t, nil
+}
+
+func retractionKey(prefix datastore.Key, groupPK, messageID []byte) datastore.Key {
+	return prefix.ChildString(base64.RawURLEncoding.EncodeToString(groupPK)).ChildString(base64.RawURLEncoding.EncodeToString(messageID))
+}
+
+func (t *retractionTracker) load(key datastore.Key, v interface{}) (bool, error) {
+	data, err := t.store.Get(key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return true, nil
+}
+
+func (t *retractionTracker) save(key datastore.Key, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := t.store.Put(key, data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// seen records the author of a message the first time it is seen, then
+// applies the retraction received before it, if any.
+func (t *retractionTracker) seen(groupPK, messageID, memberPK []byte, now time.Time) (*MessageTombstone, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := retractionKey(retractionSeenKey, groupPK, messageID)
+	if ok, err := t.store.Has(key); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	} else if ok {
+		return nil, nil
+	}
+
+	if err := t.save(key, &seenRecord{SeenAt: now.UnixNano(), MemberPK: memberPK}); err != nil {
+		return nil, err
+	}
+
+	pendingKey := retractionKey(retractionPendingKey, groupPK, messageID)
+	pending := &pendingRetraction{}
+	ok, err := t.load(pendingKey.ChildString(base64.RawURLEncoding.EncodeToString(memberPK)), pending)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.store.Query(query.Query{Prefix: pendingKey.String(), KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		if err := t.store.Delete(datastore.RawKey(entry.Key)); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	if !ok {
+		return nil, nil
+	}
+
+	return t.retractLocked(pending.Retraction, pending.MemberPK, time.Unix(0, pending.SeenAt))
+}
+
+// retract tombstones a message if the retraction comes from its author
+// within the retraction window, the tombstone is nil while the message
+// wasn't seen.
+func (t *retractionTracker) retract(r *retraction, memberPK []byte, now time.Time) (*MessageTombstone, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.retractLocked(r, memberPK, now)
+}
+
+func (t *retractionTracker) retractLocked(r *retraction, memberPK []byte, seenAt time.Time) (*MessageTombstone, error) {
+	if tombstone, err := t.tombstoneLocked(r.GroupPK, r.MessageID); err != nil || tombstone != nil {
+		return tombstone, err
+	}
+
+	rec := &seenRecord{}
+	if ok, err := t.load(retractionKey(retractionSeenKey, r.GroupPK, r.MessageID), rec); err != nil {
+		return nil, err
+	} else if !ok {
+		// kept by author, a retraction of another member can't replace the
+		// one of the author
+		pendingKey := retractionKey(retractionPendingKey, r.GroupPK, r.MessageID).ChildString(base64.RawURLEncoding.EncodeToString(memberPK))
+		return nil, t.save(pendingKey, &pendingRetraction{
+			Retraction: r,
+			MemberPK:   memberPK,
+			SeenAt:     seenAt.UnixNano(),
+		})
+	}
+
+	if !bytes.Equal(rec.MemberPK, memberPK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the author can retract a message"))
+	}
+
+	if seenAt.Sub(time.Unix(0, rec.SeenAt)) > retractionWindow {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("retraction window expired"))
+	}
+
+	if err := t.save(retractionKey(retractionTombstoneKey, r.GroupPK, r.MessageID), &tombstoneRecord{
+		DevicePK:    r.DevicePK,
+		RetractedAt: r.At,
+	}); err != nil {
+		return nil, err
+	}
+
+	tombstone := &MessageTombstone{
+		GroupPK:     r.GroupPK,
+		MessageID:   r.MessageID,
+		DevicePK:    r.DevicePK,
+		RetractedAt: time.Unix(0, r.At),
+	}
+
+	if t.emitter != nil {
+		if err := t.emitter.Emit(EvtMessageRetracted{Tombstone: tombstone}); err != nil {
+			t.logger.Warn("unable to emit message retracted event", zap.Error(err))
+		}
+	}
+
+	return tombstone, nil
+}
+
+// author returns the member which sent a message, or nil if the message
+// wasn't seen.
+func (t *retractionTracker) author(groupPK, messageID []byte) ([]byte, error) {
+	rec := &seenRecord{}
+	if ok, err := t.load(retractionKey(retractionSeenKey, groupPK, messageID), rec); err != nil || !ok {
+		return nil, err
+	}
+
+	return rec.MemberPK, nil
+}
+
+func (t *retractionTracker) tombstone(groupPK, messageID []byte) (*MessageTombstone, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.tombstoneLocked(groupPK, messageID)
+}
+
+func (t *retractionTracker) tombstoneLocked(groupPK, messageID []byte) (*MessageTombstone, error) {
+	rec := &tombstoneRecord{}
+	if ok, err := t.load(retractionKey(retractionTombstoneKey, groupPK, messageID), rec); err != nil || !ok {
+		return nil, err
+	}
+
+	return &MessageTombstone{
+		GroupPK:     groupPK,
+		MessageID:   messageID,
+		DevicePK:    rec.DevicePK,
+		RetractedAt: time.Unix(0, rec.RetractedAt),
+	}, nil
+}
+
+// MessageRetract deletes a message of the device for everyone: a retraction
+// is sent to the group, the devices which received the message replace it
+// with a tombstone. Only the messages sent within the retraction window can
+// be retracted.
+func (s *service) MessageRetract(ctx context.Context, groupPK []byte, messageID []byte) error {
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return errcode.ErrInvalidInput
+	}
+
+	delivery, err := s.deliveries.get(groupPK, messageID)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the author can retract a message"))
+	}
+
+	now := time.Now()
+	if now.Sub(delivery.SentAt) > retractionWindow {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("retraction window expired"))
+	}
+
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	devicePK, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	r := &retraction{GroupPK: groupPK, MessageID: messageID, DevicePK: devicePK, At: now.UnixNano()}
+	if r.Sig, err = md.device.Sign(r.signedBytes()); err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return s.sendControlMessage(ctx, gc, append([]byte(retractionPayloadPrefix), data...))
+}
+
+// sendControlMessage adds a message handled by the protocol to a group, it
+// is not tracked as a message of the device.
+func (s *service) sendControlMessage(ctx context.Context, gc *groupContext, payload []byte) error {
+	_, err := s.sendControlMessageWithID(ctx, gc, payload)
+	return err
+}
+
+// sendControlMessageWithID sends a control message and returns its ID.
+func (s *service) sendControlMessageWithID(ctx context.Context, gc *groupContext, payload []byte) ([]byte, error) {
+	payload, err := s.sealRatchetPayload(gc, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := gc.MessageStore().AddMessage(ctx, payload)
+	if err != nil {
+		return nil, errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	if err := s.carryMessage(ctx, gc.Group(), op.GetEntry()); err != nil {
+		s.logger.Warn("unable to carry message", zap.Error(err))
+	}
+
+	if err := s.publishMessage(ctx, gc.Group(), op.GetEntry()); err != nil {
+		s.logger.Warn("unable to publish message", zap.Error(err))
+	}
+
+	return op.GetEntry().GetHash().Bytes(), nil
+}
+
+// MessageTombstone returns the tombstone of a retracted message, or nil if
+// the message wasn't retracted.
+func (s *service) MessageTombstone(_ context.Context, groupPK []byte, messageID []byte) (*MessageTombstone, error) {
+	return s.retractions.tombstone(groupPK, messageID)
+}
+
+// deviceMember returns the public key of a device of a group and the raw
+// public key of its member.
+func deviceMember(gc *groupContext, devicePK []byte) (crypto.PubKey, []byte, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+	if err != nil {
+		return nil, nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	member, err := gc.MetadataStore().GetMemberByDevice(pk)
+	if err != nil {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	memberPK, err := member.Raw()
+	if err != nil {
+		return nil, nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return pk, memberPK, nil
+}
+
+// applyRetraction records the author of a message of a group, or applies it
+// if it is a retraction. The author of a retraction must sign it with the
+// device which sent it.
+func (s *service) applyRetraction(gc *groupContext, evt *bertytypes.GroupMessageEvent, now time.Time) (*MessageTombstone, error) {
+	pk, memberPK, err := deviceMember(gc, evt.Headers.DevicePK)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isRetractionPayload(evt.Message) {
+		return s.retractions.seen(gc.Group().PublicKey, evt.EventContext.ID, memberPK, now)
+	}
+
+	r, err := unmarshalRetraction(evt.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(r.GroupPK, gc.Group().PublicKey) || !bytes.Equal(r.DevicePK, evt.Headers.DevicePK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("retraction not sent by its signer"))
+	}
+
+	if ok, err := pk.Verify(r.signedBytes(), r.Sig); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification
+	}
+
+	return s.retractions.retract(r, memberPK, now)
+}
+
+// trackRetraction is called for each message of a group, it reports whether
+// the message is a retraction.
+func (s *service) trackRetraction(gc *groupContext, evt *bertytypes.GroupMessageEvent) bool {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil {
+		return false
+	}
+
+	if _, err := s.applyRetraction(gc, evt, time.Now()); err != nil {
+		s.logger.Debug("invalid retraction", zap.Error(err))
+	}
+
+	return isRetractionPayload(evt.Message)
+}
+
+// renderRetraction replaces the payload of a retracted message and of its
+// retraction with a tombstone payload for the clients, it reports whether
+// the message must be sent, the invalid or pending retractions are not.
+func (s *service) renderRetraction(gc *groupContext, evt *bertytypes.GroupMessageEvent) (*bertytypes.GroupMessageEvent, bool) {
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount || evt.Headers == nil || evt.EventContext == nil {
+		return evt, true
+	}
+
+	// the message may not be tracked yet
+	tombstone, err := s.applyRetraction(gc, evt, time.Now())
+	if err != nil {
+		return evt, !isRetractionPayload(evt.Message)
+	}
+
+	if tombstone == nil {
+		if isRetractionPayload(evt.Message) {
+			return evt, false
+		}
+
+		if tombstone, err = s.retractions.tombstone(gc.Group().PublicKey, evt.EventContext.ID); err != nil || tombstone == nil {
+			return evt, true
+		}
+	}
+
+	payload, err := json.Marshal(&tombstonePayload{
+		Type:        TombstonePayloadType,
+		MessageID:   tombstone.MessageID,
+		RetractedAt: tombstone.RetractedAt.UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		return evt, false
+	}
+
+	rendered := *evt
+	rendered.Message = payload
+
+	return &rendered, true
+}
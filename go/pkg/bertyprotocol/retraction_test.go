@@ -0,0 +1,91 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRetractionTracker(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	tracker, err := newRetractionTracker(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	groupPK, author, other := []byte("group"), []byte("author"), []byte("other")
+	now := time.Now()
+
+	newRetraction := func(messageID string) *retraction {
+		return &retraction{GroupPK: groupPK, MessageID: []byte(messageID), DevicePK: []byte("device"), At: now.UnixNano()}
+	}
+
+	_, err = tracker.seen(groupPK, []byte("message"), author, now)
+	require.NoError(t, err)
+
+	// only the author can retract a message
+	_, err = tracker.retract(newRetraction("message"), other, now.Add(time.Minute))
+	require.Error(t, err)
+
+	tombstone, err := tracker.tombstone(groupPK, []byte("message"))
+	require.NoError(t, err)
+	assert.Nil(t, tombstone)
+
+	tombstone, err = tracker.retract(newRetraction("message"), author, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.NotNil(t, tombstone)
+	assert.Equal(t, []byte("message"), tombstone.MessageID)
+
+	// the first seen time is kept
+	_, err = tracker.seen(groupPK, []byte("old"), author, now)
+	require.NoError(t, err)
+	_, err = tracker.seen(groupPK, []byte("old"), author, now.Add(retractionWindow))
+	require.NoError(t, err)
+
+	_, err = tracker.retract(newRetraction("old"), author, now.Add(retractionWindow+time.Minute))
+	require.Error(t, err)
+
+	reloaded, err := newRetractionTracker(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	tombstone, err = reloaded.tombstone(groupPK, []byte("message"))
+	require.NoError(t, err)
+	require.NotNil(t, tombstone)
+	assert.Equal(t, now.UnixNano(), tombstone.RetractedAt.UnixNano())
+}
+
+func TestRetractionTrackerPending(t *testing.T) {
+	tracker, err := newRetractionTracker(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	groupPK, author, other := []byte("group"), []byte("author"), []byte("other")
+	now := time.Now()
+
+	// the retractions received before their message are applied once it is
+	// seen, the one of another member is ignored
+	for _, memberPK := range [][]byte{other, author} {
+		tombstone, err := tracker.retract(&retraction{GroupPK: groupPK, MessageID: []byte("message"), DevicePK: memberPK, At: now.UnixNano()}, memberPK, now)
+		require.NoError(t, err)
+		assert.Nil(t, tombstone)
+	}
+
+	tombstone, err := tracker.seen(groupPK, []byte("message"), author, now.Add(time.Second))
+	require.NoError(t, err)
+	require.NotNil(t, tombstone)
+	assert.Equal(t, author, tombstone.DevicePK)
+
+	// a pending retraction of another member isn't applied
+	_, err = tracker.retract(&retraction{GroupPK: groupPK, MessageID: []byte("forged"), DevicePK: other, At: now.UnixNano()}, other, now)
+	require.NoError(t, err)
+
+	tombstone, err = tracker.seen(groupPK, []byte("forged"), author, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Nil(t, tombstone)
+
+	tombstone, err = tracker.tombstone(groupPK, []byte("forged"))
+	require.NoError(t, err)
+	assert.Nil(t, tombstone)
+}
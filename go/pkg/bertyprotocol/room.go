@@ -0,0 +1,637 @@
+package bertyprotocol
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/internal/tinder"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// RoomProtocolID is the protocol used to fetch the invitation of a room
+const RoomProtocolID = "/berty/room/1.0.0"
+
+const (
+	// RoomCodeLength is the number of characters of a room code
+	RoomCodeLength = 6
+
+	// RoomMaxDuration is the longest time a room can stay open
+	RoomMaxDuration = 24 * time.Hour
+
+	// roomCodeAlphabet avoids the characters that are easily mistaken for
+	// one another when read aloud or copied by hand (0/O, 1/I/L)
+	roomCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+	roomMaxPayloadSize = 64 * 1024
+)
+
+// Room is a time-bounded multi member group, joinable by the devices nearby
+// knowing its code until it expires.
+type Room struct {
+	Code    string
+	GroupPK []byte
+	Expires time.Time
+}
+
+// roomRecord is persisted, so the rooms are dissolved even if the service is
+// restarted after their expiration.
+type roomRecord struct {
+	Code    string `json:"code"`
+	GroupPK []byte `json:"group_pk"`
+	Expires int64  `json:"expires"`
+}
+
+// roomInvitation is the payload sent to the devices joining a room, sealed
+// with a key derived from the room code.
+type roomInvitation struct {
+	Group   []byte `json:"group"`
+	Expires int64  `json:"expires"`
+}
+
+type roomManager struct {
+	logger *zap.Logger
+	host   host.Host
+	tinder tinder.Driver
+	store  datastore.Batching
+
+	mu    sync.Mutex
+	rooms map[string]*openedRoom // by namespace
+}
+
+type openedRoom struct {
+	Room
+
+	ns     string
+	group  *bertytypes.Group
+	timer  *time.Timer
+	cancel context.CancelFunc
+
+	// the key is held until the room is closed
+	muKey sync.Mutex
+	key   *cryptoutil.SecureBuffer
+}
+
+func newRoomManager(logger *zap.Logger, h host.Host, driver tinder.Driver, store datastore.Batching) *roomManager {
+	rm := &roomManager{
+		logger: logger,
+		host:   h,
+		tinder: driver,
+		store:  store,
+		rooms:  make(map[string]*openedRoom),
+	}
+
+	if h != nil {
+		h.SetStreamHandler(RoomProtocolID, rm.handleStream)
+	}
+
+	return rm
+}
+
+// NormalizeRoomCode uppercases a room code and removes the separators users
+// may type.
+func NormalizeRoomCode(code string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.ToUpper(code))
+}
+
+func checkRoomCode(code string) error {
+	if len(code) != RoomCodeLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("room code must be %d characters long", RoomCodeLength))
+	}
+
+	for _, c := range code {
+		if !strings.ContainsRune(roomCodeAlphabet, c) {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid character %q in room code", c))
+		}
+	}
+
+	return nil
+}
+
+func newRoomCode() (string, error) {
+	max := big.NewInt(int64(len(roomCodeAlphabet)))
+	code := make([]byte, RoomCodeLength)
+
+	for i := range code {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			return "", errcode.ErrCryptoRandomGeneration.Wrap(err)
+		}
+
+		code[i] = roomCodeAlphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+// roomNamespace is the rendezvous point of a room, it doesn't disclose the
+// code.
+func roomNamespace(code string) string {
+	sum := sha256.Sum256([]byte("berty-room-ns:" + code))
+
+	return "berty-room/" + hex.EncodeToString(sum[:16])
+}
+
+func roomKey(code string) (*[32]byte, error) {
+	var key [32]byte
+
+	kdf := hkdf.New(sha256.New, []byte(code), nil, []byte("berty-room-key"))
+	if _, err := io.ReadFull(kdf, key[:]); err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return &key, nil
+}
+
+func (rm *roomManager) recordKey(groupPK []byte) datastore.Key {
+	return datastore.NewKey(hex.EncodeToString(groupPK))
+}
+
+func (rm *roomManager) putRecord(r *Room) error {
+	data, err := json.Marshal(&roomRecord{Code: r.Code, GroupPK: r.GroupPK, Expires: r.Expires.UnixNano()})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := rm.store.Put(rm.recordKey(r.GroupPK), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (rm *roomManager) listRecords() ([]*Room, error) {
+	results, err := rm.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	rooms := []*Room(nil)
+	for _, entry := range entries {
+		record := &roomRecord{}
+		if err := json.Unmarshal(entry.Value, record); err != nil {
+			rm.logger.Warn("invalid room record, deleting it", zap.String("key", entry.Key), zap.Error(err))
+			_ = rm.store.Delete(datastore.NewKey(entry.Key))
+			continue
+		}
+
+		rooms = append(rooms, &Room{
+			Code:    record.Code,
+			GroupPK: record.GroupPK,
+			Expires: time.Unix(0, record.Expires),
+		})
+	}
+
+	return rooms, nil
+}
+
+// open advertises a room until it expires, expire is called once the room
+// is over.
+func (rm *roomManager) open(ctx context.Context, r *Room, g *bertytypes.Group, expire func(r *Room)) error {
+	derived, err := roomKey(r.Code)
+	if err != nil {
+		return err
+	}
+
+	key, err := cryptoutil.NewSecureBufferFrom(derived[:])
+	if err != nil {
+		return err
+	}
+
+	ns := roomNamespace(r.Code)
+	ctx, cancel := context.WithDeadline(ctx, r.Expires)
+
+	or := &openedRoom{
+		Room:   *r,
+		ns:     ns,
+		key:    key,
+		group:  g,
+		cancel: cancel,
+	}
+
+	rm.mu.Lock()
+	if _, ok := rm.rooms[ns]; ok {
+		rm.mu.Unlock()
+		cancel()
+		key.Destroy()
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("room already opened"))
+	}
+
+	rm.rooms[ns] = or
+	or.timer = time.AfterFunc(time.Until(r.Expires), func() {
+		rm.close(ns)
+		expire(r)
+	})
+	rm.mu.Unlock()
+
+	if rm.tinder != nil {
+		if _, err := rm.tinder.Advertise(ctx, ns, discovery.TTL(time.Until(r.Expires))); err != nil {
+			rm.logger.Warn("unable to advertise room", zap.String("ns", ns), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// close stops advertising a room.
+func (rm *roomManager) close(ns string) {
+	rm.mu.Lock()
+	or, ok := rm.rooms[ns]
+	delete(rm.rooms, ns)
+	rm.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	or.timer.Stop()
+	or.cancel()
+
+	or.muKey.Lock()
+	or.key.Destroy()
+	or.muKey.Unlock()
+
+	if rm.tinder != nil {
+		if err := rm.tinder.Unregister(context.Background(), ns); err != nil {
+			rm.logger.Debug("unable to unregister room", zap.String("ns", ns), zap.Error(err))
+		}
+	}
+}
+
+func (rm *roomManager) closeAll() {
+	if rm.host != nil {
+		rm.host.RemoveStreamHandler(RoomProtocolID)
+	}
+
+	rm.mu.Lock()
+	namespaces := make([]string, 0, len(rm.rooms))
+	for ns := range rm.rooms {
+		namespaces = append(namespaces, ns)
+	}
+	rm.mu.Unlock()
+
+	for _, ns := range namespaces {
+		rm.close(ns)
+	}
+}
+
+func (rm *roomManager) handleStream(s network.Stream) {
+	defer s.Close()
+
+	_ = s.SetDeadline(time.Now().Add(time.Second * 10))
+
+	ns, err := readRoomFrame(s)
+	if err != nil {
+		rm.logger.Debug("unable to read room request", zap.Error(err))
+		_ = s.Reset()
+		return
+	}
+
+	rm.mu.Lock()
+	or, ok := rm.rooms[string(ns)]
+	rm.mu.Unlock()
+
+	if !ok || time.Now().After(or.Expires) {
+		_ = s.Reset()
+		return
+	}
+
+	group, err := or.group.Marshal()
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	payload, err := json.Marshal(&roomInvitation{Group: group, Expires: or.Expires.UnixNano()})
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	or.muKey.Lock()
+	key := or.key.Key()
+	if key == nil {
+		// the room has been closed in the meantime
+		or.muKey.Unlock()
+		_ = s.Reset()
+		return
+	}
+
+	sealed := secretbox.Seal(nonce[:], payload, nonce, key)
+	or.muKey.Unlock()
+
+	if err := writeRoomFrame(s, sealed); err != nil {
+		rm.logger.Debug("unable to send room invitation", zap.Error(err))
+		_ = s.Reset()
+	}
+}
+
+// fetch looks for the devices advertising the room and retrieves its
+// invitation from the first one answering.
+func (rm *roomManager) fetch(ctx context.Context, code string) (*bertytypes.Group, time.Time, error) {
+	if rm.host == nil || rm.tinder == nil {
+		return nil, time.Time{}, errcode.ErrInternal.Wrap(fmt.Errorf("rooms are not available without a host and a tinder driver"))
+	}
+
+	key, err := roomKey(code)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer cryptoutil.WipeKey(key)
+
+	ns := roomNamespace(code)
+
+	peers, err := rm.tinder.FindPeers(ctx, ns)
+	if err != nil {
+		return nil, time.Time{}, errcode.ErrInternal.Wrap(err)
+	}
+
+	for p := range peers {
+		if p.ID == rm.host.ID() {
+			continue
+		}
+
+		g, expires, err := rm.fetchFrom(ctx, p, ns, key)
+		if err != nil {
+			rm.logger.Debug("unable to fetch room invitation", zap.Stringer("peer", p.ID), zap.Error(err))
+			continue
+		}
+
+		return g, expires, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil, time.Time{}, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no room found for this code"))
+}
+
+func (rm *roomManager) fetchFrom(ctx context.Context, p peer.AddrInfo, ns string, key *[32]byte) (*bertytypes.Group, time.Time, error) {
+	if err := rm.host.Connect(ctx, p); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	s, err := rm.host.NewStream(ctx, p.ID, RoomProtocolID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer s.Close()
+
+	_ = s.SetDeadline(time.Now().Add(time.Second * 10))
+
+	if err := writeRoomFrame(s, []byte(ns)); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	sealed, err := readRoomFrame(s)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if len(sealed) < cryptoutil.NonceSize {
+		return nil, time.Time{}, errcode.ErrInvalidInput
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(sealed[:cryptoutil.NonceSize])
+	if err != nil {
+		return nil, time.Time{}, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	payload, ok := secretbox.Open(nil, sealed[cryptoutil.NonceSize:], nonce, key)
+	if !ok {
+		return nil, time.Time{}, errcode.ErrCryptoDecrypt
+	}
+
+	invitation := &roomInvitation{}
+	if err := json.Unmarshal(payload, invitation); err != nil {
+		return nil, time.Time{}, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	g := &bertytypes.Group{}
+	if err := g.Unmarshal(invitation.Group); err != nil {
+		return nil, time.Time{}, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if g.GroupType != bertytypes.GroupTypeMultiMember {
+		return nil, time.Time{}, errcode.ErrInvalidInput.Wrap(fmt.Errorf("room invitation is not a multi member group"))
+	}
+
+	expires := time.Unix(0, invitation.Expires)
+	if time.Now().After(expires) {
+		return nil, time.Time{}, errcode.ErrInvalidInput.Wrap(fmt.Errorf("room is expired"))
+	}
+
+	return g, expires, nil
+}
+
+func writeRoomFrame(w io.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+func readRoomFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > roomMaxPayloadSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("room frame too large"))
+	}
+
+	return ioutil.ReadAll(io.LimitReader(r, int64(n)))
+}
+
+// RoomCreate creates a multi member group advertised to the devices nearby
+// under a short code for the given duration. Once expired, the group is left
+// and its keys are deleted by every member.
+func (s *service) RoomCreate(ctx context.Context, duration time.Duration) (*Room, error) {
+	if duration <= 0 || duration > RoomMaxDuration {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("room duration must be between 0 and %s", RoomMaxDuration))
+	}
+
+	code, err := newRoomCode()
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := s.MultiMemberGroupCreate(ctx, &bertytypes.MultiMemberGroupCreate_Request{})
+	if err != nil {
+		return nil, err
+	}
+
+	cg, err := s.getContextGroupForID(created.GroupPK)
+	if err != nil {
+		return nil, errcode.ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	r := &Room{
+		Code:    code,
+		GroupPK: created.GroupPK,
+		Expires: time.Now().Add(duration),
+	}
+
+	if err := s.openRoom(r, cg.Group()); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// RoomJoin joins the room advertised nearby under the given code.
+func (s *service) RoomJoin(ctx context.Context, code string) (*Room, error) {
+	code = NormalizeRoomCode(code)
+	if err := checkRoomCode(code); err != nil {
+		return nil, err
+	}
+
+	g, expires, err := s.rooms.fetch(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.MultiMemberGroupJoin(ctx, &bertytypes.MultiMemberGroupJoin_Request{Group: g}); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.ActivateGroup(ctx, &bertytypes.ActivateGroup_Request{GroupPK: g.PublicKey}); err != nil {
+		return nil, err
+	}
+
+	r := &Room{
+		Code:    code,
+		GroupPK: g.PublicKey,
+		Expires: expires,
+	}
+
+	if err := s.openRoom(r, g); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// openRoom persists a room and advertises it, so the members can also let
+// other devices join.
+func (s *service) openRoom(r *Room, g *bertytypes.Group) error {
+	if err := s.rooms.putRecord(r); err != nil {
+		return err
+	}
+
+	return s.rooms.open(s.ctx, r, g, s.dissolveRoom)
+}
+
+// restoreRooms reopens the rooms persisted by a previous run and dissolves
+// those that expired in the meantime.
+func (s *service) restoreRooms() {
+	rooms, err := s.rooms.listRecords()
+	if err != nil {
+		s.logger.Error("unable to list rooms", zap.Error(err))
+		return
+	}
+
+	for _, r := range rooms {
+		if time.Now().After(r.Expires) {
+			s.dissolveRoom(r)
+			continue
+		}
+
+		if _, err := s.ActivateGroup(s.ctx, &bertytypes.ActivateGroup_Request{GroupPK: r.GroupPK}); err != nil {
+			s.logger.Warn("unable to activate room group", zap.Error(err))
+			continue
+		}
+
+		cg, err := s.getContextGroupForID(r.GroupPK)
+		if err != nil {
+			continue
+		}
+
+		if err := s.rooms.open(s.ctx, r, cg.Group(), s.dissolveRoom); err != nil {
+			s.logger.Warn("unable to reopen room", zap.Error(err))
+		}
+	}
+}
+
+// dissolveRoom leaves an expired room and purges its keys.
+func (s *service) dissolveRoom(r *Room) {
+	logger := s.logger.With(zap.String("group", hex.EncodeToString(r.GroupPK)))
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(r.GroupPK)
+	if err != nil {
+		logger.Error("invalid room group", zap.Error(err))
+		_ = s.rooms.store.Delete(s.rooms.recordKey(r.GroupPK))
+		return
+	}
+
+	if cg, err := s.getContextGroupForID(r.GroupPK); err == nil {
+		mk := cg.MessageKeystore()
+
+		for _, e := range cg.messageStore.OpLog().GetEntries().Slice() {
+			if err := mk.ForgetMessage(e.GetHash()); err != nil {
+				logger.Warn("unable to delete message key", zap.Error(err))
+			}
+		}
+
+		for _, device := range cg.MetadataStore().ListDevices() {
+			if err := mk.ForgetDevice(device); err != nil {
+				logger.Warn("unable to delete device chain key", zap.Error(err))
+			}
+		}
+	}
+
+	if _, err := s.MultiMemberGroupLeave(s.ctx, &bertytypes.MultiMemberGroupLeave_Request{GroupPK: r.GroupPK}); err != nil {
+		logger.Warn("unable to leave room group", zap.Error(err))
+	}
+
+	if err := s.deviceKeystore.ForgetGroup(pk); err != nil {
+		logger.Warn("unable to delete room group keys", zap.Error(err))
+	}
+
+	if err := s.rooms.store.Delete(s.rooms.recordKey(r.GroupPK)); err != nil {
+		logger.Warn("unable to delete room record", zap.Error(err))
+	}
+
+	logger.Info("room dissolved")
+}
@@ -0,0 +1,87 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	"github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomCode(t *testing.T) {
+	code, err := newRoomCode()
+	require.NoError(t, err)
+	require.NoError(t, checkRoomCode(code))
+
+	assert.Equal(t, "ABC234", NormalizeRoomCode("abc-234"))
+	assert.Equal(t, "ABC234", NormalizeRoomCode(" ab c2 34"))
+
+	assert.Error(t, checkRoomCode("ABC23"))
+	assert.Error(t, checkRoomCode("ABC230"))
+
+	assert.NotEqual(t, roomNamespace("ABC234"), roomNamespace("ABC235"))
+	assert.NotContains(t, roomNamespace("ABC234"), "ABC234")
+}
+
+func TestRoomInvitation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := testutil.Logger(t)
+
+	mn := libp2p_mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	require.NoError(t, err)
+	h2, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	newStore := func() datastore.Batching { return ds_sync.MutexWrap(datastore.NewMapDatastore()) }
+	rm1 := newRoomManager(logger, h1, nil, newStore())
+	defer rm1.closeAll()
+	rm2 := newRoomManager(logger, h2, nil, newStore())
+	defer rm2.closeAll()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	code, err := newRoomCode()
+	require.NoError(t, err)
+
+	expired := make(chan struct{})
+	r := &Room{Code: code, GroupPK: g.PublicKey, Expires: time.Now().Add(time.Second * 2)}
+	require.NoError(t, rm1.open(ctx, r, g, func(*Room) { close(expired) }))
+
+	key, err := roomKey(code)
+	require.NoError(t, err)
+
+	pi := peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}
+
+	fetched, expires, err := rm2.fetchFrom(ctx, pi, roomNamespace(code), key)
+	require.NoError(t, err)
+	assert.Equal(t, g.PublicKey, fetched.PublicKey)
+	assert.Equal(t, g.Secret, fetched.Secret)
+	assert.Equal(t, r.Expires.UnixNano(), expires.UnixNano())
+
+	// wrong code
+	other, err := roomKey("ZZZZZZ")
+	require.NoError(t, err)
+	_, _, err = rm2.fetchFrom(ctx, pi, roomNamespace("ZZZZZZ"), other)
+	assert.Error(t, err)
+
+	select {
+	case <-expired:
+	case <-time.After(time.Second * 5):
+		t.Fatal("room didn't expire")
+	}
+
+	// expired rooms aren't served anymore
+	_, _, err = rm2.fetchFrom(ctx, pi, roomNamespace(code), key)
+	assert.Error(t, err)
+}
@@ -0,0 +1,376 @@
+package bertyprotocol
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+const (
+	// scheduledRetryDelay is how long a due message waits before being sent
+	// again when its group can't be reached
+	scheduledRetryDelay = time.Minute
+
+	// maxScheduleDelay is how far in the future a message can be scheduled
+	maxScheduleDelay = 365 * 24 * time.Hour
+
+	scheduledIDSize = 16
+)
+
+// ScheduledMessage is a message composed now and sent later, it can be
+// changed or cancelled until it is sent.
+type ScheduledMessage struct {
+	ID        []byte    `json:"id"`
+	GroupPK   []byte    `json:"group_pk"`
+	Payload   []byte    `json:"payload"`
+	SendAt    time.Time `json:"send_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// EvtScheduledMessageSent is emitted on the event bus of the host once a
+// scheduled message is handed to its group.
+type EvtScheduledMessageSent struct {
+	Message *ScheduledMessage
+}
+
+// scheduledMessages persists the messages to send later and runs their
+// timers, the due messages are handed to the service.
+type scheduledMessages struct {
+	logger  *zap.Logger
+	store   datastore.Batching
+	emitter event.Emitter
+
+	// send hands a due message to its group, it is set by the service
+	send func(m *ScheduledMessage) error
+
+	lock   sync.Mutex
+	timers map[string]*time.Timer
+
+	// stopped is set once the service is closed, no timer is armed anymore
+	stopped bool
+}
+
+func newScheduledMessages(logger *zap.Logger, store datastore.Batching, h host.Host) (*scheduledMessages, error) {
+	sm := &scheduledMessages{
+		logger: logger,
+		store:  store,
+		timers: make(map[string]*time.Timer),
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtScheduledMessageSent))
+		if err != nil {
+			return nil, err
+		}
+
+		sm.emitter = emitter
+	}
+
+	return sm, nil
+}
+
+func scheduledKey(id []byte) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(id))
+}
+
+func (sm *scheduledMessages) getLocked(id []byte) (*ScheduledMessage, error) {
+	data, err := sm.store.Get(scheduledKey(id))
+	if err == datastore.ErrNotFound {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown scheduled message"))
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	m := &ScheduledMessage{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return m, nil
+}
+
+func (sm *scheduledMessages) putLocked(m *ScheduledMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := sm.store.Put(scheduledKey(m.ID), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func validSendAt(sendAt time.Time, now time.Time) error {
+	if sendAt.After(now.Add(maxScheduleDelay)) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a message can't be scheduled more than %s ahead", maxScheduleDelay))
+	}
+
+	return nil
+}
+
+// add persists a new message and arms its timer, a message due in the past
+// is sent right away.
+func (sm *scheduledMessages) add(groupPK, payload []byte, sendAt time.Time) (*ScheduledMessage, error) {
+	now := time.Now()
+	if err := validSendAt(sendAt, now); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, scheduledIDSize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	m := &ScheduledMessage{ID: id, GroupPK: groupPK, Payload: payload, SendAt: sendAt, CreatedAt: now}
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	if err := sm.putLocked(m); err != nil {
+		return nil, err
+	}
+
+	sm.armLocked(m.ID, m.SendAt)
+
+	return m, nil
+}
+
+// update replaces the content and the time of a message not sent yet, a nil
+// payload keeps the current one.
+func (sm *scheduledMessages) update(id, payload []byte, sendAt time.Time) (*ScheduledMessage, error) {
+	if err := validSendAt(sendAt, time.Now()); err != nil {
+		return nil, err
+	}
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	m, err := sm.getLocked(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload != nil {
+		m.Payload = payload
+	}
+	m.SendAt = sendAt
+
+	if err := sm.putLocked(m); err != nil {
+		return nil, err
+	}
+
+	sm.disarmLocked(m.ID)
+	sm.armLocked(m.ID, m.SendAt)
+
+	return m, nil
+}
+
+// cancel deletes a message not sent yet.
+func (sm *scheduledMessages) cancel(id []byte) error {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	if _, err := sm.getLocked(id); err != nil {
+		return err
+	}
+
+	if err := sm.store.Delete(scheduledKey(id)); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	sm.disarmLocked(id)
+
+	return nil
+}
+
+// list returns the messages not sent yet of a group, or of all the groups
+// if it is nil, the next one first.
+func (sm *scheduledMessages) list(groupPK []byte) ([]*ScheduledMessage, error) {
+	res, err := sm.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	messages := []*ScheduledMessage{}
+	for _, entry := range entries {
+		m := &ScheduledMessage{}
+		if err := json.Unmarshal(entry.Value, m); err != nil {
+			sm.logger.Warn("unable to read scheduled message", zap.Error(err))
+			continue
+		}
+
+		if groupPK == nil || string(m.GroupPK) == string(groupPK) {
+			messages = append(messages, m)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].SendAt.Before(messages[j].SendAt) })
+
+	return messages, nil
+}
+
+// start arms the timers of the messages persisted by a previous run.
+func (sm *scheduledMessages) start() {
+	messages, err := sm.list(nil)
+	if err != nil {
+		sm.logger.Error("unable to list scheduled messages", zap.Error(err))
+		return
+	}
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	for _, m := range messages {
+		sm.armLocked(m.ID, m.SendAt)
+	}
+}
+
+// stop disarms the timers, the messages stay scheduled for the next start.
+func (sm *scheduledMessages) stop() {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	sm.stopped = true
+	for id, timer := range sm.timers {
+		timer.Stop()
+		delete(sm.timers, id)
+	}
+}
+
+func (sm *scheduledMessages) armLocked(id []byte, at time.Time) {
+	if sm.send == nil || sm.stopped {
+		return
+	}
+
+	sm.timers[string(id)] = time.AfterFunc(time.Until(at), func() { sm.fire(id) })
+}
+
+func (sm *scheduledMessages) disarmLocked(id []byte) {
+	if timer, ok := sm.timers[string(id)]; ok {
+		timer.Stop()
+		delete(sm.timers, string(id))
+	}
+}
+
+// fire sends a due message, it is removed before being sent so it can't be
+// changed or cancelled anymore, and kept again to be retried if it fails.
+func (sm *scheduledMessages) fire(id []byte) {
+	sm.lock.Lock()
+
+	delete(sm.timers, string(id))
+
+	if sm.stopped {
+		sm.lock.Unlock()
+		return
+	}
+
+	m, err := sm.getLocked(id)
+	if err != nil {
+		// cancelled meanwhile
+		sm.lock.Unlock()
+		return
+	}
+
+	// changed meanwhile, its new timer is armed
+	if time.Now().Before(m.SendAt) {
+		sm.lock.Unlock()
+		return
+	}
+
+	if err := sm.store.Delete(scheduledKey(id)); err != nil {
+		sm.logger.Warn("unable to delete scheduled message", zap.Error(err))
+	}
+
+	sm.lock.Unlock()
+
+	if err := sm.send(m); err != nil {
+		sm.logger.Warn("unable to send scheduled message, retrying later", zap.Error(err))
+
+		sm.lock.Lock()
+		if err := sm.putLocked(m); err != nil {
+			sm.logger.Error("unable to keep scheduled message", zap.Error(err))
+		} else {
+			sm.armLocked(m.ID, time.Now().Add(scheduledRetryDelay))
+		}
+		sm.lock.Unlock()
+
+		return
+	}
+
+	if sm.emitter != nil {
+		if err := sm.emitter.Emit(EvtScheduledMessageSent{Message: m}); err != nil {
+			sm.logger.Warn("unable to emit scheduled message sent event", zap.Error(err))
+		}
+	}
+}
+
+// MessageSchedule keeps a message to send it to a group at the given time,
+// through the same path as the messages sent right away.
+func (s *service) MessageSchedule(_ context.Context, groupPK []byte, payload []byte, sendAt time.Time) (*ScheduledMessage, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(groupPK)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	g, err := s.getGroupForPK(pk)
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if g.GroupType == bertytypes.GroupTypeAccount {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return s.scheduled.add(groupPK, payload, sendAt)
+}
+
+// MessageScheduleUpdate changes a scheduled message before it is sent, a
+// nil payload keeps its content.
+func (s *service) MessageScheduleUpdate(_ context.Context, id []byte, payload []byte, sendAt time.Time) (*ScheduledMessage, error) {
+	return s.scheduled.update(id, payload, sendAt)
+}
+
+// MessageScheduleCancel deletes a scheduled message before it is sent.
+func (s *service) MessageScheduleCancel(_ context.Context, id []byte) error {
+	return s.scheduled.cancel(id)
+}
+
+// MessageScheduledList returns the messages of a group not sent yet, the
+// next one first.
+func (s *service) MessageScheduledList(_ context.Context, groupPK []byte) ([]*ScheduledMessage, error) {
+	return s.scheduled.list(groupPK)
+}
+
+// sendScheduled hands a due message to the outbound pipeline, it fails while
+// its group isn't active.
+func (s *service) sendScheduled(m *ScheduledMessage) error {
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+
+	_, err := s.AppMessageSend(s.ctx, &bertytypes.AppMessageSend_Request{GroupPK: m.GroupPK, Payload: m.Payload})
+
+	return err
+}
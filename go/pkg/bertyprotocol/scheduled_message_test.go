@@ -0,0 +1,94 @@
+package bertyprotocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestScheduledMessages(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	sm, err := newScheduledMessages(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+
+	sent := make(chan *ScheduledMessage, 4)
+	fail := make(chan struct{}, 1)
+	sm.send = func(m *ScheduledMessage) error {
+		select {
+		case <-fail:
+			return fmt.Errorf("group not active")
+		default:
+		}
+
+		sent <- m
+		return nil
+	}
+
+	groupPK := []byte("group")
+	now := time.Now()
+
+	first, err := sm.add(groupPK, []byte("first"), now.Add(time.Hour))
+	require.NoError(t, err)
+	second, err := sm.add(groupPK, []byte("second"), now.Add(2*time.Hour))
+	require.NoError(t, err)
+	_, err = sm.add(groupPK, []byte("later"), now.Add(2*maxScheduleDelay))
+	assert.Error(t, err)
+
+	list, err := sm.list(groupPK)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, first.ID, list[0].ID)
+
+	// a message can be changed and cancelled until it is sent
+	_, err = sm.update(first.ID, []byte("edited"), now.Add(50*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, sm.cancel(second.ID))
+	assert.Error(t, sm.cancel(second.ID))
+
+	select {
+	case m := <-sent:
+		assert.Equal(t, []byte("edited"), m.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not sent")
+	}
+
+	list, err = sm.list(nil)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	_, err = sm.update(first.ID, nil, now)
+	assert.Error(t, err)
+
+	// the messages are kept across restarts, a failed send is kept to be
+	// retried
+	fail <- struct{}{}
+	_, err = sm.add(groupPK, []byte("retried"), now)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(fail) == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		list, err := sm.list(groupPK)
+		return err == nil && len(list) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sm, err = newScheduledMessages(zap.NewNop(), store, nil)
+	require.NoError(t, err)
+	sm.send = func(m *ScheduledMessage) error {
+		sent <- m
+		return nil
+	}
+	sm.start()
+
+	select {
+	case m := <-sent:
+		assert.Equal(t, []byte("retried"), m.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not sent after restart")
+	}
+}
@@ -0,0 +1,151 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// sealedEnvelopePrefix marks an envelope sealed for the members of a group,
+// the relays and the carriers only see its destination
+const sealedEnvelopePrefix = "\x00berty.sealed/1\x00"
+
+// sealedSender is the content of a sealed envelope, the sender is only known
+// once it is opened.
+type sealedSender struct {
+	Signer  []byte `json:"signer"`
+	Sig     []byte `json:"sig"`
+	Payload []byte `json:"payload"`
+}
+
+func sealedEnvelopeKey(g *bertytypes.Group) (*[cryptoutil.KeySize]byte, error) {
+	key := make([]byte, cryptoutil.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, g.Secret, nil, []byte("berty sealed sender")), key); err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return cryptoutil.KeySliceToArray(key)
+}
+
+// sealedSenderSigned is what the sender signs, bound to the group so an
+// envelope can't be moved to another one.
+func sealedSenderSigned(g *bertytypes.Group, payload []byte) []byte {
+	return bytes.Join([][]byte{[]byte(sealedEnvelopePrefix), g.PublicKey, payload}, nil)
+}
+
+// sealEnvelope signs a payload with the key of the device for the group and
+// seals it with a key derived from the secret of the group.
+func sealEnvelope(g *bertytypes.Group, deviceSK crypto.PrivKey, payload []byte) ([]byte, error) {
+	signer, err := deviceSK.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sig, err := deviceSK.Sign(sealedSenderSigned(g, payload))
+	if err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	plaintext, err := json.Marshal(&sealedSender{Signer: signer, Sig: sig, Payload: payload})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	key, err := sealedEnvelopeKey(g)
+	if err != nil {
+		return nil, err
+	}
+	defer cryptoutil.WipeKey(key)
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	out := append([]byte(sealedEnvelopePrefix), nonce[:]...)
+
+	return secretbox.Seal(out, plaintext, nonce, key), nil
+}
+
+// openSealedEnvelope opens an envelope of a group and checks the signature of
+// its sender, it returns nil for an envelope which isn't sealed.
+func openSealedEnvelope(g *bertytypes.Group, data []byte) (*sealedSender, error) {
+	if !bytes.HasPrefix(data, []byte(sealedEnvelopePrefix)) {
+		return nil, nil
+	}
+
+	data = data[len(sealedEnvelopePrefix):]
+	if len(data) < cryptoutil.NonceSize+secretbox.Overhead {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("sealed envelope too short"))
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(data[:cryptoutil.NonceSize])
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	key, err := sealedEnvelopeKey(g)
+	if err != nil {
+		return nil, err
+	}
+	defer cryptoutil.WipeKey(key)
+
+	plaintext, ok := secretbox.Open(nil, data[cryptoutil.NonceSize:], nonce, key)
+	if !ok {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open sealed envelope"))
+	}
+
+	env := &sealedSender{}
+	if err := json.Unmarshal(plaintext, env); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(env.Signer)
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := pk.Verify(sealedSenderSigned(g, env.Payload), env.Sig); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid sealed envelope signature"))
+	}
+
+	return env, nil
+}
+
+// sealForGroup seals an envelope of the device for the members of a group.
+func (s *service) sealForGroup(g *bertytypes.Group, payload []byte) ([]byte, error) {
+	md, err := s.deviceKeystore.MemberDeviceForGroup(g)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return sealEnvelope(g, md.device, payload)
+}
+
+// openFromGroup opens a sealed envelope of a group, the sender must be a
+// current device of the group. The envelopes of the devices not sealing them
+// yet are returned as is.
+func (s *service) openFromGroup(gc *groupContext, data []byte) ([]byte, error) {
+	env, err := openSealedEnvelope(gc.Group(), data)
+	if err != nil {
+		return nil, err
+	} else if env == nil {
+		return data, nil
+	}
+
+	// the members who left or were kicked can't send anymore
+	if !gc.MetadataStore().isCurrentDevice(env.Signer) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("sealed envelope of a device not in the group"))
+	}
+
+	return env.Payload, nil
+}
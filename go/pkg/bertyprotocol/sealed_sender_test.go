@@ -0,0 +1,51 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealedEnvelope(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	other, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	deviceSK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	devicePK, err := deviceSK.GetPublic().Raw()
+	require.NoError(t, err)
+
+	payload := []byte("carried entry")
+	sealed, err := sealEnvelope(g, deviceSK, payload)
+	require.NoError(t, err)
+
+	// the sender and the payload aren't visible outside of the group
+	assert.False(t, bytes.Contains(sealed, devicePK))
+	assert.False(t, bytes.Contains(sealed, payload))
+
+	env, err := openSealedEnvelope(g, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, payload, env.Payload)
+	assert.Equal(t, devicePK, env.Signer)
+
+	// only the members of the group can open it
+	_, err = openSealedEnvelope(other, sealed)
+	assert.Error(t, err)
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = openSealedEnvelope(g, tampered)
+	assert.Error(t, err)
+
+	// the envelopes which aren't sealed are left to the caller
+	env, err = openSealedEnvelope(g, payload)
+	require.NoError(t, err)
+	assert.Nil(t, env)
+}
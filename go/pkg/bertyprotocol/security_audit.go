@@ -0,0 +1,360 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/zap"
+)
+
+// SecurityEventType is the type of an entry of the security audit log.
+type SecurityEventType string
+
+const (
+	SecurityKeyChanged        SecurityEventType = "key_changed"
+	SecurityContactVerified   SecurityEventType = "contact_verified"
+	SecurityContactUnverified SecurityEventType = "contact_unverified"
+	SecurityDeviceLinked      SecurityEventType = "device_linked"
+	SecurityDeviceRevoked     SecurityEventType = "device_revoked"
+	SecurityIdentityRotated   SecurityEventType = "identity_rotated"
+	SecurityDecryptionFailed  SecurityEventType = "decryption_failed"
+	SecurityInvalidSignature  SecurityEventType = "invalid_signature"
+)
+
+// NodeEventSecurity is the type of the node events of the entries added to
+// the security audit log.
+const NodeEventSecurity = "security_event"
+
+const (
+	// DefaultSecurityAuditPageSize is the number of entries returned by a
+	// query of the audit log if its limit is zero
+	DefaultSecurityAuditPageSize = 100
+
+	// maxDecryptionFailures caps the failed decryptions logged in an hour, a
+	// member sending garbage can't fill the log
+	maxDecryptionFailures = 60
+)
+
+// SecurityEvent is an entry of the security audit log. Each entry has the
+// hash of the previous one and is signed by the device, the log can't be
+// edited without breaking the chain.
+type SecurityEvent struct {
+	Seq  uint64            `json:"seq"`
+	Type SecurityEventType `json:"type"`
+	At   time.Time         `json:"at"`
+
+	ContactPK []byte `json:"contact_pk,omitempty"`
+	DevicePK  []byte `json:"device_pk,omitempty"`
+	GroupPK   []byte `json:"group_pk,omitempty"`
+	Details   string `json:"details,omitempty"`
+
+	// Hash is the hash of the entry, the next one links to it
+	Hash []byte `json:"hash"`
+}
+
+// SecurityAuditHead is the last entry of a verified audit log, a client
+// keeping it notices the entries dropped from the end of the log later.
+type SecurityAuditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash []byte `json:"hash,omitempty"`
+}
+
+// EvtSecurityEvent is emitted on the event bus of the host when an entry is
+// added to the security audit log.
+type EvtSecurityEvent struct {
+	Event *SecurityEvent
+}
+
+// securityRecord is the signed content of an entry, Ref identifies what
+// it is about, e.g. the message which failed to decrypt, so it is logged once.
+type securityRecord struct {
+	Seq       uint64            `json:"seq"`
+	Type      SecurityEventType `json:"type"`
+	At        int64             `json:"at"`
+	ContactPK []byte            `json:"contact_pk,omitempty"`
+	DevicePK  []byte            `json:"device_pk,omitempty"`
+	GroupPK   []byte            `json:"group_pk,omitempty"`
+	Details   string            `json:"details,omitempty"`
+	Ref       string            `json:"ref,omitempty"`
+	Previous  []byte            `json:"previous,omitempty"`
+}
+
+type signedSecurityRecord struct {
+	Record    []byte `json:"record"`
+	Signature []byte `json:"signature"`
+}
+
+func securityRecordKey(seq uint64) datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%020d", seq))
+}
+
+// securityAudit appends the security events to the log, nothing is ever
+// removed from it.
+type securityAudit struct {
+	logger  *zap.Logger
+	store   datastore.Datastore
+	signer  crypto.PrivKey
+	emitter event.Emitter
+
+	lock     sync.Mutex
+	seq      uint64
+	head     []byte
+	refs     map[string]struct{}
+	failures []time.Time
+}
+
+func newSecurityAudit(logger *zap.Logger, store datastore.Datastore, signer crypto.PrivKey, h host.Host) (*securityAudit, error) {
+	sa := &securityAudit{
+		logger: logger,
+		store:  store,
+		signer: signer,
+		refs:   make(map[string]struct{}),
+	}
+
+	res, err := store.Query(query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		rec, hash, err := sa.open(entry.Value)
+		if err != nil {
+			logger.Warn("invalid security audit entry", zap.String("key", entry.Key), zap.Error(err))
+			continue
+		}
+
+		if rec.Seq > sa.seq {
+			sa.seq, sa.head = rec.Seq, hash
+		}
+
+		if rec.Ref != "" {
+			sa.refs[string(rec.Type)+"/"+rec.Ref] = struct{}{}
+		}
+	}
+
+	if h != nil {
+		if sa.emitter, err = h.EventBus().Emitter(new(EvtSecurityEvent)); err != nil {
+			return nil, err
+		}
+	}
+
+	return sa, nil
+}
+
+// open checks the signature of a stored entry, it returns its record and
+// its hash.
+func (sa *securityAudit) open(data []byte) (*securityRecord, []byte, error) {
+	signed := &signedSecurityRecord{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := sa.signer.GetPublic().Verify(signed.Record, signed.Signature); err != nil || !ok {
+		return nil, nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid security audit signature"))
+	}
+
+	rec := &securityRecord{}
+	if err := json.Unmarshal(signed.Record, rec); err != nil {
+		return nil, nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	hash := sha256.Sum256(signed.Record)
+
+	return rec, hash[:], nil
+}
+
+// record appends an entry to the log, an entry with the same type and ref as
+// a previous one isn't logged twice. The failed decryptions are capped.
+func (sa *securityAudit) record(rec *securityRecord, now time.Time) (*SecurityEvent, error) {
+	if sa == nil {
+		return nil, nil
+	}
+
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+
+	ref := string(rec.Type) + "/" + rec.Ref
+	if rec.Ref != "" {
+		if _, ok := sa.refs[ref]; ok {
+			return nil, nil
+		}
+	}
+
+	if rec.Type == SecurityDecryptionFailed {
+		recent := sa.failures[:0]
+		for _, at := range sa.failures {
+			if now.Sub(at) < time.Hour {
+				recent = append(recent, at)
+			}
+		}
+
+		if sa.failures = recent; len(recent) >= maxDecryptionFailures {
+			return nil, nil
+		}
+
+		sa.failures = append(sa.failures, now)
+	}
+
+	rec.Seq, rec.At, rec.Previous = sa.seq+1, now.UnixNano(), sa.head
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sig, err := sa.signer.Sign(data)
+	if err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	signed, err := json.Marshal(&signedSecurityRecord{Record: data, Signature: sig})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := sa.store.Put(securityRecordKey(rec.Seq), signed); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	hash := sha256.Sum256(data)
+	sa.seq, sa.head = rec.Seq, hash[:]
+	if rec.Ref != "" {
+		sa.refs[ref] = struct{}{}
+	}
+
+	return rec.public(hash[:]), nil
+}
+
+func (rec *securityRecord) public(hash []byte) *SecurityEvent {
+	return &SecurityEvent{
+		Seq:       rec.Seq,
+		Type:      rec.Type,
+		At:        time.Unix(0, rec.At),
+		ContactPK: rec.ContactPK,
+		DevicePK:  rec.DevicePK,
+		GroupPK:   rec.GroupPK,
+		Details:   rec.Details,
+		Hash:      hash,
+	}
+}
+
+// add records an entry and emits it, the errors are only logged as the
+// security events happen in the middle of other operations.
+func (sa *securityAudit) add(rec *securityRecord) {
+	if sa == nil {
+		return
+	}
+
+	e, err := sa.record(rec, time.Now())
+	if err != nil {
+		sa.logger.Warn("unable to record security event", zap.String("type", string(rec.Type)), zap.Error(err))
+		return
+	} else if e == nil || sa.emitter == nil {
+		return
+	}
+
+	if err := sa.emitter.Emit(EvtSecurityEvent{Event: e}); err != nil {
+		sa.logger.Warn("unable to emit security event", zap.Error(err))
+	}
+}
+
+// list returns the entries after since, oldest first, the ones of the given
+// types only if any.
+func (sa *securityAudit) list(since uint64, limit int, types ...SecurityEventType) ([]*SecurityEvent, error) {
+	if limit <= 0 {
+		limit = DefaultSecurityAuditPageSize
+	}
+
+	filter := map[SecurityEventType]bool{}
+	for _, t := range types {
+		filter[t] = true
+	}
+
+	sa.lock.Lock()
+	last := sa.seq
+	sa.lock.Unlock()
+
+	events := []*SecurityEvent{}
+	for seq := since + 1; seq <= last && len(events) < limit; seq++ {
+		data, err := sa.store.Get(securityRecordKey(seq))
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		rec, hash, err := sa.open(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(filter) == 0 || filter[rec.Type] {
+			events = append(events, rec.public(hash))
+		}
+	}
+
+	return events, nil
+}
+
+// verify walks the whole log, each entry must be signed, follow the previous
+// one and link to its hash.
+func (sa *securityAudit) verify() (*SecurityAuditHead, error) {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+
+	head := &SecurityAuditHead{}
+	for seq := uint64(1); seq <= sa.seq; seq++ {
+		data, err := sa.store.Get(securityRecordKey(seq))
+		if err == datastore.ErrNotFound {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("security audit entry %d missing", seq))
+		} else if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		rec, hash, err := sa.open(data)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("security audit entry %d: %w", seq, err))
+		}
+
+		if rec.Seq != seq || !bytes.Equal(rec.Previous, head.Hash) {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("security audit entry %d doesn't follow the previous one", seq))
+		}
+
+		head.Seq, head.Hash = seq, hash
+	}
+
+	if !bytes.Equal(head.Hash, sa.head) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("security audit log truncated"))
+	}
+
+	return head, nil
+}
+
+// SecurityAuditLog returns the entries of the security audit log after the
+// sequence since, oldest first, the ones of the given types only if any. At
+// most limit entries are returned, DefaultSecurityAuditPageSize if zero.
+func (s *service) SecurityAuditLog(_ context.Context, since uint64, limit int, types ...SecurityEventType) ([]*SecurityEvent, error) {
+	return s.audit.list(since, limit, types...)
+}
+
+// SecurityAuditVerify checks the chain of the security audit log and returns
+// its last entry, an error tells the log was edited.
+func (s *service) SecurityAuditVerify(context.Context) (*SecurityAuditHead, error) {
+	return s.audit.verify()
+}
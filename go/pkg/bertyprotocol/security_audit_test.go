@@ -0,0 +1,172 @@
+package bertyprotocol
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSecurityAudit(t *testing.T) {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	sa, err := newSecurityAudit(zap.NewNop(), store, sk, nil)
+	require.NoError(t, err)
+
+	head, err := sa.verify()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), head.Seq)
+
+	now := time.Now()
+	e, err := sa.record(&securityRecord{Type: SecurityKeyChanged, ContactPK: []byte("contact"), DevicePK: []byte("device")}, now)
+	require.NoError(t, err)
+	require.NotNil(t, e)
+	assert.Equal(t, uint64(1), e.Seq)
+
+	_, err = sa.record(&securityRecord{Type: SecurityDeviceRevoked, DevicePK: []byte("device")}, now)
+	require.NoError(t, err)
+
+	// a failed decryption is logged once by message
+	_, err = sa.record(&securityRecord{Type: SecurityDecryptionFailed, Ref: "cid"}, now)
+	require.NoError(t, err)
+
+	e, err = sa.record(&securityRecord{Type: SecurityDecryptionFailed, Ref: "cid"}, now)
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	events, err := sa.list(0, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, SecurityKeyChanged, events[0].Type)
+	assert.Equal(t, []byte("contact"), events[0].ContactPK)
+
+	events, err = sa.list(1, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, SecurityDeviceRevoked, events[0].Type)
+
+	events, err = sa.list(0, 0, SecurityDecryptionFailed)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, uint64(3), events[0].Seq)
+
+	head, err = sa.verify()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), head.Seq)
+	assert.Equal(t, events[0].Hash, head.Hash)
+
+	// the log is loaded again with its refs
+	reloaded, err := newSecurityAudit(zap.NewNop(), store, sk, nil)
+	require.NoError(t, err)
+
+	e, err = reloaded.record(&securityRecord{Type: SecurityDecryptionFailed, Ref: "cid"}, now)
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	e, err = reloaded.record(&securityRecord{Type: SecurityIdentityRotated}, now)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), e.Seq)
+
+	_, err = reloaded.verify()
+	require.NoError(t, err)
+}
+
+func TestSecurityAuditTampering(t *testing.T) {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	newLog := func() (*securityAudit, datastore.Datastore) {
+		store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+		sa, err := newSecurityAudit(zap.NewNop(), store, sk, nil)
+		require.NoError(t, err)
+
+		for _, typ := range []SecurityEventType{SecurityDeviceLinked, SecurityKeyChanged, SecurityDeviceRevoked} {
+			_, err := sa.record(&securityRecord{Type: typ}, time.Now())
+			require.NoError(t, err)
+		}
+
+		return sa, store
+	}
+
+	// an edited entry doesn't match its signature
+	sa, store := newLog()
+	data, err := store.Get(securityRecordKey(2))
+	require.NoError(t, err)
+
+	signed := &signedSecurityRecord{}
+	require.NoError(t, json.Unmarshal(data, signed))
+
+	rec := &securityRecord{}
+	require.NoError(t, json.Unmarshal(signed.Record, rec))
+	rec.Type = SecurityContactVerified
+
+	signed.Record, err = json.Marshal(rec)
+	require.NoError(t, err)
+
+	data, err = json.Marshal(signed)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(securityRecordKey(2), data))
+
+	_, err = sa.verify()
+	assert.Error(t, err)
+
+	// a removed entry breaks the chain
+	sa, store = newLog()
+	require.NoError(t, store.Delete(securityRecordKey(2)))
+
+	_, err = sa.verify()
+	assert.Error(t, err)
+
+	// an entry can't be moved, its previous hash doesn't match
+	sa, store = newLog()
+	data, err = store.Get(securityRecordKey(3))
+	require.NoError(t, err)
+	require.NoError(t, store.Put(securityRecordKey(2), data))
+
+	_, err = sa.verify()
+	assert.Error(t, err)
+
+	// nor the end of the log dropped while running
+	sa, store = newLog()
+	require.NoError(t, store.Delete(securityRecordKey(3)))
+
+	_, err = sa.verify()
+	assert.Error(t, err)
+}
+
+func TestSecurityAuditDecryptionFailures(t *testing.T) {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	sa, err := newSecurityAudit(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()), sk, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	for i := 0; i < maxDecryptionFailures; i++ {
+		e, err := sa.record(&securityRecord{Type: SecurityDecryptionFailed}, now)
+		require.NoError(t, err)
+		require.NotNil(t, e)
+	}
+
+	e, err := sa.record(&securityRecord{Type: SecurityDecryptionFailed}, now)
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	// the other events aren't capped
+	e, err = sa.record(&securityRecord{Type: SecurityKeyChanged}, now)
+	require.NoError(t, err)
+	assert.NotNil(t, e)
+
+	e, err = sa.record(&securityRecord{Type: SecurityDecryptionFailed}, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.NotNil(t, e)
+}
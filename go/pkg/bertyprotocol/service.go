@@ -2,10 +2,18 @@ package bertyprotocol
 
 import (
 	"context"
+	"io"
 	"sync"
 	"time"
 
+	"berty.tech/berty/v2/go/internal/attachment"
+	"berty.tech/berty/v2/go/internal/backup"
+	"berty.tech/berty/v2/go/internal/featureflag"
 	"berty.tech/berty/v2/go/internal/ipfsutil"
+	bertymetrics "berty.tech/berty/v2/go/internal/metrics"
+	"berty.tech/berty/v2/go/internal/pgp"
+	"berty.tech/berty/v2/go/internal/search"
+	"berty.tech/berty/v2/go/internal/storeforward"
 	"berty.tech/berty/v2/go/internal/tinder"
 	"berty.tech/berty/v2/go/internal/tracer"
 	"berty.tech/berty/v2/go/pkg/bertytypes"
@@ -20,19 +28,172 @@ import (
 	ipfs_core "github.com/ipfs/go-ipfs/core"
 	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/peer"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"go.opentelemetry.io/otel/api/trace"
 	"go.uber.org/zap"
 )
 
 var _ Service = (*service)(nil)
 
+// closeLoopsTimeout bounds the wait for the loops of the service on close
+const closeLoopsTimeout = 10 * time.Second
+
 // Service is the main Berty Protocol interface
 type Service interface {
 	ProtocolServiceServer
+	EventServiceServer
+	PeerServiceServer
+	WebhookServiceServer
 
 	Close() error
 	Status() Status
 	IpfsCoreAPI() ipfs_interface.CoreAPI
+	FeatureFlags() *featureflag.Manager
+	ContactListExport(ctx context.Context) (*ContactList, error)
+	ContactListImport(ctx context.Context, list *ContactList) (*ContactListImportReport, error)
+	RoomCreate(ctx context.Context, duration time.Duration) (*Room, error)
+	RoomJoin(ctx context.Context, code string) (*Room, error)
+	IsContactPeer(pid peer.ID) bool
+	StateSnapshot(ctx context.Context) (*StateSnapshot, error)
+	Diagnostics(ctx context.Context) (*Diagnostics, error)
+	ContactAvailability(ctx context.Context, contactPK []byte) (*ContactAvailability, error)
+	BootstrapPeerList(ctx context.Context) ([]*ipfsutil.BootstrapPeer, error)
+	BootstrapPeerAdd(ctx context.Context, addr string, priority int) error
+	BootstrapPeerRemove(ctx context.Context, addr string) error
+	BootstrapPeerSetPriority(ctx context.Context, addr string, priority int) error
+	SetOutgoingPayloadFilter(f OutgoingPayloadFilter)
+	SetIncomingPayloadObserver(f IncomingPayloadObserver)
+	BandwidthStats(ctx context.Context) (*ipfsutil.BandwidthStats, error)
+	BandwidthSeries(ctx context.Context, since time.Time) ([]*ipfsutil.BandwidthPoint, error)
+	PeerScores(ctx context.Context) ([]*ipfsutil.PeerScore, error)
+	NetworkChanged(connectivity ipfsutil.Connectivity) error
+	SetResourceHints(hints *ResourceHints) error
+	AttachmentAutoDownload(size int64) bool
+	ConversationPeers() []peer.ID
+	StoreForwardStats(ctx context.Context) (*storeforward.Stats, error)
+	EnvelopeDedupStats(ctx context.Context) (*EnvelopeDedupStats, error)
+	EnvelopeCompressionStats(ctx context.Context) (*EnvelopeCompressionStats, error)
+	SubscribeNodeEvents(ctx context.Context, req *EventStreamRequest) (<-chan *NodeEvent, error)
+	NFCPairingRecord(ctx context.Context, bleUUID string) ([]byte, error)
+	NFCPairingReceived(ctx context.Context, ndef []byte, ownMetadata []byte) error
+	InvitationCreate(ctx context.Context, ttl time.Duration) (string, error)
+	InvitationRedeem(ctx context.Context, link string) (peer.ID, error)
+	AppMessageSendWithID(ctx context.Context, groupPK []byte, payload []byte) ([]byte, error)
+	MessageDeliveryStatus(ctx context.Context, groupPK []byte, messageID []byte) (*MessageDelivery, error)
+	MessageSignature(ctx context.Context, groupPK []byte, messageID []byte) (*MessageSignature, error)
+	MessageReverify(ctx context.Context, groupPK []byte) (*MessageReverifyReport, error)
+	ConversationMarkRead(ctx context.Context, groupPK []byte) error
+	ConversationFlagSet(ctx context.Context, groupPK []byte, flag ConversationFlag, value bool, until time.Time) error
+	ConversationFlags(ctx context.Context, groupPK []byte) (*ConversationFlags, error)
+	ConversationList(ctx context.Context, archived bool) ([]*Conversation, error)
+	NotificationRuleSet(ctx context.Context, rule *NotificationRule) (*NotificationRule, error)
+	NotificationRuleDelete(ctx context.Context, id string) error
+	NotificationRuleList(ctx context.Context) ([]*NotificationRule, error)
+	DeviceSyncStatus(ctx context.Context) ([]*DeviceSyncState, error)
+	DeviceLinkOffer(ctx context.Context) (string, error)
+	DeviceLinkAccept(ctx context.Context, offer string) (*DeviceLink, error)
+	DeviceLinked(ctx context.Context) (*DeviceLink, error)
+	DeviceLinksIssued(ctx context.Context) ([]*DeviceLink, error)
+	AccountExport(ctx context.Context, passphrase string) ([]byte, error)
+	AccountImport(ctx context.Context, data []byte, passphrase string) (*AccountImportReport, error)
+	DeviceList(ctx context.Context) ([]*AccountDevice, error)
+	DeviceRevoke(ctx context.Context, devicePK []byte) error
+	ContactLifecycleList(ctx context.Context, states ...ContactLifecycleState) ([]*ContactLifecycle, error)
+	ContactRequestDecline(ctx context.Context, contactPK []byte) error
+	ContactRequestQuarantine(ctx context.Context) ([]*QuarantinedRequest, error)
+	ContactRequestRelease(ctx context.Context, contactPK []byte) error
+	ContactRequestQuarantineDrop(ctx context.Context, contactPK []byte) error
+	ContactVerification(ctx context.Context, contactPK []byte) (*ContactVerification, error)
+	ContactVerify(ctx context.Context, contactPK []byte, safetyNumber string) error
+	ContactUnverify(ctx context.Context, contactPK []byte) error
+	ContactMetadataSet(ctx context.Context, contactPK []byte, field ContactMetadataField, value string) error
+	ContactMetadata(ctx context.Context, contactPK []byte) (*ContactMetadata, error)
+	ProfileSet(ctx context.Context, displayName, avatar string) error
+	Profile(ctx context.Context) (*Profile, error)
+	ReadReceiptsSet(ctx context.Context, groupPK []byte, enabled bool) error
+	ReadReceiptsEnabled(ctx context.Context, groupPK []byte) (bool, error)
+	TypingSet(ctx context.Context, groupPK []byte, typing bool) error
+	TypingDevices(ctx context.Context, groupPK []byte) ([][]byte, error)
+	LocationShare(ctx context.Context, groupPK []byte, location *Location, duration time.Duration) ([]byte, error)
+	LocationUpdate(ctx context.Context, groupPK []byte, shareID []byte, location *Location) error
+	LocationShareStop(ctx context.Context, groupPK []byte, shareID []byte) error
+	LiveLocations(ctx context.Context, groupPK []byte) ([]*LiveLocation, error)
+	GroupMemberInvite(ctx context.Context, groupPK []byte, memberPK []byte) (*bertytypes.Group, error)
+	GroupMemberKick(ctx context.Context, groupPK []byte, memberPK []byte) error
+	GroupMembers(ctx context.Context, groupPK []byte) ([]*GroupMember, error)
+	MessageRetract(ctx context.Context, groupPK []byte, messageID []byte) error
+	MessageTombstone(ctx context.Context, groupPK []byte, messageID []byte) (*MessageTombstone, error)
+	MessageEdit(ctx context.Context, groupPK []byte, messageID []byte, payload []byte) error
+	MessageEditHistory(ctx context.Context, groupPK []byte, messageID []byte) ([]*MessageEdit, error)
+	MessageReact(ctx context.Context, groupPK []byte, messageID []byte, emoji string, add bool) error
+	MessageReactions(ctx context.Context, groupPK []byte, messageID []byte) ([]*MessageReaction, error)
+	PollCreate(ctx context.Context, groupPK []byte, question string, options []string, anonymous bool) ([]byte, error)
+	PollVote(ctx context.Context, groupPK []byte, pollID []byte, option int) error
+	PollClose(ctx context.Context, groupPK []byte, pollID []byte) error
+	PollResults(ctx context.Context, groupPK []byte, pollID []byte) (*PollResults, error)
+	MessageTTLSet(ctx context.Context, groupPK []byte, ttl time.Duration) error
+	MessageTTL(ctx context.Context, groupPK []byte) (*MessageTTL, error)
+	MessageExpiry(ctx context.Context, groupPK []byte, messageID []byte) (time.Time, error)
+	MessageSchedule(ctx context.Context, groupPK []byte, payload []byte, sendAt time.Time) (*ScheduledMessage, error)
+	MessageScheduleUpdate(ctx context.Context, id []byte, payload []byte, sendAt time.Time) (*ScheduledMessage, error)
+	MessageScheduleCancel(ctx context.Context, id []byte) error
+	MessageScheduledList(ctx context.Context, groupPK []byte) ([]*ScheduledMessage, error)
+	OutboundQueue(ctx context.Context, groupPK []byte) ([]*OutboundMessage, error)
+	OutboundFlush(ctx context.Context, groupPK []byte) (int, error)
+	OutboundDrop(ctx context.Context, groupPK []byte, messageID []byte) error
+	AttachmentAdd(ctx context.Context, r io.Reader) (*attachment.Descriptor, error)
+	AttachmentFetch(ctx context.Context, groupPK []byte, d *attachment.Descriptor) error
+	AttachmentRead(ctx context.Context, d *attachment.Descriptor, w io.Writer) error
+	AttachmentProgress(ctx context.Context, d *attachment.Descriptor) (*attachment.Progress, error)
+	AttachmentPin(ctx context.Context, d *attachment.Descriptor) error
+	AttachmentSubscribe(ctx context.Context) (<-chan *attachment.Progress, error)
+	StreamOpen(ctx context.Context) (*attachment.StreamWriter, error)
+	StreamFetch(ctx context.Context, groupPK []byte, d *attachment.StreamDescriptor) error
+	StreamChunk(ctx context.Context, d *attachment.StreamDescriptor, index int) ([]byte, bool, error)
+	StreamReader(ctx context.Context, d *attachment.StreamDescriptor) (io.Reader, error)
+	StreamProgress(ctx context.Context, d *attachment.StreamDescriptor) (*attachment.Progress, error)
+	SetSearchTextExtractor(f SearchTextExtractor)
+	MessageSearch(ctx context.Context, text string, groupPK []byte, limit int) ([]*MessageSearchResult, error)
+	MessageSearchRebuild(ctx context.Context, groupPK []byte) (int, error)
+
+	ConversationRetentionSet(ctx context.Context, p *RetentionPolicy) error
+	ConversationRetention(ctx context.Context, groupPK []byte) (*RetentionPolicy, error)
+	StorageUsage(ctx context.Context) (*StorageUsage, error)
+	StorageCollect(ctx context.Context) (*StorageCollectReport, error)
+
+	BackupScheduleSet(ctx context.Context, schedule *BackupSchedule, passphrase string) (*BackupStatus, error)
+	BackupScheduleGet(ctx context.Context) (*BackupStatus, error)
+	BackupRun(ctx context.Context) (*backup.Report, error)
+	BackupSnapshots(ctx context.Context) ([]*backup.Snapshot, error)
+
+	IdentityRotate(ctx context.Context) (*IdentityRotation, error)
+	IdentityChain(ctx context.Context, accountPK []byte) ([]*IdentityRotation, error)
+	IdentityKeyValid(ctx context.Context, accountPK, signerPK []byte, at time.Time) (bool, error)
+
+	PrekeyStatus(ctx context.Context) (*PrekeyStatus, error)
+	PrekeyReplenish(ctx context.Context) (*PrekeyStatus, error)
+
+	PushTokenRegister(ctx context.Context, platform, bundleID, token string) (*PushRegistration, error)
+	PushTokenUnregister(ctx context.Context) error
+	PushReceive(ctx context.Context, payload []byte) (*PushReceived, error)
+	BackgroundSync(ctx context.Context, budget time.Duration, pushes [][]byte) (*BackgroundSyncReport, error)
+
+	HandleRegister(ctx context.Context, handle string) (*HandleRegistration, error)
+	HandleLookup(ctx context.Context, handle string) (*bertytypes.ShareableContact, error)
+
+	ContactDiscoveryRegister(ctx context.Context, identifier string) error
+	ContactDiscoveryUnregister(ctx context.Context, identifier string) error
+	ContactDiscover(ctx context.Context, identifiers []string) ([]*DiscoveredContact, error)
+
+	IdentityOpenPGPKey(ctx context.Context) (string, error)
+	IdentityAttestationStatement(ctx context.Context) (string, error)
+	IdentityAttestationAdd(ctx context.Context, key, signature []byte) (*pgp.Identity, error)
+	IdentityAttestationRemove(ctx context.Context, fingerprint string) error
+
+	SecurityAuditLog(ctx context.Context, since uint64, limit int, types ...SecurityEventType) ([]*SecurityEvent, error)
+	SecurityAuditVerify(ctx context.Context) (*SecurityAuditHead, error)
 }
 
 type service struct {
@@ -43,10 +204,87 @@ type service struct {
 	odb            *bertyOrbitDB
 	accountGroup   *groupContext
 	deviceKeystore DeviceKeystore
+	featureFlags   *featureflag.Manager
 	openedGroups   map[string]*groupContext
 	groups         map[string]*bertytypes.Group
+	rooms          *roomManager
+	contactPeers   *contactPeers
+	availability   *contactAvailability
+	conversations  *conversationProtector
+	bootstrap      *ipfsutil.BootstrapManager
+	bandwidth      *ipfsutil.BandwidthMeter
+	scores         *ipfsutil.PeerScores
+	rendezvous     *contactRendezvous
+	network        *ipfsutil.NetworkReactor
+	storeForward   *storeforward.Service
+	attachments    *attachment.Service
+	attachQuota    int64
+	attachPublish  int64
+	retention      *retentionPolicies
+	rootDatastore  datastore.Batching
+	orbitDir       string
+	backups        *backupScheduler
+	identities     *identityChains
+	prekeys        *prekeyStore
+	pushTokens     *pushTokens
+	handles        *handleDirectories
+	discovery      *contactDiscovery
+	groupPubSub    *ipfsutil.GroupPubSub
+	invitations    *ipfsutil.InvitationManager
+	deliveries     *deliveryTracker
+	typing         *typingIndicators
+	locations      *liveLocations
+	retractions    *retractionTracker
+	edits          *messageEdits
+	reactions      *messageReactions
+	polls          *pollTallies
+	ephemeral      *ephemeralMessages
+	scheduled      *scheduledMessages
+	outbound       *outboundQueue
+	dedup          *envelopeDedup
+	compression    *envelopeCompression
+	parts          *envelopeReassembler
+	flags          *conversationFlags
+	notifRules     *notificationRules
+	devices        *deviceSync
+	digests        *syncDigests
+	links          *deviceLinks
+	imports        datastore.Datastore
+	searchIndex    *search.Index
+	revocations    *deviceRevocations
+	audit          *securityAudit
+	signatures     *messageSignatures
+	lifecycles     *contactLifecycles
+	requestGuard   *contactRequestGuard
+	blocks         *contactBlocks
+	verifications  *contactVerifications
+	contactMeta    *contactMetadatas
+	events         *nodeEvents
+	nat            *natStatus
+	webhooks       *webhookDispatcher
+	lanes          *ipfsutil.OutboundLanes
+	metrics        *bertymetrics.Registry
+	tracer         trace.Tracer
+	host           host.Host
+	disableRatchet bool
 	lock           sync.RWMutex
 	close          func() error
+
+	// cancel stops the loops of the service, Close waits for them
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+
+	muOutgoingFilter sync.RWMutex
+	outgoingFilter   OutgoingPayloadFilter
+
+	muIncomingObserver sync.RWMutex
+	incomingObserver   IncomingPayloadObserver
+
+	muSearchText sync.RWMutex
+	searchText   SearchTextExtractor
+
+	muResourceHints sync.RWMutex
+	resourceHints   *ResourceHints
 }
 
 // Opts contains optional configuration flags for building a new Client
@@ -63,7 +301,60 @@ type Opts struct {
 	RendezvousRotationBase time.Duration
 	Host                   host.Host
 	PubSub                 *pubsub.PubSub
-	close                  func() error
+	FeatureFlags           *featureflag.Manager
+	BootstrapAddrs         []string
+	BandwidthReporter      metrics.Reporter
+	StoreForward           bool
+	DisableGroupPubSub     bool
+	DisableDoubleRatchet   bool
+	HybridKEM              bool
+	PushRelay              string
+	Blocklist              *ipfsutil.Blocklist
+	AttachmentQuota        int64
+	KeyWrapper             ipfsutil.KeyWrapper
+
+	// AttachmentPublishSize is the size from which the attachments added are
+	// published on IPFS, pinned on AttachmentPinning too if set, instead of
+	// being sent to each member. They are never published if zero.
+	AttachmentPublishSize int64
+	AttachmentPinning     *attachment.PinningService
+
+	// HandleDirectory is the addr of the directory the handles are
+	// registered on and looked up from, disabled if empty
+	HandleDirectory string
+
+	// ContactDiscovery is the addr of the contact discovery service the
+	// identifiers of the address book are looked up on, disabled if empty
+	ContactDiscovery string
+
+	// ContactRequestPoWDifficulty is the bits of proof of work asked to the
+	// senders of the contact requests, DefaultContactRequestPoWDifficulty if
+	// zero, none if negative
+	ContactRequestPoWDifficulty int
+
+	// ContactRequestsPerSource caps the contact requests of a peer, a network
+	// or a stranger in an hour, DefaultContactRequestsPerSource if zero
+	ContactRequestsPerSource int
+
+	// ContactRequestQuarantineScore is the spam score from which the requests
+	// of the strangers are quarantined, DefaultContactRequestQuarantineScore
+	// if zero, never if negative
+	ContactRequestQuarantineScore int
+
+	// EnvelopeCompression compresses the message payloads over
+	// EnvelopeCompressionThreshold bytes, DefaultEnvelopeCompressionThreshold
+	// if zero, in the groups whose other devices enabled it too
+	EnvelopeCompression          bool
+	EnvelopeCompressionThreshold int
+
+	// Metrics, if set, records the metrics of the node
+	Metrics *bertymetrics.Registry
+
+	// Startup, if set, records the identity stage once the account is
+	// opened, the stages are published as node events
+	Startup *StartupProgress
+
+	close func() error
 }
 
 func (opts *Opts) applyDefaults() error {
@@ -84,7 +375,24 @@ func (opts *Opts) applyDefaults() error {
 	}
 
 	if opts.DeviceKeystore == nil {
-		ks := ipfsutil.NewDatastoreKeystore(ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("accountGroup")))
+		ds := ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("accountGroup"))
+		ks := ipfsutil.NewDatastoreKeystore(ds)
+
+		// the keys stored before are wrapped right away, not on their first
+		// use, so none is left unwrapped on the disk
+		if opts.KeyWrapper != nil {
+			count, err := ipfsutil.WrapKeystoreKeys(ds, opts.KeyWrapper)
+			if err != nil {
+				return errcode.ErrCryptoEncrypt.Wrap(err)
+			}
+
+			if count > 0 {
+				opts.Logger.Info("device keys wrapped", zap.Int("count", count), zap.Bool("hardware", opts.KeyWrapper.Hardware()))
+			}
+
+			ks = ipfsutil.NewWrappedKeystore(ds, opts.KeyWrapper)
+		}
+
 		opts.DeviceKeystore = NewDeviceKeystore(ks)
 	}
 
@@ -93,6 +401,11 @@ func (opts *Opts) applyDefaults() error {
 		opts.MessageKeystore = NewMessageKeystore(mk)
 	}
 
+	if opts.FeatureFlags == nil {
+		fs := ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("features"))
+		opts.FeatureFlags = featureflag.New(opts.Logger, opts.Host, fs)
+	}
+
 	if opts.RendezvousRotationBase.Nanoseconds() <= 0 {
 		opts.RendezvousRotationBase = time.Hour * 24
 	}
@@ -125,6 +438,22 @@ func New(opts Opts) (Service, error) {
 		return nil, errcode.TODO.Wrap(err)
 	}
 
+	// the loops of the service stop once it is closed, even if the root
+	// context isn't canceled
+	rootCtx, cancel := context.WithCancel(opts.RootContext)
+	opts.RootContext = rootCtx
+
+	started := false
+	defer func() {
+		if !started {
+			cancel()
+		}
+	}()
+
+	if err := migrateDatastore(opts.Logger.Named("migrate"), opts.RootDatastore); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
 	orbitDirectory := opts.OrbitDirectory
 	odbOpts := &orbitdb.NewOrbitDBOptions{
 		Cache:     opts.OrbitCache,
@@ -151,28 +480,207 @@ func New(opts Opts) (Service, error) {
 		return nil, errcode.TODO.Wrap(err)
 	}
 
+	odb.ratchets = newRatchetManager(opts.Logger.Named("ratchet"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("ratchets")), opts.DeviceKeystore)
+	odb.ratchets.hybrid = opts.HybridKEM
+
+	odb.revocations, err = newDeviceRevocations(opts.Logger.Named("revocation"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("deviceRevocations")))
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	identities, err := newIdentityChains(opts.Logger.Named("identity"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("identityChains")))
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+	odb.revocations.identities = identities
+
+	deviceSK, err := opts.DeviceKeystore.DevicePrivKey()
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	odb.audit, err = newSecurityAudit(opts.Logger.Named("audit"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("securityAudit")), deviceSK, opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	odb.signatures = newMessageSignatures(opts.Logger.Named("signature"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("messageSignatures")))
+	odb.signatures.revocations = odb.revocations
+	odb.signatures.identities = identities
+	odb.signatures.audit = odb.audit
+	odb.signatures.members = odb.memberByDevice
+
+	lifecycles, err := newContactLifecycles(opts.Logger.Named("lifecycle"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("contactLifecycles")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	verifications, err := newContactVerifications(opts.Logger.Named("verification"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("contactVerifications")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	contactMetadata, err := newContactMetadatas(opts.Logger.Named("contact-meta"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("contactMetadata")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
 	acc, err := odb.OpenAccountGroup(opts.RootContext, nil)
 	if err != nil {
 		return nil, errcode.TODO.Wrap(err)
 	}
 
+	if opts.Startup != nil {
+		opts.Startup.Done(StartupStageIdentity, nil)
+	}
+
+	requestGuard, err := newContactRequestGuard(opts.Logger.Named("request-guard"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("contactRequestQuarantine")), opts.Host, contactRequestGuardOpts{
+		PoWDifficulty:     opts.ContactRequestPoWDifficulty,
+		RequestsPerSource: opts.ContactRequestsPerSource,
+		QuarantineScore:   opts.ContactRequestQuarantineScore,
+	})
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
 	if opts.TinderDriver != nil {
 		s := NewSwiper(opts.Logger, opts.PubSub, opts.RendezvousRotationBase)
 		opts.Logger.Debug("tinder swiper is enabled")
 
-		if err := initContactRequestsManager(opts.RootContext, s, acc.metadataStore, opts.IpfsCoreAPI, opts.Logger); err != nil {
+		if err := initContactRequestsManager(opts.RootContext, s, acc.metadataStore, opts.IpfsCoreAPI, opts.Logger, requestGuard, lifecycles.requestReceived); err != nil {
 			return nil, errcode.TODO.Wrap(err)
 		}
 	} else {
 		opts.Logger.Warn("no tinder driver provided, incoming and outgoing contact requests won't be enabled")
 	}
 
-	return &service{
+	var bootstrap *ipfsutil.BootstrapManager
+	if opts.BootstrapAddrs != nil && opts.Host != nil {
+		bootstrap, err = ipfsutil.NewBootstrapManager(opts.Host, ipfsutil.BootstrapOpts{
+			Logger:    opts.Logger.Named("bootstrap"),
+			Datastore: ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("bootstrap")),
+			Defaults:  opts.BootstrapAddrs,
+		})
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		bootstrap.Start(opts.RootContext)
+	}
+
+	var bandwidth *ipfsutil.BandwidthMeter
+	if opts.BandwidthReporter != nil && opts.Host != nil {
+		bandwidth, err = ipfsutil.NewBandwidthMeter(opts.Host, opts.BandwidthReporter, ipfsutil.BandwidthMeterOpts{
+			Logger:    opts.Logger.Named("bandwidth"),
+			Datastore: ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("bandwidth")),
+		})
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		bandwidth.Start(opts.RootContext)
+	}
+
+	var scores *ipfsutil.PeerScores
+	if opts.Host != nil {
+		scores, err = ipfsutil.NewPeerScores(opts.Host, ipfsutil.PeerScoresOpts{
+			Logger:    opts.Logger.Named("scores"),
+			Datastore: ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("peerScores")),
+		})
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		scores.Start(opts.RootContext)
+	}
+
+	var rendezvous *contactRendezvous
+	if opts.TinderDriver != nil && opts.Host != nil {
+		rendezvous = newContactRendezvous(opts.Logger.Named("rendezvous"), opts.Host, opts.TinderDriver, opts.RendezvousRotationBase)
+	}
+
+	conversations := newConversationProtector(opts.IpfsCoreAPI.ConnMgr(), defaultConversationProtection)
+
+	var network *ipfsutil.NetworkReactor
+	if opts.Host != nil {
+		network = ipfsutil.NewNetworkReactor(opts.Host, ipfsutil.NetworkReactorOpts{
+			Logger: opts.Logger.Named("network"),
+			Peers:  conversations.activePeers,
+		})
+
+		network.Start(opts.RootContext)
+	}
+
+	deliveries, err := newDeliveryTracker(opts.Logger.Named("delivery"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("deliveryAcks")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	typing, err := newTypingIndicators(opts.Logger.Named("typing"), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	locations, err := newLiveLocations(opts.Logger.Named("location"), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	retractions, err := newRetractionTracker(opts.Logger.Named("retraction"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("retractions")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	edits, err := newMessageEdits(opts.Logger.Named("edit"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("messageEdits")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	reactions, err := newMessageReactions(opts.Logger.Named("reaction"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("messageReactions")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	polls, err := newPollTallies(opts.Logger.Named("poll"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("polls")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	ephemeral, err := newEphemeralMessages(opts.Logger.Named("ephemeral"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("ephemeralMessages")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	scheduled, err := newScheduledMessages(opts.Logger.Named("scheduled"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("scheduledMessages")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	outbound, err := newOutboundQueue(opts.Logger.Named("outbound"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("outboundQueue")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	dedup, err := newEnvelopeDedup(opts.Logger.Named("dedup"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("envelopeDedup")))
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	flags, err := newConversationFlags(opts.Logger.Named("flags"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("conversationFlags")), opts.Host)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	rooms := newRoomManager(opts.Logger.Named("rooms"), opts.Host, opts.TinderDriver, ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("rooms")))
+
+	svc := &service{
 		ctx:            opts.RootContext,
+		cancel:         cancel,
 		ipfsCoreAPI:    opts.IpfsCoreAPI,
 		logger:         opts.Logger,
 		odb:            odb,
 		deviceKeystore: opts.DeviceKeystore,
+		featureFlags:   opts.FeatureFlags,
 		close:          opts.close,
 		accountGroup:   acc,
 		groups: map[string]*bertytypes.Group{
@@ -181,14 +689,231 @@ func New(opts Opts) (Service, error) {
 		openedGroups: map[string]*groupContext{
 			string(acc.Group().PublicKey): acc,
 		},
-	}, nil
+		rooms: rooms,
+		nat:   &natStatus{},
+		contactPeers: &contactPeers{
+			logger: opts.Logger,
+			store:  ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("contactPeers")),
+		},
+		availability: &contactAvailability{
+			logger: opts.Logger,
+			store:  ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("contactAvailability")),
+			host:   opts.Host,
+		},
+		conversations: conversations,
+		bootstrap:     bootstrap,
+		bandwidth:     bandwidth,
+		scores:        scores,
+		rendezvous:    rendezvous,
+		network:       network,
+		host:          opts.Host,
+		deliveries:    deliveries,
+		typing:        typing,
+		locations:     locations,
+		retractions:   retractions,
+		edits:         edits,
+		reactions:     reactions,
+		polls:         polls,
+		ephemeral:     ephemeral,
+		scheduled:     scheduled,
+		outbound:      outbound,
+		dedup:         dedup,
+		flags:         flags,
+		notifRules:    newNotificationRules(opts.Logger.Named("notifications"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("notificationRules"))),
+		parts:         newEnvelopeReassembler(opts.Logger.Named("parts"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("envelopeParts"))),
+		devices:       newDeviceSync(),
+		digests:       newSyncDigests(),
+		revocations:   odb.revocations,
+		audit:         odb.audit,
+		signatures:    odb.signatures,
+		identities:    identities,
+		prekeys:       newPrekeyStore(opts.Logger.Named("prekey"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("prekeys")), opts.DeviceKeystore),
+		lifecycles:    lifecycles,
+		requestGuard:  requestGuard,
+		verifications: verifications,
+		contactMeta:   contactMetadata,
+		events:        newNodeEvents(opts.Logger.Named("events")),
+		blocks:        newContactBlocks(opts.Logger.Named("blocks"), opts.Blocklist),
+		links:         newDeviceLinks(opts.Logger.Named("link"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("deviceLinks"))),
+		imports:       ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("accountImport")),
+		searchIndex:   search.New(ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("messageSearch"))),
+		retention:     newRetentionPolicies(opts.Logger.Named("retention"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("retentionPolicies"))),
+		attachQuota:   opts.AttachmentQuota,
+		attachPublish: opts.AttachmentPublishSize,
+		rootDatastore: opts.RootDatastore,
+		orbitDir:      opts.OrbitDirectory,
+		backups:       newBackupScheduler(opts.Logger.Named("backup"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey(BackupNamespace))),
+		lanes:         ipfsutil.NewOutboundLanes(),
+		metrics:       opts.Metrics,
+		tracer:        tracer.New("berty-protocol"),
+
+		disableRatchet: opts.DisableDoubleRatchet,
+	}
+
+	if opts.EnvelopeCompression {
+		svc.compression = newEnvelopeCompression(opts.EnvelopeCompressionThreshold, opts.Metrics)
+	}
+
+	svc.pushTokens, err = newPushTokens(opts.Logger.Named("push"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("push")), opts.PushRelay)
+	if err != nil {
+		return nil, err
+	}
+
+	svc.handles, err = newHandleDirectories(opts.Logger.Named("handles"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("handleDirectory")), opts.HandleDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	svc.discovery, err = newContactDiscovery(opts.Logger.Named("discovery"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("contactDiscovery")), opts.ContactDiscovery)
+	if err != nil {
+		return nil, err
+	}
+
+	odb.ratchets.announce = svc.announceRatchetKey
+	ephemeral.expire = svc.expireMessage
+	scheduled.send = svc.sendScheduled
+	outbound.retry = svc.retryOutbound
+	outbound.connectivity = svc.outboundConnectivity
+	deliveries.delivered = opts.Metrics.ObserveDeliveryLatency
+
+	svc.webhooks, err = newWebhookDispatcher(opts.Logger.Named("webhooks"), ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("webhooks")), svc.events)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if opts.StoreForward && opts.Host != nil {
+		svc.storeForward, err = storeforward.New(opts.Host, storeforward.Opts{
+			Logger:    opts.Logger.Named("storeforward"),
+			Datastore: ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("storeForward")),
+			Deliver:   svc.deliverBundle,
+			Expired:   svc.bundleExpired,
+			Scores:    scores,
+		})
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		svc.storeForward.Start(opts.RootContext)
+	}
+
+	if opts.Host != nil {
+		svc.attachments, err = attachment.New(opts.Host, attachment.Opts{
+			Logger:    opts.Logger.Named("attachment"),
+			Datastore: ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("attachments")),
+			Allow:     conversations.hasPeer,
+			Lanes:     svc.lanes,
+			Quota:     opts.AttachmentQuota,
+			IPFS:      opts.IpfsCoreAPI,
+			Pinning:   opts.AttachmentPinning,
+
+			AutoResume: svc.AttachmentAutoDownload,
+		})
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		svc.attachments.Start(opts.RootContext)
+
+		opts.Host.SetStreamHandler(deliveryAckProtocolID, svc.handleDeliveryAcks)
+		opts.Host.SetStreamHandler(typingProtocolID, svc.handleTypingSignal)
+		opts.Host.SetStreamHandler(locationProtocolID, svc.handleLocationSignal)
+		opts.Host.SetStreamHandler(deviceSyncProtocolID, svc.handleDeviceSync)
+		opts.Host.SetStreamHandler(syncDigestProtocolID, svc.handleSyncDigest)
+		svc.watchEncounters(opts.RootContext)
+		opts.Host.SetStreamHandler(deviceLinkProtocolID, svc.handleDeviceLink)
+		svc.revocations.rejectPeers(opts.Host.Network())
+
+		opts.Host.SetStreamHandler(contactResponseProtocolID, svc.handleContactResponse)
+		svc.deliverPendingDeclines(opts.RootContext)
+
+		svc.invitations, err = ipfsutil.NewInvitationManager(opts.Host, ipfsutil.InvitationOpts{
+			Logger:    opts.Logger.Named("invitations"),
+			Datastore: ipfsutil.NewNamespacedDatastore(opts.RootDatastore, datastore.NewKey("invitations")),
+			Handler:   svc.invitationRedeemed,
+		})
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		svc.spawn(func() { svc.expireInvitations(opts.RootContext) })
+	}
+
+	if opts.Host != nil && opts.PubSub != nil && !opts.DisableGroupPubSub {
+		svc.groupPubSub = svc.newGroupPubSub(&opts)
+	}
+
+	svc.spawn(svc.restoreRooms)
+	svc.spawn(svc.scheduled.start)
+	svc.spawn(func() { svc.outbound.run(opts.RootContext) })
+	svc.spawn(func() { svc.dedup.gcLoop(opts.RootContext) })
+	svc.spawn(func() { svc.parts.gcLoop(opts.RootContext) })
+	svc.spawn(func() { svc.availability.watchOwnPeers(opts.RootContext, acc) })
+	svc.spawn(func() { svc.watchConversationFlags(opts.RootContext, acc) })
+	svc.spawn(func() { svc.watchNotificationRules(opts.RootContext, acc) })
+	svc.spawn(func() { svc.watchOwnDevices(opts.RootContext, acc) })
+	svc.spawn(func() { svc.watchDeviceRevocations(opts.RootContext, acc) })
+	svc.spawn(func() { svc.watchIdentityRotations(opts.RootContext, acc) })
+	svc.spawn(func() { svc.watchContactLifecycle(opts.RootContext, acc) })
+	svc.spawn(func() { svc.watchContactBlocks(opts.RootContext, acc) })
+	svc.spawn(func() { svc.watchContactMetadata(opts.RootContext, acc) })
+	svc.spawn(func() { svc.availability.sampleLoop(opts.RootContext) })
+	svc.spawn(func() { svc.watchNATStatus(opts.RootContext) })
+	svc.spawn(func() { svc.publishNetworkActivity(opts.RootContext) })
+	svc.spawn(func() { svc.restoreAccountImport(opts.RootContext) })
+	if svc.attachments != nil {
+		svc.spawn(func() { svc.storageGCLoop(opts.RootContext) })
+	}
+	svc.spawn(func() { svc.backupLoop(opts.RootContext) })
+	if svc.storeForward != nil {
+		svc.spawn(func() { svc.prekeyLoop(opts.RootContext) })
+	}
+	svc.registerMetrics(opts.Metrics)
+	svc.events.start(opts.RootContext, opts.Host)
+	if opts.Startup != nil {
+		opts.Startup.attach(svc.events)
+	}
+	svc.webhooks.start(opts.RootContext)
+
+	started = true
+
+	return svc, nil
+}
+
+// spawn runs a loop of the service, Close waits for it to return.
+func (s *service) spawn(f func()) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		f()
+	}()
 }
 
 func (s *service) IpfsCoreAPI() ipfs_interface.CoreAPI {
 	return s.ipfsCoreAPI
 }
 
+func (s *service) FeatureFlags() *featureflag.Manager {
+	return s.featureFlags
+}
+
 func (s *service) Close() error {
+	// the loops stop before the stores and the node they use are closed
+	s.cancel()
+	s.scheduled.stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(closeLoopsTimeout):
+		s.logger.Warn("service loops still running after close", zap.Duration("timeout", closeLoopsTimeout))
+	}
+
+	s.rooms.closeAll()
 	s.odb.Close()
 	if s.close != nil {
 		s.close()
@@ -2,11 +2,14 @@ package bertyprotocol
 
 import (
 	"fmt"
+	"time"
 
+	"berty.tech/berty/v2/go/internal/tracer"
 	"berty.tech/berty/v2/go/pkg/bertytypes"
 	"berty.tech/berty/v2/go/pkg/errcode"
 	"berty.tech/go-orbit-db/stores"
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 func (s *service) indexGroups() error {
@@ -118,6 +121,9 @@ func (s *service) deactivateGroup(pk crypto.PubKey) error {
 	defer s.lock.Unlock()
 
 	delete(s.groups, string(id))
+	s.conversations.removeGroup(id)
+	s.rendezvous.stop(id)
+	s.leaveGroupTopic(id)
 
 	return nil
 }
@@ -154,19 +160,51 @@ func (s *service) activateGroup(pk crypto.PubKey) error {
 		}
 
 		s.openedGroups[string(id)] = cg
+		s.rendezvous.start(s.ctx, g)
+		s.joinGroupTopic(g)
+
+		switch g.GroupType {
+		case bertytypes.GroupTypeMultiMember:
+			go s.announceMembership(cg)
+			go s.announcePushToken(g)
+		case bertytypes.GroupTypeContact:
+			go s.announceRatchetKey(g)
+			go s.announcePushToken(g)
+			go s.watchDeviceRevocations(s.ctx, cg)
+			go s.watchIdentityRotations(s.ctx, cg)
+			go s.watchContactResponses(s.ctx, cg)
+			go s.watchContactKeys(s.ctx, cg)
+			go s.watchContactProfile(s.ctx, cg)
+		}
+
+		if s.compression != nil {
+			go s.announceEnvelopeCompression(g)
+		}
 
 		go func() {
 			for e := range cg.metadataStore.Subscribe(s.ctx) {
-				if evt, ok := e.(*stores.EventNewPeer); ok {
-					s.ipfsCoreAPI.ConnMgr().TagPeer(evt.Peer, fmt.Sprintf("grp_%s", string(id)), 42)
+				switch evt := e.(type) {
+				case *stores.EventNewPeer:
+					s.groupPeerJoined(g, id, evt.Peer)
+				case *EventMembershipChanged:
+					go s.rotateDeviceSecret(cg, evt)
 				}
 			}
 		}()
 
+		// the deletions postponed while the group wasn't active
+		s.ephemeral.arm(id)
+
 		go func() {
 			for e := range cg.messageStore.Subscribe(s.ctx) {
-				if evt, ok := e.(*stores.EventNewPeer); ok {
-					s.ipfsCoreAPI.ConnMgr().TagPeer(evt.Peer, fmt.Sprintf("grp_%s", string(id)), 42)
+				switch evt := e.(type) {
+				case *stores.EventNewPeer:
+					s.groupPeerJoined(g, id, evt.Peer)
+				case *stores.EventWrite, *stores.EventReplicateProgress:
+					// the conversation is active, its peers can't be pruned
+					s.conversations.touch(id)
+				case *bertytypes.GroupMessageEvent:
+					s.dispatchMessage(cg, evt)
 				}
 			}
 		}()
@@ -179,6 +217,40 @@ func (s *service) activateGroup(pk crypto.PubKey) error {
 	return errcode.ErrInternal.Wrap(fmt.Errorf("unknown group type"))
 }
 
+// dispatchMessage hands a message of a group to the trackers of the control
+// messages, the index and the observers. Its span is linked to the one of its
+// sender.
+func (s *service) dispatchMessage(cg *groupContext, evt *bertytypes.GroupMessageEvent) {
+	_, span := tracer.StartFromMessageHeaders(s.tracer, evt.Headers, "Dispatch Message")
+	defer span.End()
+
+	evt, _ = s.trackEphemeral(cg, evt)
+	control := s.trackRetraction(cg, evt) || s.trackEdit(cg, evt) || s.trackReaction(cg, evt) || s.trackTTL(cg, evt) || s.trackPoll(cg, evt)
+	s.indexMessage(cg, evt)
+	if control {
+		return
+	}
+
+	s.observeIncoming(cg.Group(), evt)
+	s.acknowledgeMessage(cg.Group(), evt)
+}
+
+func (s *service) groupPeerJoined(g *bertytypes.Group, id []byte, pid peer.ID) {
+	s.ipfsCoreAPI.ConnMgr().TagPeer(pid, fmt.Sprintf("grp_%s", string(id)), 42)
+	s.conversations.addPeer(id, pid)
+	s.flushDeliveryAcks(g.PublicKey)
+
+	if g.GroupType == bertytypes.GroupTypeContact {
+		s.ipfsCoreAPI.ConnMgr().Protect(pid, contactProtectionTag(id))
+		s.contactPeers.add(pid)
+		s.availability.seen(g.PublicKey, pid, time.Now())
+
+		if !s.availability.isOwnPeer(pid) {
+			s.blocks.peerJoined(g.PublicKey, pid)
+		}
+	}
+}
+
 func (s *service) getContextGroupForID(id []byte) (*groupContext, error) {
 	if len(id) == 0 {
 		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("no group id provided"))
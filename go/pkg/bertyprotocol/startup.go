@@ -0,0 +1,89 @@
+package bertyprotocol
+
+import (
+	"sync"
+	"time"
+)
+
+// NodeEventStartup is published when a stage of the startup of the node is
+// done, see StartupProgress.
+const NodeEventStartup = "startup"
+
+// The stages of the startup of a node, in order. The app is interactive once
+// the API is ready, the transports and the discovery warm up in the
+// background.
+const (
+	StartupStageStorage    = "storage"
+	StartupStageIdentity   = "identity"
+	StartupStageAPIReady   = "api_ready"
+	StartupStageTransports = "transports"
+	StartupStageDiscovery  = "discovery"
+)
+
+// StartupEvent is the payload of the NodeEventStartup events.
+type StartupEvent struct {
+	Stage string `json:"stage"`
+
+	// ElapsedMS is the time since the startup began
+	ElapsedMS int64 `json:"elapsed_ms"`
+
+	// Error is set if the stage failed, the node runs without it
+	Error string `json:"error,omitempty"`
+}
+
+// StartupProgress records the stages of the startup of a node, e.g. to
+// measure the cold start of a mobile app. The service publishes the stages
+// as node events, including the ones done before it was created, see
+// Opts.Startup.
+type StartupProgress struct {
+	mu      sync.Mutex
+	started time.Time
+	stages  []*StartupEvent
+	events  *nodeEvents
+	now     func() time.Time
+}
+
+func NewStartupProgress() *StartupProgress {
+	return &StartupProgress{
+		started: time.Now(),
+		stages:  []*StartupEvent{},
+		now:     time.Now,
+	}
+}
+
+// Done records a stage, err is the reason it failed.
+func (p *StartupProgress) Done(stage string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := &StartupEvent{
+		Stage:     stage,
+		ElapsedMS: p.now().Sub(p.started).Milliseconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	p.stages = append(p.stages, e)
+	p.events.publish(NodeEventStartup, nil, "", e)
+}
+
+// Stages returns the stages done, in order.
+func (p *StartupProgress) Stages() []*StartupEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]*StartupEvent{}, p.stages...)
+}
+
+// attach publishes the stages done so far to the events of a service, and
+// the next ones as they are done.
+func (p *StartupProgress) attach(events *nodeEvents) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.events = events
+	for _, e := range p.stages {
+		events.publish(NodeEventStartup, nil, "", e)
+	}
+}
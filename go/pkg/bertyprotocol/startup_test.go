@@ -0,0 +1,38 @@
+package bertyprotocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStartupProgress(t *testing.T) {
+	p := NewStartupProgress()
+
+	now := p.started
+	p.now = func() time.Time { return now }
+
+	now = now.Add(10 * time.Millisecond)
+	p.Done(StartupStageStorage, nil)
+
+	// the stages done before the service are published once attached
+	ne := newNodeEvents(zap.NewNop())
+	_, sub, err := ne.subscribe(&EventStreamRequest{Types: []string{NodeEventStartup}})
+	require.NoError(t, err)
+
+	p.attach(ne)
+	assert.JSONEq(t, `{"stage":"storage","elapsed_ms":10}`, string((<-sub.ch).Payload))
+
+	now = now.Add(20 * time.Millisecond)
+	p.Done(StartupStageTransports, fmt.Errorf("no listener"))
+	assert.JSONEq(t, `{"stage":"transports","elapsed_ms":30,"error":"no listener"}`, string((<-sub.ch).Payload))
+
+	stages := p.Stages()
+	require.Len(t, stages, 2)
+	assert.Equal(t, StartupStageStorage, stages[0].Stage)
+	assert.Equal(t, StartupStageTransports, stages[1].Stage)
+}
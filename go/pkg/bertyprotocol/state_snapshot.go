@@ -0,0 +1,270 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfslog "berty.tech/go-ipfs-log"
+)
+
+// StateSnapshotVersion is the version of the state snapshot format produced
+// by this package.
+const StateSnapshotVersion = 1
+
+// StateSnapshot is a canonical hash tree of the state of an account: the
+// root hashes the groups, each group hashes its metadata and message logs,
+// each log hashes the sorted CIDs of its entries. Two devices of the same
+// account in sync have the same root.
+type StateSnapshot struct {
+	Version   int              `json:"version"`
+	AccountPK []byte           `json:"account_pk"`
+	Date      time.Time        `json:"date"`
+	Root      string           `json:"root"`
+	Groups    []*GroupSnapshot `json:"groups"`
+}
+
+// GroupSnapshot is a node of the state snapshot tree. The logs are only
+// available if the group is opened on the device.
+type GroupSnapshot struct {
+	GroupPK   []byte               `json:"group_pk"`
+	GroupType bertytypes.GroupType `json:"group_type"`
+	Opened    bool                 `json:"opened"`
+	Hash      string               `json:"hash"`
+	Metadata  *LogSnapshot         `json:"metadata,omitempty"`
+	Messages  *LogSnapshot         `json:"messages,omitempty"`
+}
+
+// LogSnapshot is a leaf of the state snapshot tree.
+type LogSnapshot struct {
+	Hash    string   `json:"hash"`
+	Entries []string `json:"entries"`
+}
+
+// StateSnapshotDiff lists the divergences between two snapshots.
+type StateSnapshotDiff struct {
+	// OnlyInA and OnlyInB are the groups known by a single device
+	OnlyInA [][]byte `json:"only_in_a,omitempty"`
+	OnlyInB [][]byte `json:"only_in_b,omitempty"`
+
+	Groups []*GroupSnapshotDiff `json:"groups,omitempty"`
+}
+
+// GroupSnapshotDiff lists the divergences of a group known by both devices.
+type GroupSnapshotDiff struct {
+	GroupPK []byte `json:"group_pk"`
+
+	// OpenedOnlyInA and OpenedOnlyInB are set if the group logs are only
+	// available on one device, the entries aren't compared in that case
+	OpenedOnlyInA bool `json:"opened_only_in_a,omitempty"`
+	OpenedOnlyInB bool `json:"opened_only_in_b,omitempty"`
+
+	Metadata *LogSnapshotDiff `json:"metadata,omitempty"`
+	Messages *LogSnapshotDiff `json:"messages,omitempty"`
+}
+
+// LogSnapshotDiff lists the entries of a log only found on one device.
+type LogSnapshotDiff struct {
+	OnlyInA []string `json:"only_in_a,omitempty"`
+	OnlyInB []string `json:"only_in_b,omitempty"`
+}
+
+// Empty reports whether both snapshots are identical.
+func (d *StateSnapshotDiff) Empty() bool {
+	return len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.Groups) == 0
+}
+
+func hashNodes(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		// length-prefixed, so the concatenation is unambiguous
+		_, _ = h.Write([]byte(fmt.Sprintf("%d:", len(p))))
+		_, _ = h.Write(p)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newLogSnapshot(log ipfslog.Log) *LogSnapshot {
+	entries := []string{}
+	for _, e := range log.GetEntries().Slice() {
+		entries = append(entries, e.GetHash().String())
+	}
+
+	sort.Strings(entries)
+
+	parts := make([][]byte, len(entries))
+	for i, e := range entries {
+		parts[i] = []byte(e)
+	}
+
+	return &LogSnapshot{Hash: hashNodes(parts...), Entries: entries}
+}
+
+func newGroupSnapshot(g *bertytypes.Group, cg *groupContext) *GroupSnapshot {
+	gs := &GroupSnapshot{
+		GroupPK:   g.PublicKey,
+		GroupType: g.GroupType,
+	}
+
+	if cg == nil {
+		gs.Hash = hashNodes(g.PublicKey)
+		return gs
+	}
+
+	gs.Opened = true
+	gs.Metadata = &LogSnapshot{Hash: hashNodes(), Entries: []string{}}
+	gs.Messages = &LogSnapshot{Hash: hashNodes(), Entries: []string{}}
+
+	if cg.metadataStore != nil {
+		gs.Metadata = newLogSnapshot(cg.metadataStore.OpLog())
+	}
+
+	if cg.messageStore != nil {
+		gs.Messages = newLogSnapshot(cg.messageStore.OpLog())
+	}
+
+	gs.Hash = hashNodes(g.PublicKey, []byte(gs.Metadata.Hash), []byte(gs.Messages.Hash))
+
+	return gs
+}
+
+// StateSnapshot returns the hash tree of the groups known by the account, it
+// doesn't open any group.
+func (s *service) StateSnapshot(_ context.Context) (*StateSnapshot, error) {
+	if err := s.indexGroups(); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	s.lock.Lock()
+	groups := make([]*GroupSnapshot, 0, len(s.groups))
+	for id, g := range s.groups {
+		groups = append(groups, newGroupSnapshot(g, s.openedGroups[id]))
+	}
+	s.lock.Unlock()
+
+	sort.Slice(groups, func(i, j int) bool { return bytes.Compare(groups[i].GroupPK, groups[j].GroupPK) < 0 })
+
+	parts := make([][]byte, len(groups))
+	for i, g := range groups {
+		parts[i] = []byte(g.Hash)
+	}
+
+	return &StateSnapshot{
+		Version:   StateSnapshotVersion,
+		AccountPK: s.accountGroup.Group().PublicKey,
+		Date:      time.Now(),
+		Root:      hashNodes(parts...),
+		Groups:    groups,
+	}, nil
+}
+
+// ParseStateSnapshot decodes a serialized state snapshot.
+func ParseStateSnapshot(data []byte) (*StateSnapshot, error) {
+	snapshot := &StateSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if snapshot.Version != StateSnapshotVersion {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported state snapshot version %d", snapshot.Version))
+	}
+
+	return snapshot, nil
+}
+
+// Marshal serializes the state snapshot.
+func (s *StateSnapshot) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return data, nil
+}
+
+// DiffStateSnapshots compares two snapshots, only the subtrees whose hashes
+// differ are walked.
+func DiffStateSnapshots(a, b *StateSnapshot) *StateSnapshotDiff {
+	diff := &StateSnapshotDiff{}
+	if a.Root == b.Root {
+		return diff
+	}
+
+	groupsB := map[string]*GroupSnapshot{}
+	for _, g := range b.Groups {
+		groupsB[string(g.GroupPK)] = g
+	}
+
+	for _, ga := range a.Groups {
+		gb, ok := groupsB[string(ga.GroupPK)]
+		if !ok {
+			diff.OnlyInA = append(diff.OnlyInA, ga.GroupPK)
+			continue
+		}
+
+		delete(groupsB, string(ga.GroupPK))
+
+		if ga.Hash == gb.Hash {
+			continue
+		}
+
+		gd := &GroupSnapshotDiff{GroupPK: ga.GroupPK}
+		switch {
+		case !ga.Opened && !gb.Opened:
+			continue
+		case !gb.Opened:
+			gd.OpenedOnlyInA = true
+		case !ga.Opened:
+			gd.OpenedOnlyInB = true
+		default:
+			gd.Metadata = diffLogSnapshots(ga.Metadata, gb.Metadata)
+			gd.Messages = diffLogSnapshots(ga.Messages, gb.Messages)
+		}
+
+		diff.Groups = append(diff.Groups, gd)
+	}
+
+	for _, gb := range b.Groups {
+		if _, ok := groupsB[string(gb.GroupPK)]; ok {
+			diff.OnlyInB = append(diff.OnlyInB, gb.GroupPK)
+		}
+	}
+
+	return diff
+}
+
+func diffLogSnapshots(a, b *LogSnapshot) *LogSnapshotDiff {
+	if a == nil || b == nil || a.Hash == b.Hash {
+		return nil
+	}
+
+	entriesB := map[string]bool{}
+	for _, e := range b.Entries {
+		entriesB[e] = true
+	}
+
+	diff := &LogSnapshotDiff{}
+	for _, e := range a.Entries {
+		if !entriesB[e] {
+			diff.OnlyInA = append(diff.OnlyInA, e)
+		}
+
+		delete(entriesB, e)
+	}
+
+	for _, e := range b.Entries {
+		if entriesB[e] {
+			diff.OnlyInB = append(diff.OnlyInB, e)
+		}
+	}
+
+	return diff
+}
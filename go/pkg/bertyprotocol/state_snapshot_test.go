@@ -0,0 +1,83 @@
+package bertyprotocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSnapshot(groups ...*GroupSnapshot) *StateSnapshot {
+	parts := make([][]byte, len(groups))
+	for i, g := range groups {
+		parts[i] = []byte(g.Hash)
+	}
+
+	return &StateSnapshot{Version: StateSnapshotVersion, Root: hashNodes(parts...), Groups: groups}
+}
+
+func testGroupSnapshot(pk string, metadata, messages []string) *GroupSnapshot {
+	gs := &GroupSnapshot{GroupPK: []byte(pk)}
+	if metadata == nil && messages == nil {
+		gs.Hash = hashNodes(gs.GroupPK)
+		return gs
+	}
+
+	log := func(entries []string) *LogSnapshot {
+		parts := make([][]byte, len(entries))
+		for i, e := range entries {
+			parts[i] = []byte(e)
+		}
+
+		return &LogSnapshot{Hash: hashNodes(parts...), Entries: entries}
+	}
+
+	gs.Opened = true
+	gs.Metadata = log(metadata)
+	gs.Messages = log(messages)
+	gs.Hash = hashNodes(gs.GroupPK, []byte(gs.Metadata.Hash), []byte(gs.Messages.Hash))
+
+	return gs
+}
+
+func TestDiffStateSnapshots(t *testing.T) {
+	a := testSnapshot(
+		testGroupSnapshot("g1", []string{"m1"}, []string{"e1", "e2"}),
+		testGroupSnapshot("g2", []string{"m1"}, []string{"e1"}),
+		testGroupSnapshot("g3", nil, nil),
+	)
+
+	assert.True(t, DiffStateSnapshots(a, a).Empty())
+
+	b := testSnapshot(
+		testGroupSnapshot("g1", []string{"m1"}, []string{"e1", "e3"}),
+		testGroupSnapshot("g2", []string{"m1"}, []string{"e1"}),
+		testGroupSnapshot("g4", nil, nil),
+	)
+
+	diff := DiffStateSnapshots(a, b)
+	require.False(t, diff.Empty())
+	assert.Equal(t, [][]byte{[]byte("g3")}, diff.OnlyInA)
+	assert.Equal(t, [][]byte{[]byte("g4")}, diff.OnlyInB)
+
+	require.Len(t, diff.Groups, 1)
+	assert.Equal(t, []byte("g1"), diff.Groups[0].GroupPK)
+	assert.Nil(t, diff.Groups[0].Metadata)
+	require.NotNil(t, diff.Groups[0].Messages)
+	assert.Equal(t, []string{"e2"}, diff.Groups[0].Messages.OnlyInA)
+	assert.Equal(t, []string{"e3"}, diff.Groups[0].Messages.OnlyInB)
+}
+
+func TestStateSnapshotMarshal(t *testing.T) {
+	a := testSnapshot(testGroupSnapshot("g1", []string{"m1"}, []string{"e1"}))
+
+	data, err := a.Marshal()
+	require.NoError(t, err)
+
+	b, err := ParseStateSnapshot(data)
+	require.NoError(t, err)
+	assert.True(t, DiffStateSnapshots(a, b).Empty())
+
+	_, err = ParseStateSnapshot([]byte(`{"version": 42}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,362 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/attachment"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+)
+
+// storageGCInterval is how often the retention policies and the attachment
+// quota are applied
+const storageGCInterval = time.Hour
+
+// Storage categories of the disk usage.
+const (
+	StorageAttachmentsOwn    = "attachments_own"
+	StorageAttachmentsCached = "attachments_cached"
+	StorageMessageLog        = "message_log"
+	StorageMessageKeys       = "message_keys"
+	StorageSearchIndex       = "search_index"
+	StorageStoreForward      = "store_forward"
+	StorageOther             = "other"
+)
+
+// storageCategories maps the namespaces of the root datastore to their
+// category, the others are counted in StorageOther
+var storageCategories = map[string]string{
+	"orbitdb":       StorageMessageLog,
+	"messages":      StorageMessageKeys,
+	"ratchets":      StorageMessageKeys,
+	"messageSearch": StorageSearchIndex,
+	"storeForward":  StorageStoreForward,
+}
+
+// RetentionPolicy is how long the attachments fetched in a conversation are
+// kept by the device, the ones added by the device are always kept. Zero
+// values keep them until the quota is reached.
+type RetentionPolicy struct {
+	GroupPK []byte `json:"group_pk"`
+
+	// AttachmentMaxAge deletes the attachments fetched for longer
+	AttachmentMaxAge time.Duration `json:"attachment_max_age,omitempty"`
+
+	// AttachmentMaxBytes deletes the least recently used attachments beyond
+	// it
+	AttachmentMaxBytes int64 `json:"attachment_max_bytes,omitempty"`
+}
+
+func (p *RetentionPolicy) validate() error {
+	if len(p.GroupPK) == 0 || p.AttachmentMaxAge < 0 || p.AttachmentMaxBytes < 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid retention policy"))
+	}
+
+	return nil
+}
+
+func (p *RetentionPolicy) isZero() bool {
+	return p.AttachmentMaxAge == 0 && p.AttachmentMaxBytes == 0
+}
+
+// StorageUsage is the disk usage of the node in bytes, by category.
+type StorageUsage struct {
+	Total      int64            `json:"total"`
+	Categories map[string]int64 `json:"categories"`
+
+	// Conversations is the space of the attachments fetched by
+	// conversation, by base64 group public key
+	Conversations map[string]int64 `json:"conversations"`
+}
+
+// StorageCollectReport reports the data deleted by a collection.
+type StorageCollectReport struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+func (r *StorageCollectReport) add(c *attachment.CollectReport) {
+	if c != nil {
+		r.Removed += c.Removed
+		r.Freed += c.Freed
+	}
+}
+
+// retentionPolicies persists the retention policies of the conversations,
+// they are local to the device.
+type retentionPolicies struct {
+	logger *zap.Logger
+	store  datastore.Datastore
+
+	lock sync.Mutex
+}
+
+func newRetentionPolicies(logger *zap.Logger, store datastore.Datastore) *retentionPolicies {
+	return &retentionPolicies{logger: logger, store: store}
+}
+
+func retentionPolicyKey(groupPK []byte) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(groupPK))
+}
+
+func (r *retentionPolicies) get(groupPK []byte) (*RetentionPolicy, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	data, err := r.store.Get(retentionPolicyKey(groupPK))
+	if err == datastore.ErrNotFound {
+		return &RetentionPolicy{GroupPK: groupPK}, nil
+	} else if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	p := &RetentionPolicy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return p, nil
+}
+
+// set persists a policy, a zero one is removed.
+func (r *retentionPolicies) set(p *RetentionPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if p.isZero() {
+		if err := r.store.Delete(retentionPolicyKey(p.GroupPK)); err != nil && err != datastore.ErrNotFound {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		return nil
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := r.store.Put(retentionPolicyKey(p.GroupPK), data); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (r *retentionPolicies) list() ([]*RetentionPolicy, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res, err := r.store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	policies := []*RetentionPolicy{}
+	for _, entry := range entries {
+		p := &RetentionPolicy{}
+		if err := json.Unmarshal(entry.Value, p); err != nil {
+			r.logger.Warn("invalid retention policy", zap.String("key", entry.Key), zap.Error(err))
+			continue
+		}
+
+		policies = append(policies, p)
+	}
+
+	return policies, nil
+}
+
+// ConversationRetentionSet replaces the retention policy of a conversation,
+// it is applied right away.
+func (s *service) ConversationRetentionSet(_ context.Context, p *RetentionPolicy) error {
+	if p == nil {
+		return errcode.ErrInvalidInput
+	}
+
+	if _, err := s.getContextGroupForID(p.GroupPK); err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if err := s.retention.set(p); err != nil {
+		return err
+	}
+
+	if s.attachments == nil {
+		return nil
+	}
+
+	_, err := s.applyRetention(p, time.Now())
+
+	return err
+}
+
+// ConversationRetention returns the retention policy of a conversation.
+func (s *service) ConversationRetention(_ context.Context, groupPK []byte) (*RetentionPolicy, error) {
+	return s.retention.get(groupPK)
+}
+
+func (s *service) applyRetention(p *RetentionPolicy, now time.Time) (*attachment.CollectReport, error) {
+	before := time.Time{}
+	if p.AttachmentMaxAge > 0 {
+		before = now.Add(-p.AttachmentMaxAge)
+	}
+
+	return s.attachments.Prune(p.GroupPK, before, p.AttachmentMaxBytes)
+}
+
+// StorageCollect applies the retention policies of the conversations, then
+// the attachment quota of the node.
+func (s *service) StorageCollect(_ context.Context) (*StorageCollectReport, error) {
+	if s.attachments == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.collectStorage(time.Now())
+}
+
+func (s *service) collectStorage(now time.Time) (*StorageCollectReport, error) {
+	policies, err := s.retention.list()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &StorageCollectReport{}
+	for _, p := range policies {
+		r, err := s.applyRetention(p, now)
+		report.add(r)
+
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if s.attachQuota > 0 {
+		r, err := s.attachments.Collect(s.attachQuota)
+		report.add(r)
+
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+func (s *service) storageGCLoop(ctx context.Context) {
+	ticker := time.NewTicker(storageGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if report, err := s.collectStorage(now); err != nil {
+				s.logger.Warn("unable to collect storage", zap.Error(err))
+			} else if report.Removed > 0 {
+				s.logger.Info("storage collected", zap.Int("removed", report.Removed), zap.Int64("freed", report.Freed))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// StorageUsage returns the disk usage of the node by category.
+func (s *service) StorageUsage(_ context.Context) (*StorageUsage, error) {
+	usage := &StorageUsage{
+		Categories: map[string]int64{
+			StorageAttachmentsOwn:    0,
+			StorageAttachmentsCached: 0,
+			StorageMessageLog:        0,
+			StorageMessageKeys:       0,
+			StorageSearchIndex:       0,
+			StorageStoreForward:      0,
+			StorageOther:             0,
+		},
+		Conversations: map[string]int64{},
+	}
+
+	res, err := s.rootDatastore.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for result := range res.Next() {
+		if result.Error != nil {
+			_ = res.Close()
+			return nil, errcode.ErrInternal.Wrap(result.Error)
+		}
+
+		namespace := datastore.RawKey(result.Key).List()[0]
+		if namespace == "attachments" {
+			// split by the attachment usage below
+			continue
+		}
+
+		category, ok := storageCategories[namespace]
+		if !ok {
+			category = StorageOther
+		}
+
+		usage.Categories[category] += int64(len(result.Key) + len(result.Value))
+	}
+
+	if s.orbitDir != "" && s.orbitDir != ":memory:" {
+		usage.Categories[StorageMessageLog] += directorySize(s.orbitDir)
+	}
+
+	if s.attachments != nil {
+		a, err := s.attachments.Usage()
+		if err != nil {
+			return nil, err
+		}
+
+		usage.Categories[StorageAttachmentsOwn] = a.Own
+		usage.Categories[StorageAttachmentsCached] = a.Cached
+		for scope, size := range a.Scopes {
+			groupPK, err := hex.DecodeString(scope)
+			if err != nil {
+				continue
+			}
+
+			usage.Conversations[base64.StdEncoding.EncodeToString(groupPK)] = size
+		}
+	}
+
+	for _, size := range usage.Categories {
+		usage.Total += size
+	}
+
+	return usage, nil
+}
+
+func directorySize(dir string) int64 {
+	size := int64(0)
+	_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size
+}
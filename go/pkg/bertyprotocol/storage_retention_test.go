@@ -0,0 +1,69 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRetentionPolicies(t *testing.T) {
+	r := newRetentionPolicies(zap.NewNop(), ds_sync.MutexWrap(datastore.NewMapDatastore()))
+
+	groupPK := []byte("group")
+
+	// no policy by default
+	p, err := r.get(groupPK)
+	require.NoError(t, err)
+	assert.Equal(t, &RetentionPolicy{GroupPK: groupPK}, p)
+
+	assert.Error(t, r.set(&RetentionPolicy{AttachmentMaxAge: time.Hour}))
+	assert.Error(t, r.set(&RetentionPolicy{GroupPK: groupPK, AttachmentMaxBytes: -1}))
+
+	policy := &RetentionPolicy{GroupPK: groupPK, AttachmentMaxAge: time.Hour, AttachmentMaxBytes: 1 << 20}
+	require.NoError(t, r.set(policy))
+
+	p, err = r.get(groupPK)
+	require.NoError(t, err)
+	assert.Equal(t, policy, p)
+
+	policies, err := r.list()
+	require.NoError(t, err)
+	assert.Equal(t, []*RetentionPolicy{policy}, policies)
+
+	// a zero policy is removed
+	require.NoError(t, r.set(&RetentionPolicy{GroupPK: groupPK}))
+	policies, err = r.list()
+	require.NoError(t, err)
+	assert.Empty(t, policies)
+}
+
+func TestStorageUsage(t *testing.T) {
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	require.NoError(t, store.Put(datastore.NewKey("orbitdb/log/1"), make([]byte, 100)))
+	require.NoError(t, store.Put(datastore.NewKey("messages/key"), make([]byte, 10)))
+	require.NoError(t, store.Put(datastore.NewKey("ratchets/key"), make([]byte, 10)))
+	require.NoError(t, store.Put(datastore.NewKey("webhooks/hook"), make([]byte, 5)))
+
+	s := &service{rootDatastore: store}
+
+	usage, err := s.StorageUsage(context.Background())
+	require.NoError(t, err)
+
+	// the keys are counted with the values
+	assert.Equal(t, int64(100+len("/orbitdb/log/1")), usage.Categories[StorageMessageLog])
+	assert.Equal(t, int64(20+len("/messages/key")+len("/ratchets/key")), usage.Categories[StorageMessageKeys])
+	assert.Equal(t, int64(5+len("/webhooks/hook")), usage.Categories[StorageOther])
+	assert.Zero(t, usage.Categories[StorageAttachmentsCached])
+
+	total := int64(0)
+	for _, size := range usage.Categories {
+		total += size
+	}
+	assert.Equal(t, total, usage.Total)
+}
@@ -0,0 +1,210 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/storeforward"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-ipfs-log/entry"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
+)
+
+// carriedEntry is the payload of a bundle: an entry of the message store of a
+// group, with the block it is stored in, so the destination can sync it while
+// the sender is offline. The message itself stays sealed for the group.
+type carriedEntry struct {
+	Entry json.RawMessage `json:"entry"`
+	Block []byte          `json:"block"`
+}
+
+// storeForwardTag identifies the destination group of a bundle, only its
+// members can compute it. The bundles of a group can be linked together.
+func storeForwardTag(groupPK []byte) []byte {
+	mac := hmac.New(sha256.New, groupPK)
+	_, _ = mac.Write([]byte("berty store-and-forward"))
+
+	return mac.Sum(nil)
+}
+
+// carryMessage carries an entry of the device to the other members of the
+// group. The bundles of a disappearing message expire with it, the bundles
+// expired undelivered are reported by the delivery of the message.
+func (s *service) carryMessage(ctx context.Context, g *bertytypes.Group, e ipfslog.Entry) error {
+	if s.storeForward == nil || e == nil || g.GroupType == bertytypes.GroupTypeAccount {
+		return nil
+	}
+
+	messageID := e.GetHash().Bytes()
+
+	ttl := time.Duration(0)
+	if expiresAt, err := s.ephemeral.expiry(g.PublicKey, messageID); err == nil && !expiresAt.IsZero() {
+		if ttl = time.Until(expiresAt); ttl <= 0 {
+			return nil
+		}
+	}
+
+	ctx, span := s.tracer.Start(ctx, "Write Message", trace.WithAttributes(kv.String("transport", string(EnvelopeSourceStoreForward))))
+	defer span.End()
+
+	payload, err := s.carriedPayload(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	parts, err := splitEnvelope(payload, maxEnvelopePartSize)
+	if err != nil {
+		return err
+	}
+
+	// the carriers only see the destination of the parts, not their sender
+	tag := storeForwardTag(g.PublicKey)
+	for _, part := range parts {
+		sealed, err := s.sealForGroup(g, part)
+		if err != nil {
+			return err
+		}
+
+		id, err := s.storeForward.Carry(tag, sealed, ttl)
+		if err != nil {
+			return err
+		}
+
+		if err := s.deliveries.carried(g.PublicKey, messageID, id); err != nil {
+			s.logger.Warn("unable to record carried message", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// bundleExpired is called once a bundle carried for the device expired.
+func (s *service) bundleExpired(id []byte, delivered bool) {
+	if err := s.deliveries.carryExpired(id, delivered, time.Now()); err != nil {
+		s.logger.Warn("unable to record expired bundle", zap.Error(err))
+	}
+}
+
+func (s *service) carriedPayload(ctx context.Context, e ipfslog.Entry) ([]byte, error) {
+	entryJSON, err := json.Marshal(e)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	r, err := s.ipfsCoreAPI.Block().Get(ctx, path.IpfsPath(e.GetHash()))
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	block, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	payload, err := json.Marshal(&carriedEntry{Entry: entryJSON, Block: block})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return payload, nil
+}
+
+func (s *service) groupForTag(tag []byte) *groupContext {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, gc := range s.openedGroups {
+		if gc.Group().GroupType != bertytypes.GroupTypeAccount && hmac.Equal(storeForwardTag(gc.Group().PublicKey), tag) {
+			return gc
+		}
+	}
+
+	return nil
+}
+
+// deliverBundle syncs the entry of a bundle in its group, the first device of
+// the group reached other than the sender acknowledges the delivery, the
+// other members replicate the entry from it. The contact requests sent to
+// the prekeys of the device are received first.
+func (s *service) deliverBundle(ctx context.Context, b *storeforward.Bundle) (bool, error) {
+	if delivered, err := s.deliverPrekeyRequest(ctx, b.Tag, b.Payload); delivered || err != nil {
+		return delivered, err
+	}
+
+	gc := s.groupForTag(b.Tag)
+	if gc == nil {
+		return false, nil
+	}
+
+	return s.receiveEnvelope(ctx, gc, b.Payload, EnvelopeSourceStoreForward)
+}
+
+// syncCarriedEntry syncs an entry of another device in the message store of
+// the group, it returns false if the entry is one of the device. An entry
+// already received, e.g. over another transport, is dropped before being
+// synced.
+func (s *service) syncCarriedEntry(ctx context.Context, gc *groupContext, payload []byte, source EnvelopeSource) (bool, error) {
+	carried := &carriedEntry{}
+	if err := json.Unmarshal(payload, carried); err != nil {
+		return false, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	e := &entry.Entry{}
+	if err := json.Unmarshal(carried.Entry, e); err != nil {
+		return false, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	store := gc.MessageStore()
+	if id := e.GetIdentity(); id == nil || store.Identity() == nil || id.ID == store.Identity().ID {
+		return false, nil
+	}
+
+	envelopeID := e.GetHash().Bytes()
+	if _, ok := store.OpLog().GetEntries().Get(e.GetHash().String()); ok || s.dedup.duplicate(envelopeID, time.Now()) {
+		s.dedup.suppress(source)
+		return true, nil
+	}
+
+	stat, err := s.ipfsCoreAPI.Block().Put(ctx, bytes.NewReader(carried.Block), options.Block.Format("cbor"))
+	if err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	if !stat.Path().Cid().Equals(e.GetHash()) {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("block doesn't match the entry"))
+	}
+
+	if err := store.Sync(ctx, []ipfslog.Entry{e}); err != nil {
+		return false, errcode.ErrOrbitDBAppend.Wrap(err)
+	}
+
+	if err := s.dedup.record(envelopeID, time.Now()); err != nil {
+		s.logger.Warn("unable to record envelope ID", zap.Error(err))
+	}
+
+	s.logger.Debug("carried message synced", zap.Stringer("entry", e.GetHash()))
+
+	return true, nil
+}
+
+// StoreForwardStats returns the bundles carried by the device for the other
+// devices.
+func (s *service) StoreForwardStats(context.Context) (*storeforward.Stats, error) {
+	if s.storeForward == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.storeForward.Stats(), nil
+}
@@ -3,6 +3,7 @@ package bertyprotocol
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"encoding/base64"
 
@@ -17,6 +18,8 @@ import (
 	"berty.tech/go-orbit-db/stores/operation"
 	coreapi "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
 	"go.uber.org/zap"
 )
 
@@ -25,10 +28,16 @@ const groupMessageStoreType = "berty_group_messages"
 type messageStore struct {
 	basestore.BaseStore
 
-	devKS  DeviceKeystore
-	mks    *MessageKeystore
-	g      *bertytypes.Group
-	logger *zap.Logger
+	devKS      DeviceKeystore
+	mks        *MessageKeystore
+	ratchets   *ratchetManager
+	revoked    *deviceRevocations
+	members    func(g *bertytypes.Group, devicePK crypto.PubKey) []byte
+	audit      *securityAudit
+	signatures *messageSignatures
+	g          *bertytypes.Group
+	logger     *zap.Logger
+	tracer     trace.Tracer
 }
 
 func (m *messageStore) setLogger(l *zap.Logger) {
@@ -39,27 +48,58 @@ func (m *messageStore) setLogger(l *zap.Logger) {
 	m.logger = l.With(zap.String("group-id", fmt.Sprintf("%.6s", base64.StdEncoding.EncodeToString(m.g.PublicKey))))
 }
 
+// isRevokedDevice reports whether a device was revoked by its member, an
+// account revokes its own devices only.
+func (m *messageStore) isRevokedDevice(devicePK []byte) bool {
+	pk, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+	if err != nil || m.members == nil {
+		return false
+	}
+
+	return m.revoked.isRevoked(m.members(m.g, pk), devicePK)
+}
+
 func (m *messageStore) openMessage(ctx context.Context, e ipfslog.Entry) (*bertytypes.GroupMessageEvent, error) {
 	if e == nil {
 		return nil, errcode.ErrInvalidInput
 	}
 
-	op, err := operation.ParseOperation(e)
+	ctx, span := m.tracer.Start(ctx, "Decrypt Message", trace.WithAttributes(kv.String("message.cid", e.GetHash().String())))
+	defer span.End()
+
+	headers, payload, err := m.openEnvelope(ctx, e)
 	if err != nil {
-		m.logger.Error("unable to parse operation", zap.Error(err))
+		span.RecordError(ctx, err)
+		m.logger.Error("unable to open envelope", zap.Error(err))
+		if errcode.Is(err, errcode.ErrCryptoDecrypt) {
+			m.auditDecryptionFailed(e, nil, err)
+		}
+
 		return nil, err
 	}
 
-	ownPK := crypto.PubKey(nil)
-	md, inErr := m.devKS.MemberDeviceForGroup(m.g)
-	if inErr == nil {
-		ownPK = md.device.GetPublic()
+	// the status is kept even for the messages rejected below
+	if _, _, err := m.signatures.verify(m.g, e.GetHash().Bytes(), headers, payload, time.Now()); err != nil {
+		m.logger.Warn("unable to verify message signature", zap.Error(err))
 	}
 
-	headers, payload, err := m.mks.OpenEnvelope(ctx, m.g, ownPK, op.GetValue(), e.GetHash())
-	if err != nil {
-		m.logger.Error("unable to open envelope", zap.Error(err))
-		return nil, err
+	if m.isRevokedDevice(headers.DevicePK) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("message signed by a revoked device"))
+	}
+
+	if m.ratchets != nil && isRatchetPayload(payload) {
+		if payload, err = m.ratchets.open(m.g, headers, e.GetHash(), payload); err != nil {
+			m.logger.Error("unable to open ratchet payload", zap.Error(err))
+			m.auditDecryptionFailed(e, headers, err)
+			return nil, err
+		}
+	}
+
+	if isCompressedPayload(payload) {
+		if payload, err = decompressPayload(payload); err != nil {
+			m.logger.Error("unable to decompress payload", zap.Error(err))
+			return nil, err
+		}
 	}
 
 	eventContext := newEventContext(e.GetHash(), e.GetNext(), m.g)
@@ -70,6 +110,23 @@ func (m *messageStore) openMessage(ctx context.Context, e ipfslog.Entry) (*berty
 	}, err
 }
 
+// auditDecryptionFailed logs a message which couldn't be decrypted, once by
+// message.
+func (m *messageStore) auditDecryptionFailed(e ipfslog.Entry, headers *bertytypes.MessageHeaders, err error) {
+	rec := &securityRecord{
+		Type:    SecurityDecryptionFailed,
+		GroupPK: m.g.PublicKey,
+		Details: err.Error(),
+		Ref:     e.GetHash().String(),
+	}
+
+	if headers != nil {
+		rec.DevicePK = headers.DevicePK
+	}
+
+	m.audit.add(rec)
+}
+
 func (m *messageStore) ListMessages(ctx context.Context) (<-chan *bertytypes.GroupMessageEvent, error) {
 	out := make(chan *bertytypes.GroupMessageEvent)
 
@@ -97,7 +154,10 @@ func (m *messageStore) AddMessage(ctx context.Context, payload []byte) (operatio
 		return nil, errcode.ErrInternal.Wrap(err)
 	}
 
+	// the span of the sender is sent in the headers, see InjectSpanContextToMessageHeaders
+	_, span := m.tracer.Start(ctx, "Seal Envelope")
 	env, err := m.mks.SealEnvelope(ctx, m.g, md.device, payload)
+	span.End()
 	if err != nil {
 		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
 	}
@@ -125,10 +185,16 @@ func constructorFactoryGroupMessage(s *bertyOrbitDB) iface.StoreConstructor {
 		}
 
 		store := &messageStore{
-			devKS:  s.deviceKeystore,
-			mks:    s.messageKeystore,
-			g:      g,
-			logger: zap.NewNop(),
+			devKS:      s.deviceKeystore,
+			mks:        s.messageKeystore,
+			ratchets:   s.ratchets,
+			revoked:    s.revocations,
+			members:    s.memberByDevice,
+			audit:      s.audit,
+			signatures: s.signatures,
+			g:          g,
+			logger:     zap.NewNop(),
+			tracer:     s.tracer,
 		}
 
 		options.Index = basestore.NewBaseIndex
@@ -862,11 +862,13 @@ func newSecretEntryPayload(localDevicePrivKey crypto.PrivKey, remoteMemberPubKey
 	if err != nil {
 		return nil, errcode.ErrSerialization.Wrap(err)
 	}
+	defer cryptoutil.Wipe(message)
 
 	mongPriv, mongPub, err := cryptoutil.EdwardsToMontgomery(localDevicePrivKey, remoteMemberPubKey)
 	if err != nil {
 		return nil, errcode.ErrCryptoKeyConversion.Wrap(err)
 	}
+	defer cryptoutil.WipeKey(mongPriv)
 
 	nonce := groupIDToNonce(group)
 	encryptedSecret := box.Seal(nil, message, nonce, mongPub, mongPriv)
@@ -29,6 +29,13 @@ type metadataStoreIndex struct {
 	eventHandlers            map[bertytypes.EventType][]func(event proto.Message) error
 	postIndexActions         []func() error
 	eventsContactAddAliasKey []*bertytypes.ContactAddAliasKey
+	membershipOps            map[string]*membershipOp
+	membership               map[string]MemberState
+	memberAdds               map[string][]string
+	removedMembers           []byte
+	ratchetKeys              map[string]*ratchetKeyAnnounce
+	pushTokens               map[string]*pushTokenAnnounce
+	compressionCodecs        map[string]*envelopeCompressionAnnounce
 	ownAliasKeySent          bool
 	otherAliasKey            []byte
 	g                        *bertytypes.Group
@@ -37,6 +44,11 @@ type metadataStoreIndex struct {
 	eventEmitter             events.EmitterInterface
 	lock                     sync.RWMutex
 	logger                   *zap.Logger
+
+	// log and entry are the log indexed and the entry being handled, for the
+	// handlers needing its position in the log
+	log   ipfslog.Log
+	entry ipfslog.Entry
 }
 
 func (m *metadataStoreIndex) Get(key string) interface{} {
@@ -56,6 +68,7 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 	defer m.lock.Unlock()
 
 	entries := log.Values().Slice()
+	m.log = log
 
 	// Resetting state
 	m.contacts = map[string]*accountContact{}
@@ -89,6 +102,7 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 
 		var lastErr error
 
+		m.entry = e
 		for _, h := range handlers {
 			err = h(event)
 			if err != nil {
@@ -144,6 +158,10 @@ func (m *metadataStoreIndex) handleGroupAddMemberDevice(event proto.Message) err
 		device: device,
 	})
 
+	if m.entry != nil {
+		m.memberAdds[string(e.MemberPK)] = append(m.memberAdds[string(e.MemberPK)], m.entry.GetHash().String())
+	}
+
 	return nil
 }
 
@@ -659,6 +677,12 @@ func newMetadataIndex(ctx context.Context, eventEmitter events.EmitterInterface,
 			contacts:               map[string]*accountContact{},
 			groups:                 map[string]*accountGroup{},
 			contactRequestMetadata: map[string][]byte{},
+			membershipOps:          map[string]*membershipOp{},
+			membership:             map[string]MemberState{},
+			memberAdds:             map[string][]string{},
+			ratchetKeys:            map[string]*ratchetKeyAnnounce{},
+			pushTokens:             map[string]*pushTokenAnnounce{},
+			compressionCodecs:      map[string]*envelopeCompressionAnnounce{},
 			g:                      g,
 			eventEmitter:           eventEmitter,
 			ownMemberDevice:        md,
@@ -682,12 +706,14 @@ func newMetadataIndex(ctx context.Context, eventEmitter events.EmitterInterface,
 			bertytypes.EventTypeContactAliasKeyAdded:                   {m.handleContactAliasKeyAdded},
 			bertytypes.EventTypeGroupDeviceSecretAdded:                 {m.handleGroupAddDeviceSecret},
 			bertytypes.EventTypeGroupMemberDeviceAdded:                 {m.handleGroupAddMemberDevice},
+			bertytypes.EventTypeGroupMetadataPayloadSent:               {m.handleMembershipOp, m.handleRatchetKey, m.handlePushToken, m.handleEnvelopeCompression},
 			bertytypes.EventTypeMultiMemberGroupAdminRoleGranted:       {m.handleMultiMemberGrantAdminRole},
 			bertytypes.EventTypeMultiMemberGroupInitialMemberAnnounced: {m.handleMultiMemberInitialMember},
 		}
 
 		m.postIndexActions = []func() error{
 			m.postHandlerSentAliases,
+			m.postHandlerMembership,
 		}
 
 		return m
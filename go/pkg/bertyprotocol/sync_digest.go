@@ -0,0 +1,400 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	ipfslog "berty.tech/go-ipfs-log"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const syncDigestProtocolID = protocol.ID("/berty/sync-digest/1.0.0")
+
+const (
+	// syncDigestTimeout bounds an exchange, the encounters over the
+	// proximity links are short
+	syncDigestTimeout = time.Minute
+
+	// syncDigestInterval is the interval between two exchanges with the
+	// same peer, the stores replicate on their own while it stays connected
+	syncDigestInterval = 5 * time.Minute
+
+	// the peer with the greatest ID starts the exchange only if the other one
+	// didn't in the meantime
+	syncDigestDelay = 2 * time.Second
+
+	// maxSyncDigestStores caps the stores of a digest, maxSyncDigestWriters
+	// the writers of a store
+	maxSyncDigestStores  = 512
+	maxSyncDigestWriters = 256
+
+	// maxSyncDigestEntries caps the entries sent in an exchange,
+	// maxSyncDigestSize what is read from a peer
+	maxSyncDigestEntries = 1000
+	maxSyncDigestSize    = 64 << 20
+)
+
+// syncDigestClock is the vector clock of a store: the latest Lamport time of
+// each writer, by hex ID. An entry whose time is after the one of its writer
+// in the clock of a peer is missing on the peer.
+type syncDigestClock map[string]int
+
+func (c syncDigestClock) observe(writer string, t int) {
+	if t > c[writer] {
+		c[writer] = t
+	}
+}
+
+// missing reports whether an entry is missing on the peer of the clock.
+func (c syncDigestClock) missing(writer string, t int) bool {
+	return t > c[writer]
+}
+
+// syncDigestStore is what a peer has of a store of a group, and so what it
+// needs: the entries written after its clock.
+type syncDigestStore struct {
+	GroupPK []byte              `json:"group_pk"`
+	Store   deviceSyncStoreKind `json:"store"`
+	Clock   syncDigestClock     `json:"clock"`
+}
+
+// syncDigestFrame is a message of an exchange: the digests, then the missing
+// entries, smallest first, followed by a done frame.
+type syncDigestFrame struct {
+	Digest []*syncDigestStore `json:"digest,omitempty"`
+
+	GroupPK []byte              `json:"group_pk,omitempty"`
+	Store   deviceSyncStoreKind `json:"store,omitempty"`
+	Entry   []byte              `json:"entry,omitempty"`
+
+	Done bool `json:"done,omitempty"`
+}
+
+// syncDigestItem is an entry of a store missing on the peer.
+type syncDigestItem struct {
+	groupPK []byte
+	store   deviceSyncStoreKind
+	payload []byte
+}
+
+// sortSyncDigestItems orders the entries sent smallest first, so the short
+// encounters transfer as many entries as possible, e.g. the text messages
+// before the large ones.
+func sortSyncDigestItems(items []*syncDigestItem) {
+	sort.SliceStable(items, func(i, j int) bool { return len(items[i].payload) < len(items[j].payload) })
+}
+
+// syncDigests keeps the last exchanges by peer.
+type syncDigests struct {
+	lock      sync.Mutex
+	exchanges map[peer.ID]time.Time
+}
+
+func newSyncDigests() *syncDigests {
+	return &syncDigests{exchanges: make(map[peer.ID]time.Time)}
+}
+
+// begin reports whether an exchange with the peer can start, an exchange is
+// done at most once by interval.
+func (sd *syncDigests) begin(pid peer.ID, now time.Time) bool {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	if last, ok := sd.exchanges[pid]; ok && now.Sub(last) < syncDigestInterval {
+		return false
+	}
+
+	for p, last := range sd.exchanges {
+		if now.Sub(last) >= syncDigestInterval {
+			delete(sd.exchanges, p)
+		}
+	}
+
+	sd.exchanges[pid] = now
+
+	return true
+}
+
+// logClock returns the vector clock of a log.
+func logClock(log ipfslog.Log) syncDigestClock {
+	clock := syncDigestClock{}
+	for _, e := range log.GetEntries().Slice() {
+		clock.observe(hex.EncodeToString(e.GetClock().GetID()), e.GetClock().GetTime())
+	}
+
+	return clock
+}
+
+// digestGroups returns the opened groups shared with a peer: all of them for
+// a device of the account, the ones the peer was seen in for the others.
+func (s *service) digestGroups(pid peer.ID) []*groupContext {
+	own := s.availability.isOwnPeer(pid)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	groups := []*groupContext{}
+	for _, gc := range s.openedGroups {
+		if own || s.conversations.hasGroupPeer(gc.Group().PublicKey, pid) {
+			groups = append(groups, gc)
+		}
+	}
+
+	return groups
+}
+
+func digestStores(gc *groupContext) map[deviceSyncStoreKind]syncableStore {
+	return map[deviceSyncStoreKind]syncableStore{
+		deviceSyncMetadata: gc.MetadataStore(),
+		deviceSyncMessages: gc.MessageStore(),
+	}
+}
+
+// localDigest returns the clocks of the stores shared with a peer.
+func (s *service) localDigest(pid peer.ID) []*syncDigestStore {
+	digest := []*syncDigestStore{}
+	for _, gc := range s.digestGroups(pid) {
+		for kind, store := range digestStores(gc) {
+			clock := logClock(store.OpLog())
+			if len(clock) > maxSyncDigestWriters {
+				continue
+			}
+
+			digest = append(digest, &syncDigestStore{GroupPK: gc.Group().PublicKey, Store: kind, Clock: clock})
+		}
+	}
+
+	return digest
+}
+
+// missingItems returns the entries of the shared stores missing on the
+// peer, according to its digest, smallest first. A store the peer didn't
+// send is skipped, it isn't shared with the peer from its side.
+func (s *service) missingItems(ctx context.Context, pid peer.ID, remote []*syncDigestStore) []*syncDigestItem {
+	clocks := make(map[string]syncDigestClock, len(remote))
+	for _, d := range remote {
+		clocks[string(d.GroupPK)+"/"+string(d.Store)] = d.Clock
+	}
+
+	items := []*syncDigestItem{}
+	for _, gc := range s.digestGroups(pid) {
+		for kind, store := range digestStores(gc) {
+			clock, ok := clocks[string(gc.Group().PublicKey)+"/"+string(kind)]
+			if !ok {
+				continue
+			}
+
+			for _, e := range store.OpLog().GetEntries().Slice() {
+				if !clock.missing(hex.EncodeToString(e.GetClock().GetID()), e.GetClock().GetTime()) {
+					continue
+				}
+
+				payload, err := s.carriedPayload(ctx, e)
+				if err != nil {
+					continue
+				}
+
+				items = append(items, &syncDigestItem{groupPK: gc.Group().PublicKey, store: kind, payload: payload})
+			}
+		}
+	}
+
+	sortSyncDigestItems(items)
+
+	if len(items) > maxSyncDigestEntries {
+		items = items[:maxSyncDigestEntries]
+	}
+
+	return items
+}
+
+// watchEncounters exchanges the sync digests with the peers as soon as they
+// are connected over a proximity link.
+func (s *service) watchEncounters(ctx context.Context) {
+	s.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if ipfsutil.PathKindOf(c.RemoteMultiaddr()) != ipfsutil.PathProximity {
+				return
+			}
+
+			go s.syncDigestOnConnect(ctx, c.RemotePeer())
+		},
+	})
+}
+
+func (s *service) syncDigestOnConnect(ctx context.Context, pid peer.ID) {
+	if s.host.ID() > pid {
+		select {
+		case <-time.After(syncDigestDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if err := s.syncDigest(ctx, pid); err != nil {
+		s.logger.Debug("sync digest failed", zap.Stringer("peer", pid), zap.Error(err))
+	}
+}
+
+// syncDigest exchanges the digests of the shared stores with a peer, then
+// the entries missing on each side.
+func (s *service) syncDigest(ctx context.Context, pid peer.ID) error {
+	if len(s.digestGroups(pid)) == 0 || !s.digests.begin(pid, time.Now()) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, syncDigestTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(network.WithNoDial(ctx, "sync digest"), pid, syncDigestProtocolID)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer stream.Close()
+
+	if err := s.runSyncDigest(ctx, stream, true); err != nil {
+		_ = stream.Reset()
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) handleSyncDigest(stream network.Stream) {
+	defer stream.Close()
+
+	pid := stream.Conn().RemotePeer()
+	if len(s.digestGroups(pid)) == 0 {
+		_ = stream.Reset()
+		return
+	}
+
+	s.digests.begin(pid, time.Now())
+
+	ctx, cancel := context.WithTimeout(s.ctx, syncDigestTimeout)
+	defer cancel()
+
+	if err := s.runSyncDigest(ctx, stream, false); err != nil {
+		s.logger.Debug("sync digest failed", zap.Stringer("peer", pid), zap.Error(err))
+		_ = stream.Reset()
+	}
+}
+
+// runSyncDigest sends the digest of the initiator first, then the one of the
+// responder. The missing entries are sent by both sides at once, each entry
+// received is synced right away so an interrupted exchange isn't lost.
+func (s *service) runSyncDigest(ctx context.Context, stream network.Stream, initiator bool) error {
+	_ = stream.SetDeadline(time.Now().Add(syncDigestTimeout))
+
+	pid := stream.Conn().RemotePeer()
+	enc := json.NewEncoder(s.lanes.Stream(stream, ipfsutil.PriorityText))
+	dec := json.NewDecoder(io.LimitReader(stream, maxSyncDigestSize))
+
+	local := &syncDigestFrame{Digest: s.localDigest(pid)}
+	if initiator {
+		if err := enc.Encode(local); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+	}
+
+	remote := &syncDigestFrame{}
+	if err := dec.Decode(remote); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if len(remote.Digest) > maxSyncDigestStores {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("sync digest too large"))
+	}
+
+	if !initiator {
+		if err := enc.Encode(local); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.sendSyncDigestItems(enc, s.missingItems(ctx, pid, remote.Digest))
+	}()
+
+	received, synced, err := s.receiveSyncDigestItems(ctx, pid, dec)
+	if sendErr := <-sent; err == nil {
+		err = sendErr
+	}
+
+	if synced > 0 {
+		s.logger.Info("caught up during encounter", zap.Stringer("peer", pid), zap.Int("received", received), zap.Int("synced", synced))
+	}
+
+	return err
+}
+
+func (s *service) sendSyncDigestItems(enc *json.Encoder, items []*syncDigestItem) error {
+	for _, item := range items {
+		if err := enc.Encode(&syncDigestFrame{GroupPK: item.groupPK, Store: item.store, Entry: item.payload}); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+	}
+
+	if err := enc.Encode(&syncDigestFrame{Done: true}); err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return nil
+}
+
+// receiveSyncDigestItems syncs the entries sent by the peer in the stores
+// shared with it, until its done frame.
+func (s *service) receiveSyncDigestItems(ctx context.Context, pid peer.ID, dec *json.Decoder) (int, int, error) {
+	shared := map[string]*groupContext{}
+	for _, gc := range s.digestGroups(pid) {
+		shared[string(gc.Group().PublicKey)] = gc
+	}
+
+	received, synced := 0, 0
+	for {
+		f := &syncDigestFrame{}
+		if err := dec.Decode(f); err != nil {
+			return received, synced, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if f.Done {
+			return received, synced, nil
+		}
+
+		if received++; received > maxSyncDigestEntries {
+			return received, synced, errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many sync digest entries"))
+		}
+
+		gc, ok := shared[string(f.GroupPK)]
+		if !ok {
+			continue
+		}
+
+		store, ok := digestStores(gc)[f.Store]
+		if !ok {
+			continue
+		}
+
+		ok, err := s.syncStoreEntry(ctx, store, f.Entry)
+		if err != nil {
+			s.logger.Debug("unable to sync encounter entry", zap.Stringer("peer", pid), zap.Error(err))
+			continue
+		}
+
+		if ok {
+			synced++
+		}
+	}
+}
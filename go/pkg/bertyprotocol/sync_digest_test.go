@@ -0,0 +1,63 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncDigestClock(t *testing.T) {
+	clock := syncDigestClock{}
+	clock.observe("alice", 3)
+	clock.observe("alice", 1)
+	clock.observe("bob", 2)
+
+	assert.Equal(t, syncDigestClock{"alice": 3, "bob": 2}, clock)
+
+	assert.False(t, clock.missing("alice", 3))
+	assert.True(t, clock.missing("alice", 4))
+	assert.False(t, clock.missing("bob", 1))
+
+	// a writer the peer never saw
+	assert.True(t, clock.missing("carol", 1))
+}
+
+func TestSyncDigestItemsOrder(t *testing.T) {
+	items := []*syncDigestItem{
+		{store: deviceSyncMessages, payload: make([]byte, 300)},
+		{store: deviceSyncMetadata, payload: make([]byte, 10)},
+		{store: deviceSyncMessages, payload: make([]byte, 20)},
+		{store: deviceSyncMetadata, payload: make([]byte, 20)},
+	}
+
+	sortSyncDigestItems(items)
+
+	sizes := []int{}
+	for _, item := range items {
+		sizes = append(sizes, len(item.payload))
+	}
+
+	assert.Equal(t, []int{10, 20, 20, 300}, sizes)
+
+	// the order is kept for the same size
+	assert.Equal(t, deviceSyncMessages, items[1].store)
+	assert.Equal(t, deviceSyncMetadata, items[2].store)
+}
+
+func TestSyncDigestsBegin(t *testing.T) {
+	sd := newSyncDigests()
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+	now := time.Now()
+
+	assert.True(t, sd.begin(alice, now))
+	assert.False(t, sd.begin(alice, now.Add(time.Second)))
+	assert.True(t, sd.begin(bob, now.Add(time.Second)))
+
+	assert.True(t, sd.begin(alice, now.Add(syncDigestInterval)))
+
+	// the exchanges older than the interval are forgotten
+	sd.begin(bob, now.Add(3*syncDigestInterval))
+	assert.Len(t, sd.exchanges, 1)
+}
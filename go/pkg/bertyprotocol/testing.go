@@ -10,6 +10,8 @@ import (
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
 	keystore "github.com/ipfs/go-ipfs-keystore"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
@@ -27,6 +29,12 @@ type TestingProtocol struct {
 	Service Service
 	Client  Client
 	IPFS    ipfsutil.CoreAPIMock
+
+	serverOpts     []grpc.ServerOption
+	clientOpts     []grpc.DialOption
+	cancelService  context.CancelFunc
+	cleanupService func()
+	cleanupClient  func()
 }
 
 type TestingOpts struct {
@@ -34,6 +42,9 @@ type TestingOpts struct {
 	TracerProvider trace.Provider
 	Mocknet        libp2p_mocknet.Mocknet
 	RDVPeer        peer.AddrInfo
+
+	// Chaos, if set, injects network conditions in the streams of the node
+	Chaos *ipfsutil.Chaos
 }
 
 func NewTestingProtocol(ctx context.Context, t *testing.T, opts *TestingOpts) (*TestingProtocol, func()) {
@@ -48,22 +59,23 @@ func NewTestingProtocol(ctx context.Context, t *testing.T, opts *TestingOpts) (*
 		Logger:  opts.Logger,
 		Mocknet: opts.Mocknet,
 		RDVPeer: opts.RDVPeer,
+		Chaos:   opts.Chaos,
 	}
 
 	node, cleanupNode := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, ipfsopts)
 
+	// the datastores are kept by a restart
 	serviceOpts := Opts{
 		Host:            node.MockNode().PeerHost,
 		PubSub:          node.PubSub(),
 		Logger:          opts.Logger,
 		DeviceKeystore:  NewDeviceKeystore(keystore.NewMemKeystore()),
 		MessageKeystore: NewInMemMessageKeystore(),
+		RootDatastore:   ds_sync.MutexWrap(datastore.NewMapDatastore()),
 		IpfsCoreAPI:     node.API(),
 		TinderDriver:    node.Tinder(),
 	}
 
-	service, cleanupService := TestingService(t, serviceOpts)
-
 	if opts.TracerProvider == nil {
 		servicename := node.MockNode().Identity.ShortString()
 		opts.TracerProvider = tracer.NewTestingProvider(t, servicename)
@@ -93,23 +105,52 @@ func NewTestingProtocol(ctx context.Context, t *testing.T, opts *TestingOpts) (*
 		grpc.WithChainStreamInterceptor(grpc_trace.StreamClientInterceptor(trClient)),
 	}
 
-	server := grpc.NewServer(serverOpts...)
-	client, cleanupClient := TestingClientFromServer(t, server, service, clientOpts...)
-
 	tp := &TestingProtocol{
-		Opts:    &serviceOpts,
-		Client:  client,
-		Service: service,
-		IPFS:    node,
+		Opts:       &serviceOpts,
+		IPFS:       node,
+		serverOpts: serverOpts,
+		clientOpts: clientOpts,
 	}
+	tp.start(t)
+
 	cleanup := func() {
-		cleanupClient()
-		cleanupService()
+		tp.stop()
 		cleanupNode()
 	}
 	return tp, cleanup
 }
 
+// Restart closes the service of the node and opens a new one on the same
+// host, keystores and datastores, e.g. to open the account a device was
+// linked to.
+func (tp *TestingProtocol) Restart(t *testing.T) {
+	t.Helper()
+
+	tp.stop()
+	tp.start(t)
+}
+
+func (tp *TestingProtocol) start(t *testing.T) {
+	t.Helper()
+
+	// the goroutines of the service are stopped with it
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := *tp.Opts
+	opts.RootContext = ctx
+
+	tp.Service, tp.cleanupService = TestingService(t, opts)
+	tp.cancelService = cancel
+
+	server := grpc.NewServer(tp.serverOpts...)
+	tp.Client, tp.cleanupClient = TestingClientFromServer(t, server, tp.Service, tp.clientOpts...)
+}
+
+func (tp *TestingProtocol) stop() {
+	tp.cleanupClient()
+	tp.cleanupService()
+	tp.cancelService()
+}
+
 func (opts *TestingOpts) applyDefaults(ctx context.Context) {
 	if opts.Logger == nil {
 		opts.Logger = zap.NewNop()
@@ -0,0 +1,644 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/tracer"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	libp2p_mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testingNetworkPollInterval is the interval between two checks of the
+// assertions of a TestingNetwork.
+const testingNetworkPollInterval = 50 * time.Millisecond
+
+// TestingTopology returns the links between n nodes, by index.
+type TestingTopology func(n int) [][2]int
+
+// TopologyFull links every node to every other one.
+func TopologyFull(n int) [][2]int {
+	links := [][2]int{}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			links = append(links, [2]int{i, j})
+		}
+	}
+
+	return links
+}
+
+// TopologyLine links every node to the next one:
+// 0 ─ 1 ─ 2 ─ ... ─ n-1
+func TopologyLine(n int) [][2]int {
+	links := [][2]int{}
+	for i := 0; i < n-1; i++ {
+		links = append(links, [2]int{i, i + 1})
+	}
+
+	return links
+}
+
+// TopologyStar links every node to the first one.
+func TopologyStar(n int) [][2]int {
+	links := [][2]int{}
+	for i := 1; i < n; i++ {
+		links = append(links, [2]int{0, i})
+	}
+
+	return links
+}
+
+// TestingNetworkOpts configures a TestingNetwork.
+type TestingNetworkOpts struct {
+	Logger *zap.Logger
+
+	// Nodes is the number of nodes, 2 by default
+	Nodes int
+
+	// Topology links the nodes once started, TopologyFull by default
+	Topology TestingTopology
+
+	// Link is applied to every link, e.g. its latency
+	Link libp2p_mocknet.LinkOptions
+
+	// Chaos, if set, injects network conditions in the streams of every
+	// node, the seed of a node is the one of the conditions plus its index
+	Chaos *ipfsutil.ChaosOpts
+}
+
+func (opts *TestingNetworkOpts) applyDefaults() {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	if opts.Nodes <= 0 {
+		opts.Nodes = 2
+	}
+
+	if opts.Topology == nil {
+		opts.Topology = TopologyFull
+	}
+}
+
+// TestingNetwork runs full nodes in the process, connected by the in-memory
+// transport of a mocknet. The nodes are only connected through the links of
+// the topology, the test can cut and restore them, e.g. to partition the
+// network, and assert on the delivery of the messages, the convergence of
+// the groups and their members.
+//
+// The nodes find each other through a rendezvous point linked to all of
+// them, it doesn't join the groups, so the messages only follow the links
+// between the nodes.
+type TestingNetwork struct {
+	Mocknet libp2p_mocknet.Mocknet
+	Nodes   []*TestingProtocol
+
+	t        *testing.T
+	topology [][2]int
+}
+
+// NewTestingNetwork starts the nodes and links them with the topology.
+func NewTestingNetwork(ctx context.Context, t *testing.T, opts *TestingNetworkOpts) (*TestingNetwork, func()) {
+	t.Helper()
+
+	if opts == nil {
+		opts = &TestingNetworkOpts{}
+	}
+	opts.applyDefaults()
+
+	mn := libp2p_mocknet.New(ctx)
+	mn.SetLinkDefaults(opts.Link)
+
+	rdvpeer, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	_, cleanupRDVP := ipfsutil.TestingRDVP(ctx, t, rdvpeer)
+
+	n := &TestingNetwork{
+		Mocknet:  mn,
+		Nodes:    make([]*TestingProtocol, opts.Nodes),
+		t:        t,
+		topology: opts.Topology(opts.Nodes),
+	}
+
+	cleanups := make([]func(), opts.Nodes)
+	for i := range n.Nodes {
+		name := fmt.Sprintf("node[%d]", i)
+
+		var chaos *ipfsutil.Chaos
+		if opts.Chaos != nil {
+			chaosOpts := *opts.Chaos
+			chaosOpts.Logger = opts.Logger.Named(name).Named("chaos")
+			if chaosOpts.Seed != 0 {
+				chaosOpts.Seed += int64(i)
+			}
+
+			chaos = ipfsutil.NewChaos(chaosOpts)
+		}
+
+		n.Nodes[i], cleanups[i] = NewTestingProtocol(ctx, t, &TestingOpts{
+			Logger:         opts.Logger.Named(name),
+			TracerProvider: tracer.NewTestingProvider(t, name),
+			Mocknet:        mn,
+			RDVPeer:        rdvpeer.Peerstore().PeerInfo(rdvpeer.ID()),
+			Chaos:          chaos,
+		})
+
+		_, err := mn.ConnectPeers(n.peer(i), rdvpeer.ID())
+		require.NoError(t, err)
+	}
+
+	n.Heal()
+
+	cleanup := func() {
+		for i := range cleanups {
+			cleanups[i]()
+		}
+
+		cleanupRDVP()
+	}
+
+	return n, cleanup
+}
+
+func (n *TestingNetwork) peer(i int) peer.ID {
+	return n.Nodes[i].Opts.Host.ID()
+}
+
+// Connect links two nodes and connects them.
+func (n *TestingNetwork) Connect(i, j int) {
+	n.t.Helper()
+
+	if err := n.connect(i, j); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// Disconnect cuts the link between two nodes, they can't reach each other
+// directly until connected again.
+func (n *TestingNetwork) Disconnect(i, j int) {
+	n.t.Helper()
+
+	if err := n.disconnect(i, j); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// connect and disconnect don't fail the test, they can be called outside of
+// its goroutine.
+func (n *TestingNetwork) connect(i, j int) error {
+	if len(n.Mocknet.LinksBetweenPeers(n.peer(i), n.peer(j))) == 0 {
+		if _, err := n.Mocknet.LinkPeers(n.peer(i), n.peer(j)); err != nil {
+			return fmt.Errorf("unable to link node %d to node %d: %w", i, j, err)
+		}
+	}
+
+	if _, err := n.Mocknet.ConnectPeers(n.peer(i), n.peer(j)); err != nil {
+		return fmt.Errorf("unable to connect node %d to node %d: %w", i, j, err)
+	}
+
+	return nil
+}
+
+func (n *TestingNetwork) disconnect(i, j int) error {
+	// the nodes aren't linked outside of the topology
+	_ = n.Mocknet.UnlinkPeers(n.peer(i), n.peer(j))
+
+	if err := n.Mocknet.DisconnectPeers(n.peer(i), n.peer(j)); err != nil {
+		return fmt.Errorf("unable to disconnect node %d from node %d: %w", i, j, err)
+	}
+
+	return nil
+}
+
+// Partition cuts the links between the nodes of different sides, e.g.
+// Partition([]int{0, 1}, []int{2}) isolates the node 2.
+func (n *TestingNetwork) Partition(sides ...[]int) {
+	n.t.Helper()
+
+	for a := range sides {
+		for b := a + 1; b < len(sides); b++ {
+			for _, i := range sides[a] {
+				for _, j := range sides[b] {
+					n.Disconnect(i, j)
+				}
+			}
+		}
+	}
+}
+
+// Heal restores the links of the topology.
+func (n *TestingNetwork) Heal() {
+	n.t.Helper()
+
+	for _, link := range n.topology {
+		n.Connect(link[0], link[1])
+	}
+}
+
+// CreateGroup creates a MultiMember group joined and activated by the given
+// nodes, every node by default, and waits for its members.
+func (n *TestingNetwork) CreateGroup(ctx context.Context, members ...int) []byte {
+	n.t.Helper()
+
+	groupPK, err := n.NewGroup(ctx, members...)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+
+	return groupPK
+}
+
+// NewGroup is CreateGroup returning an error.
+func (n *TestingNetwork) NewGroup(ctx context.Context, members ...int) ([]byte, error) {
+	members = n.nodesOrAll(members)
+
+	group, _, err := NewGroupMultiMember()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range members {
+		if _, err := n.Nodes[i].Client.MultiMemberGroupJoin(ctx, &bertytypes.MultiMemberGroupJoin_Request{Group: group}); err != nil {
+			return nil, fmt.Errorf("node %d is unable to join the group: %w", i, err)
+		}
+
+		if _, err := n.Nodes[i].Client.ActivateGroup(ctx, &bertytypes.ActivateGroup_Request{GroupPK: group.PublicKey}); err != nil {
+			return nil, fmt.Errorf("node %d is unable to activate the group: %w", i, err)
+		}
+	}
+
+	if err := n.WaitMembers(ctx, group.PublicKey, members...); err != nil {
+		return nil, err
+	}
+
+	return group.PublicKey, nil
+}
+
+// Send sends a message of a node on a group.
+func (n *TestingNetwork) Send(ctx context.Context, i int, groupPK []byte, payload []byte) {
+	n.t.Helper()
+
+	if err := n.SendMessage(ctx, i, groupPK, payload); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// SendMessage is Send returning an error.
+func (n *TestingNetwork) SendMessage(ctx context.Context, i int, groupPK []byte, payload []byte) error {
+	if _, err := n.Nodes[i].Client.AppMessageSend(ctx, &bertytypes.AppMessageSend_Request{GroupPK: groupPK, Payload: payload}); err != nil {
+		return fmt.Errorf("unable to send a message of node %d: %w", i, err)
+	}
+
+	return nil
+}
+
+// RequireDelivered waits until the message is readable by the receivers,
+// every node by default.
+func (n *TestingNetwork) RequireDelivered(ctx context.Context, groupPK []byte, payload []byte, receivers ...int) {
+	n.t.Helper()
+
+	if err := n.WaitDelivered(ctx, groupPK, payload, receivers...); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// WaitDelivered is RequireDelivered returning an error, e.g. for the
+// reports of a TestingScenario.
+func (n *TestingNetwork) WaitDelivered(ctx context.Context, groupPK []byte, payload []byte, receivers ...int) error {
+	for _, i := range n.nodesOrAll(receivers) {
+		err := n.waitFor(ctx, fmt.Sprintf("message %q not delivered to node %d", payload, i), func() bool {
+			messages, _ := n.messages(ctx, i, groupPK)
+			for _, m := range messages {
+				if bytes.Equal(m.Message, payload) {
+					return true
+				}
+			}
+
+			return false
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RequireConverged waits until the nodes, every node by default, have the
+// same messages and the same metadata events on a group.
+func (n *TestingNetwork) RequireConverged(ctx context.Context, groupPK []byte, nodes ...int) {
+	n.t.Helper()
+
+	if err := n.WaitConverged(ctx, groupPK, nodes...); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// WaitConverged is RequireConverged returning an error.
+func (n *TestingNetwork) WaitConverged(ctx context.Context, groupPK []byte, nodes ...int) error {
+	nodes = n.nodesOrAll(nodes)
+
+	return n.waitFor(ctx, fmt.Sprintf("group not converged on the nodes %v", nodes), func() bool {
+		var first []string
+		for k, i := range nodes {
+			state, ok := n.groupState(ctx, i, groupPK)
+			if !ok {
+				return false
+			}
+
+			if k == 0 {
+				first = state
+				continue
+			}
+
+			if len(state) != len(first) {
+				return false
+			}
+
+			for l := range state {
+				if state[l] != first[l] {
+					return false
+				}
+			}
+		}
+
+		return true
+	})
+}
+
+// RequireMembers waits until every given node sees exactly the given nodes
+// as the members of a group.
+func (n *TestingNetwork) RequireMembers(ctx context.Context, groupPK []byte, members ...int) {
+	n.t.Helper()
+
+	if err := n.WaitMembers(ctx, groupPK, members...); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// WaitMembers is RequireMembers returning an error.
+func (n *TestingNetwork) WaitMembers(ctx context.Context, groupPK []byte, members ...int) error {
+	members = n.nodesOrAll(members)
+
+	expected := make([]string, len(members))
+	for k, i := range members {
+		info, err := n.Nodes[i].Client.GroupInfo(ctx, &bertytypes.GroupInfo_Request{GroupPK: groupPK})
+		if err != nil {
+			return fmt.Errorf("unable to get the group info of node %d: %w", i, err)
+		}
+		expected[k] = string(info.MemberPK)
+	}
+	sort.Strings(expected)
+
+	for _, i := range members {
+		svc, ok := n.Nodes[i].Service.(*service)
+		if !ok {
+			return fmt.Errorf("node %d isn't a protocol service", i)
+		}
+
+		err := n.waitFor(ctx, fmt.Sprintf("node %d doesn't see the members %v", i, members), func() bool {
+			gc, err := svc.getContextGroupForID(groupPK)
+			if err != nil {
+				return false
+			}
+
+			listed := []string{}
+			for _, pk := range gc.MetadataStore().ListMembers() {
+				raw, err := pk.Raw()
+				if err != nil {
+					return false
+				}
+
+				listed = append(listed, string(raw))
+			}
+			sort.Strings(listed)
+
+			if len(listed) != len(expected) {
+				return false
+			}
+
+			for k := range listed {
+				if listed[k] != expected[k] {
+					return false
+				}
+			}
+
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restart restarts the service of a node on the same host and datastores.
+func (n *TestingNetwork) Restart(i int) {
+	n.t.Helper()
+
+	n.Nodes[i].Restart(n.t)
+}
+
+// DevicePK returns the device public key of a node.
+func (n *TestingNetwork) DevicePK(i int) ([]byte, error) {
+	sk, err := n.Nodes[i].Opts.DeviceKeystore.DevicePrivKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return sk.GetPublic().Raw()
+}
+
+// AccountGroupPK returns the public key of the account group of a node, the
+// group shared by the devices of an account.
+func (n *TestingNetwork) AccountGroupPK(ctx context.Context, i int) ([]byte, error) {
+	config, err := n.Nodes[i].Client.InstanceGetConfiguration(ctx, &bertytypes.InstanceGetConfiguration_Request{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the configuration of node %d: %w", i, err)
+	}
+
+	return config.AccountGroupPK, nil
+}
+
+// LinkDevice links the node j to the account of the node i, restarts it to
+// open the account and waits until the node i lists its device.
+func (n *TestingNetwork) LinkDevice(ctx context.Context, i, j int) error {
+	offer, err := n.Nodes[j].Service.DeviceLinkOffer(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get the offer of node %d: %w", j, err)
+	}
+
+	if _, err := n.Nodes[i].Service.DeviceLinkAccept(ctx, offer); err != nil {
+		return fmt.Errorf("node %d is unable to link node %d: %w", i, j, err)
+	}
+
+	n.Restart(j)
+
+	devicePK, err := n.DevicePK(j)
+	if err != nil {
+		return err
+	}
+
+	return n.waitDevice(ctx, i, devicePK, fmt.Sprintf("node %d doesn't list the device of node %d", i, j), func(*AccountDevice) bool { return true })
+}
+
+// RevokeDevice revokes the device of the node j from the node i, and waits
+// until the given nodes, the node i by default, list it as revoked.
+func (n *TestingNetwork) RevokeDevice(ctx context.Context, i, j int, nodes ...int) error {
+	devicePK, err := n.DevicePK(j)
+	if err != nil {
+		return err
+	}
+
+	if err := n.Nodes[i].Service.DeviceRevoke(ctx, devicePK); err != nil {
+		return fmt.Errorf("node %d is unable to revoke node %d: %w", i, j, err)
+	}
+
+	if len(nodes) == 0 {
+		nodes = []int{i}
+	}
+
+	for _, k := range nodes {
+		err := n.waitDevice(ctx, k, devicePK, fmt.Sprintf("node %d doesn't list the device of node %d as revoked", k, j), func(d *AccountDevice) bool { return d.Revoked })
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitDevice waits until a node lists a device of its account matching the
+// condition.
+func (n *TestingNetwork) waitDevice(ctx context.Context, i int, devicePK []byte, msg string, condition func(*AccountDevice) bool) error {
+	return n.waitFor(ctx, msg, func() bool {
+		devices, err := n.Nodes[i].Service.DeviceList(ctx)
+		if err != nil {
+			return false
+		}
+
+		for _, d := range devices {
+			if bytes.Equal(d.DevicePK, devicePK) {
+				return condition(d)
+			}
+		}
+
+		return false
+	})
+}
+
+// CountDelivered returns the number of messages of a group readable by a
+// node whose payload starts with a prefix.
+func (n *TestingNetwork) CountDelivered(ctx context.Context, i int, groupPK []byte, prefix []byte) (int, bool) {
+	messages, ok := n.messages(ctx, i, groupPK)
+	if !ok {
+		return 0, false
+	}
+
+	count := 0
+	for _, m := range messages {
+		if bytes.HasPrefix(m.Message, prefix) {
+			count++
+		}
+	}
+
+	return count, true
+}
+
+func (n *TestingNetwork) nodesOrAll(nodes []int) []int {
+	if len(nodes) > 0 {
+		return nodes
+	}
+
+	all := make([]int, len(n.Nodes))
+	for i := range all {
+		all[i] = i
+	}
+
+	return all
+}
+
+// waitFor checks the condition until it is true or the context is done.
+func (n *TestingNetwork) waitFor(ctx context.Context, msg string, condition func() bool) error {
+	ticker := time.NewTicker(testingNetworkPollInterval)
+	defer ticker.Stop()
+
+	for !condition() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", msg, ctx.Err())
+		}
+	}
+
+	return nil
+}
+
+func (n *TestingNetwork) messages(ctx context.Context, i int, groupPK []byte) ([]*bertytypes.GroupMessageEvent, bool) {
+	list, err := n.Nodes[i].Client.GroupMessageList(ctx, &bertytypes.GroupMessageList_Request{GroupPK: groupPK})
+	if err != nil {
+		return nil, false
+	}
+
+	messages := []*bertytypes.GroupMessageEvent{}
+	for {
+		m, err := list.Recv()
+		if err == io.EOF {
+			return messages, true
+		} else if err != nil {
+			return nil, false
+		}
+
+		messages = append(messages, m)
+	}
+}
+
+// groupState returns the sorted IDs of the messages and the metadata events
+// of a group seen by a node.
+func (n *TestingNetwork) groupState(ctx context.Context, i int, groupPK []byte) ([]string, bool) {
+	messages, ok := n.messages(ctx, i, groupPK)
+	if !ok {
+		return nil, false
+	}
+
+	state := []string{}
+	for _, m := range messages {
+		if m.EventContext != nil {
+			state = append(state, "message/"+string(m.EventContext.ID))
+		}
+	}
+
+	list, err := n.Nodes[i].Client.GroupMetadataList(ctx, &bertytypes.GroupMetadataList_Request{GroupPK: groupPK})
+	if err != nil {
+		return nil, false
+	}
+
+	for {
+		e, err := list.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false
+		}
+
+		if e.EventContext != nil {
+			state = append(state, "metadata/"+string(e.EventContext.ID))
+		}
+	}
+
+	sort.Strings(state)
+
+	return state, true
+}
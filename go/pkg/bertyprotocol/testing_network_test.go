@@ -0,0 +1,73 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestingTopologies(t *testing.T) {
+	assert.Equal(t, [][2]int{{0, 1}, {0, 2}, {1, 2}}, TopologyFull(3))
+	assert.Equal(t, [][2]int{{0, 1}, {1, 2}}, TopologyLine(3))
+	assert.Equal(t, [][2]int{{0, 1}, {0, 2}}, TopologyStar(3))
+	assert.Empty(t, TopologyLine(1))
+}
+
+func TestTestingNetworkPartition(t *testing.T) {
+	testutil.SkipSlow(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	n, cleanup := NewTestingNetwork(ctx, t, &TestingNetworkOpts{
+		Logger:   testutil.Logger(t),
+		Nodes:    3,
+		Topology: TopologyLine,
+	})
+	defer cleanup()
+
+	groupPK := n.CreateGroup(ctx)
+
+	// the messages of the node 0 reach the node 2 through the node 1
+	n.Send(ctx, 0, groupPK, []byte("before"))
+	n.RequireDelivered(ctx, groupPK, []byte("before"))
+
+	// the node 2 catches up once the partition is healed
+	n.Partition([]int{0, 1}, []int{2})
+	n.Send(ctx, 0, groupPK, []byte("during"))
+	n.RequireDelivered(ctx, groupPK, []byte("during"), 0, 1)
+
+	n.Heal()
+	n.RequireDelivered(ctx, groupPK, []byte("during"), 2)
+	n.RequireConverged(ctx, groupPK)
+}
+
+func TestTestingNetworkChaos(t *testing.T) {
+	testutil.SkipSlow(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	n, cleanup := NewTestingNetwork(ctx, t, &TestingNetworkOpts{
+		Logger: testutil.Logger(t),
+		Nodes:  2,
+		Chaos: &ipfsutil.ChaosOpts{
+			Latency: 20 * time.Millisecond,
+			Jitter:  10 * time.Millisecond,
+			Loss:    0.05,
+			Reorder: 0.1,
+			Seed:    42,
+		},
+	})
+	defer cleanup()
+
+	groupPK := n.CreateGroup(ctx)
+
+	n.Send(ctx, 0, groupPK, []byte("lossy"))
+	n.RequireDelivered(ctx, groupPK, []byte("lossy"))
+	n.RequireConverged(ctx, groupPK)
+}
@@ -0,0 +1,350 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultScenarioFlappingPeriod is the time a flapping link stays up, then
+// down.
+const DefaultScenarioFlappingPeriod = 500 * time.Millisecond
+
+// TestingScenario scripts a flow on a TestingNetwork, e.g. a device linked
+// to an account then revoked, to test a change of the protocol end to end.
+// The steps run in order, the first failed one stops the scenario.
+type TestingScenario struct {
+	Name    string
+	Network TestingNetworkOpts
+	Steps   []TestingScenarioStep
+}
+
+// TestingScenarioStep is a step of a TestingScenario.
+type TestingScenarioStep struct {
+	Name string
+	Run  func(ctx context.Context, r *TestingScenarioRun) error
+}
+
+// TestingScenarioRun is the state shared by the steps of a scenario.
+type TestingScenarioRun struct {
+	Network *TestingNetwork
+
+	groups map[string][]byte
+	step   *TestingScenarioStepReport
+}
+
+// Group returns the public key of a group registered by a previous step.
+func (r *TestingScenarioRun) Group(name string) ([]byte, error) {
+	groupPK, ok := r.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown group %q", name)
+	}
+
+	return groupPK, nil
+}
+
+// SetGroup registers a group for the next steps.
+func (r *TestingScenarioRun) SetGroup(name string, groupPK []byte) {
+	r.groups[name] = groupPK
+}
+
+// Measure adds a metric to the report of the current step, e.g. a rate.
+func (r *TestingScenarioRun) Measure(name string, value float64) {
+	r.step.Metrics[name] = value
+}
+
+// TestingScenarioReport is the timing and the outcome of a scenario and of
+// its steps.
+type TestingScenarioReport struct {
+	Scenario   string                       `json:"scenario"`
+	Started    time.Time                    `json:"started"`
+	DurationMS int64                        `json:"duration_ms"`
+	Passed     bool                         `json:"passed"`
+	Steps      []*TestingScenarioStepReport `json:"steps"`
+}
+
+// TestingScenarioStepReport is the timing and the outcome of a step, the
+// steps after a failed one aren't run.
+type TestingScenarioStepReport struct {
+	Name       string             `json:"name"`
+	DurationMS int64              `json:"duration_ms"`
+	Error      string             `json:"error,omitempty"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+}
+
+func (r *TestingScenarioReport) String() string {
+	out, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(out)
+}
+
+// RunTestingScenario runs a scenario on a new network and logs its report.
+// The test isn't failed by the scenario, the caller checks the report.
+func RunTestingScenario(ctx context.Context, t *testing.T, s *TestingScenario) *TestingScenarioReport {
+	t.Helper()
+
+	netOpts := s.Network
+	n, cleanup := NewTestingNetwork(ctx, t, &netOpts)
+	defer cleanup()
+
+	r := &TestingScenarioRun{Network: n, groups: map[string][]byte{}}
+	report := &TestingScenarioReport{Scenario: s.Name, Started: time.Now(), Passed: true, Steps: []*TestingScenarioStepReport{}}
+
+	for _, step := range s.Steps {
+		r.step = &TestingScenarioStepReport{Name: step.Name, Metrics: map[string]float64{}}
+		report.Steps = append(report.Steps, r.step)
+
+		start := time.Now()
+		err := step.Run(ctx, r)
+		r.step.DurationMS = time.Since(start).Milliseconds()
+
+		if err != nil {
+			r.step.Error = err.Error()
+			report.Passed = false
+			break
+		}
+	}
+
+	report.DurationMS = time.Since(report.Started).Milliseconds()
+	t.Logf("scenario report:\n%s", report)
+
+	return report
+}
+
+// StepLinkDevice links the node j to the account of the node i.
+func StepLinkDevice(i, j int) TestingScenarioStep {
+	return TestingScenarioStep{
+		Name: fmt.Sprintf("link node %d to the account of node %d", j, i),
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			return r.Network.LinkDevice(ctx, i, j)
+		},
+	}
+}
+
+// StepRevokeDevice revokes the device of the node j from the node i, and
+// waits until the given nodes list it as revoked.
+func StepRevokeDevice(i, j int, nodes ...int) TestingScenarioStep {
+	return TestingScenarioStep{
+		Name: fmt.Sprintf("revoke node %d from node %d", j, i),
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			return r.Network.RevokeDevice(ctx, i, j, nodes...)
+		},
+	}
+}
+
+// StepAccountGroup registers the account group of a node.
+func StepAccountGroup(name string, i int) TestingScenarioStep {
+	return TestingScenarioStep{
+		Name: fmt.Sprintf("get the account group %q of node %d", name, i),
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			groupPK, err := r.Network.AccountGroupPK(ctx, i)
+			if err != nil {
+				return err
+			}
+
+			r.SetGroup(name, groupPK)
+			return nil
+		},
+	}
+}
+
+// StepCreateGroup creates and registers a MultiMember group joined by the
+// given nodes, every node by default.
+func StepCreateGroup(name string, members ...int) TestingScenarioStep {
+	return TestingScenarioStep{
+		Name: fmt.Sprintf("create the group %q", name),
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			groupPK, err := r.Network.NewGroup(ctx, members...)
+			if err != nil {
+				return err
+			}
+
+			r.SetGroup(name, groupPK)
+			return nil
+		},
+	}
+}
+
+// StepSendMessages sends count messages of a node on a group, their
+// payload is the prefix followed by their index.
+func StepSendMessages(group string, i int, prefix string, count int) TestingScenarioStep {
+	return TestingScenarioStep{
+		Name: fmt.Sprintf("send %d %q messages of node %d on %q", count, prefix, i, group),
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			groupPK, err := r.Group(group)
+			if err != nil {
+				return err
+			}
+
+			start := time.Now()
+			for k := 0; k < count; k++ {
+				if err := r.Network.SendMessage(ctx, i, groupPK, []byte(fmt.Sprintf("%s%d", prefix, k))); err != nil {
+					return err
+				}
+			}
+
+			r.Measure("messages_per_second", float64(count)/time.Since(start).Seconds())
+			return nil
+		},
+	}
+}
+
+// StepWaitDelivered waits until the receivers, every node by default, can
+// read count messages of a group whose payload starts with the prefix.
+func StepWaitDelivered(group string, prefix string, count int, receivers ...int) TestingScenarioStep {
+	return TestingScenarioStep{
+		Name: fmt.Sprintf("wait for %d %q messages on %q", count, prefix, group),
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			groupPK, err := r.Group(group)
+			if err != nil {
+				return err
+			}
+
+			n := r.Network
+			for _, i := range n.nodesOrAll(receivers) {
+				delivered := 0
+				err := n.waitFor(ctx, fmt.Sprintf("messages not delivered to node %d", i), func() bool {
+					delivered, _ = n.CountDelivered(ctx, i, groupPK, []byte(prefix))
+					return delivered >= count
+				})
+
+				r.Measure(fmt.Sprintf("delivered_to_node_%d", i), float64(delivered))
+				if err != nil {
+					return fmt.Errorf("%d/%d: %w", delivered, count, err)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// StepWaitConverged waits until the nodes, every node by default, have the
+// same messages and metadata events on a group.
+func StepWaitConverged(group string, nodes ...int) TestingScenarioStep {
+	return TestingScenarioStep{
+		Name: fmt.Sprintf("wait for the convergence of %q", group),
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			groupPK, err := r.Group(group)
+			if err != nil {
+				return err
+			}
+
+			return r.Network.WaitConverged(ctx, groupPK, nodes...)
+		},
+	}
+}
+
+// StepSequence runs steps as one, e.g. to flap the links while the messages
+// are sent and delivered.
+func StepSequence(name string, steps ...TestingScenarioStep) TestingScenarioStep {
+	return TestingScenarioStep{
+		Name: name,
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			for _, step := range steps {
+				if err := step.Run(ctx, r); err != nil {
+					return fmt.Errorf("%s: %w", step.Name, err)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// StepFlapping runs a step while the given links go down and up again every
+// period, DefaultScenarioFlappingPeriod if zero. The links are up once the
+// step is done.
+func StepFlapping(period time.Duration, links [][2]int, step TestingScenarioStep) TestingScenarioStep {
+	if period <= 0 {
+		period = DefaultScenarioFlappingPeriod
+	}
+
+	return TestingScenarioStep{
+		Name: step.Name + " with flapping links",
+		Run: func(ctx context.Context, r *TestingScenarioRun) error {
+			n := r.Network
+
+			var (
+				wg    sync.WaitGroup
+				flaps int
+			)
+
+			flapCtx, cancel := context.WithCancel(ctx)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				ticker := time.NewTicker(period)
+				defer ticker.Stop()
+
+				up := true
+				for {
+					select {
+					case <-ticker.C:
+					case <-flapCtx.Done():
+						return
+					}
+
+					for _, link := range links {
+						if up {
+							_ = n.disconnect(link[0], link[1])
+						} else {
+							_ = n.connect(link[0], link[1])
+						}
+					}
+
+					if up {
+						flaps++
+					}
+					up = !up
+				}
+			}()
+
+			err := step.Run(ctx, r)
+
+			cancel()
+			wg.Wait()
+
+			for _, link := range links {
+				if cerr := n.connect(link[0], link[1]); cerr != nil && err == nil {
+					err = cerr
+				}
+			}
+
+			r.Measure("flaps", float64(flaps))
+			return err
+		},
+	}
+}
+
+// ScenarioDevices is the flow of the devices of an account: the node 0
+// links the node 1, sends messages to it while their link flaps, links the
+// node 2 and then revokes it.
+func ScenarioDevices(messages int) *TestingScenario {
+	return &TestingScenario{
+		Name:    "devices",
+		Network: TestingNetworkOpts{Nodes: 3},
+		Steps: []TestingScenarioStep{
+			StepLinkDevice(0, 1),
+			StepAccountGroup("account", 0),
+			StepFlapping(0, [][2]int{{0, 1}}, StepSequence(fmt.Sprintf("exchange %d messages", messages),
+				StepSendMessages("account", 0, "flapping/", messages),
+				StepWaitDelivered("account", "flapping/", messages, 1),
+			)),
+			StepLinkDevice(0, 2),
+			StepSendMessages("account", 2, "third/", 1),
+			StepWaitDelivered("account", "third/", 1, 0, 1),
+			StepRevokeDevice(0, 2, 0, 1),
+			StepSendMessages("account", 0, "revoked/", 1),
+			StepWaitDelivered("account", "revoked/", 1, 1),
+			StepWaitConverged("account", 0, 1),
+		},
+	}
+}
@@ -0,0 +1,24 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestingScenarioDevices(t *testing.T) {
+	testutil.SkipSlow(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	s := ScenarioDevices(100)
+	s.Network.Logger = testutil.Logger(t)
+
+	report := RunTestingScenario(ctx, t, s)
+	require.True(t, report.Passed, report.String())
+	require.Len(t, report.Steps, len(s.Steps))
+}
@@ -0,0 +1,320 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/bertytypes"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"go.uber.org/zap"
+)
+
+const typingProtocolID = protocol.ID("/berty/typing/1.0.0")
+
+const (
+	// typingInterval is the minimum interval between two "typing started"
+	// signals of a conversation, the signal is repeated while typing
+	typingInterval = 3 * time.Second
+
+	// typingExpiry is how long a device is seen typing without a new signal
+	typingExpiry = 2 * typingInterval
+
+	// typingMaxAge refuses the signals replayed later
+	typingMaxAge = 30 * time.Second
+
+	typingSendTimeout = 5 * time.Second
+)
+
+// EvtTypingChanged is emitted on the event bus of the host when a device of
+// a conversation starts or stops typing, or once its last signal expires.
+type EvtTypingChanged struct {
+	GroupPK  []byte
+	DevicePK []byte
+	Typing   bool
+}
+
+// typingSignal is only sent over the open connections, it is never queued
+// nor persisted.
+type typingSignal struct {
+	GroupPK  []byte `json:"group_pk"`
+	DevicePK []byte `json:"device_pk"`
+	Typing   bool   `json:"typing"`
+	SentAt   int64  `json:"sent_at"`
+	Sig      []byte `json:"sig"`
+}
+
+func (t *typingSignal) signedBytes() []byte {
+	buf := make([]byte, 9)
+	binary.BigEndian.PutUint64(buf, uint64(t.SentAt))
+	if t.Typing {
+		buf[8] = 1
+	}
+
+	return bytes.Join([][]byte{[]byte("berty typing"), t.GroupPK, buf}, nil)
+}
+
+type typingState struct {
+	timer *time.Timer
+}
+
+// typingIndicators rate-limits the signals of the device and expires the
+// signals of the other devices.
+type typingIndicators struct {
+	logger  *zap.Logger
+	emitter event.Emitter
+
+	muSent sync.Mutex
+	sent   map[string]time.Time
+
+	muStates sync.Mutex
+	states   map[string]*typingState
+}
+
+func newTypingIndicators(logger *zap.Logger, h host.Host) (*typingIndicators, error) {
+	ti := &typingIndicators{
+		logger: logger,
+		sent:   make(map[string]time.Time),
+		states: make(map[string]*typingState),
+	}
+
+	if h != nil {
+		emitter, err := h.EventBus().Emitter(new(EvtTypingChanged))
+		if err != nil {
+			return nil, err
+		}
+
+		ti.emitter = emitter
+	}
+
+	return ti, nil
+}
+
+// shouldSend reports whether a signal of the device must be sent: a
+// "started" one at most every typingInterval, a "stopped" one only after a
+// "started" one.
+func (ti *typingIndicators) shouldSend(groupPK []byte, typing bool, now time.Time) bool {
+	ti.muSent.Lock()
+	defer ti.muSent.Unlock()
+
+	last, started := ti.sent[string(groupPK)]
+	if !typing {
+		delete(ti.sent, string(groupPK))
+		return started
+	}
+
+	if started && now.Sub(last) < typingInterval {
+		return false
+	}
+
+	ti.sent[string(groupPK)] = now
+
+	return true
+}
+
+func (ti *typingIndicators) emit(evt EvtTypingChanged) {
+	if ti.emitter == nil {
+		return
+	}
+
+	if err := ti.emitter.Emit(evt); err != nil {
+		ti.logger.Warn("unable to emit typing event", zap.Error(err))
+	}
+}
+
+// received updates the state of a device, a "started" signal expires after
+// typingExpiry without a new one.
+func (ti *typingIndicators) received(groupPK, devicePK []byte, typing bool) {
+	key := string(groupPK) + string(devicePK)
+
+	ti.muStates.Lock()
+	defer ti.muStates.Unlock()
+
+	state, ok := ti.states[key]
+	if ok {
+		state.timer.Stop()
+	}
+
+	if !typing {
+		delete(ti.states, key)
+		if ok {
+			ti.emit(EvtTypingChanged{GroupPK: groupPK, DevicePK: devicePK, Typing: false})
+		}
+
+		return
+	}
+
+	state = &typingState{}
+	state.timer = time.AfterFunc(typingExpiry, func() {
+		ti.muStates.Lock()
+		defer ti.muStates.Unlock()
+
+		if ti.states[key] != state {
+			return
+		}
+
+		delete(ti.states, key)
+		ti.emit(EvtTypingChanged{GroupPK: groupPK, DevicePK: devicePK, Typing: false})
+	})
+	ti.states[key] = state
+
+	if !ok {
+		ti.emit(EvtTypingChanged{GroupPK: groupPK, DevicePK: devicePK, Typing: true})
+	}
+}
+
+// typing returns the devices typing in a conversation.
+func (ti *typingIndicators) typing(groupPK []byte) [][]byte {
+	ti.muStates.Lock()
+	defer ti.muStates.Unlock()
+
+	devices := [][]byte{}
+	for key := range ti.states {
+		if len(key) > len(groupPK) && key[:len(groupPK)] == string(groupPK) {
+			devices = append(devices, []byte(key[len(groupPK):]))
+		}
+	}
+
+	return devices
+}
+
+// TypingSet signals the other devices of a conversation that the user
+// started or stopped typing, only to the peers currently connected.
+func (s *service) TypingSet(ctx context.Context, groupPK []byte, typing bool) error {
+	if s.host == nil {
+		return errcode.ErrNotImplemented
+	}
+
+	gc, err := s.getContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == bertytypes.GroupTypeAccount {
+		return errcode.ErrInvalidInput
+	}
+
+	now := time.Now()
+	if !s.typing.shouldSend(groupPK, typing, now) {
+		return nil
+	}
+
+	md, err := s.deviceKeystore.MemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	devicePK, err := md.device.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	signal := &typingSignal{GroupPK: groupPK, DevicePK: devicePK, Typing: typing, SentAt: now.UnixNano()}
+	if signal.Sig, err = md.device.Sign(signal.signedBytes()); err != nil {
+		return errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	for _, p := range s.conversations.groupPeers(groupPK) {
+		if s.host.Network().Connectedness(p) != network.Connected {
+			continue
+		}
+
+		go func(p peer.ID) {
+			if err := s.sendTypingSignal(p, signal); err != nil {
+				s.logger.Debug("unable to send typing signal", zap.Stringer("peer", p), zap.Error(err))
+			}
+		}(p)
+	}
+
+	return nil
+}
+
+func (s *service) sendTypingSignal(p peer.ID, signal *typingSignal) error {
+	ctx, cancel := context.WithTimeout(s.ctx, typingSendTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(network.WithNoDial(ctx, "typing"), p, typingProtocolID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(typingSendTimeout))
+
+	if err := json.NewEncoder(s.lanes.Stream(stream, ipfsutil.PriorityControl)).Encode(signal); err != nil {
+		_ = stream.Reset()
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) handleTypingSignal(stream network.Stream) {
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(typingSendTimeout))
+
+	signal := &typingSignal{}
+	if err := json.NewDecoder(io.LimitReader(stream, 4<<10)).Decode(signal); err != nil {
+		_ = stream.Reset()
+		return
+	}
+
+	if err := s.receiveTypingSignal(signal, time.Now()); err != nil {
+		s.logger.Debug("invalid typing signal", zap.Stringer("peer", stream.Conn().RemotePeer()), zap.Error(err))
+	}
+}
+
+func (s *service) receiveTypingSignal(signal *typingSignal, now time.Time) error {
+	if sentAt := time.Unix(0, signal.SentAt); now.Sub(sentAt) > typingMaxAge || sentAt.Sub(now) > typingMaxAge {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("typing signal too old"))
+	}
+
+	gc, err := s.getContextGroupForID(signal.GroupPK)
+	if err != nil {
+		return err
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(signal.DevicePK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := gc.MetadataStore().GetMemberByDevice(pk); err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if !gc.MetadataStore().isCurrentDevice(signal.DevicePK) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("not a member of the group anymore"))
+	}
+
+	if ok, err := pk.Verify(signal.signedBytes(), signal.Sig); err != nil || !ok {
+		return errcode.ErrCryptoSignatureVerification
+	}
+
+	s.typing.received(signal.GroupPK, signal.DevicePK, signal.Typing)
+
+	return nil
+}
+
+// TypingDevices returns the public keys of the devices typing in a
+// conversation.
+func (s *service) TypingDevices(_ context.Context, groupPK []byte) ([][]byte, error) {
+	if s.host == nil {
+		return nil, errcode.ErrNotImplemented
+	}
+
+	return s.typing.typing(groupPK), nil
+}
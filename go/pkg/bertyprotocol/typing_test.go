@@ -0,0 +1,43 @@
+package bertyprotocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTypingRateLimit(t *testing.T) {
+	ti, err := newTypingIndicators(zap.NewNop(), nil)
+	require.NoError(t, err)
+
+	groupPK := []byte("group")
+	now := time.Now()
+
+	// a "stopped" signal is only sent after a "started" one
+	assert.False(t, ti.shouldSend(groupPK, false, now))
+
+	assert.True(t, ti.shouldSend(groupPK, true, now))
+	assert.False(t, ti.shouldSend(groupPK, true, now.Add(typingInterval/2)))
+	assert.True(t, ti.shouldSend(groupPK, true, now.Add(typingInterval)))
+
+	assert.True(t, ti.shouldSend(groupPK, false, now.Add(typingInterval)))
+	assert.False(t, ti.shouldSend(groupPK, false, now.Add(typingInterval)))
+}
+
+func TestTypingReceived(t *testing.T) {
+	ti, err := newTypingIndicators(zap.NewNop(), nil)
+	require.NoError(t, err)
+
+	groupPK := []byte("group")
+
+	ti.received(groupPK, []byte("device1"), true)
+	ti.received(groupPK, []byte("device2"), true)
+	ti.received([]byte("other"), []byte("device3"), true)
+	assert.ElementsMatch(t, [][]byte{[]byte("device1"), []byte("device2")}, ti.typing(groupPK))
+
+	ti.received(groupPK, []byte("device1"), false)
+	assert.Equal(t, [][]byte{[]byte("device2")}, ti.typing(groupPK))
+}
@@ -0,0 +1,313 @@
+package bertyprotocol
+
+import (
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// The webhook service registers the URLs the node events are pushed to, for
+// the bots and the integrations. Its messages are plain protobuf messages:
+//
+//   service WebhookService {
+//     rpc WebhookRegister (WebhookRegister.Request) returns (WebhookRegister.Reply);
+//     rpc WebhookUnregister (WebhookUnregister.Request) returns (WebhookUnregister.Reply);
+//     rpc WebhookList (WebhookList.Request) returns (WebhookList.Reply);
+//     rpc WebhookDeliveries (WebhookDeliveries.Request) returns (WebhookDeliveries.Reply);
+//   }
+//
+//   message WebhookInfo {
+//     string id = 1;
+//     string url = 2;
+//     repeated string types = 3;
+//     bytes group_pk = 4;
+//     int64 created_at = 5;
+//     int64 delivered = 6;
+//     int64 failed = 7;
+//     int64 dropped = 8;
+//     int64 pending = 9;
+//   }
+//
+//   message WebhookDelivery {
+//     string cursor = 1;
+//     string type = 2;
+//     int64 at = 3;
+//     int32 attempts = 4;
+//     int32 status_code = 5;
+//     bool delivered = 6;
+//     string error = 7;
+//     int64 next_attempt = 8;
+//   }
+
+// WebhookInfo describes a webhook, with the counts of the events delivered,
+// failed after their last attempt, dropped while its queue was full and
+// queued.
+type WebhookInfo struct {
+	ID        string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	URL       string   `protobuf:"bytes,2,opt,name=url,proto3" json:"url,omitempty"`
+	Types     []string `protobuf:"bytes,3,rep,name=types,proto3" json:"types,omitempty"`
+	GroupPK   []byte   `protobuf:"bytes,4,opt,name=group_pk,json=groupPk,proto3" json:"group_pk,omitempty"`
+	CreatedAt int64    `protobuf:"varint,5,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	Delivered int64    `protobuf:"varint,6,opt,name=delivered,proto3" json:"delivered,omitempty"`
+	Failed    int64    `protobuf:"varint,7,opt,name=failed,proto3" json:"failed,omitempty"`
+	Dropped   int64    `protobuf:"varint,8,opt,name=dropped,proto3" json:"dropped,omitempty"`
+	Pending   int64    `protobuf:"varint,9,opt,name=pending,proto3" json:"pending,omitempty"`
+}
+
+func (m *WebhookInfo) Reset()         { *m = WebhookInfo{} }
+func (m *WebhookInfo) String() string { return proto.CompactTextString(m) }
+func (*WebhookInfo) ProtoMessage()    {}
+
+// WebhookDelivery is the status of the delivery of an event to a webhook,
+// NextAttempt is set while it is retried.
+type WebhookDelivery struct {
+	Cursor      string `protobuf:"bytes,1,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	Type        string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	At          int64  `protobuf:"varint,3,opt,name=at,proto3" json:"at,omitempty"`
+	Attempts    int32  `protobuf:"varint,4,opt,name=attempts,proto3" json:"attempts,omitempty"`
+	StatusCode  int32  `protobuf:"varint,5,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
+	Delivered   bool   `protobuf:"varint,6,opt,name=delivered,proto3" json:"delivered,omitempty"`
+	Error       string `protobuf:"bytes,7,opt,name=error,proto3" json:"error,omitempty"`
+	NextAttempt int64  `protobuf:"varint,8,opt,name=next_attempt,json=nextAttempt,proto3" json:"next_attempt,omitempty"`
+}
+
+func (m *WebhookDelivery) Reset()         { *m = WebhookDelivery{} }
+func (m *WebhookDelivery) String() string { return proto.CompactTextString(m) }
+func (*WebhookDelivery) ProtoMessage()    {}
+
+// WebhookRegister_Request registers a webhook, Types and GroupPK filter the
+// events pushed to it like the ones of EventStream. A secret is generated if
+// Secret is empty.
+type WebhookRegister_Request struct {
+	URL     string   `protobuf:"bytes,1,opt,name=url,proto3" json:"url,omitempty"`
+	Types   []string `protobuf:"bytes,2,rep,name=types,proto3" json:"types,omitempty"`
+	GroupPK []byte   `protobuf:"bytes,3,opt,name=group_pk,json=groupPk,proto3" json:"group_pk,omitempty"`
+	Secret  string   `protobuf:"bytes,4,opt,name=secret,proto3" json:"secret,omitempty"`
+}
+
+func (m *WebhookRegister_Request) Reset()         { *m = WebhookRegister_Request{} }
+func (m *WebhookRegister_Request) String() string { return proto.CompactTextString(m) }
+func (*WebhookRegister_Request) ProtoMessage()    {}
+
+type WebhookRegister_Reply struct {
+	Webhook *WebhookInfo `protobuf:"bytes,1,opt,name=webhook,proto3" json:"webhook,omitempty"`
+	// Secret is the HMAC key of the payloads, it can't be retrieved later
+	Secret string `protobuf:"bytes,2,opt,name=secret,proto3" json:"secret,omitempty"`
+}
+
+func (m *WebhookRegister_Reply) Reset()         { *m = WebhookRegister_Reply{} }
+func (m *WebhookRegister_Reply) String() string { return proto.CompactTextString(m) }
+func (*WebhookRegister_Reply) ProtoMessage()    {}
+
+type WebhookUnregister_Request struct {
+	ID string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (m *WebhookUnregister_Request) Reset()         { *m = WebhookUnregister_Request{} }
+func (m *WebhookUnregister_Request) String() string { return proto.CompactTextString(m) }
+func (*WebhookUnregister_Request) ProtoMessage()    {}
+
+type WebhookUnregister_Reply struct{}
+
+func (m *WebhookUnregister_Reply) Reset()         { *m = WebhookUnregister_Reply{} }
+func (m *WebhookUnregister_Reply) String() string { return proto.CompactTextString(m) }
+func (*WebhookUnregister_Reply) ProtoMessage()    {}
+
+type WebhookList_Request struct{}
+
+func (m *WebhookList_Request) Reset()         { *m = WebhookList_Request{} }
+func (m *WebhookList_Request) String() string { return proto.CompactTextString(m) }
+func (*WebhookList_Request) ProtoMessage()    {}
+
+type WebhookList_Reply struct {
+	Webhooks []*WebhookInfo `protobuf:"bytes,1,rep,name=webhooks,proto3" json:"webhooks,omitempty"`
+}
+
+func (m *WebhookList_Reply) Reset()         { *m = WebhookList_Reply{} }
+func (m *WebhookList_Reply) String() string { return proto.CompactTextString(m) }
+func (*WebhookList_Reply) ProtoMessage()    {}
+
+type WebhookDeliveries_Request struct {
+	ID string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (m *WebhookDeliveries_Request) Reset()         { *m = WebhookDeliveries_Request{} }
+func (m *WebhookDeliveries_Request) String() string { return proto.CompactTextString(m) }
+func (*WebhookDeliveries_Request) ProtoMessage()    {}
+
+type WebhookDeliveries_Reply struct {
+	Webhook *WebhookInfo `protobuf:"bytes,1,opt,name=webhook,proto3" json:"webhook,omitempty"`
+	// Deliveries are the last deliveries to the webhook, the latest first
+	Deliveries []*WebhookDelivery `protobuf:"bytes,2,rep,name=deliveries,proto3" json:"deliveries,omitempty"`
+}
+
+func (m *WebhookDeliveries_Reply) Reset()         { *m = WebhookDeliveries_Reply{} }
+func (m *WebhookDeliveries_Reply) String() string { return proto.CompactTextString(m) }
+func (*WebhookDeliveries_Reply) ProtoMessage()    {}
+
+// WebhookServiceClient is the client API for WebhookService service.
+type WebhookServiceClient interface {
+	WebhookRegister(ctx context.Context, in *WebhookRegister_Request, opts ...grpc.CallOption) (*WebhookRegister_Reply, error)
+	WebhookUnregister(ctx context.Context, in *WebhookUnregister_Request, opts ...grpc.CallOption) (*WebhookUnregister_Reply, error)
+	WebhookList(ctx context.Context, in *WebhookList_Request, opts ...grpc.CallOption) (*WebhookList_Reply, error)
+	WebhookDeliveries(ctx context.Context, in *WebhookDeliveries_Request, opts ...grpc.CallOption) (*WebhookDeliveries_Reply, error)
+}
+
+type webhookServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewWebhookServiceClient(cc *grpc.ClientConn) WebhookServiceClient {
+	return &webhookServiceClient{cc}
+}
+
+func (c *webhookServiceClient) WebhookRegister(ctx context.Context, in *WebhookRegister_Request, opts ...grpc.CallOption) (*WebhookRegister_Reply, error) {
+	out := new(WebhookRegister_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.WebhookService/WebhookRegister", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *webhookServiceClient) WebhookUnregister(ctx context.Context, in *WebhookUnregister_Request, opts ...grpc.CallOption) (*WebhookUnregister_Reply, error) {
+	out := new(WebhookUnregister_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.WebhookService/WebhookUnregister", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *webhookServiceClient) WebhookList(ctx context.Context, in *WebhookList_Request, opts ...grpc.CallOption) (*WebhookList_Reply, error) {
+	out := new(WebhookList_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.WebhookService/WebhookList", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *webhookServiceClient) WebhookDeliveries(ctx context.Context, in *WebhookDeliveries_Request, opts ...grpc.CallOption) (*WebhookDeliveries_Reply, error) {
+	out := new(WebhookDeliveries_Reply)
+	err := c.cc.Invoke(ctx, "/berty.protocol.v1.WebhookService/WebhookDeliveries", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WebhookServiceServer is the server API for WebhookService service.
+type WebhookServiceServer interface {
+	// WebhookRegister registers a webhook, the next events are pushed to it
+	WebhookRegister(context.Context, *WebhookRegister_Request) (*WebhookRegister_Reply, error)
+	// WebhookUnregister stops pushing the events to a webhook, its queued
+	// events are dropped
+	WebhookUnregister(context.Context, *WebhookUnregister_Request) (*WebhookUnregister_Reply, error)
+	// WebhookList returns the registered webhooks
+	WebhookList(context.Context, *WebhookList_Request) (*WebhookList_Reply, error)
+	// WebhookDeliveries returns the status of the last deliveries to a
+	// webhook
+	WebhookDeliveries(context.Context, *WebhookDeliveries_Request) (*WebhookDeliveries_Reply, error)
+}
+
+func RegisterWebhookServiceServer(s *grpc.Server, srv WebhookServiceServer) {
+	s.RegisterService(&_WebhookService_serviceDesc, srv)
+}
+
+func _WebhookService_WebhookRegister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WebhookRegister_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WebhookServiceServer).WebhookRegister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.WebhookService/WebhookRegister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WebhookServiceServer).WebhookRegister(ctx, req.(*WebhookRegister_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WebhookService_WebhookUnregister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WebhookUnregister_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WebhookServiceServer).WebhookUnregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.WebhookService/WebhookUnregister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WebhookServiceServer).WebhookUnregister(ctx, req.(*WebhookUnregister_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WebhookService_WebhookList_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WebhookList_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WebhookServiceServer).WebhookList(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.WebhookService/WebhookList",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WebhookServiceServer).WebhookList(ctx, req.(*WebhookList_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WebhookService_WebhookDeliveries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WebhookDeliveries_Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WebhookServiceServer).WebhookDeliveries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/berty.protocol.v1.WebhookService/WebhookDeliveries",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WebhookServiceServer).WebhookDeliveries(ctx, req.(*WebhookDeliveries_Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _WebhookService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "berty.protocol.v1.WebhookService",
+	HandlerType: (*WebhookServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "WebhookRegister",
+			Handler:    _WebhookService_WebhookRegister_Handler,
+		},
+		{
+			MethodName: "WebhookUnregister",
+			Handler:    _WebhookService_WebhookUnregister_Handler,
+		},
+		{
+			MethodName: "WebhookList",
+			Handler:    _WebhookService_WebhookList_Handler,
+		},
+		{
+			MethodName: "WebhookDeliveries",
+			Handler:    _WebhookService_WebhookDeliveries_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
@@ -0,0 +1,525 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+)
+
+// The headers of the requests pushing the events to the webhooks.
+const (
+	// WebhookSignatureHeader is the HMAC-SHA256 of the body keyed by the
+	// secret of the webhook, as "sha256=<hex>", see SignWebhookPayload
+	WebhookSignatureHeader = "X-Berty-Signature"
+	WebhookEventHeader     = "X-Berty-Event"
+	WebhookDeliveryHeader  = "X-Berty-Delivery"
+)
+
+const (
+	// webhookQueueSize is the number of events a webhook can lag behind,
+	// the next ones are dropped
+	webhookQueueSize = 256
+
+	// webhookDeliveriesKept is the number of deliveries kept by webhook to
+	// be inspected
+	webhookDeliveriesKept = 32
+
+	webhookMaxAttempts = 8
+	webhookMinBackoff  = time.Second
+	webhookMaxBackoff  = 10 * time.Minute
+	webhookTimeout     = 10 * time.Second
+)
+
+var nodeEventTypes = map[string]bool{
+	NodeEventMessageReceived:     true,
+	NodeEventMessageDelivery:     true,
+	NodeEventContactRequest:      true,
+	NodeEventConversationChanged: true,
+	NodeEventPeerConnected:       true,
+	NodeEventPeerDisconnected:    true,
+	NodeEventTransportState:      true,
+	NodeEventNetworkActivity:     true,
+	NodeEventStartup:             true,
+
+	NodeEventContactRequestQuarantined: true,
+	NodeEventSecurity:                  true,
+}
+
+// SignWebhookPayload returns the value of the WebhookSignatureHeader of a
+// body, the webhooks should compare it to the received one in constant time.
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPayload is the body pushed to the webhooks, a NodeEvent with its
+// JSON payload inlined.
+type webhookPayload struct {
+	Cursor  string          `json:"cursor"`
+	Type    string          `json:"type"`
+	At      int64           `json:"at"`
+	GroupPK []byte          `json:"group_pk,omitempty"`
+	PeerID  string          `json:"peer_id,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	Types     []string  `json:"types,omitempty"`
+	GroupPK   []byte    `json:"group_pk,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type webhookState struct {
+	hook   *webhook
+	filter *nodeEventsSubscriber
+	queue  chan *NodeEvent
+	cancel context.CancelFunc
+
+	// guarded by the lock of the dispatcher
+	deliveries []*WebhookDelivery
+	delivered  int64
+	failed     int64
+	dropped    int64
+}
+
+// webhookDispatcher pushes the node events to the registered webhooks, each
+// one has its queue so a slow webhook doesn't delay the others. A failed
+// delivery is retried with an exponential backoff, while the events after it
+// wait in the queue.
+//
+// The webhooks are persisted, the events aren't: the queued ones are lost
+// when the node stops.
+type webhookDispatcher struct {
+	logger *zap.Logger
+	store  datastore.Batching
+	events *nodeEvents
+	client *http.Client
+
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	lock  sync.Mutex
+	ctx   context.Context
+	hooks map[string]*webhookState
+}
+
+func newWebhookDispatcher(logger *zap.Logger, store datastore.Batching, events *nodeEvents) (*webhookDispatcher, error) {
+	wd := &webhookDispatcher{
+		logger:      logger,
+		store:       store,
+		events:      events,
+		client:      &http.Client{Timeout: webhookTimeout},
+		maxAttempts: webhookMaxAttempts,
+		minBackoff:  webhookMinBackoff,
+		maxBackoff:  webhookMaxBackoff,
+		hooks:       make(map[string]*webhookState),
+	}
+
+	res, err := store.Query(query.Query{})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	for _, e := range entries {
+		hook := &webhook{}
+		if err := json.Unmarshal(e.Value, hook); err != nil {
+			logger.Warn("invalid webhook", zap.String("key", e.Key), zap.Error(err))
+			continue
+		}
+
+		wd.hooks[hook.ID] = newWebhookState(hook)
+	}
+
+	return wd, nil
+}
+
+func newWebhookState(hook *webhook) *webhookState {
+	filter := &nodeEventsSubscriber{
+		types:   make(map[string]struct{}, len(hook.Types)),
+		groupPK: hook.GroupPK,
+	}
+
+	for _, t := range hook.Types {
+		filter.types[t] = struct{}{}
+	}
+
+	return &webhookState{
+		hook:   hook,
+		filter: filter,
+		queue:  make(chan *NodeEvent, webhookQueueSize),
+	}
+}
+
+// start dispatches the events until the context is done.
+func (wd *webhookDispatcher) start(ctx context.Context) {
+	wd.lock.Lock()
+	wd.ctx = ctx
+	for _, st := range wd.hooks {
+		wd.startWorkerLocked(st)
+	}
+	wd.lock.Unlock()
+
+	go wd.run(ctx)
+}
+
+func (wd *webhookDispatcher) startWorkerLocked(st *webhookState) {
+	ctx, cancel := context.WithCancel(wd.ctx)
+	st.cancel = cancel
+
+	go func() {
+		for {
+			select {
+			case e := <-st.queue:
+				wd.deliver(ctx, st, e)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// run forwards the events to the queues of the webhooks, its subscription is
+// resumed from the last event if it lagged behind.
+func (wd *webhookDispatcher) run(ctx context.Context) {
+	cursor := ""
+
+	for {
+		replay, sub, err := wd.events.subscribe(&EventStreamRequest{Cursor: cursor})
+		if err != nil {
+			wd.logger.Warn("node events missed by the webhooks", zap.Error(err))
+			if replay, sub, err = wd.events.subscribe(&EventStreamRequest{}); err != nil {
+				return
+			}
+		}
+
+		for _, e := range replay {
+			wd.dispatch(e)
+			cursor = e.Cursor
+		}
+
+	forward:
+		for {
+			select {
+			case e, ok := <-sub.ch:
+				if !ok {
+					break forward
+				}
+
+				wd.dispatch(e)
+				cursor = e.Cursor
+
+			case <-ctx.Done():
+				wd.events.unsubscribe(sub)
+				return
+			}
+		}
+	}
+}
+
+func (wd *webhookDispatcher) dispatch(e *NodeEvent) {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+
+	for _, st := range wd.hooks {
+		if !st.filter.match(e) {
+			continue
+		}
+
+		select {
+		case st.queue <- e:
+		default:
+			st.dropped++
+			wd.logger.Debug("webhook event dropped", zap.String("webhook", st.hook.ID), zap.String("cursor", e.Cursor))
+		}
+	}
+}
+
+// retryableStatus returns whether a delivery answered with a status code is
+// retried, 0 if the request failed.
+func retryableStatus(code int) bool {
+	return code == 0 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+func (wd *webhookDispatcher) deliver(ctx context.Context, st *webhookState, e *NodeEvent) {
+	body, err := json.Marshal(&webhookPayload{
+		Cursor:  e.Cursor,
+		Type:    e.Type,
+		At:      e.At,
+		GroupPK: e.GroupPK,
+		PeerID:  e.PeerID,
+		Payload: e.Payload,
+	})
+	if err != nil {
+		wd.logger.Warn("unable to serialize webhook payload", zap.Error(err))
+		return
+	}
+
+	d := &WebhookDelivery{Cursor: e.Cursor, Type: e.Type, At: time.Now().UnixNano()}
+
+	wd.lock.Lock()
+	st.deliveries = append(st.deliveries, d)
+	if len(st.deliveries) > webhookDeliveriesKept {
+		st.deliveries = st.deliveries[len(st.deliveries)-webhookDeliveriesKept:]
+	}
+	wd.lock.Unlock()
+
+	backoff := wd.minBackoff
+	for attempt := 1; ; attempt++ {
+		code, err := wd.post(ctx, st.hook, e, body)
+		retry := err != nil && retryableStatus(code) && attempt < wd.maxAttempts
+
+		wd.lock.Lock()
+		d.Attempts, d.StatusCode, d.NextAttempt = int32(attempt), int32(code), 0
+		switch {
+		case err == nil:
+			d.Delivered, d.Error = true, ""
+			st.delivered++
+		case retry:
+			d.Error = err.Error()
+			d.NextAttempt = time.Now().Add(backoff).UnixNano()
+		default:
+			d.Error = err.Error()
+			st.failed++
+		}
+		wd.lock.Unlock()
+
+		if !retry {
+			if err != nil {
+				wd.logger.Warn("webhook delivery failed", zap.String("webhook", st.hook.ID), zap.String("cursor", e.Cursor), zap.Error(err))
+			}
+
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff *= 2; backoff > wd.maxBackoff {
+			backoff = wd.maxBackoff
+		}
+	}
+}
+
+// post pushes an event to a webhook, it returns the status code of the
+// response, 0 if the request failed.
+func (wd *webhookDispatcher) post(ctx context.Context, hook *webhook, e *NodeEvent, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, e.Type)
+	req.Header.Set(WebhookDeliveryHeader, e.Cursor)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(hook.Secret, body))
+
+	res, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	// the connection is reused once the body is read
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+// register registers a webhook, it returns its description and its secret.
+func (wd *webhookDispatcher) register(rawURL string, types []string, groupPK []byte, secret string) (*WebhookInfo, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid webhook URL %q", rawURL))
+	}
+
+	for _, t := range types {
+		if !nodeEventTypes[t] {
+			return nil, "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown event type %q", t))
+		}
+	}
+
+	id := make([]byte, 8)
+	if _, err := crand.Read(id); err != nil {
+		return nil, "", errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	if secret == "" {
+		raw := make([]byte, 32)
+		if _, err := crand.Read(raw); err != nil {
+			return nil, "", errcode.ErrCryptoRandomGeneration.Wrap(err)
+		}
+
+		secret = hex.EncodeToString(raw)
+	}
+
+	hook := &webhook{
+		ID:        hex.EncodeToString(id),
+		URL:       u.String(),
+		Secret:    secret,
+		Types:     types,
+		GroupPK:   groupPK,
+		CreatedAt: time.Now(),
+	}
+
+	data, err := json.Marshal(hook)
+	if err != nil {
+		return nil, "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := wd.store.Put(datastore.NewKey(hook.ID), data); err != nil {
+		return nil, "", errcode.ErrInternal.Wrap(err)
+	}
+
+	st := newWebhookState(hook)
+
+	wd.lock.Lock()
+	wd.hooks[hook.ID] = st
+	if wd.ctx != nil {
+		wd.startWorkerLocked(st)
+	}
+	info := wd.infoLocked(st)
+	wd.lock.Unlock()
+
+	wd.logger.Info("webhook registered", zap.String("webhook", hook.ID), zap.String("url", hook.URL))
+
+	return info, hook.Secret, nil
+}
+
+func (wd *webhookDispatcher) unregister(id string) error {
+	wd.lock.Lock()
+	st, ok := wd.hooks[id]
+	delete(wd.hooks, id)
+	wd.lock.Unlock()
+
+	if !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown webhook %q", id))
+	}
+
+	if st.cancel != nil {
+		st.cancel()
+	}
+
+	if err := wd.store.Delete(datastore.NewKey(id)); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	wd.logger.Info("webhook unregistered", zap.String("webhook", id))
+
+	return nil
+}
+
+func (wd *webhookDispatcher) infoLocked(st *webhookState) *WebhookInfo {
+	return &WebhookInfo{
+		ID:        st.hook.ID,
+		URL:       st.hook.URL,
+		Types:     st.hook.Types,
+		GroupPK:   st.hook.GroupPK,
+		CreatedAt: st.hook.CreatedAt.UnixNano(),
+		Delivered: st.delivered,
+		Failed:    st.failed,
+		Dropped:   st.dropped,
+		Pending:   int64(len(st.queue)),
+	}
+}
+
+func (wd *webhookDispatcher) list() []*WebhookInfo {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+
+	hooks := make([]*WebhookInfo, 0, len(wd.hooks))
+	for _, st := range wd.hooks {
+		hooks = append(hooks, wd.infoLocked(st))
+	}
+
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt < hooks[j].CreatedAt })
+
+	return hooks
+}
+
+func (wd *webhookDispatcher) deliveries(id string) (*WebhookInfo, []*WebhookDelivery, error) {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+
+	st, ok := wd.hooks[id]
+	if !ok {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown webhook %q", id))
+	}
+
+	deliveries := make([]*WebhookDelivery, len(st.deliveries))
+	for i, d := range st.deliveries {
+		c := *d
+		deliveries[len(deliveries)-1-i] = &c
+	}
+
+	return wd.infoLocked(st), deliveries, nil
+}
+
+// WebhookRegister registers a webhook, the events matching its filters are
+// pushed to it from now on.
+func (s *service) WebhookRegister(_ context.Context, req *WebhookRegister_Request) (*WebhookRegister_Reply, error) {
+	info, secret, err := s.webhooks.register(req.URL, req.Types, req.GroupPK, req.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookRegister_Reply{Webhook: info, Secret: secret}, nil
+}
+
+func (s *service) WebhookUnregister(_ context.Context, req *WebhookUnregister_Request) (*WebhookUnregister_Reply, error) {
+	if err := s.webhooks.unregister(req.ID); err != nil {
+		return nil, err
+	}
+
+	return &WebhookUnregister_Reply{}, nil
+}
+
+func (s *service) WebhookList(context.Context, *WebhookList_Request) (*WebhookList_Reply, error) {
+	return &WebhookList_Reply{Webhooks: s.webhooks.list()}, nil
+}
+
+func (s *service) WebhookDeliveries(_ context.Context, req *WebhookDeliveries_Request) (*WebhookDeliveries_Reply, error) {
+	info, deliveries, err := s.webhooks.deliveries(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookDeliveries_Reply{Webhook: info, Deliveries: deliveries}, nil
+}
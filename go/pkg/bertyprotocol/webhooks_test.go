@@ -0,0 +1,102 @@
+package bertyprotocol
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type received struct {
+		signature string
+		event     string
+		payload   webhookPayload
+		valid     bool
+	}
+
+	var calls int32
+	bodies := make(chan received, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first delivery fails, it is retried
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		rec := received{signature: r.Header.Get(WebhookSignatureHeader), event: r.Header.Get(WebhookEventHeader)}
+		rec.valid = rec.signature == SignWebhookPayload("secret", body)
+		assert.NoError(t, json.Unmarshal(body, &rec.payload))
+		bodies <- rec
+	}))
+	defer srv.Close()
+
+	store := ds_sync.MutexWrap(datastore.NewMapDatastore())
+	events := newNodeEvents(zap.NewNop())
+
+	wd, err := newWebhookDispatcher(zap.NewNop(), store, events)
+	require.NoError(t, err)
+	wd.minBackoff = 10 * time.Millisecond
+	wd.start(ctx)
+
+	_, _, err = wd.register("ftp://example.com", nil, nil, "")
+	assert.Error(t, err)
+	_, _, err = wd.register(srv.URL, []string{"unknown"}, nil, "")
+	assert.Error(t, err)
+
+	info, secret, err := wd.register(srv.URL, []string{NodeEventMessageReceived}, []byte("group"), "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", secret)
+
+	// only the events matching the filters are pushed
+	events.publish(NodeEventTransportState, nil, "", &TransportStateEvent{Connectivity: "wifi"})
+	events.publish(NodeEventMessageReceived, []byte("other"), "", &MessageReceivedEvent{Message: []byte("other")})
+	events.publish(NodeEventMessageReceived, []byte("group"), "", &MessageReceivedEvent{Message: []byte("hello")})
+
+	select {
+	case rec := <-bodies:
+		assert.True(t, rec.valid)
+		assert.Equal(t, NodeEventMessageReceived, rec.event)
+		assert.Equal(t, []byte("group"), rec.payload.GroupPK)
+		assert.JSONEq(t, `{"message_id":null,"device_pk":null,"message":"aGVsbG8="}`, string(rec.payload.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+
+	require.Eventually(t, func() bool {
+		_, deliveries, err := wd.deliveries(info.ID)
+		return err == nil && len(deliveries) == 1 && deliveries[0].Delivered
+	}, 5*time.Second, 10*time.Millisecond)
+
+	got, deliveries, err := wd.deliveries(info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), got.Delivered)
+	assert.Equal(t, int32(2), deliveries[0].Attempts)
+	assert.Equal(t, int32(http.StatusOK), deliveries[0].StatusCode)
+
+	// the webhooks are persisted
+	reloaded, err := newWebhookDispatcher(zap.NewNop(), store, events)
+	require.NoError(t, err)
+	require.Len(t, reloaded.list(), 1)
+	assert.Equal(t, srv.URL, reloaded.list()[0].URL)
+
+	require.NoError(t, wd.unregister(info.ID))
+	assert.Empty(t, wd.list())
+	assert.Error(t, wd.unregister(info.ID))
+}
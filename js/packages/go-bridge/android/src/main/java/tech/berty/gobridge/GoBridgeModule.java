@@ -110,6 +110,11 @@ public class GoBridgeModule extends ReactContextBaseJavaModule {
             config.logLevel(optLog);
             config.loggerDriver(logger);
 
+            // wrap the device keys with the Android Keystore
+            if (KeystoreDriver.isSupported()) {
+                config.keystoreDriver(new KeystoreDriver("tech.berty.keystore"));
+            }
+
             // configure grpc listener
             for (String listener: optsGrpcListeners) {
                 config.addGRPCListener(listener);
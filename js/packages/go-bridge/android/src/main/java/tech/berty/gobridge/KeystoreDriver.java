@@ -0,0 +1,121 @@
+package tech.berty.gobridge;
+
+import android.annotation.TargetApi;
+import android.os.Build;
+import android.security.keystore.KeyGenParameterSpec;
+import android.security.keystore.KeyInfo;
+import android.security.keystore.KeyProperties;
+import android.security.keystore.StrongBoxUnavailableException;
+
+import java.nio.ByteBuffer;
+import java.security.KeyStore;
+
+import javax.crypto.Cipher;
+import javax.crypto.KeyGenerator;
+import javax.crypto.SecretKey;
+import javax.crypto.SecretKeyFactory;
+import javax.crypto.spec.GCMParameterSpec;
+
+import bertybridge.NativeKeystoreDriver;
+
+// KeystoreDriver wraps the device keys with an AES key of the Android
+// Keystore, backed by the StrongBox or the TEE when the device has one.
+@TargetApi(Build.VERSION_CODES.M)
+public class KeystoreDriver implements NativeKeystoreDriver {
+    private static final String PROVIDER = "AndroidKeyStore";
+    private static final String TRANSFORMATION = "AES/GCM/NoPadding";
+    private static final int TAG_LENGTH = 128;
+
+    private final String alias;
+    private SecretKey key;
+
+    public KeystoreDriver(String alias) {
+        this.alias = alias;
+    }
+
+    // isSupported reports whether the Android Keystore holds AES keys on
+    // this device
+    public static boolean isSupported() {
+        return Build.VERSION.SDK_INT >= Build.VERSION_CODES.M;
+    }
+
+    private synchronized SecretKey getKey() throws Exception {
+        if (this.key != null) {
+            return this.key;
+        }
+
+        KeyStore keyStore = KeyStore.getInstance(PROVIDER);
+        keyStore.load(null);
+
+        if (keyStore.containsAlias(this.alias)) {
+            this.key = (SecretKey) keyStore.getKey(this.alias, null);
+            return this.key;
+        }
+
+        if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.P) {
+            try {
+                this.key = this.generateKey(true);
+                return this.key;
+            } catch (StrongBoxUnavailableException e) {
+                // fallback on the TEE
+            }
+        }
+
+        this.key = this.generateKey(false);
+        return this.key;
+    }
+
+    private SecretKey generateKey(boolean strongBox) throws Exception {
+        KeyGenParameterSpec.Builder builder = new KeyGenParameterSpec.Builder(this.alias,
+            KeyProperties.PURPOSE_ENCRYPT | KeyProperties.PURPOSE_DECRYPT)
+            .setBlockModes(KeyProperties.BLOCK_MODE_GCM)
+            .setEncryptionPaddings(KeyProperties.ENCRYPTION_PADDING_NONE)
+            .setKeySize(256);
+
+        if (strongBox && Build.VERSION.SDK_INT >= Build.VERSION_CODES.P) {
+            builder.setIsStrongBoxBacked(true);
+        }
+
+        KeyGenerator generator = KeyGenerator.getInstance(KeyProperties.KEY_ALGORITHM_AES, PROVIDER);
+        generator.init(builder.build());
+        return generator.generateKey();
+    }
+
+    // wrap returns the IV followed by the sealed data
+    public byte[] wrap(byte[] data) throws Exception {
+        Cipher cipher = Cipher.getInstance(TRANSFORMATION);
+        cipher.init(Cipher.ENCRYPT_MODE, this.getKey());
+
+        byte[] iv = cipher.getIV();
+        byte[] sealed = cipher.doFinal(data);
+
+        return ByteBuffer.allocate(1 + iv.length + sealed.length)
+            .put((byte) iv.length)
+            .put(iv)
+            .put(sealed)
+            .array();
+    }
+
+    public byte[] unwrap(byte[] data) throws Exception {
+        if (data == null || data.length < 1 || data.length < 1 + data[0]) {
+            throw new Exception("invalid wrapped key");
+        }
+
+        int ivLength = data[0];
+        Cipher cipher = Cipher.getInstance(TRANSFORMATION);
+        cipher.init(Cipher.DECRYPT_MODE, this.getKey(), new GCMParameterSpec(TAG_LENGTH, data, 1, ivLength));
+
+        return cipher.doFinal(data, 1 + ivLength, data.length - 1 - ivLength);
+    }
+
+    public boolean hardware() {
+        try {
+            SecretKey key = this.getKey();
+            SecretKeyFactory factory = SecretKeyFactory.getInstance(key.getAlgorithm(), PROVIDER);
+            KeyInfo info = (KeyInfo) factory.getKeySpec(key, KeyInfo.class);
+            return info.isInsideSecureHardware();
+        } catch (Exception e) {
+            return false;
+        }
+    }
+}
@@ -107,6 +107,11 @@ class GoBridge: NSObject {
             config.logLevel(optLog)
             config.loggerDriver(logger)
 
+            // wrap the device keys with the Secure Enclave
+            if #available(iOS 10.0, *) {
+                config.keystoreDriver(KeystoreDriver("tech.berty.keystore"))
+            }
+
             // configure grpc listener
             for obj in optGrpcListeners {
                 guard let listener = obj as? String else {
@@ -0,0 +1,139 @@
+//
+//  KeystoreDriver.swift
+//  Berty
+//
+
+import Foundation
+import Security
+import Bertybridge
+
+enum KeystoreError: Error {
+  case emptyData
+  case keyGeneration(String)
+  case unsupported
+  case crypto(String)
+}
+
+// KeystoreDriver wraps the device keys with a P-256 key of the Secure
+// Enclave, or of the keychain on the devices without one.
+@available(iOS 10.0, *)
+class KeystoreDriver: NSObject, BertybridgeNativeKeystoreDriverProtocol {
+  let tag: Data
+  let algorithm = SecKeyAlgorithm.eciesEncryptionCofactorVariableIVX963SHA256AESGCM
+
+  var privateKey: SecKey?
+  var isHardware = false
+
+  init(_ tag: String) {
+    self.tag = tag.data(using: .utf8)!
+  }
+
+  static func secureEnclaveAvailable() -> Bool {
+    #if targetEnvironment(simulator)
+      return false
+    #else
+      return true
+    #endif
+  }
+
+  func getKey() throws -> SecKey {
+    if let key = self.privateKey {
+      return key
+    }
+
+    let query: [String: Any] = [
+      kSecClass as String: kSecClassKey,
+      kSecAttrApplicationTag as String: self.tag,
+      kSecAttrKeyType as String: kSecAttrKeyTypeECSECPrimeRandom,
+      kSecReturnRef as String: true,
+      kSecReturnAttributes as String: true,
+    ]
+
+    var item: CFTypeRef?
+    if SecItemCopyMatching(query as CFDictionary, &item) == errSecSuccess, let attributes = item as? [String: Any] {
+      // swiftlint:disable:next force_cast
+      let key = attributes[kSecValueRef as String] as! SecKey
+      self.isHardware = (attributes[kSecAttrTokenID as String] as? String) == (kSecAttrTokenIDSecureEnclave as String)
+      self.privateKey = key
+      return key
+    }
+
+    if KeystoreDriver.secureEnclaveAvailable(), let key = try? self.generateKey(secureEnclave: true) {
+      self.isHardware = true
+      self.privateKey = key
+      return key
+    }
+
+    let key = try self.generateKey(secureEnclave: false)
+    self.isHardware = false
+    self.privateKey = key
+    return key
+  }
+
+  func generateKey(secureEnclave: Bool) throws -> SecKey {
+    var error: Unmanaged<CFError>?
+    guard let access = SecAccessControlCreateWithFlags(kCFAllocatorDefault, kSecAttrAccessibleAfterFirstUnlockThisDeviceOnly, secureEnclave ? .privateKeyUsage : [], &error) else {
+      throw KeystoreError.keyGeneration(error.debugDescription)
+    }
+
+    var attributes: [String: Any] = [
+      kSecAttrKeyType as String: kSecAttrKeyTypeECSECPrimeRandom,
+      kSecAttrKeySizeInBits as String: 256,
+      kSecPrivateKeyAttrs as String: [
+        kSecAttrIsPermanent as String: true,
+        kSecAttrApplicationTag as String: self.tag,
+        kSecAttrAccessControl as String: access,
+      ],
+    ]
+
+    if secureEnclave {
+      attributes[kSecAttrTokenID as String] = kSecAttrTokenIDSecureEnclave
+    }
+
+    guard let key = SecKeyCreateRandomKey(attributes as CFDictionary, &error) else {
+      throw KeystoreError.keyGeneration(error.debugDescription)
+    }
+
+    return key
+  }
+
+  func wrap(_ data: Data?) throws -> Data {
+    guard let data = data else {
+      throw KeystoreError.emptyData
+    }
+
+    guard let publicKey = SecKeyCopyPublicKey(try self.getKey()), SecKeyIsAlgorithmSupported(publicKey, .encrypt, self.algorithm) else {
+      throw KeystoreError.unsupported
+    }
+
+    var error: Unmanaged<CFError>?
+    guard let sealed = SecKeyCreateEncryptedData(publicKey, self.algorithm, data as CFData, &error) else {
+      throw KeystoreError.crypto(error.debugDescription)
+    }
+
+    return sealed as Data
+  }
+
+  func unwrap(_ data: Data?) throws -> Data {
+    guard let data = data else {
+      throw KeystoreError.emptyData
+    }
+
+    let key = try self.getKey()
+    guard SecKeyIsAlgorithmSupported(key, .decrypt, self.algorithm) else {
+      throw KeystoreError.unsupported
+    }
+
+    var error: Unmanaged<CFError>?
+    guard let plaintext = SecKeyCreateDecryptedData(key, self.algorithm, data as CFData, &error) else {
+      throw KeystoreError.crypto(error.debugDescription)
+    }
+
+    return plaintext as Data
+  }
+
+  func hardware() -> Bool {
+    _ = try? self.getKey()
+    return self.isHardware
+  }
+}